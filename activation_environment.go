@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	devMapperControlPath = "/dev/mapper/control"
+	procSelfUIDMapPath   = "/proc/self/uid_map"
+)
+
+// ActivationEnvironment describes whether the current process is able to
+// activate volumes directly, as returned from DetectActivationEnvironment.
+type ActivationEnvironment struct {
+	// InUserNamespace indicates that the current process is running in a
+	// user namespace other than the initial one, which is normally the case
+	// inside an unprivileged container. Device-mapper operations are
+	// generally not permitted from these, even for the root user in the
+	// namespace.
+	InUserNamespace bool
+
+	// DeviceMapperAvailable indicates that the device-mapper control device
+	// can be opened for reading and writing.
+	DeviceMapperAvailable bool
+
+	// SystemdCryptsetup indicates whether the systemd-cryptsetup binary is
+	// available.
+	SystemdCryptsetup bool
+}
+
+// CanActivateDirectly indicates whether the default ActivationExecutor is
+// expected to work. If it isn't, an ActivationExecutor that delegates
+// activation to a privileged helper in the host (see
+// NewActivationHelperExecutor) should be configured with
+// SetActivationExecutor.
+func (e *ActivationEnvironment) CanActivateDirectly() bool {
+	return !e.InUserNamespace && e.DeviceMapperAvailable && e.SystemdCryptsetup
+}
+
+func inUserNamespace() (bool, error) {
+	f, err := os.Open(procSelfUIDMapPath)
+	switch {
+	case os.IsNotExist(err):
+		// The kernel doesn't support user namespaces.
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	defer f.Close()
+
+	// The initial user namespace maps the entire range of user IDs.
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.Join(strings.Fields(scanner.Text()), " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return len(lines) != 1 || lines[0] != "0 0 4294967295", nil
+}
+
+// DetectActivationEnvironment determines whether the current process is able
+// to activate volumes directly, which may not be the case when running inside
+// a container.
+func DetectActivationEnvironment() (*ActivationEnvironment, error) {
+	userns, err := inUserNamespace()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine user namespace: %w", err)
+	}
+
+	dmAvailable := false
+	if f, err := os.OpenFile(devMapperControlPath, os.O_RDWR, 0); err == nil {
+		f.Close()
+		dmAvailable = true
+	}
+
+	return &ActivationEnvironment{
+		InUserNamespace:       userns,
+		DeviceMapperAvailable: dmAvailable,
+		SystemdCryptsetup:     luks2SystemdCryptsetupAvailable()}, nil
+}
@@ -0,0 +1,109 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type activationEnvironmentSuite struct {
+	snapd_testutil.BaseTest
+
+	dir string
+}
+
+func (s *activationEnvironmentSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.dir = c.MkDir()
+}
+
+var _ = Suite(&activationEnvironmentSuite{})
+
+func (s *activationEnvironmentSuite) mockEnvironment(c *C, dmControl bool, uidMap string, systemdCryptsetup bool) {
+	dmControlPath := filepath.Join(s.dir, "control")
+	if dmControl {
+		c.Assert(ioutil.WriteFile(dmControlPath, nil, 0600), IsNil)
+	}
+
+	uidMapPath := filepath.Join(s.dir, "uid_map")
+	if uidMap != "" {
+		c.Assert(ioutil.WriteFile(uidMapPath, []byte(uidMap), 0644), IsNil)
+	}
+
+	s.AddCleanup(MockActivationEnvironmentPaths(dmControlPath, uidMapPath))
+	s.AddCleanup(MockLUKS2ToolsAvailable(true, systemdCryptsetup))
+}
+
+func (s *activationEnvironmentSuite) TestDetectHost(c *C) {
+	s.mockEnvironment(c, true, "         0          0 4294967295\n", true)
+
+	env, err := DetectActivationEnvironment()
+	c.Assert(err, IsNil)
+	c.Check(env, DeepEquals, &ActivationEnvironment{
+		InUserNamespace:       false,
+		DeviceMapperAvailable: true,
+		SystemdCryptsetup:     true})
+	c.Check(env.CanActivateDirectly(), Equals, true)
+}
+
+func (s *activationEnvironmentSuite) TestDetectNoUserNamespaceSupport(c *C) {
+	s.mockEnvironment(c, true, "", true)
+
+	env, err := DetectActivationEnvironment()
+	c.Assert(err, IsNil)
+	c.Check(env.InUserNamespace, Equals, false)
+	c.Check(env.CanActivateDirectly(), Equals, true)
+}
+
+func (s *activationEnvironmentSuite) TestDetectUserNamespace(c *C) {
+	s.mockEnvironment(c, true, "         0     100000      65536\n", true)
+
+	env, err := DetectActivationEnvironment()
+	c.Assert(err, IsNil)
+	c.Check(env, DeepEquals, &ActivationEnvironment{
+		InUserNamespace:       true,
+		DeviceMapperAvailable: true,
+		SystemdCryptsetup:     true})
+	c.Check(env.CanActivateDirectly(), Equals, false)
+}
+
+func (s *activationEnvironmentSuite) TestDetectNoDeviceMapper(c *C) {
+	s.mockEnvironment(c, false, "0 0 4294967295\n", true)
+
+	env, err := DetectActivationEnvironment()
+	c.Assert(err, IsNil)
+	c.Check(env.DeviceMapperAvailable, Equals, false)
+	c.Check(env.CanActivateDirectly(), Equals, false)
+}
+
+func (s *activationEnvironmentSuite) TestDetectNoSystemdCryptsetup(c *C) {
+	s.mockEnvironment(c, true, "0 0 4294967295\n", false)
+
+	env, err := DetectActivationEnvironment()
+	c.Assert(err, IsNil)
+	c.Check(env.SystemdCryptsetup, Equals, false)
+	c.Check(env.CanActivateDirectly(), Equals, false)
+}
@@ -0,0 +1,132 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+// AnyKeyslot can be supplied to ActivationExecutor.ActivateVolume to indicate
+// that any keyslot can be used to unlock the container.
+const AnyKeyslot = luks2.AnySlot
+
+var (
+	activationExecutorMu sync.Mutex
+	activationExecutor   ActivationExecutor
+)
+
+// ActivationExecutor performs the final step of activating a volume with a key
+// that has been recovered by one of the ActivateVolumeWith* family of functions.
+// This allows the mechanism used to unlock a LUKS2 container and create the
+// device mapping to be changed whilst keeping secboot's key recovery logic.
+type ActivationExecutor interface {
+	// ActivateVolume unlocks the LUKS2 container at sourceDevicePath with the
+	// supplied key, and creates a device mapping with the name volumeName. If
+	// keyslot is not AnyKeyslot, only the specified keyslot should be tried.
+	ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error
+}
+
+type stdinActivationExecutor struct{}
+
+func (stdinActivationExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	// The key is supplied to systemd-cryptsetup via a pipe.
+	release, err := ReserveFileDescriptors(2)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return luks2Activate(volumeName, sourceDevicePath, key, keyslot)
+}
+
+type keyFileActivationExecutor struct {
+	dir string
+}
+
+func (e *keyFileActivationExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	if err := os.MkdirAll(e.dir, 0700); err != nil {
+		return xerrors.Errorf("cannot create key file directory: %w", err)
+	}
+
+	release, err := ReserveFileDescriptors(1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.CreateTemp(e.dir, volumeName+".*.key")
+	if err != nil {
+		return xerrors.Errorf("cannot create key file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return xerrors.Errorf("cannot write key file: %w", err)
+	}
+
+	return luks2ActivateWithKeyFile(volumeName, sourceDevicePath, f.Name(), keyslot)
+}
+
+// NewSystemdCryptsetupKeyFileExecutor returns an ActivationExecutor that writes
+// each recovered key to a temporary file in the specified directory and passes
+// the path of this to systemd-cryptsetup, rather than supplying the key on its
+// standard input. This is useful for distributions that wrap systemd-cryptsetup
+// or that need the key to be read from a file. The directory, which is created
+// with mode 0700 if it doesn't exist, must be on a memory backed filesystem
+// such as /run. Each key file is removed once activation completes.
+func NewSystemdCryptsetupKeyFileExecutor(dir string) ActivationExecutor {
+	return &keyFileActivationExecutor{dir: dir}
+}
+
+// SetActivationExecutor sets the ActivationExecutor used by the
+// ActivateVolumeWith* family of functions. Passing nil restores the default,
+// which supplies the key to systemd-cryptsetup on its standard input.
+//
+// This returns the previously set executor.
+func SetActivationExecutor(executor ActivationExecutor) ActivationExecutor {
+	activationExecutorMu.Lock()
+	defer activationExecutorMu.Unlock()
+
+	orig := activationExecutor
+	activationExecutor = executor
+	return orig
+}
+
+// activateVolume activates the specified volume using the configured
+// ActivationExecutor.
+func activateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	activationExecutorMu.Lock()
+	executor := activationExecutor
+	activationExecutorMu.Unlock()
+
+	if executor == nil {
+		executor = stdinActivationExecutor{}
+	}
+	return executor.ActivateVolume(volumeName, sourceDevicePath, key, keyslot)
+}
@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type mockActivationExecutor struct {
+	calls []string
+	err   error
+}
+
+func (e *mockActivationExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	e.calls = append(e.calls, fmt.Sprintf("%s,%s,%x,%d", volumeName, sourceDevicePath, key, keyslot))
+	return e.err
+}
+
+func (s *cryptSuite) TestSetActivationExecutor(c *C) {
+	executor := new(mockActivationExecutor)
+	c.Check(SetActivationExecutor(executor), IsNil)
+	s.AddCleanup(func() { SetActivationExecutor(nil) })
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, &ActivateVolumeOptions{}, keyData), IsNil)
+	c.Check(executor.calls, DeepEquals, []string{fmt.Sprintf("data,/dev/sda1,%x,-1", unlockKey)})
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestSetActivationExecutorReturnsPrevious(c *C) {
+	executor1 := new(mockActivationExecutor)
+	executor2 := new(mockActivationExecutor)
+	s.AddCleanup(func() { SetActivationExecutor(nil) })
+
+	c.Check(SetActivationExecutor(executor1), IsNil)
+	c.Check(SetActivationExecutor(executor2), Equals, executor1)
+	c.Check(SetActivationExecutor(nil), Equals, executor2)
+}
+
+func (s *cryptSuite) TestActivationExecutorError(c *C) {
+	executor := &mockActivationExecutor{err: errors.New("some error")}
+	SetActivationExecutor(executor)
+	s.AddCleanup(func() { SetActivationExecutor(nil) })
+
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", []byte{1, 2, 3, 4}, nil), ErrorMatches, `some error`)
+	c.Check(executor.calls, DeepEquals, []string{"data,/dev/sda1,01020304,-1"})
+}
+
+func (s *cryptSuite) TestSystemdCryptsetupKeyFileExecutor(c *C) {
+	dir := filepath.Join(c.MkDir(), "keys")
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	var keyFile string
+	s.AddCleanup(MockLUKS2ActivateWithKeyFile(func(volumeName, sourceDevicePath, path string, slot int) error {
+		c.Check(volumeName, Equals, "data")
+		c.Check(sourceDevicePath, Equals, "/dev/sda1")
+		c.Check(slot, Equals, 2)
+
+		c.Check(filepath.Dir(path), Equals, dir)
+		fi, err := os.Stat(path)
+		c.Assert(err, IsNil)
+		c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+		data, err := os.ReadFile(path)
+		c.Check(err, IsNil)
+		c.Check(data, DeepEquals, key)
+
+		keyFile = path
+		return nil
+	}))
+
+	executor := NewSystemdCryptsetupKeyFileExecutor(dir)
+	c.Check(executor.ActivateVolume("data", "/dev/sda1", key, 2), IsNil)
+	c.Check(keyFile, Not(Equals), "")
+
+	fi, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0700))
+
+	_, err = os.Stat(keyFile)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *cryptSuite) TestSystemdCryptsetupKeyFileExecutorActivateError(c *C) {
+	dir := c.MkDir()
+
+	s.AddCleanup(MockLUKS2ActivateWithKeyFile(func(_, _, _ string, _ int) error {
+		return errors.New("systemd-cryptsetup failed with: exit status 1")
+	}))
+
+	executor := NewSystemdCryptsetupKeyFileExecutor(dir)
+	c.Check(executor.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `systemd-cryptsetup failed with: exit status 1`)
+
+	entries, err := os.ReadDir(dir)
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
@@ -0,0 +1,277 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+const (
+	// activationHelperMaxRequestSize is the maximum size of a request
+	// accepted by the activation helper.
+	activationHelperMaxRequestSize = 64 * 1024
+
+	// defaultActivationHelperTimeout is the default time permitted for a
+	// client to send its request to the activation helper.
+	defaultActivationHelperTimeout = 30 * time.Second
+)
+
+var activationHelperPeerCredentials = getUnixPeerCredentials
+
+// activationHelperRequest is sent by an unprivileged process to a privileged
+// activation helper. Each connection carries a single request, which is
+// followed by a single activationHelperResponse.
+type activationHelperRequest struct {
+	VolumeName       string `json:"volume-name"`
+	SourceDevicePath string `json:"source-device-path"`
+	Key              []byte `json:"key"`
+	Keyslot          int    `json:"keyslot"`
+}
+
+const activationHelperErrorMissingSystemdCryptsetup = "missing-systemd-cryptsetup"
+
+type activationHelperResponse struct {
+	Error     string `json:"error,omitempty"`
+	ErrorKind string `json:"error-kind,omitempty"`
+}
+
+func (r *activationHelperRequest) validate() error {
+	switch {
+	case r.VolumeName == "" || strings.Contains(r.VolumeName, "/"):
+		return errors.New("invalid volume name")
+	case !filepath.IsAbs(r.SourceDevicePath):
+		return errors.New("invalid source device path")
+	case len(r.Key) == 0:
+		return errors.New("no key")
+	}
+	return nil
+}
+
+type activationHelperExecutor struct {
+	path string
+}
+
+func (e *activationHelperExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	conn, err := net.Dial("unix", e.path)
+	if err != nil {
+		return xerrors.Errorf("cannot connect to activation helper: %w", err)
+	}
+	defer conn.Close()
+
+	req := &activationHelperRequest{
+		VolumeName:       volumeName,
+		SourceDevicePath: sourceDevicePath,
+		Key:              key,
+		Keyslot:          keyslot}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return xerrors.Errorf("cannot send request to activation helper: %w", err)
+	}
+
+	var rsp activationHelperResponse
+	if err := json.NewDecoder(conn).Decode(&rsp); err != nil {
+		return xerrors.Errorf("cannot receive response from activation helper: %w", err)
+	}
+
+	switch {
+	case rsp.ErrorKind == activationHelperErrorMissingSystemdCryptsetup:
+		return ErrMissingSystemdCryptsetup
+	case rsp.Error != "":
+		return errors.New(rsp.Error)
+	}
+	return nil
+}
+
+// NewActivationHelperExecutor returns an ActivationExecutor that delegates
+// the activation of each volume to a privileged helper that is listening on
+// the unix socket at the specified path, which will normally be provided by
+// the host. The helper is implemented by ServeActivationHelper. This permits
+// the ActivateVolumeWith* family of functions to be used from containers and
+// user namespaces in which device-mapper operations aren't permitted (see
+// DetectActivationEnvironment).
+func NewActivationHelperExecutor(path string) ActivationExecutor {
+	return &activationHelperExecutor{path: path}
+}
+
+// getUnixPeerCredentials returns the credentials of the process connected
+// to the other end of the supplied unix socket connection, as recorded by the
+// kernel when the connection was established.
+func getUnixPeerCredentials(conn net.Conn) (*unix.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return cred, nil
+}
+
+// ActivationHelperOptions provides options for ServeActivationHelperWithOptions.
+type ActivationHelperOptions struct {
+	// Executor is used to activate the requested volumes. If this is nil,
+	// volumes are activated by supplying the key to systemd-cryptsetup on
+	// its standard input.
+	Executor ActivationExecutor
+
+	// AllowedUIDs is the set of additional user IDs that are permitted to
+	// make requests to the helper, as seen from the helper's user namespace.
+	// Requests from root and from the user that the helper runs as are
+	// always permitted.
+	AllowedUIDs []uint32
+
+	// Timeout is the time that a client has to send its request after
+	// connecting. If this is zero, a default of 30 seconds is used.
+	Timeout time.Duration
+}
+
+func (o *ActivationHelperOptions) isPermittedUID(uid uint32) bool {
+	if uid == 0 || uid == uint32(os.Getuid()) {
+		return true
+	}
+	for _, allowed := range o.AllowedUIDs {
+		if uid == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *ActivationHelperOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return defaultActivationHelperTimeout
+	}
+	return o.Timeout
+}
+
+// checkActivationHelperSourceDevice checks that the supplied path is an
+// existing LUKS2 container, so that the helper can't be used to map
+// arbitrary devices or files.
+func checkActivationHelperSourceDevice(path string) error {
+	if _, err := newLUKSView(path, luks2.LockModeNonBlocking); err != nil {
+		return xerrors.Errorf("source device is not a LUKS2 container: %w", err)
+	}
+	return nil
+}
+
+func handleActivationHelperConn(conn net.Conn, opts *ActivationHelperOptions) {
+	defer conn.Close()
+
+	cred, err := activationHelperPeerCredentials(conn)
+	if err != nil || !opts.isPermittedUID(cred.Uid) {
+		// Don't respond to unauthorized clients.
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(opts.timeout())); err != nil {
+		return
+	}
+
+	var req activationHelperRequest
+	if err := json.NewDecoder(io.LimitReader(conn, activationHelperMaxRequestSize)).Decode(&req); err != nil {
+		return
+	}
+
+	var rsp activationHelperResponse
+	err = req.validate()
+	if err == nil {
+		err = checkActivationHelperSourceDevice(req.SourceDevicePath)
+	}
+	if err == nil {
+		err = opts.Executor.ActivateVolume(req.VolumeName, req.SourceDevicePath, req.Key, req.Keyslot)
+	}
+	if err != nil {
+		rsp.Error = err.Error()
+		if xerrors.Is(err, ErrMissingSystemdCryptsetup) {
+			rsp.ErrorKind = activationHelperErrorMissingSystemdCryptsetup
+		}
+	}
+
+	json.NewEncoder(conn).Encode(&rsp)
+}
+
+// ServeActivationHelper implements the privileged side of the protocol used
+// by the ActivationExecutor returned from NewActivationHelperExecutor. It
+// accepts connections from the supplied listener, which must be a unix
+// socket, and activates the requested volumes with the supplied executor. If
+// executor is nil, volumes are activated by supplying the key to
+// systemd-cryptsetup on its standard input.
+//
+// Only requests from root and from the user that the helper runs as are
+// accepted. Use ServeActivationHelperWithOptions to permit other users, such
+// as the root user of an unprivileged container.
+//
+// This runs until the listener is closed, in which case it returns nil.
+func ServeActivationHelper(l net.Listener, executor ActivationExecutor) error {
+	return ServeActivationHelperWithOptions(l, &ActivationHelperOptions{Executor: executor})
+}
+
+// ServeActivationHelperWithOptions is a variant of ServeActivationHelper that
+// accepts additional options.
+//
+// The user ID of each client is obtained from the socket with SO_PEERCRED and
+// checked against the permitted users before the request is read. Clients
+// must send their request before the timeout expires, and requests are
+// limited in size. The source device of each request must be an existing
+// LUKS2 container.
+func ServeActivationHelperWithOptions(l net.Listener, opts *ActivationHelperOptions) error {
+	if opts == nil {
+		opts = new(ActivationHelperOptions)
+	}
+	o := *opts
+	if o.Executor == nil {
+		o.Executor = stdinActivationExecutor{}
+	}
+
+	for {
+		conn, err := l.Accept()
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			return nil
+		case err != nil:
+			return xerrors.Errorf("cannot accept connection: %w", err)
+		}
+
+		go handleActivationHelperConn(conn, &o)
+	}
+}
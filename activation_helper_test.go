@@ -0,0 +1,214 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+type activationHelperSuite struct {
+	snapd_testutil.BaseTest
+
+	path     string
+	listener net.Listener
+	done     chan error
+}
+
+var _ = Suite(&activationHelperSuite{})
+
+func (s *activationHelperSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.AddCleanup(MockNewLUKSView(func(path string, lockMode luks2.LockMode) (*luksview.View, error) {
+		c.Check(lockMode, Equals, luks2.LockModeNonBlocking)
+		switch path {
+		case "/dev/sda1", "/dev/sda2":
+			return nil, nil
+		default:
+			return nil, errors.New("no LUKS2 header")
+		}
+	}))
+
+	s.path = filepath.Join(c.MkDir(), "helper.socket")
+	l, err := net.Listen("unix", s.path)
+	c.Assert(err, IsNil)
+	s.listener = l
+}
+
+func (s *activationHelperSuite) TearDownTest(c *C) {
+	c.Check(s.listener.Close(), IsNil)
+	if s.done != nil {
+		c.Check(<-s.done, IsNil)
+		s.done = nil
+	}
+	s.BaseTest.TearDownTest(c)
+}
+
+func (s *activationHelperSuite) serve(executor ActivationExecutor) {
+	s.serveWithOptions(&ActivationHelperOptions{Executor: executor})
+}
+
+func (s *activationHelperSuite) serveWithOptions(opts *ActivationHelperOptions) {
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- ServeActivationHelperWithOptions(s.listener, opts)
+	}()
+}
+
+func (s *activationHelperSuite) mockPeerUID(uid uint32) {
+	s.AddCleanup(MockActivationHelperPeerCredentials(func(net.Conn) (*unix.Ucred, error) {
+		return &unix.Ucred{Uid: uid}, nil
+	}))
+}
+
+type syncActivationExecutor struct {
+	mu sync.Mutex
+	mockActivationExecutor
+}
+
+func (e *syncActivationExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mockActivationExecutor.ActivateVolume(volumeName, sourceDevicePath, key, keyslot)
+}
+
+func (s *activationHelperSuite) TestActivateVolume(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), IsNil)
+	c.Check(helper.ActivateVolume("save", "/dev/sda2", []byte{5, 6, 7, 8}, 2), IsNil)
+	c.Check(executor.calls, DeepEquals, []string{
+		"data,/dev/sda1,01020304,-1",
+		"save,/dev/sda2,05060708,2",
+	})
+}
+
+func (s *activationHelperSuite) TestActivateVolumeError(c *C) {
+	executor := new(syncActivationExecutor)
+	executor.err = errors.New("systemd-cryptsetup failed with: exit status 1")
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `systemd-cryptsetup failed with: exit status 1`)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeMissingSystemdCryptsetup(c *C) {
+	executor := new(syncActivationExecutor)
+	executor.err = fmt.Errorf("cannot activate: %w", ErrMissingSystemdCryptsetup)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), Equals, ErrMissingSystemdCryptsetup)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeInvalidVolumeName(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("../data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `invalid volume name`)
+	c.Check(executor.calls, HasLen, 0)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeInvalidSourceDevicePath(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `invalid source device path`)
+	c.Check(executor.calls, HasLen, 0)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeNoHelper(c *C) {
+	helper := NewActivationHelperExecutor(filepath.Join(c.MkDir(), "missing.socket"))
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `cannot connect to activation helper: .*`)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeNotLUKS2(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/etc/shadow", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `source device is not a LUKS2 container: no LUKS2 header`)
+	c.Check(executor.calls, HasLen, 0)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeUnauthorizedPeer(c *C) {
+	s.mockPeerUID(1234)
+
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), ErrorMatches, `cannot (send request to|receive response from) activation helper: .*`)
+	c.Check(executor.calls, HasLen, 0)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeAllowedPeer(c *C) {
+	s.mockPeerUID(1234)
+
+	executor := new(syncActivationExecutor)
+	s.serveWithOptions(&ActivationHelperOptions{Executor: executor, AllowedUIDs: []uint32{1000, 1234}})
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", []byte{1, 2, 3, 4}, AnyKeyslot), IsNil)
+	c.Check(executor.calls, DeepEquals, []string{"data,/dev/sda1,01020304,-1"})
+}
+
+func (s *activationHelperSuite) TestActivateVolumeRequestTooLarge(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serve(executor)
+
+	helper := NewActivationHelperExecutor(s.path)
+	c.Check(helper.ActivateVolume("data", "/dev/sda1", bytes.Repeat([]byte{1}, 64*1024), AnyKeyslot), ErrorMatches, `cannot (send request to|receive response from) activation helper: .*`)
+	c.Check(executor.calls, HasLen, 0)
+}
+
+func (s *activationHelperSuite) TestActivateVolumeTimeout(c *C) {
+	executor := new(syncActivationExecutor)
+	s.serveWithOptions(&ActivationHelperOptions{Executor: executor, Timeout: 10 * time.Millisecond})
+
+	conn, err := net.Dial("unix", s.path)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// The helper should close the connection if no request is sent.
+	c.Check(conn.SetReadDeadline(time.Now().Add(10*time.Second)), IsNil)
+	_, err = conn.Read(make([]byte, 1))
+	c.Check(err, ErrorMatches, `EOF`)
+	c.Check(executor.calls, HasLen, 0)
+}
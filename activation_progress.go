@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/testhooks"
+)
+
+var (
+	// ErrActivationDeadlineExceeded is returned from the ActivateVolumeWith*
+	// family of functions if the deadline supplied via the Deadline field of
+	// ActivateVolumeOptions expires before the volume could be activated.
+	ErrActivationDeadlineExceeded = errors.New("the deadline for activating the volume was exceeded")
+
+	timeNow = testhooks.Now
+)
+
+// ActivationStage describes a step performed during volume activation that
+// is reported to an ActivationProgressReporter.
+type ActivationStage int
+
+const (
+	// ActivationStageRecoverKey indicates that a key is being recovered
+	// from the platform's secure device without any user authentication.
+	// This may involve slow operations on the secure device.
+	ActivationStageRecoverKey ActivationStage = iota + 1
+
+	// ActivationStageRecoverKeyWithPassphrase indicates that a key is being
+	// recovered from the platform's secure device with a passphrase. This
+	// involves running the passphrase KDF, which may be slow.
+	ActivationStageRecoverKeyWithPassphrase
+
+	// ActivationStageRequestPassphrase indicates that a passphrase is being
+	// requested from the user.
+	ActivationStageRequestPassphrase
+
+	// ActivationStageRequestRecoveryKey indicates that a recovery key is being
+	// requested from the user.
+	ActivationStageRequestRecoveryKey
+
+	// ActivationStageActivate indicates that the volume is being activated
+	// with a recovered key.
+	ActivationStageActivate
+
+	// ActivationStageWaitForDevice indicates that activation is waiting
+	// for the source device to appear (see the DeviceTimeout field of
+	// ActivateVolumeOptions).
+	ActivationStageWaitForDevice
+)
+
+func (s ActivationStage) String() string {
+	switch s {
+	case ActivationStageRecoverKey:
+		return "recovering key"
+	case ActivationStageRecoverKeyWithPassphrase:
+		return "recovering key with passphrase"
+	case ActivationStageRequestPassphrase:
+		return "requesting passphrase"
+	case ActivationStageRequestRecoveryKey:
+		return "requesting recovery key"
+	case ActivationStageActivate:
+		return "activating volume"
+	case ActivationStageWaitForDevice:
+		return "waiting for device"
+	default:
+		return fmt.Sprintf("ActivationStage(%d)", int(s))
+	}
+}
+
+// ActivationProgressReporter is an interface for reporting the progress of
+// volume activation, eg, to a service manager that enforces a timeout.
+type ActivationProgressReporter interface {
+	// ReportProgress is called before each step of activating the volume at
+	// sourceDevicePath. The remaining argument indicates the time remaining
+	// until the deadline supplied via ActivateVolumeOptions expires, or zero
+	// if there is no deadline.
+	ReportProgress(volumeName, sourceDevicePath string, stage ActivationStage, remaining time.Duration)
+}
+
+// activationProgress tracks the deadline and reports progress during
+// volume activation.
+type activationProgress struct {
+	volumeName       string
+	sourceDevicePath string
+	deadline         time.Time
+	reporter         ActivationProgressReporter
+}
+
+func newActivationProgress(volumeName, sourceDevicePath string, options *ActivateVolumeOptions) *activationProgress {
+	return &activationProgress{
+		volumeName:       volumeName,
+		sourceDevicePath: sourceDevicePath,
+		deadline:         options.Deadline,
+		reporter:         options.ProgressReporter}
+}
+
+// begin is called before each step of activation. It returns
+// ErrActivationDeadlineExceeded if the deadline has expired, else
+// it reports the supplied stage to the reporter.
+func (p *activationProgress) begin(stage ActivationStage) error {
+	var remaining time.Duration
+	if !p.deadline.IsZero() {
+		remaining = p.deadline.Sub(timeNow())
+		if remaining <= 0 {
+			return ErrActivationDeadlineExceeded
+		}
+	}
+
+	if p.reporter != nil {
+		p.reporter.ReportProgress(p.volumeName, p.sourceDevicePath, stage, remaining)
+	}
+	return nil
+}
+
+// newContext returns a context that expires at the deadline, if there is one,
+// so that operations on the platform's secure device can be aborted when it
+// expires.
+func (p *activationProgress) newContext() (context.Context, context.CancelFunc) {
+	if p.deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.deadline.Sub(timeNow()))
+}
+
+// waitForDevice is called before activation to wait for up to timeout for
+// the source device to appear. The wait is limited by the deadline, and
+// ErrActivationDeadlineExceeded is returned if that expires first.
+func (p *activationProgress) waitForDevice(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	if err := p.begin(ActivationStageWaitForDevice); err != nil {
+		return err
+	}
+
+	limitedByDeadline := false
+	if !p.deadline.IsZero() {
+		if remaining := p.deadline.Sub(timeNow()); remaining < timeout {
+			timeout = remaining
+			limitedByDeadline = true
+		}
+	}
+
+	err := luks2WaitForDevice(p.sourceDevicePath, timeout)
+	switch {
+	case err == nil:
+		return nil
+	case xerrors.Is(err, ErrDeviceNeverAppeared) && limitedByDeadline:
+		return ErrActivationDeadlineExceeded
+	case xerrors.Is(err, ErrDeviceNeverAppeared):
+		return ErrDeviceNeverAppeared
+	default:
+		return xerrors.Errorf("cannot wait for device: %w", err)
+	}
+}
@@ -0,0 +1,100 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+type systemdNotifyProgressReporter struct {
+	addr          *net.UnixAddr
+	extendTimeout time.Duration
+}
+
+func (r *systemdNotifyProgressReporter) notify(msg []byte) error {
+	conn, err := net.DialUnix("unixgram", nil, r.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(msg)
+	return err
+}
+
+func (r *systemdNotifyProgressReporter) ReportProgress(volumeName, sourceDevicePath string, stage ActivationStage, remaining time.Duration) {
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "STATUS=%s\n", FormatMessage(MessageUnlockingVolume, &MessageParams{
+		VolumeName:       volumeName,
+		SourceDevicePath: sourceDevicePath,
+		Stage:            stage}))
+
+	switch stage {
+	case ActivationStageRecoverKey, ActivationStageRecoverKeyWithPassphrase, ActivationStageActivate, ActivationStageWaitForDevice:
+		// These stages may involve slow KDF, secure device or storage
+		// device operations, so ask the service manager for more time. Don't ask for more
+		// time than we are prepared to spend though.
+		extend := r.extendTimeout
+		if remaining > 0 && remaining < extend {
+			extend = remaining
+		}
+		if extend > 0 {
+			fmt.Fprintf(msg, "EXTEND_TIMEOUT_USEC=%d\n", extend.Microseconds())
+		}
+	}
+
+	if err := r.notify(msg.Bytes()); err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot notify service manager: %v\n", err)
+	}
+}
+
+// NewSystemdNotifyProgressReporter creates an implementation of
+// ActivationProgressReporter that reports progress to the service manager
+// using the sd_notify protocol via the socket specified by the NOTIFY_SOCKET
+// environment variable. Each step is reported with a STATUS message. Before
+// steps that may involve slow KDF or secure device operations, the service
+// manager is asked to extend the unit's timeout by extendTimeout (or by the
+// time remaining until the activation deadline if that is shorter) with an
+// EXTEND_TIMEOUT_USEC message.
+//
+// If NOTIFY_SOCKET is not set, an error will be returned.
+func NewSystemdNotifyProgressReporter(extendTimeout time.Duration) (ActivationProgressReporter, error) {
+	if extendTimeout < 0 {
+		return nil, errors.New("invalid extendTimeout")
+	}
+
+	path := os.Getenv("NOTIFY_SOCKET")
+	switch {
+	case path == "":
+		return nil, errors.New("NOTIFY_SOCKET is not set")
+	case path[0] == '@':
+		// Abstract namespace socket
+		path = "\x00" + path[1:]
+	}
+
+	return &systemdNotifyProgressReporter{
+		addr:          &net.UnixAddr{Name: path, Net: "unixgram"},
+		extendTimeout: extendTimeout}, nil
+}
@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type activationProgressSystemdSuite struct {
+	snapd_testutil.BaseTest
+
+	conn *net.UnixConn
+}
+
+func (s *activationProgressSystemdSuite) SetUpTest(c *C) {
+	path := filepath.Join(c.MkDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	s.conn = conn
+	s.AddCleanup(func() { conn.Close() })
+
+	orig, set := os.LookupEnv("NOTIFY_SOCKET")
+	c.Check(os.Setenv("NOTIFY_SOCKET", path), IsNil)
+	s.AddCleanup(func() {
+		if set {
+			os.Setenv("NOTIFY_SOCKET", orig)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+	})
+}
+
+func (s *activationProgressSystemdSuite) readMessage(c *C) string {
+	c.Assert(s.conn.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	buf := make([]byte, 4096)
+	n, err := s.conn.Read(buf)
+	c.Assert(err, IsNil)
+	return string(buf[:n])
+}
+
+var _ = Suite(&activationProgressSystemdSuite{})
+
+type testSystemdNotifyProgressReporterData struct {
+	extendTimeout time.Duration
+
+	volumeName       string
+	sourceDevicePath string
+	stage            ActivationStage
+	remaining        time.Duration
+
+	expectedMsg string
+}
+
+func (s *activationProgressSystemdSuite) testReportProgress(c *C, data *testSystemdNotifyProgressReporterData) {
+	reporter, err := NewSystemdNotifyProgressReporter(data.extendTimeout)
+	c.Assert(err, IsNil)
+
+	reporter.ReportProgress(data.volumeName, data.sourceDevicePath, data.stage, data.remaining)
+	c.Check(s.readMessage(c), Equals, data.expectedMsg)
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressRecoverKey(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		extendTimeout:    time.Minute,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		stage:            ActivationStageRecoverKey,
+		expectedMsg:      "STATUS=Unlocking data (/dev/sda1): recovering key\nEXTEND_TIMEOUT_USEC=60000000\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressDifferentVolume(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		extendTimeout:    time.Minute,
+		volumeName:       "save",
+		sourceDevicePath: "/dev/vda2",
+		stage:            ActivationStageActivate,
+		expectedMsg:      "STATUS=Unlocking save (/dev/vda2): activating volume\nEXTEND_TIMEOUT_USEC=60000000\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressLimitedByDeadline(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		extendTimeout:    time.Minute,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		stage:            ActivationStageRecoverKeyWithPassphrase,
+		remaining:        10 * time.Second,
+		expectedMsg:      "STATUS=Unlocking data (/dev/sda1): recovering key with passphrase\nEXTEND_TIMEOUT_USEC=10000000\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressWaitForDevice(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		extendTimeout:    time.Minute,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/disk/by-uuid/e11acb7d-84e5-4b2c-9195-5f1b2bbd1a45",
+		stage:            ActivationStageWaitForDevice,
+		expectedMsg:      "STATUS=Unlocking data (/dev/disk/by-uuid/e11acb7d-84e5-4b2c-9195-5f1b2bbd1a45): waiting for device\nEXTEND_TIMEOUT_USEC=60000000\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressRequestPassphrase(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		extendTimeout:    time.Minute,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		stage:            ActivationStageRequestPassphrase,
+		expectedMsg:      "STATUS=Unlocking data (/dev/sda1): requesting passphrase\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestReportProgressNoExtend(c *C) {
+	s.testReportProgress(c, &testSystemdNotifyProgressReporterData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		stage:            ActivationStageRecoverKey,
+		expectedMsg:      "STATUS=Unlocking data (/dev/sda1): recovering key\n"})
+}
+
+func (s *activationProgressSystemdSuite) TestNewSystemdNotifyProgressReporterNoSocket(c *C) {
+	c.Check(os.Unsetenv("NOTIFY_SOCKET"), IsNil)
+	_, err := NewSystemdNotifyProgressReporter(time.Minute)
+	c.Check(err, ErrorMatches, `NOTIFY_SOCKET is not set`)
+}
+
+func (s *activationProgressSystemdSuite) TestNewSystemdNotifyProgressReporterInvalidExtendTimeout(c *C) {
+	_, err := NewSystemdNotifyProgressReporter(-time.Second)
+	c.Check(err, ErrorMatches, `invalid extendTimeout`)
+}
@@ -0,0 +1,248 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/testhooks"
+)
+
+// activationReportDigestAlg is the algorithm used to chain and sign entries
+// in an activation report log.
+const activationReportDigestAlg = crypto.SHA256
+
+// ActivationReport records that a volume was activated by one of the
+// ActivateVolumeWith* functions, and how it was unlocked.
+type ActivationReport struct {
+	Time             time.Time     `json:"time"`
+	VolumeName       string        `json:"volume-name"`
+	SourceDevicePath string        `json:"source-device-path"`
+	Reason           *UnlockReason `json:"reason"`
+}
+
+// ActivationReportEntry is a single signed entry in an activation report log.
+type ActivationReportEntry struct {
+	Report *ActivationReport `json:"report"`
+
+	// Prev is the digest of the previous entry in the log, or empty for
+	// the first entry.
+	Prev []byte `json:"prev,omitempty"`
+
+	// Digest is the digest of this entry, which is computed from Report
+	// and Prev.
+	Digest []byte `json:"digest"`
+
+	// Signature is the signature of Digest, created by the signer
+	// supplied to the ActivationReportLog. ECDSA signatures are ASN.1 DER
+	// encoded and RSA signatures use PKCS#1 v1.5.
+	Signature []byte `json:"signature"`
+}
+
+func (e *ActivationReportEntry) computeDigest() ([]byte, error) {
+	data, err := json.Marshal(e.Report)
+	if err != nil {
+		return nil, err
+	}
+
+	h := activationReportDigestAlg.New()
+	h.Write(e.Prev)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// ActivationReportLog records signed ActivationReports so that it is
+// possible to later prove when and how volumes were unlocked. Each entry is
+// written as a single line of JSON, contains the digest of the previous entry
+// and is signed with the supplied signer, which should be backed by a key
+// that cannot be extracted from the device and that can only be used by the
+// holder of its authorization value (see
+// tpm2.Connection.NewActivationReportSigner). This makes it possible to detect
+// the modification, removal or insertion of entries with
+// VerifyActivationReportLog, but not the truncation of the log. The log should
+// be stored somewhere that is append-only where possible.
+//
+// A log is used during activation by setting the ActivationReportLog field of
+// ActivateVolumeOptions.
+type ActivationReportLog struct {
+	w      io.Writer
+	f      *os.File
+	signer crypto.Signer
+	last   []byte
+}
+
+// NewActivationReportLog creates a new ActivationReportLog that writes
+// entries to w, signed with the supplied signer. When appending to an existing
+// log, last should be set to the digest of the last entry in it, as returned
+// from VerifyActivationReportLog. It should be empty for a new log.
+func NewActivationReportLog(w io.Writer, signer crypto.Signer, last []byte) *ActivationReportLog {
+	return &ActivationReportLog{w: w, signer: signer, last: last}
+}
+
+// OpenActivationReportLogFile opens the log at the specified path for
+// appending, creating it if it doesn't exist. The existing entries are
+// verified with the public key of the supplied signer. The file is never
+// truncated or rewritten. The returned log should be closed with Close once
+// it is no longer required.
+func OpenActivationReportLogFile(path string, signer crypto.Signer) (*ActivationReportLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open file: %w", err)
+	}
+
+	entries, err := VerifyActivationReportLog(f, signer.Public())
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("cannot verify existing log: %w", err)
+	}
+
+	var last []byte
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Digest
+	}
+
+	return &ActivationReportLog{w: f, f: f, signer: signer, last: last}, nil
+}
+
+// Close closes the file associated with this log if it was opened with
+// OpenActivationReportLogFile, else it does nothing.
+func (l *ActivationReportLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Append signs the supplied report and appends it to the log.
+func (l *ActivationReportLog) Append(report *ActivationReport) error {
+	entry := &ActivationReportEntry{
+		Report: report,
+		Prev:   l.last}
+
+	digest, err := entry.computeDigest()
+	if err != nil {
+		return xerrors.Errorf("cannot compute entry digest: %w", err)
+	}
+	entry.Digest = digest
+
+	sig, err := l.signer.Sign(testhooks.RandReader, digest, activationReportDigestAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot sign entry: %w", err)
+	}
+	entry.Signature = sig
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return xerrors.Errorf("cannot serialize entry: %w", err)
+	}
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		return xerrors.Errorf("cannot write entry: %w", err)
+	}
+
+	l.last = digest
+	return nil
+}
+
+func verifyActivationReportSignature(key crypto.PublicKey, digest, sig []byte) (bool, error) {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, sig), nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, activationReportDigestAlg, digest, sig) == nil, nil
+	default:
+		return false, errors.New("unsupported key type")
+	}
+}
+
+// VerifyActivationReportLog reads a log written by an ActivationReportLog
+// from r and verifies that the entries are correctly chained together and
+// signed by the supplied public key. On success, the entries are returned.
+func VerifyActivationReportLog(r io.Reader, key crypto.PublicKey) ([]*ActivationReportEntry, error) {
+	var entries []*ActivationReportEntry
+	var prev []byte
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry *ActivationReportEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, xerrors.Errorf("cannot decode entry %d: %w", len(entries), err)
+		}
+		if entry == nil || entry.Report == nil {
+			return nil, fmt.Errorf("entry %d is empty", len(entries))
+		}
+		if !bytes.Equal(entry.Prev, prev) {
+			return nil, fmt.Errorf("entry %d is not chained to the previous entry", len(entries))
+		}
+		digest, err := entry.computeDigest()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute digest for entry %d: %w", len(entries), err)
+		}
+		if !bytes.Equal(entry.Digest, digest) {
+			return nil, fmt.Errorf("entry %d has an invalid digest", len(entries))
+		}
+		ok, err := verifyActivationReportSignature(key, digest, entry.Signature)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot verify signature for entry %d: %w", len(entries), err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("entry %d has an invalid signature", len(entries))
+		}
+
+		entries = append(entries, entry)
+		prev = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("cannot read log: %w", err)
+	}
+
+	return entries, nil
+}
+
+func appendActivationReport(log *ActivationReportLog, volumeName, sourceDevicePath string, reason *UnlockReason) {
+	if log == nil {
+		return
+	}
+	report := &ActivationReport{
+		Time:             timeNow().UTC(),
+		VolumeName:       volumeName,
+		SourceDevicePath: sourceDevicePath,
+		Reason:           reason}
+	if err := log.Append(report); err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot append activation report: %v\n", err)
+	}
+}
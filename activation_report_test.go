@@ -0,0 +1,277 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockFailingSigner struct {
+	crypto.Signer
+}
+
+func (*mockFailingSigner) Sign(_ io.Reader, _ []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("some error")
+}
+
+type activationReportSuite struct {
+	key *ecdsa.PrivateKey
+	now time.Time
+}
+
+func (s *activationReportSuite) SetUpSuite(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+	s.key = key
+}
+
+func (s *activationReportSuite) SetUpTest(c *C) {
+	s.now = time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+}
+
+var _ = Suite(&activationReportSuite{})
+
+func (s *activationReportSuite) newReport(volumeName string, method UnlockMethod) *ActivationReport {
+	s.now = s.now.Add(time.Minute)
+	return &ActivationReport{
+		Time:             s.now,
+		VolumeName:       volumeName,
+		SourceDevicePath: "/dev/sda1",
+		Reason:           &UnlockReason{Method: method, KeyName: "default"}}
+}
+
+func (s *activationReportSuite) TestAppendAndVerify(c *C) {
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, s.key, nil)
+
+	reports := []*ActivationReport{
+		s.newReport("data", UnlockMethodPlatformKey),
+		s.newReport("save", UnlockMethodRecoveryKey),
+	}
+	for _, report := range reports {
+		c.Check(log.Append(report), IsNil)
+	}
+
+	entries, err := VerifyActivationReportLog(bytes.NewReader(buf.Bytes()), s.key.Public())
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0].Report, DeepEquals, reports[0])
+	c.Check(entries[0].Prev, HasLen, 0)
+	c.Check(entries[1].Report, DeepEquals, reports[1])
+	c.Check(entries[1].Prev, DeepEquals, entries[0].Digest)
+}
+
+func (s *activationReportSuite) TestAppendAndVerifyRSA(c *C) {
+	key, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, key, nil)
+	c.Check(log.Append(s.newReport("data", UnlockMethodPlatformKey)), IsNil)
+
+	entries, err := VerifyActivationReportLog(bytes.NewReader(buf.Bytes()), key.Public())
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 1)
+}
+
+func (s *activationReportSuite) TestAppendToExisting(c *C) {
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, s.key, nil)
+	c.Check(log.Append(s.newReport("data", UnlockMethodPlatformKey)), IsNil)
+
+	entries, err := VerifyActivationReportLog(bytes.NewReader(buf.Bytes()), s.key.Public())
+	c.Assert(err, IsNil)
+
+	log = NewActivationReportLog(&buf, s.key, entries[0].Digest)
+	c.Check(log.Append(s.newReport("data", UnlockMethodRecoveryKey)), IsNil)
+
+	entries, err = VerifyActivationReportLog(bytes.NewReader(buf.Bytes()), s.key.Public())
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 2)
+}
+
+func (s *activationReportSuite) TestAppendSignFailure(c *C) {
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, &mockFailingSigner{s.key}, nil)
+	c.Check(log.Append(s.newReport("data", UnlockMethodPlatformKey)), ErrorMatches, `cannot sign entry: some error`)
+	c.Check(buf.Len(), Equals, 0)
+}
+
+func (s *activationReportSuite) TestOpenFile(c *C) {
+	path := filepath.Join(c.MkDir(), "activation.log")
+
+	log, err := OpenActivationReportLogFile(path, s.key)
+	c.Assert(err, IsNil)
+	c.Check(log.Append(s.newReport("data", UnlockMethodPlatformKey)), IsNil)
+	c.Check(log.Close(), IsNil)
+
+	log, err = OpenActivationReportLogFile(path, s.key)
+	c.Assert(err, IsNil)
+	c.Check(log.Append(s.newReport("save", UnlockMethodPlatformKey)), IsNil)
+	c.Check(log.Close(), IsNil)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	entries, err := VerifyActivationReportLog(bytes.NewReader(data), s.key.Public())
+	c.Check(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0].Report.VolumeName, Equals, "data")
+	c.Check(entries[1].Report.VolumeName, Equals, "save")
+}
+
+func (s *activationReportSuite) TestOpenFileInvalid(c *C) {
+	path := filepath.Join(c.MkDir(), "activation.log")
+	c.Assert(ioutil.WriteFile(path, []byte("foo\n"), 0600), IsNil)
+
+	_, err := OpenActivationReportLogFile(path, s.key)
+	c.Check(err, ErrorMatches, `cannot verify existing log: cannot decode entry 0: invalid character 'o' in literal false \(expecting 'a'\)`)
+}
+
+func (s *activationReportSuite) newLog(c *C, n int) []*ActivationReportEntry {
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, s.key, nil)
+	for i := 0; i < n; i++ {
+		c.Assert(log.Append(s.newReport("data", UnlockMethodPlatformKey)), IsNil)
+	}
+
+	entries, err := VerifyActivationReportLog(bytes.NewReader(buf.Bytes()), s.key.Public())
+	c.Assert(err, IsNil)
+	return entries
+}
+
+func (s *activationReportSuite) encodeLog(c *C, entries []*ActivationReportEntry) io.Reader {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		c.Assert(err, IsNil)
+		buf.Write(append(data, '\n'))
+	}
+	return &buf
+}
+
+func (s *activationReportSuite) TestVerifyModifiedReport(c *C) {
+	entries := s.newLog(c, 2)
+	entries[1].Report.Reason.Method = UnlockMethodPlatformKeyWithPassphrase
+
+	_, err := VerifyActivationReportLog(s.encodeLog(c, entries), s.key.Public())
+	c.Check(err, ErrorMatches, `entry 1 has an invalid digest`)
+}
+
+func (s *activationReportSuite) TestVerifyRemovedEntry(c *C) {
+	entries := s.newLog(c, 3)
+
+	_, err := VerifyActivationReportLog(s.encodeLog(c, []*ActivationReportEntry{entries[0], entries[2]}), s.key.Public())
+	c.Check(err, ErrorMatches, `entry 1 is not chained to the previous entry`)
+}
+
+func (s *activationReportSuite) TestVerifyResignedByOtherKey(c *C) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	log := NewActivationReportLog(&buf, otherKey, nil)
+	c.Check(log.Append(s.newReport("data", UnlockMethodPlatformKey)), IsNil)
+
+	_, err = VerifyActivationReportLog(&buf, s.key.Public())
+	c.Check(err, ErrorMatches, `entry 0 has an invalid signature`)
+}
+
+func (s *activationReportSuite) TestVerifyUnsupportedKey(c *C) {
+	entries := s.newLog(c, 1)
+
+	_, err := VerifyActivationReportLog(s.encodeLog(c, entries), []byte{1, 2, 3})
+	c.Check(err, ErrorMatches, `cannot verify signature for entry 0: unsupported key type`)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecordsActivationReport(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	restore := MockTimeNow(func() time.Time { return now })
+	defer restore()
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	var buf bytes.Buffer
+	options := &ActivateVolumeOptions{ActivationReportLog: NewActivationReportLog(&buf, key, nil)}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	entries, err := VerifyActivationReportLog(&buf, key.Public())
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Report, DeepEquals, &ActivationReport{
+		Time:             now,
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		Reason: &UnlockReason{
+			Method:       UnlockMethodPlatformKey,
+			KeyName:      "foo",
+			PlatformName: "mock"}})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyRecordsActivationReport(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	var buf bytes.Buffer
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1, ActivationReportLog: NewActivationReportLog(&buf, key, nil)}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+
+	entries, err := VerifyActivationReportLog(&buf, key.Public())
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Report.VolumeName, Equals, "data")
+	c.Check(entries[0].Report.Reason.Method, Equals, UnlockMethodRecoveryKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyActivationReportFailure(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	var buf bytes.Buffer
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1, ActivationReportLog: NewActivationReportLog(&buf, &mockFailingSigner{key}, nil)}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(buf.Len(), Equals, 0)
+}
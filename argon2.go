@@ -86,9 +86,10 @@ type Argon2Options struct {
 	Mode Argon2Mode
 
 	// MemoryKiB specifies the maximum memory cost in KiB when ForceIterations
-	// is zero. In this case, it will be capped at 4GiB or half of the available
-	// memory, whichever is less. If ForceIterations is not zero, then this is
-	// used as the memory cost and is not limited.
+	// is zero. In this case, it will be capped at 4GiB, half of the available
+	// memory or the MaxKDFMemoryKiB limit set with SetResourceBudget, whichever
+	// is less. If ForceIterations is not zero, then this is used as the memory
+	// cost and is only limited by MaxKDFMemoryKiB.
 	MemoryKiB uint32
 
 	// TargetDuration specifies the target duration for the KDF which
@@ -109,7 +110,7 @@ type Argon2Options struct {
 	Parallel uint8
 }
 
-func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
+func (o *Argon2Options) kdfParams(kdf Argon2KDF, keyLen uint32) (*kdfParams, error) {
 	switch o.Mode {
 	case Argon2Default, Argon2i, Argon2id:
 		// ok
@@ -154,6 +155,12 @@ func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
 			// no limit to the threads if set explicitly.
 			params.CPUs = int(o.Parallel)
 		}
+		if limit := CurrentResourceBudget().MaxKDFMemoryKiB; limit > 0 && params.Memory > int(limit) {
+			return nil, &ResourceBudgetExceededError{
+				Resource:  ResourceKDFMemory,
+				Limit:     uint64(limit),
+				Requested: uint64(params.Memory)}
+		}
 
 		return params, nil
 	default:
@@ -165,6 +172,10 @@ func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
 		if o.MemoryKiB != 0 {
 			benchmarkParams.MaxMemoryCostKiB = o.MemoryKiB // this is capped to 4GiB by internal/argon2.
 		}
+		if limit := CurrentResourceBudget().MaxKDFMemoryKiB; limit > 0 && benchmarkParams.MaxMemoryCostKiB > limit {
+			// Ensure that the key can be recovered within the budget.
+			benchmarkParams.MaxMemoryCostKiB = limit
+		}
 		if o.TargetDuration != 0 {
 			benchmarkParams.TargetDuration = o.TargetDuration
 		}
@@ -173,7 +184,7 @@ func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
 		}
 
 		params, err := argon2.Benchmark(benchmarkParams, func(params *argon2.CostParams) (time.Duration, error) {
-			return argon2KDF().Time(mode, &Argon2CostParams{
+			return kdf.Time(mode, &Argon2CostParams{
 				Time:      params.Time,
 				MemoryKiB: params.MemoryKiB,
 				Threads:   params.Threads})
@@ -187,7 +198,7 @@ func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
 			MemoryKiB:       params.MemoryKiB,
 			ForceIterations: params.Time,
 			Parallel:        params.Threads}
-		return o.kdfParams(keyLen)
+		return o.kdfParams(kdf, keyLen)
 	}
 }
 
@@ -130,6 +130,23 @@ func (s *argon2Suite) TestKDFParamsMemoryLimit(c *C) {
 	})
 }
 
+func (s *argon2Suite) TestKDFParamsResourceBudget(c *C) {
+	SetResourceBudget(ResourceBudget{MaxKDFMemoryKiB: 32 * 1024})
+	defer SetResourceBudget(ResourceBudget{})
+
+	var opts Argon2Options
+	params, err := opts.KdfParams(0)
+	c.Assert(err, IsNil)
+	c.Check(s.kdf.BenchmarkMode, Equals, Argon2id)
+
+	c.Check(params, DeepEquals, &KdfParams{
+		Type:   "argon2id",
+		Time:   125,
+		Memory: 32 * 1024,
+		CPUs:   s.cpusAuto,
+	})
+}
+
 func (s *argon2Suite) TestKDFParamsForceBenchmarkedThreads(c *C) {
 	var opts Argon2Options
 	opts.Parallel = 1
@@ -182,6 +199,21 @@ func (s *argon2Suite) TestKDFParamsForceMemory(c *C) {
 	})
 }
 
+func (s *argon2Suite) TestKDFParamsForceMemoryExceedsResourceBudget(c *C) {
+	SetResourceBudget(ResourceBudget{MaxKDFMemoryKiB: 32 * 1024})
+	defer SetResourceBudget(ResourceBudget{})
+
+	var opts Argon2Options
+	opts.ForceIterations = 3
+	opts.MemoryKiB = 64 * 1024
+	_, err := opts.KdfParams(0)
+	c.Check(err, ErrorMatches, `kdf-memory budget exceeded: 65536 requested with 0 of 32768 in use`)
+	c.Check(err, DeepEquals, &ResourceBudgetExceededError{
+		Resource:  ResourceKDFMemory,
+		Limit:     32 * 1024,
+		Requested: 64 * 1024})
+}
+
 func (s *argon2Suite) TestKDFParamsForceIterationsDifferentCPUNum(c *C) {
 	restore := MockRuntimeNumCPU(8)
 	defer restore()
@@ -0,0 +1,61 @@
+package secboot
+
+import (
+	"github.com/snapcore/secboot/internal/artifact"
+)
+
+// ArtifactFormatVersion is the version of the serialization formats
+// understood by this package. It is recorded as the producer version in the
+// header of every artifact written by this package, and is incremented
+// whenever a format changes in a way that older versions of this package
+// cannot read.
+const ArtifactFormatVersion = artifact.FormatVersion
+
+// ArtifactHeader is embedded in serialized artifacts written by this package,
+// such as key data, provisioned secrets and LUKS2 tokens, in order to indicate
+// which versions of this package can read them. This allows a mismatch between
+// the version of this package that created an artifact (eg, from the OS) and
+// the version that reads it (eg, from the initrd) to be reported clearly,
+// rather than as a parse failure.
+//
+// Artifacts written by older versions of this package don't have a header,
+// and can be read by all versions.
+type ArtifactHeader = artifact.Header
+
+// NewArtifactHeader returns a new header for an artifact produced by this
+// package, which can be read by any version of this package with an
+// ArtifactFormatVersion of at least minReaderVersion.
+func NewArtifactHeader(minReaderVersion int) *ArtifactHeader {
+	return artifact.NewHeader(minReaderVersion)
+}
+
+// ArtifactVersionError is returned when reading an artifact that was written
+// by a newer version of this package, in a format that this version cannot
+// read.
+type ArtifactVersionError = artifact.VersionError
+
+// CheckArtifactHeader checks that an artifact of the specified type with the
+// supplied header can be read by this version of this package. A nil header
+// corresponds to an artifact written before headers were introduced, which
+// can always be read. If the artifact requires a newer version of this
+// package, a *ArtifactVersionError error is returned.
+func CheckArtifactHeader(artifactType string, hdr *ArtifactHeader) error {
+	return artifact.Check(artifactType, hdr)
+}
+
+// VersionedPlatformHandle can be implemented by a platform handle supplied
+// via KeyParams or KeyData.MarshalAndUpdatePlatformHandle if it uses a format
+// that can only be read by newer versions of this package. The header of the
+// key data is updated to indicate this.
+type VersionedPlatformHandle interface {
+	// MinReaderVersion returns the minimum ArtifactFormatVersion required
+	// to read this handle.
+	MinReaderVersion() int
+}
+
+func platformHandleMinReaderVersion(handle interface{}) int {
+	if h, ok := handle.(VersionedPlatformHandle); ok {
+		return h.MinReaderVersion()
+	}
+	return 1
+}
@@ -0,0 +1,213 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/cbor"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockVersionedPlatformHandle struct {
+	Version int `json:"version"`
+}
+
+func (h *mockVersionedPlatformHandle) MinReaderVersion() int {
+	return h.Version
+}
+
+type artifactVersionSuite struct{}
+
+var _ = Suite(&artifactVersionSuite{})
+
+func (s *artifactVersionSuite) writtenKeyDataHeader(c *C, kd *KeyData) interface{} {
+	w := makeMockKeyDataWriter()
+	c.Assert(kd.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(w.final.Bytes(), &j), IsNil)
+	return j["secboot"]
+}
+
+func (s *artifactVersionSuite) TestNewArtifactHeader(c *C) {
+	c.Check(NewArtifactHeader(1), DeepEquals, &ArtifactHeader{
+		Magic:            "secboot",
+		ProducerVersion:  ArtifactFormatVersion,
+		MinReaderVersion: 1})
+}
+
+func (s *artifactVersionSuite) TestCheckArtifactHeaderNil(c *C) {
+	c.Check(CheckArtifactHeader("foo", nil), IsNil)
+}
+
+func (s *artifactVersionSuite) TestCheckArtifactHeaderCurrent(c *C) {
+	c.Check(CheckArtifactHeader("foo", NewArtifactHeader(ArtifactFormatVersion)), IsNil)
+}
+
+func (s *artifactVersionSuite) TestCheckArtifactHeaderNewerProducer(c *C) {
+	// Artifacts from newer producers can be read if they don't require a
+	// newer reader.
+	c.Check(CheckArtifactHeader("foo", &ArtifactHeader{
+		Magic:            "secboot",
+		ProducerVersion:  ArtifactFormatVersion + 5,
+		MinReaderVersion: ArtifactFormatVersion}), IsNil)
+}
+
+func (s *artifactVersionSuite) TestCheckArtifactHeaderRequiresNewer(c *C) {
+	err := CheckArtifactHeader("foo", &ArtifactHeader{
+		Magic:            "secboot",
+		ProducerVersion:  ArtifactFormatVersion + 1,
+		MinReaderVersion: ArtifactFormatVersion + 1})
+	c.Check(err, ErrorMatches, `foo requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Assert(err, testutil.ConvertibleTo, &ArtifactVersionError{})
+	c.Check(err.(*ArtifactVersionError).Artifact, Equals, "foo")
+	c.Check(err.(*ArtifactVersionError).ProducerVersion, Equals, ArtifactFormatVersion+1)
+	c.Check(err.(*ArtifactVersionError).MinReaderVersion, Equals, ArtifactFormatVersion+1)
+}
+
+func (s *artifactVersionSuite) TestCheckArtifactHeaderInvalidMagic(c *C) {
+	c.Check(CheckArtifactHeader("foo", &ArtifactHeader{Magic: "bar", MinReaderVersion: 1}), ErrorMatches, `invalid foo header: invalid magic "bar"`)
+}
+
+func (s *artifactVersionSuite) TestReadKeyDataRequiresNewer(c *C) {
+	// Use a field with an incompatible type to check that the version is
+	// reported instead of a decoding error.
+	data := []byte(`{"secboot":{"magic":"secboot","producer_version":3,"min_reader_version":3},"generation":2,"platform_name":{"new":"format"}}`)
+	_, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(data)})
+	c.Check(err, ErrorMatches, `key data requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Check(err, testutil.ConvertibleTo, &ArtifactVersionError{})
+}
+
+func (s *artifactVersionSuite) TestNewKeyDataHeader(c *C) {
+	kd, err := NewKeyData(&KeyParams{
+		Handle:           &mockPlatformKeyDataHandle{},
+		EncryptedPayload: []byte("foo"),
+		PlatformName:     "mock",
+		KDFAlg:           crypto.SHA256})
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(kd.WriteAtomic(w), IsNil)
+
+	data := w.final.Bytes()
+
+	var j map[string]interface{}
+	c.Check(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["secboot"], DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(ArtifactFormatVersion),
+		"min_reader_version": float64(1)})
+
+	// The header should be preserved when converting to CBOR.
+	cborData, err := ConvertKeyDataFormat(data, KeyDataFormatCBOR)
+	c.Assert(err, IsNil)
+	_, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(cborData)})
+	c.Check(err, IsNil)
+}
+
+func (s *artifactVersionSuite) TestReadKeyDataCBORRequiresNewer(c *C) {
+	data, err := cbor.Marshal(map[interface{}]interface{}{
+		"secboot":         map[interface{}]interface{}{"magic": "secboot", "producer_version": uint64(3), "min_reader_version": uint64(3)},
+		"platform_name":   "mock",
+		"platform_handle": []byte("{}")})
+	c.Assert(err, IsNil)
+	cborData := append([]byte{0x01}, data...)
+
+	_, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(cborData)})
+	c.Check(err, ErrorMatches, `key data requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Check(err, testutil.ConvertibleTo, &ArtifactVersionError{})
+}
+
+func (s *artifactVersionSuite) TestReadKeyDataNoHeader(c *C) {
+	data := []byte(`{"generation":2,"platform_name":"mock","platform_handle":{},"role":"foo","kdf_alg":"sha256","encrypted_payload":"AAAA"}`)
+	kd, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(data)})
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, "mock")
+}
+
+func (s *artifactVersionSuite) TestProvisionedSecretHeader(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, make(PrimaryKey, 32), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+	c.Check(secret.Header, DeepEquals, NewArtifactHeader(1))
+}
+
+func (s *artifactVersionSuite) TestReadProvisionedSecretRequiresNewer(c *C) {
+	_, err := ReadProvisionedSecret(bytes.NewReader([]byte(`{"secboot":{"magic":"secboot","producer_version":4,"min_reader_version":4},"name":"foo","role":"network"}`)))
+	c.Check(err, ErrorMatches, `provisioned secret requires newer secboot \(format version 4 is required, but this version only supports 2\)`)
+}
+
+func (s *artifactVersionSuite) TestNewKeyDataVersionedHandle(c *C) {
+	kd, err := NewKeyData(&KeyParams{
+		Handle:           &mockVersionedPlatformHandle{Version: 2},
+		EncryptedPayload: []byte("foo"),
+		PlatformName:     "mock",
+		KDFAlg:           crypto.SHA256})
+	c.Assert(err, IsNil)
+	c.Check(s.writtenKeyDataHeader(c, kd), DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(ArtifactFormatVersion),
+		"min_reader_version": float64(2)})
+}
+
+func (s *artifactVersionSuite) TestMarshalAndUpdatePlatformHandleVersioned(c *C) {
+	kd, err := NewKeyData(&KeyParams{
+		Handle:           &mockPlatformKeyDataHandle{},
+		EncryptedPayload: []byte("foo"),
+		PlatformName:     "mock",
+		KDFAlg:           crypto.SHA256})
+	c.Assert(err, IsNil)
+
+	c.Check(kd.MarshalAndUpdatePlatformHandle(&mockVersionedPlatformHandle{Version: 2}), IsNil)
+	c.Check(s.writtenKeyDataHeader(c, kd), DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(ArtifactFormatVersion),
+		"min_reader_version": float64(2)})
+
+	// The minimum reader version is never lowered.
+	c.Check(kd.MarshalAndUpdatePlatformHandle(&mockPlatformKeyDataHandle{}), IsNil)
+	c.Check(s.writtenKeyDataHeader(c, kd), DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(ArtifactFormatVersion),
+		"min_reader_version": float64(2)})
+}
+
+func (s *artifactVersionSuite) TestMarshalAndUpdatePlatformHandleNoHeader(c *C) {
+	data := []byte(`{"generation":2,"platform_name":"mock","platform_handle":{},"role":"foo","kdf_alg":"sha256","encrypted_payload":"AAAA"}`)
+	kd, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(data)})
+	c.Assert(err, IsNil)
+
+	// Key data without a header stays that way unless it requires a newer
+	// reader.
+	c.Check(kd.MarshalAndUpdatePlatformHandle(&mockPlatformKeyDataHandle{}), IsNil)
+	c.Check(s.writtenKeyDataHeader(c, kd), IsNil)
+
+	c.Check(kd.MarshalAndUpdatePlatformHandle(&mockVersionedPlatformHandle{Version: 2}), IsNil)
+	c.Check(s.writtenKeyDataHeader(c, kd), DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(ArtifactFormatVersion),
+		"min_reader_version": float64(2)})
+}
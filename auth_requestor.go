@@ -30,3 +30,22 @@ type AuthRequestor interface {
 	// container at the specified sourceDevicePath.
 	RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error)
 }
+
+// AuthRequestorNotifier may optionally be implemented by an AuthRequestor in
+// order to receive messages for the user that aren't requests for credentials,
+// such as a warning about the number of remaining attempts after an incorrect
+// credential was supplied. The message is localized with the catalog installed
+// by SetMessageCatalog. It is up to the implementation how it is displayed.
+type AuthRequestorNotifier interface {
+	NotifyUser(volumeName, sourceDevicePath, msg string)
+}
+
+// notifyUser sends the specified message to the supplied AuthRequestor if it
+// implements AuthRequestorNotifier.
+func notifyUser(authRequestor AuthRequestor, id MessageID, params *MessageParams) {
+	notifier, ok := authRequestor.(AuthRequestorNotifier)
+	if !ok {
+		return
+	}
+	notifier.NotifyUser(params.VolumeName, params.SourceDevicePath, FormatMessage(id, params))
+}
@@ -41,6 +41,33 @@ type askPasswordMsgParams struct {
 type systemdAuthRequestor struct {
 	passphraseTmpl  *template.Template
 	recoveryKeyTmpl *template.Template
+
+	// notices contains messages from NotifyUser that will be
+	// displayed with the next request for a credential.
+	notices []string
+}
+
+func (r *systemdAuthRequestor) formatMessage(tmpl *template.Template, id MessageID, volumeName, sourceDevicePath string) (string, error) {
+	msg := new(bytes.Buffer)
+	for _, notice := range r.notices {
+		msg.WriteString(notice + " ")
+	}
+	r.notices = nil
+
+	if tmpl == nil {
+		msg.WriteString(FormatMessage(id, &MessageParams{
+			VolumeName:       volumeName,
+			SourceDevicePath: sourceDevicePath}))
+		return msg.String(), nil
+	}
+
+	params := askPasswordMsgParams{
+		VolumeName:       volumeName,
+		SourceDevicePath: sourceDevicePath}
+	if err := tmpl.Execute(msg, params); err != nil {
+		return "", xerrors.Errorf("cannot execute message template: %w", err)
+	}
+	return msg.String(), nil
 }
 
 func (r *systemdAuthRequestor) askPassword(sourceDevicePath, msg string) (string, error) {
@@ -64,29 +91,21 @@ func (r *systemdAuthRequestor) askPassword(sourceDevicePath, msg string) (string
 }
 
 func (r *systemdAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
-	params := askPasswordMsgParams{
-		VolumeName:       volumeName,
-		SourceDevicePath: sourceDevicePath}
-
-	msg := new(bytes.Buffer)
-	if err := r.passphraseTmpl.Execute(msg, params); err != nil {
-		return "", xerrors.Errorf("cannot execute message template: %w", err)
+	msg, err := r.formatMessage(r.passphraseTmpl, MessagePassphrasePrompt, volumeName, sourceDevicePath)
+	if err != nil {
+		return "", err
 	}
 
-	return r.askPassword(sourceDevicePath, msg.String())
+	return r.askPassword(sourceDevicePath, msg)
 }
 
 func (r *systemdAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
-	params := askPasswordMsgParams{
-		VolumeName:       volumeName,
-		SourceDevicePath: sourceDevicePath}
-
-	msg := new(bytes.Buffer)
-	if err := r.recoveryKeyTmpl.Execute(msg, params); err != nil {
-		return RecoveryKey{}, xerrors.Errorf("cannot execute message template: %w", err)
+	msg, err := r.formatMessage(r.recoveryKeyTmpl, MessageRecoveryKeyPrompt, volumeName, sourceDevicePath)
+	if err != nil {
+		return RecoveryKey{}, err
 	}
 
-	passphrase, err := r.askPassword(sourceDevicePath, msg.String())
+	passphrase, err := r.askPassword(sourceDevicePath, msg)
 	if err != nil {
 		return RecoveryKey{}, err
 	}
@@ -99,24 +118,44 @@ func (r *systemdAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath s
 	return key, nil
 }
 
+// NotifyUser implements AuthRequestorNotifier. As systemd-ask-password can only
+// display a message with a request, the message is displayed with the next
+// request for a credential.
+func (r *systemdAuthRequestor) NotifyUser(volumeName, sourceDevicePath, msg string) {
+	r.notices = append(r.notices, msg)
+}
+
 // NewSystemdAuthRequestor creates an implementation of AuthRequestor that
 // delegates to the systemd-ask-password binary. The supplied templates are
 // used to compose the messages that will be displayed when requesting a
 // credential. The template will be executed with the following parameters:
 // - .VolumeName: The name that the LUKS container will be mapped to.
 // - .SourceDevicePath: The device path of the LUKS container.
+//
+// If either template is empty, the corresponding MessagePassphrasePrompt or
+// MessageRecoveryKeyPrompt message is used instead, which can be localized with
+// SetMessageCatalog.
+//
+// The returned AuthRequestor implements AuthRequestorNotifier, and any
+// messages it receives are displayed with the next request.
 func NewSystemdAuthRequestor(passphraseTmpl, recoveryKeyTmpl string) (AuthRequestor, error) {
-	pt, err := template.New("passphraseMsg").Parse(passphraseTmpl)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot parse passphrase message template: %w", err)
+	r := new(systemdAuthRequestor)
+
+	if passphraseTmpl != "" {
+		pt, err := template.New("passphraseMsg").Parse(passphraseTmpl)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse passphrase message template: %w", err)
+		}
+		r.passphraseTmpl = pt
 	}
 
-	rkt, err := template.New("recoveryKeyMsg").Parse(recoveryKeyTmpl)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot parse recovery key message template: %w", err)
+	if recoveryKeyTmpl != "" {
+		rkt, err := template.New("recoveryKeyMsg").Parse(recoveryKeyTmpl)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse recovery key message template: %w", err)
+		}
+		r.recoveryKeyTmpl = rkt
 	}
 
-	return &systemdAuthRequestor{
-		passphraseTmpl:  pt,
-		recoveryKeyTmpl: rkt}, nil
+	return r, nil
 }
@@ -278,3 +278,52 @@ func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyFailure(c *C) {
 	_, err = requestor.RequestRecoveryKey("data", "/dev/sda1")
 	c.Check(err, ErrorMatches, "cannot execute systemd-ask-password: exit status 1")
 }
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseDefaultMsg(c *C) {
+	s.testRequestPassphrase(c, &testRequestPassphraseData{
+		passphrase:       "password",
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		expectedMsg:      "Enter passphrase for data (/dev/sda1):"})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseLocalizedMsg(c *C) {
+	SetMessageCatalog(mockMessageCatalog{
+		MessagePassphrasePrompt: "Geben Sie die Passphrase für {{.VolumeName}} ein:"})
+	defer SetMessageCatalog(nil)
+
+	s.testRequestPassphrase(c, &testRequestPassphraseData{
+		passphrase:       "password",
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		expectedMsg:      "Geben Sie die Passphrase für data ein:"})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyDefaultMsg(c *C) {
+	s.testRequestRecoveryKey(c, &testRequestRecoveryKeyData{
+		passphrase:       "00000-00000-00000-00000-00000-00000-00000-00000",
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		expectedMsg:      "Enter recovery key for data (/dev/sda1):"})
+}
+
+func (s *authRequestorSystemdSuite) TestNotifyUser(c *C) {
+	s.setPassphrase(c, "password")
+
+	requestor, err := NewSystemdAuthRequestor("Enter passphrase for {{.SourceDevicePath}}:", "")
+	c.Assert(err, IsNil)
+	c.Assert(requestor, Implements, new(AuthRequestorNotifier))
+
+	requestor.(AuthRequestorNotifier).NotifyUser("data", "/dev/sda1", "Incorrect passphrase.")
+
+	for _, expectedMsg := range []string{
+		"Incorrect passphrase. Enter passphrase for /dev/sda1:",
+		"Enter passphrase for /dev/sda1:", // The notice is only displayed once
+	} {
+		_, err := requestor.RequestPassphrase("data", "/dev/sda1")
+		c.Check(err, IsNil)
+		calls := s.mockSdAskPassword.Calls()
+		c.Check(calls[len(calls)-1], DeepEquals, []string{"systemd-ask-password", "--icon", "drive-harddisk",
+			"--id", filepath.Base(os.Args[0]) + ":/dev/sda1", expectedMsg})
+	}
+}
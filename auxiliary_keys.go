@@ -0,0 +1,101 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	_ "crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/keyring"
+)
+
+// FscryptKeySize is the size of the keys derived by AddFscryptKeyToKernel,
+// which is the maximum key size supported by fscrypt.
+const FscryptKeySize = 64
+
+// DeriveAuxiliaryKey derives an additional key of the specified size from the
+// primary key associated with an encrypted container, which can be used to
+// protect other data on the same device (eg, with fscrypt). This permits other
+// data to be protected by the same trust root as the encrypted container without
+// having to protect another key.
+//
+// The key is derived using HKDF-SHA256, with the label for the specified role
+// (see RoleDerivationLabel) as the salt, so different roles always produce
+// different keys. The role must be a valid name according to ValidateRoleName,
+// and it doesn't have to be registered. Callers should use a role that is
+// specific to each use, such as "fscrypt-home".
+func DeriveAuxiliaryKey(primaryKey PrimaryKey, role string, size int) ([]byte, error) {
+	if len(primaryKey) == 0 {
+		return nil, errors.New("no primary key")
+	}
+	if err := ValidateRoleName(role); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, errors.New("invalid key size")
+	}
+
+	r := hkdf.New(func() hash.Hash { return crypto.SHA256.New() }, primaryKey, RoleDerivationLabel(role), []byte("AUXILIARY"))
+	key := make([]byte, size)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+	return key, nil
+}
+
+var keyringAddFscryptKeyToFilesystem = keyring.AddFscryptKeyToFilesystem
+
+// AddFscryptKeyToKernel derives a key for the specified role with
+// DeriveAuxiliaryKey, from the primary key associated with the encrypted
+// container at the specified path, and adds it to the keyring of the filesystem
+// mounted at the specified mountpoint for use with a fscrypt v2 encryption
+// policy (such as for ext4 directory encryption). The primary key is obtained
+// from the kernel keyring with GetPrimaryKeyFromKernel, so the container must
+// have been unlocked with ActivateVolumeWithKeyData using the same prefix.
+//
+// On success, the key identifier computed by the kernel, which identifies the
+// key in an encryption policy, is returned as a hex string. The key is the same
+// each time that the container is unlocked, so directories that have been
+// encrypted with it can be unlocked on subsequent boots.
+func AddFscryptKeyToKernel(prefix, devicePath, role, mountpoint string) (identifier string, err error) {
+	primaryKey, err := GetPrimaryKeyFromKernel(prefix, devicePath, false)
+	if err != nil {
+		return "", xerrors.Errorf("cannot obtain primary key: %w", err)
+	}
+
+	key, err := DeriveAuxiliaryKey(primaryKey, role, FscryptKeySize)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := keyringAddFscryptKeyToFilesystem(mountpoint, key)
+	if err != nil {
+		return "", xerrors.Errorf("cannot add key to filesystem: %w", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
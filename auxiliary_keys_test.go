@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"syscall"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type auxiliaryKeysSuite struct{}
+
+var _ = Suite(&auxiliaryKeysSuite{})
+
+func (s *auxiliaryKeysSuite) primaryKey() PrimaryKey {
+	key := make(PrimaryKey, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func (s *auxiliaryKeysSuite) TestDeriveAuxiliaryKey(c *C) {
+	key, err := DeriveAuxiliaryKey(s.primaryKey(), "run", 32)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, testutil.DecodeHexString(c, "e0e9f86a1cbddb12a22508adf7a0d9e1be7c7da105b3c0781f2e971280cd5015"))
+}
+
+func (s *auxiliaryKeysSuite) TestDeriveAuxiliaryKeyDifferentRoles(c *C) {
+	key1, err := DeriveAuxiliaryKey(s.primaryKey(), "fscrypt-home", FscryptKeySize)
+	c.Check(err, IsNil)
+	c.Check(key1, HasLen, FscryptKeySize)
+
+	key2, err := DeriveAuxiliaryKey(s.primaryKey(), "fscrypt-data", FscryptKeySize)
+	c.Check(err, IsNil)
+	c.Check(key2, HasLen, FscryptKeySize)
+	c.Check(key1, Not(DeepEquals), key2)
+
+	// The same role always produces the same key.
+	key3, err := DeriveAuxiliaryKey(s.primaryKey(), "fscrypt-home", FscryptKeySize)
+	c.Check(err, IsNil)
+	c.Check(key3, DeepEquals, key1)
+}
+
+func (s *auxiliaryKeysSuite) TestDeriveAuxiliaryKeyInvalidRole(c *C) {
+	_, err := DeriveAuxiliaryKey(s.primaryKey(), "UNLOCK", 32)
+	c.Check(err, ErrorMatches, `invalid role "UNLOCK": .*`)
+}
+
+func (s *auxiliaryKeysSuite) TestDeriveAuxiliaryKeyNoPrimaryKey(c *C) {
+	_, err := DeriveAuxiliaryKey(nil, "run", 32)
+	c.Check(err, ErrorMatches, `no primary key`)
+}
+
+func (s *auxiliaryKeysSuite) TestDeriveAuxiliaryKeyInvalidSize(c *C) {
+	_, err := DeriveAuxiliaryKey(s.primaryKey(), "run", 0)
+	c.Check(err, ErrorMatches, `invalid key size`)
+}
+
+type auxiliaryKeysKeyringSuite struct {
+	testutil.KeyringTestBase
+}
+
+var _ = Suite(&auxiliaryKeysKeyringSuite{})
+
+func (s *auxiliaryKeysKeyringSuite) SetUpSuite(c *C) {
+	s.KeyringTestBase.SetUpSuite(c)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.Skip("Test requires the user keyring to be linked from the process's session keyring")
+	}
+}
+
+func (s *auxiliaryKeysKeyringSuite) TestAddFscryptKeyToKernel(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKeyToUserKeyring(primaryKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	expected, err := DeriveAuxiliaryKey(primaryKey, "fscrypt-home", FscryptKeySize)
+	c.Assert(err, IsNil)
+
+	restore := MockKeyringAddFscryptKeyToFilesystem(func(mountpoint string, key []byte) ([]byte, error) {
+		c.Check(mountpoint, Equals, "/home")
+		c.Check(key, DeepEquals, expected)
+		return testutil.DecodeHexString(c, "0123456789abcdef0123456789abcdef"), nil
+	})
+	defer restore()
+
+	identifier, err := AddFscryptKeyToKernel("", "/dev/sda1", "fscrypt-home", "/home")
+	c.Check(err, IsNil)
+	c.Check(identifier, Equals, "0123456789abcdef0123456789abcdef")
+}
+
+func (s *auxiliaryKeysKeyringSuite) TestAddFscryptKeyToKernelError(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKeyToUserKeyring(primaryKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	restore := MockKeyringAddFscryptKeyToFilesystem(func(string, []byte) ([]byte, error) {
+		return nil, syscall.ENOTTY
+	})
+	defer restore()
+
+	_, err := AddFscryptKeyToKernel("", "/dev/sda1", "fscrypt-home", "/home")
+	c.Check(err, ErrorMatches, `cannot add key to filesystem: inappropriate ioctl for device`)
+}
+
+func (s *auxiliaryKeysKeyringSuite) TestAddFscryptKeyToKernelNoPrimaryKey(c *C) {
+	_, err := AddFscryptKeyToKernel("", "/dev/sda1", "fscrypt-home", "/home")
+	c.Check(err, ErrorMatches, `cannot obtain primary key: cannot find key in kernel keyring`)
+}
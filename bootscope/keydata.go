@@ -237,7 +237,7 @@ func (d *KeyDataScope) deriveSigner(key secboot.PrimaryKey, role string) (crypto
 		return nil, errors.New("KDF algorithm unavailable")
 	}
 
-	r := hkdf.New(func() hash.Hash { return alg.New() }, key, []byte(role), []byte("SCOPE-AUTH"))
+	r := hkdf.New(func() hash.Hash { return alg.New() }, key, secboot.RoleDerivationLabel(role), []byte("SCOPE-AUTH"))
 	return internal_crypto.GenerateECDSAKey(elliptic.P256(), r)
 }
 
@@ -21,18 +21,19 @@ package secboot
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"time"
 
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 
 	internal_bootscope "github.com/snapcore/secboot/internal/bootscope"
-	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luksview"
 )
@@ -43,14 +44,32 @@ var (
 	// required features.
 	ErrMissingCryptsetupFeature = luks2.ErrMissingCryptsetupFeature
 
-	luks2Activate        = luks2.Activate
-	luks2AddKey          = luks2.AddKey
-	luks2Deactivate      = luks2.Deactivate
-	luks2Format          = luks2.Format
-	luks2ImportToken     = luks2.ImportToken
-	luks2KillSlot        = luks2.KillSlot
-	luks2RemoveToken     = luks2.RemoveToken
-	luks2SetSlotPriority = luks2.SetSlotPriority
+	// ErrMissingCryptsetup is returned from functions that create or modify
+	// LUKS2 containers if the system's cryptsetup binary can't be found.
+	ErrMissingCryptsetup = luks2.ErrMissingCryptsetup
+
+	// ErrMissingSystemdCryptsetup is returned from functions that activate or
+	// deactivate LUKS2 containers if the systemd-cryptsetup binary can't be
+	// found.
+	ErrMissingSystemdCryptsetup = luks2.ErrMissingSystemdCryptsetup
+
+	// ErrDeviceNeverAppeared is returned from the ActivateVolumeWith*
+	// family of functions if the DeviceTimeout field of
+	// ActivateVolumeOptions is set and the source device doesn't appear
+	// before it expires.
+	ErrDeviceNeverAppeared = luks2.ErrDeviceNeverAppeared
+
+	luks2Activate            = luks2.Activate
+	luks2ActivateWithKeyFile = luks2.ActivateWithKeyFile
+	luks2AddKey              = luks2.AddKey
+	luks2Deactivate          = luks2.Deactivate
+	luks2Format              = luks2.Format
+	luks2ImportToken         = luks2.ImportToken
+	luks2KillSlot            = luks2.KillSlot
+	luks2RemoveToken         = luks2.RemoveToken
+	luks2SetSlotPriority     = luks2.SetSlotPriority
+	luks2TestKey             = luks2.TestKey
+	luks2WaitForDevice       = luks2.WaitForDevice
 
 	newLUKSView = luksview.NewView
 
@@ -109,12 +128,12 @@ func ParseRecoveryKey(s string) (out RecoveryKey, err error) {
 }
 
 type activateWithKeyDataError struct {
-	k   *KeyData
-	err error
+	name string
+	err  error
 }
 
 func (e *activateWithKeyDataError) Error() string {
-	return fmt.Sprintf("%s: %v", e.k.ReadableName(), e.err)
+	return fmt.Sprintf("%s: %v", e.name, e.err)
 }
 
 func (e *activateWithKeyDataError) Unwrap() error {
@@ -131,24 +150,84 @@ type activateWithKeyDataState struct {
 	volumeName        string
 	sourceDevicePath  string
 	legacyDevicePaths []string
-	keyringPrefix     string
+	keyring           *keyringConfig
 
 	authRequestor   AuthRequestor
 	passphraseTries int
 
+	progress *activationProgress
+	reports  *ActivationReportLog
+
+	externalKey    DiskUnlockKey
+	externalKeyErr error
+
 	keys []*keyCandidate
 }
 
 func (s *activateWithKeyDataState) errors() (out []*activateWithKeyDataError) {
+	if s.externalKeyErr != nil {
+		out = append(out, &activateWithKeyDataError{name: externalUnlockKeyName, err: s.externalKeyErr})
+	}
 	for _, k := range s.keys {
 		if k.err == nil {
 			continue
 		}
-		out = append(out, &activateWithKeyDataError{k: k.KeyData, err: k.err})
+		out = append(out, &activateWithKeyDataError{name: k.ReadableName(), err: k.err})
 	}
 	return out
 }
 
+// addToKeyring adds the supplied unlock key, auxiliary key (if there is one)
+// and unlock reason to the configured keyring for the source device, any legacy
+// device paths and the UUID of the container if this is enabled.
+func (s *activateWithKeyDataState) addToKeyring(key DiskUnlockKey, auxKey PrimaryKey, reason *UnlockReason) {
+	var firstDeviceStat uint64
+	foundFirstDevice := false
+	addToKeyring := func(devicePath string) {
+		var st unix.Stat_t
+		if err := unixStat(devicePath, &st); err != nil {
+			fmt.Fprintf(osStderr, "secboot: cannot read device path %s: %v\n", devicePath, err)
+			if foundFirstDevice {
+				return
+			}
+		} else if (st.Mode & unix.S_IFBLK) == 0 {
+			fmt.Fprintf(osStderr, "secboot: device path %s is not a block device\n", devicePath)
+			if foundFirstDevice {
+				return
+			}
+		} else if !foundFirstDevice {
+			firstDeviceStat = st.Rdev
+			foundFirstDevice = true
+		} else if firstDeviceStat != uint64(st.Rdev) {
+			fmt.Fprintf(osStderr, "secboot: device path %s is a different device", devicePath)
+			return
+		}
+
+		s.keyring.addUnlockKeys(devicePath, key, auxKey, reason)
+	}
+
+	addToKeyring(s.sourceDevicePath)
+	for _, devicePath := range s.legacyDevicePaths {
+		addToKeyring(devicePath)
+	}
+	s.keyring.addUnlockKeysForUUID(key, auxKey, reason)
+}
+
+func (s *activateWithKeyDataState) tryExternalKey() error {
+	if err := s.progress.begin(ActivationStageActivate); err != nil {
+		return err
+	}
+	if err := activateVolume(s.volumeName, s.sourceDevicePath, s.externalKey, luks2.AnySlot); err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
+	}
+
+	reason := newUnlockReasonForExternalKey()
+	s.addToKeyring(s.externalKey, nil, reason)
+	appendActivationReport(s.reports, s.volumeName, s.sourceDevicePath, reason)
+
+	return nil
+}
+
 func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(key DiskUnlockKey, slot int, keyData *KeyData, auxKey PrimaryKey) error {
 	// Snap model checking is skipped for generation 2 keys because it's part of the platform
 	// implementation now. It's performed and is mandatory for gen 1 keys, where it was part of
@@ -179,52 +258,31 @@ func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(key DiskUnlockKey
 		}
 	}
 
-	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key, slot); err != nil {
+	if err := s.progress.begin(ActivationStageActivate); err != nil {
+		return err
+	}
+	if err := activateVolume(s.volumeName, s.sourceDevicePath, key, slot); err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
-	var firstDeviceStat uint64
-	foundFirstDevice := false
-	addToKeyring := func(devicePath string) {
-		var st unix.Stat_t
-		if err := unixStat(devicePath, &st); err != nil {
-			fmt.Fprintf(osStderr, "secboot: cannot read device path %s: %v\n", devicePath, err)
-			if foundFirstDevice {
-				return
-			}
-		} else if (st.Mode & unix.S_IFBLK) == 0 {
-			fmt.Fprintf(osStderr, "secboot: device path %s is not a block device\n", devicePath)
-			if foundFirstDevice {
-				return
-			}
-		} else if !foundFirstDevice {
-			firstDeviceStat = st.Rdev
-			foundFirstDevice = true
-		} else if firstDeviceStat != uint64(st.Rdev) {
-			fmt.Fprintf(osStderr, "secboot: device path %s is a different device", devicePath)
-			return
-		}
-
-		if err := keyring.AddKeyToUserKeyring(key, devicePath, keyringPurposeDiskUnlock, s.keyringPrefix); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
-		}
-
-		if err := keyring.AddKeyToUserKeyring(auxKey, devicePath, keyringPurposeAuxiliary, s.keyringPrefix); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
-		}
-	}
-
-	addToKeyring(s.sourceDevicePath)
-	for _, devicePath := range s.legacyDevicePaths {
-		addToKeyring(devicePath)
-	}
+	reason := newUnlockReasonForKeyData(keyData)
+	s.addToKeyring(key, auxKey, reason)
+	appendActivationReport(s.reports, s.volumeName, s.sourceDevicePath, reason)
 
 	return nil
 }
 
 func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData, slot int) error {
-	key, auxKey, err := k.RecoverKeys()
-	if err != nil {
+	if err := s.progress.begin(ActivationStageRecoverKey); err != nil {
+		return err
+	}
+	ctx, cancel := s.progress.newContext()
+	defer cancel()
+	key, auxKey, err := k.RecoverKeysContext(ctx)
+	switch {
+	case xerrors.Is(err, context.DeadlineExceeded):
+		return ErrActivationDeadlineExceeded
+	case err != nil:
 		return xerrors.Errorf("cannot recover key: %w", err)
 	}
 
@@ -232,8 +290,16 @@ func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData, slot int)
 }
 
 func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *KeyData, slot int, passphrase string) error {
-	key, auxKey, err := k.RecoverKeysWithPassphrase(passphrase)
-	if err != nil {
+	if err := s.progress.begin(ActivationStageRecoverKeyWithPassphrase); err != nil {
+		return err
+	}
+	ctx, cancel := s.progress.newContext()
+	defer cancel()
+	key, auxKey, err := k.RecoverKeysWithPassphraseContext(ctx, passphrase)
+	switch {
+	case xerrors.Is(err, context.DeadlineExceeded):
+		return ErrActivationDeadlineExceeded
+	case err != nil:
 		return xerrors.Errorf("cannot recover key: %w", err)
 	}
 
@@ -241,10 +307,27 @@ func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *KeyData, slot
 }
 
 func (s *activateWithKeyDataState) run() (success bool, err error) {
+	// Try the externally supplied key first, if there is one.
+	if s.externalKey != nil {
+		err := s.tryExternalKey()
+		if err == nil {
+			return true, nil
+		}
+		if err == ErrActivationDeadlineExceeded {
+			return false, err
+		}
+		s.externalKeyErr = err
+	}
+
 	numPassphraseKeys := 0
 
 	// Try keys that don't require any additional authentication first
 	for _, k := range s.keys {
+		if k.err != nil {
+			// Skip keys that have already been rejected.
+			continue
+		}
+
 		if k.AuthMode()&AuthModePassphrase > 0 {
 			numPassphraseKeys += 1
 		}
@@ -254,6 +337,9 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 		}
 
 		if err := s.tryKeyDataAuthModeNone(k.KeyData, k.slot); err != nil {
+			if err == ErrActivationDeadlineExceeded {
+				return false, err
+			}
 			k.err = err
 			continue
 		}
@@ -276,6 +362,9 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 		// a maximum of 2 keys with passphrases enabled (Ubuntu Core based desktop on
 		// a UEFI+TPM platform with run+recovery and recovery-only protectors for
 		// ubuntu-data).
+		if err := s.progress.begin(ActivationStageRequestPassphrase); err != nil {
+			return false, err
+		}
 		passphrase, err := s.authRequestor.RequestPassphrase(s.volumeName, s.sourceDevicePath)
 		if err != nil {
 			passphraseErr = xerrors.Errorf("cannot obtain passphrase: %w", err)
@@ -293,6 +382,9 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 			}
 
 			if err := s.tryKeyDataAuthModePassphrase(k.KeyData, k.slot, passphrase); err != nil {
+				if err == ErrActivationDeadlineExceeded {
+					return false, err
+				}
 				if !xerrors.Is(err, ErrInvalidPassphrase) {
 					numPassphraseKeys -= 1
 				}
@@ -302,47 +394,81 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 
 			return true, nil
 		}
+
+		if tries > 0 && numPassphraseKeys > 0 {
+			notifyUser(s.authRequestor, MessagePassphraseTriesRemaining, &MessageParams{
+				VolumeName:       s.volumeName,
+				SourceDevicePath: s.sourceDevicePath,
+				TriesRemaining:   tries})
+		}
 	}
 
 	// We've failed at this point
 	return false, passphraseErr
 }
 
-func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyringPrefix string, keys []*keyCandidate, authRequestor AuthRequestor, passphraseTries int, legacyDevicePaths []string) *activateWithKeyDataState {
+func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyring *keyringConfig, externalKey DiskUnlockKey, keys []*keyCandidate, authRequestor AuthRequestor, passphraseTries int, legacyDevicePaths []string, progress *activationProgress, reports *ActivationReportLog) *activateWithKeyDataState {
 	return &activateWithKeyDataState{
 		volumeName:        volumeName,
 		sourceDevicePath:  sourceDevicePath,
 		legacyDevicePaths: legacyDevicePaths,
-		keyringPrefix:     keyringPrefixOrDefault(keyringPrefix),
+		keyring:           keyring,
 		authRequestor:     authRequestor,
 		passphraseTries:   passphraseTries,
+		progress:          progress,
+		reports:           reports,
+		externalKey:       externalKey,
 		keys:              keys}
 }
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, authRequestor AuthRequestor, tries int, keyringPrefix string) error {
+func activateWithRecoveryKey(volumeName, sourceDevicePath string, view *luksview.View, authRequestor AuthRequestor, tries int, keyring *keyringConfig, keyErrors []*activateWithKeyDataError, progress *activationProgress, reports *ActivationReportLog) error {
 	if tries == 0 {
 		return errors.New("no recovery key tries permitted")
 	}
 
+	slots, err := recoveryKeyslotsForActivation(view)
+	if err != nil {
+		return err
+	}
+
 	var lastErr error
 
 	for ; tries > 0; tries-- {
 		lastErr = nil
 
+		if err := progress.begin(ActivationStageRequestRecoveryKey); err != nil {
+			return err
+		}
 		key, err := authRequestor.RequestRecoveryKey(volumeName, sourceDevicePath)
 		if err != nil {
 			lastErr = xerrors.Errorf("cannot obtain recovery key: %w", err)
 			continue
 		}
 
-		if err := luks2Activate(volumeName, sourceDevicePath, key[:], luks2.AnySlot); err != nil {
+		if err := progress.begin(ActivationStageActivate); err != nil {
+			return err
+		}
+		var keyslotName string
+		if slots == nil {
+			err = activateVolume(volumeName, sourceDevicePath, key[:], luks2.AnySlot)
+		} else {
+			keyslotName, err = activateWithRecoveryKeyslots(volumeName, sourceDevicePath, key, slots)
+		}
+		if err != nil {
 			lastErr = xerrors.Errorf("cannot activate volume: %w", err)
+			if tries > 1 {
+				notifyUser(authRequestor, MessageRecoveryKeyTriesRemaining, &MessageParams{
+					VolumeName:       volumeName,
+					SourceDevicePath: sourceDevicePath,
+					TriesRemaining:   tries - 1})
+			}
 			continue
 		}
 
-		if err := keyring.AddKeyToUserKeyring(key[:], sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
-		}
+		reason := newUnlockReasonForRecoveryKey(keyslotName, keyErrors)
+		keyring.addUnlockKeys(sourceDevicePath, key[:], nil, reason)
+		keyring.addUnlockKeysForUUID(key[:], nil, reason)
+		appendActivationReport(reports, volumeName, sourceDevicePath, reason)
 
 		break
 	}
@@ -391,10 +517,94 @@ type ActivateVolumeOptions struct {
 	// kernel keys created during activation.
 	KeyringPrefix string
 
+	// KeyringTarget specifies the kernel keyring that keys created
+	// during activation are added to. The default is the user keyring.
+	KeyringTarget KeyringTarget
+
+	// KeyringInstance identifies the unlocker that is performing
+	// activation. If set, it is appended to the description of any
+	// kernel keys created during activation so that keys added for the
+	// same device by different unlockers don't replace each other. Keys
+	// added with different instances can be enumerated with
+	// GetDiskUnlockKeysFromKernel.
+	KeyringInstance string
+
+	// KeyringUseDeviceUUID indicates that kernel keys created during
+	// activation should also be added for the UUID of the encrypted
+	// container, in addition to the source device path, so that they
+	// can be found without knowing which path was used for activation
+	// (see KeyringDeviceForUUID).
+	KeyringUseDeviceUUID bool
+
 	// LegacyDevicePaths are the device paths to register keys to
 	// keyring. This is useful when snap-bootstrap boots to an
 	// older version of snapd.
 	LegacyDevicePaths []string
+
+	// Deadline specifies the time by which activation must complete.
+	// It is checked before each step of activation (recovering a key,
+	// requesting a passphrase or recovery key, and activating the
+	// volume), and if it has expired, activation stops and
+	// ErrActivationDeadlineExceeded is returned without falling back
+	// to the recovery key. A step that is already in progress is not
+	// interrupted. The zero value means that there is no deadline.
+	Deadline time.Time
+
+	// ProgressReporter is notified before each step of activation. This
+	// can be used to keep a service manager's watchdog informed about
+	// slow operations (see NewSystemdNotifyProgressReporter).
+	ProgressReporter ActivationProgressReporter
+
+	// DeviceTimeout specifies how long to wait for the source device to
+	// appear before activation is attempted, which is useful for devices
+	// that are slow to be probed, such as USB disks. Pending udev events
+	// are processed first, and then the source device path (which will
+	// generally be a /dev/disk/by-uuid or /dev/disk/by-label symlink) is
+	// polled. If the device doesn't appear before the timeout expires,
+	// ErrDeviceNeverAppeared is returned. The wait is also limited by
+	// Deadline. The zero value means that there is no wait.
+	DeviceTimeout time.Duration
+
+	// ActivationReportLog is used to record a signed ActivationReport for
+	// each successful activation, which can later be used to prove when
+	// and how a volume was unlocked. A failure to record a report is
+	// logged but does not cause activation to fail. It is ignored by
+	// ActivateVolumeWithKey.
+	ActivationReportLog *ActivationReportLog
+
+	// ExternalUnlockKey is an unlock key supplied by the caller, eg, one
+	// that has been retrieved from a network service. If set,
+	// ActivateVolumeWithKeyData attempts to activate the volume with it
+	// before trying any KeyData objects. If this fails, the error is
+	// recorded in the same way as for a KeyData and activation continues
+	// with the KeyData objects as normal. On success, the unlock reason
+	// and activation report record UnlockMethodExternalKey. It is ignored
+	// by the other ActivateVolumeWith* functions.
+	ExternalUnlockKey DiskUnlockKey
+}
+
+// keyCandidatesFromLUKS2Tokens returns a candidate for each initialized KeyData
+// token in the supplied view, in priority order. Tokens that cannot be decoded
+// are skipped.
+func keyCandidatesFromLUKS2Tokens(sourceDevicePath string, view *luksview.View) (candidates []*keyCandidate) {
+	for _, token := range view.KeyDataTokensByPriority() {
+		if token.Data == nil {
+			// Skip uninitialized token
+			continue
+		}
+
+		r := &LUKS2KeyDataReader{
+			name:   sourceDevicePath + ":" + token.Name(),
+			Reader: bytes.NewReader(token.Data)}
+		kd, err := ReadKeyData(r)
+		if err != nil {
+			fmt.Fprintf(osStderr, "secboot: cannot read keydata from token %s: %v\n", token.Name(), err)
+			continue
+		}
+
+		candidates = append(candidates, &keyCandidate{KeyData: kd, slot: token.Keyslots()[0]})
+	}
+	return candidates
 }
 
 type activateVolumeWithKeyDataError struct {
@@ -424,7 +634,9 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // systemd-cryptsetup.
 //
 // External KeyData objects can be supplied via the keys argument, and these
-// will be attempted first.
+// will be attempted first. A raw unlock key can also be supplied via the
+// ExternalUnlockKey field of options, in which case it is attempted before
+// any KeyData objects.
 //
 // If activation with all of the KeyData objects fails, this function will
 // attempt to activate it with the fallback recovery key instead. The fallback
@@ -441,11 +653,21 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // If the fallback recovery key is used for successfully for activation, an
 // ErrRecoveryKeyUsed error will be returned.
 //
+// If the Deadline field of options is set and it expires before activation
+// completes, an ErrActivationDeadlineExceeded error will be returned.
+//
+// If the DeviceTimeout field of options is set and the source device doesn't
+// appear before it expires, an ErrDeviceNeverAppeared error will be returned.
+//
 // If activation fails, an error will be returned.
 //
 // If activation with one of the KeyData objects succeeds (ie, no error is
 // returned), then the supplied SnapModel is authorized to access the data on
 // this volume.
+//
+// On successful activation, a record of how the volume was unlocked is added
+// to the kernel keyring with the unlock key, and can be retrieved with
+// GetUnlockReasonFromKernel.
 func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequestor AuthRequestor, options *ActivateVolumeOptions, keys ...*KeyData) error {
 	if options.PassphraseTries < 0 {
 		return errors.New("invalid PassphraseTries")
@@ -457,6 +679,17 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 		return errors.New("nil authRequestor")
 	}
 
+	release, err := reserveResource(ResourceParallelActivations, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	progress := newActivationProgress(volumeName, sourceDevicePath, options)
+	if err := progress.waitForDevice(options.DeviceTimeout); err != nil {
+		return err
+	}
+
 	var candidates []*keyCandidate
 	for _, key := range keys {
 		candidates = append(candidates, &keyCandidate{KeyData: key, slot: luks2.AnySlot})
@@ -466,34 +699,24 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 	if err != nil {
 		fmt.Fprintf(osStderr, "secboot: cannot obtain LUKS2 header view: %v\n", err)
 	} else {
-		tokens := view.KeyDataTokensByPriority()
-		for _, token := range tokens {
-			if token.Data == nil {
-				// Skip uninitialized token
-				continue
-			}
-
-			r := &LUKS2KeyDataReader{
-				name:   sourceDevicePath + ":" + token.Name(),
-				Reader: bytes.NewReader(token.Data)}
-			kd, err := ReadKeyData(r)
-			if err != nil {
-				fmt.Fprintf(osStderr, "secboot: cannot read keydata from token %s: %v\n", token.Name(), err)
-				continue
-			}
-
-			candidates = append(candidates, &keyCandidate{KeyData: kd, slot: token.Keyslots()[0]})
-		}
+		candidates = append(candidates, keyCandidatesFromLUKS2Tokens(sourceDevicePath, view)...)
 	}
 
-	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options.KeyringPrefix, candidates, authRequestor, options.PassphraseTries, options.LegacyDevicePaths)
+	keyring := options.keyringConfig(view)
+	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, keyring, options.ExternalUnlockKey, candidates, authRequestor, options.PassphraseTries, options.LegacyDevicePaths, progress, options.ActivationReportLog)
 
 	success, err := s.run()
 	switch {
 	case success:
 		return nil
+	case err == ErrActivationDeadlineExceeded:
+		return err
 	default: // failed - try recovery key
-		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix); rErr != nil {
+		rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, view, authRequestor, options.RecoveryKeyTries, keyring, s.errors(), progress, options.ActivationReportLog)
+		if rErr == ErrActivationDeadlineExceeded {
+			return rErr
+		}
+		if rErr != nil {
 			// failed with recovery key - return errors
 			var kdErrs []error
 			for _, e := range s.errors() {
@@ -509,6 +732,166 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 	}
 }
 
+// RecoveryKeyFallbackPolicy determines when ActivateVolumeWithMultipleKeyData
+// falls back to activating with the recovery key.
+type RecoveryKeyFallbackPolicy int
+
+const (
+	// RecoveryKeyFallbackAlways indicates that activation should fall back
+	// to the recovery key whenever activation with all of the KeyData
+	// objects fails. This is the default.
+	RecoveryKeyFallbackAlways RecoveryKeyFallbackPolicy = iota
+
+	// RecoveryKeyFallbackIfNoKeyData indicates that activation should only
+	// fall back to the recovery key if none of the sources provided a
+	// KeyData object that could be attempted, eg, because the container
+	// has not been provisioned with any yet. If any KeyData objects were
+	// attempted and failed, no fallback occurs.
+	RecoveryKeyFallbackIfNoKeyData
+
+	// RecoveryKeyFallbackNever indicates that activation should never fall
+	// back to the recovery key.
+	RecoveryKeyFallbackNever
+)
+
+// ActivateVolumeWithMultipleKeyDataOptions provides options to
+// ActivateVolumeWithMultipleKeyData.
+type ActivateVolumeWithMultipleKeyDataOptions struct {
+	ActivateVolumeOptions
+
+	// RecoveryKeyFallback determines when activation falls back to the
+	// recovery key. The number of attempts is still limited by the
+	// RecoveryKeyTries field.
+	RecoveryKeyFallback RecoveryKeyFallbackPolicy
+}
+
+func (o *ActivateVolumeWithMultipleKeyDataOptions) permitsRecoveryKeyFallback(numUsableKeys int) bool {
+	switch o.RecoveryKeyFallback {
+	case RecoveryKeyFallbackIfNoKeyData:
+		return numUsableKeys == 0
+	case RecoveryKeyFallbackNever:
+		return false
+	default:
+		return true
+	}
+}
+
+var errRecoveryKeyFallbackNotPermitted = errors.New("recovery key fallback is not permitted")
+
+// ActivateVolumeWithMultipleKeyData attempts to activate the LUKS encrypted
+// container at sourceDevicePath and create a mapping with the name volumeName,
+// using the KeyData objects provided by the supplied sources to recover the disk
+// unlock key from the platform's secure device. This makes use of
+// systemd-cryptsetup.
+//
+// The sources are read in order, and the KeyData objects that don't require
+// any user authentication are attempted first, in the order that they are
+// provided. If these all fail, a passphrase is requested via the supplied
+// authRequestor and tested against each KeyData object that requires one, up
+// to the number of times specified by the PassphraseTries field of options. A
+// source can be restricted to providing keys with particular auth modes with
+// RestrictKeyDataSourceAuthModes. A source that cannot be read doesn't prevent
+// the other sources from being used.
+//
+// If activation with all of the KeyData objects fails, this function falls back
+// to the recovery key according to the RecoveryKeyFallback field of options, in
+// the same way as ActivateVolumeWithKeyData. If the recovery key is used
+// successfully for activation, an ErrRecoveryKeyUsed error will be returned.
+// If activation fails, the returned error includes the errors for each source
+// and KeyData object.
+//
+// The other fields of options behave in the same way as they do for
+// ActivateVolumeWithKeyData. Using NewLUKS2TokenKeyDataSource as the only source
+// is equivalent to calling ActivateVolumeWithKeyData without any external keys.
+func ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath string, authRequestor AuthRequestor, sources []KeyDataSource, options *ActivateVolumeWithMultipleKeyDataOptions) error {
+	if options.PassphraseTries < 0 {
+		return errors.New("invalid PassphraseTries")
+	}
+	if options.RecoveryKeyTries < 0 {
+		return errors.New("invalid RecoveryKeyTries")
+	}
+	if options.RecoveryKeyFallback < RecoveryKeyFallbackAlways || options.RecoveryKeyFallback > RecoveryKeyFallbackNever {
+		return errors.New("invalid RecoveryKeyFallback")
+	}
+	recoveryKeyTries := options.RecoveryKeyTries
+	if options.RecoveryKeyFallback == RecoveryKeyFallbackNever {
+		recoveryKeyTries = 0
+	}
+	if (options.PassphraseTries > 0 || recoveryKeyTries > 0) && authRequestor == nil {
+		return errors.New("nil authRequestor")
+	}
+
+	release, err := reserveResource(ResourceParallelActivations, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	progress := newActivationProgress(volumeName, sourceDevicePath, &options.ActivateVolumeOptions)
+	if err := progress.waitForDevice(options.DeviceTimeout); err != nil {
+		return err
+	}
+
+	view, err := newLUKSView(sourceDevicePath, luks2.LockModeBlocking)
+	if err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot obtain LUKS2 header view: %v\n", err)
+		view = nil
+	}
+
+	var candidates []*keyCandidate
+	var sourceErrs []*activateWithKeyDataError
+	for _, source := range sources {
+		c, err := readKeyCandidatesFromSource(source, sourceDevicePath, view)
+		if err != nil {
+			sourceErrs = append(sourceErrs, &activateWithKeyDataError{name: source.Name(), err: xerrors.Errorf("cannot read key data: %w", err)})
+			continue
+		}
+		candidates = append(candidates, c...)
+	}
+
+	numUsableKeys := 0
+	for _, k := range candidates {
+		if k.err == nil {
+			numUsableKeys += 1
+		}
+	}
+
+	keyring := options.keyringConfig(view)
+	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, keyring, options.ExternalUnlockKey, candidates, authRequestor, options.PassphraseTries, options.LegacyDevicePaths, progress, options.ActivationReportLog)
+
+	success, err := s.run()
+	switch {
+	case success:
+		return nil
+	case err == ErrActivationDeadlineExceeded:
+		return err
+	}
+
+	// failed - try recovery key if permitted
+	keyErrs := append(sourceErrs, s.errors()...)
+
+	rErr := errRecoveryKeyFallbackNotPermitted
+	if options.permitsRecoveryKeyFallback(numUsableKeys) {
+		rErr = activateWithRecoveryKey(volumeName, sourceDevicePath, view, authRequestor, recoveryKeyTries, keyring, keyErrs, progress, options.ActivationReportLog)
+	}
+	if rErr == ErrActivationDeadlineExceeded {
+		return rErr
+	}
+	if rErr != nil {
+		// failed with recovery key - return errors
+		var kdErrs []error
+		for _, e := range keyErrs {
+			kdErrs = append(kdErrs, e)
+		}
+		if err != nil {
+			kdErrs = append(kdErrs, err)
+		}
+		return &activateVolumeWithKeyDataError{kdErrs, rErr}
+	}
+	// succeeded with recovery key
+	return ErrRecoveryKeyUsed
+}
+
 // ActivateVolumeWithRecoveryKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the fallback
 // recovery key. This makes use of systemd-cryptsetup.
@@ -528,14 +911,47 @@ func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, authRequ
 		return errors.New("invalid RecoveryKeyTries")
 	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix)
+	release, err := reserveResource(ResourceParallelActivations, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	progress := newActivationProgress(volumeName, sourceDevicePath, options)
+	if err := progress.waitForDevice(options.DeviceTimeout); err != nil {
+		return err
+	}
+
+	view, err := newLUKSView(sourceDevicePath, luks2.LockModeBlocking)
+	if err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot obtain LUKS2 header view: %v\n", err)
+		view = nil
+	}
+
+	return activateWithRecoveryKey(volumeName, sourceDevicePath, view, authRequestor, options.RecoveryKeyTries, options.keyringConfig(view), nil, progress, options.ActivationReportLog)
 }
 
 // ActivateVolumeWithKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the
 // provided key. This makes use of systemd-cryptsetup.
+//
+// If options is supplied, the Deadline, ProgressReporter and DeviceTimeout
+// fields are honoured when waiting for the source device. The other fields
+// are ignored.
 func ActivateVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *ActivateVolumeOptions) error {
-	return luks2Activate(volumeName, sourceDevicePath, key, luks2.AnySlot)
+	release, err := reserveResource(ResourceParallelActivations, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if options != nil {
+		progress := newActivationProgress(volumeName, sourceDevicePath, options)
+		if err := progress.waitForDevice(options.DeviceTimeout); err != nil {
+			return err
+		}
+	}
+	return activateVolume(volumeName, sourceDevicePath, key, luks2.AnySlot)
 }
 
 // DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
@@ -570,6 +986,24 @@ type InitializeLUKS2ContainerOptions struct {
 
 	// InlineCryptoEngine set flag if to use Inline Crypto Engine
 	InlineCryptoEngine bool
+
+	// Cipher sets the cipher used to encrypt data, which must be one of
+	// "aes-xts-plain64", "aes-cbc-essiv:sha256",
+	// "xchacha12,aes-adiantum-plain64" or "xchacha20,aes-adiantum-plain64".
+	// Setting this to an empty string causes the container to be
+	// initialized with the default cipher for the current architecture.
+	// If set, the kernel must support the cipher.
+	Cipher string
+
+	// KeySize sets the size of the volume key in bits. Setting this to
+	// zero causes the default size for the selected cipher to be used.
+	KeySize int
+
+	// SectorSize sets the encryption sector size in bytes. Setting this
+	// to zero causes the container to be initialized with the default
+	// sector size. If set to a non-zero value, it must be a power of 2
+	// between 512 and 4096 bytes.
+	SectorSize uint32
 }
 
 func (o *InitializeLUKS2ContainerOptions) formatOpts() *luks2.FormatOptions {
@@ -594,15 +1028,19 @@ func (o *InitializeLUKS2ContainerOptions) formatOpts() *luks2.FormatOptions {
 			Hash:            luks2.HashSHA256,
 		},
 
-		InlineCryptoEngine: o.InlineCryptoEngine}
+		InlineCryptoEngine: o.InlineCryptoEngine,
+		Cipher:             o.Cipher,
+		KeySize:            o.KeySize,
+		SectorSize:         o.SectorSize}
 }
 
 // InitializeLUKS2Container will initialize the partition at the specified devicePath
 // as a new LUKS2 container. This can only be called on a partition that isn't mapped.
 // The label for the new LUKS2 container is provided via the label argument.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher
-// mode.
+// By default, the container will be configured to encrypt data with AES-256 and XTS
+// block cipher mode. A different cipher, key size and sector size can be selected
+// with options.
 //
 // The initial key used for unlocking the container is provided via the key argument,
 // and must be a cryptographically secure random number of at least 32-bytes.
@@ -665,7 +1103,7 @@ func removeOrphanedTokens(devicePath string, view *luksview.View) {
 	}
 }
 
-func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *luks2.KDFOptions,
+func addLUKS2ContainerKey(devicePath, keyslotName string, slot int, existingKey, newKey DiskUnlockKey, options *luks2.KDFOptions,
 	newToken func(base *luksview.TokenBase) luks2.Token, priority luks2.SlotPriority) error {
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
 	if err != nil {
@@ -679,11 +1117,23 @@ func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey Di
 	removeOrphanedTokens(devicePath, view)
 
 	freeSlot := 0
-	for _, slot := range view.UsedKeyslots() {
-		if slot != freeSlot {
-			break
+	switch {
+	case slot == luks2.AnySlot:
+		for _, used := range view.UsedKeyslots() {
+			if used != freeSlot {
+				break
+			}
+			freeSlot++
 		}
-		freeSlot++
+	case slot < 0:
+		return fmt.Errorf("invalid keyslot %d", slot)
+	default:
+		for _, used := range view.UsedKeyslots() {
+			if used == slot {
+				return fmt.Errorf("keyslot %d is already in use", slot)
+			}
+		}
+		freeSlot = slot
 	}
 
 	if err := luks2AddKey(devicePath, existingKey, newKey, &luks2.AddKeyOptions{KDFOptions: *options, Slot: freeSlot}); err != nil {
@@ -753,6 +1203,74 @@ func listLUKS2ContainerKeyNames(devicePath string, tokenType luks2.TokenType) ([
 	return names, nil
 }
 
+// LUKS2AnyKeyslot can be supplied as the Keyslot field of LUKS2KeyslotOptions
+// to select the first free keyslot.
+const LUKS2AnyKeyslot = luks2.AnySlot
+
+// LUKS2KeyslotPriority describes the priority of a keyslot, which determines
+// the order in which cryptsetup tries keyslots when it is not told which one
+// to use.
+type LUKS2KeyslotPriority int
+
+const (
+	// LUKS2KeyslotPriorityDefault selects the default priority for the
+	// type of key, which is LUKS2KeyslotPriorityHigh for unlock keys and
+	// LUKS2KeyslotPriorityNormal for everything else.
+	LUKS2KeyslotPriorityDefault LUKS2KeyslotPriority = iota
+
+	// LUKS2KeyslotPriorityIgnore means that cryptsetup will only use the
+	// keyslot if it is explicitly asked to.
+	LUKS2KeyslotPriorityIgnore
+
+	// LUKS2KeyslotPriorityNormal is the normal keyslot priority.
+	LUKS2KeyslotPriorityNormal
+
+	// LUKS2KeyslotPriorityHigh means that cryptsetup will try the keyslot
+	// before any keyslots with a normal priority.
+	LUKS2KeyslotPriorityHigh
+)
+
+func (p LUKS2KeyslotPriority) slotPriority(defaultPriority luks2.SlotPriority) (luks2.SlotPriority, error) {
+	switch p {
+	case LUKS2KeyslotPriorityDefault:
+		return defaultPriority, nil
+	case LUKS2KeyslotPriorityIgnore:
+		return luks2.SlotPriorityIgnore, nil
+	case LUKS2KeyslotPriorityNormal:
+		return luks2.SlotPriorityNormal, nil
+	case LUKS2KeyslotPriorityHigh:
+		return luks2.SlotPriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("invalid keyslot priority %d", p)
+	}
+}
+
+// LUKS2KeyslotOptions provides options to AddLUKS2ContainerUnlockKeyWithOptions
+// and AddLUKS2ContainerRecoveryKeyWithOptions.
+type LUKS2KeyslotOptions struct {
+	// Keyslot is the keyslot number to use, which must not already be in
+	// use. Note that the default value is keyslot 0. Set this to
+	// LUKS2AnyKeyslot to use the first free keyslot.
+	Keyslot int
+
+	// Priority is the priority of the new keyslot.
+	Priority LUKS2KeyslotPriority
+
+	// KDFOptions specifies the KDF used to protect the keyslot, and must
+	// be either *Argon2Options or *PBKDF2Options. If nil, the default for
+	// the type of key is used.
+	KDFOptions KDFOptions
+}
+
+func (o *LUKS2KeyslotOptions) kdfOptions(defaultOptions *luks2.KDFOptions) (*luks2.KDFOptions, error) {
+	if o.KDFOptions == nil {
+		return defaultOptions, nil
+	}
+	return keyslotKDFOptions(o.KDFOptions)
+}
+
+var defaultLUKS2KeyslotOptions = LUKS2KeyslotOptions{Keyslot: LUKS2AnyKeyslot}
+
 // AddLUKS2ContainerUnlockKey creates a keyslot with the specified name on
 // the LUKS2 container at the specified path, and uses it to protect the master
 // key with the supplied key. The created keyslot is one that will normally be
@@ -773,6 +1291,20 @@ func listLUKS2ContainerKeyNames(devicePath string, tokenType luks2.TokenType) ([
 // order to create a KeyData object. The KeyData object can be saved to the
 // keyslot using LUKS2KeyDataWriter.
 func AddLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey) error {
+	return AddLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName, existingKey, newKey, nil)
+}
+
+// AddLUKS2ContainerUnlockKeyWithOptions is the same as AddLUKS2ContainerUnlockKey,
+// but permits the keyslot number, its priority and the KDF used to protect
+// it to be specified with options. This makes it possible to guarantee that
+// the keyslot is tried before a recovery keyslot, and to keep the keyslot
+// numbering stable when a key is re-enrolled. If options is nil, the first
+// free keyslot is used with the default priority and KDF.
+func AddLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *LUKS2KeyslotOptions) error {
+	if options == nil {
+		options = &defaultLUKS2KeyslotOptions
+	}
+
 	if len(newKey) < 32 {
 		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(newKey)*8)
 	}
@@ -792,14 +1324,22 @@ func AddLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, new
 	//   against the stored digest.
 	// - for the TPM case, the storage key's seed which is 16 bytes, by computing the sealed
 	//   object's HMAC and testing it against the stored one.
-	options := luks2.KDFOptions{
+	kdfOptions, err := options.kdfOptions(&luks2.KDFOptions{
 		Type:            luks2.KDFTypePBKDF2,
 		ForceIterations: 1000,
 		Hash:            luks2.HashSHA256,
+	})
+	if err != nil {
+		return xerrors.Errorf("invalid KDF options: %w", err)
 	}
-	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, newKey, &options, func(base *luksview.TokenBase) luks2.Token {
+	priority, err := options.Priority.slotPriority(luks2.SlotPriorityHigh)
+	if err != nil {
+		return err
+	}
+
+	return addLUKS2ContainerKey(devicePath, keyslotName, options.Keyslot, existingKey, newKey, kdfOptions, func(base *luksview.TokenBase) luks2.Token {
 		return &luksview.KeyDataToken{TokenBase: *base}
-	}, luks2.SlotPriorityHigh)
+	}, priority)
 }
 
 // ListLUKS2ContainerUnlockKeyNames lists the names of keyslots on the specified
@@ -826,6 +1366,18 @@ func ListLUKS2ContainerUnlockKeyNames(devicePath string) ([]string, error) {
 //
 // In order to perform this action, an existing key must be supplied.
 func AddLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey RecoveryKey) error {
+	return AddLUKS2ContainerRecoveryKeyWithOptions(devicePath, keyslotName, existingKey, recoveryKey, nil)
+}
+
+// AddLUKS2ContainerRecoveryKeyWithOptions is the same as AddLUKS2ContainerRecoveryKey,
+// but permits the keyslot number, its priority and the KDF used to protect
+// it to be specified with options. If options is nil, the first free keyslot
+// is used with the default priority and KDF.
+func AddLUKS2ContainerRecoveryKeyWithOptions(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey RecoveryKey, options *LUKS2KeyslotOptions) error {
+	if options == nil {
+		options = &defaultLUKS2KeyslotOptions
+	}
+
 	if keyslotName == "" {
 		keyslotName = defaultRecoveryKeyslotName
 	}
@@ -834,14 +1386,22 @@ func AddLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey Di
 	// and SHA256. The recovery key has an entropy of 16 bytes which is strong
 	// and this is overkill really - this could be knocked down to minimal settings
 	// if we have a 32 byte recovery key.
-	options := luks2.KDFOptions{
+	kdfOptions, err := options.kdfOptions(&luks2.KDFOptions{
 		Type:            luks2.KDFTypePBKDF2,
 		ForceIterations: 600000,
 		Hash:            luks2.HashSHA256,
+	})
+	if err != nil {
+		return xerrors.Errorf("invalid KDF options: %w", err)
 	}
-	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, recoveryKey[:], &options, func(base *luksview.TokenBase) luks2.Token {
+	priority, err := options.Priority.slotPriority(luks2.SlotPriorityNormal)
+	if err != nil {
+		return err
+	}
+
+	return addLUKS2ContainerKey(devicePath, keyslotName, options.Keyslot, existingKey, recoveryKey[:], kdfOptions, func(base *luksview.TokenBase) luks2.Token {
 		return &luksview.RecoveryToken{TokenBase: *base}
-	}, luks2.SlotPriorityNormal)
+	}, priority)
 }
 
 // ListLUKS2ContainerRecoveryKeyNames lists the names of keyslots on the specified
@@ -854,6 +1414,10 @@ func ListLUKS2ContainerRecoveryKeyNames(devicePath string) ([]string, error) {
 // LUKS2 container at the specified path. This will return an error if the container
 // only has a single keyslot remaining.
 func DeleteLUKS2ContainerKey(devicePath, keyslotName string) error {
+	return deleteLUKS2ContainerKey(devicePath, keyslotName, false)
+}
+
+func deleteLUKS2ContainerKey(devicePath, keyslotName string, allowLast bool) error {
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
 	if err != nil {
 		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
@@ -864,7 +1428,7 @@ func DeleteLUKS2ContainerKey(devicePath, keyslotName string) error {
 		return errors.New("no key with the specified name exists")
 	}
 
-	if len(view.TokenNames()) == 1 {
+	if len(view.TokenNames()) == 1 && !allowLast {
 		// This is stricter than not permitting the deletion of the last keyslot
 		// - it intentionally does not permit deleting the last secboot named
 		// keyslot, even if the container has other keyslots that might have
@@ -923,7 +1487,17 @@ func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
 		newToken = &luksview.RecoveryToken{
 			TokenBase: luksview.TokenBase{
 				TokenKeyslot: t.TokenKeyslot,
-				TokenName:    newName}}
+				TokenName:    newName},
+			Grace: t.Grace}
+	case *luksview.UserToken:
+		newToken = &luksview.UserToken{
+			TokenBase: luksview.TokenBase{
+				TokenKeyslot: t.TokenKeyslot,
+				TokenName:    newName},
+			User:     t.User,
+			Metadata: t.Metadata}
+	case *luksview.UnsupportedToken:
+		return t.Err
 	default:
 		return errors.New("cannot rename key with unexpected token type")
 	}
@@ -934,3 +1508,35 @@ func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
 
 	return nil
 }
+
+// SetLUKS2ContainerKeyPriority changes the priority of the keyslot with the
+// specified name on the LUKS2 container at the specified path. Supplying
+// LUKS2KeyslotPriorityDefault restores the default priority for the type of
+// key.
+func SetLUKS2ContainerKeyPriority(devicePath, keyslotName string, priority LUKS2KeyslotPriority) error {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	token, _, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return errors.New("no key with the specified name exists")
+	}
+
+	defaultPriority := luks2.SlotPriorityNormal
+	if token.Type() == luksview.KeyDataTokenType {
+		defaultPriority = luks2.SlotPriorityHigh
+	}
+	slotPriority, err := priority.slotPriority(defaultPriority)
+	if err != nil {
+		return err
+	}
+
+	slot := token.Keyslots()[0]
+	if err := luks2SetSlotPriority(devicePath, slot, slotPriority); err != nil {
+		return xerrors.Errorf("cannot change keyslot priority: %w", err)
+	}
+
+	return nil
+}
@@ -21,15 +21,18 @@ package secboot_test
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/snapcore/snapd/asserts"
 	snapd_testutil "github.com/snapcore/snapd/testutil"
@@ -76,6 +79,12 @@ type mockAuthRequestor struct {
 		volumeName       string
 		sourceDevicePath string
 	}
+
+	notices []string
+}
+
+func (r *mockAuthRequestor) NotifyUser(volumeName, sourceDevicePath, msg string) {
+	r.notices = append(r.notices, msg)
 }
 
 func (r *mockAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
@@ -132,6 +141,10 @@ func (r *mockAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath stri
 type mockLUKS2Container struct {
 	keyslots map[int][]byte
 	tokens   map[int]luks2.Token
+
+	uuid         string
+	headerSize   uint64
+	metadataSize uint64
 }
 
 func newMockLUKS2Container() *mockLUKS2Container {
@@ -142,6 +155,9 @@ func newMockLUKS2Container() *mockLUKS2Container {
 
 func (c *mockLUKS2Container) ReadHeader() (*luks2.HeaderInfo, error) {
 	hdr := &luks2.HeaderInfo{
+		UUID:         c.uuid,
+		HeaderSize:   c.headerSize,
+		MetadataSize: c.metadataSize,
 		Metadata: luks2.Metadata{
 			Keyslots: make(map[int]*luks2.Keyslot),
 			Tokens:   make(map[int]luks2.Token)}}
@@ -209,6 +225,7 @@ func (l *mockLUKS2) enableMocks() (restore func()) {
 	restores = append(restores, MockLUKS2KillSlot(l.killSlot))
 	restores = append(restores, MockLUKS2RemoveToken(l.removeToken))
 	restores = append(restores, MockLUKS2SetSlotPriority(l.setSlotPriority))
+	restores = append(restores, MockLUKS2TestKey(l.testKey))
 	restores = append(restores, MockNewLUKSView(l.newLUKSView))
 
 	return func() {
@@ -385,6 +402,26 @@ func (l *mockLUKS2) setSlotPriority(devicePath string, slot int, priority luks2.
 	return nil
 }
 
+func (l *mockLUKS2) testKey(devicePath string, key []byte, slot int) error {
+	l.operations = append(l.operations, fmt.Sprint("TestKey(", devicePath, ",", slot, ")"))
+
+	dev, ok := l.devices[devicePath]
+	if !ok {
+		return errors.New("no container")
+	}
+
+	for s, k := range dev.keyslots {
+		if slot != luks2.AnySlot && s != slot {
+			continue
+		}
+		if bytes.Equal(k, key) {
+			return nil
+		}
+	}
+
+	return errors.New("cryptsetup failed with: No key available with this passphrase.")
+}
+
 func (l *mockLUKS2) newLUKSView(devicePath string, lockMode luks2.LockMode) (*luksview.View, error) {
 	l.operations = append(l.operations, fmt.Sprint("newLUKSView(", devicePath, ",", lockMode, ")"))
 
@@ -445,7 +482,7 @@ func (s *cryptSuite) SetUpTest(c *C) {
 	s.keyDataTestBase.SetUpTest(c)
 	s.KeyringTestBase.SetUpTest(c)
 
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
 
@@ -501,6 +538,19 @@ func (s *cryptSuite) checkRecoveryKeyInKeyring(c *C, prefix, path string, expect
 	c.Check(key, DeepEquals, DiskUnlockKey(expected[:]))
 }
 
+func (s *cryptSuite) checkUnlockReasonInKeyring(c *C, prefix, path string, expected UnlockMethod) *UnlockReason {
+	// The following test will fail if the user keyring isn't reachable from the session keyring. If the test have succeeded
+	// so far, mark the current test as expected to fail.
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	reason, err := GetUnlockReasonFromKernel(prefix, path, false)
+	c.Assert(err, IsNil)
+	c.Check(reason.Method, Equals, expected)
+	return reason
+}
+
 func (s *cryptSuite) checkKeyDataKeysInKeyring(c *C, prefix, path string, expectedKey DiskUnlockKey, expectedAuxKey PrimaryKey) {
 	// The following test will fail if the user keyring isn't reachable from the session keyring. If the test have succeeded
 	// so far, mark the current test as expected to fail.
@@ -598,8 +648,9 @@ func (s *cryptSuite) testActivateVolumeWithRecoveryKey(c *C, data *testActivateV
 		c.Check(rsp.sourceDevicePath, Equals, data.sourceDevicePath)
 	}
 
-	c.Assert(s.luks2.operations, HasLen, data.activateTries)
-	for _, op := range s.luks2.operations {
+	c.Assert(s.luks2.operations, HasLen, data.activateTries+1)
+	c.Check(s.luks2.operations[0], Equals, "newLUKSView("+data.sourceDevicePath+",0)")
+	for _, op := range s.luks2.operations[1:] {
 		c.Check(op, Equals, "Activate("+data.volumeName+","+data.sourceDevicePath+",-1)")
 	}
 
@@ -784,6 +835,7 @@ func (s *cryptSuite) TestRecoveryKeyStringify2(c *C) {
 type testActivateVolumeWithRecoveryKeyErrorHandlingData struct {
 	tries         int
 	authRequestor *mockAuthRequestor
+	readsHeader   bool
 	activateTries int
 }
 
@@ -818,8 +870,14 @@ func (s *cryptSuite) testActivateVolumeWithRecoveryKeyErrorHandling(c *C, data *
 		}
 	}
 
-	c.Assert(s.luks2.operations, HasLen, data.activateTries)
-	for _, op := range s.luks2.operations {
+	ops := s.luks2.operations
+	if data.readsHeader {
+		c.Assert(ops, Not(HasLen), 0)
+		c.Check(ops[0], Equals, "newLUKSView(/dev/sda1,0)")
+		ops = ops[1:]
+	}
+	c.Assert(ops, HasLen, data.activateTries)
+	for _, op := range ops {
 		c.Check(op, Equals, "Activate(data,/dev/sda1,-1)")
 	}
 
@@ -839,6 +897,7 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling2(c *C) {
 	c.Check(s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
 		tries:         0,
 		authRequestor: &mockAuthRequestor{},
+		readsHeader:   true,
 	}), ErrorMatches, "no recovery key tries permitted")
 }
 
@@ -854,6 +913,7 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling4(c *C) {
 	c.Check(s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
 		tries:         1,
 		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{errors.New("some error")}},
+		readsHeader:   true,
 	}), ErrorMatches, "cannot obtain recovery key: some error")
 }
 
@@ -862,6 +922,7 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling5(c *C) {
 	c.Check(s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
 		tries:         1,
 		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{RecoveryKey{}}},
+		readsHeader:   true,
 		activateTries: 1,
 	}), ErrorMatches, "cannot activate volume: systemd-cryptsetup failed with: exit status 1")
 }
@@ -871,6 +932,7 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling6(c *C) {
 	c.Check(s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
 		tries:         2,
 		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{errors.New("some error"), errors.New("another error")}},
+		readsHeader:   true,
 		activateTries: 0,
 	}), ErrorMatches, "cannot obtain recovery key: another error")
 }
@@ -886,6 +948,8 @@ type testActivateVolumeWithKeyDataData struct {
 	model             SnapModel
 
 	tokenName string
+
+	expectedNotices []string
 }
 
 func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolumeWithKeyDataData) {
@@ -947,6 +1011,7 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 		c.Check(rsp.volumeName, Equals, data.volumeName)
 		c.Check(rsp.sourceDevicePath, Equals, data.sourceDevicePath)
 	}
+	c.Check(authRequestor.notices, DeepEquals, data.expectedNotices)
 
 	// This should be done last because it may fail in some circumstances.
 	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, unlockKey, primaryKey)
@@ -954,6 +1019,14 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	for _, legacyPath := range data.legacyDevicePaths {
 		s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, legacyPath, unlockKey, primaryKey)
 	}
+
+	expectedMethod := UnlockMethodPlatformKey
+	if keyData.AuthMode() == AuthModePassphrase {
+		expectedMethod = UnlockMethodPlatformKeyWithPassphrase
+	}
+	reason := s.checkUnlockReasonInKeyring(c, data.keyringPrefix, data.sourceDevicePath, expectedMethod)
+	c.Check(reason.PlatformName, Equals, keyData.PlatformName())
+	c.Check(reason.RecoveryKeyUsed(), testutil.IsFalse)
 }
 
 func (s *cryptSuite) TestActivateVolumeWithKeyData1(c *C) {
@@ -962,6 +1035,46 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData1(c *C) {
 		sourceDevicePath: "/dev/sda1"})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringInstanceAndUUID(c *C) {
+	keyData, unlockKey, primaryKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+	s.luks2.devices["/dev/sda1"].uuid = "a3b45a38-12f1-4b1b-8b3a-7d8c0a5d4bb6"
+
+	bootscope.SetModel(nullSnapModel{})
+
+	options := &ActivateVolumeOptions{
+		KeyringInstance:      "foo",
+		KeyringUseDeviceUUID: true}
+	c.Assert(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	// The keys aren't added without the instance.
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	keyringOptions := &KernelKeyringOptions{Instance: "foo"}
+	for _, path := range []string{"/dev/sda1", KeyringDeviceForUUID("a3b45a38-12f1-4b1b-8b3a-7d8c0a5d4bb6")} {
+		key, err := GetDiskUnlockKeyFromKernelWithOptions(keyringOptions, path, false)
+		c.Check(err, IsNil)
+		c.Check(key, DeepEquals, unlockKey)
+
+		auxKey, err := GetPrimaryKeyFromKernelWithOptions(keyringOptions, path, false)
+		c.Check(err, IsNil)
+		c.Check(auxKey, DeepEquals, primaryKey)
+
+		reason, err := GetUnlockReasonFromKernelWithOptions(keyringOptions, path, false)
+		c.Check(err, IsNil)
+		c.Check(reason.Method, Equals, UnlockMethodPlatformKey)
+	}
+
+	keys, err := GetDiskUnlockKeysFromKernel(&KernelKeyringOptions{}, "/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*KernelDiskUnlockKey{{Instance: "foo", Key: unlockKey}})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyData2(c *C) {
 	// Test with different volumeName / sourceDevicePath
 	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
@@ -987,7 +1100,8 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData6(c *C) {
 		volumeName:       "data",
 		sourceDevicePath: "/dev/sda1",
 		passphraseTries:  3,
-		authResponses:    []interface{}{"incorrect", "1234"}})
+		authResponses:    []interface{}{"incorrect", "1234"},
+		expectedNotices:  []string{"Incorrect passphrase. 2 attempt(s) remaining before the recovery key is required."}})
 }
 
 func (s *cryptSuite) TestActivateVolumeWithKeyData7(c *C) {
@@ -1023,6 +1137,363 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData9(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataExternalKey(c *C) {
+	// Test that an externally supplied key is tried first.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	externalKey := make(DiskUnlockKey, 32)
+	rand.Read(externalKey)
+	s.addMockKeyslot("/dev/sda1", externalKey)
+
+	options := &ActivateVolumeOptions{ExternalUnlockKey: externalKey}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodExternalKey)
+	c.Check(reason.KeyName, Equals, "external-key")
+	c.Check(reason.RecoveryKeyUsed(), testutil.IsFalse)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataExternalKeyFallback(c *C) {
+	// Test that KeyData objects are tried if the externally supplied key
+	// is invalid.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	externalKey := make(DiskUnlockKey, 32)
+	rand.Read(externalKey)
+
+	options := &ActivateVolumeOptions{ExternalUnlockKey: externalKey}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodPlatformKey)
+}
+
+type mockPolicyBranchPlatformKeyDataHandler struct {
+	*mockPlatformKeyDataHandler
+	branch string
+}
+
+func (h *mockPolicyBranchPlatformKeyDataHandler) PolicyBranch(data *PlatformKeyData) (string, error) {
+	return h.branch, nil
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecordsPolicyBranch(c *C) {
+	// Test that the policy branch reported by the platform is recorded
+	// in the unlock reason.
+	RegisterPlatformKeyDataHandler(s.mockPlatformName, &mockPolicyBranchPlatformKeyDataHandler{
+		mockPlatformKeyDataHandler: s.handler,
+		branch:                     "pcr-branch-1"})
+	defer RegisterPlatformKeyDataHandler(s.mockPlatformName, s.handler)
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, &ActivateVolumeOptions{}, keyData), IsNil)
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodPlatformKey)
+	c.Check(reason.PolicyBranch, Equals, "pcr-branch-1")
+}
+
+type mockContextPlatformKeyDataHandler struct {
+	*mockPlatformKeyDataHandler
+	ctxs []context.Context
+	wait bool
+}
+
+func (h *mockContextPlatformKeyDataHandler) recoverKeys(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	h.ctxs = append(h.ctxs, ctx)
+	if h.wait {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return fn()
+}
+
+func (h *mockContextPlatformKeyDataHandler) RecoverKeysContext(ctx context.Context, data *PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	return h.recoverKeys(ctx, func() ([]byte, error) {
+		return h.RecoverKeys(data, encryptedPayload)
+	})
+}
+
+func (h *mockContextPlatformKeyDataHandler) RecoverKeysWithAuthKeyContext(ctx context.Context, data *PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
+	return h.recoverKeys(ctx, func() ([]byte, error) {
+		return h.RecoverKeysWithAuthKey(data, encryptedPayload, key)
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassesDeadlineToPlatform(c *C) {
+	// Test that the activation deadline is passed to the platform
+	// handler.
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	handler := &mockContextPlatformKeyDataHandler{mockPlatformKeyDataHandler: s.handler}
+	RegisterPlatformKeyDataHandler(s.mockPlatformName, handler)
+	defer RegisterPlatformKeyDataHandler(s.mockPlatformName, s.handler)
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	start := time.Now()
+	options := &ActivateVolumeOptions{Deadline: now.Add(time.Minute)}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	c.Assert(handler.ctxs, HasLen, 1)
+	deadline, ok := handler.ctxs[0].Deadline()
+	c.Check(ok, testutil.IsTrue)
+	c.Check(deadline.Sub(start) > 59*time.Second, testutil.IsTrue)
+	c.Check(deadline.Sub(start) <= time.Minute+time.Second, testutil.IsTrue)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphrasePassesContextToPlatform(c *C) {
+	handler := &mockContextPlatformKeyDataHandler{mockPlatformKeyDataHandler: s.handler}
+	RegisterPlatformKeyDataHandler(s.mockPlatformName, handler)
+	defer RegisterPlatformKeyDataHandler(s.mockPlatformName, s.handler)
+
+	keyData, key, _ := s.newNamedKeyDataWithPassphrase(c, "1234", "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{PassphraseTries: 1}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), IsNil)
+
+	c.Assert(handler.ctxs, HasLen, 1)
+	_, ok := handler.ctxs[0].Deadline()
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDeadlineExpiresDuringRecoverKeys(c *C) {
+	// Test that the deadline expiring whilst the platform handler is
+	// recovering the key aborts it, and doesn't result in a fallback to
+	// the recovery key.
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	handler := &mockContextPlatformKeyDataHandler{mockPlatformKeyDataHandler: s.handler, wait: true}
+	RegisterPlatformKeyDataHandler(s.mockPlatformName, handler)
+	defer RegisterPlatformKeyDataHandler(s.mockPlatformName, s.handler)
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		Deadline:         now.Add(10 * time.Millisecond)}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), Equals, ErrActivationDeadlineExceeded)
+
+	c.Check(handler.ctxs, HasLen, 1)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataExternalKeyRecoveryKeyFallback(c *C) {
+	// Test that the externally supplied key is recorded in the errors
+	// if activation falls back to the recovery key.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.State = mockPlatformDeviceStateUnavailable
+
+	externalKey := make(DiskUnlockKey, 32)
+	rand.Read(externalKey)
+
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:  1,
+		ExternalUnlockKey: externalKey}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), Equals, ErrRecoveryKeyUsed)
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodRecoveryKey)
+	c.Assert(reason.KeyErrors, HasLen, 2)
+	c.Check(reason.KeyErrors[0], DeepEquals, UnlockReasonKeyError{
+		KeyName: "external-key",
+		Error:   "cannot activate volume: systemd-cryptsetup failed with: exit status 1"})
+	c.Check(reason.KeyErrors[1].KeyName, Equals, keyData.ReadableName())
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataSourceOrder(c *C) {
+	// Test that the sources are tried in order, and that keys from LUKS2
+	// tokens are activated with the associated keyslot.
+	keyData, _, _ := s.newNamedKeyData(c, "foo")
+	tokenKeyData, tokenKey, tokenAuxKey := s.newNamedKeyData(c, "")
+	slot := s.addMockKeyslot("/dev/sda1", tokenKey)
+
+	w := makeMockKeyDataWriter()
+	c.Check(tokenKeyData.WriteAtomic(w), IsNil)
+	s.addMockToken("/dev/sda1", &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"},
+		Data: w.final.Bytes()})
+
+	sources := []KeyDataSource{
+		NewKeyDataSource("external", keyData),
+		NewLUKS2TokenKeyDataSource(),
+	}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", nil, sources, &ActivateVolumeWithMultipleKeyDataOptions{}), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+		fmt.Sprintf("Activate(data,/dev/sda1,%d)", slot),
+	})
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", tokenKey, tokenAuxKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataSourceError(c *C) {
+	// Test that a source that cannot be read doesn't prevent other sources
+	// from being used, and that its error is recorded if activation falls
+	// back to the recovery key.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.State = mockPlatformDeviceStateUnavailable
+
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	path := filepath.Join(c.MkDir(), "missing")
+	sources := []KeyDataSource{
+		NewFileKeyDataSource(path),
+		NewKeyDataSource("external", keyData),
+	}
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{RecoveryKeyTries: 1}}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, sources, options), Equals, ErrRecoveryKeyUsed)
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodRecoveryKey)
+	c.Assert(reason.KeyErrors, HasLen, 2)
+	c.Check(reason.KeyErrors[0].KeyName, Equals, path)
+	c.Check(reason.KeyErrors[0].Error, Matches, `cannot read key data: cannot open file: .*`)
+	c.Check(reason.KeyErrors[1].KeyName, Equals, keyData.ReadableName())
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRestrictAuthModes(c *C) {
+	// Test that keys with an auth mode that isn't permitted for their
+	// source are not used, and that the user isn't asked for a passphrase.
+	keyData, key, _ := s.newNamedKeyDataWithPassphrase(c, "1234", "")
+	recoveryKey := s.newRecoveryKey()
+
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	sources := []KeyDataSource{
+		RestrictKeyDataSourceAuthModes(NewKeyDataSource("external", keyData), AuthModeNone),
+	}
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{
+			PassphraseTries:  1,
+			RecoveryKeyTries: 1}}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, sources, options), Equals, ErrRecoveryKeyUsed)
+	c.Check(authRequestor.passphraseRequests, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 1)
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodRecoveryKey)
+	c.Assert(reason.KeyErrors, HasLen, 1)
+	c.Check(reason.KeyErrors[0], DeepEquals, UnlockReasonKeyError{
+		KeyName: keyData.ReadableName(),
+		Error:   "auth mode 1 is not permitted for this source"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRestrictAuthModesPermitted(c *C) {
+	keyData, key, _ := s.newNamedKeyDataWithPassphrase(c, "1234", "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	sources := []KeyDataSource{
+		RestrictKeyDataSourceAuthModes(NewKeyDataSource("external", keyData), AuthModePassphrase),
+	}
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{PassphraseTries: 1}}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, sources, options), IsNil)
+	c.Check(authRequestor.passphraseRequests, HasLen, 1)
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodPlatformKeyWithPassphrase)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRecoveryKeyFallbackNever(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.handler.State = mockPlatformDeviceStateUnavailable
+	s.addMockKeyslot("/dev/sda1", key)
+
+	authRequestor := &mockAuthRequestor{}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{RecoveryKeyTries: 3},
+		RecoveryKeyFallback:   RecoveryKeyFallbackNever}
+	err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, []KeyDataSource{NewKeyDataSource("external", keyData)}, options)
+	c.Check(err, ErrorMatches, `(?s)cannot activate with platform protected keys:
+- .*: cannot recover key: the platform's secure device is unavailable: the platform device is unavailable
+and activation with recovery key failed: recovery key fallback is not permitted`)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRecoveryKeyFallbackIfNoKeyData(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.handler.State = mockPlatformDeviceStateUnavailable
+	s.addMockKeyslot("/dev/sda1", key)
+
+	authRequestor := &mockAuthRequestor{}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{RecoveryKeyTries: 1},
+		RecoveryKeyFallback:   RecoveryKeyFallbackIfNoKeyData}
+	err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, []KeyDataSource{NewKeyDataSource("external", keyData)}, options)
+	c.Check(err, ErrorMatches, `(?s)cannot activate with platform protected keys:.*and activation with recovery key failed: recovery key fallback is not permitted`)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRecoveryKeyFallbackIfNoKeyDataNoKeys(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeWithMultipleKeyDataOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{RecoveryKeyTries: 1},
+		RecoveryKeyFallback:   RecoveryKeyFallbackIfNoKeyData}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", authRequestor, []KeyDataSource{NewLUKS2TokenKeyDataSource()}, options), Equals, ErrRecoveryKeyUsed)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 1)
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkRecoveryKeyInKeyring(c, "", "/dev/sda1", recoveryKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataInvalidRecoveryKeyFallback(c *C) {
+	options := &ActivateVolumeWithMultipleKeyDataOptions{RecoveryKeyFallback: RecoveryKeyFallbackNever + 1}
+	c.Check(ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", nil, nil, options), ErrorMatches, `invalid RecoveryKeyFallback`)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 type testActivateVolumeWithKeyDataErrorHandlingData struct {
 	diskUnlockKey DiskUnlockKey
 	recoveryKey   RecoveryKey
@@ -1098,6 +1569,13 @@ func (s *cryptSuite) testActivateVolumeWithKeyDataErrorHandling(c *C, data *test
 	if err == ErrRecoveryKeyUsed {
 		// This should be done last because it may fail in some circumstances.
 		s.checkRecoveryKeyInKeyring(c, data.keyringPrefix, "/dev/sda1", data.recoveryKey)
+
+		reason := s.checkUnlockReasonInKeyring(c, data.keyringPrefix, "/dev/sda1", UnlockMethodRecoveryKey)
+		c.Check(reason.RecoveryKeyUsed(), testutil.IsTrue)
+		if data.keyData != nil {
+			c.Assert(reason.KeyErrors, HasLen, 1)
+			c.Check(reason.KeyErrors[0].KeyName, Equals, data.keyData.ReadableName())
+		}
 	}
 
 	return err
@@ -1118,7 +1596,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling2(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1135,7 +1613,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling3(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUninitialized
+	s.handler.State = mockPlatformDeviceStateUninitialized
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1166,7 +1644,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling5(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "foo")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1186,7 +1664,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling6(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "bar")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1208,7 +1686,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling7(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1225,7 +1703,7 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling8(c *C) {
 	keyData, key, _ := s.newNamedKeyData(c, "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		diskUnlockKey:    key,
@@ -1774,7 +2252,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling2(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -1791,7 +2269,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling3(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUninitialized
+	s.handler.State = mockPlatformDeviceStateUninitialized
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -1822,7 +2300,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling5(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -1844,7 +2322,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling6(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "bar", "foo")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -1868,7 +2346,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling7(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -1885,7 +2363,7 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling8(c *C) {
 	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
 	recoveryKey := s.newRecoveryKey()
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	s.handler.State = mockPlatformDeviceStateUnavailable
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keys:             keys,
@@ -2124,6 +2602,25 @@ func (s *cryptSuite) TestInitializeLUKS2ContainerInlineCryptoEngine(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCipherAndSectorSize(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(c, 32),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:     "xchacha12,aes-adiantum-plain64",
+			KeySize:    256,
+			SectorSize: 4096,
+		},
+		fmtOpts: &luks2.FormatOptions{
+			KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, ForceIterations: 1000, Hash: luks2.HashSHA256},
+			Cipher:     "xchacha12,aes-adiantum-plain64",
+			KeySize:    256,
+			SectorSize: 4096,
+		},
+	})
+}
+
 func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidKeySize(c *C) {
 	c.Check(InitializeLUKS2Container("/dev/sda1", "data", ([]byte)(s.newPrimaryKey(c, 16)), nil), ErrorMatches, "expected a key length of at least 256-bits \\(got 128\\)")
 }
@@ -2338,6 +2835,104 @@ func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyNameInUse(c *C) {
 	c.Check(AddLUKS2ContainerUnlockKey("/dev/sda1", "default", ([]byte)(existingKey), make([]byte, 32)), ErrorMatches, "the specified name is already in use")
 }
 
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptions(c *C) {
+	existingKey := s.newPrimaryKey(c, 32)
+	key := s.newPrimaryKey(c, 32)
+
+	dev := &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+	s.luks2.devices["/dev/sda1"] = dev
+
+	c.Check(AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "foo", DiskUnlockKey(existingKey), DiskUnlockKey(key), &LUKS2KeyslotOptions{
+		Keyslot:    3,
+		Priority:   LUKS2KeyslotPriorityNormal,
+		KDFOptions: &Argon2Options{MemoryKiB: 65536, ForceIterations: 4}}), IsNil)
+
+	expectedOptions := &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypeArgon2id, MemoryKiB: 65536, ForceIterations: 4}, Slot: 3}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", expectedOptions, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,3,normal)",
+	})
+
+	c.Check(dev.keyslots[3], DeepEquals, []byte(key))
+	c.Check(dev.tokens[1], DeepEquals, &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 3,
+			TokenName:    "foo"}})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptions(c *C) {
+	existingKey := s.newPrimaryKey(c, 32)
+	key := s.newRecoveryKey()
+
+	dev := &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+	s.luks2.devices["/dev/sda1"] = dev
+
+	c.Check(AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", DiskUnlockKey(existingKey), key, &LUKS2KeyslotOptions{
+		Keyslot:  LUKS2AnyKeyslot,
+		Priority: LUKS2KeyslotPriorityIgnore}), IsNil)
+
+	expectedOptions := &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, ForceIterations: 600000, Hash: luks2.HashSHA256}, Slot: 1}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", expectedOptions, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,ignore)",
+	})
+
+	c.Check(dev.keyslots[1], DeepEquals, key[:])
+	c.Check(dev.tokens[1], DeepEquals, &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "default-recovery"}})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsKeyslotInUse(c *C) {
+	existingKey := s.newPrimaryKey(c, 32)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+	c.Check(AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "foo", DiskUnlockKey(existingKey), make([]byte, 32), &LUKS2KeyslotOptions{Keyslot: 0}),
+		ErrorMatches, "keyslot 0 is already in use")
+	c.Check(AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "foo", DiskUnlockKey(existingKey), make([]byte, 32), &LUKS2KeyslotOptions{Keyslot: -2}),
+		ErrorMatches, "invalid keyslot -2")
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsInvalidPriority(c *C) {
+	existingKey := s.newPrimaryKey(c, 32)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		keyslots: map[int][]byte{0: existingKey},
+	}
+	c.Check(AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "foo", DiskUnlockKey(existingKey), make([]byte, 32), &LUKS2KeyslotOptions{Keyslot: LUKS2AnyKeyslot, Priority: 10}),
+		ErrorMatches, "invalid keyslot priority 10")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 func (s *cryptSuite) TestListLUKS2ContainerKeyNames(c *C) {
 	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
 		tokens: map[int]luks2.Token{
@@ -2962,6 +3557,54 @@ func (s *cryptSuite) TestRenameLUKS2ContainerKeyNameInUse(c *C) {
 	c.Check(RenameLUKS2ContainerKey("/dev/sda1", "foo", "bar"), ErrorMatches, "the new name is already in use")
 }
 
+func (s *cryptSuite) testSetLUKS2ContainerKeyPriority(c *C, keyslotName string, priority LUKS2KeyslotPriority, expected string) {
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: nil,
+			2: nil,
+		},
+	}
+
+	c.Check(SetLUKS2ContainerKeyPriority("/dev/sda1", keyslotName, priority), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		expected,
+	})
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerKeyPriority(c *C) {
+	s.testSetLUKS2ContainerKeyPriority(c, "default", LUKS2KeyslotPriorityNormal, "SetSlotPriority(/dev/sda1,0,normal)")
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerKeyPriorityRecovery(c *C) {
+	s.testSetLUKS2ContainerKeyPriority(c, "recovery", LUKS2KeyslotPriorityHigh, "SetSlotPriority(/dev/sda1,2,prefer)")
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerKeyPriorityDefaultUnlock(c *C) {
+	s.testSetLUKS2ContainerKeyPriority(c, "default", LUKS2KeyslotPriorityDefault, "SetSlotPriority(/dev/sda1,0,prefer)")
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerKeyPriorityDefaultRecovery(c *C) {
+	s.testSetLUKS2ContainerKeyPriority(c, "recovery", LUKS2KeyslotPriorityDefault, "SetSlotPriority(/dev/sda1,2,normal)")
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerKeyPriorityNonExistant(c *C) {
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		keyslots: map[int][]byte{0: nil},
+	}
+	c.Check(SetLUKS2ContainerKeyPriority("/dev/sda1", "foo", LUKS2KeyslotPriorityHigh), ErrorMatches, "no key with the specified name exists")
+}
+
 type cryptSuiteUnmockedBase struct {
 	snapd_testutil.BaseTest
 	cryptTestBase
@@ -4003,3 +4646,241 @@ func (s *cryptSuite) TestActivateVolumeWithLegacyPathsError(c *C) {
 
 	s.checkKeyDataKeysInKeyring(c, "", "/dev/some/path", unlockKey, primaryKey)
 }
+
+type mockActivationProgressReporter struct {
+	reports []string
+}
+
+func (r *mockActivationProgressReporter) ReportProgress(volumeName, sourceDevicePath string, stage ActivationStage, remaining time.Duration) {
+	r.reports = append(r.reports, fmt.Sprintf("%s,%s,%s,%v", volumeName, sourceDevicePath, stage, remaining))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataProgress(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	keyData, unlockKey, primaryKey := s.newNamedKeyDataWithPassphrase(c, "1234", "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	reporter := new(mockActivationProgressReporter)
+
+	options := &ActivateVolumeOptions{
+		PassphraseTries:  1,
+		Deadline:         now.Add(time.Minute),
+		ProgressReporter: reporter}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), IsNil)
+
+	c.Check(reporter.reports, DeepEquals, []string{
+		"data,/dev/sda1,requesting passphrase,1m0s",
+		"data,/dev/sda1,recovering key with passphrase,1m0s",
+		"data,/dev/sda1,activating volume,1m0s",
+	})
+
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", unlockKey, primaryKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataProgressNoDeadline(c *C) {
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	reporter := new(mockActivationProgressReporter)
+
+	options := &ActivateVolumeOptions{ProgressReporter: reporter}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	c.Check(reporter.reports, DeepEquals, []string{
+		"data,/dev/sda1,recovering key,0s",
+		"data,/dev/sda1,activating volume,0s",
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDeadlineExpired(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		Deadline:         now}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), Equals, ErrActivationDeadlineExceeded)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDeadlineExpiresDuringPassphrase(c *C) {
+	// Test that the deadline expiring whilst waiting for a passphrase
+	// doesn't result in a fallback to the recovery key.
+	keyData, unlockKey, _ := s.newNamedKeyDataWithPassphrase(c, "1234", "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{
+		passphraseResponses:  []interface{}{"1234"},
+		recoveryKeyResponses: []interface{}{recoveryKey}}
+	reporter := new(mockActivationProgressReporter)
+
+	// Advance the clock once the passphrase has been requested.
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time {
+		if len(authRequestor.passphraseRequests) > 0 {
+			return now.Add(time.Minute)
+		}
+		return now
+	}))
+
+	options := &ActivateVolumeOptions{
+		PassphraseTries:  1,
+		RecoveryKeyTries: 1,
+		Deadline:         now.Add(30 * time.Second),
+		ProgressReporter: reporter}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), Equals, ErrActivationDeadlineExceeded)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+	c.Check(authRequestor.passphraseRequests, HasLen, 1)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+	c.Check(reporter.reports, DeepEquals, []string{"data,/dev/sda1,requesting passphrase,30s"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyDeadlineExpired(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		Deadline:         now.Add(-time.Second)}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), Equals, ErrActivationDeadlineExceeded)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) mockWaitForDevice(err error) {
+	s.AddCleanup(MockLUKS2WaitForDevice(func(path string, timeout time.Duration) error {
+		s.luks2.operations = append(s.luks2.operations, fmt.Sprintf("WaitForDevice(%s,%v)", path, timeout))
+		return err
+	}))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataWaitForDevice(c *C) {
+	s.mockWaitForDevice(nil)
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	reporter := new(mockActivationProgressReporter)
+
+	options := &ActivateVolumeOptions{
+		DeviceTimeout:    10 * time.Second,
+		ProgressReporter: reporter}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"WaitForDevice(/dev/sda1,10s)",
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+	c.Check(reporter.reports, DeepEquals, []string{
+		"data,/dev/sda1,waiting for device,0s",
+		"data,/dev/sda1,recovering key,0s",
+		"data,/dev/sda1,activating volume,0s",
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDeviceNeverAppeared(c *C) {
+	s.mockWaitForDevice(fmt.Errorf("/dev/sda1: %w", ErrDeviceNeverAppeared))
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	authRequestor := &mockAuthRequestor{}
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		DeviceTimeout:    10 * time.Second}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, options, keyData), Equals, ErrDeviceNeverAppeared)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"WaitForDevice(/dev/sda1,10s)"})
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataWaitForDeviceLimitedByDeadline(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+	s.mockWaitForDevice(fmt.Errorf("/dev/sda1: %w", ErrDeviceNeverAppeared))
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	options := &ActivateVolumeOptions{
+		Deadline:      now.Add(5 * time.Second),
+		DeviceTimeout: time.Minute}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), Equals, ErrActivationDeadlineExceeded)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"WaitForDevice(/dev/sda1,5s)"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataWaitForDeviceError(c *C) {
+	s.mockWaitForDevice(errors.New("some error"))
+
+	keyData, unlockKey, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", unlockKey)
+
+	options := &ActivateVolumeOptions{DeviceTimeout: time.Second}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, options, keyData), ErrorMatches, `cannot wait for device: some error`)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyWaitForDevice(c *C) {
+	s.mockWaitForDevice(nil)
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		DeviceTimeout:    10 * time.Second}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(s.luks2.operations[:2], DeepEquals, []string{
+		"WaitForDevice(/dev/sda1,10s)",
+		"newLUKSView(/dev/sda1,0)",
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyWaitForDevice(c *C) {
+	s.mockWaitForDevice(nil)
+
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/dev/sda1", key)
+
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", key, &ActivateVolumeOptions{DeviceTimeout: time.Second}), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"WaitForDevice(/dev/sda1,1s)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyNoOptionsDoesNotWait(c *C) {
+	s.mockWaitForDevice(nil)
+
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/dev/sda1", key)
+
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", key, nil), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1,-1)"})
+}
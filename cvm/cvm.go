@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package cvm is a platform for protecting keys in confidential virtual machines,
+// binding them to the confidential computing measurement of the guest rather than
+// to a virtual TPM, which is normally implemented by the host.
+//
+// On AMD SEV-SNP, keys are protected by a key that is derived by the AMD secure
+// processor from a chip-unique root key (the VCEK) or a root key for the VM (the
+// VMRK) and a selection of the guest's launch parameters, such as its launch
+// measurement and policy. This is requested via the /dev/sev-guest device, and
+// is only available to the guest that it was derived for.
+//
+// Intel TDX doesn't provide a sealing key to guests. Instead, keys are protected by
+// a secret that is released to the guest by an attestation service after it has
+// verified a TD quote. The caller provides access to this service by supplying an
+// implementation of [TDXSecretProvider] with [SetTDXSecretProvider].
+package cvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrNoDevice is returned when a confidential computing guest device is
+	// required but none is present.
+	ErrNoDevice = errors.New("no confidential computing guest device")
+
+	// ErrNoTDXSecretProvider is returned when a TDXSecretProvider is required
+	// but one hasn't been supplied with SetTDXSecretProvider.
+	ErrNoTDXSecretProvider = errors.New("no TDX secret provider")
+)
+
+var (
+	devDir = "/dev"
+)
+
+const (
+	sevGuestDevice = "sev-guest"
+	tdxGuestDevice = "tdx_guest"
+)
+
+// Technology corresponds to a confidential computing technology.
+type Technology int
+
+const (
+	// TechnologySEVSNP corresponds to AMD SEV-SNP.
+	TechnologySEVSNP Technology = iota + 1
+
+	// TechnologyTDX corresponds to Intel TDX.
+	TechnologyTDX
+)
+
+func (t Technology) String() string {
+	switch t {
+	case TechnologySEVSNP:
+		return "sev-snp"
+	case TechnologyTDX:
+		return "tdx"
+	default:
+		return fmt.Sprintf("Technology(%d)", int(t))
+	}
+}
+
+// DetectTechnology returns the confidential computing technology that the
+// current guest is running with, based on the guest device that is present. If
+// there isn't one, ErrNoDevice is returned.
+func DetectTechnology() (Technology, error) {
+	for _, candidate := range []struct {
+		device string
+		tech   Technology
+	}{
+		{device: sevGuestDevice, tech: TechnologySEVSNP},
+		{device: tdxGuestDevice, tech: TechnologyTDX},
+	} {
+		_, err := os.Stat(filepath.Join(devDir, candidate.device))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return 0, fmt.Errorf("cannot determine if %s device exists: %w", candidate.device, err)
+		}
+		return candidate.tech, nil
+	}
+
+	return 0, ErrNoDevice
+}
+
+// TDXSecretProvider provides access to secrets that are only released to a TDX
+// guest after its TD quote has been verified, eg, by a key broker service.
+type TDXSecretProvider interface {
+	// NewSecret creates a new secret of at least 32 bytes that is bound to
+	// the measurements of the current guest, and returns it along with an
+	// identifier that can be used to obtain it again.
+	NewSecret() (id, secret []byte, err error)
+
+	// ObtainSecret obtains the secret with the specified identifier. This
+	// should only succeed if the measurements of the current guest match
+	// those that the secret is bound to.
+	ObtainSecret(id []byte) ([]byte, error)
+}
+
+var (
+	tdxSecretProviderMu sync.RWMutex
+	tdxSecretProvider   TDXSecretProvider
+)
+
+// SetTDXSecretProvider sets the provider that will be used by this platform to
+// create and obtain secrets on TDX guests.
+func SetTDXSecretProvider(p TDXSecretProvider) {
+	tdxSecretProviderMu.Lock()
+	tdxSecretProvider = p
+	tdxSecretProviderMu.Unlock()
+}
+
+func getTDXSecretProvider() (TDXSecretProvider, error) {
+	tdxSecretProviderMu.RLock()
+	p := tdxSecretProvider
+	tdxSecretProviderMu.RUnlock()
+
+	if p == nil {
+		return nil, ErrNoTDXSecretProvider
+	}
+	return p, nil
+}
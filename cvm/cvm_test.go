@@ -0,0 +1,217 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/cvm"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+// mockSNPFirmware emulates the key derivation performed by the SEV-SNP
+// firmware for a single guest.
+type mockSNPFirmware struct {
+	vcek []byte
+	vmrk []byte
+
+	policy      uint64
+	imageID     []byte
+	familyID    []byte
+	measurement []byte
+
+	requests []*SNPDerivedKeyRequest
+}
+
+func newMockSNPFirmware(c *C) *mockSNPFirmware {
+	return &mockSNPFirmware{
+		vcek:        testutil.DecodeHexString(c, "3f9b7a6dd1f0b4c2a58e7e1d9c0b2a4f6e8d0c1b3a5f7e9d1c3b5a7f9e1d3c5b"),
+		vmrk:        testutil.DecodeHexString(c, "a1c3e5f7092b4d6f81a3c5e7f90b2d4f6a8c0e2f4b6d8fa1c3e5f7092b4d6f81"),
+		policy:      0x30000,
+		imageID:     make([]byte, 16),
+		familyID:    make([]byte, 16),
+		measurement: testutil.DecodeHexString(c, "6b1a3e6f1c8d7a9b2e4f0d5c3a1b8e7f6d9c2b4a0e1f3d5c7b9a2e4f6d8c0b1a3e5f7d9c2b4a6e8f0d1c3b5a7e9f2d4c"),
+	}
+}
+
+func (f *mockSNPFirmware) getDerivedKey(req *SNPDerivedKeyRequest) ([]byte, error) {
+	f.requests = append(f.requests, req)
+
+	var rootKey []byte
+	switch req.RootKeySelect {
+	case SNPRootKeyVCEK:
+		rootKey = f.vcek
+	case SNPRootKeyVMRK:
+		rootKey = f.vmrk
+	default:
+		return nil, errors.New("firmware returned status 0x16")
+	}
+
+	h := hmac.New(sha256.New, rootKey)
+	binary.Write(h, binary.LittleEndian, req.GuestFieldSelect)
+	binary.Write(h, binary.LittleEndian, req.VMPL)
+	if req.GuestFieldSelect&SNPGuestFieldPolicy != 0 {
+		binary.Write(h, binary.LittleEndian, f.policy)
+	}
+	if req.GuestFieldSelect&SNPGuestFieldImageID != 0 {
+		h.Write(f.imageID)
+	}
+	if req.GuestFieldSelect&SNPGuestFieldFamilyID != 0 {
+		h.Write(f.familyID)
+	}
+	if req.GuestFieldSelect&SNPGuestFieldMeasurement != 0 {
+		h.Write(f.measurement)
+	}
+	if req.GuestFieldSelect&SNPGuestFieldGuestSVN != 0 {
+		binary.Write(h, binary.LittleEndian, req.GuestSVN)
+	}
+	if req.GuestFieldSelect&SNPGuestFieldTCBVersion != 0 {
+		binary.Write(h, binary.LittleEndian, req.TCBVersion)
+	}
+	return h.Sum(nil), nil
+}
+
+// mockTDXSecretProvider emulates a key broker service that releases secrets to
+// a TDX guest.
+type mockTDXSecretProvider struct {
+	secrets map[string][]byte
+	denied  bool
+}
+
+func newMockTDXSecretProvider() *mockTDXSecretProvider {
+	return &mockTDXSecretProvider{secrets: make(map[string][]byte)}
+}
+
+func (p *mockTDXSecretProvider) NewSecret() (id, secret []byte, err error) {
+	id = make([]byte, 16)
+	rand.Read(id)
+	secret = make([]byte, 32)
+	rand.Read(secret)
+	p.secrets[string(id)] = secret
+	return id, secret, nil
+}
+
+func (p *mockTDXSecretProvider) ObtainSecret(id []byte) ([]byte, error) {
+	if p.denied {
+		return nil, errors.New("quote verification failed")
+	}
+	secret, exists := p.secrets[string(id)]
+	if !exists {
+		return nil, errors.New("unknown secret")
+	}
+	return secret, nil
+}
+
+// cvmTestBase provides a mock confidential computing guest environment.
+type cvmTestBase struct {
+	snapd_testutil.BaseTest
+
+	devDir   string
+	firmware *mockSNPFirmware
+}
+
+func (b *cvmTestBase) SetUpTest(c *C) {
+	b.BaseTest.SetUpTest(c)
+
+	b.devDir = c.MkDir()
+	b.AddCleanup(MockDevDir(b.devDir))
+
+	b.firmware = newMockSNPFirmware(c)
+	b.AddCleanup(MockSNPGetDerivedKey(func(req *SNPDerivedKeyRequest) ([]byte, error) {
+		return b.firmware.getDerivedKey(req)
+	}))
+
+	b.AddCleanup(func() { SetTDXSecretProvider(nil) })
+}
+
+// addDevice creates a mock guest device with the specified name.
+func (b *cvmTestBase) addDevice(c *C, name string) {
+	c.Assert(ioutil.WriteFile(filepath.Join(b.devDir, name), nil, 0600), IsNil)
+}
+
+type cvmSuite struct {
+	cvmTestBase
+}
+
+var _ = Suite(&cvmSuite{})
+
+func (s *cvmSuite) TestDetectTechnologySEVSNP(c *C) {
+	s.addDevice(c, "sev-guest")
+
+	tech, err := DetectTechnology()
+	c.Check(err, IsNil)
+	c.Check(tech, Equals, TechnologySEVSNP)
+}
+
+func (s *cvmSuite) TestDetectTechnologyTDX(c *C) {
+	s.addDevice(c, "tdx_guest")
+
+	tech, err := DetectTechnology()
+	c.Check(err, IsNil)
+	c.Check(tech, Equals, TechnologyTDX)
+}
+
+func (s *cvmSuite) TestDetectTechnologyNoDevice(c *C) {
+	_, err := DetectTechnology()
+	c.Check(err, Equals, ErrNoDevice)
+}
+
+func (s *cvmSuite) TestTechnologyString(c *C) {
+	c.Check(TechnologySEVSNP.String(), Equals, "sev-snp")
+	c.Check(TechnologyTDX.String(), Equals, "tdx")
+	c.Check(Technology(5).String(), Equals, "Technology(5)")
+}
+
+func (s *cvmSuite) TestParseSNPDerivedKeyResponse(c *C) {
+	expected := testutil.DecodeHexString(c, "a3e1d45b9c0f2e6d7b8a1c3f5e9d2b4a6c8e0f1d3b5a7c9e2f4d6b8a0c1e3f5d")
+
+	data := make([]byte, 64)
+	copy(data[32:], expected)
+
+	key, err := ParseSNPDerivedKeyResponse(data)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+}
+
+func (s *cvmSuite) TestParseSNPDerivedKeyResponseErrorStatus(c *C) {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data, 0x16)
+
+	_, err := ParseSNPDerivedKeyResponse(data)
+	c.Check(err, ErrorMatches, `firmware returned status 0x16`)
+}
+
+func (s *cvmSuite) TestParseSNPDerivedKeyResponseInvalidSize(c *C) {
+	_, err := ParseSNPDerivedKeyResponse(bytes.Repeat([]byte{0}, 32))
+	c.Check(err, ErrorMatches, `invalid response size 32`)
+}
@@ -0,0 +1,56 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm
+
+const (
+	PlatformName = platformName
+)
+
+type (
+	AdditionalData         = additionalData
+	KeyData                = keyData
+	PlatformKeyDataHandler = platformKeyDataHandler
+	SNPDerivedKeyRequest   = snpDerivedKeyRequest
+	SNPKeyParams           = snpKeyParams
+)
+
+var (
+	ParseSNPDerivedKeyResponse = parseSNPDerivedKeyResponse
+)
+
+func MarshalAdditionalData(d AdditionalData) ([]byte, error) {
+	return d.bytes()
+}
+
+func MockDevDir(dir string) (restore func()) {
+	orig := devDir
+	devDir = dir
+	return func() {
+		devDir = orig
+	}
+}
+
+func MockSNPGetDerivedKey(fn func(*SNPDerivedKeyRequest) ([]byte, error)) (restore func()) {
+	orig := snpGetDerivedKey
+	snpGetDerivedKey = fn
+	return func() {
+		snpGetDerivedKey = orig
+	}
+}
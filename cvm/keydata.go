@@ -0,0 +1,314 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/snapcore/secboot"
+)
+
+const (
+	platformName = "cvm"
+
+	// defaultSNPGuestFields are the guest fields that keys are bound to on
+	// SEV-SNP if none are supplied.
+	defaultSNPGuestFields = SNPGuestFieldPolicy | SNPGuestFieldMeasurement
+
+	saltSize  = 32
+	nonceSize = 12
+)
+
+var (
+	secbootNewKeyData = secboot.NewKeyData
+)
+
+type additionalData struct {
+	Version    int
+	Generation int
+	KDFAlg     secboot.HashAlg
+	AuthMode   secboot.AuthMode
+}
+
+func (d additionalData) MarshalASN1(b *cryptobyte.Builder) {
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(int64(d.Version))
+		b.AddASN1Int64(int64(d.Generation))
+		d.KDFAlg.MarshalASN1(b)
+		b.AddASN1Enum(int64(d.AuthMode))
+	})
+}
+
+func (d additionalData) bytes() ([]byte, error) {
+	builder := cryptobyte.NewBuilder(nil)
+	d.MarshalASN1(builder)
+	return builder.Bytes()
+}
+
+// snpKeyParams contains the parameters used to request a SEV-SNP derived key.
+type snpKeyParams struct {
+	RootKey     SNPRootKey     `json:"root-key"`
+	GuestFields SNPGuestFields `json:"guest-fields"`
+	VMPL        uint32         `json:"vmpl"`
+	GuestSVN    uint32         `json:"guest-svn"`
+	TCBVersion  uint64         `json:"tcb-version"`
+}
+
+func (p *snpKeyParams) request() *snpDerivedKeyRequest {
+	return &snpDerivedKeyRequest{
+		RootKeySelect:    p.RootKey,
+		GuestFieldSelect: p.GuestFields,
+		VMPL:             p.VMPL,
+		GuestSVN:         p.GuestSVN,
+		TCBVersion:       p.TCBVersion,
+	}
+}
+
+type keyData struct {
+	Version    int        `json:"version"`
+	Technology Technology `json:"technology"`
+
+	SNP         *snpKeyParams `json:"snp,omitempty"`           // The parameters for the SEV-SNP derived key
+	TDXSecretID []byte        `json:"tdx-secret-id,omitempty"` // The identifier of the secret from the TDXSecretProvider
+
+	Salt  []byte `json:"salt"`  // The HKDF salt
+	Nonce []byte `json:"nonce"` // The GCM nonce
+}
+
+// obtainSecret obtains the secret that is used to derive the key that protects
+// the payload, using the confidential computing technology that this key data is
+// bound to.
+func (kd *keyData) obtainSecret() ([]byte, error) {
+	switch kd.Technology {
+	case TechnologySEVSNP:
+		return snpGetDerivedKey(kd.SNP.request())
+	case TechnologyTDX:
+		p, err := getTDXSecretProvider()
+		if err != nil {
+			return nil, err
+		}
+		return p.ObtainSecret(kd.TDXSecretID)
+	default:
+		return nil, fmt.Errorf("unsupported technology %v", kd.Technology)
+	}
+}
+
+// deriveAESKey derives the key used to protect the payload from the secret
+// obtained from the confidential computing technology.
+func deriveAESKey(secret, salt []byte) []byte {
+	r := hkdf.New(crypto.SHA256.New, secret, salt, []byte("ENCRYPT"))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(r, key); err != nil {
+		panic(fmt.Sprintf("cannot derive key: %v", err))
+	}
+
+	return key
+}
+
+func newAEAD(secret, salt, nonce []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(deriveAESKey(secret, salt))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(b, len(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create AEAD: %w", err)
+	}
+	return aead, nil
+}
+
+// ProtectKeyParams provides the parameters to NewProtectedKey.
+type ProtectKeyParams struct {
+	// Technology is the confidential computing technology to protect the
+	// new key with. If this is zero, the technology of the current guest
+	// is detected with DetectTechnology.
+	Technology Technology
+
+	// SNPRootKey is the root key that the SEV-SNP derived key is derived
+	// from. The default is SNPRootKeyVCEK.
+	SNPRootKey SNPRootKey
+
+	// SNPGuestFields are the guest fields that the SEV-SNP derived key is
+	// bound to. If this is zero, the key is bound to the guest policy and
+	// launch measurement.
+	SNPGuestFields SNPGuestFields
+
+	// SNPVMPL is the VM privilege level that the SEV-SNP derived key is
+	// bound to. This must be greater than or equal to the VMPL of the
+	// guest.
+	SNPVMPL uint32
+
+	// SNPGuestSVN is the guest SVN that is mixed in to the SEV-SNP derived
+	// key if SNPGuestFieldGuestSVN is selected. This must not be greater
+	// than the guest SVN of the guest.
+	SNPGuestSVN uint32
+
+	// SNPTCBVersion is the TCB version that is mixed in to the SEV-SNP
+	// derived key if SNPGuestFieldTCBVersion is selected. This must not be
+	// greater than the committed TCB version of the platform.
+	SNPTCBVersion uint64
+
+	// Role describes the role of the new key.
+	Role string
+}
+
+// NewProtectedKey creates a new key that is protected by the confidential
+// computing technology specified in params.
+//
+// On SEV-SNP, the key is protected by a key derived by the secure processor
+// from the root key and guest fields specified in params. By default, this binds
+// the key to the launch measurement and policy of the current guest, so that it
+// can only be recovered by guests launched with the same image and policy. Note
+// that this means that a new key needs to be created from an updated image before
+// the old one can be retired.
+//
+// On TDX, the key is protected by a new secret obtained from the provider that
+// was supplied with SetTDXSecretProvider.
+//
+// If primaryKey isn't supplied, then one will be generated.
+//
+// This function requires some cryptographically strong randomness, obtained from the rand
+// argument. Whilst this will normally be from [rand.Reader], it can be provided from other
+// secure sources or mocked during tests.
+func NewProtectedKey(rand io.Reader, params *ProtectKeyParams, primaryKey secboot.PrimaryKey) (protectedKey *secboot.KeyData, primaryKeyOut secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	if params == nil {
+		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
+	}
+
+	tech := params.Technology
+	if tech == 0 {
+		tech, err = DetectTechnology()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot detect technology: %w", err)
+		}
+	}
+
+	kd := &keyData{
+		Version:    1,
+		Technology: tech,
+	}
+
+	var secret []byte
+
+	switch tech {
+	case TechnologySEVSNP:
+		if params.SNPRootKey != SNPRootKeyVCEK && params.SNPRootKey != SNPRootKeyVMRK {
+			return nil, nil, nil, fmt.Errorf("invalid SEV-SNP root key %d", params.SNPRootKey)
+		}
+		fields := params.SNPGuestFields
+		if fields == 0 {
+			fields = defaultSNPGuestFields
+		}
+		if !fields.valid() {
+			return nil, nil, nil, errInvalidSNPGuestFields
+		}
+		kd.SNP = &snpKeyParams{
+			RootKey:     params.SNPRootKey,
+			GuestFields: fields,
+			VMPL:        params.SNPVMPL,
+		}
+		if fields&SNPGuestFieldGuestSVN != 0 {
+			kd.SNP.GuestSVN = params.SNPGuestSVN
+		}
+		if fields&SNPGuestFieldTCBVersion != 0 {
+			kd.SNP.TCBVersion = params.SNPTCBVersion
+		}
+
+		secret, err = snpGetDerivedKey(kd.SNP.request())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot obtain derived key: %w", err)
+		}
+	case TechnologyTDX:
+		p, err := getTDXSecretProvider()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		kd.TDXSecretID, secret, err = p.NewSecret()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot create secret: %w", err)
+		}
+		if len(secret) < 32 {
+			return nil, nil, nil, errors.New("secret is too short")
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported technology %v", tech)
+	}
+
+	if len(primaryKey) == 0 {
+		primaryKey = make(secboot.PrimaryKey, 32)
+		if _, err := io.ReadFull(rand, primaryKey); err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot obtain primary key: %w", err)
+		}
+	}
+
+	kdfAlg := crypto.SHA256
+	unlockKey, payload, err := secboot.MakeDiskUnlockKey(rand, kdfAlg, primaryKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create new unlock key: %w", err)
+	}
+
+	// Obtain a 32-byte HKDF salt and a 12-byte GCM nonce.
+	randBytes := make([]byte, saltSize+nonceSize)
+	if _, err := io.ReadFull(rand, randBytes); err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot obtain required random bytes: %w", err)
+	}
+	kd.Salt = randBytes[:saltSize]
+	kd.Nonce = randBytes[saltSize:]
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: secboot.KeyDataGeneration,
+		KDFAlg:     secboot.HashAlg(kdfAlg),
+		AuthMode:   secboot.AuthModeNone,
+	}.bytes()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot serialize AAD: %w", err)
+	}
+
+	aead, err := newAEAD(secret, kd.Salt, kd.Nonce)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ciphertext := aead.Seal(nil, kd.Nonce, payload, aad)
+
+	protectedKey, err = secbootNewKeyData(&secboot.KeyParams{
+		Handle:           kd,
+		Role:             params.Role,
+		EncryptedPayload: ciphertext,
+		PlatformName:     platformName,
+		KDFAlg:           kdfAlg,
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create key data: %w", err)
+	}
+
+	return protectedKey, primaryKey, unlockKey, nil
+}
@@ -0,0 +1,199 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm_test
+
+import (
+	"crypto/rand"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/cvm"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type keydataSuite struct {
+	cvmTestBase
+}
+
+var _ = Suite(&keydataSuite{})
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNP(c *C) {
+	s.addDevice(c, "sev-guest")
+
+	kd, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Role: "foo"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, PlatformName)
+	c.Check(kd.Role(), Equals, "foo")
+	c.Check(kd.AuthMode(), Equals, secboot.AuthModeNone)
+	c.Check(primaryKey, HasLen, 32)
+
+	c.Assert(s.firmware.requests, HasLen, 1)
+	c.Check(s.firmware.requests[0], DeepEquals, &SNPDerivedKeyRequest{
+		RootKeySelect:    SNPRootKeyVCEK,
+		GuestFieldSelect: SNPGuestFieldPolicy | SNPGuestFieldMeasurement,
+	})
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+	c.Check(s.firmware.requests, HasLen, 2)
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPWithPrimaryKey(c *C) {
+	primaryKey := testutil.DecodeHexString(c, "7d5f2bd5d5e0b8e0e0b3bf1d5bfe8a1c5e4a8b9e0a0c3b3bc0f6e6a1f5a3c4b1")
+
+	kd, primaryKeyOut, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP}, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(primaryKeyOut, DeepEquals, secboot.PrimaryKey(primaryKey))
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, secboot.PrimaryKey(primaryKey))
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPCustomParams(c *C) {
+	params := &ProtectKeyParams{
+		Technology:     TechnologySEVSNP,
+		SNPRootKey:     SNPRootKeyVMRK,
+		SNPGuestFields: SNPGuestFieldFamilyID | SNPGuestFieldGuestSVN | SNPGuestFieldTCBVersion,
+		SNPVMPL:        1,
+		SNPGuestSVN:    3,
+		SNPTCBVersion:  0xdb18000000000004,
+	}
+	kd, _, unlockKey, err := NewProtectedKey(rand.Reader, params, nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.firmware.requests, HasLen, 1)
+	c.Check(s.firmware.requests[0], DeepEquals, &SNPDerivedKeyRequest{
+		RootKeySelect:    SNPRootKeyVMRK,
+		GuestFieldSelect: SNPGuestFieldFamilyID | SNPGuestFieldGuestSVN | SNPGuestFieldTCBVersion,
+		VMPL:             1,
+		GuestSVN:         3,
+		TCBVersion:       0xdb18000000000004,
+	})
+
+	// The key isn't bound to the measurement, so it can still be recovered
+	// after it changes.
+	s.firmware.measurement[0] ^= 0xff
+
+	recoveredUnlockKey, _, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Assert(s.firmware.requests, HasLen, 2)
+	c.Check(s.firmware.requests[1], DeepEquals, s.firmware.requests[0])
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPUnselectedFieldsIgnored(c *C) {
+	// Test that the guest SVN and TCB version aren't mixed in to the key
+	// if the corresponding fields aren't selected.
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP, SNPGuestSVN: 3, SNPTCBVersion: 4}, nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.firmware.requests, HasLen, 1)
+	c.Check(s.firmware.requests[0].GuestSVN, Equals, uint32(0))
+	c.Check(s.firmware.requests[0].TCBVersion, Equals, uint64(0))
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPMeasurementChanged(c *C) {
+	kd, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP}, nil)
+	c.Assert(err, IsNil)
+
+	s.firmware.measurement[0] ^= 0xff
+
+	_, _, err = kd.RecoverKeys()
+	c.Check(err, ErrorMatches, `invalid key data: cannot open payload: cipher: message authentication failed`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPInvalidRootKey(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP, SNPRootKey: 2}, nil)
+	c.Check(err, ErrorMatches, `invalid SEV-SNP root key 2`)
+	c.Check(s.firmware.requests, HasLen, 0)
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPInvalidGuestFields(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP, SNPGuestFields: 1 << 6}, nil)
+	c.Check(err, ErrorMatches, `invalid guest fields`)
+	c.Check(s.firmware.requests, HasLen, 0)
+}
+
+func (s *keydataSuite) TestNewProtectedKeySEVSNPError(c *C) {
+	s.AddCleanup(MockSNPGetDerivedKey(func(*SNPDerivedKeyRequest) ([]byte, error) {
+		return nil, ErrNoDevice
+	}))
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologySEVSNP}, nil)
+	c.Check(err, ErrorMatches, `cannot obtain derived key: no confidential computing guest device`)
+	c.Check(errors.Is(err, ErrNoDevice), testutil.IsTrue)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyTDX(c *C) {
+	s.addDevice(c, "tdx_guest")
+	provider := newMockTDXSecretProvider()
+	SetTDXSecretProvider(provider)
+
+	kd, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, PlatformName)
+	c.Check(provider.secrets, HasLen, 1)
+	c.Check(s.firmware.requests, HasLen, 0)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyTDXDenied(c *C) {
+	provider := newMockTDXSecretProvider()
+	SetTDXSecretProvider(provider)
+
+	kd, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologyTDX}, nil)
+	c.Assert(err, IsNil)
+
+	provider.denied = true
+
+	_, _, err = kd.RecoverKeys()
+	c.Check(err, ErrorMatches, `cannot perform action because of an unexpected error: cannot obtain secret: quote verification failed`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyTDXNoProvider(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: TechnologyTDX}, nil)
+	c.Check(err, Equals, ErrNoTDXSecretProvider)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoDevice(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot detect technology: no confidential computing guest device`)
+	c.Check(errors.Is(err, ErrNoDevice), testutil.IsTrue)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyUnsupportedTechnology(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Technology: 3}, nil)
+	c.Check(err, ErrorMatches, `unsupported technology Technology\(3\)`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoParams(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, nil, nil)
+	c.Check(err, ErrorMatches, `no ProtectKeyParams provided`)
+}
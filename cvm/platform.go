@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/snapcore/secboot"
+)
+
+type platformKeyDataHandler struct{}
+
+func decodeKeyData(data *secboot.PlatformKeyData) (*keyData, error) {
+	var kd *keyData
+	if err := json.Unmarshal(data.EncodedHandle, &kd); err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	}
+	if kd == nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no handle"),
+		}
+	}
+	if kd.Version != 1 {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("invalid version %d", kd.Version),
+		}
+	}
+	if len(kd.Salt) != saltSize {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("invalid salt size"),
+		}
+	}
+	switch {
+	case kd.Technology == TechnologySEVSNP && kd.SNP == nil:
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no SEV-SNP key parameters"),
+		}
+	case kd.Technology == TechnologySEVSNP && !kd.SNP.GuestFields.valid():
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errInvalidSNPGuestFields,
+		}
+	case kd.Technology != TechnologySEVSNP && kd.Technology != TechnologyTDX:
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("unsupported technology %v", kd.Technology),
+		}
+	}
+	return kd, nil
+}
+
+func (*platformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	kd, err := decodeKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: data.Generation,
+		KDFAlg:     secboot.HashAlg(data.KDFAlg),
+		AuthMode:   data.AuthMode,
+	}.bytes()
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot serialize AAD: %w", err),
+		}
+	}
+
+	secret, err := kd.obtainSecret()
+	switch {
+	case errors.Is(err, ErrNoDevice) || errors.Is(err, ErrNoTDXSecretProvider):
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorUnavailable,
+			Err:  fmt.Errorf("cannot obtain secret: %w", err),
+		}
+	case err != nil:
+		return nil, fmt.Errorf("cannot obtain secret: %w", err)
+	}
+
+	aead, err := newAEAD(secret, kd.Salt, kd.Nonce)
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	}
+
+	// If the guest's measurement or any other selected field differs from the one
+	// that the key was created with, the derived secret will be different and this
+	// will fail.
+	payload, err := aead.Open(nil, kd.Nonce, encryptedPayload, aad)
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot open payload: %w", err),
+		}
+	}
+
+	return payload, nil
+}
+
+func (*platformKeyDataHandler) RecoverKeysWithAuthKey(data *secboot.PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
+	return nil, errors.New("unsupported action")
+}
+
+func (*platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, old, new []byte) ([]byte, error) {
+	return nil, errors.New("unsupported action")
+}
+
+func init() {
+	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
+}
@@ -0,0 +1,206 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm_test
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/cvm"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type platformSuite struct {
+	cvmTestBase
+}
+
+var _ = Suite(&platformSuite{})
+
+func (s *platformSuite) newKeyData(c *C, kd *KeyData, generation int) (*secboot.PlatformKeyData, []byte) {
+	kd.Version = 1
+	kd.Salt = testutil.DecodeHexString(c, "5a2e0e5e9f3a4b3fd4c1b0a14e3d6b7b8b6f2c9d1e0a3f4b5c6d7e8f90a1b2c3")
+	kd.Nonce = testutil.DecodeHexString(c, "078535cc101b9d12d9b8f40e")
+
+	var secret []byte
+	if kd.SNP != nil {
+		var err error
+		secret, err = s.firmware.getDerivedKey(&SNPDerivedKeyRequest{
+			RootKeySelect:    kd.SNP.RootKey,
+			GuestFieldSelect: kd.SNP.GuestFields,
+			VMPL:             kd.SNP.VMPL,
+			GuestSVN:         kd.SNP.GuestSVN,
+			TCBVersion:       kd.SNP.TCBVersion})
+		c.Assert(err, IsNil)
+		s.firmware.requests = nil
+	} else {
+		secret = make([]byte, 32)
+	}
+
+	r := hkdf.New(crypto.SHA256.New, secret, kd.Salt, []byte("ENCRYPT"))
+	key := make([]byte, 32)
+	_, err := io.ReadFull(r, key)
+	c.Assert(err, IsNil)
+
+	b, err := aes.NewCipher(key)
+	c.Assert(err, IsNil)
+	aead, err := cipher.NewGCM(b)
+	c.Assert(err, IsNil)
+
+	aad, err := MarshalAdditionalData(AdditionalData{
+		Version:    1,
+		Generation: generation,
+		KDFAlg:     secboot.HashAlg(crypto.SHA256),
+		AuthMode:   secboot.AuthModeNone,
+	})
+	c.Assert(err, IsNil)
+
+	handle, err := json.Marshal(kd)
+	c.Assert(err, IsNil)
+
+	return &secboot.PlatformKeyData{
+		Generation:    generation,
+		EncodedHandle: handle,
+		KDFAlg:        crypto.SHA256,
+		AuthMode:      secboot.AuthModeNone,
+	}, aead.Seal(nil, kd.Nonce, []byte("payload"), aad)
+}
+
+func (s *platformSuite) newSNPKeyData(c *C, generation int) (*secboot.PlatformKeyData, []byte) {
+	return s.newKeyData(c, &KeyData{
+		Technology: TechnologySEVSNP,
+		SNP: &SNPKeyParams{
+			RootKey:     SNPRootKeyVCEK,
+			GuestFields: SNPGuestFieldPolicy | SNPGuestFieldMeasurement}}, generation)
+}
+
+func (s *platformSuite) TestRecoverKeys(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	payload, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("payload"))
+	c.Check(s.firmware.requests, HasLen, 1)
+}
+
+func (s *platformSuite) TestRecoverKeysWrongGeneration(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+	data.Generation = 1
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot open payload: cipher: message authentication failed`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysPolicyChanged(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+	s.firmware.policy |= 1 << 19
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot open payload: cipher: message authentication failed`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysNoDevice(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+	s.AddCleanup(MockSNPGetDerivedKey(func(*SNPDerivedKeyRequest) ([]byte, error) {
+		return nil, ErrNoDevice
+	}))
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot obtain secret: no confidential computing guest device`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysNoTDXSecretProvider(c *C) {
+	data, ciphertext := s.newKeyData(c, &KeyData{
+		Technology:  TechnologyTDX,
+		TDXSecretID: []byte("foo")}, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot obtain secret: no TDX secret provider`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysNoSNPParams(c *C) {
+	data, ciphertext := s.newKeyData(c, &KeyData{Technology: TechnologySEVSNP}, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `no SEV-SNP key parameters`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysInvalidGuestFields(c *C) {
+	data, ciphertext := s.newKeyData(c, &KeyData{
+		Technology: TechnologySEVSNP,
+		SNP:        &SNPKeyParams{GuestFields: 1 << 7}}, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `invalid guest fields`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysUnsupportedTechnology(c *C) {
+	data, ciphertext := s.newKeyData(c, &KeyData{Technology: 3}, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `unsupported technology Technology\(3\)`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysInvalidVersion(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+	data.EncodedHandle = []byte(`{"version":2}`)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `invalid version 2`)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyUnsupported(c *C) {
+	data, ciphertext := s.newSNPKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, nil)
+	c.Check(err, ErrorMatches, `unsupported action`)
+}
@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SNPRootKey corresponds to the root key that a SEV-SNP derived key is derived
+// from.
+type SNPRootKey uint32
+
+const (
+	// SNPRootKeyVCEK corresponds to the chip-unique versioned chip
+	// endorsement key. Keys derived from this can only be obtained on the
+	// same physical machine.
+	SNPRootKeyVCEK SNPRootKey = 0
+
+	// SNPRootKeyVMRK corresponds to the VM root key, which is provided by
+	// the migration agent and follows the guest across migrations.
+	SNPRootKeyVMRK SNPRootKey = 1
+)
+
+// SNPGuestFields describes the guest parameters that are mixed into a SEV-SNP
+// derived key. A key that is derived with a field selected can only be obtained
+// by guests with the same value for that field.
+type SNPGuestFields uint64
+
+const (
+	// SNPGuestFieldPolicy binds the key to the guest policy.
+	SNPGuestFieldPolicy SNPGuestFields = 1 << iota
+
+	// SNPGuestFieldImageID binds the key to the image ID supplied at launch.
+	SNPGuestFieldImageID
+
+	// SNPGuestFieldFamilyID binds the key to the family ID supplied at launch.
+	SNPGuestFieldFamilyID
+
+	// SNPGuestFieldMeasurement binds the key to the launch measurement.
+	SNPGuestFieldMeasurement
+
+	// SNPGuestFieldGuestSVN binds the key to the supplied guest SVN.
+	SNPGuestFieldGuestSVN
+
+	// SNPGuestFieldTCBVersion binds the key to the supplied TCB version.
+	SNPGuestFieldTCBVersion
+)
+
+const (
+	// snpGetDerivedKeyIoctl is SNP_GET_DERIVED_KEY from linux/sev-guest.h,
+	// which is _IOWR('S', 0x1, struct snp_guest_request_ioctl).
+	snpGetDerivedKeyIoctl = 0xc0205301
+
+	snpMsgVersion = 1
+
+	snpDerivedKeySize         = 32
+	snpDerivedKeyResponseSize = 64
+)
+
+// snpDerivedKeyRequest corresponds to the MSG_KEY_REQ message from the SEV
+// Secure Nested Paging Firmware ABI specification, which is passed to the kernel
+// as struct snp_derived_key_req.
+type snpDerivedKeyRequest struct {
+	RootKeySelect    SNPRootKey
+	Reserved         uint32
+	GuestFieldSelect SNPGuestFields
+	VMPL             uint32
+	GuestSVN         uint32
+	TCBVersion       uint64
+}
+
+// snpGuestRequestIoctl corresponds to struct snp_guest_request_ioctl.
+type snpGuestRequestIoctl struct {
+	MsgVersion uint8
+	_          [7]uint8
+	ReqData    uint64
+	RespData   uint64
+	ExitInfo2  uint64
+}
+
+// parseSNPDerivedKeyResponse decodes the MSG_KEY_RSP message returned by the
+// firmware, and returns the derived key.
+func parseSNPDerivedKeyResponse(data []byte) ([]byte, error) {
+	if len(data) != snpDerivedKeyResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", len(data))
+	}
+	if status := binary.LittleEndian.Uint32(data); status != 0 {
+		return nil, fmt.Errorf("firmware returned status %#x", status)
+	}
+	key := make([]byte, snpDerivedKeySize)
+	copy(key, data[snpDerivedKeyResponseSize-snpDerivedKeySize:])
+	return key, nil
+}
+
+func snpGetDerivedKeyImpl(req *snpDerivedKeyRequest) ([]byte, error) {
+	f, err := os.OpenFile(filepath.Join(devDir, sevGuestDevice), os.O_RDWR, 0)
+	switch {
+	case os.IsNotExist(err):
+		return nil, ErrNoDevice
+	case err != nil:
+		return nil, fmt.Errorf("cannot open device: %w", err)
+	}
+	defer f.Close()
+
+	reqBuf := new(bytes.Buffer)
+	if err := binary.Write(reqBuf, binary.LittleEndian, req); err != nil {
+		return nil, fmt.Errorf("cannot serialize request: %w", err)
+	}
+	reqData := reqBuf.Bytes()
+	respData := make([]byte, snpDerivedKeyResponseSize)
+
+	ioctlReq := &snpGuestRequestIoctl{
+		MsgVersion: snpMsgVersion,
+		ReqData:    uint64(uintptr(unsafe.Pointer(&reqData[0]))),
+		RespData:   uint64(uintptr(unsafe.Pointer(&respData[0]))),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), snpGetDerivedKeyIoctl, uintptr(unsafe.Pointer(ioctlReq)))
+	runtime.KeepAlive(reqData)
+	runtime.KeepAlive(respData)
+	if errno != 0 {
+		return nil, fmt.Errorf("SNP_GET_DERIVED_KEY failed: %w (exitinfo2: %#x)", errno, ioctlReq.ExitInfo2)
+	}
+
+	return parseSNPDerivedKeyResponse(respData)
+}
+
+// snpGetDerivedKey requests a key from the SEV-SNP firmware, derived from the
+// parameters in the supplied request.
+var snpGetDerivedKey = snpGetDerivedKeyImpl
+
+// errInvalidSNPGuestFields is returned if a key is requested with unknown guest
+// fields selected.
+var errInvalidSNPGuestFields = errors.New("invalid guest fields")
+
+func (f SNPGuestFields) valid() bool {
+	const all = SNPGuestFieldPolicy | SNPGuestFieldImageID | SNPGuestFieldFamilyID | SNPGuestFieldMeasurement | SNPGuestFieldGuestSVN | SNPGuestFieldTCBVersion
+	return f&^all == 0
+}
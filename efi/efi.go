@@ -22,6 +22,8 @@ package efi
 import "github.com/canonical/go-tpm2"
 
 const (
+	kernelDataPCR   tpm2.Handle = 9
+	kernelBootPCR   tpm2.Handle = 11
 	kernelConfigPCR tpm2.Handle = 12
 )
 
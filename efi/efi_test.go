@@ -31,6 +31,7 @@ import (
 
 	efi "github.com/canonical/go-efilib"
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot/efi"
@@ -167,6 +168,10 @@ func (h *mockPeImageHandle) OpenSection(name string) *io.SectionReader {
 	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
 }
 
+func (h *mockPeImageHandle) OpenLoadedSection(name string) *io.SectionReader {
+	return h.OpenSection(name)
+}
+
 func (h *mockPeImageHandle) HasSection(name string) bool {
 	_, exists := h.sections[name]
 	return exists
@@ -758,6 +763,7 @@ type mockPcrProfileOptionVisitor struct {
 	pcrs         tpm2.HandleList
 	env          HostEnvironment
 	varModifiers []internal_efi.InitialVariablesModifier
+	log          *tcglog.Log
 }
 
 func (v *mockPcrProfileOptionVisitor) AddPCRs(pcrs ...tpm2.Handle) {
@@ -772,6 +778,10 @@ func (v *mockPcrProfileOptionVisitor) AddInitialVariablesModifier(fn internal_ef
 	v.varModifiers = append(v.varModifiers, fn)
 }
 
+func (v *mockPcrProfileOptionVisitor) SetEventLog(log *tcglog.Log) {
+	v.log = log
+}
+
 type mockVarReader struct {
 	ctx context.Context
 }
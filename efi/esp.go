@@ -0,0 +1,293 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"golang.org/x/xerrors"
+)
+
+// espPartitionType is the GPT partition type GUID for an EFI system partition.
+const espPartitionType = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+
+var (
+	udevDataDir      = "/run/udev/data"
+	sysClassBlockDir = "/sys/class/block"
+)
+
+// ESP corresponds to an EFI system partition. Systems that mirror the ESP
+// across more than one disk may boot from any copy, depending on which disk
+// the firmware selects.
+//
+// An ESP that is mirrored with md RAID1 (using metadata that is stored at the
+// end of each member, so that the firmware can read each member as a plain
+// FAT filesystem) is represented by the md device, and the member partitions
+// are listed in Members. The copies are kept identical by md, so there is only
+// one boot chain for them.
+type ESP struct {
+	Device     string   // The path of the block device
+	PartUUID   string   // The GPT partition UUID, or empty for a md RAID device
+	MountPoint string   // The path at which the ESP is mounted, or empty if it isn't mounted
+	Members    []string // The paths of the member partitions of a md RAID device
+}
+
+// String implements [fmt.Stringer].
+func (e *ESP) String() string {
+	if e.MountPoint == "" {
+		return e.Device
+	}
+	return fmt.Sprintf("%s (%s)", e.MountPoint, e.Device)
+}
+
+// Image returns an Image for the file at the specified path relative to the
+// root of this ESP. The ESP must be mounted.
+func (e *ESP) Image(path string) FileImage {
+	return NewFileImage(filepath.Join(e.MountPoint, path))
+}
+
+// readUdevProperties returns the properties recorded in the udev database for
+// the block device with the specified major and minor numbers.
+func readUdevProperties(major, minor int) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(udevDataDir, fmt.Sprintf("b%d:%d", major, minor)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "E:") {
+			continue
+		}
+		kv := strings.SplitN(line[2:], "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		props[kv[0]] = kv[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// readBlockDeviceNumber returns the major and minor numbers of the block
+// device with the specified name.
+func readBlockDeviceNumber(name string) (major, minor int, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysClassBlockDir, name, "dev"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return 0, 0, xerrors.Errorf("invalid device number: %w", err)
+	}
+	return major, minor, nil
+}
+
+// mdHolder returns the name of the md device that the block device with the
+// specified name is a member of, or an empty string if it isn't a member of a
+// md device.
+func mdHolder(name string) (string, error) {
+	holders, err := ioutil.ReadDir(filepath.Join(sysClassBlockDir, name, "holders"))
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	for _, holder := range holders {
+		if strings.HasPrefix(holder.Name(), "md") {
+			return holder.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// FindESPs returns all of the EFI system partitions, whether they are mounted
+// or not, in the order of their device names. An ESP is identified by its GPT
+// partition type, as recorded in the udev database. If an ESP is mounted, the
+// first mount point in the mount table is returned. Partitions that are
+// members of a md RAID device are returned as a single ESP for the md device.
+//
+// Unmounted ESPs have an empty MountPoint, and must be mounted by the caller
+// before the images on them can be used.
+func FindESPs() ([]*ESP, error) {
+	mounts, err := osutil.LoadMountInfo()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot load mount info: %w", err)
+	}
+	mountPoints := make(map[[2]int]string)
+	for _, mount := range mounts {
+		if mount.Root != "/" {
+			// Ignore bind mounts of subdirectories
+			continue
+		}
+		dev := [2]int{mount.DevMajor, mount.DevMinor}
+		if _, exists := mountPoints[dev]; !exists {
+			mountPoints[dev] = mount.MountDir
+		}
+	}
+
+	devices, err := ioutil.ReadDir(sysClassBlockDir)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot enumerate block devices: %w", err)
+	}
+
+	var esps []*ESP
+	raids := make(map[string]*ESP)
+	for _, device := range devices {
+		name := device.Name()
+		major, minor, err := readBlockDeviceNumber(name)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine device number for %s: %w", name, err)
+		}
+
+		props, err := readUdevProperties(major, minor)
+		switch {
+		case os.IsNotExist(err):
+			// Not a block device known to udev
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read udev properties for %s: %w", name, err)
+		}
+
+		if !strings.EqualFold(props["ID_PART_ENTRY_TYPE"], espPartitionType) {
+			continue
+		}
+
+		holder, err := mdHolder(name)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine holders of %s: %w", name, err)
+		}
+		if holder != "" {
+			esp, exists := raids[holder]
+			if !exists {
+				major, minor, err := readBlockDeviceNumber(holder)
+				if err != nil {
+					return nil, xerrors.Errorf("cannot determine device number for %s: %w", holder, err)
+				}
+				esp = &ESP{
+					Device:     filepath.Join("/dev", holder),
+					MountPoint: mountPoints[[2]int{major, minor}]}
+				raids[holder] = esp
+				esps = append(esps, esp)
+			}
+			esp.Members = append(esp.Members, filepath.Join("/dev", name))
+			continue
+		}
+
+		esps = append(esps, &ESP{
+			Device:     filepath.Join("/dev", name),
+			PartUUID:   strings.ToLower(props["ID_PART_ENTRY_UUID"]),
+			MountPoint: mountPoints[[2]int{major, minor}]})
+	}
+
+	return esps, nil
+}
+
+// ESPMismatchError is returned from CompareESPs if a file differs between
+// copies of the ESP.
+type ESPMismatchError struct {
+	Path string // The path of the file relative to the root of each ESP
+	ESPs [2]*ESP
+}
+
+func (e *ESPMismatchError) Error() string {
+	return fmt.Sprintf("%s differs between ESPs %v and %v", e.Path, e.ESPs[0], e.ESPs[1])
+}
+
+func digestESPFile(esp *ESP, path string) ([]byte, error) {
+	if esp.MountPoint == "" {
+		return nil, errors.New("ESP is not mounted")
+	}
+
+	f, err := os.Open(filepath.Join(esp.MountPoint, path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := crypto.SHA256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CompareESPs verifies that each of the files at the specified paths, which are
+// relative to the root of each ESP, are identical on all of the supplied ESPs.
+// If they are, a PCR profile computed from the images on any one of the ESPs
+// is valid for booting from all of them. If a file differs, a
+// *ESPMismatchError error is returned. In this case, the boot chain for each
+// ESP can be modelled as a separate branch with ForEachESP.
+func CompareESPs(paths []string, esps ...*ESP) error {
+	if len(esps) < 2 {
+		return nil
+	}
+
+	for _, path := range paths {
+		expected, err := digestESPFile(esps[0], path)
+		if err != nil {
+			return xerrors.Errorf("cannot compute digest of %s on ESP %v: %w", path, esps[0], err)
+		}
+		for _, esp := range esps[1:] {
+			digest, err := digestESPFile(esp, path)
+			if err != nil {
+				return xerrors.Errorf("cannot compute digest of %s on ESP %v: %w", path, esp, err)
+			}
+			if !bytes.Equal(digest, expected) {
+				return &ESPMismatchError{Path: path, ESPs: [2]*ESP{esps[0], esp}}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ForEachESP calls the supplied function for each of the supplied ESPs in order
+// to construct the boot chain for each copy, and returns the results. These can
+// be appended to an [ImageLoadSequences] so that each copy is modelled as a
+// separate branch in a PCR profile, eg:
+//
+//	sequences.Append(ForEachESP(esps, func(esp *ESP) ImageLoadActivity {
+//		return NewImageLoadActivity(esp.Image("EFI/ubuntu/shimx64.efi")).Loads(
+//			NewImageLoadActivity(esp.Image("EFI/ubuntu/grubx64.efi")))
+//	})...)
+func ForEachESP(esps []*ESP, fn func(esp *ESP) ImageLoadActivity) []ImageLoadActivity {
+	var out []ImageLoadActivity
+	for _, esp := range esps {
+		out = append(out, fn(esp))
+	}
+	return out
+}
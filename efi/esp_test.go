@@ -0,0 +1,216 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/osutil"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+)
+
+type espSuite struct {
+	udevDataDir      string
+	sysClassBlockDir string
+}
+
+func (s *espSuite) SetUpTest(c *C) {
+	s.udevDataDir = c.MkDir()
+	s.sysClassBlockDir = c.MkDir()
+}
+
+var _ = Suite(&espSuite{})
+
+func (s *espSuite) writeUdevData(c *C, dev, content string) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.udevDataDir, dev), []byte(content), 0644), IsNil)
+}
+
+func (s *espSuite) writeBlockDevice(c *C, name, dev string, holders ...string) {
+	c.Assert(os.MkdirAll(filepath.Join(s.sysClassBlockDir, name, "holders"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.sysClassBlockDir, name, "dev"), []byte(dev+"\n"), 0644), IsNil)
+	for _, holder := range holders {
+		c.Assert(os.MkdirAll(filepath.Join(s.sysClassBlockDir, name, "holders", holder), 0755), IsNil)
+	}
+}
+
+func (s *espSuite) makeESP(c *C, files map[string]string) *ESP {
+	dir := c.MkDir()
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+	return &ESP{Device: "/dev/sda1", MountPoint: dir}
+}
+
+func (s *espSuite) mockDirs() (restore func()) {
+	restoreUdev := MockUdevDataDir(s.udevDataDir)
+	restoreSysfs := MockSysClassBlockDir(s.sysClassBlockDir)
+	return func() {
+		restoreSysfs()
+		restoreUdev()
+	}
+}
+
+func (s *espSuite) TestFindESPs(c *C) {
+	restore := s.mockDirs()
+	defer restore()
+	restore = osutil.MockMountInfo(`26 1 253:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+27 26 8:1 / /boot/efi rw,relatime shared:2 - vfat /dev/sda1 rw
+28 26 8:17 / /boot/efi2 rw,relatime shared:3 - vfat /dev/sdb1 rw
+29 26 0:5 / /dev rw,nosuid shared:4 - devtmpfs udev rw
+30 26 8:1 / /mnt/esp rw,relatime shared:5 - vfat /dev/sda1 rw
+`)
+	defer restore()
+
+	s.writeBlockDevice(c, "vda1", "253:1")
+	s.writeBlockDevice(c, "sda1", "8:1")
+	s.writeBlockDevice(c, "sdb1", "8:17")
+	s.writeUdevData(c, "b253:1", "E:ID_PART_ENTRY_TYPE=0fc63daf-8483-4772-8e79-3d69d8477de4\nE:ID_PART_ENTRY_UUID=8a7e8a5a-5f43-4e2e-9e55-17e66e3c1a10\n")
+	s.writeUdevData(c, "b8:1", "S:disk/by-partuuid/a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11\nE:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\nE:ID_PART_ENTRY_UUID=a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11\n")
+	s.writeUdevData(c, "b8:17", "E:ID_PART_ENTRY_TYPE=C12A7328-F81F-11D2-BA4B-00A0C93EC93B\nE:ID_PART_ENTRY_UUID=3F0D9A2E-7C1B-4B6A-8E21-5D4C3B2A1908\n")
+
+	esps, err := FindESPs()
+	c.Assert(err, IsNil)
+	c.Check(esps, DeepEquals, []*ESP{
+		{Device: "/dev/sda1", PartUUID: "a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11", MountPoint: "/boot/efi"},
+		{Device: "/dev/sdb1", PartUUID: "3f0d9a2e-7c1b-4b6a-8e21-5d4c3b2a1908", MountPoint: "/boot/efi2"},
+	})
+}
+
+func (s *espSuite) TestFindESPsUnmounted(c *C) {
+	restore := s.mockDirs()
+	defer restore()
+	restore = osutil.MockMountInfo(`26 1 253:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+27 26 8:1 / /boot/efi rw,relatime shared:2 - vfat /dev/sda1 rw
+`)
+	defer restore()
+
+	s.writeBlockDevice(c, "loop0", "7:0")
+	s.writeBlockDevice(c, "sda1", "8:1")
+	s.writeBlockDevice(c, "sdb1", "8:17")
+	s.writeUdevData(c, "b8:1", "E:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\nE:ID_PART_ENTRY_UUID=a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11\n")
+	s.writeUdevData(c, "b8:17", "E:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\nE:ID_PART_ENTRY_UUID=3f0d9a2e-7c1b-4b6a-8e21-5d4c3b2a1908\n")
+
+	esps, err := FindESPs()
+	c.Assert(err, IsNil)
+	c.Check(esps, DeepEquals, []*ESP{
+		{Device: "/dev/sda1", PartUUID: "a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11", MountPoint: "/boot/efi"},
+		{Device: "/dev/sdb1", PartUUID: "3f0d9a2e-7c1b-4b6a-8e21-5d4c3b2a1908"},
+	})
+	c.Check(esps[1].String(), Equals, "/dev/sdb1")
+}
+
+func (s *espSuite) TestFindESPsMDRAID(c *C) {
+	restore := s.mockDirs()
+	defer restore()
+	restore = osutil.MockMountInfo(`26 1 253:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+27 26 9:127 / /boot/efi rw,relatime shared:2 - vfat /dev/md127 rw
+`)
+	defer restore()
+
+	s.writeBlockDevice(c, "md127", "9:127")
+	s.writeBlockDevice(c, "sda1", "8:1", "md127")
+	s.writeBlockDevice(c, "sdb1", "8:17", "md127")
+	s.writeUdevData(c, "b9:127", "E:MD_LEVEL=raid1\n")
+	s.writeUdevData(c, "b8:1", "E:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\nE:ID_PART_ENTRY_UUID=a6e2c1b4-d1aa-4c07-9f38-1f5a5e0c2b11\n")
+	s.writeUdevData(c, "b8:17", "E:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\nE:ID_PART_ENTRY_UUID=3f0d9a2e-7c1b-4b6a-8e21-5d4c3b2a1908\n")
+
+	esps, err := FindESPs()
+	c.Assert(err, IsNil)
+	c.Check(esps, DeepEquals, []*ESP{
+		{Device: "/dev/md127", MountPoint: "/boot/efi", Members: []string{"/dev/sda1", "/dev/sdb1"}},
+	})
+}
+
+func (s *espSuite) TestFindESPsNone(c *C) {
+	restore := s.mockDirs()
+	defer restore()
+	restore = osutil.MockMountInfo(`26 1 253:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+`)
+	defer restore()
+
+	s.writeBlockDevice(c, "vda1", "253:1")
+	s.writeUdevData(c, "b253:1", "E:ID_PART_ENTRY_TYPE=0fc63daf-8483-4772-8e79-3d69d8477de4\n")
+
+	esps, err := FindESPs()
+	c.Check(err, IsNil)
+	c.Check(esps, HasLen, 0)
+}
+
+func (s *espSuite) TestESPImage(c *C) {
+	esp := &ESP{MountPoint: "/boot/efi"}
+	c.Check(esp.Image("EFI/ubuntu/shimx64.efi"), Equals, FileImage("/boot/efi/EFI/ubuntu/shimx64.efi"))
+}
+
+func (s *espSuite) TestCompareESPsIdentical(c *C) {
+	files := map[string]string{
+		"EFI/ubuntu/shimx64.efi": "shim",
+		"EFI/ubuntu/grubx64.efi": "grub"}
+	esp1 := s.makeESP(c, files)
+	esp2 := s.makeESP(c, files)
+
+	c.Check(CompareESPs([]string{"EFI/ubuntu/shimx64.efi", "EFI/ubuntu/grubx64.efi"}, esp1, esp2), IsNil)
+}
+
+func (s *espSuite) TestCompareESPsMismatch(c *C) {
+	esp1 := s.makeESP(c, map[string]string{
+		"EFI/ubuntu/shimx64.efi": "shim",
+		"EFI/ubuntu/grubx64.efi": "grub"})
+	esp2 := s.makeESP(c, map[string]string{
+		"EFI/ubuntu/shimx64.efi": "shim",
+		"EFI/ubuntu/grubx64.efi": "grub2"})
+
+	err := CompareESPs([]string{"EFI/ubuntu/shimx64.efi", "EFI/ubuntu/grubx64.efi"}, esp1, esp2)
+	c.Assert(err, FitsTypeOf, &ESPMismatchError{})
+	c.Check(err.(*ESPMismatchError).Path, Equals, "EFI/ubuntu/grubx64.efi")
+	c.Check(err.(*ESPMismatchError).ESPs, DeepEquals, [2]*ESP{esp1, esp2})
+}
+
+func (s *espSuite) TestCompareESPsMissingFile(c *C) {
+	esp1 := s.makeESP(c, map[string]string{"EFI/ubuntu/shimx64.efi": "shim"})
+	esp2 := s.makeESP(c, nil)
+
+	err := CompareESPs([]string{"EFI/ubuntu/shimx64.efi"}, esp1, esp2)
+	c.Check(err, ErrorMatches, `cannot compute digest of EFI/ubuntu/shimx64.efi on ESP .*: open .*: no such file or directory`)
+}
+
+func (s *espSuite) TestCompareESPsNotMounted(c *C) {
+	esp1 := s.makeESP(c, map[string]string{"EFI/ubuntu/shimx64.efi": "shim"})
+	esp2 := &ESP{Device: "/dev/sdb1"}
+
+	err := CompareESPs([]string{"EFI/ubuntu/shimx64.efi"}, esp1, esp2)
+	c.Check(err, ErrorMatches, `cannot compute digest of EFI/ubuntu/shimx64.efi on ESP /dev/sdb1: ESP is not mounted`)
+}
+
+func (s *espSuite) TestForEachESP(c *C) {
+	esps := []*ESP{{MountPoint: "/boot/efi"}, {MountPoint: "/boot/efi2"}}
+
+	activities := ForEachESP(esps, func(esp *ESP) ImageLoadActivity {
+		return NewImageLoadActivity(esp.Image("EFI/ubuntu/shimx64.efi"))
+	})
+	c.Assert(activities, HasLen, 2)
+	c.Check(activities[0], DeepEquals, NewImageLoadActivity(FileImage("/boot/efi/EFI/ubuntu/shimx64.efi")))
+	c.Check(activities[1], DeepEquals, NewImageLoadActivity(FileImage("/boot/efi2/EFI/ubuntu/shimx64.efi")))
+}
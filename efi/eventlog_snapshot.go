@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/canonical/tcglog-parser"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// eventLogSnapshotVersionTCG12 indicates that a snapshot contains a log in the
+	// legacy TCG 1.2 format, with SHA-1 digests only.
+	eventLogSnapshotVersionTCG12 = 1
+
+	// eventLogSnapshotVersionTCG2 indicates that a snapshot contains a log in the
+	// crypto-agile TCG2 format.
+	eventLogSnapshotVersionTCG2 = 2
+
+	// eventLogSnapshotMaxSize is the maximum size of a log in a snapshot. Real
+	// logs are much smaller than this, and it prevents a corrupted snapshot
+	// from causing an excessive allocation.
+	eventLogSnapshotMaxSize = 16 * 1024 * 1024
+
+	// finalEventsTableVersion is the supported version of the
+	// EFI_TCG2_FINAL_EVENTS_TABLE.
+	finalEventsTableVersion = 1
+)
+
+// eventLogSnapshotHeader corresponds to the header of the LINUX_EFI_TPM_EVENT_LOG
+// configuration table, which is how the Linux EFI stub hands over the log that it
+// obtains from the firmware's EFI_TCG2_PROTOCOL.GetEventLog.
+type eventLogSnapshotHeader struct {
+	Size                   uint32 // The size of the log that follows
+	FinalEventsPrebootSize uint32 // The size of the events at the start of the final events table that are already in the log
+	Version                uint8
+}
+
+// finalEventsTableHeader corresponds to the header of the EFI_TCG2_FINAL_EVENTS_TABLE
+// configuration table, which contains the events measured after the first call to
+// EFI_TCG2_PROTOCOL.GetEventLog.
+type finalEventsTableHeader struct {
+	Version        uint64
+	NumberOfEvents uint64
+}
+
+// countingReader counts the number of bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(data []byte) (n int, err error) {
+	n, err = r.r.Read(data)
+	r.n += int64(n)
+	return n, err
+}
+
+// readFinalEvents reads the events from the EFI_TCG2_FINAL_EVENTS_TABLE that
+// follows the log in a snapshot, if there is one, and appends the ones that
+// aren't already in the log to it. This is the same as what the kernel does
+// for the log that it exposes in sysfs.
+func readFinalEvents(r io.Reader, log *tcglog.Log, prebootSize uint32) error {
+	var hdr finalEventsTableHeader
+	switch err := binary.Read(r, binary.LittleEndian, &hdr); {
+	case err == io.EOF:
+		// No final events table
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+	if hdr.Version != finalEventsTableVersion {
+		return fmt.Errorf("unsupported version %d", hdr.Version)
+	}
+	if !log.Spec.IsEFI_2() {
+		return errors.New("log is not in the crypto-agile format")
+	}
+
+	specId, ok := log.Events[0].Data.(*tcglog.SpecIdEvent03)
+	if !ok {
+		return errors.New("log has no spec ID event")
+	}
+
+	cr := &countingReader{r: io.LimitReader(r, eventLogSnapshotMaxSize)}
+	for i := uint64(0); i < hdr.NumberOfEvents; i++ {
+		offset := cr.n
+		ev, err := tcglog.ReadEventCryptoAgile(cr, specId.DigestSizes, &tcglog.LogOptions{})
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return xerrors.Errorf("cannot read event %d: %w", i, err)
+		}
+		switch {
+		case offset < int64(prebootSize) && cr.n > int64(prebootSize):
+			return fmt.Errorf("pre-boot size %d is not on an event boundary", prebootSize)
+		case offset < int64(prebootSize):
+			// This event is already in the log.
+		default:
+			log.Events = append(log.Events, ev)
+		}
+	}
+	if cr.n < int64(prebootSize) {
+		return fmt.Errorf("pre-boot size %d exceeds the size of the events", prebootSize)
+	}
+
+	return nil
+}
+
+// ReadEventLogSnapshot reads a TCG event log from a snapshot that was handed over by
+// the bootloader, for environments where the log can't be read from sysfs. The snapshot
+// has the same format as the LINUX_EFI_TPM_EVENT_LOG EFI configuration table that the
+// Linux EFI stub uses to hand over the log to the kernel - a little-endian 32-bit log
+// size, a 32-bit final events pre-boot size, an 8-bit version (1 for a TCG 1.2 format
+// log or 2 for a crypto-agile TCG2 format log) and then the log itself, as returned from
+// the firmware's EFI_TCG2_PROTOCOL.GetEventLog.
+//
+// Events that are measured after the call to GetEventLog are only recorded in the
+// EFI_TCG2_FINAL_EVENTS_TABLE configuration table, so a copy of this table should
+// follow the log in the snapshot. The final events pre-boot size is the size of the
+// events at the start of this table that were measured before the log was copied,
+// and which are therefore already in it. The remaining events are appended to the
+// returned log, in the same way that the kernel does for the log in sysfs. If the
+// snapshot ends after the log, it is assumed that there is no final events table.
+//
+// The returned log can be used for PCR profile generation and by SimulateNextBoot
+// in place of the log read from sysfs by supplying it with the WithEventLog option.
+func ReadEventLogSnapshot(r io.Reader) (*tcglog.Log, error) {
+	var hdr eventLogSnapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+	switch hdr.Version {
+	case eventLogSnapshotVersionTCG12, eventLogSnapshotVersionTCG2:
+		// ok
+	default:
+		return nil, fmt.Errorf("unsupported version %d", hdr.Version)
+	}
+	if hdr.Size == 0 {
+		return nil, errors.New("empty log")
+	}
+	if hdr.Size > eventLogSnapshotMaxSize {
+		return nil, fmt.Errorf("log size %d is too large", hdr.Size)
+	}
+
+	data := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, xerrors.Errorf("cannot read log: %w", err)
+	}
+
+	log, err := tcglog.ReadLog(bytes.NewReader(data), &tcglog.LogOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode log: %w", err)
+	}
+
+	if err := readFinalEvents(r, log, hdr.FinalEventsPrebootSize); err != nil {
+		return nil, xerrors.Errorf("cannot read final events table: %w", err)
+	}
+
+	return log, nil
+}
+
+// ReadEventLogSnapshotFile reads a TCG event log from the snapshot file at the
+// specified path. See ReadEventLogSnapshot for a description of the format.
+func ReadEventLogSnapshotFile(path string) (*tcglog.Log, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadEventLogSnapshot(f)
+}
+
+type eventLogOption struct {
+	log *tcglog.Log
+}
+
+// WithEventLog overrides the TCG event log used for a PCR profile or by
+// SimulateNextBoot with the supplied log, instead of the one obtained from the
+// host environment. This is useful on hosts where the log can't be read from
+// sysfs but can be obtained from a snapshot handed over by the bootloader with
+// ReadEventLogSnapshot. EFI variables are still read from the host environment.
+func WithEventLog(log *tcglog.Log) PCRProfileOption {
+	return &eventLogOption{log: log}
+}
+
+func (o *eventLogOption) ApplyOptionTo(visitor internal_efi.PCRProfileOptionVisitor) error {
+	visitor.SetEventLog(o.log)
+	return nil
+}
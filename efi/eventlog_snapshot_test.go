@@ -0,0 +1,199 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/efitest"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type eventLogSnapshotSuite struct{}
+
+var _ = Suite(&eventLogSnapshotSuite{})
+
+func (s *eventLogSnapshotSuite) makeSnapshot(c *C, version uint8, log *tcglog.Log) []byte {
+	logData := new(bytes.Buffer)
+	c.Assert(log.Write(logData), IsNil)
+
+	w := new(bytes.Buffer)
+	c.Assert(binary.Write(w, binary.LittleEndian, uint32(logData.Len())), IsNil)
+	c.Assert(binary.Write(w, binary.LittleEndian, uint32(0)), IsNil)
+	c.Assert(binary.Write(w, binary.LittleEndian, version), IsNil)
+	w.Write(logData.Bytes())
+	return w.Bytes()
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshot(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	log, err := ReadEventLogSnapshot(bytes.NewReader(s.makeSnapshot(c, 2, expected)))
+	c.Assert(err, IsNil)
+	c.Check(log.Algorithms, DeepEquals, expected.Algorithms)
+	c.Assert(log.Events, HasLen, len(expected.Events))
+	for i, ev := range log.Events {
+		c.Check(ev.PCRIndex, Equals, expected.Events[i].PCRIndex)
+		c.Check(ev.EventType, Equals, expected.Events[i].EventType)
+		c.Check(ev.Digests, DeepEquals, expected.Events[i].Digests)
+	}
+}
+
+func (s *eventLogSnapshotSuite) makeFinalEventsTable(c *C, log *tcglog.Log, events []*tcglog.Event) []byte {
+	specId, ok := log.Events[0].Data.(*tcglog.SpecIdEvent03)
+	c.Assert(ok, testutil.IsTrue)
+
+	w := new(bytes.Buffer)
+	c.Assert(binary.Write(w, binary.LittleEndian, uint64(1)), IsNil)
+	c.Assert(binary.Write(w, binary.LittleEndian, uint64(len(events))), IsNil)
+	for _, ev := range events {
+		c.Assert(ev.WriteCryptoAgile(w, specId.DigestSizes), IsNil)
+	}
+	return w.Bytes()
+}
+
+func (s *eventLogSnapshotSuite) eventSize(c *C, log *tcglog.Log, ev *tcglog.Event) uint32 {
+	specId, ok := log.Events[0].Data.(*tcglog.SpecIdEvent03)
+	c.Assert(ok, testutil.IsTrue)
+
+	w := new(bytes.Buffer)
+	c.Assert(ev.WriteCryptoAgile(w, specId.DigestSizes), IsNil)
+	return uint32(w.Len())
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFinalEvents(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	n := len(expected.Events)
+
+	// The last 3 events are in the final events table, and the first of
+	// these was measured before the log was copied.
+	copied := &tcglog.Log{Spec: expected.Spec, Algorithms: expected.Algorithms, Events: expected.Events[:n-2]}
+	data := s.makeSnapshot(c, 2, copied)
+	binary.LittleEndian.PutUint32(data[4:], s.eventSize(c, expected, expected.Events[n-3]))
+	data = append(data, s.makeFinalEventsTable(c, expected, expected.Events[n-3:])...)
+
+	log, err := ReadEventLogSnapshot(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(log.Events, HasLen, n)
+	for i, ev := range log.Events {
+		c.Check(ev.PCRIndex, Equals, expected.Events[i].PCRIndex)
+		c.Check(ev.EventType, Equals, expected.Events[i].EventType)
+		c.Check(ev.Digests, DeepEquals, expected.Events[i].Digests)
+	}
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFinalEventsNoneNew(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	n := len(expected.Events)
+
+	data := s.makeSnapshot(c, 2, expected)
+	binary.LittleEndian.PutUint32(data[4:], s.eventSize(c, expected, expected.Events[n-1]))
+	data = append(data, s.makeFinalEventsTable(c, expected, expected.Events[n-1:])...)
+
+	log, err := ReadEventLogSnapshot(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(log.Events, HasLen, n)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFinalEventsUnsupportedVersion(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	data := append(s.makeSnapshot(c, 2, expected), make([]byte, 64)...)
+	_, err := ReadEventLogSnapshot(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `cannot read final events table: unsupported version 0`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFinalEventsTruncated(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	n := len(expected.Events)
+
+	data := append(s.makeSnapshot(c, 2, expected), s.makeFinalEventsTable(c, expected, expected.Events[n-2:])...)
+	_, err := ReadEventLogSnapshot(bytes.NewReader(data[:len(data)-10]))
+	c.Check(err, ErrorMatches, `cannot read final events table: cannot read event 1: unexpected EOF`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFinalEventsBadPrebootSize(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	n := len(expected.Events)
+
+	data := s.makeSnapshot(c, 2, expected)
+	binary.LittleEndian.PutUint32(data[4:], 10)
+	data = append(data, s.makeFinalEventsTable(c, expected, expected.Events[n-1:])...)
+
+	_, err := ReadEventLogSnapshot(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `cannot read final events table: pre-boot size 10 is not on an event boundary`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotFile(c *C) {
+	expected := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	path := filepath.Join(c.MkDir(), "eventlog")
+	c.Assert(ioutil.WriteFile(path, s.makeSnapshot(c, 2, expected), 0600), IsNil)
+
+	log, err := ReadEventLogSnapshotFile(path)
+	c.Assert(err, IsNil)
+	c.Check(log.Events, HasLen, len(expected.Events))
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotUnsupportedVersion(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	_, err := ReadEventLogSnapshot(bytes.NewReader(s.makeSnapshot(c, 3, log)))
+	c.Check(err, ErrorMatches, `unsupported version 3`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotEmpty(c *C) {
+	_, err := ReadEventLogSnapshot(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 0, 2}))
+	c.Check(err, ErrorMatches, `empty log`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotTooLarge(c *C) {
+	_, err := ReadEventLogSnapshot(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 2}))
+	c.Check(err, ErrorMatches, `log size 4294967295 is too large`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotTruncatedHeader(c *C) {
+	_, err := ReadEventLogSnapshot(bytes.NewReader([]byte{0, 1, 0, 0}))
+	c.Check(err, ErrorMatches, `cannot read header: unexpected EOF`)
+}
+
+func (s *eventLogSnapshotSuite) TestReadEventLogSnapshotTruncatedLog(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	data := s.makeSnapshot(c, 2, log)
+	_, err := ReadEventLogSnapshot(bytes.NewReader(data[:len(data)-10]))
+	c.Check(err, ErrorMatches, `cannot read log: unexpected EOF`)
+}
+
+func (s *eventLogSnapshotSuite) TestWithEventLog(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	visitor := new(mockPcrProfileOptionVisitor)
+	c.Check(WithEventLog(log).ApplyOptionTo(visitor), IsNil)
+	c.Check(visitor.log, Equals, log)
+}
@@ -30,7 +30,10 @@ import (
 // Export constants for testing
 const (
 	GrubChainloaderUsesShimProtocol            = grubChainloaderUsesShimProtocol
+	KernelBootPCR                              = kernelBootPCR
 	KernelConfigPCR                            = kernelConfigPCR
+	KernelDataPCR                              = kernelDataPCR
+	LoaderUsesShimProtocolIfPresent            = loaderUsesShimProtocolIfPresent
 	ShimFixVariableAuthorityEventsMatchSpec    = shimFixVariableAuthorityEventsMatchSpec
 	ShimHasSbatRevocationManagement            = shimHasSbatRevocationManagement
 	ShimHasSbatVerification                    = shimHasSbatVerification
@@ -70,12 +73,14 @@ var (
 	NewSecureBootNamespaceRules                 = newSecureBootNamespaceRules
 	NewShimImageHandle                          = newShimImageHandle
 	NewShimLoadHandler                          = newShimLoadHandler
+	NewUKILoadHandler                           = newUKILoadHandler
 	NewShimLoadHandlerConstructor               = newShimLoadHandlerConstructor
 	NewVariableSetCollector                     = newVariableSetCollector
 	OpenPeImage                                 = openPeImage
 	ParseShimVersion                            = parseShimVersion
 	ParseShimVersionDataIdent                   = parseShimVersionDataIdent
 	ReadShimSbatPolicy                          = readShimSbatPolicy
+	ReplayLog                                   = replayLog
 	SbatSectionExists                           = sbatSectionExists
 	ShimGuid                                    = shimGuid
 	ShimVersionIs                               = shimVersionIs
@@ -99,6 +104,8 @@ type ImageRules = imageRules
 type ImageSectionExists = imageSectionExists
 type ImageSignedByOrganization = imageSignedByOrganization
 type InitialVarReaderKey = initialVarReaderKey
+type LoaderFlags = loaderFlags
+type LoaderLoadHandler = loaderLoadHandler
 type LoadParams = loadParams
 type NullLoadHandler = nullLoadHandler
 type PcrBranchContext = pcrBranchContext
@@ -122,6 +129,7 @@ type ShimVendorCertFormat = shimVendorCertFormat
 type ShimVersion = shimVersion
 type SignatureDBUpdateFirmwareQuirk = signatureDBUpdateFirmwareQuirk
 type UbuntuCoreUKILoadHandler = ubuntuCoreUKILoadHandler
+type UKILoadHandler = ukiLoadHandler
 type VarBranch = varBranch
 type VariableSetCollector = variableSetCollector
 type VarReadWriter = varReadWriter
@@ -152,6 +160,22 @@ func MockMakeImageLoadHandlerMap(fn func() imageLoadHandlerMap) (restore func())
 	}
 }
 
+func MockUdevDataDir(dir string) (restore func()) {
+	orig := udevDataDir
+	udevDataDir = dir
+	return func() {
+		udevDataDir = orig
+	}
+}
+
+func MockSysClassBlockDir(dir string) (restore func()) {
+	orig := sysClassBlockDir
+	sysClassBlockDir = dir
+	return func() {
+		sysClassBlockDir = orig
+	}
+}
+
 func MockNewFwLoadHandler(fn func(*tcglog.Log) ImageLoadHandler) (restore func()) {
 	orig := newFwLoadHandler
 	newFwLoadHandler = fn
@@ -140,11 +140,14 @@ func (h *fwLoadHandler) measureSecureBootPolicyPreOS(ctx pcrBranchContext) error
 			ctx.FwContext().AppendVerificationEvent(digest)
 			ctx.ExtendPCR(internal_efi.SecureBootPolicyPCR, digest)
 		case e.PCRIndex == internal_efi.SecureBootPolicyPCR && e.EventType == tcglog.EventTypeEFIVariableDriverConfig:
-			// ignore: part of the secure boot configuration - shouldn't see this after the
+			// part of the secure boot configuration - shouldn't see this after the
 			// end of secure boot configuration signal.
 			if foundSecureBootSeparator {
 				return errors.New("unexpected configuration event")
 			}
+			if err := h.measureNetworkBootConfig(ctx, e); err != nil {
+				return err
+			}
 		case e.PCRIndex == internal_efi.SecureBootPolicyPCR:
 			return fmt.Errorf("unexpected event type (%v) found in log", e.EventType)
 		default:
@@ -162,6 +165,36 @@ func (h *fwLoadHandler) measureSecureBootPolicyPreOS(ctx pcrBranchContext) error
 	return nil
 }
 
+// measureNetworkBootConfig measures the supplied EV_EFI_VARIABLE_DRIVER_CONFIG
+// event if it is associated with network boot. Firmware that supports booting
+// over HTTPS may measure the CA certificates it uses to authenticate servers
+// after the standard secure boot variables. This is measured from the current
+// variable value so that the profile can accommodate updates to it. Other
+// configuration events are ignored here, as the standard secure boot variables
+// have already been measured.
+func (h *fwLoadHandler) measureNetworkBootConfig(ctx pcrBranchContext, event *tcglog.Event) error {
+	data, ok := event.Data.(*tcglog.EFIVariableData)
+	if !ok {
+		// if the event data failed to decode, the resulting implementation is guaranteed to implement error.
+		return fmt.Errorf("cannot measure invalid configuration event: %w", event.Data.(error))
+	}
+	name := internal_efi.TLSCACertificateVariable
+	if data.UnicodeName != name.Name || data.VariableName != name.GUID {
+		return nil
+	}
+
+	certs, _, err := ctx.Vars().ReadVar(name.Name, name.GUID)
+	switch {
+	case err == efi.ErrVarNotExist:
+		// The firmware won't measure the variable if it doesn't exist.
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot read current TLS CA certificates: %w", err)
+	}
+	ctx.MeasureVariable(internal_efi.SecureBootPolicyPCR, name.GUID, name.Name, certs)
+	return nil
+}
+
 func (h *fwLoadHandler) measurePlatformFirmware(ctx pcrBranchContext) error {
 	donePcrReset := false
 
@@ -108,6 +108,7 @@ func (p FileImage) Open() (ImageReader, error) {
 type loadParams struct {
 	KernelCommandline string
 	SnapModel         secboot.SnapModel
+	KernelBootPhase   string
 }
 
 // ImageLoadParams provides one or more values for an external parameter that
@@ -161,6 +162,31 @@ func (p snapModelParams) applyTo(params ...loadParams) []loadParams {
 	return out
 }
 
+type kernelBootPhaseParams []string
+
+// KernelBootPhaseParams returns a ImageLoadParams for the specified boot phases,
+// which are measured to the kernel boot PCR (11) by systemd-pcrphase after the
+// kernel has started. Each boot phase is a colon separated list of the phase
+// strings that will have been measured by the time that a resource is accessed,
+// eg, "enter-initrd" for a resource that is accessed from the initrd. These are
+// only used for UKIs.
+func KernelBootPhaseParams(phases ...string) ImageLoadParams {
+	return kernelBootPhaseParams(phases)
+}
+
+func (p kernelBootPhaseParams) applyTo(params ...loadParams) []loadParams {
+	var out []loadParams
+	for _, phase := range []string(p) {
+		p := make([]loadParams, len(params))
+		copy(p, params)
+		for i := range p {
+			p[i].KernelBootPhase = phase
+		}
+		out = append(out, p...)
+	}
+	return out
+}
+
 type imageLoadParamsSet []ImageLoadParams
 
 func (s imageLoadParamsSet) Resolve(initial *loadParams) []loadParams {
@@ -183,6 +209,12 @@ type ImageLoadActivity interface {
 	source() Image
 	next() []ImageLoadActivity
 	params() imageLoadParamsSet
+
+	// newHandler returns a function for creating the handler for the
+	// image associated with this activity if it has been explicitly
+	// identified, overriding the handler selected by the image rules.
+	// This returns nil if the handler is selected by the image rules.
+	newHandler() newImageLoadHandlerFn
 }
 
 // NewImageLoadActivity returns a new ImageLoadActivity for the specified image that will
@@ -198,10 +230,43 @@ func NewImageLoadActivity(image Image, params ...ImageLoadParams) ImageLoadActiv
 		loadParams:  params}
 }
 
+// NewLoaderImageLoadActivity returns a new ImageLoadActivity for an intermediate
+// loader that can't be recognized from the image alone, such as the UEFI shell
+// executing a startup script. The loader is assumed to load subsequent images
+// (added by [ImageLoadActivity.Loads]) with the firmware's LoadImage, so that they
+// are measured and verified by the firmware. Each of the subsequent images creates
+// a separate branch in the profile. Loaders that can be recognized, such as
+// systemd-boot, can be added with [NewImageLoadActivity]. The parameters are
+// handled in the same way as [NewImageLoadActivity].
+func NewLoaderImageLoadActivity(image Image, params ...ImageLoadParams) ImageLoadActivity {
+	return &baseImageLoadActivity{
+		sourceImage: image,
+		loadParams:  params,
+		handlerFn:   newLoaderLoadHandler}
+}
+
+// NewUKIImageLoadActivity returns a new ImageLoadActivity for a unified kernel
+// image (UKI) containing systemd-stub. This can be used for UKIs that can't be
+// recognized from the image alone. The stub measures each of the UKI's sections
+// to the kernel boot PCR (11), and the kernel commandline to the kernel config
+// PCR (12) if the UKI doesn't contain one. The kernel measures the UKI's
+// .initrd section to the kernel data PCR (9). Boot phases that are measured by
+// systemd-pcrphase can be supplied with [KernelBootPhaseParams]. Note that
+// additional initrds that the stub generates from credentials, sysexts and
+// confexts are not included in the profile. The parameters are otherwise
+// handled in the same way as [NewImageLoadActivity].
+func NewUKIImageLoadActivity(image Image, params ...ImageLoadParams) ImageLoadActivity {
+	return &baseImageLoadActivity{
+		sourceImage: image,
+		loadParams:  params,
+		handlerFn:   newUKILoadHandler}
+}
+
 type baseImageLoadActivity struct {
 	sourceImage Image
 	nextImages  []ImageLoadActivity
 	loadParams  imageLoadParamsSet
+	handlerFn   newImageLoadHandlerFn
 }
 
 func (e *baseImageLoadActivity) Loads(images ...ImageLoadActivity) ImageLoadActivity {
@@ -221,6 +286,10 @@ func (e *baseImageLoadActivity) params() imageLoadParamsSet {
 	return e.loadParams
 }
 
+func (e *baseImageLoadActivity) newHandler() newImageLoadHandlerFn {
+	return e.handlerFn
+}
+
 // ImageLoadSequences corresponds to all of the boot paths for images executed before
 // ExitBootServices.
 type ImageLoadSequences struct {
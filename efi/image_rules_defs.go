@@ -168,6 +168,14 @@ func makeMicrosoftUEFICASecureBootNamespaceRules() *secureBootNamespaceRules {
 			),
 			newGrubLoadHandler,
 		),
+		withImageRule(
+			"systemd-boot",
+			imageMatchesAll(
+				sbatSectionExists,
+				sbatComponentExists("systemd-boot"),
+			),
+			newLoaderLoadHandlerConstructor(loaderUsesShimProtocolIfPresent).New,
+		),
 		withImageRule(
 			"Ubuntu Core UKI",
 			imageMatchesAny(
@@ -186,6 +194,20 @@ func makeMicrosoftUEFICASecureBootNamespaceRules() *secureBootNamespaceRules {
 			),
 			newUbuntuCoreUKILoadHandler,
 		),
+		withImageRule(
+			"systemd UKI",
+			imageMatchesAny(
+				imageMatchesAll(
+					sbatSectionExists,
+					sbatComponentExists("systemd-stub"),
+				),
+				imageMatchesAll(
+					imageSectionExists(".linux"),
+					imageSectionExists(".osrel"),
+				),
+			),
+			newUKILoadHandler,
+		),
 	)
 }
 
@@ -213,8 +235,32 @@ func makeFallbackImageRules() *imageRules {
 			imageSectionExists("mods"),
 			newGrubLoadHandler,
 		),
+		// systemd-boot
+		newImageRule(
+			"systemd-boot",
+			imageMatchesAll(
+				sbatSectionExists,
+				sbatComponentExists("systemd-boot"),
+			),
+			newLoaderLoadHandlerConstructor(loaderUsesShimProtocolIfPresent).New,
+		),
 		// TODO: add rules for Ubuntu Core UKIs that are not part of the MS UEFI CA
 		//
+		// systemd UKI
+		newImageRule(
+			"systemd UKI",
+			imageMatchesAny(
+				imageMatchesAll(
+					sbatSectionExists,
+					sbatComponentExists("systemd-stub"),
+				),
+				imageMatchesAll(
+					imageSectionExists(".linux"),
+					imageSectionExists(".osrel"),
+				),
+			),
+			newUKILoadHandler,
+		),
 		// Catch-all for unrecognized leaf images
 		newImageRule(
 			"null",
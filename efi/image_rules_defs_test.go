@@ -210,6 +210,42 @@ func (s *imageRulesDefsSuite) TestMSNewImageLoadHandlerUbuntuUKINoSbat(c *C) {
 	c.Assert(handler, testutil.ConvertibleTo, &UbuntuCoreUKILoadHandler{})
 }
 
+func (s *imageRulesDefsSuite) TestMSNewImageLoadHandlerSystemdUKI(c *C) {
+	// Verify that we get a ukiLoadHandler for a UKI containing systemd-stub
+	image := newMockImage().
+		appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, grubUbuntuSig3)).
+		addSection(".linux", nil).
+		addSection(".osrel", nil).
+		withSbat([]SbatComponent{
+			{Name: "sbat"},
+			{Name: "systemd-stub"},
+		})
+
+	rules := MakeMicrosoftUEFICASecureBootNamespaceRules()
+	rules.AddAuthorities(testutil.ParseCertificate(c, canonicalCACert))
+	handler, err := rules.NewImageLoadHandler(image.newPeImageHandle())
+	c.Assert(err, IsNil)
+	c.Assert(handler, testutil.ConvertibleTo, &UKILoadHandler{})
+}
+
+func (s *imageRulesDefsSuite) TestMSNewImageLoadHandlerSystemdBoot(c *C) {
+	// Verify that we get a correctly configured loaderLoadHandler for systemd-boot
+	image := newMockImage().
+		appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, grubUbuntuSig3)).
+		withSbat([]SbatComponent{
+			{Name: "sbat"},
+			{Name: "systemd-boot"},
+		})
+
+	rules := MakeMicrosoftUEFICASecureBootNamespaceRules()
+	rules.AddAuthorities(testutil.ParseCertificate(c, canonicalCACert))
+	handler, err := rules.NewImageLoadHandler(image.newPeImageHandle())
+	c.Assert(err, IsNil)
+	c.Assert(handler, testutil.ConvertibleTo, &LoaderLoadHandler{})
+
+	c.Check(handler.(*LoaderLoadHandler).Flags, Equals, LoaderUsesShimProtocolIfPresent)
+}
+
 func (s *imageRulesDefsSuite) TestMSNewImageLoadHandlerUbuntuGrubRecognized(c *C) {
 	// Verify that the Canonical CA cert is recognized as part of the MS UEFI CA namespace
 	// after creating a handler for Ubuntu shim.
@@ -272,6 +308,33 @@ func (s *imageRulesDefsSuite) TestFallbackNewImageLoadHandlerGrub(c *C) {
 	c.Check(handler.(*GrubLoadHandler), DeepEquals, new(GrubLoadHandler))
 }
 
+func (s *imageRulesDefsSuite) TestFallbackNewImageLoadHandlerSystemdBoot(c *C) {
+	// verify that systemd-boot is recognized by the fallback rules
+	image := newMockImage().
+		withSbat([]SbatComponent{
+			{Name: "sbat"},
+			{Name: "systemd-boot"},
+		})
+
+	rules := MakeFallbackImageRules()
+	handler, err := rules.NewImageLoadHandler(image.newPeImageHandle())
+	c.Assert(err, IsNil)
+	c.Assert(handler, testutil.ConvertibleTo, &LoaderLoadHandler{})
+	c.Check(handler.(*LoaderLoadHandler).Flags, Equals, LoaderUsesShimProtocolIfPresent)
+}
+
+func (s *imageRulesDefsSuite) TestFallbackNewImageLoadHandlerSystemdUKI(c *C) {
+	// verify that a UKI without SBAT metadata is recognized by the fallback rules
+	image := newMockImage().
+		addSection(".linux", nil).
+		addSection(".osrel", nil)
+
+	rules := MakeFallbackImageRules()
+	handler, err := rules.NewImageLoadHandler(image.newPeImageHandle())
+	c.Assert(err, IsNil)
+	c.Assert(handler, testutil.ConvertibleTo, &UKILoadHandler{})
+}
+
 func (s *imageRulesDefsSuite) TestFallbackNewImageLoadHandlerNull(c *C) {
 	// verify that an unrecognized leaf image is recognized by the fallback rules
 	image := newMockImage()
@@ -222,6 +222,14 @@ func (s *imageSuite) TestSnapModelParamsOverride(c *C) {
 	c.Check(params, DeepEquals, []LoadParams{{SnapModel: model}})
 }
 
+func (s *imageSuite) TestKernelBootPhaseParams(c *C) {
+	activity := NewImageLoadActivity(nil, KernelBootPhaseParams("enter-initrd", "enter-initrd:leave-initrd"))
+	params := ImageLoadActivityParams(activity).Resolve(&LoadParams{KernelCommandline: "foo"})
+	c.Check(params, DeepEquals, []LoadParams{
+		{KernelCommandline: "foo", KernelBootPhase: "enter-initrd"},
+		{KernelCommandline: "foo", KernelBootPhase: "enter-initrd:leave-initrd"}})
+}
+
 func (s *imageSuite) TestImageLoadParamSetResolveMultiple(c *C) {
 	models := []secboot.SnapModel{
 		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
@@ -260,6 +268,24 @@ func (s *imageSuite) TestImageLoadActivityLoads(c *C) {
 	c.Check(ImageLoadActivityNext(activity), DeepEquals, activities)
 }
 
+func (s *imageSuite) TestNewLoaderImageLoadActivity(c *C) {
+	activities := []ImageLoadActivity{NewImageLoadActivity(nil), NewImageLoadActivity(nil)}
+	activity := NewLoaderImageLoadActivity(nil, KernelCommandlineParams("foo"))
+	c.Check(activity.Loads(activities...), Equals, activity)
+	c.Check(ImageLoadActivityNext(activity), DeepEquals, activities)
+
+	params := ImageLoadActivityParams(activity).Resolve(new(LoadParams))
+	c.Check(params, DeepEquals, []LoadParams{{KernelCommandline: "foo"}})
+}
+
+func (s *imageSuite) TestNewUKIImageLoadActivity(c *C) {
+	activity := NewUKIImageLoadActivity(nil, KernelBootPhaseParams("enter-initrd"))
+	c.Check(ImageLoadActivityNext(activity), HasLen, 0)
+
+	params := ImageLoadActivityParams(activity).Resolve(new(LoadParams))
+	c.Check(params, DeepEquals, []LoadParams{{KernelBootPhase: "enter-initrd"}})
+}
+
 func (s *imageSuite) TestImageLoadSequencesAppend(c *C) {
 	sequences := NewImageLoadSequences()
 
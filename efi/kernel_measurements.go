@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// AddPCRProfileKernelCmdline adds a branch point to the supplied branch that
+// models the measurement of the kernel commandline to the kernel config PCR
+// (PCR12) by systemd-stub, using the specified digest algorithm. A branch is
+// created for each of the supplied candidate commandlines, which permits a
+// policy to survive switching between them, eg, between the normal,
+// recovery and factory-reset commandlines on Ubuntu Core.
+//
+// As systemd-stub doesn't measure an empty commandline, the branch for an
+// empty commandline doesn't extend the PCR.
+//
+// This is intended for boot chains where the commandline is not embedded in
+// a UKI. For UKIs, [AddPCRProfile] should be used with the
+// [WithKernelConfigProfile] option instead.
+func AddPCRProfileKernelCmdline(pcrAlg tpm2.HashAlgorithmId, branch *secboot_tpm2.PCRProtectionProfileBranch, cmdlines ...string) error {
+	if !pcrAlg.IsValid() {
+		return errors.New("invalid PCR algorithm")
+	}
+	if len(cmdlines) == 0 {
+		return errors.New("no kernel commandlines specified")
+	}
+
+	bp := branch.AddBranchPoint()
+	for _, cmdline := range cmdlines {
+		b := bp.AddBranch()
+		if cmdline == "" {
+			continue
+		}
+		b.ExtendPCR(pcrAlg, int(kernelConfigPCR), tcglog.ComputeSystemdEFIStubCommandlineDigest(pcrAlg.GetHash(), cmdline))
+	}
+
+	bp.EndBranchPoint()
+	return nil
+}
+
+// AddPCRProfileInitrd adds a branch point to the supplied branch that models
+// the measurement of the initramfs to PCR9 by the Linux EFI stub, using the
+// specified digest algorithm. The Linux EFI stub (since Linux 5.17) measures
+// the contents of an initramfs that is loaded via the LINUX_EFI_INITRD_MEDIA
+// device path. A branch is created for each of the supplied candidate images.
+func AddPCRProfileInitrd(pcrAlg tpm2.HashAlgorithmId, branch *secboot_tpm2.PCRProtectionProfileBranch, initrds ...Image) error {
+	if !pcrAlg.IsValid() {
+		return errors.New("invalid PCR algorithm")
+	}
+	if len(initrds) == 0 {
+		return errors.New("no initrd images specified")
+	}
+
+	var digests tpm2.DigestList
+	for _, initrd := range initrds {
+		digest, err := computeInitrdDigest(pcrAlg, initrd)
+		if err != nil {
+			return fmt.Errorf("cannot compute digest of initrd %v: %w", initrd, err)
+		}
+		digests = append(digests, digest)
+	}
+
+	bp := branch.AddBranchPoint()
+	for _, digest := range digests {
+		bp.AddBranch().ExtendPCR(pcrAlg, int(kernelDataPCR), digest)
+	}
+
+	bp.EndBranchPoint()
+	return nil
+}
+
+func computeInitrdDigest(alg tpm2.HashAlgorithmId, initrd Image) (tpm2.Digest, error) {
+	r, err := initrd.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h := alg.NewHash()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
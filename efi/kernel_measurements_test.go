@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+type kernelMeasurementsSuite struct{}
+
+var _ = Suite(&kernelMeasurementsSuite{})
+
+func (s *kernelMeasurementsSuite) checkProfileValues(c *C, profile *secboot_tpm2.PCRProtectionProfile, expected []tpm2.PCRValues) {
+	values, err := profile.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, expected)
+
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", tpm2test.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileKernelCmdline(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmSHA256, profile.RootBranch(),
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=recover"), IsNil)
+
+	s.checkProfileValues(c, profile, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: testutil.DecodeHexString(c, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: testutil.DecodeHexString(c, "b3a29076eeeae197ae721c254da40480b76673038045305cfa78ec87421c4eea"),
+			},
+		},
+	})
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileKernelCmdlineSHA1(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmSHA1, profile.RootBranch(),
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run"), IsNil)
+
+	s.checkProfileValues(c, profile, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA1: {
+				12: testutil.DecodeHexString(c, "eb6312b7db70fe16206c162326e36b2fcda74b68"),
+			},
+		},
+	})
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileKernelCmdlineWithEmpty(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	profile.RootBranch().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, make(tpm2.Digest, 32))
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmSHA256, profile.RootBranch(),
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+		""), IsNil)
+
+	s.checkProfileValues(c, profile, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: testutil.DecodeHexString(c, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: make(tpm2.Digest, 32),
+			},
+		},
+	})
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileKernelCmdlineNoCmdlines(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmSHA256, profile.RootBranch()), ErrorMatches, `no kernel commandlines specified`)
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileKernelCmdlineInvalidAlg(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmNull, profile.RootBranch(), "foo"), ErrorMatches, `invalid PCR algorithm`)
+}
+
+func (s *kernelMeasurementsSuite) writeInitrd(c *C, contents string) Image {
+	path := filepath.Join(c.MkDir(), "initrd.img")
+	c.Assert(ioutil.WriteFile(path, []byte(contents), 0644), IsNil)
+	return NewFileImage(path)
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileInitrd(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileInitrd(tpm2.HashAlgorithmSHA256, profile.RootBranch(),
+		s.writeInitrd(c, "foo"), s.writeInitrd(c, "bar")), IsNil)
+
+	s.checkProfileValues(c, profile, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar"),
+			},
+		},
+	})
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileInitrdAndKernelCmdline(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileInitrd(tpm2.HashAlgorithmSHA384, profile.RootBranch(), s.writeInitrd(c, "foo")), IsNil)
+	c.Check(AddPCRProfileKernelCmdline(tpm2.HashAlgorithmSHA384, profile.RootBranch(), "", ""), IsNil)
+
+	s.checkProfileValues(c, profile, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA384: {
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA384, "foo"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA384: {
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA384, "foo"),
+			},
+		},
+	})
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileInitrdNoImages(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileInitrd(tpm2.HashAlgorithmSHA256, profile.RootBranch()), ErrorMatches, `no initrd images specified`)
+}
+
+func (s *kernelMeasurementsSuite) TestAddPCRProfileInitrdMissingImage(c *C) {
+	path := filepath.Join(c.MkDir(), "initrd.img")
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfileInitrd(tpm2.HashAlgorithmSHA256, profile.RootBranch(), NewFileImage(path)), ErrorMatches,
+		`cannot compute digest of initrd .*/initrd.img: open .*/initrd.img: no such file or directory`)
+}
@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	loaderEntriesDir = "loader/entries"
+	loaderUKIDir     = "EFI/Linux"
+)
+
+// LoaderEntry corresponds to a boot loader entry on an ESP, as defined by the
+// UAPI Boot Loader Specification. These are used by loaders such as systemd-boot.
+type LoaderEntry struct {
+	ID    string // The filename of the entry
+	Title string // The title of the entry, if it has one
+
+	// Path is the path of the EFI image that is loaded for this entry,
+	// relative to the root of the ESP.
+	Path string
+
+	// Options is the kernel command line supplied to the image for a type #1
+	// entry. This is empty for a type #2 entry, which is a UKI that contains
+	// its own kernel command line.
+	Options string
+}
+
+// ImageLoadActivity returns a new ImageLoadActivity for the image associated with
+// this entry, on the supplied ESP. If the entry has a kernel command line, it is
+// supplied to the image with KernelCommandlineParams, although this can be
+// overridden with the supplied parameters.
+func (e *LoaderEntry) ImageLoadActivity(esp *ESP, params ...ImageLoadParams) ImageLoadActivity {
+	if e.Options != "" {
+		params = append([]ImageLoadParams{KernelCommandlineParams(e.Options)}, params...)
+	}
+	return NewImageLoadActivity(esp.Image(e.Path), params...)
+}
+
+func readType1LoaderEntry(path string) (*LoaderEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &LoaderEntry{ID: filepath.Base(path)}
+
+	var options []string
+	var linux, efi string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i:])
+		}
+
+		switch key {
+		case "title":
+			entry.Title = value
+		case "linux":
+			linux = value
+		case "efi":
+			efi = value
+		case "options":
+			options = append(options, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case linux != "":
+		entry.Path = linux
+	case efi != "":
+		entry.Path = efi
+	default:
+		// This isn't a valid entry.
+		return nil, nil
+	}
+	entry.Path = strings.TrimPrefix(entry.Path, "/")
+	entry.Options = strings.Join(options, " ")
+
+	return entry, nil
+}
+
+// ReadLoaderEntries returns the boot loader entries on the supplied ESP. This
+// includes type #1 entries defined by configuration files in /loader/entries, and
+// type #2 entries for UKIs in /EFI/Linux. Type #1 entries that don't specify an
+// image are ignored. Entries are returned in lexical order of their filenames, with
+// type #1 entries first.
+//
+// Each entry can be supplied to the [ImageLoadActivity.Loads] method of the loader
+// so that each entry is modelled as a separate branch in a PCR profile, eg:
+//
+//	entries, err := ReadLoaderEntries(esp)
+//	...
+//	var next []ImageLoadActivity
+//	for _, entry := range entries {
+//		next = append(next, entry.ImageLoadActivity(esp))
+//	}
+//	loader := NewImageLoadActivity(esp.Image("EFI/systemd/systemd-bootx64.efi")).Loads(next...)
+func ReadLoaderEntries(esp *ESP) ([]*LoaderEntry, error) {
+	if esp.MountPoint == "" {
+		return nil, errors.New("ESP is not mounted")
+	}
+
+	var entries []*LoaderEntry
+
+	type1, err := ioutil.ReadDir(filepath.Join(esp.MountPoint, loaderEntriesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("cannot read type #1 entries: %w", err)
+	}
+	for _, fi := range type1 {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".conf") {
+			continue
+		}
+		entry, err := readType1LoaderEntry(filepath.Join(esp.MountPoint, loaderEntriesDir, fi.Name()))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read entry %s: %w", fi.Name(), err)
+		}
+		if entry == nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	type2, err := ioutil.ReadDir(filepath.Join(esp.MountPoint, loaderUKIDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("cannot read type #2 entries: %w", err)
+	}
+	for _, fi := range type2 {
+		if fi.IsDir() || !strings.HasSuffix(strings.ToLower(fi.Name()), ".efi") {
+			continue
+		}
+		entries = append(entries, &LoaderEntry{
+			ID:   fi.Name(),
+			Path: loaderUKIDir + "/" + fi.Name()})
+	}
+
+	return entries, nil
+}
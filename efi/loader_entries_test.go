@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+)
+
+type loaderEntriesSuite struct{}
+
+var _ = Suite(&loaderEntriesSuite{})
+
+func (s *loaderEntriesSuite) makeESP(c *C, files map[string]string) *ESP {
+	dir := c.MkDir()
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+	return &ESP{Device: "/dev/sda1", MountPoint: dir}
+}
+
+func (s *loaderEntriesSuite) TestReadLoaderEntriesType1(c *C) {
+	esp := s.makeESP(c, map[string]string{
+		"loader/entries/ubuntu-6.8.0-31.conf": `# Boot Loader Specification type#1 entry
+title      Ubuntu 24.04
+version    6.8.0-31-generic
+linux      /ubuntu/6.8.0-31/linux
+initrd     /ubuntu/6.8.0-31/initrd
+options    root=UUID=c8a0e5ab-d5a6-4b4e-b41c-6d3ba6b8c5b1 ro
+options    quiet splash
+`,
+		"loader/entries/shell.conf":   "title UEFI Shell\nefi /EFI/tools/shellx64.efi\n",
+		"loader/entries/invalid.conf": "title Invalid\n",
+		"loader/entries/README":       "foo",
+	})
+
+	entries, err := ReadLoaderEntries(esp)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []*LoaderEntry{
+		{ID: "shell.conf", Title: "UEFI Shell", Path: "EFI/tools/shellx64.efi"},
+		{
+			ID:      "ubuntu-6.8.0-31.conf",
+			Title:   "Ubuntu 24.04",
+			Path:    "ubuntu/6.8.0-31/linux",
+			Options: "root=UUID=c8a0e5ab-d5a6-4b4e-b41c-6d3ba6b8c5b1 ro quiet splash",
+		},
+	})
+}
+
+func (s *loaderEntriesSuite) TestReadLoaderEntriesType2(c *C) {
+	esp := s.makeESP(c, map[string]string{
+		"EFI/Linux/ubuntu-6.8.0-31.efi": "foo",
+		"EFI/Linux/ubuntu-6.8.0-35.EFI": "bar",
+		"EFI/Linux/README":              "baz",
+	})
+
+	entries, err := ReadLoaderEntries(esp)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []*LoaderEntry{
+		{ID: "ubuntu-6.8.0-31.efi", Path: "EFI/Linux/ubuntu-6.8.0-31.efi"},
+		{ID: "ubuntu-6.8.0-35.EFI", Path: "EFI/Linux/ubuntu-6.8.0-35.EFI"},
+	})
+}
+
+func (s *loaderEntriesSuite) TestReadLoaderEntriesMixed(c *C) {
+	esp := s.makeESP(c, map[string]string{
+		"loader/entries/shell.conf":     "efi /EFI/tools/shellx64.efi\n",
+		"EFI/Linux/ubuntu-6.8.0-31.efi": "foo",
+	})
+
+	entries, err := ReadLoaderEntries(esp)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []*LoaderEntry{
+		{ID: "shell.conf", Path: "EFI/tools/shellx64.efi"},
+		{ID: "ubuntu-6.8.0-31.efi", Path: "EFI/Linux/ubuntu-6.8.0-31.efi"},
+	})
+}
+
+func (s *loaderEntriesSuite) TestReadLoaderEntriesNone(c *C) {
+	entries, err := ReadLoaderEntries(s.makeESP(c, nil))
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *loaderEntriesSuite) TestReadLoaderEntriesNotMounted(c *C) {
+	_, err := ReadLoaderEntries(&ESP{Device: "/dev/sda1"})
+	c.Check(err, ErrorMatches, `ESP is not mounted`)
+}
+
+func (s *loaderEntriesSuite) TestLoaderEntryImageLoadActivity(c *C) {
+	esp := &ESP{Device: "/dev/sda1", MountPoint: "/boot/efi"}
+	entry := &LoaderEntry{ID: "ubuntu.conf", Path: "ubuntu/linux", Options: "ro quiet"}
+
+	activity := entry.ImageLoadActivity(esp)
+	c.Check(activity, DeepEquals, NewImageLoadActivity(FileImage("/boot/efi/ubuntu/linux"), KernelCommandlineParams("ro quiet")))
+	c.Check(ImageLoadActivityParams(activity).Resolve(new(LoadParams)), DeepEquals, []LoadParams{{KernelCommandline: "ro quiet"}})
+}
+
+func (s *loaderEntriesSuite) TestLoaderEntryImageLoadActivityNoOptions(c *C) {
+	esp := &ESP{Device: "/dev/sda1", MountPoint: "/boot/efi"}
+	entry := &LoaderEntry{ID: "ubuntu.efi", Path: "EFI/Linux/ubuntu.efi"}
+
+	activity := entry.ImageLoadActivity(esp)
+	c.Check(activity, DeepEquals, NewImageLoadActivity(FileImage("/boot/efi/EFI/Linux/ubuntu.efi")))
+}
@@ -0,0 +1,81 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"golang.org/x/xerrors"
+)
+
+type loaderFlags int
+
+const (
+	// loaderUsesShimProtocolIfPresent indicates that the loader verifies
+	// the images it loads with shim's protocol if it was loaded by shim.
+	// systemd-boot does this by overriding the firmware's security
+	// protocols.
+	loaderUsesShimProtocolIfPresent loaderFlags = 1 << iota
+)
+
+// loaderLoadHandler is an implementation of imageLoadHandler for intermediate
+// loaders that load subsequent images with the firmware's LoadImage, such as
+// systemd-boot or the UEFI shell.
+type loaderLoadHandler struct {
+	Flags loaderFlags
+}
+
+type loaderLoadHandlerConstructor loaderFlags
+
+func newLoaderLoadHandlerConstructor(flags loaderFlags) loaderLoadHandlerConstructor {
+	return loaderLoadHandlerConstructor(flags)
+}
+
+func (c loaderLoadHandlerConstructor) New(_ peImageHandle) (imageLoadHandler, error) {
+	return &loaderLoadHandler{Flags: loaderFlags(c)}, nil
+}
+
+func newLoaderLoadHandler(image peImageHandle) (imageLoadHandler, error) {
+	return newLoaderLoadHandlerConstructor(0).New(image)
+}
+
+// MeasureImageStart implements imageLoadHandler.MeasureImageStart.
+func (h *loaderLoadHandler) MeasureImageStart(_ pcrBranchContext) error {
+	// TODO: systemd-boot measures the command line of type #1 loader entries
+	// to the kernel config PCR (12), and the UEFI shell doesn't measure
+	// anything. This is currently only used for profiles that include the
+	// boot manager code and secure boot policy PCRs.
+	return nil
+}
+
+// MeasureImageLoad implements imageLoadHandler.MeasureImageLoad.
+func (h *loaderLoadHandler) MeasureImageLoad(ctx pcrBranchContext, image peImageHandle) (imageLoadHandler, error) {
+	var err error
+	if h.Flags&loaderUsesShimProtocolIfPresent != 0 && ctx.ShimContext().VendorDb != nil {
+		m := newShimImageLoadMeasurer(ctx, image)
+		err = m.measure()
+	} else {
+		m := newFwImageLoadMeasurer(ctx, image)
+		err = m.measure()
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("cannot measure image: %w", err)
+	}
+
+	return lookupImageLoadHandler(ctx, image)
+}
@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot/efi"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/secboot/internal/efitest"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type loaderLoadHandlerSuite struct {
+	mockImageLoadHandlerMap
+}
+
+func (s *loaderLoadHandlerSuite) SetUpTest(c *C) {
+	s.mockImageLoadHandlerMap = make(mockImageLoadHandlerMap)
+}
+
+var _ = Suite(&loaderLoadHandlerSuite{})
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageStart(c *C) {
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: MakePcrFlags(internal_efi.BootManagerCodePCR, internal_efi.SecureBootPolicyPCR),
+	}, nil, nil)
+
+	handler := &LoaderLoadHandler{Flags: LoaderUsesShimProtocolIfPresent}
+	c.Check(handler.MeasureImageStart(ctx), IsNil)
+	c.Check(ctx.events, HasLen, 0)
+}
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageLoadUsesShim(c *C) {
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.SecureBootPolicyPCR),
+		handlers: s,
+	}, nil, nil)
+	ctx.FwContext().Db = &SecureBootDB{
+		Name:     Db,
+		Contents: msDb(c),
+	}
+	ctx.ShimContext().Flags = ShimHasSbatVerification | ShimFixVariableAuthorityEventsMatchSpec | ShimVendorCertContainsDb | ShimHasSbatRevocationManagement
+	ctx.ShimContext().VendorDb = &SecureBootDB{
+		Name:     efi.VariableDescriptor{Name: "MokListRT", GUID: ShimGuid},
+		Contents: efi.SignatureDatabase{efitest.NewSignatureListX509(c, canonicalCACert, ShimGuid)},
+	}
+
+	image := newMockImage().appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, kernelUbuntuSig3))
+	s.mockImageLoadHandlerMap[image] = newMockLoadHandler()
+
+	handler := &LoaderLoadHandler{Flags: LoaderUsesShimProtocolIfPresent}
+	childHandler, err := handler.MeasureImageLoad(ctx, image.newPeImageHandle())
+	c.Check(err, IsNil)
+	c.Check(childHandler, Equals, s.mockImageLoadHandlerMap[image])
+	c.Check(ctx.events, DeepEquals, []*mockPcrBranchEvent{
+		{pcr: 7, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "68bdff38e48c399326ca7356eb992693d13301f3925caf10e7b39dc9240789cd")},
+	})
+	c.Check(ctx.ShimContext().HasVerificationEvent(ctx.events[0].digest), testutil.IsTrue)
+}
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageLoadShimNotPresent(c *C) {
+	// Test that a loader that uses shim's protocol if it is present falls
+	// back to the firmware if it wasn't loaded by shim.
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.SecureBootPolicyPCR),
+		handlers: s,
+	}, nil, nil)
+	ctx.FwContext().Db = &SecureBootDB{
+		Name:     Db,
+		Contents: append(msDb(c), efitest.NewSignatureListX509(c, canonicalCACert, testOwnerGuid)),
+	}
+
+	image := newMockImage().appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, kernelUbuntuSig3))
+	s.mockImageLoadHandlerMap[image] = newMockLoadHandler()
+
+	handler := &LoaderLoadHandler{Flags: LoaderUsesShimProtocolIfPresent}
+	childHandler, err := handler.MeasureImageLoad(ctx, image.newPeImageHandle())
+	c.Check(err, IsNil)
+	c.Check(childHandler, Equals, s.mockImageLoadHandlerMap[image])
+	c.Check(ctx.events, DeepEquals, []*mockPcrBranchEvent{
+		{pcr: 7, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "8c06c18055bc8f82df1405ae0fe80f64bc9b444ba82b2879acc113b9c751f6fb")},
+	})
+	c.Check(ctx.FwContext().HasVerificationEvent(ctx.events[0].digest), testutil.IsTrue)
+}
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageLoadNoShim(c *C) {
+	// Test that a loader that doesn't use shim's protocol uses the firmware
+	// even if it was loaded by shim.
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.SecureBootPolicyPCR),
+		handlers: s,
+	}, nil, nil)
+	ctx.FwContext().Db = &SecureBootDB{
+		Name:     Db,
+		Contents: append(msDb(c), efitest.NewSignatureListX509(c, canonicalCACert, testOwnerGuid)),
+	}
+	ctx.ShimContext().Flags = ShimHasSbatVerification | ShimFixVariableAuthorityEventsMatchSpec | ShimHasSbatRevocationManagement
+	ctx.ShimContext().VendorDb = &SecureBootDB{
+		Name:     efi.VariableDescriptor{Name: "Shim", GUID: ShimGuid},
+		Contents: efi.SignatureDatabase{efitest.NewSignatureListX509(c, canonicalCACert, efi.GUID{})},
+	}
+
+	image := newMockImage().appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, kernelUbuntuSig3))
+	s.mockImageLoadHandlerMap[image] = newMockLoadHandler()
+
+	handler := new(LoaderLoadHandler)
+	childHandler, err := handler.MeasureImageLoad(ctx, image.newPeImageHandle())
+	c.Check(err, IsNil)
+	c.Check(childHandler, Equals, s.mockImageLoadHandlerMap[image])
+	c.Check(ctx.events, DeepEquals, []*mockPcrBranchEvent{
+		{pcr: 7, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "8c06c18055bc8f82df1405ae0fe80f64bc9b444ba82b2879acc113b9c751f6fb")},
+	})
+	c.Check(ctx.FwContext().HasVerificationEvent(ctx.events[0].digest), testutil.IsTrue)
+}
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageLoadBootManagerCode(c *C) {
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.BootManagerCodePCR),
+		handlers: s,
+	}, nil, nil)
+
+	image := newMockImage().appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, shimUbuntuSig4))
+	s.mockImageLoadHandlerMap[image] = newMockLoadHandler()
+
+	handler := new(LoaderLoadHandler)
+	childHandler, err := handler.MeasureImageLoad(ctx, image.newPeImageHandle())
+	c.Check(err, IsNil)
+	c.Check(childHandler, Equals, s.mockImageLoadHandlerMap[image])
+	c.Check(ctx.events, DeepEquals, []*mockPcrBranchEvent{
+		{pcr: 4, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "bf6b6dfdb1f6435a81e4808db7f846d86d170566e4753d4384fdab6504be4fb9")},
+	})
+}
+
+func (s *loaderLoadHandlerSuite) TestMeasureImageLoadError(c *C) {
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.SecureBootPolicyPCR),
+		handlers: s,
+	}, nil, nil)
+	ctx.FwContext().Db = &SecureBootDB{
+		Name:     Db,
+		Contents: msDb(c),
+	}
+
+	image := newMockImage().appendSignatures(efitest.ReadWinCertificateAuthenticodeDetached(c, kernelUbuntuSig3))
+	s.mockImageLoadHandlerMap[image] = newMockLoadHandler()
+
+	handler := &LoaderLoadHandler{Flags: LoaderUsesShimProtocolIfPresent}
+	_, err := handler.MeasureImageLoad(ctx, image.newPeImageHandle())
+	c.Check(err, ErrorMatches, "cannot measure image: cannot measure secure boot event: cannot determine authority")
+}
@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"golang.org/x/xerrors"
+)
+
+// PCRChange describes how the value of a single PCR is expected to change on
+// the next boot, as computed by SimulateNextBoot.
+type PCRChange struct {
+	PCR int
+
+	// Current is the value of the PCR for the current boot, reconstructed
+	// from the TCG log.
+	Current tpm2.Digest
+
+	// Predicted contains the distinct values that the PCR may have on the
+	// next boot, one for each distinct branch of the generated profile.
+	Predicted tpm2.DigestList
+}
+
+// Changed indicates whether the current value of the PCR is not one of the
+// predicted values for the next boot.
+func (c *PCRChange) Changed() bool {
+	for _, d := range c.Predicted {
+		if bytes.Equal(d, c.Current) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextBootSimulation is the result of simulating the measurements for the
+// next boot with SimulateNextBoot.
+type NextBootSimulation struct {
+	// Profile is the generated PCR profile for the next boot, which can
+	// be used to reseal keys before rebooting.
+	Profile *secboot_tpm2.PCRProtectionProfile
+
+	// Alg is the PCR bank that the simulation was performed for.
+	Alg tpm2.HashAlgorithmId
+
+	// Changes describes the expected change to each PCR included in the
+	// profile, in ascending order of PCR index.
+	Changes []*PCRChange
+}
+
+// Summary returns a human-readable summary of the expected PCR changes.
+func (s *NextBootSimulation) Summary() string {
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "Expected PCR changes for the next boot (%v bank):\n", s.Alg)
+	for _, c := range s.Changes {
+		if !c.Changed() {
+			fmt.Fprintf(w, "  PCR%d: unchanged (%x)\n", c.PCR, c.Current)
+			continue
+		}
+		fmt.Fprintf(w, "  PCR%d: changed from %x to ", c.PCR, c.Current)
+		switch len(c.Predicted) {
+		case 1:
+			fmt.Fprintf(w, "%x\n", c.Predicted[0])
+		default:
+			fmt.Fprintf(w, "one of %d values:\n", len(c.Predicted))
+			for _, d := range c.Predicted {
+				fmt.Fprintf(w, "    %x\n", d)
+			}
+		}
+	}
+	return w.String()
+}
+
+// replayLog reconstructs the values of the specified PCRs for the current
+// boot from the supplied TCG log.
+func replayLog(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcrs pcrFlags) (map[int]tpm2.Digest, error) {
+	if !log.Algorithms.Contains(alg) {
+		return nil, fmt.Errorf("TCG log has no %v digests", alg)
+	}
+
+	replay, err := internal_efi.ReplayEventLog(log)
+	if err != nil {
+		return nil, fmt.Errorf("cannot replay TCG log: %w", err)
+	}
+
+	values := make(map[int]tpm2.Digest)
+	for _, pcr := range pcrs.PCRs() {
+		values[int(pcr)] = replay.PCRValue(alg, pcr)
+	}
+	return values, nil
+}
+
+// SimulateNextBoot simulates the measurements for the next boot from the
+// supplied load sequences and options, which are interpreted in the same way
+// as for AddPCRProfile. The load sequences should describe the images that
+// will be loaded on the next boot, including any staged updates (eg, new
+// kernel, bootloader or shim images, created with NewFileImage or
+// NewSnapFileImage).
+//
+// This returns the generated PCR profile, which can be used to reseal keys
+// before rebooting, along with a description of how each PCR in the profile
+// is expected to change compared to the values recorded in the current boot's
+// TCG log. This makes it possible for update pipelines to report which parts
+// of the boot chain are affected by an update.
+func SimulateNextBoot(pcrAlg tpm2.HashAlgorithmId, loadSequences *ImageLoadSequences, options ...PCRProfileOption) (*NextBootSimulation, error) {
+	gen, err := newPcrProfileGenerator(pcrAlg, loadSequences, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if gen.pcrs == 0 {
+		return nil, errors.New("must specify a profile to add")
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	if err := gen.addPCRProfile(profile.RootBranch()); err != nil {
+		return nil, err
+	}
+
+	predicted, err := profile.ComputePCRValues(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from profile: %w", err)
+	}
+
+	current, err := replayLog(gen.log, pcrAlg, gen.pcrs)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute current PCR values: %w", err)
+	}
+
+	result := &NextBootSimulation{Profile: profile, Alg: pcrAlg}
+	for _, pcr := range gen.pcrs.PCRs() {
+		change := &PCRChange{PCR: int(pcr), Current: current[int(pcr)]}
+		for _, values := range predicted {
+			d, ok := values[pcrAlg][int(pcr)]
+			if !ok {
+				continue
+			}
+			found := false
+			for _, p := range change.Predicted {
+				if bytes.Equal(p, d) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				change.Predicted = append(change.Predicted, d)
+			}
+		}
+		result.Changes = append(result.Changes, change)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,192 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"crypto"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/efitest"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type nextBootSuite struct {
+	mockImageHandleMixin
+	mockShimImageHandleMixin
+	mockGrubImageHandleMixin
+}
+
+func (s *nextBootSuite) SetUpTest(c *C) {
+	s.mockImageHandleMixin.SetUpTest(c)
+	s.mockShimImageHandleMixin.SetUpTest(c)
+	s.mockGrubImageHandleMixin.SetUpTest(c)
+}
+
+func (s *nextBootSuite) TearDownTest(c *C) {
+	s.mockImageHandleMixin.TearDownTest(c)
+	s.mockShimImageHandleMixin.TearDownTest(c)
+	s.mockGrubImageHandleMixin.TearDownTest(c)
+}
+
+var _ = Suite(&nextBootSuite{})
+
+func (s *nextBootSuite) TestSimulateNextBoot(c *C) {
+	shim := newMockUbuntuShimImage15_7(c)
+	grub := newMockUbuntuGrubImage3(c)
+	kernel := newMockUbuntuKernelImage3(c)
+
+	sim, err := SimulateNextBoot(tpm2.HashAlgorithmSHA256, NewImageLoadSequences().Append(
+		NewImageLoadActivity(shim).Loads(
+			NewImageLoadActivity(grub).Loads(
+				NewImageLoadActivity(kernel),
+			),
+		),
+	),
+		WithHostEnvironment(efitest.NewMockHostEnvironment(
+			makeMockVars(c, withMsSecureBootConfig(), withSbatLevel([]byte("sbat,1,2022052400\ngrub,2\n"))),
+			efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}}))),
+		WithSecureBootPolicyProfile(), WithBootManagerCodeProfile())
+	c.Assert(err, IsNil)
+	c.Check(sim.Alg, Equals, tpm2.HashAlgorithmSHA256)
+
+	pcrs, digests, err := sim.Profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, IsNil)
+	c.Check(pcrs, DeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}})
+	c.Check(digests, HasLen, 1)
+
+	c.Assert(sim.Changes, HasLen, 2)
+	c.Check(sim.Changes[0].PCR, Equals, 4)
+	c.Check(sim.Changes[0].Current, DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "4bc74f3ffe49b4dd275c9f475887b68193e2db8348d72e1c3c9099c2dcfa85b0")))
+	c.Check(sim.Changes[0].Predicted, DeepEquals, tpm2.DigestList{testutil.DecodeHexString(c, "78189c584cb5f543a798c9ab408c34912e2206ea7fa820296471ed40dd891ceb")})
+	c.Check(sim.Changes[0].Changed(), Equals, true)
+	c.Check(sim.Changes[1].PCR, Equals, 7)
+	c.Check(sim.Changes[1].Current, DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "afc99bd8b298ea9b70d2796cb0ca22fe2b70d784691a1cae2aa3ba55edc365dc")))
+	c.Check(sim.Changes[1].Predicted, DeepEquals, tpm2.DigestList{testutil.DecodeHexString(c, "3d65dbe406e9427d402488ea4f87e07e8b584c79c578a735d48d21a6405fc8bb")})
+	c.Check(sim.Changes[1].Changed(), Equals, true)
+
+	c.Check(sim.Summary(), Equals, `Expected PCR changes for the next boot (TPM_ALG_SHA256 bank):
+  PCR4: changed from 4bc74f3ffe49b4dd275c9f475887b68193e2db8348d72e1c3c9099c2dcfa85b0 to 78189c584cb5f543a798c9ab408c34912e2206ea7fa820296471ed40dd891ceb
+  PCR7: changed from afc99bd8b298ea9b70d2796cb0ca22fe2b70d784691a1cae2aa3ba55edc365dc to 3d65dbe406e9427d402488ea4f87e07e8b584c79c578a735d48d21a6405fc8bb
+`)
+}
+
+func (s *nextBootSuite) TestSimulateNextBootWithEventLog(c *C) {
+	shim := newMockUbuntuShimImage15_7(c)
+	grub := newMockUbuntuGrubImage3(c)
+	kernel := newMockUbuntuKernelImage3(c)
+
+	// The host environment doesn't provide a log, so the one supplied
+	// with WithEventLog must be used.
+	sim, err := SimulateNextBoot(tpm2.HashAlgorithmSHA256, NewImageLoadSequences().Append(
+		NewImageLoadActivity(shim).Loads(
+			NewImageLoadActivity(grub).Loads(
+				NewImageLoadActivity(kernel),
+			),
+		),
+	),
+		WithHostEnvironment(efitest.NewMockHostEnvironment(
+			makeMockVars(c, withMsSecureBootConfig(), withSbatLevel([]byte("sbat,1,2022052400\ngrub,2\n"))), nil)),
+		WithEventLog(efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})),
+		WithSecureBootPolicyProfile(), WithBootManagerCodeProfile())
+	c.Assert(err, IsNil)
+
+	c.Assert(sim.Changes, HasLen, 2)
+	c.Check(sim.Changes[0].PCR, Equals, 4)
+	c.Check(sim.Changes[0].Current, DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "4bc74f3ffe49b4dd275c9f475887b68193e2db8348d72e1c3c9099c2dcfa85b0")))
+	c.Check(sim.Changes[0].Predicted, DeepEquals, tpm2.DigestList{testutil.DecodeHexString(c, "78189c584cb5f543a798c9ab408c34912e2206ea7fa820296471ed40dd891ceb")})
+	c.Check(sim.Changes[1].PCR, Equals, 7)
+	c.Check(sim.Changes[1].Current, DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "afc99bd8b298ea9b70d2796cb0ca22fe2b70d784691a1cae2aa3ba55edc365dc")))
+	c.Check(sim.Changes[1].Predicted, DeepEquals, tpm2.DigestList{testutil.DecodeHexString(c, "3d65dbe406e9427d402488ea4f87e07e8b584c79c578a735d48d21a6405fc8bb")})
+}
+
+func (s *nextBootSuite) TestSimulateNextBootNoProfile(c *C) {
+	_, err := SimulateNextBoot(tpm2.HashAlgorithmSHA256, NewImageLoadSequences())
+	c.Check(err, ErrorMatches, `must specify a profile to add`)
+}
+
+func (s *nextBootSuite) TestNextBootSimulationSummary(c *C) {
+	sim := &NextBootSimulation{
+		Alg: tpm2.HashAlgorithmSHA256,
+		Changes: []*PCRChange{
+			{PCR: 4, Current: []byte{1}, Predicted: tpm2.DigestList{{2}, {3}}},
+			{PCR: 7, Current: []byte{4}, Predicted: tpm2.DigestList{{4}}},
+			{PCR: 12, Current: []byte{5}, Predicted: tpm2.DigestList{{5}, {6}}},
+		}}
+	c.Check(sim.Changes[0].Changed(), Equals, true)
+	c.Check(sim.Changes[1].Changed(), Equals, false)
+	c.Check(sim.Changes[2].Changed(), Equals, false)
+	c.Check(sim.Summary(), Equals, `Expected PCR changes for the next boot (TPM_ALG_SHA256 bank):
+  PCR4: changed from 01 to one of 2 values:
+    02
+    03
+  PCR7: unchanged (04)
+  PCR12: unchanged (05)
+`)
+}
+
+func (s *nextBootSuite) TestReplayLog(c *C) {
+	digest1 := testutil.DecodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c")
+	digest2 := testutil.DecodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730")
+
+	log := &tcglog.Log{Algorithms: tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA256}, Events: []*tcglog.Event{
+		{PCRIndex: 0, EventType: tcglog.EventTypeNoAction, Data: &tcglog.StartupLocalityEventData{StartupLocality: 3}},
+		{PCRIndex: 0, EventType: tcglog.EventTypeSCRTMVersion, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA256: digest1}},
+		{PCRIndex: 7, EventType: tcglog.EventTypeEFIVariableDriverConfig, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA256: digest1}},
+		{PCRIndex: 7, EventType: tcglog.EventTypeSeparator, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA256: digest2}},
+		{PCRIndex: 4, EventType: tcglog.EventTypeSeparator, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA256: digest2}},
+	}}
+
+	extend := func(value, digest []byte) tpm2.Digest {
+		h := crypto.SHA256.New()
+		h.Write(value)
+		h.Write(digest)
+		return h.Sum(nil)
+	}
+
+	pcr0 := make([]byte, 32)
+	pcr0[31] = 3
+
+	values, err := ReplayLog(log, tpm2.HashAlgorithmSHA256, MakePcrFlags(0, 7))
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, map[int]tpm2.Digest{
+		0: extend(pcr0, digest1),
+		7: extend(extend(make([]byte, 32), digest1), digest2),
+	})
+}
+
+func (s *nextBootSuite) TestReplayLogMissingDigest(c *C) {
+	log := &tcglog.Log{Algorithms: tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA256}, Events: []*tcglog.Event{
+		{PCRIndex: 7, EventType: tcglog.EventTypeSeparator, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA1: make([]byte, 20)}},
+	}}
+	_, err := ReplayLog(log, tpm2.HashAlgorithmSHA256, MakePcrFlags(7))
+	c.Check(err, ErrorMatches, `cannot replay TCG log: event 0 has no TPM_ALG_SHA256 digest`)
+}
+
+func (s *nextBootSuite) TestReplayLogMissingAlgorithm(c *C) {
+	log := &tcglog.Log{Algorithms: tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA1}, Events: []*tcglog.Event{
+		{PCRIndex: 7, EventType: tcglog.EventTypeSeparator, Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA1: make([]byte, 20)}},
+	}}
+	_, err := ReplayLog(log, tpm2.HashAlgorithmSHA256, MakePcrFlags(7))
+	c.Check(err, ErrorMatches, `TCG log has no TPM_ALG_SHA256 digests`)
+}
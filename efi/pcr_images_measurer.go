@@ -68,6 +68,14 @@ func (m *pcrImagesMeasurer) measureOneImage(bp *pcrBranchPointCtx, image ImageLo
 		if err != nil {
 			return xerrors.Errorf("cannot measure image load: %w", err)
 		}
+		if newHandler := image.newHandler(); newHandler != nil {
+			// The type of image was explicitly identified, so ignore
+			// the handler that was selected for it.
+			handler, err = newHandler(handle)
+			if err != nil {
+				return xerrors.Errorf("cannot create handler: %w", err)
+			}
+		}
 
 		// Measure the execution of the new image using its own handler.
 		if err := handler.MeasureImageStart(context); err != nil {
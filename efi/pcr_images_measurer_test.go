@@ -29,6 +29,7 @@ import (
 	efi "github.com/canonical/go-efilib"
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot/efi"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
 	"github.com/snapcore/secboot/internal/efitest"
 	"github.com/snapcore/secboot/internal/testutil"
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
@@ -198,6 +199,122 @@ func (s *pcrImagesMeasurerSuite) TestPcrImagesMeasurerNonLeaf(c *C) {
 	})
 }
 
+func (s *pcrImagesMeasurerSuite) TestPcrImagesMeasurerLoader(c *C) {
+	// Ensure that an image that is explicitly identified as a loader is
+	// measured with the loader handler rather than its own handler, and that
+	// each of the images it loads are in separate branches.
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+
+	params := new(LoadParams)
+	vars := NewVariableSetCollector(efitest.NewMockHostEnvironment(nil, nil)).Next()
+
+	h := crypto.SHA256.New()
+	io.WriteString(h, "foo")
+	digest1 := h.Sum(nil)
+
+	h = crypto.SHA256.New()
+	io.WriteString(h, "bar")
+	digest2 := h.Sum(nil)
+
+	h = crypto.SHA256.New()
+	io.WriteString(h, "baz")
+	digest3 := h.Sum(nil)
+
+	h = crypto.SHA256.New()
+	io.WriteString(h, "xyz")
+	digest4 := h.Sum(nil)
+
+	images := []*mockImage{
+		newMockImage(),
+		newMockImage(),
+		newMockImage().withDigest(crypto.SHA256, digest3),
+		newMockImage().withDigest(crypto.SHA256, digest4),
+	}
+	handlers := mockImageLoadHandlerMap{
+		images[0]: newMockLoadHandler().withExtendPCROnImageLoads(4, digest1),
+		images[1]: newMockLoadHandler().withExtendPCROnImageLoads(4, digest2),
+		images[2]: newMockLoadHandler(),
+		images[3]: newMockLoadHandler(),
+	}
+	pc := &mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(internal_efi.BootManagerCodePCR),
+		handlers: handlers,
+	}
+	bc := NewRootPcrBranchCtx(pc, profile.RootBranch(), params, vars)
+
+	m := NewPcrImagesMeasurer(bc, handlers[images[0]], NewLoaderImageLoadActivity(images[1]).Loads(
+		NewImageLoadActivity(images[2]),
+		NewImageLoadActivity(images[3]),
+	))
+	next, err := m.Measure()
+	c.Check(err, IsNil)
+	c.Check(next, HasLen, 1)
+
+	next, err = next[0].Measure()
+	c.Check(err, IsNil)
+	c.Check(next, HasLen, 0)
+
+	c.Check(profile.String(), Equals, fmt.Sprintf(`
+ BranchPoint(
+   Branch 0 {
+    ExtendPCR(TPM_ALG_SHA256, 4, %x)
+    BranchPoint(
+      Branch 0 {
+       ExtendPCR(TPM_ALG_SHA256, 4, %x)
+      }
+      Branch 1 {
+       ExtendPCR(TPM_ALG_SHA256, 4, %x)
+      }
+    )
+   }
+ )
+`, digest1, digest3, digest4))
+}
+
+func (s *pcrImagesMeasurerSuite) TestPcrImagesMeasurerUKI(c *C) {
+	// Ensure that an image that is explicitly identified as a UKI is
+	// measured with the UKI handler rather than its own handler.
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+
+	params := new(LoadParams)
+	vars := NewVariableSetCollector(efitest.NewMockHostEnvironment(nil, nil)).Next()
+
+	h := crypto.SHA256.New()
+	io.WriteString(h, "foo")
+	digest := h.Sum(nil)
+
+	images := []*mockImage{
+		newMockImage(),
+		newMockImage().addSection(".linux", []byte("mock kernel")),
+	}
+	handlers := mockImageLoadHandlerMap{
+		images[0]: newMockLoadHandler(),
+		images[1]: newMockLoadHandler().withExtendPCROnImageStart(11, digest),
+	}
+	pc := &mockPcrProfileContext{
+		alg:      tpm2.HashAlgorithmSHA256,
+		pcrs:     MakePcrFlags(KernelBootPCR),
+		handlers: handlers,
+	}
+	bc := NewRootPcrBranchCtx(pc, profile.RootBranch(), params, vars)
+
+	m := NewPcrImagesMeasurer(bc, handlers[images[0]], NewUKIImageLoadActivity(images[1], KernelBootPhaseParams("enter-initrd")))
+	next, err := m.Measure()
+	c.Check(err, IsNil)
+	c.Check(next, HasLen, 0)
+
+	c.Check(profile.String(), Equals, `
+ BranchPoint(
+   Branch 0 {
+    ExtendPCR(TPM_ALG_SHA256, 11, 0da293e37ad5511c59be47993769aacb91b243f7d010288e118dc90e95aaef5a)
+    ExtendPCR(TPM_ALG_SHA256, 11, c3363bf9734cf30d42f49ed9d5d04a122990610c1ebac8271a8efffe55387e9c)
+    ExtendPCR(TPM_ALG_SHA256, 11, 51e6b92f405d1f98d96e3de343d61d420ad6923b25de21d766f9298192f14fed)
+   }
+ )
+`)
+}
+
 func (s *pcrImagesMeasurerSuite) TestPcrImagesMeasurerTwoNonLeaf(c *C) {
 	// Ensure that measuring a 2 non-leaf application returns 2 new measurer instances
 	profile := secboot_tpm2.NewPCRProtectionProfile()
@@ -126,6 +126,11 @@ func WithDriversAndAppsProfile() PCRProfileEnablePCRsOption {
 //
 // Note that AddPCRProfile does not consider the host's revocation policy.
 //
+// If the platform firmware supports booting over HTTPS and measures the CA
+// certificates it uses to authenticate servers (the TlsCaCertificate variable)
+// after the secure boot configuration, then the current value of this variable
+// is included in the profile.
+//
 // The secure boot policy includes information about the secure boot configuration,
 // including signature databases. In order to support atomic updates to these databases,
 // it is possible to pre-generate a policy that includes these updates by supplying
@@ -177,6 +182,25 @@ func WithBootManagerCodeProfile() PCRProfileEnablePCRsOption {
 	return newPcrProfileSetPcrOption(internal_efi.BootManagerCodePCR)
 }
 
+// WithKernelBootProfile adds the kernel boot profile (PCR11). This binds a policy to
+// the sections of a unified kernel image (UKI) that are measured by systemd-stub, and
+// to the boot phases measured by systemd-pcrphase.
+//
+// Boot phases can be injected into the profile with [KernelBootPhaseParams].
+func WithKernelBootProfile() PCRProfileEnablePCRsOption {
+	return newPcrProfileSetPcrOption(kernelBootPCR)
+}
+
+// WithKernelDataProfile adds the kernel data profile (PCR9). This binds a policy
+// to the initrd of a unified kernel image (UKI), which is measured by the Linux
+// EFI stub (since Linux 5.17). Initrds that are loaded from outside of a UKI
+// can be added to a profile with [AddPCRProfileInitrd]. This is not suitable
+// for boot chains that contain GRUB, which measures the files it reads to the
+// same PCR.
+func WithKernelDataProfile() PCRProfileEnablePCRsOption {
+	return newPcrProfileSetPcrOption(kernelDataPCR)
+}
+
 // WithKernelConfigProfile adds the kernel config profile. This binds a policy to a
 // set of externally supplied commandlines. On Ubuntu Core, this also binds a policy
 // to a set of model assertions and the initrd phase of the boot.
@@ -232,8 +256,12 @@ type pcrProfileGenerator struct {
 	// SbatPolicy.
 	varModifiers []internal_efi.InitialVariablesModifier
 
-	// log is the host TCG log, which is read from the associated env.
+	// log is the host TCG log, which is read from the associated env unless
+	// it is overridden with the WithEventLog option.
 	log *tcglog.Log
+
+	// eventLog is the TCG log supplied with the WithEventLog option, if any.
+	eventLog *tcglog.Log
 }
 
 func newPcrProfileGenerator(pcrAlg tpm2.HashAlgorithmId, loadSequences *ImageLoadSequences, options ...PCRProfileOption) (*pcrProfileGenerator, error) {
@@ -255,9 +283,13 @@ func (g *pcrProfileGenerator) addPCRProfile(branch *secboot_tpm2.PCRProtectionPr
 	bp := branch.AddBranchPoint()
 	defer bp.EndBranchPoint()
 
-	log, err := g.env.ReadEventLog()
-	if err != nil {
-		return xerrors.Errorf("cannot read TCG event log: %w", err)
+	log := g.eventLog
+	if log == nil {
+		var err error
+		log, err = g.env.ReadEventLog()
+		if err != nil {
+			return xerrors.Errorf("cannot read TCG event log: %w", err)
+		}
 	}
 	g.log = log
 
@@ -336,6 +368,11 @@ func (g *pcrProfileGenerator) AddInitialVariablesModifier(fn internal_efi.Initia
 	g.varModifiers = append(g.varModifiers, fn)
 }
 
+// SetEventLog implements [internal_efi.PCRProfileOptionVisitor.SetEventLog]
+func (g *pcrProfileGenerator) SetEventLog(log *tcglog.Log) {
+	g.eventLog = log
+}
+
 // PCRAlg implements pcrProfileContext.PCRAlg.
 func (g *pcrProfileGenerator) PCRAlg() tpm2.HashAlgorithmId {
 	return g.pcrAlg
@@ -58,6 +58,13 @@ type peImageHandle interface {
 	// the specified name, or nil if no section exists.
 	OpenSection(name string) *io.SectionReader
 
+	// OpenLoadedSection returns a new io.SectionReader for the contents of
+	// the section with the specified name as it appears in memory once the
+	// image has been loaded, or nil if no section exists. Unlike OpenSection,
+	// the contents are truncated or zero padded to the virtual size of the
+	// section.
+	OpenLoadedSection(name string) *io.SectionReader
+
 	// HasSection indicates whether a section with the specified name
 	// exists.
 	HasSection(name string) bool
@@ -127,6 +134,14 @@ func (h *peImageHandleImpl) OpenSection(name string) *io.SectionReader {
 	return io.NewSectionReader(section.ReaderAt, 0, int64(section.Size))
 }
 
+func (h *peImageHandleImpl) OpenLoadedSection(name string) *io.SectionReader {
+	section := h.pefile.Section(name)
+	if section == nil {
+		return nil
+	}
+	return io.NewSectionReader(&loadedSectionReaderAt{section: section}, 0, int64(section.VirtualSize))
+}
+
 func (h *peImageHandleImpl) HasSection(name string) bool {
 	return h.pefile.Section(name) != nil
 }
@@ -187,6 +202,30 @@ func (h *peImageHandleImpl) SecureBootSignatures() ([]*efi.WinCertificateAuthent
 	return internal_efi.SecureBootSignaturesFromPEFile(h.pefile, h.r)
 }
 
+// loadedSectionReaderAt is an io.ReaderAt for the contents of a section,
+// where any data beyond the size of the section's raw data is read as zeroes.
+type loadedSectionReaderAt struct {
+	section *pe.Section
+}
+
+func (r *loadedSectionReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	size := int64(r.section.Size)
+	if off < size {
+		data := p
+		if int64(len(data)) > size-off {
+			data = data[:size-off]
+		}
+		n, err = r.section.ReadAt(data, off)
+		if n < len(data) {
+			return n, err
+		}
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 // cstringReader is a reader that can read a C-style NULL terminated string.
 type cstringReader struct {
 	r   io.Reader
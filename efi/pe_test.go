@@ -23,6 +23,7 @@ import (
 	"crypto"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
+	"io/ioutil"
 
 	. "gopkg.in/check.v1"
 
@@ -74,6 +75,41 @@ func (s *peSuite) TestPeImageHandleOpenSectionMissing(c *C) {
 	c.Check(section, IsNil)
 }
 
+func (s *peSuite) TestPeImageHandleOpenLoadedSection(c *C) {
+	source := NewFileImage("testdata/amd64/mockshim.efi.signed.1.1.1")
+
+	r, err := source.Open()
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	pefile, err := pe.NewFile(r)
+	c.Assert(err, IsNil)
+	expected, err := pefile.Section(".sbat").Data()
+	c.Assert(err, IsNil)
+
+	image, err := OpenPeImage(source)
+	c.Assert(err, IsNil)
+	defer image.Close()
+
+	section := image.OpenLoadedSection(".sbat")
+	c.Assert(section, NotNil)
+	c.Check(section.Size(), Equals, int64(pefile.Section(".sbat").VirtualSize))
+	c.Check(section.Size() < int64(len(expected)), testutil.IsTrue)
+
+	data, err := ioutil.ReadAll(section)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, expected[:section.Size()])
+}
+
+func (s *peSuite) TestPeImageHandleOpenLoadedSectionMissing(c *C) {
+	image, err := OpenPeImage(NewFileImage("testdata/amd64/mockshim.efi.signed.1.1.1"))
+	c.Assert(err, IsNil)
+	defer image.Close()
+
+	section := image.OpenLoadedSection(".foo")
+	c.Check(section, IsNil)
+}
+
 func (s *peSuite) TestPeImageHandleHasSectionTrue(c *C) {
 	image, err := OpenPeImage(NewFileImage("testdata/amd64/mockshim.efi.signed.1.1.1"))
 	c.Assert(err, IsNil)
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall
+
+import "errors"
+
+// Action describes an action that can be taken in order to resolve an error
+// or warning returned from [RunChecks]. These are intended to be rendered by
+// an installer.
+type Action string
+
+const (
+	// ActionRebootToFWSettings indicates that the error may be resolved by
+	// rebooting to the platform firmware's setup menu and changing its
+	// configuration.
+	ActionRebootToFWSettings Action = "reboot-to-fw-settings"
+
+	// ActionEnableTPMViaFirmware indicates that the error may be resolved by
+	// enabling the TPM, either from the platform firmware's setup menu or by
+	// using the physical presence interface.
+	ActionEnableTPMViaFirmware Action = "enable-tpm-via-firmware"
+
+	// ActionClearTPMViaFirmware indicates that the error may be resolved by
+	// clearing the TPM, either from the platform firmware's setup menu or by
+	// using the physical presence interface.
+	ActionClearTPMViaFirmware Action = "clear-tpm-via-firmware"
+
+	// ActionContactOEM indicates that the error is caused by the platform
+	// firmware or hardware, and can only be resolved by the OEM, eg, with a
+	// firmware update.
+	ActionContactOEM Action = "contact-oem"
+
+	// ActionContactOSVendor indicates that the error is caused by the OS, eg,
+	// because of missing kernel support.
+	ActionContactOSVendor Action = "contact-os-vendor"
+
+	// ActionPermitWithFlag indicates that the error can be ignored by running
+	// RunChecks again with the corresponding Permit* flag, although this reduces
+	// the level of protection that FDE offers.
+	ActionPermitWithFlag Action = "permit-with-flag"
+)
+
+// ActionsForError returns the actions that can be taken in order to resolve the
+// supplied error or warning, which should be one of the errors returned from
+// [RunChecks] or one of the errors contained within a [RunChecksErrors] or the
+// Warnings field of a [CheckResult]. The actions are ordered from the most to the
+// least preferable. If no action can resolve the error, nil is returned.
+func ActionsForError(err error) []Action {
+	var hierarchyOwnedErr *TPM2HierarchyOwnedError
+	var noSuitablePcrAlgErr *NoSuitablePCRAlgorithmError
+
+	switch {
+	case errors.Is(err, ErrNoTPM2Device):
+		return []Action{ActionRebootToFWSettings, ActionContactOEM}
+	case errors.Is(err, ErrTPMDisabled):
+		return []Action{ActionEnableTPMViaFirmware, ActionRebootToFWSettings}
+	case errors.Is(err, ErrTPMLockout), errors.As(err, &hierarchyOwnedErr):
+		return []Action{ActionClearTPMViaFirmware, ActionRebootToFWSettings}
+	case errors.Is(err, ErrTPMInsufficientNVCounters):
+		return []Action{ActionClearTPMViaFirmware, ActionContactOEM}
+	case errors.Is(err, ErrNoPCClientTPM), errors.Is(err, ErrNoEKCertificate):
+		return []Action{ActionContactOEM}
+	case errors.Is(err, ErrNoSecureBoot), errors.Is(err, ErrNoDeployedMode):
+		return []Action{ActionRebootToFWSettings}
+	case errors.Is(err, ErrCPUDebuggingNotLocked),
+		errors.Is(err, ErrInsufficientDMAProtection),
+		errors.Is(err, ErrUEFIDebuggingEnabled):
+		return []Action{ActionRebootToFWSettings, ActionContactOEM}
+	case errors.Is(err, ErrNoKernelIOMMU):
+		return []Action{ActionContactOSVendor}
+	case errors.As(err, &noSuitablePcrAlgErr):
+		return []Action{ActionContactOEM}
+	case errors.Is(err, ErrAbsoluteComputraceActive):
+		return []Action{ActionRebootToFWSettings, ActionPermitWithFlag}
+	case errors.Is(err, ErrVirtualMachineDetected),
+		errors.Is(err, ErrTPMStartupLocalityNotProtected),
+		errors.Is(err, ErrVARSuppliedDriversPresent),
+		errors.Is(err, ErrSysPrepApplicationsPresent),
+		errors.Is(err, ErrNotAllBootManagerCodeDigestsVerified),
+		errors.Is(err, ErrWeakSecureBootAlgorithmsDetected),
+		errors.Is(err, ErrPreOSVerificationUsingDigestsDetected):
+		return []Action{ActionPermitWithFlag}
+	default:
+		return nil
+	}
+}
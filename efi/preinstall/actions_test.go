@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi/preinstall"
+)
+
+type actionsSuite struct{}
+
+var _ = Suite(&actionsSuite{})
+
+func (s *actionsSuite) TestActionsForErrorTPMDisabled(c *C) {
+	c.Check(ActionsForError(fmt.Errorf("error with TPM2 device: %w", ErrTPMDisabled)), DeepEquals, []Action{ActionEnableTPMViaFirmware, ActionRebootToFWSettings})
+}
+
+func (s *actionsSuite) TestActionsForErrorTPMOwned(c *C) {
+	c.Check(ActionsForError(&TPM2HierarchyOwnedError{Hierarchy: tpm2.HandleOwner}), DeepEquals, []Action{ActionClearTPMViaFirmware, ActionRebootToFWSettings})
+	c.Check(ActionsForError(ErrTPMLockout), DeepEquals, []Action{ActionClearTPMViaFirmware, ActionRebootToFWSettings})
+}
+
+func (s *actionsSuite) TestActionsForErrorSecureBoot(c *C) {
+	err := fmt.Errorf("error with secure boot policy (PCR7) measurements: %w", ErrNoSecureBoot)
+	c.Check(ActionsForError(err), DeepEquals, []Action{ActionRebootToFWSettings})
+	c.Check(ActionsForError(ErrNoDeployedMode), DeepEquals, []Action{ActionRebootToFWSettings})
+}
+
+func (s *actionsSuite) TestActionsForErrorFirmwareProtections(c *C) {
+	c.Check(ActionsForError(ErrUEFIDebuggingEnabled), DeepEquals, []Action{ActionRebootToFWSettings, ActionContactOEM})
+	c.Check(ActionsForError(ErrNoKernelIOMMU), DeepEquals, []Action{ActionContactOSVendor})
+}
+
+func (s *actionsSuite) TestActionsForErrorNoSuitablePCRAlgorithm(c *C) {
+	c.Check(ActionsForError(&NoSuitablePCRAlgorithmError{}), DeepEquals, []Action{ActionContactOEM})
+}
+
+func (s *actionsSuite) TestActionsForErrorPermitted(c *C) {
+	for _, err := range []error{
+		ErrVirtualMachineDetected,
+		ErrTPMStartupLocalityNotProtected,
+		ErrVARSuppliedDriversPresent,
+		ErrSysPrepApplicationsPresent,
+		ErrNotAllBootManagerCodeDigestsVerified,
+		ErrWeakSecureBootAlgorithmsDetected,
+		ErrPreOSVerificationUsingDigestsDetected,
+	} {
+		c.Check(ActionsForError(err), DeepEquals, []Action{ActionPermitWithFlag}, Commentf("%v", err))
+	}
+	c.Check(ActionsForError(ErrAbsoluteComputraceActive), DeepEquals, []Action{ActionRebootToFWSettings, ActionPermitWithFlag})
+}
+
+func (s *actionsSuite) TestActionsForErrorUnknown(c *C) {
+	c.Check(ActionsForError(errors.New("some error")), IsNil)
+}
@@ -109,6 +109,16 @@ func checkSecureBootVariableData(data *tcglog.EFIVariableData) (sigDb efi.Signat
 // public key is considered strong enough for signing. This will return true if it is
 // or false if it isn't. It will return an error for unsupported public key algorithms
 // or if the public key's concrete type is inconsistent with the algorithm.
+// isTLSCACertificateConfigEvent returns true if the supplied EV_EFI_VARIABLE_DRIVER_CONFIG
+// event is a measurement of the TLS CA certificates used for HTTPS boot.
+func isTLSCACertificateConfigEvent(ev *tcglog.Event) bool {
+	data, ok := ev.Data.(*tcglog.EFIVariableData)
+	if !ok {
+		return false
+	}
+	return data.UnicodeName == internal_efi.TLSCACertificateVariable.Name && data.VariableName == internal_efi.TLSCACertificateVariable.GUID
+}
+
 func checkX509CertificatePublicKeyStrength(cert *x509.Certificate) (ok bool, err error) {
 	switch cert.PublicKeyAlgorithm {
 	case x509.RSA:
@@ -474,6 +484,18 @@ NextEvent:
 
 			switch ev.EventType {
 			case tcglog.EventTypeEFIVariableDriverConfig:
+				if len(configs) == 0 && isTLSCACertificateConfigEvent(ev) {
+					// Firmware that supports HTTPS boot may measure the CA certificates used to
+					// authenticate servers after the secure boot variables. WithSecureBootPolicyProfile()
+					// includes this in the profile.
+					data := ev.Data.(*tcglog.EFIVariableData)
+					expectedDigest := tcglog.ComputeEFIVariableDataDigest(pcrAlg.GetHash(), data.UnicodeName, data.VariableName, data.VariableData)
+					if !bytes.Equal(ev.Digests[pcrAlg], expectedDigest) {
+						return nil, fmt.Errorf("event data inconsistent with measured digest for EV_EFI_VARIABLE_DRIVER_CONFIG event (name:%q, GUID:%v, expected digest:%#x, measured digest:%#x)",
+							data.UnicodeName, data.VariableName, expectedDigest, ev.Digests[pcrAlg])
+					}
+					continue NextEvent
+				}
 				if len(configs) == 0 {
 					// Unexpected config event - we're not expecting another secure boot variable
 					// to measure. We should have exitted the loop by now.
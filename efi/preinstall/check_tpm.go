@@ -24,6 +24,7 @@ import (
 
 	"github.com/canonical/go-tpm2"
 	internal_efi "github.com/snapcore/secboot/internal/efi"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
 )
 
 const (
@@ -180,3 +181,17 @@ func openAndCheckTPM2Device(env internal_efi.HostEnvironment, flags checkTPM2Dev
 
 	return tpm, discreteTPM, nil
 }
+
+// checkTPM2EKCertificate checks that the TPM has at least one EK certificate
+// in one of the NV indices reserved for them by the TCG, returning
+// ErrNoEKCertificate if there isn't one.
+func checkTPM2EKCertificate(tpm *tpm2.TPMContext) error {
+	certs, err := secboot_tpm2.DiscoverEKCertificatesFromTPM(tpm)
+	if err != nil {
+		return fmt.Errorf("cannot discover EK certificates: %w", err)
+	}
+	if len(certs) == 0 {
+		return ErrNoEKCertificate
+	}
+	return nil
+}
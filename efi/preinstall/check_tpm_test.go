@@ -21,7 +21,14 @@ package preinstall_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"math/big"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
@@ -402,3 +409,49 @@ func (s *tpmSuite) TestOpenAndCheckTPM2DeviceInsufficientNVCountersPreInstall(c
 	c.Check(err, Equals, ErrTPMInsufficientNVCounters)
 	c.Check(dev.NumberOpen(), Equals, int(0))
 }
+
+func (s *tpmSuite) TestCheckTPM2EKCertificateGood(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "EK"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	c.Assert(err, IsNil)
+
+	pub := tpm2.NVPublic{
+		Index:   0x01c0000a,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    uint16(len(cert))}
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, &pub)
+	c.Assert(s.TPM.NVWrite(s.TPM.OwnerHandleContext(), index, cert, 0, nil), IsNil)
+
+	c.Check(CheckTPM2EKCertificate(s.TPM), IsNil)
+}
+
+func (s *tpmSuite) TestCheckTPM2EKCertificateNotWritten(c *C) {
+	// Define a certificate index that hasn't been written.
+	pub := tpm2.NVPublic{
+		Index:   0x01c00002,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &pub)
+
+	c.Check(CheckTPM2EKCertificate(s.TPM), Equals, ErrNoEKCertificate)
+}
+
+func (s *tpmSuite) TestCheckTPM2EKCertificateNoCertificate(c *C) {
+	// Define a template index, which isn't a certificate.
+	pub := tpm2.NVPublic{
+		Index:   0x01c00004,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &pub)
+
+	c.Check(CheckTPM2EKCertificate(s.TPM), Equals, ErrNoEKCertificate)
+}
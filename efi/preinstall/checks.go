@@ -0,0 +1,242 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	secboot_efi "github.com/snapcore/secboot/efi"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+)
+
+// CheckFlags customizes the behaviour of [RunChecks].
+type CheckFlags int
+
+const (
+	// PermitVirtualMachine will prevent RunChecks from returning an error if the
+	// current environment is a virtual machine. Checks for platform firmware
+	// protections are skipped in this case.
+	PermitVirtualMachine CheckFlags = 1 << iota
+
+	// PermitVARSuppliedDrivers will prevent RunChecks from returning an error if
+	// value-added-retailer drivers are detected.
+	PermitVARSuppliedDrivers
+
+	// PermitSysPrepApplications will prevent RunChecks from returning an error if
+	// system preparation applications are detected.
+	PermitSysPrepApplications
+
+	// PermitAbsoluteComputrace will prevent RunChecks from returning an error if
+	// Absolute is detected.
+	PermitAbsoluteComputrace
+
+	// PermitNotVerifyingAllBootManagerCodeDigests will prevent RunChecks from
+	// returning an error if not all EV_EFI_BOOT_SERVICES_APPLICATION digests in the
+	// TCG log could be verified against the supplied load images.
+	PermitNotVerifyingAllBootManagerCodeDigests
+
+	// PermitWeakSecureBootAlgorithms will prevent RunChecks from returning an error
+	// if weak algorithms are detected during secure boot verification.
+	PermitWeakSecureBootAlgorithms
+
+	// PermitPreOSVerificationUsingDigests will prevent RunChecks from returning an
+	// error if pre-OS components are verified using Authenticode digests in db.
+	PermitPreOSVerificationUsingDigests
+
+	// PermitNoDiscreteTPMResetMitigation will prevent RunChecks from returning an
+	// error if a discrete TPM is detected and it is not possible to offer any
+	// mitigation against reset attacks.
+	PermitNoDiscreteTPMResetMitigation
+
+	// PostInstallChecks indicates that RunChecks is being executed post-install
+	// rather than pre-install, which skips some TPM checks that are only relevant
+	// before the TPM is provisioned.
+	PostInstallChecks
+)
+
+var (
+	// runChecksEnv is the host environment used by RunChecks.
+	runChecksEnv internal_efi.HostEnvironment = internal_efi.DefaultEnv
+
+	// mandatoryPcrs are the PCRs that must be consistent with the TCG log for a
+	// PCR bank to be selected. These are the PCRs that the efi package can generate
+	// profiles for.
+	mandatoryPcrs = tpm2.HandleList{
+		internal_efi.PlatformFirmwarePCR,
+		internal_efi.DriversAndAppsPCR,
+		internal_efi.BootManagerCodePCR,
+		internal_efi.SecureBootPolicyPCR,
+	}
+)
+
+// RunChecks performs checks on the current platform to determine whether it is suitable
+// for EFI based TPM protected FDE. The supplied context is used when reading EFI variables.
+// The loadedImages argument provides the images associated with the current boot in the
+// order in which they were loaded, starting with the initial boot loader, and at least
+// the initial boot loader must be supplied.
+//
+// This checks that there is a TPM2 device which is enabled, not in DA lockout mode and
+// (unless the PostInstallChecks flag is supplied) not owned. It checks that the TCG log is
+// consistent with at least one supported PCR bank, that the log is not truncated and is
+// well formed, that the platform firmware is adequately protected and that secure boot is
+// enabled and in deployed mode. It also performs detailed checks on each of the PCRs that
+// the efi package can generate profiles for.
+//
+// Errors that prevent further checks from running are returned immediately. Errors
+// detected by checks that don't prevent other checks from running are collected and
+// returned in a *RunChecksErrors. Problems that don't prevent the use of FDE, such as the
+// inability to generate a profile for a specific PCR, are returned as warnings in the
+// Warnings field of the returned result. The actions that can be taken to resolve each
+// error or warning can be obtained using [ActionsForError].
+func RunChecks(ctx context.Context, flags CheckFlags, loadedImages []secboot_efi.Image) (result *CheckResult, err error) {
+	if len(loadedImages) == 0 {
+		return nil, errors.New("at least the initial EFI application loaded during this boot must be supplied")
+	}
+
+	env := runChecksEnv
+	errs := new(RunChecksErrors)
+	warnings := new(RunChecksErrors)
+	result = new(CheckResult)
+
+	virtMode, err := detectVirtualization(env)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check for virtualization: %w", err)
+	}
+
+	var tpmFlags checkTPM2DeviceFlags
+	if virtMode == detectVirtVM {
+		result.Flags |= RunningInVirtualMachine
+		tpmFlags |= checkTPM2DeviceInVM
+		if flags&PermitVirtualMachine == 0 {
+			errs.addErr(ErrVirtualMachineDetected)
+		}
+	}
+	if flags&PostInstallChecks > 0 {
+		tpmFlags |= checkTPM2DevicePostInstall
+	}
+
+	tpm, discreteTPM, err := openAndCheckTPM2Device(env, tpmFlags)
+	if err != nil {
+		return nil, &TPM2DeviceError{err}
+	}
+	defer tpm.Close()
+
+	if err := checkTPM2EKCertificate(tpm); err != nil {
+		warnings.addErr(&TPM2DeviceError{err})
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TCG log: %w", err)
+	}
+
+	pcrResults, err := checkFirmwareLogAndChoosePCRBank(tpm, log, mandatoryPcrs)
+	if err != nil {
+		return nil, err
+	}
+	result.PCRAlg = pcrResults.Alg
+
+	// The efi package doesn't support generating profiles for these PCRs yet.
+	result.Flags |= NoPlatformConfigProfileSupport | NoDriversAndAppsConfigProfileSupport | NoBootManagerConfigProfileSupport
+
+	if virtMode == detectVirtNone {
+		protectedStartupLocalities, err := checkPlatformFirmwareProtections(env, log)
+		if err != nil {
+			errs.addErr(err)
+		}
+		if discreteTPM {
+			result.Flags |= DiscreteTPMDetected
+			if protectedStartupLocalities&tpm2.Locality(1<<pcrResults.StartupLocality) == 0 {
+				result.Flags |= StartupLocalityNotProtected
+				if flags&PermitNoDiscreteTPMResetMitigation == 0 {
+					errs.addErr(ErrTPMStartupLocalityNotProtected)
+				}
+			}
+		}
+	}
+
+	driversAndAppsResult, err := checkDriversAndAppsMeasurements(log)
+	switch {
+	case err != nil:
+		result.Flags |= NoDriversAndAppsProfileSupport
+		warnings.addErr(fmt.Errorf("error with drivers and apps (PCR%d) measurements: %w", internal_efi.DriversAndAppsPCR, err))
+	case driversAndAppsResult == driversAndAppsPresent:
+		result.Flags |= VARDriversPresent
+		if flags&PermitVARSuppliedDrivers == 0 {
+			errs.addErr(ErrVARSuppliedDriversPresent)
+		}
+	}
+
+	bootManagerCodeResult, err := checkBootManagerCodeMeasurements(ctx, env, log, result.PCRAlg, loadedImages)
+	if err != nil {
+		result.Flags |= NoBootManagerCodeProfileSupport
+		warnings.addErr(fmt.Errorf("error with boot manager code (PCR%d) measurements: %w", internal_efi.BootManagerCodePCR, err))
+	} else {
+		if bootManagerCodeResult&bootManagerCodeSysprepAppsPresent > 0 {
+			result.Flags |= SysPrepApplicationsPresent
+			if flags&PermitSysPrepApplications == 0 {
+				errs.addErr(ErrSysPrepApplicationsPresent)
+			}
+		}
+		if bootManagerCodeResult&bootManagerCodeAbsoluteComputraceRunning > 0 {
+			result.Flags |= AbsoluteComputraceActive
+			if flags&PermitAbsoluteComputrace == 0 {
+				errs.addErr(ErrAbsoluteComputraceActive)
+			}
+		}
+		if bootManagerCodeResult&bootManagerCodeNotAllLaunchDigestsVerified > 0 {
+			result.Flags |= NotAllBootManagerCodeDigestsVerified
+			if flags&PermitNotVerifyingAllBootManagerCodeDigests == 0 {
+				errs.addErr(ErrNotAllBootManagerCodeDigestsVerified)
+			}
+		}
+	}
+
+	secureBootResult, err := checkSecureBootPolicyMeasurementsAndObtainAuthorities(ctx, env, log, result.PCRAlg, loadedImages[0])
+	if err != nil {
+		result.Flags |= NoSecureBootPolicyProfileSupport
+		warnings.addErr(fmt.Errorf("error with secure boot policy (PCR%d) measurements: %w", internal_efi.SecureBootPolicyPCR, err))
+	} else {
+		result.UsedSecureBootCAs = secureBootResult.UsedAuthorities
+		if secureBootResult.Flags&secureBootIncludesWeakAlg > 0 {
+			result.Flags |= WeakSecureBootAlgorithmsDetected
+			if flags&PermitWeakSecureBootAlgorithms == 0 {
+				errs.addErr(ErrWeakSecureBootAlgorithmsDetected)
+			}
+		}
+		if secureBootResult.Flags&secureBootPreOSVerificationIncludesDigest > 0 {
+			result.Flags |= PreOSVerificationUsingDigestsDetected
+			if flags&PermitPreOSVerificationUsingDigests == 0 {
+				errs.addErr(ErrPreOSVerificationUsingDigestsDetected)
+			}
+		}
+	}
+
+	if len(errs.Errs) > 0 {
+		return nil, errs
+	}
+	if len(warnings.Errs) > 0 {
+		result.Warnings = warnings
+	}
+	return result, nil
+}
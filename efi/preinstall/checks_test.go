@@ -0,0 +1,76 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall_test
+
+import (
+	"context"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	. "github.com/snapcore/secboot/efi/preinstall"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/secboot/internal/efitest"
+)
+
+type runChecksSuite struct{}
+
+var _ = Suite(&runChecksSuite{})
+
+func (s *runChecksSuite) TestRunChecksNoImages(c *C) {
+	_, err := RunChecks(context.Background(), 0, nil)
+	c.Check(err, ErrorMatches, `at least the initial EFI application loaded during this boot must be supplied`)
+}
+
+func (s *runChecksSuite) TestRunChecksContainer(c *C) {
+	restore := MockRunChecksEnv(efitest.NewMockHostEnvironmentWithOpts(
+		efitest.WithVirtMode("lxc", internal_efi.DetectVirtModeContainer),
+	))
+	defer restore()
+
+	_, err := RunChecks(context.Background(), 0, []secboot_efi.Image{new(mockImage)})
+	c.Check(err, ErrorMatches, `cannot check for virtualization: container environments are not supported`)
+}
+
+func (s *runChecksSuite) TestRunChecksNoTPM(c *C) {
+	restore := MockRunChecksEnv(efitest.NewMockHostEnvironmentWithOpts(
+		efitest.WithVirtMode(internal_efi.VirtModeNone, internal_efi.DetectVirtModeAll),
+	))
+	defer restore()
+
+	_, err := RunChecks(context.Background(), 0, []secboot_efi.Image{new(mockImage)})
+	c.Check(err, ErrorMatches, `error with TPM2 device: no TPM2 device is available`)
+
+	var tpmErr *TPM2DeviceError
+	c.Assert(errors.As(err, &tpmErr), Equals, true)
+	c.Check(errors.Is(err, ErrNoTPM2Device), Equals, true)
+	c.Check(ActionsForError(err), DeepEquals, []Action{ActionRebootToFWSettings, ActionContactOEM})
+}
+
+func (s *runChecksSuite) TestRunChecksVMNoTPM(c *C) {
+	restore := MockRunChecksEnv(efitest.NewMockHostEnvironmentWithOpts(
+		efitest.WithVirtMode("qemu", internal_efi.DetectVirtModeVM),
+	))
+	defer restore()
+
+	_, err := RunChecks(context.Background(), PermitVirtualMachine, []secboot_efi.Image{new(mockImage)})
+	c.Check(err, ErrorMatches, `error with TPM2 device: no TPM2 device is available`)
+}
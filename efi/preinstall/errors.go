@@ -110,6 +110,15 @@ func (e *RunChecksErrors) addErr(err error) {
 	e.Errs = append(e.Errs, err)
 }
 
+// Errors related to the execution environment.
+
+var (
+	// ErrVirtualMachineDetected is returned wrapped from RunChecks if the current
+	// environment is a virtual machine and the PermitVirtualMachine flag is not
+	// supplied.
+	ErrVirtualMachineDetected = errors.New("virtual machine environment detected")
+)
+
 // Errors related to checking platform firmware protections.
 
 // NoHardwareRootOfTrustError is returned wrapped from [RunChecks] if the platform
@@ -199,8 +208,36 @@ var (
 	// [github.com/canonical/go-tpm2/ppi.PPI] interface, obtained by using
 	// [github.com/canonical/go-tpm2/linux/RawDevice.PhysicalPresenceInterface].
 	ErrTPMDisabled = errors.New("TPM2 device is present but is currently disabled by the platform firmware")
+
+	// ErrNoEKCertificate is returned wrapped in TPM2DeviceError as a warning from
+	// RunChecks if there is no EK certificate stored on the TPM. This doesn't prevent
+	// the use of the TPM for FDE, but it means that the TPM's identity cannot be
+	// verified without obtaining the certificate from elsewhere.
+	ErrNoEKCertificate = errors.New("no EK certificate is available on the TPM")
+
+	// ErrTPMStartupLocalityNotProtected is returned wrapped from RunChecks if a
+	// discrete TPM is detected and its startup locality can most likely be accessed
+	// from ring 0 code, making it impossible to offer any mitigation against TPM reset
+	// attacks. This won't be returned if the PermitNoDiscreteTPMResetMitigation flag is
+	// supplied to RunChecks.
+	ErrTPMStartupLocalityNotProtected = errors.New("no reset attack mitigation is possible for the discrete TPM because its startup locality is accessible from ring 0 code")
 )
 
+// TPM2DeviceError is returned unwrapped from [RunChecks] if there is a problem
+// with the TPM2 device, or returned as a warning if the problem doesn't prevent
+// the use of the TPM for FDE.
+type TPM2DeviceError struct {
+	err error
+}
+
+func (e *TPM2DeviceError) Error() string {
+	return "error with TPM2 device: " + e.err.Error()
+}
+
+func (e *TPM2DeviceError) Unwrap() error {
+	return e.err
+}
+
 // TPMHierarchyOwnedError is returned wrapped in TPM2DeviceError if the authorization value
 // for the specified hierarchy is set, but the PostInstallChecks flag isn't set. If a
 // hierarchy is owned during pre-install, the TPM will most likely need to be cleared.
@@ -306,6 +343,37 @@ var (
 	ErrNoDeployedMode = errors.New("deployed mode should be enabled in order to generate secure boot profiles")
 )
 
+// Errors related to the checks performed on individual PCRs, which have to be opted
+// into with the corresponding flags to RunChecks.
+
+var (
+	// ErrVARSuppliedDriversPresent is returned wrapped from RunChecks if value-added-retailer
+	// drivers were detected and the PermitVARSuppliedDrivers flag isn't supplied.
+	ErrVARSuppliedDriversPresent = errors.New("value added retailer supplied drivers were detected to be running")
+
+	// ErrSysPrepApplicationsPresent is returned wrapped from RunChecks if system preparation
+	// applications were detected and the PermitSysPrepApplications flag isn't supplied.
+	ErrSysPrepApplicationsPresent = errors.New("system preparation applications were detected to be running")
+
+	// ErrAbsoluteComputraceActive is returned wrapped from RunChecks if Absolute was detected
+	// and the PermitAbsoluteComputrace flag isn't supplied.
+	ErrAbsoluteComputraceActive = errors.New("Absolute was detected to be active and it is advised that this is disabled")
+
+	// ErrNotAllBootManagerCodeDigestsVerified is returned wrapped from RunChecks if not all
+	// EV_EFI_BOOT_SERVICES_APPLICATION digests could be verified and the
+	// PermitNotVerifyingAllBootManagerCodeDigests flag isn't supplied.
+	ErrNotAllBootManagerCodeDigestsVerified = errors.New("not all EV_EFI_BOOT_SERVICES_APPLICATION boot manager launch digests could be verified")
+
+	// ErrWeakSecureBootAlgorithmsDetected is returned wrapped from RunChecks if weak secure
+	// boot algorithms were detected and the PermitWeakSecureBootAlgorithms flag isn't supplied.
+	ErrWeakSecureBootAlgorithmsDetected = errors.New("weak secure boot algorithms were used during verification")
+
+	// ErrPreOSVerificationUsingDigestsDetected is returned wrapped from RunChecks if pre-OS
+	// components were verified using Authenticode digests in db and the
+	// PermitPreOSVerificationUsingDigests flag isn't supplied.
+	ErrPreOSVerificationUsingDigestsDetected = errors.New("some pre-OS components were authenticated from the authorized signature database using an Authenticode digest")
+)
+
 // UnsupportedReqiredPCRsError is returned from methods of [PCRProfileAutoEnablePCRsOption]
 // when a valid PCR configuration cannot be created based on the supplied [PCRProfileOptionsFlags]
 // and [CheckResult].
@@ -24,6 +24,7 @@ import (
 	"io"
 
 	efi "github.com/canonical/go-efilib"
+	internal_efi "github.com/snapcore/secboot/internal/efi"
 	pe "github.com/snapcore/secboot/internal/pe1.14"
 )
 
@@ -73,6 +74,7 @@ var (
 	CheckForKernelIOMMU                                   = checkForKernelIOMMU
 	CheckPlatformFirmwareProtections                      = checkPlatformFirmwareProtections
 	CheckPlatformFirmwareProtectionsIntelMEI              = checkPlatformFirmwareProtectionsIntelMEI
+	CheckTPM2EKCertificate                                = checkTPM2EKCertificate
 	CheckSecureBootPolicyMeasurementsAndObtainAuthorities = checkSecureBootPolicyMeasurementsAndObtainAuthorities
 	CheckSecureBootPolicyPCRForDegradedFirmwareSettings   = checkSecureBootPolicyPCRForDegradedFirmwareSettings
 	DetectVirtualization                                  = detectVirtualization
@@ -110,6 +112,14 @@ func MockKnownCAs(set AuthorityTrustDataSet) (restore func()) {
 	}
 }
 
+func MockRunChecksEnv(env internal_efi.HostEnvironment) (restore func()) {
+	orig := runChecksEnv
+	runChecksEnv = env
+	return func() {
+		runChecksEnv = orig
+	}
+}
+
 func MockPeNewFile(fn func(io.ReaderAt) (*pe.File, error)) (restore func()) {
 	orig := peNewFile
 	peNewFile = fn
@@ -138,7 +138,15 @@ func isLaunchedFromLoadOption(ev *tcglog.Event, opt *efi.LoadOption) (yes bool,
 		return true, nil
 	}
 
-	// There's no match with the load option. This might happen when booting from
+	// There's no match with the load option. When using HTTP boot to boot a disk
+	// image, the firmware downloads the image to a RAM disk and launches the
+	// initial boot loader from there, so the load event path won't contain any
+	// components from the load option path.
+	if internal_efi.IsNetworkBootDevicePath(opt.FilePath) && internal_efi.IsRAMDiskDevicePath(eventDevicePath) {
+		return true, nil
+	}
+
+	// This might also happen when booting from
 	// removable media where the load option specifies the device path pointing to
 	// the bus that the removable media is connected to, but the load event contains
 	// the full path to the initial boot loader, using some extra components.
@@ -360,6 +360,81 @@ func (s *loadOptionUtilSuite) TestIsLaunchedFromLoadOptionGoodRemovableUSB(c *C)
 	c.Check(yes, testutil.IsTrue)
 }
 
+func (s *loadOptionUtilSuite) TestIsLaunchedFromLoadOptionGoodHTTPBoot(c *C) {
+	opt := &efi.LoadOption{
+		Attributes:  1,
+		Description: "UEFI HTTPv4",
+		FilePath: efi.DevicePath{
+			&efi.ACPIDevicePathNode{
+				HID: 0x0a0341d0,
+				UID: 0x0},
+			&efi.PCIDevicePathNode{
+				Function: 0x0,
+				Device:   0x3},
+			&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0b, Data: make([]byte, 33)},
+			&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0c, Data: make([]byte, 23)},
+			&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x18},
+		},
+	}
+	ev := &tcglog.Event{
+		PCRIndex:  internal_efi.BootManagerCodePCR,
+		EventType: tcglog.EventTypeEFIBootServicesApplication,
+		Data: &tcglog.EFIImageLoadEvent{
+			LocationInMemory: 0x6556c018,
+			LengthInMemory:   955072,
+			DevicePath: efi.DevicePath{
+				&efi.GenericDevicePathNode{Type: efi.MediaDevicePath, SubType: 0x09, Data: make([]byte, 34)},
+				&efi.CDROMDevicePathNode{
+					BootEntry:      1,
+					PartitionStart: 0x100,
+					PartitionSize:  0x1000},
+				efi.FilePathDevicePathNode("\\EFI\\BOOT\\BOOTX64.EFI"),
+			},
+		},
+	}
+
+	yes, err := IsLaunchedFromLoadOption(ev, opt)
+	c.Check(err, IsNil)
+	c.Check(yes, testutil.IsTrue)
+}
+
+func (s *loadOptionUtilSuite) TestIsLaunchedFromLoadOptionNoMatchRAMDisk(c *C) {
+	// A launch from a RAM disk is only associated with a network boot option.
+	opt := &efi.LoadOption{
+		Attributes:  1,
+		Description: "ubuntu",
+		FilePath: efi.DevicePath{
+			&efi.HardDriveDevicePathNode{
+				PartitionNumber: 1,
+				PartitionStart:  0x800,
+				PartitionSize:   0x100000,
+				Signature:       efi.GUIDHardDriveSignature(efi.MakeGUID(0x66de947b, 0xfdb2, 0x4525, 0xb752, [...]uint8{0x30, 0xd6, 0x6b, 0xb2, 0xb9, 0x60})),
+				MBRType:         efi.GPT},
+			efi.FilePathDevicePathNode("\\EFI\\ubuntu\\shimx64.efi"),
+		},
+	}
+	ev := &tcglog.Event{
+		PCRIndex:  internal_efi.BootManagerCodePCR,
+		EventType: tcglog.EventTypeEFIBootServicesApplication,
+		Data: &tcglog.EFIImageLoadEvent{
+			LocationInMemory: 0x6556c018,
+			LengthInMemory:   955072,
+			DevicePath: efi.DevicePath{
+				&efi.GenericDevicePathNode{Type: efi.MediaDevicePath, SubType: 0x09, Data: make([]byte, 34)},
+				&efi.CDROMDevicePathNode{
+					BootEntry:      1,
+					PartitionStart: 0x100,
+					PartitionSize:  0x1000},
+				efi.FilePathDevicePathNode("\\EFI\\BOOT\\BOOTX64.EFI"),
+			},
+		},
+	}
+
+	yes, err := IsLaunchedFromLoadOption(ev, opt)
+	c.Check(err, IsNil)
+	c.Check(yes, testutil.IsFalse)
+}
+
 func (s *loadOptionUtilSuite) TestIsLaunchedFromLoadOptionNoMatch(c *C) {
 	opt := &efi.LoadOption{
 		Attributes:  1,
@@ -23,6 +23,7 @@ import (
 	"errors"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
 	. "github.com/snapcore/secboot/efi/preinstall"
 	internal_efi "github.com/snapcore/secboot/internal/efi"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -49,6 +50,10 @@ func (*mockPcrProfileOptionVisitor) AddInitialVariablesModifier(fn internal_efi.
 	panic("not reached")
 }
 
+func (*mockPcrProfileOptionVisitor) SetEventLog(log *tcglog.Log) {
+	panic("not reached")
+}
+
 func (s *profileSuite) TestWithAutoTCGPCRProfileDefault(c *C) {
 	result := &CheckResult{
 		PCRAlg:            tpm2.HashAlgorithmSHA256,
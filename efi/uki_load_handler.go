@@ -0,0 +1,166 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+)
+
+// ukiMeasuredSections are the sections of a UKI that are measured to the
+// kernel boot PCR by systemd-stub, in the order that they are measured. The
+// .pcrsig section isn't measured because it contains signatures of the
+// expected values of this PCR.
+var ukiMeasuredSections = []string{
+	".linux",
+	".osrel",
+	".cmdline",
+	".initrd",
+	".ucode",
+	".splash",
+	".dtb",
+	".uname",
+	".sbat",
+	".pcrpkey",
+}
+
+// ukiLoadHandler is an implementation of imageLoadHandler for generic
+// unified kernel images containing systemd-stub.
+type ukiLoadHandler struct {
+	image      Image
+	sections   []string // the measured sections that are present in the image
+	hasCmdline bool     // the image has a .cmdline section
+
+	sectionDigests map[tpm2.HashAlgorithmId]tpm2.DigestList
+}
+
+func newUKILoadHandler(image peImageHandle) (imageLoadHandler, error) {
+	if !image.HasSection(".linux") {
+		return nil, errors.New("image is not a UKI: no .linux section")
+	}
+
+	h := &ukiLoadHandler{
+		image:          image.Source(),
+		hasCmdline:     image.HasSection(".cmdline"),
+		sectionDigests: make(map[tpm2.HashAlgorithmId]tpm2.DigestList),
+	}
+	for _, name := range ukiMeasuredSections {
+		if image.HasSection(name) {
+			h.sections = append(h.sections, name)
+		}
+	}
+	return h, nil
+}
+
+// computeSectionDigests returns the digests of the contents of each of the
+// measured sections, in the order they are measured.
+func (h *ukiLoadHandler) computeSectionDigests(alg tpm2.HashAlgorithmId) (tpm2.DigestList, error) {
+	if digests, exists := h.sectionDigests[alg]; exists {
+		return digests, nil
+	}
+
+	image, err := openPeImage(h.image)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	defer image.Close()
+
+	var digests tpm2.DigestList
+	for _, name := range h.sections {
+		r := image.OpenLoadedSection(name)
+		if r == nil {
+			return nil, fmt.Errorf("missing %s section", name)
+		}
+		hash := alg.NewHash()
+		if _, err := io.Copy(hash, r); err != nil {
+			return nil, fmt.Errorf("cannot read %s section: %w", name, err)
+		}
+		digests = append(digests, hash.Sum(nil))
+	}
+
+	h.sectionDigests[alg] = digests
+	return digests, nil
+}
+
+func (h *ukiLoadHandler) MeasureImageStart(ctx pcrBranchContext) error {
+	if ctx.PCRs().Contains(kernelBootPCR) {
+		digests, err := h.computeSectionDigests(ctx.PCRAlg())
+		if err != nil {
+			return fmt.Errorf("cannot compute section digests: %w", err)
+		}
+
+		// The stub measures the NULL terminated name of each section
+		// followed by its contents.
+		for i, name := range h.sections {
+			hash := ctx.PCRAlg().NewHash()
+			io.WriteString(hash, name)
+			hash.Write([]byte{0})
+			ctx.ExtendPCR(kernelBootPCR, hash.Sum(nil))
+			ctx.ExtendPCR(kernelBootPCR, digests[i])
+		}
+
+		// systemd-pcrphase measures each boot phase without a NULL
+		// terminator.
+		if ctx.Params().KernelBootPhase != "" {
+			for _, phase := range strings.Split(ctx.Params().KernelBootPhase, ":") {
+				hash := ctx.PCRAlg().NewHash()
+				io.WriteString(hash, phase)
+				ctx.ExtendPCR(kernelBootPCR, hash.Sum(nil))
+			}
+		}
+	}
+
+	// The stub exposes the .initrd section to the kernel with the
+	// LINUX_EFI_INITRD_MEDIA device path, and the Linux EFI stub measures
+	// its contents to the kernel data PCR.
+	if ctx.PCRs().Contains(kernelDataPCR) {
+		for i, name := range h.sections {
+			if name != ".initrd" {
+				continue
+			}
+			digests, err := h.computeSectionDigests(ctx.PCRAlg())
+			if err != nil {
+				return fmt.Errorf("cannot compute section digests: %w", err)
+			}
+			ctx.ExtendPCR(kernelDataPCR, digests[i])
+		}
+	}
+
+	// The stub ignores the supplied commandline if the UKI has one, and
+	// doesn't measure anything if the supplied commandline is empty.
+	if ctx.PCRs().Contains(kernelConfigPCR) && !h.hasCmdline && ctx.Params().KernelCommandline != "" {
+		ctx.ExtendPCR(kernelConfigPCR,
+			tcglog.ComputeSystemdEFIStubCommandlineDigest(ctx.PCRAlg().GetHash(), ctx.Params().KernelCommandline))
+	}
+
+	// TODO: handle credentials, confexts, sysexts and commandline addons
+	// if we need them in the future.
+
+	return nil
+}
+
+func (h *ukiLoadHandler) MeasureImageLoad(_ pcrBranchContext, _ peImageHandle) (imageLoadHandler, error) {
+	return nil, errors.New("kernel is a leaf image")
+}
@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type ukiLoadHandlerSuite struct {
+	mockImageHandleMixin
+}
+
+var _ = Suite(&ukiLoadHandlerSuite{})
+
+type testUKIMeasureImageStartParams struct {
+	image  *mockImage
+	alg    tpm2.HashAlgorithmId
+	pcrs   PcrFlags
+	params LoadParams
+
+	expectedEvents []*mockPcrBranchEvent
+}
+
+func (s *ukiLoadHandlerSuite) testMeasureImageStart(c *C, params *testUKIMeasureImageStartParams) {
+	ctx := newMockPcrBranchContext(&mockPcrProfileContext{alg: params.alg, pcrs: params.pcrs}, &params.params, nil)
+
+	handler, err := NewUKILoadHandler(params.image.newPeImageHandle())
+	c.Assert(err, IsNil)
+	c.Check(handler.MeasureImageStart(ctx), IsNil)
+	c.Check(ctx.events, DeepEquals, params.expectedEvents)
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStart(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image: newMockImage().
+			addSection(".linux", []byte("mock kernel")).
+			addSection(".osrel", []byte("ID=test\n")).
+			addSection(".initrd", []byte("mock initrd")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelBootPCR, KernelConfigPCR),
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+		expectedEvents: []*mockPcrBranchEvent{
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "0da293e37ad5511c59be47993769aacb91b243f7d010288e118dc90e95aaef5a")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "c3363bf9734cf30d42f49ed9d5d04a122990610c1ebac8271a8efffe55387e9c")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "3fb9e4e3cc810d4326b5c13cef18aee1f9df8c5f4f7f5b96665724fa3b846e08")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "0c3640f695fe2e0d11f11ab2bc4146ce908ef10cc6b0d2595c3865b54cae9426")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "15ee37e75f1e8d42080e91fdbbd2560780918c81fe3687ae6d15c472bbdaac75")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "7ccf4abcb13623e561bfa728501bc1e18c4d5efb3ecc88bea669dbfc6fa1e490")},
+			{pcr: 12, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "8fa45787227b4a6e99484fa92d49e7ef6f8677e876dadd088d1e3ca42efa020c")},
+		},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartWithCmdlineSection(c *C) {
+	// Verify that the supplied commandline isn't measured if the UKI
+	// has a .cmdline section.
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image: newMockImage().
+			addSection(".initrd", []byte("mock initrd")).
+			addSection(".cmdline", []byte("console=ttyS0")).
+			addSection(".linux", []byte("mock kernel")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelBootPCR, KernelConfigPCR),
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+		expectedEvents: []*mockPcrBranchEvent{
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "0da293e37ad5511c59be47993769aacb91b243f7d010288e118dc90e95aaef5a")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "c3363bf9734cf30d42f49ed9d5d04a122990610c1ebac8271a8efffe55387e9c")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "461203a89f23e36c3a4dc817f905b00484d2cf7e7d9376f13df91c41d84abe46")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "2b98586d9905a605c295d77c61e8cfd2027ae5b8a04eefa9018436f6ad114297")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "15ee37e75f1e8d42080e91fdbbd2560780918c81fe3687ae6d15c472bbdaac75")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "7ccf4abcb13623e561bfa728501bc1e18c4d5efb3ecc88bea669dbfc6fa1e490")},
+		},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartWithBootPhase(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image:  newMockImage().addSection(".linux", []byte("mock kernel")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelBootPCR),
+		params: LoadParams{KernelBootPhase: "enter-initrd:leave-initrd"},
+		expectedEvents: []*mockPcrBranchEvent{
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "0da293e37ad5511c59be47993769aacb91b243f7d010288e118dc90e95aaef5a")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "c3363bf9734cf30d42f49ed9d5d04a122990610c1ebac8271a8efffe55387e9c")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "51e6b92f405d1f98d96e3de343d61d420ad6923b25de21d766f9298192f14fed")},
+			{pcr: 11, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "3be261aff7db92bf507eae947f4003ffa2bcad0bffe3524601d62d0bc8be7135")},
+		},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartKernelConfigOnly(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image: newMockImage().
+			addSection(".linux", []byte("mock kernel")).
+			addSection(".osrel", []byte("ID=test\n")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelConfigPCR),
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+		expectedEvents: []*mockPcrBranchEvent{
+			{pcr: 12, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "8fa45787227b4a6e99484fa92d49e7ef6f8677e876dadd088d1e3ca42efa020c")},
+		},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartNoPCRs(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image:  newMockImage().addSection(".linux", []byte("mock kernel")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestNewUKILoadHandlerNotUKI(c *C) {
+	_, err := NewUKILoadHandler(newMockImage().newPeImageHandle())
+	c.Check(err, ErrorMatches, `image is not a UKI: no .linux section`)
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageLoad(c *C) {
+	handler, err := NewUKILoadHandler(newMockImage().addSection(".linux", nil).newPeImageHandle())
+	c.Assert(err, IsNil)
+	_, err = handler.MeasureImageLoad(nil, nil)
+	c.Check(err, ErrorMatches, `kernel is a leaf image`)
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartKernelData(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image: newMockImage().
+			addSection(".linux", []byte("mock kernel")).
+			addSection(".osrel", []byte("ID=test\n")).
+			addSection(".initrd", []byte("mock initrd")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelDataPCR),
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+		expectedEvents: []*mockPcrBranchEvent{
+			{pcr: 9, eventType: mockPcrBranchExtendEvent, digest: testutil.DecodeHexString(c, "7ccf4abcb13623e561bfa728501bc1e18c4d5efb3ecc88bea669dbfc6fa1e490")},
+		},
+	})
+}
+
+func (s *ukiLoadHandlerSuite) TestMeasureImageStartKernelDataNoInitrd(c *C) {
+	s.testMeasureImageStart(c, &testUKIMeasureImageStartParams{
+		image:  newMockImage().addSection(".linux", []byte("mock kernel")),
+		alg:    tpm2.HashAlgorithmSHA256,
+		pcrs:   MakePcrFlags(KernelDataPCR),
+		params: LoadParams{KernelCommandline: "console=tty1 panic=-1"},
+	})
+}
@@ -136,6 +136,12 @@ func withSbatPolicy(policy ShimSbatPolicy) mockVarsConfig {
 	}
 }
 
+func withTLSCACertificates(certs []byte) mockVarsConfig {
+	return func(c *C, vars efitest.MockVars) {
+		vars.AddVar("TlsCaCertificate", efi.MakeGUID(0xfd2340d0, 0x3dab, 0x4349, 0xa6c7, [...]uint8{0x3b, 0x4f, 0x12, 0xb4, 0x8e, 0xae}), efi.AttributeNonVolatile|efi.AttributeBootserviceAccess, certs)
+	}
+}
+
 func withSecureBootDisabled() mockVarsConfig {
 	return func(c *C, vars efitest.MockVars) {
 		vars.SetSecureBoot(false)
@@ -22,6 +22,7 @@ package secboot
 import (
 	"crypto"
 	"io"
+	"net"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -45,15 +46,23 @@ type (
 )
 
 func KDFOptionsKdfParams(o KDFOptions, keyLen uint32) (*KdfParams, error) {
-	return o.kdfParams(keyLen)
+	return o.kdfParams(argon2KDF(), keyLen)
 }
 
 func (o *Argon2Options) KdfParams(keyLen uint32) (*KdfParams, error) {
-	return o.kdfParams(keyLen)
+	return o.kdfParams(argon2KDF(), keyLen)
 }
 
 func (o *PBKDF2Options) KdfParams(keyLen uint32) (*KdfParams, error) {
-	return o.kdfParams(keyLen)
+	return o.kdfParams(nil, keyLen)
+}
+
+func MockKeyringAddFscryptKeyToFilesystem(fn func(string, []byte) ([]byte, error)) (restore func()) {
+	orig := keyringAddFscryptKeyToFilesystem
+	keyringAddFscryptKeyToFilesystem = fn
+	return func() {
+		keyringAddFscryptKeyToFilesystem = orig
+	}
 }
 
 func MockLUKS2Activate(fn func(string, string, []byte, int) error) (restore func()) {
@@ -104,6 +113,14 @@ func MockLUKS2KillSlot(fn func(string, int) error) (restore func()) {
 	}
 }
 
+func MockLUKS2TestKey(fn func(string, []byte, int) error) (restore func()) {
+	origTestKey := luks2TestKey
+	luks2TestKey = fn
+	return func() {
+		luks2TestKey = origTestKey
+	}
+}
+
 func MockLUKS2RemoveToken(fn func(string, int) error) (restore func()) {
 	origRemoveToken := luks2RemoveToken
 	luks2RemoveToken = fn
@@ -154,6 +171,14 @@ func MockStderr(w io.Writer) (restore func()) {
 	}
 }
 
+func MockRecoveryKeyRetrievalAttempts() (restore func()) {
+	orig := recoveryKeyRetrievalAttempts
+	recoveryKeyRetrievalAttempts = make(map[string]time.Time)
+	return func() {
+		recoveryKeyRetrievalAttempts = orig
+	}
+}
+
 func MockKeyDataGeneration(n int) (restore func()) {
 	orig := KeyDataGeneration
 	KeyDataGeneration = n
@@ -183,3 +208,89 @@ func MockUnixStat(f func(devicePath string, st *unix.Stat_t) error) (restore fun
 		unixStat = old
 	}
 }
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	orig := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = orig
+	}
+}
+
+func MockTimeAfterFunc(fn func(time.Duration, func()) *time.Timer) (restore func()) {
+	orig := timeAfterFunc
+	timeAfterFunc = fn
+	return func() {
+		timeAfterFunc = orig
+	}
+}
+
+// CachedPassphraseKeys returns the cached passphrase keys without taking them
+// from the cache.
+func (d *KeyData) CachedPassphraseKeys() (key, iv, auth []byte) {
+	if d.passphraseKeys == nil {
+		return nil, nil, nil
+	}
+	return d.passphraseKeys.key, d.passphraseKeys.iv, d.passphraseKeys.auth
+}
+
+func (k *ProtectedKeys) UnlockKey(alg crypto.Hash) (DiskUnlockKey, error) {
+	return k.unlockKey(alg)
+}
+
+func MockLUKS2WaitForDevice(fn func(string, time.Duration) error) (restore func()) {
+	origWaitForDevice := luks2WaitForDevice
+	luks2WaitForDevice = fn
+	return func() {
+		luks2WaitForDevice = origWaitForDevice
+	}
+}
+
+func MockLUKS2ActivateWithKeyFile(fn func(string, string, string, int) error) (restore func()) {
+	origActivateWithKeyFile := luks2ActivateWithKeyFile
+	luks2ActivateWithKeyFile = fn
+	return func() {
+		luks2ActivateWithKeyFile = origActivateWithKeyFile
+	}
+}
+
+func MockRoles() (restore func()) {
+	orig := roles
+	roles = make(map[string]string)
+	for k, v := range orig {
+		roles[k] = v
+	}
+	return func() {
+		roles = orig
+	}
+}
+
+func MockLUKS2ToolsAvailable(cryptsetup, systemdCryptsetup bool) (restore func()) {
+	origCryptsetupAvailable := luks2CryptsetupAvailable
+	origSystemdCryptsetupAvailable := luks2SystemdCryptsetupAvailable
+	luks2CryptsetupAvailable = func() bool { return cryptsetup }
+	luks2SystemdCryptsetupAvailable = func() bool { return systemdCryptsetup }
+	return func() {
+		luks2CryptsetupAvailable = origCryptsetupAvailable
+		luks2SystemdCryptsetupAvailable = origSystemdCryptsetupAvailable
+	}
+}
+
+func MockActivationHelperPeerCredentials(fn func(net.Conn) (*unix.Ucred, error)) (restore func()) {
+	orig := activationHelperPeerCredentials
+	activationHelperPeerCredentials = fn
+	return func() {
+		activationHelperPeerCredentials = orig
+	}
+}
+
+func MockActivationEnvironmentPaths(devMapperControl, procSelfUIDMap string) (restore func()) {
+	origDevMapperControlPath := devMapperControlPath
+	origProcSelfUIDMapPath := procSelfUIDMapPath
+	devMapperControlPath = devMapperControl
+	procSelfUIDMapPath = procSelfUIDMap
+	return func() {
+		devMapperControlPath = origDevMapperControlPath
+		procSelfUIDMapPath = origProcSelfUIDMapPath
+	}
+}
@@ -0,0 +1,365 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/testhooks"
+)
+
+// FactoryResetCheckpoint indicates how far a factory reset performed by
+// FactoryReset has progressed. Each value corresponds to the last step
+// that has been completed.
+type FactoryResetCheckpoint int
+
+const (
+	// FactoryResetNotStarted indicates that no steps have been completed.
+	FactoryResetNotStarted FactoryResetCheckpoint = iota
+
+	// FactoryResetOldKeysRenamed indicates that the existing unlock
+	// keyslots have been renamed out of the way.
+	FactoryResetOldKeysRenamed
+
+	// FactoryResetNewKeysEnrolled indicates that new unlock keys have
+	// been enrolled to every volume.
+	FactoryResetNewKeysEnrolled
+
+	// FactoryResetRecoveryKeyRotated indicates that the recovery key has
+	// been replaced on every volume.
+	FactoryResetRecoveryKeyRotated
+
+	// FactoryResetCountersReset indicates that the platform-specific
+	// reset step has completed.
+	FactoryResetCountersReset
+
+	// FactoryResetComplete indicates that the old keyslots have been
+	// removed and the factory reset is complete.
+	FactoryResetComplete
+)
+
+func (c FactoryResetCheckpoint) String() string {
+	switch c {
+	case FactoryResetNotStarted:
+		return "not-started"
+	case FactoryResetOldKeysRenamed:
+		return "old-keys-renamed"
+	case FactoryResetNewKeysEnrolled:
+		return "new-keys-enrolled"
+	case FactoryResetRecoveryKeyRotated:
+		return "recovery-key-rotated"
+	case FactoryResetCountersReset:
+		return "counters-reset"
+	case FactoryResetComplete:
+		return "complete"
+	default:
+		return fmt.Sprintf("FactoryResetCheckpoint(%d)", c)
+	}
+}
+
+// factoryResetOldSuffix is appended to the names of keyslots that are
+// renamed out of the way during a factory reset.
+const factoryResetOldSuffix = "-factory-reset"
+
+// FactoryResetVolume describes a single volume that is reset by FactoryReset.
+type FactoryResetVolume struct {
+	// DevicePath is the path of the LUKS2 container.
+	DevicePath string
+
+	// KeyslotName is the name of the unlock keyslot that is replaced. If
+	// empty, the name "default" will be used.
+	KeyslotName string
+
+	// RecoveryKeyslotName is the name of the recovery keyslot that is
+	// replaced. If empty, the name "default-recovery" will be used.
+	RecoveryKeyslotName string
+
+	// ExistingKey is the current unlock key for the container. It must
+	// remain valid until the factory reset is complete.
+	ExistingKey DiskUnlockKey
+}
+
+func (v *FactoryResetVolume) keyslotName() string {
+	if v.KeyslotName == "" {
+		return defaultKeyslotName
+	}
+	return v.KeyslotName
+}
+
+func (v *FactoryResetVolume) recoveryKeyslotName() string {
+	if v.RecoveryKeyslotName == "" {
+		return defaultRecoveryKeyslotName
+	}
+	return v.RecoveryKeyslotName
+}
+
+// FactoryResetParams contains the parameters for FactoryReset.
+type FactoryResetParams struct {
+	// PrimaryKey is the new primary key shared by all of the volumes.
+	PrimaryKey PrimaryKey
+
+	// Protector is used to protect a new unlock key for each volume.
+	Protector PrimaryKeyProtector
+
+	// RecoveryKey is the new recovery key, which replaces the existing
+	// one on every volume. It should be persisted or displayed by the
+	// caller before calling FactoryReset so that it isn't lost if the
+	// reset is interrupted.
+	RecoveryKey RecoveryKey
+
+	// Volumes are the volumes to reset.
+	Volumes []*FactoryResetVolume
+
+	// SaveVolume is an optional volume that is unlocked with a save key
+	// rather than with a key protected by Protector, such as a volume
+	// containing data that is retained across the factory reset, with
+	// a key that is stored on one of the other volumes. A new save key
+	// is generated and enrolled in place of the existing one in the
+	// keyslot named by KeyslotName, so that the old save key can no
+	// longer unlock it. Its recovery key is replaced in the same way as
+	// for the other volumes.
+	SaveVolume *FactoryResetVolume
+
+	// SaveKey is called with the new save key once it has been enrolled
+	// to SaveVolume, and must persist it. It is required if SaveVolume
+	// is supplied. If the factory reset is resumed from a checkpoint
+	// before FactoryResetNewKeysEnrolled, it is called again with a
+	// different key.
+	SaveKey func(DiskUnlockKey) error
+
+	// ResetCounters is an optional platform-specific callback that is
+	// executed once the new keys have been enrolled and before the old
+	// ones are removed, eg, to revoke the PCR policies of the old keys.
+	// It must be safe to call more than once.
+	ResetCounters func() error
+
+	// Resume is the last checkpoint reached by a previous, interrupted
+	// call to FactoryReset with the same volumes, or FactoryResetNotStarted
+	// for a new factory reset.
+	Resume FactoryResetCheckpoint
+
+	// Checkpoint is called each time a step completes. The caller should
+	// persist the supplied checkpoint so that an interrupted factory reset
+	// can be resumed by supplying it as Resume. If it returns an error, the
+	// factory reset stops.
+	Checkpoint func(FactoryResetCheckpoint) error
+}
+
+// allVolumes returns all of the volumes that are reset, including the save
+// volume.
+func (p *FactoryResetParams) allVolumes() []*FactoryResetVolume {
+	if p.SaveVolume == nil {
+		return p.Volumes
+	}
+	return append(append([]*FactoryResetVolume(nil), p.Volumes...), p.SaveVolume)
+}
+
+func keyslotExists(devicePath, name string) (bool, error) {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return false, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+	_, _, exists := view.TokenByName(name)
+	return exists, nil
+}
+
+// renameKeyslotForFactoryReset renames the named keyslot out of the way, if it
+// hasn't been already.
+func renameKeyslotForFactoryReset(devicePath, name string) error {
+	renamed, err := keyslotExists(devicePath, name+factoryResetOldSuffix)
+	if err != nil {
+		return err
+	}
+	if renamed {
+		return nil
+	}
+	exists, err := keyslotExists(devicePath, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	return RenameLUKS2ContainerKey(devicePath, name, name+factoryResetOldSuffix)
+}
+
+// removeKeyslotIfExists removes the named keyslot if it exists.
+func removeKeyslotIfExists(devicePath, name string) error {
+	exists, err := keyslotExists(devicePath, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	return DeleteLUKS2ContainerKey(devicePath, name)
+}
+
+func factoryResetRenameOldKeys(params *FactoryResetParams) error {
+	for _, v := range params.allVolumes() {
+		if err := renameKeyslotForFactoryReset(v.DevicePath, v.keyslotName()); err != nil {
+			return xerrors.Errorf("cannot rename unlock key on %s: %w", v.DevicePath, err)
+		}
+	}
+	return nil
+}
+
+func factoryResetEnrollNewKeys(params *FactoryResetParams) error {
+	var enrollments []*LUKS2Enrollment
+	for _, v := range params.Volumes {
+		// Remove a key left by a previous interrupted attempt. The old
+		// key has already been renamed at this point.
+		if err := removeKeyslotIfExists(v.DevicePath, v.keyslotName()); err != nil {
+			return xerrors.Errorf("cannot remove incomplete unlock key on %s: %w", v.DevicePath, err)
+		}
+		enrollments = append(enrollments, &LUKS2Enrollment{
+			DevicePath:  v.DevicePath,
+			KeyslotName: v.keyslotName(),
+			ExistingKey: v.ExistingKey})
+	}
+
+	if _, err := EnrollLUKS2ContainersWithPrimaryKey(params.PrimaryKey, params.Protector, enrollments...); err != nil {
+		return err
+	}
+
+	if params.SaveVolume == nil {
+		return nil
+	}
+	return factoryResetEnrollNewSaveKey(params)
+}
+
+func factoryResetEnrollNewSaveKey(params *FactoryResetParams) error {
+	v := params.SaveVolume
+	if err := removeKeyslotIfExists(v.DevicePath, v.keyslotName()); err != nil {
+		return xerrors.Errorf("cannot remove incomplete save key on %s: %w", v.DevicePath, err)
+	}
+
+	saveKey := make(DiskUnlockKey, 32)
+	if _, err := io.ReadFull(testhooks.RandReader, saveKey); err != nil {
+		return xerrors.Errorf("cannot obtain new save key: %w", err)
+	}
+	if err := AddLUKS2ContainerUnlockKey(v.DevicePath, v.keyslotName(), v.ExistingKey, saveKey); err != nil {
+		return xerrors.Errorf("cannot add save key to %s: %w", v.DevicePath, err)
+	}
+	if err := params.SaveKey(saveKey); err != nil {
+		return xerrors.Errorf("cannot save new save key: %w", err)
+	}
+	return nil
+}
+
+func factoryResetRotateRecoveryKey(params *FactoryResetParams) error {
+	for _, v := range params.allVolumes() {
+		name := v.recoveryKeyslotName()
+		if err := renameKeyslotForFactoryReset(v.DevicePath, name); err != nil {
+			return xerrors.Errorf("cannot rename recovery key on %s: %w", v.DevicePath, err)
+		}
+		if err := removeKeyslotIfExists(v.DevicePath, name); err != nil {
+			return xerrors.Errorf("cannot remove incomplete recovery key on %s: %w", v.DevicePath, err)
+		}
+		if err := AddLUKS2ContainerRecoveryKey(v.DevicePath, name, v.ExistingKey, params.RecoveryKey); err != nil {
+			return xerrors.Errorf("cannot add recovery key to %s: %w", v.DevicePath, err)
+		}
+	}
+	return nil
+}
+
+func factoryResetRemoveOldKeys(params *FactoryResetParams) error {
+	for _, v := range params.allVolumes() {
+		for _, name := range []string{v.keyslotName(), v.recoveryKeyslotName()} {
+			if err := removeKeyslotIfExists(v.DevicePath, name+factoryResetOldSuffix); err != nil {
+				return xerrors.Errorf("cannot remove old key on %s: %w", v.DevicePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// FactoryReset replaces the keys for a set of volumes that share a primary
+// key, which is required when resetting a device to factory settings whilst
+// retaining the contents of some volumes. It performs the following steps in
+// order, each of which corresponds to a FactoryResetCheckpoint:
+//   - The existing unlock keyslots are renamed out of the way.
+//   - A new unlock key is derived and protected for each volume using the
+//     supplied primary key and protector, and enrolled with its KeyData (see
+//     EnrollLUKS2ContainersWithPrimaryKey). If there is a save volume, a new
+//     save key is generated and enrolled to it, and passed to SaveKey.
+//   - The recovery key on each volume is replaced with the supplied one.
+//   - The optional ResetCounters callback is executed.
+//   - The old unlock and recovery keyslots are removed.
+//
+// The existing keys are retained until the final step, so the volumes can
+// be unlocked with either the old or the new keys until the factory reset is
+// complete. Each step can be safely repeated, and the Checkpoint callback is
+// called as each one completes. If the factory reset is interrupted, it can
+// be resumed by calling this function again with the same parameters and
+// the last checkpoint supplied as Resume. Note that if the new unlock keys
+// are enrolled again when resuming, new KeyData is created for them.
+func FactoryReset(params *FactoryResetParams) error {
+	if params.Protector == nil {
+		return errors.New("no protector supplied")
+	}
+	if len(params.Volumes) == 0 {
+		return errors.New("no volumes supplied")
+	}
+	if params.SaveVolume != nil && params.SaveKey == nil {
+		return errors.New("no SaveKey callback supplied for the save volume")
+	}
+	if params.Resume < FactoryResetNotStarted || params.Resume > FactoryResetComplete {
+		return fmt.Errorf("invalid checkpoint %v", params.Resume)
+	}
+
+	for _, step := range []struct {
+		checkpoint FactoryResetCheckpoint
+		fn         func(*FactoryResetParams) error
+	}{
+		{checkpoint: FactoryResetOldKeysRenamed, fn: factoryResetRenameOldKeys},
+		{checkpoint: FactoryResetNewKeysEnrolled, fn: factoryResetEnrollNewKeys},
+		{checkpoint: FactoryResetRecoveryKeyRotated, fn: factoryResetRotateRecoveryKey},
+		{checkpoint: FactoryResetCountersReset, fn: func(params *FactoryResetParams) error {
+			if params.ResetCounters == nil {
+				return nil
+			}
+			if err := params.ResetCounters(); err != nil {
+				return xerrors.Errorf("cannot reset counters: %w", err)
+			}
+			return nil
+		}},
+		{checkpoint: FactoryResetComplete, fn: factoryResetRemoveOldKeys},
+	} {
+		if step.checkpoint <= params.Resume {
+			continue
+		}
+		if err := step.fn(params); err != nil {
+			return err
+		}
+		if params.Checkpoint != nil {
+			if err := params.Checkpoint(step.checkpoint); err != nil {
+				return xerrors.Errorf("cannot save checkpoint %v: %w", step.checkpoint, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"sort"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+func (s *cryptSuite) addMockContainerForFactoryReset(c *C, path string) DiskUnlockKey {
+	key := s.addMockContainerWithDefaultKey(c, path)
+	var recoveryKey RecoveryKey
+	copy(recoveryKey[:], s.newPrimaryKey(c, 16))
+	slot := s.addMockKeyslot(path, recoveryKey[:])
+	s.addMockToken(path, &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default-recovery"}})
+	return key
+}
+
+func (s *cryptSuite) mockTokenNames(path string) (names []string) {
+	for _, token := range s.luks2.devices[path].tokens {
+		names = append(names, token.(luksview.NamedToken).Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *cryptSuite) newFactoryResetParams(c *C, paths ...string) *FactoryResetParams {
+	params := &FactoryResetParams{
+		PrimaryKey: s.newPrimaryKey(c, 32),
+		Protector:  s.mockPrimaryKeyProtector(c),
+	}
+	copy(params.RecoveryKey[:], s.newPrimaryKey(c, 16))
+	for _, path := range paths {
+		params.Volumes = append(params.Volumes, &FactoryResetVolume{
+			DevicePath:  path,
+			ExistingKey: s.addMockContainerForFactoryReset(c, path)})
+	}
+	return params
+}
+
+func (s *cryptSuite) checkFactoryResetComplete(c *C, params *FactoryResetParams) {
+	for _, v := range params.Volumes {
+		c.Check(s.mockTokenNames(v.DevicePath), DeepEquals, []string{"default", "default-recovery"})
+
+		r, err := NewLUKS2KeyDataReader(v.DevicePath, "default")
+		c.Assert(err, IsNil)
+		kd, err := ReadKeyData(r)
+		c.Assert(err, IsNil)
+		unlockKey, primaryKey, err := kd.RecoverKeys()
+		c.Check(err, IsNil)
+		c.Check(primaryKey, DeepEquals, params.PrimaryKey)
+
+		dev := s.luks2.devices[v.DevicePath]
+		c.Check([]byte(unlockKey), DeepEquals, dev.keyslots[r.KeyslotID()])
+		c.Check([]byte(unlockKey), Not(DeepEquals), []byte(v.ExistingKey))
+
+		_, id, exists := mockTokenByName(c, dev, "default-recovery")
+		c.Assert(exists, Equals, true)
+		c.Check(dev.keyslots[dev.tokens[id].Keyslots()[0]], DeepEquals, params.RecoveryKey[:])
+	}
+}
+
+func mockTokenByName(c *C, dev *mockLUKS2Container, name string) (luksview.NamedToken, int, bool) {
+	view, err := dev.newLUKSView()
+	c.Assert(err, IsNil)
+	return view.TokenByName(name)
+}
+
+func (s *cryptSuite) TestFactoryReset(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1", "/dev/sda2")
+
+	var resetCounters int
+	params.ResetCounters = func() error {
+		resetCounters++
+		// The new keys should be in place, and the old ones should
+		// not have been removed yet.
+		c.Check(s.mockTokenNames("/dev/sda1"), DeepEquals, []string{"default", "default-factory-reset", "default-recovery", "default-recovery-factory-reset"})
+		return nil
+	}
+	var checkpoints []FactoryResetCheckpoint
+	params.Checkpoint = func(checkpoint FactoryResetCheckpoint) error {
+		checkpoints = append(checkpoints, checkpoint)
+		return nil
+	}
+
+	c.Check(FactoryReset(params), IsNil)
+	c.Check(resetCounters, Equals, 1)
+	c.Check(checkpoints, DeepEquals, []FactoryResetCheckpoint{
+		FactoryResetOldKeysRenamed,
+		FactoryResetNewKeysEnrolled,
+		FactoryResetRecoveryKeyRotated,
+		FactoryResetCountersReset,
+		FactoryResetComplete,
+	})
+	s.checkFactoryResetComplete(c, params)
+}
+
+func (s *cryptSuite) testFactoryResetResume(c *C, interruptAfter FactoryResetCheckpoint) {
+	params := s.newFactoryResetParams(c, "/dev/sda1", "/dev/sda2")
+	params.Checkpoint = func(checkpoint FactoryResetCheckpoint) error {
+		if checkpoint == interruptAfter {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+	c.Check(FactoryReset(params), ErrorMatches, `cannot save checkpoint `+interruptAfter.String()+`: interrupted`)
+
+	var checkpoints []FactoryResetCheckpoint
+	params.Resume = interruptAfter - 1
+	params.Checkpoint = func(checkpoint FactoryResetCheckpoint) error {
+		checkpoints = append(checkpoints, checkpoint)
+		return nil
+	}
+	c.Check(FactoryReset(params), IsNil)
+	c.Check(checkpoints[0], Equals, interruptAfter)
+	c.Check(checkpoints[len(checkpoints)-1], Equals, FactoryResetComplete)
+	s.checkFactoryResetComplete(c, params)
+}
+
+func (s *cryptSuite) TestFactoryResetResumeRename(c *C) {
+	s.testFactoryResetResume(c, FactoryResetOldKeysRenamed)
+}
+
+func (s *cryptSuite) TestFactoryResetResumeEnroll(c *C) {
+	s.testFactoryResetResume(c, FactoryResetNewKeysEnrolled)
+}
+
+func (s *cryptSuite) TestFactoryResetResumeRecoveryKey(c *C) {
+	s.testFactoryResetResume(c, FactoryResetRecoveryKeyRotated)
+}
+
+func (s *cryptSuite) TestFactoryResetResumeRemove(c *C) {
+	s.testFactoryResetResume(c, FactoryResetComplete)
+}
+
+func (s *cryptSuite) TestFactoryResetResetCountersError(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1")
+	params.ResetCounters = func() error {
+		return errors.New("some error")
+	}
+	c.Check(FactoryReset(params), ErrorMatches, `cannot reset counters: some error`)
+
+	// The old keys should be retained.
+	c.Check(s.mockTokenNames("/dev/sda1"), DeepEquals, []string{"default", "default-factory-reset", "default-recovery", "default-recovery-factory-reset"})
+}
+
+func (s *cryptSuite) TestFactoryResetInvalidExistingKey(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1")
+	params.Volumes[0].ExistingKey = DiskUnlockKey(s.newPrimaryKey(c, 32))
+	c.Check(FactoryReset(params), ErrorMatches, `cannot enroll /dev/sda1: cannot add key: invalid key`)
+}
+
+func (s *cryptSuite) TestFactoryResetSaveVolume(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1")
+	params.SaveVolume = &FactoryResetVolume{
+		DevicePath:  "/dev/sda2",
+		ExistingKey: s.addMockContainerForFactoryReset(c, "/dev/sda2")}
+
+	var saveKeys []DiskUnlockKey
+	params.SaveKey = func(key DiskUnlockKey) error {
+		saveKeys = append(saveKeys, key)
+		return nil
+	}
+
+	c.Check(FactoryReset(params), IsNil)
+	s.checkFactoryResetComplete(c, params)
+
+	c.Assert(saveKeys, HasLen, 1)
+	c.Check(saveKeys[0], HasLen, 32)
+	c.Check(saveKeys[0], Not(DeepEquals), params.SaveVolume.ExistingKey)
+
+	// The old save key should have been replaced by the new one.
+	dev := s.luks2.devices["/dev/sda2"]
+	c.Check(s.mockTokenNames("/dev/sda2"), DeepEquals, []string{"default", "default-recovery"})
+	_, id, exists := mockTokenByName(c, dev, "default")
+	c.Assert(exists, Equals, true)
+	c.Check(dev.keyslots[dev.tokens[id].Keyslots()[0]], DeepEquals, []byte(saveKeys[0]))
+	for _, key := range dev.keyslots {
+		c.Check(key, Not(DeepEquals), []byte(params.SaveVolume.ExistingKey))
+	}
+
+	_, id, exists = mockTokenByName(c, dev, "default-recovery")
+	c.Assert(exists, Equals, true)
+	c.Check(dev.keyslots[dev.tokens[id].Keyslots()[0]], DeepEquals, params.RecoveryKey[:])
+}
+
+func (s *cryptSuite) TestFactoryResetSaveVolumeResumeEnroll(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1")
+	params.SaveVolume = &FactoryResetVolume{
+		DevicePath:  "/dev/sda2",
+		ExistingKey: s.addMockContainerForFactoryReset(c, "/dev/sda2")}
+	params.SaveKey = func(key DiskUnlockKey) error {
+		return errors.New("some error")
+	}
+	c.Check(FactoryReset(params), ErrorMatches, `cannot save new save key: some error`)
+
+	var saveKey DiskUnlockKey
+	params.Resume = FactoryResetOldKeysRenamed
+	params.SaveKey = func(key DiskUnlockKey) error {
+		saveKey = key
+		return nil
+	}
+	c.Check(FactoryReset(params), IsNil)
+
+	dev := s.luks2.devices["/dev/sda2"]
+	c.Check(s.mockTokenNames("/dev/sda2"), DeepEquals, []string{"default", "default-recovery"})
+	_, id, exists := mockTokenByName(c, dev, "default")
+	c.Assert(exists, Equals, true)
+	c.Check(dev.keyslots[dev.tokens[id].Keyslots()[0]], DeepEquals, []byte(saveKey))
+	c.Check(dev.keyslots, HasLen, 2)
+}
+
+func (s *cryptSuite) TestFactoryResetSaveVolumeNoSaveKey(c *C) {
+	params := s.newFactoryResetParams(c, "/dev/sda1")
+	params.SaveVolume = &FactoryResetVolume{DevicePath: "/dev/sda2"}
+	c.Check(FactoryReset(params), ErrorMatches, `no SaveKey callback supplied for the save volume`)
+}
+
+func (s *cryptSuite) TestFactoryResetNoVolumes(c *C) {
+	c.Check(FactoryReset(&FactoryResetParams{Protector: s.mockPrimaryKeyProtector(c)}), ErrorMatches, `no volumes supplied`)
+}
@@ -0,0 +1,196 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"sort"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+var (
+	luks2CryptsetupAvailable        = luks2.CryptsetupAvailable
+	luks2SystemdCryptsetupAvailable = luks2.SystemdCryptsetupAvailable
+)
+
+// Names of optional activation features reported by Features.
+const (
+	// ActivationFeatureKeyringPrefix indicates support for
+	// ActivateVolumeOptions.KeyringPrefix.
+	ActivationFeatureKeyringPrefix = "keyring-prefix"
+
+	// ActivationFeatureLegacyDevicePaths indicates support for
+	// ActivateVolumeOptions.LegacyDevicePaths.
+	ActivationFeatureLegacyDevicePaths = "legacy-device-paths"
+
+	// ActivationFeaturePassphrase indicates support for passphrase
+	// protected keys and ActivateVolumeOptions.PassphraseTries.
+	ActivationFeaturePassphrase = "passphrase"
+
+	// ActivationFeatureRecoveryKey indicates support for activation
+	// with a recovery key and ActivateVolumeOptions.RecoveryKeyTries.
+	ActivationFeatureRecoveryKey = "recovery-key"
+
+	// ActivationFeatureDeadline indicates support for
+	// ActivateVolumeOptions.Deadline.
+	ActivationFeatureDeadline = "deadline"
+
+	// ActivationFeatureProgressReporter indicates support for
+	// ActivateVolumeOptions.ProgressReporter.
+	ActivationFeatureProgressReporter = "progress-reporter"
+
+	// ActivationFeatureRecoveryKeyGrace indicates support for enforcing
+	// grace limits on recovery keyslots (see
+	// SetLUKS2ContainerRecoveryKeyGrace).
+	ActivationFeatureRecoveryKeyGrace = "recovery-key-grace"
+
+	// ActivationFeatureUserKeys indicates support for per-user
+	// passphrase keyslots (see AddLUKS2ContainerUserKey).
+	ActivationFeatureUserKeys = "user-keys"
+
+	// ActivationFeatureActivationHelper indicates support for delegating
+	// activation to a privileged helper (see NewActivationHelperExecutor).
+	ActivationFeatureActivationHelper = "activation-helper"
+
+	// ActivationFeatureKeyringTarget indicates support for
+	// ActivateVolumeOptions.KeyringTarget, KeyringInstance and
+	// KeyringUseDeviceUUID.
+	ActivationFeatureKeyringTarget = "keyring-target"
+)
+
+// FeatureSet describes the capabilities of this package, as returned
+// from Features.
+type FeatureSet struct {
+	// Platforms contains the names of the platforms for which a
+	// handler has been registered, in lexical order. Platform
+	// packages register their handler when they are imported.
+	Platforms []string
+
+	// KeyDataGenerations contains the KeyData generations that can
+	// be read by this package, in ascending order. New keys are always
+	// created with the highest generation (see KeyDataGeneration).
+	KeyDataGenerations []int
+
+	// ArtifactFormatVersion is the version of the serialization formats
+	// that can be read by this package (see ArtifactHeader).
+	ArtifactFormatVersion int
+
+	// KDFs contains the names of the KDFs that are supported for
+	// passphrase protected keys.
+	KDFs []string
+
+	// ActivationFeatures contains the names of the optional activation
+	// features that are supported (see the ActivationFeature* constants).
+	ActivationFeatures []string
+
+	// CgoEnabled indicates whether this package was built with cgo. No
+	// functionality depends on cgo, so this is informational - static
+	// builds with CGO_ENABLED=0 are fully functional.
+	CgoEnabled bool
+
+	// Cryptsetup indicates whether the system's cryptsetup binary is
+	// available. Without it, creating and modifying LUKS2 containers
+	// fails with ErrMissingCryptsetup.
+	Cryptsetup bool
+
+	// SystemdCryptsetup indicates whether the systemd-cryptsetup binary is
+	// available. Without it, activating and deactivating LUKS2 containers
+	// fails with ErrMissingSystemdCryptsetup.
+	SystemdCryptsetup bool
+}
+
+// HasPlatform indicates whether a handler for the named platform is
+// registered.
+func (s *FeatureSet) HasPlatform(name string) bool {
+	return containsString(s.Platforms, name)
+}
+
+// HasKeyDataGeneration indicates whether KeyData with the specified
+// generation can be read.
+func (s *FeatureSet) HasKeyDataGeneration(generation int) bool {
+	for _, g := range s.KeyDataGenerations {
+		if g == generation {
+			return true
+		}
+	}
+	return false
+}
+
+// HasKDF indicates whether the named KDF is supported.
+func (s *FeatureSet) HasKDF(name string) bool {
+	return containsString(s.KDFs, name)
+}
+
+// HasActivationFeature indicates whether the named activation feature
+// is supported.
+func (s *FeatureSet) HasActivationFeature(name string) bool {
+	return containsString(s.ActivationFeatures, name)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Features returns a description of the capabilities of this package, so
+// that consumers can adapt their behaviour without relying on version numbers.
+// The returned value is a snapshot, and won't include platforms that are
+// registered after this is called.
+func Features() *FeatureSet {
+	var platforms []string
+	for name, handler := range handlers {
+		if handler == nil {
+			continue
+		}
+		platforms = append(platforms, name)
+	}
+	sort.Strings(platforms)
+
+	var generations []int
+	for g := 1; g <= KeyDataGeneration; g++ {
+		generations = append(generations, g)
+	}
+
+	return &FeatureSet{
+		Platforms:             platforms,
+		KeyDataGenerations:    generations,
+		ArtifactFormatVersion: ArtifactFormatVersion,
+		KDFs:                  []string{string(Argon2i), string(Argon2id), pbkdf2Type},
+		ActivationFeatures: []string{
+			ActivationFeatureKeyringPrefix,
+			ActivationFeatureLegacyDevicePaths,
+			ActivationFeaturePassphrase,
+			ActivationFeatureRecoveryKey,
+			ActivationFeatureDeadline,
+			ActivationFeatureProgressReporter,
+			ActivationFeatureRecoveryKeyGrace,
+			ActivationFeatureUserKeys,
+			ActivationFeatureActivationHelper,
+			ActivationFeatureKeyringTarget,
+		},
+		CgoEnabled:        cgoEnabled,
+		Cryptsetup:        luks2CryptsetupAvailable(),
+		SystemdCryptsetup: luks2SystemdCryptsetupAvailable(),
+	}
+}
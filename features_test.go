@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type featuresSuite struct{}
+
+var _ = Suite(&featuresSuite{})
+
+func (s *featuresSuite) TestFeatures(c *C) {
+	RegisterPlatformKeyDataHandler("features-test-b", &mockPlatformKeyDataHandler{})
+	defer RegisterPlatformKeyDataHandler("features-test-b", nil)
+	RegisterPlatformKeyDataHandler("features-test-a", &mockPlatformKeyDataHandler{})
+	defer RegisterPlatformKeyDataHandler("features-test-a", nil)
+
+	features := Features()
+
+	var platforms []string
+	for _, p := range features.Platforms {
+		if p == "features-test-a" || p == "features-test-b" {
+			platforms = append(platforms, p)
+		}
+	}
+	c.Check(platforms, DeepEquals, []string{"features-test-a", "features-test-b"})
+	c.Check(features.HasPlatform("features-test-a"), Equals, true)
+
+	c.Check(features.KeyDataGenerations, DeepEquals, []int{1, 2})
+	c.Check(features.HasKeyDataGeneration(KeyDataGeneration), Equals, true)
+	c.Check(features.ArtifactFormatVersion, Equals, ArtifactFormatVersion)
+	c.Check(features.HasKeyDataGeneration(KeyDataGeneration+1), Equals, false)
+
+	c.Check(features.KDFs, DeepEquals, []string{"argon2i", "argon2id", "pbkdf2"})
+	c.Check(features.HasKDF("argon2id"), Equals, true)
+	c.Check(features.HasKDF("scrypt"), Equals, false)
+
+	c.Check(features.HasActivationFeature(ActivationFeatureDeadline), Equals, true)
+	c.Check(features.HasActivationFeature(ActivationFeatureProgressReporter), Equals, true)
+	c.Check(features.HasActivationFeature(ActivationFeatureRecoveryKeyGrace), Equals, true)
+	c.Check(features.HasActivationFeature(ActivationFeatureUserKeys), Equals, true)
+	c.Check(features.HasActivationFeature(ActivationFeatureActivationHelper), Equals, true)
+	c.Check(features.HasActivationFeature(ActivationFeatureKeyringTarget), Equals, true)
+	c.Check(features.HasActivationFeature("foo"), Equals, false)
+}
+
+func (s *featuresSuite) TestFeaturesUnregisteredPlatform(c *C) {
+	RegisterPlatformKeyDataHandler("features-test", &mockPlatformKeyDataHandler{})
+	RegisterPlatformKeyDataHandler("features-test", nil)
+
+	c.Check(Features().HasPlatform("features-test"), Equals, false)
+}
+
+func (s *featuresSuite) TestFeaturesLUKS2Tools(c *C) {
+	restore := MockLUKS2ToolsAvailable(true, false)
+	defer restore()
+
+	features := Features()
+	c.Check(features.Cryptsetup, Equals, true)
+	c.Check(features.SystemdCryptsetup, Equals, false)
+
+	restore = MockLUKS2ToolsAvailable(false, true)
+	defer restore()
+
+	features = Features()
+	c.Check(features.Cryptsetup, Equals, false)
+	c.Check(features.SystemdCryptsetup, Equals, true)
+}
@@ -0,0 +1,451 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/snapcore/secboot/internal/cbor"
+	internal_crypto "github.com/snapcore/secboot/internal/crypto"
+)
+
+const (
+	ctap2CmdMakeCredential = 0x01
+	ctap2CmdGetAssertion   = 0x02
+	ctap2CmdClientPIN      = 0x06
+
+	ctap2PINProtocol = 1
+
+	ctap2PINSubCmdGetKeyAgreement = 0x02
+	ctap2PINSubCmdGetPINToken     = 0x05
+
+	ctap2StatusOK = 0x00
+
+	ctap2ErrOperationDenied   = 0x27
+	ctap2ErrNoCredentials     = 0x2e
+	ctap2ErrUserActionTimeout = 0x2f
+	ctap2ErrPINInvalid        = 0x31
+	ctap2ErrPINBlocked        = 0x32
+	ctap2ErrPINAuthBlocked    = 0x34
+	ctap2ErrPINRequired       = 0x36
+
+	coseKeyType    = 1
+	coseKeyAlg     = 3
+	coseKeyCurve   = -1
+	coseKeyX       = -2
+	coseKeyY       = -3
+	coseKeyTypeEC2 = 2
+	coseAlgES256   = -7
+	coseAlgECDHES  = -25
+	coseCurveP256  = 1
+
+	authDataMinSize = 37
+	authDataFlagUP  = 0x01
+	authDataFlagAT  = 0x40
+	authDataFlagED  = 0x80
+	aaguidSize      = 16
+
+	coordinateSize = 32
+	pinAuthSize    = 16
+	clientDataSize = 32
+	hmacSecretSize = 32
+	userIDSize     = 32
+
+	hmacSecretExtKey = "hmac-secret"
+)
+
+// ctapStatus is a CTAP2 status code returned from a device.
+type ctapStatus uint8
+
+func (s ctapStatus) Error() string {
+	switch s {
+	case ctap2ErrOperationDenied:
+		return "the operation was denied"
+	case ctap2ErrNoCredentials:
+		return "no valid credentials were provided"
+	case ctap2ErrUserActionTimeout:
+		return "timed out waiting for user interaction"
+	case ctap2ErrPINInvalid:
+		return "the PIN is invalid"
+	case ctap2ErrPINBlocked:
+		return "the PIN is blocked"
+	case ctap2ErrPINAuthBlocked:
+		return "PIN authentication is blocked until the device is reinserted"
+	case ctap2ErrPINRequired:
+		return "a PIN is required"
+	default:
+		return fmt.Sprintf("CTAP2 error 0x%02x", uint8(s))
+	}
+}
+
+// cborTransport is implemented by a transport that can send CTAP2 CBOR
+// messages to a device.
+type cborTransport interface {
+	cbor(data []byte) ([]byte, error)
+}
+
+// authenticator implements the parts of CTAP2 required by this package.
+type authenticator struct {
+	transport cborTransport
+	rand      io.Reader
+}
+
+func (a *authenticator) call(cmd uint8, params map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	req := []byte{cmd}
+	if params != nil {
+		data, err := cbor.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode request: %w", err)
+		}
+		req = append(req, data...)
+	}
+
+	rsp, err := a.transport.cbor(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) < 1 {
+		return nil, errors.New("empty response")
+	}
+	if rsp[0] != ctap2StatusOK {
+		return nil, ctapStatus(rsp[0])
+	}
+	if len(rsp) == 1 {
+		return make(map[interface{}]interface{}), nil
+	}
+
+	v, err := cbor.Unmarshal(rsp[1:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid response type")
+	}
+	return m, nil
+}
+
+func getBytes(m map[interface{}]interface{}, key interface{}) ([]byte, error) {
+	v, ok := m[key].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("missing or invalid %v field", key)
+	}
+	return v, nil
+}
+
+func aesCBC(key, data []byte, encrypt bool) ([]byte, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid data size")
+	}
+	iv := make([]byte, aes.BlockSize)
+	out := make([]byte, len(data))
+	if encrypt {
+		cipher.NewCBCEncrypter(b, iv).CryptBlocks(out, data)
+	} else {
+		cipher.NewCBCDecrypter(b, iv).CryptBlocks(out, data)
+	}
+	return out, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// sharedSecret performs key agreement with the device as described in section
+// 5.5.4 of the CTAP2 specification for PIN/UV auth protocol 1, returning the
+// platform's public key in COSE format and the shared secret.
+func (a *authenticator) sharedSecret() (platformKey map[interface{}]interface{}, secret []byte, err error) {
+	rsp, err := a.call(ctap2CmdClientPIN, map[interface{}]interface{}{
+		1: ctap2PINProtocol,
+		2: ctap2PINSubCmdGetKeyAgreement})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot obtain key agreement key: %w", err)
+	}
+	deviceKey, ok := rsp[uint64(1)].(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("invalid key agreement key")
+	}
+	x, err := getBytes(deviceKey, int64(coseKeyX))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key agreement key: %w", err)
+	}
+	y, err := getBytes(deviceKey, int64(coseKeyY))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key agreement key: %w", err)
+	}
+
+	curve := elliptic.P256()
+	deviceX := new(big.Int).SetBytes(x)
+	deviceY := new(big.Int).SetBytes(y)
+	if !curve.IsOnCurve(deviceX, deviceY) {
+		return nil, nil, errors.New("invalid key agreement key: point is not on the curve")
+	}
+
+	key, err := internal_crypto.GenerateECDSAKey(curve, a.rand)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate key agreement key: %w", err)
+	}
+
+	z, _ := curve.ScalarMult(deviceX, deviceY, key.D.Bytes())
+	h := sha256.Sum256(z.FillBytes(make([]byte, coordinateSize)))
+
+	platformKey = map[interface{}]interface{}{
+		coseKeyType:  coseKeyTypeEC2,
+		coseKeyAlg:   coseAlgECDHES,
+		coseKeyCurve: coseCurveP256,
+		coseKeyX:     key.X.FillBytes(make([]byte, coordinateSize)),
+		coseKeyY:     key.Y.FillBytes(make([]byte, coordinateSize))}
+	return platformKey, h[:], nil
+}
+
+// getPINToken obtains a PIN token from the device using the supplied PIN.
+func (a *authenticator) getPINToken(pin string) ([]byte, error) {
+	platformKey, secret, err := a.sharedSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	pinHash := sha256.Sum256([]byte(pin))
+	pinHashEnc, err := aesCBC(secret, pinHash[:16], true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt PIN hash: %w", err)
+	}
+
+	rsp, err := a.call(ctap2CmdClientPIN, map[interface{}]interface{}{
+		1: ctap2PINProtocol,
+		2: ctap2PINSubCmdGetPINToken,
+		3: platformKey,
+		6: pinHashEnc})
+	if err != nil {
+		return nil, err
+	}
+	tokenEnc, err := getBytes(rsp, uint64(2))
+	if err != nil {
+		return nil, err
+	}
+	return aesCBC(secret, tokenEnc, false)
+}
+
+func (a *authenticator) clientDataHash() ([]byte, error) {
+	clientData := make([]byte, clientDataSize)
+	if _, err := io.ReadFull(a.rand, clientData); err != nil {
+		return nil, fmt.Errorf("cannot obtain client data: %w", err)
+	}
+	h := sha256.Sum256(clientData)
+	return h[:], nil
+}
+
+// parseAuthData parses the supplied authenticator data, returning the
+// credential ID from the attested credential data if there is any, and the
+// extension outputs if there are any.
+func parseAuthData(rpID string, authData []byte) (credentialID []byte, extensions map[interface{}]interface{}, err error) {
+	if len(authData) < authDataMinSize {
+		return nil, nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return nil, nil, errors.New("unexpected relying party ID hash")
+	}
+	flags := authData[32]
+	authData = authData[authDataMinSize:]
+
+	if flags&authDataFlagAT != 0 {
+		if len(authData) < aaguidSize+2 {
+			return nil, nil, errors.New("attested credential data too short")
+		}
+		n := int(binary.BigEndian.Uint16(authData[aaguidSize:]))
+		authData = authData[aaguidSize+2:]
+		if len(authData) < n {
+			return nil, nil, errors.New("attested credential data too short")
+		}
+		credentialID = authData[:n]
+		authData = authData[n:]
+
+		// Skip the credential public key.
+		_, authData, err = cbor.UnmarshalPrefix(authData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decode credential public key: %w", err)
+		}
+	}
+
+	if flags&authDataFlagED != 0 {
+		v, err := cbor.Unmarshal(authData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decode extensions: %w", err)
+		}
+		var ok bool
+		extensions, ok = v.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil, errors.New("invalid extensions type")
+		}
+	} else if len(authData) > 0 {
+		return nil, nil, errors.New("trailing authenticator data")
+	}
+
+	return credentialID, extensions, nil
+}
+
+// makeCredential creates a new non-discoverable credential for the supplied
+// relying party ID with the hmac-secret extension enabled, and returns its
+// ID. If pin is not empty, it is used to authorize the creation of the
+// credential. This requires the user to touch the device.
+func (a *authenticator) makeCredential(rpID, pin string) ([]byte, error) {
+	clientDataHash, err := a.clientDataHash()
+	if err != nil {
+		return nil, err
+	}
+
+	userID := make([]byte, userIDSize)
+	if _, err := io.ReadFull(a.rand, userID); err != nil {
+		return nil, fmt.Errorf("cannot obtain user ID: %w", err)
+	}
+
+	params := map[interface{}]interface{}{
+		1: clientDataHash,
+		2: map[interface{}]interface{}{"id": rpID},
+		3: map[interface{}]interface{}{"id": userID, "name": rpID},
+		4: []interface{}{map[interface{}]interface{}{"alg": coseAlgES256, "type": "public-key"}},
+		6: map[interface{}]interface{}{hmacSecretExtKey: true},
+		7: map[interface{}]interface{}{"rk": false}}
+
+	if pin != "" {
+		token, err := a.getPINToken(pin)
+		if err != nil {
+			return nil, fmt.Errorf("cannot obtain PIN token: %w", err)
+		}
+		params[8] = hmacSHA256(token, clientDataHash)[:pinAuthSize]
+		params[9] = ctap2PINProtocol
+	}
+
+	rsp, err := a.call(ctap2CmdMakeCredential, params)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := getBytes(rsp, uint64(2))
+	if err != nil {
+		return nil, err
+	}
+
+	credentialID, extensions, err := parseAuthData(rpID, authData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authenticator data: %w", err)
+	}
+	if len(credentialID) == 0 {
+		return nil, errors.New("no attested credential data")
+	}
+	if enabled, _ := extensions[hmacSecretExtKey].(bool); !enabled {
+		return nil, errors.New("device does not support the hmac-secret extension")
+	}
+
+	return credentialID, nil
+}
+
+// hasCredential determines whether the device holds the specified credential for
+// the supplied relying party ID. This does not require the user to touch the
+// device.
+func (a *authenticator) hasCredential(rpID string, credentialID []byte) (bool, error) {
+	clientDataHash, err := a.clientDataHash()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = a.call(ctap2CmdGetAssertion, map[interface{}]interface{}{
+		1: rpID,
+		2: clientDataHash,
+		3: []interface{}{map[interface{}]interface{}{"id": credentialID, "type": "public-key"}},
+		5: map[interface{}]interface{}{"up": false}})
+	switch {
+	case errors.Is(err, ErrNoCredentials):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// getHMACSecret uses the hmac-secret extension to obtain the secret associated
+// with the specified credential and the supplied salt. This requires the user to
+// touch the device.
+func (a *authenticator) getHMACSecret(rpID string, credentialID, salt []byte) ([]byte, error) {
+	if len(salt) != hmacSecretSize {
+		return nil, errors.New("invalid salt size")
+	}
+
+	clientDataHash, err := a.clientDataHash()
+	if err != nil {
+		return nil, err
+	}
+
+	platformKey, secret, err := a.sharedSecret()
+	if err != nil {
+		return nil, err
+	}
+	saltEnc, err := aesCBC(secret, salt, true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt salt: %w", err)
+	}
+
+	rsp, err := a.call(ctap2CmdGetAssertion, map[interface{}]interface{}{
+		1: rpID,
+		2: clientDataHash,
+		3: []interface{}{map[interface{}]interface{}{"id": credentialID, "type": "public-key"}},
+		4: map[interface{}]interface{}{
+			hmacSecretExtKey: map[interface{}]interface{}{
+				1: platformKey,
+				2: saltEnc,
+				3: hmacSHA256(secret, saltEnc)[:pinAuthSize]}}})
+	if err != nil {
+		return nil, err
+	}
+	authData, err := getBytes(rsp, uint64(2))
+	if err != nil {
+		return nil, err
+	}
+
+	_, extensions, err := parseAuthData(rpID, authData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authenticator data: %w", err)
+	}
+	if authData[32]&authDataFlagUP == 0 {
+		return nil, errors.New("user presence was not verified")
+	}
+	outputEnc, ok := extensions[hmacSecretExtKey].([]byte)
+	if !ok || len(outputEnc) != hmacSecretSize {
+		return nil, errors.New("missing or invalid hmac-secret output")
+	}
+
+	return aesCBC(secret, outputEnc, false)
+}
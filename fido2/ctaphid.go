@@ -0,0 +1,214 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	hidReportSize = 64
+
+	hidInitPayloadSize = hidReportSize - 7
+	hidContPayloadSize = hidReportSize - 5
+	hidMaxMessageSize  = hidInitPayloadSize + 128*hidContPayloadSize
+
+	hidBroadcastChannel = 0xffffffff
+
+	hidCmdInit      = 0x86
+	hidCmdCBOR      = 0x90
+	hidCmdKeepalive = 0xbb
+	hidCmdError     = 0xbf
+
+	hidCapabilityCBOR = 0x04
+
+	hidInitNonceSize = 8
+)
+
+// hidError is an error returned from a device with a CTAPHID_ERROR response.
+type hidError uint8
+
+func (e hidError) Error() string {
+	return fmt.Sprintf("CTAPHID error 0x%02x", uint8(e))
+}
+
+// hidDevice provides the CTAPHID transport for a FIDO2 device.
+type hidDevice struct {
+	rw      io.ReadWriteCloser
+	channel uint32
+}
+
+// newHIDDevice initializes the CTAPHID transport on the supplied hidraw device,
+// allocating a new channel. The supplied random source is used to generate the
+// nonce for the CTAPHID_INIT command.
+func newHIDDevice(rw io.ReadWriteCloser, rand io.Reader) (*hidDevice, error) {
+	d := &hidDevice{rw: rw, channel: hidBroadcastChannel}
+
+	nonce := make([]byte, hidInitNonceSize)
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return nil, fmt.Errorf("cannot obtain nonce: %w", err)
+	}
+
+	var rsp []byte
+	for {
+		var err error
+		rsp, err = d.transact(hidCmdInit, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize channel: %w", err)
+		}
+		if len(rsp) < 17 {
+			return nil, errors.New("cannot initialize channel: invalid response size")
+		}
+		// Another client can initialize a channel concurrently on the
+		// broadcast channel, so ignore responses that aren't for us.
+		if bytes.Equal(rsp[:hidInitNonceSize], nonce) {
+			break
+		}
+	}
+
+	if rsp[16]&hidCapabilityCBOR == 0 {
+		return nil, errors.New("device does not support CTAP2")
+	}
+
+	d.channel = binary.BigEndian.Uint32(rsp[8:])
+	return d, nil
+}
+
+func (d *hidDevice) writeMessage(cmd uint8, data []byte) error {
+	if len(data) > hidMaxMessageSize {
+		return errors.New("message too large")
+	}
+
+	// Each report is prefixed with a report number of 0, which is not
+	// sent to the device.
+	report := make([]byte, 1+hidReportSize)
+	binary.BigEndian.PutUint32(report[1:], d.channel)
+	report[5] = cmd
+	binary.BigEndian.PutUint16(report[6:], uint16(len(data)))
+	n := copy(report[8:], data)
+	data = data[n:]
+	if _, err := d.rw.Write(report); err != nil {
+		return err
+	}
+
+	for seq := uint8(0); len(data) > 0; seq++ {
+		report := make([]byte, 1+hidReportSize)
+		binary.BigEndian.PutUint32(report[1:], d.channel)
+		report[5] = seq
+		n := copy(report[6:], data)
+		data = data[n:]
+		if _, err := d.rw.Write(report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *hidDevice) readReport() ([]byte, error) {
+	for {
+		report := make([]byte, hidReportSize)
+		n, err := d.rw.Read(report)
+		if err != nil {
+			return nil, err
+		}
+		if n < 7 {
+			return nil, errors.New("short report")
+		}
+		if binary.BigEndian.Uint32(report) != d.channel {
+			// This report is for another channel.
+			continue
+		}
+		return report[:n], nil
+	}
+}
+
+func (d *hidDevice) readMessage() (cmd uint8, data []byte, err error) {
+	report, err := d.readReport()
+	if err != nil {
+		return 0, nil, err
+	}
+	cmd = report[4]
+	if cmd&0x80 == 0 {
+		return 0, nil, errors.New("unexpected continuation packet")
+	}
+	size := int(binary.BigEndian.Uint16(report[5:]))
+	if size > hidMaxMessageSize {
+		return 0, nil, errors.New("invalid message size")
+	}
+	data = append(data, report[7:]...)
+
+	for seq := uint8(0); len(data) < size; seq++ {
+		report, err := d.readReport()
+		if err != nil {
+			return 0, nil, err
+		}
+		if report[4] != seq {
+			return 0, nil, fmt.Errorf("unexpected sequence number %d (expected %d)", report[4], seq)
+		}
+		data = append(data, report[5:]...)
+	}
+
+	return cmd, data[:size], nil
+}
+
+// transact sends the supplied command and data to the device and returns the
+// response. Keepalive messages are skipped.
+func (d *hidDevice) transact(cmd uint8, data []byte) ([]byte, error) {
+	if err := d.writeMessage(cmd, data); err != nil {
+		return nil, fmt.Errorf("cannot send message: %w", err)
+	}
+
+	for {
+		rspCmd, rsp, err := d.readMessage()
+		if err != nil {
+			return nil, fmt.Errorf("cannot receive message: %w", err)
+		}
+
+		switch rspCmd {
+		case cmd:
+			return rsp, nil
+		case hidCmdKeepalive:
+			// The device is still processing the request, or is
+			// waiting for the user to touch it.
+			continue
+		case hidCmdError:
+			if len(rsp) < 1 {
+				return nil, errors.New("invalid error response")
+			}
+			return nil, hidError(rsp[0])
+		default:
+			return nil, fmt.Errorf("unexpected response command 0x%02x", rspCmd)
+		}
+	}
+}
+
+// cbor sends a CTAPHID_CBOR command to the device and returns the response.
+func (d *hidDevice) cbor(data []byte) ([]byte, error) {
+	return d.transact(hidCmdCBOR, data)
+}
+
+func (d *hidDevice) Close() error {
+	return d.rw.Close()
+}
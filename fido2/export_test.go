@@ -0,0 +1,60 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2
+
+import "io"
+
+const (
+	DefaultRelyingPartyID = defaultRelyingPartyID
+	PlatformName          = platformName
+)
+
+type (
+	AdditionalData         = additionalData
+	KeyData                = keyData
+	PlatformKeyDataHandler = platformKeyDataHandler
+)
+
+var (
+	IsFIDOReportDescriptor = isFIDOReportDescriptor
+)
+
+func MarshalAdditionalData(d AdditionalData) ([]byte, error) {
+	return d.bytes()
+}
+
+func MockHidrawDirs(sysfsDir, dir string) (restore func()) {
+	origSysfsDir := sysfsHidrawDir
+	origDir := devDir
+	sysfsHidrawDir = sysfsDir
+	devDir = dir
+	return func() {
+		sysfsHidrawDir = origSysfsDir
+		devDir = origDir
+	}
+}
+
+func MockOpenDevice(fn func(string) (io.ReadWriteCloser, error)) (restore func()) {
+	orig := openDevice
+	openDevice = fn
+	return func() {
+		openDevice = orig
+	}
+}
@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package fido2 is a platform for protecting keys with a FIDO2 security key, using
+// the hmac-secret extension. This is the same mechanism that is used by
+// systemd-cryptenroll --fido2-device.
+//
+// A non-discoverable credential with the hmac-secret extension enabled is created
+// on the security key when a key is protected. The credential ID and a random salt
+// are stored in the key data, and the security key computes a secret from these
+// with a HMAC keyed by a secret that never leaves the security key. This secret is
+// used to derive the key that protects the key data payload. Recovering a key
+// requires the same security key to be present and for the user to touch it.
+//
+// Security keys are accessed directly via the Linux hidraw interface, using the
+// CTAPHID transport.
+package fido2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNoDevice is returned when a FIDO2 security key is required but
+	// none are present.
+	ErrNoDevice = errors.New("no FIDO2 device")
+
+	// ErrPINRequired is returned when creating a credential requires a PIN
+	// but one wasn't supplied.
+	ErrPINRequired error = ctapStatus(ctap2ErrPINRequired)
+
+	// ErrPINInvalid is returned when the supplied PIN is incorrect.
+	ErrPINInvalid error = ctapStatus(ctap2ErrPINInvalid)
+
+	// ErrPINBlocked is returned when the PIN is blocked because it has been
+	// entered incorrectly too many times.
+	ErrPINBlocked error = ctapStatus(ctap2ErrPINBlocked)
+
+	// ErrNoCredentials is returned when a security key doesn't hold the
+	// credential that is used to protect a key.
+	ErrNoCredentials error = ctapStatus(ctap2ErrNoCredentials)
+)
+
+var (
+	sysfsHidrawDir = "/sys/class/hidraw"
+	devDir         = "/dev"
+
+	openDevice = func(path string) (io.ReadWriteCloser, error) {
+		return os.OpenFile(path, os.O_RDWR, 0)
+	}
+)
+
+const (
+	hidItemUsagePage = 0x04
+	hidItemUsage     = 0x08
+	hidItemLong      = 0xfe
+
+	fidoUsagePage = 0xf1d0
+	fidoUsageCTAP = 0x01
+)
+
+// isFIDOReportDescriptor determines whether the supplied HID report descriptor
+// belongs to a FIDO device, by searching for the FIDO usage page and the CTAPHID
+// usage.
+func isFIDOReportDescriptor(desc []byte) bool {
+	var usagePage uint32
+	for len(desc) > 0 {
+		prefix := desc[0]
+		if prefix == hidItemLong {
+			// Skip long items.
+			if len(desc) < 2 {
+				return false
+			}
+			n := 3 + int(desc[1])
+			if len(desc) < n {
+				return false
+			}
+			desc = desc[n:]
+			continue
+		}
+
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		if len(desc) < 1+size {
+			return false
+		}
+
+		var value uint32
+		for i := size; i > 0; i-- {
+			value = value<<8 | uint32(desc[i])
+		}
+		desc = desc[1+size:]
+
+		switch prefix & 0xfc {
+		case hidItemUsagePage:
+			usagePage = value
+		case hidItemUsage:
+			if usagePage == fidoUsagePage && value == fidoUsageCTAP {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ListDevices returns the paths of the hidraw devices that correspond to FIDO2
+// security keys, in lexical order.
+func ListDevices() ([]string, error) {
+	entries, err := ioutil.ReadDir(sysfsHidrawDir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("cannot read hidraw devices: %w", err)
+	}
+
+	var devices []string
+	for _, entry := range entries {
+		desc, err := ioutil.ReadFile(filepath.Join(sysfsHidrawDir, entry.Name(), "device", "report_descriptor"))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("cannot read report descriptor for %s: %w", entry.Name(), err)
+		}
+		if !isFIDOReportDescriptor(desc) {
+			continue
+		}
+		devices = append(devices, filepath.Join(devDir, entry.Name()))
+	}
+
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// defaultDevice returns the path of the only FIDO2 security key that is present.
+// It is an error if there is more than one.
+func defaultDevice() (string, error) {
+	devices, err := ListDevices()
+	if err != nil {
+		return "", err
+	}
+	switch len(devices) {
+	case 0:
+		return "", ErrNoDevice
+	case 1:
+		return devices[0], nil
+	default:
+		return "", fmt.Errorf("more than one FIDO2 device is present (%s)", strings.Join(devices, ", "))
+	}
+}
@@ -0,0 +1,574 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/fido2"
+	"github.com/snapcore/secboot/internal/cbor"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
+
+func Test(t *testing.T) { TestingT(t) }
+
+// fidoReportDescriptor is the report descriptor of a typical FIDO security key.
+var fidoReportDescriptor = []byte{
+	0x06, 0xd0, 0xf1, // Usage Page (FIDO Alliance)
+	0x09, 0x01, // Usage (CTAPHID)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x20, //   Usage (Input Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x40, //   Report Count (64)
+	0x81, 0x02, //   Input (Data, Var, Abs)
+	0x09, 0x21, //   Usage (Output Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x40, //   Report Count (64)
+	0x91, 0x02, //   Output (Data, Var, Abs)
+	0xc0, // End Collection
+}
+
+// keyboardReportDescriptor is the start of the report descriptor of a keyboard.
+var keyboardReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0xc0, // End Collection
+}
+
+type mockCredential struct {
+	rpID string
+	cr   []byte // The per-credential secret used by hmac-secret
+}
+
+// mockAuthenticator is a software implementation of the parts of a CTAP2
+// authenticator used by this package.
+type mockAuthenticator struct {
+	key         *ecdsa.PrivateKey // The key agreement key
+	pin         string
+	pinRetries  int
+	pinToken    []byte
+	credentials map[string]*mockCredential
+
+	noHMACSecret bool // Don't support the hmac-secret extension
+	denyUP       bool // Deny user presence
+	touches      int  // The number of times the user has been asked to touch the device
+}
+
+func newMockAuthenticator(pin string) *mockAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+	return &mockAuthenticator{
+		key:         key,
+		pin:         pin,
+		pinRetries:  8,
+		pinToken:    token,
+		credentials: make(map[string]*mockCredential)}
+}
+
+func (a *mockAuthenticator) coseKey() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		1:  2,
+		3:  -25,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32))}
+}
+
+func (a *mockAuthenticator) sharedSecret(platformKey interface{}) ([]byte, bool) {
+	m, ok := platformKey.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	xb, _ := m[int64(-2)].([]byte)
+	yb, _ := m[int64(-3)].([]byte)
+	x := new(big.Int).SetBytes(xb)
+	y := new(big.Int).SetBytes(yb)
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return nil, false
+	}
+	z, _ := elliptic.P256().ScalarMult(x, y, a.key.D.Bytes())
+	h := sha256.Sum256(z.FillBytes(make([]byte, 32)))
+	return h[:], true
+}
+
+func mockAESCBC(key, data []byte, encrypt bool) []byte {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	if encrypt {
+		cipher.NewCBCEncrypter(b, make([]byte, 16)).CryptBlocks(out, data)
+	} else {
+		cipher.NewCBCDecrypter(b, make([]byte, 16)).CryptBlocks(out, data)
+	}
+	return out
+}
+
+func mockHMAC(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func mockResponse(status uint8, rsp map[interface{}]interface{}) []byte {
+	if status != 0 {
+		return []byte{status}
+	}
+	data, err := cbor.Marshal(rsp)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{0}, data...)
+}
+
+func (a *mockAuthenticator) handle(req []byte) []byte {
+	v, err := cbor.Unmarshal(req[1:])
+	if err != nil {
+		return []byte{0x12} // CTAP2_ERR_INVALID_CBOR
+	}
+	params, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return []byte{0x11} // CTAP2_ERR_CBOR_UNEXPECTED_TYPE
+	}
+
+	switch req[0] {
+	case 0x01:
+		return a.makeCredential(params)
+	case 0x02:
+		return a.getAssertion(params)
+	case 0x06:
+		return a.clientPIN(params)
+	default:
+		return []byte{0x01} // CTAP1_ERR_INVALID_COMMAND
+	}
+}
+
+func (a *mockAuthenticator) clientPIN(params map[interface{}]interface{}) []byte {
+	if params[uint64(1)] != uint64(1) {
+		return []byte{0x02} // CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	switch params[uint64(2)] {
+	case uint64(2):
+		return mockResponse(0, map[interface{}]interface{}{1: a.coseKey()})
+	case uint64(5):
+		if a.pin == "" {
+			return []byte{0x35} // CTAP2_ERR_PIN_NOT_SET
+		}
+		if a.pinRetries == 0 {
+			return []byte{0x32} // CTAP2_ERR_PIN_BLOCKED
+		}
+		secret, ok := a.sharedSecret(params[uint64(3)])
+		if !ok {
+			return []byte{0x02}
+		}
+		pinHashEnc, _ := params[uint64(6)].([]byte)
+		if len(pinHashEnc) != 16 {
+			return []byte{0x02}
+		}
+		pinHash := sha256.Sum256([]byte(a.pin))
+		if !bytes.Equal(mockAESCBC(secret, pinHashEnc, false), pinHash[:16]) {
+			a.pinRetries -= 1
+			return []byte{0x31} // CTAP2_ERR_PIN_INVALID
+		}
+		return mockResponse(0, map[interface{}]interface{}{2: mockAESCBC(secret, a.pinToken, true)})
+	default:
+		return []byte{0x02}
+	}
+}
+
+func (a *mockAuthenticator) makeCredential(params map[interface{}]interface{}) []byte {
+	clientDataHash, _ := params[uint64(1)].([]byte)
+	rp, _ := params[uint64(2)].(map[interface{}]interface{})
+	rpID, _ := rp["id"].(string)
+	if len(clientDataHash) != 32 || rpID == "" {
+		return []byte{0x14} // CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if a.pin != "" {
+		pinAuth, ok := params[uint64(8)].([]byte)
+		if !ok {
+			return []byte{0x36} // CTAP2_ERR_PIN_REQUIRED
+		}
+		if !hmac.Equal(pinAuth, mockHMAC(a.pinToken, clientDataHash)[:16]) {
+			return []byte{0x33} // CTAP2_ERR_PIN_AUTH_INVALID
+		}
+	}
+
+	a.touches += 1
+	if a.denyUP {
+		return []byte{0x27} // CTAP2_ERR_OPERATION_DENIED
+	}
+
+	ext, _ := params[uint64(6)].(map[interface{}]interface{})
+	hmacSecret, _ := ext["hmac-secret"].(bool)
+
+	cred := &mockCredential{rpID: rpID, cr: make([]byte, 32)}
+	rand.Read(cred.cr)
+	id := make([]byte, 48)
+	rand.Read(id)
+	a.credentials[string(id)] = cred
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := new(bytes.Buffer)
+	authData.Write(rpIDHash[:])
+	flags := uint8(0x41)
+	if hmacSecret && !a.noHMACSecret {
+		flags |= 0x80
+	}
+	authData.WriteByte(flags)
+	binary.Write(authData, binary.BigEndian, uint32(1))
+	authData.Write(make([]byte, 16))
+	binary.Write(authData, binary.BigEndian, uint16(len(id)))
+	authData.Write(id)
+	pub, _ := cbor.Marshal(a.coseKey())
+	authData.Write(pub)
+	if flags&0x80 != 0 {
+		ext, _ := cbor.Marshal(map[interface{}]interface{}{"hmac-secret": true})
+		authData.Write(ext)
+	}
+
+	return mockResponse(0, map[interface{}]interface{}{
+		1: "none",
+		2: authData.Bytes(),
+		3: map[interface{}]interface{}{}})
+}
+
+func (a *mockAuthenticator) getAssertion(params map[interface{}]interface{}) []byte {
+	rpID, _ := params[uint64(1)].(string)
+	clientDataHash, _ := params[uint64(2)].([]byte)
+	if len(clientDataHash) != 32 || rpID == "" {
+		return []byte{0x14}
+	}
+
+	allowList, _ := params[uint64(3)].([]interface{})
+	var id []byte
+	var cred *mockCredential
+	for _, desc := range allowList {
+		m, _ := desc.(map[interface{}]interface{})
+		candidate, _ := m["id"].([]byte)
+		if c, exists := a.credentials[string(candidate)]; exists && c.rpID == rpID {
+			id = candidate
+			cred = c
+			break
+		}
+	}
+	if cred == nil {
+		return []byte{0x2e} // CTAP2_ERR_NO_CREDENTIALS
+	}
+
+	up := true
+	if options, ok := params[uint64(5)].(map[interface{}]interface{}); ok {
+		if v, ok := options["up"].(bool); ok {
+			up = v
+		}
+	}
+
+	var flags uint8
+	if up {
+		a.touches += 1
+		if a.denyUP {
+			return []byte{0x27}
+		}
+		flags |= 0x01
+	}
+
+	var extOut []byte
+	if ext, ok := params[uint64(4)].(map[interface{}]interface{}); ok {
+		hmacSecret, ok := ext["hmac-secret"].(map[interface{}]interface{})
+		if ok && !a.noHMACSecret {
+			secret, ok := a.sharedSecret(hmacSecret[uint64(1)])
+			if !ok {
+				return []byte{0x02}
+			}
+			saltEnc, _ := hmacSecret[uint64(2)].([]byte)
+			saltAuth, _ := hmacSecret[uint64(3)].([]byte)
+			if !hmac.Equal(saltAuth, mockHMAC(secret, saltEnc)[:16]) {
+				return []byte{0x2a} // CTAP2_ERR_EXTENSION_FIRST
+			}
+			salt := mockAESCBC(secret, saltEnc, false)
+			output := mockHMAC(cred.cr, salt)
+			extOut, _ = cbor.Marshal(map[interface{}]interface{}{"hmac-secret": mockAESCBC(secret, output, true)})
+			flags |= 0x80
+		}
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := new(bytes.Buffer)
+	authData.Write(rpIDHash[:])
+	authData.WriteByte(flags)
+	binary.Write(authData, binary.BigEndian, uint32(2))
+	authData.Write(extOut)
+
+	return mockResponse(0, map[interface{}]interface{}{
+		1: map[interface{}]interface{}{"id": id, "type": "public-key"},
+		2: authData.Bytes(),
+		3: []byte("signature")})
+}
+
+// mockHIDDevice implements the CTAPHID transport for a mockAuthenticator.
+type mockHIDDevice struct {
+	auth *mockAuthenticator
+
+	nextChannel   uint32
+	noCBOR        bool // Don't advertise CTAP2 support
+	keepalives    int  // The number of keepalive messages to send before each response
+	otherChannels bool // Send a message to another channel before each response
+
+	req     []byte
+	reqSize int
+	reqCmd  uint8
+	reqChan uint32
+	reports [][]byte
+	closed  bool
+}
+
+func newMockHIDDevice(auth *mockAuthenticator) *mockHIDDevice {
+	return &mockHIDDevice{auth: auth, nextChannel: 0x01020304}
+}
+
+func (d *mockHIDDevice) queueMessage(channel uint32, cmd uint8, data []byte) {
+	report := make([]byte, 64)
+	binary.BigEndian.PutUint32(report, channel)
+	report[4] = cmd
+	binary.BigEndian.PutUint16(report[5:], uint16(len(data)))
+	n := copy(report[7:], data)
+	data = data[n:]
+	d.reports = append(d.reports, report)
+
+	for seq := uint8(0); len(data) > 0; seq++ {
+		report := make([]byte, 64)
+		binary.BigEndian.PutUint32(report, channel)
+		report[4] = seq
+		n := copy(report[5:], data)
+		data = data[n:]
+		d.reports = append(d.reports, report)
+	}
+}
+
+func (d *mockHIDDevice) handleMessage() {
+	if d.otherChannels {
+		d.queueMessage(d.reqChan+1, d.reqCmd, []byte{0})
+	}
+	for i := 0; i < d.keepalives; i++ {
+		d.queueMessage(d.reqChan, 0xbb, []byte{2}) // STATUS_UPNEEDED
+	}
+
+	switch d.reqCmd {
+	case 0x86:
+		rsp := make([]byte, 17)
+		copy(rsp, d.req)
+		binary.BigEndian.PutUint32(rsp[8:], d.nextChannel)
+		rsp[12] = 2
+		if !d.noCBOR {
+			rsp[16] = 0x04
+		}
+		d.nextChannel += 1
+		d.queueMessage(d.reqChan, 0x86, rsp)
+	case 0x90:
+		d.queueMessage(d.reqChan, 0x90, d.auth.handle(d.req))
+	default:
+		d.queueMessage(d.reqChan, 0xbf, []byte{0x01}) // ERR_INVALID_CMD
+	}
+}
+
+func (d *mockHIDDevice) Write(data []byte) (int, error) {
+	if d.closed {
+		return 0, errors.New("closed")
+	}
+	if len(data) != 65 || data[0] != 0 {
+		return 0, errors.New("invalid report")
+	}
+	report := data[1:]
+	channel := binary.BigEndian.Uint32(report)
+
+	if report[4]&0x80 != 0 {
+		d.reqChan = channel
+		d.reqCmd = report[4]
+		d.reqSize = int(binary.BigEndian.Uint16(report[5:]))
+		d.req = append([]byte(nil), report[7:]...)
+	} else {
+		if channel != d.reqChan {
+			return 0, errors.New("unexpected channel")
+		}
+		d.req = append(d.req, report[5:]...)
+	}
+
+	if len(d.req) >= d.reqSize {
+		d.req = d.req[:d.reqSize]
+		d.handleMessage()
+	}
+
+	return len(data), nil
+}
+
+func (d *mockHIDDevice) Read(data []byte) (int, error) {
+	if d.closed {
+		return 0, errors.New("closed")
+	}
+	if len(d.reports) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(data, d.reports[0])
+	d.reports = d.reports[1:]
+	return n, nil
+}
+
+func (d *mockHIDDevice) Close() error {
+	if d.closed {
+		return errors.New("already closed")
+	}
+	d.closed = true
+	return nil
+}
+
+// fido2TestBase provides a mock hidraw environment with FIDO2 security keys.
+type fido2TestBase struct {
+	snapd_testutil.BaseTest
+
+	sysfsDir string
+	devices  map[string]*mockHIDDevice
+	opened   []*mockHIDDevice
+}
+
+func (b *fido2TestBase) SetUpTest(c *C) {
+	b.BaseTest.SetUpTest(c)
+
+	b.sysfsDir = c.MkDir()
+	b.devices = make(map[string]*mockHIDDevice)
+	b.opened = nil
+
+	b.AddCleanup(MockHidrawDirs(b.sysfsDir, "/dev"))
+
+	b.AddCleanup(MockOpenDevice(func(path string) (io.ReadWriteCloser, error) {
+		dev, exists := b.devices[path]
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		// Each open creates a new handle to the same device.
+		handle := &mockHIDDevice{auth: dev.auth, nextChannel: dev.nextChannel, noCBOR: dev.noCBOR, keepalives: dev.keepalives, otherChannels: dev.otherChannels}
+		dev.nextChannel += 0x100
+		b.opened = append(b.opened, handle)
+		return handle, nil
+	}))
+}
+
+// addDevice adds a mock hidraw device with the specified name and report
+// descriptor.
+func (b *fido2TestBase) addDevice(c *C, name string, desc []byte, dev *mockHIDDevice) {
+	dir := filepath.Join(b.sysfsDir, name, "device")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "report_descriptor"), desc, 0644), IsNil)
+	if dev != nil {
+		b.devices[filepath.Join("/dev", name)] = dev
+	}
+}
+
+// addAuthenticator adds a mock FIDO2 security key with the specified name.
+func (b *fido2TestBase) addAuthenticator(c *C, name string, auth *mockAuthenticator) *mockHIDDevice {
+	dev := newMockHIDDevice(auth)
+	b.addDevice(c, name, fidoReportDescriptor, dev)
+	return dev
+}
+
+type fido2Suite struct {
+	fido2TestBase
+}
+
+var _ = Suite(&fido2Suite{})
+
+func (s *fido2Suite) TestIsFIDOReportDescriptor(c *C) {
+	c.Check(IsFIDOReportDescriptor(fidoReportDescriptor), Equals, true)
+}
+
+func (s *fido2Suite) TestIsFIDOReportDescriptorNotFIDO(c *C) {
+	c.Check(IsFIDOReportDescriptor(keyboardReportDescriptor), Equals, false)
+}
+
+func (s *fido2Suite) TestIsFIDOReportDescriptorWrongUsage(c *C) {
+	c.Check(IsFIDOReportDescriptor([]byte{0x06, 0xd0, 0xf1, 0x09, 0x02}), Equals, false)
+}
+
+func (s *fido2Suite) TestIsFIDOReportDescriptorLongItem(c *C) {
+	desc := append([]byte{0xfe, 0x02, 0x10, 0xaa, 0xbb}, fidoReportDescriptor...)
+	c.Check(IsFIDOReportDescriptor(desc), Equals, true)
+}
+
+func (s *fido2Suite) TestIsFIDOReportDescriptorTruncated(c *C) {
+	c.Check(IsFIDOReportDescriptor([]byte{0x06, 0xd0}), Equals, false)
+	c.Check(IsFIDOReportDescriptor([]byte{0xfe, 0x04, 0x10}), Equals, false)
+}
+
+func (s *fido2Suite) TestListDevices(c *C) {
+	s.addDevice(c, "hidraw2", fidoReportDescriptor, nil)
+	s.addDevice(c, "hidraw0", keyboardReportDescriptor, nil)
+	s.addDevice(c, "hidraw1", fidoReportDescriptor, nil)
+
+	devices, err := ListDevices()
+	c.Check(err, IsNil)
+	c.Check(devices, DeepEquals, []string{"/dev/hidraw1", "/dev/hidraw2"})
+}
+
+func (s *fido2Suite) TestListDevicesNone(c *C) {
+	s.addDevice(c, "hidraw0", keyboardReportDescriptor, nil)
+
+	devices, err := ListDevices()
+	c.Check(err, IsNil)
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *fido2Suite) TestListDevicesNoHidraw(c *C) {
+	s.AddCleanup(MockHidrawDirs(filepath.Join(s.sysfsDir, "missing"), "/dev"))
+
+	devices, err := ListDevices()
+	c.Check(err, IsNil)
+	c.Check(devices, HasLen, 0)
+}
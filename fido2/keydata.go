@@ -0,0 +1,246 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/snapcore/secboot"
+)
+
+const (
+	platformName = "fido2"
+
+	// defaultRelyingPartyID is the relying party ID used for new credentials
+	// if one isn't supplied.
+	defaultRelyingPartyID = "secboot"
+
+	saltSize  = hmacSecretSize
+	nonceSize = 12
+)
+
+var (
+	secbootNewKeyData = secboot.NewKeyData
+)
+
+type additionalData struct {
+	Version    int
+	Generation int
+	KDFAlg     secboot.HashAlg
+	AuthMode   secboot.AuthMode
+}
+
+func (d additionalData) MarshalASN1(b *cryptobyte.Builder) {
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(int64(d.Version))
+		b.AddASN1Int64(int64(d.Generation))
+		d.KDFAlg.MarshalASN1(b)
+		b.AddASN1Enum(int64(d.AuthMode))
+	})
+}
+
+func (d additionalData) bytes() ([]byte, error) {
+	builder := cryptobyte.NewBuilder(nil)
+	d.MarshalASN1(builder)
+	return builder.Bytes()
+}
+
+type keyData struct {
+	Version int `json:"version"`
+
+	RelyingPartyID string `json:"rp-id"`         // The relying party ID of the credential
+	CredentialID   []byte `json:"credential-id"` // The ID of the credential on the security key
+	Salt           []byte `json:"salt"`          // The salt supplied to the hmac-secret extension
+	Nonce          []byte `json:"nonce"`         // The GCM nonce
+}
+
+// deriveAESKey derives the key used to protect the payload from the secret
+// returned from the hmac-secret extension.
+func deriveAESKey(secret []byte) []byte {
+	r := hkdf.New(crypto.SHA256.New, secret, nil, []byte("ENCRYPT"))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(r, key); err != nil {
+		panic(fmt.Sprintf("cannot derive key: %v", err))
+	}
+
+	return key
+}
+
+func newAEAD(secret, nonce []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(deriveAESKey(secret))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(b, len(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create AEAD: %w", err)
+	}
+	return aead, nil
+}
+
+// openAuthenticator opens the FIDO2 security key at the specified hidraw device
+// path.
+func openAuthenticator(path string, rand io.Reader) (*authenticator, io.Closer, error) {
+	rw, err := openDevice(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dev, err := newHIDDevice(rw, rand)
+	if err != nil {
+		rw.Close()
+		return nil, nil, err
+	}
+	return &authenticator{transport: dev, rand: rand}, dev, nil
+}
+
+// ProtectKeyParams provides the parameters to NewProtectedKey.
+type ProtectKeyParams struct {
+	// Device is the path of the hidraw device for the security key to
+	// protect the new key with. If this is empty, the only security key
+	// that is present will be used, and it is an error if there is more
+	// than one.
+	Device string
+
+	// PIN is the security key's PIN. Security keys that have a PIN
+	// configured require it in order to create a new credential. It is
+	// not required in order to recover the key.
+	PIN string
+
+	// RelyingPartyID is the relying party ID of the new credential. If
+	// this is empty, a default will be used.
+	RelyingPartyID string
+
+	// Role describes the role of the new key.
+	Role string
+}
+
+// NewProtectedKey creates a new key that is protected by the FIDO2 security key
+// specified in params, using the hmac-secret extension. A new credential is
+// created on the security key, and its ID is stored in the returned key data along
+// with a random salt. This requires the user to touch the security key twice. Recovering
+// the key requires the same security key to be present, and for the user to touch
+// it again.
+//
+// If primaryKey isn't supplied, then one will be generated.
+//
+// This function requires some cryptographically strong randomness, obtained from the rand
+// argument. Whilst this will normally be from [rand.Reader], it can be provided from other
+// secure sources or mocked during tests.
+func NewProtectedKey(rand io.Reader, params *ProtectKeyParams, primaryKey secboot.PrimaryKey) (protectedKey *secboot.KeyData, primaryKeyOut secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	if params == nil {
+		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
+	}
+
+	rpID := params.RelyingPartyID
+	if rpID == "" {
+		rpID = defaultRelyingPartyID
+	}
+
+	device := params.Device
+	if device == "" {
+		device, err = defaultDevice()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot select device: %w", err)
+		}
+	}
+
+	if len(primaryKey) == 0 {
+		primaryKey = make(secboot.PrimaryKey, 32)
+		if _, err := io.ReadFull(rand, primaryKey); err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot obtain primary key: %w", err)
+		}
+	}
+
+	kdfAlg := crypto.SHA256
+	unlockKey, payload, err := secboot.MakeDiskUnlockKey(rand, kdfAlg, primaryKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create new unlock key: %w", err)
+	}
+
+	// Obtain a 32-byte salt for the hmac-secret extension and a 12-byte
+	// GCM nonce.
+	randBytes := make([]byte, saltSize+nonceSize)
+	if _, err := io.ReadFull(rand, randBytes); err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot obtain required random bytes: %w", err)
+	}
+
+	kd := &keyData{
+		Version:        1,
+		RelyingPartyID: rpID,
+		Salt:           randBytes[:saltSize],
+		Nonce:          randBytes[saltSize:],
+	}
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: secboot.KeyDataGeneration,
+		KDFAlg:     secboot.HashAlg(kdfAlg),
+		AuthMode:   secboot.AuthModeNone,
+	}.bytes()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot serialize AAD: %w", err)
+	}
+
+	auth, closer, err := openAuthenticator(device, rand)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot open device %s: %w", device, err)
+	}
+	defer closer.Close()
+
+	kd.CredentialID, err = auth.makeCredential(rpID, params.PIN)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create credential: %w", err)
+	}
+
+	secret, err := auth.getHMACSecret(rpID, kd.CredentialID, kd.Salt)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot obtain secret: %w", err)
+	}
+
+	aead, err := newAEAD(secret, kd.Nonce)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ciphertext := aead.Seal(nil, kd.Nonce, payload, aad)
+
+	protectedKey, err = secbootNewKeyData(&secboot.KeyParams{
+		Handle:           kd,
+		Role:             params.Role,
+		EncryptedPayload: ciphertext,
+		PlatformName:     platformName,
+		KDFAlg:           kdfAlg,
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create key data: %w", err)
+	}
+
+	return protectedKey, primaryKey, unlockKey, nil
+}
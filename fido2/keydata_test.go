@@ -0,0 +1,223 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2_test
+
+import (
+	"crypto/rand"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/fido2"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type keydataSuite struct {
+	fido2TestBase
+}
+
+var _ = Suite(&keydataSuite{})
+
+func (s *keydataSuite) TestNewProtectedKey(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	kd, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Role: "foo"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, PlatformName)
+	c.Check(kd.Role(), Equals, "foo")
+	c.Check(kd.AuthMode(), Equals, secboot.AuthModeNone)
+	c.Check(primaryKey, HasLen, 32)
+
+	// Creating the key requires 2 touches - one to create the
+	// credential and one to obtain the secret.
+	c.Check(auth.touches, Equals, 2)
+	c.Check(auth.credentials, HasLen, 1)
+	for _, cred := range auth.credentials {
+		c.Check(cred.rpID, Equals, DefaultRelyingPartyID)
+	}
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+	c.Check(auth.touches, Equals, 3)
+
+	for _, dev := range s.opened {
+		c.Check(dev.closed, testutil.IsTrue)
+	}
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWithPrimaryKey(c *C) {
+	s.addAuthenticator(c, "hidraw0", newMockAuthenticator(""))
+
+	primaryKey := testutil.DecodeHexString(c, "7d5f2bd5d5e0b8e0e0b3bf1d5bfe8a1c5e4a8b9e0a0c3b3bc0f6e6a1f5a3c4b1")
+
+	kd, primaryKeyOut, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(primaryKeyOut, DeepEquals, secboot.PrimaryKey(primaryKey))
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, secboot.PrimaryKey(primaryKey))
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWithRelyingPartyID(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	kd, _, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{RelyingPartyID: "io.example"}, nil)
+	c.Assert(err, IsNil)
+
+	c.Check(auth.credentials, HasLen, 1)
+	for _, cred := range auth.credentials {
+		c.Check(cred.rpID, Equals, "io.example")
+	}
+
+	recoveredUnlockKey, _, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWithPIN(c *C) {
+	auth := newMockAuthenticator("1234")
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	kd, _, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{PIN: "1234"}, nil)
+	c.Assert(err, IsNil)
+
+	// The PIN isn't required to recover the key.
+	recoveredUnlockKey, _, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyPINRequired(c *C) {
+	auth := newMockAuthenticator("1234")
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot create credential: a PIN is required`)
+	c.Check(errors.Is(err, ErrPINRequired), testutil.IsTrue)
+	c.Check(auth.credentials, HasLen, 0)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWrongPIN(c *C) {
+	auth := newMockAuthenticator("1234")
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{PIN: "5678"}, nil)
+	c.Check(err, ErrorMatches, `cannot create credential: cannot obtain PIN token: the PIN is invalid`)
+	c.Check(errors.Is(err, ErrPINInvalid), testutil.IsTrue)
+	c.Check(auth.pinRetries, Equals, 7)
+	c.Check(auth.credentials, HasLen, 0)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyPINBlocked(c *C) {
+	auth := newMockAuthenticator("1234")
+	auth.pinRetries = 0
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{PIN: "1234"}, nil)
+	c.Check(err, ErrorMatches, `cannot create credential: cannot obtain PIN token: the PIN is blocked`)
+	c.Check(errors.Is(err, ErrPINBlocked), testutil.IsTrue)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoHMACSecret(c *C) {
+	auth := newMockAuthenticator("")
+	auth.noHMACSecret = true
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot create credential: device does not support the hmac-secret extension`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyDenied(c *C) {
+	auth := newMockAuthenticator("")
+	auth.denyUP = true
+	s.addAuthenticator(c, "hidraw0", auth)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot create credential: the operation was denied`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoDevice(c *C) {
+	s.addDevice(c, "hidraw0", keyboardReportDescriptor, nil)
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot select device: no FIDO2 device`)
+	c.Check(errors.Is(err, ErrNoDevice), testutil.IsTrue)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyMoreThanOneDevice(c *C) {
+	s.addAuthenticator(c, "hidraw0", newMockAuthenticator(""))
+	s.addAuthenticator(c, "hidraw1", newMockAuthenticator(""))
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot select device: more than one FIDO2 device is present \(/dev/hidraw0, /dev/hidraw1\)`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWithDevice(c *C) {
+	auth1 := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth1)
+	auth2 := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw1", auth2)
+
+	kd, _, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{Device: "/dev/hidraw1"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(auth1.credentials, HasLen, 0)
+	c.Check(auth2.credentials, HasLen, 1)
+
+	// Recovering the key should find the correct device without
+	// requiring a touch on the other one.
+	recoveredUnlockKey, _, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(auth1.touches, Equals, 0)
+	c.Check(auth2.touches, Equals, 3)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoCTAP2(c *C) {
+	dev := s.addAuthenticator(c, "hidraw0", newMockAuthenticator(""))
+	dev.noCBOR = true
+
+	_, _, _, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Check(err, ErrorMatches, `cannot open device /dev/hidraw0: device does not support CTAP2`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyKeepaliveAndOtherChannels(c *C) {
+	dev := s.addAuthenticator(c, "hidraw0", newMockAuthenticator(""))
+	dev.keepalives = 3
+	dev.otherChannels = true
+
+	kd, _, unlockKey, err := NewProtectedKey(rand.Reader, &ProtectKeyParams{}, nil)
+	c.Assert(err, IsNil)
+
+	recoveredUnlockKey, _, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoParams(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, nil, nil)
+	c.Check(err, ErrorMatches, `no ProtectKeyParams provided`)
+}
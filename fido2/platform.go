@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/testhooks"
+)
+
+type platformKeyDataHandler struct{}
+
+func decodeKeyData(data *secboot.PlatformKeyData) (*keyData, error) {
+	var kd *keyData
+	if err := json.Unmarshal(data.EncodedHandle, &kd); err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	}
+	if kd == nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no handle"),
+		}
+	}
+	if kd.Version != 1 {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("invalid version %d", kd.Version),
+		}
+	}
+	if len(kd.Salt) != saltSize {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("invalid salt size"),
+		}
+	}
+	return kd, nil
+}
+
+// findCredential returns the security key that holds the credential described by
+// the supplied key data. This does not require the user to touch any security key.
+func findCredential(kd *keyData) (*authenticator, func() error, error) {
+	devices, err := ListDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(devices) == 0 {
+		return nil, nil, ErrNoDevice
+	}
+
+	for _, device := range devices {
+		auth, closer, err := openAuthenticator(device, testhooks.RandReader)
+		if err != nil {
+			// Ignore devices that can't be opened, which may be
+			// in use by another process.
+			continue
+		}
+		found, err := auth.hasCredential(kd.RelyingPartyID, kd.CredentialID)
+		if err != nil || !found {
+			closer.Close()
+			continue
+		}
+		return auth, closer.Close, nil
+	}
+
+	return nil, nil, ErrNoCredentials
+}
+
+func (*platformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	kd, err := decodeKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: data.Generation,
+		KDFAlg:     secboot.HashAlg(data.KDFAlg),
+		AuthMode:   data.AuthMode,
+	}.bytes()
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot serialize AAD: %w", err),
+		}
+	}
+
+	auth, closeFn, err := findCredential(kd)
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorUnavailable,
+			Err:  fmt.Errorf("cannot find device with credential: %w", err),
+		}
+	}
+	defer closeFn()
+
+	secret, err := auth.getHMACSecret(kd.RelyingPartyID, kd.CredentialID, kd.Salt)
+	switch {
+	case errors.Is(err, ctapStatus(ctap2ErrOperationDenied)) || errors.Is(err, ctapStatus(ctap2ErrUserActionTimeout)):
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorUnavailable,
+			Err:  fmt.Errorf("cannot obtain secret: %w", err),
+		}
+	case err != nil:
+		return nil, fmt.Errorf("cannot obtain secret: %w", err)
+	}
+
+	aead, err := newAEAD(secret, kd.Nonce)
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	}
+
+	payload, err := aead.Open(nil, kd.Nonce, encryptedPayload, aad)
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot open payload: %w", err),
+		}
+	}
+
+	return payload, nil
+}
+
+func (*platformKeyDataHandler) RecoverKeysWithAuthKey(data *secboot.PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
+	return nil, errors.New("unsupported action")
+}
+
+func (*platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, old, new []byte) ([]byte, error) {
+	return nil, errors.New("unsupported action")
+}
+
+func init() {
+	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
+}
@@ -0,0 +1,219 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fido2_test
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/fido2"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type platformSuite struct {
+	fido2TestBase
+}
+
+var _ = Suite(&platformSuite{})
+
+func (s *platformSuite) newKeyData(c *C, auth *mockAuthenticator, generation int) (*secboot.PlatformKeyData, []byte) {
+	kd := &KeyData{
+		Version:        1,
+		RelyingPartyID: "secboot",
+		CredentialID:   testutil.DecodeHexString(c, "9f0a3ac2c63bd1e6d3ae1b0d7bd0f7e8b4a2b6a6f6ab1d9b7fa4e6c4bd0a0f4e"),
+		Salt:           testutil.DecodeHexString(c, "5a2e0e5e9f3a4b3fd4c1b0a14e3d6b7b8b6f2c9d1e0a3f4b5c6d7e8f90a1b2c3"),
+		Nonce:          testutil.DecodeHexString(c, "078535cc101b9d12d9b8f40e"),
+	}
+	cr := testutil.DecodeHexString(c, "b7f4fc6e0c4a86e4e9b0a1d05c5a6ee0e7b1bd6b1b4c2f0f2f2c7f3f8ac0b1d2")
+	auth.credentials[string(kd.CredentialID)] = &mockCredential{rpID: kd.RelyingPartyID, cr: cr}
+
+	r := hkdf.New(crypto.SHA256.New, mockHMAC(cr, kd.Salt), nil, []byte("ENCRYPT"))
+	key := make([]byte, 32)
+	_, err := io.ReadFull(r, key)
+	c.Assert(err, IsNil)
+
+	b, err := aes.NewCipher(key)
+	c.Assert(err, IsNil)
+	aead, err := cipher.NewGCM(b)
+	c.Assert(err, IsNil)
+
+	aad, err := MarshalAdditionalData(AdditionalData{
+		Version:    1,
+		Generation: generation,
+		KDFAlg:     secboot.HashAlg(crypto.SHA256),
+		AuthMode:   secboot.AuthModeNone,
+	})
+	c.Assert(err, IsNil)
+
+	handle, err := json.Marshal(kd)
+	c.Assert(err, IsNil)
+
+	return &secboot.PlatformKeyData{
+		Generation:    generation,
+		EncodedHandle: handle,
+		KDFAlg:        crypto.SHA256,
+		AuthMode:      secboot.AuthModeNone,
+	}, aead.Seal(nil, kd.Nonce, []byte("payload"), aad)
+}
+
+func (s *platformSuite) TestRecoverKeys(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+	data, ciphertext := s.newKeyData(c, auth, 2)
+
+	var platform PlatformKeyDataHandler
+	payload, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("payload"))
+	c.Check(auth.touches, Equals, 1)
+
+	for _, dev := range s.opened {
+		c.Check(dev.closed, testutil.IsTrue)
+	}
+}
+
+func (s *platformSuite) TestRecoverKeysSelectsDevice(c *C) {
+	auth1 := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth1)
+	s.addDevice(c, "hidraw1", keyboardReportDescriptor, nil)
+	auth2 := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw2", auth2)
+	data, ciphertext := s.newKeyData(c, auth2, 2)
+
+	var platform PlatformKeyDataHandler
+	payload, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("payload"))
+	c.Check(auth1.touches, Equals, 0)
+	c.Check(auth2.touches, Equals, 1)
+
+	c.Check(s.opened, HasLen, 2)
+	for _, dev := range s.opened {
+		c.Check(dev.closed, testutil.IsTrue)
+	}
+}
+
+func (s *platformSuite) TestRecoverKeysWrongGeneration(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+	data, ciphertext := s.newKeyData(c, auth, 2)
+	data.Generation = 1
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot open payload: cipher: message authentication failed`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysNoDevice(c *C) {
+	auth := newMockAuthenticator("")
+	data, ciphertext := s.newKeyData(c, auth, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot find device with credential: no FIDO2 device`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysNoCredential(c *C) {
+	s.addAuthenticator(c, "hidraw0", newMockAuthenticator(""))
+	data, ciphertext := s.newKeyData(c, newMockAuthenticator(""), 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot find device with credential: no valid credentials were provided`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysDenied(c *C) {
+	auth := newMockAuthenticator("")
+	auth.denyUP = true
+	s.addAuthenticator(c, "hidraw0", auth)
+	data, ciphertext := s.newKeyData(c, auth, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `cannot obtain secret: the operation was denied`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysInvalidVersion(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+	data, ciphertext := s.newKeyData(c, auth, 2)
+	data.EncodedHandle = []byte(`{"version":2}`)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `invalid version 2`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysInvalidSalt(c *C) {
+	auth := newMockAuthenticator("")
+	s.addAuthenticator(c, "hidraw0", auth)
+	data, ciphertext := s.newKeyData(c, auth, 2)
+	data.EncodedHandle = []byte(`{"version":1,"salt":"AQID"}`)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `invalid salt size`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysNoHandle(c *C) {
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(&secboot.PlatformKeyData{EncodedHandle: []byte("null")}, nil)
+	c.Check(err, ErrorMatches, `no handle`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyUnsupported(c *C) {
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(&secboot.PlatformKeyData{}, nil, nil)
+	c.Check(err, ErrorMatches, `unsupported action`)
+}
+
+func (s *platformSuite) TestChangeAuthKeyUnsupported(c *C) {
+	var platform PlatformKeyDataHandler
+	_, err := platform.ChangeAuthKey(&secboot.PlatformKeyData{}, nil, nil)
+	c.Check(err, ErrorMatches, `unsupported action`)
+}
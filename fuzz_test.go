@@ -0,0 +1,73 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+// The following functions are entry points for go's native fuzzing support,
+// and can be run with "go test -run=- -fuzz=<name>". Without -fuzz, they are
+// run as tests with the seed inputs.
+
+func FuzzReadKeyData(f *testing.F) {
+	f.Add([]byte(`{"generation":2,"platform_name":"mock","platform_handle":{"key":"AAAA"},"role":"foo","kdf_alg":"sha256","encrypted_payload":"AAAA"}`))
+	f.Add([]byte(`{"generation":2,"platform_name":"mock","platform_handle":null,"role":"","kdf_alg":"sha256","encrypted_payload":"","passphrase_params":{"kdf":{"type":"argon2id","salt":"AAAA","time":4,"memory":1024,"cpus":1},"encryption":"aes-cfb","derived_key_size":32,"encryption_key_size":32,"auth_key_size":32}}`))
+	f.Add([]byte(`{"platform_name":"mock","platform_handle":{},"encrypted_payload":"AAAA","authorized_snap_models":{"alg":"sha256","kdf_alg":"sha256","key_digest":{"alg":"sha256","salt":"AAAA","digest":"AAAA"},"hmacs":null}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kd, err := ReadKeyData(&mockKeyDataReader{"fuzz", bytes.NewReader(data)})
+		if err != nil {
+			return
+		}
+		kd.Generation()
+		kd.AuthMode()
+		kd.UniqueID()
+
+		var handle interface{}
+		kd.UnmarshalPlatformHandle(&handle)
+	})
+}
+
+func FuzzUnmarshalProtectedKeys(f *testing.F) {
+	f.Add([]byte{0x30, 0x06, 0x04, 0x01, 0xaa, 0x04, 0x01, 0xbb})
+	f.Add(bytes.Repeat([]byte{0xff}, 16))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pk, err := UnmarshalProtectedKeys(data)
+		if err != nil {
+			return
+		}
+		pk.UnlockKey(crypto.SHA256)
+	})
+}
+
+func FuzzUnmarshalV1KeyPayload(f *testing.F) {
+	f.Add([]byte{0x00, 0x02, 0xaa, 0xbb, 0x00, 0x01, 0xcc})
+	f.Add([]byte{0x00, 0x20})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshalV1KeyPayload(data)
+	})
+}
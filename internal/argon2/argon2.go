@@ -29,6 +29,10 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// MaxMemoryCostKiB is the maximum memory cost in KiB that will be selected by
+// Benchmark. Parameters with a larger memory cost should be treated as invalid.
+const MaxMemoryCostKiB = 4 * 1024 * 1024
+
 const (
 	// Dummy password for benchmarking (same value used by cryptsetup)
 	benchmarkPassword = "foo"
@@ -38,7 +42,7 @@ const (
 
 	minTimeCost      = 4
 	minMemoryCostKiB = 32 * 1024
-	maxMemoryCostKiB = 4 * 1024 * 1024
+	maxMemoryCostKiB = MaxMemoryCostKiB
 
 	tolerance = 0.05
 )
@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package artifact provides the version header that is embedded in
+// serialized artifacts written by secboot.
+package artifact
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// FormatVersion is the version of the serialization formats
+	// understood by secboot. It is recorded as the producer version in the
+	// header of every artifact written by secboot, and is incremented
+	// whenever a format changes in a way that older versions can't read.
+	//
+	// The versions are:
+	//  - 1: The initial version.
+	//  - 2: TPM2 key data version 4.
+	FormatVersion = 2
+
+	magic = "secboot"
+)
+
+// Header is embedded in serialized artifacts in order to indicate which
+// versions of secboot can read them.
+type Header struct {
+	Magic            string `json:"magic"`
+	ProducerVersion  int    `json:"producer_version"`   // The value of FormatVersion for the producer
+	MinReaderVersion int    `json:"min_reader_version"` // The minimum value of FormatVersion for readers
+}
+
+// NewHeader returns a new header for an artifact which can be read by any
+// version of secboot with a FormatVersion of at least minReaderVersion.
+func NewHeader(minReaderVersion int) *Header {
+	return &Header{
+		Magic:            magic,
+		ProducerVersion:  FormatVersion,
+		MinReaderVersion: minReaderVersion}
+}
+
+// VersionError is returned when reading an artifact that was written by a
+// newer version of secboot, in a format that this version can't read.
+type VersionError struct {
+	Artifact         string // The type of artifact, eg, "key data"
+	ProducerVersion  int
+	MinReaderVersion int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s requires newer secboot (format version %d is required, but this version only supports %d)", e.Artifact, e.MinReaderVersion, FormatVersion)
+}
+
+// Check checks that an artifact of the specified type with the supplied
+// header can be read by this version of secboot. A nil header corresponds to
+// an artifact written before headers were introduced, which can always be
+// read. If the artifact requires a newer version, a *VersionError error is
+// returned.
+func Check(artifact string, hdr *Header) error {
+	if hdr == nil {
+		return nil
+	}
+	if hdr.Magic != magic {
+		return fmt.Errorf("invalid %s header: invalid magic %q", artifact, hdr.Magic)
+	}
+	if hdr.MinReaderVersion > FormatVersion {
+		return &VersionError{
+			Artifact:         artifact,
+			ProducerVersion:  hdr.ProducerVersion,
+			MinReaderVersion: hdr.MinReaderVersion}
+	}
+	return nil
+}
+
+// headerJSON is used to decode just the header from a JSON encoded
+// artifact, which is embedded with the "secboot" key.
+type headerJSON struct {
+	Header *Header `json:"secboot"`
+}
+
+// CheckJSON checks the header embedded with the "secboot" key in the
+// supplied JSON encoded artifact, before the rest of the artifact is
+// decoded.
+func CheckJSON(artifact string, data []byte) error {
+	var h headerJSON
+	if err := json.Unmarshal(data, &h); err != nil {
+		return xerrors.Errorf("cannot decode %s header: %w", artifact, err)
+	}
+	return Check(artifact, h.Header)
+}
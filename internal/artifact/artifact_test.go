@@ -0,0 +1,54 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package artifact_test
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/artifact"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type artifactSuite struct{}
+
+var _ = Suite(&artifactSuite{})
+
+func (s *artifactSuite) TestCheckJSONNoHeader(c *C) {
+	c.Check(CheckJSON("foo", []byte(`{"foo":"bar"}`)), IsNil)
+}
+
+func (s *artifactSuite) TestCheckJSONCurrent(c *C) {
+	c.Check(CheckJSON("foo", []byte(`{"secboot":{"magic":"secboot","producer_version":2,"min_reader_version":2},"foo":"bar"}`)), IsNil)
+}
+
+func (s *artifactSuite) TestCheckJSONRequiresNewer(c *C) {
+	err := CheckJSON("foo", []byte(`{"secboot":{"magic":"secboot","producer_version":4,"min_reader_version":3},"foo":{"new":"format"}}`))
+	c.Check(err, ErrorMatches, `foo requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Assert(err, testutil.ConvertibleTo, &VersionError{})
+	c.Check(err.(*VersionError).ProducerVersion, Equals, 4)
+}
+
+func (s *artifactSuite) TestCheckJSONInvalidHeader(c *C) {
+	c.Check(CheckJSON("foo", []byte(`{"secboot":"bar"}`)), ErrorMatches, `cannot decode foo header: .*`)
+}
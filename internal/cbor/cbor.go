@@ -0,0 +1,349 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package cbor implements a minimal encoder and decoder for the subset of
+// CBOR (RFC 8949) that is required to encode key data. It supports unsigned
+// and negative integers, byte strings, text strings, arrays, maps, booleans,
+// null and 64-bit floats. Indefinite length items and tags are not supported.
+//
+// Values are represented by the following Go types: uint64 and int64 for
+// integers (int64 is only used for negative integers when decoding), float64,
+// []byte, string, []interface{}, map[interface{}]interface{}, bool and nil.
+// Maps with string or integer keys are also accepted by Marshal. Map keys are
+// encoded in the deterministic order described in section 4.2.1 of RFC 8949.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorSimple = 7
+
+	simpleFalse   = 20
+	simpleTrue    = 21
+	simpleNull    = 22
+	simpleFloat64 = 27
+
+	// maxDepth is the maximum nesting depth of arrays and maps when decoding.
+	maxDepth = 32
+)
+
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeMap(buf *bytes.Buffer, n int, each func(fn func(k, v interface{}) error) error) error {
+	type entry struct {
+		key   []byte
+		value interface{}
+	}
+	var entries []entry
+	if err := each(func(k, v interface{}) error {
+		kb := new(bytes.Buffer)
+		if err := encode(kb, k); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: kb.Bytes(), value: v})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	writeHead(buf, majorMap, uint64(n))
+	for i, e := range entries {
+		if i > 0 && bytes.Equal(e.key, entries[i-1].key) {
+			return errors.New("duplicate map key")
+		}
+		buf.Write(e.key)
+		if err := encode(buf, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(majorSimple<<5 | simpleNull)
+	case bool:
+		if v {
+			buf.WriteByte(majorSimple<<5 | simpleTrue)
+		} else {
+			buf.WriteByte(majorSimple<<5 | simpleFalse)
+		}
+	case uint64:
+		writeHead(buf, majorUint, v)
+	case int:
+		return encode(buf, int64(v))
+	case int64:
+		if v < 0 {
+			writeHead(buf, majorNegInt, uint64(-(v + 1)))
+		} else {
+			writeHead(buf, majorUint, uint64(v))
+		}
+	case float64:
+		buf.WriteByte(majorSimple<<5 | simpleFloat64)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case []byte:
+		writeHead(buf, majorBytes, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		return encodeMap(buf, len(v), func(fn func(k, v interface{}) error) error {
+			for k, e := range v {
+				if err := fn(k, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case map[string]interface{}:
+		return encodeMap(buf, len(v), func(fn func(k, v interface{}) error) error {
+			for k, e := range v {
+				if err := fn(k, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case map[uint64]interface{}:
+		return encodeMap(buf, len(v), func(fn func(k, v interface{}) error) error {
+			for k, e := range v {
+				if err := fn(k, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+// Marshal returns the CBOR encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) readHead() (major byte, n uint64, err error) {
+	if len(d.data) < 1 {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	major = d.data[0] >> 5
+	info := d.data[0] & 0x1f
+	d.data = d.data[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported additional information (%d)", info)
+	}
+	if len(d.data) < size {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	for _, b := range d.data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	d.data = d.data[size:]
+	return major, n, nil
+}
+
+func (d *decoder) decodeSimple() (interface{}, error) {
+	info := d.data[0] & 0x1f
+	d.data = d.data[1:]
+
+	switch info {
+	case simpleFalse:
+		return false, nil
+	case simpleTrue:
+		return true, nil
+	case simpleNull:
+		return nil, nil
+	case simpleFloat64:
+		if len(d.data) < 8 {
+			return nil, errors.New("unexpected end of data")
+		}
+		n := binary.BigEndian.Uint64(d.data)
+		d.data = d.data[8:]
+		return math.Float64frombits(n), nil
+	default:
+		return nil, fmt.Errorf("unsupported simple value or float (%d)", info)
+	}
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("maximum nesting depth exceeded")
+	}
+	if len(d.data) > 0 && d.data[0]>>5 == majorSimple {
+		return d.decodeSimple()
+	}
+
+	major, n, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case majorUint:
+		return n, nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("negative integer out of range")
+		}
+		return -int64(n) - 1, nil
+	case majorBytes, majorText:
+		if n > uint64(len(d.data)) {
+			return nil, errors.New("unexpected end of data")
+		}
+		b := d.data[:n]
+		d.data = d.data[n:]
+		if major == majorText {
+			return string(b), nil
+		}
+		return append([]byte{}, b...), nil
+	case majorArray:
+		// Each element is at least 1 byte.
+		if n > uint64(len(d.data)) {
+			return nil, errors.New("unexpected end of data")
+		}
+		out := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			e, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	case majorMap:
+		// Each entry is at least 2 bytes.
+		if n > uint64(len(d.data))/2 {
+			return nil, errors.New("unexpected end of data")
+		}
+		out := make(map[interface{}]interface{})
+		for i := uint64(0); i < n; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case uint64, int64, string:
+			default:
+				return nil, fmt.Errorf("unsupported map key type %T", k)
+			}
+			if _, exists := out[k]; exists {
+				return nil, fmt.Errorf("duplicate map key %v", k)
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = v
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported major type %d", major)
+	}
+}
+
+// Unmarshal decodes a single CBOR data item from data. It is an error if
+// there is trailing data.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) > 0 {
+		return nil, errors.New("trailing data")
+	}
+	return v, nil
+}
+
+// UnmarshalPrefix decodes a single CBOR data item from the start of data, and
+// returns it along with the remaining data. This is useful for formats where a
+// CBOR data item is followed by other data.
+func UnmarshalPrefix(data []byte) (v interface{}, rest []byte, err error) {
+	d := &decoder{data: data}
+	v, err = d.decode(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, d.data, nil
+}
@@ -0,0 +1,201 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cbor_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/cbor"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type cborSuite struct{}
+
+var _ = Suite(&cborSuite{})
+
+func decodeHexString(c *C, s string) []byte {
+	b, err := hex.DecodeString(s)
+	c.Assert(err, IsNil)
+	return b
+}
+
+type testVectorData struct {
+	value   interface{}
+	encoded string
+}
+
+// These test vectors are from appendix A of RFC 8949.
+var testVectors = []testVectorData{
+	{value: uint64(0), encoded: "00"},
+	{value: uint64(23), encoded: "17"},
+	{value: uint64(24), encoded: "1818"},
+	{value: uint64(100), encoded: "1864"},
+	{value: uint64(1000), encoded: "1903e8"},
+	{value: uint64(1000000), encoded: "1a000f4240"},
+	{value: uint64(18446744073709551615), encoded: "1bffffffffffffffff"},
+	{value: int64(-1), encoded: "20"},
+	{value: int64(-1000), encoded: "3903e7"},
+	{value: float64(1.1), encoded: "fb3ff199999999999a"},
+	{value: float64(-4.1), encoded: "fbc010666666666666"},
+	{value: false, encoded: "f4"},
+	{value: true, encoded: "f5"},
+	{value: nil, encoded: "f6"},
+	{value: []byte{}, encoded: "40"},
+	{value: []byte{1, 2, 3, 4}, encoded: "4401020304"},
+	{value: "", encoded: "60"},
+	{value: "IETF", encoded: "6449455446"},
+	{value: "ü", encoded: "62c3bc"},
+	{value: []interface{}{}, encoded: "80"},
+	{value: []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}}, encoded: "8201820203"},
+	{value: map[interface{}]interface{}{}, encoded: "a0"},
+	{value: map[interface{}]interface{}{uint64(1): uint64(2), uint64(3): uint64(4)}, encoded: "a201020304"},
+	{value: map[interface{}]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}, encoded: "a26161016162820203"},
+}
+
+func (s *cborSuite) TestMarshal(c *C) {
+	for i, data := range testVectors {
+		b, err := Marshal(data.value)
+		c.Check(err, IsNil, Commentf("vector %d", i))
+		c.Check(b, DeepEquals, decodeHexString(c, data.encoded), Commentf("vector %d", i))
+	}
+}
+
+func (s *cborSuite) TestUnmarshal(c *C) {
+	for i, data := range testVectors {
+		v, err := Unmarshal(decodeHexString(c, data.encoded))
+		c.Check(err, IsNil, Commentf("vector %d", i))
+		c.Check(v, DeepEquals, data.value, Commentf("vector %d", i))
+	}
+}
+
+func (s *cborSuite) TestMarshalInt(c *C) {
+	b, err := Marshal([]interface{}{10, int64(-500)})
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, decodeHexString(c, "820a3901f3"))
+}
+
+func (s *cborSuite) TestMarshalMapKeyOrder(c *C) {
+	// Keys are sorted by their encoded form, so shorter keys come first.
+	b, err := Marshal(map[interface{}]interface{}{
+		"aa":       uint64(1),
+		"b":        uint64(2),
+		uint64(10): uint64(3),
+		uint64(1):  uint64(4)})
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, decodeHexString(c, "a401040a0361620262616101"))
+}
+
+func (s *cborSuite) TestMarshalStringMap(c *C) {
+	b, err := Marshal(map[string]interface{}{"b": uint64(2), "a": uint64(1)})
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, decodeHexString(c, "a2616101616202"))
+}
+
+func (s *cborSuite) TestMarshalUintMap(c *C) {
+	b, err := Marshal(map[uint64]interface{}{2: "b", 1: "a"})
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, decodeHexString(c, "a2016161026162"))
+}
+
+func (s *cborSuite) TestMarshalUnsupportedType(c *C) {
+	_, err := Marshal([]interface{}{float32(1)})
+	c.Check(err, ErrorMatches, `unsupported type float32`)
+}
+
+func (s *cborSuite) TestMarshalDuplicateKey(c *C) {
+	_, err := Marshal(map[interface{}]interface{}{uint64(1): nil, int64(1): nil})
+	c.Check(err, ErrorMatches, `duplicate map key`)
+}
+
+func (s *cborSuite) TestRoundTripLongByteString(c *C) {
+	data := bytes.Repeat([]byte{0xaa}, 300)
+	b, err := Marshal(data)
+	c.Assert(err, IsNil)
+	c.Check(b[:3], DeepEquals, []byte{0x59, 0x01, 0x2c})
+
+	v, err := Unmarshal(b)
+	c.Check(err, IsNil)
+	c.Check(v, DeepEquals, data)
+}
+
+type testUnmarshalErrorData struct {
+	encoded string
+	err     string
+}
+
+func (s *cborSuite) TestUnmarshalErrors(c *C) {
+	for i, data := range []testUnmarshalErrorData{
+		{encoded: "", err: "unexpected end of data"},
+		{encoded: "19ff", err: "unexpected end of data"},
+		{encoded: "1c", err: `unsupported additional information \(28\)`},
+		{encoded: "5f", err: `unsupported additional information \(31\)`},
+		{encoded: "4401", err: "unexpected end of data"},
+		{encoded: "6401", err: "unexpected end of data"},
+		{encoded: "8201", err: "unexpected end of data"},
+		{encoded: "5bffffffffffffffff", err: "unexpected end of data"},
+		{encoded: "9bffffffffffffffff", err: "unexpected end of data"},
+		{encoded: "3bffffffffffffffff", err: "negative integer out of range"},
+		{encoded: "c0", err: "unsupported major type 6"},
+		{encoded: "f0", err: `unsupported simple value or float \(16\)`},
+		{encoded: "f93c00", err: `unsupported simple value or float \(25\)`},
+		{encoded: "fb3ff1", err: "unexpected end of data"},
+		{encoded: "a2010101", err: "unexpected end of data"},
+		{encoded: "a201010102", err: "duplicate map key 1"},
+		{encoded: "0000", err: "trailing data"},
+	} {
+		_, err := Unmarshal(decodeHexString(c, data.encoded))
+		c.Check(err, ErrorMatches, data.err, Commentf("vector %d", i))
+	}
+}
+
+func (s *cborSuite) TestUnmarshalUnsupportedMapKey(c *C) {
+	_, err := Unmarshal(decodeHexString(c, "a18001"))
+	c.Check(err, ErrorMatches, `unsupported map key type \[\]interface \{\}`)
+}
+
+func (s *cborSuite) TestUnmarshalMaxDepth(c *C) {
+	_, err := Unmarshal(append(bytes.Repeat([]byte{0x81}, 33), 0x00))
+	c.Check(err, ErrorMatches, "maximum nesting depth exceeded")
+
+	_, err = Unmarshal(append(bytes.Repeat([]byte{0x81}, 32), 0x00))
+	c.Check(err, IsNil)
+}
+
+func (s *cborSuite) TestUnmarshalPrefix(c *C) {
+	v, rest, err := UnmarshalPrefix(decodeHexString(c, "a1616101ff00"))
+	c.Check(err, IsNil)
+	c.Check(v, DeepEquals, map[interface{}]interface{}{"a": uint64(1)})
+	c.Check(rest, DeepEquals, []byte{0xff, 0x00})
+
+	v, rest, err = UnmarshalPrefix(decodeHexString(c, "01"))
+	c.Check(err, IsNil)
+	c.Check(v, Equals, uint64(1))
+	c.Check(rest, HasLen, 0)
+}
+
+func (s *cborSuite) TestUnmarshalPrefixError(c *C) {
+	_, _, err := UnmarshalPrefix(decodeHexString(c, "8201"))
+	c.Check(err, ErrorMatches, "unexpected end of data")
+}
@@ -181,6 +181,28 @@ func (s *compatTestSuiteBase) testUnsealErrorMatchesCommon(c *C, pattern string)
 	c.Check(err, ErrorMatches, pattern)
 }
 
+func (s *compatTestSuiteBase) testUpgradeLegacyKeyFile(c *C, pcrEventsFile string) {
+	s.replayPCRSequenceFromFile(c, pcrEventsFile)
+
+	upgrade, err := secboot_tpm2.UpgradeLegacyKeyFile(s.TPM(), s.absPath("key"), &secboot_tpm2.ProtectKeyParams{
+		PCRProfile:             secboot_tpm2.NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	expectedKey, err := ioutil.ReadFile(s.absPath("clearKey"))
+	c.Assert(err, IsNil)
+	c.Check(upgrade.LegacyUnlockKey, DeepEquals, secboot.DiskUnlockKey(expectedKey))
+
+	skd, err := secboot_tpm2.NewSealedKeyData(upgrade.KeyData)
+	c.Assert(err, IsNil)
+	c.Check(skd.Version(), Equals, uint32(3))
+
+	unlockKey, primaryKey, err := upgrade.KeyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(unlockKey, DeepEquals, upgrade.UnlockKey)
+	c.Check(primaryKey, DeepEquals, upgrade.PrimaryKey)
+}
+
 func TestMain(m *testing.M) {
 	// Provide a way for run-tests to configure this in a way that
 	// can be ignored by other suites
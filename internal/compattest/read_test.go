@@ -0,0 +1,53 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package compattest
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// compatTestReadSuite verifies that legacy key files can be parsed without
+// access to a TPM.
+type compatTestReadSuite struct{}
+
+var _ = Suite(&compatTestReadSuite{})
+
+func (s *compatTestReadSuite) testReadLegacyKeyFile(c *C, path string, expectedVersion uint32, expectedCounter tpm2.Handle) {
+	k, err := secboot_tpm2.ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+	c.Check(k.Version(), Equals, expectedVersion)
+	c.Check(k.PCRPolicyCounterHandle(), Equals, expectedCounter)
+
+	kd, err := secboot_tpm2.NewKeyDataFromSealedKeyObjectFile(path)
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, "tpm2-legacy")
+}
+
+func (s *compatTestReadSuite) TestReadV0(c *C) {
+	s.testReadLegacyKeyFile(c, "testdata/v0/key", 0, 0x01801000)
+}
+
+func (s *compatTestReadSuite) TestReadV1(c *C) {
+	s.testReadLegacyKeyFile(c, "testdata/v1/key", 1, 0x01801000)
+}
@@ -132,3 +132,7 @@ func (s *compatTestV0Suite) TestUnsealAfterLock(c *C) {
 	c.Assert(secboot_tpm2.BlockPCRProtectionPolicies(s.TPM(), []int{12}), IsNil)
 	s.testUnsealErrorMatchesCommon(c, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: cannot execute PolicyOR assertions: current session digest not found in policy data")
 }
+
+func (s *compatTestV0Suite) TestUpgradeLegacyKeyFile(c *C) {
+	s.testUpgradeLegacyKeyFile(c, s.absPath("pcrSequence.1"))
+}
@@ -0,0 +1,245 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+)
+
+// ReplayedEvent is a measured event from a TCG event log that has been replayed
+// by ReplayEventLog.
+type ReplayedEvent struct {
+	Index int           // The index of the event in the log
+	Event *tcglog.Event // The event
+
+	// Values contains the value of the PCR that the event was measured to,
+	// immediately after the event was measured, for each algorithm.
+	Values map[tpm2.HashAlgorithmId]tpm2.Digest
+}
+
+// EventLogReplay is the result of replaying a TCG event log with
+// ReplayEventLog. It contains the predicted PCR values, which should match
+// the PCR values in the TPM if the log is consistent with it.
+type EventLogReplay struct {
+	algs   tcglog.AlgorithmIdList
+	values tpm2.PCRValues
+	events map[tpm2.Handle][]*ReplayedEvent
+}
+
+// ReplayEventLog replays the supplied TCG event log, normally obtained from
+// [HostEnvironmentEFI.ReadEventLog], for each of the digest algorithms in the
+// log. EV_NO_ACTION events are not measured, with the exception of the
+// StartupLocality event which determines the initial value of PCR0.
+func ReplayEventLog(log *tcglog.Log) (*EventLogReplay, error) {
+	r := &EventLogReplay{
+		algs:   log.Algorithms,
+		values: make(tpm2.PCRValues),
+		events: make(map[tpm2.Handle][]*ReplayedEvent),
+	}
+
+	for i, ev := range log.Events {
+		if ev.EventType == tcglog.EventTypeNoAction {
+			loc, isLoc := ev.Data.(*tcglog.StartupLocalityEventData)
+			if !isLoc {
+				continue
+			}
+			if ev.PCRIndex != PlatformFirmwarePCR {
+				return nil, fmt.Errorf("unexpected StartupLocality event %d in PCR%d", i, ev.PCRIndex)
+			}
+			if len(r.events[PlatformFirmwarePCR]) > 0 {
+				return nil, fmt.Errorf("unexpected StartupLocality event %d after measurements to PCR0", i)
+			}
+			for _, alg := range r.algs {
+				value := make(tpm2.Digest, alg.Size())
+				value[len(value)-1] = loc.StartupLocality
+				r.values.SetValue(alg, int(PlatformFirmwarePCR), value)
+			}
+			continue
+		}
+
+		replayed := &ReplayedEvent{
+			Index:  i,
+			Event:  ev,
+			Values: make(map[tpm2.HashAlgorithmId]tpm2.Digest),
+		}
+		for _, alg := range r.algs {
+			digest, exists := ev.Digests[alg]
+			if !exists {
+				return nil, fmt.Errorf("event %d has no %v digest", i, alg)
+			}
+
+			h := alg.NewHash()
+			h.Write(r.PCRValue(alg, ev.PCRIndex))
+			h.Write(digest)
+			value := h.Sum(nil)
+
+			r.values.SetValue(alg, int(ev.PCRIndex), value)
+			replayed.Values[alg] = value
+		}
+		r.events[ev.PCRIndex] = append(r.events[ev.PCRIndex], replayed)
+	}
+
+	return r, nil
+}
+
+// Algorithms returns the digest algorithms that the log was replayed for.
+func (r *EventLogReplay) Algorithms() tcglog.AlgorithmIdList {
+	return r.algs
+}
+
+// PCRs returns the PCRs that have a predicted value other than their reset
+// value of zero, in ascending order.
+func (r *EventLogReplay) PCRs() tpm2.HandleList {
+	seen := make(map[int]struct{})
+	for _, values := range r.values {
+		for pcr := range values {
+			seen[pcr] = struct{}{}
+		}
+	}
+
+	var pcrs tpm2.HandleList
+	for pcr := range seen {
+		pcrs = append(pcrs, tpm2.Handle(pcr))
+	}
+	sort.Slice(pcrs, func(i, j int) bool { return pcrs[i] < pcrs[j] })
+	return pcrs
+}
+
+// PCRValue returns the predicted value of the specified PCR for the specified
+// algorithm.
+func (r *EventLogReplay) PCRValue(alg tpm2.HashAlgorithmId, pcr tpm2.Handle) tpm2.Digest {
+	if value, exists := r.values[alg][int(pcr)]; exists {
+		return value
+	}
+	return make(tpm2.Digest, alg.Size())
+}
+
+// Events returns the replayed events that were measured to the specified PCR,
+// in the order that they appear in the log.
+func (r *EventLogReplay) Events(pcr tpm2.Handle) []*ReplayedEvent {
+	return r.events[pcr]
+}
+
+// PCRMismatch describes a PCR with a value that is different to the value
+// predicted by replaying the TCG event log.
+type PCRMismatch struct {
+	PCR       tpm2.Handle
+	Alg       tpm2.HashAlgorithmId
+	Predicted tpm2.Digest // The value predicted from the log
+	Actual    tpm2.Digest // The actual value
+
+	// LastEvent is the last event in the log that was measured to the PCR,
+	// or nil if there are no events for it.
+	LastEvent *ReplayedEvent
+}
+
+func (m *PCRMismatch) String() string {
+	return fmt.Sprintf("PCR%d (%v): predicted value %x from log, actual value %x", m.PCR, m.Alg, m.Predicted, m.Actual)
+}
+
+// CheckPCRValues compares the supplied PCR values, normally read from the TPM,
+// against the values predicted by replaying the log. A PCRMismatch is returned
+// for each PCR that is different, ordered by algorithm and then by PCR. Values
+// for algorithms that the log wasn't replayed for are ignored.
+func (r *EventLogReplay) CheckPCRValues(actual tpm2.PCRValues) []*PCRMismatch {
+	var mismatches []*PCRMismatch
+	for _, alg := range r.algs {
+		var pcrs []int
+		for pcr := range actual[alg] {
+			pcrs = append(pcrs, pcr)
+		}
+		sort.Ints(pcrs)
+
+		for _, pcr := range pcrs {
+			predicted := r.PCRValue(alg, tpm2.Handle(pcr))
+			if bytes.Equal(predicted, actual[alg][pcr]) {
+				continue
+			}
+
+			mismatch := &PCRMismatch{
+				PCR:       tpm2.Handle(pcr),
+				Alg:       alg,
+				Predicted: predicted,
+				Actual:    actual[alg][pcr],
+			}
+			if events := r.events[tpm2.Handle(pcr)]; len(events) > 0 {
+				mismatch.LastEvent = events[len(events)-1]
+			}
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	return mismatches
+}
+
+// MeasurementMismatch describes the first point at which a sequence of predicted
+// measurements for a PCR differs from the measurements recorded in the TCG event
+// log.
+type MeasurementMismatch struct {
+	PCR   tpm2.Handle
+	Alg   tpm2.HashAlgorithmId
+	Index int // The index of the measurement in the sequence of measurements for the PCR
+
+	// Predicted is the predicted digest of the measurement, or nil if
+	// the log contains more measurements than were predicted.
+	Predicted tpm2.Digest
+
+	// Event is the event from the log, or nil if the log contains fewer
+	// measurements than were predicted.
+	Event *ReplayedEvent
+}
+
+func (m *MeasurementMismatch) String() string {
+	switch {
+	case m.Event == nil:
+		return fmt.Sprintf("PCR%d (%v): measurement %d with digest %x is missing from the log", m.PCR, m.Alg, m.Index, m.Predicted)
+	case m.Predicted == nil:
+		return fmt.Sprintf("PCR%d (%v): unexpected measurement %d in log (event %d, %v)", m.PCR, m.Alg, m.Index, m.Event.Index, m.Event.Event.EventType)
+	default:
+		return fmt.Sprintf("PCR%d (%v): measurement %d has predicted digest %x, but the log contains %x (event %d, %v)",
+			m.PCR, m.Alg, m.Index, m.Predicted, m.Event.Event.Digests[m.Alg], m.Event.Index, m.Event.Event.EventType)
+	}
+}
+
+// DiffMeasurements compares the supplied sequence of predicted measurement
+// digests for the specified PCR and algorithm, such as those generated for a
+// PCR profile, with the measurements recorded in the log. This returns nil if
+// they are the same, or else it describes the first measurement that differs.
+func (r *EventLogReplay) DiffMeasurements(alg tpm2.HashAlgorithmId, pcr tpm2.Handle, predicted tpm2.DigestList) *MeasurementMismatch {
+	events := r.events[pcr]
+	for i := 0; i < len(predicted) || i < len(events); i++ {
+		mismatch := &MeasurementMismatch{PCR: pcr, Alg: alg, Index: i}
+		if i < len(predicted) {
+			mismatch.Predicted = predicted[i]
+		}
+		if i < len(events) {
+			mismatch.Event = events[i]
+		}
+		if mismatch.Predicted != nil && mismatch.Event != nil && bytes.Equal(mismatch.Predicted, mismatch.Event.Event.Digests[alg]) {
+			continue
+		}
+		return mismatch
+	}
+	return nil
+}
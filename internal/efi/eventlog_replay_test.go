@@ -0,0 +1,223 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"crypto"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/secboot/internal/efitest"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type eventLogReplaySuite struct{}
+
+var _ = Suite(&eventLogReplaySuite{})
+
+func (s *eventLogReplaySuite) digest(str string) tpm2.Digest {
+	h := crypto.SHA256.New()
+	h.Write([]byte(str))
+	return h.Sum(nil)
+}
+
+func (s *eventLogReplaySuite) newLog() *tcglog.Log {
+	return &tcglog.Log{
+		Algorithms: tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA256},
+		Events: []*tcglog.Event{
+			{
+				PCRIndex:  0,
+				EventType: tcglog.EventTypeNoAction,
+				Data:      &tcglog.StartupLocalityEventData{StartupLocality: 3},
+			},
+			{
+				PCRIndex:  0,
+				EventType: tcglog.EventTypeSCRTMVersion,
+				Digests:   tcglog.DigestMap{tpm2.HashAlgorithmSHA256: s.digest("foo")},
+			},
+			{
+				PCRIndex:  4,
+				EventType: tcglog.EventTypeEFIAction,
+				Digests:   tcglog.DigestMap{tpm2.HashAlgorithmSHA256: s.digest("bar")},
+			},
+			{
+				PCRIndex:  4,
+				EventType: tcglog.EventTypeSeparator,
+				Digests:   tcglog.DigestMap{tpm2.HashAlgorithmSHA256: s.digest("baz")},
+			},
+		},
+	}
+}
+
+func (s *eventLogReplaySuite) TestReplayEventLog(c *C) {
+	log := s.newLog()
+
+	replay, err := ReplayEventLog(log)
+	c.Assert(err, IsNil)
+	c.Check(replay.Algorithms(), DeepEquals, tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA256})
+	c.Check(replay.PCRs(), DeepEquals, tpm2.HandleList{0, 4})
+	c.Check(replay.PCRValue(tpm2.HashAlgorithmSHA256, 0), DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "a13aca791cd6b94063abca4f6433a1e39780fceccda6c4697e39abf850b9a5f1")))
+	c.Check(replay.PCRValue(tpm2.HashAlgorithmSHA256, 4), DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "6ffe9519f67e78b21323c9fb6597f3de605396032233fd08df01694ec6647297")))
+	c.Check(replay.PCRValue(tpm2.HashAlgorithmSHA256, 7), DeepEquals, make(tpm2.Digest, 32))
+
+	c.Check(replay.Events(4), DeepEquals, []*ReplayedEvent{
+		{
+			Index:  2,
+			Event:  log.Events[2],
+			Values: map[tpm2.HashAlgorithmId]tpm2.Digest{tpm2.HashAlgorithmSHA256: testutil.DecodeHexString(c, "a98b1d896c9383603b7923fffe230c9e4df24218eb84c90c5c758e63ce62843c")},
+		},
+		{
+			Index:  3,
+			Event:  log.Events[3],
+			Values: map[tpm2.HashAlgorithmId]tpm2.Digest{tpm2.HashAlgorithmSHA256: testutil.DecodeHexString(c, "6ffe9519f67e78b21323c9fb6597f3de605396032233fd08df01694ec6647297")},
+		},
+	})
+	c.Check(replay.Events(7), HasLen, 0)
+}
+
+func (s *eventLogReplaySuite) TestReplayEventLogMissingDigest(c *C) {
+	log := s.newLog()
+	log.Algorithms = append(log.Algorithms, tpm2.HashAlgorithmSHA1)
+
+	_, err := ReplayEventLog(log)
+	c.Check(err, ErrorMatches, `event 1 has no TPM_ALG_SHA1 digest`)
+}
+
+func (s *eventLogReplaySuite) TestReplayEventLogUnexpectedStartupLocality(c *C) {
+	log := s.newLog()
+	log.Events = append(log.Events, log.Events[0])
+
+	_, err := ReplayEventLog(log)
+	c.Check(err, ErrorMatches, `unexpected StartupLocality event 4 after measurements to PCR0`)
+}
+
+func (s *eventLogReplaySuite) TestReplayEventLogMockLog(c *C) {
+	// Make sure that a realistic log replays.
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1}})
+
+	replay, err := ReplayEventLog(log)
+	c.Assert(err, IsNil)
+	c.Check(replay.PCRs(), DeepEquals, tpm2.HandleList{0, 1, 2, 3, 4, 5, 6, 7})
+	c.Check(replay.Events(7), Not(HasLen), 0)
+}
+
+func (s *eventLogReplaySuite) TestCheckPCRValuesMatch(c *C) {
+	replay, err := ReplayEventLog(s.newLog())
+	c.Assert(err, IsNil)
+
+	values := tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {
+			0: testutil.DecodeHexString(c, "a13aca791cd6b94063abca4f6433a1e39780fceccda6c4697e39abf850b9a5f1"),
+			4: testutil.DecodeHexString(c, "6ffe9519f67e78b21323c9fb6597f3de605396032233fd08df01694ec6647297"),
+			7: make(tpm2.Digest, 32),
+		},
+		// Values for algorithms that aren't in the log are ignored.
+		tpm2.HashAlgorithmSHA1: {
+			4: make(tpm2.Digest, 20),
+		},
+	}
+	c.Check(replay.CheckPCRValues(values), HasLen, 0)
+}
+
+func (s *eventLogReplaySuite) TestCheckPCRValuesMismatch(c *C) {
+	log := s.newLog()
+	replay, err := ReplayEventLog(log)
+	c.Assert(err, IsNil)
+
+	values := tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {
+			0: testutil.DecodeHexString(c, "a13aca791cd6b94063abca4f6433a1e39780fceccda6c4697e39abf850b9a5f1"),
+			4: s.digest("foo"),
+			7: s.digest("bar"),
+		},
+	}
+	mismatches := replay.CheckPCRValues(values)
+	c.Check(mismatches, DeepEquals, []*PCRMismatch{
+		{
+			PCR:       4,
+			Alg:       tpm2.HashAlgorithmSHA256,
+			Predicted: testutil.DecodeHexString(c, "6ffe9519f67e78b21323c9fb6597f3de605396032233fd08df01694ec6647297"),
+			Actual:    s.digest("foo"),
+			LastEvent: replay.Events(4)[1],
+		},
+		{
+			PCR:       7,
+			Alg:       tpm2.HashAlgorithmSHA256,
+			Predicted: make(tpm2.Digest, 32),
+			Actual:    s.digest("bar"),
+		},
+	})
+	c.Check(mismatches[0].String(), Equals, "PCR4 (TPM_ALG_SHA256): predicted value 6ffe9519f67e78b21323c9fb6597f3de605396032233fd08df01694ec6647297 from log, actual value 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+}
+
+func (s *eventLogReplaySuite) TestDiffMeasurementsMatch(c *C) {
+	replay, err := ReplayEventLog(s.newLog())
+	c.Assert(err, IsNil)
+
+	c.Check(replay.DiffMeasurements(tpm2.HashAlgorithmSHA256, 4, tpm2.DigestList{s.digest("bar"), s.digest("baz")}), IsNil)
+	c.Check(replay.DiffMeasurements(tpm2.HashAlgorithmSHA256, 7, nil), IsNil)
+}
+
+func (s *eventLogReplaySuite) TestDiffMeasurementsDifferentDigest(c *C) {
+	replay, err := ReplayEventLog(s.newLog())
+	c.Assert(err, IsNil)
+
+	mismatch := replay.DiffMeasurements(tpm2.HashAlgorithmSHA256, 4, tpm2.DigestList{s.digest("bar"), s.digest("foo")})
+	c.Check(mismatch, DeepEquals, &MeasurementMismatch{
+		PCR:       4,
+		Alg:       tpm2.HashAlgorithmSHA256,
+		Index:     1,
+		Predicted: s.digest("foo"),
+		Event:     replay.Events(4)[1],
+	})
+	c.Check(mismatch.String(), Equals, "PCR4 (TPM_ALG_SHA256): measurement 1 has predicted digest 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae, "+
+		"but the log contains baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096 (event 3, EV_SEPARATOR)")
+}
+
+func (s *eventLogReplaySuite) TestDiffMeasurementsMissingFromLog(c *C) {
+	replay, err := ReplayEventLog(s.newLog())
+	c.Assert(err, IsNil)
+
+	mismatch := replay.DiffMeasurements(tpm2.HashAlgorithmSHA256, 4, tpm2.DigestList{s.digest("bar"), s.digest("baz"), s.digest("foo")})
+	c.Check(mismatch, DeepEquals, &MeasurementMismatch{
+		PCR:       4,
+		Alg:       tpm2.HashAlgorithmSHA256,
+		Index:     2,
+		Predicted: s.digest("foo"),
+	})
+	c.Check(mismatch.String(), Equals, "PCR4 (TPM_ALG_SHA256): measurement 2 with digest 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae is missing from the log")
+}
+
+func (s *eventLogReplaySuite) TestDiffMeasurementsUnexpectedInLog(c *C) {
+	replay, err := ReplayEventLog(s.newLog())
+	c.Assert(err, IsNil)
+
+	mismatch := replay.DiffMeasurements(tpm2.HashAlgorithmSHA256, 4, tpm2.DigestList{s.digest("bar")})
+	c.Check(mismatch, DeepEquals, &MeasurementMismatch{
+		PCR:   4,
+		Alg:   tpm2.HashAlgorithmSHA256,
+		Index: 1,
+		Event: replay.Events(4)[1],
+	})
+	c.Check(mismatch.String(), Equals, "PCR4 (TPM_ALG_SHA256): unexpected measurement 1 in log (event 3, EV_SEPARATOR)")
+}
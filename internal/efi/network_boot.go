@@ -0,0 +1,75 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	efi "github.com/canonical/go-efilib"
+)
+
+// Device path sub-types for the messaging and media device path nodes
+// associated with network boot, which aren't decoded by go-efilib.
+const (
+	msgMACAddrDP efi.DevicePathSubType = 0x0b
+	msgIPv4DP    efi.DevicePathSubType = 0x0c
+	msgIPv6DP    efi.DevicePathSubType = 0x0d
+	msgURIDP     efi.DevicePathSubType = 0x18
+
+	mediaRAMDiskDP efi.DevicePathSubType = 0x09
+)
+
+// TLSCACertificateVariable is the variable containing the CA certificates that
+// are used by the firmware to authenticate servers when booting over HTTPS.
+// Some firmware implementations measure this to PCR7 as part of the secure
+// boot configuration.
+var TLSCACertificateVariable = efi.VariableDescriptor{
+	Name: "TlsCaCertificate",
+	GUID: efi.MakeGUID(0xfd2340d0, 0x3dab, 0x4349, 0xa6c7, [...]uint8{0x3b, 0x4f, 0x12, 0xb4, 0x8e, 0xae}),
+}
+
+func hasGenericNode(path efi.DevicePath, nodeType efi.DevicePathType, subTypes ...efi.DevicePathSubType) bool {
+	for _, node := range path {
+		n, ok := node.(*efi.GenericDevicePathNode)
+		if !ok || n.Type != nodeType {
+			continue
+		}
+		for _, subType := range subTypes {
+			if n.SubType == subType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsNetworkBootDevicePath returns true if the supplied device path refers to
+// a network location, which is the case for load options and image loads
+// associated with PXE or HTTP boot. These contain a MAC address, IPv4, IPv6
+// or URI component.
+func IsNetworkBootDevicePath(path efi.DevicePath) bool {
+	return hasGenericNode(path, efi.MessagingDevicePath, msgMACAddrDP, msgIPv4DP, msgIPv6DP, msgURIDP)
+}
+
+// IsRAMDiskDevicePath returns true if the supplied device path refers to a
+// location inside of a RAM disk. When using HTTP boot to boot a disk image, the
+// firmware downloads the image to a RAM disk and launches the initial boot
+// loader from there.
+func IsRAMDiskDevicePath(path efi.DevicePath) bool {
+	return hasGenericNode(path, efi.MediaDevicePath, mediaRAMDiskDP)
+}
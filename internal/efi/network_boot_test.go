@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+
+	efi "github.com/canonical/go-efilib"
+	. "github.com/snapcore/secboot/internal/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type networkBootSuite struct{}
+
+var _ = Suite(&networkBootSuite{})
+
+func (s *networkBootSuite) pciRoot() efi.DevicePath {
+	return efi.DevicePath{
+		&efi.ACPIDevicePathNode{HID: 0x0a0341d0, UID: 0},
+		&efi.PCIDevicePathNode{Function: 0, Device: 3},
+	}
+}
+
+func (s *networkBootSuite) TestIsNetworkBootDevicePathPXE(c *C) {
+	path := append(s.pciRoot(),
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0b, Data: make([]byte, 33)},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0c, Data: make([]byte, 23)})
+	c.Check(IsNetworkBootDevicePath(path), testutil.IsTrue)
+}
+
+func (s *networkBootSuite) TestIsNetworkBootDevicePathHTTPIPv6(c *C) {
+	path := append(s.pciRoot(),
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0b, Data: make([]byte, 33)},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x0d, Data: make([]byte, 56)},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x18, Data: []byte("http://192.168.1.1/shimx64.efi")})
+	c.Check(IsNetworkBootDevicePath(path), testutil.IsTrue)
+}
+
+func (s *networkBootSuite) TestIsNetworkBootDevicePathShortFormURI(c *C) {
+	// Decode the path from its binary form to make sure that go-efilib
+	// represents it in the way that we expect.
+	path := efi.DevicePath{&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x18, Data: []byte("http://192.168.1.1/boot.iso")}}
+	b, err := path.Bytes()
+	c.Assert(err, IsNil)
+	decoded, err := efi.ReadDevicePath(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+
+	c.Check(IsNetworkBootDevicePath(decoded), testutil.IsTrue)
+	c.Check(decoded.ShortFormType(), Equals, efi.DevicePathShortFormURI)
+}
+
+func (s *networkBootSuite) TestIsNetworkBootDevicePathFalse(c *C) {
+	path := append(s.pciRoot(),
+		&efi.NVMENamespaceDevicePathNode{NamespaceID: 1},
+		&efi.HardDriveDevicePathNode{PartitionNumber: 1, PartitionStart: 0x800, PartitionSize: 0x100000, MBRType: efi.GPT},
+		efi.FilePathDevicePathNode("\\EFI\\ubuntu\\shimx64.efi"))
+	c.Check(IsNetworkBootDevicePath(path), testutil.IsFalse)
+}
+
+func (s *networkBootSuite) TestIsRAMDiskDevicePath(c *C) {
+	path := efi.DevicePath{
+		&efi.GenericDevicePathNode{Type: efi.MediaDevicePath, SubType: 0x09, Data: make([]byte, 34)},
+		&efi.CDROMDevicePathNode{BootEntry: 1, PartitionStart: 0x100, PartitionSize: 0x1000},
+		efi.FilePathDevicePathNode("\\EFI\\BOOT\\BOOTX64.EFI"),
+	}
+	c.Check(IsRAMDiskDevicePath(path), testutil.IsTrue)
+	c.Check(IsNetworkBootDevicePath(path), testutil.IsFalse)
+}
+
+func (s *networkBootSuite) TestIsRAMDiskDevicePathFalse(c *C) {
+	path := append(s.pciRoot(),
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: 0x18, Data: []byte("http://192.168.1.1/shimx64.efi")})
+	c.Check(IsRAMDiskDevicePath(path), testutil.IsFalse)
+}
@@ -22,6 +22,7 @@ package efi
 import (
 	efi "github.com/canonical/go-efilib"
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
 )
 
 type InitialVariablesModifier func(VariableSet) error
@@ -36,6 +37,10 @@ type PCRProfileOptionVisitor interface {
 	// AddInitialVariablesModifier adds a function that will be called to allow
 	// the initial variable set for profile generation to be modified.
 	AddInitialVariablesModifier(fn InitialVariablesModifier)
+
+	// SetEventLog overrides the TCG event log obtained from the host
+	// environment with the supplied log.
+	SetEventLog(log *tcglog.Log)
 }
 
 // VariableSet corresponds to a set of EFI variables.
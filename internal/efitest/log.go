@@ -112,6 +112,7 @@ type LogOptions struct {
 	IncludeOSPresentFirmwareAppLaunch efi.GUID                       // include a flash based application launch in the log as part of the OS-present phase
 	NoSBAT                            bool                           // omit the SbatLevel measurement to mimic older versions of shim
 	PreOSVerificationUsesDigests      crypto.Hash                    // Whether Driver or SysPrep launches are verified using a digest
+	TLSCACertificates                 []byte                         // include a measurement of the TlsCaCertificate variable with the supplied contents
 }
 
 // NewLog creates a mock TCG log for testing. The log will look like a standard
@@ -295,6 +296,16 @@ func NewLog(c *C, opts *LogOptions) *tcglog.Log {
 			data:      data})
 
 	}
+	if len(opts.TLSCACertificates) > 0 {
+		data := &tcglog.EFIVariableData{
+			VariableName: efi.MakeGUID(0xfd2340d0, 0x3dab, 0x4349, 0xa6c7, [...]uint8{0x3b, 0x4f, 0x12, 0xb4, 0x8e, 0xae}),
+			UnicodeName:  "TlsCaCertificate",
+			VariableData: opts.TLSCACertificates}
+		builder.hashLogExtendEvent(c, data, &logEvent{
+			pcrIndex:  7,
+			eventType: tcglog.EventTypeEFIVariableDriverConfig,
+			data:      data})
+	}
 	if !opts.DisallowPreOSVerification {
 		// Most firmware measures a EV_SEPARATOR here to separate config and verification,
 		// but some older firmware implementations don't do this - it gets measured as part
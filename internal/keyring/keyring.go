@@ -20,26 +20,76 @@
 package keyring
 
 import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
 const (
-	userKeyType = "user"
-	userKeyring = -4
+	userKeyType  = "user"
+	logonKeyType = "logon"
+
+	fscryptMaxKeySize = 64
+)
+
+// Keyring identifies a kernel keyring.
+type Keyring int
+
+const (
+	// SessionKeyring is the session keyring of the current process.
+	SessionKeyring Keyring = unix.KEY_SPEC_SESSION_KEYRING
+
+	// UserKeyring is the user keyring of the current user.
+	UserKeyring Keyring = unix.KEY_SPEC_USER_KEYRING
 )
 
-func formatDesc(devicePath, purpose, prefix string) string {
-	return prefix + ":" + devicePath + ":" + purpose
+// PersistentKeyring returns the persistent keyring of the current user,
+// linking it to the session keyring so that its keys can be searched for.
+func PersistentKeyring() (Keyring, error) {
+	id, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_SESSION_KEYRING, 0, 0)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot obtain persistent keyring: %w", err)
+	}
+	return Keyring(id), nil
 }
 
-func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
-	_, err := unix.AddKey(userKeyType, formatDesc(devicePath, purpose, prefix), key, userKeyring)
+// Description is the structured description of a key added by this package,
+// which has the form "<prefix>:<device>:<purpose>[:<instance>]". The instance
+// is optional, and permits more than one key with the same purpose to exist
+// for a device.
+type Description struct {
+	Prefix   string
+	Device   string
+	Purpose  string
+	Instance string
+}
+
+func (d Description) String() string {
+	s := d.Prefix + ":" + d.Device + ":" + d.Purpose
+	if d.Instance != "" {
+		s += ":" + d.Instance
+	}
+	return s
+}
+
+// AddKey adds the supplied key to the specified keyring as a user key with the
+// supplied description. Any existing key with the same description is
+// replaced.
+func AddKey(keyring Keyring, key []byte, desc Description) error {
+	_, err := unix.AddKey(userKeyType, desc.String(), key, int(keyring))
 	return err
 }
 
-func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+// GetKey returns the payload of the user key with the supplied description
+// from the specified keyring.
+func GetKey(keyring Keyring, desc Description) ([]byte, error) {
+	id, err := unix.KeyctlSearch(int(keyring), userKeyType, desc.String(), 0)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot find key: %w", err)
 	}
@@ -57,12 +107,176 @@ func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
 	return key, nil
 }
 
-func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+// RemoveKey unlinks the user key with the supplied description from the
+// specified keyring.
+func RemoveKey(keyring Keyring, desc Description) error {
+	id, err := unix.KeyctlSearch(int(keyring), userKeyType, desc.String(), 0)
 	if err != nil {
 		return xerrors.Errorf("cannot find key: %w", err)
 	}
 
-	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, int(keyring), 0, 0)
 	return err
 }
+
+// FindKeys returns the descriptions of all of the user keys linked directly
+// from the specified keyring with the supplied prefix, device and purpose,
+// regardless of their instance.
+func FindKeys(keyring Keyring, prefix, device, purpose string) ([]Description, error) {
+	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, int(keyring), nil, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine size of keyring: %w", err)
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.KeyctlBuffer(unix.KEYCTL_READ, int(keyring), buf, 0); err != nil {
+		return nil, xerrors.Errorf("cannot read keyring: %w", err)
+	}
+	buf = buf[:sz]
+
+	base := Description{Prefix: prefix, Device: device, Purpose: purpose}.String()
+
+	var out []Description
+	for ; len(buf) >= 4; buf = buf[4:] {
+		id := int(binary.LittleEndian.Uint32(buf))
+
+		// The description has the format "<type>;<uid>;<gid>;<perm>;<description>".
+		info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		if err != nil {
+			// The key may have been removed or we may not have permission
+			// to view it.
+			continue
+		}
+		fields := strings.SplitN(info, ";", 5)
+		if len(fields) != 5 || fields[0] != userKeyType {
+			continue
+		}
+
+		desc := Description{Prefix: prefix, Device: device, Purpose: purpose}
+		switch {
+		case fields[4] == base:
+		case strings.HasPrefix(fields[4], base+":"):
+			desc.Instance = fields[4][len(base)+1:]
+		default:
+			continue
+		}
+		out = append(out, desc)
+	}
+
+	return out, nil
+}
+
+func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
+	return AddKey(UserKeyring, key, Description{Prefix: prefix, Device: devicePath, Purpose: purpose})
+}
+
+// SetKeyTimeout sets a timeout on the key with the supplied description in
+// the specified keyring, after which the kernel expires it. The timeout is
+// rounded up to the nearest second.
+func SetKeyTimeout(keyring Keyring, desc Description, timeout time.Duration) error {
+	id, err := unix.KeyctlSearch(int(keyring), userKeyType, desc.String(), 0)
+	if err != nil {
+		return xerrors.Errorf("cannot find key: %w", err)
+	}
+
+	secs := (timeout + time.Second - 1) / time.Second
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(secs), 0, 0)
+	return err
+}
+
+// PossessorOnlyPerm is a key permission mask that grants all permissions to
+// processes that possess a key, and none to other processes, including those
+// running as the same user.
+const PossessorOnlyPerm uint32 = 0x3f000000
+
+// SetKeyPermissions sets the permission mask of the key with the supplied
+// description in the specified keyring.
+func SetKeyPermissions(keyring Keyring, desc Description, perm uint32) error {
+	id, err := unix.KeyctlSearch(int(keyring), userKeyType, desc.String(), 0)
+	if err != nil {
+		return xerrors.Errorf("cannot find key: %w", err)
+	}
+
+	return unix.KeyctlSetperm(id, perm)
+}
+
+// AddKeyWithPermissions adds the supplied key to the specified keyring as a
+// user key with the supplied description and permission mask. The key is
+// first added with a placeholder payload, and the real payload is only
+// written once the permissions have been applied, so that it is never
+// accessible with the default permissions. Any existing key with the same
+// description is replaced. If an error occurs, the key is removed.
+func AddKeyWithPermissions(keyring Keyring, key []byte, desc Description, perm uint32) error {
+	id, err := unix.AddKey(userKeyType, desc.String(), []byte{0}, int(keyring))
+	if err != nil {
+		return err
+	}
+	if err := unix.KeyctlSetperm(id, perm); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_UNLINK, id, int(keyring), 0, 0)
+		return xerrors.Errorf("cannot set permissions: %w", err)
+	}
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_UPDATE, id, key, 0); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_UNLINK, id, int(keyring), 0, 0)
+		return xerrors.Errorf("cannot update payload: %w", err)
+	}
+	return nil
+}
+
+// SetKeyTimeoutInUserKeyring sets a timeout on the specified key, after which
+// the kernel expires it. The timeout is rounded up to the nearest second.
+func SetKeyTimeoutInUserKeyring(devicePath, purpose, prefix string, timeout time.Duration) error {
+	return SetKeyTimeout(UserKeyring, Description{Prefix: prefix, Device: devicePath, Purpose: purpose}, timeout)
+}
+
+func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
+	return GetKey(UserKeyring, Description{Prefix: prefix, Device: devicePath, Purpose: purpose})
+}
+
+func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
+	return RemoveKey(UserKeyring, Description{Prefix: prefix, Device: devicePath, Purpose: purpose})
+}
+
+// AddUserKeyWithDescToUserKeyring adds the supplied payload to the user
+// keyring as a user key with the supplied description.
+func AddUserKeyWithDescToUserKeyring(payload []byte, desc string) error {
+	_, err := unix.AddKey(userKeyType, desc, payload, int(UserKeyring))
+	return err
+}
+
+// AddFscryptKeyToFilesystem adds the supplied key to the keyring of the
+// filesystem mounted at the specified path for use with a fscrypt v2 encryption
+// policy, using FS_IOC_ADD_ENCRYPTION_KEY. On success, it returns the key
+// identifier computed by the kernel, which identifies the key in an encryption
+// policy.
+func AddFscryptKeyToFilesystem(mountpoint string, key []byte) ([]byte, error) {
+	if len(key) > fscryptMaxKeySize {
+		return nil, errors.New("key is too large")
+	}
+
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The argument is struct fscrypt_add_key_arg, followed by the raw key.
+	var arg unix.FscryptAddKeyArg
+	buf := make([]byte, unsafe.Sizeof(arg)+uintptr(len(key)))
+	defer func() {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}()
+
+	argp := (*unix.FscryptAddKeyArg)(unsafe.Pointer(&buf[0]))
+	argp.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	argp.Raw_size = uint32(len(key))
+	copy(buf[unsafe.Sizeof(arg):], key)
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ADD_ENCRYPTION_KEY, uintptr(unsafe.Pointer(argp))); errno != 0 {
+		return nil, errno
+	}
+
+	identifier := make([]byte, unix.FSCRYPT_KEY_IDENTIFIER_SIZE)
+	copy(identifier, argp.Key_spec.U[:])
+	return identifier, nil
+}
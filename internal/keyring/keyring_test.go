@@ -20,9 +20,16 @@
 package keyring_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -147,6 +154,95 @@ func (s *keyringSuite) TestGetKeyFromUserKeyringNoKey(c *C) {
 	c.Check(e, Equals, syscall.ENOKEY)
 }
 
+func (s *keyringSuite) keyTimeout(c *C, devicePath, purpose, prefix string) string {
+	id, err := unix.KeyctlSearch(-4, "user", prefix+":"+devicePath+":"+purpose, 0)
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile("/proc/keys")
+	c.Assert(err, IsNil)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != fmt.Sprintf("%08x", id) {
+			continue
+		}
+		return fields[3]
+	}
+	c.Fatalf("cannot find key %08x", id)
+	return ""
+}
+
+func (s *keyringSuite) TestSetKeyTimeoutInUserKeyring(c *C) {
+	c.Check(AddKeyToUserKeyring(make([]byte, 32), "/dev/sda1", "recovery", "secboot"), IsNil)
+	defer RemoveKeyFromUserKeyring("/dev/sda1", "recovery", "secboot")
+	c.Check(s.keyTimeout(c, "/dev/sda1", "recovery", "secboot"), Equals, "perm")
+
+	c.Check(SetKeyTimeoutInUserKeyring("/dev/sda1", "recovery", "secboot", 10*time.Minute), IsNil)
+	c.Check(s.keyTimeout(c, "/dev/sda1", "recovery", "secboot"), Matches, `[[:digit:]]+m`)
+
+	key, err := GetKeyFromUserKeyring("/dev/sda1", "recovery", "secboot")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, make([]byte, 32))
+}
+
+func (s *keyringSuite) TestSetKeyTimeoutInUserKeyringNoKey(c *C) {
+	err := SetKeyTimeoutInUserKeyring("/dev/sda1", "foo", "bar", time.Minute)
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+
+	var e syscall.Errno
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+	c.Check(e, Equals, syscall.ENOKEY)
+}
+
+func (s *keyringSuite) TestSetKeyPermissions(c *C) {
+	desc := Description{Prefix: "secboot", Device: "/dev/sda1", Purpose: "recovery"}
+	c.Check(AddKey(UserKeyring, make([]byte, 32), desc), IsNil)
+	defer RemoveKey(UserKeyring, desc)
+
+	c.Check(SetKeyPermissions(UserKeyring, desc, PossessorOnlyPerm), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", desc.String(), 0)
+	c.Assert(err, IsNil)
+	info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Assert(err, IsNil)
+	c.Check(strings.Split(info, ";")[3], Equals, "3f000000")
+
+	key, err := GetKey(UserKeyring, desc)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, make([]byte, 32))
+}
+
+func (s *keyringSuite) TestAddKeyWithPermissions(c *C) {
+	desc := Description{Prefix: "secboot", Device: "/dev/sda1", Purpose: "recovery"}
+	c.Check(AddKeyWithPermissions(UserKeyring, []byte("foo"), desc, PossessorOnlyPerm), IsNil)
+	defer RemoveKey(UserKeyring, desc)
+
+	id, err := unix.KeyctlSearch(-4, "user", desc.String(), 0)
+	c.Assert(err, IsNil)
+	info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Assert(err, IsNil)
+	c.Check(strings.Split(info, ";")[3], Equals, "3f000000")
+
+	key, err := GetKey(UserKeyring, desc)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte("foo"))
+}
+
+func (s *keyringSuite) TestAddKeyWithPermissionsReplace(c *C) {
+	desc := Description{Prefix: "secboot", Device: "/dev/sda1", Purpose: "recovery"}
+	c.Check(AddKeyWithPermissions(UserKeyring, []byte("foo"), desc, PossessorOnlyPerm), IsNil)
+	defer RemoveKey(UserKeyring, desc)
+	c.Check(AddKeyWithPermissions(UserKeyring, []byte("bar"), desc, PossessorOnlyPerm), IsNil)
+
+	key, err := GetKey(UserKeyring, desc)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte("bar"))
+}
+
+func (s *keyringSuite) TestSetKeyPermissionsNoKey(c *C) {
+	err := SetKeyPermissions(UserKeyring, Description{Prefix: "bar", Device: "/dev/sda1", Purpose: "foo"}, PossessorOnlyPerm)
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
 type testRemoveKeyFromUserKeyringData struct {
 	devicePath string
 	purpose    string
@@ -183,3 +279,72 @@ func (s *keyringSuite) TestRemoveKeyFromUserKeyringNoKey(c *C) {
 	c.Check(xerrors.As(err, &e), testutil.IsTrue)
 	c.Check(e, Equals, syscall.ENOKEY)
 }
+
+func (s *keyringSuite) TestAddFscryptKeyToFilesystemTooLarge(c *C) {
+	_, err := AddFscryptKeyToFilesystem(c.MkDir(), make([]byte, 65))
+	c.Check(err, ErrorMatches, "key is too large")
+}
+
+func (s *keyringSuite) TestAddFscryptKeyToFilesystemNoMountpoint(c *C) {
+	_, err := AddFscryptKeyToFilesystem(filepath.Join(c.MkDir(), "missing"), make([]byte, 64))
+	c.Check(os.IsNotExist(err), testutil.IsTrue)
+}
+
+func (s *keyringSuite) TestDescriptionString(c *C) {
+	desc := Description{Prefix: "secboot", Device: "/dev/sda1", Purpose: "unlock"}
+	c.Check(desc.String(), Equals, "secboot:/dev/sda1:unlock")
+
+	desc.Instance = "snap-bootstrap"
+	c.Check(desc.String(), Equals, "secboot:/dev/sda1:unlock:snap-bootstrap")
+}
+
+func (s *keyringSuite) TestAddKeyWithInstance(c *C) {
+	desc := Description{Prefix: "secboot", Device: "/dev/sda1", Purpose: "unlock", Instance: "foo"}
+	c.Check(AddKey(UserKeyring, []byte{1, 2, 3}, desc), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", "secboot:/dev/sda1:unlock:foo", 0)
+	c.Check(err, IsNil)
+	c.Check(id, testutil.InSlice(Equals), testutil.GetKeyringKeys(c, testutil.UserKeyring))
+
+	key, err := GetKey(UserKeyring, desc)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, []byte{1, 2, 3})
+
+	// The key can't be found without the instance.
+	desc.Instance = ""
+	_, err = GetKey(UserKeyring, desc)
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestFindKeys(c *C) {
+	for _, desc := range []Description{
+		{Prefix: "secboot", Device: "/dev/sda1", Purpose: "unlock"},
+		{Prefix: "secboot", Device: "/dev/sda1", Purpose: "unlock", Instance: "foo"},
+		{Prefix: "secboot", Device: "/dev/sda1", Purpose: "unlock", Instance: "bar"},
+		{Prefix: "secboot", Device: "/dev/sda1", Purpose: "aux", Instance: "foo"},
+		{Prefix: "secboot", Device: "/dev/sda12", Purpose: "unlock"},
+		{Prefix: "other", Device: "/dev/sda1", Purpose: "unlock"},
+	} {
+		c.Check(AddKey(UserKeyring, make([]byte, 32), desc), IsNil)
+	}
+
+	descs, err := FindKeys(UserKeyring, "secboot", "/dev/sda1", "unlock")
+	c.Check(err, IsNil)
+	c.Check(descs, HasLen, 3)
+
+	var instances []string
+	for _, desc := range descs {
+		c.Check(desc.Prefix, Equals, "secboot")
+		c.Check(desc.Device, Equals, "/dev/sda1")
+		c.Check(desc.Purpose, Equals, "unlock")
+		instances = append(instances, desc.Instance)
+	}
+	sort.Strings(instances)
+	c.Check(instances, DeepEquals, []string{"", "bar", "foo"})
+}
+
+func (s *keyringSuite) TestFindKeysNone(c *C) {
+	descs, err := FindKeys(UserKeyring, "secboot", "/dev/sda1", "unlock")
+	c.Check(err, IsNil)
+	c.Check(descs, HasLen, 0)
+}
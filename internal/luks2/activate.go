@@ -21,39 +21,73 @@ package luks2
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 
 	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
 )
 
 var (
+	// ErrMissingSystemdCryptsetup is returned from Activate, ActivateWithKeyFile
+	// and Deactivate if the systemd-cryptsetup binary can't be found.
+	ErrMissingSystemdCryptsetup = errors.New("cannot perform the requested operation because systemd-cryptsetup is not available")
+
 	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
 )
 
-// Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
-// mapping with the supplied volumeName. The device is unlocked using the supplied key. The slot
-// arguments specifies which keyslot ID to use - set this to AnySlot to activate with any keyslot.
-func Activate(volumeName, sourceDevicePath string, key []byte, slot int) error {
+// SystemdCryptsetupAvailable indicates whether the systemd-cryptsetup binary,
+// which is required to activate and deactivate volumes, is present.
+func SystemdCryptsetupAvailable() bool {
+	_, err := exec.LookPath(systemdCryptsetupPath)
+	return err == nil
+}
+
+func systemdCryptsetupCmdError(output []byte, err error) error {
+	if xerrors.Is(err, exec.ErrNotFound) || xerrors.Is(err, os.ErrNotExist) {
+		return ErrMissingSystemdCryptsetup
+	}
+	return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+}
+
+func activate(volumeName, sourceDevicePath, keyFile string, stdin io.Reader, slot int) error {
 	cmd := exec.Command(systemdCryptsetupPath,
 		// attach <sourceDevicePath> to /dev/mapper/<volumeName>
 		"attach", volumeName, sourceDevicePath,
-		// read key from stdin
-		"/dev/stdin",
+		// read key from the supplied file
+		keyFile,
 		// hardcode luks, one try and specify the keyslot to use
 		fmt.Sprintf("luks,keyslot=%d,tries=1", slot))
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
-	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stdin = stdin
 
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+		return systemdCryptsetupCmdError(output, err)
 	}
 
 	return nil
 }
 
+// Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
+// mapping with the supplied volumeName. The device is unlocked using the supplied key. The slot
+// arguments specifies which keyslot ID to use - set this to AnySlot to activate with any keyslot.
+func Activate(volumeName, sourceDevicePath string, key []byte, slot int) error {
+	return activate(volumeName, sourceDevicePath, "/dev/stdin", bytes.NewReader(key), slot)
+}
+
+// ActivateWithKeyFile unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates
+// a device mapping with the supplied volumeName. The device is unlocked using the key stored in the
+// file at keyFile, which the caller is responsible for creating and removing. The slot argument
+// specifies which keyslot ID to use - set this to AnySlot to activate with any keyslot.
+func ActivateWithKeyFile(volumeName, sourceDevicePath, keyFile string, slot int) error {
+	return activate(volumeName, sourceDevicePath, keyFile, nil, slot)
+}
+
 // Deactivate detaches the LUKS volume with the supplied name.
 func Deactivate(volumeName string) error {
 	cmd := exec.Command(systemdCryptsetupPath, "detach", volumeName)
@@ -61,7 +95,7 @@ func Deactivate(volumeName string) error {
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
 
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+		return systemdCryptsetupCmdError(output, err)
 	}
 
 	return nil
@@ -139,6 +139,31 @@ func (s *activateSuite) TestActivateWrongKey(c *C) {
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,keyslot=-1,tries=1"})
 }
 
+func (s *activateSuite) TestActivateWithKeyFile(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	keyFile := filepath.Join(c.MkDir(), "key")
+	c.Assert(ioutil.WriteFile(keyFile, key, 0600), IsNil)
+
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", keyFile, 1), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", keyFile, "luks,keyslot=1,tries=1"})
+}
+
+func (s *activateSuite) TestActivateWithKeyFileWrongKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	keyFile := filepath.Join(c.MkDir(), "key")
+	c.Assert(ioutil.WriteFile(keyFile, make([]byte, 32), 0600), IsNil)
+
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", keyFile, AnySlot), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+}
+
 func (s *activateSuite) TestDeactivate(c *C) {
 	c.Assert(Deactivate("data"), IsNil)
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
@@ -154,3 +179,19 @@ func (s *activateSuite) TestDeactivateErr(c *C) {
 		"systemd-cryptsetup", "detach", "bad-volume",
 	})
 }
+
+func (s *activateSuite) TestSystemdCryptsetupAvailable(c *C) {
+	c.Check(SystemdCryptsetupAvailable(), Equals, true)
+
+	restore := MockSystemdCryptsetupPath(filepath.Join(c.MkDir(), "systemd-cryptsetup"))
+	defer restore()
+	c.Check(SystemdCryptsetupAvailable(), Equals, false)
+}
+
+func (s *activateSuite) TestActivateMissingSystemdCryptsetup(c *C) {
+	restore := MockSystemdCryptsetupPath(filepath.Join(c.MkDir(), "systemd-cryptsetup"))
+	defer restore()
+
+	c.Check(Activate("data", "/dev/sda1", make([]byte, 32), AnySlot), Equals, ErrMissingSystemdCryptsetup)
+	c.Check(Deactivate("data"), Equals, ErrMissingSystemdCryptsetup)
+}
@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
@@ -33,6 +34,7 @@ import (
 
 	"github.com/snapcore/snapd/osutil"
 
+	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
@@ -52,6 +54,12 @@ var (
 	// required features.
 	ErrMissingCryptsetupFeature = errors.New("cannot perform the requested operation because a required feature is missing from cryptsetup")
 
+	// ErrMissingCryptsetup is returned from functions that make use of the
+	// system's cryptsetup binary, if that binary can't be found.
+	ErrMissingCryptsetup = errors.New("cannot perform the requested operation because cryptsetup is not available")
+
+	cryptsetupPath = "cryptsetup"
+
 	features     Features
 	featuresOnce sync.Once
 )
@@ -81,23 +89,35 @@ const (
 // from it is supplied to cryptsetup via its stdin. If callback is supplied, it will be invoked
 // after cryptsetup has started.
 func cryptsetupCmd(stdin io.Reader, args ...string) error {
-	cmd := exec.Command("cryptsetup", args...)
+	cmd := exec.Command(cryptsetupPath, args...)
 	cmd.Stdin = stdin
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	output, err := cmd.CombinedOutput()
+	switch {
+	case err == nil:
+	case xerrors.Is(err, exec.ErrNotFound), xerrors.Is(err, os.ErrNotExist):
+		return ErrMissingCryptsetup
+	default:
 		return fmt.Errorf("cryptsetup failed with: %v", osutil.OutputErr(output, err))
 	}
 
 	return nil
 }
 
+// CryptsetupAvailable indicates whether the cryptsetup binary, which is
+// required to create and modify LUKS2 containers, is present.
+func CryptsetupAvailable() bool {
+	_, err := exec.LookPath(cryptsetupPath)
+	return err == nil
+}
+
 // DetectCryptsetupFeatures returns the features supported by the cryptsetup binary
 // on this system.
 func DetectCryptsetupFeatures() Features {
 	featuresOnce.Do(func() {
 		features = 0
 
-		cmd := exec.Command("cryptsetup", "--version")
+		cmd := exec.Command(cryptsetupPath, "--version")
 		out, err := cmd.CombinedOutput()
 		if err == nil {
 			var major, minor, patch int
@@ -239,9 +259,59 @@ type FormatOptions struct {
 
 	// InlineCryptoEngine set flag if to use Inline Crypto Engine
 	InlineCryptoEngine bool
+
+	// Cipher sets the cipher used to encrypt data, which must be one of
+	// "aes-xts-plain64", "aes-cbc-essiv:sha256",
+	// "xchacha12,aes-adiantum-plain64" or "xchacha20,aes-adiantum-plain64".
+	// Set to an empty string to use the default for the current
+	// architecture. If set, it is verified that the kernel supports the
+	// cipher.
+	Cipher string
+
+	// KeySize sets the size of the volume key in bits. Set to zero to use
+	// the default for the selected cipher.
+	KeySize int
+
+	// SectorSize sets the encryption sector size in bytes. Set to zero to
+	// use the cryptsetup default. Must be a power of 2 between 512 and
+	// 4096 bytes.
+	SectorSize uint32
+}
+
+// cipherAndKeySize returns the cipher and the size of the volume key in bytes
+// that are selected by these options.
+func (options *FormatOptions) cipherAndKeySize() (cipher string, size int) {
+	cipher = options.Cipher
+	if cipher == "" {
+		cipher = selectCipher()
+	}
+	size = options.KeySize / 8
+	if size == 0 {
+		size = supportedCiphers[cipher].defaultKeySize
+	}
+	return cipher, size
 }
 
-func (options *FormatOptions) validate(cipher string) error {
+func (options *FormatOptions) validate(cipher string, keySize int) error {
+	info, ok := supportedCiphers[cipher]
+	if !ok {
+		return fmt.Errorf("cannot use unsupported cipher %q", cipher)
+	}
+	if options.KeySize%8 != 0 || !info.supportsKeySize(keySize) {
+		return fmt.Errorf("cannot set key size to %d bits for cipher %s", options.KeySize, cipher)
+	}
+	if options.Cipher != "" {
+		if err := checkKernelCipherSupport(info.kernelName); err != nil {
+			return xerrors.Errorf("cannot use cipher %s: %w", cipher, err)
+		}
+	}
+
+	switch options.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("cannot set sector size to %d bytes", options.SectorSize)
+	}
+
 	if (options.MetadataKiBSize != 0 || options.KeyslotsAreaKiBSize != 0) &&
 		DetectCryptsetupFeatures()&FeatureHeaderSizeSetting == 0 {
 		return ErrMissingCryptsetupFeature
@@ -264,7 +334,7 @@ func (options *FormatOptions) validate(cipher string) error {
 	if options.KeyslotsAreaKiBSize != 0 {
 		// Verify that the size is sufficient for a single keyslot, not more than 128MiB
 		// and a multiple of 4KiB.
-		if options.KeyslotsAreaKiBSize < uint32((keySize(cipher)*4000)/1024) ||
+		if options.KeyslotsAreaKiBSize < uint32((keySize*4000)/1024) ||
 			options.KeyslotsAreaKiBSize > 128*1024 || options.KeyslotsAreaKiBSize%4 != 0 {
 			return fmt.Errorf("cannot set keyslots area size to %v KiB", options.KeyslotsAreaKiBSize)
 		}
@@ -288,6 +358,10 @@ func (options *FormatOptions) appendArguments(args []string) []string {
 		// use inline crypto engine
 		args = append(args, "--inline-crypto-engine")
 	}
+	if options.SectorSize != 0 {
+		// override the default encryption sector size if specified
+		args = append(args, "--sector-size", strconv.FormatUint(uint64(options.SectorSize), 10))
+	}
 
 	return args
 }
@@ -315,25 +389,64 @@ func selectCipher() string {
 	}
 }
 
-// keySize returns the size of the key in bytes for the given encryption
-// algorithm. It will panic if an unsupported cipher is passed in.
-func keySize(cipher string) int {
-	switch cipher {
-	case "aes-xts-plain64":
-		return 64
-	case "aes-cbc-essiv:sha256":
-		return 32
-	default:
-		panic(fmt.Sprintf("internal error: unknown keysize for cipher %v", cipher))
+// cipherInfo describes a cipher that can be selected with FormatOptions.
+type cipherInfo struct {
+	kernelName     string // The name of the cipher in the kernel crypto API
+	defaultKeySize int    // The default key size in bytes
+	keySizes       []int  // The supported key sizes in bytes
+}
+
+func (i cipherInfo) supportsKeySize(size int) bool {
+	for _, s := range i.keySizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+var supportedCiphers = map[string]cipherInfo{
+	// XTS requires 2 keys, so this is AES-128 or AES-256.
+	"aes-xts-plain64": {kernelName: "xts(aes)", defaultKeySize: 64, keySizes: []int{32, 64}},
+	// The ESSIV IV generator is implemented by dm-crypt on older kernels,
+	// so only check for the underlying cipher.
+	"aes-cbc-essiv:sha256": {kernelName: "cbc(aes)", defaultKeySize: 32, keySizes: []int{16, 24, 32}},
+	// Adiantum is suitable for devices without AES acceleration.
+	"xchacha12,aes-adiantum-plain64": {kernelName: "adiantum(xchacha12,aes)", defaultKeySize: 32, keySizes: []int{32}},
+	"xchacha20,aes-adiantum-plain64": {kernelName: "adiantum(xchacha20,aes)", defaultKeySize: 32, keySizes: []int{32}},
+}
+
+// checkKernelCipherSupport checks that the kernel crypto API supports the
+// named symmetric cipher by binding an AF_ALG socket to it, which also causes
+// the kernel to load any required modules. If the kernel doesn't support
+// AF_ALG sockets, then this check is skipped and cryptsetup will report any
+// error.
+var checkKernelCipherSupport = func(name string) error {
+	fd, err := unix.Socket(unix.AF_ALG, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err == unix.EAFNOSUPPORT {
+		return nil
+	}
+	if err != nil {
+		return os.NewSyscallError("socket", err)
 	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrALG{Type: "skcipher", Name: name}); err != nil {
+		if err == unix.ENOENT {
+			return fmt.Errorf("%s is not supported by the kernel", name)
+		}
+		return os.NewSyscallError("bind", err)
+	}
+	return nil
 }
 
 // Format will initialize a LUKS2 container with the specified options and set the primary key to the
 // supplied key. The label for the new container will be set to the supplied label. This can only be
 // called on a device that is not mapped.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode. The
-// KDF for the primary keyslot will be configured to use argon2i with the supplied benchmark time.
+// By default, the container will be configured to encrypt data with AES-256 and XTS block cipher
+// mode. A different cipher, key size and sector size can be selected with opts. The KDF for the
+// primary keyslot will be configured to use argon2i with the supplied benchmark time.
 //
 // WARNING: This function is destructive. Calling this on an existing LUKS2 container will make the
 // data contained inside of it irretrievable.
@@ -343,12 +456,11 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		opts = &defaultOpts
 	}
 
-	cipher := selectCipher()
-	if err := opts.validate(cipher); err != nil {
+	cipher, ksize := opts.cipherAndKeySize()
+	if err := opts.validate(cipher, ksize); err != nil {
 		return err
 	}
 
-	ksize := keySize(cipher)
 	args := []string{
 		// batch processing, no password verification for formatting an existing LUKS container
 		"--batch-mode",
@@ -496,6 +608,18 @@ func KillSlot(devicePath string, slot int) error {
 	return cryptsetupCmd(nil, "luksKillSlot", "--batch-mode", "--type", "luks2", devicePath, strconv.Itoa(slot))
 }
 
+// TestKey checks that the supplied key can be used to unlock the specified LUKS2
+// container without activating it. The slot argument specifies which keyslot ID
+// to test - set this to AnySlot to test against any keyslot.
+func TestKey(devicePath string, key []byte, slot int) error {
+	args := []string{"open", "--test-passphrase", "--type", "luks2", "--key-file", "-"}
+	if slot != AnySlot {
+		args = append(args, "--key-slot", strconv.Itoa(slot))
+	}
+	args = append(args, devicePath)
+	return cryptsetupCmd(bytes.NewReader(key), args...)
+}
+
 // SetSlotPriority sets the priority of the keyslot with the supplied slot number on
 // the specified LUKS2 container.
 func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
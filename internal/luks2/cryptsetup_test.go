@@ -148,6 +148,19 @@ func (s *cryptsetupSuite) TestDetectCryptsetupFeaturesNoTokenReplace(c *C) {
 	s.testDetectCryptsetupFeatures(c, FeatureHeaderSizeSetting|FeatureTokenImport)
 }
 
+func (s *cryptsetupSuite) TestCryptsetupAvailable(c *C) {
+	restore := MockCryptsetupPath(filepath.Join(c.MkDir(), "cryptsetup"))
+	defer restore()
+	c.Check(CryptsetupAvailable(), Equals, false)
+}
+
+func (s *cryptsetupSuite) TestMissingCryptsetup(c *C) {
+	restore := MockCryptsetupPath(filepath.Join(c.MkDir(), "cryptsetup"))
+	defer restore()
+
+	c.Check(KillSlot("/dev/sda1", 0), Equals, ErrMissingCryptsetup)
+}
+
 func (s *cryptsetupSuite) TestFormatOptionsValidateGood(c *C) {
 	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
 
@@ -332,8 +345,19 @@ func (s *cryptsetupSuiteBase) testFormat(c *C, data *testFormatData) {
 
 	c.Check(Format(devicePath, data.label, data.key, data.options), IsNil)
 
-	cipher := SelectCipher()
-	keysize := KeySize(cipher)
+	options := data.options
+	if options == nil {
+		options = new(FormatOptions)
+	}
+
+	cipher := options.Cipher
+	if cipher == "" {
+		cipher = SelectCipher()
+	}
+	keysize := options.KeySize / 8
+	if keysize == 0 {
+		keysize = KeySize(cipher)
+	}
 	cmd := []string{"cryptsetup", "--batch-mode", "luksFormat", "--type", "luks2",
 		"--key-file", "-", "--cipher", cipher, "--key-size", strconv.Itoa(keysize * 8),
 		"--label", data.label}
@@ -341,11 +365,6 @@ func (s *cryptsetupSuiteBase) testFormat(c *C, data *testFormatData) {
 	cmd = append(cmd, devicePath)
 	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{cmd})
 
-	options := data.options
-	if options == nil {
-		options = new(FormatOptions)
-	}
-
 	info, err := ReadHeader(devicePath, LockModeBlocking)
 	c.Assert(err, IsNil)
 
@@ -395,6 +414,9 @@ func (s *cryptsetupSuiteBase) testFormat(c *C, data *testFormatData) {
 	segment, ok := info.Metadata.Segments[0]
 	c.Assert(ok, Equals, true)
 	c.Check(segment.Encryption, Equals, cipher)
+	if options.SectorSize > 0 {
+		c.Check(segment.SectorSize, Equals, int(options.SectorSize))
+	}
 
 	c.Check(info.Metadata.Tokens, HasLen, 0)
 
@@ -597,6 +619,21 @@ func (s *cryptsetupSuite) TestFormatWithInvalidKeyslotsAreaSize(c *C) {
 	c.Check(Format(devicePath, "", make([]byte, 32), &FormatOptions{KeyslotsAreaKiBSize: 41}), ErrorMatches, "cannot set keyslots area size to 41 KiB")
 }
 
+func (s *cryptsetupSuite) TestFormatWithCipherAndSectorSize(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000},
+			Cipher:     "aes-xts-plain64",
+			KeySize:    256,
+			SectorSize: 4096},
+		extraArgs: []string{"--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "--sector-size", "4096"},
+	})
+}
+
 func (s *cryptsetupSuite) TestFormatWithInlineCryptoEngine(c *C) {
 	mockCryptsetup := snapd_testutil.MockCommand(c, "cryptsetup", "echo cryptsetup 2.6.1")
 	defer mockCryptsetup.Restore()
@@ -1243,6 +1280,44 @@ func (s *cryptsetupSuite) TestKillNonExistantSlot(c *C) {
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
 }
 
+func (s *cryptsetupSuite) TestTestKey(c *C) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	s.cryptsetup.ForgetCalls()
+
+	c.Check(TestKey(devicePath, key2, 1), IsNil)
+	c.Check(TestKey(devicePath, key1, AnySlot), IsNil)
+
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-file", "-", "--key-slot", "1", devicePath},
+		{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-file", "-", devicePath},
+	})
+}
+
+func (s *cryptsetupSuite) TestTestKeyWrongSlot(c *C) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	c.Check(TestKey(devicePath, key2, 0), ErrorMatches, "cryptsetup failed with: .*")
+}
+
 type testSetSlotPriorityData struct {
 	slotId   int
 	priority SlotPriority
@@ -1337,3 +1412,63 @@ func (s *cipherSuite) TestSelectCipherAndKeysize(c *C) {
 		c.Check(keysize, Equals, tc.expectedKeysize)
 	}
 }
+
+func (s *cipherSuite) TestFormatOptionsValidateCipherGood(c *C) {
+	s.AddCleanup(MockRuntimeGOARCH("amd64"))
+
+	var names []string
+	s.AddCleanup(MockCheckKernelCipherSupport(func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+
+	for _, opts := range []FormatOptions{
+		{},
+		{KeySize: 256},
+		{SectorSize: 512},
+		{SectorSize: 4096},
+		{Cipher: "aes-xts-plain64"},
+		{Cipher: "aes-xts-plain64", KeySize: 256},
+		{Cipher: "aes-cbc-essiv:sha256", KeySize: 128},
+		{Cipher: "xchacha12,aes-adiantum-plain64", SectorSize: 4096},
+		{Cipher: "xchacha20,aes-adiantum-plain64", KeySize: 256},
+	} {
+		c.Check(opts.Validate(), IsNil, Commentf("opts: %#v", opts))
+	}
+	c.Check(names, DeepEquals, []string{"xts(aes)", "xts(aes)", "cbc(aes)", "adiantum(xchacha12,aes)", "adiantum(xchacha20,aes)"})
+}
+
+func (s *cipherSuite) TestFormatOptionsValidateBadCipher(c *C) {
+	opts := FormatOptions{Cipher: "twofish-xts-plain64"}
+	c.Check(opts.Validate(), ErrorMatches, `cannot use unsupported cipher "twofish-xts-plain64"`)
+}
+
+func (s *cipherSuite) TestFormatOptionsValidateBadKeySize(c *C) {
+	s.AddCleanup(MockRuntimeGOARCH("amd64"))
+	s.AddCleanup(MockCheckKernelCipherSupport(func(string) error { return nil }))
+
+	for _, opts := range []FormatOptions{
+		{KeySize: 128},
+		{KeySize: 257},
+		{Cipher: "aes-cbc-essiv:sha256", KeySize: 512},
+		{Cipher: "xchacha12,aes-adiantum-plain64", KeySize: 512},
+	} {
+		c.Check(opts.Validate(), ErrorMatches, fmt.Sprintf(`cannot set key size to %d bits for cipher .*`, opts.KeySize), Commentf("opts: %#v", opts))
+	}
+}
+
+func (s *cipherSuite) TestFormatOptionsValidateBadSectorSize(c *C) {
+	for _, sz := range []uint32{256, 1000, 8192} {
+		opts := FormatOptions{SectorSize: sz}
+		c.Check(opts.Validate(), ErrorMatches, fmt.Sprintf(`cannot set sector size to %d bytes`, sz))
+	}
+}
+
+func (s *cipherSuite) TestFormatOptionsValidateCipherNotSupportedByKernel(c *C) {
+	s.AddCleanup(MockCheckKernelCipherSupport(func(name string) error {
+		return fmt.Errorf("%s is not supported by the kernel", name)
+	}))
+
+	opts := FormatOptions{Cipher: "xchacha12,aes-adiantum-plain64"}
+	c.Check(opts.Validate(), ErrorMatches, `cannot use cipher xchacha12,aes-adiantum-plain64: adiantum\(xchacha12,aes\) is not supported by the kernel`)
+}
@@ -0,0 +1,101 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/testhooks"
+)
+
+var (
+	// ErrDeviceNeverAppeared is returned from WaitForDevice if the device
+	// doesn't appear before the timeout expires.
+	ErrDeviceNeverAppeared = errors.New("device never appeared")
+
+	udevadmPath        = "udevadm"
+	devicePollInterval = 100 * time.Millisecond
+
+	timeNow = testhooks.Now
+)
+
+// udevSettle waits for up to timeout for pending udev events to be processed,
+// or until the specified path exists. Failures are not fatal because the
+// caller polls for the device anyway.
+func udevSettle(path string, timeout time.Duration) {
+	cmd := exec.Command(udevadmPath, "settle",
+		fmt.Sprintf("--timeout=%d", timeout/time.Second),
+		"--exit-if-exists="+path)
+	output, err := cmd.CombinedOutput()
+	switch {
+	case err == nil:
+	case xerrors.Is(err, exec.ErrNotFound), xerrors.Is(err, os.ErrNotExist):
+		// No udev, eg, in a container.
+	default:
+		fmt.Fprintf(stderr, "luks2.WaitForDevice: udevadm settle failed: %v\n", osutil.OutputErr(output, err))
+	}
+}
+
+// WaitForDevice waits for up to timeout for the device at the specified path to
+// appear. The path will generally be a /dev/disk/by-uuid or /dev/disk/by-label
+// symlink for a device that may be slow to be probed, such as a USB disk. This
+// first waits for pending udev events to be processed with "udevadm settle", and
+// then polls for the device until the timeout expires.
+//
+// If the device doesn't appear before the timeout expires, an error that wraps
+// ErrDeviceNeverAppeared will be returned.
+func WaitForDevice(path string, timeout time.Duration) error {
+	deadline := timeNow().Add(timeout)
+	settled := false
+
+	for {
+		_, err := os.Stat(path)
+		switch {
+		case err == nil:
+			return nil
+		case !os.IsNotExist(err):
+			return err
+		}
+
+		remaining := deadline.Sub(timeNow())
+		if remaining <= 0 {
+			return xerrors.Errorf("%s: %w", path, ErrDeviceNeverAppeared)
+		}
+
+		if !settled {
+			udevSettle(path, remaining)
+			settled = true
+			continue
+		}
+
+		if remaining > devicePollInterval {
+			remaining = devicePollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/testutil"
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type deviceSuite struct {
+	snapd_testutil.BaseTest
+
+	dir         string
+	mockUdevadm *snapd_testutil.MockCmd
+}
+
+func (s *deviceSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.dir = c.MkDir()
+	s.mockUdevadm = snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "udevadm"), "")
+	s.AddCleanup(s.mockUdevadm.Restore)
+	s.AddCleanup(MockUdevadmPath(s.mockUdevadm.Exe()))
+}
+
+var _ = Suite(&deviceSuite{})
+
+func (s *deviceSuite) TestWaitForDeviceExists(c *C) {
+	path := filepath.Join(s.dir, "foo")
+	c.Assert(os.WriteFile(path, nil, 0644), IsNil)
+
+	c.Check(WaitForDevice(path, time.Second), IsNil)
+	c.Check(s.mockUdevadm.Calls(), HasLen, 0)
+}
+
+func (s *deviceSuite) TestWaitForDeviceAppearsAfterSettle(c *C) {
+	path := filepath.Join(s.dir, "foo")
+	s.mockUdevadm = snapd_testutil.MockCommand(c, s.mockUdevadm.Exe(), `touch "`+path+`"`)
+
+	c.Check(WaitForDevice(path, 5*time.Second), IsNil)
+	c.Check(s.mockUdevadm.Calls(), DeepEquals, [][]string{
+		{"udevadm", "settle", "--timeout=4", "--exit-if-exists=" + path},
+	})
+}
+
+func (s *deviceSuite) TestWaitForDeviceAppearsLater(c *C) {
+	path := filepath.Join(s.dir, "foo")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		os.WriteFile(path, nil, 0644)
+	}()
+
+	c.Check(WaitForDevice(path, 5*time.Second), IsNil)
+	c.Check(s.mockUdevadm.Calls(), HasLen, 1)
+}
+
+func (s *deviceSuite) TestWaitForDeviceNeverAppears(c *C) {
+	path := filepath.Join(s.dir, "foo")
+
+	err := WaitForDevice(path, 300*time.Millisecond)
+	c.Check(err, ErrorMatches, path+`: device never appeared`)
+	c.Check(err, testutil.ErrorIs, ErrDeviceNeverAppeared)
+}
+
+func (s *deviceSuite) TestWaitForDeviceNoUdevadm(c *C) {
+	s.AddCleanup(MockUdevadmPath(filepath.Join(s.dir, "udevadm")))
+	path := filepath.Join(s.dir, "foo")
+
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	c.Check(WaitForDevice(path, 200*time.Millisecond), ErrorMatches, path+`: device never appeared`)
+	c.Check(stderr.String(), Equals, "")
+}
+
+func (s *deviceSuite) TestWaitForDeviceSettleFails(c *C) {
+	s.mockUdevadm = snapd_testutil.MockCommand(c, s.mockUdevadm.Exe(), `echo "some error" >&2; exit 1`)
+	path := filepath.Join(s.dir, "foo")
+
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	c.Check(WaitForDevice(path, 200*time.Millisecond), ErrorMatches, path+`: device never appeared`)
+	c.Check(stderr.String(), Equals, "luks2.WaitForDevice: udevadm settle failed: some error\n")
+}
@@ -30,11 +30,11 @@ import (
 var (
 	AcquireSharedLock = acquireSharedLock
 	SelectCipher      = selectCipher
-	KeySize           = keySize
 )
 
-func (o *FormatOptions) Validate(cipher string) error {
-	return o.validate(cipher)
+func (o *FormatOptions) Validate() error {
+	cipher, keySize := o.cipherAndKeySize()
+	return o.validate(cipher, keySize)
 }
 
 func MockDataDeviceInfo(stMock *unix.Stat_t) (restore func()) {
@@ -80,6 +80,14 @@ func MockSystemdCryptsetupPath(path string) (restore func()) {
 	}
 }
 
+func MockCryptsetupPath(path string) (restore func()) {
+	origCryptsetupPath := cryptsetupPath
+	cryptsetupPath = path
+	return func() {
+		cryptsetupPath = origCryptsetupPath
+	}
+}
+
 func MockStderr(w io.Writer) (restore func()) {
 	origStderr := stderr
 	stderr = w
@@ -92,6 +100,18 @@ func ResetCryptsetupFeatures() {
 	featuresOnce = sync.Once{}
 }
 
+func KeySize(cipher string) int {
+	return supportedCiphers[cipher].defaultKeySize
+}
+
+func MockCheckKernelCipherSupport(fn func(string) error) (restore func()) {
+	orig := checkKernelCipherSupport
+	checkKernelCipherSupport = fn
+	return func() {
+		checkKernelCipherSupport = orig
+	}
+}
+
 func MockRuntimeGOARCH(arch string) (restore func()) {
 	oldRuntimeGOARCH := runtimeGOARCH
 	runtimeGOARCH = arch
@@ -99,3 +119,19 @@ func MockRuntimeGOARCH(arch string) (restore func()) {
 		runtimeGOARCH = oldRuntimeGOARCH
 	}
 }
+
+func MockUdevadmPath(path string) (restore func()) {
+	origUdevadmPath := udevadmPath
+	udevadmPath = path
+	return func() {
+		udevadmPath = origUdevadmPath
+	}
+}
+
+func MockBlkdiscardPath(path string) (restore func()) {
+	origBlkdiscardPath := blkdiscardPath
+	blkdiscardPath = path
+	return func() {
+		blkdiscardPath = origBlkdiscardPath
+	}
+}
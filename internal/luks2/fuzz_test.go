@@ -0,0 +1,40 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package luks2_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+// The following functions are entry points for go's native fuzzing support,
+// and can be run with "go test -run=- -fuzz=<name>". Without -fuzz, they are
+// run as tests with the seed inputs.
+
+func FuzzMetadataUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`{"keyslots":{"0":{"type":"luks2","key_size":64,"area":{"type":"raw","offset":"32768","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"argon2i","time":4,"memory":32,"cpus":1,"salt":"AAAA"},"af":{"type":"luks1","stripes":4000,"hash":"sha256"}}},"segments":{},"digests":{},"tokens":{"0":{"type":"foo","keyslots":["0"]}},"config":{"json_size":"12288","keyslots_size":"3129344"}}`))
+	f.Add([]byte(`{"keyslots":{"0":null},"tokens":{"0":null}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Metadata
+		json.Unmarshal(data, &m)
+	})
+}
@@ -331,6 +331,10 @@ func (a csumAlg) GetHash() crypto.Hash {
 	return Hash(strings.TrimRight(string(a[:]), "\x00")).GetHash()
 }
 
+// maxHdrSize is the largest header size (binary header and JSON metadata area)
+// permitted by the LUKS2 On-Disk Format specification.
+const maxHdrSize = 0x400000
+
 type binaryHdr struct {
 	Magic       [6]byte
 	Version     uint16
@@ -741,6 +745,9 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return xerrors.Errorf("invalid keyslot index: %w", err)
 		}
+		if v == nil {
+			return fmt.Errorf("missing keyslot %d", id)
+		}
 		m.Keyslots[id] = v
 	}
 
@@ -750,6 +757,9 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return xerrors.Errorf("invalid segment index: %w", err)
 		}
+		if v == nil {
+			return fmt.Errorf("missing segment %d", id)
+		}
 		m.Segments[id] = v
 	}
 
@@ -759,6 +769,9 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return xerrors.Errorf("invalid digest index: %w", err)
 		}
+		if v == nil {
+			return fmt.Errorf("missing digest %d", id)
+		}
 		m.Digests[id] = v
 	}
 
@@ -768,6 +781,9 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return xerrors.Errorf("invalid token index: %w", err)
 		}
+		if v == nil {
+			return fmt.Errorf("missing token %d", id)
+		}
 		var token Token
 		if decoder, ok := tokenDecoders[v.typ]; ok {
 			token, err = decoder(v.data)
@@ -790,9 +806,31 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 
 // HeaderInfo corresponds to the header (binary header and JSON metadata) for a LUKS2 volume.
 type HeaderInfo struct {
-	HeaderSize uint64   // The total size of the binary header and JSON metadata in bytes
-	Label      string   // The label
-	Metadata   Metadata // JSON metadata
+	HeaderSize   uint64   // The total size of the binary header and JSON metadata area in bytes
+	MetadataSize uint64   // The size of the JSON metadata in bytes, excluding padding
+	Label        string   // The label
+	UUID         string   // The UUID of the container
+	Metadata     Metadata // JSON metadata
+}
+
+// MetadataAreaSize returns the size of the JSON metadata area in bytes, which
+// limits the size of the JSON metadata. This returns 0 if the header size isn't
+// known.
+func (h *HeaderInfo) MetadataAreaSize() uint64 {
+	hdrSize := uint64(binary.Size(binaryHdr{}))
+	if h.HeaderSize < hdrSize {
+		return 0
+	}
+	return h.HeaderSize - hdrSize
+}
+
+// jsonMetadataSize returns the size of the JSON metadata in the supplied
+// metadata area, which is padded with zeroes.
+func jsonMetadataSize(data []byte) uint64 {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return uint64(i)
+	}
+	return uint64(len(data))
 }
 
 func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryHdr, *bytes.Buffer, error) {
@@ -813,9 +851,12 @@ func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryH
 	if hdr.Version != 2 {
 		return nil, nil, errors.New("invalid version")
 	}
-	if hdr.HdrSize > uint64(math.MaxInt64) {
+	if hdr.HdrSize > maxHdrSize {
 		return nil, nil, errors.New("header size too large")
 	}
+	if hdr.HdrSize < uint64(binary.Size(hdr)) {
+		return nil, nil, errors.New("header size too small")
+	}
 	if hdr.HdrOffset > uint64(math.MaxInt64) {
 		return nil, nil, errors.New("header offset too large")
 	}
@@ -895,7 +936,9 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 	// Try to decode and check the primary header
 	primaryHdr, primaryJSONData, primaryErr := decodeAndCheckHeader(f, 0, true)
 	var primaryMetadata Metadata
+	var primaryMetadataSize uint64
 	if primaryErr == nil {
+		primaryMetadataSize = jsonMetadataSize(primaryJSONData.Bytes())
 		if err := json.NewDecoder(primaryJSONData).Decode(&primaryMetadata); err != nil {
 			primaryErr = xerrors.Errorf("cannot decode JSON metadata area: %w", err)
 		}
@@ -919,7 +962,9 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 		secondaryHdr, secondaryJSONData, secondaryErr = decodeAndCheckHeader(f, int64(primaryHdr.HdrSize), false)
 	}
 	var secondaryMetadata Metadata
+	var secondaryMetadataSize uint64
 	if secondaryErr == nil {
+		secondaryMetadataSize = jsonMetadataSize(secondaryJSONData.Bytes())
 		if err := json.NewDecoder(secondaryJSONData).Decode(&secondaryMetadata); err != nil {
 			secondaryErr = xerrors.Errorf("cannot decode JSON metadata area: %w", err)
 		}
@@ -927,11 +972,13 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 
 	var hdr *binaryHdr
 	var metadata *Metadata
+	var metadataSize uint64
 	switch {
 	case primaryErr == nil && secondaryErr == nil:
 		// Both headers are valid
 		hdr = primaryHdr
 		metadata = &primaryMetadata
+		metadataSize = primaryMetadataSize
 		switch {
 		case secondaryHdr.SeqId < primaryHdr.SeqId:
 			// The secondary header is obsolete. Cryptsetup will recover this automatically.
@@ -942,17 +989,20 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 			// this automatically.
 			hdr = secondaryHdr
 			metadata = &secondaryMetadata
+			metadataSize = secondaryMetadataSize
 			fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is obsolete\n", path)
 		}
 	case primaryErr == nil:
 		// We only have a valid primary header so use that. Cryptsetup will recover this automatically.
 		hdr = primaryHdr
 		metadata = &primaryMetadata
+		metadataSize = primaryMetadataSize
 		fmt.Fprintf(stderr, "luks2.ReadHeader: secondary header for %s is invalid: %v\n", path, secondaryErr)
 	case secondaryErr == nil:
 		// We only have a valid secondary header so use that. Cryptsetup will recover this automatically.
 		hdr = secondaryHdr
 		metadata = &secondaryMetadata
+		metadataSize = secondaryMetadataSize
 		fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is invalid: %v\n", path, primaryErr)
 	default:
 		// No valid headers :(
@@ -960,14 +1010,21 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 	}
 
 	return &HeaderInfo{
-		HeaderSize: hdr.HdrSize,
-		Label:      hdr.Label.String(),
-		Metadata:   *metadata}, nil
+		HeaderSize:   hdr.HdrSize,
+		MetadataSize: metadataSize,
+		Label:        hdr.Label.String(),
+		UUID:         string(bytes.TrimRight(hdr.Uuid[:], "\x00")),
+		Metadata:     *metadata}, nil
 }
 
 // RegisterTokenDecoder registers a custom decoder for the specified token type,
 // in order for external packages to be able to create type-specific token structures
-// as opposed to relying on GenericToken.
+// as opposed to relying on GenericToken. Supplying a nil decoder unregisters any
+// existing decoder for the specified token type.
 func RegisterTokenDecoder(typ TokenType, decoder TokenDecoder) {
+	if decoder == nil {
+		delete(tokenDecoders, typ)
+		return
+	}
 	tokenDecoders[typ] = decoder
 }
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -299,7 +300,11 @@ func (s *metadataSuite) testReadHeader(c *C, data *testReadHeaderData) {
 	c.Assert(err, IsNil)
 
 	c.Check(hdr.HeaderSize, Equals, data.hdrSize)
+	c.Check(hdr.MetadataAreaSize(), Equals, data.hdrSize-4096)
+	c.Check(hdr.MetadataSize > 0, testutil.IsTrue)
+	c.Check(hdr.MetadataSize < hdr.MetadataAreaSize(), testutil.IsTrue)
 	c.Check(hdr.Label, Equals, "data")
+	c.Check(hdr.UUID, Matches, `[[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}`)
 
 	c.Assert(hdr.Metadata.Keyslots, HasLen, 2)
 
@@ -470,3 +475,32 @@ func (s *metadataSuite) TestReadHeaderWithExternalToken(c *C) {
 	c.Check(token.A, Equals, "foo")
 	c.Check(token.B, Equals, 7)
 }
+
+func (s *metadataSuite) TestReadHeaderWithUnregisteredExternalToken(c *C) {
+	RegisterTokenDecoder("secboot-test", func(data []byte) (Token, error) {
+		return nil, errors.New("unexpected call")
+	})
+	RegisterTokenDecoder("secboot-test", nil)
+
+	hdr, err := ReadHeader(s.decompress(c, "testdata/luks2-valid-hdr.img"), LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	c.Assert(hdr.Metadata.Tokens, HasLen, 1)
+	token, ok := hdr.Metadata.Tokens[0].(*GenericToken)
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(token.TokenType, Equals, TokenType("secboot-test"))
+}
+
+func (s *metadataSuite) TestMetadataAreaSizeUnknown(c *C) {
+	c.Check((&HeaderInfo{}).MetadataAreaSize(), Equals, uint64(0))
+}
+
+func (s *metadataSuite) TestUnmarshalMetadataNullKeyslot(c *C) {
+	var m Metadata
+	c.Check(json.Unmarshal([]byte(`{"keyslots":{"0":null}}`), &m), ErrorMatches, `missing keyslot 0`)
+}
+
+func (s *metadataSuite) TestUnmarshalMetadataNullToken(c *C) {
+	var m Metadata
+	c.Check(json.Unmarshal([]byte(`{"tokens":{"1":null}}`), &m), ErrorMatches, `missing token 1`)
+}
@@ -0,0 +1,334 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// wipeBlockSize is the size of each write and read when overwriting
+	// and verifying data.
+	wipeBlockSize = 1024 * 1024
+)
+
+var (
+	// ErrWipeVerificationFailed is returned from WipeKeyslot and WipeVolume
+	// if the wiped data could not be verified.
+	ErrWipeVerificationFailed = errors.New("cannot verify that the data was wiped")
+
+	blkdiscardPath = "blkdiscard"
+)
+
+// WipeMethod describes the method that was used to wipe the data on a volume.
+type WipeMethod int
+
+const (
+	// WipeMethodSecureDiscard indicates that the data was wiped with a
+	// secure discard.
+	WipeMethodSecureDiscard WipeMethod = iota + 1
+
+	// WipeMethodDiscard indicates that the data was wiped with a discard.
+	WipeMethodDiscard
+
+	// WipeMethodOverwrite indicates that the data was overwritten with
+	// zeroes.
+	WipeMethodOverwrite
+)
+
+func (m WipeMethod) String() string {
+	switch m {
+	case WipeMethodSecureDiscard:
+		return "secure-discard"
+	case WipeMethodDiscard:
+		return "discard"
+	case WipeMethodOverwrite:
+		return "overwrite"
+	default:
+		return fmt.Sprintf("WipeMethod(%d)", int(m))
+	}
+}
+
+// WipeStage describes the stage of a wipe operation that is reporting progress.
+type WipeStage int
+
+const (
+	// WipeStageOverwrite indicates that data is being overwritten.
+	WipeStageOverwrite WipeStage = iota + 1
+
+	// WipeStageVerify indicates that overwritten or discarded data is
+	// being verified.
+	WipeStageVerify
+)
+
+// WipeProgressFunc is called periodically during a wipe operation with the
+// current stage and the number of bytes processed out of the total for that
+// stage.
+type WipeProgressFunc func(stage WipeStage, done, total uint64)
+
+// WipeVolumeOptions provides the options for WipeVolume.
+type WipeVolumeOptions struct {
+	// NoDiscard disables the use of discards, so that the data is always
+	// overwritten.
+	NoDiscard bool
+
+	// Progress is an optional callback for reporting progress.
+	Progress WipeProgressFunc
+}
+
+// WipeResult is the result of a successful call to WipeVolume.
+type WipeResult struct {
+	// CryptoErased indicates that all of the keyslots were erased from
+	// the volume's LUKS2 header before the data was wiped, which destroys
+	// the volume key. This is false if the volume didn't have a valid
+	// LUKS2 header.
+	CryptoErased bool
+
+	// Method is the method used to wipe the data on the volume.
+	Method WipeMethod
+}
+
+func blkdiscard(devicePath string, secure bool) error {
+	var args []string
+	if secure {
+		args = append(args, "--secure")
+	}
+	args = append(args, devicePath)
+
+	cmd := exec.Command(blkdiscardPath, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return osutil.OutputErr(output, err)
+	}
+	return nil
+}
+
+// discardVolume discards all of the data on the specified volume, using a
+// secure discard if it is supported.
+func discardVolume(devicePath string) (WipeMethod, error) {
+	if err := blkdiscard(devicePath, true); err == nil {
+		return WipeMethodSecureDiscard, nil
+	}
+	if err := blkdiscard(devicePath, false); err != nil {
+		return 0, err
+	}
+	return WipeMethodDiscard, nil
+}
+
+// deviceSize returns the size of the specified file or block device.
+func deviceSize(devicePath string) (uint64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
+
+// overwriteRange overwrites the specified range of the specified volume with
+// zeroes.
+func overwriteRange(devicePath string, offset, size uint64, progress WipeProgressFunc) error {
+	f, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, wipeBlockSize)
+	var done uint64
+	for done < size {
+		n := uint64(len(buf))
+		if size-done < n {
+			n = size - done
+		}
+		if _, err := f.WriteAt(buf[:n], int64(offset+done)); err != nil {
+			return err
+		}
+		done += n
+		if progress != nil {
+			progress(WipeStageOverwrite, done, size)
+		}
+	}
+
+	return f.Sync()
+}
+
+// verifyRangeIsZero verifies that the specified range of the specified volume
+// only contains zeroes. Cached pages are dropped first so that the data is
+// read back from the device.
+func verifyRangeIsZero(devicePath string, offset, size uint64, progress WipeProgressFunc) error {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// This is just advisory.
+	unix.Fadvise(int(f.Fd()), int64(offset), int64(size), unix.FADV_DONTNEED)
+
+	buf := make([]byte, wipeBlockSize)
+	zeroes := make([]byte, wipeBlockSize)
+	var done uint64
+	for done < size {
+		n := uint64(len(buf))
+		if size-done < n {
+			n = size - done
+		}
+		if _, err := f.ReadAt(buf[:n], int64(offset+done)); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf[:n], zeroes[:n]) {
+			return fmt.Errorf("%w: non-zero data found at offset %d", ErrWipeVerificationFailed, offset+done)
+		}
+		done += n
+		if progress != nil {
+			progress(WipeStageVerify, done, size)
+		}
+	}
+
+	return nil
+}
+
+// WipeKeyslot erases the keyslot with the supplied slot number from the
+// specified LUKS2 container, and then overwrites the binary keyslot area that
+// it used with zeroes. It verifies that the keyslot has been removed from the
+// metadata and that the keyslot area has been overwritten. If this cannot be
+// verified, an error that wraps ErrWipeVerificationFailed will be returned.
+//
+// The optional progress callback is used to report the progress of
+// overwriting and verifying the keyslot area.
+//
+// WARNING: This function will remove the last keyslot if there is only one
+// left, which will make the encrypted data permanently inaccessible.
+func WipeKeyslot(devicePath string, slot int, progress WipeProgressFunc) error {
+	hdr, err := ReadHeader(devicePath, LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+	keyslot, exists := hdr.Metadata.Keyslots[slot]
+	if !exists {
+		return fmt.Errorf("no keyslot with ID %d", slot)
+	}
+	area := keyslot.Area
+
+	if err := KillSlot(devicePath, slot); err != nil {
+		return xerrors.Errorf("cannot kill keyslot: %w", err)
+	}
+
+	hdr, err = ReadHeader(devicePath, LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+	if _, exists := hdr.Metadata.Keyslots[slot]; exists {
+		return fmt.Errorf("%w: keyslot %d still exists", ErrWipeVerificationFailed, slot)
+	}
+
+	if area == nil {
+		return nil
+	}
+	if err := overwriteRange(devicePath, area.Offset, area.Size, progress); err != nil {
+		return xerrors.Errorf("cannot overwrite keyslot area: %w", err)
+	}
+	if err := verifyRangeIsZero(devicePath, area.Offset, area.Size, progress); err != nil {
+		return xerrors.Errorf("cannot verify keyslot area: %w", err)
+	}
+
+	return nil
+}
+
+// WipeVolume wipes all of the data on the specified volume, which must not be
+// in use. If the volume has a valid LUKS2 header, all of its keyslots are
+// erased first, which destroys the volume key and makes the encrypted data
+// permanently inaccessible even if the subsequent wipe is incomplete.
+//
+// Unless disabled with the NoDiscard option, the whole volume is then
+// discarded with blkdiscard, using a secure discard if the device supports
+// it. The whole volume is read back after a discard, and if any of it doesn't
+// read back as zeroes or the discard fails, the whole volume is overwritten
+// with zeroes instead, and the result is verified by reading it back. If this
+// cannot be verified, an error that wraps ErrWipeVerificationFailed will be
+// returned.
+//
+// The optional Progress callback is used to report the progress of
+// overwriting and verifying the data.
+func WipeVolume(devicePath string, options *WipeVolumeOptions) (*WipeResult, error) {
+	if options == nil {
+		options = new(WipeVolumeOptions)
+	}
+
+	size, err := deviceSize(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine volume size: %w", err)
+	}
+
+	result := new(WipeResult)
+
+	if _, err := ReadHeader(devicePath, LockModeBlocking); err == nil {
+		if err := cryptsetupCmd(nil, "erase", "--batch-mode", "--type", "luks2", devicePath); err != nil {
+			return nil, xerrors.Errorf("cannot erase keyslots: %w", err)
+		}
+		// The volume key is destroyed if there are no keyslots
+		// left or if the header is no longer valid.
+		if hdr, err := ReadHeader(devicePath, LockModeBlocking); err == nil && len(hdr.Metadata.Keyslots) > 0 {
+			return nil, fmt.Errorf("%w: %d keyslots still exist", ErrWipeVerificationFailed, len(hdr.Metadata.Keyslots))
+		}
+		result.CryptoErased = true
+	}
+
+	if !options.NoDiscard {
+		method, err := discardVolume(devicePath)
+		switch {
+		case err != nil:
+			fmt.Fprintf(stderr, "luks2.WipeVolume: cannot discard %s: %v\n", devicePath, err)
+		default:
+			err := verifyRangeIsZero(devicePath, 0, size, options.Progress)
+			if err == nil {
+				result.Method = method
+				return result, nil
+			}
+			fmt.Fprintf(stderr, "luks2.WipeVolume: cannot verify discard of %s: %v\n", devicePath, err)
+		}
+	}
+
+	if err := overwriteRange(devicePath, 0, size, options.Progress); err != nil {
+		return nil, xerrors.Errorf("cannot overwrite volume: %w", err)
+	}
+	if err := verifyRangeIsZero(devicePath, 0, size, options.Progress); err != nil {
+		return nil, xerrors.Errorf("cannot verify volume: %w", err)
+	}
+	result.Method = WipeMethodOverwrite
+
+	return result, nil
+}
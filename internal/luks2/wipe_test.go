@@ -0,0 +1,303 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+	"github.com/snapcore/secboot/internal/paths/pathstest"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+const (
+	// mockCryptsetupEraseBottom destroys both LUKS2 headers of the
+	// device supplied as the last argument.
+	mockCryptsetupEraseBottom = `eval dev=\${$#}; dd if=/dev/zero of="$dev" bs=4096 count=64 conv=notrunc 2>/dev/null`
+
+	// mockBlkdiscardZeroBottom zeroes the contents of the device supplied
+	// as the last argument.
+	mockBlkdiscardZeroBottom = `eval dev=\${$#}; sz=$(stat -c %s "$dev"); truncate -s 0 "$dev"; truncate -s "$sz" "$dev"`
+)
+
+type wipeProgressEvent struct {
+	stage WipeStage
+	done  uint64
+	total uint64
+}
+
+type wipeSuite struct {
+	snapd_testutil.BaseTest
+
+	dir            string
+	mockCryptsetup *snapd_testutil.MockCmd
+	mockBlkdiscard *snapd_testutil.MockCmd
+	stderr         *bytes.Buffer
+	progress       []wipeProgressEvent
+}
+
+func (s *wipeSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
+
+	s.dir = c.MkDir()
+	s.mockCryptsetup = snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "cryptsetup"), "")
+	s.AddCleanup(s.mockCryptsetup.Restore)
+	s.AddCleanup(MockCryptsetupPath(s.mockCryptsetup.Exe()))
+
+	s.mockBlkdiscard = snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "blkdiscard"), mockBlkdiscardZeroBottom)
+	s.AddCleanup(s.mockBlkdiscard.Restore)
+	s.AddCleanup(MockBlkdiscardPath(s.mockBlkdiscard.Exe()))
+
+	s.stderr = new(bytes.Buffer)
+	s.AddCleanup(MockStderr(s.stderr))
+
+	s.progress = nil
+}
+
+var _ = Suite(&wipeSuite{})
+
+func (s *wipeSuite) recordProgress(stage WipeStage, done, total uint64) {
+	s.progress = append(s.progress, wipeProgressEvent{stage: stage, done: done, total: total})
+}
+
+func (s *wipeSuite) decompressHeader(c *C, path string) string {
+	dst := filepath.Join(s.dir, filepath.Base(path))
+	c.Assert(testutil.CopyFile(dst+".xz", path+".xz", 0600), IsNil)
+	c.Assert(exec.Command("unxz", dst+".xz").Run(), IsNil)
+	return dst
+}
+
+func (s *wipeSuite) makeDataFile(c *C, size int) string {
+	path := filepath.Join(s.dir, "disk")
+	c.Assert(ioutil.WriteFile(path, bytes.Repeat([]byte{0xaa}, size), 0600), IsNil)
+	return path
+}
+
+func (s *wipeSuite) checkZeroed(c *C, path string) {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Count(data, []byte{0}), Equals, len(data))
+}
+
+func (s *wipeSuite) TestWipeVolumeCryptoEraseAndSecureDiscard(c *C) {
+	s.mockCryptsetup = snapd_testutil.MockCommand(c, s.mockCryptsetup.Exe(), mockCryptsetupEraseBottom)
+
+	path := s.decompressHeader(c, "testdata/luks2-valid-hdr.img")
+
+	result, err := WipeVolume(path, &WipeVolumeOptions{Progress: s.recordProgress})
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{CryptoErased: true, Method: WipeMethodSecureDiscard})
+
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "erase", "--batch-mode", "--type", "luks2", path},
+	})
+	c.Check(s.mockBlkdiscard.Calls(), DeepEquals, [][]string{
+		{"blkdiscard", "--secure", path},
+	})
+	c.Check(s.progress, HasLen, 16)
+	c.Check(s.progress[15], Equals, wipeProgressEvent{stage: WipeStageVerify, done: 16 * 1024 * 1024, total: 16 * 1024 * 1024})
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeDiscard(c *C) {
+	s.mockBlkdiscard = snapd_testutil.MockCommand(c, s.mockBlkdiscard.Exe(), `if [ "$1" = "--secure" ]; then exit 1; fi; `+mockBlkdiscardZeroBottom)
+
+	path := s.makeDataFile(c, 2*1024*1024)
+
+	result, err := WipeVolume(path, nil)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{Method: WipeMethodDiscard})
+
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+	c.Check(s.mockBlkdiscard.Calls(), DeepEquals, [][]string{
+		{"blkdiscard", "--secure", path},
+		{"blkdiscard", path},
+	})
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeDiscardNotZeroed(c *C) {
+	// Test that the volume is overwritten if the discarded data doesn't
+	// read back as zeroes.
+	s.mockBlkdiscard = snapd_testutil.MockCommand(c, s.mockBlkdiscard.Exe(), "")
+
+	path := s.makeDataFile(c, 2*1024*1024)
+
+	result, err := WipeVolume(path, &WipeVolumeOptions{Progress: s.recordProgress})
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{Method: WipeMethodOverwrite})
+
+	c.Check(s.mockBlkdiscard.Calls(), HasLen, 1)
+	c.Check(s.progress, DeepEquals, []wipeProgressEvent{
+		{stage: WipeStageOverwrite, done: 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageOverwrite, done: 2 * 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageVerify, done: 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageVerify, done: 2 * 1024 * 1024, total: 2 * 1024 * 1024},
+	})
+	c.Check(s.stderr.String(), Equals, "luks2.WipeVolume: cannot verify discard of "+path+": cannot verify that the data was wiped: non-zero data found at offset 0\n")
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeDiscardPartiallyZeroed(c *C) {
+	// Test that the whole volume is verified after a discard, and that it
+	// is overwritten if only part of the discarded data reads back as
+	// zeroes.
+	s.mockBlkdiscard = snapd_testutil.MockCommand(c, s.mockBlkdiscard.Exe(), `eval dev=\${$#}; dd if=/dev/zero of="$dev" bs=1M count=1 conv=notrunc 2>/dev/null`)
+
+	path := s.makeDataFile(c, 2*1024*1024)
+
+	result, err := WipeVolume(path, &WipeVolumeOptions{Progress: s.recordProgress})
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{Method: WipeMethodOverwrite})
+
+	c.Check(s.progress, DeepEquals, []wipeProgressEvent{
+		{stage: WipeStageVerify, done: 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageOverwrite, done: 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageOverwrite, done: 2 * 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageVerify, done: 1024 * 1024, total: 2 * 1024 * 1024},
+		{stage: WipeStageVerify, done: 2 * 1024 * 1024, total: 2 * 1024 * 1024},
+	})
+	c.Check(s.stderr.String(), Equals, fmt.Sprintf("luks2.WipeVolume: cannot verify discard of %s: cannot verify that the data was wiped: non-zero data found at offset %d\n", path, 1024*1024))
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeNoDiscard(c *C) {
+	path := s.makeDataFile(c, 1536*1024)
+
+	result, err := WipeVolume(path, &WipeVolumeOptions{NoDiscard: true, Progress: s.recordProgress})
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{Method: WipeMethodOverwrite})
+
+	c.Check(s.mockBlkdiscard.Calls(), HasLen, 0)
+	c.Check(s.progress, DeepEquals, []wipeProgressEvent{
+		{stage: WipeStageOverwrite, done: 1024 * 1024, total: 1536 * 1024},
+		{stage: WipeStageOverwrite, done: 1536 * 1024, total: 1536 * 1024},
+		{stage: WipeStageVerify, done: 1024 * 1024, total: 1536 * 1024},
+		{stage: WipeStageVerify, done: 1536 * 1024, total: 1536 * 1024},
+	})
+	c.Check(s.stderr.String(), Equals, "")
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeNoBlkdiscard(c *C) {
+	s.AddCleanup(MockBlkdiscardPath(filepath.Join(s.dir, "blkdiscard")))
+
+	path := s.makeDataFile(c, 1024*1024)
+
+	result, err := WipeVolume(path, nil)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &WipeResult{Method: WipeMethodOverwrite})
+	c.Check(s.stderr.String(), Matches, "luks2.WipeVolume: cannot discard "+path+": .*\n")
+	s.checkZeroed(c, path)
+}
+
+func (s *wipeSuite) TestWipeVolumeCryptoEraseNotVerified(c *C) {
+	path := s.decompressHeader(c, "testdata/luks2-valid-hdr.img")
+
+	_, err := WipeVolume(path, nil)
+	c.Check(err, ErrorMatches, `cannot verify that the data was wiped: 2 keyslots still exist`)
+	c.Check(err, testutil.ErrorIs, ErrWipeVerificationFailed)
+	c.Check(s.mockBlkdiscard.Calls(), HasLen, 0)
+}
+
+func (s *wipeSuite) TestWipeVolumeCryptoEraseFails(c *C) {
+	s.mockCryptsetup = snapd_testutil.MockCommand(c, s.mockCryptsetup.Exe(), `echo "some error" >&2; exit 1`)
+
+	path := s.decompressHeader(c, "testdata/luks2-valid-hdr.img")
+
+	_, err := WipeVolume(path, nil)
+	c.Check(err, ErrorMatches, `cannot erase keyslots: cryptsetup failed with: some error`)
+	c.Check(s.mockBlkdiscard.Calls(), HasLen, 0)
+}
+
+func (s *wipeSuite) TestWipeVolumeMissing(c *C) {
+	_, err := WipeVolume(filepath.Join(s.dir, "disk"), nil)
+	c.Check(err, ErrorMatches, `cannot determine volume size: open .*/disk: no such file or directory`)
+	c.Check(err, testutil.ErrorIs, os.ErrNotExist)
+}
+
+func (s *wipeSuite) TestWipeKeyslotNotVerified(c *C) {
+	path := s.decompressHeader(c, "testdata/luks2-valid-hdr.img")
+
+	err := WipeKeyslot(path, 0, nil)
+	c.Check(err, ErrorMatches, `cannot verify that the data was wiped: keyslot 0 still exists`)
+	c.Check(err, testutil.ErrorIs, ErrWipeVerificationFailed)
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksKillSlot", "--batch-mode", "--type", "luks2", path, "0"},
+	})
+}
+
+func (s *wipeSuite) TestWipeKeyslotMissing(c *C) {
+	path := s.decompressHeader(c, "testdata/luks2-valid-hdr.img")
+
+	c.Check(WipeKeyslot(path, 5, nil), ErrorMatches, `no keyslot with ID 5`)
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *wipeSuite) TestWipeMethodString(c *C) {
+	c.Check(WipeMethodSecureDiscard.String(), Equals, "secure-discard")
+	c.Check(WipeMethodDiscard.String(), Equals, "discard")
+	c.Check(WipeMethodOverwrite.String(), Equals, "overwrite")
+	c.Check(WipeMethod(10).String(), Equals, "WipeMethod(10)")
+}
+
+func (s *cryptsetupSuite) TestWipeKeyslot(c *C) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	hdr, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	area := hdr.Metadata.Keyslots[1].Area
+
+	var progress []wipeProgressEvent
+	c.Check(WipeKeyslot(devicePath, 1, func(stage WipeStage, done, total uint64) {
+		progress = append(progress, wipeProgressEvent{stage: stage, done: done, total: total})
+	}), IsNil)
+	c.Check(progress, DeepEquals, []wipeProgressEvent{
+		{stage: WipeStageOverwrite, done: area.Size, total: area.Size},
+		{stage: WipeStageVerify, done: area.Size, total: area.Size},
+	})
+
+	hdr, err = ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.Keyslots, HasLen, 1)
+
+	luks2test.CheckLUKS2Passphrase(c, devicePath, key1)
+}
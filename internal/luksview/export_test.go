@@ -20,3 +20,5 @@
 package luksview
 
 type OrphanedToken = orphanedToken
+
+var FallbackDecodeTokenHelper = fallbackDecodeTokenHelper
@@ -0,0 +1,48 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package luksview_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+// The following functions are entry points for go's native fuzzing support,
+// and can be run with "go test -run=- -fuzz=<name>". Without -fuzz, they are
+// run as tests with the seed inputs.
+
+func FuzzDecodeTokens(f *testing.F) {
+	f.Add([]byte(`{"tokens":{"0":{"type":"ubuntu-fde","keyslots":["0"],"ubuntu_fde_name":"default","ubuntu_fde_priority":1,"ubuntu_fde_data":{}}}}`))
+	f.Add([]byte(`{"tokens":{"0":{"type":"ubuntu-fde-recovery","keyslots":["1"],"ubuntu_fde_name":"default-recovery"}}}`))
+	f.Add([]byte(`{"tokens":{"0":{"type":"ubuntu-fde-user","keyslots":["2"],"ubuntu_fde_name":"user-foo","ubuntu_fde_user":"foo"}}}`))
+	f.Add([]byte(`{"tokens":{"0":{"type":"ubuntu-fde","keyslots":[],"ubuntu_fde_name":"default"}}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m luks2.Metadata
+		if err := json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		for _, token := range m.Tokens {
+			token.Type()
+			token.Keyslots()
+		}
+	})
+}
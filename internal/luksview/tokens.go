@@ -23,15 +23,24 @@ import (
 	"encoding/json"
 	"errors"
 	"strconv"
+	"time"
 
 	"golang.org/x/xerrors"
 
+	"github.com/snapcore/secboot/internal/artifact"
 	"github.com/snapcore/secboot/internal/luks2"
 )
 
 const (
 	KeyDataTokenType  luks2.TokenType = "ubuntu-fde"
 	RecoveryTokenType luks2.TokenType = "ubuntu-fde-recovery"
+	UserTokenType     luks2.TokenType = "ubuntu-fde-user"
+
+	tokenArtifact = "LUKS2 token"
+
+	// tokenMinReaderVersion is the minimum artifact.FormatVersion
+	// required to read the tokens created by this package.
+	tokenMinReaderVersion = 1
 )
 
 var (
@@ -39,10 +48,44 @@ var (
 	errOrphanedNamedToken = errors.New("orphaned named token")
 )
 
+func decodeUnsupportedToken(data []byte, verErr *artifact.VersionError) (luks2.Token, error) {
+	var raw tokenBaseRaw
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var token *luks2.GenericToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+
+	switch {
+	case raw.Name == "" || len(raw.Keyslots) > 1:
+		var token *luks2.GenericToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return nil, err
+		}
+		return token, nil
+	case len(raw.Keyslots) == 0:
+		return &orphanedToken{raw: raw}, nil
+	}
+
+	return &UnsupportedToken{
+		TokenBase: TokenBase{
+			TokenKeyslot: raw.Keyslots[0],
+			TokenName:    raw.Name},
+		TokenType: raw.Type,
+		Err:       verErr,
+		data:      data}, nil
+}
+
 func fallbackDecodeTokenHelper(data []byte, origErr error) (luks2.Token, error) {
+	var verErr *artifact.VersionError
+
 	switch {
 	case origErr == nil:
 		panic("asked to decode fallback token without an error")
+	case xerrors.As(origErr, &verErr):
+		return decodeUnsupportedToken(data, verErr)
 	case xerrors.Is(origErr, errOrphanedNamedToken):
 		var token *orphanedToken
 		if err := json.Unmarshal(data, &token); err != nil {
@@ -76,6 +119,14 @@ func init() {
 		}
 		return token, nil
 	})
+
+	luks2.RegisterTokenDecoder(UserTokenType, func(data []byte) (luks2.Token, error) {
+		var token *UserToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return fallbackDecodeTokenHelper(data, err)
+		}
+		return token, nil
+	})
 }
 
 // NamedToken corresponds to a token created by secboot, which identifies
@@ -119,9 +170,18 @@ func (k *tokenKeyslots) UnmarshalJSON(data []byte) error {
 }
 
 type tokenBaseRaw struct {
-	Type     luks2.TokenType `json:"type"`
-	Keyslots tokenKeyslots   `json:"keyslots"`
-	Name     string          `json:"ubuntu_fde_name"`
+	Type     luks2.TokenType  `json:"type"`
+	Keyslots tokenKeyslots    `json:"keyslots"`
+	Name     string           `json:"ubuntu_fde_name"`
+	Header   *artifact.Header `json:"secboot,omitempty"`
+}
+
+func newTokenBaseRaw(typ luks2.TokenType, base *TokenBase) tokenBaseRaw {
+	return tokenBaseRaw{
+		Type:     typ,
+		Keyslots: tokenKeyslots{base.TokenKeyslot},
+		Name:     base.TokenName,
+		Header:   artifact.NewHeader(tokenMinReaderVersion)}
 }
 
 // TokenBase provides the fields that are common to all tokens created by secboot.
@@ -138,14 +198,38 @@ func (t *TokenBase) Name() string {
 	return t.TokenName
 }
 
+// RecoveryGrace limits the use of a recovery keyslot on a container that
+// doesn't have any platform protected keyslots.
+type RecoveryGrace struct {
+	NotAfter *time.Time `json:"not_after,omitempty"` // The time after which the keyslot can't be used, if set
+	MaxUses  int        `json:"max_uses,omitempty"`  // The maximum number of times the keyslot can be used, if not zero
+	Uses     int        `json:"uses"`                // The number of times the keyslot has been used
+
+	// Counter optionally identifies a platform counter that maintains the
+	// number of times the keyslot has been used, in which case Uses is unused.
+	Counter *RecoveryGraceCounter `json:"counter,omitempty"`
+}
+
+// RecoveryGraceCounter identifies a counter maintained by a platform that
+// records the number of times a recovery keyslot has been used.
+type RecoveryGraceCounter struct {
+	PlatformName string `json:"platform_name"` // The name of the platform that maintains the counter
+	Handle       []byte `json:"handle"`        // Platform specific data that identifies the counter
+}
+
 type recoveryTokenRaw struct {
 	tokenBaseRaw
+	Grace *RecoveryGrace `json:"ubuntu_fde_grace,omitempty"`
 }
 
 // RecoveryToken represents a token with the type "ubuntu-fde-recovery",
 // associated with a recovery keyslot
 type RecoveryToken struct {
 	TokenBase
+
+	// Grace is an optional limit on the use of the associated
+	// keyslot.
+	Grace *RecoveryGrace
 }
 
 func (t *RecoveryToken) Type() luks2.TokenType {
@@ -154,14 +238,16 @@ func (t *RecoveryToken) Type() luks2.TokenType {
 
 func (t *RecoveryToken) MarshalJSON() ([]byte, error) {
 	raw := &recoveryTokenRaw{
-		tokenBaseRaw: tokenBaseRaw{
-			Type:     RecoveryTokenType,
-			Keyslots: tokenKeyslots{t.TokenKeyslot},
-			Name:     t.TokenName}}
+		tokenBaseRaw: newTokenBaseRaw(RecoveryTokenType, &t.TokenBase),
+		Grace:        t.Grace}
 	return json.Marshal(raw)
 }
 
 func (t *RecoveryToken) UnmarshalJSON(data []byte) error {
+	if err := artifact.CheckJSON(tokenArtifact, data); err != nil {
+		return err
+	}
+
 	var raw *recoveryTokenRaw
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return err
@@ -180,7 +266,64 @@ func (t *RecoveryToken) UnmarshalJSON(data []byte) error {
 	*t = RecoveryToken{
 		TokenBase: TokenBase{
 			TokenKeyslot: int(raw.Keyslots[0]),
-			TokenName:    raw.Name}}
+			TokenName:    raw.Name},
+		Grace: raw.Grace}
+	return nil
+}
+
+type userTokenRaw struct {
+	tokenBaseRaw
+	User     string            `json:"ubuntu_fde_user"`
+	Metadata map[string]string `json:"ubuntu_fde_user_metadata,omitempty"`
+}
+
+// UserToken represents a token with the type "ubuntu-fde-user", associated
+// with a keyslot that is protected directly by a user's passphrase.
+type UserToken struct {
+	TokenBase
+
+	User     string            // The user that the associated keyslot belongs to
+	Metadata map[string]string // Optional metadata about the user
+}
+
+func (t *UserToken) Type() luks2.TokenType {
+	return UserTokenType
+}
+
+func (t *UserToken) MarshalJSON() ([]byte, error) {
+	raw := &userTokenRaw{
+		tokenBaseRaw: newTokenBaseRaw(UserTokenType, &t.TokenBase),
+		User:         t.User,
+		Metadata:     t.Metadata}
+	return json.Marshal(raw)
+}
+
+func (t *UserToken) UnmarshalJSON(data []byte) error {
+	if err := artifact.CheckJSON(tokenArtifact, data); err != nil {
+		return err
+	}
+
+	var raw *userTokenRaw
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	switch {
+	case raw.Name == "" || raw.User == "" || len(raw.Keyslots) > 1:
+		return errInvalidNamedToken
+	case len(raw.Keyslots) == 0:
+		// Cryptsetup removes the keyslot ID from associated tokens
+		// when the slot is deleted, so a token with no associated
+		// keyslots is orphaned.
+		return errOrphanedNamedToken
+	}
+
+	*t = UserToken{
+		TokenBase: TokenBase{
+			TokenKeyslot: int(raw.Keyslots[0]),
+			TokenName:    raw.Name},
+		User:     raw.User,
+		Metadata: raw.Metadata}
 	return nil
 }
 
@@ -212,16 +355,17 @@ func (t *KeyDataToken) Type() luks2.TokenType {
 
 func (t *KeyDataToken) MarshalJSON() ([]byte, error) {
 	raw := &keyDataTokenRaw{
-		tokenBaseRaw: tokenBaseRaw{
-			Type:     KeyDataTokenType,
-			Keyslots: tokenKeyslots{t.TokenKeyslot},
-			Name:     t.TokenName},
-		Priority: t.Priority,
-		Data:     t.Data}
+		tokenBaseRaw: newTokenBaseRaw(KeyDataTokenType, &t.TokenBase),
+		Priority:     t.Priority,
+		Data:         t.Data}
 	return json.Marshal(raw)
 }
 
 func (t *KeyDataToken) UnmarshalJSON(data []byte) error {
+	if err := artifact.CheckJSON(tokenArtifact, data); err != nil {
+		return err
+	}
+
 	var raw *keyDataTokenRaw
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return err
@@ -246,6 +390,26 @@ func (t *KeyDataToken) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// UnsupportedToken represents a token created by a newer version of secboot
+// that can't be decoded by this version. It reserves the name of the
+// associated keyslot, and is preserved unmodified if it is written back.
+type UnsupportedToken struct {
+	TokenBase
+
+	TokenType luks2.TokenType // The type of this token
+	Err       error           // The reason that this token can't be decoded
+
+	data []byte
+}
+
+func (t *UnsupportedToken) Type() luks2.TokenType {
+	return t.TokenType
+}
+
+func (t *UnsupportedToken) MarshalJSON() ([]byte, error) {
+	return t.data, nil
+}
+
 type orphanedToken struct {
 	raw tokenBaseRaw
 }
@@ -22,9 +22,11 @@ package luksview_test
 import (
 	"encoding/json"
 	"strconv"
+	"time"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/secboot/internal/artifact"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luks2/luks2test"
 	. "github.com/snapcore/secboot/internal/luksview"
@@ -51,6 +53,11 @@ func (s *tokenSuite) checkTokenBaseJSON(c *C, j map[string]interface{}, token *T
 	name, ok := j["ubuntu_fde_name"].(string)
 	c.Check(ok, testutil.IsTrue)
 	c.Check(name, Equals, token.Name())
+
+	c.Check(j["secboot"], DeepEquals, map[string]interface{}{
+		"magic":              "secboot",
+		"producer_version":   float64(artifact.FormatVersion),
+		"min_reader_version": float64(1)})
 }
 
 func (s *tokenSuite) checkRecoveryTokenJSON(c *C, data []byte, token *RecoveryToken) {
@@ -108,6 +115,78 @@ func (s *tokenSuite) TestUnmarshalRecoveryToken2(c *C) {
 	c.Check(token2, DeepEquals, token)
 }
 
+func (s *tokenSuite) TestUnmarshalRecoveryTokenWithGrace(c *C) {
+	notAfter := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery",
+			TokenKeyslot: 1},
+		Grace: &RecoveryGrace{
+			NotAfter: &notAfter,
+			MaxUses:  5,
+			Uses:     2}}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["ubuntu_fde_grace"], DeepEquals, map[string]interface{}{
+		"not_after": "2024-06-01T00:00:00Z",
+		"max_uses":  float64(5),
+		"uses":      float64(2)})
+
+	var token2 *RecoveryToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
+func (s *tokenSuite) TestUnmarshalRecoveryTokenWithGraceNoTimeLimit(c *C) {
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery",
+			TokenKeyslot: 1},
+		Grace: &RecoveryGrace{MaxUses: 5}}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["ubuntu_fde_grace"], DeepEquals, map[string]interface{}{
+		"max_uses": float64(5),
+		"uses":     float64(0)})
+
+	var token2 *RecoveryToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
+func (s *tokenSuite) TestUnmarshalRecoveryTokenWithGraceCounter(c *C) {
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery",
+			TokenKeyslot: 1},
+		Grace: &RecoveryGrace{
+			MaxUses: 5,
+			Counter: &RecoveryGraceCounter{
+				PlatformName: "mock",
+				Handle:       []byte{0x01, 0x02}}}}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["ubuntu_fde_grace"], DeepEquals, map[string]interface{}{
+		"max_uses": float64(5),
+		"uses":     float64(0),
+		"counter": map[string]interface{}{
+			"platform_name": "mock",
+			"handle":        "AQI="}})
+
+	var token2 *RecoveryToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
 func (s *tokenSuite) TestDecodeRecoveryToken(c *C) {
 	if luks2.DetectCryptsetupFeatures()&luks2.FeatureTokenImport == 0 {
 		c.Skip("cryptsetup doesn't support token import")
@@ -184,6 +263,10 @@ func (s *tokenSuite) TestDecodeInvalidRecoveryToken(c *C) {
 		TokenKeyslots: []int{0},
 		Params: map[string]interface{}{
 			"ubuntu_fde_name": "",
+			"secboot": map[string]interface{}{
+				"magic":              "secboot",
+				"producer_version":   float64(artifact.FormatVersion),
+				"min_reader_version": float64(1)},
 		},
 	})
 }
@@ -342,6 +425,93 @@ func (s *tokenSuite) TestDecodeInvalidKeyDataToken(c *C) {
 		Params: map[string]interface{}{
 			"ubuntu_fde_name":     "",
 			"ubuntu_fde_priority": float64(0),
+			"secboot": map[string]interface{}{
+				"magic":              "secboot",
+				"producer_version":   float64(artifact.FormatVersion),
+				"min_reader_version": float64(1)},
 		},
 	})
 }
+
+func (s *tokenSuite) TestMarshalUserToken(c *C) {
+	token := &UserToken{
+		TokenBase: TokenBase{
+			TokenName:    "user-alice",
+			TokenKeyslot: 2},
+		User:     "alice",
+		Metadata: map[string]string{"display-name": "Alice"}}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	s.checkTokenBaseJSON(c, j, &token.TokenBase, UserTokenType)
+	c.Check(j["ubuntu_fde_user"], Equals, "alice")
+	c.Check(j["ubuntu_fde_user_metadata"], DeepEquals, map[string]interface{}{"display-name": "Alice"})
+}
+
+func (s *tokenSuite) TestUnmarshalUserToken(c *C) {
+	token := &UserToken{
+		TokenBase: TokenBase{
+			TokenName:    "user-bob",
+			TokenKeyslot: 3},
+		User: "bob"}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var token2 *UserToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
+func (s *tokenSuite) TestUnmarshalUserTokenNoUser(c *C) {
+	data := []byte(`{"type":"ubuntu-fde-user","keyslots":["1"],"ubuntu_fde_name":"user-bob"}`)
+
+	var token *UserToken
+	c.Check(json.Unmarshal(data, &token), ErrorMatches, `invalid named token`)
+}
+
+func (s *tokenSuite) TestUnmarshalTokenRequiresNewer(c *C) {
+	data := []byte(`{"type":"ubuntu-fde","keyslots":["1"],"ubuntu_fde_name":"foo","ubuntu_fde_priority":{"new":"format"},"secboot":{"magic":"secboot","producer_version":5,"min_reader_version":5}}`)
+
+	var token *KeyDataToken
+	err := json.Unmarshal(data, &token)
+	c.Check(err, ErrorMatches, `LUKS2 token requires newer secboot \(format version 5 is required, but this version only supports 2\)`)
+	c.Check(err, testutil.ConvertibleTo, &artifact.VersionError{})
+}
+
+func (s *tokenSuite) TestDecodeUnsupportedToken(c *C) {
+	data := []byte(`{"type":"ubuntu-fde-recovery","keyslots":["1"],"ubuntu_fde_name":"foo","secboot":{"magic":"secboot","producer_version":5,"min_reader_version":5}}`)
+
+	var token *RecoveryToken
+	err := json.Unmarshal(data, &token)
+	c.Assert(err, NotNil)
+
+	decoded, err := FallbackDecodeTokenHelper(data, err)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, testutil.ConvertibleTo, &UnsupportedToken{})
+
+	unsupported := decoded.(*UnsupportedToken)
+	c.Check(unsupported.Type(), Equals, RecoveryTokenType)
+	c.Check(unsupported.Keyslots(), DeepEquals, []int{1})
+	c.Check(unsupported.Name(), Equals, "foo")
+	c.Check(unsupported.Err, ErrorMatches, `LUKS2 token requires newer secboot \(format version 5 is required, but this version only supports 2\)`)
+
+	// The token is preserved unmodified.
+	encoded, err := json.Marshal(unsupported)
+	c.Check(err, IsNil)
+	c.Check(encoded, DeepEquals, data)
+}
+
+func (s *tokenSuite) TestDecodeOrphanedUnsupportedToken(c *C) {
+	data := []byte(`{"type":"ubuntu-fde","keyslots":[],"ubuntu_fde_name":"foo","secboot":{"magic":"secboot","producer_version":5,"min_reader_version":5}}`)
+
+	var token *KeyDataToken
+	err := json.Unmarshal(data, &token)
+	c.Assert(err, NotNil)
+
+	decoded, err := FallbackDecodeTokenHelper(data, err)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, testutil.ConvertibleTo, &OrphanedToken{})
+	c.Check(decoded.(NamedToken).Name(), Equals, "foo")
+}
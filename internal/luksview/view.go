@@ -115,6 +115,11 @@ func (v *View) Reread() error {
 	return nil
 }
 
+// UUID returns the UUID of the container.
+func (v *View) UUID() string {
+	return v.hdr.UUID
+}
+
 // TokenNames returns a sorted list of all of the keyslot names from this view.
 // This doesn't return names associated with tokens that have been orphaned
 // because their associated keyslot has been deleted.
@@ -148,12 +153,11 @@ func (v *View) KeyDataTokensByPriority() (tokens []*KeyDataToken) {
 	for _, name := range v.TokenNames() {
 		t := v.namedTokens[name].token
 
-		if t.Type() != KeyDataTokenType {
+		token, ok := t.(*KeyDataToken)
+		if !ok {
 			continue
 		}
 
-		token := t.(*KeyDataToken)
-
 		if token.Priority < 0 {
 			// Priority -1 tokens are ignored unless called explicitly
 			// by name.
@@ -192,6 +196,13 @@ func (v *View) OrphanedTokenIds() (ids []int) {
 	return ids
 }
 
+// MetadataSpace returns the number of bytes of the JSON metadata area that are
+// currently used and the total size of the area. The total size is 0 if it isn't
+// known.
+func (v *View) MetadataSpace() (used, total uint64) {
+	return v.hdr.MetadataSize, v.hdr.MetadataAreaSize()
+}
+
 // UsedKeyslots returns a list of ids for currently active keyslots.
 func (v *View) UsedKeyslots() (slots []int) {
 	for slot := range v.hdr.Metadata.Keyslots {
@@ -166,6 +166,26 @@ func (s *viewSuite) TestViewUsedKeyslots(c *C) {
 	c.Check(view.UsedKeyslots(), DeepEquals, []int{0, 1, 2, 3, 4, 5})
 }
 
+func (s *viewSuite) TestViewMetadataSpace(c *C) {
+	hdr := testHeader
+	hdr.HeaderSize = 16384
+	hdr.MetadataSize = 2000
+
+	view, err := NewViewFromCustomHeaderSource(hdr)
+	c.Assert(err, IsNil)
+	used, total := view.MetadataSpace()
+	c.Check(used, Equals, uint64(2000))
+	c.Check(total, Equals, uint64(12288))
+}
+
+func (s *viewSuite) TestViewMetadataSpaceUnknown(c *C) {
+	view, err := NewViewFromCustomHeaderSource(testHeader)
+	c.Assert(err, IsNil)
+	used, total := view.MetadataSpace()
+	c.Check(used, Equals, uint64(0))
+	c.Check(total, Equals, uint64(0))
+}
+
 func (s *viewSuite) TestNewView(c *C) {
 	if luks2.DetectCryptsetupFeatures()&luks2.FeatureTokenImport == 0 {
 		c.Skip("cryptsetup doesn't support token import")
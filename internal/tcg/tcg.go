@@ -76,6 +76,71 @@ func MakeDefaultEKTemplate() *tpm2.Public {
 		Unique: &tpm2.PublicIDU{RSA: make(tpm2.PublicKeyRSA, 256)}}
 }
 
+// MakeECCSRKTemplate returns a SRK template for the specified ECC curve, or nil
+// if the curve is not supported. The NIST P-256 template is the one defined in
+// section 7.5.1 of "TCG TPM v2.0 Provisioning Guidance", version 1.0, revision
+// 1.0, 15 March 2017. The NIST P-384 template uses the same structure with a
+// name algorithm and symmetric algorithm of a matching strength.
+func MakeECCSRKTemplate(curve tpm2.ECCCurve) *tpm2.Public {
+	var nameAlg tpm2.HashAlgorithmId
+	var symKeyBits uint16
+	var size int
+	switch curve {
+	case tpm2.ECCCurveNIST_P256:
+		nameAlg = tpm2.HashAlgorithmSHA256
+		symKeyBits = 128
+		size = 32
+	case tpm2.ECCCurveNIST_P384:
+		nameAlg = tpm2.HashAlgorithmSHA384
+		symKeyBits = 256
+		size = 48
+	default:
+		return nil
+	}
+
+	return &tpm2.Public{
+		Type:    tpm2.ObjectTypeECC,
+		NameAlg: nameAlg,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+			tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			ECCDetail: &tpm2.ECCParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: symKeyBits},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:  tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+				CurveID: curve,
+				KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+		Unique: &tpm2.PublicIDU{
+			ECC: &tpm2.ECCPoint{
+				X: make(tpm2.ECCParameter, size),
+				Y: make(tpm2.ECCParameter, size)}}}
+}
+
+func MakeDefaultECCEKTemplate() *tpm2.Public {
+	return &tpm2.Public{
+		Type:    tpm2.ObjectTypeECC,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrAdminWithPolicy | tpm2.AttrRestricted |
+			tpm2.AttrDecrypt,
+		AuthPolicy: []byte{0x83, 0x71, 0x97, 0x67, 0x44, 0x84, 0xb3, 0xf8, 0x1a, 0x90, 0xcc, 0x8d, 0x46, 0xa5, 0xd7, 0x24, 0xfd, 0x52, 0xd7,
+			0x6e, 0x06, 0x52, 0x0b, 0x64, 0xf2, 0xa1, 0xda, 0x1b, 0x33, 0x14, 0x69, 0xaa},
+		Params: &tpm2.PublicParamsU{
+			ECCDetail: &tpm2.ECCParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:  tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+				CurveID: tpm2.ECCCurveNIST_P256,
+				KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+		Unique: &tpm2.PublicIDU{
+			ECC: &tpm2.ECCPoint{
+				X: make(tpm2.ECCParameter, 32),
+				Y: make(tpm2.ECCParameter, 32)}}}
+}
+
 var (
 	// srkTemplate is the default RSA2048 SRK template, see section 7.5.1 of "TCG TPM v2.0 Provisioning Guidance", version 1.0, revision 1.0, 15 March 2017.
 	SRKTemplate = MakeDefaultSRKTemplate()
@@ -83,6 +148,9 @@ var (
 	// Default RSA2048 EK template, see section B.3.3 of "TCG EK Credential Profile For TPM Family 2.0; Level 0", Version 2.1, Revision 13, 10 December 2018
 	EKTemplate = MakeDefaultEKTemplate()
 
+	// Default ECC NIST P256 EK template, see section B.3.4 of "TCG EK Credential Profile For TPM Family 2.0; Level 0", Version 2.1, Revision 13, 10 December 2018
+	ECCEKTemplate = MakeDefaultECCEKTemplate()
+
 	OIDExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17} // id-ce-subjectAltName, see section 4.2.16 of RFC5280
 
 	// TCG specific OIDs, see section 4 of "TCG EK Credential Profile For TPM Family 2.0; Level 0", Version 2.1, Revision 13, 10 December 2018.
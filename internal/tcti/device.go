@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tcti
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// maxResponseSize is the maximum size of a response from a TPM character
+// device.
+const maxResponseSize = 4096
+
+// DeadlineTransport is implemented by transports that support deadlines for
+// reading responses, so that a caller can stop waiting for a wedged TPM without
+// leaving a pending read behind.
+type DeadlineTransport interface {
+	// SetReadDeadline sets the deadline for reading a response. A pending
+	// read is unblocked when the deadline expires, and returns an error
+	// that wraps os.ErrDeadlineExceeded. A zero value clears the deadline.
+	SetReadDeadline(t time.Time) error
+}
+
+func ignoringEINTR(fn func() (int, error)) (int, error) {
+	for {
+		n, err := fn()
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
+
+// deviceTransport is a connection to a Linux TPM character device. The device
+// is opened in non-blocking mode and added to the runtime's poller, so that
+// reads can be unblocked by a deadline or by closing the device.
+//
+// Responses are read with a single read of maxResponseSize, as older kernels
+// don't support partial reads, and then returned from a buffer.
+type deviceTransport struct {
+	file *os.File
+	rsp  []byte
+}
+
+func openDevice(path string) (*deviceTransport, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceTransport{file: f}, nil
+}
+
+func (d *deviceTransport) readResponse() error {
+	conn, err := d.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxResponseSize)
+	var n int
+	var readErr error
+	if err := conn.Read(func(fd uintptr) bool {
+		n, readErr = ignoringEINTR(func() (int, error) {
+			return syscall.Read(int(fd), buf)
+		})
+		// The device returns zero bytes rather than EAGAIN if there
+		// isn't a response ready, in which case wait for it to become
+		// readable.
+		return readErr != syscall.EAGAIN && (n > 0 || readErr != nil)
+	}); err != nil {
+		return &os.PathError{Op: "read", Path: d.file.Name(), Err: err}
+	}
+	if readErr != nil {
+		return &os.PathError{Op: "read", Path: d.file.Name(), Err: readErr}
+	}
+
+	d.rsp = buf[:n]
+	return nil
+}
+
+func (d *deviceTransport) Read(data []byte) (int, error) {
+	if len(d.rsp) == 0 {
+		if err := d.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, d.rsp)
+	d.rsp = d.rsp[n:]
+	return n, nil
+}
+
+func (d *deviceTransport) Write(data []byte) (int, error) {
+	conn, err := d.file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	var writeErr error
+	if err := conn.Write(func(fd uintptr) bool {
+		n, writeErr = ignoringEINTR(func() (int, error) {
+			return syscall.Write(int(fd), data)
+		})
+		return true
+	}); err != nil {
+		return 0, &os.PathError{Op: "write", Path: d.file.Name(), Err: err}
+	}
+	if writeErr != nil {
+		return n, &os.PathError{Op: "write", Path: d.file.Name(), Err: writeErr}
+	}
+	if n < len(data) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (d *deviceTransport) Close() error {
+	return d.file.Close()
+}
+
+func (d *deviceTransport) SetReadDeadline(t time.Time) error {
+	return d.file.SetReadDeadline(t)
+}
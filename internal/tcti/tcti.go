@@ -21,7 +21,6 @@ package tcti
 
 import (
 	"github.com/canonical/go-tpm2"
-	"github.com/canonical/go-tpm2/linux"
 )
 
 const (
@@ -29,7 +28,9 @@ const (
 	tpmPath = "/dev/tpm0"
 )
 
-// OpenDefaultTcti connects to the default TPM character device. This can be overridden for tests to connect to a simulator device.
+// OpenDefaultTcti connects to the default TPM character device. The returned
+// transport implements DeadlineTransport. This can be overridden for tests to
+// connect to a simulator device.
 var OpenDefault = func() (tpm2.TCTI, error) {
-	return linux.OpenDevice(tpmPath)
+	return openDevice(tpmPath)
 }
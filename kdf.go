@@ -22,5 +22,5 @@ package secboot
 // KDFOptions is an interface for supplying options for different
 // key derivation functions
 type KDFOptions interface {
-	kdfParams(keyLen uint32) (*kdfParams, error)
+	kdfParams(argon2 Argon2KDF, keyLen uint32) (*kdfParams, error)
 }
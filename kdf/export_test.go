@@ -0,0 +1,32 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kdf
+
+import (
+	"github.com/snapcore/secboot/internal/argon2"
+)
+
+func MockArgon2Benchmark(fn func(*argon2.BenchmarkParams, argon2.KeyDurationFunc) (*argon2.CostParams, error)) (restore func()) {
+	orig := argon2Benchmark
+	argon2Benchmark = fn
+	return func() {
+		argon2Benchmark = orig
+	}
+}
@@ -0,0 +1,174 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kdf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/snapcore/secboot"
+)
+
+type helperCommand string
+
+const (
+	helperCommandDerive helperCommand = "derive"
+	helperCommandTime   helperCommand = "time"
+)
+
+// helperRequest is sent to the helper process on its standard input.
+type helperRequest struct {
+	Command    helperCommand      `json:"command"`
+	Passphrase string             `json:"passphrase,omitempty"`
+	Salt       []byte             `json:"salt,omitempty"`
+	Mode       secboot.Argon2Mode `json:"mode"`
+	Time       uint32             `json:"time"`
+	MemoryKiB  uint32             `json:"memory"`
+	Threads    uint8              `json:"threads"`
+	KeyLen     uint32             `json:"key-len,omitempty"`
+}
+
+// helperResponse is returned from the helper process on its standard output.
+type helperResponse struct {
+	Key      []byte        `json:"key,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type helperProcessKDF struct {
+	newCmd func() (*exec.Cmd, error)
+}
+
+func (k *helperProcessKDF) run(req *helperRequest) (*helperResponse, error) {
+	cmd, err := k.newCmd()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create helper command: %w", err)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize request: %w", err)
+	}
+
+	stdout := new(bytes.Buffer)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot run helper process: %w", err)
+	}
+
+	var rsp *helperResponse
+	if err := json.NewDecoder(stdout).Decode(&rsp); err != nil {
+		return nil, fmt.Errorf("cannot decode response from helper process: %w", err)
+	}
+	if rsp.Error != "" {
+		return nil, errors.New(rsp.Error)
+	}
+	return rsp, nil
+}
+
+func (k *helperProcessKDF) Derive(passphrase string, salt []byte, mode secboot.Argon2Mode, params *secboot.Argon2CostParams, keyLen uint32) ([]byte, error) {
+	rsp, err := k.run(&helperRequest{
+		Command:    helperCommandDerive,
+		Passphrase: passphrase,
+		Salt:       salt,
+		Mode:       mode,
+		Time:       params.Time,
+		MemoryKiB:  params.MemoryKiB,
+		Threads:    params.Threads,
+		KeyLen:     keyLen})
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(rsp.Key)) != keyLen {
+		return nil, errors.New("helper process returned a key with the wrong length")
+	}
+	return rsp.Key, nil
+}
+
+func (k *helperProcessKDF) Time(mode secboot.Argon2Mode, params *secboot.Argon2CostParams) (time.Duration, error) {
+	rsp, err := k.run(&helperRequest{
+		Command:   helperCommandTime,
+		Mode:      mode,
+		Time:      params.Time,
+		MemoryKiB: params.MemoryKiB,
+		Threads:   params.Threads})
+	if err != nil {
+		return 0, err
+	}
+	return rsp.Duration, nil
+}
+
+// NewHelperProcessKDF returns a secboot.Argon2KDF implementation that runs
+// each key derivation or timing operation in a new short-lived helper
+// process, so that the memory consumed by Argon2id is released as soon as the
+// operation completes. The supplied function is called to create the command
+// for each operation, and the helper process must call RunHelper with its
+// standard input and output.
+//
+// The returned KDF can be supplied to Benchmark, configured with
+// secboot.SetArgon2KDF, or supplied as the KDF in
+// secboot.KeyWithPassphraseParams.
+func NewHelperProcessKDF(newCmd func() (*exec.Cmd, error)) secboot.Argon2KDF {
+	return &helperProcessKDF{newCmd: newCmd}
+}
+
+// RunHelper handles a single request from a KDF returned from
+// NewHelperProcessKDF, reading it from the supplied reader and writing the
+// response to the supplied writer. It runs Argon2 in the current process with
+// secboot.InProcessArgon2KDF, and is intended to be called from the entry
+// point of the helper process with its standard input and output. An error is
+// only returned if the request cannot be read or the response cannot be
+// written. Errors from the KDF are returned to the caller of the KDF.
+func RunHelper(r io.Reader, w io.Writer) error {
+	var req *helperRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return fmt.Errorf("cannot decode request: %w", err)
+	}
+
+	params := &secboot.Argon2CostParams{
+		Time:      req.Time,
+		MemoryKiB: req.MemoryKiB,
+		Threads:   req.Threads}
+
+	rsp := new(helperResponse)
+	var err error
+	switch req.Command {
+	case helperCommandDerive:
+		rsp.Key, err = secboot.InProcessArgon2KDF.Derive(req.Passphrase, req.Salt, req.Mode, params, req.KeyLen)
+	case helperCommandTime:
+		rsp.Duration, err = secboot.InProcessArgon2KDF.Time(req.Mode, params)
+	default:
+		err = fmt.Errorf("invalid command %q", req.Command)
+	}
+	if err != nil {
+		rsp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		return fmt.Errorf("cannot encode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kdf_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/kdf"
+)
+
+type helperSuite struct{}
+
+var _ = Suite(&helperSuite{})
+
+func (s *helperSuite) newHelperCmd() (*exec.Cmd, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "SECBOOT_KDF_TEST_HELPER=1")
+	return cmd, nil
+}
+
+func (s *helperSuite) TestDerive(c *C) {
+	params := &secboot.Argon2CostParams{Time: 4, MemoryKiB: 32, Threads: 1}
+	expected, err := secboot.InProcessArgon2KDF.Derive("foo", []byte("0123456789abcdef"), secboot.Argon2id, params, 32)
+	c.Assert(err, IsNil)
+
+	kdf := NewHelperProcessKDF(s.newHelperCmd)
+	key, err := kdf.Derive("foo", []byte("0123456789abcdef"), secboot.Argon2id, params, 32)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+}
+
+func (s *helperSuite) TestDeriveError(c *C) {
+	kdf := NewHelperProcessKDF(s.newHelperCmd)
+	_, err := kdf.Derive("foo", []byte("0123456789abcdef"), secboot.Argon2Mode("bar"), &secboot.Argon2CostParams{Time: 4, MemoryKiB: 32, Threads: 1}, 32)
+	c.Check(err, ErrorMatches, `invalid mode`)
+}
+
+func (s *helperSuite) TestTime(c *C) {
+	kdf := NewHelperProcessKDF(s.newHelperCmd)
+	duration, err := kdf.Time(secboot.Argon2id, &secboot.Argon2CostParams{Time: 4, MemoryKiB: 32, Threads: 1})
+	c.Check(err, IsNil)
+	c.Check(duration > 0, testutil.IsTrue)
+}
+
+func (s *helperSuite) TestNewCmdError(c *C) {
+	kdf := NewHelperProcessKDF(func() (*exec.Cmd, error) {
+		return nil, errors.New("some error")
+	})
+	_, err := kdf.Time(secboot.Argon2id, &secboot.Argon2CostParams{Time: 4, MemoryKiB: 32, Threads: 1})
+	c.Check(err, ErrorMatches, `cannot create helper command: some error`)
+}
+
+func (s *helperSuite) TestHelperFails(c *C) {
+	kdf := NewHelperProcessKDF(func() (*exec.Cmd, error) {
+		return exec.Command("false"), nil
+	})
+	_, err := kdf.Time(secboot.Argon2id, &secboot.Argon2CostParams{Time: 4, MemoryKiB: 32, Threads: 1})
+	c.Check(err, ErrorMatches, `cannot run helper process: exit status 1`)
+}
+
+func (s *helperSuite) TestRunHelperInvalidCommand(c *C) {
+	out := new(bytes.Buffer)
+	c.Check(RunHelper(bytes.NewReader([]byte(`{"command":"foo"}`)), out), IsNil)
+
+	var rsp map[string]interface{}
+	c.Check(json.Unmarshal(out.Bytes(), &rsp), IsNil)
+	c.Check(rsp, DeepEquals, map[string]interface{}{"error": `invalid command "foo"`})
+}
+
+func (s *helperSuite) TestRunHelperInvalidRequest(c *C) {
+	c.Check(RunHelper(bytes.NewReader([]byte(`foo`)), new(bytes.Buffer)), ErrorMatches, `cannot decode request: .*`)
+}
@@ -0,0 +1,89 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package kdf provides a mechanism for tuning the cost parameters of the
+// Argon2id passphrase KDF. The benchmark is run with a secboot.Argon2KDF
+// implementation, which would normally be one returned from
+// NewHelperProcessKDF so that the benchmark runs in short-lived helper
+// processes and the memory that it consumes is released when it completes. The tuned parameters can be persisted by the caller and reused
+// when creating new passphrase protected keys, rather than benchmarking each
+// time.
+package kdf
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/argon2"
+)
+
+var argon2Benchmark = argon2.Benchmark
+
+// Benchmark computes the Argon2id cost parameters for the specified target
+// duration using the supplied KDF implementation, which should be the same
+// implementation that is configured with secboot.SetArgon2KDF or supplied as
+// the KDF in secboot.KeyWithPassphraseParams. The memory cost is limited to
+// maxMemoryKiB, or 1GiB if this is zero. It is also limited to the
+// MaxKDFMemoryKiB limit set with secboot.SetResourceBudget, so that a key
+// created with the returned parameters can be recovered on a device with
+// constrained memory, such as from an initrd. The default target duration is
+// 2 seconds.
+//
+// The returned options have the cost parameters set explicitly, and can be
+// persisted by the caller and supplied as the KDFOptions in
+// secboot.KeyWithPassphraseParams in order to create keys without running the
+// benchmark again.
+func Benchmark(kdf secboot.Argon2KDF, targetDuration time.Duration, maxMemoryKiB uint32) (*secboot.Argon2Options, error) {
+	if kdf == nil {
+		return nil, errors.New("no KDF")
+	}
+	if targetDuration < 0 {
+		return nil, errors.New("invalid target duration")
+	}
+	if targetDuration == 0 {
+		targetDuration = 2 * time.Second
+	}
+	if maxMemoryKiB == 0 {
+		maxMemoryKiB = 1 * 1024 * 1024
+	}
+	if limit := secboot.CurrentResourceBudget().MaxKDFMemoryKiB; limit > 0 && maxMemoryKiB > limit {
+		maxMemoryKiB = limit
+	}
+
+	params, err := argon2Benchmark(&argon2.BenchmarkParams{
+		MaxMemoryCostKiB: maxMemoryKiB,
+		TargetDuration:   targetDuration,
+	}, func(params *argon2.CostParams) (time.Duration, error) {
+		return kdf.Time(secboot.Argon2id, &secboot.Argon2CostParams{
+			Time:      params.Time,
+			MemoryKiB: params.MemoryKiB,
+			Threads:   params.Threads})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot benchmark KDF: %w", err)
+	}
+
+	return &secboot.Argon2Options{
+		Mode:            secboot.Argon2id,
+		MemoryKiB:       params.MemoryKiB,
+		ForceIterations: params.Time,
+		Parallel:        params.Threads}, nil
+}
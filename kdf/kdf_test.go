@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kdf_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/argon2"
+	. "github.com/snapcore/secboot/kdf"
+)
+
+// mockKDF is a secboot.Argon2KDF that records the parameters supplied to
+// Time, as a KDF that delegates to a helper process would receive them.
+type mockKDF struct {
+	timeCalls []*secboot.Argon2CostParams
+	timeErr   error
+}
+
+func (k *mockKDF) Derive(passphrase string, salt []byte, mode secboot.Argon2Mode, params *secboot.Argon2CostParams, keyLen uint32) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (k *mockKDF) Time(mode secboot.Argon2Mode, params *secboot.Argon2CostParams) (time.Duration, error) {
+	if mode != secboot.Argon2id {
+		return 0, errors.New("unexpected mode")
+	}
+	k.timeCalls = append(k.timeCalls, params)
+	if k.timeErr != nil {
+		return 0, k.timeErr
+	}
+	return time.Second, nil
+}
+
+// mockBenchmark returns cost parameters derived from the supplied benchmark
+// parameters, so that the tests don't have to run the real benchmark.
+func mockBenchmark(params *argon2.BenchmarkParams, keyFn argon2.KeyDurationFunc) (*argon2.CostParams, error) {
+	if _, err := keyFn(&argon2.CostParams{Time: 4, MemoryKiB: 32 * 1024, Threads: 4}); err != nil {
+		return nil, err
+	}
+	return &argon2.CostParams{
+		Time:      uint32(params.TargetDuration / time.Second),
+		MemoryKiB: params.MaxMemoryCostKiB,
+		Threads:   4}, nil
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("SECBOOT_KDF_TEST_HELPER") == "1" {
+		if err := RunHelper(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func Test(t *testing.T) { TestingT(t) }
+
+type kdfSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&kdfSuite{})
+
+func (s *kdfSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.AddCleanup(MockArgon2Benchmark(mockBenchmark))
+}
+
+func (s *kdfSuite) TestBenchmark(c *C) {
+	kdf := new(mockKDF)
+	opts, err := Benchmark(kdf, 3*time.Second, 512*1024)
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, &secboot.Argon2Options{
+		Mode:            secboot.Argon2id,
+		MemoryKiB:       512 * 1024,
+		ForceIterations: 3,
+		Parallel:        4})
+	c.Check(kdf.timeCalls, DeepEquals, []*secboot.Argon2CostParams{{Time: 4, MemoryKiB: 32 * 1024, Threads: 4}})
+}
+
+func (s *kdfSuite) TestBenchmarkDefaults(c *C) {
+	opts, err := Benchmark(new(mockKDF), 0, 0)
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, &secboot.Argon2Options{
+		Mode:            secboot.Argon2id,
+		MemoryKiB:       1024 * 1024,
+		ForceIterations: 2,
+		Parallel:        4})
+}
+
+func (s *kdfSuite) TestBenchmarkResourceBudget(c *C) {
+	orig := secboot.SetResourceBudget(secboot.ResourceBudget{MaxKDFMemoryKiB: 256 * 1024})
+	defer secboot.SetResourceBudget(orig)
+
+	opts, err := Benchmark(new(mockKDF), 2*time.Second, 512*1024)
+	c.Assert(err, IsNil)
+	c.Check(opts.MemoryKiB, Equals, uint32(256*1024))
+}
+
+func (s *kdfSuite) TestBenchmarkInvalidTargetDuration(c *C) {
+	_, err := Benchmark(new(mockKDF), -1, 0)
+	c.Check(err, ErrorMatches, `invalid target duration`)
+}
+
+func (s *kdfSuite) TestBenchmarkNoKDF(c *C) {
+	_, err := Benchmark(nil, 2*time.Second, 0)
+	c.Check(err, ErrorMatches, `no KDF`)
+}
+
+func (s *kdfSuite) TestBenchmarkKDFError(c *C) {
+	_, err := Benchmark(&mockKDF{timeErr: errors.New("some error")}, 2*time.Second, 0)
+	c.Check(err, ErrorMatches, `cannot benchmark KDF: some error`)
+}
@@ -20,18 +20,24 @@
 package secboot
 
 import (
+	"bufio"
+	"context"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/asn1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"math"
 
+	"github.com/snapcore/secboot/internal/argon2"
+	"github.com/snapcore/secboot/internal/artifact"
 	"github.com/snapcore/secboot/internal/pbkdf2"
+	"github.com/snapcore/secboot/testhooks"
 	"golang.org/x/crypto/cryptobyte"
 	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
 	"golang.org/x/crypto/hkdf"
@@ -43,6 +49,19 @@ const (
 	passphraseKeyLen                   = 32
 	passphraseEncryptionKeyLen         = 32
 	passphraseEncryption               = "aes-cfb"
+
+	// maxPassphraseDerivedKeySize is an upper limit on the size of key
+	// derived from a passphrase, as this is read from key data which
+	// shouldn't be able to cause large allocations.
+	maxPassphraseDerivedKeySize = 1024
+
+	keyDataArtifact = "key data"
+
+	// keyDataMinReaderVersion is the minimum ArtifactFormatVersion
+	// required to read key data created by NewKeyData. This is increased
+	// for key data with a platform handle that implements
+	// VersionedPlatformHandle.
+	keyDataMinReaderVersion = 1
 )
 
 var (
@@ -136,6 +155,8 @@ type KeyParams struct {
 	// something as simple as binary data stored in a byte slice or a more complex
 	// JSON object, depending on the requirements of the implementation. A handle
 	// already encoded to JSON can be supplied using the json.RawMessage type.
+	// If the handle uses a format that requires a newer version of this
+	// package to read, it should implement VersionedPlatformHandle.
 	Handle interface{}
 
 	Role string
@@ -160,11 +181,29 @@ type KeyParams struct {
 // implementation.
 type KeyWithPassphraseParams struct {
 	KeyParams
-	KDFOptions KDFOptions // The passphrase KDF options
+	KDFOptions KDFOptions // The passphrase KDF options. This is ignored if PassphraseIsAuthKey is true.
 
 	// AuthKeySize is the size of key to derive from the passphrase for
-	// use by the platform implementation.
+	// use by the platform implementation. This is ignored if
+	// PassphraseIsAuthKey is true.
 	AuthKeySize int
+
+	// PassphraseIsAuthKey indicates that the passphrase should be supplied
+	// to the platform implementation unmodified as the auth key rather
+	// than using a key derived from it. This is intended for platforms
+	// where the passphrase is a credential for a device that enforces its
+	// own dictionary attack protection, such as a PKCS#11 token PIN. In
+	// this case, the payload is not additionally encrypted with a key
+	// derived from the passphrase, so that the key data can't be used to
+	// test guesses of the passphrase without the device.
+	PassphraseIsAuthKey bool
+
+	// KDF is the Argon2 implementation used to benchmark the KDF cost
+	// parameters and to derive keys from the passphrase whilst creating
+	// the key, and for subsequent passphrase operations on the returned
+	// KeyData. If it is nil, the implementation configured with
+	// SetArgon2KDF is used. This is ignored for other KDFs.
+	KDF Argon2KDF
 }
 
 // KeyID is the unique ID for a KeyData object. It is used to facilitate the
@@ -304,6 +343,11 @@ type passphraseParams struct {
 	DerivedKeySize    int    `json:"derived_key_size"`    // Size of key to derive from passphrase using the parameters of the KDF field.
 	EncryptionKeySize int    `json:"encryption_key_size"` // Size of encryption key to derive from passphrase derived key
 	AuthKeySize       int    `json:"auth_key_size"`       // Size of auth key to derive from passphrase derived key
+
+	// PassphraseIsAuthKey indicates that the passphrase is supplied to the
+	// platform as the auth key, and that the payload isn't encrypted with
+	// a key derived from it. The other fields are unused in this case.
+	PassphraseIsAuthKey bool `json:"passphrase_is_auth_key,omitempty"`
 }
 
 type keyData struct {
@@ -313,6 +357,10 @@ type keyData struct {
 	// used to derive the unlock key.
 	Generation int `json:"generation,omitempty"`
 
+	// Header indicates which versions of this package can read this key
+	// data. It doesn't exist in key data created by older versions.
+	Header *ArtifactHeader `json:"secboot,omitempty"`
+
 	PlatformName string `json:"platform_name"` // used to identify a PlatformKeyDataHandler
 
 	// PlatformHandle is an opaque blob of data used by the associated
@@ -371,6 +419,20 @@ func processPlatformHandlerError(err error) error {
 type KeyData struct {
 	readableName string
 	data         keyData
+	format       KeyDataFormat
+
+	// argon2 is the Argon2 implementation supplied when this key data was
+	// created, if any.
+	argon2 Argon2KDF
+
+	passphraseKeys *cachedPassphraseKeys
+}
+
+func (d *KeyData) argon2KDF() Argon2KDF {
+	if d.argon2 != nil {
+		return d.argon2
+	}
+	return argon2KDF()
 }
 
 func (d *KeyData) derivePassphraseKeys(passphrase string) (key, iv, auth []byte, err error) {
@@ -379,17 +441,18 @@ func (d *KeyData) derivePassphraseKeys(passphrase string) (key, iv, auth []byte,
 	}
 
 	params := d.data.PassphraseParams
-	if params.DerivedKeySize < 0 {
+	if params.PassphraseIsAuthKey {
+		// The passphrase is only checked by the platform's device.
+		return nil, nil, []byte(passphrase), nil
+	}
+	if params.DerivedKeySize < 0 || params.DerivedKeySize > maxPassphraseDerivedKeySize {
 		return nil, nil, nil, fmt.Errorf("invalid derived key size (%d bytes)", params.DerivedKeySize)
 	}
 	if params.EncryptionKeySize < 0 || params.EncryptionKeySize > 32 {
 		// The key size can't be larger than 32 with the supported cipher
 		return nil, nil, nil, fmt.Errorf("invalid encryption key size (%d bytes)", params.EncryptionKeySize)
 	}
-	if params.AuthKeySize < 0 {
-		return nil, nil, nil, fmt.Errorf("invalid auth key size (%d bytes)", params.AuthKeySize)
-	}
-	if params.KDF.Time < 0 {
+	if params.KDF.Time < 0 || int64(params.KDF.Time) > math.MaxUint32 {
 		return nil, nil, nil, fmt.Errorf("invalid KDF time (%d)", params.KDF.Time)
 	}
 
@@ -398,6 +461,12 @@ func (d *KeyData) derivePassphraseKeys(passphrase string) (key, iv, auth []byte,
 		return nil, nil, nil, fmt.Errorf("unavailable leaf KDF digest algorithm %v", kdfAlg)
 	}
 
+	// HKDF can't produce keys larger than 255 times the digest size, so
+	// check this before allocating the auth key.
+	if params.AuthKeySize < 0 || params.AuthKeySize > 255*kdfAlg.Size() {
+		return nil, nil, nil, fmt.Errorf("invalid auth key size (%d bytes)", params.AuthKeySize)
+	}
+
 	// Include derivation parameters in the Argon2 salt in order to protect them
 	builder := cryptobyte.NewBuilder(nil)
 	builder.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) { // SEQUENCE {
@@ -418,10 +487,12 @@ func (d *KeyData) derivePassphraseKeys(passphrase string) (key, iv, auth []byte,
 
 	switch params.KDF.Type {
 	case string(Argon2i), string(Argon2id):
-		if params.KDF.Memory < 0 {
+		// Bound the memory cost so that untrusted key data can't request
+		// an arbitrarily large allocation.
+		if params.KDF.Memory < 0 || params.KDF.Memory > argon2.MaxMemoryCostKiB {
 			return nil, nil, nil, fmt.Errorf("invalid argon2 memory (%d)", params.KDF.Memory)
 		}
-		if params.KDF.CPUs < 0 {
+		if params.KDF.CPUs < 0 || params.KDF.CPUs > math.MaxUint8 {
 			return nil, nil, nil, fmt.Errorf("invalid argon2 threads (%d)", params.KDF.CPUs)
 		}
 
@@ -430,7 +501,12 @@ func (d *KeyData) derivePassphraseKeys(passphrase string) (key, iv, auth []byte,
 			Time:      uint32(params.KDF.Time),
 			MemoryKiB: uint32(params.KDF.Memory),
 			Threads:   uint8(params.KDF.CPUs)}
-		derived, err = argon2KDF().Derive(passphrase, salt, mode, costParams, uint32(params.DerivedKeySize))
+		release, err := reserveResource(ResourceKDFMemory, uint64(costParams.MemoryKiB))
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot derive key from passphrase: %w", err)
+		}
+		derived, err = d.argon2KDF().Derive(passphrase, salt, mode, costParams, uint32(params.DerivedKeySize))
+		release()
 		if err != nil {
 			return nil, nil, nil, xerrors.Errorf("cannot derive key from passphrase: %w", err)
 		}
@@ -482,9 +558,10 @@ func (d *KeyData) updatePassphrase(payload, oldAuthKey []byte, passphrase string
 		return err
 	}
 
-	if d.data.PassphraseParams.Encryption != passphraseEncryption {
+	params := d.data.PassphraseParams
+	if !params.PassphraseIsAuthKey && params.Encryption != passphraseEncryption {
 		// Only AES-CFB is supported
-		return fmt.Errorf("unexpected encryption algorithm \"%s\"", d.data.PassphraseParams.Encryption)
+		return fmt.Errorf("unexpected encryption algorithm \"%s\"", params.Encryption)
 	}
 
 	handle, err := handler.ChangeAuthKey(d.platformKeyData(), oldAuthKey, authKey)
@@ -492,11 +569,20 @@ func (d *KeyData) updatePassphrase(payload, oldAuthKey []byte, passphrase string
 		return err
 	}
 
+	if params.PassphraseIsAuthKey {
+		// The payload is only protected by the platform.
+		d.clearCachedPassphraseKeys()
+		d.data.PlatformHandle = handle
+		d.data.EncryptedPayload = payload
+		return nil
+	}
+
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return xerrors.Errorf("cannot create cipher: %w", err)
 	}
 
+	d.clearCachedPassphraseKeys()
 	d.data.PlatformHandle = handle
 	d.data.EncryptedPayload = make([]byte, len(payload))
 
@@ -506,26 +592,45 @@ func (d *KeyData) updatePassphrase(payload, oldAuthKey []byte, passphrase string
 	return nil
 }
 
-func (d *KeyData) openWithPassphrase(passphrase string) (payload []byte, authKey []byte, err error) {
-	key, iv, authKey, err := d.derivePassphraseKeys(passphrase)
-	if err != nil {
-		return nil, nil, err
+func (d *KeyData) openWithPassphraseKeys(key, iv []byte) (payload []byte, err error) {
+	if d.data.PassphraseParams.PassphraseIsAuthKey {
+		return d.data.EncryptedPayload, nil
 	}
-
 	if d.data.PassphraseParams.Encryption != passphraseEncryption {
 		// Only AES-CFB is supported
-		return nil, nil, fmt.Errorf("unexpected encryption algorithm \"%s\"", d.data.PassphraseParams.Encryption)
+		return nil, fmt.Errorf("unexpected encryption algorithm \"%s\"", d.data.PassphraseParams.Encryption)
 	}
 
 	payload = make([]byte, len(d.data.EncryptedPayload))
 
 	c, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
 	}
 	stream := cipher.NewCFBDecrypter(c, iv)
 	stream.XORKeyStream(payload, d.data.EncryptedPayload)
 
+	return payload, nil
+}
+
+// openWithPassphrase decrypts the payload with the keys derived from the supplied
+// passphrase. If the same passphrase was recently verified by
+// RecoverKeysWithPassphrase, the keys derived then are reused rather than running
+// the KDF again.
+func (d *KeyData) openWithPassphrase(passphrase string) (payload []byte, authKey []byte, err error) {
+	key, iv, authKey, ok := d.takeCachedPassphraseKeys(passphrase)
+	if !ok {
+		key, iv, authKey, err = d.derivePassphraseKeys(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	payload, err = d.openWithPassphraseKeys(key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return payload, authKey, nil
 }
 
@@ -554,7 +659,11 @@ func (d *KeyData) recoverKeysCommon(data []byte) (DiskUnlockKey, PrimaryKey, err
 		if err != nil {
 			return nil, nil, &InvalidKeyDataError{xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)}
 		}
-		return pk.unlockKey(crypto.Hash(d.data.KDFAlg)), pk.Primary, nil
+		unlockKey, err := pk.unlockKey(crypto.Hash(d.data.KDFAlg))
+		if err != nil {
+			return nil, nil, &InvalidKeyDataError{xerrors.Errorf("cannot derive unlock key: %w", err)}
+		}
+		return unlockKey, pk.Primary, nil
 	default:
 		return nil, nil, fmt.Errorf("invalid keydata generation %d", d.Generation())
 	}
@@ -626,9 +735,22 @@ func (d *KeyData) MarshalAndUpdatePlatformHandle(handle interface{}) error {
 	}
 
 	d.data.PlatformHandle = b
+	d.requireMinReaderVersion(platformHandleMinReaderVersion(handle))
 	return nil
 }
 
+// requireMinReaderVersion updates the header of this key data if necessary
+// so that it can only be read by versions of this package with an
+// ArtifactFormatVersion of at least the specified version.
+func (d *KeyData) requireMinReaderVersion(version int) {
+	switch {
+	case d.data.Header == nil && version <= keyDataMinReaderVersion:
+		// Key data without a header can be read by all versions.
+	case d.data.Header == nil || d.data.Header.MinReaderVersion < version:
+		d.data.Header = NewArtifactHeader(version)
+	}
+}
+
 // RecoverKeys recovers the disk unlock key and auxiliary key associated with this
 // key data from the platform's secure device, for key data that doesn't have any
 // additional authentication modes enabled (AuthMode returns AuthModeNone).
@@ -647,6 +769,14 @@ func (d *KeyData) MarshalAndUpdatePlatformHandle(handle interface{}) error {
 // If the keys cannot be recovered because the platform's secure device is not
 // available, a *PlatformDeviceUnavailableError error will be returned.
 func (d *KeyData) RecoverKeys() (DiskUnlockKey, PrimaryKey, error) {
+	return d.RecoverKeysContext(context.Background())
+}
+
+// RecoverKeysContext is a variant of RecoverKeys that accepts a context, which
+// is passed to the platform handler if it implements
+// PlatformKeyDataHandlerWithContext, so that recovering the keys can be
+// cancelled or time out.
+func (d *KeyData) RecoverKeysContext(ctx context.Context) (DiskUnlockKey, PrimaryKey, error) {
 	if d.AuthMode() != AuthModeNone {
 		return nil, nil, errors.New("cannot recover key without authorization")
 	}
@@ -656,7 +786,13 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, PrimaryKey, error) {
 		return nil, nil, ErrNoPlatformHandlerRegistered
 	}
 
-	c, err := handler.RecoverKeys(d.platformKeyData(), d.data.EncryptedPayload)
+	var c []byte
+	var err error
+	if h, ok := handler.(PlatformKeyDataHandlerWithContext); ok {
+		c, err = h.RecoverKeysContext(ctx, d.platformKeyData(), d.data.EncryptedPayload)
+	} else {
+		c, err = handler.RecoverKeys(d.platformKeyData(), d.data.EncryptedPayload)
+	}
 	if err != nil {
 		return nil, nil, processPlatformHandlerError(err)
 	}
@@ -664,7 +800,31 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, PrimaryKey, error) {
 	return d.recoverKeysCommon(c)
 }
 
+// policyBranch returns a description of the branch of the authorization
+// policy of this key that is satisfied, if the platform handler is able to
+// report it. This is used for informational purposes, so errors are ignored.
+func (d *KeyData) policyBranch() string {
+	handler, ok := handlers[d.data.PlatformName].(PlatformKeyDataHandlerWithPolicyBranch)
+	if !ok {
+		return ""
+	}
+	branch, err := handler.PolicyBranch(d.platformKeyData())
+	if err != nil {
+		return ""
+	}
+	return branch
+}
+
 func (d *KeyData) RecoverKeysWithPassphrase(passphrase string) (DiskUnlockKey, PrimaryKey, error) {
+	return d.RecoverKeysWithPassphraseContext(context.Background(), passphrase)
+}
+
+// RecoverKeysWithPassphraseContext is a variant of RecoverKeysWithPassphrase
+// that accepts a context, which is passed to the platform handler if it
+// implements PlatformKeyDataHandlerWithContext, so that recovering the keys
+// can be cancelled or time out. The context is not used for the passphrase
+// KDF.
+func (d *KeyData) RecoverKeysWithPassphraseContext(ctx context.Context, passphrase string) (DiskUnlockKey, PrimaryKey, error) {
 	if d.AuthMode() != AuthModePassphrase {
 		return nil, nil, errors.New("cannot recover key with passphrase")
 	}
@@ -674,28 +834,61 @@ func (d *KeyData) RecoverKeysWithPassphrase(passphrase string) (DiskUnlockKey, P
 		return nil, nil, ErrNoPlatformHandlerRegistered
 	}
 
-	payload, key, err := d.openWithPassphrase(passphrase)
+	key, iv, authKey, err := d.derivePassphraseKeys(passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	c, err := handler.RecoverKeysWithAuthKey(d.platformKeyData(), payload, key)
+	payload, err := d.openWithPassphraseKeys(key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var c []byte
+	if h, ok := handler.(PlatformKeyDataHandlerWithContext); ok {
+		c, err = h.RecoverKeysWithAuthKeyContext(ctx, d.platformKeyData(), payload, authKey)
+	} else {
+		c, err = handler.RecoverKeysWithAuthKey(d.platformKeyData(), payload, authKey)
+	}
 	if err != nil {
 		return nil, nil, processPlatformHandlerError(err)
 	}
 
-	return d.recoverKeysCommon(c)
+	unlockKey, primaryKey, err := d.recoverKeysCommon(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The passphrase has been verified, so retain the derived keys for
+	// a short time in case the caller is about to change it. There are
+	// no derived keys if the passphrase is the auth key.
+	if !d.data.PassphraseParams.PassphraseIsAuthKey {
+		d.cachePassphraseKeys(passphrase, key, iv, authKey)
+	}
+
+	return unlockKey, primaryKey, nil
 }
 
 // ChangePassphrase updates the passphrase used to recover the keys from this key data
 // via the KeyData.RecoverKeysWithPassphrase API. This can only be called if a passhphrase
 // has been set previously (KeyData.AuthMode returns AuthModePassphrase).
 //
-// The current passphrase must be supplied via the oldPassphrase argument.
+// The current passphrase must be supplied via the oldPassphrase argument. If it was
+// verified by a successful call to RecoverKeysWithPassphrase on this KeyData shortly
+// beforehand, the keys that were derived from it then are reused rather than running
+// the KDF again, so that only the new passphrase has to be processed by the KDF.
+// These keys are kept only in memory, for a limited time, and are discarded after
+// the first attempt to use them.
+//
+// If the new passphrase doesn't meet the requirements of the policy configured
+// with SetPassphrasePolicy, a *PassphrasePolicyError error will be returned.
 func (d *KeyData) ChangePassphrase(oldPassphrase, newPassphrase string) error {
 	if d.AuthMode()&AuthModePassphrase == 0 {
 		return errors.New("cannot change passphrase without setting an initial passphrase")
 	}
+	if err := CheckPassphrase(newPassphrase); err != nil {
+		return err
+	}
 
 	payload, oldKey, err := d.openWithPassphrase(oldPassphrase)
 	if err != nil {
@@ -709,11 +902,127 @@ func (d *KeyData) ChangePassphrase(oldPassphrase, newPassphrase string) error {
 	return nil
 }
 
+// SetAuthModeParams contains the parameters for KeyData.SetAuthMode.
+type SetAuthModeParams struct {
+	// Mode is the new authentication mode.
+	Mode AuthMode
+
+	// OldPassphrase is the current passphrase, required if AuthMode
+	// currently returns AuthModePassphrase.
+	OldPassphrase string
+
+	// NewPassphrase is the new passphrase, required if Mode is
+	// AuthModePassphrase.
+	NewPassphrase string
+
+	// KDFOptions is used to derive keys from the new passphrase when
+	// enabling passphrase authentication. If nil, the default Argon2
+	// options are used.
+	KDFOptions KDFOptions
+
+	// AuthKeySize is the size of key to derive from the new passphrase
+	// for use by the platform when enabling passphrase authentication.
+	AuthKeySize int
+}
+
+// SetAuthMode changes the authentication mode for this key data, enabling,
+// changing or removing a passphrase as required. The change is delegated to
+// the platform's handler, so this provides a single entry point for changing
+// the authentication of key data for any platform. When changing between
+// passphrases, this is equivalent to ChangePassphrase.
+//
+// When enabling passphrase authentication, the KDFOptions and AuthKeySize
+// fields of params are used in the same way as the equivalent fields in
+// KeyWithPassphraseParams. Not all platforms support enabling passphrase
+// authentication for a key that was created without it. In that case, the
+// handler will return an error.
+//
+// If the new passphrase doesn't meet the requirements of the policy configured
+// with SetPassphrasePolicy, a *PassphrasePolicyError error will be returned.
+// If the old passphrase is incorrect, a ErrInvalidPassphrase error will be
+// returned.
+//
+// On success, the changes must be persisted using WriteAtomic.
+func (d *KeyData) SetAuthMode(params *SetAuthModeParams) error {
+	switch {
+	case params.Mode != AuthModeNone && params.Mode != AuthModePassphrase:
+		return fmt.Errorf("invalid auth mode %d", params.Mode)
+	case d.AuthMode() == AuthModePassphrase && params.Mode == AuthModePassphrase:
+		return d.ChangePassphrase(params.OldPassphrase, params.NewPassphrase)
+	case d.AuthMode() == AuthModePassphrase:
+		return d.removePassphrase(params.OldPassphrase)
+	case params.Mode == AuthModePassphrase:
+		return d.setPassphrase(params.NewPassphrase, params.KDFOptions, params.AuthKeySize)
+	default:
+		// Nothing to do
+		return nil
+	}
+}
+
+func (d *KeyData) setPassphrase(passphrase string, kdfOptions KDFOptions, authKeySize int) error {
+	if err := CheckPassphrase(passphrase); err != nil {
+		return err
+	}
+
+	params, err := newPassphraseParams(kdfOptions, d.argon2KDF(), authKeySize)
+	if err != nil {
+		return err
+	}
+
+	d.data.PassphraseParams = params
+	if err := d.updatePassphrase(d.data.EncryptedPayload, make([]byte, authKeySize), passphrase); err != nil {
+		d.data.PassphraseParams = nil
+		return processPlatformHandlerError(err)
+	}
+
+	return nil
+}
+
+func (d *KeyData) removePassphrase(passphrase string) error {
+	handler := handlers[d.data.PlatformName]
+	if handler == nil {
+		return ErrNoPlatformHandlerRegistered
+	}
+
+	payload, oldKey, err := d.openWithPassphrase(passphrase)
+	if err != nil {
+		return err
+	}
+
+	// An all-zero auth key indicates that there is no passphrase, as
+	// supplied as the initial key by NewKeyDataWithPassphrase.
+	data := d.platformKeyData()
+	data.AuthMode = AuthModeNone
+	handle, err := handler.ChangeAuthKey(data, oldKey, make([]byte, len(oldKey)))
+	if err != nil {
+		return processPlatformHandlerError(err)
+	}
+
+	d.clearCachedPassphraseKeys()
+	d.data.PlatformHandle = handle
+	d.data.EncryptedPayload = payload
+	d.data.PassphraseParams = nil
+	return nil
+}
+
 // WriteAtomic saves this key data to the supplied KeyDataWriter.
 func (d *KeyData) WriteAtomic(w KeyDataWriter) error {
-	enc := json.NewEncoder(w)
-	if err := enc.Encode(d.data); err != nil {
-		return xerrors.Errorf("cannot encode keydata: %w", err)
+	switch d.format {
+	case KeyDataFormatJSON:
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(d.data); err != nil {
+			return xerrors.Errorf("cannot encode keydata: %w", err)
+		}
+	case KeyDataFormatCBOR:
+		data, err := d.marshalCBOR()
+		if err != nil {
+			return xerrors.Errorf("cannot encode keydata: %w", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return xerrors.Errorf("cannot write keydata: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid keydata format %v", d.format)
 	}
 
 	if err := w.Commit(); err != nil {
@@ -724,11 +1033,35 @@ func (d *KeyData) WriteAtomic(w KeyDataWriter) error {
 }
 
 // ReadKeyData reads the key data from the supplied KeyDataReader, returning a
-// new KeyData object.
+// new KeyData object. The format of the key data is detected automatically.
 func ReadKeyData(r KeyDataReader) (*KeyData, error) {
 	d := &KeyData{readableName: r.ReadableName()}
-	dec := json.NewDecoder(r)
-	if err := dec.Decode(&d.data); err != nil {
+
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(1); err == nil && b[0] == keyDataCBORFormatByte {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read key data: %w", err)
+		}
+		if err := d.unmarshalCBOR(data); err != nil {
+			var verErr *ArtifactVersionError
+			if xerrors.As(err, &verErr) {
+				return nil, verErr
+			}
+			return nil, xerrors.Errorf("cannot decode key data: %w", err)
+		}
+		d.format = KeyDataFormatCBOR
+		return d, nil
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(br).Decode(&raw); err != nil {
+		return nil, xerrors.Errorf("cannot decode key data: %w", err)
+	}
+	if err := artifact.CheckJSON(keyDataArtifact, raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &d.data); err != nil {
 		return nil, xerrors.Errorf("cannot decode key data: %w", err)
 	}
 
@@ -739,7 +1072,16 @@ func ReadKeyData(r KeyDataReader) (*KeyData, error) {
 // should be created by a platform-specific package, containing a payload encrypted by
 // the platform's secure device and the associated handle required for subsequent
 // recovery of the keys.
+//
+// If a role is supplied, it must be a valid name according to ValidateRoleName.
+// It doesn't need to be registered.
 func NewKeyData(params *KeyParams) (*KeyData, error) {
+	if params.Role != "" {
+		if err := ValidateRoleName(params.Role); err != nil {
+			return nil, err
+		}
+	}
+
 	encodedHandle, err := json.Marshal(params.Handle)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot encode platform handle: %w", err)
@@ -748,6 +1090,7 @@ func NewKeyData(params *KeyParams) (*KeyData, error) {
 	kd := &KeyData{
 		data: keyData{
 			Generation:       KeyDataGeneration,
+			Header:           NewArtifactHeader(keyDataMinReaderVersion),
 			PlatformName:     params.PlatformName,
 			Role:             params.Role,
 			PlatformHandle:   json.RawMessage(encodedHandle),
@@ -755,37 +1098,28 @@ func NewKeyData(params *KeyParams) (*KeyData, error) {
 			EncryptedPayload: params.EncryptedPayload,
 		},
 	}
+	kd.requireMinReaderVersion(platformHandleMinReaderVersion(params.Handle))
 
 	return kd, nil
 }
 
-// NewKeyDataWithPassphrase is similar to NewKeyData but creates KeyData objects that are supported
-// by a passphrase, which is passed as an extra argument. The supplied KeyWithPassphraseParams include
-// in addition to the KeyParams fields, the KDFOptions and AuthKeySize fields which are used in the key
-// derivation process.
-func NewKeyDataWithPassphrase(params *KeyWithPassphraseParams, passphrase string) (*KeyData, error) {
-	kd, err := NewKeyData(&params.KeyParams)
-	if err != nil {
-		return nil, err
-	}
-
-	kdfOptions := params.KDFOptions
+func newPassphraseParams(kdfOptions KDFOptions, argon2 Argon2KDF, authKeySize int) (*passphraseParams, error) {
 	if kdfOptions == nil {
 		var defaultOptions Argon2Options
 		kdfOptions = &defaultOptions
 	}
 
-	kdfParams, err := kdfOptions.kdfParams(passphraseKeyLen)
+	kdfParams, err := kdfOptions.kdfParams(argon2, passphraseKeyLen)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot derive KDF cost parameters: %w", err)
 	}
 
 	var salt [16]byte
-	if _, err := rand.Read(salt[:]); err != nil {
+	if _, err := io.ReadFull(testhooks.RandReader, salt[:]); err != nil {
 		return nil, xerrors.Errorf("cannot read salt: %w", err)
 	}
 
-	kd.data.PassphraseParams = &passphraseParams{
+	return &passphraseParams{
 		KDF: kdfData{
 			Salt:      salt[:],
 			kdfParams: *kdfParams,
@@ -793,10 +1127,46 @@ func NewKeyDataWithPassphrase(params *KeyWithPassphraseParams, passphrase string
 		Encryption:        passphraseEncryption,
 		DerivedKeySize:    passphraseKeyLen,
 		EncryptionKeySize: passphraseEncryptionKeyLen,
-		AuthKeySize:       params.AuthKeySize,
+		AuthKeySize:       authKeySize,
+	}, nil
+}
+
+// NewKeyDataWithPassphrase is similar to NewKeyData but creates KeyData objects that are supported
+// by a passphrase, which is passed as an extra argument. The supplied KeyWithPassphraseParams include
+// in addition to the KeyParams fields, the KDFOptions and AuthKeySize fields which are used in the key
+// derivation process.
+//
+// If the passphrase doesn't meet the requirements of the policy configured with
+// SetPassphrasePolicy, a *PassphrasePolicyError error will be returned.
+func NewKeyDataWithPassphrase(params *KeyWithPassphraseParams, passphrase string) (*KeyData, error) {
+	if err := CheckPassphrase(passphrase); err != nil {
+		return nil, err
 	}
 
-	if err := kd.updatePassphrase(kd.data.EncryptedPayload, make([]byte, params.AuthKeySize), passphrase); err != nil {
+	kd, err := NewKeyData(&params.KeyParams)
+	if err != nil {
+		return nil, err
+	}
+
+	authKeySize := params.AuthKeySize
+	kd.argon2 = params.KDF
+
+	switch {
+	case params.PassphraseIsAuthKey:
+		// There's no need for a KDF because there are no keys
+		// derived from the passphrase.
+		authKeySize = 0
+		kd.data.PassphraseParams = &passphraseParams{PassphraseIsAuthKey: true}
+	default:
+		kd.data.PassphraseParams, err = newPassphraseParams(params.KDFOptions, kd.argon2KDF(), authKeySize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The initial auth key is all zeroes, or empty if the passphrase is
+	// supplied as the auth key.
+	if err := kd.updatePassphrase(kd.data.EncryptedPayload, make([]byte, authKeySize), passphrase); err != nil {
 		return nil, xerrors.Errorf("cannot set passphrase: %w", err)
 	}
 
@@ -828,19 +1198,21 @@ func unmarshalProtectedKeys(data []byte) (*protectedKeys, error) {
 	return pk, nil
 }
 
-func (k *protectedKeys) unlockKey(alg crypto.Hash) DiskUnlockKey {
+func (k *protectedKeys) unlockKey(alg crypto.Hash) (DiskUnlockKey, error) {
 	if alg == crypto.Hash(nilHash) {
 		// This is to support the legacy TPM key data created
 		// via tpm2.NewKeyDataFromSealedKeyObjectFile.
-		return k.Unique
+		return k.Unique, nil
 	}
 
 	unlockKey := make([]byte, len(k.Primary))
 	r := hkdf.New(func() hash.Hash { return alg.New() }, k.Primary, k.Unique, []byte("UNLOCK"))
 	if _, err := io.ReadFull(r, unlockKey); err != nil {
-		panic(err)
+		// HKDF can't produce keys larger than 255 times the
+		// digest size.
+		return nil, err
 	}
-	return unlockKey
+	return unlockKey, nil
 }
 
 func (k *protectedKeys) marshalASN1(builder *cryptobyte.Builder) {
@@ -871,5 +1243,10 @@ func MakeDiskUnlockKey(rand io.Reader, alg crypto.Hash, primaryKey PrimaryKey) (
 		return nil, nil, xerrors.Errorf("cannot marshal cleartext payload: %w", err)
 	}
 
-	return pk.unlockKey(alg), cleartextPayload, nil
+	unlockKey, err = pk.unlockKey(alg)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive unlock key: %w", err)
+	}
+
+	return unlockKey, cleartextPayload, nil
 }
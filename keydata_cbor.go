@@ -0,0 +1,319 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/artifact"
+	"github.com/snapcore/secboot/internal/cbor"
+)
+
+// KeyDataFormat describes the encoding used to serialize a KeyData.
+type KeyDataFormat int
+
+const (
+	// KeyDataFormatJSON indicates that a KeyData is serialized as JSON. This
+	// is the default, and is understood by all releases of this package.
+	KeyDataFormatJSON KeyDataFormat = iota
+
+	// KeyDataFormatCBOR indicates that a KeyData is serialized as CBOR,
+	// which is more compact and cheaper to parse. The fields of the key
+	// data are identified by integers rather than by name, and the
+	// encrypted payload is encoded as a byte string rather than as a base64
+	// string. The opaque platform handle is stored as a byte string
+	// containing its JSON encoding so that it is preserved exactly. The
+	// serialized data starts with a format byte that can't appear at the
+	// start of the JSON format. When written to a LUKS2 token, the data is
+	// compressed and stored as a base64 encoded JSON string. Note that older
+	// releases of this package can't read this format.
+	KeyDataFormatCBOR
+)
+
+func (f KeyDataFormat) String() string {
+	switch f {
+	case KeyDataFormatJSON:
+		return "json"
+	case KeyDataFormatCBOR:
+		return "cbor"
+	default:
+		return fmt.Sprintf("KeyDataFormat(%d)", int(f))
+	}
+}
+
+// keyDataCBORFormatByte is the first byte of key data serialized as CBOR.
+const keyDataCBORFormatByte = 0x01
+
+// keyDataCBORKeys maps the names of the top-level fields of keyData to the
+// integer keys used in the CBOR encoding. These must never be changed.
+var keyDataCBORKeys = map[string]uint64{
+	"generation":             1,
+	"platform_name":          2,
+	"platform_handle":        3,
+	"role":                   4,
+	"kdf_alg":                5,
+	"encrypted_payload":      6,
+	"passphrase_params":      7,
+	"authorized_snap_models": 8,
+}
+
+// jsonToCBORValue converts a value decoded from JSON with json.Decoder.UseNumber
+// to a value that can be encoded with cbor.Marshal.
+func jsonToCBORValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return n, nil
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			e, err := jsonToCBORValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, e := range v {
+			e, err := jsonToCBORValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = e
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// cborToJSONValue converts a value decoded with cbor.Unmarshal to a value
+// that can be encoded with json.Marshal.
+func cborToJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, errors.New("unsupported float value")
+		}
+		return v, nil
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			e, err := cborToJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected map key type %T", k)
+			}
+			e, err := cborToJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out[ks] = e
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func (d *KeyData) marshalCBOR() ([]byte, error) {
+	j, err := json.Marshal(d.data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	m := make(map[interface{}]interface{})
+	for name, v := range fields {
+		v, err := jsonToCBORValue(v)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot encode %s: %w", name, err)
+		}
+		switch name {
+		case "platform_handle":
+			// Preserve the platform handle exactly, as this is opaque
+			// to us and is used to compute the unique ID of the key
+			// data.
+			v = []byte(d.data.PlatformHandle)
+		case "encrypted_payload":
+			if s, ok := v.(string); ok {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, xerrors.Errorf("cannot decode %s: %w", name, err)
+				}
+				v = b
+			}
+		}
+
+		if key, ok := keyDataCBORKeys[name]; ok {
+			m[key] = v
+		} else {
+			m[name] = v
+		}
+	}
+
+	b, err := cbor.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{keyDataCBORFormatByte}, b...), nil
+}
+
+func (d *KeyData) unmarshalCBOR(data []byte) error {
+	if len(data) == 0 || data[0] != keyDataCBORFormatByte {
+		return errors.New("invalid format byte")
+	}
+
+	v, err := cbor.Unmarshal(data[1:])
+	if err != nil {
+		return err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("key data is not a map")
+	}
+
+	names := make(map[uint64]string)
+	for name, key := range keyDataCBORKeys {
+		names[key] = name
+	}
+
+	var platformHandle []byte
+	fields := make(map[string]interface{})
+	for k, v := range m {
+		var name string
+		switch k := k.(type) {
+		case uint64:
+			var ok bool
+			name, ok = names[k]
+			if !ok {
+				return fmt.Errorf("unexpected key %d", k)
+			}
+		case string:
+			name = k
+		default:
+			return fmt.Errorf("unexpected key type %T", k)
+		}
+
+		if name == "platform_handle" {
+			b, ok := v.([]byte)
+			if !ok {
+				return fmt.Errorf("unexpected type %T for platform_handle", v)
+			}
+			platformHandle = b
+			continue
+		}
+
+		v, err := cborToJSONValue(v)
+		if err != nil {
+			return xerrors.Errorf("cannot decode %s: %w", name, err)
+		}
+		fields[name] = v
+	}
+
+	j, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := artifact.CheckJSON(keyDataArtifact, j); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(j, &d.data); err != nil {
+		return err
+	}
+	if platformHandle != nil {
+		if !json.Valid(platformHandle) {
+			return errors.New("platform_handle is not valid JSON")
+		}
+		d.data.PlatformHandle = platformHandle
+	}
+	return nil
+}
+
+// Format returns the format in which this key data is serialized by
+// WriteAtomic. This is the format that it was read in, or KeyDataFormatJSON
+// for new key data.
+func (d *KeyData) Format() KeyDataFormat {
+	return d.format
+}
+
+// SetFormat sets the format in which this key data is serialized by
+// WriteAtomic. This can be used to convert key data between formats.
+func (d *KeyData) SetFormat(format KeyDataFormat) {
+	d.format = format
+}
+
+type bytesKeyDataReader struct {
+	*bytes.Reader
+}
+
+func (bytesKeyDataReader) ReadableName() string { return "" }
+
+type bytesKeyDataWriter struct {
+	*bytes.Buffer
+}
+
+func (bytesKeyDataWriter) Commit() error { return nil }
+
+// ConvertKeyDataFormat converts the supplied serialized key data, which may be
+// in any supported format, to the specified format.
+func ConvertKeyDataFormat(data []byte, format KeyDataFormat) ([]byte, error) {
+	kd, err := ReadKeyData(bytesKeyDataReader{bytes.NewReader(data)})
+	if err != nil {
+		return nil, err
+	}
+	kd.SetFormat(format)
+
+	w := bytesKeyDataWriter{new(bytes.Buffer)}
+	if err := kd.WriteAtomic(w); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
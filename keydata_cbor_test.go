@@ -0,0 +1,149 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type keyDataCBORSuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&keyDataCBORSuite{})
+
+func (s *keyDataCBORSuite) writeKeyData(c *C, keyData *KeyData) []byte {
+	w := makeMockKeyDataWriter()
+	c.Assert(keyData.WriteAtomic(w), IsNil)
+	data, err := ioutil.ReadAll(w.Reader())
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *keyDataCBORSuite) TestRoundTrip(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Format(), Equals, KeyDataFormatJSON)
+
+	expectedId, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+
+	jsonData := s.writeKeyData(c, keyData)
+
+	keyData.SetFormat(KeyDataFormatCBOR)
+	cborData := s.writeKeyData(c, keyData)
+	c.Check(cborData[0], Equals, byte(0x01))
+	c.Check(len(cborData) < len(jsonData), Equals, true)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(cborData)})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Format(), Equals, KeyDataFormatCBOR)
+	c.Check(keyData.ReadableName(), Equals, "foo")
+	c.Check(keyData.PlatformName(), Equals, s.mockPlatformName)
+
+	id, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedId)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keyDataCBORSuite) TestRoundTripWithPassphrase(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, &PBKDF2Options{}, 32, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase")
+	c.Assert(err, IsNil)
+	keyData.SetFormat(KeyDataFormatCBOR)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(s.writeKeyData(c, keyData))})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Format(), Equals, KeyDataFormatCBOR)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keyDataCBORSuite) TestConvertKeyDataFormat(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	jsonData := s.writeKeyData(c, keyData)
+
+	cborData, err := ConvertKeyDataFormat(jsonData, KeyDataFormatCBOR)
+	c.Assert(err, IsNil)
+	c.Check(cborData[0], Equals, byte(0x01))
+
+	converted, err := ConvertKeyDataFormat(cborData, KeyDataFormatJSON)
+	c.Assert(err, IsNil)
+	c.Check(json.Valid(converted), Equals, true)
+	c.Check(converted, DeepEquals, jsonData)
+}
+
+func (s *keyDataCBORSuite) TestReadInvalidCBOR(c *C) {
+	_, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader([]byte{0x01, 0x83, 0x01})})
+	c.Check(err, ErrorMatches, `cannot decode key data: unexpected end of data`)
+}
+
+func (s *keyDataCBORSuite) TestReadCBORNotMap(c *C) {
+	_, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader([]byte{0x01, 0x01})})
+	c.Check(err, ErrorMatches, `cannot decode key data: key data is not a map`)
+}
+
+func (s *keyDataCBORSuite) TestReadCBORUnexpectedKey(c *C) {
+	_, err := ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader([]byte{0x01, 0xa1, 0x18, 0x64, 0x00})})
+	c.Check(err, ErrorMatches, `cannot decode key data: unexpected key 100`)
+}
+
+func (s *keyDataCBORSuite) TestWriteInvalidFormat(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFormat(KeyDataFormat(5))
+	c.Check(keyData.WriteAtomic(makeMockKeyDataWriter()), ErrorMatches, `invalid keydata format KeyDataFormat\(5\)`)
+}
+
+func (s *keyDataCBORSuite) TestKeyDataFormatString(c *C) {
+	c.Check(KeyDataFormatJSON.String(), Equals, "json")
+	c.Check(KeyDataFormatCBOR.String(), Equals, "cbor")
+	c.Check(KeyDataFormat(5).String(), Equals, "KeyDataFormat(5)")
+}
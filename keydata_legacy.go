@@ -48,7 +48,7 @@ func unmarshalV1KeyPayload(data []byte) (unlockKey DiskUnlockKey, auxKey Primary
 
 	if sz > 0 {
 		unlockKey = make(DiskUnlockKey, sz)
-		if _, err := r.Read(unlockKey); err != nil {
+		if _, err := io.ReadFull(r, unlockKey); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -59,7 +59,7 @@ func unmarshalV1KeyPayload(data []byte) (unlockKey DiskUnlockKey, auxKey Primary
 
 	if sz > 0 {
 		auxKey = make(PrimaryKey, sz)
-		if _, err := r.Read(auxKey); err != nil {
+		if _, err := io.ReadFull(r, auxKey); err != nil {
 			return nil, nil, err
 		}
 	}
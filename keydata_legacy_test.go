@@ -38,8 +38,8 @@ func (s *keyDataLegacySuite) SetUpSuite(c *C) {
 }
 
 func (s *keyDataLegacySuite) SetUpTest(c *C) {
-	s.handler.state = mockPlatformDeviceStateOK
-	s.handler.passphraseSupport = false
+	s.handler.State = mockPlatformDeviceStateOK
+	s.handler.PassphraseSupport = false
 }
 
 func (s *keyDataLegacySuite) TearDownSuite(c *C) {
@@ -130,7 +130,7 @@ func (s *keyDataLegacySuite) TestLegacyKeyPayloadUnmarshalInvalid1(c *C) {
 	}
 
 	key, auxKey, err := UnmarshalV1KeyPayload(payload)
-	c.Check(err, ErrorMatches, "EOF")
+	c.Check(err, ErrorMatches, "unexpected EOF")
 	c.Check(key, IsNil)
 	c.Check(auxKey, IsNil)
 }
@@ -189,7 +189,7 @@ func (s *keyDataLegacySuite) TestRecoverKeysInvalidData(c *C) {
 
 	c.Assert(err, IsNil)
 	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
-	c.Check(err, ErrorMatches, "invalid key data: JSON decode error: json: cannot unmarshal string into Go value of type secboot_test.mockPlatformKeyDataHandle")
+	c.Check(err, ErrorMatches, "invalid key data: JSON decode error: json: cannot unmarshal string into Go value of type secboottest.MockPlatformKeyDataHandle")
 	c.Check(recoveredKey, IsNil)
 	c.Check(recoveredAuxKey, IsNil)
 }
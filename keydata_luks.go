@@ -21,7 +21,12 @@ package secboot
 
 import (
 	"bytes"
+	"compress/flate"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 
 	"golang.org/x/xerrors"
 
@@ -29,6 +34,84 @@ import (
 	"github.com/snapcore/secboot/internal/luksview"
 )
 
+const (
+	// luks2CompressedKeyDataFormatByte is the first byte of key data that
+	// is stored in a LUKS2 token in a compressed form. This can't appear at
+	// the start of the JSON or CBOR formats.
+	luks2CompressedKeyDataFormatByte = 0x02
+
+	// luks2MaxKeyDataSize is the maximum size of decompressed key data.
+	// This is the maximum size of the LUKS2 JSON metadata area.
+	luks2MaxKeyDataSize = 4*1024*1024 - 4096
+)
+
+// encodeLUKS2TokenKeyData encodes the supplied serialized key data so that it
+// can be stored in a LUKS2 token. LUKS2 tokens are JSON, so key data that
+// isn't JSON has to be stored as a base64 encoded JSON string. In this case, it
+// is compressed first, which recovers more than the space lost to the base64
+// encoding because the platform handle and some other fields are themselves
+// base64 encoded.
+func encodeLUKS2TokenKeyData(data []byte) (json.RawMessage, error) {
+	if len(data) == 0 || data[0] != keyDataCBORFormatByte {
+		return data, nil
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(luks2CompressedKeyDataFormatByte)
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(buf.Bytes())
+}
+
+// decodeLUKS2TokenKeyData decodes serialized key data from the supplied LUKS2
+// token data, which was encoded by encodeLUKS2TokenKeyData.
+func decodeLUKS2TokenKeyData(data json.RawMessage) ([]byte, error) {
+	if len(data) == 0 || data[0] != '"' {
+		return data, nil
+	}
+
+	var decoded []byte
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 || decoded[0] != luks2CompressedKeyDataFormatByte {
+		return decoded, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(decoded[1:]))
+	defer r.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, luks2MaxKeyDataSize+1))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decompress: %w", err)
+	}
+	if len(decompressed) > luks2MaxKeyDataSize {
+		return nil, errors.New("decompressed key data is too large")
+	}
+	return decompressed, nil
+}
+
+// LUKS2MetadataSpaceError is returned when writing a KeyData to a LUKS2 token
+// if there is insufficient space for it in the container's JSON metadata area.
+// The size of this area is set when the container is created (see
+// InitializeLUKS2ContainerOptions.MetadataKiBSize).
+type LUKS2MetadataSpaceError struct {
+	Required  uint64 // The number of bytes required for the token
+	Available uint64 // The number of bytes available for the token
+}
+
+func (e *LUKS2MetadataSpaceError) Error() string {
+	return fmt.Sprintf("insufficient space in LUKS2 metadata area for key data: %d bytes required, %d bytes available", e.Required, e.Available)
+}
+
 // LUKS2KeyDataReader provides a mechanism to read a KeyData from a LUKS2 token.
 type LUKS2KeyDataReader struct {
 	name     string
@@ -49,6 +132,9 @@ func NewLUKS2KeyDataReader(devicePath, name string) (*LUKS2KeyDataReader, error)
 	if !exists {
 		return nil, errors.New("a keyslot with the specified name does not exist")
 	}
+	if t, ok := token.(*luksview.UnsupportedToken); ok {
+		return nil, t.Err
+	}
 
 	kdToken, ok := token.(*luksview.KeyDataToken)
 	if !ok {
@@ -59,11 +145,16 @@ func NewLUKS2KeyDataReader(devicePath, name string) (*LUKS2KeyDataReader, error)
 		return nil, errors.New("named keyslot does not contain key data yet")
 	}
 
+	data, err := decodeLUKS2TokenKeyData(kdToken.Data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode key data: %w", err)
+	}
+
 	return &LUKS2KeyDataReader{
 		name:     devicePath + ":" + name,
 		slot:     token.Keyslots()[0],
 		priority: kdToken.Priority,
-		Reader:   bytes.NewReader(kdToken.Data)}, nil
+		Reader:   bytes.NewReader(data)}, nil
 }
 
 func (r *LUKS2KeyDataReader) ReadableName() string {
@@ -85,11 +176,12 @@ func (r *LUKS2KeyDataReader) Priority() int {
 
 // LUKS2KeyDataWriter provides a mechanism to write a KeyData to a LUKS2 token.
 type LUKS2KeyDataWriter struct {
-	devicePath string
-	id         int
-	slot       int
-	name       string
-	priority   int
+	devicePath   string
+	id           int
+	slot         int
+	name         string
+	priority     int
+	maxTokenSize int64 // The maximum size of the updated token, or -1 if not known
 	*bytes.Buffer
 }
 
@@ -116,22 +208,52 @@ func NewLUKS2KeyDataWriter(devicePath, name string) (*LUKS2KeyDataWriter, error)
 		return nil, errors.New("named keyslot has the wrong type")
 	}
 
+	// The updated token can use the space occupied by the current token in
+	// addition to the free space in the metadata area.
+	maxTokenSize := int64(-1)
+	if used, total := view.MetadataSpace(); total > 0 {
+		current, err := json.Marshal(kdToken)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot encode existing token: %w", err)
+		}
+		maxTokenSize = int64(total) - int64(used) + int64(len(current))
+		if maxTokenSize < 0 {
+			maxTokenSize = 0
+		}
+	}
+
 	return &LUKS2KeyDataWriter{
-		devicePath: devicePath,
-		id:         id,
-		slot:       token.Keyslots()[0],
-		name:       name,
-		priority:   kdToken.Priority,
-		Buffer:     new(bytes.Buffer)}, nil
+		devicePath:   devicePath,
+		id:           id,
+		slot:         token.Keyslots()[0],
+		name:         name,
+		priority:     kdToken.Priority,
+		maxTokenSize: maxTokenSize,
+		Buffer:       new(bytes.Buffer)}, nil
 }
 
 func (w *LUKS2KeyDataWriter) Commit() error {
+	data, err := encodeLUKS2TokenKeyData(w.Bytes())
+	if err != nil {
+		return xerrors.Errorf("cannot encode key data: %w", err)
+	}
+
 	token := &luksview.KeyDataToken{
 		TokenBase: luksview.TokenBase{
 			TokenKeyslot: w.slot,
 			TokenName:    w.name},
 		Priority: w.priority,
-		Data:     w.Bytes()}
+		Data:     data}
+
+	if w.maxTokenSize >= 0 {
+		tokenData, err := json.Marshal(token)
+		if err != nil {
+			return xerrors.Errorf("cannot encode token: %w", err)
+		}
+		if int64(len(tokenData)) > w.maxTokenSize {
+			return &LUKS2MetadataSpaceError{Required: uint64(len(tokenData)), Available: uint64(w.maxTokenSize)}
+		}
+	}
 
 	return luks2ImportToken(w.devicePath, token, &luks2.ImportTokenOptions{Id: w.id, Replace: true})
 }
@@ -145,3 +267,64 @@ func (w *LUKS2KeyDataWriter) Commit() error {
 func (w *LUKS2KeyDataWriter) SetPriority(priority int) {
 	w.priority = priority
 }
+
+// LUKS2KeyDataInfo describes a keyslot on a LUKS2 container that can contain
+// a KeyData, as returned from ListLUKS2ContainerKeyData.
+type LUKS2KeyDataInfo struct {
+	Name       string // The name of the keyslot
+	Keyslot    int    // The ID of the keyslot
+	Priority   int    // The priority of the key data
+	HasKeyData bool   // Whether a KeyData has been written to the keyslot's token
+}
+
+// ListLUKS2ContainerKeyData returns information about each of the keyslots on
+// the specified LUKS2 container that store a KeyData in their associated token,
+// sorted by name. This includes keyslots with a negative priority and keyslots
+// that don't contain key data yet. A KeyData can be read from one of these with
+// NewLUKS2KeyDataReader.
+func ListLUKS2ContainerKeyData(devicePath string) ([]*LUKS2KeyDataInfo, error) {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS2 header view: %w", err)
+	}
+
+	var out []*LUKS2KeyDataInfo
+	for _, name := range view.TokenNames() {
+		token, _, _ := view.TokenByName(name)
+		kdToken, ok := token.(*luksview.KeyDataToken)
+		if !ok {
+			continue
+		}
+		out = append(out, &LUKS2KeyDataInfo{
+			Name:       name,
+			Keyslot:    token.Keyslots()[0],
+			Priority:   kdToken.Priority,
+			HasKeyData: kdToken.Data != nil})
+	}
+
+	return out, nil
+}
+
+// ImportKeyDataToLUKS2Container writes the supplied KeyData to the token
+// associated with the keyslot with the specified name on the specified LUKS2
+// container, with the supplied priority, replacing any KeyData that the token
+// already contains. This is useful for migrating key data that is stored in a
+// separate file so that it is stored with the container that it protects. The
+// keyslot must have been created with InitializeLUKS2Container or
+// AddLUKS2ContainerUnlockKey, and the supplied KeyData must protect the key for
+// it.
+//
+// If there is insufficient space for the KeyData in the container's JSON
+// metadata area, a *LUKS2MetadataSpaceError error will be returned.
+func ImportKeyDataToLUKS2Container(devicePath, keyslotName string, keyData *KeyData, priority int) error {
+	w, err := NewLUKS2KeyDataWriter(devicePath, keyslotName)
+	if err != nil {
+		return xerrors.Errorf("cannot create writer: %w", err)
+	}
+	w.SetPriority(priority)
+
+	if err := keyData.WriteAtomic(w); err != nil {
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+	return nil
+}
@@ -20,11 +20,15 @@
 package secboot_test
 
 import (
+	"bytes"
 	"crypto"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
+	"golang.org/x/xerrors"
 
 	. "gopkg.in/check.v1"
 
@@ -228,12 +232,141 @@ func (s *keyDataLuksSuite) TestWriterTokenWrongType(c *C) {
 	c.Check(err, ErrorMatches, "named keyslot has the wrong type")
 }
 
+func (s *keyDataLuksSuite) TestWriterWithMetadataSpace(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "foo",
+					TokenKeyslot: 0}},
+		},
+		keyslots:     map[int][]byte{0: unlockKey},
+		headerSize:   16384,
+		metadataSize: 2000}
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w, err := NewLUKS2KeyDataWriter("/dev/sda1", "foo")
+	c.Assert(err, IsNil)
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	s.checkKeyDataJSONFromLUKSToken(c, "/dev/sda1", 0, 0, "foo", 0, protected, 0)
+}
+
+func (s *keyDataLuksSuite) TestWriterInsufficientMetadataSpace(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	token := &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenName:    "foo",
+			TokenKeyslot: 0}}
+	tokenData, err := json.Marshal(token)
+	c.Assert(err, IsNil)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens:       map[int]luks2.Token{0: token},
+		keyslots:     map[int][]byte{0: unlockKey},
+		headerSize:   16384,
+		metadataSize: 12000}
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w, err := NewLUKS2KeyDataWriter("/dev/sda1", "foo")
+	c.Assert(err, IsNil)
+	err = keyData.WriteAtomic(w)
+	c.Check(err, ErrorMatches, `cannot commit keydata: insufficient space in LUKS2 metadata area for key data: [[:digit:]]+ bytes required, [[:digit:]]+ bytes available`)
+
+	var e *LUKS2MetadataSpaceError
+	c.Assert(xerrors.As(err, &e), testutil.IsTrue)
+	c.Check(e.Available, Equals, uint64(12288-12000+len(tokenData)))
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *keyDataLuksSuite) TestListLUKS2ContainerKeyData(c *C) {
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "default",
+					TokenKeyslot: 0},
+				Priority: 1,
+				Data:     []byte("{}")},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "default-recovery",
+					TokenKeyslot: 1}},
+			2: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "bar",
+					TokenKeyslot: 3},
+				Priority: -1},
+		},
+		keyslots: map[int][]byte{0: nil, 1: nil, 3: nil}}
+
+	keys, err := ListLUKS2ContainerKeyData("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*LUKS2KeyDataInfo{
+		{Name: "bar", Keyslot: 3, Priority: -1},
+		{Name: "default", Keyslot: 0, Priority: 1, HasKeyData: true},
+	})
+}
+
+func (s *keyDataLuksSuite) TestListLUKS2ContainerKeyDataNoContainer(c *C) {
+	_, err := ListLUKS2ContainerKeyData("/dev/sda1")
+	c.Check(err, ErrorMatches, `cannot obtain LUKS2 header view: no container`)
+}
+
+func (s *keyDataLuksSuite) TestImportKeyDataToLUKS2Container(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			3: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "foo",
+					TokenKeyslot: 2}},
+		},
+		keyslots: map[int][]byte{2: unlockKey}}
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(ImportKeyDataToLUKS2Container("/dev/sda1", "foo", keyData, 4), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("ImportToken(/dev/sda1,", &luks2.ImportTokenOptions{Id: 3, Replace: true}, ")"),
+	})
+	s.checkKeyDataJSONFromLUKSToken(c, "/dev/sda1", 3, 2, "foo", 4, protected, 0)
+}
+
+func (s *keyDataLuksSuite) TestImportKeyDataToLUKS2ContainerNoKeyslot(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	s.luks2.devices["/dev/sda1"] = newMockLUKS2Container()
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(ImportKeyDataToLUKS2Container("/dev/sda1", "foo", keyData, 0), ErrorMatches,
+		`cannot create writer: a keyslot with the specified name does not exist`)
+}
+
 type testKeyDataLuksReaderData struct {
 	id       int
 	path     string
 	name     string
 	slot     int
 	priority int
+	format   KeyDataFormat
 }
 
 func (s *keyDataLuksSuite) testReader(c *C, data *testKeyDataLuksReaderData) {
@@ -256,6 +389,7 @@ func (s *keyDataLuksSuite) testReader(c *C, data *testKeyDataLuksReaderData) {
 	expectedId, err := keyData.UniqueID()
 	c.Check(err, IsNil)
 
+	keyData.SetFormat(data.format)
 	w, err := NewLUKS2KeyDataWriter(data.path, data.name)
 	c.Check(keyData.WriteAtomic(w), IsNil)
 
@@ -273,6 +407,7 @@ func (s *keyDataLuksSuite) testReader(c *C, data *testKeyDataLuksReaderData) {
 	keyData, err = ReadKeyData(r)
 	c.Assert(err, IsNil)
 	c.Check(keyData.ReadableName(), Equals, data.path+":"+data.name)
+	c.Check(keyData.Format(), Equals, data.format)
 
 	id, err := keyData.UniqueID()
 	c.Check(err, IsNil)
@@ -294,6 +429,122 @@ func (s *keyDataLuksSuite) TestReader(c *C) {
 	})
 }
 
+func (s *keyDataLuksSuite) TestReaderCBOR(c *C) {
+	s.testReader(c, &testKeyDataLuksReaderData{
+		id:       0,
+		path:     "/dev/sda1",
+		name:     "foo",
+		slot:     0,
+		priority: 1,
+		format:   KeyDataFormatCBOR,
+	})
+
+	// The token data is a base64 encoded JSON string containing the
+	// compressed key data.
+	token := s.luks2.devices["/dev/sda1"].tokens[0].(*luksview.KeyDataToken)
+	var data []byte
+	c.Assert(json.Unmarshal(token.Data, &data), IsNil)
+	c.Check(data[0], Equals, byte(0x02))
+}
+
+func (s *keyDataLuksSuite) TestWriterCBORTokenSize(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	// Replace the platform handle with one that is similar in size and
+	// content to a TPM sealed key object, which contains base64 encoded
+	// binary fields.
+	w := makeMockKeyDataWriter()
+	c.Assert(keyData.WriteAtomic(w), IsNil)
+	var fields map[string]json.RawMessage
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&fields), IsNil)
+
+	rng := rand.New(rand.NewSource(0))
+	field := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	handle := map[string]interface{}{
+		"version":         3,
+		"key_private":     field(222),
+		"key_public":      append(make([]byte, 78), field(32)...),
+		"import_sym_seed": field(258),
+		"auth_public_key": append(make([]byte, 20), field(70)...),
+		"pcr_or_digests":  [][]byte{field(32), field(32), field(32), field(32), field(32), field(32), field(32), field(32)},
+		"signature_r":     field(32),
+		"signature_s":     field(32)}
+	fields["platform_handle"], err = json.Marshal(handle)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(fields)
+	c.Assert(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(data)})
+	c.Assert(err, IsNil)
+
+	tokenSize := func(format KeyDataFormat) int {
+		s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenName:    "foo",
+						TokenKeyslot: 0}},
+			},
+			keyslots: map[int][]byte{0: unlockKey}}
+
+		keyData.SetFormat(format)
+		w, err := NewLUKS2KeyDataWriter("/dev/sda1", "foo")
+		c.Assert(err, IsNil)
+		c.Assert(keyData.WriteAtomic(w), IsNil)
+
+		data, err := json.Marshal(s.luks2.devices["/dev/sda1"].tokens[0])
+		c.Assert(err, IsNil)
+		return len(data)
+	}
+
+	// Measure the size of the token actually written to the LUKS2 header.
+	jsonSize := tokenSize(KeyDataFormatJSON)
+	cborSize := tokenSize(KeyDataFormatCBOR)
+	c.Logf("JSON token: %d bytes, CBOR token: %d bytes", jsonSize, cborSize)
+	c.Check(cborSize < jsonSize, testutil.IsTrue)
+}
+
+func (s *keyDataLuksSuite) TestReaderUncompressedCBOR(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFormat(KeyDataFormatCBOR)
+
+	w := makeMockKeyDataWriter()
+	c.Assert(keyData.WriteAtomic(w), IsNil)
+	cborData, err := ioutil.ReadAll(w.Reader())
+	c.Assert(err, IsNil)
+
+	// Key data that was written before compression was added.
+	tokenData, err := json.Marshal(cborData)
+	c.Assert(err, IsNil)
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenName:    "foo",
+					TokenKeyslot: 0},
+				Data: tokenData},
+		},
+		keyslots: map[int][]byte{0: unlockKey}}
+
+	r, err := NewLUKS2KeyDataReader("/dev/sda1", "foo")
+	c.Assert(err, IsNil)
+	keyData, err = ReadKeyData(r)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Format(), Equals, KeyDataFormatCBOR)
+}
+
 func (s *keyDataLuksSuite) TestReaderDifferentPath(c *C) {
 	s.testReader(c, &testKeyDataLuksReaderData{
 		id:       0,
@@ -0,0 +1,153 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/snapcore/secboot/testhooks"
+)
+
+// passphraseKeysCacheLifetime is how long the keys derived from a passphrase
+// that was verified by KeyData.RecoverKeysWithPassphrase can be reused when
+// changing or removing the passphrase on the same KeyData.
+var passphraseKeysCacheLifetime = 30 * time.Second
+
+// timeAfterFunc is used to wipe cached passphrase keys once they expire.
+var timeAfterFunc = time.AfterFunc
+
+// cachedPassphraseKeys contains the keys derived from a passphrase that was
+// recently verified by the platform, so that a subsequent passphrase change can
+// avoid running the KDF for the old passphrase again. The passphrase itself is
+// not retained - only a MAC of it with a random key, which is used to check that
+// the same passphrase is being supplied.
+//
+// The keys are wiped by a timer when they expire, even if they are never
+// used, so that they don't remain in memory for the lifetime of the KeyData.
+// As this happens on another goroutine, access to the keys is serialized
+// with mu.
+type cachedPassphraseKeys struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	wiped bool
+
+	params        *passphraseParams
+	macKey        []byte
+	passphraseMAC []byte
+	key           []byte
+	iv            []byte
+	auth          []byte
+	expiry        time.Time
+}
+
+func passphraseMAC(key []byte, passphrase string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(passphrase))
+	return h.Sum(nil)
+}
+
+// wipe clears the cached keys from memory.
+func (c *cachedPassphraseKeys) wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wipeLocked()
+}
+
+func (c *cachedPassphraseKeys) wipeLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	for _, b := range [][]byte{c.macKey, c.passphraseMAC, c.key, c.iv, c.auth} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	c.wiped = true
+}
+
+// cachePassphraseKeys retains the supplied keys, which were derived from the
+// supplied passphrase and have just been verified by the platform. Any previously
+// cached keys are discarded.
+func (d *KeyData) cachePassphraseKeys(passphrase string, key, iv, auth []byte) {
+	d.clearCachedPassphraseKeys()
+
+	macKey := make([]byte, 32)
+	if _, err := io.ReadFull(testhooks.RandReader, macKey); err != nil {
+		// Caching is only an optimization.
+		return
+	}
+
+	c := &cachedPassphraseKeys{
+		params:        d.data.PassphraseParams,
+		macKey:        macKey,
+		passphraseMAC: passphraseMAC(macKey, passphrase),
+		key:           append([]byte(nil), key...),
+		iv:            append([]byte(nil), iv...),
+		auth:          append([]byte(nil), auth...),
+		expiry:        timeNow().Add(passphraseKeysCacheLifetime),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = timeAfterFunc(passphraseKeysCacheLifetime, c.wipe)
+	d.passphraseKeys = c
+}
+
+// takeCachedPassphraseKeys returns the cached keys for the supplied passphrase
+// if there are any that haven't expired, and they were derived with the current
+// passphrase parameters. The cache is cleared regardless, so keys are only reused
+// once.
+func (d *KeyData) takeCachedPassphraseKeys(passphrase string) (key, iv, auth []byte, ok bool) {
+	c := d.passphraseKeys
+	if c == nil {
+		return nil, nil, nil, false
+	}
+	d.passphraseKeys = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.wiped || timeNow().After(c.expiry) || c.params != d.data.PassphraseParams ||
+		!hmac.Equal(passphraseMAC(c.macKey, passphrase), c.passphraseMAC) {
+		c.wipeLocked()
+		return nil, nil, nil, false
+	}
+
+	// Hand the keys to the caller, making sure that the timer doesn't
+	// wipe them whilst they are being used.
+	key = append([]byte(nil), c.key...)
+	iv = append([]byte(nil), c.iv...)
+	auth = append([]byte(nil), c.auth...)
+	c.wipeLocked()
+	return key, iv, auth, true
+}
+
+// clearCachedPassphraseKeys discards any cached passphrase keys.
+func (d *KeyData) clearCachedPassphraseKeys() {
+	if d.passphraseKeys == nil {
+		return
+	}
+	d.passphraseKeys.wipe()
+	d.passphraseKeys = nil
+}
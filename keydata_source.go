@@ -0,0 +1,207 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+// KeyDataSource provides an ordered list of KeyData objects that can be used
+// to activate a volume with ActivateVolumeWithMultipleKeyData.
+type KeyDataSource interface {
+	// Name returns a human readable name for this source, which is used
+	// to identify it in errors.
+	Name() string
+
+	// ReadKeyData returns the KeyData objects provided by this source for
+	// the LUKS container at the specified path.
+	ReadKeyData(sourceDevicePath string) ([]*KeyData, error)
+}
+
+// keyCandidateSource is implemented by sources that can associate KeyData
+// objects with specific keyslots on the container, or which need to mark some
+// of them as unusable.
+type keyCandidateSource interface {
+	readKeyCandidates(sourceDevicePath string, view *luksview.View) ([]*keyCandidate, error)
+}
+
+// readKeyCandidatesFromSource returns an activation candidate for each KeyData
+// provided by the supplied source. The view may be nil if the container's
+// LUKS2 header could not be decoded.
+func readKeyCandidatesFromSource(source KeyDataSource, sourceDevicePath string, view *luksview.View) ([]*keyCandidate, error) {
+	if s, ok := source.(keyCandidateSource); ok {
+		return s.readKeyCandidates(sourceDevicePath, view)
+	}
+
+	keys, err := source.ReadKeyData(sourceDevicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*keyCandidate
+	for _, key := range keys {
+		candidates = append(candidates, &keyCandidate{KeyData: key, slot: luks2.AnySlot})
+	}
+	return candidates, nil
+}
+
+type luks2TokenKeyDataSource struct{}
+
+func (luks2TokenKeyDataSource) Name() string {
+	return "luks2-tokens"
+}
+
+func (s luks2TokenKeyDataSource) ReadKeyData(sourceDevicePath string) ([]*KeyData, error) {
+	view, err := newLUKSView(sourceDevicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS2 header view: %w", err)
+	}
+
+	var keys []*KeyData
+	for _, candidate := range keyCandidatesFromLUKS2Tokens(sourceDevicePath, view) {
+		keys = append(keys, candidate.KeyData)
+	}
+	return keys, nil
+}
+
+func (luks2TokenKeyDataSource) readKeyCandidates(sourceDevicePath string, view *luksview.View) ([]*keyCandidate, error) {
+	if view == nil {
+		return nil, errors.New("no LUKS2 header view is available")
+	}
+	return keyCandidatesFromLUKS2Tokens(sourceDevicePath, view), nil
+}
+
+// NewLUKS2TokenKeyDataSource returns a KeyDataSource that provides the KeyData
+// objects stored in the tokens of the LUKS2 container being activated, in
+// priority order. Tokens that cannot be decoded are skipped.
+func NewLUKS2TokenKeyDataSource() KeyDataSource {
+	return luks2TokenKeyDataSource{}
+}
+
+type fileKeyDataSource struct {
+	path string
+}
+
+func (s *fileKeyDataSource) Name() string {
+	return s.path
+}
+
+func (s *fileKeyDataSource) ReadKeyData(_ string) ([]*KeyData, error) {
+	r, err := NewFileKeyDataReader(s.path)
+	if err != nil {
+		return nil, err
+	}
+	kd, err := ReadKeyData(r)
+	if err != nil {
+		return nil, err
+	}
+	return []*KeyData{kd}, nil
+}
+
+// NewFileKeyDataSource returns a KeyDataSource that provides the KeyData
+// object stored in the file at the specified path.
+func NewFileKeyDataSource(path string) KeyDataSource {
+	return &fileKeyDataSource{path: path}
+}
+
+type staticKeyDataSource struct {
+	name string
+	keys []*KeyData
+}
+
+func (s *staticKeyDataSource) Name() string {
+	return s.name
+}
+
+func (s *staticKeyDataSource) ReadKeyData(_ string) ([]*KeyData, error) {
+	return s.keys, nil
+}
+
+// NewKeyDataSource returns a KeyDataSource with the specified name that
+// provides the supplied KeyData objects. This can be used for KeyData objects
+// that have been obtained by other means, such as those created by the hooks
+// platform.
+func NewKeyDataSource(name string, keys ...*KeyData) KeyDataSource {
+	return &staticKeyDataSource{name: name, keys: keys}
+}
+
+type authModeRestrictedKeyDataSource struct {
+	KeyDataSource
+	modes []AuthMode
+}
+
+func (s *authModeRestrictedKeyDataSource) permitted(mode AuthMode) bool {
+	for _, m := range s.modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *authModeRestrictedKeyDataSource) ReadKeyData(sourceDevicePath string) ([]*KeyData, error) {
+	keys, err := s.KeyDataSource.ReadKeyData(sourceDevicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*KeyData
+	for _, key := range keys {
+		if !s.permitted(key.AuthMode()) {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out, nil
+}
+
+func (s *authModeRestrictedKeyDataSource) readKeyCandidates(sourceDevicePath string, view *luksview.View) ([]*keyCandidate, error) {
+	candidates, err := readKeyCandidatesFromSource(s.KeyDataSource, sourceDevicePath, view)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		if !s.permitted(candidate.AuthMode()) {
+			// Keep the candidate so that the reason it wasn't used is
+			// included in the errors, but make sure it is skipped.
+			candidate.err = fmt.Errorf("auth mode %d is not permitted for this source", candidate.AuthMode())
+		}
+	}
+	return candidates, nil
+}
+
+// RestrictKeyDataSourceAuthModes returns a KeyDataSource that only permits the
+// KeyData objects provided by the supplied source to be used if they have one
+// of the specified auth modes. This can be used to require that keys from a
+// source that is not trusted to enforce user authentication must have a
+// passphrase, or to prevent a source from prompting the user for one.
+//
+// When used with ActivateVolumeWithMultipleKeyData, KeyData objects with any
+// other auth mode are not used, and are reported as failed.
+func RestrictKeyDataSourceAuthModes(source KeyDataSource, modes ...AuthMode) KeyDataSource {
+	return &authModeRestrictedKeyDataSource{KeyDataSource: source, modes: modes}
+}
@@ -41,6 +41,7 @@ import (
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/pbkdf2"
 	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/secboottest"
 	snapd_testutil "github.com/snapcore/snapd/testutil"
 
 	"golang.org/x/crypto/cryptobyte"
@@ -50,141 +51,17 @@ import (
 	. "gopkg.in/check.v1"
 )
 
-type mockPlatformKeyDataHandle struct {
-	Key                []byte      `json:"key"`
-	IV                 []byte      `json:"iv"`
-	AuthKeyHMAC        []byte      `json:"auth-key-hmac"`
-	ExpectedGeneration int         `json:"exp-generation"`
-	ExpectedKDFAlg     crypto.Hash `json:"exp-kdf_alg"`
-	ExpectedAuthMode   AuthMode    `json:"exp-auth-mode"`
-}
+type (
+	mockPlatformKeyDataHandle  = secboottest.MockPlatformKeyDataHandle
+	mockPlatformKeyDataHandler = secboottest.MockPlatformKeyDataHandler
+)
 
 const (
-	mockPlatformDeviceStateOK = iota
-	mockPlatformDeviceStateUnavailable
-	mockPlatformDeviceStateUninitialized
+	mockPlatformDeviceStateOK            = secboottest.MockPlatformDeviceStateOK
+	mockPlatformDeviceStateUnavailable   = secboottest.MockPlatformDeviceStateUnavailable
+	mockPlatformDeviceStateUninitialized = secboottest.MockPlatformDeviceStateUninitialized
 )
 
-type mockPlatformKeyDataHandler struct {
-	state             int
-	passphraseSupport bool
-}
-
-func (h *mockPlatformKeyDataHandler) checkState() error {
-	switch h.state {
-	case mockPlatformDeviceStateUnavailable:
-		return &PlatformHandlerError{Type: PlatformHandlerErrorUnavailable, Err: errors.New("the platform device is unavailable")}
-	case mockPlatformDeviceStateUninitialized:
-		return &PlatformHandlerError{Type: PlatformHandlerErrorUninitialized, Err: errors.New("the platform device is uninitialized")}
-	default:
-		return nil
-	}
-}
-
-func (h *mockPlatformKeyDataHandler) unmarshalHandle(data *PlatformKeyData) (*mockPlatformKeyDataHandle, error) {
-	var handle mockPlatformKeyDataHandle
-	if err := json.Unmarshal(data.EncodedHandle, &handle); err != nil {
-		return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: fmt.Errorf("JSON decode error: %w", err)}
-	}
-
-	if data.Generation != handle.ExpectedGeneration {
-		return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("unexpected generation")}
-	}
-
-	if data.Generation > 1 {
-		if data.KDFAlg != handle.ExpectedKDFAlg {
-			return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("unexpected KDFAlg")}
-		}
-	}
-
-	if data.AuthMode != handle.ExpectedAuthMode {
-		return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("unexpected AuthMode")}
-	}
-
-	return &handle, nil
-}
-
-func (h *mockPlatformKeyDataHandler) checkKey(handle *mockPlatformKeyDataHandle, key []byte) error {
-	m := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
-	m.Write(key)
-	if !bytes.Equal(handle.AuthKeyHMAC, m.Sum(nil)) {
-		return &PlatformHandlerError{Type: PlatformHandlerErrorInvalidAuthKey, Err: errors.New("the supplied key is incorrect")}
-	}
-
-	return nil
-}
-
-func (h *mockPlatformKeyDataHandler) recoverKeys(handle *mockPlatformKeyDataHandle, payload []byte) ([]byte, error) {
-	b, err := aes.NewCipher(handle.Key)
-	if err != nil {
-		return nil, fmt.Errorf("cannot create cipher: %w", err)
-	}
-
-	s := cipher.NewCFBDecrypter(b, handle.IV)
-	out := make([]byte, len(payload))
-	s.XORKeyStream(out, payload)
-	return out, nil
-}
-
-func (h *mockPlatformKeyDataHandler) RecoverKeys(data *PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
-	if err := h.checkState(); err != nil {
-		return nil, err
-	}
-
-	handle, err := h.unmarshalHandle(data)
-	if err != nil {
-		return nil, err
-	}
-
-	return h.recoverKeys(handle, encryptedPayload)
-}
-
-func (h *mockPlatformKeyDataHandler) RecoverKeysWithAuthKey(data *PlatformKeyData, encryptedPayload []byte, key []byte) ([]byte, error) {
-	if !h.passphraseSupport {
-		return nil, errors.New("not supported")
-	}
-
-	if err := h.checkState(); err != nil {
-		return nil, err
-	}
-
-	handle, err := h.unmarshalHandle(data)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := h.checkKey(handle, key); err != nil {
-		return nil, err
-	}
-
-	return h.recoverKeys(handle, encryptedPayload)
-}
-
-func (h *mockPlatformKeyDataHandler) ChangeAuthKey(data *PlatformKeyData, old, new []byte) ([]byte, error) {
-	if !h.passphraseSupport {
-		return nil, errors.New("not supported")
-	}
-
-	if err := h.checkState(); err != nil {
-		return nil, err
-	}
-
-	handle, err := h.unmarshalHandle(data)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := h.checkKey(handle, old); err != nil {
-		return nil, err
-	}
-
-	m := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
-	m.Write(new)
-	handle.AuthKeyHMAC = m.Sum(nil)
-
-	return json.Marshal(&handle)
-}
-
 type mockKeyDataWriter struct {
 	tmp   *bytes.Buffer
 	final *bytes.Buffer
@@ -265,8 +142,8 @@ func (s *keyDataTestBase) SetUpSuite(c *C) {
 }
 
 func (s *keyDataTestBase) SetUpTest(c *C) {
-	s.handler.state = mockPlatformDeviceStateOK
-	s.handler.passphraseSupport = false
+	s.handler.State = mockPlatformDeviceStateOK
+	s.handler.PassphraseSupport = false
 	s.origArgon2KDF = SetArgon2KDF(&testutil.MockArgon2KDF{})
 	s.restorePBKDF2Benchmark = MockPBKDF2Benchmark(func(duration time.Duration, hashAlg crypto.Hash) (uint, error) {
 		c.Check(hashAlg, Equals, s.expectedPBKDF2Hash)
@@ -295,40 +172,8 @@ func (s *keyDataTestBase) newPrimaryKey(c *C, sz1 int) PrimaryKey {
 }
 
 func (s *keyDataTestBase) mockProtectKeys(c *C, primaryKey PrimaryKey, kdfAlg crypto.Hash, modelAuthHash crypto.Hash) (out *KeyParams, unlockKey DiskUnlockKey) {
-	unique := make([]byte, len(primaryKey))
-	_, err := rand.Read(unique)
-	c.Assert(err, IsNil)
-
-	unlockKey, payload, err := MakeDiskUnlockKey(bytes.NewReader(unique), kdfAlg, primaryKey)
+	out, unlockKey, err := secboottest.MakeMockKeyParams(testutil.RandReader, s.mockPlatformName, primaryKey, kdfAlg)
 	c.Assert(err, IsNil)
-
-	k := make([]byte, 48)
-	_, err = rand.Read(k)
-	c.Assert(err, IsNil)
-
-	handle := mockPlatformKeyDataHandle{
-		Key:                k[:32],
-		IV:                 k[32:],
-		ExpectedGeneration: KeyDataGeneration,
-		ExpectedKDFAlg:     kdfAlg,
-		ExpectedAuthMode:   AuthModeNone,
-	}
-
-	h := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
-	h.Write(make([]byte, 32))
-	handle.AuthKeyHMAC = h.Sum(nil)
-
-	b, err := aes.NewCipher(handle.Key)
-	c.Assert(err, IsNil)
-	stream := cipher.NewCFBEncrypter(b, handle.IV)
-
-	out = &KeyParams{
-		PlatformName:     s.mockPlatformName,
-		Handle:           &handle,
-		EncryptedPayload: make([]byte, len(payload)),
-		KDFAlg:           kdfAlg}
-	stream.XORKeyStream(out.EncryptedPayload, payload)
-
 	return out, unlockKey
 }
 
@@ -745,6 +590,14 @@ func (s *keyDataSuite) TestNewKeyData(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (s *keyDataSuite) TestNewKeyDataInvalidRole(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+	protected.Role = "Run"
+	_, err := NewKeyData(protected)
+	c.Check(err, ErrorMatches, `invalid role "Run": must start with a lower case letter or digit and only contain lower case letters, digits, '-' and '\+'`)
+}
+
 func (s *keyDataSuite) TestKeyDataPlatformName(c *C) {
 	primaryKey := s.newPrimaryKey(c, 32)
 	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
@@ -818,13 +671,13 @@ func (s *keyDataSuite) TestRecoverKeysInvalidData(c *C) {
 	keyData, err := NewKeyData(protected)
 	c.Assert(err, IsNil)
 	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
-	c.Check(err, ErrorMatches, "invalid key data: JSON decode error: json: cannot unmarshal string into Go value of type secboot_test.mockPlatformKeyDataHandle")
+	c.Check(err, ErrorMatches, "invalid key data: JSON decode error: json: cannot unmarshal string into Go value of type secboottest.MockPlatformKeyDataHandle")
 	c.Check(recoveredKey, IsNil)
 	c.Check(recoveredAuxKey, IsNil)
 }
 
 func (s *keyDataSuite) testRecoverKeysWithPassphrase(c *C, passphrase string) {
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	primaryKey := s.newPrimaryKey(c, 32)
 	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
@@ -846,8 +699,81 @@ func (s *keyDataSuite) TestRecoverKeysWithPassphrase2(c *C) {
 	s.testRecoverKeysWithPassphrase(c, "1234")
 }
 
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseIsAuthKey(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+	protected.PassphraseIsAuthKey = true
+
+	// The initial auth key is empty rather than all zeroes.
+	handle := protected.Handle.(*mockPlatformKeyDataHandle)
+	h := hmac.New(crypto.SHA256.New, handle.Key)
+	handle.AuthKeyHMAC = h.Sum(nil)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "1234")
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	params, ok := j["passphrase_params"].(map[string]interface{})
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(params["passphrase_is_auth_key"], Equals, true)
+	c.Check(params["auth_key_size"], Equals, float64(0))
+
+	// The payload isn't encrypted with a key derived from the passphrase,
+	// so the key data can't be used to test guesses offline.
+	c.Check(j["encrypted_payload"], Equals, base64.StdEncoding.EncodeToString(protected.EncryptedPayload))
+
+	// The passphrase should be supplied to the platform unmodified.
+	handleBytes, err := json.Marshal(j["platform_handle"])
+	c.Check(err, IsNil)
+	var newHandle *mockPlatformKeyDataHandle
+	c.Check(json.Unmarshal(handleBytes, &newHandle), IsNil)
+	h = hmac.New(crypto.SHA256.New, handle.Key)
+	h.Write([]byte("1234"))
+	c.Check(newHandle.AuthKeyHMAC, DeepEquals, h.Sum(nil))
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("4321")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+}
+
+func (s *keyDataSuite) TestChangePassphraseIsAuthKey(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+	protected.PassphraseIsAuthKey = true
+
+	handle := protected.Handle.(*mockPlatformKeyDataHandle)
+	h := hmac.New(crypto.SHA256.New, handle.Key)
+	handle.AuthKeyHMAC = h.Sum(nil)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "1234")
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("4321", "5678"), Equals, ErrInvalidPassphrase)
+	c.Check(keyData.ChangePassphrase("1234", "5678"), IsNil)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeysWithPassphrase("5678")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("1234")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+}
+
 func (s *keyDataSuite) TestRecoverKeysWithPassphrasePBKDF2(c *C) {
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	primaryKey := s.newPrimaryKey(c, 32)
 	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, &PBKDF2Options{}, 32, crypto.SHA256, crypto.SHA256)
@@ -866,10 +792,11 @@ type testRecoverKeysWithPassphraseErrorHandlingData struct {
 	derivedKeySize    int
 	encryptionKeySize int
 	authKeySize       int
+	kdfMemory         int
 }
 
 func (s *keyDataSuite) testRecoverKeysWithPassphraseErrorHandling(c *C, data *testRecoverKeysWithPassphraseErrorHandlingData) {
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	if data.kdfType == "" {
 		data.kdfType = "argon2i"
@@ -887,6 +814,10 @@ func (s *keyDataSuite) testRecoverKeysWithPassphraseErrorHandling(c *C, data *te
 		data.authKeySize = 32
 	}
 
+	if data.kdfMemory == 0 {
+		data.kdfMemory = 1024063
+	}
+
 	j := []byte(
 		`{` +
 			`"generation":2,` +
@@ -908,7 +839,7 @@ func (s *keyDataSuite) testRecoverKeysWithPassphraseErrorHandling(c *C, data *te
 			`"type":"` + data.kdfType + `",` +
 			`"salt":"8A3SHdXVwCzEmD7YMKkyWw==",` +
 			`"time":4,` +
-			`"memory":1024063,` +
+			`"memory":` + fmt.Sprint(data.kdfMemory) + `,` +
 			`"cpus":4},` +
 			`"encryption":"aes-cfb",` +
 			`"derived_key_size":` + fmt.Sprint(data.derivedKeySize) + `,` +
@@ -946,6 +877,22 @@ func (s *keyDataSuite) TestRecoverKeysWithPassphraseInvalidDerivedKeySize(c *C)
 	})
 }
 
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseInvalidKDFMemory(c *C) {
+	s.testRecoverKeysWithPassphraseErrorHandling(c, &testRecoverKeysWithPassphraseErrorHandlingData{
+		kdfMemory: 4*1024*1024 + 1,
+		errMsg:    "invalid argon2 memory (4194305)",
+	})
+}
+
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseExceedsKDFMemoryBudget(c *C) {
+	SetResourceBudget(ResourceBudget{MaxKDFMemoryKiB: 32 * 1024})
+	defer SetResourceBudget(ResourceBudget{})
+
+	s.testRecoverKeysWithPassphraseErrorHandling(c, &testRecoverKeysWithPassphraseErrorHandlingData{
+		errMsg: "cannot derive key from passphrase: kdf-memory budget exceeded: 1024063 requested with 0 of 32768 in use",
+	})
+}
+
 func (s *keyDataSuite) TestRecoverKeysWithPassphraseInvalidEncryptionKeySizeSmall(c *C) {
 	s.testRecoverKeysWithPassphraseErrorHandling(c, &testRecoverKeysWithPassphraseErrorHandlingData{
 		encryptionKeySize: -1,
@@ -1084,7 +1031,7 @@ type testChangePassphraseData struct {
 }
 
 func (s *keyDataSuite) testChangePassphrase(c *C, data *testChangePassphraseData) {
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	primaryKey := s.newPrimaryKey(c, 32)
 	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, data.kdfOptions, 32, crypto.SHA256, crypto.SHA256)
@@ -1139,7 +1086,7 @@ func (s *keyDataSuite) TestChangePassphrasePBKDF2(c *C) {
 }
 
 func (s *keyDataSuite) TestChangePassphraseWrongPassphrase(c *C) {
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	primaryKey := s.newPrimaryKey(c, 32)
 
@@ -1156,6 +1103,353 @@ func (s *keyDataSuite) TestChangePassphraseWrongPassphrase(c *C) {
 	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "12345678", kdfOptions)
 }
 
+// countingArgon2KDF counts the number of times that a key is derived.
+type countingArgon2KDF struct {
+	testutil.MockArgon2KDF
+	derives int
+}
+
+func (k *countingArgon2KDF) Derive(passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	k.derives += 1
+	return k.MockArgon2KDF.Derive(passphrase, salt, mode, params, keyLen)
+}
+
+func (s *keyDataSuite) newKeyDataWithPassphraseForCacheTest(c *C, passphrase string) (*KeyData, *countingArgon2KDF) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+
+	kdf := new(countingArgon2KDF)
+	SetArgon2KDF(kdf)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, passphrase)
+	c.Assert(err, IsNil)
+	kdf.derives = 0
+
+	return keyData, kdf
+}
+
+func (s *keyDataSuite) TestNewKeyDataWithPassphraseKDF(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+
+	// The supplied KDF should be used instead of the global one.
+	SetArgon2KDF(nil)
+	kdf := new(countingArgon2KDF)
+	protected.KDF = kdf
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "12345678")
+	c.Assert(err, IsNil)
+	c.Check(kdf.derives, Equals, 1)
+	c.Check(kdf.BenchmarkMode, Equals, Argon2id)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey)
+	c.Check(recoveredAuxKey, DeepEquals, primaryKey)
+	c.Check(kdf.derives, Equals, 2)
+}
+
+func (s *keyDataSuite) TestChangePassphraseAfterRecoveryReusesKeys(c *C) {
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+	c.Check(kdf.derives, Equals, 1)
+
+	c.Check(keyData.ChangePassphrase("12345678", "87654321"), IsNil)
+	// Only the new passphrase should have been processed by the KDF.
+	c.Check(kdf.derives, Equals, 2)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("87654321")
+	c.Check(err, IsNil)
+	_, _, err = keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+}
+
+func (s *keyDataSuite) TestChangePassphraseAfterRecoveryExpired(c *C) {
+	now := time.Now()
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+	c.Check(kdf.derives, Equals, 1)
+
+	now = now.Add(31 * time.Second)
+
+	c.Check(keyData.ChangePassphrase("12345678", "87654321"), IsNil)
+	c.Check(kdf.derives, Equals, 3)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("87654321")
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataSuite) TestCachedPassphraseKeysWipedOnExpiry(c *C) {
+	// Test that the cached keys are wiped when the timer fires, even if
+	// they are never used.
+	var expire func()
+	s.AddCleanup(MockTimeAfterFunc(func(d time.Duration, fn func()) *time.Timer {
+		c.Check(d, Equals, 30*time.Second)
+		expire = fn
+		return time.AfterFunc(time.Hour, func() {})
+	}))
+
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+	c.Assert(expire, NotNil)
+
+	key, iv, auth := keyData.CachedPassphraseKeys()
+	c.Assert(key, Not(HasLen), 0)
+	c.Check(key, Not(DeepEquals), make([]byte, len(key)))
+
+	expire()
+
+	for _, b := range [][]byte{key, iv, auth} {
+		c.Check(b, DeepEquals, make([]byte, len(b)))
+	}
+
+	// The wiped keys must not be used.
+	c.Check(keyData.ChangePassphrase("12345678", "87654321"), IsNil)
+	c.Check(kdf.derives, Equals, 3)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("87654321")
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataSuite) TestChangePassphraseAfterRecoveryWrongPassphrase(c *C) {
+	// Test that the cached keys aren't used for a different passphrase.
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("passphrase", "87654321"), Equals, ErrInvalidPassphrase)
+	c.Check(kdf.derives, Equals, 3)
+
+	// The cached keys are discarded after the first attempt.
+	c.Check(keyData.ChangePassphrase("12345678", "87654321"), IsNil)
+	c.Check(kdf.derives, Equals, 5)
+}
+
+func (s *keyDataSuite) TestChangePassphraseAfterFailedRecovery(c *C) {
+	// Test that keys aren't cached if the passphrase isn't verified.
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+	c.Check(kdf.derives, Equals, 1)
+
+	c.Check(keyData.ChangePassphrase("passphrase", "87654321"), Equals, ErrInvalidPassphrase)
+	c.Check(kdf.derives, Equals, 3)
+}
+
+func (s *keyDataSuite) TestChangePassphraseTwiceAfterRecovery(c *C) {
+	// Test that the cached keys are only used once.
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("12345678", "87654321"), IsNil)
+	c.Check(kdf.derives, Equals, 2)
+
+	c.Check(keyData.ChangePassphrase("87654321", "abcdefgh"), IsNil)
+	c.Check(kdf.derives, Equals, 4)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("abcdefgh")
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataSuite) TestRemovePassphraseAfterRecoveryReusesKeys(c *C) {
+	keyData, kdf := s.newKeyDataWithPassphraseForCacheTest(c, "12345678")
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("12345678")
+	c.Check(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{Mode: AuthModeNone, OldPassphrase: "12345678"}), IsNil)
+	c.Check(kdf.derives, Equals, 1)
+	c.Check(keyData.AuthMode(), Equals, AuthModeNone)
+
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataSuite) TestNewKeyDataWithPassphrasePolicyViolation(c *C) {
+	s.handler.PassphraseSupport = true
+	s.AddCleanup(func() { SetPassphrasePolicy(nil) })
+	SetPassphrasePolicy(&PassphrasePolicy{MinLength: 10})
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+
+	_, err := NewKeyDataWithPassphrase(protected, "12345678")
+	c.Check(err, ErrorMatches, `passphrase does not meet the policy requirements: too short \(8 characters, at least 10 required\)`)
+	c.Check(err, testutil.ConvertibleTo, &PassphrasePolicyError{})
+}
+
+func (s *keyDataSuite) TestChangePassphrasePolicyViolation(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	kdfOptions := &Argon2Options{
+		TargetDuration: 100 * time.Millisecond,
+	}
+	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, kdfOptions, 32, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "12345678")
+	c.Check(err, IsNil)
+
+	s.AddCleanup(func() { SetPassphrasePolicy(nil) })
+	SetPassphrasePolicy(&PassphrasePolicy{Blocklist: []string{"Secret-Passphrase"}})
+
+	c.Check(keyData.ChangePassphrase("12345678", "secret-passphrase"), ErrorMatches, `passphrase does not meet the policy requirements: passphrase is blocklisted`)
+
+	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "12345678", kdfOptions)
+}
+
+func (s *keyDataSuite) TestSetAuthModeEnablePassphrase(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModePassphrase,
+		NewPassphrase: "passphrase",
+		KDFOptions:    &Argon2Options{},
+		AuthKeySize:   32}), IsNil)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, ErrorMatches, `cannot recover key without authorization`)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("1234")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keyDataSuite) TestSetAuthModeEnablePassphraseNotSupported(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	err = keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModePassphrase,
+		NewPassphrase: "passphrase",
+		KDFOptions:    &Argon2Options{},
+		AuthKeySize:   32})
+	c.Check(err, ErrorMatches, `cannot perform action because of an unexpected error: not supported`)
+	c.Check(keyData.AuthMode(), Equals, AuthModeNone)
+
+	s.checkKeyDataJSONAuthModeNone(c, keyData, protected, 0)
+}
+
+func (s *keyDataSuite) TestSetAuthModeEnablePassphrasePolicyViolation(c *C) {
+	s.handler.PassphraseSupport = true
+	s.AddCleanup(func() { SetPassphrasePolicy(nil) })
+	SetPassphrasePolicy(&PassphrasePolicy{MinLength: 10})
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	err = keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModePassphrase,
+		NewPassphrase: "1234",
+		AuthKeySize:   32})
+	c.Check(err, testutil.ConvertibleTo, &PassphrasePolicyError{})
+	c.Check(keyData.AuthMode(), Equals, AuthModeNone)
+}
+
+func (s *keyDataSuite) TestSetAuthModeRemovePassphrase(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, unlockKey := s.mockProtectKeysWithPassphrase(c, primaryKey, nil, 32, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase")
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModeNone,
+		OldPassphrase: "passphrase"}), IsNil)
+	c.Check(keyData.AuthMode(), Equals, AuthModeNone)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+
+	// The key data should be the same as a key created without a passphrase.
+	handle := protected.Handle.(*mockPlatformKeyDataHandle)
+	handle.ExpectedAuthMode = AuthModeNone
+	s.checkKeyDataJSONAuthModeNone(c, keyData, &protected.KeyParams, 0)
+}
+
+func (s *keyDataSuite) TestSetAuthModeRemovePassphraseWrongPassphrase(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	kdfOptions := &Argon2Options{}
+	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, kdfOptions, 32, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase")
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModeNone,
+		OldPassphrase: "1234"}), Equals, ErrInvalidPassphrase)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+
+	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "passphrase", kdfOptions)
+}
+
+func (s *keyDataSuite) TestSetAuthModeChangePassphrase(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	kdfOptions := &Argon2Options{}
+	protected, _ := s.mockProtectKeysWithPassphrase(c, primaryKey, kdfOptions, 32, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase")
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{
+		Mode:          AuthModePassphrase,
+		OldPassphrase: "passphrase",
+		NewPassphrase: "1234"}), IsNil)
+
+	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "1234", kdfOptions)
+}
+
+func (s *keyDataSuite) TestSetAuthModeInvalid(c *C) {
+	primaryKey := s.newPrimaryKey(c, 32)
+	protected, _ := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetAuthMode(&SetAuthModeParams{Mode: 5}), ErrorMatches, `invalid auth mode 5`)
+}
+
 type testWriteAtomicData struct {
 	keyData *KeyData
 	params  *KeyParams
@@ -1395,7 +1689,7 @@ func (s *keyDataSuite) TestLegacyKeyPayloadUnmarshalInvalid1(c *C) {
 	}
 
 	key, auxKey, err := UnmarshalV1KeyPayload(payload)
-	c.Check(err, ErrorMatches, "EOF")
+	c.Check(err, ErrorMatches, "unexpected EOF")
 	c.Check(key, IsNil)
 	c.Check(auxKey, IsNil)
 }
@@ -1653,7 +1947,7 @@ func (s *keyDataSuite) TestLegacySetAuthorizedSnapModelsWithWrongKey(c *C) {
 
 func (s *keyDataSuite) TestKeyDataDerivePassphraseKeysExpectedInfoFields(c *C) {
 	// Test that key derivation from passphrase is using expected info fields
-	s.handler.passphraseSupport = true
+	s.handler.PassphraseSupport = true
 
 	// Valid KeyData with passphrase "passphrase"
 	j := []byte(
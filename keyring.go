@@ -22,10 +22,10 @@ package secboot
 import (
 	"errors"
 	"fmt"
-	"os"
 	"syscall"
 
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/luksview"
 
 	"golang.org/x/xerrors"
 )
@@ -37,6 +37,149 @@ const (
 
 var ErrKernelKeyNotFound = errors.New("cannot find key in kernel keyring")
 
+// KeyringTarget specifies the kernel keyring that keys are added to during
+// activation.
+type KeyringTarget int
+
+const (
+	// KeyringTargetUser is the user keyring of the current user, which is
+	// the default.
+	KeyringTargetUser KeyringTarget = iota
+
+	// KeyringTargetSession is the session keyring of the current process.
+	KeyringTargetSession
+
+	// KeyringTargetPersistent is the persistent keyring of the current
+	// user, which is not associated with a session and survives the
+	// process that created it.
+	KeyringTargetPersistent
+)
+
+func (t KeyringTarget) keyring() (keyring.Keyring, error) {
+	switch t {
+	case KeyringTargetUser:
+		return keyring.UserKeyring, nil
+	case KeyringTargetSession:
+		return keyring.SessionKeyring, nil
+	case KeyringTargetPersistent:
+		return keyring.PersistentKeyring()
+	default:
+		return 0, fmt.Errorf("invalid keyring target %d", t)
+	}
+}
+
+// KeyringDeviceForUUID returns the device identifier used in the description
+// of kernel keys for the encrypted container with the specified UUID, for use
+// with ActivateVolumeOptions.KeyringUseDeviceUUID. This can be supplied as the
+// device path to the functions in this package that retrieve keys from the
+// kernel keyring.
+func KeyringDeviceForUUID(uuid string) string {
+	return "UUID=" + uuid
+}
+
+// KernelKeyringOptions specifies where to find keys in the kernel keyring.
+// These should match the corresponding fields of the ActivateVolumeOptions
+// supplied during unlocking.
+type KernelKeyringOptions struct {
+	// Prefix is the prefix used for the description of kernel keys (see
+	// ActivateVolumeOptions.KeyringPrefix).
+	Prefix string
+
+	// Target is the keyring containing the keys (see
+	// ActivateVolumeOptions.KeyringTarget).
+	Target KeyringTarget
+
+	// Instance identifies the unlocker that added the keys (see
+	// ActivateVolumeOptions.KeyringInstance).
+	Instance string
+}
+
+// keyringConfig describes how keys are added to the kernel keyring during
+// activation.
+type keyringConfig struct {
+	prefix   string
+	target   KeyringTarget
+	instance string
+
+	// deviceUUID is the UUID of the encrypted container if keys should
+	// also be added using KeyringDeviceForUUID.
+	deviceUUID string
+}
+
+func newKeyringConfig(options *KernelKeyringOptions) *keyringConfig {
+	return &keyringConfig{
+		prefix:   keyringPrefixOrDefault(options.Prefix),
+		target:   options.Target,
+		instance: options.Instance}
+}
+
+func (c *keyringConfig) description(devicePath, purpose string) keyring.Description {
+	return keyring.Description{
+		Prefix:   c.prefix,
+		Device:   devicePath,
+		Purpose:  purpose,
+		Instance: c.instance}
+}
+
+func (c *keyringConfig) addKey(key []byte, devicePath, purpose string) error {
+	kr, err := c.target.keyring()
+	if err != nil {
+		return err
+	}
+	return keyring.AddKey(kr, key, c.description(devicePath, purpose))
+}
+
+// addUnlockKeys adds the supplied unlock key, auxiliary key (if there is
+// one) and unlock reason to the configured keyring for the specified device.
+// Errors are logged but otherwise ignored.
+func (c *keyringConfig) addUnlockKeys(devicePath string, key DiskUnlockKey, auxKey PrimaryKey, reason *UnlockReason) {
+	if err := c.addKey(key, devicePath, keyringPurposeDiskUnlock); err != nil {
+		fmt.Fprintf(osStderr, "secboot: Cannot add key to keyring: %v\n", err)
+	}
+
+	if auxKey != nil {
+		if err := c.addKey(auxKey, devicePath, keyringPurposeAuxiliary); err != nil {
+			fmt.Fprintf(osStderr, "secboot: Cannot add key to keyring: %v\n", err)
+		}
+	}
+
+	addUnlockReasonToKeyring(reason, devicePath, c)
+}
+
+// addUnlockKeysForUUID is like addUnlockKeys, but adds the keys for the UUID
+// of the encrypted container if this is enabled.
+func (c *keyringConfig) addUnlockKeysForUUID(key DiskUnlockKey, auxKey PrimaryKey, reason *UnlockReason) {
+	if c.deviceUUID == "" {
+		return
+	}
+	c.addUnlockKeys(KeyringDeviceForUUID(c.deviceUUID), key, auxKey, reason)
+}
+
+func (c *keyringConfig) getKey(devicePath, purpose string, remove bool) ([]byte, error) {
+	kr, err := c.target.keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	desc := c.description(devicePath, purpose)
+	key, err := keyring.GetKey(kr, desc)
+	if err != nil {
+		var e syscall.Errno
+		if xerrors.As(err, &e) && e == syscall.ENOKEY {
+			return nil, ErrKernelKeyNotFound
+		}
+		return nil, err
+	}
+
+	if remove {
+		if err := keyring.RemoveKey(kr, desc); err != nil {
+			fmt.Fprintf(osStderr, "secboot: cannot remove key from keyring: %v\n", err)
+		}
+	}
+
+	return key, nil
+}
+
 func keyringPrefixOrDefault(prefix string) string {
 	if prefix == "" {
 		return "ubuntu-fde"
@@ -53,23 +196,57 @@ func keyringPrefixOrDefault(prefix string) string {
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
 func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnlockKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix))
+	return GetDiskUnlockKeyFromKernelWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, remove)
+}
+
+// GetDiskUnlockKeyFromKernelWithOptions is a variant of
+// GetDiskUnlockKeyFromKernel that retrieves the key from the keyring and with
+// the instance specified by the supplied options.
+func GetDiskUnlockKeyFromKernelWithOptions(options *KernelKeyringOptions, devicePath string, remove bool) (DiskUnlockKey, error) {
+	return newKeyringConfig(options).getKey(devicePath, keyringPurposeDiskUnlock, remove)
+}
+
+// KernelDiskUnlockKey is a key that was used to unlock an encrypted container,
+// as returned from GetDiskUnlockKeysFromKernel.
+type KernelDiskUnlockKey struct {
+	Instance string // The instance of the unlocker that added this key
+	Key      DiskUnlockKey
+}
+
+// GetDiskUnlockKeysFromKernel retrieves all of the keys that were used to
+// unlock the encrypted container at the specified path, regardless of the
+// instance of the unlocker that added them. This is useful where more than
+// one unlocker may have added keys for the same container (see
+// ActivateVolumeOptions.KeyringInstance). The Instance field of options is
+// ignored.
+//
+// If no keys are found, a ErrKernelKeyNotFound error will be returned.
+func GetDiskUnlockKeysFromKernel(options *KernelKeyringOptions, devicePath string) ([]*KernelDiskUnlockKey, error) {
+	config := newKeyringConfig(options)
+	kr, err := config.target.keyring()
 	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
 		return nil, err
+	}
 
+	descs, err := keyring.FindKeys(kr, config.prefix, devicePath, keyringPurposeDiskUnlock)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot enumerate keys: %w", err)
 	}
 
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+	var out []*KernelDiskUnlockKey
+	for _, desc := range descs {
+		key, err := keyring.GetKey(kr, desc)
+		if err != nil {
+			// The key may have been removed since it was enumerated.
+			continue
 		}
+		out = append(out, &KernelDiskUnlockKey{Instance: desc.Instance, Key: key})
+	}
+	if len(out) == 0 {
+		return nil, ErrKernelKeyNotFound
 	}
 
-	return key, nil
+	return out, nil
 }
 
 // GetPrimaryKeyFromKernel retrieves the auxiliary key associated with the
@@ -82,21 +259,23 @@ func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnl
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
 func GetPrimaryKeyFromKernel(prefix, devicePath string, remove bool) (PrimaryKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix))
-	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
-		return nil, err
+	return GetPrimaryKeyFromKernelWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, remove)
+}
 
-	}
+// GetPrimaryKeyFromKernelWithOptions is a variant of GetPrimaryKeyFromKernel
+// that retrieves the key from the keyring and with the instance specified by
+// the supplied options.
+func GetPrimaryKeyFromKernelWithOptions(options *KernelKeyringOptions, devicePath string, remove bool) (PrimaryKey, error) {
+	return newKeyringConfig(options).getKey(devicePath, keyringPurposeAuxiliary, remove)
+}
 
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
-		}
+func (o *ActivateVolumeOptions) keyringConfig(view *luksview.View) *keyringConfig {
+	config := newKeyringConfig(&KernelKeyringOptions{
+		Prefix:   o.KeyringPrefix,
+		Target:   o.KeyringTarget,
+		Instance: o.KeyringInstance})
+	if o.KeyringUseDeviceUUID && view != nil {
+		config.deviceUUID = view.UUID()
 	}
-
-	return key, nil
+	return config
 }
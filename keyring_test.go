@@ -169,3 +169,65 @@ func (s *keyringSuite) TestGetPrimaryKeyFromKernelAndRemove(c *C) {
 	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "aux", "ubuntu-fde")
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelWithOptions(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKey(keyring.UserKeyring, key, keyring.Description{Prefix: "foo", Device: "/dev/sda1", Purpose: "unlock", Instance: "bar"}), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernelWithOptions(&KernelKeyringOptions{Prefix: "foo", Instance: "bar"}, "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetDiskUnlockKeyFromKernelWithOptions(&KernelKeyringOptions{Prefix: "foo", Instance: "bar"}, "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelWithOptionsWrongInstance(c *C) {
+	c.Check(keyring.AddKey(keyring.UserKeyring, make([]byte, 32), keyring.Description{Prefix: "ubuntu-fde", Device: "/dev/sda1", Purpose: "unlock", Instance: "bar"}), IsNil)
+
+	_, err := GetDiskUnlockKeyFromKernelWithOptions(&KernelKeyringOptions{Instance: "foo"}, "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelWithOptionsInvalidTarget(c *C) {
+	_, err := GetDiskUnlockKeyFromKernelWithOptions(&KernelKeyringOptions{Target: 10}, "/dev/sda1", false)
+	c.Check(err, ErrorMatches, `invalid keyring target 10`)
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeysFromKernel(c *C) {
+	key1 := make(DiskUnlockKey, 32)
+	rand.Read(key1)
+	key2 := make(DiskUnlockKey, 32)
+	rand.Read(key2)
+
+	c.Check(keyring.AddKey(keyring.UserKeyring, key1, keyring.Description{Prefix: "ubuntu-fde", Device: "/dev/sda1", Purpose: "unlock"}), IsNil)
+	c.Check(keyring.AddKey(keyring.UserKeyring, key2, keyring.Description{Prefix: "ubuntu-fde", Device: "/dev/sda1", Purpose: "unlock", Instance: "foo"}), IsNil)
+	c.Check(keyring.AddKey(keyring.UserKeyring, make([]byte, 32), keyring.Description{Prefix: "ubuntu-fde", Device: "/dev/sda1", Purpose: "aux", Instance: "foo"}), IsNil)
+
+	keys, err := GetDiskUnlockKeysFromKernel(&KernelKeyringOptions{}, "/dev/sda1")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	if keys[0].Instance != "" {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	c.Check(keys[0], DeepEquals, &KernelDiskUnlockKey{Key: key1})
+	c.Check(keys[1], DeepEquals, &KernelDiskUnlockKey{Instance: "foo", Key: key2})
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeysFromKernelNoKeys(c *C) {
+	_, err := GetDiskUnlockKeysFromKernel(&KernelKeyringOptions{}, "/dev/sda1")
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestGetPrimaryKeyFromKernelWithOptions(c *C) {
+	key := make(PrimaryKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKey(keyring.UserKeyring, key, keyring.Description{Prefix: "ubuntu-fde", Device: "UUID=a3b45a38-12f1-4b1b-8b3a-7d8c0a5d4bb6", Purpose: "aux", Instance: "foo"}), IsNil)
+
+	key2, err := GetPrimaryKeyFromKernelWithOptions(&KernelKeyringOptions{Instance: "foo"}, KeyringDeviceForUUID("a3b45a38-12f1-4b1b-8b3a-7d8c0a5d4bb6"), false)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
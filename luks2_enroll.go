@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrLUKS2EnrollmentAborted is set as the error for a volume in the results
+// returned from EnrollLUKS2ContainersWithPrimaryKey if the enrollment for that
+// volume was not performed or was rolled back because of an error with another
+// volume.
+var ErrLUKS2EnrollmentAborted = errors.New("enrollment aborted because of an error with another volume")
+
+// LUKS2Enrollment describes a single volume to enroll with
+// EnrollLUKS2ContainersWithPrimaryKey.
+type LUKS2Enrollment struct {
+	// DevicePath is the path of the LUKS2 container.
+	DevicePath string
+
+	// KeyslotName is the name of the keyslot to create. If empty, the
+	// name "default" will be used.
+	KeyslotName string
+
+	// ExistingKey is an existing key for the container, required to
+	// add the new keyslot.
+	ExistingKey DiskUnlockKey
+}
+
+// LUKS2EnrollmentResult is the result of enrolling a single volume with
+// EnrollLUKS2ContainersWithPrimaryKey.
+type LUKS2EnrollmentResult struct {
+	DevicePath  string
+	KeyslotName string
+
+	// KeyData is the KeyData that protects the new keyslot. It is only
+	// set if Err is nil.
+	KeyData *KeyData
+
+	// Err is the error for this volume, or nil on success.
+	Err error
+}
+
+// PrimaryKeyProtector is a platform-specific function used by
+// EnrollLUKS2ContainersWithPrimaryKey to protect the supplied primary key
+// for a single volume. It should derive a new unlock key (eg, via
+// MakeDiskUnlockKey) and return it with the KeyData that protects it.
+type PrimaryKeyProtector func(primaryKey PrimaryKey, enrollment *LUKS2Enrollment) (*KeyData, DiskUnlockKey, error)
+
+type luks2EnrollmentsError struct {
+	devicePath string
+	err        error
+}
+
+func (e *luks2EnrollmentsError) Error() string {
+	return fmt.Sprintf("cannot enroll %s: %v", e.devicePath, e.err)
+}
+
+func (e *luks2EnrollmentsError) Unwrap() error {
+	return e.err
+}
+
+// EnrollLUKS2ContainersWithPrimaryKey enrolls a set of volumes that share the
+// supplied primary key, such as separate volumes for /, /home and swap. For each
+// volume, this uses the supplied platform-specific protector to derive a unique
+// unlock key and protect it, adds a new keyslot with the unlock key, and writes
+// the associated KeyData to the keyslot's token.
+//
+// All of the KeyData objects are created before any of the containers are
+// modified. If a container cannot be modified, the keyslots already added to the
+// other containers are removed again, so the containers are either all enrolled or
+// none of them are. Note that modifying multiple containers can't be truly atomic,
+// and an interruption can leave some containers enrolled.
+//
+// One result is returned for each of the supplied enrollments in the same order.
+// On failure, an error is returned describing the first volume that failed, and
+// the result for each volume indicates what happened to it. Volumes that weren't
+// modified or which were rolled back successfully have their error set to
+// ErrLUKS2EnrollmentAborted.
+func EnrollLUKS2ContainersWithPrimaryKey(primaryKey PrimaryKey, protector PrimaryKeyProtector, enrollments ...*LUKS2Enrollment) ([]*LUKS2EnrollmentResult, error) {
+	if protector == nil {
+		return nil, errors.New("no protector supplied")
+	}
+
+	results := make([]*LUKS2EnrollmentResult, len(enrollments))
+	unlockKeys := make([]DiskUnlockKey, len(enrollments))
+	for i, e := range enrollments {
+		keyslotName := e.KeyslotName
+		if keyslotName == "" {
+			keyslotName = defaultKeyslotName
+		}
+		results[i] = &LUKS2EnrollmentResult{DevicePath: e.DevicePath, KeyslotName: keyslotName}
+	}
+
+	abort := func(failed int, err error) ([]*LUKS2EnrollmentResult, error) {
+		for i, r := range results {
+			if i == failed {
+				r.Err = err
+			} else if r.Err == nil {
+				r.Err = ErrLUKS2EnrollmentAborted
+			}
+			r.KeyData = nil
+		}
+		return results, &luks2EnrollmentsError{devicePath: results[failed].DevicePath, err: err}
+	}
+
+	// Protect the keys for every volume first, as this doesn't modify them.
+	for i, e := range enrollments {
+		kd, unlockKey, err := protector(primaryKey, e)
+		if err != nil {
+			return abort(i, xerrors.Errorf("cannot protect key: %w", err))
+		}
+		results[i].KeyData = kd
+		unlockKeys[i] = unlockKey
+	}
+
+	// Roll back the keyslots added to each of the volumes up to and
+	// including the one at the supplied index.
+	rollback := func(last int) {
+		for i := last; i >= 0; i-- {
+			if err := deleteLUKS2ContainerKey(results[i].DevicePath, results[i].KeyslotName, true); err != nil {
+				results[i].Err = xerrors.Errorf("cannot roll back: %w", err)
+			}
+		}
+	}
+
+	for i, e := range enrollments {
+		r := results[i]
+
+		if err := AddLUKS2ContainerUnlockKey(r.DevicePath, r.KeyslotName, e.ExistingKey, unlockKeys[i]); err != nil {
+			rollback(i - 1)
+			return abort(i, err)
+		}
+
+		w, err := NewLUKS2KeyDataWriter(r.DevicePath, r.KeyslotName)
+		if err == nil {
+			err = r.KeyData.WriteAtomic(w)
+		}
+		if err != nil {
+			rollback(i)
+			if r.Err != nil {
+				// The rollback for this volume failed.
+				err = fmt.Errorf("cannot write key data: %v (%v)", err, r.Err)
+				r.Err = nil
+			} else {
+				err = xerrors.Errorf("cannot write key data: %w", err)
+			}
+			return abort(i, err)
+		}
+	}
+
+	return results, nil
+}
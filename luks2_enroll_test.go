@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+func (s *cryptSuite) addMockContainerWithDefaultKey(c *C, path string) DiskUnlockKey {
+	key := s.newPrimaryKey(c, 32)
+	slot := s.addMockKeyslot(path, key)
+	s.addMockToken(path, &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"}})
+	return DiskUnlockKey(key)
+}
+
+func (s *cryptSuite) mockPrimaryKeyProtector(c *C) PrimaryKeyProtector {
+	return func(primaryKey PrimaryKey, enrollment *LUKS2Enrollment) (*KeyData, DiskUnlockKey, error) {
+		protected, unlockKey := s.mockProtectKeys(c, primaryKey, crypto.SHA256, crypto.SHA256)
+		kd, err := NewKeyData(protected)
+		return kd, unlockKey, err
+	}
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKey(c *C) {
+	existing1 := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	existing2 := s.addMockContainerWithDefaultKey(c, "/dev/sda2")
+
+	primaryKey := s.newPrimaryKey(c, 32)
+	results, err := EnrollLUKS2ContainersWithPrimaryKey(primaryKey, s.mockPrimaryKeyProtector(c),
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", KeyslotName: "run", ExistingKey: existing1},
+		&LUKS2Enrollment{DevicePath: "/dev/sda2", KeyslotName: "run", ExistingKey: existing2})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+
+	for i, path := range []string{"/dev/sda1", "/dev/sda2"} {
+		c.Check(results[i].DevicePath, Equals, path)
+		c.Check(results[i].KeyslotName, Equals, "run")
+		c.Check(results[i].Err, IsNil)
+		c.Assert(results[i].KeyData, NotNil)
+
+		r, err := NewLUKS2KeyDataReader(path, "run")
+		c.Assert(err, IsNil)
+		c.Check(r.KeyslotID(), Equals, 1)
+		kd, err := ReadKeyData(r)
+		c.Assert(err, IsNil)
+
+		unlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+		c.Check(err, IsNil)
+		c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+		c.Check([]byte(unlockKey), DeepEquals, s.luks2.devices[path].keyslots[1])
+	}
+
+	// Each volume should have a different unlock key.
+	c.Check(s.luks2.devices["/dev/sda1"].keyslots[1], Not(DeepEquals), s.luks2.devices["/dev/sda2"].keyslots[1])
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKeyDefaultName(c *C) {
+	existing := s.newPrimaryKey(c, 32)
+	s.addMockKeyslot("/dev/sda1", existing)
+
+	results, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), s.mockPrimaryKeyProtector(c),
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", ExistingKey: DiskUnlockKey(existing)})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].KeyslotName, Equals, "default")
+
+	_, err = NewLUKS2KeyDataReader("/dev/sda1", "default")
+	c.Check(err, IsNil)
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKeyProtectError(c *C) {
+	existing1 := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	existing2 := s.addMockContainerWithDefaultKey(c, "/dev/sda2")
+
+	n := 0
+	protector := func(primaryKey PrimaryKey, enrollment *LUKS2Enrollment) (*KeyData, DiskUnlockKey, error) {
+		n++
+		if n == 2 {
+			return nil, nil, errors.New("some error")
+		}
+		return s.mockPrimaryKeyProtector(c)(primaryKey, enrollment)
+	}
+
+	results, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), protector,
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", KeyslotName: "run", ExistingKey: existing1},
+		&LUKS2Enrollment{DevicePath: "/dev/sda2", KeyslotName: "run", ExistingKey: existing2})
+	c.Check(err, ErrorMatches, `cannot enroll /dev/sda2: cannot protect key: some error`)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Err, Equals, ErrLUKS2EnrollmentAborted)
+	c.Check(results[0].KeyData, IsNil)
+	c.Check(results[1].Err, ErrorMatches, `cannot protect key: some error`)
+
+	// No containers should have been modified.
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKeyRollback(c *C) {
+	existing1 := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	s.addMockContainerWithDefaultKey(c, "/dev/sda2")
+	existing3 := s.addMockContainerWithDefaultKey(c, "/dev/sda3")
+
+	results, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), s.mockPrimaryKeyProtector(c),
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", KeyslotName: "run", ExistingKey: existing1},
+		&LUKS2Enrollment{DevicePath: "/dev/sda2", KeyslotName: "run", ExistingKey: existing3},
+		&LUKS2Enrollment{DevicePath: "/dev/sda3", KeyslotName: "run", ExistingKey: existing3})
+	c.Check(err, ErrorMatches, `cannot enroll /dev/sda2: cannot add key: invalid key`)
+	c.Assert(results, HasLen, 3)
+	c.Check(results[0].Err, Equals, ErrLUKS2EnrollmentAborted)
+	c.Check(results[1].Err, ErrorMatches, `cannot add key: invalid key`)
+	c.Check(results[2].Err, Equals, ErrLUKS2EnrollmentAborted)
+
+	// The first container should have been rolled back and the third
+	// one should not have been touched.
+	for _, path := range []string{"/dev/sda1", "/dev/sda2", "/dev/sda3"} {
+		c.Check(s.luks2.devices[path].keyslots, HasLen, 1, Commentf("path: %s", path))
+		c.Check(s.luks2.devices[path].tokens, HasLen, 1, Commentf("path: %s", path))
+	}
+	for _, op := range s.luks2.operations {
+		c.Check(op, Not(Matches), `.*\(/dev/sda3,.*`)
+	}
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKeyWriteErrorRollback(c *C) {
+	existing1 := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	existing2 := s.addMockContainerWithDefaultKey(c, "/dev/sda2")
+
+	restore := MockLUKS2ImportToken(func(devicePath string, token luks2.Token, options *luks2.ImportTokenOptions) error {
+		if devicePath == "/dev/sda2" && options != nil && options.Replace {
+			return errors.New("some error")
+		}
+		return s.luks2.importToken(devicePath, token, options)
+	})
+	defer restore()
+
+	results, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), s.mockPrimaryKeyProtector(c),
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", KeyslotName: "run", ExistingKey: existing1},
+		&LUKS2Enrollment{DevicePath: "/dev/sda2", KeyslotName: "run", ExistingKey: existing2})
+	c.Check(err, ErrorMatches, `cannot enroll /dev/sda2: cannot write key data: cannot commit keydata: some error`)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Err, Equals, ErrLUKS2EnrollmentAborted)
+	c.Check(results[1].Err, ErrorMatches, `cannot write key data: cannot commit keydata: some error`)
+
+	for _, path := range []string{"/dev/sda1", "/dev/sda2"} {
+		c.Check(s.luks2.devices[path].keyslots, HasLen, 1, Commentf("path: %s", path))
+		c.Check(s.luks2.devices[path].tokens, HasLen, 1, Commentf("path: %s", path))
+	}
+}
+
+func (s *cryptSuite) TestEnrollLUKS2ContainersWithPrimaryKeyNoProtector(c *C) {
+	_, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), nil)
+	c.Check(err, ErrorMatches, `no protector supplied`)
+}
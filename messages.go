@@ -0,0 +1,146 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"text/template"
+)
+
+// MessageID identifies a user-facing message that is generated by secboot.
+type MessageID string
+
+const (
+	// MessagePassphrasePrompt is the prompt used to request a passphrase
+	// by the AuthRequestor returned from NewSystemdAuthRequestor when it
+	// is created without a passphrase template.
+	MessagePassphrasePrompt MessageID = "passphrase-prompt"
+
+	// MessageRecoveryKeyPrompt is the prompt used to request a recovery key
+	// by the AuthRequestor returned from NewSystemdAuthRequestor when it is
+	// created without a recovery key template.
+	MessageRecoveryKeyPrompt MessageID = "recovery-key-prompt"
+
+	// MessagePassphraseTriesRemaining is a warning that is sent to an
+	// AuthRequestor that implements AuthRequestorNotifier after an incorrect
+	// passphrase is entered, indicating how many more attempts are permitted
+	// before falling back to the recovery key.
+	MessagePassphraseTriesRemaining MessageID = "passphrase-tries-remaining"
+
+	// MessageRecoveryKeyTriesRemaining is a warning that is sent to an
+	// AuthRequestor that implements AuthRequestorNotifier after an incorrect
+	// recovery key is entered, indicating how many more attempts are permitted.
+	MessageRecoveryKeyTriesRemaining MessageID = "recovery-key-tries-remaining"
+
+	// MessageUnlockingVolume is the status message used by the
+	// ActivationProgressReporter returned from NewSystemdNotifyProgressReporter.
+	MessageUnlockingVolume MessageID = "unlocking-volume"
+)
+
+// defaultMessages contains the default English templates for each message.
+var defaultMessages = map[MessageID]string{
+	MessagePassphrasePrompt:          "Enter passphrase for {{.VolumeName}} ({{.SourceDevicePath}}):",
+	MessageRecoveryKeyPrompt:         "Enter recovery key for {{.VolumeName}} ({{.SourceDevicePath}}):",
+	MessagePassphraseTriesRemaining:  "Incorrect passphrase. {{.TriesRemaining}} attempt(s) remaining before the recovery key is required.",
+	MessageRecoveryKeyTriesRemaining: "Incorrect recovery key. {{.TriesRemaining}} attempt(s) remaining.",
+	MessageUnlockingVolume:           "Unlocking {{.VolumeName}} ({{.SourceDevicePath}}): {{.Stage}}",
+}
+
+// MessageParams contains the parameters that are used to execute a message
+// template. Not every message uses every parameter.
+type MessageParams struct {
+	VolumeName       string          // The name that the LUKS container will be mapped to.
+	SourceDevicePath string          // The device path of the LUKS container.
+	TriesRemaining   int             // The number of remaining attempts for a credential.
+	Stage            ActivationStage // The current activation stage.
+}
+
+// MessageCatalog provides localized versions of the messages generated by
+// secboot, and can be installed with SetMessageCatalog.
+type MessageCatalog interface {
+	// MessageTemplate returns the localized template for the specified
+	// message, in the text/template syntax. The template is executed with
+	// a MessageParams. If there is no localized version of the message,
+	// this should return false, and the default English template will be
+	// used instead.
+	MessageTemplate(id MessageID) (tmpl string, ok bool)
+}
+
+var (
+	messageCatalogMu sync.Mutex
+	messageCatalog   MessageCatalog
+)
+
+// SetMessageCatalog installs the supplied catalog for localizing messages
+// generated by secboot. Supplying nil restores the default English messages.
+func SetMessageCatalog(catalog MessageCatalog) {
+	messageCatalogMu.Lock()
+	defer messageCatalogMu.Unlock()
+	messageCatalog = catalog
+}
+
+func executeMessageTemplate(id MessageID, tmpl string, params *MessageParams) (string, error) {
+	t, err := template.New(string(id)).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse template: %w", err)
+	}
+	msg := new(bytes.Buffer)
+	if err := t.Execute(msg, params); err != nil {
+		return "", fmt.Errorf("cannot execute template: %w", err)
+	}
+	return msg.String(), nil
+}
+
+// FormatMessage returns the specified message with the supplied parameters,
+// localized by the catalog installed with SetMessageCatalog if there is one.
+// If the localized template is invalid, the default English message is
+// returned instead. This is useful for custom AuthRequestor implementations.
+func FormatMessage(id MessageID, params *MessageParams) string {
+	if params == nil {
+		params = new(MessageParams)
+	}
+
+	messageCatalogMu.Lock()
+	catalog := messageCatalog
+	messageCatalogMu.Unlock()
+
+	if catalog != nil {
+		if tmpl, ok := catalog.MessageTemplate(id); ok {
+			msg, err := executeMessageTemplate(id, tmpl, params)
+			if err == nil {
+				return msg
+			}
+			fmt.Fprintf(osStderr, "secboot: invalid localized template for message %q: %v\n", id, err)
+		}
+	}
+
+	tmpl, ok := defaultMessages[id]
+	if !ok {
+		return string(id)
+	}
+	msg, err := executeMessageTemplate(id, tmpl, params)
+	if err != nil {
+		// The default templates are all valid.
+		panic(fmt.Sprintf("invalid default template for message %q: %v", id, err))
+	}
+	return msg
+}
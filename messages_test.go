@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type mockMessageCatalog map[MessageID]string
+
+func (c mockMessageCatalog) MessageTemplate(id MessageID) (string, bool) {
+	tmpl, ok := c[id]
+	return tmpl, ok
+}
+
+type messagesSuite struct{}
+
+var _ = Suite(&messagesSuite{})
+
+func (s *messagesSuite) TearDownTest(c *C) {
+	SetMessageCatalog(nil)
+}
+
+func (s *messagesSuite) TestFormatMessageDefault(c *C) {
+	c.Check(FormatMessage(MessagePassphrasePrompt, &MessageParams{VolumeName: "data", SourceDevicePath: "/dev/sda1"}), Equals,
+		"Enter passphrase for data (/dev/sda1):")
+	c.Check(FormatMessage(MessageRecoveryKeyPrompt, &MessageParams{VolumeName: "save", SourceDevicePath: "/dev/sda2"}), Equals,
+		"Enter recovery key for save (/dev/sda2):")
+	c.Check(FormatMessage(MessagePassphraseTriesRemaining, &MessageParams{TriesRemaining: 2}), Equals,
+		"Incorrect passphrase. 2 attempt(s) remaining before the recovery key is required.")
+	c.Check(FormatMessage(MessageRecoveryKeyTriesRemaining, &MessageParams{TriesRemaining: 1}), Equals,
+		"Incorrect recovery key. 1 attempt(s) remaining.")
+	c.Check(FormatMessage(MessageUnlockingVolume, &MessageParams{VolumeName: "data", SourceDevicePath: "/dev/sda1", Stage: ActivationStageActivate}), Equals,
+		"Unlocking data (/dev/sda1): activating volume")
+}
+
+func (s *messagesSuite) TestFormatMessageNilParams(c *C) {
+	c.Check(FormatMessage(MessageRecoveryKeyTriesRemaining, nil), Equals, "Incorrect recovery key. 0 attempt(s) remaining.")
+}
+
+func (s *messagesSuite) TestFormatMessageUnknown(c *C) {
+	c.Check(FormatMessage("foo", nil), Equals, "foo")
+}
+
+func (s *messagesSuite) TestFormatMessageWithCatalog(c *C) {
+	SetMessageCatalog(mockMessageCatalog{
+		MessagePassphrasePrompt: "Geben Sie die Passphrase für {{.VolumeName}} ein:"})
+
+	c.Check(FormatMessage(MessagePassphrasePrompt, &MessageParams{VolumeName: "data"}), Equals, "Geben Sie die Passphrase für data ein:")
+	// Messages missing from the catalog use the default.
+	c.Check(FormatMessage(MessageRecoveryKeyPrompt, &MessageParams{VolumeName: "data", SourceDevicePath: "/dev/sda1"}), Equals,
+		"Enter recovery key for data (/dev/sda1):")
+}
+
+func (s *messagesSuite) TestFormatMessageWithInvalidCatalogTemplate(c *C) {
+	SetMessageCatalog(mockMessageCatalog{
+		MessagePassphrasePrompt: "{{.Foo}"})
+
+	c.Check(FormatMessage(MessagePassphrasePrompt, &MessageParams{VolumeName: "data", SourceDevicePath: "/dev/sda1"}), Equals,
+		"Enter passphrase for data (/dev/sda1):")
+}
+
+func (s *messagesSuite) TestSetMessageCatalogNil(c *C) {
+	SetMessageCatalog(mockMessageCatalog{MessagePassphrasePrompt: "foo"})
+	c.Check(FormatMessage(MessagePassphrasePrompt, nil), Equals, "foo")
+
+	SetMessageCatalog(nil)
+	c.Check(FormatMessage(MessagePassphrasePrompt, nil), Equals, "Enter passphrase for  ():")
+}
@@ -0,0 +1,218 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	passphrasePolicyMu sync.Mutex
+	passphrasePolicy   *PassphrasePolicy
+
+	// commonPassphrases is a small list of passphrases that are
+	// known to be commonly used, and which are always rejected by a
+	// policy with a non-zero MinEntropyBits.
+	commonPassphrases = []string{
+		"123456", "1234567", "12345678", "123456789", "1234567890",
+		"password", "password1", "passw0rd", "qwerty", "qwertyuiop",
+		"abc123", "letmein", "welcome", "iloveyou", "admin",
+		"monkey", "dragon", "sunshine", "princess", "football",
+		"baseball", "master", "shadow", "trustno1", "ubuntu",
+	}
+
+	// keyboardRows is used to detect runs of adjacent keys.
+	keyboardRows = []string{
+		"`1234567890-=",
+		"qwertyuiop[]\\",
+		"asdfghjkl;'",
+		"zxcvbnm,./",
+	}
+)
+
+// PassphrasePolicyError is returned from APIs that set a passphrase if the
+// supplied passphrase doesn't meet the requirements of the configured
+// PassphrasePolicy.
+type PassphrasePolicyError struct {
+	msg string
+}
+
+func (e *PassphrasePolicyError) Error() string {
+	return "passphrase does not meet the policy requirements: " + e.msg
+}
+
+// PassphrasePolicy describes the requirements for passphrases that are set
+// using NewKeyDataWithPassphrase, KeyData.ChangePassphrase and the
+// platform-specific APIs that make use of these.
+type PassphrasePolicy struct {
+	// MinLength is the minimum number of characters that a passphrase
+	// must contain.
+	MinLength int
+
+	// MinEntropyBits is the minimum estimated entropy of a passphrase
+	// in bits, as returned from EstimatePassphraseEntropy.
+	MinEntropyBits float64
+
+	// Blocklist contains passphrases that are rejected. The comparison
+	// is case-insensitive.
+	Blocklist []string
+}
+
+// Check tests the supplied passphrase against this policy, returning a
+// *PassphrasePolicyError error if it doesn't meet the requirements.
+func (p *PassphrasePolicy) Check(passphrase string) error {
+	if n := utf8.RuneCountInString(passphrase); n < p.MinLength {
+		return &PassphrasePolicyError{fmt.Sprintf("too short (%d characters, at least %d required)", n, p.MinLength)}
+	}
+
+	for _, blocked := range p.Blocklist {
+		if strings.EqualFold(passphrase, blocked) {
+			return &PassphrasePolicyError{"passphrase is blocklisted"}
+		}
+	}
+
+	if p.MinEntropyBits > 0 {
+		if bits := EstimatePassphraseEntropy(passphrase); bits < p.MinEntropyBits {
+			return &PassphrasePolicyError{fmt.Sprintf("too easy to guess (estimated %.1f bits of entropy, at least %.1f required)", bits, p.MinEntropyBits)}
+		}
+	}
+
+	return nil
+}
+
+// SetPassphrasePolicy sets the policy that is enforced by APIs that set a
+// passphrase. Passing nil disables enforcement, which is the default.
+//
+// This returns the previously set policy.
+func SetPassphrasePolicy(policy *PassphrasePolicy) *PassphrasePolicy {
+	passphrasePolicyMu.Lock()
+	defer passphrasePolicyMu.Unlock()
+
+	orig := passphrasePolicy
+	passphrasePolicy = policy
+	return orig
+}
+
+// CheckPassphrase tests the supplied passphrase against the policy configured
+// with SetPassphrasePolicy, returning a *PassphrasePolicyError error if it
+// doesn't meet the requirements. It always succeeds if no policy is set.
+func CheckPassphrase(passphrase string) error {
+	passphrasePolicyMu.Lock()
+	policy := passphrasePolicy
+	passphrasePolicyMu.Unlock()
+
+	if policy == nil {
+		return nil
+	}
+	return policy.Check(passphrase)
+}
+
+func passphraseCharsetSize(passphrase string) (n int) {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range passphrase {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	if lower {
+		n += 26
+	}
+	if upper {
+		n += 26
+	}
+	if digit {
+		n += 10
+	}
+	if symbol {
+		n += 33
+	}
+	if other {
+		n += 100
+	}
+	return n
+}
+
+func isKeyboardAdjacent(a, b rune) bool {
+	a = unicode.ToLower(a)
+	b = unicode.ToLower(b)
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i < 0 {
+			continue
+		}
+		j := strings.IndexRune(row, b)
+		if j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// EstimatePassphraseEntropy returns a conservative estimate of the entropy of
+// the supplied passphrase in bits. This is a simple estimator inspired by
+// zxcvbn: commonly used passphrases score zero, and characters that repeat the
+// previous character, continue an alphabetic or numeric sequence, or are adjacent
+// on a keyboard to the previous character only contribute a single bit each. All
+// other characters contribute log2 of the size of the character set in use.
+func EstimatePassphraseEntropy(passphrase string) float64 {
+	if passphrase == "" {
+		return 0
+	}
+
+	lower := strings.ToLower(passphrase)
+	for _, common := range commonPassphrases {
+		if lower == common {
+			return 0
+		}
+	}
+
+	perChar := math.Log2(float64(passphraseCharsetSize(passphrase)))
+
+	var bits float64
+	prev := rune(-1)
+	for _, r := range passphrase {
+		switch {
+		case prev < 0:
+			bits += perChar
+		case r == prev, r == prev+1, r == prev-1, isKeyboardAdjacent(prev, r):
+			bits += 1
+		default:
+			bits += perChar
+		}
+		prev = r
+	}
+
+	return bits
+}
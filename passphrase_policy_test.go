@@ -0,0 +1,101 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"math"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type passphrasePolicySuite struct{}
+
+func (s *passphrasePolicySuite) TearDownTest(c *C) {
+	SetPassphrasePolicy(nil)
+}
+
+var _ = Suite(&passphrasePolicySuite{})
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyEmpty(c *C) {
+	c.Check(EstimatePassphraseEntropy(""), Equals, float64(0))
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyCommon(c *C) {
+	c.Check(EstimatePassphraseEntropy("password"), Equals, float64(0))
+	c.Check(EstimatePassphraseEntropy("PassWord"), Equals, float64(0))
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyRandomLower(c *C) {
+	// No repeats, sequences or adjacent keys
+	c.Check(EstimatePassphraseEntropy("xmvkeqaz"), Equals, 8*math.Log2(26))
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyMixedClasses(c *C) {
+	c.Check(EstimatePassphraseEntropy("x7M!"), Equals, 4*math.Log2(26+26+10+33))
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyRepeats(c *C) {
+	c.Check(EstimatePassphraseEntropy("aaaaaaaa"), Equals, math.Log2(26)+7)
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropySequence(c *C) {
+	c.Check(EstimatePassphraseEntropy("98765"), Equals, math.Log2(10)+4)
+}
+
+func (s *passphrasePolicySuite) TestEstimatePassphraseEntropyKeyboard(c *C) {
+	c.Check(EstimatePassphraseEntropy("asdfgh"), Equals, math.Log2(26)+5)
+}
+
+func (s *passphrasePolicySuite) TestCheckOK(c *C) {
+	policy := &PassphrasePolicy{MinLength: 8, MinEntropyBits: 40, Blocklist: []string{"correct horse battery staple"}}
+	c.Check(policy.Check("xmvkeqaz-plor"), IsNil)
+}
+
+func (s *passphrasePolicySuite) TestCheckTooShort(c *C) {
+	policy := &PassphrasePolicy{MinLength: 8}
+	c.Check(policy.Check("xmvké"), ErrorMatches, `passphrase does not meet the policy requirements: too short \(5 characters, at least 8 required\)`)
+}
+
+func (s *passphrasePolicySuite) TestCheckBlocklisted(c *C) {
+	policy := &PassphrasePolicy{Blocklist: []string{"Correct Horse Battery Staple"}}
+	err := policy.Check("correct horse battery staple")
+	c.Check(err, ErrorMatches, `passphrase does not meet the policy requirements: passphrase is blocklisted`)
+	c.Check(err, testutil.ConvertibleTo, &PassphrasePolicyError{})
+}
+
+func (s *passphrasePolicySuite) TestCheckLowEntropy(c *C) {
+	policy := &PassphrasePolicy{MinEntropyBits: 40}
+	c.Check(policy.Check("aaaaaaaaaaaaaaaa"), ErrorMatches, `passphrase does not meet the policy requirements: too easy to guess \(estimated 19.7 bits of entropy, at least 40.0 required\)`)
+}
+
+func (s *passphrasePolicySuite) TestCheckPassphraseNoPolicy(c *C) {
+	c.Check(CheckPassphrase(""), IsNil)
+}
+
+func (s *passphrasePolicySuite) TestCheckPassphraseWithPolicy(c *C) {
+	policy := &PassphrasePolicy{MinLength: 4}
+	c.Check(SetPassphrasePolicy(policy), IsNil)
+	c.Check(CheckPassphrase("abc"), ErrorMatches, `passphrase does not meet the policy requirements: too short \(3 characters, at least 4 required\)`)
+	c.Check(CheckPassphrase("abcd"), IsNil)
+	c.Check(SetPassphrasePolicy(nil), Equals, policy)
+}
@@ -46,7 +46,7 @@ type PBKDF2Options struct {
 	HashAlg crypto.Hash
 }
 
-func (o *PBKDF2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
+func (o *PBKDF2Options) kdfParams(_ Argon2KDF, keyLen uint32) (*kdfParams, error) {
 	if keyLen > math.MaxInt32 {
 		return nil, errors.New("invalid key length")
 	}
@@ -102,6 +102,6 @@ func (o *PBKDF2Options) kdfParams(keyLen uint32) (*kdfParams, error) {
 		o = &PBKDF2Options{
 			ForceIterations: uint32(iterations),
 			HashAlg:         HashAlg}
-		return o.kdfParams(keyLen)
+		return o.kdfParams(nil, keyLen)
 	}
 }
@@ -0,0 +1,196 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11
+
+import (
+	"crypto"
+	_ "crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+
+	"github.com/snapcore/secboot"
+)
+
+const (
+	platformName = "pkcs11"
+
+	keyIDSize = 16
+	nonceSize = 12
+)
+
+var (
+	secbootNewKeyDataWithPassphrase = secboot.NewKeyDataWithPassphrase
+)
+
+type additionalData struct {
+	Version    int
+	Generation int
+	KDFAlg     secboot.HashAlg
+	AuthMode   secboot.AuthMode
+}
+
+func (d additionalData) MarshalASN1(b *cryptobyte.Builder) {
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(int64(d.Version))
+		b.AddASN1Int64(int64(d.Generation))
+		d.KDFAlg.MarshalASN1(b)
+		b.AddASN1Enum(int64(d.AuthMode))
+	})
+}
+
+func (d additionalData) bytes() ([]byte, error) {
+	builder := cryptobyte.NewBuilder(nil)
+	d.MarshalASN1(builder)
+	return builder.Bytes()
+}
+
+type keyData struct {
+	Version int `json:"version"`
+
+	TokenSerial string `json:"token-serial"` // The serial number of the token
+	KeyID       []byte `json:"key-id"`       // The CKA_ID of the AES key on the token
+	Nonce       []byte `json:"nonce"`        // The GCM nonce
+}
+
+func isZeroKey(key []byte) bool {
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ProtectKeyParams provides the parameters to NewProtectedKey.
+type ProtectKeyParams struct {
+	// TokenSerial is the serial number of the token to protect the new
+	// key with.
+	TokenSerial string
+
+	// PIN is the current user PIN for the token. It is not changed, and
+	// it is used as the passphrase for the new key.
+	PIN string
+
+	// Role describes the role of the new key.
+	Role string
+}
+
+// NewProtectedKey creates a new key that is protected by an AES key generated on the
+// PKCS#11 token with the serial number specified in params. The token is accessed
+// using the module supplied to [SetModule]. The token's user PIN is used as the
+// passphrase for the new key, and recovering the key requires the PIN. The PIN
+// is supplied to the token unmodified, so the token's own retry counter protects
+// it, and several keys can be protected by the same token. Note that changing the
+// passphrase of a key with [secboot.KeyData.ChangePassphrase] changes the token's
+// PIN, after which any other keys protected by the same token can no longer be
+// recovered and must be recreated.
+//
+// If primaryKey isn't supplied, then one will be generated.
+//
+// This function requires some cryptographically strong randomness, obtained from the rand
+// argument. Whilst this will normally be from [rand.Reader], it can be provided from other
+// secure sources or mocked during tests.
+func NewProtectedKey(rand io.Reader, params *ProtectKeyParams, primaryKey secboot.PrimaryKey) (protectedKey *secboot.KeyData, primaryKeyOut secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	if params == nil {
+		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
+	}
+
+	// Check the PIN before doing anything with the token.
+	if err := secboot.CheckPassphrase(params.PIN); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(primaryKey) == 0 {
+		primaryKey = make(secboot.PrimaryKey, 32)
+		if _, err := io.ReadFull(rand, primaryKey); err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot obtain primary key: %w", err)
+		}
+	}
+
+	kdfAlg := crypto.SHA256
+	unlockKey, payload, err := secboot.MakeDiskUnlockKey(rand, kdfAlg, primaryKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create new unlock key: %w", err)
+	}
+
+	// Obtain a 16-byte key ID and a 12-byte GCM nonce.
+	randBytes := make([]byte, keyIDSize+nonceSize)
+	if _, err := io.ReadFull(rand, randBytes); err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot obtain required random bytes: %w", err)
+	}
+
+	kd := &keyData{
+		Version:     1,
+		TokenSerial: params.TokenSerial,
+		KeyID:       randBytes[:keyIDSize],
+		Nonce:       randBytes[keyIDSize:],
+	}
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: secboot.KeyDataGeneration,
+		KDFAlg:     secboot.HashAlg(kdfAlg),
+		AuthMode:   secboot.AuthModePassphrase,
+	}.bytes()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot serialize AAD: %w", err)
+	}
+
+	session, err := openSession(params.TokenSerial)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot open session: %w", err)
+	}
+	defer session.Close()
+
+	if err := session.Login(params.PIN); err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot log in to token: %w", err)
+	}
+
+	if err := session.GenerateKey(kd.KeyID); err != nil {
+		session.Logout()
+		return nil, nil, nil, fmt.Errorf("cannot generate key: %w", err)
+	}
+
+	ciphertext, err := session.Encrypt(kd.KeyID, kd.Nonce, aad, payload)
+	session.Logout()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot encrypt payload: %w", err)
+	}
+
+	protectedKey, err = secbootNewKeyDataWithPassphrase(&secboot.KeyWithPassphraseParams{
+		KeyParams: secboot.KeyParams{
+			Handle:           kd,
+			Role:             params.Role,
+			EncryptedPayload: ciphertext,
+			PlatformName:     platformName,
+			KDFAlg:           kdfAlg,
+		},
+		PassphraseIsAuthKey: true,
+	}, params.PIN)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot create key data: %w", err)
+	}
+
+	return protectedKey, primaryKey, unlockKey, nil
+}
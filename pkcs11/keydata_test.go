@@ -0,0 +1,163 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11_test
+
+import (
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/pkcs11"
+)
+
+type keydataSuite struct {
+	pkcs11TestBase
+}
+
+var _ = Suite(&keydataSuite{})
+
+func (s *keydataSuite) params() *ProtectKeyParams {
+	return &ProtectKeyParams{
+		TokenSerial: "0123456789abcdef",
+		PIN:         "1234",
+		Role:        "foo",
+	}
+}
+
+func (s *keydataSuite) TestNewProtectedKey(c *C) {
+	kd, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, PlatformName)
+	c.Check(kd.Role(), Equals, "foo")
+	c.Check(kd.AuthMode(), Equals, secboot.AuthModePassphrase)
+	c.Check(primaryKey, HasLen, 32)
+
+	// The token's PIN should not have been changed.
+	c.Check(s.token.pin, Equals, "1234")
+	c.Check(s.token.keys, HasLen, 1)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWithPrimaryKey(c *C) {
+	primaryKey := testutil.DecodeHexString(c, "7d5f2bd5d5e0b8e0e0b3bf1d5bfe8a1c5e4a8b9e0a0c3b3bc0f6e6a1f5a3c4b1")
+
+	kd, primaryKeyOut, unlockKey, err := NewProtectedKey(rand.Reader, s.params(), primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(primaryKeyOut, DeepEquals, secboot.PrimaryKey(primaryKey))
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, secboot.PrimaryKey(primaryKey))
+}
+
+func (s *keydataSuite) TestRecoverKeysWithWrongPassphrase(c *C) {
+	kd, _, _, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+
+	_, _, err = kd.RecoverKeysWithPassphrase("4321")
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyTwoKeys(c *C) {
+	kd1, primaryKey1, unlockKey1, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+	kd2, primaryKey2, unlockKey2, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+
+	c.Check(s.token.pin, Equals, "1234")
+	c.Check(s.token.keys, HasLen, 2)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd1.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey1)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey1)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err = kd2.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey2)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey2)
+
+	// Changing the passphrase of one key changes the token PIN, and
+	// the other key can no longer be recovered.
+	c.Check(kd1.ChangePassphrase("1234", "5678"), IsNil)
+	c.Check(s.token.pin, Equals, "5678")
+
+	_, _, err = kd2.RecoverKeysWithPassphrase("1234")
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+}
+
+func (s *keydataSuite) TestChangePassphrase(c *C) {
+	kd, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+
+	c.Check(kd.ChangePassphrase("1234", "5678"), IsNil)
+	c.Check(s.token.pin, Equals, "5678")
+
+	_, _, err = kd.RecoverKeysWithPassphrase("1234")
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeysWithPassphrase("5678")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *keydataSuite) TestChangePassphraseWrongPassphrase(c *C) {
+	kd, _, _, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Assert(err, IsNil)
+
+	c.Check(kd.ChangePassphrase("4321", "5678"), Equals, secboot.ErrInvalidPassphrase)
+	c.Check(s.token.pin, Equals, "1234")
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoParams(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, nil, nil)
+	c.Check(err, ErrorMatches, `no ProtectKeyParams provided`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyNoModule(c *C) {
+	SetModule(nil)
+	_, _, _, err := NewProtectedKey(rand.Reader, s.params(), nil)
+	c.Check(err, ErrorMatches, `cannot open session: no PKCS#11 module`)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyTokenNotPresent(c *C) {
+	params := s.params()
+	params.TokenSerial = "foo"
+	_, _, _, err := NewProtectedKey(rand.Reader, params, nil)
+	c.Check(err, ErrorMatches, `cannot open session: the token is not present`)
+	c.Check(err, testutil.ErrorIs, ErrTokenNotPresent)
+}
+
+func (s *keydataSuite) TestNewProtectedKeyWrongPIN(c *C) {
+	params := s.params()
+	params.PIN = "4321"
+	_, _, _, err := NewProtectedKey(rand.Reader, params, nil)
+	c.Check(err, ErrorMatches, `cannot log in to token: the PIN is incorrect`)
+	c.Check(err, testutil.ErrorIs, ErrPINIncorrect)
+	c.Check(s.token.keys, HasLen, 0)
+}
@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PKCS#11 return values that are mapped to the errors in this package.
+const (
+	ckrDeviceRemoved              = 0x32
+	ckrKeyHandleInvalid           = 0x60
+	ckrPINIncorrect               = 0xa0
+	ckrPINLocked                  = 0xa4
+	ckrTokenNotPresent            = 0xe0
+	ckrCryptokiAlreadyInitialized = 0x191
+)
+
+// P11KitProxyModule is the name of the p11-kit proxy module, which provides
+// access to all of the PKCS#11 modules configured on the system. It can be
+// passed to LoadModule.
+const P11KitProxyModule = "p11-kit-proxy.so"
+
+// ReturnValueError is returned from a Module obtained from LoadModule for
+// PKCS#11 return values that don't correspond to one of the other errors in
+// this package.
+type ReturnValueError uint
+
+func (e ReturnValueError) Error() string {
+	return fmt.Sprintf("PKCS#11 function returned 0x%08x", uint(e))
+}
+
+// errNoCgo is returned from LoadModule when built without cgo.
+var errNoCgo = errors.New("loading PKCS#11 modules requires cgo")
+
+// returnValueToError converts the supplied PKCS#11 return value to an error,
+// returning nil for CKR_OK.
+func returnValueToError(rv uint) error {
+	switch rv {
+	case 0:
+		return nil
+	case ckrPINIncorrect:
+		return ErrPINIncorrect
+	case ckrPINLocked:
+		return ErrPINLocked
+	case ckrTokenNotPresent, ckrDeviceRemoved:
+		return ErrTokenNotPresent
+	case ckrKeyHandleInvalid:
+		return ErrKeyNotFound
+	default:
+		return ReturnValueError(rv)
+	}
+}
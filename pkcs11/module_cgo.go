@@ -0,0 +1,412 @@
+//go:build cgo
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11
+
+/*
+#cgo LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef unsigned long ck_ulong;
+typedef unsigned char ck_byte;
+typedef ck_ulong ck_rv;
+
+typedef struct {
+	ck_byte major;
+	ck_byte minor;
+} ck_version;
+
+typedef struct {
+	ck_byte label[32];
+	ck_byte manufacturer_id[32];
+	ck_byte model[16];
+	ck_byte serial_number[16];
+	ck_ulong flags;
+	ck_ulong max_session_count;
+	ck_ulong session_count;
+	ck_ulong max_rw_session_count;
+	ck_ulong rw_session_count;
+	ck_ulong max_pin_len;
+	ck_ulong min_pin_len;
+	ck_ulong total_public_memory;
+	ck_ulong free_public_memory;
+	ck_ulong total_private_memory;
+	ck_ulong free_private_memory;
+	ck_version hardware_version;
+	ck_version firmware_version;
+	ck_byte utc_time[16];
+} ck_token_info;
+
+typedef struct {
+	ck_ulong type;
+	void *value;
+	ck_ulong value_len;
+} ck_attribute;
+
+typedef struct {
+	ck_ulong mechanism;
+	void *parameter;
+	ck_ulong parameter_len;
+} ck_mechanism;
+
+typedef struct {
+	ck_byte *iv;
+	ck_ulong iv_len;
+	ck_ulong iv_bits;
+	ck_byte *aad;
+	ck_ulong aad_len;
+	ck_ulong tag_bits;
+} ck_gcm_params;
+
+typedef struct {
+	void *create_mutex;
+	void *destroy_mutex;
+	void *lock_mutex;
+	void *unlock_mutex;
+	ck_ulong flags;
+	void *reserved;
+} ck_c_initialize_args;
+
+// ck_function_list is CK_FUNCTION_LIST with the function pointers expressed
+// as an array indexed by the fn_* constants below.
+typedef struct {
+	ck_version version;
+	void *fns[59];
+} ck_function_list;
+
+enum {
+	fn_initialize = 0,
+	fn_get_slot_list = 4,
+	fn_get_token_info = 6,
+	fn_set_pin = 11,
+	fn_open_session = 12,
+	fn_close_session = 13,
+	fn_login = 18,
+	fn_logout = 19,
+	fn_find_objects_init = 26,
+	fn_find_objects = 27,
+	fn_find_objects_final = 28,
+	fn_encrypt_init = 29,
+	fn_encrypt = 30,
+	fn_decrypt_init = 33,
+	fn_decrypt = 34,
+	fn_generate_key = 58
+};
+
+#define CKR_OK 0
+#define CKR_GENERAL_ERROR 5
+#define CKF_RW_SESSION 2
+#define CKF_SERIAL_SESSION 4
+#define CKF_OS_LOCKING_OK 2
+#define CKU_USER 1
+#define CKO_SECRET_KEY 4
+#define CKK_AES 0x1f
+#define CKA_CLASS 0
+#define CKA_TOKEN 1
+#define CKA_PRIVATE 2
+#define CKA_KEY_TYPE 0x100
+#define CKA_ID 0x102
+#define CKA_SENSITIVE 0x103
+#define CKA_ENCRYPT 0x104
+#define CKA_DECRYPT 0x105
+#define CKA_VALUE_LEN 0x161
+#define CKA_EXTRACTABLE 0x162
+#define CKM_AES_KEY_GEN 0x1080
+#define CKM_AES_GCM 0x1087
+
+static const char *load_module(const char *path, void **handle, ck_function_list **list) {
+	*handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (*handle == NULL) {
+		return dlerror();
+	}
+	ck_rv (*get_function_list)(ck_function_list **) = dlsym(*handle, "C_GetFunctionList");
+	if (get_function_list == NULL) {
+		const char *err = dlerror();
+		dlclose(*handle);
+		return err;
+	}
+	if (get_function_list(list) != CKR_OK || *list == NULL) {
+		dlclose(*handle);
+		return "C_GetFunctionList failed";
+	}
+	return NULL;
+}
+
+static ck_rv initialize(ck_function_list *list) {
+	ck_c_initialize_args args = { .flags = CKF_OS_LOCKING_OK };
+	return ((ck_rv (*)(void *))list->fns[fn_initialize])(&args);
+}
+
+static ck_rv get_slot_list(ck_function_list *list, ck_ulong *slots, ck_ulong *count) {
+	return ((ck_rv (*)(ck_byte, ck_ulong *, ck_ulong *))list->fns[fn_get_slot_list])(1, slots, count);
+}
+
+static ck_rv get_token_info(ck_function_list *list, ck_ulong slot, ck_token_info *info) {
+	return ((ck_rv (*)(ck_ulong, ck_token_info *))list->fns[fn_get_token_info])(slot, info);
+}
+
+static ck_rv open_session(ck_function_list *list, ck_ulong slot, ck_ulong *session) {
+	return ((ck_rv (*)(ck_ulong, ck_ulong, void *, void *, ck_ulong *))list->fns[fn_open_session])(
+		slot, CKF_RW_SESSION | CKF_SERIAL_SESSION, NULL, NULL, session);
+}
+
+static ck_rv close_session(ck_function_list *list, ck_ulong session) {
+	return ((ck_rv (*)(ck_ulong))list->fns[fn_close_session])(session);
+}
+
+static ck_rv login(ck_function_list *list, ck_ulong session, ck_byte *pin, ck_ulong pin_len) {
+	return ((ck_rv (*)(ck_ulong, ck_ulong, ck_byte *, ck_ulong))list->fns[fn_login])(session, CKU_USER, pin, pin_len);
+}
+
+static ck_rv logout(ck_function_list *list, ck_ulong session) {
+	return ((ck_rv (*)(ck_ulong))list->fns[fn_logout])(session);
+}
+
+static ck_rv set_pin(ck_function_list *list, ck_ulong session, ck_byte *old_pin, ck_ulong old_len, ck_byte *new_pin, ck_ulong new_len) {
+	return ((ck_rv (*)(ck_ulong, ck_byte *, ck_ulong, ck_byte *, ck_ulong))list->fns[fn_set_pin])(
+		session, old_pin, old_len, new_pin, new_len);
+}
+
+static ck_rv generate_key(ck_function_list *list, ck_ulong session, ck_byte *id, ck_ulong id_len, ck_ulong *key) {
+	ck_ulong class = CKO_SECRET_KEY;
+	ck_ulong key_type = CKK_AES;
+	ck_ulong value_len = 32;
+	ck_byte yes = 1;
+	ck_byte no = 0;
+	ck_attribute template[] = {
+		{ CKA_CLASS, &class, sizeof(class) },
+		{ CKA_KEY_TYPE, &key_type, sizeof(key_type) },
+		{ CKA_VALUE_LEN, &value_len, sizeof(value_len) },
+		{ CKA_ID, id, id_len },
+		{ CKA_TOKEN, &yes, sizeof(yes) },
+		{ CKA_PRIVATE, &yes, sizeof(yes) },
+		{ CKA_SENSITIVE, &yes, sizeof(yes) },
+		{ CKA_EXTRACTABLE, &no, sizeof(no) },
+		{ CKA_ENCRYPT, &yes, sizeof(yes) },
+		{ CKA_DECRYPT, &yes, sizeof(yes) }
+	};
+	ck_mechanism mechanism = { CKM_AES_KEY_GEN, NULL, 0 };
+	return ((ck_rv (*)(ck_ulong, ck_mechanism *, ck_attribute *, ck_ulong, ck_ulong *))list->fns[fn_generate_key])(
+		session, &mechanism, template, sizeof(template) / sizeof(template[0]), key);
+}
+
+static ck_rv find_key(ck_function_list *list, ck_ulong session, ck_byte *id, ck_ulong id_len, ck_ulong *key, ck_ulong *count) {
+	ck_ulong class = CKO_SECRET_KEY;
+	ck_ulong key_type = CKK_AES;
+	ck_attribute template[] = {
+		{ CKA_CLASS, &class, sizeof(class) },
+		{ CKA_KEY_TYPE, &key_type, sizeof(key_type) },
+		{ CKA_ID, id, id_len }
+	};
+	ck_rv rv = ((ck_rv (*)(ck_ulong, ck_attribute *, ck_ulong))list->fns[fn_find_objects_init])(
+		session, template, sizeof(template) / sizeof(template[0]));
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = ((ck_rv (*)(ck_ulong, ck_ulong *, ck_ulong, ck_ulong *))list->fns[fn_find_objects])(session, key, 1, count);
+	ck_rv final_rv = ((ck_rv (*)(ck_ulong))list->fns[fn_find_objects_final])(session);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return final_rv;
+}
+
+// crypt performs a single-part AES-GCM encryption or decryption. If out is
+// NULL, the required size of the output is returned in out_len.
+static ck_rv crypt(ck_function_list *list, int encrypt, ck_ulong session, ck_ulong key,
+		   ck_byte *iv, ck_ulong iv_len, ck_byte *aad, ck_ulong aad_len,
+		   ck_byte *in, ck_ulong in_len, ck_byte *out, ck_ulong *out_len) {
+	ck_gcm_params params = { iv, iv_len, iv_len * 8, aad, aad_len, 128 };
+	ck_mechanism mechanism = { CKM_AES_GCM, &params, sizeof(params) };
+	ck_rv rv = ((ck_rv (*)(ck_ulong, ck_mechanism *, ck_ulong))list->fns[encrypt ? fn_encrypt_init : fn_decrypt_init])(
+		session, &mechanism, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return ((ck_rv (*)(ck_ulong, ck_byte *, ck_ulong, ck_byte *, ck_ulong *))list->fns[encrypt ? fn_encrypt : fn_decrypt])(
+		session, in, in_len, out, out_len);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+type cgoModule struct {
+	list *C.ck_function_list
+}
+
+// LoadModule loads the PKCS#11 module at the specified path, which is passed to
+// dlopen, and initializes it. The returned module can be supplied to [SetModule].
+// Modules are never unloaded or finalized once loaded.
+func LoadModule(path string) (Module, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var handle unsafe.Pointer
+	var list *C.ck_function_list
+	if err := C.load_module(cPath, &handle, &list); err != nil {
+		return nil, fmt.Errorf("cannot load module: %s", C.GoString(err))
+	}
+
+	switch rv := uint(C.initialize(list)); rv {
+	case 0, ckrCryptokiAlreadyInitialized:
+	default:
+		return nil, fmt.Errorf("cannot initialize module: %w", returnValueToError(rv))
+	}
+
+	return &cgoModule{list: list}, nil
+}
+
+func (m *cgoModule) findSlot(serial string) (C.ck_ulong, error) {
+	var count C.ck_ulong
+	if err := returnValueToError(uint(C.get_slot_list(m.list, nil, &count))); err != nil {
+		return 0, fmt.Errorf("cannot obtain slot count: %w", err)
+	}
+	if count == 0 {
+		return 0, ErrTokenNotPresent
+	}
+
+	slots := make([]C.ck_ulong, count)
+	if err := returnValueToError(uint(C.get_slot_list(m.list, &slots[0], &count))); err != nil {
+		return 0, fmt.Errorf("cannot obtain slots: %w", err)
+	}
+
+	for _, slot := range slots[:count] {
+		var info C.ck_token_info
+		if err := returnValueToError(uint(C.get_token_info(m.list, slot, &info))); err != nil {
+			if err == ErrTokenNotPresent {
+				continue
+			}
+			return 0, fmt.Errorf("cannot obtain token info for slot %d: %w", slot, err)
+		}
+		tokenSerial := C.GoBytes(unsafe.Pointer(&info.serial_number[0]), C.int(len(info.serial_number)))
+		if string(bytes.TrimRight(tokenSerial, " ")) == serial {
+			return slot, nil
+		}
+	}
+
+	return 0, ErrTokenNotPresent
+}
+
+func (m *cgoModule) OpenSession(serial string) (Session, error) {
+	slot, err := m.findSlot(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	var handle C.ck_ulong
+	if err := returnValueToError(uint(C.open_session(m.list, slot, &handle))); err != nil {
+		return nil, err
+	}
+	return &cgoSession{list: m.list, handle: handle}, nil
+}
+
+type cgoSession struct {
+	list   *C.ck_function_list
+	handle C.ck_ulong
+}
+
+// cBytes returns a pointer to the first element of the supplied slice, or nil
+// if it is empty.
+func cBytes(b []byte) *C.ck_byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.ck_byte)(unsafe.Pointer(&b[0]))
+}
+
+func (s *cgoSession) Login(pin string) error {
+	p := []byte(pin)
+	return returnValueToError(uint(C.login(s.list, s.handle, cBytes(p), C.ck_ulong(len(p)))))
+}
+
+func (s *cgoSession) Logout() error {
+	return returnValueToError(uint(C.logout(s.list, s.handle)))
+}
+
+func (s *cgoSession) SetPIN(oldPIN, newPIN string) error {
+	o := []byte(oldPIN)
+	n := []byte(newPIN)
+	return returnValueToError(uint(C.set_pin(s.list, s.handle, cBytes(o), C.ck_ulong(len(o)), cBytes(n), C.ck_ulong(len(n)))))
+}
+
+func (s *cgoSession) GenerateKey(id []byte) error {
+	var key C.ck_ulong
+	return returnValueToError(uint(C.generate_key(s.list, s.handle, cBytes(id), C.ck_ulong(len(id)), &key)))
+}
+
+func (s *cgoSession) findKey(id []byte) (C.ck_ulong, error) {
+	var key, count C.ck_ulong
+	if err := returnValueToError(uint(C.find_key(s.list, s.handle, cBytes(id), C.ck_ulong(len(id)), &key, &count))); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *cgoSession) crypt(encrypt bool, id, nonce, aad, data []byte) ([]byte, error) {
+	key, err := s.findKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var enc C.int
+	if encrypt {
+		enc = 1
+	}
+
+	// Obtain the size of the output first.
+	var outLen C.ck_ulong
+	if err := returnValueToError(uint(C.crypt(s.list, enc, s.handle, key,
+		cBytes(nonce), C.ck_ulong(len(nonce)), cBytes(aad), C.ck_ulong(len(aad)),
+		cBytes(data), C.ck_ulong(len(data)), nil, &outLen))); err != nil {
+		return nil, err
+	}
+
+	// Allocate an extra byte so that the output pointer is never nil.
+	out := make([]byte, outLen+1)
+	if err := returnValueToError(uint(C.crypt(s.list, enc, s.handle, key,
+		cBytes(nonce), C.ck_ulong(len(nonce)), cBytes(aad), C.ck_ulong(len(aad)),
+		cBytes(data), C.ck_ulong(len(data)), cBytes(out), &outLen))); err != nil {
+		return nil, err
+	}
+	return out[:outLen], nil
+}
+
+func (s *cgoSession) Encrypt(id, nonce, aad, data []byte) ([]byte, error) {
+	return s.crypt(true, id, nonce, aad, data)
+}
+
+func (s *cgoSession) Decrypt(id, nonce, aad, data []byte) ([]byte, error) {
+	return s.crypt(false, id, nonce, aad, data)
+}
+
+func (s *cgoSession) Close() error {
+	return returnValueToError(uint(C.close_session(s.list, s.handle)))
+}
@@ -0,0 +1,29 @@
+//go:build !cgo
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11
+
+// LoadModule loads the PKCS#11 module at the specified path, which is passed to
+// dlopen, and initializes it. The returned module can be supplied to [SetModule].
+// This requires cgo, so it always fails in this build.
+func LoadModule(path string) (Module, error) {
+	return nil, errNoCgo
+}
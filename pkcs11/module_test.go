@@ -0,0 +1,73 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/pkcs11"
+)
+
+type moduleSuite struct{}
+
+var _ = Suite(&moduleSuite{})
+
+func (s *moduleSuite) TestReturnValueToErrorOK(c *C) {
+	c.Check(ReturnValueToError(0), IsNil)
+}
+
+func (s *moduleSuite) TestReturnValueToErrorPINIncorrect(c *C) {
+	c.Check(ReturnValueToError(0xa0), Equals, ErrPINIncorrect)
+}
+
+func (s *moduleSuite) TestReturnValueToErrorPINLocked(c *C) {
+	c.Check(ReturnValueToError(0xa4), Equals, ErrPINLocked)
+}
+
+func (s *moduleSuite) TestReturnValueToErrorTokenNotPresent(c *C) {
+	c.Check(ReturnValueToError(0xe0), Equals, ErrTokenNotPresent)
+	c.Check(ReturnValueToError(0x32), Equals, ErrTokenNotPresent)
+}
+
+func (s *moduleSuite) TestReturnValueToErrorKeyNotFound(c *C) {
+	c.Check(ReturnValueToError(0x60), Equals, ErrKeyNotFound)
+}
+
+func (s *moduleSuite) TestReturnValueToErrorOther(c *C) {
+	err := ReturnValueToError(0x5)
+	c.Check(err, Equals, ReturnValueError(0x5))
+	c.Check(err, ErrorMatches, `PKCS#11 function returned 0x00000005`)
+}
+
+func (s *moduleSuite) TestLoadModuleMissing(c *C) {
+	_, err := LoadModule("/nonexistent/module.so")
+	c.Check(err, NotNil)
+}
+
+func (s *moduleSuite) TestLoadModuleTokenNotPresent(c *C) {
+	// The p11-kit library exports the proxy module.
+	m, err := LoadModule("libp11-kit.so.0")
+	if err != nil {
+		c.Skip("cannot load p11-kit: " + err.Error())
+	}
+
+	_, err = m.OpenSession("not-a-real-token-serial")
+	c.Check(err, Equals, ErrTokenNotPresent)
+}
@@ -0,0 +1,125 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package pkcs11 is a platform for protecting keys with a secret key that is held
+// on a PKCS#11 token, such as a HSM or a smartcard.
+//
+// Keys are protected by an AES key that is generated on and never leaves the token,
+// and access to it is protected by the token's user PIN. The PIN is used as the
+// passphrase with the platform agnostic passphrase support in secboot, and it is
+// supplied to the token unmodified so that the token's own retry counter protects
+// it. Changing the passphrase of a key changes the token's user PIN.
+//
+// The key data contains no secrets that can be used to test a PIN offline - the
+// payload can only be decrypted by the token once the user has logged in.
+//
+// The caller provides access to tokens by supplying a [Module] with [SetModule].
+// A PKCS#11 module can be loaded with [LoadModule].
+package pkcs11
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrPINIncorrect should be returned from Session.Login and Session.SetPIN
+	// if the supplied PIN is incorrect (CKR_PIN_INCORRECT).
+	ErrPINIncorrect = errors.New("the PIN is incorrect")
+
+	// ErrPINLocked should be returned from Session.Login and Session.SetPIN
+	// if the token's user PIN is locked (CKR_PIN_LOCKED).
+	ErrPINLocked = errors.New("the PIN is locked")
+
+	// ErrTokenNotPresent should be returned from Module.OpenSession if the
+	// requested token is not present.
+	ErrTokenNotPresent = errors.New("the token is not present")
+
+	// ErrKeyNotFound should be returned from Session.Encrypt and
+	// Session.Decrypt if the requested key does not exist on the token.
+	ErrKeyNotFound = errors.New("the key was not found on the token")
+
+	// ErrNoModule is returned when a PKCS#11 module is required but one
+	// hasn't been supplied with SetModule.
+	ErrNoModule = errors.New("no PKCS#11 module")
+)
+
+// Session corresponds to a read-write session with a PKCS#11 token.
+type Session interface {
+	// Login logs the normal user in to the token with the supplied PIN
+	// (C_Login with CKU_USER).
+	Login(pin string) error
+
+	// Logout logs the user out of the token (C_Logout).
+	Logout() error
+
+	// SetPIN changes the normal user's PIN (C_SetPIN). It will be called
+	// with the user logged in with the old PIN.
+	SetPIN(oldPIN, newPIN string) error
+
+	// GenerateKey creates a new 256-bit AES key on the token with the
+	// specified CKA_ID value (C_GenerateKey with CKM_AES_KEY_GEN). The key
+	// should be a token object, and must be private, sensitive and not
+	// extractable.
+	GenerateKey(id []byte) error
+
+	// Encrypt encrypts and authenticates the supplied data using the AES
+	// key with the specified CKA_ID value with CKM_AES_GCM, using the
+	// supplied nonce and additional data and a 128-bit tag.
+	Encrypt(id, nonce, aad, data []byte) ([]byte, error)
+
+	// Decrypt decrypts and authenticates the supplied data using the AES
+	// key with the specified CKA_ID value with CKM_AES_GCM, using the
+	// supplied nonce and additional data and a 128-bit tag.
+	Decrypt(id, nonce, aad, data []byte) ([]byte, error)
+
+	// Close closes this session.
+	Close() error
+}
+
+// Module corresponds to a PKCS#11 module.
+type Module interface {
+	// OpenSession opens a read-write session with the token with the
+	// specified serial number (CKA_SERIAL_NUMBER from CK_TOKEN_INFO).
+	OpenSession(serial string) (Session, error)
+}
+
+var (
+	moduleMu sync.RWMutex
+	module   Module
+)
+
+// SetModule sets the PKCS#11 module that will be used by this platform to access
+// tokens.
+func SetModule(m Module) {
+	moduleMu.Lock()
+	module = m
+	moduleMu.Unlock()
+}
+
+func openSession(serial string) (Session, error) {
+	moduleMu.RLock()
+	m := module
+	moduleMu.RUnlock()
+
+	if m == nil {
+		return nil, ErrNoModule
+	}
+	return m.OpenSession(serial)
+}
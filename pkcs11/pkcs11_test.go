@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/pkcs11"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
+
+func Test(t *testing.T) { TestingT(t) }
+
+// mockToken is an in-memory PKCS#11 token.
+type mockToken struct {
+	pin     string
+	locked  bool
+	keys    map[string][]byte
+	removed bool
+}
+
+func newMockToken(pin string) *mockToken {
+	return &mockToken{pin: pin, keys: make(map[string][]byte)}
+}
+
+type mockModule struct {
+	tokens map[string]*mockToken
+}
+
+func (m *mockModule) OpenSession(serial string) (Session, error) {
+	token, exists := m.tokens[serial]
+	if !exists || token.removed {
+		return nil, ErrTokenNotPresent
+	}
+	return &mockSession{token: token}, nil
+}
+
+type mockSession struct {
+	token    *mockToken
+	loggedIn bool
+	closed   bool
+}
+
+func (s *mockSession) Login(pin string) error {
+	switch {
+	case s.closed:
+		return errors.New("session closed")
+	case s.token.locked:
+		return ErrPINLocked
+	case pin != s.token.pin:
+		return ErrPINIncorrect
+	}
+	s.loggedIn = true
+	return nil
+}
+
+func (s *mockSession) Logout() error {
+	if !s.loggedIn {
+		return errors.New("not logged in")
+	}
+	s.loggedIn = false
+	return nil
+}
+
+func (s *mockSession) SetPIN(oldPIN, newPIN string) error {
+	switch {
+	case !s.loggedIn:
+		return errors.New("not logged in")
+	case oldPIN != s.token.pin:
+		return ErrPINIncorrect
+	}
+	s.token.pin = newPIN
+	return nil
+}
+
+func (s *mockSession) GenerateKey(id []byte) error {
+	if !s.loggedIn {
+		return errors.New("not logged in")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	s.token.keys[string(id)] = key
+	return nil
+}
+
+func (s *mockSession) aead(id []byte) (cipher.AEAD, error) {
+	if !s.loggedIn {
+		return nil, errors.New("not logged in")
+	}
+	key, exists := s.token.keys[string(id)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func (s *mockSession) Encrypt(id, nonce, aad, data []byte) ([]byte, error) {
+	aead, err := s.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, data, aad), nil
+}
+
+func (s *mockSession) Decrypt(id, nonce, aad, data []byte) ([]byte, error) {
+	aead, err := s.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, data, aad)
+}
+
+func (s *mockSession) Close() error {
+	if s.loggedIn {
+		return errors.New("still logged in")
+	}
+	s.closed = true
+	return nil
+}
+
+type pkcs11TestBase struct {
+	token *mockToken
+}
+
+func (b *pkcs11TestBase) SetUpTest(c *C) {
+	b.token = newMockToken("1234")
+	SetModule(&mockModule{tokens: map[string]*mockToken{"0123456789abcdef": b.token}})
+}
+
+func (b *pkcs11TestBase) TearDownTest(c *C) {
+	SetModule(nil)
+}
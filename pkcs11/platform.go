@@ -0,0 +1,175 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/snapcore/secboot"
+)
+
+type platformKeyDataHandler struct{}
+
+func decodeKeyData(data *secboot.PlatformKeyData) (*keyData, error) {
+	var kd *keyData
+	if err := json.Unmarshal(data.EncodedHandle, &kd); err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	}
+	if kd == nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no handle"),
+		}
+	}
+	if kd.Version != 1 {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("invalid version %d", kd.Version),
+		}
+	}
+	return kd, nil
+}
+
+// processSessionError converts errors returned from the Module or Session
+// to the appropriate PlatformHandlerError.
+func processSessionError(err error) error {
+	switch {
+	case errors.Is(err, ErrPINIncorrect):
+		return &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidAuthKey,
+			Err:  err,
+		}
+	case errors.Is(err, ErrPINLocked), errors.Is(err, ErrTokenNotPresent), errors.Is(err, ErrNoModule):
+		return &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorUnavailable,
+			Err:  err,
+		}
+	case errors.Is(err, ErrKeyNotFound):
+		return &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err,
+		}
+	default:
+		return err
+	}
+}
+
+func (*platformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	return nil, &secboot.PlatformHandlerError{
+		Type: secboot.PlatformHandlerErrorInvalidData,
+		Err:  errors.New("keys protected by a PKCS#11 token require a passphrase"),
+	}
+}
+
+func (*platformKeyDataHandler) RecoverKeysWithAuthKey(data *secboot.PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
+	kd, err := decodeKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := additionalData{
+		Version:    kd.Version,
+		Generation: data.Generation,
+		KDFAlg:     secboot.HashAlg(data.KDFAlg),
+		AuthMode:   data.AuthMode,
+	}.bytes()
+	if err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot serialize AAD: %w", err),
+		}
+	}
+
+	session, err := openSession(kd.TokenSerial)
+	if err != nil {
+		return nil, processSessionError(fmt.Errorf("cannot open session: %w", err))
+	}
+	defer session.Close()
+
+	if err := session.Login(string(key)); err != nil {
+		return nil, processSessionError(fmt.Errorf("cannot log in to token: %w", err))
+	}
+	defer session.Logout()
+
+	payload, err := session.Decrypt(kd.KeyID, kd.Nonce, aad, encryptedPayload)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, processSessionError(fmt.Errorf("cannot open payload: %w", err))
+		}
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("cannot open payload: %w", err),
+		}
+	}
+
+	return payload, nil
+}
+
+func (*platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, old, new []byte) ([]byte, error) {
+	kd, err := decodeKeyData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if isZeroKey(new) {
+		return nil, errors.New("cannot disable passphrase authentication")
+	}
+
+	session, err := openSession(kd.TokenSerial)
+	if err != nil {
+		return nil, processSessionError(fmt.Errorf("cannot open session: %w", err))
+	}
+	defer session.Close()
+
+	if isZeroKey(old) {
+		// The key is being created by NewProtectedKey with the token's
+		// current PIN, which isn't changed. Just check that it is
+		// correct.
+		if err := session.Login(string(new)); err != nil {
+			return nil, processSessionError(fmt.Errorf("cannot log in to token: %w", err))
+		}
+		session.Logout()
+		return data.EncodedHandle, nil
+	}
+
+	oldPIN := string(old)
+	newPIN := string(new)
+
+	if err := session.Login(oldPIN); err != nil {
+		return nil, processSessionError(fmt.Errorf("cannot log in to token: %w", err))
+	}
+	defer session.Logout()
+
+	if err := session.SetPIN(oldPIN, newPIN); err != nil {
+		return nil, processSessionError(fmt.Errorf("cannot change PIN: %w", err))
+	}
+
+	// The handle doesn't change.
+	return data.EncodedHandle, nil
+}
+
+func init() {
+	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
+}
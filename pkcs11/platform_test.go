@@ -0,0 +1,213 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pkcs11_test
+
+import (
+	"crypto"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/pkcs11"
+)
+
+type platformSuite struct {
+	pkcs11TestBase
+}
+
+var _ = Suite(&platformSuite{})
+
+func (s *platformSuite) newKeyData(c *C, generation int) (*secboot.PlatformKeyData, []byte, []byte) {
+	authKey := []byte("1234")
+	s.token.pin = string(authKey)
+
+	session, err := (&mockModule{tokens: map[string]*mockToken{"serial": s.token}}).OpenSession("serial")
+	c.Assert(err, IsNil)
+	c.Assert(session.Login(s.token.pin), IsNil)
+	defer session.Logout()
+
+	kd := &KeyData{
+		Version:     1,
+		TokenSerial: "0123456789abcdef",
+		KeyID:       []byte{1, 2, 3, 4},
+		Nonce:       testutil.DecodeHexString(c, "078535cc101b9d12d9b8f40e"),
+	}
+	c.Assert(session.GenerateKey(kd.KeyID), IsNil)
+
+	aad := AdditionalData{
+		Version:    1,
+		Generation: generation,
+		KDFAlg:     secboot.HashAlg(crypto.SHA256),
+		AuthMode:   secboot.AuthModePassphrase,
+	}
+	aadBytes, err := MarshalAdditionalData(aad)
+	c.Assert(err, IsNil)
+
+	ciphertext, err := session.Encrypt(kd.KeyID, kd.Nonce, aadBytes, []byte("payload"))
+	c.Assert(err, IsNil)
+
+	handle, err := json.Marshal(kd)
+	c.Assert(err, IsNil)
+
+	return &secboot.PlatformKeyData{
+		Generation:    generation,
+		EncodedHandle: handle,
+		KDFAlg:        crypto.SHA256,
+		AuthMode:      secboot.AuthModePassphrase,
+	}, ciphertext, authKey
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKey(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	payload, err := platform.RecoverKeysWithAuthKey(data, ciphertext, authKey)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("payload"))
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyWrongGeneration(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+	data.Generation = 1
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, authKey)
+	c.Check(err, ErrorMatches, `cannot open payload: cipher: message authentication failed`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyWrongAuthKey(c *C) {
+	data, ciphertext, _ := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, make([]byte, 32))
+	c.Check(err, ErrorMatches, `cannot log in to token: the PIN is incorrect`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidAuthKey)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyPINLocked(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+	s.token.locked = true
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, authKey)
+	c.Check(err, ErrorMatches, `cannot log in to token: the PIN is locked`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyTokenNotPresent(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+	s.token.removed = true
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, authKey)
+	c.Check(err, ErrorMatches, `cannot open session: the token is not present`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorUnavailable)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyKeyNotFound(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+	s.token.keys = make(map[string][]byte)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(data, ciphertext, authKey)
+	c.Check(err, ErrorMatches, `cannot open payload: the key was not found on the token`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeysWithAuthKeyInvalidHandle(c *C) {
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeysWithAuthKey(&secboot.PlatformKeyData{EncodedHandle: []byte(`{"version":2}`)}, nil, nil)
+	c.Check(err, ErrorMatches, `invalid version 2`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidData)
+}
+
+func (s *platformSuite) TestRecoverKeys(c *C) {
+	data, ciphertext, _ := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.RecoverKeys(data, ciphertext)
+	c.Check(err, ErrorMatches, `keys protected by a PKCS#11 token require a passphrase`)
+}
+
+func (s *platformSuite) TestChangeAuthKey(c *C) {
+	data, ciphertext, authKey := s.newKeyData(c, 2)
+	newAuthKey := []byte("5678")
+
+	var platform PlatformKeyDataHandler
+	handle, err := platform.ChangeAuthKey(data, authKey, newAuthKey)
+	c.Check(err, IsNil)
+	c.Check(handle, DeepEquals, data.EncodedHandle)
+	c.Check(s.token.pin, Equals, "5678")
+
+	payload, err := platform.RecoverKeysWithAuthKey(data, ciphertext, newAuthKey)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("payload"))
+}
+
+func (s *platformSuite) TestChangeAuthKeyInitial(c *C) {
+	data, _, authKey := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	handle, err := platform.ChangeAuthKey(data, nil, authKey)
+	c.Check(err, IsNil)
+	c.Check(handle, DeepEquals, data.EncodedHandle)
+	c.Check(s.token.pin, Equals, "1234")
+}
+
+func (s *platformSuite) TestChangeAuthKeyInitialWrongPIN(c *C) {
+	data, _, _ := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.ChangeAuthKey(data, nil, []byte("5678"))
+	c.Check(err, ErrorMatches, `cannot log in to token: the PIN is incorrect`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidAuthKey)
+}
+
+func (s *platformSuite) TestChangeAuthKeyWrongAuthKey(c *C) {
+	data, _, authKey := s.newKeyData(c, 2)
+
+	var platform PlatformKeyDataHandler
+	_, err := platform.ChangeAuthKey(data, authKey, make([]byte, len(authKey)))
+	c.Check(err, ErrorMatches, `cannot disable passphrase authentication`)
+
+	_, err = platform.ChangeAuthKey(data, []byte("0000"), []byte("5678"))
+	c.Check(err, ErrorMatches, `cannot log in to token: the PIN is incorrect`)
+
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformHandlerError{})
+	c.Check(err.(*secboot.PlatformHandlerError).Type, Equals, secboot.PlatformHandlerErrorInvalidAuthKey)
+	c.Check(s.token.pin, Equals, "1234")
+}
@@ -0,0 +1,43 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package plainkey_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/snapcore/secboot/plainkey"
+)
+
+// The following functions are entry points for go's native fuzzing support,
+// and can be run with "go test -run=- -fuzz=<name>". Without -fuzz, they are
+// run as tests with the seed inputs.
+
+func FuzzReadProtectorKey(f *testing.F) {
+	w := new(bytes.Buffer)
+	if err := WriteProtectorKey(w, "run", make([]byte, 32)); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(w.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadProtectorKey(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,152 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plainkey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	protectorKeyFileVersion = 1
+	protectorKeyFileTagSize = 32
+)
+
+var (
+	protectorKeyFileMagic = []byte("SBPK")
+
+	// ErrInvalidProtectorKeyFile is returned from ReadProtectorKey if the
+	// supplied data is not a valid protector key file, or if it has been
+	// corrupted.
+	ErrInvalidProtectorKeyFile = errors.New("invalid protector key file")
+)
+
+func deriveProtectorKeyFileTagKey(key []byte) []byte {
+	r := hkdf.New(crypto.SHA256.New, key, nil, []byte("PROTECTOR-KEY-FILE"))
+
+	tagKey := make([]byte, 32)
+	if _, err := io.ReadFull(r, tagKey); err != nil {
+		panic(fmt.Sprintf("cannot derive key: %v", err))
+	}
+
+	return tagKey
+}
+
+func computeProtectorKeyFileTag(key, data []byte) []byte {
+	h := hmac.New(crypto.SHA256.New, deriveProtectorKeyFileTagKey(key))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// WriteProtectorKey serializes the supplied protector key and its role to w
+// using a small versioned file format, so that it can be stored at rest and
+// loaded later on with ReadProtectorKey before being passed to
+// SetProtectorKeys. The file contains a magic value, a version, the role and
+// the key, followed by a HMAC that covers all of these and is keyed with a
+// value derived from the key, so that corruption of any part of the file is
+// detected when it is read.
+func WriteProtectorKey(w io.Writer, role string, key []byte) error {
+	if len(role) > 255 {
+		return errors.New("role is too long")
+	}
+	if len(key) == 0 || len(key) > 0xffff {
+		return errors.New("invalid key length")
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddBytes(protectorKeyFileMagic)
+	b.AddUint8(protectorKeyFileVersion)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(role))
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(key)
+	})
+	data, err := b.Bytes()
+	if err != nil {
+		return fmt.Errorf("cannot serialize key: %w", err)
+	}
+
+	data = append(data, computeProtectorKeyFileTag(key, data)...)
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("cannot write key: %w", err)
+	}
+
+	return nil
+}
+
+// ReadProtectorKey reads a protector key and its role that were written by
+// WriteProtectorKey from r. If the data is not a valid protector key file or
+// its integrity check fails, an error that wraps ErrInvalidProtectorKeyFile
+// is returned.
+func ReadProtectorKey(r io.Reader) (role string, key []byte, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read key: %w", err)
+	}
+
+	s := cryptobyte.String(data)
+
+	var magic []byte
+	if !s.ReadBytes(&magic, len(protectorKeyFileMagic)) || !bytes.Equal(magic, protectorKeyFileMagic) {
+		return "", nil, fmt.Errorf("%w: invalid magic", ErrInvalidProtectorKeyFile)
+	}
+
+	var version uint8
+	if !s.ReadUint8(&version) {
+		return "", nil, fmt.Errorf("%w: cannot read version", ErrInvalidProtectorKeyFile)
+	}
+	if version != protectorKeyFileVersion {
+		return "", nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProtectorKeyFile, version)
+	}
+
+	var roleBytes cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&roleBytes) {
+		return "", nil, fmt.Errorf("%w: cannot read role", ErrInvalidProtectorKeyFile)
+	}
+
+	var keyBytes cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&keyBytes) || len(keyBytes) == 0 {
+		return "", nil, fmt.Errorf("%w: cannot read key", ErrInvalidProtectorKeyFile)
+	}
+
+	signed := data[:len(data)-len(s)]
+
+	var tag []byte
+	if !s.ReadBytes(&tag, protectorKeyFileTagSize) {
+		return "", nil, fmt.Errorf("%w: cannot read integrity tag", ErrInvalidProtectorKeyFile)
+	}
+	if !s.Empty() {
+		return "", nil, fmt.Errorf("%w: trailing bytes", ErrInvalidProtectorKeyFile)
+	}
+
+	if !hmac.Equal(tag, computeProtectorKeyFileTag(keyBytes, signed)) {
+		return "", nil, fmt.Errorf("%w: integrity check failed", ErrInvalidProtectorKeyFile)
+	}
+
+	return string(roleBytes), []byte(keyBytes), nil
+}
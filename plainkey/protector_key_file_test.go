@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plainkey_test
+
+import (
+	"bytes"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/plainkey"
+)
+
+type protectorKeyFileSuite struct{}
+
+var _ = Suite(&protectorKeyFileSuite{})
+
+func (s *protectorKeyFileSuite) TestWriteAndRead(c *C) {
+	key := testutil.DecodeHexString(c, "8ab5fe5b4d2f4a3a9c1d2a0272d4b8e4e1f3c0ab52a5d7e56d9e1d24c17b8ea1")
+
+	w := new(bytes.Buffer)
+	c.Check(WriteProtectorKey(w, "run", key), IsNil)
+	c.Check(w.Bytes()[:5], DeepEquals, []byte("SBPK\x01"))
+
+	role, recovered, err := ReadProtectorKey(w)
+	c.Check(err, IsNil)
+	c.Check(role, Equals, "run")
+	c.Check(recovered, DeepEquals, key)
+}
+
+func (s *protectorKeyFileSuite) TestWriteAndReadEmptyRole(c *C) {
+	key := testutil.DecodeHexString(c, "a2c1b9d0e3f4")
+
+	w := new(bytes.Buffer)
+	c.Check(WriteProtectorKey(w, "", key), IsNil)
+
+	role, recovered, err := ReadProtectorKey(w)
+	c.Check(err, IsNil)
+	c.Check(role, Equals, "")
+	c.Check(recovered, DeepEquals, key)
+}
+
+func (s *protectorKeyFileSuite) writeKey(c *C) []byte {
+	w := new(bytes.Buffer)
+	c.Check(WriteProtectorKey(w, "run", testutil.DecodeHexString(c, "8ab5fe5b4d2f4a3a9c1d2a0272d4b8e4")), IsNil)
+	return w.Bytes()
+}
+
+func (s *protectorKeyFileSuite) testReadError(c *C, data []byte, expected string) {
+	_, _, err := ReadProtectorKey(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, expected)
+	c.Check(errors.Is(err, ErrInvalidProtectorKeyFile), Equals, true)
+}
+
+func (s *protectorKeyFileSuite) TestReadCorruptedKey(c *C) {
+	data := s.writeKey(c)
+	data[12] ^= 0x01
+	s.testReadError(c, data, `invalid protector key file: integrity check failed`)
+}
+
+func (s *protectorKeyFileSuite) TestReadCorruptedRole(c *C) {
+	data := s.writeKey(c)
+	data[6] = 'R'
+	s.testReadError(c, data, `invalid protector key file: integrity check failed`)
+}
+
+func (s *protectorKeyFileSuite) TestReadCorruptedTag(c *C) {
+	data := s.writeKey(c)
+	data[len(data)-1] ^= 0x01
+	s.testReadError(c, data, `invalid protector key file: integrity check failed`)
+}
+
+func (s *protectorKeyFileSuite) TestReadInvalidMagic(c *C) {
+	data := s.writeKey(c)
+	data[0] = 'X'
+	s.testReadError(c, data, `invalid protector key file: invalid magic`)
+}
+
+func (s *protectorKeyFileSuite) TestReadRawKey(c *C) {
+	// A raw key blob, as stored before this format existed.
+	s.testReadError(c, testutil.DecodeHexString(c, "8ab5fe5b4d2f4a3a9c1d2a0272d4b8e4"), `invalid protector key file: invalid magic`)
+}
+
+func (s *protectorKeyFileSuite) TestReadUnsupportedVersion(c *C) {
+	data := s.writeKey(c)
+	data[4] = 2
+	s.testReadError(c, data, `invalid protector key file: unsupported version 2`)
+}
+
+func (s *protectorKeyFileSuite) TestReadTruncated(c *C) {
+	data := s.writeKey(c)
+	s.testReadError(c, data[:len(data)-1], `invalid protector key file: cannot read integrity tag`)
+}
+
+func (s *protectorKeyFileSuite) TestReadTrailingBytes(c *C) {
+	data := append(s.writeKey(c), 0)
+	s.testReadError(c, data, `invalid protector key file: trailing bytes`)
+}
+
+func (s *protectorKeyFileSuite) TestWriteEmptyKey(c *C) {
+	c.Check(WriteProtectorKey(new(bytes.Buffer), "run", nil), ErrorMatches, `invalid key length`)
+}
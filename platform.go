@@ -19,7 +19,10 @@
 
 package secboot
 
-import "crypto"
+import (
+	"context"
+	"crypto"
+)
 
 // PlatformHandlerErrorType indicates the type of error that
 // PlatformHandlerError is associated with.
@@ -94,13 +97,44 @@ type PlatformKeyDataHandler interface {
 
 	// ChangeAuthKey is called to notify the platform implementation that the
 	// passphrase is being changed. The old and new parameters are passphrase derived
-	// keys. Either value can be nil if passphrase authentication is being enabled (
-	// where old will be nil) or disabled (where new will be nil).
+	// keys. If passphrase authentication is being enabled or disabled, the old or new
+	// value respectively will be a zero-filled key. The AuthMode field of data
+	// indicates the authentication mode after the change.
 	//
 	// On success, it should return an updated handle.
 	ChangeAuthKey(data *PlatformKeyData, old, new []byte) ([]byte, error)
 }
 
+// PlatformKeyDataHandlerWithPolicyBranch can optionally be implemented by a
+// PlatformKeyDataHandler that is able to report which branch of the
+// authorization policy of a key is satisfied by the current state of the
+// platform. This is recorded in the UnlockReason for a volume that is
+// unlocked with the key.
+type PlatformKeyDataHandlerWithPolicyBranch interface {
+	PlatformKeyDataHandler
+
+	// PolicyBranch returns a description of the branch of the authorization
+	// policy of the supplied key data that is satisfied by the current state
+	// of the platform's secure device.
+	PolicyBranch(data *PlatformKeyData) (string, error)
+}
+
+// PlatformKeyDataHandlerWithContext is implemented by platform handlers that
+// support cancelling the recovery of keys, or imposing a deadline on it, with
+// a context. This is used by KeyData.RecoverKeysContext and
+// KeyData.RecoverKeysWithPassphraseContext. Handlers that don't implement it
+// are called without the context.
+type PlatformKeyDataHandlerWithContext interface {
+	PlatformKeyDataHandler
+
+	// RecoverKeysContext is a variant of RecoverKeys that accepts a context.
+	RecoverKeysContext(ctx context.Context, data *PlatformKeyData, encryptedPayload []byte) ([]byte, error)
+
+	// RecoverKeysWithAuthKeyContext is a variant of RecoverKeysWithAuthKey
+	// that accepts a context.
+	RecoverKeysWithAuthKeyContext(ctx context.Context, data *PlatformKeyData, encryptedPayload, key []byte) ([]byte, error)
+}
+
 var handlers = make(map[string]PlatformKeyDataHandler)
 
 // RegisterPlatformKeyDataHandler registers a handler for the specified platform name.
@@ -0,0 +1,220 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import "fmt"
+
+// ProtectionLevel is a coarse classification of how well a protector
+// protects the key for an encrypted volume.
+type ProtectionLevel int
+
+const (
+	// ProtectionLevelNone indicates that there is no protection, which is
+	// the case for a volume without any protectors.
+	ProtectionLevelNone ProtectionLevel = iota
+
+	// ProtectionLevelLow indicates that a key can be recovered without
+	// any user interaction and with only a weak binding to the state of
+	// the platform, or that the protection could not be assessed.
+	ProtectionLevelLow
+
+	// ProtectionLevelMedium indicates that a key is bound to the integrity
+	// of the boot chain, or is protected with a strong passphrase.
+	ProtectionLevelMedium
+
+	// ProtectionLevelHigh indicates that a key is strongly bound to the
+	// integrity of the boot chain and system configuration, or requires
+	// knowledge of a high entropy secret such as a recovery key.
+	ProtectionLevelHigh
+)
+
+func (l ProtectionLevel) String() string {
+	switch l {
+	case ProtectionLevelNone:
+		return "none"
+	case ProtectionLevelLow:
+		return "low"
+	case ProtectionLevelMedium:
+		return "medium"
+	case ProtectionLevelHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("ProtectionLevel(%d)", int(l))
+	}
+}
+
+// PassphraseEntropyClass is a coarse classification of the estimated entropy
+// of a passphrase.
+type PassphraseEntropyClass int
+
+const (
+	// PassphraseEntropyUnknown indicates that the entropy of a passphrase
+	// is not known, which is normally the case once it has been enrolled.
+	PassphraseEntropyUnknown PassphraseEntropyClass = iota
+
+	// PassphraseEntropyWeak indicates a passphrase with an estimated
+	// entropy of less than 40 bits.
+	PassphraseEntropyWeak
+
+	// PassphraseEntropyModerate indicates a passphrase with an estimated
+	// entropy of at least 40 bits and less than 64 bits.
+	PassphraseEntropyModerate
+
+	// PassphraseEntropyStrong indicates a passphrase with an estimated
+	// entropy of at least 64 bits.
+	PassphraseEntropyStrong
+)
+
+func (c PassphraseEntropyClass) String() string {
+	switch c {
+	case PassphraseEntropyUnknown:
+		return "unknown"
+	case PassphraseEntropyWeak:
+		return "weak"
+	case PassphraseEntropyModerate:
+		return "moderate"
+	case PassphraseEntropyStrong:
+		return "strong"
+	default:
+		return fmt.Sprintf("PassphraseEntropyClass(%d)", int(c))
+	}
+}
+
+// ClassifyPassphraseEntropy returns the entropy class of the supplied
+// passphrase, based on the estimate returned from EstimatePassphraseEntropy.
+func ClassifyPassphraseEntropy(passphrase string) PassphraseEntropyClass {
+	bits := EstimatePassphraseEntropy(passphrase)
+	switch {
+	case bits < 40:
+		return PassphraseEntropyWeak
+	case bits < 64:
+		return PassphraseEntropyModerate
+	default:
+		return PassphraseEntropyStrong
+	}
+}
+
+// ProtectorKind describes the type of a protector.
+type ProtectorKind string
+
+const (
+	// ProtectorKindPlatform is a key protected by a platform's secure
+	// device without any user authentication.
+	ProtectorKindPlatform ProtectorKind = "platform"
+
+	// ProtectorKindPlatformWithPassphrase is a key protected by a
+	// platform's secure device and a passphrase.
+	ProtectorKindPlatformWithPassphrase ProtectorKind = "platform-with-passphrase"
+
+	// ProtectorKindRecoveryKey is a recovery key, which is not protected
+	// by a platform's secure device.
+	ProtectorKindRecoveryKey ProtectorKind = "recovery-key"
+)
+
+// PlatformKeyDataProtectionAssessor may optionally be implemented by a
+// PlatformKeyDataHandler in order to classify the protection provided by the
+// platform for a key, which is used by AssessKeyDataProtection. This should
+// not require access to the platform's secure device.
+type PlatformKeyDataProtectionAssessor interface {
+	ProtectionLevel(data *PlatformKeyData) (ProtectionLevel, error)
+}
+
+// ProtectorStrength describes the protection provided by a single protector,
+// as returned from AssessKeyDataProtection or RecoveryKeyProtection.
+type ProtectorStrength struct {
+	Kind         ProtectorKind
+	PlatformName string // The name of the platform, if there is one
+	Role         string // The role of the key data, if there is one
+
+	// PlatformLevel is the level of protection provided by the platform.
+	// If the platform doesn't support assessing the protection it provides,
+	// PlatformAssessed will be false and this will be ProtectionLevelLow.
+	PlatformLevel    ProtectionLevel
+	PlatformAssessed bool
+
+	// PassphraseEntropy is the entropy class of the passphrase for
+	// keys with a passphrase.
+	PassphraseEntropy PassphraseEntropyClass
+
+	// Level is the overall level of protection.
+	Level ProtectionLevel
+}
+
+// AssessKeyDataProtection classifies the protection provided by the supplied
+// key data. The platform's contribution is determined by its handler if it
+// implements PlatformKeyDataProtectionAssessor. If the key data has a
+// passphrase, the caller can supply its entropy class if it is known (eg, when
+// it is being enrolled), else PassphraseEntropyUnknown should be supplied. A
+// passphrase with an entropy class of at least PassphraseEntropyModerate
+// raises the overall level by one.
+func AssessKeyDataProtection(data *KeyData, passphraseEntropy PassphraseEntropyClass) (*ProtectorStrength, error) {
+	out := &ProtectorStrength{
+		Kind:          ProtectorKindPlatform,
+		PlatformName:  data.PlatformName(),
+		Role:          data.Role(),
+		PlatformLevel: ProtectionLevelLow}
+
+	if assessor, ok := handlers[data.PlatformName()].(PlatformKeyDataProtectionAssessor); ok {
+		level, err := assessor.ProtectionLevel(data.platformKeyData())
+		if err != nil {
+			return nil, processPlatformHandlerError(err)
+		}
+		out.PlatformLevel = level
+		out.PlatformAssessed = true
+	}
+	out.Level = out.PlatformLevel
+
+	if data.AuthMode() == AuthModePassphrase {
+		out.Kind = ProtectorKindPlatformWithPassphrase
+		out.PassphraseEntropy = passphraseEntropy
+		if passphraseEntropy >= PassphraseEntropyModerate && out.Level < ProtectionLevelHigh {
+			out.Level += 1
+		}
+	}
+
+	return out, nil
+}
+
+// RecoveryKeyProtection returns the protection provided by a recovery key.
+// Recovery keys are randomly generated 128-bit keys, so they always provide
+// ProtectionLevelHigh.
+func RecoveryKeyProtection() *ProtectorStrength {
+	return &ProtectorStrength{
+		Kind:  ProtectorKindRecoveryKey,
+		Level: ProtectionLevelHigh}
+}
+
+// VolumeProtectionLevel aggregates the levels of the protectors enrolled for
+// a single volume. As any one of them can be used to unlock the volume, the
+// volume is only as well protected as its weakest protector. If there are no
+// protectors, ProtectionLevelNone is returned.
+func VolumeProtectionLevel(protectors ...*ProtectorStrength) ProtectionLevel {
+	if len(protectors) == 0 {
+		return ProtectionLevelNone
+	}
+
+	level := ProtectionLevelHigh
+	for _, p := range protectors {
+		if p.Level < level {
+			level = p.Level
+		}
+	}
+	return level
+}
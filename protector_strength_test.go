@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockAssessingPlatformKeyDataHandler struct {
+	*mockPlatformKeyDataHandler
+	level ProtectionLevel
+	err   error
+}
+
+func (h *mockAssessingPlatformKeyDataHandler) ProtectionLevel(data *PlatformKeyData) (ProtectionLevel, error) {
+	if h.err != nil {
+		return ProtectionLevelNone, h.err
+	}
+	return h.level, nil
+}
+
+type protectorStrengthSuite struct {
+	keyDataTestBase
+	assessingHandler *mockAssessingPlatformKeyDataHandler
+}
+
+func (s *protectorStrengthSuite) SetUpSuite(c *C) {
+	s.keyDataTestBase.SetUpSuite(c)
+	s.assessingHandler = &mockAssessingPlatformKeyDataHandler{mockPlatformKeyDataHandler: s.handler}
+	RegisterPlatformKeyDataHandler("mock-assessing", s.assessingHandler)
+}
+
+func (s *protectorStrengthSuite) SetUpTest(c *C) {
+	s.keyDataTestBase.SetUpTest(c)
+	s.assessingHandler.level = ProtectionLevelNone
+	s.assessingHandler.err = nil
+}
+
+func (s *protectorStrengthSuite) TearDownSuite(c *C) {
+	RegisterPlatformKeyDataHandler("mock-assessing", nil)
+	s.keyDataTestBase.TearDownSuite(c)
+}
+
+var _ = Suite(&protectorStrengthSuite{})
+
+func (s *protectorStrengthSuite) newKeyData(c *C, platformName string) *KeyData {
+	params, _ := s.mockProtectKeys(c, s.newPrimaryKey(c, 32), crypto.SHA256, crypto.SHA256)
+	params.PlatformName = platformName
+	params.Role = "run"
+	kd, err := NewKeyData(params)
+	c.Assert(err, IsNil)
+	return kd
+}
+
+func (s *protectorStrengthSuite) newKeyDataWithPassphrase(c *C, platformName string) *KeyData {
+	s.handler.PassphraseSupport = true
+	params, _ := s.mockProtectKeysWithPassphrase(c, s.newPrimaryKey(c, 32), nil, 32, crypto.SHA256, crypto.SHA256)
+	params.PlatformName = platformName
+	kd, err := NewKeyDataWithPassphrase(params, "passphrase")
+	c.Assert(err, IsNil)
+	return kd
+}
+
+func (s *protectorStrengthSuite) TestAssessKeyDataProtection(c *C) {
+	s.assessingHandler.level = ProtectionLevelMedium
+
+	strength, err := AssessKeyDataProtection(s.newKeyData(c, "mock-assessing"), PassphraseEntropyUnknown)
+	c.Assert(err, IsNil)
+	c.Check(strength, DeepEquals, &ProtectorStrength{
+		Kind:             ProtectorKindPlatform,
+		PlatformName:     "mock-assessing",
+		Role:             "run",
+		PlatformLevel:    ProtectionLevelMedium,
+		PlatformAssessed: true,
+		Level:            ProtectionLevelMedium})
+}
+
+func (s *protectorStrengthSuite) TestAssessKeyDataProtectionNotSupported(c *C) {
+	strength, err := AssessKeyDataProtection(s.newKeyData(c, s.mockPlatformName), PassphraseEntropyUnknown)
+	c.Assert(err, IsNil)
+	c.Check(strength, DeepEquals, &ProtectorStrength{
+		Kind:          ProtectorKindPlatform,
+		PlatformName:  s.mockPlatformName,
+		Role:          "run",
+		PlatformLevel: ProtectionLevelLow,
+		Level:         ProtectionLevelLow})
+}
+
+func (s *protectorStrengthSuite) TestAssessKeyDataProtectionWithPassphrase(c *C) {
+	s.assessingHandler.level = ProtectionLevelMedium
+	kd := s.newKeyDataWithPassphrase(c, "mock-assessing")
+
+	for _, t := range []struct {
+		entropy  PassphraseEntropyClass
+		expected ProtectionLevel
+	}{
+		{entropy: PassphraseEntropyUnknown, expected: ProtectionLevelMedium},
+		{entropy: PassphraseEntropyWeak, expected: ProtectionLevelMedium},
+		{entropy: PassphraseEntropyModerate, expected: ProtectionLevelHigh},
+		{entropy: PassphraseEntropyStrong, expected: ProtectionLevelHigh},
+	} {
+		strength, err := AssessKeyDataProtection(kd, t.entropy)
+		c.Assert(err, IsNil)
+		c.Check(strength.Kind, Equals, ProtectorKindPlatformWithPassphrase)
+		c.Check(strength.PassphraseEntropy, Equals, t.entropy)
+		c.Check(strength.PlatformLevel, Equals, ProtectionLevelMedium)
+		c.Check(strength.Level, Equals, t.expected, Commentf("%v", t.entropy))
+	}
+}
+
+func (s *protectorStrengthSuite) TestAssessKeyDataProtectionWithPassphraseIsCapped(c *C) {
+	s.assessingHandler.level = ProtectionLevelHigh
+
+	strength, err := AssessKeyDataProtection(s.newKeyDataWithPassphrase(c, "mock-assessing"), PassphraseEntropyStrong)
+	c.Assert(err, IsNil)
+	c.Check(strength.Level, Equals, ProtectionLevelHigh)
+}
+
+func (s *protectorStrengthSuite) TestAssessKeyDataProtectionInvalidData(c *C) {
+	s.assessingHandler.err = &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("some error")}
+
+	_, err := AssessKeyDataProtection(s.newKeyData(c, "mock-assessing"), PassphraseEntropyUnknown)
+	c.Check(err, ErrorMatches, `invalid key data: some error`)
+	var e *InvalidKeyDataError
+	c.Check(errors.As(err, &e), testutil.IsTrue)
+}
+
+func (s *protectorStrengthSuite) TestRecoveryKeyProtection(c *C) {
+	c.Check(RecoveryKeyProtection(), DeepEquals, &ProtectorStrength{
+		Kind:  ProtectorKindRecoveryKey,
+		Level: ProtectionLevelHigh})
+}
+
+func (s *protectorStrengthSuite) TestVolumeProtectionLevel(c *C) {
+	c.Check(VolumeProtectionLevel(), Equals, ProtectionLevelNone)
+	c.Check(VolumeProtectionLevel(RecoveryKeyProtection()), Equals, ProtectionLevelHigh)
+	c.Check(VolumeProtectionLevel(
+		RecoveryKeyProtection(),
+		&ProtectorStrength{Level: ProtectionLevelMedium},
+		&ProtectorStrength{Level: ProtectionLevelLow}), Equals, ProtectionLevelLow)
+}
+
+func (s *protectorStrengthSuite) TestClassifyPassphraseEntropy(c *C) {
+	c.Check(ClassifyPassphraseEntropy("1234"), Equals, PassphraseEntropyWeak)
+	c.Check(ClassifyPassphraseEntropy("correcthorse"), Equals, PassphraseEntropyModerate)
+	c.Check(ClassifyPassphraseEntropy("Tr0ub4dor&3-correct-horse-battery-staple"), Equals, PassphraseEntropyStrong)
+}
+
+func (s *protectorStrengthSuite) TestStrings(c *C) {
+	c.Check(ProtectionLevelNone.String(), Equals, "none")
+	c.Check(ProtectionLevelHigh.String(), Equals, "high")
+	c.Check(ProtectionLevel(10).String(), Equals, "ProtectionLevel(10)")
+	c.Check(PassphraseEntropyModerate.String(), Equals, "moderate")
+	c.Check(PassphraseEntropyClass(10).String(), Equals, "PassphraseEntropyClass(10)")
+}
@@ -0,0 +1,275 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/artifact"
+)
+
+const (
+	provisionedSecretKeySize = 32
+	maxSecretNameLen         = 255
+
+	keyringPurposeSecret = "secret"
+
+	provisionedSecretArtifact = "provisioned secret"
+
+	// provisionedSecretMinReaderVersion is the minimum ArtifactFormatVersion
+	// required to read secrets created by SealProvisionedSecret.
+	provisionedSecretMinReaderVersion = 1
+)
+
+// ProvisionedSecret is an additional secret, such as a network credential or
+// an update server token, that is protected by the primary key associated with
+// an encrypted container. Once the container has been unlocked, the secret can
+// be recovered and installed for use by services with
+// InstallProvisionedSecretsFromKernel, without having to maintain a separate
+// secret store.
+//
+// The secret is encrypted with AES-256-GCM, using a key derived from the
+// primary key and the role of the secret with HKDF-SHA256. The name and role
+// are authenticated as part of the ciphertext.
+type ProvisionedSecret struct {
+	Header     *ArtifactHeader `json:"secboot,omitempty"`
+	Name       string          `json:"name"`
+	Role       string          `json:"role"`
+	Nonce      []byte          `json:"nonce"`
+	Ciphertext []byte          `json:"ciphertext"`
+}
+
+// ReadProvisionedSecret reads a ProvisionedSecret that was previously
+// serialized with ProvisionedSecret.Write from the supplied reader.
+func ReadProvisionedSecret(r io.Reader) (*ProvisionedSecret, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, xerrors.Errorf("cannot decode secret: %w", err)
+	}
+	if err := artifact.CheckJSON(provisionedSecretArtifact, raw); err != nil {
+		return nil, err
+	}
+
+	var s *ProvisionedSecret
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, xerrors.Errorf("cannot decode secret: %w", err)
+	}
+	if s == nil {
+		return nil, errors.New("no secret")
+	}
+	if err := validateSecretName(s.Name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write serializes this secret to the supplied writer.
+func (s *ProvisionedSecret) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+func validateSecretName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("invalid secret name: empty")
+	case len(name) > maxSecretNameLen:
+		return fmt.Errorf("invalid secret name %q: too long", name)
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid secret name %q", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("invalid secret name %q: contains invalid character", name)
+	}
+	return nil
+}
+
+func (s *ProvisionedSecret) additionalData() []byte {
+	return []byte("SECRET:" + s.Role + ":" + s.Name)
+}
+
+func newProvisionedSecretAEAD(primaryKey PrimaryKey, role string) (cipher.AEAD, error) {
+	r := hkdf.New(crypto.SHA256.New, primaryKey, RoleDerivationLabel(role), []byte("SECRET"))
+	key := make([]byte, provisionedSecretKeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+// SealProvisionedSecret encrypts the supplied secret with a key derived from
+// the supplied primary key, which must be the primary key associated with the
+// KeyData used to unlock the encrypted container. The role must be a valid name
+// according to ValidateRoleName, and is used to separate the keys used for
+// different purposes - it doesn't have to be registered. The name identifies
+// the secret when it is installed, and must be a valid file name.
+//
+// The random source is used to generate the nonce.
+func SealProvisionedSecret(rand io.Reader, primaryKey PrimaryKey, role, name string, secret []byte) (*ProvisionedSecret, error) {
+	if len(primaryKey) == 0 {
+		return nil, errors.New("no primary key")
+	}
+	if err := ValidateRoleName(role); err != nil {
+		return nil, err
+	}
+	if err := validateSecretName(name); err != nil {
+		return nil, err
+	}
+
+	aead, err := newProvisionedSecretAEAD(primaryKey, role)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ProvisionedSecret{
+		Header: NewArtifactHeader(provisionedSecretMinReaderVersion),
+		Name:   name,
+		Role:   role,
+		Nonce:  make([]byte, aead.NonceSize())}
+	if _, err := io.ReadFull(rand, s.Nonce); err != nil {
+		return nil, xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+	s.Ciphertext = aead.Seal(nil, s.Nonce, secret, s.additionalData())
+	return s, nil
+}
+
+// Unseal recovers this secret using the supplied primary key.
+func (s *ProvisionedSecret) Unseal(primaryKey PrimaryKey) ([]byte, error) {
+	if len(primaryKey) == 0 {
+		return nil, errors.New("no primary key")
+	}
+
+	aead, err := newProvisionedSecretAEAD(primaryKey, s.Role)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	secret, err := aead.Open(nil, s.Nonce, s.Ciphertext, s.additionalData())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decrypt secret: %w", err)
+	}
+	return secret, nil
+}
+
+// SecretInstaller is used by InstallProvisionedSecretsFromKernel to make
+// recovered secrets available to services.
+type SecretInstaller interface {
+	InstallSecret(name string, secret []byte) error
+}
+
+type systemdCredentialInstaller struct {
+	dir string
+}
+
+func (i *systemdCredentialInstaller) InstallSecret(name string, secret []byte) error {
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return err
+	}
+	return osutil.AtomicWriteFile(filepath.Join(i.dir, name), secret, 0400, 0)
+}
+
+// NewSystemdCredentialInstaller returns a SecretInstaller that writes each
+// secret to a file in the specified credential store directory, which is
+// created if it doesn't exist. Services can consume the secrets as systemd
+// credentials with the LoadCredential= directive. The directory should be on
+// a tmpfs that is only accessible by root, such as /run/credstore.
+func NewSystemdCredentialInstaller(dir string) SecretInstaller {
+	return &systemdCredentialInstaller{dir: dir}
+}
+
+type keyringSecretInstaller struct {
+	config *keyringConfig
+}
+
+func (i *keyringSecretInstaller) InstallSecret(name string, secret []byte) error {
+	// The description has the form "<prefix>:secret:<name>[:<instance>]".
+	return i.config.addKey(secret, keyringPurposeSecret, name)
+}
+
+// NewKeyringSecretInstaller returns a SecretInstaller that adds each secret to
+// the user keyring as a user key with the description
+// "<prefix>:secret:<name>". If prefix is empty, the default prefix is used.
+func NewKeyringSecretInstaller(prefix string) SecretInstaller {
+	return NewKeyringSecretInstallerWithOptions(&KernelKeyringOptions{Prefix: prefix})
+}
+
+// NewKeyringSecretInstallerWithOptions is a variant of NewKeyringSecretInstaller
+// that adds each secret to the keyring specified by the supplied options. If an
+// instance is specified, it is appended to the description of each key as
+// ":<instance>".
+func NewKeyringSecretInstallerWithOptions(options *KernelKeyringOptions) SecretInstaller {
+	return &keyringSecretInstaller{config: newKeyringConfig(options)}
+}
+
+// InstallProvisionedSecretsFromKernel recovers each of the supplied secrets
+// using the primary key associated with the encrypted container at the
+// specified path, and installs them with the supplied installer. The primary key
+// is obtained from the kernel keyring with GetPrimaryKeyFromKernel, so the
+// container must have been unlocked with ActivateVolumeWithKeyData using the
+// same prefix. This stops at the first secret that cannot be recovered or
+// installed.
+func InstallProvisionedSecretsFromKernel(prefix, devicePath string, installer SecretInstaller, secrets ...*ProvisionedSecret) error {
+	return InstallProvisionedSecretsFromKernelWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, installer, secrets...)
+}
+
+// InstallProvisionedSecretsFromKernelWithOptions is a variant of
+// InstallProvisionedSecretsFromKernel that obtains the primary key from the
+// kernel keyring with GetPrimaryKeyFromKernelWithOptions.
+func InstallProvisionedSecretsFromKernelWithOptions(options *KernelKeyringOptions, devicePath string, installer SecretInstaller, secrets ...*ProvisionedSecret) error {
+	primaryKey, err := GetPrimaryKeyFromKernelWithOptions(options, devicePath, false)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain primary key: %w", err)
+	}
+
+	for _, s := range secrets {
+		if err := validateSecretName(s.Name); err != nil {
+			return err
+		}
+		secret, err := s.Unseal(primaryKey)
+		if err != nil {
+			return xerrors.Errorf("cannot unseal secret %q: %w", s.Name, err)
+		}
+		if err := installer.InstallSecret(s.Name, secret); err != nil {
+			return xerrors.Errorf("cannot install secret %q: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
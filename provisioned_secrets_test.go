@@ -0,0 +1,265 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type provisionedSecretsSuite struct{}
+
+var _ = Suite(&provisionedSecretsSuite{})
+
+func (s *provisionedSecretsSuite) primaryKey() PrimaryKey {
+	key := make(PrimaryKey, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func (s *provisionedSecretsSuite) TestSealAndUnseal(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+	c.Check(secret.Name, Equals, "wifi-psk")
+	c.Check(secret.Role, Equals, "network")
+	c.Check(secret.Nonce, HasLen, 12)
+	c.Check(secret.Ciphertext, Not(DeepEquals), []byte("foo"))
+
+	recovered, err := secret.Unseal(s.primaryKey())
+	c.Check(err, IsNil)
+	c.Check(recovered, DeepEquals, []byte("foo"))
+}
+
+func (s *provisionedSecretsSuite) TestSealDeterministic(c *C) {
+	nonce := testutil.DecodeHexString(c, "000102030405060708090a0b")
+	secret, err := SealProvisionedSecret(bytes.NewReader(nonce), s.primaryKey(), "update", "token", []byte("bar"))
+	c.Assert(err, IsNil)
+	c.Check(secret.Nonce, DeepEquals, nonce)
+
+	secret2, err := SealProvisionedSecret(bytes.NewReader(nonce), s.primaryKey(), "update", "token", []byte("bar"))
+	c.Assert(err, IsNil)
+	c.Check(secret2, DeepEquals, secret)
+}
+
+func (s *provisionedSecretsSuite) TestUnsealWrongKey(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	_, err = secret.Unseal(make(PrimaryKey, 32))
+	c.Check(err, ErrorMatches, `cannot decrypt secret: cipher: message authentication failed`)
+}
+
+func (s *provisionedSecretsSuite) TestUnsealRenamed(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	secret.Name = "other"
+	_, err = secret.Unseal(s.primaryKey())
+	c.Check(err, ErrorMatches, `cannot decrypt secret: cipher: message authentication failed`)
+}
+
+func (s *provisionedSecretsSuite) TestUnsealDifferentRole(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	secret.Role = "update"
+	_, err = secret.Unseal(s.primaryKey())
+	c.Check(err, ErrorMatches, `cannot decrypt secret: cipher: message authentication failed`)
+}
+
+func (s *provisionedSecretsSuite) TestUnsealInvalidNonce(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	secret.Nonce = secret.Nonce[1:]
+	_, err = secret.Unseal(s.primaryKey())
+	c.Check(err, ErrorMatches, `invalid nonce size`)
+}
+
+func (s *provisionedSecretsSuite) TestSealNoPrimaryKey(c *C) {
+	_, err := SealProvisionedSecret(rand.Reader, nil, "network", "wifi-psk", []byte("foo"))
+	c.Check(err, ErrorMatches, `no primary key`)
+}
+
+func (s *provisionedSecretsSuite) TestSealInvalidRole(c *C) {
+	_, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "UNLOCK", "wifi-psk", []byte("foo"))
+	c.Check(err, ErrorMatches, `invalid role "UNLOCK": .*`)
+}
+
+func (s *provisionedSecretsSuite) TestSealInvalidName(c *C) {
+	for _, t := range []struct {
+		name string
+		err  string
+	}{
+		{name: "", err: `invalid secret name: empty`},
+		{name: ".", err: `invalid secret name "."`},
+		{name: "..", err: `invalid secret name "\.\."`},
+		{name: "foo/bar", err: `invalid secret name "foo/bar": contains invalid character`},
+		{name: string(make([]byte, 256)), err: `invalid secret name .*: too long`},
+	} {
+		_, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", t.name, []byte("foo"))
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
+
+func (s *provisionedSecretsSuite) TestWriteAndRead(c *C) {
+	secret, err := SealProvisionedSecret(rand.Reader, s.primaryKey(), "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	w := new(bytes.Buffer)
+	c.Check(secret.Write(w), IsNil)
+
+	secret2, err := ReadProvisionedSecret(w)
+	c.Assert(err, IsNil)
+	c.Check(secret2, DeepEquals, secret)
+}
+
+func (s *provisionedSecretsSuite) TestReadInvalidName(c *C) {
+	_, err := ReadProvisionedSecret(bytes.NewReader([]byte(`{"name":"../foo","role":"network"}`)))
+	c.Check(err, ErrorMatches, `invalid secret name "../foo": contains invalid character`)
+}
+
+func (s *provisionedSecretsSuite) TestReadNull(c *C) {
+	_, err := ReadProvisionedSecret(bytes.NewReader([]byte(`null`)))
+	c.Check(err, ErrorMatches, `no secret`)
+}
+
+func (s *provisionedSecretsSuite) TestSystemdCredentialInstaller(c *C) {
+	dir := filepath.Join(c.MkDir(), "credstore")
+	installer := NewSystemdCredentialInstaller(dir)
+	c.Check(installer.InstallSecret("wifi-psk", []byte("foo")), IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "wifi-psk"))
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte("foo"))
+
+	fi, err := os.Stat(filepath.Join(dir, "wifi-psk"))
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0400))
+
+	fi, err = os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0700))
+}
+
+type provisionedSecretsKeyringSuite struct {
+	testutil.KeyringTestBase
+}
+
+var _ = Suite(&provisionedSecretsKeyringSuite{})
+
+func (s *provisionedSecretsKeyringSuite) SetUpSuite(c *C) {
+	s.KeyringTestBase.SetUpSuite(c)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.Skip("Test requires the user keyring to be linked from the process's session keyring")
+	}
+}
+
+func (s *provisionedSecretsKeyringSuite) TestInstallProvisionedSecretsFromKernel(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKeyToUserKeyring(primaryKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	secret1, err := SealProvisionedSecret(rand.Reader, primaryKey, "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+	secret2, err := SealProvisionedSecret(rand.Reader, primaryKey, "update", "token", []byte("bar"))
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	c.Check(InstallProvisionedSecretsFromKernel("", "/dev/sda1", NewSystemdCredentialInstaller(dir), secret1, secret2), IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "wifi-psk"))
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte("foo"))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "token"))
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte("bar"))
+}
+
+func (s *provisionedSecretsKeyringSuite) TestInstallProvisionedSecretsFromKernelToKeyring(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKeyToUserKeyring(primaryKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	secret, err := SealProvisionedSecret(rand.Reader, primaryKey, "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	c.Check(InstallProvisionedSecretsFromKernel("", "/dev/sda1", NewKeyringSecretInstaller(""), secret), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", "ubuntu-fde:secret:wifi-psk", 0)
+	c.Assert(err, IsNil)
+	payload := make([]byte, 3)
+	_, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("foo"))
+}
+
+func (s *provisionedSecretsKeyringSuite) TestInstallProvisionedSecretsFromKernelWithOptions(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKey(keyring.UserKeyring, primaryKey, keyring.Description{Prefix: "foo", Device: "/dev/sda1", Purpose: "aux", Instance: "initrd"}), IsNil)
+
+	secret, err := SealProvisionedSecret(rand.Reader, primaryKey, "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	options := &KernelKeyringOptions{Prefix: "foo", Instance: "initrd"}
+	c.Check(InstallProvisionedSecretsFromKernelWithOptions(options, "/dev/sda1", NewKeyringSecretInstallerWithOptions(options), secret), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", "foo:secret:wifi-psk:initrd", 0)
+	c.Assert(err, IsNil)
+	payload := make([]byte, 3)
+	_, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0)
+	c.Check(err, IsNil)
+	c.Check(payload, DeepEquals, []byte("foo"))
+}
+
+func (s *provisionedSecretsKeyringSuite) TestInstallProvisionedSecretsFromKernelNoPrimaryKey(c *C) {
+	err := InstallProvisionedSecretsFromKernel("", "/dev/sda1", NewSystemdCredentialInstaller(c.MkDir()))
+	c.Check(err, ErrorMatches, `cannot obtain primary key: cannot find key in kernel keyring`)
+}
+
+type mockSecretInstaller struct{}
+
+func (*mockSecretInstaller) InstallSecret(name string, secret []byte) error {
+	return errors.New("some error")
+}
+
+func (s *provisionedSecretsKeyringSuite) TestInstallProvisionedSecretsFromKernelInstallError(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	c.Check(keyring.AddKeyToUserKeyring(primaryKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	secret, err := SealProvisionedSecret(rand.Reader, primaryKey, "network", "wifi-psk", []byte("foo"))
+	c.Assert(err, IsNil)
+
+	err = InstallProvisionedSecretsFromKernel("", "/dev/sda1", new(mockSecretInstaller), secret)
+	c.Check(err, ErrorMatches, `cannot install secret "wifi-psk": some error`)
+}
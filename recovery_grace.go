@@ -0,0 +1,331 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+// ErrRecoveryKeyGraceExpired is returned from ActivateVolumeWithRecoveryKey and
+// ActivateVolumeWithKeyData if a volume that has no platform protected keys
+// can't be activated with the recovery key because the grace limits of every
+// recovery keyslot have been exceeded (see SetLUKS2ContainerRecoveryKeyGrace).
+var ErrRecoveryKeyGraceExpired = errors.New("the grace period for activating with the recovery key alone has expired")
+
+// RecoveryKeyGrace limits how long a recovery keyslot can be used to unlock a
+// LUKS2 container that doesn't have any platform protected keys. This is useful
+// for images that are provisioned with only a recovery key, and which should
+// have a platform protected key enrolled shortly after installation.
+type RecoveryKeyGrace struct {
+	// NotAfter is the time after which the recovery keyslot can no longer be
+	// used. The zero value means that there is no time limit.
+	NotAfter time.Time
+
+	// MaxUses is the maximum number of times that the recovery keyslot can
+	// be used. Zero means that there is no limit.
+	MaxUses int
+
+	// Uses is the number of times that the recovery keyslot has been used
+	// since the grace limit was set. It is ignored by
+	// SetLUKS2ContainerRecoveryKeyGrace.
+	Uses int
+
+	// Counter optionally identifies a platform counter that records the
+	// number of times that the recovery keyslot has been used. Without this,
+	// the use count is only stored in the LUKS2 header, where it can be
+	// reset by modifying or restoring an older copy of the header.
+	Counter *RecoveryKeyGraceCounter
+}
+
+// RecoveryKeyGraceCounter identifies a counter maintained by a platform that
+// records the number of times that a recovery keyslot with a grace limit has
+// been used.
+type RecoveryKeyGraceCounter struct {
+	// PlatformName is the name of the platform that maintains the counter.
+	// A RecoveryKeyGraceCounterHandler must be registered for it.
+	PlatformName string
+
+	// Handle is platform specific data that identifies the counter.
+	Handle []byte
+}
+
+// RecoveryKeyGraceCounterHandler is implemented by platforms that can record
+// the number of times that a recovery keyslot with a grace limit has been used
+// in a way that can't be rolled back by modifying the LUKS2 header, such as in
+// a TPM NV index.
+type RecoveryKeyGraceCounterHandler interface {
+	// Uses returns the number of times that the counter with the supplied
+	// handle has been incremented.
+	Uses(handle []byte) (int, error)
+
+	// Increment increments the counter with the supplied handle.
+	Increment(handle []byte) error
+}
+
+var recoveryKeyGraceCounterHandlers = make(map[string]RecoveryKeyGraceCounterHandler)
+
+// RegisterRecoveryKeyGraceCounterHandler registers a handler for the recovery
+// key grace counters maintained by the specified platform name.
+func RegisterRecoveryKeyGraceCounterHandler(name string, handler RecoveryKeyGraceCounterHandler) {
+	recoveryKeyGraceCounterHandlers[name] = handler
+}
+
+// recoveryGraceUses returns the number of times that the recovery keyslot with
+// the supplied grace limit has been used.
+func recoveryGraceUses(grace *luksview.RecoveryGrace) (int, error) {
+	if grace.Counter == nil {
+		return grace.Uses, nil
+	}
+	handler := recoveryKeyGraceCounterHandlers[grace.Counter.PlatformName]
+	if handler == nil {
+		return 0, fmt.Errorf("no handler registered for recovery key grace counter platform %q", grace.Counter.PlatformName)
+	}
+	return handler.Uses(grace.Counter.Handle)
+}
+
+func (g *RecoveryKeyGrace) exceeded() bool {
+	if !g.NotAfter.IsZero() && timeNow().After(g.NotAfter) {
+		return true
+	}
+	return g.MaxUses > 0 && g.Uses >= g.MaxUses
+}
+
+func recoveryTokenByName(view *luksview.View, keyslotName string) (*luksview.RecoveryToken, int, error) {
+	token, id, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return nil, 0, errors.New("no key with the specified name exists")
+	}
+	if t, ok := token.(*luksview.UnsupportedToken); ok {
+		return nil, 0, t.Err
+	}
+	recoveryToken, ok := token.(*luksview.RecoveryToken)
+	if !ok {
+		return nil, 0, errors.New("the specified key is not a recovery key")
+	}
+	return recoveryToken, id, nil
+}
+
+// SetLUKS2ContainerRecoveryKeyGrace sets a grace limit on the recovery keyslot
+// with the specified name on the LUKS2 container at the specified path. Whilst
+// the container has no platform protected keys, the volume can only be activated
+// with this recovery keyslot until the time specified by NotAfter and for at most
+// MaxUses times. Once a platform protected key has been enrolled, the limit is no
+// longer enforced. Passing a nil grace removes the limit.
+//
+// If the specified name is empty, the name "default-recovery" will be used.
+func SetLUKS2ContainerRecoveryKeyGrace(devicePath, keyslotName string, grace *RecoveryKeyGrace) error {
+	if keyslotName == "" {
+		keyslotName = defaultRecoveryKeyslotName
+	}
+	if grace != nil && grace.MaxUses < 0 {
+		return errors.New("invalid MaxUses")
+	}
+	if grace != nil && grace.Counter != nil {
+		if recoveryKeyGraceCounterHandlers[grace.Counter.PlatformName] == nil {
+			return fmt.Errorf("no handler registered for recovery key grace counter platform %q", grace.Counter.PlatformName)
+		}
+	}
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	token, id, err := recoveryTokenByName(view, keyslotName)
+	if err != nil {
+		return err
+	}
+
+	newToken := &luksview.RecoveryToken{TokenBase: token.TokenBase}
+	if grace != nil {
+		newToken.Grace = &luksview.RecoveryGrace{MaxUses: grace.MaxUses}
+		if !grace.NotAfter.IsZero() {
+			notAfter := grace.NotAfter.UTC()
+			newToken.Grace.NotAfter = &notAfter
+		}
+		if grace.Counter != nil {
+			newToken.Grace.Counter = &luksview.RecoveryGraceCounter{
+				PlatformName: grace.Counter.PlatformName,
+				Handle:       grace.Counter.Handle}
+		}
+	}
+
+	if err := luks2ImportToken(devicePath, newToken, &luks2.ImportTokenOptions{Id: id, Replace: true}); err != nil {
+		return xerrors.Errorf("cannot import new token: %w", err)
+	}
+
+	return nil
+}
+
+// LUKS2ContainerRecoveryKeyGrace returns the grace limit for the recovery
+// keyslot with the specified name on the LUKS2 container at the specified
+// path, or nil if there is no limit (see SetLUKS2ContainerRecoveryKeyGrace).
+//
+// If the specified name is empty, the name "default-recovery" will be used.
+func LUKS2ContainerRecoveryKeyGrace(devicePath, keyslotName string) (*RecoveryKeyGrace, error) {
+	if keyslotName == "" {
+		keyslotName = defaultRecoveryKeyslotName
+	}
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	token, _, err := recoveryTokenByName(view, keyslotName)
+	if err != nil {
+		return nil, err
+	}
+	if token.Grace == nil {
+		return nil, nil
+	}
+
+	grace, err := newRecoveryKeyGrace(token.Grace)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain use count: %w", err)
+	}
+	return grace, nil
+}
+
+func newRecoveryKeyGrace(grace *luksview.RecoveryGrace) (*RecoveryKeyGrace, error) {
+	uses, err := recoveryGraceUses(grace)
+	if err != nil {
+		return nil, err
+	}
+	out := &RecoveryKeyGrace{
+		MaxUses: grace.MaxUses,
+		Uses:    uses}
+	if grace.NotAfter != nil {
+		out.NotAfter = *grace.NotAfter
+	}
+	if grace.Counter != nil {
+		out.Counter = &RecoveryKeyGraceCounter{
+			PlatformName: grace.Counter.PlatformName,
+			Handle:       grace.Counter.Handle}
+	}
+	return out, nil
+}
+
+type recoveryKeyslot struct {
+	id    int
+	token *luksview.RecoveryToken
+}
+
+// recoveryKeyslotsForActivation returns the recovery keyslots that can be
+// used to activate the container with the supplied header view. A nil result
+// with no error means that any keyslot can be used, which is the case if the
+// container has platform protected keys, if none of its recovery keyslots have
+// a grace limit, or if the header view is not available.
+func recoveryKeyslotsForActivation(view *luksview.View) ([]*recoveryKeyslot, error) {
+	if view == nil {
+		return nil, nil
+	}
+
+	for _, token := range view.KeyDataTokensByPriority() {
+		if token.Data != nil {
+			// There is an initialized platform protected key.
+			return nil, nil
+		}
+	}
+
+	var slots []*recoveryKeyslot
+	var graced bool
+	for _, name := range view.TokenNames() {
+		token, id, _ := view.TokenByName(name)
+		recoveryToken, ok := token.(*luksview.RecoveryToken)
+		if !ok {
+			continue
+		}
+		if recoveryToken.Grace != nil {
+			graced = true
+			grace, err := newRecoveryKeyGrace(recoveryToken.Grace)
+			if err != nil {
+				// Fail closed if the use count can't be obtained.
+				fmt.Fprintf(osStderr, "secboot: cannot obtain use count of recovery keyslot %s: %v\n", name, err)
+				continue
+			}
+			if grace.exceeded() {
+				continue
+			}
+		}
+		slots = append(slots, &recoveryKeyslot{id: id, token: recoveryToken})
+	}
+
+	switch {
+	case !graced:
+		return nil, nil
+	case len(slots) == 0:
+		return nil, ErrRecoveryKeyGraceExpired
+	default:
+		return slots, nil
+	}
+}
+
+// recordRecoveryKeyslotUse increments the use count of the supplied recovery
+// keyslot if it has a grace limit.
+func recordRecoveryKeyslotUse(devicePath string, slot *recoveryKeyslot) error {
+	if slot.token.Grace == nil {
+		return nil
+	}
+
+	if counter := slot.token.Grace.Counter; counter != nil {
+		handler := recoveryKeyGraceCounterHandlers[counter.PlatformName]
+		if handler == nil {
+			return fmt.Errorf("no handler registered for recovery key grace counter platform %q", counter.PlatformName)
+		}
+		return handler.Increment(counter.Handle)
+	}
+
+	grace := *slot.token.Grace
+	grace.Uses += 1
+	newToken := &luksview.RecoveryToken{
+		TokenBase: slot.token.TokenBase,
+		Grace:     &grace}
+	return luks2ImportToken(devicePath, newToken, &luks2.ImportTokenOptions{Id: slot.id, Replace: true})
+}
+
+// activateWithRecoveryKeyslots attempts to activate the specified volume with
+// the supplied recovery key using each of the supplied keyslots in turn,
+// recording the use of the one that succeeds. On success, it returns the name
+// of the keyslot that was used. If the use can't be recorded, the volume is
+// deactivated again and an error is returned.
+func activateWithRecoveryKeyslots(volumeName, sourceDevicePath string, key RecoveryKey, slots []*recoveryKeyslot) (name string, err error) {
+	for _, slot := range slots {
+		err = activateVolume(volumeName, sourceDevicePath, key[:], slot.token.TokenKeyslot)
+		if err != nil {
+			continue
+		}
+		if err := recordRecoveryKeyslotUse(sourceDevicePath, slot); err != nil {
+			if err := luks2Deactivate(volumeName); err != nil {
+				fmt.Fprintf(osStderr, "secboot: cannot deactivate volume after failing to record use of recovery keyslot: %v\n", err)
+			}
+			return "", xerrors.Errorf("cannot record use of recovery keyslot %s: %w", slot.token.Name(), err)
+		}
+		return slot.token.Name(), nil
+	}
+	return "", err
+}
@@ -0,0 +1,277 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+func (s *cryptSuite) addMockRecoveryKeyslotWithGrace(c *C, path string, grace *luksview.RecoveryGrace) RecoveryKey {
+	recoveryKey := s.newRecoveryKey()
+	slot := s.addMockKeyslot(path, recoveryKey[:])
+	s.addMockToken(path, &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default-recovery"},
+		Grace: grace})
+	return recoveryKey
+}
+
+type mockRecoveryKeyGraceCounterHandler struct {
+	uses         map[string]int
+	usesErr      error
+	incrementErr error
+}
+
+func (h *mockRecoveryKeyGraceCounterHandler) Uses(handle []byte) (int, error) {
+	if h.usesErr != nil {
+		return 0, h.usesErr
+	}
+	return h.uses[string(handle)], nil
+}
+
+func (h *mockRecoveryKeyGraceCounterHandler) Increment(handle []byte) error {
+	if h.incrementErr != nil {
+		return h.incrementErr
+	}
+	h.uses[string(handle)] += 1
+	return nil
+}
+
+func (s *cryptSuite) mockRecoveryKeyGraceCounterHandler(c *C) *mockRecoveryKeyGraceCounterHandler {
+	handler := &mockRecoveryKeyGraceCounterHandler{uses: make(map[string]int)}
+	RegisterRecoveryKeyGraceCounterHandler("mock-grace", handler)
+	s.AddCleanup(func() { RegisterRecoveryKeyGraceCounterHandler("mock-grace", nil) })
+	return handler
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGrace(c *C) {
+	s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", nil)
+
+	grace := &RecoveryKeyGrace{
+		NotAfter: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		MaxUses:  3,
+		Uses:     10}
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", grace), IsNil)
+
+	token, _, _ := mockTokenByName(c, s.luks2.devices["/dev/sda1"], "default-recovery")
+	notAfter := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	c.Check(token.(*luksview.RecoveryToken).Grace, DeepEquals, &luksview.RecoveryGrace{
+		NotAfter: &notAfter,
+		MaxUses:  3})
+
+	current, err := LUKS2ContainerRecoveryKeyGrace("/dev/sda1", "default-recovery")
+	c.Check(err, IsNil)
+	c.Check(current, DeepEquals, &RecoveryKeyGrace{
+		NotAfter: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		MaxUses:  3})
+
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", nil), IsNil)
+	current, err = LUKS2ContainerRecoveryKeyGrace("/dev/sda1", "")
+	c.Check(err, IsNil)
+	c.Check(current, IsNil)
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGraceNoTimeLimit(c *C) {
+	s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", nil)
+
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", &RecoveryKeyGrace{MaxUses: 3}), IsNil)
+
+	token, _, _ := mockTokenByName(c, s.luks2.devices["/dev/sda1"], "default-recovery")
+	c.Check(token.(*luksview.RecoveryToken).Grace, DeepEquals, &luksview.RecoveryGrace{MaxUses: 3})
+
+	current, err := LUKS2ContainerRecoveryKeyGrace("/dev/sda1", "")
+	c.Check(err, IsNil)
+	c.Check(current, DeepEquals, &RecoveryKeyGrace{MaxUses: 3})
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGraceNotRecoveryKey(c *C) {
+	s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "default", &RecoveryKeyGrace{MaxUses: 1}), ErrorMatches, `the specified key is not a recovery key`)
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGraceMissing(c *C) {
+	s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", &RecoveryKeyGrace{MaxUses: 1}), ErrorMatches, `no key with the specified name exists`)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyWithinGrace(c *C) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	notAfter := now.Add(24 * time.Hour)
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		NotAfter: &notAfter,
+		MaxUses:  2})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+	c.Check(s.luks2.operations[:2], DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,0)",
+	})
+
+	grace, err := LUKS2ContainerRecoveryKeyGrace("/dev/sda1", "")
+	c.Check(err, IsNil)
+	c.Check(grace.Uses, Equals, 1)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceExpired(c *C) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return now }))
+
+	notAfter := now.Add(-time.Second)
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		NotAfter: &notAfter})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), Equals, ErrRecoveryKeyGraceExpired)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+	c.Check(s.luks2.activated, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceUsesExceeded(c *C) {
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 2,
+		Uses:    2})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), Equals, ErrRecoveryKeyGraceExpired)
+	c.Check(s.luks2.activated, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceNotEnforcedWithPlatformKey(c *C) {
+	// Enroll a platform protected key.
+	existing := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	_, err := EnrollLUKS2ContainersWithPrimaryKey(s.newPrimaryKey(c, 32), s.mockPrimaryKeyProtector(c),
+		&LUKS2Enrollment{DevicePath: "/dev/sda1", KeyslotName: "run", ExistingKey: existing})
+	c.Assert(err, IsNil)
+
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 1,
+		Uses:    1})
+	s.luks2.operations = nil
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGraceWithCounter(c *C) {
+	handler := s.mockRecoveryKeyGraceCounterHandler(c)
+	handler.uses["counter"] = 1
+	s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", nil)
+
+	grace := &RecoveryKeyGrace{
+		MaxUses: 3,
+		Counter: &RecoveryKeyGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}}
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", grace), IsNil)
+
+	token, _, _ := mockTokenByName(c, s.luks2.devices["/dev/sda1"], "default-recovery")
+	c.Check(token.(*luksview.RecoveryToken).Grace, DeepEquals, &luksview.RecoveryGrace{
+		MaxUses: 3,
+		Counter: &luksview.RecoveryGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+
+	current, err := LUKS2ContainerRecoveryKeyGrace("/dev/sda1", "")
+	c.Check(err, IsNil)
+	c.Check(current, DeepEquals, &RecoveryKeyGrace{
+		MaxUses: 3,
+		Uses:    1,
+		Counter: &RecoveryKeyGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+}
+
+func (s *cryptSuite) TestSetLUKS2ContainerRecoveryKeyGraceCounterNoHandler(c *C) {
+	s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", nil)
+
+	grace := &RecoveryKeyGrace{
+		MaxUses: 3,
+		Counter: &RecoveryKeyGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}}
+	c.Check(SetLUKS2ContainerRecoveryKeyGrace("/dev/sda1", "", grace), ErrorMatches, `no handler registered for recovery key grace counter platform "mock-grace"`)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceCounter(c *C) {
+	handler := s.mockRecoveryKeyGraceCounterHandler(c)
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 2,
+		Counter: &luksview.RecoveryGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+	c.Check(handler.uses["counter"], Equals, 1)
+
+	// The use count in the header shouldn't be updated.
+	token, _, _ := mockTokenByName(c, s.luks2.devices["/dev/sda1"], "default-recovery")
+	c.Check(token.(*luksview.RecoveryToken).Grace.Uses, Equals, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceCounterExceeded(c *C) {
+	// The use count recorded by the counter takes precedence over the
+	// one in the header.
+	handler := s.mockRecoveryKeyGraceCounterHandler(c)
+	handler.uses["counter"] = 2
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 2,
+		Counter: &luksview.RecoveryGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), Equals, ErrRecoveryKeyGraceExpired)
+	c.Check(s.luks2.activated, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceCounterUnavailable(c *C) {
+	handler := s.mockRecoveryKeyGraceCounterHandler(c)
+	handler.usesErr = errors.New("some error")
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 2,
+		Counter: &luksview.RecoveryGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), Equals, ErrRecoveryKeyGraceExpired)
+	c.Check(s.luks2.activated, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyGraceRecordUseFails(c *C) {
+	handler := s.mockRecoveryKeyGraceCounterHandler(c)
+	handler.incrementErr = errors.New("some error")
+	recoveryKey := s.addMockRecoveryKeyslotWithGrace(c, "/dev/sda1", &luksview.RecoveryGrace{
+		MaxUses: 2,
+		Counter: &luksview.RecoveryGraceCounter{PlatformName: "mock-grace", Handle: []byte("counter")}})
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), ErrorMatches,
+		`cannot activate volume: cannot record use of recovery keyslot default-recovery: some error`)
+	c.Check(s.luks2.activated, HasLen, 0)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,0)",
+		"Deactivate(data)",
+	})
+}
@@ -0,0 +1,227 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+	"github.com/snapcore/secboot/testhooks"
+)
+
+var (
+	// ErrRecoveryKeyRotationIncomplete is returned from RotateRecoveryKey if
+	// a previous rotation for the same keyslot handed out a new key but has
+	// not been completed with CompleteRecoveryKeyRotation.
+	ErrRecoveryKeyRotationIncomplete = errors.New("a previous recovery key rotation has not been completed")
+)
+
+const (
+	// recoveryKeyRotationSuffix is appended to the name of a recovery keyslot
+	// to obtain the name of the temporary keyslot used whilst a new key is
+	// being added and verified. The key in this keyslot has never been handed
+	// out, so it can always be discarded.
+	recoveryKeyRotationSuffix = "-rotating"
+
+	// recoveryKeyPendingSuffix is appended to the name of a recovery keyslot
+	// to obtain the name of the keyslot holding a new key that may have been
+	// handed out to the caller. This keyslot is only ever removed once the
+	// caller has confirmed which key it kept.
+	recoveryKeyPendingSuffix = "-pending"
+)
+
+// RotateRecoveryKey begins replacing the recovery key in the keyslot with the
+// specified name on the LUKS2 container at the specified path with a freshly
+// generated one, which is returned. If the specified name is empty, the name
+// "default-recovery" will be used. The supplied existing recovery key is used
+// to authorize the addition of the new key.
+//
+// The new key is first added to a temporary keyslot and verified. The
+// temporary keyslot is then renamed to record that its key is about to be
+// handed out, before the optional save callback is called with it. The
+// caller should use this to persist or display the new key.
+//
+// This function never removes the old recovery key. Once the caller knows
+// which key it has kept, it must call CompleteRecoveryKeyRotation with that
+// key, which removes the other one. This must also be done if the save
+// callback fails or this function returns an error after the new key was
+// saved, as the caller may still have retained the new key.
+//
+// If a previous call was interrupted before the new key was handed out, its
+// temporary keyslot is discarded. If it was interrupted afterwards, this
+// returns ErrRecoveryKeyRotationIncomplete and the caller must first call
+// CompleteRecoveryKeyRotation.
+func RotateRecoveryKey(devicePath, keyslotName string, oldKey RecoveryKey, save func(RecoveryKey) error) (RecoveryKey, error) {
+	if keyslotName == "" {
+		keyslotName = defaultRecoveryKeyslotName
+	}
+	tmpName := keyslotName + recoveryKeyRotationSuffix
+	pendingName := keyslotName + recoveryKeyPendingSuffix
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if _, _, exists := view.TokenByName(pendingName); exists {
+		return RecoveryKey{}, ErrRecoveryKeyRotationIncomplete
+	}
+
+	token, _, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return RecoveryKey{}, errors.New("no key with the specified name exists")
+	}
+	if t, ok := token.(*luksview.UnsupportedToken); ok {
+		return RecoveryKey{}, t.Err
+	}
+	if _, ok := token.(*luksview.RecoveryToken); !ok {
+		return RecoveryKey{}, errors.New("the specified key is not a recovery key")
+	}
+
+	if _, _, exists := view.TokenByName(tmpName); exists {
+		// A previous rotation was interrupted before its key was handed
+		// out, so it is safe to discard it.
+		if err := deleteLUKS2ContainerKey(devicePath, tmpName, false); err != nil {
+			return RecoveryKey{}, xerrors.Errorf("cannot remove key from interrupted rotation: %w", err)
+		}
+	}
+
+	var newKey RecoveryKey
+	if _, err := io.ReadFull(testhooks.RandReader, newKey[:]); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot generate new recovery key: %w", err)
+	}
+
+	if err := AddLUKS2ContainerRecoveryKey(devicePath, tmpName, oldKey[:], newKey); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot add new recovery key: %w", err)
+	}
+
+	if err := verifyRotatedRecoveryKey(devicePath, tmpName, newKey); err != nil {
+		// Ignore the error here - if this fails, the temporary keyslot
+		// will be removed on the next attempt.
+		deleteLUKS2ContainerKey(devicePath, tmpName, false)
+		return RecoveryKey{}, err
+	}
+
+	// Record that the new key is about to be handed out. From this point,
+	// its keyslot is only removed by CompleteRecoveryKeyRotation.
+	if err := RenameLUKS2ContainerKey(devicePath, tmpName, pendingName); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot mark new recovery key as pending: %w", err)
+	}
+
+	if save != nil {
+		if err := save(newKey); err != nil {
+			return newKey, xerrors.Errorf("cannot save new recovery key: %w", err)
+		}
+	}
+
+	return newKey, nil
+}
+
+// CompleteRecoveryKeyRotation completes a recovery key rotation for the
+// keyslot with the specified name on the LUKS2 container at the specified
+// path, which was started with RotateRecoveryKey. If the specified name is
+// empty, the name "default-recovery" will be used. The supplied key must be
+// the recovery key that the caller has kept, which may be either the old or
+// the new key. The other key is removed, and the kept key is left in the
+// keyslot with the specified name.
+//
+// This can be called repeatedly with the same key if it is interrupted. If
+// there is no rotation in progress, this just checks that the supplied key
+// is the current recovery key.
+func CompleteRecoveryKeyRotation(devicePath, keyslotName string, keptKey RecoveryKey) error {
+	if keyslotName == "" {
+		keyslotName = defaultRecoveryKeyslotName
+	}
+	pendingName := keyslotName + recoveryKeyPendingSuffix
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	matches := func(name string) (exists bool, ok bool, err error) {
+		token, _, exists := view.TokenByName(name)
+		if !exists {
+			return false, false, nil
+		}
+		if _, ok := token.(*luksview.RecoveryToken); !ok {
+			return true, false, errors.New("the specified key is not a recovery key")
+		}
+		if err := luks2TestKey(devicePath, keptKey[:], token.Keyslots()[0]); err != nil {
+			return true, false, nil
+		}
+		return true, true, nil
+	}
+
+	oldExists, keptOld, err := matches(keyslotName)
+	if err != nil {
+		return err
+	}
+	pendingExists, keptPending, err := matches(pendingName)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case keptOld:
+		if !pendingExists {
+			return nil
+		}
+		if err := deleteLUKS2ContainerKey(devicePath, pendingName, false); err != nil {
+			return xerrors.Errorf("cannot remove unused new recovery key: %w", err)
+		}
+	case keptPending:
+		if oldExists {
+			if err := deleteLUKS2ContainerKey(devicePath, keyslotName, false); err != nil {
+				return xerrors.Errorf("cannot remove old recovery key: %w", err)
+			}
+		}
+		if err := RenameLUKS2ContainerKey(devicePath, pendingName, keyslotName); err != nil {
+			return xerrors.Errorf("cannot rename new recovery key: %w", err)
+		}
+	case !oldExists && !pendingExists:
+		return errors.New("no key with the specified name exists")
+	default:
+		return errors.New("the supplied key does not match the old or new recovery key")
+	}
+
+	return nil
+}
+
+func verifyRotatedRecoveryKey(devicePath, keyslotName string, key RecoveryKey) error {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	token, _, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return errors.New("new recovery key is missing")
+	}
+
+	if err := luks2TestKey(devicePath, key[:], token.Keyslots()[0]); err != nil {
+		return xerrors.Errorf("cannot verify new recovery key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+type recoveryKeyRotationSuite struct {
+	snapd_testutil.BaseTest
+
+	luks2 *mockLUKS2
+}
+
+func (s *recoveryKeyRotationSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.luks2 = &mockLUKS2{
+		devices:   make(map[string]*mockLUKS2Container),
+		activated: make(map[string]string)}
+	s.AddCleanup(s.luks2.enableMocks())
+}
+
+var _ = Suite(&recoveryKeyRotationSuite{})
+
+func (s *recoveryKeyRotationSuite) newRecoveryKey() (key RecoveryKey) {
+	rand.Read(key[:])
+	return key
+}
+
+// newDevice creates a mock container with a platform key in slot 0 and the
+// supplied recovery key in slot 1 with the specified name.
+func (s *recoveryKeyRotationSuite) newDevice(path, recoveryKeyslotName string, recoveryKey RecoveryKey) *mockLUKS2Container {
+	unlockKey := make([]byte, 32)
+	rand.Read(unlockKey)
+
+	dev := &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    recoveryKeyslotName}},
+		},
+		keyslots: map[int][]byte{
+			0: unlockKey,
+			1: recoveryKey[:],
+		},
+	}
+	s.luks2.devices[path] = dev
+	return dev
+}
+
+func (s *recoveryKeyRotationSuite) checkRecoveryKey(c *C, dev *mockLUKS2Container, name string, key RecoveryKey) {
+	view, err := dev.newLUKSView()
+	c.Assert(err, IsNil)
+
+	token, _, exists := view.TokenByName(name)
+	c.Assert(exists, Equals, true)
+	c.Check(token, FitsTypeOf, &luksview.RecoveryToken{})
+	c.Check(dev.keyslots[token.Keyslots()[0]], DeepEquals, []byte(key[:]))
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKey(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	var saved []RecoveryKey
+	newKey, err := RotateRecoveryKey("/dev/sda1", "", oldKey, func(key RecoveryKey) error {
+		// The new key must be marked as pending before it is handed out.
+		s.checkRecoveryKey(c, dev, "default-recovery-pending", key)
+		saved = append(saved, key)
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(newKey, Not(Equals), oldKey)
+	c.Check(saved, DeepEquals, []RecoveryKey{newKey})
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, ForceIterations: 600000, Hash: luks2.HashSHA256}, Slot: 2}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,2,normal)",
+		"newLUKSView(/dev/sda1,0)",
+		"TestKey(/dev/sda1,2)",
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("ImportToken(/dev/sda1,", &luks2.ImportTokenOptions{Id: 2, Replace: true}, ")"),
+	})
+
+	// Both keys are retained until the rotation is completed.
+	c.Check(dev.keyslots, HasLen, 3)
+	c.Check(dev.tokens, HasLen, 3)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+	s.checkRecoveryKey(c, dev, "default-recovery-pending", newKey)
+
+	c.Check(CompleteRecoveryKeyRotation("/dev/sda1", "", newKey), IsNil)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "default-recovery", newKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyNamedNoSave(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/vdb2", "foo", oldKey)
+
+	newKey, err := RotateRecoveryKey("/dev/vdb2", "foo", oldKey, nil)
+	c.Check(err, IsNil)
+	c.Check(newKey, Not(Equals), oldKey)
+	s.checkRecoveryKey(c, dev, "foo-pending", newKey)
+
+	c.Check(CompleteRecoveryKeyRotation("/dev/vdb2", "foo", newKey), IsNil)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "foo", newKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyInvalidOldKey(c *C) {
+	dev := s.newDevice("/dev/sda1", "default-recovery", s.newRecoveryKey())
+
+	_, err := RotateRecoveryKey("/dev/sda1", "", s.newRecoveryKey(), nil)
+	c.Check(err, ErrorMatches, "cannot add new recovery key: cannot add key: invalid key")
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyVerifyFails(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	restore := MockLUKS2TestKey(func(devicePath string, key []byte, slot int) error {
+		return errors.New("cryptsetup failed with: No key available with this passphrase.")
+	})
+	defer restore()
+
+	saveCalled := false
+	_, err := RotateRecoveryKey("/dev/sda1", "", oldKey, func(RecoveryKey) error {
+		saveCalled = true
+		return nil
+	})
+	c.Check(err, ErrorMatches, "cannot verify new recovery key: cryptsetup failed with: No key available with this passphrase.")
+	c.Check(saveCalled, Equals, false)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeySaveFails(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	newKey, err := RotateRecoveryKey("/dev/sda1", "", oldKey, func(RecoveryKey) error {
+		return errors.New("some error")
+	})
+	c.Check(err, ErrorMatches, "cannot save new recovery key: some error")
+
+	// The new key may have been partially saved, so it must not be
+	// removed until the caller confirms which key it kept.
+	c.Check(dev.keyslots, HasLen, 3)
+	s.checkRecoveryKey(c, dev, "default-recovery-pending", newKey)
+
+	c.Check(CompleteRecoveryKeyRotation("/dev/sda1", "", oldKey), IsNil)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyInterruptedBeforeHandedOut(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	abandonedKey := s.newRecoveryKey()
+	dev.keyslots[2] = abandonedKey[:]
+	dev.tokens[2] = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 2,
+			TokenName:    "default-recovery-rotating"}}
+
+	newKey, err := RotateRecoveryKey("/dev/sda1", "", oldKey, nil)
+	c.Check(err, IsNil)
+
+	c.Check(s.luks2.operations[0:4], DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"newLUKSView(/dev/sda1,0)",
+		"KillSlot(/dev/sda1,2)",
+		"RemoveToken(/dev/sda1,2)",
+	})
+
+	c.Check(dev.keyslots, HasLen, 3)
+	c.Check(dev.tokens, HasLen, 3)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+	s.checkRecoveryKey(c, dev, "default-recovery-pending", newKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyIncomplete(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	pendingKey := s.newRecoveryKey()
+	dev.keyslots[2] = pendingKey[:]
+	dev.tokens[2] = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 2,
+			TokenName:    "default-recovery-pending"}}
+
+	_, err := RotateRecoveryKey("/dev/sda1", "", oldKey, nil)
+	c.Check(err, Equals, ErrRecoveryKeyRotationIncomplete)
+
+	c.Check(dev.keyslots, HasLen, 3)
+	c.Check(dev.tokens, HasLen, 3)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+	s.checkRecoveryKey(c, dev, "default-recovery-pending", pendingKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestCompleteRecoveryKeyRotationInterruptedAfterRemove(c *C) {
+	newKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery-pending", newKey)
+
+	c.Check(CompleteRecoveryKeyRotation("/dev/sda1", "", newKey), IsNil)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "default-recovery", newKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestCompleteRecoveryKeyRotationNotInProgress(c *C) {
+	key := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", key)
+
+	c.Check(CompleteRecoveryKeyRotation("/dev/sda1", "", key), IsNil)
+
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+	s.checkRecoveryKey(c, dev, "default-recovery", key)
+}
+
+func (s *recoveryKeyRotationSuite) TestCompleteRecoveryKeyRotationWrongKey(c *C) {
+	oldKey := s.newRecoveryKey()
+	dev := s.newDevice("/dev/sda1", "default-recovery", oldKey)
+
+	newKey, err := RotateRecoveryKey("/dev/sda1", "", oldKey, nil)
+	c.Check(err, IsNil)
+
+	err = CompleteRecoveryKeyRotation("/dev/sda1", "", s.newRecoveryKey())
+	c.Check(err, ErrorMatches, "the supplied key does not match the old or new recovery key")
+
+	c.Check(dev.keyslots, HasLen, 3)
+	s.checkRecoveryKey(c, dev, "default-recovery", oldKey)
+	s.checkRecoveryKey(c, dev, "default-recovery-pending", newKey)
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyNotRecoveryKey(c *C) {
+	s.newDevice("/dev/sda1", "default-recovery", s.newRecoveryKey())
+
+	_, err := RotateRecoveryKey("/dev/sda1", "default", s.newRecoveryKey(), nil)
+	c.Check(err, ErrorMatches, "the specified key is not a recovery key")
+}
+
+func (s *recoveryKeyRotationSuite) TestRotateRecoveryKeyNonExistant(c *C) {
+	s.newDevice("/dev/sda1", "default-recovery", s.newRecoveryKey())
+
+	_, err := RotateRecoveryKey("/dev/sda1", "foo", s.newRecoveryKey(), nil)
+	c.Check(err, ErrorMatches, "no key with the specified name exists")
+}
@@ -0,0 +1,275 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/secboot/internal/keyring"
+
+	"golang.org/x/xerrors"
+)
+
+const keyringPurposeRecoveryKey = "recovery"
+
+// DefaultRecoveryKeyStashTimeout is the period for which a recovery key added
+// with StashRecoveryKeyInKernel can be retrieved if no timeout is specified.
+const DefaultRecoveryKeyStashTimeout = 10 * time.Minute
+
+// RecoveryKeyRetrievalInterval is the minimum period between attempts by this
+// process to retrieve a stashed recovery key for the same container.
+const RecoveryKeyRetrievalInterval = time.Second
+
+// ErrRecoveryKeyExpired is returned from RetrieveStashedRecoveryKey if the
+// stashed recovery key has expired.
+var ErrRecoveryKeyExpired = errors.New("the stashed recovery key has expired")
+
+// ErrRecoveryKeyRetrievalRateLimited is returned from RetrieveStashedRecoveryKey
+// if it is called again for the same container before
+// RecoveryKeyRetrievalInterval has elapsed since the previous attempt.
+var ErrRecoveryKeyRetrievalRateLimited = errors.New("too many attempts to retrieve the stashed recovery key")
+
+var (
+	recoveryKeyRetrievalMu       sync.Mutex
+	recoveryKeyRetrievalAttempts = make(map[string]time.Time)
+)
+
+// RecoveryKeyRetrievalResult describes the outcome of an attempt to retrieve
+// a stashed recovery key.
+type RecoveryKeyRetrievalResult string
+
+const (
+	// RecoveryKeyRetrieved indicates that the recovery key was retrieved.
+	RecoveryKeyRetrieved RecoveryKeyRetrievalResult = "retrieved"
+
+	// RecoveryKeyRetrievalExpired indicates that the recovery key had
+	// expired.
+	RecoveryKeyRetrievalExpired RecoveryKeyRetrievalResult = "expired"
+
+	// RecoveryKeyRetrievalNotFound indicates that there was no recovery key,
+	// either because one was never stashed or because it has already been
+	// retrieved or has been expired by the kernel.
+	RecoveryKeyRetrievalNotFound RecoveryKeyRetrievalResult = "not-found"
+
+	// RecoveryKeyRetrievalRateLimited indicates that the attempt was
+	// rejected because it followed a previous attempt too closely.
+	RecoveryKeyRetrievalRateLimited RecoveryKeyRetrievalResult = "rate-limited"
+
+	// RecoveryKeyRetrievalFailed indicates that retrieval failed because of
+	// an unexpected error.
+	RecoveryKeyRetrievalFailed RecoveryKeyRetrievalResult = "failed"
+)
+
+// RecoveryKeyRetrievalRecord is written to the audit log supplied via
+// RetrieveRecoveryKeyOptions for each attempt to retrieve a stashed recovery
+// key.
+type RecoveryKeyRetrievalRecord struct {
+	Time       time.Time                  `json:"time"`
+	DevicePath string                     `json:"device-path"`
+	Requester  string                     `json:"requester,omitempty"`
+	Result     RecoveryKeyRetrievalResult `json:"result"`
+}
+
+// RetrieveRecoveryKeyOptions provides options to RetrieveStashedRecoveryKey.
+type RetrieveRecoveryKeyOptions struct {
+	// Requester identifies the caller, and is recorded in the audit log.
+	Requester string
+
+	// AuditLog is an optional writer to which a JSON encoded
+	// RecoveryKeyRetrievalRecord is written for each attempt, one per line.
+	AuditLog io.Writer
+}
+
+type stashedRecoveryKey struct {
+	Key      []byte    `json:"key"`
+	NotAfter time.Time `json:"not-after"`
+}
+
+// StashRecoveryKeyInKernel adds the supplied recovery key for the encrypted
+// container at the specified path to the kernel keyring, so that it can be
+// displayed again during installation with RetrieveStashedRecoveryKey rather than
+// being stored in a file. The key can only be retrieved once, and it expires
+// after the specified timeout, after which it is also removed by the kernel. If
+// the timeout is zero, DefaultRecoveryKeyStashTimeout is used. Any previously
+// stashed recovery key for the same container is replaced.
+//
+// The permissions of the stashed key are restricted so that it can only be
+// accessed by processes that possess it, ie, processes that can reach the
+// keyring that it is added to from their own session, process or thread
+// keyring. Other processes running as the same user can't read it, or see
+// that it exists.
+func StashRecoveryKeyInKernel(prefix, devicePath string, key RecoveryKey, timeout time.Duration) error {
+	return StashRecoveryKeyInKernelWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, key, timeout)
+}
+
+// StashRecoveryKeyInKernelWithOptions is a variant of StashRecoveryKeyInKernel
+// that adds the recovery key to the keyring and with the instance specified by
+// the supplied options.
+func StashRecoveryKeyInKernelWithOptions(options *KernelKeyringOptions, devicePath string, key RecoveryKey, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultRecoveryKeyStashTimeout
+	}
+	if timeout < 0 {
+		return errors.New("invalid timeout")
+	}
+
+	data, err := json.Marshal(&stashedRecoveryKey{
+		Key:      key[:],
+		NotAfter: timeNow().Add(timeout).UTC()})
+	if err != nil {
+		return xerrors.Errorf("cannot serialize recovery key: %w", err)
+	}
+
+	config := newKeyringConfig(options)
+	kr, err := config.target.keyring()
+	if err != nil {
+		return err
+	}
+	desc := config.description(devicePath, keyringPurposeRecoveryKey)
+	if err := keyring.AddKeyWithPermissions(kr, data, desc, keyring.PossessorOnlyPerm); err != nil {
+		return xerrors.Errorf("cannot add recovery key to keyring: %w", err)
+	}
+	if err := keyring.SetKeyTimeout(kr, desc, timeout); err != nil {
+		keyring.RemoveKey(kr, desc)
+		return xerrors.Errorf("cannot set timeout on recovery key: %w", err)
+	}
+
+	return nil
+}
+
+// checkRecoveryKeyRetrievalRate records an attempt to retrieve the stashed
+// recovery key with the supplied description, and returns false if it follows
+// the previous attempt too closely.
+func checkRecoveryKeyRetrievalRate(desc keyring.Description) bool {
+	recoveryKeyRetrievalMu.Lock()
+	defer recoveryKeyRetrievalMu.Unlock()
+
+	now := timeNow()
+	if last, ok := recoveryKeyRetrievalAttempts[desc.String()]; ok && now.Sub(last) < RecoveryKeyRetrievalInterval {
+		return false
+	}
+	recoveryKeyRetrievalAttempts[desc.String()] = now
+	return true
+}
+
+func auditRecoveryKeyRetrieval(options *RetrieveRecoveryKeyOptions, devicePath string, result RecoveryKeyRetrievalResult) {
+	if options.AuditLog == nil {
+		return
+	}
+	data, err := json.Marshal(&RecoveryKeyRetrievalRecord{
+		Time:       timeNow().UTC(),
+		DevicePath: devicePath,
+		Requester:  options.Requester,
+		Result:     result})
+	if err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot serialize recovery key retrieval record: %v\n", err)
+		return
+	}
+	if _, err := options.AuditLog.Write(append(data, '\n')); err != nil {
+		fmt.Fprintf(osStderr, "secboot: cannot write recovery key retrieval record: %v\n", err)
+	}
+}
+
+// RetrieveStashedRecoveryKey retrieves the recovery key for the encrypted
+// container at the specified path that was previously added with
+// StashRecoveryKeyInKernel. The value of prefix must match the prefix that was
+// supplied to StashRecoveryKeyInKernel. The key is removed from the kernel keyring before
+// it is returned, so that it can only be retrieved once. Each attempt is
+// recorded in the audit log supplied via options, if there is one. Attempts for
+// the same container are limited to one per RecoveryKeyRetrievalInterval, and
+// a ErrRecoveryKeyRetrievalRateLimited error is returned for an attempt that
+// exceeds this.
+//
+// If no key is found, a ErrKernelKeyNotFound error will be returned. This is
+// also the case if the key has already been retrieved. If the key has expired,
+// a ErrRecoveryKeyExpired error will be returned.
+func RetrieveStashedRecoveryKey(prefix, devicePath string, options *RetrieveRecoveryKeyOptions) (key RecoveryKey, err error) {
+	return RetrieveStashedRecoveryKeyWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, options)
+}
+
+// RetrieveStashedRecoveryKeyWithOptions is a variant of RetrieveStashedRecoveryKey
+// that retrieves the recovery key from the keyring and with the instance specified
+// by the supplied keyring options, which must match the options supplied to
+// StashRecoveryKeyInKernelWithOptions.
+func RetrieveStashedRecoveryKeyWithOptions(keyringOptions *KernelKeyringOptions, devicePath string, options *RetrieveRecoveryKeyOptions) (key RecoveryKey, err error) {
+	if options == nil {
+		options = new(RetrieveRecoveryKeyOptions)
+	}
+
+	result := RecoveryKeyRetrievalFailed
+	defer func() {
+		auditRecoveryKeyRetrieval(options, devicePath, result)
+	}()
+
+	config := newKeyringConfig(keyringOptions)
+	kr, err := config.target.keyring()
+	if err != nil {
+		return RecoveryKey{}, err
+	}
+	desc := config.description(devicePath, keyringPurposeRecoveryKey)
+	if !checkRecoveryKeyRetrievalRate(desc) {
+		result = RecoveryKeyRetrievalRateLimited
+		return RecoveryKey{}, ErrRecoveryKeyRetrievalRateLimited
+	}
+
+	data, err := keyring.GetKey(kr, desc)
+	if err != nil {
+		var e syscall.Errno
+		if xerrors.As(err, &e) {
+			switch e {
+			case syscall.ENOKEY:
+				result = RecoveryKeyRetrievalNotFound
+				return RecoveryKey{}, ErrKernelKeyNotFound
+			case syscall.EKEYEXPIRED:
+				result = RecoveryKeyRetrievalExpired
+				return RecoveryKey{}, ErrRecoveryKeyExpired
+			}
+		}
+		return RecoveryKey{}, err
+	}
+
+	// Remove the key before doing anything else, so that it can only be
+	// retrieved once.
+	if err := keyring.RemoveKey(kr, desc); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot remove recovery key from keyring: %w", err)
+	}
+
+	var stashed stashedRecoveryKey
+	if err := json.Unmarshal(data, &stashed); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot decode recovery key: %w", err)
+	}
+	if len(stashed.Key) != len(key) {
+		return RecoveryKey{}, errors.New("invalid recovery key length")
+	}
+	if timeNow().After(stashed.NotAfter) {
+		result = RecoveryKeyRetrievalExpired
+		return RecoveryKey{}, ErrRecoveryKeyExpired
+	}
+
+	copy(key[:], stashed.Key)
+	result = RecoveryKeyRetrieved
+	return key, nil
+}
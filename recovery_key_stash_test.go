@@ -0,0 +1,248 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type recoveryKeyStashSuite struct {
+	testutil.KeyringTestBase
+	now time.Time
+}
+
+func (s *recoveryKeyStashSuite) SetUpSuite(c *C) {
+	s.KeyringTestBase.SetUpSuite(c)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.Skip("Test requires the user keyring to be linked from the process's session keyring")
+	}
+}
+
+func (s *recoveryKeyStashSuite) SetUpTest(c *C) {
+	s.KeyringTestBase.SetUpTest(c)
+	s.now = time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	s.AddCleanup(MockTimeNow(func() time.Time { return s.now }))
+	s.AddCleanup(MockRecoveryKeyRetrievalAttempts())
+}
+
+var _ = Suite(&recoveryKeyStashSuite{})
+
+func (s *recoveryKeyStashSuite) checkAuditLog(c *C, log *bytes.Buffer, expected ...*RecoveryKeyRetrievalRecord) {
+	dec := json.NewDecoder(log)
+	for _, e := range expected {
+		var record *RecoveryKeyRetrievalRecord
+		c.Check(dec.Decode(&record), IsNil)
+		c.Check(record, DeepEquals, e)
+	}
+	c.Check(dec.More(), testutil.IsFalse)
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKey(c *C) {
+	key := RecoveryKey{0x1e, 0x4e, 0xf2, 0x62, 0x84, 0x9a, 0x71, 0x3c, 0x5e, 0x8f, 0xe3, 0x9b, 0x4a, 0x4c, 0xb0, 0x3f}
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key, 0), IsNil)
+
+	log := new(bytes.Buffer)
+	retrieved, err := RetrieveStashedRecoveryKey("", "/dev/sda1", &RetrieveRecoveryKeyOptions{
+		Requester: "installer",
+		AuditLog:  log})
+	c.Check(err, IsNil)
+	c.Check(retrieved, DeepEquals, key)
+
+	s.checkAuditLog(c, log, &RecoveryKeyRetrievalRecord{
+		Time:       s.now,
+		DevicePath: "/dev/sda1",
+		Requester:  "installer",
+		Result:     RecoveryKeyRetrieved})
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyDifferentPrefix(c *C) {
+	key := RecoveryKey{0xb3, 0x58, 0x2c, 0x40, 0x12, 0x9e, 0x6d, 0xa1, 0x07, 0x55, 0xc8, 0x31, 0xf4, 0x2a, 0x9b, 0x66}
+	c.Check(StashRecoveryKeyInKernel("foo", "/dev/nvme0n1p3", key, time.Minute), IsNil)
+
+	_, err := RetrieveStashedRecoveryKey("", "/dev/nvme0n1p3", nil)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	retrieved, err := RetrieveStashedRecoveryKey("foo", "/dev/nvme0n1p3", nil)
+	c.Check(err, IsNil)
+	c.Check(retrieved, DeepEquals, key)
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyWithOptions(c *C) {
+	key := RecoveryKey{0xb3, 0x58, 0x2c, 0x40, 0x12, 0x9e, 0x6d, 0xa1, 0x07, 0x55, 0xc8, 0x31, 0xf4, 0x2a, 0x9b, 0x66}
+	options := &KernelKeyringOptions{Instance: "installer"}
+	c.Check(StashRecoveryKeyInKernelWithOptions(options, "/dev/sda1", key, time.Minute), IsNil)
+
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", nil)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	retrieved, err := RetrieveStashedRecoveryKeyWithOptions(options, "/dev/sda1", nil)
+	c.Check(err, IsNil)
+	c.Check(retrieved, DeepEquals, key)
+
+	_, err = keyring.GetKey(keyring.UserKeyring, keyring.Description{Prefix: "ubuntu-fde", Device: "/dev/sda1", Purpose: "recovery", Instance: "installer"})
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyOnlyOnce(c *C) {
+	key := RecoveryKey{0x1e, 0x4e, 0xf2, 0x62, 0x84, 0x9a, 0x71, 0x3c, 0x5e, 0x8f, 0xe3, 0x9b, 0x4a, 0x4c, 0xb0, 0x3f}
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key, 0), IsNil)
+
+	log := new(bytes.Buffer)
+	options := &RetrieveRecoveryKeyOptions{AuditLog: log}
+
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", options)
+	c.Check(err, IsNil)
+
+	s.now = s.now.Add(time.Second)
+	_, err = RetrieveStashedRecoveryKey("", "/dev/sda1", options)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	s.checkAuditLog(c, log,
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now.Add(-time.Second),
+			DevicePath: "/dev/sda1",
+			Result:     RecoveryKeyRetrieved},
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now,
+			DevicePath: "/dev/sda1",
+			Result:     RecoveryKeyRetrievalNotFound})
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyRateLimited(c *C) {
+	key := RecoveryKey{0x1e, 0x4e, 0xf2, 0x62, 0x84, 0x9a, 0x71, 0x3c, 0x5e, 0x8f, 0xe3, 0x9b, 0x4a, 0x4c, 0xb0, 0x3f}
+
+	log := new(bytes.Buffer)
+	options := &RetrieveRecoveryKeyOptions{AuditLog: log}
+
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", options)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key, 0), IsNil)
+
+	s.now = s.now.Add(500 * time.Millisecond)
+	_, err = RetrieveStashedRecoveryKey("", "/dev/sda1", options)
+	c.Check(err, Equals, ErrRecoveryKeyRetrievalRateLimited)
+
+	// Attempts for other containers aren't affected.
+	_, err = RetrieveStashedRecoveryKey("", "/dev/sda2", options)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	s.now = s.now.Add(500 * time.Millisecond)
+	retrieved, err := RetrieveStashedRecoveryKey("", "/dev/sda1", options)
+	c.Check(err, IsNil)
+	c.Check(retrieved, DeepEquals, key)
+
+	s.checkAuditLog(c, log,
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now.Add(-time.Second),
+			DevicePath: "/dev/sda1",
+			Result:     RecoveryKeyRetrievalNotFound},
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now.Add(-500 * time.Millisecond),
+			DevicePath: "/dev/sda1",
+			Result:     RecoveryKeyRetrievalRateLimited},
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now.Add(-500 * time.Millisecond),
+			DevicePath: "/dev/sda2",
+			Result:     RecoveryKeyRetrievalNotFound},
+		&RecoveryKeyRetrievalRecord{
+			Time:       s.now,
+			DevicePath: "/dev/sda1",
+			Result:     RecoveryKeyRetrieved})
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyExpired(c *C) {
+	key := RecoveryKey{0x1e, 0x4e, 0xf2, 0x62, 0x84, 0x9a, 0x71, 0x3c, 0x5e, 0x8f, 0xe3, 0x9b, 0x4a, 0x4c, 0xb0, 0x3f}
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key, 5*time.Minute), IsNil)
+
+	s.now = s.now.Add(5*time.Minute + time.Second)
+
+	log := new(bytes.Buffer)
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", &RetrieveRecoveryKeyOptions{AuditLog: log})
+	c.Check(err, Equals, ErrRecoveryKeyExpired)
+
+	s.checkAuditLog(c, log, &RecoveryKeyRetrievalRecord{
+		Time:       s.now,
+		DevicePath: "/dev/sda1",
+		Result:     RecoveryKeyRetrievalExpired})
+
+	// The expired key should have been removed.
+	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "recovery", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyReplaced(c *C) {
+	key1 := RecoveryKey{0x1e, 0x4e, 0xf2, 0x62, 0x84, 0x9a, 0x71, 0x3c, 0x5e, 0x8f, 0xe3, 0x9b, 0x4a, 0x4c, 0xb0, 0x3f}
+	key2 := RecoveryKey{0xb3, 0x58, 0x2c, 0x40, 0x12, 0x9e, 0x6d, 0xa1, 0x07, 0x55, 0xc8, 0x31, 0xf4, 0x2a, 0x9b, 0x66}
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key1, 0), IsNil)
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", key2, 0), IsNil)
+
+	retrieved, err := RetrieveStashedRecoveryKey("", "/dev/sda1", nil)
+	c.Check(err, IsNil)
+	c.Check(retrieved, DeepEquals, key2)
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyNotFound(c *C) {
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", nil)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *recoveryKeyStashSuite) TestStashRecoveryKeyInKernelInvalidTimeout(c *C) {
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", RecoveryKey{}, -time.Second), ErrorMatches, "invalid timeout")
+}
+
+func (s *recoveryKeyStashSuite) TestStashRecoveryKeyInKernelPossessorOnly(c *C) {
+	c.Check(StashRecoveryKeyInKernel("", "/dev/sda1", RecoveryKey{}, 0), IsNil)
+
+	id, err := unix.KeyctlSearch(int(keyring.UserKeyring), "user", "ubuntu-fde:/dev/sda1:recovery", 0)
+	c.Assert(err, IsNil)
+	info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Assert(err, IsNil)
+
+	// Only possessors of the key have any permissions.
+	c.Check(strings.Split(info, ";")[3], Equals, "3f000000")
+}
+
+type mockFailingWriter struct{}
+
+func (*mockFailingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("some error")
+}
+
+func (s *recoveryKeyStashSuite) TestRetrieveStashedRecoveryKeyAuditLogError(c *C) {
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	_, err := RetrieveStashedRecoveryKey("", "/dev/sda1", &RetrieveRecoveryKeyOptions{AuditLog: new(mockFailingWriter)})
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	c.Check(stderr.String(), Equals, "secboot: cannot write recovery key retrieval record: some error\n")
+}
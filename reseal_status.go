@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+// ResealState describes the progress of an update to the policy that
+// protects a set of keys (a reseal).
+type ResealState string
+
+const (
+	// ResealStateNone indicates that there is no reseal in progress, and
+	// the last committed policy has been verified by a successful boot.
+	ResealStateNone ResealState = ""
+
+	// ResealStatePending indicates that a new policy has been generated but
+	// has not been committed, so the keys are still protected by the
+	// previous policy.
+	ResealStatePending ResealState = "pending"
+
+	// ResealStateCommitted indicates that a new policy has been committed
+	// but hasn't yet been verified by a successful boot.
+	ResealStateCommitted ResealState = "committed"
+)
+
+// ResealAction describes what boot logic should do based on a ResealStatus.
+type ResealAction int
+
+const (
+	// ResealActionNone indicates that the keys are expected to unlock with
+	// the current policy and no further action is required.
+	ResealActionNone ResealAction = iota
+
+	// ResealActionRetry indicates that a previous reseal was interrupted
+	// before it was committed, and should be performed again.
+	ResealActionRetry
+
+	// ResealActionRollback indicates that a committed reseal hasn't been
+	// verified after the maximum permitted number of boot attempts, and
+	// should be rolled back.
+	ResealActionRollback
+)
+
+func (a ResealAction) String() string {
+	switch a {
+	case ResealActionNone:
+		return "none"
+	case ResealActionRetry:
+		return "retry"
+	case ResealActionRollback:
+		return "rollback"
+	default:
+		return fmt.Sprintf("ResealAction(%d)", int(a))
+	}
+}
+
+// ResealStatus records the state of a reseal so that it persists across
+// boots.
+type ResealStatus struct {
+	State ResealState `json:"state,omitempty"`
+
+	// Time is the time at which State last changed.
+	Time time.Time `json:"time"`
+
+	// BootAttempts is the number of boots that have been attempted since
+	// the new policy was committed.
+	BootAttempts int `json:"boot-attempts,omitempty"`
+}
+
+// NextAction returns the action that boot logic should take based on this
+// status. If the state is ResealStateCommitted and more than maxBootAttempts
+// boots have been attempted without verifying the new policy, then
+// ResealActionRollback is returned.
+func (s *ResealStatus) NextAction(maxBootAttempts int) ResealAction {
+	switch s.State {
+	case ResealStatePending:
+		return ResealActionRetry
+	case ResealStateCommitted:
+		if s.BootAttempts > maxBootAttempts {
+			return ResealActionRollback
+		}
+		return ResealActionNone
+	default:
+		return ResealActionNone
+	}
+}
+
+// ResealStatusFile provides a mechanism to persist a ResealStatus to a file.
+// All updates are atomic.
+type ResealStatusFile struct {
+	path string
+}
+
+// NewResealStatusFile returns a new ResealStatusFile for the file at the
+// specified path.
+func NewResealStatusFile(path string) *ResealStatusFile {
+	return &ResealStatusFile{path: path}
+}
+
+// Read returns the current status. If the file doesn't exist, a status with
+// the state ResealStateNone is returned.
+func (f *ResealStatusFile) Read() (*ResealStatus, error) {
+	data, err := ioutil.ReadFile(f.path)
+	switch {
+	case os.IsNotExist(err):
+		return new(ResealStatus), nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read file: %w", err)
+	}
+
+	var status *ResealStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, xerrors.Errorf("cannot decode reseal status: %w", err)
+	}
+	if status == nil {
+		return new(ResealStatus), nil
+	}
+	return status, nil
+}
+
+func (f *ResealStatusFile) write(status *ResealStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return xerrors.Errorf("cannot encode reseal status: %w", err)
+	}
+
+	if err := osutil.AtomicWriteFile(f.path, data, 0600, 0); err != nil {
+		return xerrors.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+func (f *ResealStatusFile) setState(state ResealState) error {
+	return f.write(&ResealStatus{State: state, Time: timeNow().UTC()})
+}
+
+// MarkPending records that a new policy has been generated but not yet
+// committed. This should be called before the new policy is persisted.
+func (f *ResealStatusFile) MarkPending() error {
+	return f.setState(ResealStatePending)
+}
+
+// MarkCommitted records that a new policy has been committed. This should be
+// called after the new policy has been persisted, and it resets the number of
+// boot attempts. It is an error if the current state is not
+// ResealStatePending.
+func (f *ResealStatusFile) MarkCommitted() error {
+	status, err := f.Read()
+	if err != nil {
+		return err
+	}
+	if status.State != ResealStatePending {
+		return fmt.Errorf("unexpected reseal state %q", status.State)
+	}
+	return f.setState(ResealStateCommitted)
+}
+
+// MarkBootAttempt records a boot attempt, and should be called early during
+// each boot. If the current state is ResealStateCommitted, the number of boot
+// attempts is incremented. The updated status is returned so that the caller
+// can use it to decide what to do next.
+func (f *ResealStatusFile) MarkBootAttempt() (*ResealStatus, error) {
+	status, err := f.Read()
+	if err != nil {
+		return nil, err
+	}
+	if status.State != ResealStateCommitted {
+		return status, nil
+	}
+
+	status.BootAttempts += 1
+	if err := f.write(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MarkVerified records that the current policy has been verified by a
+// successful boot, returning the state to ResealStateNone. This should be
+// called once the booted system has confirmed that the keys were unlocked
+// with the new policy. It is also used to clear the state after a pending
+// reseal has been abandoned or a committed reseal has been rolled back.
+func (f *ResealStatusFile) MarkVerified() error {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("cannot remove file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type resealStatusSuite struct {
+	path string
+	now  time.Time
+}
+
+func (s *resealStatusSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "reseal-status")
+	s.now = time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+}
+
+var _ = Suite(&resealStatusSuite{})
+
+func (s *resealStatusSuite) mockTimeNow() (restore func()) {
+	return MockTimeNow(func() time.Time { return s.now })
+}
+
+func (s *resealStatusSuite) TestReadNoFile(c *C) {
+	status, err := NewResealStatusFile(s.path).Read()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{})
+	c.Check(status.NextAction(3), Equals, ResealActionNone)
+}
+
+func (s *resealStatusSuite) TestMarkPending(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewResealStatusFile(s.path)
+	c.Check(f.MarkPending(), IsNil)
+
+	status, err := f.Read()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{State: ResealStatePending, Time: s.now})
+	c.Check(status.NextAction(3), Equals, ResealActionRetry)
+
+	// The pending state survives across boots.
+	status, err = f.MarkBootAttempt()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{State: ResealStatePending, Time: s.now})
+}
+
+func (s *resealStatusSuite) TestMarkCommitted(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewResealStatusFile(s.path)
+	c.Check(f.MarkPending(), IsNil)
+	s.now = s.now.Add(time.Minute)
+	c.Check(f.MarkCommitted(), IsNil)
+
+	status, err := f.Read()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{State: ResealStateCommitted, Time: s.now})
+	c.Check(status.NextAction(3), Equals, ResealActionNone)
+}
+
+func (s *resealStatusSuite) TestMarkCommittedNotPending(c *C) {
+	c.Check(NewResealStatusFile(s.path).MarkCommitted(), ErrorMatches, `unexpected reseal state ""`)
+}
+
+func (s *resealStatusSuite) TestMarkBootAttempt(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewResealStatusFile(s.path)
+	c.Check(f.MarkPending(), IsNil)
+	c.Check(f.MarkCommitted(), IsNil)
+
+	for i, expected := range []ResealAction{ResealActionNone, ResealActionNone, ResealActionRollback} {
+		status, err := f.MarkBootAttempt()
+		c.Check(err, IsNil)
+		c.Check(status.BootAttempts, Equals, i+1)
+		c.Check(status.NextAction(2), Equals, expected)
+	}
+
+	status, err := f.Read()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{State: ResealStateCommitted, Time: s.now, BootAttempts: 3})
+}
+
+func (s *resealStatusSuite) TestMarkBootAttemptNone(c *C) {
+	status, err := NewResealStatusFile(s.path).MarkBootAttempt()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{})
+
+	_, err = os.Stat(s.path)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *resealStatusSuite) TestMarkVerified(c *C) {
+	f := NewResealStatusFile(s.path)
+	c.Check(f.MarkPending(), IsNil)
+	c.Check(f.MarkCommitted(), IsNil)
+	c.Check(f.MarkVerified(), IsNil)
+
+	status, err := f.Read()
+	c.Check(err, IsNil)
+	c.Check(status, DeepEquals, &ResealStatus{})
+
+	// Marking verified when there is no status is fine.
+	c.Check(f.MarkVerified(), IsNil)
+}
+
+func (s *resealStatusSuite) TestReadInvalid(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("foo"), 0600), IsNil)
+
+	_, err := NewResealStatusFile(s.path).Read()
+	c.Check(err, ErrorMatches, `cannot decode reseal status: invalid character 'o' in literal false \(expecting 'a'\)`)
+}
+
+func (s *resealStatusSuite) TestResealActionString(c *C) {
+	c.Check(ResealActionNone.String(), Equals, "none")
+	c.Check(ResealActionRetry.String(), Equals, "retry")
+	c.Check(ResealActionRollback.String(), Equals, "rollback")
+	c.Check(ResealAction(10).String(), Equals, "ResealAction(10)")
+}
@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BudgetedResource identifies a resource that is bounded by the ResourceBudget
+// configured with SetResourceBudget.
+type BudgetedResource string
+
+const (
+	// ResourceKDFMemory is the amount of memory in KiB used by passphrase
+	// key derivations.
+	ResourceKDFMemory BudgetedResource = "kdf-memory"
+
+	// ResourceTPMSessions is the number of TPM sessions that are loaded.
+	ResourceTPMSessions BudgetedResource = "tpm-sessions"
+
+	// ResourceParallelActivations is the number of volume activations that
+	// are in progress.
+	ResourceParallelActivations BudgetedResource = "parallel-activations"
+
+	// ResourceFileDescriptors is the number of file descriptors that are
+	// held open.
+	ResourceFileDescriptors BudgetedResource = "file-descriptors"
+)
+
+// ResourceBudget bounds the resources used by this package and by the
+// platform implementations, which is useful for running on devices with
+// constrained memory, such as from an initrd. Each limit applies to the
+// total use across all goroutines. A limit of zero means that the use of a
+// resource is not bounded.
+type ResourceBudget struct {
+	// MaxKDFMemoryKiB is the maximum amount of memory in KiB that can be
+	// used by concurrent passphrase key derivations. New passphrase
+	// protected keys are created with a memory cost that fits within this.
+	MaxKDFMemoryKiB uint32
+
+	// MaxTPMSessions is the maximum number of TPM sessions that can be
+	// loaded at once. Each TPM connection holds one session for its
+	// lifetime, and most operations temporarily require one more.
+	MaxTPMSessions int
+
+	// MaxParallelActivations is the maximum number of volume activations
+	// that can be in progress at once. An activation is in progress for the
+	// whole of a call to one of the ActivateVolumeWith* family of functions,
+	// including unsealing keys and passphrase key derivations.
+	MaxParallelActivations int
+
+	// MaxFileDescriptors is the maximum number of file descriptors that can
+	// be held open at once, such as for TPM connections and for passing keys
+	// to systemd-cryptsetup.
+	MaxFileDescriptors int
+}
+
+func (b *ResourceBudget) limit(resource BudgetedResource) uint64 {
+	switch resource {
+	case ResourceKDFMemory:
+		return uint64(b.MaxKDFMemoryKiB)
+	case ResourceTPMSessions:
+		return uint64(b.MaxTPMSessions)
+	case ResourceParallelActivations:
+		return uint64(b.MaxParallelActivations)
+	case ResourceFileDescriptors:
+		return uint64(b.MaxFileDescriptors)
+	default:
+		return 0
+	}
+}
+
+// ResourceBudgetExceededError is returned when an operation would exceed the
+// limit configured for a resource with SetResourceBudget.
+type ResourceBudgetExceededError struct {
+	Resource  BudgetedResource
+	Limit     uint64 // The configured limit
+	InUse     uint64 // The amount of the resource already in use
+	Requested uint64 // The amount of the resource requested
+}
+
+func (e *ResourceBudgetExceededError) Error() string {
+	return fmt.Sprintf("%s budget exceeded: %d requested with %d of %d in use", e.Resource, e.Requested, e.InUse, e.Limit)
+}
+
+var (
+	resourceBudgetMu sync.Mutex
+	resourceBudget   ResourceBudget
+	resourceUsage    = make(map[BudgetedResource]uint64)
+)
+
+// SetResourceBudget sets the limits on resource usage for this package and
+// the platform implementations. This should be called before any other
+// function in this package. Passing the zero value removes all limits, which
+// is the default.
+//
+// This returns the previously set budget.
+func SetResourceBudget(budget ResourceBudget) ResourceBudget {
+	resourceBudgetMu.Lock()
+	defer resourceBudgetMu.Unlock()
+
+	orig := resourceBudget
+	resourceBudget = budget
+	return orig
+}
+
+// CurrentResourceBudget returns the limits set with SetResourceBudget.
+func CurrentResourceBudget() ResourceBudget {
+	resourceBudgetMu.Lock()
+	defer resourceBudgetMu.Unlock()
+
+	return resourceBudget
+}
+
+// reserveResource reserves the specified amount of a resource from the
+// current budget, returning a *ResourceBudgetExceededError error if this
+// would exceed the limit. The returned function must be called to release
+// the reservation, and is safe to call more than once.
+func reserveResource(resource BudgetedResource, n uint64) (release func(), err error) {
+	resourceBudgetMu.Lock()
+	defer resourceBudgetMu.Unlock()
+
+	inUse := resourceUsage[resource]
+	if limit := resourceBudget.limit(resource); limit > 0 && inUse+n > limit {
+		return nil, &ResourceBudgetExceededError{
+			Resource:  resource,
+			Limit:     limit,
+			InUse:     inUse,
+			Requested: n}
+	}
+	resourceUsage[resource] = inUse + n
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			resourceBudgetMu.Lock()
+			defer resourceBudgetMu.Unlock()
+			resourceUsage[resource] -= n
+		})
+	}, nil
+}
+
+// ReserveTPMSessions reserves the specified number of TPM sessions from the
+// budget configured with SetResourceBudget. It is intended to be called by
+// platform implementations before loading sessions. If this would exceed the
+// budget, a *ResourceBudgetExceededError error is returned. The returned
+// function must be called to release the reservation once the sessions have
+// been flushed.
+func ReserveTPMSessions(n int) (release func(), err error) {
+	return reserveResource(ResourceTPMSessions, uint64(n))
+}
+
+// ReserveFileDescriptors reserves the specified number of file descriptors
+// from the budget configured with SetResourceBudget. It is intended to be
+// called by platform implementations before opening devices. If this would
+// exceed the budget, a *ResourceBudgetExceededError error is returned. The
+// returned function must be called to release the reservation once the file
+// descriptors have been closed.
+func ReserveFileDescriptors(n int) (release func(), err error) {
+	return reserveResource(ResourceFileDescriptors, uint64(n))
+}
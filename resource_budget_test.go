@@ -0,0 +1,169 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type resourceBudgetSuite struct {
+	testutil.KeyringTestBase
+}
+
+func (s *resourceBudgetSuite) SetUpTest(c *C) {
+	s.KeyringTestBase.SetUpTest(c)
+	s.AddCleanup(func() { SetResourceBudget(ResourceBudget{}) })
+}
+
+var _ = Suite(&resourceBudgetSuite{})
+
+func (s *resourceBudgetSuite) TestSetResourceBudget(c *C) {
+	budget := ResourceBudget{MaxKDFMemoryKiB: 65536, MaxTPMSessions: 2, MaxParallelActivations: 1, MaxFileDescriptors: 8}
+	c.Check(SetResourceBudget(budget), DeepEquals, ResourceBudget{})
+	c.Check(CurrentResourceBudget(), DeepEquals, budget)
+	c.Check(SetResourceBudget(ResourceBudget{}), DeepEquals, budget)
+}
+
+func (s *resourceBudgetSuite) TestReserveTPMSessionsUnlimited(c *C) {
+	release, err := ReserveTPMSessions(100)
+	c.Assert(err, IsNil)
+	release()
+}
+
+func (s *resourceBudgetSuite) TestReserveTPMSessions(c *C) {
+	SetResourceBudget(ResourceBudget{MaxTPMSessions: 3})
+
+	release1, err := ReserveTPMSessions(1)
+	c.Assert(err, IsNil)
+	release2, err := ReserveTPMSessions(2)
+	c.Assert(err, IsNil)
+
+	_, err = ReserveTPMSessions(1)
+	c.Check(err, ErrorMatches, `tpm-sessions budget exceeded: 1 requested with 3 of 3 in use`)
+	c.Check(err, DeepEquals, &ResourceBudgetExceededError{
+		Resource:  ResourceTPMSessions,
+		Limit:     3,
+		InUse:     3,
+		Requested: 1})
+
+	release2()
+	release2() // Releasing more than once has no effect.
+
+	release3, err := ReserveTPMSessions(2)
+	c.Check(err, IsNil)
+	release3()
+	release1()
+}
+
+func (s *resourceBudgetSuite) TestParallelActivations(c *C) {
+	SetResourceBudget(ResourceBudget{MaxParallelActivations: 1})
+
+	var innerErr error
+	executor := &reentrantActivationExecutor{fn: func() {
+		innerErr = ActivateVolumeWithKey("data2", "/dev/sda2", []byte{1, 2, 3, 4}, nil)
+	}}
+	SetActivationExecutor(executor)
+	defer SetActivationExecutor(nil)
+
+	c.Check(ActivateVolumeWithKey("data1", "/dev/sda1", []byte{1, 2, 3, 4}, nil), IsNil)
+	c.Check(innerErr, ErrorMatches, `parallel-activations budget exceeded: 1 requested with 1 of 1 in use`)
+	c.Check(executor.calls, Equals, 1)
+
+	// The reservation is released when activation completes.
+	executor.fn = nil
+	c.Check(ActivateVolumeWithKey("data1", "/dev/sda1", []byte{1, 2, 3, 4}, nil), IsNil)
+	c.Check(executor.calls, Equals, 2)
+}
+
+type reentrantAuthRequestor struct {
+	fn func()
+}
+
+func (r *reentrantAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (r *reentrantAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	r.fn()
+	return RecoveryKey{}, nil
+}
+
+func (s *resourceBudgetSuite) TestParallelActivationsHeldDuringKeyRecovery(c *C) {
+	// The reservation should be held for the whole activation, not just
+	// for the final step.
+	SetResourceBudget(ResourceBudget{MaxParallelActivations: 1})
+
+	executor := new(reentrantActivationExecutor)
+	SetActivationExecutor(executor)
+	defer SetActivationExecutor(nil)
+
+	var innerErr error
+	authRequestor := &reentrantAuthRequestor{fn: func() {
+		innerErr = ActivateVolumeWithKey("data2", "/dev/sda2", []byte{1, 2, 3, 4}, nil)
+	}}
+
+	c.Check(ActivateVolumeWithRecoveryKey("data1", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 1}), IsNil)
+	c.Check(innerErr, ErrorMatches, `parallel-activations budget exceeded: 1 requested with 1 of 1 in use`)
+	c.Check(executor.calls, Equals, 1)
+}
+
+func (s *resourceBudgetSuite) TestReserveFileDescriptors(c *C) {
+	SetResourceBudget(ResourceBudget{MaxFileDescriptors: 2})
+
+	release, err := ReserveFileDescriptors(2)
+	c.Assert(err, IsNil)
+
+	_, err = ReserveFileDescriptors(1)
+	c.Check(err, ErrorMatches, `file-descriptors budget exceeded: 1 requested with 2 of 2 in use`)
+
+	release()
+	release, err = ReserveFileDescriptors(1)
+	c.Check(err, IsNil)
+	release()
+}
+
+func (s *resourceBudgetSuite) TestActivateVolumeFileDescriptors(c *C) {
+	// The default executor supplies the key via a pipe, which requires
+	// 2 file descriptors.
+	SetResourceBudget(ResourceBudget{MaxFileDescriptors: 1})
+
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", []byte{1, 2, 3, 4}, nil), ErrorMatches,
+		`file-descriptors budget exceeded: 2 requested with 0 of 1 in use`)
+}
+
+type reentrantActivationExecutor struct {
+	calls int
+	fn    func()
+}
+
+func (e *reentrantActivationExecutor) ActivateVolume(volumeName, sourceDevicePath string, key []byte, keyslot int) error {
+	e.calls += 1
+	if e.fn != nil {
+		fn := e.fn
+		e.fn = nil
+		fn()
+	}
+	return nil
+}
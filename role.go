@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const (
+	// RoleRun is the role for keys that unlock volumes in normal run mode.
+	RoleRun = "run"
+
+	// RoleRecover is the role for keys that unlock volumes in recovery mode.
+	RoleRecover = "recover"
+
+	// RoleRunRecover is the role for keys that unlock volumes in both
+	// normal run mode and recovery mode.
+	RoleRunRecover = "run+recover"
+)
+
+// maxRoleLen is the maximum length of a role. This is constrained by the
+// length prefix used to store the role in a protector key file.
+const maxRoleLen = 255
+
+// roleRegexp matches valid role names. These only contain lower case letters,
+// digits, '-' and '+', which means that there is only one way to express a
+// particular role and that roles can never be confused with the fixed labels
+// used internally for key derivation (such as "UNLOCK").
+var roleRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+-]*$`)
+
+var roles = map[string]string{
+	RoleRun:        "unlock volumes in run mode",
+	RoleRecover:    "unlock volumes in recovery mode",
+	RoleRunRecover: "unlock volumes in run mode and recovery mode",
+}
+
+// RoleExistsError is returned from RegisterRole if the specified role
+// is already registered.
+type RoleExistsError struct {
+	Role string
+}
+
+func (e *RoleExistsError) Error() string {
+	return fmt.Sprintf("role %q is already registered", e.Role)
+}
+
+// ValidateRoleName checks that the supplied role is a valid name. A valid
+// role is a non-empty string of no more than 255 characters which starts with
+// a lower case letter or digit, and otherwise only contains lower case letters,
+// digits, '-' and '+'.
+func ValidateRoleName(role string) error {
+	if len(role) > maxRoleLen {
+		return fmt.Errorf("invalid role %q: too long", role)
+	}
+	if !roleRegexp.MatchString(role) {
+		return fmt.Errorf("invalid role %q: must start with a lower case letter or digit and only contain lower case letters, digits, '-' and '+'", role)
+	}
+	return nil
+}
+
+// RegisterRole registers an additional role, such as one for a new type of
+// volume (eg, "swap" or "var-log"). The description is informational. The
+// role must be a valid name according to ValidateRoleName, and a
+// *RoleExistsError error is returned if it is already registered, including if
+// it is one of the roles defined by this package.
+//
+// This is not safe to call concurrently with other functions that access the
+// role registry, and is intended to be called during initialization.
+func RegisterRole(role, description string) error {
+	if err := ValidateRoleName(role); err != nil {
+		return err
+	}
+	if _, exists := roles[role]; exists {
+		return &RoleExistsError{Role: role}
+	}
+	roles[role] = description
+	return nil
+}
+
+// IsRegisteredRole indicates whether the specified role has been registered,
+// either because it is defined by this package or because it was registered
+// with RegisterRole.
+func IsRegisteredRole(role string) bool {
+	_, exists := roles[role]
+	return exists
+}
+
+// RegisteredRoles returns all of the registered roles in sorted order.
+func RegisteredRoles() []string {
+	var out []string
+	for role := range roles {
+		out = append(out, role)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// RoleDescription returns the description of the specified role, and false
+// if it isn't registered.
+func RoleDescription(role string) (string, bool) {
+	description, exists := roles[role]
+	return description, exists
+}
+
+// RoleDerivationLabel returns the label that is used to bind keys that are
+// derived for a specific role to that role. This is the role string encoded as
+// bytes. It is used as the salt when deriving the role specific key that
+// authorizes a key data scope, and as the policy reference for the PCR
+// policies of keys protected by a TPM. Because roles are compared as exact
+// byte strings, keys derived for different roles are always distinct.
+//
+// This doesn't require the role to be registered, which permits key data
+// created with arbitrary roles by earlier releases to continue to be used.
+func RoleDerivationLabel(role string) []byte {
+	return []byte(role)
+}
@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type roleSuite struct {
+	restore func()
+}
+
+func (s *roleSuite) SetUpTest(c *C) {
+	s.restore = MockRoles()
+}
+
+func (s *roleSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+var _ = Suite(&roleSuite{})
+
+func (s *roleSuite) TestBuiltinRoles(c *C) {
+	c.Check(RegisteredRoles(), DeepEquals, []string{"recover", "run", "run+recover"})
+	for _, role := range []string{RoleRun, RoleRecover, RoleRunRecover} {
+		c.Check(IsRegisteredRole(role), Equals, true)
+	}
+	c.Check(IsRegisteredRole("swap"), Equals, false)
+}
+
+func (s *roleSuite) TestRegisterRole(c *C) {
+	c.Check(RegisterRole("swap", "unlock swap volumes"), IsNil)
+	c.Check(RegisterRole("var-log", "unlock log volumes"), IsNil)
+	c.Check(IsRegisteredRole("swap"), Equals, true)
+	c.Check(IsRegisteredRole("var-log"), Equals, true)
+	c.Check(RegisteredRoles(), DeepEquals, []string{"recover", "run", "run+recover", "swap", "var-log"})
+
+	description, ok := RoleDescription("swap")
+	c.Check(ok, Equals, true)
+	c.Check(description, Equals, "unlock swap volumes")
+
+	_, ok = RoleDescription("foo")
+	c.Check(ok, Equals, false)
+}
+
+func (s *roleSuite) TestRegisterRoleExists(c *C) {
+	c.Check(RegisterRole("swap", ""), IsNil)
+
+	err := RegisterRole("swap", "")
+	c.Check(err, ErrorMatches, `role "swap" is already registered`)
+	c.Check(err, DeepEquals, &RoleExistsError{Role: "swap"})
+}
+
+func (s *roleSuite) TestRegisterRoleBuiltinExists(c *C) {
+	c.Check(RegisterRole(RoleRun, ""), DeepEquals, &RoleExistsError{Role: RoleRun})
+}
+
+func (s *roleSuite) TestRegisterRoleInvalid(c *C) {
+	for _, role := range []string{"", "Swap", "UNLOCK", "var_log", "-swap", "+run", "var log", "swap/1"} {
+		c.Check(RegisterRole(role, ""), ErrorMatches, `invalid role ".*": must start with a lower case letter or digit and only contain lower case letters, digits, '-' and '\+'`, Commentf("role: %q", role))
+		c.Check(IsRegisteredRole(role), Equals, false)
+	}
+}
+
+func (s *roleSuite) TestRegisterRoleTooLong(c *C) {
+	c.Check(RegisterRole(strings.Repeat("a", 256), ""), ErrorMatches, `invalid role "a+": too long`)
+	c.Check(RegisterRole(strings.Repeat("a", 255), ""), IsNil)
+}
+
+func (s *roleSuite) TestRoleDerivationLabel(c *C) {
+	c.Check(RoleDerivationLabel(RoleRun), DeepEquals, []byte("run"))
+	c.Check(RoleDerivationLabel("unregistered"), DeepEquals, []byte("unregistered"))
+	c.Check(RoleDerivationLabel(""), DeepEquals, []byte{})
+}
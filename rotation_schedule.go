@@ -0,0 +1,212 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+// RotationAction describes a periodic maintenance action for a set of keys.
+type RotationAction int
+
+const (
+	// RotationActionReseal indicates that the policy that protects a set
+	// of keys should be updated.
+	RotationActionReseal RotationAction = iota + 1
+
+	// RotationActionRotateRecoveryKey indicates that the recovery key for
+	// a set of encrypted volumes should be replaced.
+	RotationActionRotateRecoveryKey
+)
+
+func (a RotationAction) String() string {
+	switch a {
+	case RotationActionReseal:
+		return "reseal"
+	case RotationActionRotateRecoveryKey:
+		return "rotate-recovery-key"
+	default:
+		return fmt.Sprintf("RotationAction(%d)", int(a))
+	}
+}
+
+// RotationSchedule describes how often keys should be resealed and how
+// often the recovery key should be rotated, along with when these actions
+// were last performed. A zero interval disables the corresponding action.
+type RotationSchedule struct {
+	// ResealIntervalDays is the number of days between reseals.
+	ResealIntervalDays int `json:"reseal-interval-days,omitempty"`
+
+	// RecoveryKeyRotationMonths is the number of months between recovery
+	// key rotations.
+	RecoveryKeyRotationMonths int `json:"recovery-key-rotation-months,omitempty"`
+
+	// LastReseal is the time of the last reseal. If this is zero, a
+	// reseal is due immediately.
+	LastReseal time.Time `json:"last-reseal"`
+
+	// LastRecoveryKeyRotation is the time of the last recovery key
+	// rotation. If this is zero, a rotation is due immediately.
+	LastRecoveryKeyRotation time.Time `json:"last-recovery-key-rotation"`
+}
+
+// NextReseal returns the time at which the next reseal is due. If reseals
+// are disabled, the zero time is returned.
+func (s *RotationSchedule) NextReseal() time.Time {
+	if s.ResealIntervalDays <= 0 {
+		return time.Time{}
+	}
+	if s.LastReseal.IsZero() {
+		return timeNow().UTC()
+	}
+	return s.LastReseal.AddDate(0, 0, s.ResealIntervalDays)
+}
+
+// NextRecoveryKeyRotation returns the time at which the next recovery key
+// rotation is due. If rotations are disabled, the zero time is returned.
+func (s *RotationSchedule) NextRecoveryKeyRotation() time.Time {
+	if s.RecoveryKeyRotationMonths <= 0 {
+		return time.Time{}
+	}
+	if s.LastRecoveryKeyRotation.IsZero() {
+		return timeNow().UTC()
+	}
+	return s.LastRecoveryKeyRotation.AddDate(0, s.RecoveryKeyRotationMonths, 0)
+}
+
+// NextActions returns the actions that are currently due, in the order in
+// which they should be performed. This is intended to be called
+// periodically, eg, from a timer.
+func (s *RotationSchedule) NextActions() []RotationAction {
+	now := timeNow()
+
+	var actions []RotationAction
+	if next := s.NextReseal(); !next.IsZero() && !now.Before(next) {
+		actions = append(actions, RotationActionReseal)
+	}
+	if next := s.NextRecoveryKeyRotation(); !next.IsZero() && !now.Before(next) {
+		actions = append(actions, RotationActionRotateRecoveryKey)
+	}
+	return actions
+}
+
+// RotationScheduleFile provides a mechanism to persist a RotationSchedule to
+// a file. All updates are atomic.
+type RotationScheduleFile struct {
+	path string
+}
+
+// NewRotationScheduleFile returns a new RotationScheduleFile for the file at
+// the specified path.
+func NewRotationScheduleFile(path string) *RotationScheduleFile {
+	return &RotationScheduleFile{path: path}
+}
+
+// Read returns the current schedule. If the file doesn't exist, an empty
+// schedule with all actions disabled is returned.
+func (f *RotationScheduleFile) Read() (*RotationSchedule, error) {
+	data, err := ioutil.ReadFile(f.path)
+	switch {
+	case os.IsNotExist(err):
+		return new(RotationSchedule), nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read file: %w", err)
+	}
+
+	var schedule *RotationSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, xerrors.Errorf("cannot decode rotation schedule: %w", err)
+	}
+	if schedule == nil {
+		return new(RotationSchedule), nil
+	}
+	return schedule, nil
+}
+
+// Write persists the supplied schedule.
+func (f *RotationScheduleFile) Write(schedule *RotationSchedule) error {
+	if schedule.ResealIntervalDays < 0 {
+		return fmt.Errorf("invalid reseal interval %d", schedule.ResealIntervalDays)
+	}
+	if schedule.RecoveryKeyRotationMonths < 0 {
+		return fmt.Errorf("invalid recovery key rotation interval %d", schedule.RecoveryKeyRotationMonths)
+	}
+
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return xerrors.Errorf("cannot encode rotation schedule: %w", err)
+	}
+
+	if err := osutil.AtomicWriteFile(f.path, data, 0600, 0); err != nil {
+		return xerrors.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+// SetIntervals updates the intervals of the persisted schedule without
+// changing when actions were last performed.
+func (f *RotationScheduleFile) SetIntervals(resealDays, recoveryKeyMonths int) error {
+	schedule, err := f.Read()
+	if err != nil {
+		return err
+	}
+	schedule.ResealIntervalDays = resealDays
+	schedule.RecoveryKeyRotationMonths = recoveryKeyMonths
+	return f.Write(schedule)
+}
+
+// MarkDone records that the specified action has been performed at the
+// current time. This should be called once the action has completed
+// successfully.
+func (f *RotationScheduleFile) MarkDone(action RotationAction) error {
+	schedule, err := f.Read()
+	if err != nil {
+		return err
+	}
+
+	now := timeNow().UTC()
+	switch action {
+	case RotationActionReseal:
+		schedule.LastReseal = now
+	case RotationActionRotateRecoveryKey:
+		schedule.LastRecoveryKeyRotation = now
+	default:
+		return fmt.Errorf("invalid rotation action %v", action)
+	}
+	return f.Write(schedule)
+}
+
+// NextActions reads the persisted schedule and returns the actions that are
+// currently due. See RotationSchedule.NextActions.
+func (f *RotationScheduleFile) NextActions() ([]RotationAction, error) {
+	schedule, err := f.Read()
+	if err != nil {
+		return nil, err
+	}
+	return schedule.NextActions(), nil
+}
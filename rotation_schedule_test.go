@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type rotationScheduleSuite struct {
+	path string
+	now  time.Time
+}
+
+func (s *rotationScheduleSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "rotation-schedule")
+	s.now = time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+}
+
+var _ = Suite(&rotationScheduleSuite{})
+
+func (s *rotationScheduleSuite) mockTimeNow() (restore func()) {
+	return MockTimeNow(func() time.Time { return s.now })
+}
+
+func (s *rotationScheduleSuite) TestReadNoFile(c *C) {
+	defer s.mockTimeNow()()
+
+	schedule, err := NewRotationScheduleFile(s.path).Read()
+	c.Check(err, IsNil)
+	c.Check(schedule, DeepEquals, &RotationSchedule{})
+	c.Check(schedule.NextActions(), HasLen, 0)
+	c.Check(schedule.NextReseal().IsZero(), Equals, true)
+	c.Check(schedule.NextRecoveryKeyRotation().IsZero(), Equals, true)
+}
+
+func (s *rotationScheduleSuite) TestNeverPerformed(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewRotationScheduleFile(s.path)
+	c.Check(f.SetIntervals(30, 6), IsNil)
+
+	actions, err := f.NextActions()
+	c.Check(err, IsNil)
+	c.Check(actions, DeepEquals, []RotationAction{RotationActionReseal, RotationActionRotateRecoveryKey})
+}
+
+func (s *rotationScheduleSuite) TestSchedule(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewRotationScheduleFile(s.path)
+	c.Check(f.SetIntervals(30, 6), IsNil)
+	c.Check(f.MarkDone(RotationActionReseal), IsNil)
+	c.Check(f.MarkDone(RotationActionRotateRecoveryKey), IsNil)
+
+	schedule, err := f.Read()
+	c.Assert(err, IsNil)
+	c.Check(schedule, DeepEquals, &RotationSchedule{
+		ResealIntervalDays:        30,
+		RecoveryKeyRotationMonths: 6,
+		LastReseal:                s.now,
+		LastRecoveryKeyRotation:   s.now})
+	c.Check(schedule.NextReseal(), Equals, time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC))
+	c.Check(schedule.NextRecoveryKeyRotation(), Equals, time.Date(2024, 12, 1, 10, 0, 0, 0, time.UTC))
+
+	for _, t := range []struct {
+		now      time.Time
+		expected []RotationAction
+	}{
+		{now: time.Date(2024, 6, 30, 10, 0, 0, 0, time.UTC)},
+		{now: time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC), expected: []RotationAction{RotationActionReseal}},
+		{now: time.Date(2024, 12, 1, 10, 0, 0, 0, time.UTC), expected: []RotationAction{RotationActionReseal, RotationActionRotateRecoveryKey}},
+	} {
+		s.now = t.now
+		actions, err := f.NextActions()
+		c.Check(err, IsNil)
+		c.Check(actions, DeepEquals, t.expected)
+	}
+
+	// Performing a reseal moves the next one along.
+	c.Check(f.MarkDone(RotationActionReseal), IsNil)
+	actions, err := f.NextActions()
+	c.Check(err, IsNil)
+	c.Check(actions, DeepEquals, []RotationAction{RotationActionRotateRecoveryKey})
+}
+
+func (s *rotationScheduleSuite) TestSetIntervalsPreservesHistory(c *C) {
+	defer s.mockTimeNow()()
+
+	f := NewRotationScheduleFile(s.path)
+	c.Check(f.MarkDone(RotationActionReseal), IsNil)
+	c.Check(f.SetIntervals(7, 0), IsNil)
+
+	schedule, err := f.Read()
+	c.Assert(err, IsNil)
+	c.Check(schedule, DeepEquals, &RotationSchedule{ResealIntervalDays: 7, LastReseal: s.now})
+	c.Check(schedule.NextActions(), HasLen, 0)
+}
+
+func (s *rotationScheduleSuite) TestInvalidIntervals(c *C) {
+	f := NewRotationScheduleFile(s.path)
+	c.Check(f.SetIntervals(-1, 0), ErrorMatches, `invalid reseal interval -1`)
+	c.Check(f.SetIntervals(0, -2), ErrorMatches, `invalid recovery key rotation interval -2`)
+}
+
+func (s *rotationScheduleSuite) TestMarkDoneInvalidAction(c *C) {
+	c.Check(NewRotationScheduleFile(s.path).MarkDone(RotationAction(10)), ErrorMatches, `invalid rotation action RotationAction\(10\)`)
+}
+
+func (s *rotationScheduleSuite) TestReadInvalid(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("foo"), 0600), IsNil)
+
+	_, err := NewRotationScheduleFile(s.path).Read()
+	c.Check(err, ErrorMatches, `cannot decode rotation schedule: invalid character 'o' in literal false \(expecting 'a'\)`)
+}
+
+func (s *rotationScheduleSuite) TestRotationActionString(c *C) {
+	c.Check(RotationActionReseal.String(), Equals, "reseal")
+	c.Check(RotationActionRotateRecoveryKey.String(), Equals, "rotate-recovery-key")
+	c.Check(RotationAction(10).String(), Equals, "RotationAction(10)")
+}
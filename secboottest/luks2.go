@@ -0,0 +1,241 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboottest
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// DefaultLUKS2TestVolumeSizeMiB is the default size of the disk image backing a
+// LUKS2TestVolume.
+const DefaultLUKS2TestVolumeSizeMiB = 32
+
+// LUKS2TestVolumeOptions carries options for creating a LUKS2TestVolume.
+type LUKS2TestVolumeOptions struct {
+	// SizeMiB is the size of the backing disk image in MiB. If this is
+	// zero, DefaultLUKS2TestVolumeSizeMiB is used.
+	SizeMiB int
+
+	// Label is the label of the LUKS2 container. If this is empty,
+	// "secboottest" is used.
+	Label string
+}
+
+// LUKS2TestVolume is a disposable LUKS2 container, backed by a disk image
+// attached to a loop device. Creating one requires the losetup and cryptsetup
+// commands and permission to create loop devices, which normally means that the
+// test must run as root.
+type LUKS2TestVolume struct {
+	// ImagePath is the path of the disk image that backs this volume.
+	ImagePath string
+
+	// DevicePath is the path of the loop device that the disk image is
+	// attached to, and is the source device path of the LUKS2 container.
+	DevicePath string
+
+	// Key is the key for the initial keyslot, which has the name "default".
+	Key secboot.DiskUnlockKey
+
+	activated []string
+}
+
+// NewLUKS2TestVolume creates a new disk image in the specified directory,
+// attaches it to a loop device and initializes it as a LUKS2 container with a
+// randomly generated key. The volume must be cleaned up with Close when it is no
+// longer required. If any part of this fails, everything that was created is
+// cleaned up again.
+func NewLUKS2TestVolume(dir string, opts *LUKS2TestVolumeOptions) (*LUKS2TestVolume, error) {
+	if opts == nil {
+		opts = new(LUKS2TestVolumeOptions)
+	}
+	size := opts.SizeMiB
+	if size == 0 {
+		size = DefaultLUKS2TestVolumeSizeMiB
+	}
+	label := opts.Label
+	if label == "" {
+		label = "secboottest"
+	}
+
+	f, err := os.CreateTemp(dir, "luks2-*.img")
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create disk image: %w", err)
+	}
+	vol := &LUKS2TestVolume{ImagePath: f.Name()}
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		vol.Close()
+	}()
+
+	err = f.Truncate(int64(size) * 1024 * 1024)
+	f.Close()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot resize disk image: %w", err)
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", vol.ImagePath).Output()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot attach disk image to loop device: %w", err)
+	}
+	vol.DevicePath = strings.TrimSpace(string(out))
+	if vol.DevicePath == "" {
+		return nil, errors.New("cannot attach disk image to loop device: no device path returned")
+	}
+
+	vol.Key = make(secboot.DiskUnlockKey, 32)
+	if _, err := rand.Read(vol.Key); err != nil {
+		return nil, xerrors.Errorf("cannot generate key: %w", err)
+	}
+
+	if err := secboot.InitializeLUKS2Container(vol.DevicePath, label, vol.Key, nil); err != nil {
+		return nil, xerrors.Errorf("cannot initialize LUKS2 container: %w", err)
+	}
+
+	succeeded = true
+	return vol, nil
+}
+
+// EnrollTPMProtectedKey creates a new key protected by the supplied TPM
+// connection with the supplied parameters, adds it to a new keyslot with the
+// specified name and stores the protected key data in the keyslot's token, so
+// that it is used by secboot.ActivateVolumeWithKeyData. The primary key of the
+// new key is returned.
+func (v *LUKS2TestVolume) EnrollTPMProtectedKey(tpm *secboot_tpm2.Connection, keyslotName string, params *secboot_tpm2.ProtectKeyParams) (secboot.PrimaryKey, error) {
+	kd, primaryKey, unlockKey, err := secboot_tpm2.NewTPMProtectedKey(tpm, params)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create TPM protected key: %w", err)
+	}
+	if err := secboot.AddLUKS2ContainerUnlockKey(v.DevicePath, keyslotName, v.Key, unlockKey); err != nil {
+		return nil, xerrors.Errorf("cannot add unlock key: %w", err)
+	}
+	if err := secboot.ImportKeyDataToLUKS2Container(v.DevicePath, keyslotName, kd, 0); err != nil {
+		return nil, xerrors.Errorf("cannot import key data: %w", err)
+	}
+	return primaryKey, nil
+}
+
+// Activate activates this volume with secboot.ActivateVolumeWithKeyData using
+// the key data stored in its tokens, creating a mapping with the specified name.
+// If options is nil, a default set of options is used. A mapping that is created
+// by this is removed again by Close. Note that secboot.ErrRecoveryKeyUsed is
+// returned if the volume was activated with a recovery key.
+func (v *LUKS2TestVolume) Activate(volumeName string, authRequestor secboot.AuthRequestor, options *secboot.ActivateVolumeOptions) error {
+	if options == nil {
+		options = new(secboot.ActivateVolumeOptions)
+	}
+	err := secboot.ActivateVolumeWithKeyData(volumeName, v.DevicePath, authRequestor, options)
+	if err == nil || err == secboot.ErrRecoveryKeyUsed {
+		v.activated = append(v.activated, volumeName)
+	}
+	return err
+}
+
+// Close removes any mappings created by Activate, detaches the loop device and
+// removes the disk image. It attempts all of these steps even if one of them
+// fails, and returns the first error.
+func (v *LUKS2TestVolume) Close() error {
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, name := range v.activated {
+		if err := secboot.DeactivateVolume(name); err != nil {
+			setErr(xerrors.Errorf("cannot deactivate volume %s: %w", name, err))
+		}
+	}
+	v.activated = nil
+
+	if v.DevicePath != "" {
+		if out, err := exec.Command("losetup", "--detach", v.DevicePath).CombinedOutput(); err != nil {
+			setErr(xerrors.Errorf("cannot detach loop device %s: %v", v.DevicePath, osutil.OutputErr(out, err)))
+		}
+		v.DevicePath = ""
+	}
+
+	if v.ImagePath != "" {
+		if err := os.Remove(v.ImagePath); err != nil && !os.IsNotExist(err) {
+			setErr(xerrors.Errorf("cannot remove disk image: %w", err))
+		}
+		v.ImagePath = ""
+	}
+
+	return firstErr
+}
+
+// RunTPMActivationTest performs an end-to-end test of TPM protected keys with a
+// disposable LUKS2 volume. It creates a LUKS2TestVolume in the specified
+// directory, enrolls a key protected by the TPM simulator on the specified port
+// with the supplied parameters in a keyslot named "tpm", and then activates it
+// with the specified volume name with the TPM simulator mocked as the default TPM,
+// as would happen during early boot. The supplied callback is then executed with
+// the activated volume. Everything is cleaned up before this function returns,
+// regardless of whether it succeeded.
+//
+// The TPM simulator must already be running, and the storage hierarchy must
+// have an empty authorization value.
+func RunTPMActivationTest(dir string, port uint, volumeName string, params *secboot_tpm2.ProtectKeyParams, fn func(vol *LUKS2TestVolume) error) (err error) {
+	vol, err := NewLUKS2TestVolume(dir, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := vol.Close(); closeErr != nil && err == nil {
+			err = xerrors.Errorf("cannot clean up volume: %w", closeErr)
+		}
+	}()
+
+	restore := MockTPMSimulatorAsDefaultTPM(port)
+	defer restore()
+
+	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return xerrors.Errorf("cannot connect to TPM simulator: %w", err)
+	}
+	defer tpm.Close()
+
+	if _, err := vol.EnrollTPMProtectedKey(tpm, "tpm", params); err != nil {
+		return err
+	}
+
+	if err := vol.Activate(volumeName, nil, nil); err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
+	}
+
+	if fn == nil {
+		return nil
+	}
+	return fn(vol)
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboottest_test
+
+import (
+	"os"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/secboottest"
+)
+
+// mockCryptsetupBottom makes the mock cryptsetup look like a version that
+// supports all of the features used by secboot.
+const mockCryptsetupBottom = `if [ "$1" = "--version" ]; then echo "cryptsetup 2.4.3"; exit 0; fi
+`
+
+type luks2Suite struct {
+	snapd_testutil.BaseTest
+	dir        string
+	losetup    *snapd_testutil.MockCmd
+	cryptsetup *snapd_testutil.MockCmd
+}
+
+var _ = Suite(&luks2Suite{})
+
+func (s *luks2Suite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.dir = c.MkDir()
+	s.losetup = snapd_testutil.MockCommand(c, "losetup", `if [ "$1" = "--find" ]; then echo /dev/loop7; fi`)
+	s.AddCleanup(s.losetup.Restore)
+	s.cryptsetup = snapd_testutil.MockCommand(c, "cryptsetup", mockCryptsetupBottom)
+	s.AddCleanup(s.cryptsetup.Restore)
+}
+
+func (s *luks2Suite) luksFormatCall(c *C) []string {
+	for _, call := range s.cryptsetup.Calls() {
+		for _, arg := range call {
+			if arg == "luksFormat" {
+				return call
+			}
+		}
+	}
+	c.Fatal("no luksFormat call")
+	return nil
+}
+
+func (s *luks2Suite) TestNewLUKS2TestVolume(c *C) {
+	vol, err := NewLUKS2TestVolume(s.dir, nil)
+	c.Assert(err, IsNil)
+	c.Check(vol.DevicePath, Equals, "/dev/loop7")
+	c.Check(vol.Key, HasLen, 32)
+	c.Check(filepath.Dir(vol.ImagePath), Equals, s.dir)
+
+	fi, err := os.Stat(vol.ImagePath)
+	c.Assert(err, IsNil)
+	c.Check(fi.Size(), Equals, int64(DefaultLUKS2TestVolumeSizeMiB*1024*1024))
+
+	c.Check(s.losetup.Calls(), DeepEquals, [][]string{{"losetup", "--find", "--show", vol.ImagePath}})
+	c.Check(s.luksFormatCall(c), snapd_testutil.Contains, "secboottest")
+
+	imagePath := vol.ImagePath
+	c.Check(vol.Close(), IsNil)
+	c.Check(s.losetup.Calls()[1], DeepEquals, []string{"losetup", "--detach", "/dev/loop7"})
+	_, err = os.Stat(imagePath)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *luks2Suite) TestNewLUKS2TestVolumeWithOptions(c *C) {
+	vol, err := NewLUKS2TestVolume(s.dir, &LUKS2TestVolumeOptions{SizeMiB: 64, Label: "foo"})
+	c.Assert(err, IsNil)
+	defer vol.Close()
+
+	fi, err := os.Stat(vol.ImagePath)
+	c.Assert(err, IsNil)
+	c.Check(fi.Size(), Equals, int64(64*1024*1024))
+	c.Check(s.luksFormatCall(c), snapd_testutil.Contains, "foo")
+}
+
+func (s *luks2Suite) TestNewLUKS2TestVolumeLosetupFails(c *C) {
+	s.losetup.Restore()
+	s.losetup = snapd_testutil.MockCommand(c, "losetup", `exit 1`)
+
+	_, err := NewLUKS2TestVolume(s.dir, nil)
+	c.Check(err, ErrorMatches, `cannot attach disk image to loop device: exit status 1`)
+
+	// The disk image is cleaned up.
+	entries, err := os.ReadDir(s.dir)
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *luks2Suite) TestNewLUKS2TestVolumeCryptsetupFails(c *C) {
+	s.cryptsetup.Restore()
+	s.cryptsetup = snapd_testutil.MockCommand(c, "cryptsetup", mockCryptsetupBottom+`echo "some error" >&2; exit 1`)
+
+	_, err := NewLUKS2TestVolume(s.dir, nil)
+	c.Check(err, ErrorMatches, `cannot initialize LUKS2 container: cannot format: .*`)
+
+	// The loop device is detached and the disk image is cleaned up.
+	c.Check(s.losetup.Calls()[1], DeepEquals, []string{"losetup", "--detach", "/dev/loop7"})
+	entries, err := os.ReadDir(s.dir)
+	c.Check(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *luks2Suite) TestCloseDetachFails(c *C) {
+	vol, err := NewLUKS2TestVolume(s.dir, nil)
+	c.Assert(err, IsNil)
+
+	s.losetup.Restore()
+	s.losetup = snapd_testutil.MockCommand(c, "losetup", `echo "busy" >&2; exit 1`)
+
+	imagePath := vol.ImagePath
+	c.Check(vol.Close(), ErrorMatches, `cannot detach loop device /dev/loop7: busy`)
+
+	// The disk image is still removed.
+	_, err = os.Stat(imagePath)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
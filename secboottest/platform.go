@@ -0,0 +1,300 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboottest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/snapcore/secboot"
+)
+
+// MockPlatformDeviceState describes the state of the platform device simulated by
+// a MockPlatformKeyDataHandler.
+type MockPlatformDeviceState int
+
+const (
+	// MockPlatformDeviceStateOK indicates that the platform device is available
+	// and initialized.
+	MockPlatformDeviceStateOK MockPlatformDeviceState = iota
+
+	// MockPlatformDeviceStateUnavailable indicates that the platform device is
+	// unavailable, which results in a secboot.PlatformHandlerErrorUnavailable
+	// error.
+	MockPlatformDeviceStateUnavailable
+
+	// MockPlatformDeviceStateUninitialized indicates that the platform device is
+	// not initialized, which results in a secboot.PlatformHandlerErrorUninitialized
+	// error.
+	MockPlatformDeviceStateUninitialized
+)
+
+// MockPlatformKeyDataHandle is the platform handle for key data protected by a
+// MockPlatformKeyDataHandler.
+type MockPlatformKeyDataHandle struct {
+	Key                []byte           `json:"key"`
+	IV                 []byte           `json:"iv"`
+	AuthKeyHMAC        []byte           `json:"auth-key-hmac"`
+	ExpectedGeneration int              `json:"exp-generation"`
+	ExpectedKDFAlg     crypto.Hash      `json:"exp-kdf_alg"`
+	ExpectedAuthMode   secboot.AuthMode `json:"exp-auth-mode"`
+}
+
+// MockPlatformKeyDataHandler is an implementation of secboot.PlatformKeyDataHandler
+// that protects keys without a platform device. This is only intended for testing and
+// is not meant to be secure in any way.
+type MockPlatformKeyDataHandler struct {
+	// State is the state of the simulated platform device.
+	State MockPlatformDeviceState
+
+	// PassphraseSupport indicates whether the handler supports keys with
+	// passphrases.
+	PassphraseSupport bool
+}
+
+// RegisterMockPlatformKeyDataHandler creates a new MockPlatformKeyDataHandler and
+// registers it with the specified name. The returned callback unregisters it.
+func RegisterMockPlatformKeyDataHandler(name string) (handler *MockPlatformKeyDataHandler, restore func()) {
+	handler = new(MockPlatformKeyDataHandler)
+	secboot.RegisterPlatformKeyDataHandler(name, handler)
+	return handler, func() {
+		secboot.RegisterPlatformKeyDataHandler(name, nil)
+	}
+}
+
+func (h *MockPlatformKeyDataHandler) checkState() error {
+	switch h.State {
+	case MockPlatformDeviceStateUnavailable:
+		return &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorUnavailable, Err: errors.New("the platform device is unavailable")}
+	case MockPlatformDeviceStateUninitialized:
+		return &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorUninitialized, Err: errors.New("the platform device is uninitialized")}
+	default:
+		return nil
+	}
+}
+
+func (h *MockPlatformKeyDataHandler) unmarshalHandle(data *secboot.PlatformKeyData) (*MockPlatformKeyDataHandle, error) {
+	handle, err := h.unmarshalHandleAnyAuthMode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.AuthMode != handle.ExpectedAuthMode {
+		return nil, &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorInvalidData, Err: errors.New("unexpected AuthMode")}
+	}
+
+	return handle, nil
+}
+
+func (h *MockPlatformKeyDataHandler) unmarshalHandleAnyAuthMode(data *secboot.PlatformKeyData) (*MockPlatformKeyDataHandle, error) {
+	var handle MockPlatformKeyDataHandle
+	if err := json.Unmarshal(data.EncodedHandle, &handle); err != nil {
+		return nil, &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorInvalidData, Err: fmt.Errorf("JSON decode error: %w", err)}
+	}
+
+	if data.Generation != handle.ExpectedGeneration {
+		return nil, &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorInvalidData, Err: errors.New("unexpected generation")}
+	}
+
+	if data.Generation > 1 {
+		if data.KDFAlg != handle.ExpectedKDFAlg {
+			return nil, &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorInvalidData, Err: errors.New("unexpected KDFAlg")}
+		}
+	}
+
+	return &handle, nil
+}
+
+func (h *MockPlatformKeyDataHandler) checkKey(handle *MockPlatformKeyDataHandle, key []byte) error {
+	m := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
+	m.Write(key)
+	if !bytes.Equal(handle.AuthKeyHMAC, m.Sum(nil)) {
+		return &secboot.PlatformHandlerError{Type: secboot.PlatformHandlerErrorInvalidAuthKey, Err: errors.New("the supplied key is incorrect")}
+	}
+
+	return nil
+}
+
+func (h *MockPlatformKeyDataHandler) recoverKeys(handle *MockPlatformKeyDataHandle, payload []byte) ([]byte, error) {
+	b, err := aes.NewCipher(handle.Key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+
+	s := cipher.NewCFBDecrypter(b, handle.IV)
+	out := make([]byte, len(payload))
+	s.XORKeyStream(out, payload)
+	return out, nil
+}
+
+// RecoverKeys implements secboot.PlatformKeyDataHandler.RecoverKeys.
+func (h *MockPlatformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	if err := h.checkState(); err != nil {
+		return nil, err
+	}
+
+	handle, err := h.unmarshalHandle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.recoverKeys(handle, encryptedPayload)
+}
+
+// RecoverKeysWithAuthKey implements secboot.PlatformKeyDataHandler.RecoverKeysWithAuthKey.
+func (h *MockPlatformKeyDataHandler) RecoverKeysWithAuthKey(data *secboot.PlatformKeyData, encryptedPayload []byte, key []byte) ([]byte, error) {
+	if !h.PassphraseSupport {
+		return nil, errors.New("not supported")
+	}
+
+	if err := h.checkState(); err != nil {
+		return nil, err
+	}
+
+	handle, err := h.unmarshalHandle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkKey(handle, key); err != nil {
+		return nil, err
+	}
+
+	return h.recoverKeys(handle, encryptedPayload)
+}
+
+// ChangeAuthKey implements secboot.PlatformKeyDataHandler.ChangeAuthKey.
+func (h *MockPlatformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, old, new []byte) ([]byte, error) {
+	if !h.PassphraseSupport {
+		return nil, errors.New("not supported")
+	}
+
+	if err := h.checkState(); err != nil {
+		return nil, err
+	}
+
+	// The auth mode supplied to ChangeAuthKey is the mode after the change.
+	handle, err := h.unmarshalHandleAnyAuthMode(data)
+	if err != nil {
+		return nil, err
+	}
+	handle.ExpectedAuthMode = data.AuthMode
+
+	if err := h.checkKey(handle, old); err != nil {
+		return nil, err
+	}
+
+	m := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
+	m.Write(new)
+	handle.AuthKeyHMAC = m.Sum(nil)
+
+	return json.Marshal(&handle)
+}
+
+// MakeMockKeyParams creates the parameters for a new secboot.KeyData protected by a
+// MockPlatformKeyDataHandler registered with the specified platform name. The supplied
+// primary key is used to derive the returned unlock key, with the specified digest
+// algorithm. Randomness is obtained from the supplied reader.
+func MakeMockKeyParams(rand io.Reader, platformName string, primaryKey secboot.PrimaryKey, kdfAlg crypto.Hash) (params *secboot.KeyParams, unlockKey secboot.DiskUnlockKey, err error) {
+	unlockKey, payload, err := secboot.MakeDiskUnlockKey(rand, kdfAlg, primaryKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := make([]byte, 48)
+	if _, err := io.ReadFull(rand, k); err != nil {
+		return nil, nil, err
+	}
+
+	handle := MockPlatformKeyDataHandle{
+		Key:                k[:32],
+		IV:                 k[32:],
+		ExpectedGeneration: secboot.KeyDataGeneration,
+		ExpectedKDFAlg:     kdfAlg,
+		ExpectedAuthMode:   secboot.AuthModeNone,
+	}
+
+	h := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, handle.Key)
+	h.Write(make([]byte, 32))
+	handle.AuthKeyHMAC = h.Sum(nil)
+
+	b, err := aes.NewCipher(handle.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	stream := cipher.NewCFBEncrypter(b, handle.IV)
+
+	params = &secboot.KeyParams{
+		PlatformName:     platformName,
+		Handle:           &handle,
+		EncryptedPayload: make([]byte, len(payload)),
+		KDFAlg:           kdfAlg}
+	stream.XORKeyStream(params.EncryptedPayload, payload)
+
+	return params, unlockKey, nil
+}
+
+// MakeMockKeyWithPassphraseParams is like MakeMockKeyParams, but creates the parameters
+// for a new secboot.KeyData with a passphrase. The MockPlatformKeyDataHandler must have
+// PassphraseSupport set in order to recover keys from it.
+func MakeMockKeyWithPassphraseParams(rand io.Reader, platformName string, primaryKey secboot.PrimaryKey, kdfAlg crypto.Hash, kdfOptions secboot.KDFOptions, authKeySize int) (params *secboot.KeyWithPassphraseParams, unlockKey secboot.DiskUnlockKey, err error) {
+	kp, unlockKey, err := MakeMockKeyParams(rand, platformName, primaryKey, kdfAlg)
+	if err != nil {
+		return nil, nil, err
+	}
+	kp.Handle.(*MockPlatformKeyDataHandle).ExpectedAuthMode = secboot.AuthModePassphrase
+
+	return &secboot.KeyWithPassphraseParams{
+		KeyParams:   *kp,
+		KDFOptions:  kdfOptions,
+		AuthKeySize: authKeySize,
+	}, unlockKey, nil
+}
+
+// NewMockKeyData creates a new secboot.KeyData with a newly generated primary key,
+// protected by a MockPlatformKeyDataHandler registered with the specified platform
+// name. The primary key and unlock key are also returned.
+func NewMockKeyData(rand io.Reader, platformName, role string) (kd *secboot.KeyData, primaryKey secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	primaryKey = make(secboot.PrimaryKey, 32)
+	if _, err := io.ReadFull(rand, primaryKey); err != nil {
+		return nil, nil, nil, err
+	}
+
+	params, unlockKey, err := MakeMockKeyParams(rand, platformName, primaryKey, crypto.SHA256)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	params.Role = role
+
+	kd, err = secboot.NewKeyData(params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return kd, primaryKey, unlockKey, nil
+}
@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboottest_test
+
+import (
+	"crypto"
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/secboottest"
+)
+
+type platformSuite struct {
+	handler        *MockPlatformKeyDataHandler
+	restoreHandler func()
+	restoreKDF     func()
+}
+
+var _ = Suite(&platformSuite{})
+
+func (s *platformSuite) SetUpTest(c *C) {
+	s.handler, s.restoreHandler = RegisterMockPlatformKeyDataHandler("mock")
+	orig := secboot.SetArgon2KDF(new(MockArgon2KDF))
+	s.restoreKDF = func() { secboot.SetArgon2KDF(orig) }
+}
+
+func (s *platformSuite) TearDownTest(c *C) {
+	s.restoreKDF()
+	s.restoreHandler()
+}
+
+func (s *platformSuite) TestNewMockKeyData(c *C) {
+	kd, primaryKey, unlockKey, err := NewMockKeyData(rand.Reader, "mock", "run")
+	c.Assert(err, IsNil)
+	c.Check(kd.PlatformName(), Equals, "mock")
+	c.Check(kd.Role(), Equals, "run")
+	c.Check(primaryKey, HasLen, 32)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+}
+
+func (s *platformSuite) TestRecoverKeysUnavailable(c *C) {
+	kd, _, _, err := NewMockKeyData(rand.Reader, "mock", "run")
+	c.Assert(err, IsNil)
+
+	s.handler.State = MockPlatformDeviceStateUnavailable
+	_, _, err = kd.RecoverKeys()
+	c.Check(err, ErrorMatches, `the platform's secure device is unavailable: the platform device is unavailable`)
+	c.Check(err, FitsTypeOf, &secboot.PlatformDeviceUnavailableError{})
+}
+
+func (s *platformSuite) TestRecoverKeysUninitialized(c *C) {
+	kd, _, _, err := NewMockKeyData(rand.Reader, "mock", "run")
+	c.Assert(err, IsNil)
+
+	s.handler.State = MockPlatformDeviceStateUninitialized
+	_, _, err = kd.RecoverKeys()
+	c.Check(err, ErrorMatches, `the platform's secure device is not properly initialized: the platform device is uninitialized`)
+	c.Check(err, FitsTypeOf, &secboot.PlatformUninitializedError{})
+}
+
+func (s *platformSuite) TestMakeMockKeyWithPassphraseParams(c *C) {
+	s.handler.PassphraseSupport = true
+
+	primaryKey := make(secboot.PrimaryKey, 32)
+	_, err := rand.Read(primaryKey)
+	c.Assert(err, IsNil)
+
+	params, unlockKey, err := MakeMockKeyWithPassphraseParams(rand.Reader, "mock", primaryKey, crypto.SHA256, nil, 32)
+	c.Assert(err, IsNil)
+
+	kd, err := secboot.NewKeyDataWithPassphrase(params, "passphrase")
+	c.Assert(err, IsNil)
+	c.Check(kd.AuthMode(), Equals, secboot.AuthModePassphrase)
+
+	recoveredUnlockKey, recoveredPrimaryKey, err := kd.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredUnlockKey, DeepEquals, unlockKey)
+	c.Check(recoveredPrimaryKey, DeepEquals, primaryKey)
+
+	_, _, err = kd.RecoverKeysWithPassphrase("foo")
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+}
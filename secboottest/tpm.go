@@ -0,0 +1,74 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboottest
+
+import (
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mssim"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcti"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// DefaultTPMSimulatorPort is the default port of the TPM simulator (mssim).
+const DefaultTPMSimulatorPort = 2321
+
+// openTPMSimulator opens a connection to the TPM simulator on the specified port
+// on the local host, and starts it up if this hasn't already been done.
+func openTPMSimulator(port uint) (tpm2.Transport, error) {
+	transport, err := mssim.NewLocalDevice(port).Open()
+	if err != nil {
+		return nil, err
+	}
+
+	tpm := tpm2.NewTPMContext(transport)
+	if err := tpm.Startup(tpm2.StartupClear); err != nil && !tpm2.IsTPMError(err, tpm2.ErrorInitialize, tpm2.CommandStartup) {
+		transport.Close()
+		return nil, xerrors.Errorf("cannot start up TPM simulator: %w", err)
+	}
+
+	return transport, nil
+}
+
+// MockTPMSimulatorAsDefaultTPM overrides the default TPM device so that any
+// subsequent connections made by secboot, such as with tpm2.ConnectToDefaultTPM,
+// are made to the TPM simulator on the specified port on the local host. The
+// returned callback restores the original behaviour.
+func MockTPMSimulatorAsDefaultTPM(port uint) (restore func()) {
+	orig := tcti.OpenDefault
+	tcti.OpenDefault = func() (tpm2.TCTI, error) {
+		return openTPMSimulator(port)
+	}
+	return func() {
+		tcti.OpenDefault = orig
+	}
+}
+
+// OpenTPMSimulatorConnection returns a new connection to the TPM simulator on the
+// specified port on the local host. The simulator must already be running.
+//
+// The returned connection must be closed when it is no longer required.
+func OpenTPMSimulatorConnection(port uint) (*secboot_tpm2.Connection, error) {
+	restore := MockTPMSimulatorAsDefaultTPM(port)
+	defer restore()
+
+	return secboot_tpm2.ConnectToDefaultTPM()
+}
@@ -0,0 +1,121 @@
+//go:build secboot_testhooks
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package testhooks
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	drbg "github.com/canonical/go-sp800.90a-drbg"
+	"golang.org/x/xerrors"
+)
+
+// MockClock replaces the clock returned from Now with the supplied one. The
+// returned function restores the previous clock.
+func MockClock(c Clock) (restore func()) {
+	if c == nil {
+		panic("nil clock")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	orig := clock
+	clock = c
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = orig
+	}
+}
+
+// MockRandReader replaces the source of randomness read by RandReader with the
+// supplied one. The returned function restores the previous source.
+func MockRandReader(r io.Reader) (restore func()) {
+	if r == nil {
+		panic("nil reader")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	orig := source
+	source = r
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		source = orig
+	}
+}
+
+// FixedClock is a Clock that only changes when it is explicitly advanced.
+type FixedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFixedClock returns a new FixedClock that starts at the specified time.
+func NewFixedClock(t time.Time) *FixedClock {
+	return &FixedClock{now: t}
+}
+
+// Now implements Clock.Now.
+func (c *FixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the specified duration.
+func (c *FixedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// EnableDeterministicMode replaces the clock with a FixedClock that starts at
+// the specified time, and replaces the source of randomness with a DRBG that
+// is seeded with the supplied seed, which must be at least 32 bytes long. The
+// same sequence of calls will then produce the same results each time. The
+// FixedClock is returned so that the caller can advance it, along with a
+// function that restores the previous clock and source of randomness.
+func EnableDeterministicMode(start time.Time, seed []byte) (c *FixedClock, restore func(), err error) {
+	if len(seed) < 32 {
+		return nil, nil, errors.New("seed is too short")
+	}
+
+	rng, err := drbg.NewCTRWithExternalEntropy(32, seed, nil, []byte("SECBOOT-TESTHOOKS"), nil)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot instantiate DRBG: %w", err)
+	}
+
+	c = NewFixedClock(start)
+	restoreClock := MockClock(c)
+	restoreRand := MockRandReader(rng)
+
+	return c, func() {
+		restoreRand()
+		restoreClock()
+	}, nil
+}
@@ -0,0 +1,93 @@
+//go:build secboot_testhooks
+
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package testhooks_test
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/testhooks"
+)
+
+type mockSuite struct{}
+
+var _ = Suite(&mockSuite{})
+
+func (s *mockSuite) TestMockClock(c *C) {
+	t := time.Date(2024, time.June, 3, 10, 0, 0, 0, time.UTC)
+	clock := NewFixedClock(t)
+
+	restore := MockClock(clock)
+	c.Check(Now(), Equals, t)
+
+	clock.Advance(time.Hour)
+	c.Check(Now(), Equals, t.Add(time.Hour))
+
+	restore()
+	c.Check(Now().Equal(t.Add(time.Hour)), testutil.IsFalse)
+}
+
+func (s *mockSuite) TestMockRandReader(c *C) {
+	restore := MockRandReader(bytes.NewReader([]byte{1, 2, 3, 4}))
+
+	data := make([]byte, 4)
+	_, err := io.ReadFull(RandReader, data)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte{1, 2, 3, 4})
+
+	restore()
+	_, err = io.ReadFull(RandReader, data)
+	c.Check(err, IsNil)
+}
+
+func (s *mockSuite) TestEnableDeterministicMode(c *C) {
+	start := time.Date(2024, time.June, 3, 10, 0, 0, 0, time.UTC)
+	seed := testutil.DecodeHexString(c, "6e0bdee4f7ee6cc1aed4b2c4a8ed1e4a5a3b8d7c2e6f1b0a9c8d7e6f5a4b3c2d")
+
+	run := func() (time.Time, []byte) {
+		clock, restore, err := EnableDeterministicMode(start, seed)
+		c.Assert(err, IsNil)
+		defer restore()
+
+		clock.Advance(time.Minute)
+
+		data := make([]byte, 32)
+		_, err = io.ReadFull(RandReader, data)
+		c.Assert(err, IsNil)
+		return Now(), data
+	}
+
+	now1, data1 := run()
+	now2, data2 := run()
+	c.Check(now1, Equals, start.Add(time.Minute))
+	c.Check(now2, Equals, now1)
+	c.Check(data2, DeepEquals, data1)
+}
+
+func (s *mockSuite) TestEnableDeterministicModeShortSeed(c *C) {
+	_, _, err := EnableDeterministicMode(time.Now(), make([]byte, 16))
+	c.Check(err, ErrorMatches, `seed is too short`)
+}
@@ -0,0 +1,83 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package testhooks provides the source of time and randomness used by secboot and
+its sub-packages, and allows them to be replaced so that integration tests in
+other projects can run deterministically.
+
+The functions that replace the clock and the source of randomness (MockClock,
+MockRandReader and EnableDeterministicMode) are only built when the
+secboot_testhooks build tag is specified, so that they are not available to
+production binaries. Integration tests that use them must be built with
+"-tags secboot_testhooks".
+
+Time dependent code, such as the evaluation of time bounded policies and
+activation deadlines, obtains the current time from Now. Timeouts, such as the
+time spent waiting for a device to appear, are also measured with Now, so a
+FixedClock must be advanced for them to expire. Code that generates
+salts, keys and nonces obtains randomness from RandReader. Note that this
+doesn't affect randomness that is generated inside the TPM or by third party
+libraries, such as the nonces for TPM sessions.
+*/
+package testhooks
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var (
+	mu     sync.RWMutex
+	clock  Clock     = systemClock{}
+	source io.Reader = rand.Reader
+)
+
+// Now returns the current time from the current Clock, which is the system
+// clock unless it has been replaced with MockClock.
+func Now() time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	return clock.Now()
+}
+
+type randReader struct{}
+
+func (randReader) Read(data []byte) (int, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return source.Read(data)
+}
+
+// RandReader is a source of cryptographically secure randomness that reads
+// from crypto/rand.Reader unless it has been replaced with MockRandReader.
+var RandReader io.Reader = randReader{}
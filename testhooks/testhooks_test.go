@@ -0,0 +1,51 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package testhooks_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/testhooks"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type testhooksSuite struct{}
+
+var _ = Suite(&testhooksSuite{})
+
+func (s *testhooksSuite) TestNowDefault(c *C) {
+	before := time.Now()
+	now := Now()
+	c.Check(now.Before(before), testutil.IsFalse)
+	c.Check(now.After(time.Now()), testutil.IsFalse)
+}
+
+func (s *testhooksSuite) TestRandReaderDefault(c *C) {
+	data := make([]byte, 32)
+	_, err := io.ReadFull(RandReader, data)
+	c.Check(err, IsNil)
+	c.Check(data, Not(DeepEquals), make([]byte, 32))
+}
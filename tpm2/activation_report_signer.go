@@ -0,0 +1,194 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/objectutil"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// activationReportSigningKeyTemplate is the template for the key created by
+// Connection.CreateActivationReportSigningKey. It's an unrestricted ECDSA
+// signing key, so that it can sign digests computed outside of the TPM. Use
+// of the key requires knowledge of its authorization value.
+var activationReportSigningKeyTemplate = objectutil.NewECCKeyTemplate(objectutil.UsageSign,
+	objectutil.WithoutDictionaryAttackProtection(),
+	objectutil.WithECCScheme(tpm2.ECCSchemeECDSA, tpm2.HashAlgorithmSHA256))
+
+// CreateActivationReportSigningKey creates a NIST-P256 ECDSA signing key as a
+// child of the storage root key, and persists it at the specified handle,
+// replacing any existing object. The private part of the key never leaves the
+// TPM. The key can be used to sign activation reports with the signer
+// returned from NewActivationReportSigner, and the returned public key should
+// be exported so that the reports can later be verified with
+// secboot.VerifyActivationReportLog.
+//
+// The key is created with the supplied authorization value, which must be
+// supplied to NewActivationReportSigner in order to use it. Unlike a primary
+// key, the key can't be recreated by anyone else with access to the TPM, so
+// only holders of the authorization value can sign reports with it. The key
+// isn't subject to dictionary attack protection, so the authorization value
+// should be randomly generated and at least 16 bytes long.
+//
+// The handle should be in the range reserved for owner persistent objects.
+// This requires knowledge of the authorization value for the storage
+// hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this
+// function. Clearing the TPM removes the key.
+func (t *Connection) CreateActivationReportSigningKey(handle tpm2.Handle, authValue []byte) (*ecdsa.PublicKey, error) {
+	if handle.Type() != tpm2.HandleTypePersistent {
+		return nil, errors.New("invalid handle type")
+	}
+	if len(authValue) == 0 {
+		return nil, errors.New("no authorization value supplied")
+	}
+
+	srk, err := t.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+
+	obj, err := t.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		// No existing object to evict
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context to determine if persistent handle is already occupied: %w", err)
+	default:
+		if _, err := t.EvictControl(t.OwnerHandleContext(), obj, handle, t.HmacSession()); err != nil {
+			if isAuthFailError(err, tpm2.CommandEvictControl, 1) {
+				return nil, AuthFailError{tpm2.HandleOwner}
+			}
+			return nil, xerrors.Errorf("cannot evict existing object at persistent handle: %w", err)
+		}
+	}
+
+	sensitive := tpm2.SensitiveCreate{UserAuth: authValue}
+	priv, pub, _, _, _, err := t.Create(srk, &sensitive, activationReportSigningKeyTemplate, nil, nil, t.HmacSession().IncludeAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create signing key: %w", err)
+	}
+
+	transientKey, err := t.Load(srk, priv, pub, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot load signing key: %w", err)
+	}
+	defer t.FlushContext(transientKey)
+
+	if _, err := t.EvictControl(t.OwnerHandleContext(), transientKey, handle, t.HmacSession()); err != nil {
+		if isAuthFailError(err, tpm2.CommandEvictControl, 1) {
+			return nil, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, xerrors.Errorf("cannot make signing key persistent: %w", err)
+	}
+
+	return pub.Public().(*ecdsa.PublicKey), nil
+}
+
+type activationReportSigner struct {
+	tpm *Connection
+	key tpm2.ResourceContext
+	pub *ecdsa.PublicKey
+}
+
+func (s *activationReportSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *activationReportSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var hashAlg tpm2.HashAlgorithmId
+	for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384, tpm2.HashAlgorithmSHA512} {
+		if alg.GetHash() == opts.HashFunc() {
+			hashAlg = alg
+			break
+		}
+	}
+	if hashAlg == tpm2.HashAlgorithmNull {
+		return nil, fmt.Errorf("unsupported digest algorithm %v", opts.HashFunc())
+	}
+
+	scheme := &tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{HashAlg: hashAlg}}}
+	sig, err := s.tpm.Sign(s.key, digest, scheme, nil, s.tpm.HmacSession())
+	switch {
+	case isAuthFailError(err, tpm2.CommandSign, 1):
+		return nil, errors.New("invalid authorization value for signing key")
+	case err != nil:
+		return nil, xerrors.Errorf("cannot sign digest: %w", err)
+	}
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureR),
+		S: new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureS),
+	})
+}
+
+// NewActivationReportSigner returns a signer for the key created with
+// CreateActivationReportSigningKey at the specified handle, which can be
+// supplied to secboot.NewActivationReportLog or
+// secboot.OpenActivationReportLogFile. Signatures are ASN.1 DER encoded. The
+// supplied authorization value must be the one the key was created with, else
+// signing will fail.
+//
+// The connection must remain open whilst the signer is in use.
+func (t *Connection) NewActivationReportSigner(handle tpm2.Handle, authValue []byte) (crypto.Signer, error) {
+	key, err := t.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, errors.New("no signing key exists at the specified handle")
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for signing key: %w", err)
+	}
+
+	pub, _, _, err := t.ReadPublic(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of signing key: %w", err)
+	}
+	if pub.Type != tpm2.ObjectTypeECC || pub.Attrs&(tpm2.AttrSign|tpm2.AttrRestricted|tpm2.AttrUserWithAuth) != tpm2.AttrSign|tpm2.AttrUserWithAuth {
+		return nil, errors.New("object at the specified handle is not an unrestricted ECC signing key")
+	}
+	ecdsaPub, ok := pub.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("object at the specified handle has an unsupported public key")
+	}
+
+	key.SetAuthValue(authValue)
+
+	return &activationReportSigner{tpm: t, key: key, pub: ecdsaPub}, nil
+}
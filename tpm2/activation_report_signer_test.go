@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type activationReportSignerSuite struct {
+	tpm2test.TPMSimulatorTest
+}
+
+var _ = Suite(&activationReportSignerSuite{})
+
+func (s *activationReportSignerSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+}
+
+func (s *activationReportSignerSuite) TestSign(c *C) {
+	pub, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+
+	signer, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+	c.Check(signer.Public(), DeepEquals, pub)
+
+	digest := sha256.Sum256([]byte("foo"))
+	sig, err := signer.Sign(testutil.RandReader, digest[:], crypto.SHA256)
+	c.Check(err, IsNil)
+	c.Check(ecdsa.VerifyASN1(pub, digest[:], sig), testutil.IsTrue)
+}
+
+func (s *activationReportSignerSuite) TestActivationReportLog(c *C) {
+	pub, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+
+	signer, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	log := secboot.NewActivationReportLog(&buf, signer, nil)
+	report := &secboot.ActivationReport{
+		Time:             time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		Reason:           &secboot.UnlockReason{Method: secboot.UnlockMethodPlatformKey}}
+	c.Check(log.Append(report), IsNil)
+
+	entries, err := secboot.VerifyActivationReportLog(&buf, pub)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Report, DeepEquals, report)
+}
+
+func (s *activationReportSignerSuite) TestCreateReplacesExisting(c *C) {
+	pub1, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+	pub2, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+
+	// The key is created from fresh randomness each time, so it can't be
+	// recreated by someone else with access to the TPM.
+	c.Check(pub2, Not(DeepEquals), pub1)
+
+	signer, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+	c.Check(signer.Public(), DeepEquals, pub2)
+}
+
+func (s *activationReportSignerSuite) TestSignWrongAuthValue(c *C) {
+	_, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Assert(err, IsNil)
+
+	signer, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("bar"))
+	c.Assert(err, IsNil)
+
+	digest := sha256.Sum256([]byte("foo"))
+	_, err = signer.Sign(testutil.RandReader, digest[:], crypto.SHA256)
+	c.Check(err, ErrorMatches, `invalid authorization value for signing key`)
+}
+
+func (s *activationReportSignerSuite) TestCreateNoAuthValue(c *C) {
+	_, err := s.TPM().CreateActivationReportSigningKey(0x81000010, nil)
+	c.Check(err, ErrorMatches, `no authorization value supplied`)
+}
+
+func (s *activationReportSignerSuite) TestCreateInvalidHandle(c *C) {
+	_, err := s.TPM().CreateActivationReportSigningKey(0x01800000, []byte("foo"))
+	c.Check(err, ErrorMatches, `invalid handle type`)
+}
+
+func (s *activationReportSignerSuite) TestCreateAuthFail(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	_, err := s.TPM().CreateActivationReportSigningKey(0x81000010, []byte("foo"))
+	c.Check(err, Equals, AuthFailError{tpm2.HandleOwner})
+}
+
+func (s *activationReportSignerSuite) TestNewSignerNoKey(c *C) {
+	_, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("foo"))
+	c.Check(err, ErrorMatches, `no signing key exists at the specified handle`)
+}
+
+func (s *activationReportSignerSuite) TestNewSignerWrongKey(c *C) {
+	primary := s.CreatePrimary(c, tpm2.HandleOwner, tpm2_testutil.NewRSAStorageKeyTemplate())
+	s.EvictControl(c, tpm2.HandleOwner, primary, 0x81000010)
+
+	_, err := s.TPM().NewActivationReportSigner(0x81000010, []byte("foo"))
+	c.Check(err, ErrorMatches, `object at the specified handle is not an unrestricted ECC signing key`)
+}
@@ -0,0 +1,417 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// An authorized reseal permits the recovery system to update the PCR policy
+// for a key on behalf of the run system, without access to the key's primary
+// key. The run system, which has the primary key, computes a PCR policy for
+// each of a bounded set of named PCR profiles that it expects the recovery
+// system might need, such as profiles for repairing a boot chain, and signs
+// them with NewAuthorizedResealBundle. The returned bundle is stored somewhere
+// that the recovery system can read it. Later on, the recovery system applies
+// one of the pre-authorized policies by name with ApplyAuthorizedReseal.
+//
+// The bundle is a complete record of the uses of the PCR policy authorization
+// key to create it, and the bundle itself is signed with the same key so that
+// its contents can't be modified. Each application returns an
+// AuthorizedResealRecord that can be logged, so that the use of the
+// pre-authorized policies can be audited against the bundle.
+//
+// The pre-authorized policies are created with the current PCR policy version,
+// so they are all revoked by the next call to RevokeOldPCRProtectionPolicies
+// after a PCR policy is created with NewPCRPolicyVersion.
+
+const (
+	// maxAuthorizedReseals is the maximum number of PCR policies in a single
+	// authorized reseal bundle.
+	maxAuthorizedReseals = 16
+
+	// maxAuthorizedResealNameLen is the maximum length of the name of an
+	// authorized reseal.
+	maxAuthorizedResealNameLen = 64
+)
+
+// AuthorizedResealProfile is a named PCR profile supplied to
+// NewAuthorizedResealBundle.
+type AuthorizedResealProfile struct {
+	// Name identifies this profile in the bundle, and is supplied to
+	// ApplyAuthorizedReseal in order to apply it.
+	Name string
+
+	// Profile is the PCR profile from which to compute the pre-authorized
+	// PCR policy.
+	Profile *PCRProtectionProfile
+}
+
+// authorizedReseal is a single pre-authorized PCR policy in an authorized
+// reseal bundle.
+type authorizedReseal struct {
+	name string
+	data *pcrPolicyData_v3 // The signed PCR policy metadata
+}
+
+// AuthorizedResealBundle is a bounded set of PCR policies for a key and any keys
+// that are related to it, that have been authorized by the run system so that they
+// can be applied later on by the recovery system with ApplyAuthorizedReseal. It is
+// created by SealedKeyData.NewAuthorizedResealBundle, and can be serialized to JSON
+// with encoding/json.
+type AuthorizedResealBundle struct {
+	authKeyName tpm2.Name
+	policyRef   tpm2.Nonce
+	created     time.Time
+	expires     time.Time
+	reseals     []*authorizedReseal
+	signature   *tpm2.Signature
+}
+
+// Created returns the time at which this bundle was created.
+func (b *AuthorizedResealBundle) Created() time.Time {
+	return b.created
+}
+
+// Expires returns the time after which the PCR policies in this bundle can
+// no longer be applied, or the zero time if they don't expire. Note that this
+// is enforced by ApplyAuthorizedReseal and not by the TPM.
+func (b *AuthorizedResealBundle) Expires() time.Time {
+	return b.expires
+}
+
+// Names returns the names of the PCR policies in this bundle, in the order
+// that they were supplied to NewAuthorizedResealBundle.
+func (b *AuthorizedResealBundle) Names() []string {
+	var names []string
+	for _, r := range b.reseals {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// PolicyDigest returns the PCR policy digest authorized for the PCR policy
+// with the specified name, or nil if there isn't one.
+func (b *AuthorizedResealBundle) PolicyDigest(name string) tpm2.Digest {
+	r := b.lookup(name)
+	if r == nil {
+		return nil
+	}
+	return r.data.AuthorizedPolicy
+}
+
+// Digest returns the digest of this bundle, which is signed by the PCR policy
+// authorization key and identifies the bundle in an AuthorizedResealRecord.
+func (b *AuthorizedResealBundle) Digest() tpm2.Digest {
+	alg := b.authKeyName.Algorithm()
+	if !alg.Available() {
+		return nil
+	}
+
+	h := alg.NewHash()
+	h.Write([]byte("AUTHORIZED-RESEAL"))
+	mu.MustMarshalToWriter(h, b.authKeyName, b.policyRef, b.created.Unix(), b.expiresUnix(), uint32(len(b.reseals)))
+	for _, r := range b.reseals {
+		mu.MustMarshalToWriter(h, []byte(r.name), r.data.AuthorizedPolicy)
+	}
+	return h.Sum(nil)
+}
+
+func (b *AuthorizedResealBundle) expiresUnix() int64 {
+	if b.expires.IsZero() {
+		return 0
+	}
+	return b.expires.Unix()
+}
+
+func (b *AuthorizedResealBundle) lookup(name string) *authorizedReseal {
+	for _, r := range b.reseals {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// sign signs this bundle with the supplied PCR policy authorization key.
+func (b *AuthorizedResealBundle) sign(key *ecdsa.PrivateKey) error {
+	digest := b.Digest()
+	if digest == nil {
+		return errors.New("digest algorithm is not available")
+	}
+	sig, err := SignPCRPolicyDigest(key, b.authKeyName.Algorithm(), digest)
+	if err != nil {
+		return err
+	}
+	b.signature = sig
+	return nil
+}
+
+// verify checks that this bundle was created for a key with the supplied PCR policy
+// authorization key and policy reference, and that it hasn't been modified.
+func (b *AuthorizedResealBundle) verify(authPublicKey *tpm2.Public, policyRef tpm2.Nonce) error {
+	if !bytes.Equal(b.authKeyName, authPublicKey.Name()) || !bytes.Equal(b.policyRef, policyRef) {
+		return errors.New("bundle was not created for this key")
+	}
+
+	if b.signature == nil || b.signature.SigAlg != tpm2.SigSchemeAlgECDSA || b.signature.Signature.ECDSA.Hash != authPublicKey.NameAlg {
+		return errors.New("invalid signature scheme")
+	}
+	digest := b.Digest()
+	if digest == nil {
+		return errors.New("digest algorithm is not available")
+	}
+	ok, err := util.VerifySignature(authPublicKey.Public(), digest, b.signature)
+	if err != nil {
+		return xerrors.Errorf("cannot verify signature: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+type authorizedResealJSON struct {
+	Name   string `json:"name"`
+	Policy []byte `json:"policy"` // The signed PCR policy metadata, as pcrPolicyData_v4
+}
+
+type authorizedResealBundleJSON struct {
+	AuthKeyName tpm2.Name              `json:"auth-key-name"`
+	PolicyRef   tpm2.Nonce             `json:"policy-ref"`
+	Created     time.Time              `json:"created"`
+	Expires     *time.Time             `json:"expires,omitempty"`
+	Reseals     []authorizedResealJSON `json:"reseals"`
+	Signature   []byte                 `json:"signature"` // TPMT_SIGNATURE
+}
+
+// MarshalJSON implements json.Marshaler.
+func (b *AuthorizedResealBundle) MarshalJSON() ([]byte, error) {
+	j := &authorizedResealBundleJSON{
+		AuthKeyName: b.authKeyName,
+		PolicyRef:   b.policyRef,
+		Created:     b.created}
+	if !b.expires.IsZero() {
+		expires := b.expires
+		j.Expires = &expires
+	}
+
+	for _, r := range b.reseals {
+		policy, err := mu.MarshalToBytes(newPcrPolicyDataV4(r.data))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot marshal PCR policy %q: %w", r.name, err)
+		}
+		j.Reseals = append(j.Reseals, authorizedResealJSON{Name: r.name, Policy: policy})
+	}
+
+	sig, err := mu.MarshalToBytes(b.signature)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal signature: %w", err)
+	}
+	j.Signature = sig
+
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *AuthorizedResealBundle) UnmarshalJSON(data []byte) error {
+	var j *authorizedResealBundleJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j == nil {
+		return errors.New("no bundle")
+	}
+	if len(j.Reseals) > maxAuthorizedReseals {
+		return errors.New("too many PCR policies")
+	}
+
+	out := &AuthorizedResealBundle{
+		authKeyName: j.AuthKeyName,
+		policyRef:   j.PolicyRef,
+		created:     j.Created}
+	if j.Expires != nil {
+		out.expires = *j.Expires
+	}
+
+	for _, r := range j.Reseals {
+		var policy *pcrPolicyData_v4
+		if _, err := mu.UnmarshalFromBytes(r.Policy, &policy); err != nil {
+			return xerrors.Errorf("cannot unmarshal PCR policy %q: %w", r.Name, err)
+		}
+		out.reseals = append(out.reseals, &authorizedReseal{name: r.Name, data: policy.asV3()})
+	}
+
+	if _, err := mu.UnmarshalFromBytes(j.Signature, &out.signature); err != nil {
+		return xerrors.Errorf("cannot unmarshal signature: %w", err)
+	}
+
+	*b = *out
+	return nil
+}
+
+// NewAuthorizedResealBundle computes a PCR policy for this key from each of the supplied
+// named profiles, in the same way as NewUnsignedPCRPolicy with NoNewPCRPolicyVersion, and
+// authorizes them with the PCR policy authorization key derived from the supplied primary
+// key. The returned bundle can be used by the recovery system to apply any one of these
+// policies to this key, or any keys that are related to it, with ApplyAuthorizedReseal.
+//
+// No more than 16 profiles can be supplied, and each must have a unique non-empty name.
+// If expires is not the zero time, ApplyAuthorizedReseal refuses to apply the policies
+// after this time.
+//
+// If validation of the key data fails, a InvalidKeyDataError error will be returned.
+func (k *SealedKeyData) NewAuthorizedResealBundle(tpm *Connection, primaryKey secboot.PrimaryKey, profiles []*AuthorizedResealProfile, expires time.Time) (*AuthorizedResealBundle, error) {
+	switch {
+	case len(profiles) == 0:
+		return nil, errors.New("no profiles supplied")
+	case len(profiles) > maxAuthorizedReseals:
+		return nil, fmt.Errorf("too many profiles supplied (maximum %d)", maxAuthorizedReseals)
+	}
+
+	names := make(map[string]bool)
+	for i, p := range profiles {
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("profile at index %d has no name", i)
+		case len(p.Name) > maxAuthorizedResealNameLen:
+			return nil, fmt.Errorf("name of profile at index %d is too long", i)
+		case names[p.Name]:
+			return nil, fmt.Errorf("duplicate profile name %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	authKey, err := k.PCRPolicyAuthKey(primaryKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPolicy, err := k.v3Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	var reseals []*authorizedReseal
+	for _, p := range profiles {
+		policy, err := k.NewUnsignedPCRPolicy(tpm, p.Profile, NoNewPCRPolicyVersion)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR policy for profile %q: %w", p.Name, err)
+		}
+		sig, err := SignPCRPolicyDigest(authKey, policy.HashAlg(), policy.Digest())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot sign PCR policy for profile %q: %w", p.Name, err)
+		}
+
+		data := *policy.data
+		data.AuthorizedPolicySignature = sig
+		reseals = append(reseals, &authorizedReseal{name: p.Name, data: &data})
+	}
+
+	return newAuthorizedResealBundle(authKey, keyPolicy.StaticData.AuthPublicKey, keyPolicy.StaticData.PCRPolicyRef, reseals, expires)
+}
+
+// newAuthorizedResealBundle creates a new bundle from the supplied signed PCR policies, and
+// signs it with the supplied PCR policy authorization key.
+func newAuthorizedResealBundle(authKey *ecdsa.PrivateKey, authPublicKey *tpm2.Public, policyRef tpm2.Nonce, reseals []*authorizedReseal, expires time.Time) (*AuthorizedResealBundle, error) {
+	bundle := &AuthorizedResealBundle{
+		authKeyName: authPublicKey.Name(),
+		policyRef:   policyRef,
+		created:     timeNow().UTC().Truncate(time.Second),
+		reseals:     reseals}
+	if !expires.IsZero() {
+		bundle.expires = expires.UTC().Truncate(time.Second)
+	}
+
+	if err := bundle.sign(authKey); err != nil {
+		return nil, xerrors.Errorf("cannot sign bundle: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// AuthorizedResealRecord records the application of a PCR policy from an
+// AuthorizedResealBundle, and is returned from ApplyAuthorizedReseal so that
+// it can be logged.
+type AuthorizedResealRecord struct {
+	Time         time.Time   `json:"time"`
+	Name         string      `json:"name"`          // The name of the applied PCR policy
+	PolicyDigest tpm2.Digest `json:"policy-digest"` // The applied PCR policy digest
+	BundleDigest tpm2.Digest `json:"bundle-digest"` // The digest of the bundle
+}
+
+// ApplyAuthorizedReseal updates the PCR protection policy for this key to the PCR
+// policy with the specified name from the supplied bundle, which was created by the
+// run system with NewAuthorizedResealBundle for this key or a key that is related
+// to it. This doesn't require the primary key. The signature of the bundle is verified
+// with the public part of the key's PCR policy authorization key before the policy is
+// applied, and the policy won't be applied if the bundle has expired.
+//
+// On success, this key will have an updated authorization policy. It must be persisted
+// using secboot.KeyData.WriteAtomic. A record of the update is returned.
+func (k *SealedKeyData) ApplyAuthorizedReseal(bundle *AuthorizedResealBundle, name string) (*AuthorizedResealRecord, error) {
+	keyPolicy, err := k.v3Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bundle.verify(keyPolicy.StaticData.AuthPublicKey, keyPolicy.StaticData.PCRPolicyRef); err != nil {
+		return nil, xerrors.Errorf("cannot verify authorized reseal bundle: %w", err)
+	}
+
+	now := timeNow()
+	if !bundle.expires.IsZero() && now.After(bundle.expires) {
+		return nil, fmt.Errorf("authorized reseal bundle expired at %v", bundle.expires)
+	}
+
+	r := bundle.lookup(name)
+	if r == nil {
+		return nil, fmt.Errorf("no PCR policy named %q in authorized reseal bundle", name)
+	}
+
+	data := *r.data
+	data.AuthorizedPolicySignature = nil
+	policy := &UnsignedPCRPolicy{
+		authPublicKey: keyPolicy.StaticData.AuthPublicKey,
+		policyRef:     bundle.policyRef,
+		data:          &data}
+	if err := k.UpdatePCRProtectionPolicyWithSignature(policy, r.data.AuthorizedPolicySignature); err != nil {
+		return nil, xerrors.Errorf("cannot apply PCR policy %q: %w", name, err)
+	}
+
+	return &AuthorizedResealRecord{
+		Time:         now.UTC(),
+		Name:         name,
+		PolicyDigest: r.data.AuthorizedPolicy,
+		BundleDigest: bundle.Digest()}, nil
+}
@@ -0,0 +1,276 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type authorizedResealSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *authorizedResealSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *authorizedResealSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&authorizedResealSuite{})
+
+func (s *authorizedResealSuite) newKey(c *C, pcrPolicyCounterHandle tpm2.Handle) (*secboot.KeyData, *SealedKeyData, secboot.PrimaryKey) {
+	// Protect the key with an initial PCR policy that can't be satisfied
+	params := &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")),
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	return k, skd, primaryKey
+}
+
+func (s *authorizedResealSuite) TestApplyAuthorizedReseal(c *C) {
+	k, skd, primaryKey := s.newKey(c, s.NextAvailableHandle(c, 0x01810000))
+
+	// Run system: pre-authorize a policy for the current PCR values and one
+	// that can't be satisfied.
+	bundle, err := skd.NewAuthorizedResealBundle(s.TPM(), primaryKey, []*AuthorizedResealProfile{
+		{Name: "current", Profile: tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})},
+		{Name: "other", Profile: NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make([]byte, 32))},
+	}, time.Time{})
+	c.Assert(err, IsNil)
+	c.Check(bundle.Names(), DeepEquals, []string{"current", "other"})
+
+	b, err := json.Marshal(bundle)
+	c.Assert(err, IsNil)
+
+	// Recovery system: apply a pre-authorized policy without the primary key.
+	var bundle2 *AuthorizedResealBundle
+	c.Assert(json.Unmarshal(b, &bundle2), IsNil)
+
+	record, err := skd.ApplyAuthorizedReseal(bundle2, "current")
+	c.Assert(err, IsNil)
+	c.Check(record.Name, Equals, "current")
+	c.Check(record.PolicyDigest, DeepEquals, bundle.PolicyDigest("current"))
+	c.Check(record.BundleDigest, DeepEquals, bundle.Digest())
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+
+	_, err = skd.ApplyAuthorizedReseal(bundle2, "other")
+	c.Check(err, IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *authorizedResealSuite) TestNewAuthorizedResealBundleWrongPrimaryKey(c *C) {
+	_, skd, _ := s.newKey(c, tpm2.HandleNull)
+
+	_, err := skd.NewAuthorizedResealBundle(s.TPM(), make(secboot.PrimaryKey, 32), []*AuthorizedResealProfile{{Name: "foo"}}, time.Time{})
+	c.Check(err, ErrorMatches, "invalid key data: dynamic authorization policy signing private key doesn't match public key")
+	c.Check(err, FitsTypeOf, InvalidKeyDataError{})
+}
+
+type authorizedResealSuiteNoTPM struct{}
+
+var _ = Suite(&authorizedResealSuiteNoTPM{})
+
+func (s *authorizedResealSuiteNoTPM) newKey(c *C) (*SealedKeyData, *ecdsa.PrivateKey) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	authKey, err := skd.PCRPolicyAuthKey(primaryKey)
+	c.Assert(err, IsNil)
+	return skd, authKey
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedReseal(c *C) {
+	skd, authKey := s.newKey(c)
+
+	created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	restore := MockTimeNow(func() time.Time { return created })
+	defer restore()
+
+	foo := testutil.DecodeHexString(c, "c4ceb1bf93ea7e95ba1ef1b7bc3ef2cd3a2d9b1e8acca5e0e2e47ea4d4d2ba2f")
+	bar := testutil.DecodeHexString(c, "3e1ac0c48c56a3ed1ae6ec7e85e35f5d8d3b23d0c7b3a8a8ec4f2c26e2f7fb58")
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, authKey, []string{"foo", "bar"}, []tpm2.Digest{foo, bar}, time.Time{})
+	c.Assert(err, IsNil)
+	c.Check(bundle.Created(), Equals, created)
+	c.Check(bundle.Expires().IsZero(), testutil.IsTrue)
+	c.Check(bundle.Names(), DeepEquals, []string{"foo", "bar"})
+	c.Check(bundle.PolicyDigest("bar"), DeepEquals, tpm2.Digest(bar))
+	c.Check(bundle.PolicyDigest("baz"), IsNil)
+
+	record, err := skd.ApplyAuthorizedReseal(bundle, "bar")
+	c.Assert(err, IsNil)
+	c.Check(record, DeepEquals, &AuthorizedResealRecord{
+		Time:         created,
+		Name:         "bar",
+		PolicyDigest: bar,
+		BundleDigest: bundle.Digest()})
+	c.Check(skd.AuthorizedPCRPolicy(), DeepEquals, tpm2.Digest(bar))
+
+	_, err = skd.ApplyAuthorizedReseal(bundle, "foo")
+	c.Check(err, IsNil)
+	c.Check(skd.AuthorizedPCRPolicy(), DeepEquals, tpm2.Digest(foo))
+}
+
+func (s *authorizedResealSuiteNoTPM) TestAuthorizedResealBundleJSON(c *C) {
+	skd, authKey := s.newKey(c)
+
+	expires := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, authKey, []string{"foo", "bar"}, []tpm2.Digest{make(tpm2.Digest, 32), make(tpm2.Digest, 32)}, expires)
+	c.Assert(err, IsNil)
+
+	b, err := json.Marshal(bundle)
+	c.Assert(err, IsNil)
+
+	var bundle2 *AuthorizedResealBundle
+	c.Assert(json.Unmarshal(b, &bundle2), IsNil)
+	c.Check(bundle2.Created().Equal(bundle.Created()), testutil.IsTrue)
+	c.Check(bundle2.Expires().Equal(expires), testutil.IsTrue)
+	c.Check(bundle2.Names(), DeepEquals, bundle.Names())
+	c.Check(bundle2.Digest(), DeepEquals, bundle.Digest())
+
+	restore := MockTimeNow(func() time.Time { return expires.Add(-time.Hour) })
+	defer restore()
+	_, err = skd.ApplyAuthorizedReseal(bundle2, "bar")
+	c.Check(err, IsNil)
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedResealTampered(c *C) {
+	skd, authKey := s.newKey(c)
+
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, authKey, []string{"foo"}, []tpm2.Digest{make(tpm2.Digest, 32)}, time.Time{})
+	c.Assert(err, IsNil)
+
+	b, err := json.Marshal(bundle)
+	c.Assert(err, IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(b, &j), IsNil)
+	j["reseals"].([]interface{})[0].(map[string]interface{})["name"] = "bar"
+	b, err = json.Marshal(j)
+	c.Assert(err, IsNil)
+
+	var bundle2 *AuthorizedResealBundle
+	c.Assert(json.Unmarshal(b, &bundle2), IsNil)
+
+	_, err = skd.ApplyAuthorizedReseal(bundle2, "bar")
+	c.Check(err, ErrorMatches, "cannot verify authorized reseal bundle: invalid signature")
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedResealWrongSigningKey(c *C) {
+	skd, _ := s.newKey(c)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, otherKey, []string{"foo"}, []tpm2.Digest{make(tpm2.Digest, 32)}, time.Time{})
+	c.Assert(err, IsNil)
+
+	_, err = skd.ApplyAuthorizedReseal(bundle, "foo")
+	c.Check(err, ErrorMatches, "cannot verify authorized reseal bundle: invalid signature")
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedResealWrongKey(c *C) {
+	skd1, authKey := s.newKey(c)
+	skd2, _ := s.newKey(c)
+
+	bundle, err := NewAuthorizedResealBundleForTesting(skd1, authKey, []string{"foo"}, []tpm2.Digest{make(tpm2.Digest, 32)}, time.Time{})
+	c.Assert(err, IsNil)
+
+	_, err = skd2.ApplyAuthorizedReseal(bundle, "foo")
+	c.Check(err, ErrorMatches, "cannot verify authorized reseal bundle: bundle was not created for this key")
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedResealExpired(c *C) {
+	skd, authKey := s.newKey(c)
+
+	expires := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, authKey, []string{"foo"}, []tpm2.Digest{make(tpm2.Digest, 32)}, expires)
+	c.Assert(err, IsNil)
+
+	restore := MockTimeNow(func() time.Time { return expires.Add(time.Second) })
+	defer restore()
+
+	_, err = skd.ApplyAuthorizedReseal(bundle, "foo")
+	c.Check(err, ErrorMatches, "authorized reseal bundle expired at 2026-11-01 00:00:00 \\+0000 UTC")
+}
+
+func (s *authorizedResealSuiteNoTPM) TestApplyAuthorizedResealUnknownName(c *C) {
+	skd, authKey := s.newKey(c)
+
+	bundle, err := NewAuthorizedResealBundleForTesting(skd, authKey, []string{"foo"}, []tpm2.Digest{make(tpm2.Digest, 32)}, time.Time{})
+	c.Assert(err, IsNil)
+
+	_, err = skd.ApplyAuthorizedReseal(bundle, "bar")
+	c.Check(err, ErrorMatches, "no PCR policy named \"bar\" in authorized reseal bundle")
+}
+
+func (s *authorizedResealSuiteNoTPM) TestNewAuthorizedResealBundleInvalidProfiles(c *C) {
+	skd, _ := s.newKey(c)
+
+	_, err := skd.NewAuthorizedResealBundle(nil, nil, nil, time.Time{})
+	c.Check(err, ErrorMatches, "no profiles supplied")
+
+	_, err = skd.NewAuthorizedResealBundle(nil, nil, make([]*AuthorizedResealProfile, 17), time.Time{})
+	c.Check(err, ErrorMatches, "too many profiles supplied \\(maximum 16\\)")
+
+	_, err = skd.NewAuthorizedResealBundle(nil, nil, []*AuthorizedResealProfile{{Name: "foo"}, {}}, time.Time{})
+	c.Check(err, ErrorMatches, "profile at index 1 has no name")
+
+	_, err = skd.NewAuthorizedResealBundle(nil, nil, []*AuthorizedResealProfile{{Name: "foo"}, {Name: "bar"}, {Name: "foo"}}, time.Time{})
+	c.Check(err, ErrorMatches, "duplicate profile name \"foo\"")
+}
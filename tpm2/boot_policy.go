@@ -0,0 +1,350 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	bootPolicyHeaderSize = 20
+)
+
+var (
+	bootPolicyMagic = [4]byte{'S', 'B', 'B', 'P'}
+
+	// ErrBootPolicyLocked is returned from Connection.WriteBootPolicy if the
+	// boot policy NV index has been write locked with Connection.LockBootPolicy
+	// since the last TPM reset.
+	ErrBootPolicyLocked = errors.New("the boot policy NV index is write locked")
+
+	// ErrNoBootPolicy is returned from Connection.ReadBootPolicy if a boot
+	// policy has not been written to the NV index yet.
+	ErrNoBootPolicy = errors.New("no boot policy has been written")
+
+	// ErrBootPolicyRolledBack is returned from Connection.ReadBootPolicy and
+	// Connection.WriteBootPolicy if the boot policy stored in the NV index
+	// was written before the most recent update recorded by the associated
+	// NV counter, which indicates that an older policy has been restored.
+	ErrBootPolicyRolledBack = errors.New("the boot policy has been rolled back")
+)
+
+// BootPolicy is a versioned policy blob that is stored in a NV index so that it
+// can be read and measured by a bootloader. The format of Data is defined by the
+// bootloader.
+type BootPolicy struct {
+	Version uint32 // The version of the policy, which can only increase
+	Data    []byte // The policy blob
+
+	// Counter is the value of the associated NV counter that this policy
+	// was written against. It is set by Connection.WriteBootPolicy and
+	// ignored otherwise. A bootloader should reject a policy with a counter
+	// value that is less than the current value of the NV counter.
+	Counter uint64
+}
+
+func (p *BootPolicy) marshal() []byte {
+	b := new(bytes.Buffer)
+	b.Write(bootPolicyMagic[:])
+	binary.Write(b, binary.BigEndian, p.Version)
+	binary.Write(b, binary.BigEndian, p.Counter)
+	binary.Write(b, binary.BigEndian, uint32(len(p.Data)))
+	b.Write(p.Data)
+	return b.Bytes()
+}
+
+func unmarshalBootPolicy(data []byte) (*BootPolicy, error) {
+	if len(data) < bootPolicyHeaderSize {
+		return nil, errors.New("data is too short")
+	}
+	if !bytes.Equal(data[:4], bootPolicyMagic[:]) {
+		return nil, errors.New("invalid magic")
+	}
+	version := binary.BigEndian.Uint32(data[4:])
+	counter := binary.BigEndian.Uint64(data[8:])
+	size := binary.BigEndian.Uint32(data[16:])
+	if uint64(size) > uint64(len(data)-bootPolicyHeaderSize) {
+		return nil, errors.New("invalid policy size")
+	}
+
+	return &BootPolicy{
+		Version: version,
+		Data:    append([]byte(nil), data[bootPolicyHeaderSize:bootPolicyHeaderSize+int(size)]...),
+		Counter: counter}, nil
+}
+
+// CreateBootPolicyIndex creates a NV index at the specified handle for storing a
+// BootPolicy with a blob of up to maxDataSize bytes, and a NV counter at the
+// specified counter handle that protects the stored policy against rollback.
+// The handles should be in the range reserved for owner indices. The indices can
+// only be written and read with the authorization of the storage hierarchy, and
+// the policy index can be write locked until the next TPM reset with
+// LockBootPolicy. The authorization value for the storage hierarchy must be
+// provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to
+// calling this function.
+//
+// If there is already a NV index at either of the specified handles, a
+// TPMResourceExistsError error is returned.
+func (t *Connection) CreateBootPolicyIndex(handle, counterHandle tpm2.Handle, maxDataSize uint16) (err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex || counterHandle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle type")
+	}
+	if handle == counterHandle {
+		return errors.New("the policy and counter handles must be different")
+	}
+	if int(maxDataSize)+bootPolicyHeaderSize > 0xffff {
+		return errors.New("maximum data size is too large")
+	}
+
+	defineSpace := func(nvPub *tpm2.NVPublic) (tpm2.ResourceContext, error) {
+		index, err := t.NVDefineSpace(t.OwnerHandleContext(), nil, nvPub, t.HmacSession())
+		if err != nil {
+			switch {
+			case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+				return nil, TPMResourceExistsError{nvPub.Index}
+			case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+				return nil, AuthFailError{tpm2.HandleOwner}
+			}
+			return nil, xerrors.Errorf("cannot define NV index: %w", err)
+		}
+		return index, nil
+	}
+
+	counter, err := defineSpace(&tpm2.NVPublic{
+		Index:   counterHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
+		Size:    8})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		t.NVUndefineSpace(t.OwnerHandleContext(), counter, t.HmacSession())
+	}()
+
+	// Initialize the counter so that it can be read.
+	if err := t.NVIncrement(t.OwnerHandleContext(), counter, t.HmacSession()); err != nil {
+		return xerrors.Errorf("cannot initialize NV counter: %w", err)
+	}
+
+	if _, err := defineSpace(&tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVWriteStClear | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
+		Size:    maxDataSize + bootPolicyHeaderSize}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *Connection) bootPolicyIndex(handle tpm2.Handle) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	index, err := t.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+	pub, _, err := t.NVReadPublic(index)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if pub.Attrs.Type() != tpm2.NVTypeOrdinary || pub.Size < bootPolicyHeaderSize {
+		return nil, nil, errors.New("NV index has the wrong type or size")
+	}
+	return index, pub, nil
+}
+
+func (t *Connection) bootPolicyCounter(handle tpm2.Handle) (tpm2.ResourceContext, uint64, error) {
+	index, err := t.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot create context for NV counter: %w", err)
+	}
+	pub, _, err := t.NVReadPublic(index)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot read public area of NV counter: %w", err)
+	}
+	if pub.Attrs.Type() != tpm2.NVTypeCounter || pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, 0, errors.New("NV counter has the wrong type or is not initialized")
+	}
+
+	var value uint64
+	if err := runWithParamEncryption(t.HmacSession(), t.nvReadEncryptAttrs(), func(session tpm2.SessionContext) (err error) {
+		value, err = t.NVReadCounter(t.OwnerHandleContext(), index, session)
+		return err
+	}); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVRead, 1) {
+			return nil, 0, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, 0, xerrors.Errorf("cannot read NV counter: %w", err)
+	}
+	return index, value, nil
+}
+
+func (t *Connection) readBootPolicy(index tpm2.ResourceContext, pub *tpm2.NVPublic, counter uint64) (*BootPolicy, error) {
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, ErrNoBootPolicy
+	}
+
+	var data []byte
+	if err := runWithParamEncryption(t.HmacSession(), t.nvReadEncryptAttrs(), func(session tpm2.SessionContext) (err error) {
+		data, err = t.NVRead(t.OwnerHandleContext(), index, pub.Size, 0, session)
+		return err
+	}); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVRead, 1) {
+			return nil, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	policy, err := unmarshalBootPolicy(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode boot policy: %w", err)
+	}
+	if policy.Counter < counter {
+		return nil, ErrBootPolicyRolledBack
+	}
+	return policy, nil
+}
+
+// ReadBootPolicy reads the BootPolicy from the NV index at the specified handle,
+// which must have been created by CreateBootPolicyIndex along with the NV counter
+// at the specified counter handle. This requires the authorization value for the
+// storage hierarchy. If no policy has been written yet, a ErrNoBootPolicy error is
+// returned. If the stored policy was written before the current value of the NV
+// counter, a ErrBootPolicyRolledBack error is returned.
+func (t *Connection) ReadBootPolicy(handle, counterHandle tpm2.Handle) (*BootPolicy, error) {
+	index, pub, err := t.bootPolicyIndex(handle)
+	if err != nil {
+		return nil, err
+	}
+	_, counter, err := t.bootPolicyCounter(counterHandle)
+	if err != nil {
+		return nil, err
+	}
+	return t.readBootPolicy(index, pub, counter)
+}
+
+// WriteBootPolicy writes the supplied policy to the NV index at the specified
+// handle, which must have been created by CreateBootPolicyIndex along with the NV
+// counter at the specified counter handle. The version of the supplied policy must
+// be greater than the version of the policy that is currently stored, which
+// permits a new policy to revoke an older one. This requires the authorization
+// value for the storage hierarchy.
+//
+// The NV counter is incremented after the policy is written, and the policy
+// records the new counter value. As the counter can never decrease, restoring
+// a previously written policy to the NV index is detected by ReadBootPolicy
+// and by subsequent calls to this function, which return a
+// ErrBootPolicyRolledBack error.
+//
+// If the index has been write locked by LockBootPolicy, a ErrBootPolicyLocked
+// error is returned, and the policy can only be written after the next TPM
+// reset.
+func (t *Connection) WriteBootPolicy(handle, counterHandle tpm2.Handle, policy *BootPolicy) error {
+	index, pub, err := t.bootPolicyIndex(handle)
+	if err != nil {
+		return err
+	}
+	if len(policy.Data)+bootPolicyHeaderSize > int(pub.Size) {
+		return fmt.Errorf("policy is too large (maximum size is %d bytes)", int(pub.Size)-bootPolicyHeaderSize)
+	}
+	if pub.Attrs&tpm2.AttrNVWriteLocked != 0 {
+		return ErrBootPolicyLocked
+	}
+
+	counterIndex, counter, err := t.bootPolicyCounter(counterHandle)
+	if err != nil {
+		return err
+	}
+
+	current, err := t.readBootPolicy(index, pub, counter)
+	switch {
+	case err == ErrNoBootPolicy:
+		// Ok
+	case err == ErrBootPolicyRolledBack:
+		return err
+	case err != nil:
+		return xerrors.Errorf("cannot read current boot policy: %w", err)
+	case policy.Version <= current.Version:
+		return fmt.Errorf("policy version %d is not newer than the current version %d", policy.Version, current.Version)
+	}
+
+	// Write the policy with the value that the counter will have once it
+	// is incremented. If we are interrupted before the counter is
+	// incremented, the policy is still considered valid.
+	toWrite := *policy
+	toWrite.Counter = counter + 1
+
+	// Pad the data to the size of the index so that no trailing bytes from
+	// a previous larger policy remain.
+	data := make([]byte, pub.Size)
+	copy(data, toWrite.marshal())
+
+	if err := runWithParamEncryption(t.HmacSession(), tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+		return t.NVWrite(t.OwnerHandleContext(), index, data, 0, session)
+	}); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandNVWrite):
+			return ErrBootPolicyLocked
+		case isAuthFailError(err, tpm2.CommandNVWrite, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot write NV index: %w", err)
+	}
+
+	if err := t.NVIncrement(t.OwnerHandleContext(), counterIndex, t.HmacSession()); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVIncrement, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot increment NV counter: %w", err)
+	}
+
+	return nil
+}
+
+// LockBootPolicy write locks the NV index at the specified handle, which must
+// have been created by CreateBootPolicyIndex, until the next TPM reset. This
+// should be called once the boot policy has been updated during early boot, to
+// prevent it from being modified for the remainder of the boot. This requires
+// the authorization value for the storage hierarchy.
+func (t *Connection) LockBootPolicy(handle tpm2.Handle) error {
+	index, _, err := t.bootPolicyIndex(handle)
+	if err != nil {
+		return err
+	}
+
+	if err := t.NVWriteLock(t.OwnerHandleContext(), index, t.HmacSession()); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVWriteLock, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot write lock NV index: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type bootPolicySuiteNoTPM struct{}
+
+type bootPolicySuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *bootPolicySuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&bootPolicySuiteNoTPM{})
+var _ = Suite(&bootPolicySuite{})
+
+func (s *bootPolicySuiteNoTPM) TestMarshal(c *C) {
+	policy := &BootPolicy{Version: 3, Data: []byte("foo"), Counter: 5}
+	c.Check(policy.Marshal(), DeepEquals, testutil.DecodeHexString(c, "53424250000000030000000000000005"+"00000003666f6f"))
+}
+
+func (s *bootPolicySuiteNoTPM) TestUnmarshalWithPadding(c *C) {
+	policy, err := UnmarshalBootPolicy(testutil.DecodeHexString(c, "53424250000000030000000000000005"+"00000003666f6f0000000000"))
+	c.Check(err, IsNil)
+	c.Check(policy, DeepEquals, &BootPolicy{Version: 3, Data: []byte("foo"), Counter: 5})
+}
+
+func (s *bootPolicySuiteNoTPM) TestUnmarshalInvalidMagic(c *C) {
+	_, err := UnmarshalBootPolicy(testutil.DecodeHexString(c, "00000000000000030000000000000005"+"00000003666f6f"))
+	c.Check(err, ErrorMatches, `invalid magic`)
+}
+
+func (s *bootPolicySuiteNoTPM) TestUnmarshalInvalidSize(c *C) {
+	_, err := UnmarshalBootPolicy(testutil.DecodeHexString(c, "53424250000000030000000000000005"+"00000004666f6f"))
+	c.Check(err, ErrorMatches, `invalid policy size`)
+}
+
+func (s *bootPolicySuiteNoTPM) TestUnmarshalTooShort(c *C) {
+	_, err := UnmarshalBootPolicy(testutil.DecodeHexString(c, "53424250"))
+	c.Check(err, ErrorMatches, `data is too short`)
+}
+
+func (s *bootPolicySuite) createIndex(c *C, size uint16) (handle, counterHandle tpm2.Handle) {
+	handle = s.NextAvailableHandle(c, 0x01810100)
+	counterHandle = s.NextAvailableHandle(c, handle+1)
+	c.Assert(s.TPM().CreateBootPolicyIndex(handle, counterHandle, size), IsNil)
+	s.AddCleanup(func() {
+		for _, h := range []tpm2.Handle{handle, counterHandle} {
+			index, err := s.TPM().CreateResourceContextFromTPM(h)
+			c.Assert(err, IsNil)
+			c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+		}
+	})
+	return handle, counterHandle
+}
+
+func (s *bootPolicySuite) readCounter(c *C, handle tpm2.Handle) uint64 {
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	value, err := s.TPM().NVReadCounter(s.TPM().OwnerHandleContext(), index, nil)
+	c.Assert(err, IsNil)
+	return value
+}
+
+func (s *bootPolicySuite) TestWriteAndRead(c *C) {
+	handle, counterHandle := s.createIndex(c, 64)
+
+	_, err := s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, Equals, ErrNoBootPolicy)
+
+	counter := s.readCounter(c, counterHandle)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy1")}), IsNil)
+	c.Check(s.readCounter(c, counterHandle), Equals, counter+1)
+	policy, err := s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, IsNil)
+	c.Check(policy, DeepEquals, &BootPolicy{Version: 1, Data: []byte("policy1"), Counter: counter + 1})
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("p2")}), IsNil)
+	c.Check(s.readCounter(c, counterHandle), Equals, counter+2)
+	policy, err = s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, IsNil)
+	c.Check(policy, DeepEquals, &BootPolicy{Version: 2, Data: []byte("p2"), Counter: counter + 2})
+}
+
+func (s *bootPolicySuite) TestWriteOlderVersion(c *C) {
+	handle, counterHandle := s.createIndex(c, 64)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("policy")}), IsNil)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("other")}), ErrorMatches,
+		`policy version 2 is not newer than the current version 2`)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("other")}), ErrorMatches,
+		`policy version 1 is not newer than the current version 2`)
+}
+
+func (s *bootPolicySuite) TestRollback(c *C) {
+	handle, counterHandle := s.createIndex(c, 64)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy1")}), IsNil)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	pub, _, err := s.TPM().NVReadPublic(index)
+	c.Assert(err, IsNil)
+	old, err := s.TPM().NVRead(s.TPM().OwnerHandleContext(), index, pub.Size, 0, nil)
+	c.Assert(err, IsNil)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("policy2")}), IsNil)
+
+	// Restore the old policy directly.
+	c.Check(s.TPM().NVWrite(s.TPM().OwnerHandleContext(), index, old, 0, nil), IsNil)
+
+	_, err = s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, Equals, ErrBootPolicyRolledBack)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("policy2")}), Equals, ErrBootPolicyRolledBack)
+}
+
+func (s *bootPolicySuite) TestWriteTooLarge(c *C) {
+	handle, counterHandle := s.createIndex(c, 4)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy")}), ErrorMatches,
+		`policy is too large \(maximum size is 4 bytes\)`)
+}
+
+func (s *bootPolicySuite) TestLock(c *C) {
+	handle, counterHandle := s.createIndex(c, 64)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy")}), IsNil)
+	c.Check(s.TPM().LockBootPolicy(handle), IsNil)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 2, Data: []byte("policy")}), Equals, ErrBootPolicyLocked)
+
+	policy, err := s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, IsNil)
+	c.Check(policy.Version, Equals, uint32(1))
+}
+
+func (s *bootPolicySuite) TestCreateExists(c *C) {
+	handle, counterHandle := s.createIndex(c, 64)
+	c.Check(s.TPM().CreateBootPolicyIndex(handle, s.NextAvailableHandle(c, counterHandle+1), 64), Equals, TPMResourceExistsError{handle})
+	c.Check(s.TPM().CreateBootPolicyIndex(s.NextAvailableHandle(c, counterHandle+1), counterHandle, 64), Equals, TPMResourceExistsError{counterHandle})
+}
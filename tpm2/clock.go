@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/testhooks"
+)
+
+var timeNow = testhooks.Now
+
+// ReadSafeClock reads the current time and clock information from the TPM. If
+// the TPM indicates that the clock value is not safe, which is the case after
+// an unorderly shutdown until the TPM next updates the clock value stored in NV,
+// then a ErrTPMClockUnsafe error will be returned. An unsafe clock value may have
+// been reported previously, and so shouldn't be relied on when constructing or
+// evaluating policies that use TPM2_PolicyCounterTimer. Virtual TPMs may also
+// report an unsafe clock after the guest has been migrated.
+func (t *Connection) ReadSafeClock() (*tpm2.TimeInfo, error) {
+	info, err := t.ReadClock()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read clock: %w", err)
+	}
+	if !info.ClockInfo.Safe {
+		return nil, ErrTPMClockUnsafe
+	}
+	return info, nil
+}
+
+// ClockMapping records the relationship between wall time and the TPM's clock
+// at a specific point in time, and can be used to translate between the two
+// when constructing time-bounded policies. It can be serialized to JSON in
+// order to persist it.
+//
+// The TPM's clock only advances whilst the TPM is powered, so the translation
+// is only exact for the period during which the TPM was continuously powered
+// after the mapping was created. For clock values reached later, the
+// corresponding wall time returned from WallTimeAt is the earliest possible wall
+// time, and the clock value returned from ClockAt for a wall time is the latest
+// clock value that could have been reached by that time.
+//
+// Mappings created on a virtual TPM (see Connection.IsVirtualTPM) are only valid
+// for the TPM reset cycle in which they were created, because the clock of a
+// virtual TPM may not be preserved when the guest is migrated or restored from a
+// snapshot.
+type ClockMapping struct {
+	WallTime   time.Time `json:"wall-time"`
+	Clock      uint64    `json:"clock"`
+	ResetCount uint32    `json:"reset-count"`
+	VirtualTPM bool      `json:"virtual-tpm,omitempty"` // The mapping was created on a virtual TPM
+}
+
+// NewClockMapping creates a new mapping between the current wall time and the
+// TPM's clock. The TPM's clock must be safe, else a ErrTPMClockUnsafe error will
+// be returned.
+func (t *Connection) NewClockMapping() (*ClockMapping, error) {
+	info, err := t.ReadSafeClock()
+	if err != nil {
+		return nil, err
+	}
+	virtual, err := t.IsVirtualTPM()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClockMapping{
+		WallTime:   timeNow().UTC(),
+		Clock:      info.ClockInfo.Clock,
+		ResetCount: info.ClockInfo.ResetCount,
+		VirtualTPM: virtual}, nil
+}
+
+// ClockAt returns the TPM clock value that corresponds to the supplied wall time.
+// If the wall time is before the time that this mapping was created, an error
+// is returned.
+func (m *ClockMapping) ClockAt(t time.Time) (uint64, error) {
+	d := t.Sub(m.WallTime)
+	if d < 0 {
+		return 0, errors.New("wall time is before the mapping was created")
+	}
+	return m.Clock + uint64(d.Milliseconds()), nil
+}
+
+// WallTimeAt returns the wall time that corresponds to the supplied TPM clock value.
+// If the clock value is before the clock value at the time that this mapping was
+// created, an error is returned.
+func (m *ClockMapping) WallTimeAt(clock uint64) (time.Time, error) {
+	if clock < m.Clock {
+		return time.Time{}, errors.New("clock value is before the mapping was created")
+	}
+	return m.WallTime.Add(time.Duration(clock-m.Clock) * time.Millisecond), nil
+}
+
+// IsValidFor indicates whether this mapping is valid for the supplied current
+// clock information from the TPM. The TPM's clock is monotonic unless the TPM is
+// cleared, so if the current clock or reset count is lower than when the mapping
+// was created, the mapping is no longer valid. If the mapping was created on a
+// virtual TPM, it is also no longer valid if the reset count has changed.
+func (m *ClockMapping) IsValidFor(info *tpm2.ClockInfo) bool {
+	if m.VirtualTPM && info.ResetCount != m.ResetCount {
+		return false
+	}
+	return info.Clock >= m.Clock && info.ResetCount >= m.ResetCount
+}
+
+// Write serializes this mapping to the supplied writer.
+func (m *ClockMapping) Write(w io.Writer) error {
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		return xerrors.Errorf("cannot encode clock mapping: %w", err)
+	}
+	return nil
+}
+
+// ReadClockMapping reads a mapping previously serialized with ClockMapping.Write
+// from the supplied reader.
+func ReadClockMapping(r io.Reader) (*ClockMapping, error) {
+	var m *ClockMapping
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, xerrors.Errorf("cannot decode clock mapping: %w", err)
+	}
+	if m == nil {
+		return nil, errors.New("no clock mapping")
+	}
+	return m, nil
+}
@@ -0,0 +1,153 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type clockSuiteNoTPM struct{}
+
+type clockSuite struct {
+	tpm2test.TPMTest
+}
+
+var _ = Suite(&clockSuiteNoTPM{})
+var _ = Suite(&clockSuite{})
+
+func (s *clockSuiteNoTPM) TestClockAt(c *C) {
+	m := &ClockMapping{
+		WallTime: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:    50000}
+	clock, err := m.ClockAt(time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC))
+	c.Check(err, IsNil)
+	c.Check(clock, Equals, uint64(110000))
+}
+
+func (s *clockSuiteNoTPM) TestClockAtBeforeMapping(c *C) {
+	m := &ClockMapping{
+		WallTime: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:    50000}
+	_, err := m.ClockAt(time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC))
+	c.Check(err, ErrorMatches, `wall time is before the mapping was created`)
+}
+
+func (s *clockSuiteNoTPM) TestWallTimeAt(c *C) {
+	m := &ClockMapping{
+		WallTime: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:    50000}
+	t, err := m.WallTimeAt(50000 + 3600*1000)
+	c.Check(err, IsNil)
+	c.Check(t, Equals, time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC))
+}
+
+func (s *clockSuiteNoTPM) TestWallTimeAtBeforeMapping(c *C) {
+	m := &ClockMapping{
+		WallTime: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:    50000}
+	_, err := m.WallTimeAt(49999)
+	c.Check(err, ErrorMatches, `clock value is before the mapping was created`)
+}
+
+func (s *clockSuiteNoTPM) TestIsValidFor(c *C) {
+	m := &ClockMapping{Clock: 50000, ResetCount: 3}
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 60000, ResetCount: 4}), Equals, true)
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 50000, ResetCount: 3}), Equals, true)
+	// The TPM has been cleared.
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 1000, ResetCount: 0}), Equals, false)
+}
+
+func (s *clockSuiteNoTPM) TestIsValidForVirtualTPM(c *C) {
+	m := &ClockMapping{Clock: 50000, ResetCount: 3, VirtualTPM: true}
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 60000, ResetCount: 3}), Equals, true)
+	// The guest may have been migrated or restored from a snapshot.
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 60000, ResetCount: 4}), Equals, false)
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 60000, ResetCount: 2}), Equals, false)
+	c.Check(m.IsValidFor(&tpm2.ClockInfo{Clock: 40000, ResetCount: 3}), Equals, false)
+}
+
+func (s *clockSuiteNoTPM) TestWriteAndReadVirtualTPM(c *C) {
+	m := &ClockMapping{
+		WallTime:   time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:      50000,
+		ResetCount: 2,
+		VirtualTPM: true}
+
+	w := new(bytes.Buffer)
+	c.Check(m.Write(w), IsNil)
+	c.Check(w.String(), Equals, `{"wall-time":"2024-03-01T12:00:00Z","clock":50000,"reset-count":2,"virtual-tpm":true}`+"\n")
+
+	m2, err := ReadClockMapping(w)
+	c.Check(err, IsNil)
+	c.Check(m2, DeepEquals, m)
+}
+
+func (s *clockSuiteNoTPM) TestWriteAndRead(c *C) {
+	m := &ClockMapping{
+		WallTime:   time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Clock:      50000,
+		ResetCount: 2}
+
+	w := new(bytes.Buffer)
+	c.Check(m.Write(w), IsNil)
+	c.Check(w.String(), Equals, `{"wall-time":"2024-03-01T12:00:00Z","clock":50000,"reset-count":2}`+"\n")
+
+	m2, err := ReadClockMapping(w)
+	c.Check(err, IsNil)
+	c.Check(m2, DeepEquals, m)
+}
+
+func (s *clockSuiteNoTPM) TestReadInvalid(c *C) {
+	_, err := ReadClockMapping(bytes.NewReader([]byte("foo")))
+	c.Check(err, ErrorMatches, `cannot decode clock mapping: .*`)
+
+	_, err = ReadClockMapping(bytes.NewReader([]byte("null")))
+	c.Check(err, ErrorMatches, `no clock mapping`)
+}
+
+func (s *clockSuite) TestReadSafeClock(c *C) {
+	info, err := s.TPM().ReadSafeClock()
+	c.Assert(err, IsNil)
+	c.Check(info.ClockInfo.Safe, Equals, true)
+}
+
+func (s *clockSuite) TestNewClockMapping(c *C) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	restore := MockTimeNow(func() time.Time { return now })
+	defer restore()
+
+	m, err := s.TPM().NewClockMapping()
+	c.Assert(err, IsNil)
+	c.Check(m.WallTime, Equals, now)
+
+	info, err := s.TPM().ReadClock()
+	c.Assert(err, IsNil)
+	c.Check(m.IsValidFor(&info.ClockInfo), Equals, true)
+	c.Check(m.ResetCount, Equals, info.ClockInfo.ResetCount)
+	c.Check(m.VirtualTPM, Equals, false)
+}
@@ -29,4 +29,8 @@ const (
 	// SHA-256 is mandatory to exist on every PC-Client TPM
 	// XXX: Maybe dynamically select algorithms based on what's available on the device?
 	defaultSessionHashAlgorithm tpm2.HashAlgorithmId = tpm2.HashAlgorithmSHA256
+
+	bootManagerCodePCR  = 4  // Boot Manager Code and Boot Attempts PCR
+	secureBootPolicyPCR = 7  // Secure Boot Policy Measurements PCR
+	kernelConfigPCR     = 12 // Kernel commandline and system model PCR
 )
@@ -0,0 +1,274 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcti"
+)
+
+// ErrConnectionAborted is returned from any function if the connection to the
+// TPM can no longer be used because a previous command was aborted whilst
+// waiting for a response, as a result of its context being cancelled or its
+// deadline expiring. The connection should be closed.
+var ErrConnectionAborted = errors.New("the TPM connection was aborted whilst waiting for a response")
+
+// contextTransport is a tpm2.Transport that associates a context with
+// commands, so that they can be cancelled or time out. The context is checked
+// before each command is submitted. If the underlying transport supports read
+// deadlines and the context is cancelled or its deadline expires whilst waiting
+// for a response, the pending read is unblocked and the underlying transport is
+// closed. The connection can no longer be used after this, as there is no way
+// to retrieve the response to a command later on.
+type contextTransport struct {
+	transport tpm2.Transport
+	ctx       context.Context
+	aborted   bool
+	commands  int // the number of commands submitted, for metrics
+	handles   handleTracker
+}
+
+func newContextTransport(transport tpm2.Transport) *contextTransport {
+	return &contextTransport{
+		transport: transport,
+		ctx:       context.Background()}
+}
+
+// setContext associates the supplied context with subsequent commands,
+// returning a function to restore the previous context.
+func (t *contextTransport) setContext(ctx context.Context) (restore func()) {
+	orig := t.ctx
+	t.ctx = ctx
+	return func() {
+		t.ctx = orig
+	}
+}
+
+// watchContext arranges for a pending read on the underlying transport to be
+// unblocked if the supplied context is cancelled or its deadline expires, by
+// setting a read deadline. The returned function must be called once the read
+// has completed, and clears the deadline.
+func (t *contextTransport) watchContext(ctx context.Context, transport tcti.DeadlineTransport) (stop func(), err error) {
+	deadline, _ := ctx.Deadline()
+	if err := transport.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// Expire the deadline now.
+			transport.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		transport.SetReadDeadline(time.Time{})
+	}, nil
+}
+
+func (t *contextTransport) Read(data []byte) (int, error) {
+	if t.aborted {
+		return 0, ErrConnectionAborted
+	}
+
+	ctx := t.ctx
+	if transport, ok := t.transport.(tcti.DeadlineTransport); ok && ctx.Done() != nil {
+		stop, err := t.watchContext(ctx, transport)
+		if err == nil {
+			defer stop()
+		}
+		// If the transport doesn't support deadlines, the read will
+		// block until the TPM responds.
+	}
+
+	n, err := t.transport.Read(data)
+	if err != nil && ctx.Err() != nil {
+		// The read was unblocked because the context was cancelled or
+		// its deadline expired. The TPM may still respond to the
+		// command, so the transport is closed to make sure that the
+		// response can't be consumed by a subsequent command.
+		t.aborted = true
+		t.transport.Close()
+		return 0, ctx.Err()
+	}
+	t.handles.responseRead(data[:n])
+	return n, err
+}
+
+func (t *contextTransport) Write(data []byte) (int, error) {
+	if t.aborted {
+		return 0, ErrConnectionAborted
+	}
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := t.transport.Write(data)
+	if err == nil {
+		// Each command is submitted with a single write.
+		t.commands += 1
+		t.handles.commandSubmitted(data)
+	}
+	return n, err
+}
+
+func (t *contextTransport) Close() error {
+	if t.aborted {
+		// Already closed
+		return nil
+	}
+	return t.transport.Close()
+}
+
+// RunWithContext runs the supplied function with the supplied context
+// associated with this connection, which makes it possible for any function in
+// this package that uses this connection to be cancelled or to time out. The
+// context is checked before each TPM command is submitted, and if it is
+// cancelled or its deadline expires, the function will return an error that
+// wraps the error returned from the context's Err method. This can be tested
+// for with errors.Is.
+//
+// If the context is cancelled or its deadline expires whilst waiting for the
+// TPM to respond to a command (eg, because the TPM is wedged), the connection
+// is aborted and can no longer be used, and subsequent calls will return a
+// ErrConnectionAborted error. In this case, the connection should be closed.
+// Note that the TPM may still complete the aborted command.
+//
+// If this connection was created with NewConnectionWithExternalHmacSession,
+// the context can only be checked before fn is called.
+//
+// Dedicated context variants exist for the most commonly used long-running
+// operations. Any other function in this package that accepts a Connection can
+// be made cancellable by calling it from fn. The platform handler registered by
+// this package opens its own connection with ConnectToTPMContext and uses the
+// context supplied to secboot.KeyData.RecoverKeysContext or
+// secboot.KeyData.RecoverKeysWithPassphraseContext, which is how the
+// secboot.ActivateVolumeWith* functions apply their deadline. The other
+// secboot.KeyData methods that use the platform handler (eg,
+// secboot.KeyData.ChangePassphrase) cannot be cancelled.
+func (t *Connection) RunWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.transport != nil {
+		restore := t.transport.setContext(ctx)
+		defer restore()
+	}
+
+	err := fn()
+	if err != nil && ctx.Err() != nil && !xerrors.Is(err, ctx.Err()) {
+		// Some errors from the TPM are converted to other errors
+		// without wrapping them, so make sure that the caller can
+		// still test for the context error.
+		return xerrors.Errorf("%v: %w", err, ctx.Err())
+	}
+	return err
+}
+
+// EnsureProvisionedContext is a variant of EnsureProvisioned that accepts a
+// context. See RunWithContext for details of how the context is used.
+func (t *Connection) EnsureProvisionedContext(ctx context.Context, mode ProvisionMode, newLockoutAuth []byte) error {
+	return t.RunWithContext(ctx, func() error {
+		return t.EnsureProvisioned(mode, newLockoutAuth)
+	})
+}
+
+// SealKeyToTPMContext is a variant of SealKeyToTPM that accepts a context. See
+// Connection.RunWithContext for details of how the context is used.
+func SealKeyToTPMContext(ctx context.Context, tpm *Connection, key secboot.DiskUnlockKey, keyPath string, params *KeyCreationParams) (authKey secboot.PrimaryKey, err error) {
+	err = tpm.RunWithContext(ctx, func() (err error) {
+		authKey, err = SealKeyToTPM(tpm, key, keyPath, params)
+		return err
+	})
+	return authKey, err
+}
+
+// UnsealFromTPMContext is a variant of UnsealFromTPM that accepts a context.
+// See Connection.RunWithContext for details of how the context is used.
+func (k *SealedKeyObject) UnsealFromTPMContext(ctx context.Context, tpm *Connection) (key secboot.DiskUnlockKey, authKey secboot.PrimaryKey, err error) {
+	err = tpm.RunWithContext(ctx, func() (err error) {
+		key, authKey, err = k.UnsealFromTPM(tpm)
+		return err
+	})
+	return key, authKey, err
+}
+
+// SealKeyToTPMMultipleContext is a variant of SealKeyToTPMMultiple that accepts
+// a context. See Connection.RunWithContext for details of how the context is
+// used.
+func SealKeyToTPMMultipleContext(ctx context.Context, tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey secboot.PrimaryKey, err error) {
+	err = tpm.RunWithContext(ctx, func() (err error) {
+		authKey, err = SealKeyToTPMMultiple(tpm, keys, params)
+		return err
+	})
+	return authKey, err
+}
+
+// NewTPMProtectedKeyContext is a variant of NewTPMProtectedKey that accepts a
+// context. See Connection.RunWithContext for details of how the context is
+// used.
+func NewTPMProtectedKeyContext(ctx context.Context, tpm *Connection, params *ProtectKeyParams) (protectedKey *secboot.KeyData, primaryKey secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	err = tpm.RunWithContext(ctx, func() (err error) {
+		protectedKey, primaryKey, unlockKey, err = NewTPMProtectedKey(tpm, params)
+		return err
+	})
+	return protectedKey, primaryKey, unlockKey, err
+}
+
+// UpdatePCRProtectionPolicyContext is a variant of
+// SealedKeyObject.UpdatePCRProtectionPolicy that accepts a context. See
+// Connection.RunWithContext for details of how the context is used.
+func (k *SealedKeyObject) UpdatePCRProtectionPolicyContext(ctx context.Context, tpm *Connection, authKey secboot.PrimaryKey, pcrProfile *PCRProtectionProfile) error {
+	return tpm.RunWithContext(ctx, func() error {
+		return k.UpdatePCRProtectionPolicy(tpm, authKey, pcrProfile)
+	})
+}
+
+// RevokeOldPCRProtectionPoliciesContext is a variant of
+// SealedKeyObject.RevokeOldPCRProtectionPolicies that accepts a context. See
+// Connection.RunWithContext for details of how the context is used.
+func (k *SealedKeyObject) RevokeOldPCRProtectionPoliciesContext(ctx context.Context, tpm *Connection, authKey secboot.PrimaryKey) error {
+	return tpm.RunWithContext(ctx, func() error {
+		return k.RevokeOldPCRProtectionPolicies(tpm, authKey)
+	})
+}
+
+// UpdateKeyDataPCRProtectionPolicyContext is a variant of
+// UpdateKeyDataPCRProtectionPolicy that accepts a context. See
+// Connection.RunWithContext for details of how the context is used.
+func UpdateKeyDataPCRProtectionPolicyContext(ctx context.Context, tpm *Connection, authKey secboot.PrimaryKey, pcrProfile *PCRProtectionProfile, policyVersionOption PCRPolicyVersionOption, keys ...*secboot.KeyData) error {
+	return tpm.RunWithContext(ctx, func() error {
+		return UpdateKeyDataPCRProtectionPolicy(tpm, authKey, pcrProfile, policyVersionOption, keys...)
+	})
+}
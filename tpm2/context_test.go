@@ -0,0 +1,375 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+// mockContextTransport is a transport where reads block until a response is
+// supplied, the read deadline expires or the transport is closed.
+type mockContextTransport struct {
+	written []byte
+	rsp     chan []byte
+	closed  chan struct{}
+	pending []byte
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newMockContextTransport() *mockContextTransport {
+	return &mockContextTransport{
+		rsp:             make(chan []byte, 1),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}, 1)}
+}
+
+func (t *mockContextTransport) Read(data []byte) (int, error) {
+	for len(t.pending) == 0 {
+		t.mu.Lock()
+		deadline := t.deadline
+		t.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timeout = time.After(time.Until(deadline))
+		}
+
+		select {
+		case rsp := <-t.rsp:
+			t.pending = rsp
+		case <-t.closed:
+			return 0, io.ErrClosedPipe
+		case <-t.deadlineChanged:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(data, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func (t *mockContextTransport) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	t.deadline = deadline
+	t.mu.Unlock()
+
+	select {
+	case t.deadlineChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (t *mockContextTransport) Write(data []byte) (int, error) {
+	t.written = append(t.written, data...)
+	return len(data), nil
+}
+
+func (t *mockContextTransport) Close() error {
+	select {
+	case <-t.closed:
+		return errors.New("already closed")
+	default:
+		close(t.closed)
+		return nil
+	}
+}
+
+type contextSuite struct{}
+
+var _ = Suite(&contextSuite{})
+
+func (s *contextSuite) TestWrite(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	n, err := transport.Write([]byte{1, 2, 3})
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 3)
+	c.Check(mock.written, DeepEquals, []byte{1, 2, 3})
+}
+
+func (s *contextSuite) TestWriteCancelled(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer transport.SetContext(ctx)()
+
+	_, err := transport.Write([]byte{1, 2, 3})
+	c.Check(err, Equals, context.Canceled)
+	c.Check(mock.written, HasLen, 0)
+}
+
+func (s *contextSuite) TestRead(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer transport.SetContext(ctx)()
+
+	mock.rsp <- []byte{4, 5, 6}
+	data := make([]byte, 10)
+	n, err := transport.Read(data)
+	c.Check(err, IsNil)
+	c.Check(data[:n], DeepEquals, []byte{4, 5, 6})
+}
+
+func (s *contextSuite) TestReadTimeout(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	restore := transport.SetContext(ctx)
+
+	_, err := transport.Read(make([]byte, 10))
+	c.Check(err, Equals, context.DeadlineExceeded)
+
+	// The underlying transport should have been closed.
+	select {
+	case <-mock.closed:
+	default:
+		c.Error("transport not closed")
+	}
+
+	// The connection can't be used again, even with a new context.
+	restore()
+	_, err = transport.Write([]byte{1, 2, 3})
+	c.Check(err, Equals, ErrConnectionAborted)
+	_, err = transport.Read(make([]byte, 10))
+	c.Check(err, Equals, ErrConnectionAborted)
+	c.Check(transport.Close(), IsNil)
+}
+
+func (s *contextSuite) TestReadCancelled(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer transport.SetContext(ctx)()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := transport.Read(make([]byte, 10))
+	c.Check(err, Equals, context.Canceled)
+
+	// The underlying transport should have been closed.
+	select {
+	case <-mock.closed:
+	default:
+		c.Error("transport not closed")
+	}
+}
+
+func (s *contextSuite) TestReadClearsDeadline(c *C) {
+	mock := newMockContextTransport()
+	transport := NewContextTransport(mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	defer transport.SetContext(ctx)()
+
+	mock.rsp <- []byte{4, 5, 6}
+	data := make([]byte, 10)
+	n, err := transport.Read(data)
+	c.Check(err, IsNil)
+	c.Check(data[:n], DeepEquals, []byte{4, 5, 6})
+	c.Check(mock.deadline.IsZero(), testutil.IsTrue)
+}
+
+// mockContextTransportNoDeadline is a transport that doesn't support read
+// deadlines.
+type mockContextTransportNoDeadline struct {
+	mock *mockContextTransport
+}
+
+func (t *mockContextTransportNoDeadline) Read(data []byte) (int, error) {
+	return t.mock.Read(data)
+}
+
+func (t *mockContextTransportNoDeadline) Write(data []byte) (int, error) {
+	return t.mock.Write(data)
+}
+
+func (t *mockContextTransportNoDeadline) Close() error {
+	return t.mock.Close()
+}
+
+func (s *contextSuite) TestReadNoDeadlineSupport(c *C) {
+	// Test that a read from a transport that doesn't support deadlines
+	// waits for the response.
+	mock := newMockContextTransport()
+	transport := NewContextTransport(&mockContextTransportNoDeadline{mock: mock})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	defer transport.SetContext(ctx)()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mock.rsp <- []byte{4, 5, 6}
+	}()
+
+	data := make([]byte, 10)
+	n, err := transport.Read(data)
+	c.Check(err, IsNil)
+	c.Check(data[:n], DeepEquals, []byte{4, 5, 6})
+}
+
+func (s *contextSuite) TestRunWithContextCancelled(c *C) {
+	tpm := NewConnectionWithContextTransport(NewContextTransport(newMockContextTransport()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	err := tpm.RunWithContext(ctx, func() error {
+		called = true
+		return nil
+	})
+	c.Check(err, Equals, context.Canceled)
+	c.Check(called, testutil.IsFalse)
+}
+
+func (s *contextSuite) TestRunWithContextTimeout(c *C) {
+	mock := newMockContextTransport()
+	tpm := NewConnectionWithContextTransport(NewContextTransport(mock))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := tpm.RunWithContext(ctx, func() error {
+		_, err := tpm.GetRandom(16)
+		return err
+	})
+	c.Check(errors.Is(err, context.DeadlineExceeded), testutil.IsTrue)
+	c.Check(mock.written, Not(HasLen), 0)
+
+	// Subsequent commands fail.
+	_, err = tpm.GetRandom(16)
+	c.Check(errors.Is(err, ErrConnectionAborted), testutil.IsTrue)
+	c.Check(tpm.Close(), IsNil)
+}
+
+func (s *contextSuite) TestContextVariantsCancelled(c *C) {
+	mock := newMockContextTransport()
+	tpm := NewConnectionWithContextTransport(NewContextTransport(mock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := SealKeyToTPMMultipleContext(ctx, tpm, nil, nil)
+	c.Check(err, Equals, context.Canceled)
+	_, _, _, err = NewTPMProtectedKeyContext(ctx, tpm, nil)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(UpdateKeyDataPCRProtectionPolicyContext(ctx, tpm, nil, nil, NoNewPCRPolicyVersion), Equals, context.Canceled)
+	c.Check(mock.written, HasLen, 0)
+}
+
+func (s *contextSuite) TestRunWithContextWrapsError(c *C) {
+	tpm := NewConnectionWithContextTransport(NewContextTransport(newMockContextTransport()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := tpm.RunWithContext(ctx, func() error {
+		cancel()
+		return errors.New("some error")
+	})
+	c.Check(err, ErrorMatches, `some error: context canceled`)
+	c.Check(errors.Is(err, context.Canceled), testutil.IsTrue)
+}
+
+func (s *contextSuite) TestRunWithContextRestoresContext(c *C) {
+	mock := newMockContextTransport()
+	tpm := NewConnectionWithContextTransport(NewContextTransport(mock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Check(tpm.RunWithContext(ctx, func() error { return nil }), IsNil)
+	cancel()
+
+	// The cancelled context is no longer associated with the connection.
+	mock.rsp <- mockGetRandomResponse()
+	_, err := tpm.GetRandom(4)
+	c.Check(err, IsNil)
+}
+
+func mockGetRandomResponse() []byte {
+	buf := new(bytes.Buffer)
+	// tag = TPM_ST_NO_SESSIONS, size = 16, rc = TPM_RC_SUCCESS, TPM2B_DIGEST{size = 4}
+	buf.Write([]byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04})
+	return buf.Bytes()
+}
+
+type contextSuiteTPM struct {
+	tpm2test.TPMTest
+}
+
+func (s *contextSuiteTPM) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&contextSuiteTPM{})
+
+func (s *contextSuiteTPM) TestEnsureProvisionedContext(c *C) {
+	c.Check(s.TPM().EnsureProvisionedContext(context.Background(), ProvisionModeWithoutLockout, nil), IsNil)
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	c.Check(srk, NotNil)
+}
+
+func (s *contextSuiteTPM) TestEnsureProvisionedContextCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := s.TPM().EnsureProvisionedContext(ctx, ProvisionModeWithoutLockout, nil)
+	c.Check(err, Equals, context.Canceled)
+
+	_, err = s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Check(tpm2.IsResourceUnavailableError(err, tcg.SRKHandle), testutil.IsTrue)
+}
@@ -0,0 +1,369 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// DesiredPolicyBranch describes a single set of PCR values that a DesiredPolicy
+// approves.
+type DesiredPolicyBranch struct {
+	Description string `json:"description,omitempty"`
+
+	// Values contains the hex encoded value of each of the PCRs selected by
+	// the DesiredPolicy.
+	Values map[int]string `json:"values"`
+}
+
+// DesiredPolicy is a declarative description of the PCR policy that a set of
+// related TPM protected keys should have. It is intended to be maintained
+// externally and applied with ReconcileDesiredPolicy, so that the policy of
+// the keys on a device can be managed by updating a single document.
+type DesiredPolicy struct {
+	// PCRAlg is the PCR bank, and is one of "sha1", "sha256", "sha384" or
+	// "sha512".
+	PCRAlg string `json:"pcr-alg"`
+
+	// PCRs are the selected PCRs.
+	PCRs []int `json:"pcrs"`
+
+	// Branches are the approved sets of PCR values. A key can be unsealed
+	// if the selected PCRs match any one of these.
+	Branches []DesiredPolicyBranch `json:"branches"`
+
+	// PCRPolicyCounterHandle is the handle of the PCR policy counter that the
+	// keys are expected to use, or tpm2.HandleNull if they are not expected to
+	// use one. If this isn't set, the counter isn't checked. The counter is
+	// fixed when a key is created, and can't be changed by reconciling.
+	PCRPolicyCounterHandle *tpm2.Handle `json:"pcr-policy-counter-handle,omitempty"`
+}
+
+// ReadDesiredPolicy decodes a DesiredPolicy from the supplied reader.
+func ReadDesiredPolicy(r io.Reader) (*DesiredPolicy, error) {
+	var p *DesiredPolicy
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, xerrors.Errorf("cannot decode desired policy: %w", err)
+	}
+	if p == nil {
+		return nil, errors.New("no desired policy")
+	}
+	return p, nil
+}
+
+// ReadDesiredPolicyFile decodes a DesiredPolicy from the file at the specified
+// path.
+func ReadDesiredPolicyFile(path string) (*DesiredPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadDesiredPolicy(f)
+}
+
+func parseHashAlgName(name string) (tpm2.HashAlgorithmId, error) {
+	for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384, tpm2.HashAlgorithmSHA512} {
+		if hashAlgName(alg) == name {
+			return alg, nil
+		}
+	}
+	return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported PCR algorithm %q", name)
+}
+
+// PCRProtectionProfile returns a PCRProtectionProfile that corresponds to this
+// policy. An error is returned if the policy is invalid.
+func (p *DesiredPolicy) PCRProtectionProfile() (*PCRProtectionProfile, error) {
+	alg, err := parseHashAlgName(p.PCRAlg)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.PCRs) == 0 {
+		return nil, errors.New("no PCRs selected")
+	}
+	if len(p.Branches) == 0 {
+		return nil, errors.New("no branches")
+	}
+
+	var profiles []*PCRProtectionProfile
+	for i, branch := range p.Branches {
+		if len(branch.Values) != len(p.PCRs) {
+			return nil, fmt.Errorf("branch %d has %d values, but %d PCRs are selected", i, len(branch.Values), len(p.PCRs))
+		}
+		profile := NewPCRProtectionProfile()
+		for _, pcr := range p.PCRs {
+			if pcr < 0 || pcr > 23 {
+				return nil, fmt.Errorf("invalid PCR %d", pcr)
+			}
+			str, exists := branch.Values[pcr]
+			if !exists {
+				return nil, fmt.Errorf("branch %d has no value for PCR %d", i, pcr)
+			}
+			value, err := hex.DecodeString(str)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot decode value for PCR %d in branch %d: %w", pcr, i, err)
+			}
+			if len(value) != alg.Size() {
+				return nil, fmt.Errorf("value for PCR %d in branch %d has the wrong size", pcr, i)
+			}
+			profile.AddPCRValue(alg, pcr, value)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	if len(profiles) == 1 {
+		return profiles[0], nil
+	}
+	return NewPCRProtectionProfile().AddProfileOR(profiles...), nil
+}
+
+// PolicyDrift describes how the PCR policy of a key differs from a
+// DesiredPolicy.
+type PolicyDrift struct {
+	// SelectionChanged indicates that the key selects different PCRs.
+	SelectionChanged bool
+
+	// AddedBranches is the number of branches in the desired policy that
+	// the key doesn't currently approve.
+	AddedBranches int
+
+	// RemovedBranches is the number of branches that the key currently
+	// approves that aren't in the desired policy.
+	RemovedBranches int
+
+	// Unknown indicates that the current policy of the key can't be
+	// inspected, which is the case for keys created by older releases. Keys
+	// with an unknown policy are always updated by ReconcileDesiredPolicy.
+	Unknown bool
+}
+
+// Drifted indicates whether the key's policy differs from the desired policy.
+func (d *PolicyDrift) Drifted() bool {
+	return d.Unknown || d.SelectionChanged || d.AddedBranches > 0 || d.RemovedBranches > 0
+}
+
+// String implements [fmt.Stringer].
+func (d *PolicyDrift) String() string {
+	switch {
+	case d.Unknown:
+		return "current policy is unknown"
+	case !d.Drifted():
+		return "no drift"
+	case d.SelectionChanged:
+		return "PCR selection changed"
+	default:
+		return fmt.Sprintf("%d branches added, %d branches removed", d.AddedBranches, d.RemovedBranches)
+	}
+}
+
+// PCRPolicyCounterMismatchError is returned from ComputePolicyDrift and
+// ReconcileDesiredPolicy if a key doesn't use the PCR policy counter specified
+// by a DesiredPolicy. This can't be fixed by updating the policy of the key.
+type PCRPolicyCounterMismatchError struct {
+	KeyIndex int
+	Expected tpm2.Handle
+	Actual   tpm2.Handle
+}
+
+func (e *PCRPolicyCounterMismatchError) Error() string {
+	return fmt.Sprintf("key at index %d uses PCR policy counter %v, but the desired policy requires %v", e.KeyIndex, e.Actual, e.Expected)
+}
+
+// computePolicyDrift compares the PCR policy of the supplied key with a policy
+// computed from the supplied PCR selection and PCR digests.
+func computePolicyDrift(data keyData, pcrs tpm2.PCRSelectionList, pcrDigests tpm2.DigestList) (*PolicyDrift, error) {
+	policy, ok := data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		return &PolicyDrift{Unknown: true}, nil
+	}
+
+	drift := new(PolicyDrift)
+	if !bytes.Equal(mu.MustMarshalToBytes(policy.PCRData.Selection), mu.MustMarshalToBytes(pcrs)) {
+		drift.SelectionChanged = true
+		return drift, nil
+	}
+
+	tree, err := policy.PCRData.OrData.resolve()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot resolve PolicyOR tree: %w", err)
+	}
+	current := make(map[string]bool)
+	for _, n := range tree.leafNodes {
+		for _, d := range n.digests {
+			current[string(d)] = true
+		}
+	}
+
+	alg := data.Public().NameAlg
+	desired := make(map[string]bool)
+	for _, digest := range pcrDigests {
+		trial := util.ComputeAuthPolicy(alg)
+		trial.PolicyPCR(digest, pcrs)
+		desired[string(trial.GetDigest())] = true
+	}
+
+	for d := range desired {
+		if !current[d] {
+			drift.AddedBranches += 1
+		}
+	}
+	for d := range current {
+		if !desired[d] {
+			drift.RemovedBranches += 1
+		}
+	}
+
+	return drift, nil
+}
+
+// ComputePolicyDrift compares the PCR policy of each of the supplied TPM
+// protected keys with the supplied desired policy, without modifying them. The
+// returned slice has an entry for each key.
+//
+// If any of the keys doesn't use the PCR policy counter required by the desired
+// policy, a *PCRPolicyCounterMismatchError error is returned.
+func ComputePolicyDrift(policy *DesiredPolicy, keys ...*secboot.KeyData) ([]*PolicyDrift, error) {
+	profile, err := policy.PCRProtectionProfile()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid desired policy: %w", err)
+	}
+
+	var out []*PolicyDrift
+	for i, key := range keys {
+		skd, err := NewSealedKeyData(key)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot obtain SealedKeyData for key at index %d: %w", i, err)
+		}
+
+		if policy.PCRPolicyCounterHandle != nil && skd.PCRPolicyCounterHandle() != *policy.PCRPolicyCounterHandle {
+			return nil, &PCRPolicyCounterMismatchError{
+				KeyIndex: i,
+				Expected: *policy.PCRPolicyCounterHandle,
+				Actual:   skd.PCRPolicyCounterHandle()}
+		}
+
+		pcrs, pcrDigests, err := profile.ComputePCRDigests(nil, skd.data.Public().NameAlg)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR digests from desired policy: %w", err)
+		}
+
+		drift, err := computePolicyDrift(skd.data, pcrs, pcrDigests)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute drift for key at index %d: %w", i, err)
+		}
+		out = append(out, drift)
+	}
+
+	return out, nil
+}
+
+// PolicyReconcileResult is the result of ReconcileDesiredPolicy.
+type PolicyReconcileResult struct {
+	// Drift describes how the policy of each key differed from the desired
+	// policy before it was reconciled.
+	Drift []*PolicyDrift
+
+	// Updated contains the indices of the keys that were updated, and must
+	// be persisted by the caller.
+	Updated []int
+
+	// RevocationRequired indicates that branches were removed from keys that
+	// use a PCR policy counter. The caller should call
+	// RevokeOldPCRProtectionPolicies once the updated keys have been persisted
+	// in order to prevent the removed branches from being used.
+	RevocationRequired bool
+}
+
+// ReconcileDesiredPolicy makes the PCR policy of each of the supplied TPM
+// protected keys match the supplied desired policy. The keys must all be related
+// (ie, they were created using SealKeysToTPM), and authKey must be the
+// primary key associated with them.
+//
+// The drift of each key is computed first with ComputePolicyDrift, and only
+// keys that have drifted are updated, so calling this repeatedly with the same
+// desired policy is cheap and doesn't modify the keys after the first call.
+// Updated keys must be persisted by the caller with secboot.KeyData.WriteAtomic.
+// If branches are removed from keys that use a PCR policy counter, the updated
+// policies are created with a new version and RevocationRequired is set in the
+// result - the old policies are not revoked until the caller calls
+// RevokeOldPCRProtectionPolicies after persisting the updated keys.
+func ReconcileDesiredPolicy(tpm *Connection, authKey secboot.PrimaryKey, policy *DesiredPolicy, keys ...*secboot.KeyData) (*PolicyReconcileResult, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sealed keys supplied")
+	}
+
+	drift, err := ComputePolicyDrift(policy, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PolicyReconcileResult{Drift: drift}
+
+	var updateKeys []*secboot.KeyData
+	versionOption := NoNewPCRPolicyVersion
+	for i, d := range drift {
+		if !d.Drifted() {
+			continue
+		}
+		result.Updated = append(result.Updated, i)
+		updateKeys = append(updateKeys, keys[i])
+
+		if (d.Unknown || d.SelectionChanged || d.RemovedBranches > 0) && policy.revocable(keys[i]) {
+			versionOption = NewPCRPolicyVersion
+			result.RevocationRequired = true
+		}
+	}
+	if len(updateKeys) == 0 {
+		return result, nil
+	}
+
+	// The policy was validated by ComputePolicyDrift.
+	profile, _ := policy.PCRProtectionProfile()
+	if err := UpdateKeyDataPCRProtectionPolicy(tpm, authKey, profile, versionOption, updateKeys...); err != nil {
+		return nil, xerrors.Errorf("cannot update keys: %w", err)
+	}
+
+	sort.Ints(result.Updated)
+	return result, nil
+}
+
+// revocable indicates whether the supplied key uses a PCR policy counter.
+func (p *DesiredPolicy) revocable(key *secboot.KeyData) bool {
+	skd, err := NewSealedKeyData(key)
+	if err != nil {
+		return false
+	}
+	return skd.PCRPolicyCounterHandle() != tpm2.HandleNull
+}
@@ -0,0 +1,182 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type desiredPolicySuite struct {
+	srk *tpm2.Public
+}
+
+var _ = Suite(&desiredPolicySuite{})
+
+func (s *desiredPolicySuite) SetUpSuite(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.srk = tpm2_testutil.NewExternalRSAStoragePublicKey(&key.PublicKey)
+}
+
+func (s *desiredPolicySuite) newKey(c *C, policy *DesiredPolicy) *secboot.KeyData {
+	profile, err := policy.PCRProtectionProfile()
+	c.Assert(err, IsNil)
+
+	k, _, _, err := NewExternalTPMProtectedKey(s.srk, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		Role:                   "foo"})
+	c.Assert(err, IsNil)
+	return k
+}
+
+func (s *desiredPolicySuite) branch(v byte) DesiredPolicyBranch {
+	return DesiredPolicyBranch{Values: map[int]string{
+		4: fmt.Sprintf("%064x", v),
+		7: strings.Repeat("a", 64)}}
+}
+
+func (s *desiredPolicySuite) policy(branches ...byte) *DesiredPolicy {
+	p := &DesiredPolicy{PCRAlg: "sha256", PCRs: []int{4, 7}}
+	for _, b := range branches {
+		p.Branches = append(p.Branches, s.branch(b))
+	}
+	return p
+}
+
+func (s *desiredPolicySuite) TestReadDesiredPolicy(c *C) {
+	handle := tpm2.Handle(0x01880001)
+	p, err := ReadDesiredPolicy(bytes.NewReader([]byte(`{
+	"pcr-alg": "sha256",
+	"pcrs": [7],
+	"branches": [
+		{"description": "current", "values": {"7": "0000000000000000000000000000000000000000000000000000000000000000"}}
+	],
+	"pcr-policy-counter-handle": 25690113
+}`)))
+	c.Assert(err, IsNil)
+	c.Check(p, DeepEquals, &DesiredPolicy{
+		PCRAlg: "sha256",
+		PCRs:   []int{7},
+		Branches: []DesiredPolicyBranch{
+			{Description: "current", Values: map[int]string{7: strings.Repeat("0", 64)}}},
+		PCRPolicyCounterHandle: &handle})
+
+	_, err = p.PCRProtectionProfile()
+	c.Check(err, IsNil)
+}
+
+func (s *desiredPolicySuite) TestReadDesiredPolicyNull(c *C) {
+	_, err := ReadDesiredPolicy(bytes.NewReader([]byte("null")))
+	c.Check(err, ErrorMatches, `no desired policy`)
+}
+
+func (s *desiredPolicySuite) TestPCRProtectionProfileInvalid(c *C) {
+	p := s.policy(0)
+	p.PCRAlg = "md5"
+	_, err := p.PCRProtectionProfile()
+	c.Check(err, ErrorMatches, `unsupported PCR algorithm "md5"`)
+
+	p = s.policy()
+	_, err = p.PCRProtectionProfile()
+	c.Check(err, ErrorMatches, `no branches`)
+
+	p = s.policy(0)
+	p.PCRs = []int{4, 8}
+	_, err = p.PCRProtectionProfile()
+	c.Check(err, ErrorMatches, `branch 0 has no value for PCR 8`)
+
+	p = s.policy(0, 1)
+	delete(p.Branches[1].Values, 7)
+	_, err = p.PCRProtectionProfile()
+	c.Check(err, ErrorMatches, `branch 1 has 1 values, but 2 PCRs are selected`)
+
+	p = s.policy(0)
+	p.Branches[0].Values[7] = "aa"
+	_, err = p.PCRProtectionProfile()
+	c.Check(err, ErrorMatches, `value for PCR 7 in branch 0 has the wrong size`)
+}
+
+func (s *desiredPolicySuite) TestComputePolicyDriftNone(c *C) {
+	k := s.newKey(c, s.policy(0, 1))
+
+	drift, err := ComputePolicyDrift(s.policy(1, 0), k)
+	c.Assert(err, IsNil)
+	c.Check(drift, DeepEquals, []*PolicyDrift{{}})
+	c.Check(drift[0].Drifted(), Equals, false)
+	c.Check(drift[0].String(), Equals, "no drift")
+}
+
+func (s *desiredPolicySuite) TestComputePolicyDriftBranches(c *C) {
+	k1 := s.newKey(c, s.policy(0, 1))
+	k2 := s.newKey(c, s.policy(0))
+
+	drift, err := ComputePolicyDrift(s.policy(1, 2, 3), k1, k2)
+	c.Assert(err, IsNil)
+	c.Check(drift, DeepEquals, []*PolicyDrift{
+		{AddedBranches: 2, RemovedBranches: 1},
+		{AddedBranches: 3, RemovedBranches: 1}})
+	c.Check(drift[0].Drifted(), Equals, true)
+	c.Check(drift[0].String(), Equals, "2 branches added, 1 branches removed")
+}
+
+func (s *desiredPolicySuite) TestComputePolicyDriftSelection(c *C) {
+	k := s.newKey(c, s.policy(0))
+
+	p := s.policy(0)
+	p.PCRs = []int{7}
+	delete(p.Branches[0].Values, 4)
+
+	drift, err := ComputePolicyDrift(p, k)
+	c.Assert(err, IsNil)
+	c.Check(drift, DeepEquals, []*PolicyDrift{{SelectionChanged: true}})
+	c.Check(drift[0].String(), Equals, "PCR selection changed")
+}
+
+func (s *desiredPolicySuite) TestComputePolicyDriftCounterMismatch(c *C) {
+	k := s.newKey(c, s.policy(0))
+
+	p := s.policy(0)
+	handle := tpm2.Handle(0x01880001)
+	p.PCRPolicyCounterHandle = &handle
+
+	_, err := ComputePolicyDrift(p, k)
+	c.Check(err, ErrorMatches, `key at index 0 uses PCR policy counter TPM_RH_NULL, but the desired policy requires 0x01880001`)
+	c.Check(err, FitsTypeOf, &PCRPolicyCounterMismatchError{})
+}
+
+func (s *desiredPolicySuite) TestComputePolicyDriftInvalidPolicy(c *C) {
+	k := s.newKey(c, s.policy(0))
+
+	_, err := ComputePolicyDrift(s.policy(), k)
+	c.Check(err, ErrorMatches, `invalid desired policy: no branches`)
+}
@@ -0,0 +1,203 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNoEKPin is returned from Connection.VerifyPinnedEK if there is no pinned
+// endorsement key.
+var ErrNoEKPin = errors.New("no pinned endorsement key")
+
+// EKPinMismatchError is returned from Connection.VerifyPinnedEK and
+// ConnectToDefaultTPMWithEKPin if the endorsement key of the TPM does not match
+// the pinned endorsement key. This could indicate that the connection is not to
+// the expected TPM, or that the endorsement primary seed has been changed.
+type EKPinMismatchError struct {
+	Expected tpm2.Name // The name of the pinned endorsement key
+	Actual   tpm2.Name // The name of the endorsement key of the TPM
+}
+
+func (e *EKPinMismatchError) Error() string {
+	return fmt.Sprintf("endorsement key %#x does not match pinned key %#x", e.Actual, e.Expected)
+}
+
+// EKPin records the endorsement key of a TPM that has been trusted on first use.
+type EKPin struct {
+	Name tpm2.Name `json:"name"` // The name of the endorsement key
+
+	// Public is the public area of the endorsement key marshalled as a
+	// TPM2B_PUBLIC structure.
+	Public []byte `json:"public"`
+}
+
+// ReadEKPinFile reads the pinned endorsement key from the file at the specified
+// path. If the file does not exist, a ErrNoEKPin error is returned.
+func ReadEKPinFile(path string) (*EKPin, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, ErrNoEKPin
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read file: %w", err)
+	}
+
+	var pin *EKPin
+	if err := json.Unmarshal(data, &pin); err != nil {
+		return nil, xerrors.Errorf("cannot decode EK pin: %w", err)
+	}
+	if pin == nil {
+		return nil, errors.New("invalid EK pin: no data")
+	}
+
+	var pub *tpm2.Public
+	if _, err := mu.UnmarshalFromBytes(pin.Public, mu.Sized(&pub)); err != nil {
+		return nil, xerrors.Errorf("invalid EK pin: cannot unmarshal public area: %w", err)
+	}
+	name, err := pub.ComputeName()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid EK pin: cannot compute name: %w", err)
+	}
+	if !bytes.Equal(name, pin.Name) {
+		return nil, errors.New("invalid EK pin: name doesn't match public area")
+	}
+
+	return pin, nil
+}
+
+// PinEK records the endorsement key that was used to salt the HMAC session for
+// this connection to the file at the specified path, so that it can be verified
+// on subsequent connections with VerifyPinnedEK. This is a trust-on-first-use
+// (TOFU) mechanism for TPMs that don't have an EK certificate that can be used
+// to verify the endorsement key. It provides no assurance that the endorsement
+// key belongs to a genuine TPM, only that it is the same key that was pinned.
+//
+// If the TPM has no valid endorsement key, a ErrTPMProvisioning error will be
+// returned.
+func (t *Connection) PinEK(path string) error {
+	if t.ekPublic == nil {
+		return ErrTPMProvisioning
+	}
+
+	name, err := t.ekPublic.ComputeName()
+	if err != nil {
+		return xerrors.Errorf("cannot compute EK name: %w", err)
+	}
+	pub, err := mu.MarshalToBytes(mu.Sized(t.ekPublic))
+	if err != nil {
+		return xerrors.Errorf("cannot marshal EK public area: %w", err)
+	}
+
+	data, err := json.Marshal(&EKPin{Name: name, Public: pub})
+	if err != nil {
+		return xerrors.Errorf("cannot encode EK pin: %w", err)
+	}
+	if err := osutil.AtomicWriteFile(path, data, 0600, 0); err != nil {
+		return xerrors.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+// VerifyPinnedEK verifies that the endorsement key that was used to salt the
+// HMAC session for this connection matches the one pinned in the file at the
+// specified path by PinEK. As the session is salted with the endorsement key,
+// subsequent commands that use it will only succeed if the TPM has the private
+// part of the pinned key.
+//
+// If the file does not exist, a ErrNoEKPin error will be returned. If the TPM has
+// no valid endorsement key, a ErrTPMProvisioning error will be returned. If the
+// endorsement key doesn't match, a *EKPinMismatchError error will be returned.
+func (t *Connection) VerifyPinnedEK(path string) error {
+	pin, err := ReadEKPinFile(path)
+	if err != nil {
+		return err
+	}
+
+	if t.ekPublic == nil {
+		return ErrTPMProvisioning
+	}
+	name, err := t.ekPublic.ComputeName()
+	if err != nil {
+		return xerrors.Errorf("cannot compute EK name: %w", err)
+	}
+	if !bytes.Equal(name, pin.Name) {
+		return &EKPinMismatchError{Expected: pin.Name, Actual: name}
+	}
+	return nil
+}
+
+// ConnectToDefaultTPMWithEKPin connects to the default TPM and verifies its
+// endorsement key using the trust-on-first-use (TOFU) pin stored in the file at
+// the specified path. If the file does not exist, the endorsement key is pinned
+// to it with Connection.PinEK. Otherwise, it is verified with
+// Connection.VerifyPinnedEK. This is intended for TPMs that are not provisioned
+// with an EK certificate, where the endorsement key can't be verified against
+// the manufacturer's certificate authority.
+//
+// The TPM must already be provisioned with an endorsement key, else a
+// ErrTPMProvisioning error will be returned. As the endorsement key is derived
+// from the endorsement primary seed, provisioning the TPM again with the same
+// endorsement key template does not invalidate the pin. Provisioning the TPM
+// with a different template does invalidate it, eg, by calling
+// Connection.EnsureProvisionedWithParams with a different value of
+// ProvisionParams.PreferECC, as does clearing the TPM or changing the
+// endorsement primary seed. In these cases, the pin file must be removed so
+// that the new endorsement key can be pinned. If the endorsement key doesn't
+// match the pinned key, a *EKPinMismatchError error will be returned.
+//
+// If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
+func ConnectToDefaultTPMWithEKPin(path string) (*Connection, error) {
+	t, err := ConnectToDefaultTPM()
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		t.Close()
+	}()
+
+	switch err := t.VerifyPinnedEK(path); {
+	case err == ErrNoEKPin:
+		if err := t.PinEK(path); err != nil {
+			return nil, xerrors.Errorf("cannot pin EK: %w", err)
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	succeeded = true
+	return t, nil
+}
@@ -0,0 +1,220 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/templates"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type ekPinSuiteNoTPM struct{}
+
+type ekPinSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *ekPinSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&ekPinSuiteNoTPM{})
+var _ = Suite(&ekPinSuite{})
+
+func (s *ekPinSuite) provision(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+func (s *ekPinSuite) TestPinEK(c *C) {
+	s.provision(c)
+
+	path := filepath.Join(c.MkDir(), "ek-pin")
+	c.Check(s.TPM().PinEK(path), IsNil)
+
+	ek, err := s.TPM().CreateResourceContextFromTPM(tcg.EKHandle)
+	c.Assert(err, IsNil)
+	pub, _, _, err := s.TPM().ReadPublic(ek)
+	c.Assert(err, IsNil)
+
+	pin, err := ReadEKPinFile(path)
+	c.Assert(err, IsNil)
+	c.Check(pin.Name, DeepEquals, ek.Name())
+	c.Check(pin.Public, DeepEquals, mu.MustMarshalToBytes(mu.Sized(pub)))
+
+	c.Check(s.TPM().VerifyPinnedEK(path), IsNil)
+}
+
+func (s *ekPinSuite) TestPinEKUnprovisioned(c *C) {
+	c.Check(s.TPM().PinEK(filepath.Join(c.MkDir(), "ek-pin")), Equals, ErrTPMProvisioning)
+}
+
+func (s *ekPinSuite) TestVerifyPinnedEKNoPin(c *C) {
+	s.provision(c)
+	c.Check(s.TPM().VerifyPinnedEK(filepath.Join(c.MkDir(), "ek-pin")), Equals, ErrNoEKPin)
+}
+
+func (s *ekPinSuite) TestVerifyPinnedEKMismatch(c *C) {
+	s.provision(c)
+
+	path := filepath.Join(c.MkDir(), "ek-pin")
+	c.Check(s.TPM().PinEK(path), IsNil)
+	pin, err := ReadEKPinFile(path)
+	c.Assert(err, IsNil)
+
+	// Replace the EK with a different key.
+	ek, err := s.TPM().CreateResourceContextFromTPM(tcg.EKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, ek, ek.Handle())
+
+	primary := s.CreatePrimary(c, tpm2.HandleOwner, tpm2_testutil.NewRSAStorageKeyTemplate())
+	newEK := s.EvictControl(c, tpm2.HandleOwner, primary, tcg.EKHandle)
+	s.ReinitTPMConnectionFromExisting(c)
+
+	err = s.TPM().VerifyPinnedEK(path)
+	c.Assert(err, testutil.ConvertibleTo, &EKPinMismatchError{})
+	c.Check(err.(*EKPinMismatchError).Expected, DeepEquals, pin.Name)
+	c.Check(err.(*EKPinMismatchError).Actual, DeepEquals, newEK.Name())
+}
+
+func (s *ekPinSuite) TestConnectToDefaultTPMWithEKPin(c *C) {
+	s.provision(c)
+
+	path := filepath.Join(c.MkDir(), "ek-pin")
+
+	// The first connection pins the EK.
+	tpm, err := ConnectToDefaultTPMWithEKPin(path)
+	c.Assert(err, IsNil)
+	c.Check(tpm.Close(), IsNil)
+
+	pin, err := ReadEKPinFile(path)
+	c.Assert(err, IsNil)
+	ek, err := s.TPM().CreateResourceContextFromTPM(tcg.EKHandle)
+	c.Assert(err, IsNil)
+	c.Check(pin.Name, DeepEquals, ek.Name())
+
+	// Subsequent connections verify it.
+	tpm, err = ConnectToDefaultTPMWithEKPin(path)
+	c.Assert(err, IsNil)
+	_, err = tpm.GetRandom(16, tpm.HmacSession().IncludeAttrs(tpm2.AttrResponseEncrypt))
+	c.Check(err, IsNil)
+	c.Check(tpm.Close(), IsNil)
+}
+
+func (s *ekPinSuite) TestConnectToDefaultTPMWithEKPinMismatch(c *C) {
+	path := filepath.Join(c.MkDir(), "ek-pin")
+
+	primary := s.CreatePrimary(c, tpm2.HandleOwner, tpm2_testutil.NewRSAStorageKeyTemplate())
+	s.EvictControl(c, tpm2.HandleOwner, primary, tcg.EKHandle)
+	tpm, err := ConnectToDefaultTPMWithEKPin(path)
+	c.Assert(err, IsNil)
+	c.Check(tpm.Close(), IsNil)
+
+	ek, err := s.TPM().CreateResourceContextFromTPM(tcg.EKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, ek, ek.Handle())
+	s.provision(c)
+
+	tpm, err = ConnectToDefaultTPMWithEKPin(path)
+	c.Check(err, testutil.ConvertibleTo, &EKPinMismatchError{})
+	c.Check(tpm, IsNil)
+}
+
+func (s *ekPinSuite) TestConnectToDefaultTPMWithEKPinUnprovisioned(c *C) {
+	primary := s.CreatePrimary(c, tpm2.HandleOwner, tpm2_testutil.NewRSAKeyTemplate(templates.KeyUsageDecrypt, nil))
+	s.EvictControl(c, tpm2.HandleOwner, primary, tcg.EKHandle)
+
+	tpm, err := ConnectToDefaultTPMWithEKPin(filepath.Join(c.MkDir(), "ek-pin"))
+	c.Check(err, ErrorMatches, `cannot pin EK: the TPM is not correctly provisioned`)
+	c.Check(tpm, IsNil)
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFileNoFile(c *C) {
+	_, err := ReadEKPinFile(filepath.Join(c.MkDir(), "ek-pin"))
+	c.Check(err, Equals, ErrNoEKPin)
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFileInvalidJSON(c *C) {
+	path := filepath.Join(c.MkDir(), "ek-pin")
+	c.Assert(ioutil.WriteFile(path, []byte("foo"), 0600), IsNil)
+
+	_, err := ReadEKPinFile(path)
+	c.Check(err, ErrorMatches, `cannot decode EK pin: invalid character 'o' in literal false \(expecting 'a'\)`)
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFileNull(c *C) {
+	path := filepath.Join(c.MkDir(), "ek-pin")
+	c.Assert(ioutil.WriteFile(path, []byte("null"), 0600), IsNil)
+
+	_, err := ReadEKPinFile(path)
+	c.Check(err, ErrorMatches, `invalid EK pin: no data`)
+}
+
+func (s *ekPinSuiteNoTPM) writePin(c *C, pin *EKPin) string {
+	data, err := json.Marshal(pin)
+	c.Assert(err, IsNil)
+
+	path := filepath.Join(c.MkDir(), "ek-pin")
+	c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+	return path
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFile(c *C) {
+	pub := tcg.MakeDefaultEKTemplate()
+	name, err := pub.ComputeName()
+	c.Assert(err, IsNil)
+	expected := &EKPin{Name: name, Public: mu.MustMarshalToBytes(mu.Sized(pub))}
+
+	pin, err := ReadEKPinFile(s.writePin(c, expected))
+	c.Check(err, IsNil)
+	c.Check(pin, DeepEquals, expected)
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFileInvalidPublic(c *C) {
+	_, err := ReadEKPinFile(s.writePin(c, &EKPin{Name: []byte{0, 1}, Public: []byte{0, 5, 1, 2, 3}}))
+	c.Check(err, ErrorMatches, `(?s)invalid EK pin: cannot unmarshal public area: .*`)
+}
+
+func (s *ekPinSuiteNoTPM) TestReadEKPinFileNameMismatch(c *C) {
+	pub := tcg.MakeDefaultEKTemplate()
+	_, err := ReadEKPinFile(s.writePin(c, &EKPin{
+		Name:   make(tpm2.Name, 34),
+		Public: mu.MustMarshalToBytes(mu.Sized(pub))}))
+	c.Check(err, ErrorMatches, `invalid EK pin: name doesn't match public area`)
+}
+
+func (s *ekPinSuiteNoTPM) TestEKPinMismatchError(c *C) {
+	err := &EKPinMismatchError{Expected: tpm2.Name{0x00, 0x0b, 0x01}, Actual: tpm2.Name{0x00, 0x0b, 0x02}}
+	c.Check(err, ErrorMatches, `endorsement key 0x000b02 does not match pinned key 0x000b01`)
+}
@@ -0,0 +1,225 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// ekCertHandleRangeFirst and ekCertHandleRangeLast define the range of
+	// NV indices that the TCG reserves for EK certificates and their associated
+	// templates and nonces, see section 2.2.1.4 of "TCG EK Credential Profile
+	// For TPM Family 2.0; Level 0", Version 2.3.
+	ekCertHandleRangeFirst tpm2.Handle = 0x01c00000
+	ekCertHandleRangeLast  tpm2.Handle = 0x01c07fff
+)
+
+// ErrNoEKCertificate is returned from Connection.EKCertificate if no suitable
+// EK certificate could be found on the TPM.
+var ErrNoEKCertificate = errors.New("no EK certificate found")
+
+// EKCertificate corresponds to an EK certificate stored on the TPM.
+type EKCertificate struct {
+	// Handles are the NV indices that the certificate was read from. Most
+	// certificates are stored in a single index, but some TPMs split large
+	// certificates across consecutive indices.
+	Handles tpm2.HandleList
+
+	// Type is the type of the endorsement key, which is either
+	// tpm2.ObjectTypeRSA or tpm2.ObjectTypeECC.
+	Type tpm2.ObjectTypeId
+
+	Certificate *x509.Certificate
+}
+
+type ekCertNVIndex struct {
+	handle tpm2.Handle
+	data   []byte
+}
+
+// derLength returns the total length of the DER encoded value at the start of
+// the supplied data, determined from its tag and length octets. It returns
+// false if the data doesn't start with a definite length SEQUENCE.
+func derLength(data []byte) (int, bool) {
+	if len(data) < 2 || data[0] != 0x30 {
+		return 0, false
+	}
+	if data[1] < 0x80 {
+		return 2 + int(data[1]), true
+	}
+
+	n := int(data[1] & 0x7f)
+	if n == 0 || n > 3 || len(data) < 2+n {
+		return 0, false
+	}
+	length := 0
+	for _, b := range data[2 : 2+n] {
+		length = (length << 8) | int(b)
+	}
+	return 2 + n + length, true
+}
+
+// assembleEKCertificates assembles EK certificates from the supplied NV index
+// contents, which must be sorted by handle. Certificates that span multiple
+// consecutive indices are concatenated, and padding after the end of each
+// certificate is discarded. Indices that don't contain a RSA or ECC certificate
+// (such as EK templates and nonces) are ignored.
+func assembleEKCertificates(indices []ekCertNVIndex) (certs []*EKCertificate) {
+	for i := 0; i < len(indices); i++ {
+		length, ok := derLength(indices[i].data)
+		if !ok {
+			continue
+		}
+
+		data := append([]byte(nil), indices[i].data...)
+		handles := tpm2.HandleList{indices[i].handle}
+
+		j := i
+		for len(data) < length && j+1 < len(indices) && indices[j+1].handle == indices[j].handle+1 {
+			j++
+			data = append(data, indices[j].data...)
+			handles = append(handles, indices[j].handle)
+		}
+		if len(data) < length {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(data[:length])
+		if err != nil {
+			continue
+		}
+
+		var keyType tpm2.ObjectTypeId
+		switch cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			keyType = tpm2.ObjectTypeRSA
+		case *ecdsa.PublicKey:
+			keyType = tpm2.ObjectTypeECC
+		default:
+			continue
+		}
+
+		certs = append(certs, &EKCertificate{Handles: handles, Type: keyType, Certificate: cert})
+		i = j
+	}
+
+	return certs
+}
+
+func readEKCertNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle) ([]byte, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, nil
+	}
+
+	var auth tpm2.ResourceContext
+	switch {
+	case pub.Attrs&tpm2.AttrNVOwnerRead != 0:
+		auth = tpm.OwnerHandleContext()
+	case pub.Attrs&(tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA) == tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA:
+		auth = index
+	default:
+		// Don't risk incrementing the DA counter or reading
+		// an index that requires physical presence.
+		return nil, nil
+	}
+	return tpm.NVRead(auth, index, pub.Size, 0, nil)
+}
+
+// DiscoverEKCertificates scans the range of NV indices that the TCG reserves for
+// EK certificates and returns all of the RSA and ECC EK certificates that it finds,
+// ordered by handle. This handles certificates that are stored at non-standard
+// indices in this range, as well as certificates that are split across consecutive
+// indices and certificates that are followed by padding.
+//
+// Indices that cannot be read using the owner hierarchy or using an empty
+// authorization value without affecting the dictionary attack counter are
+// skipped.
+func (t *Connection) DiscoverEKCertificates() ([]*EKCertificate, error) {
+	return DiscoverEKCertificatesFromTPM(t.TPMContext)
+}
+
+// DiscoverEKCertificatesFromTPM is the same as
+// [Connection.DiscoverEKCertificates], but operates on the supplied TPM context
+// rather than on a Connection.
+func DiscoverEKCertificatesFromTPM(tpm *tpm2.TPMContext) ([]*EKCertificate, error) {
+	handles, err := tpm.GetCapabilityHandles(ekCertHandleRangeFirst, uint32(ekCertHandleRangeLast-ekCertHandleRangeFirst+1))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+
+	var indices []ekCertNVIndex
+	for _, h := range handles {
+		if h > ekCertHandleRangeLast {
+			break
+		}
+		data, err := readEKCertNVIndex(tpm, h)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.AnyCommandCode) ||
+			tpm2.IsTPMHandleError(err, tpm2.AnyErrorCode, tpm2.AnyCommandCode, tpm2.AnyHandleIndex) ||
+			tpm2.IsTPMSessionError(err, tpm2.AnyErrorCode, tpm2.AnyCommandCode, tpm2.AnySessionIndex) ||
+			tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.AnyCommandCode, tpm2.AnyParameterIndex) ||
+			tpm2.IsResourceUnavailableError(err, h):
+			// Skip indices that we can't read.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read NV index %v: %w", h, err)
+		}
+		indices = append(indices, ekCertNVIndex{handle: h, data: data})
+	}
+
+	sort.Slice(indices, func(i, j int) bool { return indices[i].handle < indices[j].handle })
+
+	return assembleEKCertificates(indices), nil
+}
+
+// EKCertificate returns the EK certificate for the key of the specified type
+// (tpm2.ObjectTypeRSA or tpm2.ObjectTypeECC), as found using
+// DiscoverEKCertificates. If there is more than one certificate of the requested
+// type, the one stored at the lowest index is returned. If there are no
+// certificates of the requested type, a ErrNoEKCertificate error is returned.
+func (t *Connection) EKCertificate(keyType tpm2.ObjectTypeId) (*EKCertificate, error) {
+	certs, err := t.DiscoverEKCertificates()
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cert.Type == keyType {
+			return cert, nil
+		}
+	}
+	return nil, ErrNoEKCertificate
+}
@@ -0,0 +1,183 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type ekCertMixin struct {
+	rsaCert []byte
+	eccCert []byte
+}
+
+func (m *ekCertMixin) makeCert(c *C, key crypto.Signer) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "EK"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	c.Assert(err, IsNil)
+	return cert
+}
+
+func (m *ekCertMixin) setUpCerts(c *C) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	m.rsaCert = m.makeCert(c, rsaKey)
+
+	eccKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	m.eccCert = m.makeCert(c, eccKey)
+}
+
+type ekCertSuiteNoTPM struct {
+	ekCertMixin
+}
+
+func (s *ekCertSuiteNoTPM) SetUpSuite(c *C) {
+	s.setUpCerts(c)
+}
+
+type ekCertSuite struct {
+	tpm2test.TPMTest
+	ekCertMixin
+}
+
+func (s *ekCertSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+	s.setUpCerts(c)
+}
+
+var _ = Suite(&ekCertSuiteNoTPM{})
+var _ = Suite(&ekCertSuite{})
+
+func (s *ekCertSuiteNoTPM) TestAssembleSingle(c *C) {
+	certs := AssembleEKCertificates([]EKCertNVIndex{
+		MakeEKCertNVIndex(0x01c00002, s.rsaCert),
+		MakeEKCertNVIndex(0x01c0000a, s.eccCert)})
+	c.Assert(certs, HasLen, 2)
+	c.Check(certs[0].Handles, DeepEquals, tpm2.HandleList{0x01c00002})
+	c.Check(certs[0].Type, Equals, tpm2.ObjectTypeRSA)
+	c.Check(certs[0].Certificate.Raw, DeepEquals, s.rsaCert)
+	c.Check(certs[1].Handles, DeepEquals, tpm2.HandleList{0x01c0000a})
+	c.Check(certs[1].Type, Equals, tpm2.ObjectTypeECC)
+	c.Check(certs[1].Certificate.Raw, DeepEquals, s.eccCert)
+}
+
+func (s *ekCertSuiteNoTPM) TestAssembleWithPadding(c *C) {
+	data := append(append([]byte(nil), s.rsaCert...), make([]byte, 64)...)
+	for i := len(s.rsaCert); i < len(data); i++ {
+		data[i] = 0xff
+	}
+	certs := AssembleEKCertificates([]EKCertNVIndex{MakeEKCertNVIndex(0x01c00100, data)})
+	c.Assert(certs, HasLen, 1)
+	c.Check(certs[0].Certificate.Raw, DeepEquals, s.rsaCert)
+}
+
+func (s *ekCertSuiteNoTPM) TestAssembleMultiPart(c *C) {
+	certs := AssembleEKCertificates([]EKCertNVIndex{
+		MakeEKCertNVIndex(0x01c00010, s.rsaCert[:300]),
+		MakeEKCertNVIndex(0x01c00011, s.rsaCert[300:500]),
+		MakeEKCertNVIndex(0x01c00012, s.rsaCert[500:]),
+		MakeEKCertNVIndex(0x01c00013, s.eccCert)})
+	c.Assert(certs, HasLen, 2)
+	c.Check(certs[0].Handles, DeepEquals, tpm2.HandleList{0x01c00010, 0x01c00011, 0x01c00012})
+	c.Check(certs[0].Certificate.Raw, DeepEquals, s.rsaCert)
+	c.Check(certs[1].Handles, DeepEquals, tpm2.HandleList{0x01c00013})
+	c.Check(certs[1].Type, Equals, tpm2.ObjectTypeECC)
+}
+
+func (s *ekCertSuiteNoTPM) TestAssembleMultiPartNotConsecutive(c *C) {
+	certs := AssembleEKCertificates([]EKCertNVIndex{
+		MakeEKCertNVIndex(0x01c00010, s.rsaCert[:500]),
+		MakeEKCertNVIndex(0x01c00012, s.rsaCert[500:])})
+	c.Check(certs, HasLen, 0)
+}
+
+func (s *ekCertSuiteNoTPM) TestAssembleIgnoresOtherData(c *C) {
+	certs := AssembleEKCertificates([]EKCertNVIndex{
+		MakeEKCertNVIndex(0x01c00003, []byte{0x30, 0x02, 0x01, 0x00}), // nonce that looks like DER
+		MakeEKCertNVIndex(0x01c00004, []byte{0x00, 0x01, 0x00, 0x0b}), // template
+		MakeEKCertNVIndex(0x01c0000a, s.eccCert)})
+	c.Assert(certs, HasLen, 1)
+	c.Check(certs[0].Handles, DeepEquals, tpm2.HandleList{0x01c0000a})
+}
+
+func (s *ekCertSuite) defineIndex(c *C, handle tpm2.Handle, data []byte) {
+	pub := tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    uint16(len(data))}
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, &pub)
+	c.Check(s.TPM().NVWrite(s.TPM().OwnerHandleContext(), index, data, 0, nil), IsNil)
+}
+
+func (s *ekCertSuite) TestDiscoverEKCertificates(c *C) {
+	s.defineIndex(c, 0x01c00102, s.rsaCert[:400])
+	s.defineIndex(c, 0x01c00103, s.rsaCert[400:])
+	s.defineIndex(c, 0x01c0000a, s.eccCert)
+
+	certs, err := s.TPM().DiscoverEKCertificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 2)
+	c.Check(certs[0].Handles, DeepEquals, tpm2.HandleList{0x01c0000a})
+	c.Check(certs[0].Type, Equals, tpm2.ObjectTypeECC)
+	c.Check(certs[1].Handles, DeepEquals, tpm2.HandleList{0x01c00102, 0x01c00103})
+	c.Check(certs[1].Type, Equals, tpm2.ObjectTypeRSA)
+	c.Check(certs[1].Certificate.Raw, DeepEquals, s.rsaCert)
+}
+
+func (s *ekCertSuite) TestEKCertificate(c *C) {
+	s.defineIndex(c, 0x01c00002, s.rsaCert)
+	s.defineIndex(c, 0x01c0000a, s.eccCert)
+
+	cert, err := s.TPM().EKCertificate(tpm2.ObjectTypeECC)
+	c.Assert(err, IsNil)
+	c.Check(cert.Certificate.Raw, DeepEquals, s.eccCert)
+
+	cert, err = s.TPM().EKCertificate(tpm2.ObjectTypeRSA)
+	c.Assert(err, IsNil)
+	c.Check(cert.Certificate.Raw, DeepEquals, s.rsaCert)
+}
+
+func (s *ekCertSuite) TestEKCertificateNotFound(c *C) {
+	s.defineIndex(c, 0x01c00002, s.rsaCert)
+
+	_, err := s.TPM().EKCertificate(tpm2.ObjectTypeECC)
+	c.Check(err, Equals, ErrNoEKCertificate)
+}
@@ -50,6 +50,21 @@ var (
 
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
+
+	// ErrTPMClockUnsafe is returned from Connection.ReadSafeClock if the TPM indicates that its clock value may have
+	// been reported before, which happens after an unorderly shutdown until the next time the clock is updated in NV.
+	ErrTPMClockUnsafe = errors.New("the TPM clock is not safe")
+
+	// ErrKeyNotBoundToTPM is returned from VerifyKeyBinding or ImportSealedKey if the supplied key was not created under the
+	// storage root key of the TPM, eg, because the key belongs to a different device or the TPM has been cleared since the key was created.
+	ErrKeyNotBoundToTPM = errors.New("the key is not bound to this TPM")
+
+	// ErrPolicySessionNotSatisfied is returned from SealedKeyObject.UnsealWithSession if the supplied policy session
+	// doesn't satisfy the authorization policy of the sealed key object.
+	ErrPolicySessionNotSatisfied = errors.New("the supplied policy session does not satisfy the authorization policy")
+
+	// ErrPINFail is returned from MigrateSealedKeyObjects if the supplied PIN is incorrect.
+	ErrPINFail = errors.New("the provided PIN is incorrect")
 )
 
 // TPMResourceExistsError is returned from any function that creates a persistent TPM resource if a resource already exists
@@ -20,7 +20,12 @@
 package tpm2
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"time"
+
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
 
 	"github.com/snapcore/secboot"
 )
@@ -34,32 +39,53 @@ const (
 
 // Export variables and unexported functions for testing
 var (
+	AssembleEKCertificates                  = assembleEKCertificates
+	NewExportedPublicKey                    = newExportedPublicKey
+	PcrProtectionLevel                      = pcrProtectionLevel
 	ComputeV0PinNVIndexPostInitAuthPolicies = computeV0PinNVIndexPostInitAuthPolicies
 	CreatePcrPolicyCounter                  = createPcrPolicyCounterLegacy
 	EnsurePcrPolicyCounter                  = ensurePcrPolicyCounter
 	ComputeV1PcrPolicyRefFromCounterName    = computeV1PcrPolicyRefFromCounterName
 	ComputeV3PcrPolicyCounterAuthPolicies   = computeV3PcrPolicyCounterAuthPolicies
 	ComputeV3PcrPolicyRef                   = computeV3PcrPolicyRef
+	ComputeOSVersionCounterAuthPolicies     = computeOSVersionCounterAuthPolicies
+	ComputePcrPolicyNVIndexAuthPolicy       = computePcrPolicyNVIndexAuthPolicy
+	ComputePolicyAuthorizeNVDigest          = computePolicyAuthorizeNVDigest
+	CreatePcrPolicyNVIndices                = createPcrPolicyNVIndices
 	DeriveV3PolicyAuthKey                   = deriveV3PolicyAuthKey
 	ErrSessionDigestNotFound                = errSessionDigestNotFound
+	FindEventLogMismatches                  = findEventLogMismatches
 	IsPolicyDataError                       = isPolicyDataError
+	IsVirtualTPMManufacturer                = isVirtualTPMManufacturer
 	MakeSealedKeyData                       = makeSealedKeyData
+	MakeSealedKeysData                      = makeSealedKeysData
 	MakeKeyDataNoAuth                       = makeKeyDataNoAuth
 	MakeKeyDataWithPassphraseConstructor    = makeKeyDataWithPassphraseConstructor
 	NewKeyData                              = newKeyData
 	NewKeyDataPolicy                        = newKeyDataPolicy
 	NewKeyDataPolicyLegacy                  = newKeyDataPolicyLegacy
+	NewKeyDataPolicyWithPCRPolicyNVIndex    = newKeyDataPolicyWithPCRPolicyNVIndex
+	NewFileSealedKeyObjectReaderFrom        = newFileSealedKeyObjectReader
 	NewPolicyAuthPublicKey                  = newPolicyAuthPublicKey
+	NewPolicyDescription                    = newPolicyDescription
 	NewPolicyOrDataV0                       = newPolicyOrDataV0
 	NewPolicyOrTree                         = newPolicyOrTree
+	PadSealedKeyData                        = padSealedKeyData
 	ReadKeyDataV0                           = readKeyDataV0
 	ReadKeyDataV1                           = readKeyDataV1
 	ReadKeyDataV2                           = readKeyDataV2
 	ReadKeyDataV3                           = readKeyDataV3
+	ReadKeyDataV4                           = readKeyDataV4
+	ReadNVGenerationIndexName               = readNVGenerationIndexName
+	RunWithParamEncryption                  = runWithParamEncryption
+	SummarizeEventLog                       = summarizeEventLog
+	UnmarshalBootPolicy                     = unmarshalBootPolicy
+	UnpadSealedKeyData                      = unpadSealedKeyData
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
 // unexported members of some unexported types.
+type EKCertNVIndex = ekCertNVIndex
 type GoSnapModelHasher = goSnapModelHasher
 type KeyData = keyData
 type KeyData_v0 = keyData_v0
@@ -75,12 +101,12 @@ type KeyDataPolicy_v1 = keyDataPolicy_v1
 type KeyDataPolicy_v2 = keyDataPolicy_v2
 type KeyDataPolicy_v3 = keyDataPolicy_v3
 
-func NewImportableObjectKeySealer(key *tpm2.Public) keySealer {
-	return &importableObjectKeySealer{key}
+func NewImportableObjectKeySealer(key *tpm2.Public, noDA bool) keySealer {
+	return &importableObjectKeySealer{tpmKey: key, noDA: noDA}
 }
 
-func NewSealedObjectKeySealer(tpm *Connection) keySealer {
-	return &sealedObjectKeySealer{tpm}
+func NewSealedObjectKeySealer(tpm *Connection, noDA bool) keySealer {
+	return &sealedObjectKeySealer{tpm: tpm, noDA: noDA}
 }
 
 type PcrPolicyVersionOption = pcrPolicyVersionOption
@@ -134,7 +160,26 @@ func NewPcrPolicyParams(key secboot.PrimaryKey, pcrs tpm2.PCRSelectionList, pcrD
 	}
 }
 
+func (p *PcrPolicyParams) WithNVGeneration(handle tpm2.Handle, minimum uint64, indexName tpm2.Name) *PcrPolicyParams {
+	p.nvGeneration = &nvGenerationCheck{Handle: handle, Minimum: minimum}
+	p.nvGenerationIndexName = indexName
+	return p
+}
+
+func (p *PcrPolicyParams) WithNVGenerationRange(handle tpm2.Handle, minimum, maximum uint64, indexName tpm2.Name) *PcrPolicyParams {
+	p.nvGeneration = &nvGenerationCheck{Handle: handle, Minimum: minimum, Maximum: maximum}
+	p.nvGenerationIndexName = indexName
+	return p
+}
+
+func (p *PcrPolicyParams) WithResetCount(maximum uint32) *PcrPolicyParams {
+	p.resetCount = &resetCountCheck{Maximum: maximum}
+	return p
+}
+
+type NVGenerationCheck = nvGenerationCheck
 type PlatformKeyDataHandler = platformKeyDataHandler
+type ResetCountCheck = resetCountCheck
 type SealedKeyDataBase = sealedKeyDataBase
 type SnapModelHasher = snapModelHasher
 type StaticPolicyData_v0 = staticPolicyData_v0
@@ -191,7 +236,15 @@ func MockEnsurePcrPolicyCounter(fn func(*tpm2.TPMContext, tpm2.Handle, *tpm2.Pub
 	}
 }
 
-func MockNewKeyDataPolicy(fn func(tpm2.HashAlgorithmId, *tpm2.Public, string, *tpm2.NVPublic, bool) (KeyDataPolicy, tpm2.Digest, error)) (restore func()) {
+func MockCreatePcrPolicyNVIndices(fn func(*tpm2.TPMContext, tpm2.Handle, *tpm2.Public, tpm2.Nonce, tpm2.SessionContext) (*tpm2.NVPublic, error)) (restore func()) {
+	orig := createPcrPolicyNVIndices
+	createPcrPolicyNVIndices = fn
+	return func() {
+		createPcrPolicyNVIndices = orig
+	}
+}
+
+func MockNewKeyDataPolicy(fn func(tpm2.HashAlgorithmId, *tpm2.Public, string, *tpm2.NVPublic, bool, bool, tpm2.Name) (KeyDataPolicy, tpm2.Digest, error)) (restore func()) {
 	orig := newKeyDataPolicy
 	newKeyDataPolicy = fn
 	return func() {
@@ -199,7 +252,7 @@ func MockNewKeyDataPolicy(fn func(tpm2.HashAlgorithmId, *tpm2.Public, string, *t
 	}
 }
 
-func MockNewPolicyAuthPublicKey(fn func(authKey secboot.PrimaryKey) (*tpm2.Public, error)) (restore func()) {
+func MockNewPolicyAuthPublicKey(fn func(nameAlg tpm2.HashAlgorithmId, authKey secboot.PrimaryKey) (*tpm2.Public, error)) (restore func()) {
 	orig := newPolicyAuthPublicKey
 	newPolicyAuthPublicKey = fn
 	return func() {
@@ -231,10 +284,38 @@ func MockSkdbUpdatePCRProtectionPolicyNoValidate(fn func(*sealedKeyDataBase, *tp
 	}
 }
 
-func (k *SealedKeyData) Data() KeyData {
+func MockIsVirtualTPM(fn func(*tpm2.TPMContext) (bool, error)) (restore func()) {
+	orig := isVirtualTPM
+	isVirtualTPM = fn
+	return func() {
+		isVirtualTPM = orig
+	}
+}
+
+func MockSysfsPath(path string) (restore func()) {
+	orig := sysfsPath
+	sysfsPath = path
+	return func() {
+		sysfsPath = orig
+	}
+}
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	orig := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = orig
+	}
+}
+
+func (k *sealedKeyDataBase) Data() KeyData {
 	return k.data
 }
 
+func (k *sealedKeyDataBase) UpdatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMContext, key secboot.PrimaryKey, counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption PcrPolicyVersionOption) error {
+	return k.updatePCRProtectionPolicyNoValidate(tpm, key, counterPub, profile, policyVersionOption)
+}
+
 func (k *SealedKeyData) Validate(tpm *tpm2.TPMContext, authKey secboot.PrimaryKey) error {
 	if _, err := k.validateData(tpm, k.k.Role()); err != nil {
 		return err
@@ -247,6 +328,14 @@ func (k *SealedKeyObject) Data() KeyData {
 	return k.data
 }
 
+func NewRecoveryKeyGraceCounterHandler() secboot.RecoveryKeyGraceCounterHandler {
+	return new(recoveryKeyGraceCounterHandler)
+}
+
+func NewSealedKeyObject(data KeyData) *SealedKeyObject {
+	return newSealedKeyObject(data)
+}
+
 func (k *SealedKeyObject) Validate(tpm *tpm2.TPMContext, authKey secboot.PrimaryKey) error {
 	if _, err := k.validateData(tpm, ""); err != nil {
 		return err
@@ -263,3 +352,104 @@ func ValidateKeyDataFile(tpm *tpm2.TPMContext, keyFile string, authKey secboot.P
 
 	return k.Validate(tpm, authKey)
 }
+
+func MakeEKCertNVIndex(handle tpm2.Handle, data []byte) EKCertNVIndex {
+	return ekCertNVIndex{handle: handle, data: data}
+}
+
+func (l *ProvisioningAuditLog) Record(action ProvisioningAction, details string) error {
+	return l.record(nil, nil, action, details)
+}
+
+func (t *Connection) RecordProvisioningAction(action ProvisioningAction, details string) error {
+	return t.recordProvisioningAction(action, details)
+}
+
+func (p *BootPolicy) Marshal() []byte {
+	return p.marshal()
+}
+
+func NewSealedKeyDataWithPadding(data KeyData, paddingBucketSize uint32) *SealedKeyData {
+	return &SealedKeyData{
+		sealedKeyDataBase: sealedKeyDataBase{data: data},
+		paddingBucketSize: paddingBucketSize}
+}
+
+func (k *SealedKeyData) PaddingBucketSize() uint32 {
+	return k.paddingBucketSize
+}
+
+type ContextTransport = contextTransport
+
+type HandleTracker = handleTracker
+
+func (t *HandleTracker) CommandSubmitted(data []byte) {
+	t.commandSubmitted(data)
+}
+
+func (t *HandleTracker) ResponseRead(data []byte) {
+	t.responseRead(data)
+}
+
+func (t *HandleTracker) IsOwned(handle tpm2.Handle) bool {
+	return t.isOwned(handle)
+}
+
+func NewContextTransport(transport tpm2.Transport) *ContextTransport {
+	return newContextTransport(transport)
+}
+
+func (t *ContextTransport) SetContext(ctx context.Context) (restore func()) {
+	return t.setContext(ctx)
+}
+
+func NewConnectionWithContextTransport(transport *ContextTransport) *Connection {
+	return &Connection{TPMContext: tpm2.NewTPMContext(transport), transport: transport}
+}
+
+func NewUnsealError(reason UnsealFailureReason, err error) *UnsealError {
+	return &UnsealError{Reason: reason, err: err}
+}
+
+func RunInstrumentedOperation(op Operation, transport tpm2.Transport, fn func() error) error {
+	r := beginOperation(op, transport)
+	err := fn()
+	r.end(err)
+	return err
+}
+
+func (k *SealedKeyData) AuthorizedPCRPolicy() tpm2.Digest {
+	policy, err := k.v3Policy()
+	if err != nil {
+		return nil
+	}
+	return policy.PCRData.AuthorizedPolicy
+}
+
+// NewAuthorizedResealBundleForTesting creates a bundle for the supplied key
+// containing the supplied named PCR policy digests, without requiring a TPM.
+func NewAuthorizedResealBundleForTesting(k *SealedKeyData, authKey *ecdsa.PrivateKey, names []string, digests []tpm2.Digest, expires time.Time) (*AuthorizedResealBundle, error) {
+	policy, err := k.v3Policy()
+	if err != nil {
+		return nil, err
+	}
+	alg := policy.StaticData.AuthPublicKey.NameAlg
+
+	var reseals []*authorizedReseal
+	for i, name := range names {
+		data := &pcrPolicyData_v3{
+			Selection:        tpm2.PCRSelectionList{},
+			AuthorizedPolicy: digests[i]}
+		digest, err := util.ComputePolicyAuthorizeDigest(alg, data.AuthorizedPolicy, policy.StaticData.PCRPolicyRef)
+		if err != nil {
+			return nil, err
+		}
+		data.AuthorizedPolicySignature, err = SignPCRPolicyDigest(authKey, alg, digest)
+		if err != nil {
+			return nil, err
+		}
+		reseals = append(reseals, &authorizedReseal{name: name, data: data})
+	}
+
+	return newAuthorizedResealBundle(authKey, policy.StaticData.AuthPublicKey, policy.StaticData.PCRPolicyRef, reseals, expires)
+}
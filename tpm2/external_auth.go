@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNoExternalAuthorizer is returned when unsealing a key that was created
+// with ProtectKeyParams.ExternalAuthName if no ExternalAuthorizer has been
+// registered with SetExternalAuthorizer.
+var ErrNoExternalAuthorizer = errors.New("no external authorizer is registered")
+
+// ExternalAuthorizer provides authorization for the NV index or object that
+// gates unsealing of keys created with ProtectKeyParams.ExternalAuthName. It
+// would typically be implemented by the integration with an external
+// authenticator, such as a fingerprint match engine running in a TEE, which
+// authorizes the use of the NV index or object once the user has been
+// authenticated.
+type ExternalAuthorizer interface {
+	// AuthorizeExternalAuth returns a context for the NV index or object
+	// with the specified name and a session for authorizing its use in a
+	// TPM2_PolicySecret assertion. If the returned session is nil, the
+	// authorization value set on the returned context is used instead.
+	// The returned context must not be flushed until the next call or
+	// until unsealing completes, and it is the responsibility of the
+	// implementation to flush any transient object or policy session it
+	// creates.
+	AuthorizeExternalAuth(tpm *tpm2.TPMContext, name tpm2.Name) (tpm2.ResourceContext, tpm2.SessionContext, error)
+}
+
+var externalAuthorizer ExternalAuthorizer
+
+// SetExternalAuthorizer registers the ExternalAuthorizer that is used when
+// unsealing keys created with ProtectKeyParams.ExternalAuthName. Supplying
+// nil removes the current one.
+func SetExternalAuthorizer(authorizer ExternalAuthorizer) {
+	externalAuthorizer = authorizer
+}
+
+// executeExternalAuthAssertion executes a TPM2_PolicySecret assertion for the
+// NV index or object with the specified name, which is obtained from the
+// registered ExternalAuthorizer.
+func executeExternalAuthAssertion(tpm *tpm2.TPMContext, name tpm2.Name, policySession, hmacSession tpm2.SessionContext) error {
+	if externalAuthorizer == nil {
+		return ErrNoExternalAuthorizer
+	}
+
+	authObject, authSession, err := externalAuthorizer.AuthorizeExternalAuth(tpm, name)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain external authorization: %w", err)
+	}
+	if authObject == nil {
+		return errors.New("external authorizer did not supply a resource")
+	}
+	if !bytes.Equal(authObject.Name(), name) {
+		return errors.New("external authorizer supplied a resource with the wrong name")
+	}
+	if authSession == nil {
+		authSession = hmacSession
+	}
+
+	if _, _, err := tpm.PolicySecret(authObject, policySession, nil, nil, 0, authSession); err != nil {
+		if isAuthFailError(err, tpm2.CommandPolicySecret, 1) || tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandPolicySecret, 1) {
+			return AuthFailError{authObject.Handle()}
+		}
+		return err
+	}
+
+	return nil
+}
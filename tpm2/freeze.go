@@ -0,0 +1,144 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+func sealedKeyDataForFreeze(keys []*secboot.KeyData) ([]*SealedKeyData, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sealed keys supplied")
+	}
+
+	var skds []*SealedKeyData
+	for i, key := range keys {
+		skd, err := NewSealedKeyData(key)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot obtain SealedKeyData for key at index %d: %w", i, err)
+		}
+		handle := skd.data.Policy().PCRPolicyCounterHandle()
+		switch {
+		case handle == tpm2.HandleNull:
+			return nil, fmt.Errorf("key at index %d has no PCR policy counter", i)
+		case i > 0 && handle != skds[0].data.Policy().PCRPolicyCounterHandle():
+			return nil, fmt.Errorf("unexpected PCR policy counter for key at index %d (expected %v, got %v)", i, skds[0].data.Policy().PCRPolicyCounterHandle(), handle)
+		}
+		skds = append(skds, skd)
+	}
+
+	return skds, nil
+}
+
+// FreezeProtectors temporarily replaces the PCR policy of one or more related TPM
+// protected KeyData objects with a fallback policy that does not depend on any PCR
+// values. This is intended to be called before performing an update of firmware or
+// other boot components for which a new PCR profile cannot be computed in advance
+// (eg, via fwupd), so that the keys can still be recovered on the next boot without
+// prompting for a recovery key. The caller must supply the private part of the
+// authorization key.
+//
+// The fallback policy is bound to the TPM's reset count, so that it can only be
+// used for the specified number of subsequent boots. This should allow for any
+// additional reboots performed by the firmware whilst applying the update. The
+// fallback policy expires after this even if ThawProtectors is never called, after
+// which the keys can only be recovered with a recovery key.
+//
+// The fallback policy should be revoked by ThawProtectors as soon as possible after
+// booting the updated components. Until then, the keys are not protected by the PCR
+// policy. As a fallback policy can only be revoked using a PCR policy counter, this
+// returns an error if any of the keys were created without one.
+//
+// As the reset count of a virtual TPM can be rolled back by restoring the guest
+// from a snapshot, this returns an error on a virtual TPM (see
+// Connection.IsVirtualTPM).
+//
+// The keys must all be related (ie, they were created using SealKeysToTPM).
+// On success, each of the supplied KeyData objects must be persisted using
+// secboot.KeyData.WriteAtomic.
+func FreezeProtectors(tpm *Connection, authKey secboot.PrimaryKey, boots uint32, keys ...*secboot.KeyData) error {
+	if boots == 0 {
+		return errors.New("the fallback policy must permit at least one boot")
+	}
+
+	skds, err := sealedKeyDataForFreeze(keys)
+	if err != nil {
+		return err
+	}
+
+	info, err := tpm.ReadClock()
+	if err != nil {
+		return xerrors.Errorf("cannot read reset count: %w", err)
+	}
+	if math.MaxUint32-info.ClockInfo.ResetCount < boots {
+		return errors.New("the reset count is too high")
+	}
+	profile := NewPCRProtectionProfile().RequireMaximumResetCount(info.ClockInfo.ResetCount + boots)
+
+	for i, skd := range skds {
+		// The fallback policy version is set to the current value of the
+		// PCR policy counter so that the next revocation invalidates it.
+		if err := skd.UpdatePCRProtectionPolicy(tpm, authKey, profile, NoNewPCRPolicyVersion); err != nil {
+			return xerrors.Errorf("cannot freeze key at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// ThawProtectors reseals one or more related TPM protected KeyData objects that
+// were previously frozen with FreezeProtectors using the PCR profile defined by
+// the pcrProfile argument, and then revokes the PCR-independent fallback policy
+// by incrementing the PCR policy counter. This should be called once the updated
+// boot components have been booted successfully and a new PCR profile can be
+// computed. The caller must supply the private part of the authorization key.
+//
+// On success, each of the supplied KeyData objects must be persisted using
+// secboot.KeyData.WriteAtomic. Note that the fallback policy is revoked before
+// this function returns, so any copies of the frozen KeyData objects can no
+// longer be used after this.
+func ThawProtectors(tpm *Connection, authKey secboot.PrimaryKey, pcrProfile *PCRProtectionProfile, keys ...*secboot.KeyData) error {
+	skds, err := sealedKeyDataForFreeze(keys)
+	if err != nil {
+		return err
+	}
+
+	for i, skd := range skds {
+		if err := skd.UpdatePCRProtectionPolicy(tpm, authKey, pcrProfile, NewPCRPolicyVersion); err != nil {
+			return xerrors.Errorf("cannot reseal key at index %d: %w", i, err)
+		}
+	}
+
+	for i, skd := range skds {
+		if err := skd.RevokeOldPCRProtectionPolicies(tpm, authKey); err != nil {
+			return xerrors.Errorf("cannot revoke fallback policy for key at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type freezeSuite struct {
+	tpm2test.TPMTest
+	primaryKeyMixin
+}
+
+func (s *freezeSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *freezeSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	s.primaryKeyMixin.tpmTest = &s.TPMTest.TPMTest
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+type freezeSimulatorSuite struct {
+	tpm2test.TPMSimulatorTest
+}
+
+func (s *freezeSimulatorSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+}
+
+var _ = Suite(&freezeSuite{})
+var _ = Suite(&freezeSimulatorSuite{})
+
+func (s *freezeSuite) TestFreezeAndThaw(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	c.Check(FreezeProtectors(s.TPM(), primaryKey, 2, k), IsNil)
+
+	// Keep a copy of the frozen key.
+	w := newMockKeyDataWriter()
+	c.Check(k.WriteAtomic(w), IsNil)
+	frozen, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+
+	// Simulate a firmware update.
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+
+	c.Check(ThawProtectors(s.TPM(), primaryKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), k), IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+
+	// The fallback policy should have been revoked.
+	_, _, err = frozen.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy has been revoked")
+
+	// The new policy should depend on the PCR values again.
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *freezeSuite) TestFreezeNoPCRPolicyCounter(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	c.Check(FreezeProtectors(s.TPM(), primaryKey, 2, k), ErrorMatches, `key at index 0 has no PCR policy counter`)
+}
+
+func (s *freezeSuite) TestFreezeWrongAuthKey(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	err = FreezeProtectors(s.TPM(), make(secboot.PrimaryKey, 32), 2, k)
+	c.Check(err, ErrorMatches, `cannot freeze key at index 0: cannot update PCR protection policy: invalid key data: .*`)
+}
+
+func (s *freezeSuite) TestFreezeNoBoots(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	c.Check(FreezeProtectors(s.TPM(), primaryKey, 0, k), ErrorMatches, `the fallback policy must permit at least one boot`)
+}
+
+func (s *freezeSuite) TestFreezeNoKeys(c *C) {
+	c.Check(FreezeProtectors(s.TPM(), nil, 2), ErrorMatches, `no sealed keys supplied`)
+	c.Check(ThawProtectors(s.TPM(), nil, nil), ErrorMatches, `no sealed keys supplied`)
+}
+
+func (s *freezeSimulatorSuite) TestFreezeExpires(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: 0x01810000}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	info, err := s.TPM().ReadClock()
+	c.Assert(err, IsNil)
+
+	c.Check(FreezeProtectors(s.TPM(), primaryKey, 1, k), IsNil)
+
+	// The fallback policy can be used on the next boot.
+	s.ResetTPMSimulator(c)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+
+	// ... but not on any subsequent boots.
+	s.ResetTPMSimulator(c)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, fmt.Sprintf("invalid key data: cannot complete authorization policy assertions: "+
+		"the TPM reset count is higher than the permitted maximum of %d", info.ClockInfo.ResetCount+1))
+}
+
+func (s *freezeSuite) TestFreezeVirtualTPM(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	restore := MockIsVirtualTPM(func(*tpm2.TPMContext) (bool, error) { return true, nil })
+	defer restore()
+
+	c.Check(FreezeProtectors(s.TPM(), primaryKey, 2, k), ErrorMatches,
+		`cannot freeze key at index 0: cannot update PCR protection policy: reset count requirements are not supported on a virtual TPM`)
+}
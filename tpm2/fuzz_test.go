@@ -0,0 +1,107 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+// The following functions are entry points for go's native fuzzing support,
+// and can be run with "go test -run=- -fuzz=<name>". Without -fuzz, they are
+// run as tests with the seed inputs.
+
+func FuzzReadSealedKeyObject(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x03, 0x00, 0x00})
+	f.Add(bytes.Repeat([]byte{0x00, 0x01}, 32))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		k, err := ReadSealedKeyObject(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		k.Version()
+		k.PCRPolicyCounterHandle()
+	})
+}
+
+func FuzzNewFileSealedKeyObjectReader(f *testing.F) {
+	f.Add([]byte{0x55, 0x53, 0x4b, 0x24, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x55, 0x53, 0x4b, 0x24, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x04, 0xaa, 0xbb, 0xcc, 0xdd})
+	f.Add([]byte{0x55, 0x53, 0x4b, 0x24, 0x00, 0x00, 0x00, 0x02, 0xff, 0xff, 0xff, 0xff, 0x00, 0x0b, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewFileSealedKeyObjectReaderFrom(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		ReadSealedKeyObject(r)
+	})
+}
+
+func FuzzSealedKeyDataUnmarshalJSON(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x03})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		var k SealedKeyData
+		if err := json.Unmarshal(b, &k); err != nil {
+			return
+		}
+		k.Version()
+		k.PCRPolicyCounterHandle()
+		k.PolicyDescription()
+	})
+}
+
+func FuzzUnmarshalBootPolicy(f *testing.F) {
+	f.Add([]byte{0x53, 0x42, 0x42, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0xaa})
+	f.Add([]byte{0x53, 0x42, 0x42, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshalBootPolicy(data)
+	})
+}
+
+func FuzzReadClockMapping(f *testing.F) {
+	f.Add([]byte(`{"clock":100,"reset-count":1,"wall-time":"2024-01-01T00:00:00Z"}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadClockMapping(bytes.NewReader(data))
+	})
+}
+
+func FuzzVerifyProvisioningAuditLog(f *testing.F) {
+	f.Add([]byte("{}\n"))
+	f.Add([]byte("null\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		VerifyProvisioningAuditLog(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,300 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/testhooks"
+)
+
+const (
+	hierarchyAuthStoreKeySize = 32
+
+	// hierarchyAuthSize is the size of the authorization values generated
+	// by RotateHierarchyAuth. This is the size of the digest of the name
+	// algorithm of the hierarchies.
+	hierarchyAuthSize = 32
+)
+
+var hierarchyAuthStoreAdditionalData = []byte("TPM2-HIERARCHY-AUTH")
+
+// hierarchyAuthValues contains the current and staged authorization values for
+// each hierarchy, keyed by handle.
+type hierarchyAuthValues struct {
+	Current map[tpm2.Handle][]byte `json:"current,omitempty"`
+	Staged  map[tpm2.Handle][]byte `json:"staged,omitempty"`
+}
+
+// hierarchyAuthStoreFile is the on-disk format of a HierarchyAuthStore.
+type hierarchyAuthStoreFile struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// HierarchyAuthStore stores the authorization values for the owner, endorsement
+// and lockout hierarchies in a file, so that products can set high entropy
+// authorization values for these once the TPM has been provisioned rather than
+// leaving them empty. The values are encrypted with AES-256-GCM, using a key
+// derived from the supplied primary key with HKDF-SHA256, so they can only be
+// recovered by unlocking the key data that protects the primary key (eg, a key
+// created with NewTPMProtectedKey).
+//
+// The store can be used as an escrow for Connection.ChangeHierarchyAuth with
+// Escrow, and retains both the current and any staged values.
+type HierarchyAuthStore struct {
+	path       string
+	primaryKey secboot.PrimaryKey
+}
+
+// NewHierarchyAuthStore returns a new HierarchyAuthStore for the file at the
+// specified path, which is created when a value is first stored. The values
+// are protected with the supplied primary key.
+func NewHierarchyAuthStore(path string, primaryKey secboot.PrimaryKey) *HierarchyAuthStore {
+	return &HierarchyAuthStore{path: path, primaryKey: primaryKey}
+}
+
+func (s *HierarchyAuthStore) newAEAD() (cipher.AEAD, error) {
+	if len(s.primaryKey) == 0 {
+		return nil, errors.New("no primary key")
+	}
+
+	r := hkdf.New(crypto.SHA256.New, s.primaryKey, nil, hierarchyAuthStoreAdditionalData)
+	key := make([]byte, hierarchyAuthStoreKeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+func (s *HierarchyAuthStore) read() (*hierarchyAuthValues, error) {
+	values := &hierarchyAuthValues{
+		Current: make(map[tpm2.Handle][]byte),
+		Staged:  make(map[tpm2.Handle][]byte)}
+
+	data, err := ioutil.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return values, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read file: %w", err)
+	}
+
+	var f *hierarchyAuthStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, xerrors.Errorf("cannot decode file: %w", err)
+	}
+	if f == nil {
+		return nil, errors.New("invalid file: no data")
+	}
+
+	aead, err := s.newAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid file: invalid nonce size")
+	}
+
+	payload, err := aead.Open(nil, f.Nonce, f.Ciphertext, hierarchyAuthStoreAdditionalData)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decrypt authorization values: %w", err)
+	}
+	if err := json.Unmarshal(payload, values); err != nil {
+		return nil, xerrors.Errorf("cannot decode authorization values: %w", err)
+	}
+	if values.Current == nil {
+		values.Current = make(map[tpm2.Handle][]byte)
+	}
+	if values.Staged == nil {
+		values.Staged = make(map[tpm2.Handle][]byte)
+	}
+
+	return values, nil
+}
+
+func (s *HierarchyAuthStore) write(values *hierarchyAuthValues) error {
+	aead, err := s.newAEAD()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(values)
+	if err != nil {
+		return xerrors.Errorf("cannot encode authorization values: %w", err)
+	}
+
+	f := &hierarchyAuthStoreFile{Nonce: make([]byte, aead.NonceSize())}
+	if _, err := io.ReadFull(testhooks.RandReader, f.Nonce); err != nil {
+		return xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+	f.Ciphertext = aead.Seal(nil, f.Nonce, payload, hierarchyAuthStoreAdditionalData)
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return xerrors.Errorf("cannot encode file: %w", err)
+	}
+	if err := osutil.AtomicWriteFile(s.path, data, 0600, 0); err != nil {
+		return xerrors.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+func (s *HierarchyAuthStore) update(fn func(values *hierarchyAuthValues)) error {
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+	fn(values)
+	return s.write(values)
+}
+
+// AuthValue returns the current authorization value for the specified
+// hierarchy, which must be one of tpm2.HandleOwner, tpm2.HandleEndorsement or
+// tpm2.HandleLockout. If no value has been stored, an empty value is returned.
+func (s *HierarchyAuthStore) AuthValue(hierarchy tpm2.Handle) ([]byte, error) {
+	if err := checkHierarchyHandle(hierarchy); err != nil {
+		return nil, err
+	}
+	values, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return values.Current[hierarchy], nil
+}
+
+// StagedAuthValue returns the staged authorization value for the specified
+// hierarchy, if there is one. A staged value remains if the outcome of a call
+// to Connection.ChangeHierarchyAuth could not be determined, in which case
+// the caller should determine whether this or the current value is valid.
+func (s *HierarchyAuthStore) StagedAuthValue(hierarchy tpm2.Handle) (auth []byte, ok bool, err error) {
+	if err := checkHierarchyHandle(hierarchy); err != nil {
+		return nil, false, err
+	}
+	values, err := s.read()
+	if err != nil {
+		return nil, false, err
+	}
+	auth, ok = values.Staged[hierarchy]
+	return auth, ok, nil
+}
+
+// SetAuthValues sets the authorization values of the owner, endorsement and
+// lockout hierarchy ResourceContexts of the supplied connection to the current
+// values from this store, so that the connection can be used to authorize
+// commands with these hierarchies.
+func (s *HierarchyAuthStore) SetAuthValues(tpm *Connection) error {
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+	for _, hierarchy := range []tpm2.Handle{tpm2.HandleOwner, tpm2.HandleEndorsement, tpm2.HandleLockout} {
+		tpm.GetPermanentContext(hierarchy).SetAuthValue(values.Current[hierarchy])
+	}
+	return nil
+}
+
+// Escrow returns a HierarchyAuthEscrow for the specified hierarchy that is
+// backed by this store, for use with Connection.ChangeHierarchyAuth.
+func (s *HierarchyAuthStore) Escrow(hierarchy tpm2.Handle) HierarchyAuthEscrow {
+	return &hierarchyAuthStoreEscrow{store: s, hierarchy: hierarchy}
+}
+
+type hierarchyAuthStoreEscrow struct {
+	store     *HierarchyAuthStore
+	hierarchy tpm2.Handle
+}
+
+func (e *hierarchyAuthStoreEscrow) Stage(newAuth []byte) error {
+	if err := checkHierarchyHandle(e.hierarchy); err != nil {
+		return err
+	}
+	return e.store.update(func(values *hierarchyAuthValues) {
+		values.Staged[e.hierarchy] = newAuth
+	})
+}
+
+func (e *hierarchyAuthStoreEscrow) Commit() error {
+	return e.store.update(func(values *hierarchyAuthValues) {
+		auth, ok := values.Staged[e.hierarchy]
+		if !ok {
+			return
+		}
+		values.Current[e.hierarchy] = auth
+		delete(values.Staged, e.hierarchy)
+	})
+}
+
+func (e *hierarchyAuthStoreEscrow) Abort() error {
+	return e.store.update(func(values *hierarchyAuthValues) {
+		delete(values.Staged, e.hierarchy)
+	})
+}
+
+// RotateHierarchyAuth changes the authorization value for the specified
+// hierarchy, which must be one of tpm2.HandleOwner, tpm2.HandleEndorsement or
+// tpm2.HandleLockout, to a newly generated high entropy value, which is stored
+// in the supplied store. The current authorization value is obtained from the
+// store, which will be empty if it has never been set.
+//
+// See Connection.ChangeHierarchyAuth for details of the errors returned.
+func RotateHierarchyAuth(tpm *Connection, hierarchy tpm2.Handle, store *HierarchyAuthStore) error {
+	if store == nil {
+		return errors.New("no store supplied")
+	}
+
+	current, err := store.AuthValue(hierarchy)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain current authorization value: %w", err)
+	}
+
+	newAuth := make([]byte, hierarchyAuthSize)
+	if _, err := io.ReadFull(testhooks.RandReader, newAuth); err != nil {
+		return xerrors.Errorf("cannot obtain new authorization value: %w", err)
+	}
+
+	tpm.GetPermanentContext(hierarchy).SetAuthValue(current)
+	return tpm.ChangeHierarchyAuth(hierarchy, newAuth, store.Escrow(hierarchy))
+}
+
+// LockoutAuthRotate changes the authorization value for the lockout hierarchy
+// to a newly generated high entropy value, which is stored in the supplied
+// store. See RotateHierarchyAuth.
+func LockoutAuthRotate(tpm *Connection, store *HierarchyAuthStore) error {
+	return RotateHierarchyAuth(tpm, tpm2.HandleLockout, store)
+}
@@ -0,0 +1,216 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type hierarchyAuthStoreSuiteNoTPM struct {
+	path       string
+	primaryKey secboot.PrimaryKey
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "hierarchy-auth")
+	s.primaryKey = testutil.DecodeHexString(c, "90e29c2f9ba13c0ae9ec7b1e6bbbb3a4efd0e3f4b5d2c0e2e6d8bd0d0b1bc6e1")
+}
+
+var _ = Suite(&hierarchyAuthStoreSuiteNoTPM{})
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestAuthValueEmpty(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+	for _, hierarchy := range []tpm2.Handle{tpm2.HandleOwner, tpm2.HandleEndorsement, tpm2.HandleLockout} {
+		auth, err := store.AuthValue(hierarchy)
+		c.Check(err, IsNil)
+		c.Check(auth, HasLen, 0)
+	}
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestEscrowCommit(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+
+	escrow := store.Escrow(tpm2.HandleOwner)
+	c.Check(escrow.Stage([]byte("foo")), IsNil)
+
+	auth, err := store.AuthValue(tpm2.HandleOwner)
+	c.Check(err, IsNil)
+	c.Check(auth, HasLen, 0)
+	staged, ok, err := store.StagedAuthValue(tpm2.HandleOwner)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+	c.Check(staged, DeepEquals, []byte("foo"))
+
+	c.Check(escrow.Commit(), IsNil)
+
+	// Use a new store to make sure that the value was persisted.
+	store = NewHierarchyAuthStore(s.path, s.primaryKey)
+	auth, err = store.AuthValue(tpm2.HandleOwner)
+	c.Check(err, IsNil)
+	c.Check(auth, DeepEquals, []byte("foo"))
+	_, ok, err = store.StagedAuthValue(tpm2.HandleOwner)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsFalse)
+
+	// Other hierarchies are unaffected.
+	auth, err = store.AuthValue(tpm2.HandleLockout)
+	c.Check(err, IsNil)
+	c.Check(auth, HasLen, 0)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestEscrowAbort(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+	c.Check(store.Escrow(tpm2.HandleLockout).Stage([]byte("foo")), IsNil)
+	c.Check(store.Escrow(tpm2.HandleLockout).Commit(), IsNil)
+
+	escrow := store.Escrow(tpm2.HandleLockout)
+	c.Check(escrow.Stage([]byte("bar")), IsNil)
+	c.Check(escrow.Abort(), IsNil)
+
+	auth, err := store.AuthValue(tpm2.HandleLockout)
+	c.Check(err, IsNil)
+	c.Check(auth, DeepEquals, []byte("foo"))
+	_, ok, err := store.StagedAuthValue(tpm2.HandleLockout)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestFileIsEncrypted(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+	escrow := store.Escrow(tpm2.HandleEndorsement)
+	c.Check(escrow.Stage([]byte("secret-auth-value")), IsNil)
+	c.Check(escrow.Commit(), IsNil)
+
+	data, err := ioutil.ReadFile(s.path)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Not(Matches), `(?s).*secret-auth-value.*`)
+	c.Check(string(data), Not(Matches), `(?s).*c2VjcmV0LWF1dGgtdmFsdWU.*`)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestWrongPrimaryKey(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+	c.Check(store.Escrow(tpm2.HandleOwner).Stage([]byte("foo")), IsNil)
+
+	store = NewHierarchyAuthStore(s.path, make(secboot.PrimaryKey, 32))
+	_, err := store.AuthValue(tpm2.HandleOwner)
+	c.Check(err, ErrorMatches, `cannot decrypt authorization values: cipher: message authentication failed`)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestNoPrimaryKey(c *C) {
+	store := NewHierarchyAuthStore(s.path, nil)
+	c.Check(store.Escrow(tpm2.HandleOwner).Stage([]byte("foo")), ErrorMatches, `no primary key`)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestInvalidHierarchy(c *C) {
+	store := NewHierarchyAuthStore(s.path, s.primaryKey)
+	_, err := store.AuthValue(tpm2.HandlePlatform)
+	c.Check(err, ErrorMatches, `invalid hierarchy TPM_RH_PLATFORM`)
+	c.Check(store.Escrow(tpm2.HandlePlatform).Stage([]byte("foo")), ErrorMatches, `invalid hierarchy TPM_RH_PLATFORM`)
+}
+
+func (s *hierarchyAuthStoreSuiteNoTPM) TestInvalidFile(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("null"), 0600), IsNil)
+	_, err := NewHierarchyAuthStore(s.path, s.primaryKey).AuthValue(tpm2.HandleOwner)
+	c.Check(err, ErrorMatches, `invalid file: no data`)
+}
+
+type hierarchyAuthSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *hierarchyAuthSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePlatformHierarchy
+}
+
+var _ = Suite(&hierarchyAuthSuite{})
+
+func (s *hierarchyAuthSuite) restoreHierarchyAuth(c *C, hierarchy tpm2.Handle) {
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// ChangeHierarchyAuth uses command parameter encryption.
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().GetPermanentContext(hierarchy), nil, nil), IsNil)
+	})
+}
+
+func (s *hierarchyAuthSuite) testRotateHierarchyAuth(c *C, hierarchy tpm2.Handle) {
+	store := NewHierarchyAuthStore(filepath.Join(c.MkDir(), "hierarchy-auth"), make(secboot.PrimaryKey, 32))
+
+	c.Check(RotateHierarchyAuth(s.TPM(), hierarchy, store), IsNil)
+	s.restoreHierarchyAuth(c, hierarchy)
+
+	auth1, err := store.AuthValue(hierarchy)
+	c.Check(err, IsNil)
+	c.Check(auth1, HasLen, 32)
+	c.Check(s.TPM().GetPermanentContext(hierarchy).AuthValue(), DeepEquals, auth1)
+
+	// Rotate again, which requires the current value to be obtained from
+	// the store.
+	s.TPM().GetPermanentContext(hierarchy).SetAuthValue(nil)
+	c.Check(RotateHierarchyAuth(s.TPM(), hierarchy, store), IsNil)
+
+	auth2, err := store.AuthValue(hierarchy)
+	c.Check(err, IsNil)
+	c.Check(auth2, HasLen, 32)
+	c.Check(auth2, Not(DeepEquals), auth1)
+
+	// Make sure that the TPM is using the stored value.
+	s.TPM().GetPermanentContext(hierarchy).SetAuthValue(nil)
+	c.Check(store.SetAuthValues(s.TPM()), IsNil)
+	c.Check(s.TPM().HierarchyChangeAuth(s.TPM().GetPermanentContext(hierarchy), auth2, nil), IsNil)
+}
+
+func (s *hierarchyAuthSuite) TestRotateHierarchyAuthOwner(c *C) {
+	s.testRotateHierarchyAuth(c, tpm2.HandleOwner)
+}
+
+func (s *hierarchyAuthSuite) TestRotateHierarchyAuthEndorsement(c *C) {
+	s.testRotateHierarchyAuth(c, tpm2.HandleEndorsement)
+}
+
+func (s *hierarchyAuthSuite) TestLockoutAuthRotate(c *C) {
+	store := NewHierarchyAuthStore(filepath.Join(c.MkDir(), "hierarchy-auth"), make(secboot.PrimaryKey, 32))
+
+	c.Check(LockoutAuthRotate(s.TPM(), store), IsNil)
+	s.restoreHierarchyAuth(c, tpm2.HandleLockout)
+
+	auth, err := store.AuthValue(tpm2.HandleLockout)
+	c.Check(err, IsNil)
+	c.Check(auth, HasLen, 32)
+
+	s.TPM().LockoutHandleContext().SetAuthValue(auth)
+	c.Check(s.TPM().DictionaryAttackLockReset(s.TPM().LockoutHandleContext(), nil), IsNil)
+}
+
+func (s *hierarchyAuthSuite) TestChangeHierarchyAuthInvalidHierarchy(c *C) {
+	c.Check(s.TPM().ChangeHierarchyAuth(tpm2.HandlePlatform, nil, new(mockLockoutAuthEscrow)), ErrorMatches, `invalid hierarchy TPM_RH_PLATFORM`)
+}
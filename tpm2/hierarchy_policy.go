@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// HierarchyAuthPolicy corresponds to an authorization policy for one of the TPM's
+// hierarchies.
+type HierarchyAuthPolicy struct {
+	Alg    tpm2.HashAlgorithmId // The digest algorithm of the policy
+	Digest tpm2.Digest          // The policy digest
+}
+
+// HierarchyAuthPolicies contains authorization policies for the TPM's owner,
+// endorsement and lockout hierarchies. A nil field means that the policy for
+// the corresponding hierarchy is not changed.
+type HierarchyAuthPolicies struct {
+	Owner       *HierarchyAuthPolicy
+	Endorsement *HierarchyAuthPolicy
+	Lockout     *HierarchyAuthPolicy
+}
+
+// HierarchyAuthSigner is a callback used to sign an authorization for a policy
+// created with ComputeSignedHierarchyAuthPolicy. It is supplied with the TPM's
+// nonce for the policy session and the policy ref, and should return a signature
+// of the digest computed from these (see the documentation for TPM2_PolicySigned).
+// This allows the private key to be kept on a remote service or a HSM.
+type HierarchyAuthSigner func(nonceTPM, policyRef tpm2.Nonce) (*tpm2.Signature, error)
+
+// ComputeSignedHierarchyAuthPolicy computes an authorization policy for a hierarchy
+// that is satisfied by a signed authorization from authKey with the supplied
+// policyRef. The policy can be set on a hierarchy with
+// Connection.SetHierarchyAuthPolicies, and then used to authorize the hierarchy
+// using a session returned from Connection.StartSignedHierarchyAuthPolicySession.
+func ComputeSignedHierarchyAuthPolicy(alg tpm2.HashAlgorithmId, authKey *tpm2.Public, policyRef tpm2.Nonce) (*HierarchyAuthPolicy, error) {
+	if !alg.Available() {
+		return nil, errors.New("digest algorithm is not available")
+	}
+	if authKey == nil || !authKey.IsAsymmetric() {
+		return nil, errors.New("auth key must be an asymmetric key")
+	}
+	if authKey.Attrs&tpm2.AttrSign == 0 {
+		return nil, errors.New("auth key is not a signing key")
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(authKey.Name(), policyRef)
+
+	return &HierarchyAuthPolicy{Alg: alg, Digest: trial.GetDigest()}, nil
+}
+
+func (t *Connection) setPrimaryPolicy(hierarchy tpm2.ResourceContext, policy *HierarchyAuthPolicy, session tpm2.SessionContext) error {
+	return t.StartCommand(tpm2.CommandSetPrimaryPolicy).
+		AddHandles(tpm2.UseResourceContextWithAuth(hierarchy, session)).
+		AddParams(policy.Digest, policy.Alg).
+		Run(nil)
+}
+
+// SetHierarchyAuthPolicies sets the authorization policies for the TPM's owner,
+// endorsement and lockout hierarchies. This allows a hierarchy to be authorized
+// with a policy session (eg, one that requires a signed authorization, see
+// ComputeSignedHierarchyAuthPolicy) in addition to its authorization value, which
+// is useful for deployments where control of the hierarchies is centralized. In
+// that case, the authorization value of each hierarchy should be set to a random
+// value that is discarded.
+//
+// Setting a policy for a hierarchy requires knowledge of its current authorization
+// value, which must be provided by calling SetAuthValue on the corresponding
+// ResourceContext prior to calling this function. If the wrong value is provided,
+// a AuthFailError error will be returned. If the lockout hierarchy is in dictionary
+// attack lockout mode, a ErrTPMLockout error will be returned.
+//
+// To remove the policy from a hierarchy, supply a HierarchyAuthPolicy with an empty
+// digest and the algorithm set to tpm2.HashAlgorithmNull.
+func (t *Connection) SetHierarchyAuthPolicies(policies *HierarchyAuthPolicies) error {
+	session := t.HmacSession()
+
+	for _, h := range []struct {
+		handle tpm2.Handle
+		policy *HierarchyAuthPolicy
+	}{
+		{handle: tpm2.HandleLockout, policy: policies.Lockout},
+		{handle: tpm2.HandleEndorsement, policy: policies.Endorsement},
+		{handle: tpm2.HandleOwner, policy: policies.Owner},
+	} {
+		if h.policy == nil {
+			continue
+		}
+
+		if h.policy.Alg != tpm2.HashAlgorithmNull {
+			if !h.policy.Alg.IsValid() {
+				return fmt.Errorf("invalid digest algorithm for hierarchy %v", h.handle)
+			}
+			if len(h.policy.Digest) != h.policy.Alg.Size() {
+				return fmt.Errorf("invalid digest size for hierarchy %v", h.handle)
+			}
+		} else if len(h.policy.Digest) > 0 {
+			return fmt.Errorf("invalid digest size for hierarchy %v", h.handle)
+		}
+
+		if err := t.setPrimaryPolicy(t.GetPermanentContext(h.handle), h.policy, session); err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandSetPrimaryPolicy, 1):
+				return AuthFailError{h.handle}
+			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandSetPrimaryPolicy):
+				return ErrTPMLockout
+			}
+			return xerrors.Errorf("cannot set authorization policy for hierarchy %v: %w", h.handle, err)
+		}
+	}
+
+	return nil
+}
+
+// StartSignedHierarchyAuthPolicySession starts a policy session that satisfies
+// a policy computed by ComputeSignedHierarchyAuthPolicy with the supplied
+// arguments. The signed authorization is obtained by calling the supplied sign
+// callback. The returned session can be used once to authorize a hierarchy for
+// which the policy has been set with SetHierarchyAuthPolicies, eg:
+//
+//	session, err := tpm.StartSignedHierarchyAuthPolicySession(alg, authKey, policyRef, sign)
+//	...
+//	err = tpm.Clear(tpm.LockoutHandleContext(), session)
+//
+// A session is flushed from the TPM automatically once it has been used. If it is
+// not used, the caller is responsible for flushing it.
+func (t *Connection) StartSignedHierarchyAuthPolicySession(alg tpm2.HashAlgorithmId, authKey *tpm2.Public, policyRef tpm2.Nonce, sign HierarchyAuthSigner) (session tpm2.SessionContext, err error) {
+	if !alg.Available() {
+		return nil, errors.New("digest algorithm is not available")
+	}
+
+	session, err = t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, alg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		t.FlushContext(session)
+	}()
+
+	// Load the public part of the key in to the TPM. There's no integrity protection
+	// for this command as if it's altered in transit then either the signature
+	// verification fails or the policy digest will not match the one associated with
+	// the hierarchy.
+	key, err := t.LoadExternal(nil, authKey, tpm2.HandleEndorsement)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot load auth key: %w", err)
+	}
+	defer t.FlushContext(key)
+
+	signature, err := sign(session.NonceTPM(), policyRef)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign authorization: %w", err)
+	}
+
+	if _, _, err := t.PolicySigned(key, session, true, nil, policyRef, 0, signature); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+
+	return session, nil
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type hierarchyPolicyMixin struct {
+	key     *ecdsa.PrivateKey
+	authKey *tpm2.Public
+}
+
+func (m *hierarchyPolicyMixin) setUpKey(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	m.key = key
+	m.authKey = util.NewExternalECCPublicKey(tpm2.HashAlgorithmSHA256, templates.KeyUsageSign, nil, &key.PublicKey)
+}
+
+func (m *hierarchyPolicyMixin) sign(nonceTPM, policyRef tpm2.Nonce) (*tpm2.Signature, error) {
+	scheme := tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{
+				HashAlg: tpm2.HashAlgorithmSHA256}}}
+	return util.SignPolicyAuthorization(m.key, &scheme, nonceTPM, nil, policyRef, 0)
+}
+
+type hierarchyPolicySuiteNoTPM struct {
+	hierarchyPolicyMixin
+}
+
+func (s *hierarchyPolicySuiteNoTPM) SetUpTest(c *C) {
+	s.setUpKey(c)
+}
+
+type hierarchyPolicySuite struct {
+	tpm2test.TPMTest
+	hierarchyPolicyMixin
+}
+
+func (s *hierarchyPolicySuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *hierarchyPolicySuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	s.setUpKey(c)
+}
+
+var _ = Suite(&hierarchyPolicySuiteNoTPM{})
+var _ = Suite(&hierarchyPolicySuite{})
+
+func (s *hierarchyPolicySuiteNoTPM) testComputeSignedHierarchyAuthPolicy(c *C, alg tpm2.HashAlgorithmId, policyRef tpm2.Nonce) {
+	policy, err := ComputeSignedHierarchyAuthPolicy(alg, s.authKey, policyRef)
+	c.Assert(err, IsNil)
+	c.Check(policy.Alg, Equals, alg)
+
+	// TPM2_PolicySigned: policyDigest = H(H(0 || TPM_CC_PolicySigned || authKey.Name) || policyRef)
+	h := alg.NewHash()
+	h.Write(make([]byte, alg.Size()))
+	binary.Write(h, binary.BigEndian, tpm2.CommandPolicySigned)
+	h.Write(s.authKey.Name())
+	digest := h.Sum(nil)
+
+	h = alg.NewHash()
+	h.Write(digest)
+	h.Write(policyRef)
+	c.Check(policy.Digest, DeepEquals, tpm2.Digest(h.Sum(nil)))
+}
+
+func (s *hierarchyPolicySuiteNoTPM) TestComputeSignedHierarchyAuthPolicy(c *C) {
+	s.testComputeSignedHierarchyAuthPolicy(c, tpm2.HashAlgorithmSHA256, nil)
+}
+
+func (s *hierarchyPolicySuiteNoTPM) TestComputeSignedHierarchyAuthPolicyWithPolicyRef(c *C) {
+	s.testComputeSignedHierarchyAuthPolicy(c, tpm2.HashAlgorithmSHA256, []byte("foo"))
+}
+
+func (s *hierarchyPolicySuiteNoTPM) TestComputeSignedHierarchyAuthPolicySHA384(c *C) {
+	s.testComputeSignedHierarchyAuthPolicy(c, tpm2.HashAlgorithmSHA384, nil)
+}
+
+func (s *hierarchyPolicySuiteNoTPM) TestComputeSignedHierarchyAuthPolicyInvalidAlg(c *C) {
+	_, err := ComputeSignedHierarchyAuthPolicy(tpm2.HashAlgorithmNull, s.authKey, nil)
+	c.Check(err, ErrorMatches, `digest algorithm is not available`)
+}
+
+func (s *hierarchyPolicySuiteNoTPM) TestComputeSignedHierarchyAuthPolicyNotSigningKey(c *C) {
+	s.authKey.Attrs &^= tpm2.AttrSign
+	_, err := ComputeSignedHierarchyAuthPolicy(tpm2.HashAlgorithmSHA256, s.authKey, nil)
+	c.Check(err, ErrorMatches, `auth key is not a signing key`)
+}
+
+func (s *hierarchyPolicySuite) setPolicy(c *C, policies *HierarchyAuthPolicies) {
+	c.Check(s.TPM().SetHierarchyAuthPolicies(policies), IsNil)
+	s.AddCleanup(func() {
+		reset := &HierarchyAuthPolicy{Alg: tpm2.HashAlgorithmNull}
+		c.Check(s.TPM().SetHierarchyAuthPolicies(&HierarchyAuthPolicies{
+			Owner:       reset,
+			Endorsement: reset,
+			Lockout:     reset}), IsNil)
+	})
+}
+
+func (s *hierarchyPolicySuite) TestSetLockoutAuthPolicyAndUseSignedSession(c *C) {
+	policy, err := ComputeSignedHierarchyAuthPolicy(tpm2.HashAlgorithmSHA256, s.authKey, []byte("lockout"))
+	c.Assert(err, IsNil)
+	s.setPolicy(c, &HierarchyAuthPolicies{Lockout: policy})
+
+	session, err := s.TPM().StartSignedHierarchyAuthPolicySession(tpm2.HashAlgorithmSHA256, s.authKey, []byte("lockout"), s.sign)
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().DictionaryAttackLockReset(s.TPM().LockoutHandleContext(), session), IsNil)
+}
+
+func (s *hierarchyPolicySuite) TestSetOwnerAuthPolicyAndUseSignedSession(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+
+	policy, err := ComputeSignedHierarchyAuthPolicy(tpm2.HashAlgorithmSHA256, s.authKey, nil)
+	c.Assert(err, IsNil)
+	s.setPolicy(c, &HierarchyAuthPolicies{Owner: policy})
+
+	// Discard the auth value so that the hierarchy can only be authorized
+	// with the policy.
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	session, err := s.TPM().StartSignedHierarchyAuthPolicySession(tpm2.HashAlgorithmSHA256, s.authKey, nil, s.sign)
+	c.Assert(err, IsNil)
+
+	pub := tpm2.NVPublic{
+		Index:   0x0181ff00,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := s.TPM().NVDefineSpace(s.TPM().OwnerHandleContext(), nil, &pub, session)
+	c.Assert(err, IsNil)
+
+	s.TPM().OwnerHandleContext().SetAuthValue([]byte("1234"))
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+}
+
+func (s *hierarchyPolicySuite) TestSetHierarchyAuthPoliciesAuthFail(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleEndorsement, []byte("1234"))
+	s.TPM().EndorsementHandleContext().SetAuthValue(nil)
+
+	policy, err := ComputeSignedHierarchyAuthPolicy(tpm2.HashAlgorithmSHA256, s.authKey, nil)
+	c.Assert(err, IsNil)
+	err = s.TPM().SetHierarchyAuthPolicies(&HierarchyAuthPolicies{Endorsement: policy})
+	c.Check(err, Equals, AuthFailError{tpm2.HandleEndorsement})
+}
+
+func (s *hierarchyPolicySuite) TestSetHierarchyAuthPoliciesInvalidDigest(c *C) {
+	err := s.TPM().SetHierarchyAuthPolicies(&HierarchyAuthPolicies{
+		Owner: &HierarchyAuthPolicy{Alg: tpm2.HashAlgorithmSHA256, Digest: make([]byte, 20)}})
+	c.Check(err, ErrorMatches, `invalid digest size for hierarchy TPM_RH_OWNER`)
+}
+
+func (s *hierarchyPolicySuite) TestStartSignedHierarchyAuthPolicySessionSignError(c *C) {
+	_, err := s.TPM().StartSignedHierarchyAuthPolicySession(tpm2.HashAlgorithmSHA256, s.authKey, nil, func(tpm2.Nonce, tpm2.Nonce) (*tpm2.Signature, error) {
+		return nil, errors.New("some error")
+	})
+	c.Check(err, ErrorMatches, `cannot sign authorization: some error`)
+}
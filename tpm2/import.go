@@ -0,0 +1,84 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// NeedsImport indicates whether this sealed key object was created by
+// NewExternalTPMProtectedKey and has not been imported in to the storage
+// hierarchy of the target TPM with ImportSealedKey yet.
+func (k *SealedKeyData) NeedsImport() bool {
+	return len(k.data.ImportSymSeed()) > 0
+}
+
+// ImportSealedKey completes the import of a sealed key object created by
+// NewExternalTPMProtectedKey in to the storage hierarchy of the supplied TPM. This
+// is intended to be called on the target device, eg, on first boot, for keys that
+// were pre-provisioned without access to its TPM. Although these keys can be
+// unsealed without being imported first, the import is otherwise repeated on
+// every unseal.
+//
+// The import is performed with the storage root key persisted at the standard
+// handle (0x81000001). If this doesn't exist, a ErrTPMProvisioning error will be
+// returned. If the key was created for a different storage root key, a
+// ErrKeyNotBoundToTPM error will be returned. This doesn't reveal the sensitive
+// data in the sealed key object.
+//
+// On success, the supplied key data is updated with the imported sealed key object
+// and it must be persisted using secboot.KeyData.WriteAtomic. If the key has
+// already been imported or was not created by NewExternalTPMProtectedKey, this
+// function does nothing.
+func ImportSealedKey(tpm *Connection, key *secboot.KeyData) error {
+	skd, err := NewSealedKeyData(key)
+	if err != nil {
+		return err
+	}
+	if !skd.NeedsImport() {
+		return nil
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return ErrTPMProvisioning
+	case err != nil:
+		return xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+
+	err = skd.ensureImported(tpm.TPMContext, srk)
+	switch {
+	case isImportInvalidParamError(err):
+		return ErrKeyNotBoundToTPM
+	case err != nil:
+		return xerrors.Errorf("cannot import sealed key object: %w", err)
+	}
+
+	if err := key.MarshalAndUpdatePlatformHandle(skd); err != nil {
+		return xerrors.Errorf("cannot update TPM platform handle on KeyData: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type importSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *importSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *importSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&importSuite{})
+
+func (s *importSuite) srkPublic(c *C) *tpm2.Public {
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	pub, _, _, err := s.TPM().ReadPublic(srk)
+	c.Assert(err, IsNil)
+	return pub
+}
+
+func (s *importSuite) marshalKeyData(c *C, k *secboot.KeyData) []byte {
+	w := newMockKeyDataWriter()
+	c.Assert(k.WriteAtomic(w), IsNil)
+	return w.final.Bytes()
+}
+
+func (s *importSuite) TestImportSealedKey(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, primaryKey, unlockKey, err := NewExternalTPMProtectedKey(s.srkPublic(c), params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.NeedsImport(), testutil.IsTrue)
+
+	c.Check(ImportSealedKey(s.TPM(), k), IsNil)
+
+	skd, err = NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.NeedsImport(), testutil.IsFalse)
+	c.Check(skd.Data().ImportSymSeed(), HasLen, 0)
+	c.Check(skd.Validate(s.TPM().TPMContext, primaryKey), IsNil)
+
+	unlockKeyUnsealed, primaryKeyUnsealed, err := k.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(unlockKeyUnsealed, DeepEquals, unlockKey)
+	c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
+}
+
+func (s *importSuite) TestImportSealedKeyNotImportable(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.NeedsImport(), testutil.IsFalse)
+
+	expected := s.marshalKeyData(c, k)
+	c.Check(ImportSealedKey(s.TPM(), k), IsNil)
+	c.Check(s.marshalKeyData(c, k), DeepEquals, expected)
+}
+
+func (s *importSuite) TestImportSealedKeyDifferentTPM(c *C) {
+	// Protect a key for a storage key that isn't in this TPM.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	otherPub := util.NewExternalRSAPublicKey(tpm2.HashAlgorithmSHA256, templates.KeyUsageDecrypt, nil, &key.PublicKey)
+	otherPub.Attrs |= tpm2.AttrRestricted
+	otherPub.Params.RSADetail.Symmetric = tpm2.SymDefObject{
+		Algorithm: tpm2.SymObjectAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}}
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewExternalTPMProtectedKey(otherPub, params)
+	c.Assert(err, IsNil)
+
+	c.Check(ImportSealedKey(s.TPM(), k), Equals, ErrKeyNotBoundToTPM)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.NeedsImport(), testutil.IsTrue)
+}
+
+func (s *importSuite) TestImportSealedKeyNoSRK(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewExternalTPMProtectedKey(s.srkPublic(c), params)
+	c.Assert(err, IsNil)
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+
+	c.Check(ImportSealedKey(s.TPM(), k), Equals, ErrTPMProvisioning)
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/objectutil"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// KeyBinding describes the relationship between a sealed key and the storage
+// root key of a TPM, as established by VerifyKeyBinding.
+type KeyBinding struct {
+	SRKName          tpm2.Name // The name of the storage root key
+	SRKQualifiedName tpm2.Name // The qualified name of the storage root key
+	KeyName          tpm2.Name // The name of the sealed key object
+	KeyQualifiedName tpm2.Name // The qualified name of the sealed key object
+}
+
+func (k *sealedKeyDataBase) verifyBinding(tpm *tpm2.TPMContext) (*KeyBinding, error) {
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+
+	// Establish that the SRK is a primary key in the storage hierarchy.
+	_, srkName, srkQN, err := tpm.ReadPublic(srk)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of SRK: %w", err)
+	}
+	expectedSrkQN, err := objectutil.ComputeQualifiedNameInHierarchy(srkName, tpm2.HandleOwner)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute qualified name of SRK: %w", err)
+	}
+	if !bytes.Equal(srkQN, expectedSrkQN) {
+		return nil, ErrTPMProvisioning
+	}
+
+	pub := k.data.Public()
+	if !pub.NameAlg.Available() {
+		return nil, keyDataError{errors.New("sealed key object has an unsupported name algorithm")}
+	}
+
+	// Loading the sealed key object proves that its private area is protected
+	// by the SRK's seed, as the TPM checks its outer integrity HMAC. Importable
+	// objects that haven't been imported yet are imported first, which also
+	// requires the SRK's private key. Neither of these reveals the sensitive
+	// data, and the key data isn't modified.
+	priv := k.data.Private()
+	if len(k.data.ImportSymSeed()) > 0 {
+		priv, err = tpm.Import(srk, nil, pub, priv, k.data.ImportSymSeed(), nil, nil)
+		switch {
+		case isImportInvalidParamError(err):
+			return nil, ErrKeyNotBoundToTPM
+		case err != nil:
+			return nil, xerrors.Errorf("cannot import sealed key object: %w", err)
+		}
+	}
+
+	key, err := tpm.Load(srk, priv, pub, nil)
+	switch {
+	case isLoadInvalidParamError(err):
+		return nil, ErrKeyNotBoundToTPM
+	case err != nil:
+		return nil, xerrors.Errorf("cannot load sealed key object: %w", err)
+	}
+	defer tpm.FlushContext(key)
+
+	_, keyName, keyQN, err := tpm.ReadPublic(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of sealed key object: %w", err)
+	}
+	if !bytes.Equal(keyName, pub.Name()) {
+		return nil, errors.New("TPM returned an unexpected name for the sealed key object")
+	}
+	expectedKeyQN, err := objectutil.ComputeQualifiedNameInHierarchy(keyName, tpm2.HandleOwner, srkName)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute qualified name of sealed key object: %w", err)
+	}
+	if !bytes.Equal(keyQN, expectedKeyQN) {
+		return nil, errors.New("TPM returned an unexpected qualified name for the sealed key object")
+	}
+
+	return &KeyBinding{
+		SRKName:          srkName,
+		SRKQualifiedName: srkQN,
+		KeyName:          keyName,
+		KeyQualifiedName: keyQN}, nil
+}
+
+// VerifyKeyBinding verifies that the supplied key data was created by this
+// package for the storage root key of the supplied TPM, without unsealing it
+// or requiring any authorization. This can be used to check whether a disk
+// still belongs with a particular device, eg, when refurbishing devices.
+//
+// The key's private area is loaded into the TPM under the storage root key,
+// which only succeeds if it was protected with the storage root key's seed.
+// The qualified names of the storage root key and the sealed key object are
+// then checked to establish that the storage root key is a primary key in the
+// storage hierarchy and that the sealed key object is its child. Note that the
+// creation ticket is not retained in the key data, so this does not establish
+// the PCR values at the time of creation.
+//
+// If the key is not bound to the TPM, including where the TPM has been cleared
+// since the key was created, a ErrKeyNotBoundToTPM error is returned. If the TPM
+// does not have a storage root key, a ErrTPMProvisioning error is returned.
+func VerifyKeyBinding(tpm *Connection, kd *secboot.KeyData) (*KeyBinding, error) {
+	k, err := NewSealedKeyData(kd)
+	if err != nil {
+		return nil, err
+	}
+	return k.verifyBinding(tpm.TPMContext)
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/objectutil"
+	"github.com/canonical/go-tpm2/templates"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type keyBindingSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *keyBindingSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *keyBindingSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&keyBindingSuite{})
+
+func (s *keyBindingSuite) srkPublic(c *C) (*tpm2.Public, tpm2.Name) {
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	pub, name, _, err := s.TPM().ReadPublic(srk)
+	c.Assert(err, IsNil)
+	return pub, name
+}
+
+func (s *keyBindingSuite) checkBinding(c *C, binding *KeyBinding) {
+	_, srkName := s.srkPublic(c)
+	c.Check(binding.SRKName, DeepEquals, srkName)
+
+	expectedSrkQN, err := objectutil.ComputeQualifiedNameInHierarchy(srkName, tpm2.HandleOwner)
+	c.Check(err, IsNil)
+	c.Check(binding.SRKQualifiedName, DeepEquals, expectedSrkQN)
+
+	expectedKeyQN, err := objectutil.ComputeQualifiedName(binding.KeyName, expectedSrkQN)
+	c.Check(err, IsNil)
+	c.Check(binding.KeyQualifiedName, DeepEquals, expectedKeyQN)
+}
+
+func (s *keyBindingSuite) TestVerifyKeyBinding(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	binding, err := VerifyKeyBinding(s.TPM(), k)
+	c.Assert(err, IsNil)
+	s.checkBinding(c, binding)
+}
+
+func (s *keyBindingSuite) TestVerifyKeyBindingImportable(c *C) {
+	srkPub, _ := s.srkPublic(c)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewExternalTPMProtectedKey(srkPub, params)
+	c.Assert(err, IsNil)
+
+	binding, err := VerifyKeyBinding(s.TPM(), k)
+	c.Assert(err, IsNil)
+	s.checkBinding(c, binding)
+}
+
+func (s *keyBindingSuite) TestVerifyKeyBindingDifferentTPM(c *C) {
+	// Protect a key for a storage key that isn't in this TPM.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	otherPub := util.NewExternalRSAPublicKey(tpm2.HashAlgorithmSHA256, templates.KeyUsageDecrypt, nil, &key.PublicKey)
+	otherPub.Attrs |= tpm2.AttrRestricted
+	otherPub.Params.RSADetail.Symmetric = tpm2.SymDefObject{
+		Algorithm: tpm2.SymObjectAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}}
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewExternalTPMProtectedKey(otherPub, params)
+	c.Assert(err, IsNil)
+
+	_, err = VerifyKeyBinding(s.TPM(), k)
+	c.Check(err, Equals, ErrKeyNotBoundToTPM)
+}
+
+func (s *keyBindingSuite) TestVerifyKeyBindingNoSRK(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+
+	_, err = VerifyKeyBinding(s.TPM(), k)
+	c.Check(err, Equals, ErrTPMProvisioning)
+}
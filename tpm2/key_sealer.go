@@ -25,8 +25,19 @@ import (
 	"github.com/canonical/go-tpm2/util"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
 )
 
+// noDAAttr returns the object attribute that exempts a sealed object from
+// dictionary attack protection if noDA is true.
+func noDAAttr(noDA bool) tpm2.ObjectAttributes {
+	if noDA {
+		return tpm2.AttrNoDA
+	}
+	return 0
+}
+
 // keySealer is an abstraction for creating a sealed key object
 type keySealer interface {
 	// CreateSealedObject creates a new sealed object containing the supplied data
@@ -39,7 +50,39 @@ type keySealer interface {
 // sealedObjectKeySealer is an implementation of keySealer that seals data to
 // to the storage primary key of the associated TPM.
 type sealedObjectKeySealer struct {
-	tpm *Connection
+	tpm  *Connection
+	srk  tpm2.ResourceContext // The SRK provisioned by a previous call, if any
+	noDA bool                 // Exempt the sealed object from dictionary attack protection
+}
+
+// paramEncryptionSession returns a session for encrypting the parameters of the
+// command that creates the sealed object, and a function to release it. If the
+// connection uses a HMAC session supplied by the caller, that is used instead of
+// starting a new session salted with the SRK.
+func (s *sealedObjectKeySealer) paramEncryptionSession(srk tpm2.ResourceContext) (tpm2.SessionContext, func(), error) {
+	if s.tpm.externalHmac {
+		return s.tpm.HmacSession().IncludeAttrs(tpm2.AttrCommandEncrypt), func() {}, nil
+	}
+
+	// Begin session for parameter encryption, salted with the SRK.
+	symmetric := &tpm2.SymDef{
+		Algorithm: tpm2.SymAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
+	}
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := s.tpm.StartAuthSession(srk, nil, tpm2.SessionTypeHMAC, symmetric, defaultSessionHashAlgorithm, nil)
+	if err != nil {
+		releaseSession()
+		return nil, nil, err
+	}
+	return session.WithAttrs(tpm2.AttrCommandEncrypt), func() {
+		s.tpm.FlushContext(session)
+		releaseSession()
+	}, nil
 }
 
 func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.HashAlgorithmId, policy tpm2.Digest) (tpm2.Private, *tpm2.Public, tpm2.EncryptedSecret, error) {
@@ -49,29 +92,30 @@ func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.Has
 	// requires knowledge of the owner hierarchy authorization anyway. This way, we know that the
 	// primary key we seal to is good and future calls to ProvisionTPM won't provision an object
 	// that cannot unseal the key we protect.
+	//
+	// When creating more than one key, the SRK provisioned for the first key is reused
+	// for subsequent keys.
 	srk := s.tpm.provisionedSrk
+	if srk == nil {
+		srk = s.srk
+	}
 	if srk == nil {
 		var err error
-		srk, err = provisionStoragePrimaryKey(s.tpm.TPMContext, s.tpm.HmacSession())
+		srk, err = provisionStoragePrimaryKey(s.tpm.TPMContext, s.tpm.HmacSession(), s.tpm.nvReadEncryptAttrs())
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return nil, nil, nil, AuthFailError{tpm2.HandleOwner}
 		case err != nil:
 			return nil, nil, nil, xerrors.Errorf("cannot provision storage root key: %w", err)
 		}
+		s.srk = srk
 	}
 
-	// Begin session for parameter encryption, salted with the SRK.
-	symmetric := &tpm2.SymDef{
-		Algorithm: tpm2.SymAlgorithmAES,
-		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
-		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
-	}
-	session, err := s.tpm.StartAuthSession(srk, nil, tpm2.SessionTypeHMAC, symmetric, defaultSessionHashAlgorithm, nil)
+	session, releaseSession, err := s.paramEncryptionSession(srk)
 	if err != nil {
 		return nil, nil, nil, xerrors.Errorf("cannot create session: %w", err)
 	}
-	defer s.tpm.FlushContext(session)
+	defer releaseSession()
 
 	// Create the sensitive data
 	sensitive := tpm2.SensitiveCreate{Data: data}
@@ -79,19 +123,78 @@ func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.Has
 	// Define the template
 	template := templates.NewSealedObject(nameAlg)
 	template.Attrs &^= tpm2.AttrUserWithAuth
+	template.Attrs |= noDAAttr(s.noDA)
 	template.AuthPolicy = policy
 
 	// Now create the sealed key object. The command is integrity protected so if the object
 	// at the handle we expect the SRK to reside at has a different name (ie, if we're
 	// connected via a resource manager and somebody swapped the object with another one), this
 	// command will fail.
-	priv, pub, _, _, _, err := s.tpm.Create(srk, &sensitive, template, nil, nil, session.WithAttrs(tpm2.AttrCommandEncrypt))
+	priv, pub, _, _, _, err := s.tpm.Create(srk, &sensitive, template, nil, nil, session)
 	if err != nil {
 		return nil, nil, nil, xerrors.Errorf("cannot create sealed object: %w", err)
 	}
 	return priv, pub, nil, err
 }
 
+// nullHierarchyPrimaryTemplate returns the template for the ephemeral primary
+// key in the null hierarchy that keys created in dev mode are sealed to (see
+// ProtectKeyParams.NullHierarchyDevMode). An ECC key is used because it is
+// much faster to create than a RSA key, as this is recreated each time such a
+// key is unsealed.
+func nullHierarchyPrimaryTemplate() *tpm2.Public {
+	return templates.NewECCStorageKeyWithDefaults()
+}
+
+// nullHierarchyKeySealer is an implementation of keySealer that seals data to
+// an ephemeral primary key in the null hierarchy of the associated TPM. The null
+// hierarchy's seed changes on every TPM reset, so the sealed object can't be
+// loaded after the next TPM reset. This doesn't require the authorization value
+// for or make any changes to the storage hierarchy, which makes it suitable for
+// exercising the code paths in development and CI environments.
+type nullHierarchyKeySealer struct {
+	tpm  *Connection
+	noDA bool // Exempt the sealed object from dictionary attack protection
+}
+
+func (s *nullHierarchyKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.HashAlgorithmId, policy tpm2.Digest) (tpm2.Private, *tpm2.Public, tpm2.EncryptedSecret, error) {
+	primary, _, _, _, _, err := s.tpm.CreatePrimary(s.tpm.NullHandleContext(), nil, nullHierarchyPrimaryTemplate(), nil, nil, nil)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create primary key in null hierarchy: %w", err)
+	}
+	defer s.tpm.FlushContext(primary)
+
+	// Begin session for parameter encryption, salted with the primary key.
+	symmetric := &tpm2.SymDef{
+		Algorithm: tpm2.SymAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
+	}
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create session: %w", err)
+	}
+	defer releaseSession()
+	session, err := s.tpm.StartAuthSession(primary, nil, tpm2.SessionTypeHMAC, symmetric, defaultSessionHashAlgorithm, nil)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create session: %w", err)
+	}
+	defer s.tpm.FlushContext(session)
+
+	sensitive := tpm2.SensitiveCreate{Data: data}
+
+	template := templates.NewSealedObject(nameAlg)
+	template.Attrs &^= tpm2.AttrUserWithAuth
+	template.Attrs |= noDAAttr(s.noDA)
+	template.AuthPolicy = policy
+
+	priv, pub, _, _, _, err := s.tpm.Create(primary, &sensitive, template, nil, nil, session.WithAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create sealed object: %w", err)
+	}
+	return priv, pub, nil, nil
+}
+
 // importableObjectKeySealer is an implementation of keySealer that seals data to
 // an object that can be imported to the hierarchy protected by the specified storage
 // key, which should correspond to the TPM's storage primary key. This is suitable in
@@ -99,11 +202,13 @@ func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.Has
 // of its storage primary key.
 type importableObjectKeySealer struct {
 	tpmKey *tpm2.Public
+	noDA   bool // Exempt the sealed object from dictionary attack protection
 }
 
 func (s *importableObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.HashAlgorithmId, policy tpm2.Digest) (tpm2.Private, *tpm2.Public, tpm2.EncryptedSecret, error) {
 	pub, sensitive := util.NewExternalSealedObject(nameAlg, nil, data)
 	pub.Attrs &^= tpm2.AttrUserWithAuth
+	pub.Attrs |= noDAAttr(s.noDA)
 	pub.AuthPolicy = policy
 
 	// Now create the importable sealed key object (duplication object).
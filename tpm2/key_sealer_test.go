@@ -60,10 +60,11 @@ type testCreateSealedObjectData struct {
 	nameAlg      tpm2.HashAlgorithmId
 	policyDigest tpm2.Digest
 	session      tpm2.SessionContext
+	noDA         bool
 }
 
 func (s *sealedObjectKeySealerSuite) testCreateSealedObject(c *C, data *testCreateSealedObjectData) {
-	sealer := NewSealedObjectKeySealer(s.TPM())
+	sealer := NewSealedObjectKeySealer(s.TPM(), data.noDA)
 
 	priv, pub, importSymSeed, err := sealer.CreateSealedObject(data.data, data.nameAlg, data.policyDigest)
 	c.Assert(err, IsNil)
@@ -71,7 +72,11 @@ func (s *sealedObjectKeySealerSuite) testCreateSealedObject(c *C, data *testCrea
 
 	c.Check(pub.Type, Equals, tpm2.ObjectTypeKeyedHash)
 	c.Check(pub.NameAlg, Equals, data.nameAlg)
-	c.Check(pub.Attrs, Equals, tpm2.AttrFixedParent|tpm2.AttrFixedTPM)
+	expectedAttrs := tpm2.AttrFixedParent | tpm2.AttrFixedTPM
+	if data.noDA {
+		expectedAttrs |= tpm2.AttrNoDA
+	}
+	c.Check(pub.Attrs, Equals, expectedAttrs)
 	c.Check(pub.AuthPolicy, DeepEquals, data.policyDigest)
 	c.Check(pub.Params, DeepEquals,
 		&tpm2.PublicParamsU{
@@ -99,6 +104,15 @@ func (s *sealedObjectKeySealerSuite) TestCreateSealedObject(c *C) {
 		session:      s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)})
 }
 
+func (s *sealedObjectKeySealerSuite) TestCreateSealedObjectNoDA(c *C) {
+	s.testCreateSealedObject(c, &testCreateSealedObjectData{
+		data:         []byte("foo"),
+		nameAlg:      tpm2.HashAlgorithmSHA256,
+		policyDigest: make([]byte, 32),
+		session:      s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256),
+		noDA:         true})
+}
+
 func (s *sealedObjectKeySealerSuite) TestCreateSealedObjectWithNewConnection(c *C) {
 	// createSealedObject behaves slightly different if called immediately after
 	// EnsureProvisioned with the same Connection
@@ -165,14 +179,18 @@ func (s *importableObjectKeySealerSuite) testCreateSealedObject(c *C, data *test
 
 	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&key.PublicKey)
 
-	sealer := NewImportableObjectKeySealer(srk)
+	sealer := NewImportableObjectKeySealer(srk, data.noDA)
 
 	priv, pub, importSymSeed, err := sealer.CreateSealedObject(data.data, data.nameAlg, data.policyDigest)
 	c.Assert(err, IsNil)
 
 	c.Check(pub.Type, Equals, tpm2.ObjectTypeKeyedHash)
 	c.Check(pub.NameAlg, Equals, data.nameAlg)
-	c.Check(pub.Attrs, Equals, tpm2.ObjectAttributes(0))
+	expectedAttrs := tpm2.ObjectAttributes(0)
+	if data.noDA {
+		expectedAttrs |= tpm2.AttrNoDA
+	}
+	c.Check(pub.Attrs, Equals, expectedAttrs)
 	c.Check(pub.AuthPolicy, DeepEquals, data.policyDigest)
 	c.Check(pub.Params, DeepEquals,
 		&tpm2.PublicParamsU{
@@ -194,6 +212,14 @@ func (s *importableObjectKeySealerSuite) TestCreateSealedObject(c *C) {
 		policyDigest: make([]byte, 32)})
 }
 
+func (s *importableObjectKeySealerSuite) TestCreateSealedObjectNoDA(c *C) {
+	s.testCreateSealedObject(c, &testCreateSealedObjectData{
+		data:         []byte("foo"),
+		nameAlg:      tpm2.HashAlgorithmSHA256,
+		policyDigest: make([]byte, 32),
+		noDA:         true})
+}
+
 func (s *importableObjectKeySealerSuite) TestCreateSealedObjectDifferentData(c *C) {
 	s.testCreateSealedObject(c, &testCreateSealedObjectData{
 		data:         []byte("bar"),
@@ -21,9 +21,9 @@ package tpm2
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 
 	"github.com/canonical/go-tpm2"
@@ -35,6 +35,8 @@ import (
 	"github.com/snapcore/secboot/internal/tcg"
 )
 
+const sealedKeyObjectArtifact = "sealed key object"
+
 type keyDataError struct {
 	err error
 }
@@ -99,9 +101,24 @@ func readKeyData(r io.Reader, version uint32) (keyData, error) {
 		return readKeyDataV2(r)
 	case 3:
 		return readKeyDataV3(r)
+	case 4:
+		return readKeyDataV4(r)
 	default:
-		return nil, fmt.Errorf("unexpected version number (%d)", version)
+		// This is a newer version, although it's not known which
+		// version of secboot is required to read it.
+		return nil, &secboot.ArtifactVersionError{
+			Artifact:         sealedKeyObjectArtifact,
+			MinReaderVersion: secboot.ArtifactFormatVersion + 1}
+	}
+}
+
+// keyDataMinReaderVersion returns the minimum secboot.ArtifactFormatVersion
+// required to read key data with the specified version.
+func keyDataMinReaderVersion(version uint32) int {
+	if version >= 4 {
+		return 2
 	}
+	return 1
 }
 
 func newKeyData(keyPrivate tpm2.Private, keyPublic *tpm2.Public, importSymSeed tpm2.EncryptedSecret, policy keyDataPolicy) (keyData, error) {
@@ -150,6 +167,14 @@ func (k *sealedKeyDataBase) ensureImported(tpm *tpm2.TPMContext, parent tpm2.Res
 	return nil
 }
 
+// nullHierarchyDevMode indicates whether the TPM sealed object associated with this
+// keyData was created with an ephemeral null hierarchy primary key as its parent (see
+// ProtectKeyParams.NullHierarchyDevMode).
+func (k *sealedKeyDataBase) nullHierarchyDevMode() bool {
+	d, ok := k.data.(*keyData_v3)
+	return ok && d.PolicyData.StaticData.NullHierarchyDevMode
+}
+
 // load loads the TPM sealed object associated with this keyData in to the storage hierarchy of the TPM, and returns the newly
 // created tpm2.ResourceContext.
 func (k *sealedKeyDataBase) load(tpm *tpm2.TPMContext, parent tpm2.ResourceContext) (tpm2.ResourceContext, error) {
@@ -169,7 +194,7 @@ func (k *sealedKeyDataBase) validateData(tpm *tpm2.TPMContext, role string) (*tp
 	if k.data.Public().Type != sealedKeyTemplate.Type {
 		return nil, keyDataError{errors.New("sealed key object has the wrong type")}
 	}
-	if k.data.Public().Attrs&^(tpm2.AttrFixedTPM|tpm2.AttrFixedParent) != sealedKeyTemplate.Attrs {
+	if k.data.Public().Attrs&^(tpm2.AttrFixedTPM|tpm2.AttrFixedParent|tpm2.AttrNoDA) != sealedKeyTemplate.Attrs {
 		return nil, keyDataError{errors.New("sealed key object has the wrong attributes")}
 	}
 
@@ -190,7 +215,7 @@ func (k *sealedKeyDataBase) validateData(tpm *tpm2.TPMContext, role string) (*tp
 	tpm.FlushContext(keyContext)
 
 	// Version specific validation.
-	pcrPolicyCounter, err := k.data.ValidateData(tpm, []byte(role))
+	pcrPolicyCounter, err := k.data.ValidateData(tpm, secboot.RoleDerivationLabel(role))
 	if err != nil {
 		return nil, err
 	}
@@ -216,6 +241,53 @@ func (k *sealedKeyDataBase) validateData(tpm *tpm2.TPMContext, role string) (*tp
 type SealedKeyData struct {
 	sealedKeyDataBase
 	k *secboot.KeyData
+
+	// paddingBucketSize is the size that the serialized data is padded to
+	// a multiple of, or zero if it isn't padded (see padSealedKeyData).
+	paddingBucketSize uint32
+}
+
+// padSealedKeyData pads the supplied serialized sealed key data so that its size
+// is a multiple of bucketSize, in order to avoid leaking information about the
+// complexity of the PCR policy. The padding consists of zero
+// bytes followed by the bucket size encoded as a big-endian uint32, so that it
+// can be preserved when the data is serialized again.
+func padSealedKeyData(data []byte, bucketSize uint32) []byte {
+	if bucketSize == 0 {
+		return data
+	}
+
+	n := uint64(len(data)) + 4
+	n += (uint64(bucketSize) - (n % uint64(bucketSize))) % uint64(bucketSize)
+
+	padded := make([]byte, n)
+	copy(padded, data)
+	binary.BigEndian.PutUint32(padded[n-4:], bucketSize)
+	return padded
+}
+
+// unpadSealedKeyData validates the supplied padding, which is whatever follows the
+// serialized sealed key data, and returns the bucket size that was used to
+// create it. The total size of the padded data is supplied via size.
+func unpadSealedKeyData(padding []byte, size int) (bucketSize uint32, err error) {
+	if len(padding) == 0 {
+		return 0, nil
+	}
+	if len(padding) < 4 {
+		return 0, errors.New("padding too short")
+	}
+
+	bucketSize = binary.BigEndian.Uint32(padding[len(padding)-4:])
+	if bucketSize == 0 || size%int(bucketSize) != 0 || len(padding) > int(bucketSize)+3 {
+		return 0, errors.New("invalid padding size")
+	}
+	for _, b := range padding[:len(padding)-4] {
+		if b != 0 {
+			return 0, errors.New("invalid padding bytes")
+		}
+	}
+
+	return bucketSize, nil
 }
 
 // NewSealedKeyData returns a SealedKeyData from the supplied secboot.KeyData
@@ -223,6 +295,10 @@ type SealedKeyData struct {
 func NewSealedKeyData(k *secboot.KeyData) (*SealedKeyData, error) {
 	var skd *SealedKeyData
 	if err := k.UnmarshalPlatformHandle(&skd); err != nil {
+		var verErr *secboot.ArtifactVersionError
+		if xerrors.As(err, &verErr) {
+			return nil, verErr
+		}
 		return nil, InvalidKeyDataError{err.Error()}
 	}
 	skd.k = k
@@ -241,6 +317,18 @@ func (k *SealedKeyData) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.Policy().PCRPolicyCounterHandle()
 }
 
+// DictionaryAttackProtected indicates whether failed authorization attempts for
+// this sealed key object are counted by the TPM's dictionary attack protection
+// logic (see ProtectKeyParams.DisableDictionaryAttackProtection).
+func (k *SealedKeyData) DictionaryAttackProtected() bool {
+	return k.data.Public().Attrs&tpm2.AttrNoDA == 0
+}
+
+// MinReaderVersion implements [secboot.VersionedPlatformHandle].
+func (k *SealedKeyData) MinReaderVersion() int {
+	return keyDataMinReaderVersion(k.data.Version())
+}
+
 func (k *SealedKeyData) MarshalJSON() ([]byte, error) {
 	w := new(bytes.Buffer)
 	if _, err := mu.MarshalToWriter(w, k.data.Version()); err != nil {
@@ -249,7 +337,7 @@ func (k *SealedKeyData) MarshalJSON() ([]byte, error) {
 	if err := k.data.Write(w); err != nil {
 		return nil, err
 	}
-	return json.Marshal(w.Bytes())
+	return json.Marshal(padSealedKeyData(w.Bytes(), k.paddingBucketSize))
 }
 
 func (k *SealedKeyData) UnmarshalJSON(data []byte) error {
@@ -270,6 +358,12 @@ func (k *SealedKeyData) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	bucketSize, err := unpadSealedKeyData(b[len(b)-r.Len():], len(b))
+	if err != nil {
+		return xerrors.Errorf("cannot decode padding: %w", err)
+	}
+
 	k.data = kd
+	k.paddingBucketSize = bucketSize
 	return nil
 }
@@ -31,6 +31,7 @@ import (
 	"github.com/canonical/go-tpm2/mu"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/sys"
+	"golang.org/x/xerrors"
 	"maze.io/x/crypto/afis"
 
 	"github.com/snapcore/secboot"
@@ -89,6 +90,10 @@ func ReadSealedKeyObject(r io.Reader) (*SealedKeyObject, error) {
 
 	data, err := readKeyData(r, version)
 	if err != nil {
+		var verErr *secboot.ArtifactVersionError
+		if xerrors.As(err, &verErr) {
+			return nil, verErr
+		}
 		return nil, InvalidKeyDataError{err.Error()}
 	}
 
@@ -120,6 +125,18 @@ func NewFileSealedKeyObjectReader(path string) (io.Reader, error) {
 	}
 	defer f.Close()
 
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileSealedKeyObjectReader(f, fi.Size())
+}
+
+// newFileSealedKeyObjectReader decodes the key file metadata from the supplied
+// reader, which contains size bytes. The size is used to reject headers that
+// describe more data than is actually available.
+func newFileSealedKeyObjectReader(f io.Reader, size int64) (io.Reader, error) {
 	// v0 files contain the following structure:
 	//  magic   uint32 // 0x55534b24
 	//  version uint32 // 0
@@ -164,12 +181,15 @@ func NewFileSealedKeyObjectReader(path string) (io.Reader, error) {
 		return nil, InvalidKeyDataError{fmt.Sprintf("cannot unmarshal AFIS header: %v", err)}
 	}
 
-	if afisHdr.Stripes == 0 {
+	if afisHdr.Stripes == 0 || afisHdr.Stripes > afisHdr.Size || afisHdr.Size%afisHdr.Stripes != 0 {
 		return nil, InvalidKeyDataError{"invalid number of stripes"}
 	}
 	if !afisHdr.HashAlg.Available() {
 		return nil, InvalidKeyDataError{"digest algorithm unavailable"}
 	}
+	if int64(afisHdr.Size) > size {
+		return nil, InvalidKeyDataError{"striped data size exceeds the file size"}
+	}
 
 	data := make([]byte, afisHdr.Size)
 	if _, err := io.ReadFull(f, data); err != nil {
@@ -21,9 +21,11 @@ package tpm2_test
 
 import (
 	"math/rand"
+	"os"
 	"path/filepath"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
 
 	"golang.org/x/sys/unix"
 
@@ -43,7 +45,10 @@ func (s *keydataLegacySuite) SetUpSuite(c *C) {
 		tpm2test.TPMFeatureNV
 }
 
+type keydataLegacySuiteNoTPM struct{}
+
 var _ = Suite(&keydataLegacySuite{})
+var _ = Suite(&keydataLegacySuiteNoTPM{})
 
 func (s *keydataLegacySuite) TestFileReadAndWrite(c *C) {
 	key := make([]byte, 32)
@@ -94,3 +99,25 @@ func (s *keydataLegacySuite) TestReadAndWrite(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(k.Validate(s.TPM().TPMContext, authPrivateKey), IsNil)
 }
+
+func (s *keydataLegacySuiteNoTPM) writeStripedFile(c *C, stripes uint32, size uint32, data []byte) string {
+	path := filepath.Join(c.MkDir(), "keydata")
+	b, err := mu.MarshalToBytes(uint32(0x55534b24), uint32(2), stripes, tpm2.HashAlgorithmSHA256, size)
+	c.Assert(err, IsNil)
+	c.Assert(os.WriteFile(path, append(b, data...), 0600), IsNil)
+	return path
+}
+
+func (s *keydataLegacySuiteNoTPM) TestNewFileSealedKeyObjectReaderSizeTooLarge(c *C) {
+	path := s.writeStripedFile(c, 1, 0xffffffff, make([]byte, 32))
+	_, err := NewFileSealedKeyObjectReader(path)
+	c.Check(err, ErrorMatches, `invalid key data: striped data size exceeds the file size`)
+	c.Check(err, FitsTypeOf, InvalidKeyDataError{})
+}
+
+func (s *keydataLegacySuiteNoTPM) TestNewFileSealedKeyObjectReaderTooManyStripes(c *C) {
+	path := s.writeStripedFile(c, 64, 32, make([]byte, 32))
+	_, err := NewFileSealedKeyObjectReader(path)
+	c.Check(err, ErrorMatches, `invalid key data: invalid number of stripes`)
+	c.Check(err, FitsTypeOf, InvalidKeyDataError{})
+}
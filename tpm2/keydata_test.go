@@ -21,10 +21,12 @@ package tpm2_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
 
 	. "gopkg.in/check.v1"
 
@@ -116,3 +118,265 @@ func (s *keydataSuiteNoTPM) TestNewKeyDataV3(c *C) {
 	c.Check(data.ImportSymSeed(), DeepEquals, importSymSeed)
 	c.Check(data.Policy(), Equals, policy)
 }
+
+func (s *keydataSuiteNoTPM) newKeyDataRequireEndorsementAuth(c *C) KeyData {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, false, true, nil)
+	c.Assert(err, IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(tpm2.Private{1, 2, 3, 4}, pub, nil, policy)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *keydataSuiteNoTPM) TestKeyDataRequireEndorsementAuthIsV4(c *C) {
+	data := s.newKeyDataRequireEndorsementAuth(c)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.RequireEndorsementAuth, testutil.IsTrue)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *keydataSuiteNoTPM) TestReadKeyDataV4NoV4Features(c *C) {
+	data := s.newKeyDataRequireEndorsementAuth(c).(*KeyData_v3).AsV4()
+	data.PolicyData.StaticData.RequireEndorsementAuth = false
+
+	b, err := mu.MarshalToBytes(data)
+	c.Assert(err, IsNil)
+
+	_, err = ReadKeyDataV4(bytes.NewReader(b))
+	c.Check(err, ErrorMatches, `version 4 key data does not use any version 4 features`)
+}
+
+func (s *keydataSuiteNoTPM) newKeyDataExternalAuth(c *C) KeyData {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	nvPub := &tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthRead | tpm2.AttrNVAuthWrite | tpm2.AttrNVWritten),
+		Size:    8}
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, false, false, nvPub.Name())
+	c.Assert(err, IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(tpm2.Private{1, 2, 3, 4}, pub, nil, policy)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *keydataSuiteNoTPM) TestKeyDataExternalAuthIsV4(c *C) {
+	data := s.newKeyDataExternalAuth(c)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.ExternalAuthName, DeepEquals, data.Policy().(*KeyDataPolicy_v3).StaticData.ExternalAuthName)
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.NVGeneration, IsNil)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *keydataSuiteNoTPM) newKeyDataPCRPolicyNVIndex(c *C) KeyData {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	nvPub := &tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       34}
+
+	policy, policyDigest, err := NewKeyDataPolicyWithPCRPolicyNVIndex(tpm2.HashAlgorithmSHA256, authKey, "", nvPub, false, false, nil)
+	c.Assert(err, IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(tpm2.Private{1, 2, 3, 4}, pub, nil, policy)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *keydataSuiteNoTPM) TestKeyDataPCRPolicyNVIndexIsV4(c *C) {
+	data := s.newKeyDataPCRPolicyNVIndex(c)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.PCRPolicyNVIndexHandle, Equals, tpm2.Handle(0x01810000))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.PCRPolicyCounterHandle, Equals, tpm2.HandleNull)
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.NVGeneration, IsNil)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *keydataSuiteNoTPM) TestKeyDataNullHierarchyDevModeIsV4(c *C) {
+	data := s.newKeyDataPCRPolicyNVIndex(c)
+	data.Policy().(*KeyDataPolicy_v3).StaticData.NullHierarchyDevMode = true
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.NullHierarchyDevMode, testutil.IsTrue)
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.PCRPolicyNVIndexHandle, Equals, tpm2.Handle(0x01810000))
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *keydataSuiteNoTPM) TestPadSealedKeyData(c *C) {
+	for _, t := range []struct {
+		size     int
+		bucket   uint32
+		expected int
+	}{
+		{size: 100, bucket: 0, expected: 100},
+		{size: 100, bucket: 512, expected: 512},
+		{size: 508, bucket: 512, expected: 512},
+		{size: 509, bucket: 512, expected: 1024},
+		{size: 1500, bucket: 1024, expected: 2048},
+	} {
+		data := make([]byte, t.size)
+		for i := range data {
+			data[i] = 0xaa
+		}
+
+		padded := PadSealedKeyData(data, t.bucket)
+		c.Check(padded, HasLen, t.expected)
+		c.Check(padded[:t.size], DeepEquals, data)
+
+		bucket, err := UnpadSealedKeyData(padded[t.size:], len(padded))
+		c.Check(err, IsNil)
+		c.Check(bucket, Equals, t.bucket)
+	}
+}
+
+func (s *keydataSuiteNoTPM) TestUnpadSealedKeyDataInvalid(c *C) {
+	_, err := UnpadSealedKeyData([]byte{0, 0, 4}, 64)
+	c.Check(err, ErrorMatches, `padding too short`)
+
+	_, err = UnpadSealedKeyData([]byte{0, 0, 0, 0}, 64)
+	c.Check(err, ErrorMatches, `invalid padding size`)
+
+	_, err = UnpadSealedKeyData([]byte{0, 0, 0, 0, 0, 0, 0, 48}, 64)
+	c.Check(err, ErrorMatches, `invalid padding size`)
+
+	_, err = UnpadSealedKeyData(append(make([]byte, 64), 0, 0, 0, 64), 128)
+	c.Check(err, ErrorMatches, `invalid padding size`)
+
+	_, err = UnpadSealedKeyData([]byte{0, 1, 0, 0, 0, 0, 0, 64}, 64)
+	c.Check(err, ErrorMatches, `invalid padding bytes`)
+}
+
+func (s *keydataSuiteNoTPM) TestSealedKeyDataPaddingRoundTrip(c *C) {
+	data := s.newKeyDataRequireEndorsementAuth(c)
+
+	unpadded, err := json.Marshal(NewSealedKeyDataWithPadding(data, 0))
+	c.Assert(err, IsNil)
+
+	b, err := json.Marshal(NewSealedKeyDataWithPadding(data, 1024))
+	c.Assert(err, IsNil)
+
+	var raw []byte
+	c.Assert(json.Unmarshal(b, &raw), IsNil)
+	c.Check(raw, HasLen, 1024)
+
+	var skd *SealedKeyData
+	c.Assert(json.Unmarshal(b, &skd), IsNil)
+	c.Check(skd.PaddingBucketSize(), Equals, uint32(1024))
+	c.Check(skd.Version(), Equals, uint32(4))
+
+	// The padding is preserved when serialized again.
+	b2, err := json.Marshal(skd)
+	c.Check(err, IsNil)
+	c.Check(b2, DeepEquals, b)
+
+	// Unpadded data is still read correctly.
+	skd = nil
+	c.Assert(json.Unmarshal(unpadded, &skd), IsNil)
+	c.Check(skd.PaddingBucketSize(), Equals, uint32(0))
+}
+
+func (s *keydataSuiteNoTPM) TestSealedKeyDataMinReaderVersion(c *C) {
+	data := s.newKeyDataRequireEndorsementAuth(c)
+	c.Check(NewSealedKeyDataWithPadding(data, 0).MinReaderVersion(), Equals, 2)
+
+	data.Policy().(*KeyDataPolicy_v3).StaticData.RequireEndorsementAuth = false
+	c.Check(data.Version(), Equals, uint32(3))
+	c.Check(NewSealedKeyDataWithPadding(data, 0).MinReaderVersion(), Equals, 1)
+}
+
+func (s *keydataSuiteNoTPM) TestReadSealedKeyObjectNewerVersion(c *C) {
+	_, err := ReadSealedKeyObject(bytes.NewReader(mu.MustMarshalToBytes(uint32(5))))
+	c.Check(err, ErrorMatches, `sealed key object requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Check(err, testutil.ConvertibleTo, &secboot.ArtifactVersionError{})
+}
+
+func (s *keydataSuiteNoTPM) TestNewSealedKeyDataNewerVersion(c *C) {
+	handle, err := json.Marshal(mu.MustMarshalToBytes(uint32(5)))
+	c.Assert(err, IsNil)
+
+	kd, err := secboot.NewKeyData(&secboot.KeyParams{
+		Handle:           json.RawMessage(handle),
+		EncryptedPayload: []byte{1, 2, 3, 4},
+		PlatformName:     "tpm2"})
+	c.Assert(err, IsNil)
+
+	_, err = NewSealedKeyData(kd)
+	c.Check(err, ErrorMatches, `sealed key object requires newer secboot \(format version 3 is required, but this version only supports 2\)`)
+	c.Check(err, testutil.ConvertibleTo, &secboot.ArtifactVersionError{})
+}
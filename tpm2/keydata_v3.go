@@ -67,7 +67,25 @@ func readKeyDataV3(r io.Reader) (keyData, error) {
 	return d, nil
 }
 
+// requiresV4 indicates whether this key uses any of the optional policy
+// features that aren't supported by the version 3 format.
+func (d *keyData_v3) requiresV4() bool {
+	static := d.PolicyData.StaticData
+	pcrData := d.PolicyData.PCRData
+	return static.RequireEndorsementAuth ||
+		len(static.ExternalAuthName) > 0 ||
+		d.PolicyData.usesPCRPolicyNVIndex() ||
+		static.NullHierarchyDevMode ||
+		static.AlternatePCRBanks ||
+		(pcrData != nil && (pcrData.NVGeneration != nil || pcrData.ResetCount != nil))
+}
+
 func (d *keyData_v3) Version() uint32 {
+	if d.requiresV4() {
+		// Only use v4 for keys that require it, so that keys that
+		// don't can still be read by older versions.
+		return 4
+	}
 	return 3
 }
 
@@ -119,10 +137,25 @@ func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, role []byte) (tpm2.Resou
 		}
 	}
 
+	// Create a context for the PCR policy NV index, if there is one.
+	var pcrPolicyIndex tpm2.ResourceContext
+	if d.PolicyData.usesPCRPolicyNVIndex() {
+		pcrPolicyIndexHandle := d.PolicyData.StaticData.PCRPolicyNVIndexHandle
+		pcrPolicyIndex, err = tpm.CreateResourceContextFromTPM(pcrPolicyIndexHandle)
+		if err != nil {
+			if tpm2.IsResourceUnavailableError(err, pcrPolicyIndexHandle) {
+				return nil, keyDataError{errors.New("PCR policy NV index is unavailable")}
+			}
+			return nil, xerrors.Errorf("cannot create context for PCR policy NV index: %w", err)
+		}
+	}
+
 	// Create a context for the PCR policy counter.
 	pcrPolicyCounterHandle := d.PolicyData.StaticData.PCRPolicyCounterHandle
 	var pcrPolicyCounter tpm2.ResourceContext
 	switch {
+	case pcrPolicyIndex != nil && pcrPolicyCounterHandle != tpm2.HandleNull:
+		return nil, keyDataError{errors.New("PCR policy counter cannot be used with a PCR policy NV index")}
 	case pcrPolicyCounterHandle != tpm2.HandleNull && pcrPolicyCounterHandle.Type() != tpm2.HandleTypeNVIndex:
 		return nil, keyDataError{errors.New("PCR policy counter handle is invalid")}
 	case pcrPolicyCounterHandle != tpm2.HandleNull:
@@ -146,7 +179,19 @@ func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, role []byte) (tpm2.Resou
 		return nil, keyDataError{errors.New("cannot determine if static authorization policy matches sealed key object: algorithm unavailable")}
 	}
 	trial := util.ComputeAuthPolicy(d.KeyPublic.NameAlg)
-	trial.PolicyAuthorize(d.PolicyData.StaticData.PCRPolicyRef, authKeyName)
+	if pcrPolicyIndex != nil {
+		// The name of the PCR policy NV index binds it and the key
+		// that authorizes writes to it to the static policy.
+		trial.SetDigest(computePolicyAuthorizeNVDigest(d.KeyPublic.NameAlg, pcrPolicyIndex.Name()))
+	} else {
+		trial.PolicyAuthorize(d.PolicyData.StaticData.PCRPolicyRef, authKeyName)
+	}
+	if d.PolicyData.StaticData.RequireEndorsementAuth {
+		trial.PolicySecret(tpm2.MakeHandleName(tpm2.HandleEndorsement), nil)
+	}
+	if name := d.PolicyData.StaticData.ExternalAuthName; len(name) > 0 {
+		trial.PolicySecret(name, nil)
+	}
 	if d.PolicyData.StaticData.RequireAuthValue {
 		trial.PolicyAuthValue()
 	}
@@ -159,6 +204,11 @@ func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, role []byte) (tpm2.Resou
 }
 
 func (d *keyData_v3) Write(w io.Writer) error {
+	if d.Version() == 4 {
+		_, err := mu.MarshalToWriter(w, d.AsV4())
+		return err
+	}
+
 	_, err := mu.MarshalToWriter(w, d)
 	return err
 }
@@ -85,7 +85,7 @@ func (s *keyDataV3Suite) newMockKeyData(c *C, pcrPolicyCounterHandle tpm2.Handle
 
 	template := tpm2_testutil.NewSealedObjectTemplate()
 
-	policyData, policyDigest, err := NewKeyDataPolicy(template.NameAlg, authPublicKey, role, pcrPolicyCounterPub, requireAuthValue)
+	policyData, policyDigest, err := NewKeyDataPolicy(template.NameAlg, authPublicKey, role, pcrPolicyCounterPub, requireAuthValue, false, nil)
 	c.Assert(err, IsNil)
 	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
 
@@ -125,7 +125,7 @@ func (s *keyDataV3Suite) newMockImportableKeyData(c *C, role string, requireAuth
 
 	pub, sensitive := tpm2_testutil.NewExternalSealedObject(nil, secret)
 
-	policyData, policy, err := NewKeyDataPolicy(pub.NameAlg, authPublicKey, role, nil, requireAuthValue)
+	policyData, policy, err := NewKeyDataPolicy(pub.NameAlg, authPublicKey, role, nil, requireAuthValue, false, nil)
 	c.Assert(err, IsNil)
 	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
 
@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+)
+
+// staticPolicyData_v4 represents version 4 of the metadata for executing a
+// policy session that never changes for the life of a key. It is the same as
+// version 3 with the addition of fields for optional features.
+type staticPolicyData_v4 struct {
+	AuthPublicKey          *tpm2.Public
+	PCRPolicyRef           tpm2.Nonce
+	PCRPolicyCounterHandle tpm2.Handle
+	RequireAuthValue       bool
+	RequireEndorsementAuth bool
+	ExternalAuthName       tpm2.Name   // Empty if authorization from an external NV index or object is not required
+	PCRPolicyNVIndexHandle tpm2.Handle // Not a NV index handle if PCR policies are authorized by a signature
+	NullHierarchyDevMode   bool
+	AlternatePCRBanks      bool
+}
+
+// nvGenerationCheck_v4 represents version 4 of the NV generation check in the
+// PCR policy metadata.
+type nvGenerationCheck_v4 struct {
+	Handle  tpm2.Handle // Not a NV index handle if there is no NV generation check
+	Minimum uint64
+	Maximum uint64 // Zero if there is no maximum
+}
+
+// resetCountCheck_v4 represents version 4 of the reset count check in the
+// PCR policy metadata.
+type resetCountCheck_v4 struct {
+	Required bool
+	Maximum  uint32
+}
+
+// pcrPolicyData_v4 represents version 4 of the PCR policy metadata for
+// executing a policy session, and can be updated. It is the same as version 3
+// with the addition of fields for optional features.
+type pcrPolicyData_v4 struct {
+	Selection                 tpm2.PCRSelectionList
+	OrData                    policyOrData_v0
+	PolicySequence            uint64
+	NVGeneration              nvGenerationCheck_v4
+	ResetCount                resetCountCheck_v4
+	AuthorizedPolicy          tpm2.Digest
+	AuthorizedPolicySignature *tpm2.Signature
+}
+
+func newPcrPolicyDataV4(data *pcrPolicyData_v3) *pcrPolicyData_v4 {
+	nvGeneration := nvGenerationCheck_v4{Handle: tpm2.HandleNull}
+	if data.NVGeneration != nil {
+		nvGeneration = nvGenerationCheck_v4{
+			Handle:  data.NVGeneration.Handle,
+			Minimum: data.NVGeneration.Minimum,
+			Maximum: data.NVGeneration.Maximum}
+	}
+
+	var resetCount resetCountCheck_v4
+	if data.ResetCount != nil {
+		resetCount = resetCountCheck_v4{Required: true, Maximum: data.ResetCount.Maximum}
+	}
+
+	return &pcrPolicyData_v4{
+		Selection:                 data.Selection,
+		OrData:                    data.OrData,
+		PolicySequence:            data.PolicySequence,
+		NVGeneration:              nvGeneration,
+		ResetCount:                resetCount,
+		AuthorizedPolicy:          data.AuthorizedPolicy,
+		AuthorizedPolicySignature: data.AuthorizedPolicySignature}
+}
+
+func (d *pcrPolicyData_v4) asV3() *pcrPolicyData_v3 {
+	var nvGeneration *nvGenerationCheck
+	if d.NVGeneration.Handle.Type() == tpm2.HandleTypeNVIndex {
+		nvGeneration = &nvGenerationCheck{
+			Handle:  d.NVGeneration.Handle,
+			Minimum: d.NVGeneration.Minimum,
+			Maximum: d.NVGeneration.Maximum}
+	}
+
+	var resetCount *resetCountCheck
+	if d.ResetCount.Required {
+		resetCount = &resetCountCheck{Maximum: d.ResetCount.Maximum}
+	}
+
+	return &pcrPolicyData_v3{
+		Selection:                 d.Selection,
+		OrData:                    d.OrData,
+		PolicySequence:            d.PolicySequence,
+		AuthorizedPolicy:          d.AuthorizedPolicy,
+		AuthorizedPolicySignature: d.AuthorizedPolicySignature,
+		NVGeneration:              nvGeneration,
+		ResetCount:                resetCount}
+}
+
+// keyDataPolicy_v4 represents version 4 of the metadata for executing a
+// policy session. For keys with PCR policies that are authorized by a NV
+// index, the PCR policy metadata is only a copy of the metadata stored in
+// the PCR policy NV indices, and it may be out of date if the PCR policy was
+// updated without persisting the key data afterwards.
+type keyDataPolicy_v4 struct {
+	StaticData *staticPolicyData_v4
+	PCRData    *pcrPolicyData_v4
+}
+
+// keyData_v4 represents version 4 of keyData. The difference between v3 and
+// v4 is support for optional policy features, so this is only used for
+// serialization of keys that require one of them. Version 4 keys are
+// represented in memory by keyData_v3. Note that the encrypted payload format
+// is unchanged, and its additional data continues to identify version 3.
+type keyData_v4 struct {
+	KeyPrivate       tpm2.Private
+	KeyPublic        *tpm2.Public
+	KeyImportSymSeed tpm2.EncryptedSecret
+	PolicyData       *keyDataPolicy_v4
+}
+
+func readKeyDataV4(r io.Reader) (keyData, error) {
+	var d *keyData_v4
+	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
+		return nil, err
+	}
+
+	data := d.AsV3()
+	if data.Version() != 4 {
+		// We only ever write v4 for keys that require it.
+		return nil, errors.New("version 4 key data does not use any version 4 features")
+	}
+	return data, nil
+}
+
+func (d *keyData_v4) AsV3() *keyData_v3 {
+	static := d.PolicyData.StaticData
+	return &keyData_v3{
+		KeyPrivate:       d.KeyPrivate,
+		KeyPublic:        d.KeyPublic,
+		KeyImportSymSeed: d.KeyImportSymSeed,
+		PolicyData: &keyDataPolicy_v3{
+			StaticData: &staticPolicyData_v3{
+				AuthPublicKey:          static.AuthPublicKey,
+				PCRPolicyRef:           static.PCRPolicyRef,
+				PCRPolicyCounterHandle: static.PCRPolicyCounterHandle,
+				RequireAuthValue:       static.RequireAuthValue,
+				RequireEndorsementAuth: static.RequireEndorsementAuth,
+				ExternalAuthName:       static.ExternalAuthName,
+				PCRPolicyNVIndexHandle: static.PCRPolicyNVIndexHandle,
+				NullHierarchyDevMode:   static.NullHierarchyDevMode,
+				AlternatePCRBanks:      static.AlternatePCRBanks},
+			PCRData: d.PolicyData.PCRData.asV3()}}
+}
+
+func (d *keyData_v3) AsV4() *keyData_v4 {
+	static := d.PolicyData.StaticData
+	return &keyData_v4{
+		KeyPrivate:       d.KeyPrivate,
+		KeyPublic:        d.KeyPublic,
+		KeyImportSymSeed: d.KeyImportSymSeed,
+		PolicyData: &keyDataPolicy_v4{
+			StaticData: &staticPolicyData_v4{
+				AuthPublicKey:          static.AuthPublicKey,
+				PCRPolicyRef:           static.PCRPolicyRef,
+				PCRPolicyCounterHandle: static.PCRPolicyCounterHandle,
+				RequireAuthValue:       static.RequireAuthValue,
+				RequireEndorsementAuth: static.RequireEndorsementAuth,
+				ExternalAuthName:       static.ExternalAuthName,
+				PCRPolicyNVIndexHandle: static.PCRPolicyNVIndexHandle,
+				NullHierarchyDevMode:   static.NullHierarchyDevMode,
+				AlternatePCRBanks:      static.AlternatePCRBanks},
+			PCRData: newPcrPolicyDataV4(d.PolicyData.PCRData)}}
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// HierarchyAuthEscrow is implemented by mechanisms that keep a recoverable copy
+// of the authorization value for a hierarchy, such as by wrapping it to a
+// recovery key, an external escrow service or a HierarchyAuthStore. It is used
+// by Connection.ChangeHierarchyAuth to rotate the authorization value without
+// the risk of it being lost.
+//
+// A new value is first staged with Stage, which must store it durably alongside
+// the current value. Once the TPM has been updated, the new value is made the
+// current one with Commit. If the TPM could not be updated, the staged value is
+// discarded with Abort.
+type HierarchyAuthEscrow interface {
+	Stage(newAuth []byte) error
+	Commit() error
+	Abort() error
+}
+
+// LockoutAuthEscrow is a HierarchyAuthEscrow for the lockout hierarchy.
+type LockoutAuthEscrow = HierarchyAuthEscrow
+
+// HierarchyAuthChangeError is returned from Connection.ChangeHierarchyAuth if
+// the authorization value for a hierarchy may have been changed on the TPM but
+// the escrow could not be brought in to a consistent state.
+type HierarchyAuthChangeError struct {
+	Hierarchy tpm2.Handle
+
+	// Changed indicates whether the authorization value is known to have
+	// been changed on the TPM. If this is false, it isn't known whether the
+	// old or the new value is valid, and both are retained by the escrow as
+	// the current and staged values respectively.
+	Changed bool
+
+	err error
+}
+
+func (e *HierarchyAuthChangeError) Error() string {
+	if e.Changed {
+		return fmt.Sprintf("the %s hierarchy authorization value was changed but the escrow could not be committed: %v", hierarchyName(e.Hierarchy), e.err)
+	}
+	return fmt.Sprintf("cannot determine whether the %s hierarchy authorization value was changed: %v", hierarchyName(e.Hierarchy), e.err)
+}
+
+func (e *HierarchyAuthChangeError) Unwrap() error {
+	return e.err
+}
+
+// LockoutAuthChangeError is returned from Connection.ChangeLockoutAuth if the
+// authorization value for the lockout hierarchy may have been changed on the
+// TPM but the escrow could not be brought in to a consistent state.
+type LockoutAuthChangeError = HierarchyAuthChangeError
+
+// hierarchyName returns the name of the specified hierarchy for use in error
+// messages.
+func hierarchyName(hierarchy tpm2.Handle) string {
+	switch hierarchy {
+	case tpm2.HandleOwner:
+		return "owner"
+	case tpm2.HandleEndorsement:
+		return "endorsement"
+	case tpm2.HandleLockout:
+		return "lockout"
+	default:
+		return hierarchy.String()
+	}
+}
+
+// checkHierarchyHandle checks that the supplied handle corresponds to a
+// hierarchy with an authorization value that can be changed.
+func checkHierarchyHandle(hierarchy tpm2.Handle) error {
+	switch hierarchy {
+	case tpm2.HandleOwner, tpm2.HandleEndorsement, tpm2.HandleLockout:
+		return nil
+	default:
+		return fmt.Errorf("invalid hierarchy %v", hierarchy)
+	}
+}
+
+// hierarchyAuthProvisioningAction returns the action that is recorded in the
+// provisioning audit log when the authorization value for the specified
+// hierarchy is changed.
+func hierarchyAuthProvisioningAction(hierarchy tpm2.Handle) ProvisioningAction {
+	switch hierarchy {
+	case tpm2.HandleOwner:
+		return ProvisioningActionSetOwnerAuth
+	case tpm2.HandleEndorsement:
+		return ProvisioningActionSetEndorsementAuth
+	default:
+		return ProvisioningActionSetLockoutAuth
+	}
+}
+
+// isTPMResponseError indicates whether the specified error is an error or warning
+// returned from the TPM for the specified command, in which case the command is
+// known not to have had any effect.
+func isTPMResponseError(err error, command tpm2.CommandCode) bool {
+	return tpm2.IsTPMError(err, tpm2.AnyErrorCode, command) || tpm2.IsTPMWarning(err, tpm2.AnyWarningCode, command)
+}
+
+// ChangeHierarchyAuth changes the authorization value for the specified
+// hierarchy, which must be one of tpm2.HandleOwner, tpm2.HandleEndorsement or
+// tpm2.HandleLockout, to newAuth, keeping the supplied escrow in sync with the
+// TPM. The current authorization value must be provided by calling SetAuthValue
+// on the hierarchy's ResourceContext prior to this call.
+//
+// The new value is staged in the escrow before the TPM is updated, and committed
+// afterwards. If staging fails, the TPM is not modified. If the TPM rejects the
+// change, the staged value is aborted and the current value remains valid. If the
+// wrong authorization value is provided, a AuthFailError error will be returned,
+// and if the TPM is in dictionary attack lockout mode, ErrTPMLockout will be
+// returned.
+//
+// If the outcome of the change on the TPM cannot be determined (eg, because of a
+// communication failure), or if the change succeeded but the escrow could not be
+// committed, a *HierarchyAuthChangeError error is returned. In the first case,
+// the escrow retains both the current and new values and the caller should
+// determine which one is valid before committing or aborting. In the second case,
+// the caller should retry committing the escrow.
+//
+// On success, the hierarchy's ResourceContext is updated to use the new
+// authorization value.
+func (t *Connection) ChangeHierarchyAuth(hierarchy tpm2.Handle, newAuth []byte, escrow HierarchyAuthEscrow) error {
+	if err := checkHierarchyHandle(hierarchy); err != nil {
+		return err
+	}
+	if escrow == nil {
+		return errors.New("no escrow supplied")
+	}
+
+	if err := escrow.Stage(newAuth); err != nil {
+		return xerrors.Errorf("cannot stage new authorization value in escrow: %w", err)
+	}
+
+	// Use command parameter encryption here for the new value. Note that this
+	// only offers protections against passive interposers.
+	if err := t.HierarchyChangeAuth(t.GetPermanentContext(hierarchy), newAuth, t.HmacSession().IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
+		if !isTPMResponseError(err, tpm2.CommandHierarchyChangeAuth) {
+			return &HierarchyAuthChangeError{Hierarchy: hierarchy, err: err}
+		}
+
+		if abortErr := escrow.Abort(); abortErr != nil {
+			return xerrors.Errorf("cannot abort staged authorization value in escrow (%v) after failing to change the authorization value: %w", abortErr, err)
+		}
+
+		switch {
+		case isAuthFailError(err, tpm2.CommandHierarchyChangeAuth, 1):
+			return AuthFailError{hierarchy}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandHierarchyChangeAuth):
+			return ErrTPMLockout
+		}
+		return xerrors.Errorf("cannot change the %s hierarchy authorization value: %w", hierarchyName(hierarchy), err)
+	}
+
+	if err := escrow.Commit(); err != nil {
+		return &HierarchyAuthChangeError{Hierarchy: hierarchy, Changed: true, err: err}
+	}
+
+	return t.recordProvisioningAction(hierarchyAuthProvisioningAction(hierarchy), "")
+}
+
+// ChangeLockoutAuth changes the authorization value for the lockout hierarchy to
+// newAuth, keeping the supplied escrow in sync with the TPM. The current
+// authorization value must be provided by calling
+// Connection.LockoutHandleContext().SetAuthValue() prior to this call.
+//
+// See ChangeHierarchyAuth for details of how errors are handled.
+func (t *Connection) ChangeLockoutAuth(newAuth []byte, escrow LockoutAuthEscrow) error {
+	return t.ChangeHierarchyAuth(tpm2.HandleLockout, newAuth, escrow)
+}
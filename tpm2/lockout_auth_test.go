@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type mockLockoutAuthEscrow struct {
+	current []byte
+	staged  []byte
+
+	stageErr  error
+	commitErr error
+
+	aborted bool
+}
+
+func (e *mockLockoutAuthEscrow) Stage(newAuth []byte) error {
+	if e.stageErr != nil {
+		return e.stageErr
+	}
+	e.staged = newAuth
+	return nil
+}
+
+func (e *mockLockoutAuthEscrow) Commit() error {
+	if e.commitErr != nil {
+		return e.commitErr
+	}
+	e.current = e.staged
+	e.staged = nil
+	return nil
+}
+
+func (e *mockLockoutAuthEscrow) Abort() error {
+	e.staged = nil
+	e.aborted = true
+	return nil
+}
+
+type lockoutAuthSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *lockoutAuthSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePlatformHierarchy // Allow the test fixture to clear the TPM after tripping the lockout
+}
+
+var _ = Suite(&lockoutAuthSuite{})
+
+func (s *lockoutAuthSuite) checkLockoutAuth(c *C, expected []byte) {
+	s.TPM().LockoutHandleContext().SetAuthValue(expected)
+	c.Check(s.TPM().DictionaryAttackLockReset(s.TPM().LockoutHandleContext(), nil), IsNil)
+}
+
+func (s *lockoutAuthSuite) restoreLockoutAuth(c *C) {
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// ChangeLockoutAuth uses command parameter encryption. We have to do
+		// this manually else the test fixture fails the test.
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuth(c *C) {
+	escrow := &mockLockoutAuthEscrow{current: []byte("1234")}
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("1234"))
+
+	c.Check(s.TPM().ChangeLockoutAuth([]byte("5678"), escrow), IsNil)
+	s.restoreLockoutAuth(c)
+
+	c.Check(escrow.current, DeepEquals, []byte("5678"))
+	c.Check(escrow.staged, IsNil)
+	c.Check(escrow.aborted, testutil.IsFalse)
+	c.Check(s.TPM().LockoutHandleContext().AuthValue(), DeepEquals, []byte("5678"))
+
+	s.checkLockoutAuth(c, []byte("5678"))
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthFromEmpty(c *C) {
+	escrow := new(mockLockoutAuthEscrow)
+
+	c.Check(s.TPM().ChangeLockoutAuth([]byte("foo"), escrow), IsNil)
+	s.restoreLockoutAuth(c)
+
+	c.Check(escrow.current, DeepEquals, []byte("foo"))
+	s.checkLockoutAuth(c, []byte("foo"))
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthNoEscrow(c *C) {
+	c.Check(s.TPM().ChangeLockoutAuth([]byte("foo"), nil), ErrorMatches, `no escrow supplied`)
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthStageError(c *C) {
+	escrow := &mockLockoutAuthEscrow{stageErr: errors.New("some error")}
+
+	err := s.TPM().ChangeLockoutAuth([]byte("foo"), escrow)
+	c.Check(err, ErrorMatches, `cannot stage new authorization value in escrow: some error`)
+	c.Check(escrow.aborted, testutil.IsFalse)
+
+	// The TPM should not have been modified.
+	s.checkLockoutAuth(c, nil)
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthAuthFail(c *C) {
+	defer func() {
+		// This test trips the lockout for the lockout auth, which can't be
+		// undone by the test fixture.
+		s.ClearTPMUsingPlatformHierarchy(c)
+	}()
+
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("1234"))
+	s.TPM().LockoutHandleContext().SetAuthValue(nil)
+
+	escrow := &mockLockoutAuthEscrow{current: []byte("1234")}
+	err := s.TPM().ChangeLockoutAuth([]byte("5678"), escrow)
+	c.Assert(err, testutil.ConvertibleTo, AuthFailError{})
+	c.Check(err.(AuthFailError).Handle, Equals, tpm2.HandleLockout)
+
+	c.Check(escrow.aborted, testutil.IsTrue)
+	c.Check(escrow.staged, IsNil)
+	c.Check(escrow.current, DeepEquals, []byte("1234"))
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthInLockout(c *C) {
+	defer func() {
+		// This test trips the lockout for the lockout auth, which can't be
+		// undone by the test fixture.
+		s.ClearTPMUsingPlatformHierarchy(c)
+	}()
+
+	authValue := []byte("1234")
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, authValue)
+
+	// Trip the DA lockout
+	s.TPM().LockoutHandleContext().SetAuthValue(nil)
+	c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), testutil.ErrorIs,
+		&tpm2.TPMSessionError{TPMError: &tpm2.TPMError{Command: tpm2.CommandHierarchyChangeAuth, Code: tpm2.ErrorAuthFail}, Index: 1})
+	s.TPM().LockoutHandleContext().SetAuthValue(authValue)
+
+	escrow := &mockLockoutAuthEscrow{current: authValue}
+	c.Check(s.TPM().ChangeLockoutAuth([]byte("5678"), escrow), Equals, ErrTPMLockout)
+	c.Check(escrow.aborted, testutil.IsTrue)
+	c.Check(escrow.current, DeepEquals, authValue)
+}
+
+func (s *lockoutAuthSuite) TestChangeLockoutAuthCommitError(c *C) {
+	escrow := &mockLockoutAuthEscrow{commitErr: errors.New("some error")}
+
+	err := s.TPM().ChangeLockoutAuth([]byte("foo"), escrow)
+	s.restoreLockoutAuth(c)
+	c.Check(err, ErrorMatches, `the lockout hierarchy authorization value was changed but the escrow could not be committed: some error`)
+
+	c.Assert(err, testutil.ConvertibleTo, &LockoutAuthChangeError{})
+	c.Check(err.(*LockoutAuthChangeError).Changed, testutil.IsTrue)
+
+	// The new value is still staged so that it isn't lost.
+	c.Check(escrow.staged, DeepEquals, []byte("foo"))
+	c.Check(escrow.aborted, testutil.IsFalse)
+	s.checkLockoutAuth(c, []byte("foo"))
+}
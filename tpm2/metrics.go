@@ -0,0 +1,205 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// Operation identifies a high-level operation that is instrumented by this
+// package.
+type Operation string
+
+const (
+	// OperationConnect corresponds to opening and initializing a connection
+	// to the default TPM device with ConnectToDefaultTPM or
+	// ConnectToDefaultTPMContext.
+	OperationConnect Operation = "connect"
+
+	// OperationProvisionStatus corresponds to checking the provisioning status
+	// of the TPM with Connection.ProvisionStatus. This is also performed as part
+	// of Connection.EnsureProvisioned.
+	OperationProvisionStatus Operation = "provision-status"
+
+	// OperationUnseal corresponds to unsealing a key from the TPM, either with
+	// SealedKeyObject.UnsealFromTPM and related APIs or when recovering keys from
+	// secboot.KeyData objects protected by the TPM.
+	OperationUnseal Operation = "unseal"
+)
+
+// OperationMetrics contains the metrics for a single instrumented operation.
+type OperationMetrics struct {
+	Operation Operation
+
+	// Commands is the number of TPM commands that were submitted during the
+	// operation. Commands are only counted for connections that were opened
+	// by this package with ConnectToDefaultTPM or ConnectToDefaultTPMContext,
+	// and this will be zero for other connections.
+	Commands int
+
+	// Duration is the wall time taken to complete the operation.
+	Duration time.Duration
+
+	// Err is the error that the operation failed with, or nil if it
+	// succeeded.
+	Err error
+}
+
+// MetricsHook is called with the metrics for each instrumented operation when it
+// completes. It is called from the goroutine that performed the operation.
+type MetricsHook func(m *OperationMetrics)
+
+var metricsHook MetricsHook
+
+// SetMetricsHook registers a hook that is called with the metrics for each
+// instrumented operation. Operations may be nested, eg, OperationProvisionStatus
+// is reported during Connection.EnsureProvisioned, in which case the metrics for
+// the outer operation include those of the inner one. Supplying nil removes the
+// current hook.
+//
+// MetricsReport.Record can be used as a hook in order to collect a simple report.
+func SetMetricsHook(hook MetricsHook) {
+	metricsHook = hook
+}
+
+// operationRecorder records the metrics for a single instrumented operation.
+type operationRecorder struct {
+	hook          MetricsHook
+	op            Operation
+	start         time.Time
+	transport     *contextTransport
+	startCommands int
+}
+
+// beginOperation begins recording the metrics for the specified operation, using
+// the supplied transport to count TPM commands. This returns nil if there isn't
+// a registered metrics hook, in which case nothing is recorded.
+func beginOperation(op Operation, transport tpm2.Transport) *operationRecorder {
+	if metricsHook == nil {
+		return nil
+	}
+
+	r := &operationRecorder{
+		hook:  metricsHook,
+		op:    op,
+		start: timeNow()}
+	if t, ok := transport.(*contextTransport); ok {
+		r.transport = t
+		r.startCommands = t.commands
+	}
+	return r
+}
+
+// setNewTransport associates a newly created transport with this recorder,
+// for operations that create their own transport.
+func (r *operationRecorder) setNewTransport(transport *contextTransport) {
+	if r == nil {
+		return
+	}
+	r.transport = transport
+	r.startCommands = 0
+}
+
+// end completes the recording of metrics for this operation and calls the
+// registered metrics hook.
+func (r *operationRecorder) end(err error) {
+	if r == nil {
+		return
+	}
+
+	m := &OperationMetrics{
+		Operation: r.op,
+		Duration:  timeNow().Sub(r.start),
+		Err:       err}
+	if r.transport != nil {
+		m.Commands = r.transport.commands - r.startCommands
+	}
+	r.hook(m)
+}
+
+// OperationSummary contains the aggregated metrics for all of the recorded
+// instances of an operation.
+type OperationSummary struct {
+	Operation Operation
+	Count     int           // The number of times that the operation was performed
+	Failures  int           // The number of times that the operation failed
+	Commands  int           // The total number of TPM commands submitted
+	Duration  time.Duration // The total wall time
+}
+
+// MetricsReport collects the metrics for instrumented operations. Its Record
+// method can be registered with SetMetricsHook. It is safe to use from multiple
+// goroutines.
+type MetricsReport struct {
+	mu         sync.Mutex
+	operations []OperationMetrics
+}
+
+// Record adds the supplied metrics to this report.
+func (r *MetricsReport) Record(m *OperationMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations = append(r.operations, *m)
+}
+
+// Operations returns the metrics for each recorded operation, in the order that
+// they completed.
+func (r *MetricsReport) Operations() []OperationMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]OperationMetrics(nil), r.operations...)
+}
+
+// Summary returns the aggregated metrics for each recorded operation, in the order
+// that each operation first completed.
+func (r *MetricsReport) Summary() []OperationSummary {
+	var out []OperationSummary
+	indices := make(map[Operation]int)
+	for _, m := range r.Operations() {
+		i, ok := indices[m.Operation]
+		if !ok {
+			i = len(out)
+			indices[m.Operation] = i
+			out = append(out, OperationSummary{Operation: m.Operation})
+		}
+
+		s := &out[i]
+		s.Count += 1
+		if m.Err != nil {
+			s.Failures += 1
+		}
+		s.Commands += m.Commands
+		s.Duration += m.Duration
+	}
+	return out
+}
+
+func (r *MetricsReport) String() string {
+	var b strings.Builder
+	for _, s := range r.Summary() {
+		fmt.Fprintf(&b, "%s: count=%d failures=%d commands=%d duration=%v\n", s.Operation, s.Count, s.Failures, s.Commands, s.Duration)
+	}
+	return b.String()
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type metricsSuiteNoTPM struct{}
+
+var _ = Suite(&metricsSuiteNoTPM{})
+
+func (s *metricsSuiteNoTPM) TearDownTest(c *C) {
+	SetMetricsHook(nil)
+}
+
+func (s *metricsSuiteNoTPM) TestInstrumentedOperation(c *C) {
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	restore := MockTimeNow(func() time.Time { return now })
+	defer restore()
+
+	report := new(MetricsReport)
+	SetMetricsHook(report.Record)
+
+	transport := NewContextTransport(newMockContextTransport())
+	c.Check(RunInstrumentedOperation(OperationUnseal, transport, func() error {
+		for i := 0; i < 3; i++ {
+			_, err := transport.Write([]byte{1, 2, 3})
+			c.Check(err, IsNil)
+		}
+		now = now.Add(250 * time.Millisecond)
+		return nil
+	}), IsNil)
+
+	c.Check(report.Operations(), DeepEquals, []OperationMetrics{
+		{Operation: OperationUnseal, Commands: 3, Duration: 250 * time.Millisecond},
+	})
+}
+
+func (s *metricsSuiteNoTPM) TestInstrumentedOperationCountsSinceStart(c *C) {
+	report := new(MetricsReport)
+	SetMetricsHook(report.Record)
+
+	transport := NewContextTransport(newMockContextTransport())
+	_, err := transport.Write([]byte{1, 2, 3})
+	c.Check(err, IsNil)
+
+	c.Check(RunInstrumentedOperation(OperationProvisionStatus, transport, func() error {
+		_, err := transport.Write([]byte{1, 2, 3})
+		return err
+	}), IsNil)
+
+	ops := report.Operations()
+	c.Assert(ops, HasLen, 1)
+	c.Check(ops[0].Commands, Equals, 1)
+}
+
+func (s *metricsSuiteNoTPM) TestInstrumentedOperationError(c *C) {
+	report := new(MetricsReport)
+	SetMetricsHook(report.Record)
+
+	expectedErr := errors.New("some error")
+	c.Check(RunInstrumentedOperation(OperationConnect, nil, func() error {
+		return expectedErr
+	}), Equals, expectedErr)
+
+	ops := report.Operations()
+	c.Assert(ops, HasLen, 1)
+	c.Check(ops[0].Operation, Equals, OperationConnect)
+	c.Check(ops[0].Commands, Equals, 0)
+	c.Check(ops[0].Err, Equals, expectedErr)
+}
+
+func (s *metricsSuiteNoTPM) TestNoMetricsHook(c *C) {
+	called := false
+	c.Check(RunInstrumentedOperation(OperationUnseal, nil, func() error {
+		called = true
+		return nil
+	}), IsNil)
+	c.Check(called, testutil.IsTrue)
+}
+
+func (s *metricsSuiteNoTPM) TestMetricsReportSummary(c *C) {
+	report := new(MetricsReport)
+	report.Record(&OperationMetrics{Operation: OperationConnect, Commands: 10, Duration: 100 * time.Millisecond})
+	report.Record(&OperationMetrics{Operation: OperationUnseal, Commands: 20, Duration: 300 * time.Millisecond})
+	report.Record(&OperationMetrics{Operation: OperationUnseal, Commands: 5, Duration: 50 * time.Millisecond, Err: errors.New("some error")})
+
+	c.Check(report.Summary(), DeepEquals, []OperationSummary{
+		{Operation: OperationConnect, Count: 1, Commands: 10, Duration: 100 * time.Millisecond},
+		{Operation: OperationUnseal, Count: 2, Failures: 1, Commands: 25, Duration: 350 * time.Millisecond},
+	})
+	c.Check(report.String(), Equals, `connect: count=1 failures=0 commands=10 duration=100ms
+unseal: count=2 failures=1 commands=25 duration=350ms
+`)
+}
+
+type metricsSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *metricsSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *metricsSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+	s.AddCleanup(func() { SetMetricsHook(nil) })
+}
+
+var _ = Suite(&metricsSuite{})
+
+func (s *metricsSuite) TestUnsealFromTPM(c *C) {
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), make(secboot.DiskUnlockKey, 32), path, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	report := new(MetricsReport)
+	SetMetricsHook(report.Record)
+
+	_, _, err = k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+
+	ops := report.Operations()
+	c.Assert(ops, HasLen, 1)
+	c.Check(ops[0].Operation, Equals, OperationUnseal)
+	c.Check(ops[0].Err, IsNil)
+}
+
+func (s *metricsSuite) TestProvisionStatus(c *C) {
+	report := new(MetricsReport)
+	SetMetricsHook(report.Record)
+
+	_, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+
+	ops := report.Operations()
+	c.Assert(ops, HasLen, 1)
+	c.Check(ops[0].Operation, Equals, OperationProvisionStatus)
+	c.Check(ops[0].Err, IsNil)
+}
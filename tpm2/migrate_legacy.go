@@ -0,0 +1,262 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// CurrentSealedKeyObjectVersion is the metadata version of sealed key objects
+// created by SealKeyToTPM and SealKeyToTPMMultiple. Version 2 sealed key objects
+// are importable objects created by SealKeyToExternalTPMStorageKey, which are
+// otherwise identical to version 1 objects and become version 1 objects once they
+// have been imported in to the TPM.
+const CurrentSealedKeyObjectVersion uint32 = 1
+
+// Migrate upgrades this sealed key object to the specified metadata version,
+// which must be greater than 0 and no greater than CurrentSealedKeyObjectVersion.
+// If the sealed key object already has the requested version or a later one,
+// this function does nothing and returns a nil authKey.
+//
+// This is equivalent to calling MigrateSealedKeyObjects with just this sealed
+// key object and no PIN. Sealed key objects that were created together with
+// SealKeyToTPMMultiple should be migrated together with MigrateSealedKeyObjects
+// so that they continue to share the same key for authorizing PCR policy
+// updates and the same PCR policy counter.
+func (k *SealedKeyObject) Migrate(tpm *Connection, targetVersion uint32, params *KeyCreationParams) (authKey secboot.PrimaryKey, err error) {
+	return MigrateSealedKeyObjects(tpm, targetVersion, []*SealedKeyObject{k}, params, "")
+}
+
+// MigrateSealedKeyObjects upgrades the supplied related sealed key objects to
+// the specified metadata version, which must be greater than 0 and no greater
+// than CurrentSealedKeyObjectVersion. Sealed key objects that already have the
+// requested version or a later one are skipped. If none of them need upgrading,
+// this function does nothing and returns a nil authKey.
+//
+// Version 0 sealed key objects cannot be upgraded without re-sealing, so this
+// unseals each key first. The current PCR values must satisfy the PCR policy of
+// each sealed key object. If the keys are protected by a PIN, it must be
+// supplied, and ErrPINFail is returned if it is incorrect. The sealed key
+// objects to upgrade must share the same PCR policy counter, as they do when
+// they are created together by SealKeyToTPMMultiple. The same disk unlock keys
+// are then sealed again to the storage hierarchy with the supplied parameters,
+// in the same way as SealKeyToTPMMultiple, so that the upgraded sealed key
+// objects share a new key for authorizing PCR policy updates and a new PCR
+// policy counter, and the encrypted containers do not need to be modified. The
+// new sealed key objects are not protected by a PIN. The PCR policy counter
+// used by a version 0 sealed key object cannot be reused, so
+// PCRPolicyCounterHandle must either be tpm2.HandleNull or a different handle.
+// The old PCR policy counter is not undefined by this function.
+//
+// This function requires knowledge of the authorization value for the storage
+// hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function.
+//
+// On success, this returns the private part of the new key used for authorizing
+// PCR policy updates, and the upgraded SealedKeyObjects are updated. They must
+// be persisted using SealedKeyObject.WriteAtomic. If any part of this function
+// fails, none of the supplied SealedKeyObjects are modified.
+//
+// Migrating to the secboot.KeyData format is performed with UpgradeLegacyKeyFile.
+func MigrateSealedKeyObjects(tpm *Connection, targetVersion uint32, keys []*SealedKeyObject, params *KeyCreationParams, pin string) (authKey secboot.PrimaryKey, err error) {
+	if targetVersion == 0 || targetVersion > CurrentSealedKeyObjectVersion {
+		return nil, fmt.Errorf("unsupported target version (%d)", targetVersion)
+	}
+
+	var toMigrate []*SealedKeyObject
+	for _, k := range keys {
+		if k.data.Version() >= targetVersion {
+			continue
+		}
+		toMigrate = append(toMigrate, k)
+	}
+	if len(toMigrate) == 0 {
+		return nil, nil
+	}
+
+	// params is mandatory.
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+
+	pcrPolicyCounterHandle := toMigrate[0].PCRPolicyCounterHandle()
+	for _, k := range toMigrate[1:] {
+		if k.PCRPolicyCounterHandle() != pcrPolicyCounterHandle {
+			return nil, errors.New("cannot migrate sealed key objects that don't share the same PCR policy counter")
+		}
+	}
+	if params.PCRPolicyCounterHandle != tpm2.HandleNull && params.PCRPolicyCounterHandle == pcrPolicyCounterHandle {
+		return nil, errors.New("cannot reuse the PCR policy counter of a version 0 sealed key object")
+	}
+
+	var unsealed []secboot.DiskUnlockKey
+	for i, k := range toMigrate {
+		key, err := k.unsealForMigration(tpm, []byte(pin))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot unseal key %d: %w", i, err)
+		}
+		unsealed = append(unsealed, key)
+	}
+
+	return sealKeyObjectsToTPM(tpm, unsealed, params, func(skos []*SealedKeyObject) error {
+		for i, k := range toMigrate {
+			k.data = skos[i].data
+		}
+		return nil
+	})
+}
+
+// unsealForMigration unseals the key from this sealed key object. If a PIN
+// is supplied, it is used to satisfy the PIN assertion of a version 0 sealed
+// key object.
+func (k *SealedKeyObject) unsealForMigration(tpm *Connection, pin []byte) (secboot.DiskUnlockKey, error) {
+	if len(pin) == 0 {
+		key, _, err := k.UnsealFromTPM(tpm)
+		return key, err
+	}
+
+	policy, ok := k.data.Policy().(*keyDataPolicy_v0)
+	if !ok {
+		return nil, errors.New("a PIN is only supported for version 0 sealed key objects")
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSession()
+
+	symmetric := &tpm2.SymDef{
+		Algorithm: tpm2.SymAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
+	}
+	session, err := tpm.StartAuthSession(srk, nil, tpm2.SessionTypePolicy, symmetric, k.data.Public().NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(session)
+
+	if err := policy.executePCRPolicyWithPIN(tpm.TPMContext, session, tpm.HmacSession(), pin); err != nil {
+		if isAuthFailError(err, tpm2.CommandPolicySecret, 1) {
+			return nil, ErrPINFail
+		}
+		return nil, xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
+	}
+
+	data, err := k.unsealDataFromTPMWithSession(tpm.TPMContext, nil, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrResponseEncrypt), tpm.HmacSession(), tpm.nvReadEncryptAttrs())
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := k.unmarshalUnsealedData(data)
+	return key, err
+}
+
+// MigrateSealedKeyObjectFile reads the sealed key object from the file at the
+// specified path and upgrades it to CurrentSealedKeyObjectVersion with
+// SealedKeyObject.Migrate if it was created with an older version, atomically
+// replacing the file at the specified path. This is intended to be called when
+// reading key files that may have been created by an older version of secboot.
+//
+// The sealed key object is returned. If it had to be upgraded, the private part
+// of the new key used for authorizing PCR policy updates is also returned.
+// Otherwise, this is nil and the file is not modified.
+func MigrateSealedKeyObjectFile(tpm *Connection, path string, params *KeyCreationParams) (k *SealedKeyObject, authKey secboot.PrimaryKey, err error) {
+	k, err = ReadSealedKeyObjectFromFile(path)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read key data file: %w", err)
+	}
+
+	authKey, err = k.Migrate(tpm, CurrentSealedKeyObjectVersion, params)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot migrate sealed key object: %w", err)
+	}
+	if authKey == nil {
+		return k, nil, nil
+	}
+
+	if err := k.WriteAtomic(NewFileSealedKeyObjectWriter(path)); err != nil {
+		return nil, nil, xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	return k, authKey, nil
+}
+
+// MigrateSealedKeyObjectFiles reads the related sealed key objects from the
+// files at the specified paths and upgrades them together to
+// CurrentSealedKeyObjectVersion with MigrateSealedKeyObjects, atomically
+// replacing each upgraded file. The PIN is required if the keys are
+// protected by one.
+//
+// The sealed key objects are returned. If any had to be upgraded, the private
+// part of the new key used for authorizing PCR policy updates is also
+// returned. Otherwise, this is nil and no file is modified. If writing one of
+// the files fails, the files that were already written remain upgraded. Both
+// the upgraded and the original sealed key objects remain usable in this case,
+// because the original PCR policy counter is not undefined.
+func MigrateSealedKeyObjectFiles(tpm *Connection, paths []string, params *KeyCreationParams, pin string) (keys []*SealedKeyObject, authKey secboot.PrimaryKey, err error) {
+	for _, path := range paths {
+		k, err := ReadSealedKeyObjectFromFile(path)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read key data file %s: %w", path, err)
+		}
+		keys = append(keys, k)
+	}
+
+	versions := make([]uint32, len(keys))
+	for i, k := range keys {
+		versions[i] = k.Version()
+	}
+
+	authKey, err = MigrateSealedKeyObjects(tpm, CurrentSealedKeyObjectVersion, keys, params, pin)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot migrate sealed key objects: %w", err)
+	}
+	if authKey == nil {
+		return keys, nil, nil
+	}
+
+	for i, k := range keys {
+		if k.Version() == versions[i] {
+			continue
+		}
+		if err := k.WriteAtomic(NewFileSealedKeyObjectWriter(paths[i])); err != nil {
+			return nil, nil, xerrors.Errorf("cannot write key data file %s: %w", paths[i], err)
+		}
+	}
+
+	return keys, authKey, nil
+}
@@ -0,0 +1,180 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type migrateLegacySuiteNoTPM struct{}
+
+type migrateLegacySuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *migrateLegacySuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *migrateLegacySuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&migrateLegacySuiteNoTPM{})
+var _ = Suite(&migrateLegacySuite{})
+
+func (s *migrateLegacySuiteNoTPM) newImportableKeyFile(c *C) string {
+	srkKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&srkKey.PublicKey)
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err = SealKeyToExternalTPMStorageKey(srk, key, path, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateInvalidTargetVersion(c *C) {
+	k, err := ReadSealedKeyObjectFromFile(s.newImportableKeyFile(c))
+	c.Assert(err, IsNil)
+
+	_, err = k.Migrate(nil, 0, nil)
+	c.Check(err, ErrorMatches, `unsupported target version \(0\)`)
+	_, err = k.Migrate(nil, 2, nil)
+	c.Check(err, ErrorMatches, `unsupported target version \(2\)`)
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateNotRequired(c *C) {
+	k, err := ReadSealedKeyObjectFromFile(s.newImportableKeyFile(c))
+	c.Assert(err, IsNil)
+	c.Check(k.Version(), Equals, uint32(2))
+
+	authKey, err := k.Migrate(nil, CurrentSealedKeyObjectVersion, nil)
+	c.Check(err, IsNil)
+	c.Check(authKey, IsNil)
+	c.Check(k.Version(), Equals, uint32(2))
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateFileNotRequired(c *C) {
+	path := s.newImportableKeyFile(c)
+	expected, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	k, authKey, err := MigrateSealedKeyObjectFile(nil, path, nil)
+	c.Check(err, IsNil)
+	c.Check(authKey, IsNil)
+	c.Check(k.Version(), Equals, uint32(2))
+
+	data, err := ioutil.ReadFile(path)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, expected)
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateFileMissing(c *C) {
+	_, _, err := MigrateSealedKeyObjectFile(nil, filepath.Join(c.MkDir(), "key"), nil)
+	c.Check(err, ErrorMatches, `cannot read key data file: open .*/key: no such file or directory`)
+}
+
+func (s *migrateLegacySuiteNoTPM) newV0SealedKeyObject(pcrPolicyCounterHandle tpm2.Handle) *SealedKeyObject {
+	return NewSealedKeyObject(&KeyData_v0{
+		KeyPublic: tpm2_testutil.NewSealedObjectTemplate(),
+		PolicyData: &KeyDataPolicy_v0{
+			StaticData: &StaticPolicyData_v0{PCRPolicyCounterHandle: pcrPolicyCounterHandle},
+			PCRData:    &PcrPolicyData_v0{}}})
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateSealedKeyObjectsNotRequired(c *C) {
+	k1, err := ReadSealedKeyObjectFromFile(s.newImportableKeyFile(c))
+	c.Assert(err, IsNil)
+	k2, err := ReadSealedKeyObjectFromFile(s.newImportableKeyFile(c))
+	c.Assert(err, IsNil)
+
+	authKey, err := MigrateSealedKeyObjects(nil, CurrentSealedKeyObjectVersion, []*SealedKeyObject{k1, k2}, nil, "1234")
+	c.Check(err, IsNil)
+	c.Check(authKey, IsNil)
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateSealedKeyObjectsDifferentPCRPolicyCounters(c *C) {
+	_, err := MigrateSealedKeyObjects(nil, CurrentSealedKeyObjectVersion, []*SealedKeyObject{
+		s.newV0SealedKeyObject(0x01800000),
+		s.newV0SealedKeyObject(0x01800001)}, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull}, "")
+	c.Check(err, ErrorMatches, `cannot migrate sealed key objects that don't share the same PCR policy counter`)
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateSealedKeyObjectsReusePCRPolicyCounter(c *C) {
+	_, err := MigrateSealedKeyObjects(nil, CurrentSealedKeyObjectVersion, []*SealedKeyObject{
+		s.newV0SealedKeyObject(0x01800000),
+		s.newV0SealedKeyObject(0x01800000)}, &KeyCreationParams{PCRPolicyCounterHandle: 0x01800000}, "")
+	c.Check(err, ErrorMatches, `cannot reuse the PCR policy counter of a version 0 sealed key object`)
+}
+
+func (s *migrateLegacySuiteNoTPM) TestMigrateFilesNotRequired(c *C) {
+	paths := []string{s.newImportableKeyFile(c), s.newImportableKeyFile(c)}
+
+	keys, authKey, err := MigrateSealedKeyObjectFiles(nil, paths, nil, "")
+	c.Check(err, IsNil)
+	c.Check(authKey, IsNil)
+	c.Assert(keys, HasLen, 2)
+	c.Check(keys[0].Version(), Equals, uint32(2))
+	c.Check(keys[1].Version(), Equals, uint32(2))
+}
+
+func (s *migrateLegacySuite) TestMigrateFileCurrentVersion(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	expectedAuthKey, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, authKey, err := MigrateSealedKeyObjectFile(s.TPM(), path, nil)
+	c.Check(err, IsNil)
+	c.Check(authKey, IsNil)
+	c.Check(k.Version(), Equals, CurrentSealedKeyObjectVersion)
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, expectedAuthKey)
+}
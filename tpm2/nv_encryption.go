@@ -0,0 +1,86 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"github.com/canonical/go-tpm2"
+)
+
+// NVParameterEncryption describes how the parameters of commands that access
+// the NV indices managed by this package (the SRK template index, boot policy
+// indices and provisioning audit anchors) are protected from being observed on
+// the bus between the CPU and the TPM.
+//
+// Parameter encryption requires a salted session, so it is only used if the
+// TPM has an endorsement key or the connection was created with a suitable
+// external session (see Connection.HmacSession). If the TPM rejects a command
+// that uses parameter encryption, the error is returned and the command is not
+// retried without it.
+//
+// PCR policy counter values are not protected by this because they are not
+// confidential - the current value is also recorded in the key data.
+type NVParameterEncryption int
+
+const (
+	// NVParameterEncryptionCommand encrypts command parameters, such as data
+	// written to an NV index. This is the default.
+	NVParameterEncryptionCommand NVParameterEncryption = iota
+
+	// NVParameterEncryptionCommandAndResponse encrypts response parameters,
+	// such as data read from an NV index, in addition to command parameters.
+	NVParameterEncryptionCommandAndResponse
+)
+
+// SetNVParameterEncryption sets how the parameters of commands that access the
+// NV indices managed by this package are protected.
+func (t *Connection) SetNVParameterEncryption(mode NVParameterEncryption) {
+	t.nvParamEncryption = mode
+}
+
+// nvReadEncryptAttrs returns the parameter encryption attributes to use for
+// reading from an NV index managed by this package.
+func (t *Connection) nvReadEncryptAttrs() tpm2.SessionAttributes {
+	if t.nvParamEncryption == NVParameterEncryptionCommandAndResponse {
+		return tpm2.AttrResponseEncrypt
+	}
+	return 0
+}
+
+// canEncryptParams indicates whether the supplied session can be used for
+// parameter encryption.
+func canEncryptParams(session tpm2.SessionContext) bool {
+	if session == nil {
+		return false
+	}
+	alg := session.Params().Symmetric.Algorithm
+	return alg.IsValidBlockCipher() || alg == tpm2.SymAlgorithmXOR
+}
+
+// runWithParamEncryption runs the supplied function with a copy of the supplied
+// session that has the specified parameter encryption attributes, if the session
+// can be used for parameter encryption. Errors are returned as is - in
+// particular, the function is never retried without parameter encryption, as a
+// warning that provokes this could be injected by an adversary on the bus.
+func runWithParamEncryption(session tpm2.SessionContext, attrs tpm2.SessionAttributes, fn func(tpm2.SessionContext) error) error {
+	if attrs == 0 || !canEncryptParams(session) {
+		return fn(session)
+	}
+	return fn(session.IncludeAttrs(attrs))
+}
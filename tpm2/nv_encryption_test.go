@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type nvEncryptionSuiteNoTPM struct{}
+
+type nvEncryptionSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *nvEncryptionSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&nvEncryptionSuiteNoTPM{})
+var _ = Suite(&nvEncryptionSuite{})
+
+func (s *nvEncryptionSuiteNoTPM) TestRunWithParamEncryptionNoSession(c *C) {
+	calls := 0
+	err := RunWithParamEncryption(nil, tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+		calls += 1
+		c.Check(session, IsNil)
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *nvEncryptionSuiteNoTPM) TestRunWithParamEncryptionError(c *C) {
+	calls := 0
+	err := RunWithParamEncryption(nil, tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+		calls += 1
+		return errors.New("some error")
+	})
+	c.Check(err, ErrorMatches, `some error`)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *nvEncryptionSuite) createBootPolicyIndex(c *C) (handle, counterHandle tpm2.Handle) {
+	handle = s.NextAvailableHandle(c, 0x01810100)
+	counterHandle = s.NextAvailableHandle(c, handle+1)
+	c.Assert(s.TPM().CreateBootPolicyIndex(handle, counterHandle, 64), IsNil)
+	s.AddCleanup(func() {
+		for _, h := range []tpm2.Handle{handle, counterHandle} {
+			index, err := s.TPM().CreateResourceContextFromTPM(h)
+			c.Assert(err, IsNil)
+			c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+		}
+	})
+	return handle, counterHandle
+}
+
+// lastSessionAttrs returns the attributes of the session used for the last
+// instance of the specified command.
+func (s *nvEncryptionSuite) lastSessionAttrs(c *C, code tpm2.CommandCode) tpm2.SessionAttributes {
+	log := s.CommandLog()
+	for i := len(log) - 1; i >= 0; i-- {
+		if log[i].CmdCode != code {
+			continue
+		}
+		c.Assert(log[i].CmdAuthArea, HasLen, 1)
+		return log[i].CmdAuthArea[0].SessionAttributes
+	}
+	c.Fatalf("no command with code %v", code)
+	return 0
+}
+
+func (s *nvEncryptionSuite) TestRunWithParamEncryptionNoFallback(c *C) {
+	// Check that a session resource warning doesn't cause the function to be
+	// retried without parameter encryption.
+	var attrs []tpm2.SessionAttributes
+	err := RunWithParamEncryption(s.TPM().HmacSession(), tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+		attrs = append(attrs, session.Attrs())
+		return &tpm2.TPMWarning{Command: tpm2.CommandNVWrite, Code: tpm2.WarningSessionMemory}
+	})
+	c.Check(tpm2.IsTPMWarning(err, tpm2.WarningSessionMemory, tpm2.CommandNVWrite), testutil.IsTrue)
+	c.Assert(attrs, HasLen, 1)
+	c.Check(attrs[0]&tpm2.AttrCommandEncrypt, Equals, tpm2.AttrCommandEncrypt)
+}
+
+func (s *nvEncryptionSuite) TestWriteBootPolicyEncryptsCommand(c *C) {
+	handle, counterHandle := s.createBootPolicyIndex(c)
+
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy")}), IsNil)
+	c.Check(s.lastSessionAttrs(c, tpm2.CommandNVWrite)&tpm2.AttrCommandEncrypt, Equals, tpm2.AttrCommandEncrypt)
+}
+
+func (s *nvEncryptionSuite) TestReadBootPolicyDefault(c *C) {
+	handle, counterHandle := s.createBootPolicyIndex(c)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy")}), IsNil)
+
+	policy, err := s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, IsNil)
+	c.Check(policy.Version, Equals, uint32(1))
+	c.Check(policy.Data, DeepEquals, []byte("policy"))
+	c.Check(s.lastSessionAttrs(c, tpm2.CommandNVRead)&tpm2.AttrResponseEncrypt, Equals, tpm2.SessionAttributes(0))
+}
+
+func (s *nvEncryptionSuite) TestReadBootPolicyEncryptsResponse(c *C) {
+	handle, counterHandle := s.createBootPolicyIndex(c)
+	c.Check(s.TPM().WriteBootPolicy(handle, counterHandle, &BootPolicy{Version: 1, Data: []byte("policy")}), IsNil)
+
+	s.TPM().SetNVParameterEncryption(NVParameterEncryptionCommandAndResponse)
+
+	policy, err := s.TPM().ReadBootPolicy(handle, counterHandle)
+	c.Check(err, IsNil)
+	c.Check(policy.Version, Equals, uint32(1))
+	c.Check(policy.Data, DeepEquals, []byte("policy"))
+	c.Check(s.lastSessionAttrs(c, tpm2.CommandNVRead)&tpm2.AttrResponseEncrypt, Equals, tpm2.AttrResponseEncrypt)
+}
+
+func (s *nvEncryptionSuite) TestUnsealWithTransientSRKEncryptsTemplateRead(c *C) {
+	template := templates.NewRSAStorageKeyWithDefaults()
+	c.Check(s.TPM().EnsureProvisionedWithCustomSRK(ProvisionModeWithoutLockout, nil, template),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+
+	s.TPM().SetNVParameterEncryption(NVParameterEncryptionCommandAndResponse)
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	// Evict the SRK so that unsealing has to create a transient one from
+	// the stored template.
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	_, err = s.TPM().EvictControl(s.TPM().OwnerHandleContext(), srk, srk.Handle(), nil)
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+	unsealed, _, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(unsealed, DeepEquals, key)
+	c.Check(s.lastSessionAttrs(c, tpm2.CommandNVRead)&tpm2.AttrResponseEncrypt, Equals, tpm2.AttrResponseEncrypt)
+}
@@ -0,0 +1,133 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"golang.org/x/xerrors"
+)
+
+// nvGenerationCheck corresponds to a PolicyNV assertion in a PCR policy that
+// the NV index at the specified handle contains a generation of at least the
+// specified minimum, and an optional second PolicyNV assertion that it contains
+// a generation of at most the specified maximum.
+type nvGenerationCheck struct {
+	Handle  tpm2.Handle
+	Minimum uint64
+
+	// Maximum isn't part of the version 3 format, which doesn't support
+	// NV generation checks anyway. Zero means that there is no maximum.
+	Maximum uint64 `tpm2:"ignore"`
+}
+
+// readNVGenerationIndexName returns the name of the NV index required by the
+// supplied requirement, after checking that it is suitable for use in a PCR
+// policy.
+//
+// The PCR policy is bound to the name of the index, which includes its
+// attributes and authorization policy but not its authorization value. The
+// index must therefore be a counter so that its value can't be decreased, and
+// writes must require the authorization of the storage or platform hierarchy or
+// satisfaction of the index's authorization policy. An index that can be
+// written with its authorization value is rejected, as anyone who can delete
+// it could recreate it with the same name and an authorization value of their
+// choosing.
+func readNVGenerationIndexName(tpm *tpm2.TPMContext, req *NVGenerationRequirement) (tpm2.Name, error) {
+	index, err := tpm.CreateResourceContextFromTPM(req.Handle)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+	pub, name, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	switch {
+	case pub.Attrs.Type() != tpm2.NVTypeCounter:
+		return nil, errors.New("NV index is not a counter")
+	case pub.Attrs&tpm2.AttrNVAuthRead == 0:
+		return nil, errors.New("NV index cannot be read with its authorization value")
+	case pub.Attrs&tpm2.AttrNVAuthWrite != 0:
+		return nil, errors.New("NV index can be written with its authorization value")
+	case pub.Attrs&tpm2.AttrNVPolicyDelete != 0:
+		return nil, errors.New("NV index has the TPMA_NV_POLICY_DELETE attribute")
+	case pub.Attrs&tpm2.AttrNVWritten == 0:
+		return nil, errors.New("NV index has not been written")
+	}
+	return name, nil
+}
+
+func (d *pcrPolicyData_v0) addNVGenerationCheck(trial *util.TrialAuthPolicy, indexName tpm2.Name, check *nvGenerationCheck) {
+	operandB := make([]byte, 8)
+	binary.BigEndian.PutUint64(operandB, check.Minimum)
+	trial.PolicyNV(indexName, operandB, 0, tpm2.OpUnsignedGE)
+	if check.Maximum != 0 {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, check.Maximum)
+		trial.PolicyNV(indexName, operandB, 0, tpm2.OpUnsignedLE)
+	}
+	d.NVGeneration = check
+}
+
+func (d *pcrPolicyData_v0) executeNVGenerationCheck(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
+	handle := d.NVGeneration.Handle
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return policyDataError{fmt.Errorf("invalid handle %v for NV generation index", handle)}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		// If there is no NV index at the expected handle then the PCR policy
+		// can't be satisfied and must be updated.
+		return policyDataError{errors.New("no NV generation index found")}
+	case err != nil:
+		return err
+	}
+
+	operandB := make([]byte, 8)
+	binary.BigEndian.PutUint64(operandB, d.NVGeneration.Minimum)
+	if err := tpm.PolicyNV(index, index, policySession, operandB, 0, tpm2.OpUnsignedGE, nil); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+			// The generation is lower than the minimum.
+			return policyDataError{fmt.Errorf("the NV generation is lower than the required minimum of %d", d.NVGeneration.Minimum)}
+		}
+		return xerrors.Errorf("cannot complete NV generation check: %w", err)
+	}
+
+	if d.NVGeneration.Maximum == 0 {
+		return nil
+	}
+
+	binary.BigEndian.PutUint64(operandB, d.NVGeneration.Maximum)
+	if err := tpm.PolicyNV(index, index, policySession, operandB, 0, tpm2.OpUnsignedLE, nil); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+			// The generation is higher than the maximum.
+			return policyDataError{fmt.Errorf("the NV generation is higher than the permitted maximum of %d", d.NVGeneration.Maximum)}
+		}
+		return xerrors.Errorf("cannot complete NV generation check: %w", err)
+	}
+
+	return nil
+}
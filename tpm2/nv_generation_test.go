@@ -0,0 +1,362 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type nvGenerationSuiteNoTPM struct{}
+
+type nvGenerationSuite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+}
+
+func (s *nvGenerationSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&nvGenerationSuiteNoTPM{})
+var _ = Suite(&nvGenerationSuite{})
+
+func (s *nvGenerationSuiteNoTPM) TestRequireNVGeneration(c *C) {
+	profile := NewPCRProtectionProfile().RequireNVGeneration(0x01880010, 3)
+	c.Check(profile.NVGenerationRequirement(), DeepEquals, &NVGenerationRequirement{Handle: 0x01880010, Minimum: 3})
+	c.Check(NewPCRProtectionProfile().NVGenerationRequirement(), IsNil)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestRequireNVGenerationInvalidHandle(c *C) {
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		RequireNVGeneration(0x81000000, 3)
+	_, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, `cannot compute PCR values because an error occurred when constructing the profile: invalid NV index handle \(occurred at .*\)`)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestAddProfileORMergesNVGeneration(c *C) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().RequireNVGeneration(0x01880010, 3),
+		NewPCRProtectionProfile(),
+		NewPCRProtectionProfile().RequireNVGeneration(0x01880010, 5))
+	c.Check(profile.NVGenerationRequirement(), DeepEquals, &NVGenerationRequirement{Handle: 0x01880010, Minimum: 5})
+}
+
+func (s *nvGenerationSuiteNoTPM) TestRequireNVGenerationRange(c *C) {
+	profile := NewPCRProtectionProfile().RequireNVGenerationRange(0x01880010, 3, 5)
+	c.Check(profile.NVGenerationRequirement(), DeepEquals, &NVGenerationRequirement{Handle: 0x01880010, Minimum: 3, Maximum: 5})
+}
+
+func (s *nvGenerationSuiteNoTPM) TestRequireNVGenerationRangeInvalid(c *C) {
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		RequireNVGenerationRange(0x01880010, 5, 3)
+	_, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, `cannot compute PCR values because an error occurred when constructing the profile: invalid NV generation range \(occurred at .*\)`)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestAddProfileORMergesNVGenerationRange(c *C) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().RequireNVGenerationRange(0x01880010, 3, 8),
+		NewPCRProtectionProfile().RequireNVGeneration(0x01880010, 4),
+		NewPCRProtectionProfile().RequireNVGenerationRange(0x01880010, 1, 6))
+	c.Check(profile.NVGenerationRequirement(), DeepEquals, &NVGenerationRequirement{Handle: 0x01880010, Minimum: 4, Maximum: 6})
+}
+
+func (s *nvGenerationSuiteNoTPM) TestAddProfileORNVGenerationRangeEmpty(c *C) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).RequireNVGenerationRange(0x01880010, 1, 3),
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).RequireNVGeneration(0x01880010, 4))
+	_, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, `cannot compute PCR values because an error occurred when constructing the profile: sub-profiles require NV generations that can't be satisfied together \(occurred at .*\)`)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestAddProfileORDifferentNVIndices(c *C) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).RequireNVGeneration(0x01880010, 3),
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).RequireNVGeneration(0x01880011, 3))
+	_, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, `cannot compute PCR values because an error occurred when constructing the profile: sub-profiles require generations from different NV indices \(occurred at .*\)`)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestNewExternalKeyWithNVGeneration(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&key.PublicKey)
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		RequireNVGeneration(0x01880010, 3)
+	_, _, _, err = NewExternalTPMProtectedKey(srk, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, ErrorMatches, `cannot set initial PCR policy: TPM connection required to update PCR policy with NV generation requirement`)
+}
+
+func (s *nvGenerationSuiteNoTPM) newKeyData(c *C) KeyData {
+	return s.newKeyDataWithMaximum(c, 0)
+}
+
+func (s *nvGenerationSuiteNoTPM) newKeyDataWithMaximum(c *C, maximum uint64) KeyData {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, false, false, nil)
+	c.Assert(err, IsNil)
+
+	nvName := tpm2.Name(append([]byte{0x00, 0x0b}, make([]byte, 32)...))
+	params := NewPcrPolicyParams(primaryKey,
+		tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		tpm2.DigestList{make(tpm2.Digest, 32)}, nil, 0).WithNVGenerationRange(0x01880010, 3, maximum, nvName)
+	c.Assert(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(tpm2.Private{1, 2, 3, 4}, pub, nil, policy)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *nvGenerationSuiteNoTPM) TestKeyDataWithNVGenerationIsV4(c *C) {
+	data := s.newKeyData(c)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.NVGeneration, DeepEquals, &NVGenerationCheck{Handle: 0x01880010, Minimum: 3})
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.RequireEndorsementAuth, testutil.IsFalse)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestKeyDataWithNVGenerationMaximumIsV4(c *C) {
+	data := s.newKeyDataWithMaximum(c, 5)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.NVGeneration, DeepEquals, &NVGenerationCheck{Handle: 0x01880010, Minimum: 3, Maximum: 5})
+	c.Check(read.Policy().(*KeyDataPolicy_v3).StaticData.NullHierarchyDevMode, testutil.IsFalse)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *nvGenerationSuiteNoTPM) TestPolicyDescriptionWithMaximum(c *C) {
+	desc, err := NewPolicyDescription(s.newKeyDataWithMaximum(c, 5))
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 1)
+	pcrPolicy := desc.Policy[0].AuthorizedPolicy
+	c.Assert(pcrPolicy, NotNil)
+	c.Assert(pcrPolicy.Policy, HasLen, 4)
+	c.Check(pcrPolicy.Policy[3], DeepEquals, PolicyElementDescription{
+		Type:        "POLICYNV",
+		Description: "the NV index must contain a generation that is not higher than the maximum",
+		NVIndex:     "0x01880010",
+		OperandB:    "0000000000000005",
+		Operation:   "UNSIGNED_LE"})
+}
+
+func (s *nvGenerationSuiteNoTPM) TestPolicyDescription(c *C) {
+	desc, err := NewPolicyDescription(s.newKeyData(c))
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 1)
+	pcrPolicy := desc.Policy[0].AuthorizedPolicy
+	c.Assert(pcrPolicy, NotNil)
+	c.Assert(pcrPolicy.Policy, HasLen, 3)
+	c.Check(pcrPolicy.Policy[2], DeepEquals, PolicyElementDescription{
+		Type:        "POLICYNV",
+		Description: "the NV index must contain a generation that is not lower than the minimum",
+		NVIndex:     "0x01880010",
+		OperandB:    "0000000000000003",
+		Operation:   "UNSIGNED_GE"})
+}
+
+func (s *nvGenerationSuite) defineGenerationCounter(c *C, generation int) tpm2.ResourceContext {
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01880010),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8})
+	for i := 0; i < generation; i++ {
+		c.Assert(s.TPM().NVIncrement(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+	}
+	return index
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexName(c *C) {
+	index := s.defineGenerationCounter(c, 1)
+	name, err := ReadNVGenerationIndexName(s.TPM().TPMContext, &NVGenerationRequirement{Handle: index.Handle(), Minimum: 1})
+	c.Check(err, IsNil)
+	c.Check(name, DeepEquals, index.Name())
+}
+
+func (s *nvGenerationSuite) testReadNVGenerationIndexNameInvalid(c *C, attrs tpm2.NVAttributes, size uint16, increment bool) error {
+	public := &tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01880010),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   attrs,
+		Size:    size}
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, public)
+	if increment {
+		c.Assert(s.TPM().NVIncrement(index, index, nil), IsNil)
+	}
+	_, err := ReadNVGenerationIndexName(s.TPM().TPMContext, &NVGenerationRequirement{Handle: index.Handle(), Minimum: 1})
+	return err
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexNameNotCounter(c *C) {
+	err := s.testReadNVGenerationIndexNameInvalid(c, tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA), 8, false)
+	c.Check(err, ErrorMatches, `NV index is not a counter`)
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexNameNoAuthRead(c *C) {
+	err := s.testReadNVGenerationIndexNameInvalid(c, tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVOwnerWrite|tpm2.AttrNVOwnerRead|tpm2.AttrNVNoDA), 8, false)
+	c.Check(err, ErrorMatches, `NV index cannot be read with its authorization value`)
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexNameAuthWrite(c *C) {
+	err := s.testReadNVGenerationIndexNameInvalid(c, tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA), 8, true)
+	c.Check(err, ErrorMatches, `NV index can be written with its authorization value`)
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexNameNotWritten(c *C) {
+	err := s.testReadNVGenerationIndexNameInvalid(c, tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVOwnerWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA), 8, false)
+	c.Check(err, ErrorMatches, `NV index has not been written`)
+}
+
+func (s *nvGenerationSuite) TestReadNVGenerationIndexNameNoIndex(c *C) {
+	_, err := ReadNVGenerationIndexName(s.TPM().TPMContext, &NVGenerationRequirement{Handle: s.NextAvailableHandle(c, 0x01880010), Minimum: 1})
+	c.Check(err, ErrorMatches, `cannot create context for NV index: .*`)
+}
+
+func (s *nvGenerationSuite) testExecutePCRPolicy(c *C, index tpm2.ResourceContext, minimum uint64) error {
+	return s.testExecutePCRPolicyWithRange(c, index, minimum, 0)
+}
+
+func (s *nvGenerationSuite) testExecutePCRPolicyWithRange(c *C, index tpm2.ResourceContext, minimum, maximum uint64) error {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, primaryKey)
+
+	policyData, expectedDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKeyPublic, "", nil, false, false, nil)
+	c.Assert(err, IsNil)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}}
+	_, values, err := s.TPM().PCRRead(pcrs)
+	c.Assert(err, IsNil)
+	digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+	c.Assert(err, IsNil)
+
+	params := NewPcrPolicyParams(primaryKey, pcrs, tpm2.DigestList{digest}, nil, 0).WithNVGenerationRange(index.Handle(), minimum, maximum, index.Name())
+	c.Assert(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err := policyData.ExecutePCRPolicy(s.TPM().TPMContext, session, s.TPM().HmacSession()); err != nil {
+		return err
+	}
+
+	digest, err = s.TPM().PolicyGetDigest(session)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expectedDigest)
+	return nil
+}
+
+func (s *nvGenerationSuite) TestExecutePCRPolicyWithNVGeneration(c *C) {
+	index := s.defineGenerationCounter(c, 3)
+	c.Check(s.testExecutePCRPolicy(c, index, 3), IsNil)
+	c.Check(s.testExecutePCRPolicy(c, index, 1), IsNil)
+}
+
+func (s *nvGenerationSuite) TestExecutePCRPolicyWithNVGenerationTooLow(c *C) {
+	index := s.defineGenerationCounter(c, 3)
+	err := s.testExecutePCRPolicy(c, index, 4)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, `the NV generation is lower than the required minimum of 4`)
+}
+
+func (s *nvGenerationSuite) TestExecutePCRPolicyWithNVGenerationRange(c *C) {
+	index := s.defineGenerationCounter(c, 3)
+	c.Check(s.testExecutePCRPolicyWithRange(c, index, 1, 3), IsNil)
+	c.Check(s.testExecutePCRPolicyWithRange(c, index, 3, 5), IsNil)
+}
+
+func (s *nvGenerationSuite) TestExecutePCRPolicyWithNVGenerationTooHigh(c *C) {
+	index := s.defineGenerationCounter(c, 3)
+	err := s.testExecutePCRPolicyWithRange(c, index, 1, 2)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, `the NV generation is higher than the permitted maximum of 2`)
+}
+
+func (s *nvGenerationSuite) TestExecutePCRPolicyWithNVGenerationMissingIndex(c *C) {
+	index := s.defineGenerationCounter(c, 3)
+	handle := index.Handle()
+	name := index.Name()
+	c.Assert(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, primaryKey)
+	policyData, _, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKeyPublic, "", nil, false, false, nil)
+	c.Assert(err, IsNil)
+
+	params := NewPcrPolicyParams(primaryKey, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}},
+		tpm2.DigestList{make(tpm2.Digest, 32)}, nil, 0).WithNVGeneration(handle, 3, name)
+	c.Assert(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	err = policyData.ExecutePCRPolicy(s.TPM().TPMContext, session, s.TPM().HmacSession())
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, `no NV generation index found`)
+}
@@ -0,0 +1,274 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/policyutil"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/testhooks"
+)
+
+// osVersionCounterPolicyRef is the policy reference that signed authorizations
+// for incrementing an OS version counter are bound to.
+var osVersionCounterPolicyRef = tpm2.Nonce("OS-VERSION-INCREMENT")
+
+// computeOSVersionCounterAuthPolicies computes the authorization policy digests
+// passed to TPM2_PolicyOR for an OS version counter that can be incremented with
+// a signed authorization from the key associated with authKeyName.
+func computeOSVersionCounterAuthPolicies(alg tpm2.HashAlgorithmId, authKeyName tpm2.Name) tpm2.DigestList {
+	// The NV index requires 3 policies:
+	// - A policy to read the index with no authorization.
+	// - A policy to initialize the index with no authorization.
+	// - A policy for incrementing the index using a signed assertion.
+	var authPolicies tpm2.DigestList
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVRead)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(alg)
+	trial.PolicyNvWritten(false)
+	trial.PolicyCommandCode(tpm2.CommandNVIncrement)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(authKeyName, osVersionCounterPolicyRef)
+	trial.PolicyCommandCode(tpm2.CommandNVIncrement)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	return authPolicies
+}
+
+func newOSVersionCounterPublic(handle tpm2.Handle, authKey *tpm2.Public) *tpm2.NVPublic {
+	nameAlg := tpm2.HashAlgorithmSHA256
+
+	trial := util.ComputeAuthPolicy(nameAlg)
+	trial.PolicyOR(computeOSVersionCounterAuthPolicies(nameAlg, authKey.Name()))
+
+	return &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA),
+		AuthPolicy: trial.GetDigest(),
+		Size:       8}
+}
+
+// CreateOSVersionCounter creates and initializes a NV counter at the specified
+// handle for preventing rollback of the OS to an older version. The handle should
+// be in the range reserved for owner indices. The counter can be read by anyone,
+// so it can be checked by a bootloader, and its value can be asserted in the PCR
+// policy of a sealed key by using PCRProtectionProfile.RequireNVGenerationRange. It
+// can only be incremented with a signed authorization from the key associated with
+// the supplied public area, using IncrementOSVersionCounter. As the value of a NV
+// counter can never decrease, this makes it possible to prevent a device from
+// automatically unlocking its disk with a key that was sealed for an OS version
+// that has been revoked.
+//
+// In order for this to prevent rollback, the PCR policy of a key that is sealed for
+// OS version V must require that the counter is no higher than V, by specifying a
+// maximum of V with PCRProtectionProfile.RequireNVGenerationRange. Once the counter
+// has been incremented past V, the key can't be unsealed even if the device is
+// rolled back to OS version V along with its key data. Note that a minimum alone
+// doesn't prevent rollback, as the counter will continue to satisfy the PCR policy
+// of an older key.
+//
+// The TPM initializes a new NV counter to the highest value of any NV counter that
+// has existed on it, so the initial value is returned and OS versions should be
+// expressed relative to it.
+//
+// The authorization value for the storage hierarchy must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function.
+// If there is already a NV index at the specified handle, a TPMResourceExistsError
+// error is returned.
+func (t *Connection) CreateOSVersionCounter(handle tpm2.Handle, authKey *tpm2.Public) (initialValue uint64, err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return 0, errors.New("invalid handle type")
+	}
+	if authKey == nil || !authKey.IsAsymmetric() {
+		return 0, errors.New("invalid authorization key")
+	}
+
+	public := newOSVersionCounterPublic(handle, authKey)
+
+	index, err := t.NVDefineSpace(t.OwnerHandleContext(), nil, public, t.HmacSession())
+	if err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return 0, TPMResourceExistsError{handle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return 0, AuthFailError{tpm2.HandleOwner}
+		}
+		return 0, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		t.NVUndefineSpace(t.OwnerHandleContext(), index, t.HmacSession())
+	}()
+
+	// Begin a session to initialize the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseSession()
+	policySession, err := t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer t.FlushContext(policySession)
+
+	if err := t.PolicyNvWritten(policySession, false); err != nil {
+		return 0, err
+	}
+	if err := t.PolicyCommandCode(policySession, tpm2.CommandNVIncrement); err != nil {
+		return 0, err
+	}
+	if err := t.PolicyOR(policySession, computeOSVersionCounterAuthPolicies(public.NameAlg, authKey.Name())); err != nil {
+		return 0, err
+	}
+
+	if err := t.NVIncrement(index, index, policySession); err != nil {
+		return 0, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	value, err := t.NVReadCounter(index, index, nil)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+	return value, nil
+}
+
+func (t *Connection) osVersionCounterIndex(handle tpm2.Handle) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	index, err := t.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+	pub, _, err := t.NVReadPublic(index)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if pub.Attrs.Type() != tpm2.NVTypeCounter || pub.Attrs&tpm2.AttrNVAuthRead == 0 {
+		return nil, nil, errors.New("NV index has the wrong type or attributes")
+	}
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, nil, errors.New("NV index has not been initialized")
+	}
+	return index, pub, nil
+}
+
+// ReadOSVersionCounter reads the current value of the OS version counter at the
+// specified handle, which must have been created by CreateOSVersionCounter.
+func (t *Connection) ReadOSVersionCounter(handle tpm2.Handle) (uint64, error) {
+	index, _, err := t.osVersionCounterIndex(handle)
+	if err != nil {
+		return 0, err
+	}
+	value, err := t.NVReadCounter(index, index, nil)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+	return value, nil
+}
+
+// IncrementOSVersionCounter increments the OS version counter at the specified
+// handle, which must have been created by CreateOSVersionCounter with the supplied
+// authorization key. The increment is authorized with a signature from the supplied
+// signer, which must be the private part of authKey. The signature is bound to a
+// fresh TPM session, so it can't be replayed. The signer may be backed by a remote
+// service or hardware security module. The new value of the counter is returned.
+//
+// Once the counter is incremented, any sealed key with a PCR policy that requires
+// a lower maximum value with PCRProtectionProfile.RequireNVGenerationRange can no
+// longer be unsealed, so keys for the new OS version must be resealed with a maximum
+// of at least the new value before incrementing the counter.
+func (t *Connection) IncrementOSVersionCounter(handle tpm2.Handle, authKey *tpm2.Public, signer crypto.Signer) (uint64, error) {
+	if authKey == nil || !authKey.IsAsymmetric() {
+		return 0, errors.New("invalid authorization key")
+	}
+
+	index, pub, err := t.osVersionCounterIndex(handle)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(pub.AuthPolicy, newOSVersionCounterPublic(handle, authKey).AuthPolicy) {
+		return 0, errors.New("NV index is not associated with the supplied authorization key")
+	}
+
+	// Begin a policy session to increment the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseSession()
+	policySession, err := t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, pub.NameAlg)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer t.FlushContext(policySession)
+
+	// Load the public part of the key in to the TPM. There's no integrity protection for this
+	// command as if it's altered in transit then either the signature verification fails or
+	// the policy digest will not match the one associated with the NV index.
+	keyLoaded, err := t.LoadExternal(nil, authKey, tpm2.HandleEndorsement)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot load authorization key: %w", err)
+	}
+	defer t.FlushContext(keyLoaded)
+
+	auth, err := policyutil.SignPolicySignedAuthorization(testhooks.RandReader, &policyutil.PolicySignedParams{NonceTPM: policySession.NonceTPM()},
+		authKey, osVersionCounterPolicyRef, signer, authKey.NameAlg.GetHash())
+	if err != nil {
+		return 0, xerrors.Errorf("cannot sign authorization: %w", err)
+	}
+
+	if _, _, err := t.PolicySigned(keyLoaded, policySession, true, nil, osVersionCounterPolicyRef, 0, auth.Signature); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5) {
+			return 0, errors.New("invalid signature for authorization key")
+		}
+		return 0, xerrors.Errorf("cannot execute PolicySigned assertion: %w", err)
+	}
+	if err := t.PolicyCommandCode(policySession, tpm2.CommandNVIncrement); err != nil {
+		return 0, err
+	}
+	if err := t.PolicyOR(policySession, computeOSVersionCounterAuthPolicies(pub.NameAlg, authKey.Name())); err != nil {
+		return 0, err
+	}
+
+	if err := t.NVIncrement(index, index, policySession); err != nil {
+		return 0, xerrors.Errorf("cannot increment NV index: %w", err)
+	}
+
+	value, err := t.NVReadCounter(index, index, nil)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,196 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type osVersionCounterSuiteNoTPM struct{}
+
+type osVersionCounterSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *osVersionCounterSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&osVersionCounterSuiteNoTPM{})
+var _ = Suite(&osVersionCounterSuite{})
+
+func (s *osVersionCounterSuiteNoTPM) TestComputeAuthPolicies(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authKey := util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &key.PublicKey)
+
+	policies := ComputeOSVersionCounterAuthPolicies(tpm2.HashAlgorithmSHA256, authKey.Name())
+	c.Assert(policies, HasLen, 3)
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySigned(authKey.Name(), []byte("OS-VERSION-INCREMENT"))
+	trial.PolicyCommandCode(tpm2.CommandNVIncrement)
+	c.Check(policies[2], DeepEquals, trial.GetDigest())
+
+	key2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authKey2 := util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &key2.PublicKey)
+
+	policies2 := ComputeOSVersionCounterAuthPolicies(tpm2.HashAlgorithmSHA256, authKey2.Name())
+	c.Check(policies2[:2], DeepEquals, policies[:2])
+	c.Check(policies2[2], Not(DeepEquals), policies[2])
+}
+
+func (s *osVersionCounterSuite) createCounter(c *C) (tpm2.Handle, uint64, *tpm2.Public, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authKey := util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &key.PublicKey)
+
+	handle := s.NextAvailableHandle(c, 0x01880020)
+	initialValue, err := s.TPM().CreateOSVersionCounter(handle, authKey)
+	c.Assert(err, IsNil)
+	s.AddCleanup(func() {
+		index, err := s.TPM().CreateResourceContextFromTPM(handle)
+		c.Assert(err, IsNil)
+		c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+	})
+	return handle, initialValue, authKey, key
+}
+
+func (s *osVersionCounterSuite) TestCreate(c *C) {
+	handle, initialValue, _, _ := s.createCounter(c)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	pub, _, err := s.TPM().NVReadPublic(index)
+	c.Assert(err, IsNil)
+	c.Check(pub.Attrs, Equals, tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVPolicyRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten))
+
+	value, err := s.TPM().ReadOSVersionCounter(handle)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue)
+}
+
+func (s *osVersionCounterSuite) TestCreateExists(c *C) {
+	handle, _, authKey, _ := s.createCounter(c)
+
+	_, err := s.TPM().CreateOSVersionCounter(handle, authKey)
+	c.Check(err, Equals, TPMResourceExistsError{handle})
+}
+
+func (s *osVersionCounterSuite) TestCreateInvalidHandle(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authKey := util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &key.PublicKey)
+
+	_, err = s.TPM().CreateOSVersionCounter(0x81000001, authKey)
+	c.Check(err, ErrorMatches, `invalid handle type`)
+}
+
+func (s *osVersionCounterSuite) TestIncrement(c *C) {
+	handle, initialValue, authKey, signer := s.createCounter(c)
+
+	value, err := s.TPM().IncrementOSVersionCounter(handle, authKey, signer)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue+1)
+
+	value, err = s.TPM().IncrementOSVersionCounter(handle, authKey, signer)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue+2)
+
+	value, err = s.TPM().ReadOSVersionCounter(handle)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue+2)
+}
+
+func (s *osVersionCounterSuite) TestIncrementWrongKey(c *C) {
+	handle, initialValue, _, _ := s.createCounter(c)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authKey := util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &key.PublicKey)
+
+	_, err = s.TPM().IncrementOSVersionCounter(handle, authKey, key)
+	c.Check(err, ErrorMatches, `NV index is not associated with the supplied authorization key`)
+
+	value, err := s.TPM().ReadOSVersionCounter(handle)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue)
+}
+
+func (s *osVersionCounterSuite) TestIncrementWrongSigner(c *C) {
+	handle, initialValue, authKey, _ := s.createCounter(c)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	_, err = s.TPM().IncrementOSVersionCounter(handle, authKey, key)
+	c.Check(err, ErrorMatches, `invalid signature for authorization key`)
+
+	value, err := s.TPM().ReadOSVersionCounter(handle)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initialValue)
+}
+
+func (s *osVersionCounterSuite) TestReadWrongType(c *C) {
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01880020),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8})
+
+	_, err := s.TPM().ReadOSVersionCounter(index.Handle())
+	c.Check(err, ErrorMatches, `NV index has the wrong type or attributes`)
+}
+
+func (s *osVersionCounterSuite) TestIncrementRevokesKeysForOlderVersions(c *C) {
+	handle, initialValue, authKey, signer := s.createCounter(c)
+
+	// Seal a key for the current OS version.
+	k, _, unlockKey, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile: tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}).
+			RequireNVGenerationRange(handle, initialValue, initialValue),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	recoveredKey, _, err := k.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey)
+
+	// Revoke the current OS version.
+	_, err = s.TPM().IncrementOSVersionCounter(handle, authKey, signer)
+	c.Assert(err, IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, fmt.Sprintf(`.*the NV generation is higher than the permitted maximum of %d`, initialValue))
+}
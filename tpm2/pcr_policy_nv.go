@@ -0,0 +1,444 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// PCR policies can be authorized by a pair of NV indices rather than with a
+// signature stored in the key data. In this mode, the static policy contains a
+// TPM2_PolicyAuthorizeNV assertion for a NV index that contains the digest of
+// the current PCR policy, and the metadata required to execute the PCR policy
+// is stored in a second NV index at the next handle. Updating the PCR policy
+// only writes to these indices, so the key data doesn't have to be rewritten,
+// which is useful where it is stored in a read-only location. Writing a new
+// digest to the NV index also revokes all previous PCR policies, so a PCR
+// policy counter isn't used in this mode.
+//
+// Both indices can only be written with a signed authorization from the key
+// used to authorize PCR policies, which is bound to the static policy via the
+// name of the first index.
+
+const (
+	// pcrPolicyNVDataMaxSize is the maximum size of the NV index that contains
+	// the PCR policy metadata. The index is smaller than this if the TPM's
+	// TPM_PT_NV_INDEX_MAX property is smaller.
+	pcrPolicyNVDataMaxSize = 2048
+
+	pcrPolicyNVIndexAttrs = tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA
+)
+
+// pcrPolicyNVData is the PCR policy metadata stored in the NV index at the
+// handle following the one that contains the PCR policy digest. The index is
+// always written in its entirety, with the unused space padded with zeros.
+type pcrPolicyNVData struct {
+	Selection tpm2.PCRSelectionList
+	OrData    policyOrData_v0
+}
+
+// pcrPolicyNVDataHandle returns the handle of the NV index containing the PCR
+// policy metadata for the PCR policy NV index with the supplied handle.
+func pcrPolicyNVDataHandle(handle tpm2.Handle) tpm2.Handle {
+	return handle + 1
+}
+
+// computePcrPolicyNVIndexAuthPolicy computes the authorization policy for the
+// PCR policy NV indices, which permits them to be written with a signed
+// authorization from the key associated with updateKeyName and the supplied
+// policyRef. The policyRef binds the role to the indices.
+func computePcrPolicyNVIndexAuthPolicy(alg tpm2.HashAlgorithmId, updateKeyName tpm2.Name, policyRef tpm2.Nonce) tpm2.Digest {
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(updateKeyName, policyRef)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	return trial.GetDigest()
+}
+
+// computePolicyAuthorizeNVDigest computes the session digest that results from
+// a TPM2_PolicyAuthorizeNV assertion for the NV index with the supplied name.
+// The assertion resets the session digest, so it must be the first assertion
+// in a policy.
+func computePolicyAuthorizeNVDigest(alg tpm2.HashAlgorithmId, nvIndexName tpm2.Name) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(make([]byte, alg.Size()))
+	binary.Write(h, binary.BigEndian, tpm2.CommandPolicyAuthorizeNV)
+	h.Write(nvIndexName)
+	return h.Sum(nil)
+}
+
+// executePolicyAuthorizeNV executes a TPM2_PolicyAuthorizeNV assertion for the
+// supplied NV index, which must be readable with an empty authorization value.
+func executePolicyAuthorizeNV(tpm *tpm2.TPMContext, index tpm2.ResourceContext, policySession tpm2.SessionContext) error {
+	return tpm.StartCommand(tpm2.CommandPolicyAuthorizeNV).
+		AddHandles(tpm2.UseResourceContextWithAuth(index, nil), tpm2.UseHandleContext(index), tpm2.UseHandleContext(policySession)).
+		Run(nil)
+}
+
+// createPcrPolicyNVIndices creates the pair of NV indices used to authorize PCR
+// policies, starting at the supplied handle. The indices can be written with a
+// signed authorization from updateKey, using the supplied policyRef.
+//
+// On success, it returns the public area of the index that will contain the
+// PCR policy digest, with the AttrNVWritten attribute set so that it can be
+// used to compute the static policy. The index is written when the initial PCR
+// policy is created.
+//
+// If hmacSession is supplied, it is used for authenticating with the storage hierarchy, in order to avoid
+// transmitting the cleartext auth value, and must have the AttrContinueSession attribute set
+var createPcrPolicyNVIndices = func(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, policyRef tpm2.Nonce, hmacSession tpm2.SessionContext) (public *tpm2.NVPublic, err error) {
+	nameAlg := updateKey.NameAlg
+	authPolicy := computePcrPolicyNVIndexAuthPolicy(nameAlg, updateKey.Name(), policyRef)
+
+	dataSize := uint32(pcrPolicyNVDataMaxSize)
+	indexMax, err := tpm.GetCapabilityTPMProperty(tpm2.PropertyNVIndexMax)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine maximum NV index size: %w", err)
+	}
+	if indexMax < dataSize {
+		dataSize = indexMax
+	}
+
+	public = &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(pcrPolicyNVIndexAttrs),
+		AuthPolicy: authPolicy,
+		Size:       uint16(binary.Size(tpm2.HashAlgorithmId(0)) + nameAlg.Size())}
+	dataPublic := &tpm2.NVPublic{
+		Index:      pcrPolicyNVDataHandle(handle),
+		NameAlg:    nameAlg,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(pcrPolicyNVIndexAttrs),
+		AuthPolicy: authPolicy,
+		Size:       uint16(dataSize)}
+
+	for _, pub := range []*tpm2.NVPublic{public, dataPublic} {
+		var index tpm2.ResourceContext
+		index, err = tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, pub, hmacSession)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+		}()
+	}
+
+	// The index has a different name once it has been written, so update the public area
+	// we return so that it can be used to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+	return public, nil
+}
+
+// pcrPolicyNVIndexContext corresponds to one of the NV indices used to authorize PCR
+// policies.
+type pcrPolicyNVIndexContext struct {
+	tpm       *tpm2.TPMContext
+	index     tpm2.ResourceContext
+	size      uint16
+	updateKey *tpm2.Public
+	policyRef tpm2.Nonce
+}
+
+// newPcrPolicyNVIndexContext returns a context for the PCR policy NV index at the supplied
+// handle, after checking that its public area is consistent with updateKey and policyRef.
+func newPcrPolicyNVIndexContext(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, policyRef tpm2.Nonce) (*pcrPolicyNVIndexContext, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area: %w", err)
+	}
+	if pub.NameAlg != updateKey.NameAlg ||
+		pub.Attrs&^tpm2.AttrNVWritten != tpm2.NVTypeOrdinary.WithAttrs(pcrPolicyNVIndexAttrs) ||
+		!bytes.Equal(pub.AuthPolicy, computePcrPolicyNVIndexAuthPolicy(updateKey.NameAlg, updateKey.Name(), policyRef)) {
+		return nil, fmt.Errorf("NV index %v has an unexpected public area", handle)
+	}
+
+	return &pcrPolicyNVIndexContext{
+		tpm:       tpm,
+		index:     index,
+		size:      pub.Size,
+		updateKey: updateKey,
+		policyRef: policyRef}, nil
+}
+
+// write writes the supplied data to the start of the index, using the supplied key to
+// sign the authorization for each TPM2_NV_Write command.
+func (c *pcrPolicyNVIndexContext) write(key *ecdsa.PrivateKey, data []byte) error {
+	if len(data) > int(c.size) {
+		return fmt.Errorf("data is too large for NV index (%d bytes, maximum %d bytes)", len(data), c.size)
+	}
+
+	bufferMax, err := c.tpm.GetCapabilityTPMProperty(tpm2.PropertyNVBufferMax)
+	if err != nil {
+		return xerrors.Errorf("cannot determine maximum NV buffer size: %w", err)
+	}
+	if bufferMax == 0 {
+		return errors.New("invalid maximum NV buffer size")
+	}
+
+	// Begin a policy session to write to the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
+	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(policySession)
+
+	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
+	// transit then either the signature verification fails or the policy digest will not match the one associated with the NV
+	// index.
+	keyLoaded, err := c.tpm.LoadExternal(nil, c.updateKey, tpm2.HandleEndorsement)
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(keyLoaded)
+
+	scheme := tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{
+				HashAlg: c.updateKey.NameAlg}}}
+
+	// The data may need to be written with more than one command, each of
+	// which requires a new signed authorization.
+	for offset := 0; offset < len(data); {
+		n := len(data) - offset
+		if n > int(bufferMax) {
+			n = int(bufferMax)
+		}
+
+		signature, err := util.SignPolicyAuthorization(key, &scheme, policySession.NonceTPM(), nil, c.policyRef, 0)
+		if err != nil {
+			return xerrors.Errorf("cannot sign authorization: %w", err)
+		}
+		if _, _, err := c.tpm.PolicySigned(keyLoaded, policySession, true, nil, c.policyRef, 0, signature); err != nil {
+			return err
+		}
+		if err := c.tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite); err != nil {
+			return err
+		}
+		if err := c.tpm.NVWrite(c.index, c.index, data[offset:offset+n], uint16(offset), policySession.WithAttrs(tpm2.AttrContinueSession)); err != nil {
+			return err
+		}
+
+		offset += n
+	}
+
+	return nil
+}
+
+// usesPCRPolicyNVIndex indicates whether PCR policies for this key are authorized by a
+// NV index with a TPM2_PolicyAuthorizeNV assertion rather than by a signature.
+func (p *keyDataPolicy_v3) usesPCRPolicyNVIndex() bool {
+	return p.StaticData.PCRPolicyNVIndexHandle.Type() == tpm2.HandleTypeNVIndex
+}
+
+// updatePCRPolicyNV updates the PCR policy associated with this keyDataPolicy for keys
+// where PCR policies are authorized by a NV index. This computes a PCR policy as described
+// in UpdatePCRPolicy, and then writes its metadata and digest to the PCR policy NV indices
+// with an authorization signed by the supplied key, which immediately replaces the previous
+// PCR policy. The PCR policy metadata in this keyDataPolicy is also updated, although it
+// isn't used for executing the policy.
+func (p *keyDataPolicy_v3) updatePCRPolicyNV(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error {
+	if tpm == nil {
+		return errors.New("TPM connection required to update PCR policy stored in NV index")
+	}
+	if params.nvGeneration != nil {
+		return errors.New("NV generation requirements are not supported for PCR policies stored in a NV index")
+	}
+	if params.resetCount != nil {
+		return errors.New("reset count requirements are not supported for PCR policies stored in a NV index")
+	}
+
+	pcrData, approvedPolicy, err := p.computePCRPolicy(alg, params)
+	if err != nil {
+		return err
+	}
+
+	key, err := deriveV3PolicyAuthKey(p.StaticData.AuthPublicKey.NameAlg.GetHash(), params.key)
+	if err != nil {
+		return xerrors.Errorf("cannot derive auth key: %w", err)
+	}
+
+	handle := p.StaticData.PCRPolicyNVIndexHandle
+
+	dataIndex, err := newPcrPolicyNVIndexContext(tpm, pcrPolicyNVDataHandle(handle), p.StaticData.AuthPublicKey, p.StaticData.PCRPolicyRef)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain context for PCR policy metadata NV index: %w", err)
+	}
+	digestIndex, err := newPcrPolicyNVIndexContext(tpm, handle, p.StaticData.AuthPublicKey, p.StaticData.PCRPolicyRef)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain context for PCR policy NV index: %w", err)
+	}
+
+	data, err := mu.MarshalToBytes(&pcrPolicyNVData{Selection: pcrData.Selection, OrData: pcrData.OrData})
+	if err != nil {
+		return xerrors.Errorf("cannot serialize PCR policy metadata: %w", err)
+	}
+	if len(data) > int(dataIndex.size) {
+		return fmt.Errorf("PCR policy metadata is too large for NV index (%d bytes, maximum %d bytes)", len(data), dataIndex.size)
+	}
+	data = append(data, make([]byte, int(dataIndex.size)-len(data))...)
+
+	// Write the metadata first. The previous PCR policy can't be satisfied
+	// once this is written, and the new PCR policy can't be satisfied until
+	// its digest is written.
+	if err := dataIndex.write(key, data); err != nil {
+		return xerrors.Errorf("cannot write PCR policy metadata to NV index: %w", err)
+	}
+	if err := digestIndex.write(key, mu.MustMarshalToBytes(tpm2.MakeTaggedHash(alg, approvedPolicy))); err != nil {
+		return xerrors.Errorf("cannot write PCR policy digest to NV index: %w", err)
+	}
+
+	pcrData.AuthorizedPolicy = approvedPolicy
+	pcrData.AuthorizedPolicySignature = &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}
+	p.PCRData = pcrData
+	return nil
+}
+
+// readPCRPolicyNVData reads the PCR policy metadata from the NV index that follows
+// the PCR policy NV index, for keys where PCR policies are authorized by a NV index.
+func (p *keyDataPolicy_v3) readPCRPolicyNVData(tpm *tpm2.TPMContext) (*pcrPolicyData_v3, error) {
+	dataHandle := pcrPolicyNVDataHandle(p.StaticData.PCRPolicyNVIndexHandle)
+	dataIndex, err := tpm.CreateResourceContextFromTPM(dataHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, dataHandle):
+		return nil, policyDataError{errors.New("no PCR policy metadata NV index found")}
+	case err != nil:
+		return nil, err
+	}
+
+	dataPub, _, err := tpm.NVReadPublic(dataIndex)
+	if err != nil {
+		return nil, err
+	}
+	data, err := tpm.NVRead(dataIndex, dataIndex, dataPub.Size, 0, nil)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVUninitialized, tpm2.CommandNVRead):
+		return nil, policyDataError{errors.New("PCR policy metadata NV index has not been initialized")}
+	case err != nil:
+		return nil, err
+	}
+
+	var nvData *pcrPolicyNVData
+	if _, err := mu.UnmarshalFromBytes(data, &nvData); err != nil {
+		return nil, policyDataError{xerrors.Errorf("cannot unmarshal PCR policy metadata: %w", err)}
+	}
+
+	return &pcrPolicyData_v3{
+		Selection: nvData.Selection,
+		OrData:    nvData.OrData}, nil
+}
+
+// executePCRPolicyNV executes the PCR policy for keys where PCR policies are authorized
+// by a NV index, using the metadata stored in the NV index that follows it.
+func (p *keyDataPolicy_v3) executePCRPolicyNV(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
+	handle := p.StaticData.PCRPolicyNVIndexHandle
+
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		// If there is no NV index at the expected handle then the key file is invalid and must be recreated.
+		return policyDataError{errors.New("no PCR policy NV index found")}
+	case err != nil:
+		return err
+	}
+
+	pcrData, err := p.readPCRPolicyNVData(tpm)
+	if err != nil {
+		return err
+	}
+
+	if err := pcrData.executePcrAssertions(tpm, policySession); err != nil {
+		return xerrors.Errorf("cannot execute PCR assertions: %w", err)
+	}
+
+	if err := executePolicyAuthorizeNV(tpm, index, policySession); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorizeNV),
+			tpm2.IsTPMError(err, tpm2.ErrorHash, tpm2.CommandPolicyAuthorizeNV),
+			tpm2.IsTPMError(err, tpm2.ErrorNVUninitialized, tpm2.CommandPolicyAuthorizeNV):
+			// The PCR policy metadata is inconsistent with the
+			// authorized PCR policy digest.
+			return policyDataError{errors.New("the PCR policy is invalid")}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// newKeyDataPolicyWithPCRPolicyNVIndex creates a keyDataPolicy in the same way as
+// newKeyDataPolicy, except that PCR policies are authorized by the NV index with the
+// supplied public area (by way of a PolicyAuthorizeNV assertion) rather than by a
+// signature, which permits the PCR policy to be updated without modifying the key data.
+// The public area must be the one returned from createPcrPolicyNVIndices.
+func newKeyDataPolicyWithPCRPolicyNVIndex(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyIndexPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (keyDataPolicy, tpm2.Digest, error) {
+	if len(role) > 1024 {
+		// See the comment in newKeyDataPolicy.
+		return nil, nil, errors.New("invalid role: too large")
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.SetDigest(computePolicyAuthorizeNVDigest(alg, pcrPolicyIndexPub.Name()))
+	if requireEndorsementAuth {
+		trial.PolicySecret(tpm2.MakeHandleName(tpm2.HandleEndorsement), nil)
+	}
+	if len(externalAuthName) > 0 {
+		trial.PolicySecret(externalAuthName, nil)
+	}
+	if requireAuthValue {
+		trial.PolicyAuthValue()
+	}
+
+	return &keyDataPolicy_v3{
+		StaticData: &staticPolicyData_v3{
+			AuthPublicKey:          key,
+			PCRPolicyRef:           computeV3PcrPolicyRef(key.NameAlg, secboot.RoleDerivationLabel(role), nil),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			RequireAuthValue:       requireAuthValue,
+			RequireEndorsementAuth: requireEndorsementAuth,
+			ExternalAuthName:       externalAuthName,
+			PCRPolicyNVIndexHandle: pcrPolicyIndexPub.Index},
+		PCRData: &pcrPolicyData_v3{
+			AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}}, trial.GetDigest(), nil
+}
@@ -0,0 +1,238 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// The PCR policy for a key is authorized with a signature from a key that is
+// derived from the key's primary key. The public part of this key is bound to
+// the key's authorization policy when the key is created, so it can't be
+// changed afterwards. Rather than having to keep the primary key on each device,
+// the private part of this key can be exported with PCRPolicyAuthKey so that
+// new PCR policies can be signed by a remote service. A device computes a new
+// unsigned PCR policy with NewUnsignedPCRPolicy, sends the digest returned from
+// UnsignedPCRPolicy.Digest to the remote service to be signed with
+// SignPCRPolicyDigest, and then applies the returned signature with
+// UpdatePCRProtectionPolicyWithSignature.
+//
+// Alternatively, a key can be created with ProtectKeyParams.PCRPolicyAuthPublicKey
+// set so that its PCR policies are authorized by a key that is held centrally,
+// in which case no key has to be exported from the device.
+
+// v3Policy returns the policy metadata for this key, or an error if this key
+// wasn't created with one of the APIs that supports signing PCR policies
+// remotely (ie, it was created with one of the legacy APIs, or its PCR policies are
+// authorized by a NV index).
+func (k *sealedKeyDataBase) v3Policy() (*keyDataPolicy_v3, error) {
+	policy, ok := k.data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		return nil, errors.New("unsupported key data version")
+	}
+	if policy.usesPCRPolicyNVIndex() {
+		return nil, errors.New("PCR policies for this key are authorized by a NV index")
+	}
+	return policy, nil
+}
+
+// PCRPolicyAuthKey returns the private key used to authorize PCR policies for this
+// key, derived from the supplied primary key. The primary key is either the one
+// returned when the key was created, or the one recovered when the key is unlocked.
+//
+// The returned key can be used by a remote service to sign new PCR policies for this
+// key and any keys that are related to it (ie, they were created with the same
+// primary key), with SignPCRPolicyDigest. It must be kept secret, because it can be
+// used to authorize any PCR policy for these keys, including policies that don't
+// bind them to any PCR values.
+func (k *SealedKeyData) PCRPolicyAuthKey(primaryKey secboot.PrimaryKey) (*ecdsa.PrivateKey, error) {
+	policy, err := k.v3Policy()
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.ValidateAuthKey(primaryKey); err != nil {
+		if isKeyDataError(err) {
+			return nil, InvalidKeyDataError{err.Error()}
+		}
+		return nil, xerrors.Errorf("cannot validate auth key: %w", err)
+	}
+	return deriveV3PolicyAuthKey(policy.StaticData.AuthPublicKey.NameAlg.GetHash(), primaryKey)
+}
+
+// setUnauthorizedPCRPolicy sets the initial PCR policy for a new key created with
+// ProtectKeyParams.PCRPolicyAuthPublicKey, computed from the supplied profile. The
+// policy has no signature, so it must be authorized with
+// UpdatePCRProtectionPolicyWithSignature before the key can be unsealed.
+func (k *sealedKeyDataBase) setUnauthorizedPCRPolicy(tpm *tpm2.TPMContext, profile *PCRProtectionProfile) error {
+	policy, err := k.v3Policy()
+	if err != nil {
+		return err
+	}
+
+	params, err := k.newPCRPolicyParams(tpm, nil, profile, resetPcrPolicyVersion)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR policy parameters: %w", err)
+	}
+
+	data, approvedPolicy, err := policy.computePCRPolicy(k.data.Public().NameAlg, params)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR policy: %w", err)
+	}
+	data.AuthorizedPolicy = approvedPolicy
+	data.AuthorizedPolicySignature = &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}
+
+	policy.PCRData = data
+	return nil
+}
+
+// UnsignedPCRPolicy is a new PCR policy for a key that hasn't been authorized yet.
+// It is created by SealedKeyData.NewUnsignedPCRPolicy, and applied with
+// SealedKeyData.UpdatePCRProtectionPolicyWithSignature.
+type UnsignedPCRPolicy struct {
+	authPublicKey *tpm2.Public
+	policyRef     tpm2.Nonce
+	data          *pcrPolicyData_v3
+}
+
+// HashAlg returns the digest algorithm that must be used to sign this policy.
+func (p *UnsignedPCRPolicy) HashAlg() tpm2.HashAlgorithmId {
+	return p.authPublicKey.NameAlg
+}
+
+// Digest returns the digest that must be signed in order to authorize this policy.
+// This is computed from the approved policy digest and the key's policy reference
+// in the same way as the digest verified by the TPM2_PolicyAuthorize assertion in the
+// key's authorization policy.
+func (p *UnsignedPCRPolicy) Digest() tpm2.Digest {
+	// ComputePolicyAuthorizeDigest only fails if the digest algorithm is not
+	// available, which would have been detected by validateData.
+	digest, _ := util.ComputePolicyAuthorizeDigest(p.HashAlg(), p.data.AuthorizedPolicy, p.policyRef)
+	return digest
+}
+
+// SignPCRPolicyDigest signs the supplied digest, returned from UnsignedPCRPolicy.Digest,
+// with the supplied PCR policy authorization key, returned from
+// SealedKeyData.PCRPolicyAuthKey. The supplied digest algorithm is returned from
+// UnsignedPCRPolicy.HashAlg.
+func SignPCRPolicyDigest(key *ecdsa.PrivateKey, alg tpm2.HashAlgorithmId, digest tpm2.Digest) (*tpm2.Signature, error) {
+	if !alg.Available() {
+		return nil, errors.New("digest algorithm is not available")
+	}
+	if len(digest) != alg.Size() {
+		return nil, errors.New("invalid digest length")
+	}
+
+	scheme := &tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{
+				HashAlg: alg}}}
+	return util.Sign(key, scheme, digest)
+}
+
+// NewUnsignedPCRPolicy computes a new PCR policy for this key from the profile defined
+// by the pcrProfile argument, in the same way as UpdatePCRProtectionPolicy, but without
+// authorizing it. This doesn't require the primary key. The policy is authorized by
+// signing the digest returned from UnsignedPCRPolicy.Digest with SignPCRPolicyDigest, and
+// applied with UpdatePCRProtectionPolicyWithSignature.
+//
+// If validation of the key data fails, a InvalidKeyDataError error will be returned.
+func (k *SealedKeyData) NewUnsignedPCRPolicy(tpm *Connection, pcrProfile *PCRProtectionProfile, policyVersionOption PCRPolicyVersionOption) (*UnsignedPCRPolicy, error) {
+	policy, err := k.v3Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	pcrPolicyCounterPub, err := k.validateData(tpm.TPMContext, k.k.Role())
+	if err != nil {
+		if isKeyDataError(err) {
+			return nil, InvalidKeyDataError{err.Error()}
+		}
+		return nil, xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	if pcrProfile == nil {
+		pcrProfile = NewPCRProtectionProfile()
+	}
+	params, err := k.newPCRPolicyParams(tpm.TPMContext, pcrPolicyCounterPub, pcrProfile, policyVersionOption.internalOpt())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR policy parameters: %w", err)
+	}
+
+	data, approvedPolicy, err := policy.computePCRPolicy(k.data.Public().NameAlg, params)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR policy: %w", err)
+	}
+	data.AuthorizedPolicy = approvedPolicy
+
+	return &UnsignedPCRPolicy{
+		authPublicKey: policy.StaticData.AuthPublicKey,
+		policyRef:     policy.StaticData.PCRPolicyRef,
+		data:          data}, nil
+}
+
+// UpdatePCRProtectionPolicyWithSignature updates the PCR protection policy for this key
+// to the supplied policy, which was returned from NewUnsignedPCRPolicy, using the supplied
+// signature, which was returned from SignPCRPolicyDigest. The policy must have been
+// computed for this key or a key that is related to it, and the signature is verified
+// with the public part of the key's PCR policy authorization key before the policy is
+// applied.
+//
+// On success, this key will have an updated authorization policy. It must be persisted
+// using secboot.KeyData.WriteAtomic.
+func (k *SealedKeyData) UpdatePCRProtectionPolicyWithSignature(policy *UnsignedPCRPolicy, signature *tpm2.Signature) error {
+	keyPolicy, err := k.v3Policy()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(policy.authPublicKey.Name(), keyPolicy.StaticData.AuthPublicKey.Name()) || !bytes.Equal(policy.policyRef, keyPolicy.StaticData.PCRPolicyRef) {
+		return errors.New("PCR policy was not computed for this key")
+	}
+
+	if signature == nil || signature.SigAlg != tpm2.SigSchemeAlgECDSA || signature.Signature == nil || signature.Signature.ECDSA == nil || signature.Signature.ECDSA.Hash != policy.HashAlg() {
+		return errors.New("invalid signature scheme")
+	}
+	ok, err := util.VerifySignature(keyPolicy.StaticData.AuthPublicKey.Public(), policy.Digest(), signature)
+	if err != nil {
+		return xerrors.Errorf("cannot verify signature: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+
+	data := *policy.data
+	data.AuthorizedPolicySignature = signature
+	keyPolicy.PCRData = &data
+
+	if err := k.k.MarshalAndUpdatePlatformHandle(k); err != nil {
+		return xerrors.Errorf("cannot update TPM platform handle on KeyData: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type pcrPolicySigningSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *pcrPolicySigningSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *pcrPolicySigningSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&pcrPolicySigningSuite{})
+
+func (s *pcrPolicySigningSuite) newKey(c *C, pcrPolicyCounterHandle tpm2.Handle) (*secboot.KeyData, *SealedKeyData, secboot.PrimaryKey) {
+	// Protect the key with an initial PCR policy that can't be satisfied
+	params := &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")),
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	return k, skd, primaryKey
+}
+
+func (s *pcrPolicySigningSuite) testUpdatePCRProtectionPolicyWithSignature(c *C, pcrPolicyCounterHandle tpm2.Handle) {
+	k, skd, primaryKey := s.newKey(c, pcrPolicyCounterHandle)
+
+	_, _, err := k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+
+	authKey, err := skd.PCRPolicyAuthKey(primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, err := skd.NewUnsignedPCRPolicy(s.TPM(), tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion)
+	c.Assert(err, IsNil)
+	c.Check(policy.HashAlg(), Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(policy.Digest(), HasLen, 32)
+
+	sig, err := SignPCRPolicyDigest(authKey, policy.HashAlg(), policy.Digest())
+	c.Assert(err, IsNil)
+
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, sig), IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *pcrPolicySigningSuite) TestUpdatePCRProtectionPolicyWithSignatureWithPCRPolicyCounter(c *C) {
+	s.testUpdatePCRProtectionPolicyWithSignature(c, s.NextAvailableHandle(c, 0x01810000))
+}
+
+func (s *pcrPolicySigningSuite) TestUpdatePCRProtectionPolicyWithSignatureNoPCRPolicyCounter(c *C) {
+	s.testUpdatePCRProtectionPolicyWithSignature(c, tpm2.HandleNull)
+}
+
+func (s *pcrPolicySigningSuite) TestPCRPolicyAuthKeyWrongPrimaryKey(c *C) {
+	_, skd, _ := s.newKey(c, tpm2.HandleNull)
+
+	_, err := skd.PCRPolicyAuthKey(make(secboot.PrimaryKey, 32))
+	c.Check(err, ErrorMatches, "cannot validate auth key: dynamic authorization policy signing private key doesn't match public key")
+}
+
+func (s *pcrPolicySigningSuite) TestUpdatePCRProtectionPolicyWithSignatureInvalidSignature(c *C) {
+	k, skd, _ := s.newKey(c, tpm2.HandleNull)
+
+	policy, err := skd.NewUnsignedPCRPolicy(s.TPM(), tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion)
+	c.Assert(err, IsNil)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	sig, err := SignPCRPolicyDigest(otherKey, policy.HashAlg(), policy.Digest())
+	c.Assert(err, IsNil)
+
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, sig), ErrorMatches, "invalid signature")
+
+	// The existing PCR policy is retained.
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *pcrPolicySigningSuite) TestUpdatePCRProtectionPolicyWithSignatureWrongKey(c *C) {
+	_, skd1, primaryKey := s.newKey(c, tpm2.HandleNull)
+	_, skd2, _ := s.newKey(c, tpm2.HandleNull)
+
+	authKey, err := skd1.PCRPolicyAuthKey(primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, err := skd1.NewUnsignedPCRPolicy(s.TPM(), tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion)
+	c.Assert(err, IsNil)
+	sig, err := SignPCRPolicyDigest(authKey, policy.HashAlg(), policy.Digest())
+	c.Assert(err, IsNil)
+
+	c.Check(skd2.UpdatePCRProtectionPolicyWithSignature(policy, sig), ErrorMatches, "PCR policy was not computed for this key")
+}
+
+func (s *pcrPolicySigningSuite) TestUpdatePCRProtectionPolicyWithSignatureMalformedSignature(c *C) {
+	_, skd, _ := s.newKey(c, tpm2.HandleNull)
+
+	policy, err := skd.NewUnsignedPCRPolicy(s.TPM(), tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion)
+	c.Assert(err, IsNil)
+
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgECDSA}), ErrorMatches, "invalid signature scheme")
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgECDSA, Signature: &tpm2.SignatureU{}}), ErrorMatches, "invalid signature scheme")
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}), ErrorMatches, "invalid signature scheme")
+}
+
+func (s *pcrPolicySigningSuite) TestPCRPolicyAuthPublicKey(c *C) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyAuthPublicKey: &signer.PublicKey}
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	// The initial PCR policy isn't authorized.
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy has not been authorized")
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	// The device can't authorize its own PCR policies.
+	_, err = skd.PCRPolicyAuthKey(primaryKey)
+	c.Check(err, ErrorMatches, "cannot validate auth key: dynamic authorization policy signing private key doesn't match public key")
+
+	policy, err := skd.NewUnsignedPCRPolicy(s.TPM(), tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion)
+	c.Assert(err, IsNil)
+	sig, err := SignPCRPolicyDigest(signer, policy.HashAlg(), policy.Digest())
+	c.Assert(err, IsNil)
+
+	c.Check(skd.UpdatePCRProtectionPolicyWithSignature(policy, sig), IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+type pcrPolicySigningSuiteNoTPM struct{}
+
+var _ = Suite(&pcrPolicySigningSuiteNoTPM{})
+
+func (s *pcrPolicySigningSuiteNoTPM) TestSignPCRPolicyDigestInvalidLength(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	_, err = SignPCRPolicyDigest(key, tpm2.HashAlgorithmSHA256, make(tpm2.Digest, 20))
+	c.Check(err, ErrorMatches, "invalid digest length")
+}
+
+func (s *pcrPolicySigningSuiteNoTPM) TestSignPCRPolicyDigest(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	sig, err := SignPCRPolicyDigest(key, tpm2.HashAlgorithmSHA256, make(tpm2.Digest, 32))
+	c.Assert(err, IsNil)
+	c.Check(sig.SigAlg, Equals, tpm2.SigSchemeAlgECDSA)
+	c.Check(sig.Signature.ECDSA.Hash, Equals, tpm2.HashAlgorithmSHA256)
+}
+
+func (s *pcrPolicySigningSuiteNoTPM) TestPCRPolicyAuthKey(c *C) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	key, err := skd.PCRPolicyAuthKey(primaryKey)
+	c.Assert(err, IsNil)
+
+	expected, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(key.PublicKey.Equal(expected.Public()), testutil.IsTrue)
+}
+
+func (s *pcrPolicySigningSuiteNoTPM) TestPCRPolicyAuthPublicKeyWithPCRPolicyCounter(c *C) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	_, _, _, err = NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		PCRPolicyAuthPublicKey: &signer.PublicKey})
+	c.Check(err, ErrorMatches, "cannot use a PCR policy counter with a PCR policy authorization public key")
+}
+
+func (s *pcrPolicySigningSuiteNoTPM) TestPCRPolicyAuthPublicKeyWrongCurve(c *C) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+	signer, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	_, _, _, err = NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyAuthPublicKey: &signer.PublicKey})
+	c.Check(err, ErrorMatches, "PCR policy authorization public key must be a NIST P-256 key")
+}
+
+func (s *pcrPolicySigningSuiteNoTPM) TestPCRPolicyAuthPublicKeyExternal(c *C) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyAuthPublicKey: &signer.PublicKey})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	_, err = skd.PCRPolicyAuthKey(primaryKey)
+	c.Check(err, ErrorMatches, "cannot validate auth key: dynamic authorization policy signing private key doesn't match public key")
+}
@@ -36,6 +36,8 @@ import (
 	"github.com/canonical/go-tpm2/util"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
 )
 
 // maxPCR is the maximum PCR index representable by a selection. A selection is a
@@ -590,9 +592,33 @@ func (b *PCRProtectionProfileBranch) EndBranch() *PCRProtectionProfileBranchPoin
 type PCRProtectionProfile struct {
 	root              *PCRProtectionProfileBranch
 	pcrsToReadFromTPM tpm2.PCRSelectionList
+	nvGeneration      *NVGenerationRequirement
+	maxResetCount     *uint32
+	constraints       *PCRProfileConstraints
 	err               error
 }
 
+// NVGenerationRequirement describes a requirement that an NV index contains a
+// generation number that is at least a minimum value and optionally at most a
+// maximum value, which is added to the PCR policy of a key in addition to the
+// assertions on PCR values.
+type NVGenerationRequirement struct {
+	// Handle is the handle of the NV index. This must be a NV counter that
+	// is readable with its own empty authorization value (ie, it must have
+	// the TPMA_NV_AUTHREAD attribute). It must be writable only with the
+	// authorization of the storage or platform hierarchy or with its
+	// authorization policy (ie, it must not have the TPMA_NV_AUTHWRITE
+	// attribute), and it must not have the TPMA_NV_POLICY_DELETE attribute.
+	Handle tpm2.Handle
+
+	// Minimum is the minimum generation number.
+	Minimum uint64
+
+	// Maximum is the maximum generation number, or zero if there is no
+	// maximum.
+	Maximum uint64
+}
+
 // NewPCRProtectionProfile creates an empty PCR profile.
 func NewPCRProtectionProfile() *PCRProtectionProfile {
 	profile := new(PCRProtectionProfile)
@@ -667,9 +693,107 @@ func (p *PCRProtectionProfile) ExtendPCR(alg tpm2.HashAlgorithmId, pcr int, valu
 	return p
 }
 
+// RequireNVGeneration adds a requirement that the NV index at the specified
+// handle contains a generation number of at least minimum. This applies to the
+// whole profile rather than to a single branch, and replaces any requirement
+// added previously. It can be used to bind a key to a security generation that
+// isn't otherwise reflected in the PCR values - for example, a component that
+// maintains the minimum SBAT generation permitted on a device can store it in a
+// NV counter, so that keys can't be released after a rollback to a revoked
+// bootloader even if the PCR values are the same. As NV counters can't be
+// decremented, the generation can't be rolled back.
+//
+// The function returns the same PCRProtectionProfile so that calls may be
+// chained.
+func (p *PCRProtectionProfile) RequireNVGeneration(handle tpm2.Handle, minimum uint64) *PCRProtectionProfile {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		p.fail("invalid NV index handle")
+		return p
+	}
+	p.nvGeneration = &NVGenerationRequirement{Handle: handle, Minimum: minimum}
+	return p
+}
+
+// RequireNVGenerationRange adds a requirement that the NV index at the specified
+// handle contains a generation number of at least minimum and at most maximum.
+// This behaves like RequireNVGeneration, but the maximum makes it possible to
+// revoke keys with this requirement by incrementing the NV counter. For example,
+// a key that is sealed for OS version V with an OS version counter created by
+// Connection.CreateOSVersionCounter should have a maximum of V, so that it can't
+// be unsealed after the counter has been incremented to a newer version, even if
+// the device is rolled back to an older OS that still has the key. Maximum must
+// not be zero or lower than minimum.
+//
+// The function returns the same PCRProtectionProfile so that calls may be
+// chained.
+func (p *PCRProtectionProfile) RequireNVGenerationRange(handle tpm2.Handle, minimum, maximum uint64) *PCRProtectionProfile {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		p.fail("invalid NV index handle")
+		return p
+	}
+	if maximum == 0 || maximum < minimum {
+		p.fail("invalid NV generation range")
+		return p
+	}
+	p.nvGeneration = &NVGenerationRequirement{Handle: handle, Minimum: minimum, Maximum: maximum}
+	return p
+}
+
+// NVGenerationRequirement returns the requirement added with
+// RequireNVGeneration, or nil if there isn't one.
+func (p *PCRProtectionProfile) NVGenerationRequirement() *NVGenerationRequirement {
+	return p.nvGeneration
+}
+
+// RequireMaximumResetCount adds a requirement that the TPM's reset count is not
+// higher than the specified maximum. The TPM increments its reset count on every
+// TPM reset, which normally happens on every boot, so this limits the number of
+// boots for which the PCR policy computed from this profile can be used. The
+// current reset count can be obtained with Connection.ReadClock. Note that the
+// reset count is set to zero when the TPM is cleared, although this also removes
+// the storage hierarchy that keys are protected by.
+//
+// Creating a PCR policy from a profile with this requirement fails on a virtual
+// TPM (see Connection.IsVirtualTPM), because its reset count can be rolled back
+// by restoring the guest from a snapshot.
+//
+// The function returns the same PCRProtectionProfile so that calls may be
+// chained.
+func (p *PCRProtectionProfile) RequireMaximumResetCount(maximum uint32) *PCRProtectionProfile {
+	p.maxResetCount = &maximum
+	return p
+}
+
+// MaximumResetCount returns the maximum reset count added with
+// RequireMaximumResetCount. If there isn't one, false is returned.
+func (p *PCRProtectionProfile) MaximumResetCount() (maximum uint32, ok bool) {
+	if p.maxResetCount == nil {
+		return 0, false
+	}
+	return *p.maxResetCount, true
+}
+
+// SetConstraints sets constraints that are used to prune branches that are
+// unreachable from the PCR policy computed from this profile, replacing any
+// constraints that were set previously. Constraints apply to the whole profile
+// and are not inherited from sub-profiles added with AddProfileOR. They are not
+// serialized with the profile.
+//
+// The function returns the same PCRProtectionProfile so that calls may be
+// chained.
+func (p *PCRProtectionProfile) SetConstraints(constraints *PCRProfileConstraints) *PCRProtectionProfile {
+	p.constraints = constraints
+	return p
+}
+
 // AddProfileOR adds a branch point to this branch containing the supplied
 // root branches associated with the supplied sub-profiles as branches, in order
-// to define PCR policies for multiple conditions.
+// to define PCR policies for multiple conditions. Any NV generation
+// requirements on the sub-profiles are applied to this profile, using the
+// highest minimum generation and the lowest maximum generation. It is an error
+// for the sub-profiles to have requirements for different NV indices, or for
+// the resulting range to be empty. Any reset count requirements on the
+// sub-profiles are also applied to this profile, using the lowest maximum.
 //
 // Deprecated: Use PCRProtectionProfileBranch.AddBranchPoint instead.
 func (p *PCRProtectionProfile) AddProfileOR(profiles ...*PCRProtectionProfile) *PCRProtectionProfile {
@@ -689,6 +813,33 @@ func (p *PCRProtectionProfile) AddProfileOR(profiles ...*PCRProtectionProfile) *
 
 		p.pcrsToReadFromTPM = p.pcrsToReadFromTPM.MustMerge(sub.pcrsToReadFromTPM)
 		bp.childBranches = append(bp.childBranches, branch)
+
+		if req := sub.nvGeneration; req != nil {
+			switch {
+			case p.nvGeneration == nil:
+				p.nvGeneration = req
+			case p.nvGeneration.Handle != req.Handle:
+				p.fail("sub-profiles require generations from different NV indices")
+				return p
+			default:
+				merged := *p.nvGeneration
+				if req.Minimum > merged.Minimum {
+					merged.Minimum = req.Minimum
+				}
+				if req.Maximum != 0 && (merged.Maximum == 0 || req.Maximum < merged.Maximum) {
+					merged.Maximum = req.Maximum
+				}
+				if merged.Maximum != 0 && merged.Maximum < merged.Minimum {
+					p.fail("sub-profiles require NV generations that can't be satisfied together")
+					return p
+				}
+				p.nvGeneration = &merged
+			}
+		}
+
+		if maximum := sub.maxResetCount; maximum != nil && (p.maxResetCount == nil || *maximum < *p.maxResetCount) {
+			p.maxResetCount = maximum
+		}
 	}
 
 	bp.EndBranchPoint()
@@ -839,6 +990,28 @@ type savedPCRProtectionProfile struct {
 	Instrs  []*savedPCRProtectionProfileInstr // a list of instructions used to reconstruct this profile
 }
 
+const (
+	pcrProfileArtifact = "PCR profile"
+
+	// savedPCRProtectionProfileMagic identifies a saved PCR profile with
+	// a header. This can't be mistaken for the length of the digest list at
+	// the start of a profile without a header, as it exceeds
+	// maxSavedDigests.
+	savedPCRProtectionProfileMagic uint32 = 0xffffffff
+
+	// pcrProfileMinReaderVersion is the minimum
+	// secboot.ArtifactFormatVersion required to read a saved PCR profile.
+	pcrProfileMinReaderVersion = 1
+)
+
+// savedPCRProtectionProfileHeader is written with savedPCRProtectionProfileMagic
+// before a saved PCR profile in order to indicate which versions of secboot can
+// read it. Profiles saved by older versions of secboot don't have a header.
+type savedPCRProtectionProfileHeader struct {
+	ProducerVersion  uint32
+	MinReaderVersion uint32
+}
+
 type pcrProtectionProfileSerializer struct {
 	digests   tpm2.DigestList
 	digestMap map[[32]byte]uint32
@@ -924,13 +1097,40 @@ func (p PCRProtectionProfile) Marshal(w io.Writer) error {
 		return errors.New("profile contains too many digests")
 	}
 
-	_, err := mu.MarshalToWriter(w, &savedPCRProtectionProfile{
-		Digests: c.digests,
-		Instrs:  c.instrs})
+	_, err := mu.MarshalToWriter(w,
+		savedPCRProtectionProfileMagic,
+		&savedPCRProtectionProfileHeader{
+			ProducerVersion:  secboot.ArtifactFormatVersion,
+			MinReaderVersion: pcrProfileMinReaderVersion},
+		&savedPCRProtectionProfile{
+			Digests: c.digests,
+			Instrs:  c.instrs})
 	return err
 }
 
 func (p *PCRProtectionProfile) Unmarshal(r io.Reader) error {
+	var magic uint32
+	if _, err := mu.UnmarshalFromReader(r, &magic); err != nil {
+		return err
+	}
+	switch magic {
+	case savedPCRProtectionProfileMagic:
+		var hdr savedPCRProtectionProfileHeader
+		if _, err := mu.UnmarshalFromReader(r, &hdr); err != nil {
+			return err
+		}
+		if hdr.MinReaderVersion > secboot.ArtifactFormatVersion {
+			return &secboot.ArtifactVersionError{
+				Artifact:         pcrProfileArtifact,
+				ProducerVersion:  int(hdr.ProducerVersion),
+				MinReaderVersion: int(hdr.MinReaderVersion)}
+		}
+	default:
+		// This profile doesn't have a header, and the value that was
+		// read is the length of the digest list.
+		r = io.MultiReader(bytes.NewReader(mu.MustMarshalToBytes(magic)), r)
+	}
+
 	var s *savedPCRProtectionProfile
 	if _, err := mu.UnmarshalFromReader(r, &s); err != nil {
 		return err
@@ -1028,10 +1228,17 @@ func (p *PCRProtectionProfile) Unmarshal(r io.Reader) error {
 type pcrProtectionProfileComputerBranchContext struct {
 	values          pcrValuesList
 	subBranchValues pcrValuesList
+
+	// measurements contains the measurements that are relevant to the
+	// profile's constraints for each entry in values.
+	measurements          [][]PCRMeasurement
+	subBranchMeasurements [][]PCRMeasurement
+	hasSubBranches        bool
 }
 
 type pcrProtectionProfileComputer struct {
 	tpmValues   tpm2.PCRValues
+	constraints *PCRProfileConstraints
 	branchStack []*pcrProtectionProfileComputerBranchContext
 }
 
@@ -1040,9 +1247,17 @@ func (c *pcrProtectionProfileComputer) currentBranch() *pcrProtectionProfileComp
 }
 
 func (c *pcrProtectionProfileComputer) beginBranch(_ int) {
-	// A sub-branch inherits a copy of the PCR values from the parent branch
+	// A sub-branch inherits a copy of the PCR values and measurements from the
+	// parent branch. The measurements are capped so that appending to them in
+	// the sub-branch doesn't modify the parent's.
+	var measurements [][]PCRMeasurement
+	for _, m := range c.currentBranch().measurements {
+		measurements = append(measurements, m[:len(m):len(m)])
+	}
 	c.branchStack = append([]*pcrProtectionProfileComputerBranchContext{
-		&pcrProtectionProfileComputerBranchContext{values: c.currentBranch().values.copy()},
+		&pcrProtectionProfileComputerBranchContext{
+			values:       c.currentBranch().values.copy(),
+			measurements: measurements},
 	}, c.branchStack...)
 }
 
@@ -1055,7 +1270,27 @@ func (c *pcrProtectionProfileComputer) addPCRValueFromTPM(alg tpm2.HashAlgorithm
 }
 
 func (c *pcrProtectionProfileComputer) extendPCR(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
-	c.currentBranch().values.extendValue(alg, pcr, value)
+	branch := c.currentBranch()
+	branch.values.extendValue(alg, pcr, value)
+
+	m := PCRMeasurement{Alg: alg, PCR: pcr, Digest: value}
+	if c.constraints == nil || !c.constraints.isRelevant(m) {
+		return
+	}
+
+	// Prune the PCR values for any path through the profile that contains a
+	// measurement that can't be made during the same boot as this one.
+	var values pcrValuesList
+	var measurements [][]PCRMeasurement
+	for i, v := range branch.values {
+		if c.constraints.excludes(branch.measurements[i], m) {
+			continue
+		}
+		values = append(values, v)
+		measurements = append(measurements, append(branch.measurements[i], m))
+	}
+	branch.values = values
+	branch.measurements = measurements
 }
 
 func (*pcrProtectionProfileComputer) beginBranchPoint() {}
@@ -1063,19 +1298,24 @@ func (*pcrProtectionProfileComputer) beginBranchPoint() {}
 func (c *pcrProtectionProfileComputer) endBranchPoint() {
 	// When a branch point is completed, the branch inherits the PCR values computed
 	// by the sub-branches.
-	if c.currentBranch().subBranchValues == nil {
+	if !c.currentBranch().hasSubBranches {
 		// There were no sub branches.
 		return
 	}
 
 	c.currentBranch().values = c.currentBranch().subBranchValues
+	c.currentBranch().measurements = c.currentBranch().subBranchMeasurements
 	c.currentBranch().subBranchValues = nil
+	c.currentBranch().subBranchMeasurements = nil
+	c.currentBranch().hasSubBranches = false
 }
 
 func (c *pcrProtectionProfileComputer) endBranch() {
-	values := c.currentBranch().values
+	branch := c.currentBranch()
 	c.branchStack = c.branchStack[1:]
-	c.currentBranch().subBranchValues = append(c.currentBranch().subBranchValues, values...)
+	c.currentBranch().subBranchValues = append(c.currentBranch().subBranchValues, branch.values...)
+	c.currentBranch().subBranchMeasurements = append(c.currentBranch().subBranchMeasurements, branch.measurements...)
+	c.currentBranch().hasSubBranches = true
 }
 
 // ComputePCRValues computes PCR values for this PCRProtectionProfile, and is
@@ -1085,7 +1325,8 @@ func (c *pcrProtectionProfileComputer) endBranch() {
 // one-to-one association between a branch in the computed policy and a branch
 // in the profile.
 //
-// The returned list of PCR values is not de-duplicated.
+// The returned list of PCR values is not de-duplicated. Branches that are
+// unreachable according to the constraints set with SetConstraints are omitted.
 func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PCRValues, error) {
 	if p.err != nil {
 		return nil, fmt.Errorf("cannot compute PCR values because an error occurred when constructing the profile: %v", p.err)
@@ -1103,11 +1344,19 @@ func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PC
 		}
 	}
 	context := &pcrProtectionProfileComputer{
-		tpmValues: tpmValues,
+		tpmValues:   tpmValues,
+		constraints: p.constraints,
 		branchStack: []*pcrProtectionProfileComputerBranchContext{
-			&pcrProtectionProfileComputerBranchContext{values: pcrValuesList{make(tpm2.PCRValues)}}}}
+			&pcrProtectionProfileComputerBranchContext{
+				values:       pcrValuesList{make(tpm2.PCRValues)},
+				measurements: [][]PCRMeasurement{nil}}}}
 	p.run(context)
-	return []tpm2.PCRValues(context.currentBranch().subBranchValues), nil
+
+	values := context.currentBranch().subBranchValues
+	if len(values) == 0 {
+		return nil, errors.New("all branches were pruned by the profile's constraints")
+	}
+	return []tpm2.PCRValues(values), nil
 }
 
 // ComputePCRDigests computes a PCR policy consisting of a PCR selection and
@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// PCRMeasurement identifies a single measurement in a PCRProtectionProfile,
+// made with PCRProtectionProfileBranch.ExtendPCR.
+type PCRMeasurement struct {
+	Alg    tpm2.HashAlgorithmId
+	PCR    int
+	Digest tpm2.Digest
+}
+
+func (m PCRMeasurement) equal(other PCRMeasurement) bool {
+	return m.Alg == other.Alg && m.PCR == other.PCR && bytes.Equal(m.Digest, other.Digest)
+}
+
+// PCRProfileConstraints describes combinations of measurements that can never
+// occur during the same boot, eg, because a particular version of shim never
+// loads a particular version of grub. These can be applied to a
+// PCRProtectionProfile with PCRProtectionProfile.SetConstraints in order to
+// prune branches from the computed PCR policy that are unreachable. This is
+// useful for profiles that are composed from many components, where the number
+// of branches in the computed PCR policy grows combinatorially and may exceed the
+// limits of the TPM's PolicyOR assertion.
+type PCRProfileConstraints struct {
+	exclusions [][2]PCRMeasurement
+}
+
+// NewPCRProfileConstraints creates an empty set of constraints.
+func NewPCRProfileConstraints() *PCRProfileConstraints {
+	return new(PCRProfileConstraints)
+}
+
+// AddExclusion records that the supplied measurements can never both be made
+// during the same boot. Any branch of a computed PCR policy that contains both
+// of these measurements will be pruned. The function returns the same
+// PCRProfileConstraints so that calls may be chained.
+func (c *PCRProfileConstraints) AddExclusion(a, b PCRMeasurement) *PCRProfileConstraints {
+	c.exclusions = append(c.exclusions, [2]PCRMeasurement{a, b})
+	return c
+}
+
+// isRelevant indicates whether the supplied measurement appears in any
+// exclusion.
+func (c *PCRProfileConstraints) isRelevant(m PCRMeasurement) bool {
+	for _, e := range c.exclusions {
+		if e[0].equal(m) || e[1].equal(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes indicates whether the supplied measurement can't be made during the
+// same boot as any of the supplied previous measurements.
+func (c *PCRProfileConstraints) excludes(measured []PCRMeasurement, m PCRMeasurement) bool {
+	for _, e := range c.exclusions {
+		var other PCRMeasurement
+		switch {
+		case e[0].equal(m):
+			other = e[1]
+		case e[1].equal(m):
+			other = e[0]
+		default:
+			continue
+		}
+		for _, prev := range measured {
+			if prev.equal(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
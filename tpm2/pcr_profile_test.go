@@ -27,8 +27,11 @@ import (
 	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
 	"github.com/canonical/go-tpm2/util"
 
+	"golang.org/x/xerrors"
+
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
 	"github.com/snapcore/secboot/internal/tpm2test"
 	. "github.com/snapcore/secboot/tpm2"
@@ -598,6 +601,75 @@ func (s *pcrProfileSuite) TestEmptyProfileOR(c *C) {
 	})
 }
 
+func (s *pcrProfileSuite) TestConstraints(c *C) {
+	// Verify that branches containing mutually exclusive measurements are pruned
+	shimA := tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "shimA")
+	grubY := tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "grubY")
+
+	s.testPCRProtectionProfile(c, &testPCRProtectionProfileData{
+		alg: tpm2.HashAlgorithmSHA256,
+		profile: func() *PCRProtectionProfile {
+			p := NewPCRProtectionProfile()
+			p.RootBranch().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 4, make(tpm2.Digest, 32)).
+				AddBranchPoint().
+				AddBranch().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 4, shimA).
+				EndBranch().
+				AddBranch().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 4, tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "shimB")).
+				EndBranch().
+				EndBranchPoint().
+				AddBranchPoint().
+				AddBranch().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 4, tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "grubX")).
+				EndBranch().
+				AddBranch().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 4, grubY).
+				EndBranch().
+				EndBranchPoint()
+			p.SetConstraints(NewPCRProfileConstraints().AddExclusion(
+				PCRMeasurement{Alg: tpm2.HashAlgorithmSHA256, PCR: 4, Digest: shimA},
+				PCRMeasurement{Alg: tpm2.HashAlgorithmSHA256, PCR: 4, Digest: grubY}))
+			return p
+		}(),
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shimA", "grubX"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shimB", "grubX"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shimB", "grubY"),
+				},
+			},
+		},
+	})
+}
+
+func (s *pcrProfileSuite) TestConstraintsPruneAllBranches(c *C) {
+	foo := tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")
+	bar := tpm2test.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "bar")
+
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, foo).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, bar)
+	p.SetConstraints(NewPCRProfileConstraints().AddExclusion(
+		PCRMeasurement{Alg: tpm2.HashAlgorithmSHA256, PCR: 7, Digest: foo},
+		PCRMeasurement{Alg: tpm2.HashAlgorithmSHA256, PCR: 7, Digest: bar}))
+
+	_, err := p.ComputePCRValues(nil)
+	c.Check(err, ErrorMatches, `all branches were pruned by the profile's constraints`)
+}
+
 func (s *pcrProfileSuite) TestProfileString(c *C) {
 	profile := NewPCRProtectionProfile()
 	profile.RootBranch().
@@ -935,7 +1007,8 @@ func (s *pcrProfileSuite) TestMarshalAndUnmarshal(c *C) {
 		EndBranchPoint() // End (B1 || B2 || B3)
 	b, err := mu.MarshalToBytes(p)
 	c.Assert(err, IsNil)
-	c.Check(b, DeepEquals, testutil.DecodeHexString(c, "00000003"+
+	c.Check(b, DeepEquals, testutil.DecodeHexString(c, "ffffffff"+"00000002"+"00000001"+
+		"00000003"+
 		"0020424816d020cf3d793ac021da47379bdf608080a83eb9364a7fbe0bdfa87111d7"+
 		"0020a98b1d896c9383603b7923fffe230c9e4df24218eb84c90c5c758e63ce62843c"+
 		"00200000000000000000000000000000000000000000000000000000000000000000"+
@@ -972,6 +1045,34 @@ func (s *pcrProfileSuite) TestMarshalAndUnmarshal(c *C) {
 `)
 }
 
+func (s *pcrProfileSuite) TestUnmarshalNoHeader(c *C) {
+	// Profiles saved by older versions don't have a header.
+	b := testutil.DecodeHexString(c, "00000001"+
+		"0020424816d020cf3d793ac021da47379bdf608080a83eb9364a7fbe0bdfa87111d7"+
+		"00000003"+
+		"0102000b0000000707")
+
+	var p *PCRProtectionProfile
+	_, err := mu.UnmarshalFromBytes(b, &p)
+	c.Assert(err, IsNil)
+	c.Check(p.String(), Equals, `
+ AddPCRValue(TPM_ALG_SHA256, 7, 424816d020cf3d793ac021da47379bdf608080a83eb9364a7fbe0bdfa87111d7)
+`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalRequiresNewer(c *C) {
+	b := testutil.DecodeHexString(c, "ffffffff"+"00000004"+"00000003"+"00000000"+"00000000")
+
+	var p *PCRProtectionProfile
+	_, err := mu.UnmarshalFromBytes(b, &p)
+	c.Check(err, ErrorMatches, "cannot unmarshal argument 0 whilst processing element of type "+
+		"tpm2.PCRProtectionProfile: PCR profile requires newer secboot \\(format version 3 is required, but this version only supports 2\\)")
+
+	var e *secboot.ArtifactVersionError
+	c.Assert(xerrors.As(err, &e), testutil.IsTrue)
+	c.Check(e.ProducerVersion, Equals, 4)
+}
+
 func (s *pcrProfileSuite) TestUnmarshalDigestIndexOutOfRange(c *C) {
 	b := testutil.DecodeHexString(c, "00000000000000030102000b0000100707")
 
@@ -0,0 +1,208 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"golang.org/x/xerrors"
+)
+
+// PCRMismatch describes a PCR that has a value which differs from the value
+// expected by a PCR policy.
+type PCRMismatch struct {
+	Alg      tpm2.HashAlgorithmId
+	PCR      int
+	Expected tpm2.Digest
+	Actual   tpm2.Digest
+}
+
+func (m PCRMismatch) String() string {
+	return fmt.Sprintf("PCR%d,%v: expected %x, got %x", m.PCR, m.Alg, m.Expected, m.Actual)
+}
+
+// PCRPolicyValidationResult is the result of validating the PCR policy of a
+// sealed key object against the current PCR values.
+type PCRPolicyValidationResult struct {
+	// Satisfied indicates whether the current PCR values match one of the
+	// sets of values approved by the PCR policy.
+	Satisfied bool
+
+	// Selection is the PCR selection that the PCR policy applies to.
+	Selection tpm2.PCRSelectionList
+
+	// CurrentValues contains the current values of the selected PCRs.
+	CurrentValues tpm2.PCRValues
+
+	// CurrentDigest is the digest of CurrentValues that is used by the
+	// TPM2_PolicyPCR assertion.
+	CurrentDigest tpm2.Digest
+
+	alg      tpm2.HashAlgorithmId
+	approved tpm2.DigestList
+}
+
+func (r *PCRPolicyValidationResult) isApproved(digest tpm2.Digest) bool {
+	for _, d := range r.approved {
+		if bytes.Equal(d, digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mismatches returns the PCRs that don't have the values expected by the PCR
+// policy. The key data only records a digest of each approved set of PCR values,
+// so the expected values are obtained from the supplied profile, which should
+// be the one that the current PCR policy was created from. Only branches of the
+// profile that correspond to approved sets of values are considered, and the
+// mismatches for the branch that is closest to the current PCR values are
+// returned. The profile must not contain values that are read from the TPM. If
+// the PCR policy is satisfied, no mismatches are returned.
+func (r *PCRPolicyValidationResult) Mismatches(profile *PCRProtectionProfile) ([]PCRMismatch, error) {
+	if r.Satisfied {
+		return nil, nil
+	}
+
+	branches, err := profile.ComputePCRValues(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from profile: %w", err)
+	}
+
+	var out []PCRMismatch
+	found := false
+	for _, values := range branches {
+		pcrDigest, err := util.ComputePCRDigest(r.alg, r.Selection, values)
+		if err != nil {
+			// This branch doesn't contain values for all of the selected PCRs.
+			continue
+		}
+		trial := util.ComputeAuthPolicy(r.alg)
+		trial.PolicyPCR(pcrDigest, r.Selection)
+		if !r.isApproved(trial.GetDigest()) {
+			continue
+		}
+
+		var mismatches []PCRMismatch
+		for _, s := range r.Selection {
+			for _, pcr := range s.Select {
+				expected := values[s.Hash][pcr]
+				actual := r.CurrentValues[s.Hash][pcr]
+				if bytes.Equal(expected, actual) {
+					continue
+				}
+				mismatches = append(mismatches, PCRMismatch{Alg: s.Hash, PCR: pcr, Expected: expected, Actual: actual})
+			}
+		}
+
+		if !found || len(mismatches) < len(out) {
+			out = mismatches
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, errors.New("the profile doesn't contain any of the sets of PCR values approved by the PCR policy")
+	}
+	return out, nil
+}
+
+func (k *sealedKeyDataBase) validateAgainstCurrentPCRs(tpm *tpm2.TPMContext) (*PCRPolicyValidationResult, error) {
+	var pcrData *pcrPolicyData_v0
+	switch p := k.data.Policy().(type) {
+	case *keyDataPolicy_v0:
+		pcrData = p.PCRData
+	case *keyDataPolicy_v1:
+		pcrData = p.PCRData
+	case *keyDataPolicy_v3:
+		pcrData = p.PCRData
+	default:
+		return nil, fmt.Errorf("unsupported policy type %T", p)
+	}
+
+	tree, err := pcrData.OrData.resolve()
+	if err != nil {
+		return nil, InvalidKeyDataError{fmt.Sprintf("cannot resolve PolicyOR tree: %v", err)}
+	}
+
+	result := &PCRPolicyValidationResult{
+		Selection: pcrData.Selection,
+		alg:       k.data.Public().NameAlg}
+	for _, n := range tree.leafNodes {
+		result.approved = append(result.approved, n.digests...)
+	}
+
+	_, values, err := tpm.PCRRead(pcrData.Selection)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+	result.CurrentValues = values
+
+	currentDigest, err := util.ComputePCRDigest(result.alg, pcrData.Selection, values)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute digest of current PCR values: %w", err)
+	}
+	result.CurrentDigest = currentDigest
+
+	// Execute the PCR assertion in a trial session so that the TPM computes
+	// the policy digest from the current PCR values.
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeTrial, nil, result.alg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start trial session: %w", err)
+	}
+	defer tpm.FlushContext(session)
+
+	if err := tpm.PolicyPCR(session, nil, pcrData.Selection); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyPCR, 2) {
+			return nil, InvalidKeyDataError{"invalid PCR selection"}
+		}
+		return nil, xerrors.Errorf("cannot execute PCR assertion: %w", err)
+	}
+
+	digest, err := tpm.PolicyGetDigest(session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain trial session digest: %w", err)
+	}
+	result.Satisfied = result.isApproved(digest)
+
+	return result, nil
+}
+
+// ValidateAgainstCurrentPCRs determines whether the current PCR values satisfy
+// the PCR policy of this sealed key object, by executing the PCR assertion in a
+// trial session. This doesn't check that the PCR policy hasn't been revoked.
+// If the policy isn't satisfied, the returned result can be used to determine
+// which PCRs have unexpected values.
+func (k *SealedKeyObject) ValidateAgainstCurrentPCRs(tpm *Connection) (*PCRPolicyValidationResult, error) {
+	return k.validateAgainstCurrentPCRs(tpm.TPMContext)
+}
+
+// ValidateAgainstCurrentPCRs determines whether the current PCR values satisfy
+// the PCR policy of this sealed key object, by executing the PCR assertion in a
+// trial session. This doesn't check that the PCR policy hasn't been revoked.
+// If the policy isn't satisfied, the returned result can be used to determine
+// which PCRs have unexpected values.
+func (k *SealedKeyData) ValidateAgainstCurrentPCRs(tpm *Connection) (*PCRPolicyValidationResult, error) {
+	return k.validateAgainstCurrentPCRs(tpm.TPMContext)
+}
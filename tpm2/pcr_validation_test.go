@@ -0,0 +1,137 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type pcrValidationSuiteNoTPM struct{}
+
+var _ = Suite(&pcrValidationSuiteNoTPM{})
+
+type pcrValidationSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *pcrValidationSuiteNoTPM) TestPCRMismatchString(c *C) {
+	m := PCRMismatch{
+		Alg:      tpm2.HashAlgorithmSHA256,
+		PCR:      7,
+		Expected: tpm2.Digest{0x01, 0x02},
+		Actual:   tpm2.Digest{0x03, 0x04}}
+	c.Check(m.String(), Equals, "PCR7,TPM_ALG_SHA256: expected 0102, got 0304")
+}
+
+func (s *pcrValidationSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *pcrValidationSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&pcrValidationSuite{})
+
+func (s *pcrValidationSuite) newKey(c *C, profile *PCRProtectionProfile) *SealedKeyData {
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	return skd
+}
+
+func (s *pcrValidationSuite) TestValidateAgainstCurrentPCRsSatisfied(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+	k := s.newKey(c, profile)
+
+	result, err := k.ValidateAgainstCurrentPCRs(s.TPM())
+	c.Assert(err, IsNil)
+	c.Check(result.Satisfied, testutil.IsTrue)
+	c.Check(result.Selection, tpm2_testutil.TPMValueDeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+
+	_, values, err := s.TPM().PCRRead(result.Selection)
+	c.Assert(err, IsNil)
+	c.Check(result.CurrentValues, DeepEquals, values)
+
+	mismatches, err := result.Mismatches(profile)
+	c.Check(err, IsNil)
+	c.Check(mismatches, HasLen, 0)
+}
+
+func (s *pcrValidationSuite) TestValidateAgainstCurrentPCRsNotSatisfied(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+	k := s.newKey(c, profile)
+
+	_, expected, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}})
+	c.Assert(err, IsNil)
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	result, err := k.ValidateAgainstCurrentPCRs(s.TPM())
+	c.Assert(err, IsNil)
+	c.Check(result.Satisfied, testutil.IsFalse)
+
+	mismatches, err := result.Mismatches(profile)
+	c.Check(err, IsNil)
+	c.Check(mismatches, DeepEquals, []PCRMismatch{
+		{
+			Alg:      tpm2.HashAlgorithmSHA256,
+			PCR:      23,
+			Expected: expected[tpm2.HashAlgorithmSHA256][23],
+			Actual:   result.CurrentValues[tpm2.HashAlgorithmSHA256][23],
+		},
+	})
+}
+
+func (s *pcrValidationSuite) TestMismatchesWithUnrelatedProfile(c *C) {
+	k := s.newKey(c, tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}))
+
+	_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	result, err := k.ValidateAgainstCurrentPCRs(s.TPM())
+	c.Assert(err, IsNil)
+	c.Check(result.Satisfied, testutil.IsFalse)
+
+	profile := NewPCRProtectionProfile()
+	profile.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+	_, err = result.Mismatches(profile)
+	c.Check(err, ErrorMatches, `the profile doesn't contain any of the sets of PCR values approved by the PCR policy`)
+}
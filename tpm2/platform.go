@@ -20,6 +20,7 @@
 package tpm2
 
 import (
+	"context"
 	_ "crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -38,7 +39,7 @@ const platformName = "tpm2"
 
 type platformKeyDataHandler struct{}
 
-func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData, encryptedPayload, authKey []byte) ([]byte, error) {
+func (h *platformKeyDataHandler) recoverKeysCommon(ctx context.Context, data *secboot.PlatformKeyData, encryptedPayload, authKey []byte) ([]byte, error) {
 	if data.Generation < 0 || int64(data.Generation) > math.MaxUint32 {
 		return nil, &secboot.PlatformHandlerError{
 			Type: secboot.PlatformHandlerErrorInvalidData,
@@ -67,7 +68,7 @@ func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData
 			Err:  fmt.Errorf("invalid key data version: %d", k.data.Version())}
 	}
 
-	tpm, err := ConnectToTPM()
+	tpm, err := ConnectToTPMContext(ctx)
 	switch {
 	case err == ErrNoTPM2Device:
 		return nil, &secboot.PlatformHandlerError{
@@ -78,8 +79,11 @@ func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData
 	}
 	defer tpm.Close()
 
-	symKey, err := k.unsealDataFromTPM(tpm.TPMContext, authKey, tpm.HmacSession())
-	if err != nil {
+	var symKey []byte
+	if err := tpm.RunWithContext(ctx, func() (err error) {
+		symKey, err = k.unsealDataFromTPM(tpm.TPMContext, authKey, tpm.HmacSession(), tpm.nvReadEncryptAttrs())
+		return err
+	}); err != nil {
 		var e InvalidKeyDataError
 		switch {
 		case xerrors.As(err, &e):
@@ -113,11 +117,24 @@ func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData
 }
 
 func (h *platformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
-	return h.recoverKeysCommon(data, encryptedPayload, nil)
+	return h.RecoverKeysContext(context.Background(), data, encryptedPayload)
+}
+
+// RecoverKeysContext implements [secboot.PlatformKeyDataHandlerWithContext].
+// See Connection.RunWithContext for details of how the context is used.
+func (h *platformKeyDataHandler) RecoverKeysContext(ctx context.Context, data *secboot.PlatformKeyData, encryptedPayload []byte) ([]byte, error) {
+	return h.recoverKeysCommon(ctx, data, encryptedPayload, nil)
 }
 
 func (h *platformKeyDataHandler) RecoverKeysWithAuthKey(data *secboot.PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
-	return h.recoverKeysCommon(data, encryptedPayload, key)
+	return h.RecoverKeysWithAuthKeyContext(context.Background(), data, encryptedPayload, key)
+}
+
+// RecoverKeysWithAuthKeyContext implements
+// [secboot.PlatformKeyDataHandlerWithContext]. See Connection.RunWithContext
+// for details of how the context is used.
+func (h *platformKeyDataHandler) RecoverKeysWithAuthKeyContext(ctx context.Context, data *secboot.PlatformKeyData, encryptedPayload, key []byte) ([]byte, error) {
+	return h.recoverKeysCommon(ctx, data, encryptedPayload, key)
 }
 
 func (h *platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, old, new []byte) ([]byte, error) {
@@ -146,6 +163,11 @@ func (h *platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, ol
 			Type: secboot.PlatformHandlerErrorInvalidData,
 			Err:  fmt.Errorf("invalid key data version: %d", k.data.Version())}
 	}
+	if policy, ok := k.data.Policy().(*keyDataPolicy_v3); ok && !policy.StaticData.RequireAuthValue {
+		// The authorization policy for keys created without a passphrase doesn't
+		// require knowledge of the auth value, so setting one would have no effect.
+		return nil, errors.New("cannot set passphrase on a key that was created without passphrase support")
+	}
 
 	// Validate the initial key data
 	_, err = k.validateData(tpm.TPMContext, data.Role)
@@ -192,6 +214,11 @@ func (h *platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, ol
 		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
 		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
 	}
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create session: %w", err)
+	}
+	defer releaseSession()
 	session, err := tpm.StartAuthSession(srk, nil, tpm2.SessionTypeHMAC, symmetric, k.data.Public().NameAlg, nil)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot create session: %w", err)
@@ -230,6 +257,85 @@ func (h *platformKeyDataHandler) ChangeAuthKey(data *secboot.PlatformKeyData, ol
 	return newHandle, nil
 }
 
+// pcrProtectionLevel classifies the protection provided by a PCR policy with
+// the supplied PCR selection. A policy that includes the boot manager code PCR
+// or the secure boot policy PCR is bound to the integrity of the boot chain,
+// and one that also includes the kernel configuration PCR is additionally
+// bound to the kernel commandline and system model.
+func pcrProtectionLevel(pcrs tpm2.PCRSelectionList) secboot.ProtectionLevel {
+	selected := make(map[int]bool)
+	for _, s := range pcrs {
+		for _, pcr := range s.Select {
+			selected[pcr] = true
+		}
+	}
+
+	switch {
+	case !selected[bootManagerCodePCR] && !selected[secureBootPolicyPCR]:
+		return secboot.ProtectionLevelLow
+	case !selected[kernelConfigPCR]:
+		return secboot.ProtectionLevelMedium
+	default:
+		return secboot.ProtectionLevelHigh
+	}
+}
+
+// ProtectionLevel implements [secboot.PlatformKeyDataProtectionAssessor].
+func (h *platformKeyDataHandler) ProtectionLevel(data *secboot.PlatformKeyData) (secboot.ProtectionLevel, error) {
+	var k *SealedKeyData
+	if err := json.Unmarshal(data.EncodedHandle, &k); err != nil {
+		return secboot.ProtectionLevelNone, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err}
+	}
+	policy, ok := k.data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		return secboot.ProtectionLevelNone, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("invalid key data version: %d", k.data.Version())}
+	}
+
+	return pcrProtectionLevel(policy.PCRData.Selection), nil
+}
+
+// PolicyBranch implements [secboot.PlatformKeyDataHandlerWithPolicyBranch].
+// The returned string has the form "pcr-branch-N", where N is the index of
+// the branch of the PCR policy that is satisfied by the current PCR values.
+// Branches are numbered in the order that the PCR values are generated by
+// the PCRProtectionProfile that the key was sealed with.
+func (h *platformKeyDataHandler) PolicyBranch(data *secboot.PlatformKeyData) (string, error) {
+	var k *SealedKeyData
+	if err := json.Unmarshal(data.EncodedHandle, &k); err != nil {
+		return "", &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err}
+	}
+	policy, ok := k.data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		return "", &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("invalid key data version: %d", k.data.Version())}
+	}
+
+	tpm, err := ConnectToTPM()
+	switch {
+	case err == ErrNoTPM2Device:
+		return "", &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorUnavailable,
+			Err:  err}
+	case err != nil:
+		return "", xerrors.Errorf("cannot connect to TPM: %w", err)
+	}
+	defer tpm.Close()
+
+	branch, err := policy.pcrPolicyBranch(tpm.TPMContext, k.data.Public().NameAlg)
+	if err != nil {
+		return "", xerrors.Errorf("cannot determine PCR policy branch: %w", err)
+	}
+	return fmt.Sprintf("pcr-branch-%d", branch), nil
+}
+
 func init() {
 	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
+	secboot.RegisterRecoveryKeyGraceCounterHandler(platformName, &recoveryKeyGraceCounterHandler{})
 }
@@ -20,6 +20,7 @@
 package tpm2_test
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	gohash "hash"
@@ -109,6 +110,26 @@ func (s *platformSuite) TestRecoverKeysWithPassphraseIntegrated(c *C) {
 	c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
 }
 
+func (s *platformSuite) TestRecoverKeysWithPassphraseIntegratedMultipleKeys(c *C) {
+	params := &PassphraseProtectKeyParams{
+		ProtectKeyParams: ProtectKeyParams{
+			PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+			PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0),
+		},
+	}
+
+	keys, primaryKey, unlockKeys, err := SealKeysToTPMWithPassphrase(s.TPM(), params, []string{"run+recover", "recover"}, "passphrase")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	for i, k := range keys {
+		unlockKeyUnsealed, primaryKeyUnsealed, err := k.RecoverKeysWithPassphrase("passphrase")
+		c.Check(err, IsNil)
+		c.Check(unlockKeyUnsealed, DeepEquals, unlockKeys[i])
+		c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
+	}
+}
+
 func (s *platformSuite) TestRecoverKeysWithPassphraseIntegratedPBKDF2(c *C) {
 	params := &ProtectKeyParams{
 		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
@@ -195,6 +216,56 @@ func (s *platformSuite) TestChangePassphraseWithBadPassphraseIntegrated(c *C) {
 	c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
 }
 
+func (s *platformSuite) TestSetAuthModeRemoveAndRestorePassphraseIntegrated(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0),
+		Role:                   "",
+	}
+
+	passphraseParams := &PassphraseProtectKeyParams{
+		ProtectKeyParams: *params,
+	}
+
+	k, primaryKey, unlockKey, err := NewTPMPassphraseProtectedKey(s.TPM(), passphraseParams, "passphrase")
+	c.Assert(err, IsNil)
+
+	c.Check(k.SetAuthMode(&secboot.SetAuthModeParams{Mode: secboot.AuthModeNone, OldPassphrase: "passphrase"}), IsNil)
+
+	unlockKeyUnsealed, primaryKeyUnsealed, err := k.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(unlockKeyUnsealed, DeepEquals, unlockKey)
+	c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
+
+	c.Check(k.SetAuthMode(&secboot.SetAuthModeParams{
+		Mode:          secboot.AuthModePassphrase,
+		NewPassphrase: "1234",
+		AuthKeySize:   32}), IsNil)
+
+	unlockKeyUnsealed, primaryKeyUnsealed, err = k.RecoverKeysWithPassphrase("1234")
+	c.Check(err, IsNil)
+	c.Check(unlockKeyUnsealed, DeepEquals, unlockKey)
+	c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
+}
+
+func (s *platformSuite) TestSetAuthModeEnablePassphraseNotSupportedIntegrated(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0),
+		Role:                   "",
+	}
+
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	err = k.SetAuthMode(&secboot.SetAuthModeParams{
+		Mode:          secboot.AuthModePassphrase,
+		NewPassphrase: "1234",
+		AuthKeySize:   32})
+	c.Check(err, ErrorMatches, `cannot perform action because of an unexpected error: cannot set passphrase on a key that was created without passphrase support`)
+	c.Check(k.AuthMode(), Equals, secboot.AuthModeNone)
+}
+
 func (s *platformSuite) verifyASN1(c *C, data []byte) (primaryKey, unique []byte) {
 	d := cryptobyte.String(data)
 	c.Assert(d.ReadASN1(&d, cryptobyte_asn1.SEQUENCE), Equals, true)
@@ -385,6 +456,30 @@ func (s *platformSuite) TestRecoverKeysNoTPMConnection(c *C) {
 	c.Check(err, ErrorMatches, "no TPM2 device is available")
 }
 
+func (s *platformSuite) TestRecoverKeysContextCancelled(c *C) {
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		Role:                   "",
+	})
+	c.Check(err, IsNil)
+
+	var platformHandle json.RawMessage
+	c.Check(k.UnmarshalPlatformHandle(&platformHandle), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var handler PlatformKeyDataHandler
+	_, err = handler.RecoverKeysContext(ctx, &secboot.PlatformKeyData{
+		Generation:    k.Generation(),
+		EncodedHandle: platformHandle,
+		KDFAlg:        crypto.Hash(crypto.SHA256)},
+		s.lastEncryptedPayload)
+	c.Check(err, testutil.ErrorIs, context.Canceled)
+	c.Check(err, ErrorMatches, "cannot connect to TPM: context canceled")
+}
+
 func (s *platformSuite) testRecoverKeysUnsealErrorHandling(c *C, prepare func(*secboot.KeyData, secboot.PrimaryKey)) error {
 	params := &ProtectKeyParams{
 		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
@@ -478,7 +573,7 @@ func (s *platformSuite) TestRecoverKeysWithAuthKey(c *C) {
 
 	// Need to mock newKeyDataPolicy to force require an auth value when using NewTPMProtectedKey so that we don't
 	// have to use the passphrase APIs.
-	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue bool) (KeyDataPolicy, tpm2.Digest, error) {
+	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
 		index := tpm2.HandleNull
 		var indexName tpm2.Name
 		if pcrPolicyCounterPub != nil {
@@ -555,7 +650,7 @@ func (s *platformSuite) TestRecoverKeysWithIncorrectAuthKey(c *C) {
 
 	// Need to mock newKeyDataPolicy to force require an auth value when using NewTPMProtectedKey so that we don't
 	// have to use the passphrase APIs.
-	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue bool) (KeyDataPolicy, tpm2.Digest, error) {
+	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
 		index := tpm2.HandleNull
 		var indexName tpm2.Name
 		if pcrPolicyCounterPub != nil {
@@ -627,7 +722,7 @@ func (s *platformSuite) TestChangeAuthKeyWithIncorrectAuthKey(c *C) {
 
 	// Need to mock newKeyDataPolicy to force require an auth value when using NewTPMProtectedKey so that we don't
 	// have to use the passphrase APIs.
-	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue bool) (KeyDataPolicy, tpm2.Digest, error) {
+	restore := MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
 		index := tpm2.HandleNull
 		var indexName tpm2.Name
 		if pcrPolicyCounterPub != nil {
@@ -693,3 +788,53 @@ func (s *platformSuite) TestChangeAuthKeyWithIncorrectAuthKey(c *C) {
 	c.Check(err, ErrorMatches, "TPM returned an error for session 1 whilst executing command TPM_CC_ObjectChangeAuth: "+
 		"TPM_RC_AUTH_FAIL \\(the authorization HMAC check failed and DA counter incremented\\)")
 }
+
+func (s *platformSuite) testProtectionLevel(c *C, pcrs []int, expected secboot.ProtectionLevel) {
+	params := &ProtectKeyParams{PCRPolicyCounterHandle: tpm2.HandleNull}
+	if pcrs != nil {
+		params.PCRProfile = tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, pcrs)
+	}
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), params)
+	c.Assert(err, IsNil)
+
+	strength, err := secboot.AssessKeyDataProtection(k, secboot.PassphraseEntropyUnknown)
+	c.Assert(err, IsNil)
+	c.Check(strength.PlatformAssessed, testutil.IsTrue)
+	c.Check(strength.PlatformLevel, Equals, expected)
+	c.Check(strength.Level, Equals, expected)
+}
+
+func (s *platformSuite) TestProtectionLevelNilPCRProfile(c *C) {
+	s.testProtectionLevel(c, nil, secboot.ProtectionLevelLow)
+}
+
+func (s *platformSuite) TestProtectionLevelSecureBootPolicy(c *C) {
+	s.testProtectionLevel(c, []int{7}, secboot.ProtectionLevelMedium)
+}
+
+func (s *platformSuite) TestProtectionLevelSecureBootPolicyAndKernelConfig(c *C) {
+	s.testProtectionLevel(c, []int{7, 12}, secboot.ProtectionLevelHigh)
+}
+
+type platformSuiteNoTPM struct{}
+
+var _ = Suite(&platformSuiteNoTPM{})
+
+func (s *platformSuiteNoTPM) TestPCRProtectionLevel(c *C) {
+	for _, t := range []struct {
+		pcrs     tpm2.PCRSelectionList
+		expected secboot.ProtectionLevel
+	}{
+		{pcrs: nil, expected: secboot.ProtectionLevelLow},
+		{pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{0, 2}}}, expected: secboot.ProtectionLevelLow},
+		{pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4}}}, expected: secboot.ProtectionLevelMedium},
+		{pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}, expected: secboot.ProtectionLevelMedium},
+		{pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{12}}}, expected: secboot.ProtectionLevelLow},
+		{pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}, expected: secboot.ProtectionLevelHigh},
+		{pcrs: tpm2.PCRSelectionList{
+			{Hash: tpm2.HashAlgorithmSHA1, Select: []int{12}},
+			{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}, expected: secboot.ProtectionLevelHigh},
+	} {
+		c.Check(PcrProtectionLevel(t.pcrs), Equals, t.expected, Commentf("%v", t.pcrs))
+	}
+}
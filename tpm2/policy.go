@@ -21,7 +21,6 @@ package tpm2
 
 import (
 	"bytes"
-	"crypto"
 	_ "crypto/sha256"
 	"errors"
 
@@ -50,12 +49,26 @@ type pcrPolicyParams struct {
 	pcrs       tpm2.PCRSelectionList // PCR selection
 	pcrDigests tpm2.DigestList       // Approved PCR digests
 
+	// alternatePcrBanks contains additional approved PCR digests for subsets
+	// of the PCR banks in pcrs. See pcrBankDigests.
+	alternatePcrBanks []*pcrBankDigests
+
 	// policyCounterName is the name of the NV index used for revoking authorization
 	// policies. The name must be associated with the handle in the keyDataPolicy,
 	// else the policy will not work.
 	policyCounterName tpm2.Name
 
 	policySequence uint64 // the PCR policy sequence
+
+	// nvGeneration is an optional NV generation check, and nvGenerationIndexName
+	// is the name of the associated NV index. This is only supported by version 3
+	// key data and later.
+	nvGeneration          *nvGenerationCheck
+	nvGenerationIndexName tpm2.Name
+
+	// resetCount is an optional check of the TPM's reset count. This is only
+	// supported by version 3 key data and later.
+	resetCount *resetCountCheck
 }
 
 // policyOrNode represents a collection of up to 8 digests used in a single
@@ -164,6 +177,11 @@ func createPcrPolicyCounterLegacy(tpm *tpm2.TPMContext, handle tpm2.Handle, upda
 	}()
 
 	// Begin a session to initialize the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer releaseSession()
 	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
 	if err != nil {
 		return nil, 0, err
@@ -205,7 +223,8 @@ func createPcrPolicyCounterLegacy(tpm *tpm2.TPMContext, handle tpm2.Handle, upda
 // If hmacSession is supplied, it is used for authenticating with the storage hierarchy, in order to avoid
 // transmitting the cleartext auth value, and must have the AttrContinueSession attribute set
 var ensurePcrPolicyCounter = func(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, hmacSession tpm2.SessionContext) (public *tpm2.NVPublic, err error) {
-	nameAlg := tpm2.HashAlgorithmSHA256
+	// Use the same name algorithm as the key for authorizing updates.
+	nameAlg := updateKey.NameAlg
 
 	authPolicies := computeV3PcrPolicyCounterAuthPolicies(nameAlg, updateKey.Name())
 
@@ -214,7 +233,7 @@ var ensurePcrPolicyCounter = func(tpm *tpm2.TPMContext, handle tpm2.Handle, upda
 
 	public = &tpm2.NVPublic{
 		Index:      handle,
-		NameAlg:    tpm2.HashAlgorithmSHA256,
+		NameAlg:    nameAlg,
 		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA),
 		AuthPolicy: trial.GetDigest(),
 		Size:       8}
@@ -235,6 +254,11 @@ var ensurePcrPolicyCounter = func(tpm *tpm2.TPMContext, handle tpm2.Handle, upda
 		}()
 
 		// Begin a session to initialize the index.
+		releaseSession, err := secboot.ReserveTPMSessions(1)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseSession()
 		policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
 		if err != nil {
 			return nil, err
@@ -274,13 +298,13 @@ var ensurePcrPolicyCounter = func(tpm *tpm2.TPMContext, handle tpm2.Handle, upda
 	return public, nil
 }
 
-var newPolicyAuthPublicKey = func(key secboot.PrimaryKey) (*tpm2.Public, error) {
-	ecdsaKey, err := deriveV3PolicyAuthKey(crypto.SHA256, key)
+var newPolicyAuthPublicKey = func(nameAlg tpm2.HashAlgorithmId, key secboot.PrimaryKey) (*tpm2.Public, error) {
+	ecdsaKey, err := deriveV3PolicyAuthKey(nameAlg.GetHash(), key)
 	if err != nil {
 		return nil, err
 	}
 
-	return util.NewExternalECCPublicKey(tpm2.HashAlgorithmSHA256, templates.KeyUsageSign, nil, &ecdsaKey.PublicKey), nil
+	return util.NewExternalECCPublicKey(nameAlg, templates.KeyUsageSign, nil, &ecdsaKey.PublicKey), nil
 }
 
 // ensureSufficientORDigests turns a single digest in to a pair of identical digests.
@@ -298,6 +322,12 @@ func ensureSufficientORDigests(digests tpm2.DigestList) tpm2.DigestList {
 //   - The PCR policy created by updatePcrPolicy and authorized by key is valid and has been satisfied (by way
 //     of a PolicyAuthorize assertion, which allows the PCR policy to be updated without creating a new sealed
 //     key object).
+//   - Optionally, knowledge of the authorization value for the endorsement hierarchy has been demonstrated
+//     (by way of a PolicySecret assertion), if requireEndorsementAuth is true. This binds the key to the
+//     TPM's endorsement hierarchy, and therefore to the TPM's identity.
+//   - Optionally, knowledge of the authorization value or satisfaction of the authorization policy for the
+//     NV index or object with the name externalAuthName (by way of a PolicySecret assertion), if it is
+//     supplied. This permits an external authenticator to gate unsealing.
 //   - Knowledge of the the authorization value for the entity on which the policy session is used has been
 //     demonstrated by the caller - this will be used in the future as part of the passphrase integration.
 //
@@ -310,7 +340,7 @@ func ensureSufficientORDigests(digests tpm2.DigestList) tpm2.DigestList {
 //
 // This returns some policy metadata and a policy digest which is used as the auth policy field of the
 // protected object.
-var newKeyDataPolicy = func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue bool) (keyDataPolicy, tpm2.Digest, error) {
+var newKeyDataPolicy = func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (keyDataPolicy, tpm2.Digest, error) {
 	if len(role) > 1024 {
 		// We serialize this in the TPM wire format in computeV3PcrPolicyRef and define the
 		// type as TPM2B_MAX_BUFFER in the SE041, and this has a maximum size of 1024 bytes,
@@ -326,10 +356,16 @@ var newKeyDataPolicy = func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role str
 		pcrPolicyCounterName = pcrPolicyCounterPub.Name()
 	}
 
-	pcrPolicyRef := computeV3PcrPolicyRef(key.NameAlg, []byte(role), pcrPolicyCounterName)
+	pcrPolicyRef := computeV3PcrPolicyRef(key.NameAlg, secboot.RoleDerivationLabel(role), pcrPolicyCounterName)
 
 	trial := util.ComputeAuthPolicy(alg)
 	trial.PolicyAuthorize(pcrPolicyRef, key.Name())
+	if requireEndorsementAuth {
+		trial.PolicySecret(tpm2.MakeHandleName(tpm2.HandleEndorsement), nil)
+	}
+	if len(externalAuthName) > 0 {
+		trial.PolicySecret(externalAuthName, nil)
+	}
 	if requireAuthValue {
 		trial.PolicyAuthValue()
 	}
@@ -339,7 +375,9 @@ var newKeyDataPolicy = func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role str
 			AuthPublicKey:          key,
 			PCRPolicyRef:           pcrPolicyRef,
 			PCRPolicyCounterHandle: pcrPolicyCounterHandle,
-			RequireAuthValue:       requireAuthValue},
+			RequireAuthValue:       requireAuthValue,
+			RequireEndorsementAuth: requireEndorsementAuth,
+			ExternalAuthName:       externalAuthName},
 		PCRData: &pcrPolicyData_v3{
 			// Set AuthorizedPolicySignature here because this object needs to be
 			// serializable before the initial signature is created.
@@ -510,6 +548,22 @@ func (t *policyOrTree) executeAssertions(tpm *tpm2.TPMContext, session tpm2.Sess
 	return nil
 }
 
+// leafIndex returns the index of the supplied digest within the leaf nodes of
+// this tree, which is its index in the list of digests that the tree was
+// created from.
+func (t *policyOrTree) leafIndex(digest tpm2.Digest) (int, bool) {
+	i := 0
+	for _, n := range t.leafNodes {
+		for _, d := range n.digests {
+			if bytes.Equal(d, digest) {
+				return i, true
+			}
+			i++
+		}
+	}
+	return -1, false
+}
+
 // BlockPCRProtectionPolicies inserts a fence in to the specific PCRs for all active PCR banks, in order to
 // make PCR policies that depend on the specified PCRs and are satisfiable by the current PCR values invalid
 // until the next TPM restart (equivalent to eg, system resume from suspend-to-disk) or TPM reset
@@ -0,0 +1,285 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// PCRPolicyCounterStatus describes the state of the PCR policy counter associated
+// with a key.
+type PCRPolicyCounterStatus int
+
+const (
+	// PCRPolicyCounterStatusNone indicates that the key doesn't have a PCR
+	// policy counter.
+	PCRPolicyCounterStatusNone PCRPolicyCounterStatus = iota
+
+	// PCRPolicyCounterStatusOK indicates that the key's PCR policy counter
+	// exists on the TPM.
+	PCRPolicyCounterStatusOK
+
+	// PCRPolicyCounterStatusMissing indicates that there is no NV index at
+	// the handle of the key's PCR policy counter. This can be caused by a
+	// firmware bug or NV wear, and the key's PCR policy cannot be satisfied
+	// until the counter is recreated with RepairPCRPolicyCounters.
+	PCRPolicyCounterStatusMissing
+
+	// PCRPolicyCounterStatusInvalid indicates that there is a NV index at
+	// the handle of the key's PCR policy counter, but it isn't the index
+	// that the key was created with. This is only detected for keys created
+	// with ProtectKeyWithTPM and related APIs.
+	PCRPolicyCounterStatusInvalid
+)
+
+func (s PCRPolicyCounterStatus) String() string {
+	switch s {
+	case PCRPolicyCounterStatusNone:
+		return "none"
+	case PCRPolicyCounterStatusOK:
+		return "ok"
+	case PCRPolicyCounterStatusMissing:
+		return "missing"
+	case PCRPolicyCounterStatusInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("PCRPolicyCounterStatus(%d)", int(s))
+	}
+}
+
+func (k *sealedKeyDataBase) pcrPolicyCounterStatus(tpm *tpm2.TPMContext, role string) (PCRPolicyCounterStatus, error) {
+	handle := k.data.Policy().PCRPolicyCounterHandle()
+	switch {
+	case handle == tpm2.HandleNull:
+		return PCRPolicyCounterStatusNone, nil
+	case handle.Type() != tpm2.HandleTypeNVIndex:
+		return 0, InvalidKeyDataError{"PCR policy counter handle is invalid"}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return PCRPolicyCounterStatusMissing, nil
+	case err != nil:
+		return 0, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+	}
+
+	if policy, ok := k.data.Policy().(*keyDataPolicy_v3); ok {
+		alg := policy.StaticData.AuthPublicKey.NameAlg
+		expected := computeV3PcrPolicyRefFromCounterContext(alg, secboot.RoleDerivationLabel(role), index)
+		if !bytes.Equal(expected, policy.StaticData.PCRPolicyRef) {
+			return PCRPolicyCounterStatusInvalid, nil
+		}
+	}
+
+	return PCRPolicyCounterStatusOK, nil
+}
+
+// PCRPolicyCounterStatus returns the state of the PCR policy counter associated with
+// this key. This can be used to determine whether a failure to recover this key is
+// because the counter has disappeared, rather than because the PCR values don't match
+// the PCR policy.
+func (k *SealedKeyData) PCRPolicyCounterStatus(tpm *Connection) (PCRPolicyCounterStatus, error) {
+	return k.pcrPolicyCounterStatus(tpm.TPMContext, k.k.Role())
+}
+
+// PCRPolicyCounterRepairResult is the result of RepairPCRPolicyCounters.
+type PCRPolicyCounterRepairResult struct {
+	// RecreatedCounters contains the handles of the PCR policy counters
+	// that were recreated.
+	RecreatedCounters []tpm2.Handle
+
+	// Repaired contains the keys whose PCR policies can be used again with
+	// the recreated counters. Some of these will have been updated with a
+	// reauthorized PCR policy, so they must all be persisted.
+	Repaired []*secboot.KeyData
+
+	// NeedsReseal contains the keys with a missing or invalid PCR policy
+	// counter that could not be repaired. These must be recreated with a
+	// new PCR protection profile, using a different PCR policy counter
+	// handle if the counter is invalid.
+	NeedsReseal []*secboot.KeyData
+}
+
+func (r *PCRPolicyCounterRepairResult) recreatedCounter(handle tpm2.Handle) bool {
+	for _, h := range r.RecreatedCounters {
+		if h == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// repairPCRPolicyCounter recreates the missing PCR policy counter for this key and
+// reauthorizes its PCR policy if the recreated counter has a value that revokes the
+// current policy. It returns false if the key can't be repaired.
+func (k *sealedKeyDataBase) repairPCRPolicyCounter(tpm *tpm2.TPMContext, authKey secboot.PrimaryKey, role string, hmacSession tpm2.SessionContext) (bool, error) {
+	policy, ok := k.data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		// Keys created with the legacy APIs use a PCR policy counter
+		// that can't be recreated with the same name.
+		return false, nil
+	}
+
+	if err := policy.ValidateAuthKey(authKey); err != nil {
+		if isKeyDataError(err) {
+			return false, InvalidKeyDataError{err.Error()}
+		}
+		return false, xerrors.Errorf("cannot validate auth key: %w", err)
+	}
+
+	handle := policy.StaticData.PCRPolicyCounterHandle
+	counterPub, err := ensurePcrPolicyCounter(tpm, handle, policy.StaticData.AuthPublicKey, hmacSession)
+	switch {
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return false, AuthFailError{tpm2.HandleOwner}
+	case errors.Is(err, TPMResourceExistsError{handle}):
+		// The counter exists but isn't the one associated with
+		// this key.
+		return false, nil
+	case err != nil:
+		return false, xerrors.Errorf("cannot recreate PCR policy counter: %w", err)
+	}
+
+	alg := policy.StaticData.AuthPublicKey.NameAlg
+	if !bytes.Equal(computeV3PcrPolicyRef(alg, secboot.RoleDerivationLabel(role), counterPub.Name()), policy.StaticData.PCRPolicyRef) {
+		// The key was created with a different counter.
+		return false, nil
+	}
+
+	counter, err := policy.PCRPolicyCounterContext(tpm, counterPub)
+	if err != nil {
+		return false, xerrors.Errorf("cannot obtain PCR policy counter context: %w", err)
+	}
+	value, err := counter.Get()
+	if err != nil {
+		return false, xerrors.Errorf("cannot obtain PCR policy counter value: %w", err)
+	}
+	if value <= policy.PCRPolicySequence() {
+		// The current PCR policy hasn't been revoked by the
+		// recreated counter.
+		return true, nil
+	}
+
+	var nvGenerationIndexName tpm2.Name
+	if check := policy.PCRData.NVGeneration; check != nil {
+		nvGenerationIndexName, err = readNVGenerationIndexName(tpm, &NVGenerationRequirement{Handle: check.Handle, Minimum: check.Minimum, Maximum: check.Maximum})
+		if err != nil {
+			// The current PCR policy can't be satisfied anyway.
+			return false, nil
+		}
+	}
+
+	if err := policy.ReauthorizePCRPolicy(k.data.Public().NameAlg, authKey, counterPub.Name(), value, nvGenerationIndexName); err != nil {
+		if isPolicyDataError(err) {
+			return false, nil
+		}
+		return false, xerrors.Errorf("cannot reauthorize PCR policy: %w", err)
+	}
+
+	return true, nil
+}
+
+// RepairPCRPolicyCounters detects keys whose PCR policy counter is missing from the
+// TPM and repairs them where possible, rather than leaving them with PCR policies that
+// can't be satisfied. This can happen because of a firmware bug or NV wear.
+//
+// For each key with a missing counter, the counter is recreated at the same handle
+// with the same public area, so that it has the same name. As a new counter is
+// initialized with the highest value of any counter that has existed on the TPM, it
+// may revoke the key's current PCR policy, in which case the current PCR policy is
+// reauthorized with a new policy sequence without changing the permitted PCR values.
+// This requires authorization with the storage hierarchy in order to create the
+// counter, and the supplied authKey, which must be the primary key associated with
+// all of the supplied keys. Only the current copies of keys should be supplied, as this
+// will also reauthorize PCR policies of stale copies that had been revoked.
+//
+// The result reports which counters were recreated, which keys were repaired and must
+// be persisted, and which keys couldn't be repaired and need to be resealed with a new
+// PCR protection profile. Keys with a valid PCR policy counter or without one are not
+// included in the result.
+//
+// If the TPM returns an error because the storage hierarchy authorization is
+// incorrect, a AuthFailError error will be returned. If any key is invalid, a
+// InvalidKeyDataError error will be returned.
+func RepairPCRPolicyCounters(tpm *Connection, authKey secboot.PrimaryKey, keys ...*secboot.KeyData) (*PCRPolicyCounterRepairResult, error) {
+	result := new(PCRPolicyCounterRepairResult)
+
+	for i, key := range keys {
+		skd, err := NewSealedKeyData(key)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot obtain SealedKeyData for key at index %d: %w", i, err)
+		}
+
+		status, err := skd.pcrPolicyCounterStatus(tpm.TPMContext, key.Role())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine PCR policy counter status for key at index %d: %w", i, err)
+		}
+
+		handle := skd.data.Policy().PCRPolicyCounterHandle()
+
+		switch {
+		case status == PCRPolicyCounterStatusNone:
+			continue
+		case status == PCRPolicyCounterStatusOK && !result.recreatedCounter(handle):
+			// Keys that share a counter that was recreated for a
+			// previous key might need their PCR policy reauthorizing.
+			continue
+		case status == PCRPolicyCounterStatusInvalid:
+			result.NeedsReseal = append(result.NeedsReseal, key)
+			continue
+		}
+
+		repaired, err := skd.repairPCRPolicyCounter(tpm.TPMContext, authKey, key.Role(), tpm.HmacSession())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot repair key at index %d: %w", i, err)
+		}
+
+		if status == PCRPolicyCounterStatusMissing {
+			status, err = skd.pcrPolicyCounterStatus(tpm.TPMContext, key.Role())
+			if err != nil {
+				return nil, xerrors.Errorf("cannot determine PCR policy counter status for key at index %d: %w", i, err)
+			}
+			if status != PCRPolicyCounterStatusMissing {
+				result.RecreatedCounters = append(result.RecreatedCounters, handle)
+			}
+		}
+
+		if !repaired {
+			result.NeedsReseal = append(result.NeedsReseal, key)
+			continue
+		}
+
+		if err := key.MarshalAndUpdatePlatformHandle(skd); err != nil {
+			return nil, xerrors.Errorf("cannot update TPM platform handle on KeyData at index %d: %w", i, err)
+		}
+		result.Repaired = append(result.Repaired, key)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,209 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type policyCounterRepairSuiteNoTPM struct{}
+
+var _ = Suite(&policyCounterRepairSuiteNoTPM{})
+
+func (s *policyCounterRepairSuiteNoTPM) TestPCRPolicyCounterStatusString(c *C) {
+	c.Check(PCRPolicyCounterStatusNone.String(), Equals, "none")
+	c.Check(PCRPolicyCounterStatusOK.String(), Equals, "ok")
+	c.Check(PCRPolicyCounterStatusMissing.String(), Equals, "missing")
+	c.Check(PCRPolicyCounterStatusInvalid.String(), Equals, "invalid")
+	c.Check(PCRPolicyCounterStatus(10).String(), Equals, "PCRPolicyCounterStatus(10)")
+}
+
+type policyCounterRepairSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *policyCounterRepairSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *policyCounterRepairSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&policyCounterRepairSuite{})
+
+func (s *policyCounterRepairSuite) newKey(c *C, handle tpm2.Handle) (*secboot.KeyData, secboot.PrimaryKey) {
+	k, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: handle})
+	c.Assert(err, IsNil)
+	return k, primaryKey
+}
+
+func (s *policyCounterRepairSuite) copyKey(c *C, k *secboot.KeyData) *secboot.KeyData {
+	w := newMockKeyDataWriter()
+	c.Assert(k.WriteAtomic(w), IsNil)
+	k2, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+	return k2
+}
+
+func (s *policyCounterRepairSuite) undefineCounter(c *C, handle tpm2.Handle) {
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	c.Assert(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+}
+
+func (s *policyCounterRepairSuite) checkStatus(c *C, k *secboot.KeyData, expected PCRPolicyCounterStatus) {
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	status, err := skd.PCRPolicyCounterStatus(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(status, Equals, expected)
+}
+
+func (s *policyCounterRepairSuite) TestPCRPolicyCounterStatusOK(c *C) {
+	k, _ := s.newKey(c, s.NextAvailableHandle(c, 0x01810000))
+	s.checkStatus(c, k, PCRPolicyCounterStatusOK)
+}
+
+func (s *policyCounterRepairSuite) TestPCRPolicyCounterStatusNone(c *C) {
+	k, _ := s.newKey(c, tpm2.HandleNull)
+	s.checkStatus(c, k, PCRPolicyCounterStatusNone)
+}
+
+func (s *policyCounterRepairSuite) TestPCRPolicyCounterStatusMissing(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k, _ := s.newKey(c, handle)
+	s.undefineCounter(c, handle)
+	s.checkStatus(c, k, PCRPolicyCounterStatusMissing)
+}
+
+func (s *policyCounterRepairSuite) TestPCRPolicyCounterStatusInvalid(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k, _ := s.newKey(c, handle)
+	s.undefineCounter(c, handle)
+
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+	s.checkStatus(c, k, PCRPolicyCounterStatusInvalid)
+}
+
+func (s *policyCounterRepairSuite) TestRepairPCRPolicyCounters(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k, primaryKey := s.newKey(c, handle)
+	s.undefineCounter(c, handle)
+
+	_, _, err := k.RecoverKeys()
+	c.Check(err, ErrorMatches, `invalid key data: cannot complete authorization policy assertions: no PCR policy counter found`)
+
+	result, err := RepairPCRPolicyCounters(s.TPM(), primaryKey, k)
+	c.Assert(err, IsNil)
+	c.Check(result.RecreatedCounters, DeepEquals, []tpm2.Handle{handle})
+	c.Check(result.Repaired, DeepEquals, []*secboot.KeyData{k})
+	c.Check(result.NeedsReseal, HasLen, 0)
+
+	s.checkStatus(c, k, PCRPolicyCounterStatusOK)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *policyCounterRepairSuite) TestRepairPCRPolicyCountersReauthorize(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k1, primaryKey := s.newKey(c, handle)
+	k2 := s.copyKey(c, k1)
+
+	// Advance the counter so that the recreated counter revokes the
+	// PCR policy of k1.
+	skd, err := NewSealedKeyData(k2)
+	c.Assert(err, IsNil)
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), primaryKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NewPCRPolicyVersion), IsNil)
+	c.Check(skd.RevokeOldPCRProtectionPolicies(s.TPM(), primaryKey), IsNil)
+	s.undefineCounter(c, handle)
+
+	result, err := RepairPCRPolicyCounters(s.TPM(), primaryKey, k1, k2)
+	c.Assert(err, IsNil)
+	c.Check(result.RecreatedCounters, DeepEquals, []tpm2.Handle{handle})
+	c.Check(result.Repaired, DeepEquals, []*secboot.KeyData{k1, k2})
+	c.Check(result.NeedsReseal, HasLen, 0)
+
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, IsNil)
+	_, _, err = k2.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *policyCounterRepairSuite) TestRepairPCRPolicyCountersNothingToDo(c *C) {
+	k1, primaryKey := s.newKey(c, s.NextAvailableHandle(c, 0x01810000))
+	k2, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PrimaryKey:             primaryKey})
+	c.Assert(err, IsNil)
+
+	result, err := RepairPCRPolicyCounters(s.TPM(), primaryKey, k1, k2)
+	c.Assert(err, IsNil)
+	c.Check(result, DeepEquals, &PCRPolicyCounterRepairResult{})
+}
+
+func (s *policyCounterRepairSuite) TestRepairPCRPolicyCountersInvalid(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k, primaryKey := s.newKey(c, handle)
+	s.undefineCounter(c, handle)
+
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+
+	result, err := RepairPCRPolicyCounters(s.TPM(), primaryKey, k)
+	c.Assert(err, IsNil)
+	c.Check(result.RecreatedCounters, HasLen, 0)
+	c.Check(result.Repaired, HasLen, 0)
+	c.Check(result.NeedsReseal, DeepEquals, []*secboot.KeyData{k})
+}
+
+func (s *policyCounterRepairSuite) TestRepairPCRPolicyCountersWrongAuthKey(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	k, _ := s.newKey(c, handle)
+	s.undefineCounter(c, handle)
+
+	_, err := RepairPCRPolicyCounters(s.TPM(), make(secboot.PrimaryKey, 32), k)
+	c.Check(err, ErrorMatches, `cannot repair key at index 0: invalid key data: dynamic authorization policy signing private key doesn't match public key`)
+	c.Check(err, testutil.ConvertibleTo, InvalidKeyDataError{})
+}
@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"golang.org/x/xerrors"
+)
+
+// PolicyDigestDescription describes a policy digest for a single algorithm.
+type PolicyDigestDescription struct {
+	HashAlg string `json:"hashAlg"`
+	Digest  string `json:"digest"`
+}
+
+// PolicyPCRSelectionDescription describes the PCRs selected from a single bank.
+type PolicyPCRSelectionDescription struct {
+	HashAlg   string `json:"hash"`
+	PCRSelect []int  `json:"pcrSelect"`
+}
+
+// PolicyElementDescription describes a single assertion in an authorization
+// policy. The Type field is one of "POLICYAUTHORIZE", "POLICYAUTHVALUE",
+// "POLICYSECRET", "POLICYPCR", "POLICYOR" or "POLICYNV", and determines which
+// of the other fields are set.
+type PolicyElementDescription struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+
+	// POLICYAUTHORIZE
+	KeyName          string             `json:"keyName,omitempty"`
+	PolicyRef        string             `json:"policyRef,omitempty"`
+	ApprovedPolicy   string             `json:"approvedPolicy,omitempty"`
+	AuthorizedPolicy *PolicyDescription `json:"authorizedPolicy,omitempty"`
+
+	// POLICYSECRET
+	ObjectName string `json:"objectName,omitempty"`
+
+	// POLICYPCR
+	PCRSelection []PolicyPCRSelectionDescription `json:"pcrSelection,omitempty"`
+
+	// POLICYOR
+	BranchDigests []string `json:"branchDigests,omitempty"`
+
+	// POLICYNV
+	NVIndex   string `json:"nvIndex,omitempty"`
+	OperandB  string `json:"operandB,omitempty"`
+	Operation string `json:"operation,omitempty"`
+
+	// POLICYCOUNTERTIMER (also uses OperandB and Operation)
+	Offset uint16 `json:"offset,omitempty"`
+}
+
+// PolicyDescription is a description of an authorization policy that is
+// intended to be reviewed by security teams and external policy auditors.
+// When serialized to JSON, it is modelled on the JSON policy language used
+// by the TSS Feature API and associated tools, with the element types named
+// after the corresponding TPM2_Policy* commands.
+//
+// Some parts of a policy, such as the PCR values that are approved for a key,
+// are not stored in the key data. These are described by the digests that
+// they produce, which an auditor can compare with digests that they compute
+// independently from the values they expect.
+type PolicyDescription struct {
+	Description   string                     `json:"description,omitempty"`
+	PolicyDigests []PolicyDigestDescription  `json:"policyDigests"`
+	Policy        []PolicyElementDescription `json:"policy"`
+}
+
+func hashAlgName(alg tpm2.HashAlgorithmId) string {
+	switch alg {
+	case tpm2.HashAlgorithmSHA1:
+		return "sha1"
+	case tpm2.HashAlgorithmSHA256:
+		return "sha256"
+	case tpm2.HashAlgorithmSHA384:
+		return "sha384"
+	case tpm2.HashAlgorithmSHA512:
+		return "sha512"
+	case tpm2.HashAlgorithmSM3_256:
+		return "sm3_256"
+	default:
+		return fmt.Sprintf("0x%04x", uint16(alg))
+	}
+}
+
+func newPolicyDescription(data keyData) (*PolicyDescription, error) {
+	policy, ok := data.Policy().(*keyDataPolicy_v3)
+	if !ok {
+		return nil, fmt.Errorf("cannot describe the policy for version %d key data", data.Version())
+	}
+
+	pcrData := policy.PCRData
+
+	tree, err := pcrData.OrData.resolve()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot resolve PolicyOR tree: %w", err)
+	}
+	var branches []string
+	for _, n := range tree.leafNodes {
+		for _, d := range n.digests {
+			branches = append(branches, hex.EncodeToString(d))
+		}
+	}
+
+	var selection []PolicyPCRSelectionDescription
+	for _, s := range pcrData.Selection {
+		selection = append(selection, PolicyPCRSelectionDescription{
+			HashAlg:   hashAlgName(s.Hash),
+			PCRSelect: s.Select})
+	}
+
+	alg := data.Public().NameAlg
+
+	pcrPolicy := &PolicyDescription{
+		Description: fmt.Sprintf("PCR policy with sequence %d", pcrData.PolicySequence),
+		PolicyDigests: []PolicyDigestDescription{
+			{HashAlg: hashAlgName(alg), Digest: hex.EncodeToString(pcrData.AuthorizedPolicy)}},
+		Policy: []PolicyElementDescription{
+			{
+				Type:         "POLICYPCR",
+				Description:  "the selected PCRs must match one of the approved sets of values",
+				PCRSelection: selection,
+			},
+			{
+				Type:          "POLICYOR",
+				Description:   "one branch for each approved set of PCR values, each being the policy digest after the preceding POLICYPCR assertion",
+				BranchDigests: branches,
+			},
+		}}
+
+	if handle := policy.StaticData.PCRPolicyCounterHandle; handle != tpm2.HandleNull {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, pcrData.PolicySequence)
+		pcrPolicy.Policy = append(pcrPolicy.Policy, PolicyElementDescription{
+			Type:        "POLICYNV",
+			Description: "the PCR policy must not have been revoked",
+			NVIndex:     fmt.Sprintf("0x%08x", uint32(handle)),
+			OperandB:    hex.EncodeToString(operandB),
+			Operation:   "UNSIGNED_LE"})
+	}
+	if check := pcrData.NVGeneration; check != nil {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, check.Minimum)
+		pcrPolicy.Policy = append(pcrPolicy.Policy, PolicyElementDescription{
+			Type:        "POLICYNV",
+			Description: "the NV index must contain a generation that is not lower than the minimum",
+			NVIndex:     fmt.Sprintf("0x%08x", uint32(check.Handle)),
+			OperandB:    hex.EncodeToString(operandB),
+			Operation:   "UNSIGNED_GE"})
+		if check.Maximum != 0 {
+			operandB := make([]byte, 8)
+			binary.BigEndian.PutUint64(operandB, check.Maximum)
+			pcrPolicy.Policy = append(pcrPolicy.Policy, PolicyElementDescription{
+				Type:        "POLICYNV",
+				Description: "the NV index must contain a generation that is not higher than the maximum",
+				NVIndex:     fmt.Sprintf("0x%08x", uint32(check.Handle)),
+				OperandB:    hex.EncodeToString(operandB),
+				Operation:   "UNSIGNED_LE"})
+		}
+	}
+	if check := pcrData.ResetCount; check != nil {
+		operandB := make([]byte, 4)
+		binary.BigEndian.PutUint32(operandB, check.Maximum)
+		pcrPolicy.Policy = append(pcrPolicy.Policy, PolicyElementDescription{
+			Type:        "POLICYCOUNTERTIMER",
+			Description: "the TPM reset count must not be higher than the maximum",
+			OperandB:    hex.EncodeToString(operandB),
+			Offset:      resetCountOffset,
+			Operation:   "UNSIGNED_LE"})
+	}
+
+	out := &PolicyDescription{
+		PolicyDigests: []PolicyDigestDescription{
+			{HashAlg: hashAlgName(alg), Digest: hex.EncodeToString(data.Public().AuthPolicy)}},
+		Policy: []PolicyElementDescription{
+			{
+				Type:             "POLICYAUTHORIZE",
+				Description:      "the PCR policy must be authorized by the key used to update the PCR policy",
+				KeyName:          hex.EncodeToString(policy.StaticData.AuthPublicKey.Name()),
+				PolicyRef:        hex.EncodeToString(policy.StaticData.PCRPolicyRef),
+				ApprovedPolicy:   hex.EncodeToString(pcrData.AuthorizedPolicy),
+				AuthorizedPolicy: pcrPolicy,
+			},
+		}}
+	if policy.usesPCRPolicyNVIndex() {
+		out.Policy[0] = PolicyElementDescription{
+			Type:             "POLICYAUTHORIZENV",
+			Description:      "the PCR policy must match the digest stored in the PCR policy NV index",
+			NVIndex:          fmt.Sprintf("0x%08x", uint32(policy.StaticData.PCRPolicyNVIndexHandle)),
+			ApprovedPolicy:   hex.EncodeToString(pcrData.AuthorizedPolicy),
+			AuthorizedPolicy: pcrPolicy,
+		}
+	}
+	if policy.StaticData.RequireEndorsementAuth {
+		out.Policy = append(out.Policy, PolicyElementDescription{
+			Type:        "POLICYSECRET",
+			Description: "the authorization value of the endorsement hierarchy must be supplied",
+			ObjectName:  hex.EncodeToString(tpm2.MakeHandleName(tpm2.HandleEndorsement))})
+	}
+	if name := policy.StaticData.ExternalAuthName; len(name) > 0 {
+		out.Policy = append(out.Policy, PolicyElementDescription{
+			Type:        "POLICYSECRET",
+			Description: "authorization for the NV index or object supplied by the external authenticator must be demonstrated",
+			ObjectName:  hex.EncodeToString(name)})
+	}
+	if policy.StaticData.RequireAuthValue {
+		out.Policy = append(out.Policy, PolicyElementDescription{
+			Type:        "POLICYAUTHVALUE",
+			Description: "the passphrase derived authorization value must be supplied"})
+	}
+
+	return out, nil
+}
+
+// PolicyDescription returns a description of the authorization policy that
+// gates the release of this sealed key object, so that it can be reviewed
+// independently. The result can be serialized to JSON with encoding/json.
+//
+// This is only supported for version 3 sealed key objects and later.
+func (k *SealedKeyData) PolicyDescription() (*PolicyDescription, error) {
+	return newPolicyDescription(k.data)
+}
@@ -0,0 +1,278 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type policyDescriptionSuite struct{}
+
+var _ = Suite(&policyDescriptionSuite{})
+
+func (s *policyDescriptionSuite) pcrBranchDigest(c *C, pcr int, value tpm2.Digest) string {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{pcr}}}
+	pcrDigest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {pcr: value}})
+	c.Assert(err, IsNil)
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyPCR(pcrDigest, pcrs)
+	return hex.EncodeToString(trial.GetDigest())
+}
+
+func (s *policyDescriptionSuite) TestSealedKeyDataPolicyDescription(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&key.PublicKey)
+
+	value1 := make(tpm2.Digest, 32)
+	value2 := make(tpm2.Digest, 32)
+	value2[0] = 1
+
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, value1),
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, value2))
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(srk, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		Role:                   "foo"})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	desc, err := skd.PolicyDescription()
+	c.Assert(err, IsNil)
+
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 1)
+	authorize := desc.Policy[0]
+	c.Check(authorize.Type, Equals, "POLICYAUTHORIZE")
+	c.Check(authorize.KeyName, Equals, hex.EncodeToString(authKey.Name()))
+	c.Check(authorize.PolicyRef, Equals, hex.EncodeToString(ComputeV3PcrPolicyRef(tpm2.HashAlgorithmSHA256, []byte("foo"), nil)))
+
+	// The static policy digest must match the one that can be computed
+	// from the description.
+	approved, err := hex.DecodeString(authorize.ApprovedPolicy)
+	c.Assert(err, IsNil)
+	keyName, err := hex.DecodeString(authorize.KeyName)
+	c.Assert(err, IsNil)
+	policyRef, err := hex.DecodeString(authorize.PolicyRef)
+	c.Assert(err, IsNil)
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyAuthorize(policyRef, tpm2.Name(keyName))
+	c.Check(desc.PolicyDigests, DeepEquals, []PolicyDigestDescription{
+		{HashAlg: "sha256", Digest: hex.EncodeToString(trial.GetDigest())}})
+
+	pcrPolicy := authorize.AuthorizedPolicy
+	c.Assert(pcrPolicy, NotNil)
+	c.Check(pcrPolicy.Description, Equals, "PCR policy with sequence 0")
+	c.Check(pcrPolicy.PolicyDigests, DeepEquals, []PolicyDigestDescription{
+		{HashAlg: "sha256", Digest: hex.EncodeToString(approved)}})
+	c.Assert(pcrPolicy.Policy, HasLen, 2)
+	c.Check(pcrPolicy.Policy[0].Type, Equals, "POLICYPCR")
+	c.Check(pcrPolicy.Policy[0].PCRSelection, DeepEquals, []PolicyPCRSelectionDescription{
+		{HashAlg: "sha256", PCRSelect: []int{7}}})
+	c.Check(pcrPolicy.Policy[1].Type, Equals, "POLICYOR")
+	c.Check(pcrPolicy.Policy[1].BranchDigests, DeepEquals, []string{
+		s.pcrBranchDigest(c, 7, value1),
+		s.pcrBranchDigest(c, 7, value2),
+	})
+
+	// The approved PCR policy digest must match the one that can
+	// be computed from the branches.
+	var branches tpm2.DigestList
+	for _, b := range pcrPolicy.Policy[1].BranchDigests {
+		d, err := hex.DecodeString(b)
+		c.Assert(err, IsNil)
+		branches = append(branches, d)
+	}
+	trial = util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyOR(branches)
+	c.Check(trial.GetDigest(), DeepEquals, tpm2.Digest(approved))
+
+	data, err := json.Marshal(desc)
+	c.Check(err, IsNil)
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	policy := j["policy"].([]interface{})
+	c.Check(policy[0].(map[string]interface{})["type"], Equals, "POLICYAUTHORIZE")
+	c.Check(policy[0].(map[string]interface{})["authorizedPolicy"], NotNil)
+}
+
+func (s *policyDescriptionSuite) TestPolicyDescriptionWithCounterAndAuthValue(c *C) {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	counterPub := &tpm2.NVPublic{
+		Index:   0x01800000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    8}
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", counterPub, true, false, nil)
+	c.Assert(err, IsNil)
+
+	value := make(tpm2.Digest, 32)
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: value}})
+	c.Assert(err, IsNil)
+	c.Check(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(primaryKey, pcrs, tpm2.DigestList{pcrDigest}, counterPub.Name(), 5)), IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(nil, pub, nil, policy)
+	c.Assert(err, IsNil)
+
+	desc, err := NewPolicyDescription(data)
+	c.Assert(err, IsNil)
+	c.Check(desc.PolicyDigests, DeepEquals, []PolicyDigestDescription{
+		{HashAlg: "sha256", Digest: hex.EncodeToString(policyDigest)}})
+
+	c.Assert(desc.Policy, HasLen, 2)
+	c.Check(desc.Policy[0].Type, Equals, "POLICYAUTHORIZE")
+	c.Check(desc.Policy[1].Type, Equals, "POLICYAUTHVALUE")
+
+	pcrPolicy := desc.Policy[0].AuthorizedPolicy
+	c.Check(pcrPolicy.Description, Equals, "PCR policy with sequence 5")
+	c.Assert(pcrPolicy.Policy, HasLen, 3)
+	nv := pcrPolicy.Policy[2]
+	c.Check(nv.Type, Equals, "POLICYNV")
+	c.Check(nv.NVIndex, Equals, "0x01800000")
+	c.Check(nv.OperandB, Equals, "0000000000000005")
+	c.Check(nv.Operation, Equals, "UNSIGNED_LE")
+}
+
+func (s *policyDescriptionSuite) TestPolicyDescriptionWithEndorsementAuth(c *C) {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, true, true, nil)
+	c.Assert(err, IsNil)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: make(tpm2.Digest, 32)}})
+	c.Assert(err, IsNil)
+	c.Check(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(primaryKey, pcrs, tpm2.DigestList{pcrDigest}, nil, 0)), IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(nil, pub, nil, policy)
+	c.Assert(err, IsNil)
+
+	desc, err := NewPolicyDescription(data)
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 3)
+	c.Check(desc.Policy[0].Type, Equals, "POLICYAUTHORIZE")
+	c.Check(desc.Policy[1].Type, Equals, "POLICYSECRET")
+	c.Check(desc.Policy[1].ObjectName, Equals, "4000000b")
+	c.Check(desc.Policy[2].Type, Equals, "POLICYAUTHVALUE")
+}
+
+func (s *policyDescriptionSuite) TestPolicyDescriptionWithExternalAuth(c *C) {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	nvPub := &tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthRead | tpm2.AttrNVAuthWrite | tpm2.AttrNVWritten),
+		Size:    8}
+	externalAuthName := nvPub.Name()
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, false, true, externalAuthName)
+	c.Assert(err, IsNil)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: make(tpm2.Digest, 32)}})
+	c.Assert(err, IsNil)
+	c.Check(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(primaryKey, pcrs, tpm2.DigestList{pcrDigest}, nil, 0)), IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(nil, pub, nil, policy)
+	c.Assert(err, IsNil)
+
+	desc, err := NewPolicyDescription(data)
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 3)
+	c.Check(desc.Policy[0].Type, Equals, "POLICYAUTHORIZE")
+	c.Check(desc.Policy[1].Type, Equals, "POLICYSECRET")
+	c.Check(desc.Policy[1].ObjectName, Equals, "4000000b")
+	c.Check(desc.Policy[2].Type, Equals, "POLICYSECRET")
+	c.Check(desc.Policy[2].ObjectName, Equals, hex.EncodeToString(externalAuthName))
+}
+
+func (s *policyDescriptionSuite) TestPolicyDescriptionUnsupportedVersion(c *C) {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, policyDigest, err := NewKeyDataPolicyLegacy(tpm2.HashAlgorithmSHA256, authKey, nil, 0)
+	c.Assert(err, IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(nil, pub, nil, policy)
+	c.Assert(err, IsNil)
+
+	_, err = NewPolicyDescription(data)
+	c.Check(err, ErrorMatches, `cannot describe the policy for version 1 key data`)
+}
@@ -33,6 +33,7 @@ import (
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
 	"github.com/snapcore/secboot/internal/tpm2test"
 	. "github.com/snapcore/secboot/tpm2"
@@ -211,6 +212,9 @@ type testNewKeyDataPolicyData struct {
 	pcrPolicyCounterPub *tpm2.NVPublic
 	pcrPolicySequence   uint64
 
+	requireEndorsementAuth bool
+	externalAuthName       tpm2.Name
+
 	expected tpm2.Digest
 }
 
@@ -228,10 +232,12 @@ func (s *policySuiteNoTPM) testNewKeyDataPolicy(c *C, data *testNewKeyDataPolicy
 		pcrPolicyCounterHandle = data.pcrPolicyCounterPub.Index
 	}
 
-	policy, digest, err := NewKeyDataPolicy(data.alg, authKey, "", data.pcrPolicyCounterPub, false)
+	policy, digest, err := NewKeyDataPolicy(data.alg, authKey, "", data.pcrPolicyCounterPub, false, data.requireEndorsementAuth, data.externalAuthName)
 	c.Assert(err, IsNil)
 	c.Assert(policy, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
 	c.Check(policy.(*KeyDataPolicy_v3).StaticData.AuthPublicKey, DeepEquals, authKey)
+	c.Check(policy.(*KeyDataPolicy_v3).StaticData.RequireEndorsementAuth, Equals, data.requireEndorsementAuth)
+	c.Check(policy.(*KeyDataPolicy_v3).StaticData.ExternalAuthName, DeepEquals, data.externalAuthName)
 	c.Check(policy.PCRPolicyCounterHandle(), Equals, pcrPolicyCounterHandle)
 	c.Check(policy.PCRPolicySequence(), Equals, data.pcrPolicySequence)
 
@@ -255,6 +261,102 @@ xtjPyepMPNg3K7iPmPopFLA5Ap8RjR1Eu9B8LllUHTqYHJY6YQ3o+CP5TQ==
 		expected:          testutil.DecodeHexString(c, "aaf8226b1df9aefc9d03533b58abaf514b0f4ab6c10af0e26ef5d9db0d8aff24")})
 }
 
+func (s *policySuiteNoTPM) TestNewKeyDataPolicyRequireEndorsementAuth(c *C) {
+	s.testNewKeyDataPolicy(c, &testNewKeyDataPolicyData{
+		alg: tpm2.HashAlgorithmSHA256,
+		key: `
+-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE49+rltJgmI3V7QqrkLBpB4V3xunW
+xtjPyepMPNg3K7iPmPopFLA5Ap8RjR1Eu9B8LllUHTqYHJY6YQ3o+CP5TQ==
+-----END PUBLIC KEY-----`,
+		pcrPolicyCounterPub: &tpm2.NVPublic{
+			Index:   0x0181fff0,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+			Size:    8},
+		pcrPolicySequence:      0,
+		requireEndorsementAuth: true,
+		expected:               testutil.DecodeHexString(c, "baf37e93b3417dedb0f1fd66cf5a67e0ac34796181eb94281d782548961c0e31")})
+}
+
+func (s *policySuiteNoTPM) TestNewKeyDataPolicyExternalAuthName(c *C) {
+	nvPub := &tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthRead | tpm2.AttrNVAuthWrite | tpm2.AttrNVWritten),
+		Size:    8}
+
+	s.testNewKeyDataPolicy(c, &testNewKeyDataPolicyData{
+		alg: tpm2.HashAlgorithmSHA256,
+		key: `
+-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE49+rltJgmI3V7QqrkLBpB4V3xunW
+xtjPyepMPNg3K7iPmPopFLA5Ap8RjR1Eu9B8LllUHTqYHJY6YQ3o+CP5TQ==
+-----END PUBLIC KEY-----`,
+		pcrPolicyCounterPub: &tpm2.NVPublic{
+			Index:   0x0181fff0,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+			Size:    8},
+		pcrPolicySequence: 0,
+		externalAuthName:  nvPub.Name(),
+		expected:          testutil.DecodeHexString(c, "c40fddea6fef1740c45bad6334df7baf36472b36dced1a1d7b92e84e1758725a")})
+}
+
+func (s *policySuiteNoTPM) TestComputePolicyAuthorizeNVDigest(c *C) {
+	name := tpm2.Name(testutil.DecodeHexString(c, "000b0d4ff9c0e8a8ae7e4f9e1ec2c0f6d8fc6b1c2a1a46bbac6bd4b5cc5c0b43e5c3"))
+
+	h := crypto.SHA256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x92})
+	h.Write(name)
+
+	c.Check(ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, name), DeepEquals, tpm2.Digest(h.Sum(nil)))
+}
+
+func (s *policySuiteNoTPM) TestNewKeyDataPolicyWithPCRPolicyNVIndex(c *C) {
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, make(secboot.PrimaryKey, 32))
+	c.Assert(err, IsNil)
+
+	nvPub := &tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       34}
+
+	policy, digest, err := NewKeyDataPolicyWithPCRPolicyNVIndex(tpm2.HashAlgorithmSHA256, authKey, "foo", nvPub, true, true, nil)
+	c.Assert(err, IsNil)
+	c.Assert(policy, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
+
+	static := policy.(*KeyDataPolicy_v3).StaticData
+	c.Check(static.AuthPublicKey, Equals, authKey)
+	c.Check(static.PCRPolicyRef, DeepEquals, ComputeV3PcrPolicyRef(tpm2.HashAlgorithmSHA256, secboot.RoleDerivationLabel("foo"), nil))
+	c.Check(static.PCRPolicyCounterHandle, Equals, tpm2.HandleNull)
+	c.Check(static.PCRPolicyNVIndexHandle, Equals, nvPub.Index)
+	c.Check(static.RequireAuthValue, testutil.IsTrue)
+	c.Check(static.RequireEndorsementAuth, testutil.IsTrue)
+	c.Check(policy.PCRPolicyCounterHandle(), Equals, tpm2.HandleNull)
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.SetDigest(ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, nvPub.Name()))
+	trial.PolicySecret(tpm2.MakeHandleName(tpm2.HandleEndorsement), nil)
+	trial.PolicyAuthValue()
+	c.Check(digest, DeepEquals, trial.GetDigest())
+
+	// PCR policies for this key can only be updated by writing to the NV index.
+	c.Check(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, &PcrPolicyParams{}), ErrorMatches,
+		`the PCR policy for this key must be updated in its NV index`)
+}
+
+func (s *policySuiteNoTPM) TestNewKeyDataPolicyWithPCRPolicyNVIndexInvalidRole(c *C) {
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, make(secboot.PrimaryKey, 32))
+	c.Assert(err, IsNil)
+
+	_, _, err = NewKeyDataPolicyWithPCRPolicyNVIndex(tpm2.HashAlgorithmSHA256, authKey, string(make([]byte, 1025)), &tpm2.NVPublic{Index: 0x01810000}, false, false, nil)
+	c.Check(err, ErrorMatches, `invalid role: too large`)
+}
+
 func (s *policySuiteNoTPM) TestNewKeyDataPolicySHA1(c *C) {
 	s.testNewKeyDataPolicy(c, &testNewKeyDataPolicyData{
 		alg: tpm2.HashAlgorithmSHA1,
@@ -250,9 +250,19 @@ type pcrPolicyData_v0 struct {
 	PolicySequence            uint64
 	AuthorizedPolicy          tpm2.Digest
 	AuthorizedPolicySignature *tpm2.Signature
+
+	// NVGeneration isn't part of the version 0-3 formats, and is only
+	// supported for version 3 keys and later. Keys with this set are
+	// serialized as version 4 (see pcrPolicyData_v4).
+	NVGeneration *nvGenerationCheck `tpm2:"ignore"`
+
+	// ResetCount isn't part of the version 0-3 formats, and is only
+	// supported for version 3 keys and later. Keys with this set are
+	// serialized as version 4 (see pcrPolicyData_v4).
+	ResetCount *resetCountCheck `tpm2:"ignore"`
 }
 
-func (d *pcrPolicyData_v0) addPcrAssertions(alg tpm2.HashAlgorithmId, trial *util.TrialAuthPolicy, pcrs tpm2.PCRSelectionList, digests tpm2.DigestList) error {
+func (d *pcrPolicyData_v0) addPcrAssertions(alg tpm2.HashAlgorithmId, trial *util.TrialAuthPolicy, pcrs tpm2.PCRSelectionList, digests tpm2.DigestList, alternateBanks []*pcrBankDigests) error {
 	// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
 	var orDigests tpm2.DigestList
 
@@ -265,6 +275,18 @@ func (d *pcrPolicyData_v0) addPcrAssertions(alg tpm2.HashAlgorithmId, trial *uti
 		orDigests = append(orDigests, trial2.GetDigest())
 	}
 
+	// The TPM excludes PCR banks that aren't allocated from the selection when
+	// executing TPM2_PolicyPCR, so add conditions for each of the supplied
+	// subsets of banks.
+	for _, bank := range alternateBanks {
+		for _, digest := range bank.digests {
+			trial2 := util.ComputeAuthPolicy(alg)
+			trial2.SetDigest(trial.GetDigest())
+			trial2.PolicyPCR(digest, bank.pcrs)
+			orDigests = append(orDigests, trial2.GetDigest())
+		}
+	}
+
 	orTree, err := newPolicyOrTree(alg, trial, orDigests)
 	if err != nil {
 		return xerrors.Errorf("cannot create tree for PolicyOR digests: %w", err)
@@ -339,6 +361,43 @@ func (d *pcrPolicyData_v0) executeRevocationCheck(tpm *tpm2.TPMContext, counter
 	return nil
 }
 
+// matchBranch returns the index of the branch of this PCR policy that is
+// satisfied by the current PCR values, which is the index of the corresponding
+// set of PCR values in the profile that the policy was computed from. This
+// uses a trial session with the specified digest algorithm, so it has no
+// effect on any policy session.
+func (d *pcrPolicyData_v0) matchBranch(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (int, error) {
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return -1, err
+	}
+	defer releaseSession()
+
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeTrial, nil, alg)
+	if err != nil {
+		return -1, xerrors.Errorf("cannot start trial session: %w", err)
+	}
+	defer tpm.FlushContext(session)
+
+	if err := tpm.PolicyPCR(session, nil, d.Selection); err != nil {
+		return -1, err
+	}
+	digest, err := tpm.PolicyGetDigest(session)
+	if err != nil {
+		return -1, err
+	}
+
+	tree, err := d.OrData.resolve()
+	if err != nil {
+		return -1, policyDataError{xerrors.Errorf("cannot resolve PolicyOR tree: %w", err)}
+	}
+	i, ok := tree.leafIndex(digest)
+	if !ok {
+		return -1, errSessionDigestNotFound
+	}
+	return i, nil
+}
+
 // keyDataPolicy_v0 represents version 0 of the metadata for executing a
 // policy session.
 type keyDataPolicy_v0 struct {
@@ -370,7 +429,7 @@ func (p *keyDataPolicy_v0) UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcr
 	pcrData := new(pcrPolicyData_v0)
 
 	trial := util.ComputeAuthPolicy(alg)
-	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests); err != nil {
+	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests, params.alternatePcrBanks); err != nil {
 		return xerrors.Errorf("cannot compute base PCR policy: %w", err)
 	}
 
@@ -399,6 +458,13 @@ func (p *keyDataPolicy_v0) SetPCRPolicyFrom(src keyDataPolicy) {
 }
 
 func (p *keyDataPolicy_v0) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext) error {
+	return p.executePCRPolicyWithPIN(tpm, policySession, hmacSession, nil)
+}
+
+// executePCRPolicyWithPIN executes the PCR policy in the same way as
+// ExecutePCRPolicy, using the supplied PIN as the authorization value for
+// the PCR policy counter.
+func (p *keyDataPolicy_v0) executePCRPolicyWithPIN(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext, pin []byte) error {
 	if err := p.PCRData.executePcrAssertions(tpm, policySession); err != nil {
 		return xerrors.Errorf("cannot execute PCR assertions: %w", err)
 	}
@@ -426,6 +492,11 @@ func (p *keyDataPolicy_v0) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession,
 		return policyDataError{errors.New("PCR policy counter has an unsupported name algorithm")}
 	}
 
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
 	revocationCheckSession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, pcrPolicyCounterPub.NameAlg)
 	if err != nil {
 		return err
@@ -485,7 +556,8 @@ func (p *keyDataPolicy_v0) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession,
 	}
 
 	// For metadata version 0, PIN support was implemented by asserting knowlege of the authorization value
-	// for the PCR policy counter, although this support was never used and has been removed.
+	// for the PCR policy counter. A PIN is only supplied when migrating a sealed key object.
+	pcrPolicyCounter.SetAuthValue(pin)
 	if _, _, err := tpm.PolicySecret(pcrPolicyCounter, policySession, nil, nil, 0, hmacSession); err != nil {
 		return err
 	}
@@ -517,6 +589,11 @@ type pcrPolicyCounterContext_v0 struct {
 }
 
 func (c *pcrPolicyCounterContext_v0) Get() (uint64, error) {
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseSession()
 	authSession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
 	if err != nil {
 		return 0, err
@@ -543,6 +620,11 @@ func (c *pcrPolicyCounterContext_v0) Increment(key secboot.PrimaryKey) error {
 	}
 
 	// Begin a policy session to increment the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
 	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
 	if err != nil {
 		return err
@@ -142,7 +142,7 @@ func (p *keyDataPolicy_v1) UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcr
 	pcrData := new(pcrPolicyData_v1)
 
 	trial := util.ComputeAuthPolicy(alg)
-	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests); err != nil {
+	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests, params.alternatePcrBanks); err != nil {
 		return xerrors.Errorf("cannot compute base PCR policy: %w", err)
 	}
 
@@ -264,6 +264,11 @@ func (c *pcrPolicyCounterContext_v1) Increment(key secboot.PrimaryKey) error {
 	}
 
 	// Begin a policy session to increment the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
 	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
 	if err != nil {
 		return err
@@ -20,6 +20,7 @@
 package tpm2
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -137,6 +138,29 @@ type staticPolicyData_v3 struct {
 	PCRPolicyRef           tpm2.Nonce
 	PCRPolicyCounterHandle tpm2.Handle
 	RequireAuthValue       bool
+
+	// RequireEndorsementAuth isn't part of the version 3 format. Keys
+	// with this set are serialized as version 4 (see staticPolicyData_v4).
+	RequireEndorsementAuth bool `tpm2:"ignore"`
+
+	// ExternalAuthName isn't part of the version 3 format. Keys with
+	// this set are serialized as version 4 (see staticPolicyData_v4).
+	ExternalAuthName tpm2.Name `tpm2:"ignore"`
+
+	// PCRPolicyNVIndexHandle isn't part of the version 3 format. Keys
+	// with PCR policies authorized by a NV index are serialized as
+	// version 4 (see staticPolicyData_v4).
+	PCRPolicyNVIndexHandle tpm2.Handle `tpm2:"ignore"`
+
+	// NullHierarchyDevMode isn't part of the version 3 format. Keys
+	// sealed to an ephemeral null hierarchy primary key are serialized
+	// as version 4 (see staticPolicyData_v4).
+	NullHierarchyDevMode bool `tpm2:"ignore"`
+
+	// AlternatePCRBanks isn't part of the version 3 format. Keys with
+	// PCR policies that can be satisfied by each PCR bank on its own are
+	// serialized as version 4 (see staticPolicyData_v4).
+	AlternatePCRBanks bool `tpm2:"ignore"`
 }
 
 // pcrPolicyData_v3 represents version 3 of the PCR policy metadata for
@@ -167,33 +191,117 @@ func (p *keyDataPolicy_v3) PCRPolicySequence() uint64 {
 //     permitted PCR values there are).
 //   - The PCR policy hasn't been revoked. This is done using a PolicyNV assertion to assert that the
 //     value of an optional NV counter is not greater than the PCR policy sequence.
+//   - An optional NV index contains a generation that is not less than a minimum value. This is done
+//     using a PolicyNV assertion.
+//   - The TPM's reset count is optionally not greater than a maximum value, which limits the number of
+//     boots for which the PCR policy can be used. This is done using a PolicyCounterTimer assertion.
 //
 // The computed PCR policy digest is authorized with the supplied key. The signature of this is
 // validated during execution before executing the corresponding PolicyAuthorize assertion as part of the
 // static policy.
 func (p *keyDataPolicy_v3) UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error {
+	if p.usesPCRPolicyNVIndex() {
+		return errors.New("the PCR policy for this key must be updated in its NV index")
+	}
+
+	pcrData, approvedPolicy, err := p.computePCRPolicy(alg, params)
+	if err != nil {
+		return err
+	}
+
+	key, err := deriveV3PolicyAuthKey(p.StaticData.AuthPublicKey.NameAlg.GetHash(), params.key)
+	if err != nil {
+		return xerrors.Errorf("cannot derive auth key: %w", err)
+	}
+
+	if err := pcrData.authorizePolicy(key, p.authScheme(), approvedPolicy, p.StaticData.PCRPolicyRef); err != nil {
+		return xerrors.Errorf("cannot authorize policy: %w", err)
+	}
+
+	p.PCRData = pcrData
+	return nil
+}
+
+// computePCRPolicy computes the metadata for a new PCR policy as described in
+// UpdatePCRPolicy, without authorizing it. The key in the supplied parameters is
+// ignored. The returned metadata has no signature, and the returned digest is the
+// policy digest that must be authorized.
+func (p *keyDataPolicy_v3) computePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) (*pcrPolicyData_v3, tpm2.Digest, error) {
 	pcrData := new(pcrPolicyData_v3)
 
 	trial := util.ComputeAuthPolicy(alg)
-	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests); err != nil {
-		return xerrors.Errorf("cannot compute base PCR policy: %w", err)
+	if err := pcrData.addPcrAssertions(alg, trial, params.pcrs, params.pcrDigests, params.alternatePcrBanks); err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute base PCR policy: %w", err)
 	}
 
 	if params.policyCounterName != nil {
 		pcrData.addRevocationCheck(trial, params.policyCounterName, params.policySequence)
 	}
 
-	key, err := deriveV3PolicyAuthKey(p.StaticData.AuthPublicKey.NameAlg.GetHash(), params.key)
-	if err != nil {
-		return xerrors.Errorf("cannot derive auth key: %w", err)
+	if params.nvGeneration != nil {
+		pcrData.addNVGenerationCheck(trial, params.nvGenerationIndexName, params.nvGeneration)
+	}
+
+	if params.resetCount != nil {
+		pcrData.addResetCountCheck(trial, params.resetCount)
 	}
 
-	scheme := &tpm2.SigScheme{
+	return pcrData, trial.GetDigest(), nil
+}
+
+// authScheme returns the signature scheme used to authorize PCR policies.
+func (p *keyDataPolicy_v3) authScheme() *tpm2.SigScheme {
+	return &tpm2.SigScheme{
 		Scheme: tpm2.SigSchemeAlgECDSA,
 		Details: &tpm2.SigSchemeU{
 			ECDSA: &tpm2.SigSchemeECDSA{
 				HashAlg: p.StaticData.AuthPublicKey.NameAlg}}}
-	if err := pcrData.authorizePolicy(key, scheme, trial.GetDigest(), p.StaticData.PCRPolicyRef); err != nil {
+}
+
+// ReauthorizePCRPolicy authorizes the current PCR policy again with the supplied key
+// and policy sequence, without changing the permitted PCR values or the NV generation
+// check. This is used to restore a PCR policy that was revoked because its PCR policy
+// counter had to be recreated with a higher value. The supplied counter and NV
+// generation index names must match those used to create the current PCR policy,
+// which is verified by recomputing the current authorized policy digest first.
+func (p *keyDataPolicy_v3) ReauthorizePCRPolicy(alg tpm2.HashAlgorithmId, key secboot.PrimaryKey, policyCounterName tpm2.Name, policySequence uint64, nvGenerationIndexName tpm2.Name) error {
+	tree, err := p.PCRData.OrData.resolve()
+	if err != nil {
+		return policyDataError{xerrors.Errorf("cannot resolve PolicyOR tree: %w", err)}
+	}
+	root := tree.leafNodes[0]
+	for root.parent != nil {
+		root = root.parent
+	}
+
+	computeDigest := func(pcrData *pcrPolicyData_v3, sequence uint64) tpm2.Digest {
+		trial := util.ComputeAuthPolicy(alg)
+		trial.PolicyOR(ensureSufficientORDigests(root.digests))
+		pcrData.addRevocationCheck(trial, policyCounterName, sequence)
+		if p.PCRData.NVGeneration != nil {
+			pcrData.addNVGenerationCheck(trial, nvGenerationIndexName, p.PCRData.NVGeneration)
+		}
+		if p.PCRData.ResetCount != nil {
+			pcrData.addResetCountCheck(trial, p.PCRData.ResetCount)
+		}
+		return trial.GetDigest()
+	}
+
+	if !bytes.Equal(computeDigest(new(pcrPolicyData_v3), p.PCRData.PolicySequence), p.PCRData.AuthorizedPolicy) {
+		return policyDataError{errors.New("the current PCR policy is inconsistent with its metadata")}
+	}
+
+	pcrData := &pcrPolicyData_v3{
+		Selection: p.PCRData.Selection,
+		OrData:    p.PCRData.OrData}
+	digest := computeDigest(pcrData, policySequence)
+
+	authKey, err := deriveV3PolicyAuthKey(p.StaticData.AuthPublicKey.NameAlg.GetHash(), key)
+	if err != nil {
+		return xerrors.Errorf("cannot derive auth key: %w", err)
+	}
+
+	if err := pcrData.authorizePolicy(authKey, p.authScheme(), digest, p.StaticData.PCRPolicyRef); err != nil {
 		return xerrors.Errorf("cannot authorize policy: %w", err)
 	}
 
@@ -205,7 +313,63 @@ func (p *keyDataPolicy_v3) SetPCRPolicyFrom(src keyDataPolicy) {
 	p.PCRData = src.(*keyDataPolicy_v3).PCRData
 }
 
-func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, _ tpm2.SessionContext) error {
+func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext) error {
+	if p.usesPCRPolicyNVIndex() {
+		if err := p.executePCRPolicyNV(tpm, policySession); err != nil {
+			return err
+		}
+	} else {
+		if err := p.executeSignedPCRPolicy(tpm, policySession); err != nil {
+			return err
+		}
+	}
+
+	if p.StaticData.RequireEndorsementAuth {
+		// Demonstrate knowledge of the endorsement hierarchy's authorization value, which binds
+		// the key to this TPM and will fail if the hierarchy has been disabled or its
+		// authorization value has been changed.
+		if _, _, err := tpm.PolicySecret(tpm.EndorsementHandleContext(), policySession, nil, nil, 0, hmacSession); err != nil {
+			if isAuthFailError(err, tpm2.CommandPolicySecret, 1) {
+				return AuthFailError{tpm2.HandleEndorsement}
+			}
+			return err
+		}
+	}
+
+	if name := p.StaticData.ExternalAuthName; len(name) > 0 {
+		// Demonstrate authorization for the NV index or object supplied by the external
+		// authenticator.
+		if err := executeExternalAuthAssertion(tpm, name, policySession, hmacSession); err != nil {
+			return err
+		}
+	}
+
+	if p.StaticData.RequireAuthValue {
+		if err := tpm.PolicyAuthValue(policySession); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pcrPolicyBranch returns the index of the branch of the PCR policy that is
+// satisfied by the current PCR values. See pcrPolicyData_v0.matchBranch.
+func (p *keyDataPolicy_v3) pcrPolicyBranch(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (int, error) {
+	pcrData := p.PCRData
+	if p.usesPCRPolicyNVIndex() {
+		var err error
+		pcrData, err = p.readPCRPolicyNVData(tpm)
+		if err != nil {
+			return -1, err
+		}
+	}
+	return pcrData.matchBranch(tpm, alg)
+}
+
+// executeSignedPCRPolicy executes the PCR policy using the metadata stored in this
+// keyDataPolicy, for keys where PCR policies are authorized with a signature.
+func (p *keyDataPolicy_v3) executeSignedPCRPolicy(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
 	if err := p.PCRData.executePcrAssertions(tpm, policySession); err != nil {
 		return xerrors.Errorf("cannot execute PCR assertions: %w", err)
 	}
@@ -232,6 +396,25 @@ func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession,
 		}
 	}
 
+	if p.PCRData.NVGeneration != nil {
+		if err := p.PCRData.executeNVGenerationCheck(tpm, policySession); err != nil {
+			return err
+		}
+	}
+
+	if p.PCRData.ResetCount != nil {
+		if err := p.PCRData.executeResetCountCheck(tpm, policySession); err != nil {
+			return err
+		}
+	}
+
+	if p.PCRData.AuthorizedPolicySignature == nil || p.PCRData.AuthorizedPolicySignature.SigAlg == tpm2.SigSchemeAlgNull {
+		// This is the initial PCR policy for a key created with an
+		// external PCR policy authorization key, which hasn't been
+		// authorized yet.
+		return policyDataError{errors.New("the PCR policy has not been authorized")}
+	}
+
 	authPublicKey := p.StaticData.AuthPublicKey
 	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
 	if err != nil {
@@ -267,12 +450,6 @@ func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession,
 		return err
 	}
 
-	if p.StaticData.RequireAuthValue {
-		if err := tpm.PolicyAuthValue(policySession); err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -293,6 +470,11 @@ func (c *pcrPolicyCounterContext_v3) Increment(key secboot.PrimaryKey) error {
 	}
 
 	// Begin a policy session to increment the index.
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return err
+	}
+	defer releaseSession()
 	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
 	if err != nil {
 		return err
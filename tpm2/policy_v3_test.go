@@ -310,6 +310,114 @@ func (s *policyV3SuiteNoTPM) TestSetPCRPolicyFrom(c *C) {
 	c.Check(policyData2.(*KeyDataPolicy_v3).PCRData, DeepEquals, policyData1.PCRData)
 }
 
+func newPolicyCounterPub(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    8}
+}
+
+type testV3ReauthorizePCRPolicyData struct {
+	pcrDigests   tpm2.DigestList
+	nvGeneration bool
+}
+
+func (s *policyV3SuiteNoTPM) testReauthorizePCRPolicy(c *C, data *testV3ReauthorizePCRPolicyData) {
+	key := make(secboot.PrimaryKey, 32)
+	rand.Read(key)
+
+	policyCounterPub := newPolicyCounterPub(0x01800000)
+	nvGenerationPub := &tpm2.NVPublic{
+		Index:   0x01800010,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVWritten),
+		Size:    8}
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}
+
+	newParams := func(sequence uint64) *PcrPolicyParams {
+		params := NewPcrPolicyParams(key, pcrs, data.pcrDigests, policyCounterPub.Name(), sequence)
+		if data.nvGeneration {
+			params = params.WithNVGeneration(nvGenerationPub.Index, 3, nvGenerationPub.Name())
+		}
+		return params
+	}
+
+	policyData := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)}}
+	c.Check(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, newParams(5)), IsNil)
+
+	var nvGenerationName tpm2.Name
+	if data.nvGeneration {
+		nvGenerationName = nvGenerationPub.Name()
+	}
+	c.Check(policyData.ReauthorizePCRPolicy(tpm2.HashAlgorithmSHA256, key, policyCounterPub.Name(), 20, nvGenerationName), IsNil)
+
+	// The result should be the same as creating a new PCR policy with the
+	// same PCR values and the new sequence.
+	expected := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)}}
+	c.Check(expected.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, newParams(20)), IsNil)
+
+	c.Check(policyData.PCRData.PolicySequence, Equals, uint64(20))
+	c.Check(policyData.PCRData.Selection, tpm2_testutil.TPMValueDeepEquals, expected.PCRData.Selection)
+	c.Check(policyData.PCRData.OrData, DeepEquals, expected.PCRData.OrData)
+	c.Check(policyData.PCRData.NVGeneration, DeepEquals, expected.PCRData.NVGeneration)
+	c.Check(policyData.PCRData.AuthorizedPolicy, DeepEquals, expected.PCRData.AuthorizedPolicy)
+
+	digest, err := util.ComputePolicyAuthorizeDigest(tpm2.HashAlgorithmSHA256,
+		policyData.PCRData.AuthorizedPolicy, policyData.StaticData.PCRPolicyRef)
+	c.Check(err, IsNil)
+	ok, err := util.VerifySignature(policyData.StaticData.AuthPublicKey.Public(), digest, policyData.PCRData.AuthorizedPolicySignature)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+}
+
+func (s *policyV3SuiteNoTPM) TestReauthorizePCRPolicy(c *C) {
+	s.testReauthorizePCRPolicy(c, &testV3ReauthorizePCRPolicyData{
+		pcrDigests: tpm2.DigestList{hash(crypto.SHA256, "1"), hash(crypto.SHA256, "2")}})
+}
+
+func (s *policyV3SuiteNoTPM) TestReauthorizePCRPolicySingleDigest(c *C) {
+	s.testReauthorizePCRPolicy(c, &testV3ReauthorizePCRPolicyData{
+		pcrDigests: tpm2.DigestList{hash(crypto.SHA256, "1")}})
+}
+
+func (s *policyV3SuiteNoTPM) TestReauthorizePCRPolicyDepth2(c *C) {
+	var digests tpm2.DigestList
+	for i := 1; i < 26; i++ {
+		digests = append(digests, hash(crypto.SHA256, strconv.Itoa(i)))
+	}
+	s.testReauthorizePCRPolicy(c, &testV3ReauthorizePCRPolicyData{pcrDigests: digests})
+}
+
+func (s *policyV3SuiteNoTPM) TestReauthorizePCRPolicyWithNVGeneration(c *C) {
+	s.testReauthorizePCRPolicy(c, &testV3ReauthorizePCRPolicyData{
+		pcrDigests:   tpm2.DigestList{hash(crypto.SHA256, "1"), hash(crypto.SHA256, "2")},
+		nvGeneration: true})
+}
+
+func (s *policyV3SuiteNoTPM) TestReauthorizePCRPolicyDifferentCounter(c *C) {
+	key := make(secboot.PrimaryKey, 32)
+	rand.Read(key)
+
+	policyData := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)}}
+	params := NewPcrPolicyParams(key,
+		tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		tpm2.DigestList{hash(crypto.SHA256, "1")},
+		newPolicyCounterPub(0x01800000).Name(), 5)
+	c.Check(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+	pcrData := policyData.PCRData
+
+	err := policyData.ReauthorizePCRPolicy(tpm2.HashAlgorithmSHA256, key, newPolicyCounterPub(0x01800001).Name(), 20, nil)
+	c.Check(err, ErrorMatches, `the current PCR policy is inconsistent with its metadata`)
+	c.Check(policyData.PCRData, Equals, pcrData)
+}
+
 type testV3ExecutePCRPolicyData struct {
 	authKeyNameAlg      tpm2.HashAlgorithmId
 	policyCounterHandle tpm2.Handle
@@ -336,7 +444,7 @@ func (s *policyV3Suite) testExecutePCRPolicy(c *C, data *testV3ExecutePCRPolicyD
 		policyCounterName = policyCounterPub.Name()
 	}
 
-	policyData, expectedDigest, err := NewKeyDataPolicy(data.alg, authKeyPublic, "", policyCounterPub, false)
+	policyData, expectedDigest, err := NewKeyDataPolicy(data.alg, authKeyPublic, "", policyCounterPub, false, false, nil)
 	c.Assert(err, IsNil)
 	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
 
@@ -699,7 +807,7 @@ func (s *policyV3Suite) testExecutePCRPolicyErrorHandling(c *C, data *testV3Exec
 		policyCounterName = policyCounterPub.Name()
 	}
 
-	policyData, expectedDigest, err := NewKeyDataPolicy(data.alg, authKeyPublic, "", policyCounterPub, false)
+	policyData, expectedDigest, err := NewKeyDataPolicy(data.alg, authKeyPublic, "", policyCounterPub, false, false, nil)
 	c.Assert(err, IsNil)
 	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v3{})
 
@@ -21,6 +21,7 @@ package tpm2
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -48,6 +49,10 @@ const (
 	// here is in the range reserved for owner indices, so there shouldn't be
 	// anything here on a new installation.
 	srkTemplateHandle tpm2.Handle = 0x01810001
+
+	// ekTemplateHandle is the NV index at which we can find a custom template for
+	// the endorsement key, if a non-default one was selected during provisioning.
+	ekTemplateHandle tpm2.Handle = 0x01810002
 )
 
 // ProvisionMode is used to control the behaviour of Connection.EnsureProvisioned.
@@ -101,58 +106,92 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 	return obj, nil
 }
 
-// selectSrkTemplate chooses a template to use for the storage primary key. Either the default
-// template will be returned or a custom one stored in a decidcated NV index. The supplied
-// HMAC session is used for authenticating with the storage hierarchy and is used to avoid sending
-// the authorization value in the clear.
+// isValidEKTemplate indicates whether the supplied template is suitable for an
+// endorsement key, which is used for salting sessions.
+func isValidEKTemplate(tmpl *tpm2.Public) bool {
+	return tmpl.IsAsymmetric() && tmpl.IsStorageParent() && tmpl.Attrs&(tpm2.AttrFixedParent|tpm2.AttrFixedTPM) == tpm2.AttrFixedParent|tpm2.AttrFixedTPM
+}
+
+// readStoredTemplate reads a template stored in the NV index at the specified handle,
+// returning nil if there isn't one or it can't be decoded. The supplied HMAC session
+// is used for authenticating with the storage hierarchy and is used to avoid sending
+// the authorization value in the clear. The readAttrs argument specifies the parameter
+// encryption attributes to use for reading the template.
 // XXX: The NV index should be created with the TPMA_NV_AUTHREAD attribute to avoid this entirely.
-func selectSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) *tpm2.Public {
-	nv, err := tpm.CreateResourceContextFromTPM(srkTemplateHandle)
+func readStoredTemplate(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext, readAttrs tpm2.SessionAttributes) *tpm2.Public {
+	nv, err := tpm.CreateResourceContextFromTPM(handle)
 	if err != nil {
-		return tcg.SRKTemplate
+		return nil
 	}
 
 	nvPub, _, err := tpm.NVReadPublic(nv)
 	if err != nil {
-		return tcg.SRKTemplate
+		return nil
 	}
 
-	b, err := tpm.NVRead(tpm.OwnerHandleContext(), nv, nvPub.Size, 0, session)
-	if err != nil {
-		return tcg.SRKTemplate
+	var b []byte
+	if err := runWithParamEncryption(session, readAttrs, func(session tpm2.SessionContext) (err error) {
+		b, err = tpm.NVRead(tpm.OwnerHandleContext(), nv, nvPub.Size, 0, session)
+		return err
+	}); err != nil {
+		return nil
 	}
 
 	var tmpl *tpm2.Public
 	if _, err := mu.UnmarshalFromBytes(b, &tmpl); err != nil {
-		return tcg.SRKTemplate
+		return nil
 	}
 
-	if !tmpl.IsStorageParent() {
+	return tmpl
+}
+
+// selectSrkTemplate chooses a template to use for the storage primary key. Either the default
+// template will be returned or a custom one stored in a decidcated NV index. The supplied
+// HMAC session is used for authenticating with the storage hierarchy and is used to avoid sending
+// the authorization value in the clear. The readAttrs argument specifies the parameter encryption
+// attributes to use for reading the custom template.
+func selectSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext, readAttrs tpm2.SessionAttributes) *tpm2.Public {
+	tmpl := readStoredTemplate(tpm, srkTemplateHandle, session, readAttrs)
+	if tmpl == nil || !tmpl.IsStorageParent() {
 		return tcg.SRKTemplate
 	}
 
 	return tmpl
 }
 
+// selectEkTemplate chooses a template to use for the endorsement key. Either the default
+// template will be returned or one stored in a dedicated NV index if a non-default template
+// was selected during provisioning. The session and readAttrs arguments are used in the same
+// way as for selectSrkTemplate.
+func selectEkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext, readAttrs tpm2.SessionAttributes) *tpm2.Public {
+	tmpl := readStoredTemplate(tpm, ekTemplateHandle, session, readAttrs)
+	if tmpl == nil || !isValidEKTemplate(tmpl) {
+		return tcg.EKTemplate
+	}
+
+	return tmpl
+}
+
 // provisionStoragePrimaryKey provisions a storage primary key at the well known persistent
 // handle. If session is supplied, it is expected to be a HMAC session with the AttrContinueSession
 // attribute set, and is used for authenticating with the relevant hierarchies to avoid sending
-// authorization values in the clear.
-func provisionStoragePrimaryKey(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
-	return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), selectSrkTemplate(tpm, session), tcg.SRKHandle, session)
+// authorization values in the clear. The templateReadAttrs argument is passed to selectSrkTemplate.
+func provisionStoragePrimaryKey(tpm *tpm2.TPMContext, session tpm2.SessionContext, templateReadAttrs tpm2.SessionAttributes) (tpm2.ResourceContext, error) {
+	return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), selectSrkTemplate(tpm, session, templateReadAttrs), tcg.SRKHandle, session)
 }
 
-// storeSrkTemplate stores the supplied template at a well known handle. If session is supplied,
-// it must be a HMAC session and is used for authenticating with the storage hierarchy to avoid sending
-// authorization values in the clear.
-func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.SessionContext) error {
+// storeTemplate stores the supplied template in a NV index at the specified handle. If session
+// is supplied, it must be a HMAC session and is used for authenticating with the storage hierarchy
+// to avoid sending authorization values in the clear. It is also used for encrypting the template
+// when it is written to the NV index.
+func storeTemplate(tpm *tpm2.TPMContext, handle tpm2.Handle, template *tpm2.Public, session tpm2.SessionContext) error {
 	tmplB, err := mu.MarshalToBytes(template)
 	if err != nil {
 		return xerrors.Errorf("cannot marshal template: %w", err)
 	}
 
 	nvPub := tpm2.NVPublic{
-		Index:   srkTemplateHandle,
+		Index:   handle,
 		NameAlg: tpm2.HashAlgorithmSHA256,
 		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVWriteDefine | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
 		Size:    uint16(len(tmplB))}
@@ -161,7 +200,9 @@ func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.
 		return xerrors.Errorf("cannot define NV index: %w", err)
 	}
 
-	if err := tpm.NVWrite(nv, nv, tmplB, 0, nil); err != nil {
+	if err := runWithParamEncryption(session, tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+		return tpm.NVWrite(nv, nv, tmplB, 0, session)
+	}); err != nil {
 		return xerrors.Errorf("cannot write NV index: %w", err)
 	}
 
@@ -172,28 +213,105 @@ func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.
 	return nil
 }
 
-// removeStoredSrkTemplate removes the SRK template stored at the well known handle, if there
-// is one. If a session is supplied, it must be a HMAC session and is used for authenticating
-// with the storage hierarchy to avoid sending the authorization value in the clear.
-func removeStoredSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) error {
-	nv, err := tpm.CreateResourceContextFromTPM(srkTemplateHandle)
+// storeSrkTemplate stores the supplied SRK template at a well known handle. See storeTemplate.
+func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.SessionContext) error {
+	return storeTemplate(tpm, srkTemplateHandle, template, session)
+}
+
+// removeStoredTemplate removes the template stored at the specified handle, if there
+// is one, indicating whether a template was removed. If a session is supplied, it must be a HMAC
+// session and is used for authenticating with the storage hierarchy to avoid sending the
+// authorization value in the clear.
+func removeStoredTemplate(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (removed bool, err error) {
+	nv, err := tpm.CreateResourceContextFromTPM(handle)
 	switch {
-	case err != nil && !tpm2.IsResourceUnavailableError(err, srkTemplateHandle):
+	case err != nil && !tpm2.IsResourceUnavailableError(err, handle):
 		// Unexpected error
-		return xerrors.Errorf("cannot create resource context: %w", err)
-	case tpm2.IsResourceUnavailableError(err, srkTemplateHandle):
+		return false, xerrors.Errorf("cannot create resource context: %w", err)
+	case tpm2.IsResourceUnavailableError(err, handle):
 		// Ok, nothing to do
-		return nil
+		return false, nil
 	}
 
 	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), nv, session); err != nil {
-		return xerrors.Errorf("cannot undefine index: %w", err)
+		return false, xerrors.Errorf("cannot undefine index: %w", err)
 	}
 
-	return nil
+	return true, nil
+}
+
+// removeStoredSrkTemplate removes the SRK template stored at the well known handle, if there
+// is one. See removeStoredTemplate.
+func removeStoredSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) (removed bool, err error) {
+	return removeStoredTemplate(tpm, srkTemplateHandle, session)
+}
+
+// ProvisionParams provides optional parameters to Connection.EnsureProvisionedWithParams.
+type ProvisionParams struct {
+	// SRKTemplate is a custom template for the storage root key. If supplied,
+	// it takes precedence over PreferECC for the storage root key. See
+	// Connection.EnsureProvisionedWithCustomSRK.
+	SRKTemplate *tpm2.Public
+
+	// PreferECC indicates that the endorsement key and storage root key should
+	// be created from ECC templates rather than the default RSA 2048 templates,
+	// if the TPM supports the required curves. ECC primary keys are much faster
+	// to create than RSA keys, which is significant on some low-end TPMs. If the
+	// TPM doesn't support the required curve for a key, the default RSA template
+	// is used for it instead.
+	//
+	// The endorsement key is always created using the NIST P-256 template defined
+	// in the "TCG EK Credential Profile for TPM Family 2.0" specification, for which
+	// manufacturers provision certificates. The storage root key is created using
+	// the curve specified by ECCCurve.
+	PreferECC bool
+
+	// ECCCurve is the curve used for the storage root key when PreferECC is set.
+	// Only tpm2.ECCCurveNIST_P256 and tpm2.ECCCurveNIST_P384 are supported. If
+	// this is not set, tpm2.ECCCurveNIST_P256 is used.
+	ECCCurve tpm2.ECCCurve
 }
 
-func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, srkTemplate *tpm2.Public, useExistingSrkTemplate bool) error {
+// templates returns the templates for the endorsement key and storage root key for
+// these parameters. A nil template indicates that the default RSA template should
+// be used.
+func (p *ProvisionParams) templates(tpm *tpm2.TPMContext) (ekTemplate, srkTemplate *tpm2.Public, err error) {
+	srkTemplate = p.SRKTemplate
+	if !p.PreferECC {
+		return nil, srkTemplate, nil
+	}
+
+	curve := p.ECCCurve
+	if curve == tpm2.ECCCurve(0) {
+		curve = tpm2.ECCCurveNIST_P256
+	}
+	eccSrkTemplate := tcg.MakeECCSRKTemplate(curve)
+	if eccSrkTemplate == nil {
+		return nil, nil, fmt.Errorf("unsupported ECC curve %v", curve)
+	}
+
+	if tpm.IsECCCurveSupported(tpm2.ECCCurveNIST_P256) {
+		ekTemplate = tcg.ECCEKTemplate
+	}
+	if srkTemplate == nil && tpm.IsECCCurveSupported(curve) {
+		srkTemplate = eccSrkTemplate
+	}
+	return ekTemplate, srkTemplate, nil
+}
+
+func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, params *ProvisionParams) error {
+	// If no parameters are supplied, we reuse any existing templates.
+	useExistingTemplates := params == nil
+
+	var ekTemplate, srkTemplate *tpm2.Public
+	if params != nil {
+		var err error
+		ekTemplate, srkTemplate, err = params.templates(t.TPMContext)
+		if err != nil {
+			return err
+		}
+	}
+
 	session := t.HmacSession()
 
 	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
@@ -218,10 +336,51 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 			}
 			return xerrors.Errorf("cannot clear the TPM: %w", err)
 		}
+		if err := t.recordProvisioningAction(ProvisioningActionClear, ""); err != nil {
+			return err
+		}
+	}
+
+	// Select the template for the endorsement key
+	if !useExistingTemplates && mode != ProvisionModeClear {
+		// If we're not reusing the existing template, remove it. We don't
+		// need to do this if mode == ProvisionModeClear because it will have
+		// already been removed.
+		removed, err := removeStoredTemplate(t.TPMContext, ekTemplateHandle, session)
+		if err != nil {
+			if isAuthFailError(err, tpm2.AnyCommandCode, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return xerrors.Errorf("cannot remove stored EK template: %w", err)
+		}
+		if removed {
+			if err := t.recordProvisioningAction(ProvisioningActionRemoveEKTemplate, ""); err != nil {
+				return err
+			}
+		}
+	}
+	switch {
+	case ekTemplate != nil:
+		// Persist the non-default template so that it is used again for
+		// future calls to EnsureProvisioned.
+		if err := storeTemplate(t.TPMContext, ekTemplateHandle, ekTemplate, session); err != nil {
+			if isAuthFailError(err, tpm2.AnyCommandCode, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return xerrors.Errorf("cannot store EK template: %w", err)
+		}
+		if err := t.recordProvisioningAction(ProvisioningActionStoreEKTemplate, fmt.Sprintf("handle=%v", ekTemplateHandle)); err != nil {
+			return err
+		}
+	case useExistingTemplates:
+		ekTemplate = selectEkTemplate(t.TPMContext, session, t.nvReadEncryptAttrs())
+	default:
+		ekTemplate = tcg.EKTemplate
 	}
 
 	// Provision an endorsement key
-	if _, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session); err != nil {
+	ek, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), ekTemplate, tcg.EKHandle, session)
+	if err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.CommandEvictControl, 1):
 			return AuthFailError{tpm2.HandleOwner}
@@ -231,6 +390,9 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 			return xerrors.Errorf("cannot provision endorsement key: %w", err)
 		}
 	}
+	if err := t.recordProvisioningAction(ProvisioningActionCreateEK, fmt.Sprintf("handle=%v name=%x", ek.Handle(), ek.Name())); err != nil {
+		return err
+	}
 
 	// Reinitialize the connection, which creates a new session that's salted with a value protected with the newly provisioned EK.
 	// This will have a symmetric algorithm for parameter encryption during HierarchyChangeAuth.
@@ -240,22 +402,31 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 	session = t.HmacSession()
 
 	// Provision a storage root key
-	if !useExistingSrkTemplate && mode != ProvisionModeClear {
+	if !useExistingTemplates && mode != ProvisionModeClear {
 		// If we're not reusing the existing custom template, remove it. We don't
 		// need to do this if mode == ProvisionModeClear because it will have already
 		// been removed.
-		if err := removeStoredSrkTemplate(t.TPMContext, session); err != nil {
+		removed, err := removeStoredSrkTemplate(t.TPMContext, session)
+		if err != nil {
 			return xerrors.Errorf("cannot remove stored custom SRK template: %w", err)
 		}
+		if removed {
+			if err := t.recordProvisioningAction(ProvisioningActionRemoveSRKTemplate, ""); err != nil {
+				return err
+			}
+		}
 	}
 	if srkTemplate != nil {
 		// Persist the new custom template
 		if err := storeSrkTemplate(t.TPMContext, srkTemplate, session); err != nil {
 			return xerrors.Errorf("cannot store custom SRK template: %w", err)
 		}
+		if err := t.recordProvisioningAction(ProvisioningActionStoreSRKTemplate, fmt.Sprintf("handle=%v", srkTemplateHandle)); err != nil {
+			return err
+		}
 	}
 
-	srk, err := provisionStoragePrimaryKey(t.TPMContext, session)
+	srk, err := provisionStoragePrimaryKey(t.TPMContext, session, t.nvReadEncryptAttrs())
 	if err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
@@ -265,6 +436,9 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		}
 	}
 	t.provisionedSrk = srk
+	if err := t.recordProvisioningAction(ProvisioningActionCreateSRK, fmt.Sprintf("handle=%v name=%x", srk.Handle(), srk.Name())); err != nil {
+		return err
+	}
 
 	if mode == ProvisionModeWithoutLockout {
 		props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
@@ -306,6 +480,9 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		}
 		return xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
 	}
+	if err := t.recordProvisioningAction(ProvisioningActionSetDAParameters, fmt.Sprintf("maxTries=%d recoveryTime=%d lockoutRecovery=%d", maxTries, recoveryTime, lockoutRecovery)); err != nil {
+		return err
+	}
 
 	// Disable owner clear. Pass the HMAC session here so we don't supply the cleartext auth
 	// value for the lockout hierarchy.
@@ -313,12 +490,18 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		// Lockout auth failure or lockout mode would have been caught by DictionaryAttackParameters
 		return xerrors.Errorf("cannot disable owner clear: %w", err)
 	}
+	if err := t.recordProvisioningAction(ProvisioningActionDisableOwnerClear, ""); err != nil {
+		return err
+	}
 
 	// Set the lockout hierarchy authorization. Use command parameter encryption here for the new value.
 	// Note that this only offers protections against passive interposers.
 	if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), newLockoutAuth, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
 		return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
 	}
+	if err := t.recordProvisioningAction(ProvisioningActionSetLockoutAuth, ""); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -379,7 +562,29 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 		return errors.New("supplied SRK template is not valid for a parent key")
 	}
 
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, srkTemplate, false)
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, &ProvisionParams{SRKTemplate: srkTemplate})
+}
+
+// EnsureProvisionedWithParams prepares the TPM for full disk encryption in the same way as
+// EnsureProvisioned, with the optional parameters supplied via params.
+//
+// If params is nil, this behaves identically to EnsureProvisioned. Otherwise, the templates
+// for the endorsement key and storage root key are selected from the supplied parameters
+// rather than reusing any previously selected templates. If params.SRKTemplate is supplied,
+// this behaves like EnsureProvisionedWithCustomSRK with respect to the storage root key.
+//
+// If params.PreferECC is set and the TPM supports the required curves, the endorsement key
+// and storage root key are created from ECC templates rather than the default RSA templates.
+// Any non-default templates are persisted inside the TPM, and future calls to
+// EnsureProvisioned will use them unless mode is set to ProvisionModeClear. The storage root
+// key template will also be used to recreate the storage root key during device activation if
+// the initial unsealing fails.
+func (t *Connection) EnsureProvisionedWithParams(mode ProvisionMode, newLockoutAuth []byte, params *ProvisionParams) error {
+	if params != nil && params.SRKTemplate != nil && !params.SRKTemplate.IsStorageParent() {
+		return errors.New("supplied SRK template is not valid for a parent key")
+	}
+
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, params)
 }
 
 // EnsureProvisioned prepares the TPM for full disk encryption. The mode parameter specifies the behaviour of this function.
@@ -411,7 +616,9 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 // created using the RSA template defined in the "TCG EK Credential Profile for TPM Family 2.0" specification. The storage root
 // key will be created using the RSA template defined in the "TCG TPM v2.0 Provisioning Guidance" specification unless the
 // TPM has previously been provisioned with a custom SRK template using the EnsureProvisionedWithCustomSRK function and mode is
-// not ProvisionModeClear, in which case, the originally supplied template will be used instead. If there are any objects already
+// not ProvisionModeClear, in which case, the originally supplied template will be used instead. Similarly, if the TPM has
+// previously been provisioned with ECC templates using the EnsureProvisionedWithParams function and mode is not
+// ProvisionModeClear, the originally selected templates will be used for both keys. If there are any objects already
 // stored at the locations required for either primary key, then this function will evict them automatically from the TPM. These
 // operations both require the use of the storage and endorsement hierarchies. If mode is ProvisionModeFull or
 // ProvisionModeWithoutLockout, then knowledge of the authorization values for these hierarchies is required. Whilst these will be
@@ -428,7 +635,84 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 // completed without using the lockout hierarchy, but the function should be called again either with mode set to ProvisionModeFull
 // (if the authorization value for the lockout hierarchy is known), or ProvisionModeClear.
 func (t *Connection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true)
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil)
+}
+
+// ProvisionResult describes the outcome of Connection.EnsureProvisionedWithFallback.
+type ProvisionResult struct {
+	// Mode is the mode that provisioning completed in. This will be
+	// ProvisionModeWithoutLockout if provisioning was downgraded.
+	Mode ProvisionMode
+
+	// DowngradeReason is the error that prevented provisioning from being
+	// completed with ProvisionModeFull, if provisioning was downgraded. This
+	// will be an AuthFailError for the lockout hierarchy, or ErrTPMLockout.
+	DowngradeReason error
+
+	// Status is the provisioning status of the TPM after provisioning. If
+	// provisioning was downgraded, Status.RequiresLockout indicates whether
+	// the TPM is only partially provisioned.
+	Status ProvisionStatusAttributes
+}
+
+// Downgraded indicates whether provisioning was downgraded from
+// ProvisionModeFull to ProvisionModeWithoutLockout.
+func (r *ProvisionResult) Downgraded() bool {
+	return r.DowngradeReason != nil
+}
+
+// isLockoutUnavailableError indicates whether the supplied error from
+// ensureProvisionedInternal indicates that the lockout hierarchy couldn't be used.
+func isLockoutUnavailableError(err error) bool {
+	if err == ErrTPMLockout {
+		return true
+	}
+	var e AuthFailError
+	return xerrors.As(err, &e) && e.Handle == tpm2.HandleLockout
+}
+
+// EnsureProvisionedWithFallback prepares the TPM for full disk encryption in the same way as
+// EnsureProvisionedWithParams with mode set to ProvisionModeFull, but falls back to the behaviour
+// of ProvisionModeWithoutLockout if the lockout hierarchy cannot be used, rather than returning
+// an error.
+//
+// The lockout hierarchy cannot be used if the wrong authorization value is supplied for it, in
+// which case the TPM will have entered dictionary attack lockout mode for the lockout hierarchy
+// (see EnsureProvisioned), or if it is already in lockout mode. If the authorization value for
+// the lockout hierarchy is known to be unavailable, EnsureProvisioned should be called with
+// ProvisionModeWithoutLockout instead to avoid triggering the lockout.
+//
+// On success, the returned result describes whether provisioning was downgraded and why, and
+// the provisioning status of the TPM afterwards, which the caller can use to decide whether
+// partial provisioning is acceptable. In this case, ErrTPMProvisioningRequiresLockout is never
+// returned. Any other error is returned as it would be by EnsureProvisionedWithParams.
+func (t *Connection) EnsureProvisionedWithFallback(newLockoutAuth []byte, params *ProvisionParams) (*ProvisionResult, error) {
+	if params != nil && params.SRKTemplate != nil && !params.SRKTemplate.IsStorageParent() {
+		return nil, errors.New("supplied SRK template is not valid for a parent key")
+	}
+
+	result := &ProvisionResult{Mode: ProvisionModeFull}
+
+	err := t.ensureProvisionedInternal(ProvisionModeFull, newLockoutAuth, params)
+	switch {
+	case err == nil:
+		// Fully provisioned.
+	case isLockoutUnavailableError(err):
+		// The operations that don't require the lockout hierarchy are
+		// performed first, so they have already completed.
+		result.Mode = ProvisionModeWithoutLockout
+		result.DowngradeReason = err
+	default:
+		return nil, err
+	}
+
+	status, err := t.ProvisionStatus()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine provisioning status: %w", err)
+	}
+	result.Status = status
+
+	return result, nil
 }
 
 // RequestTPMClearUsingPPI submits a request to the firmware to clear the TPM on the next reboot. This is the only way to clear
@@ -0,0 +1,385 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ProvisioningAction describes an action recorded in a ProvisioningAuditLog.
+type ProvisioningAction string
+
+const (
+	// ProvisioningActionClear indicates that the TPM was cleared.
+	ProvisioningActionClear ProvisioningAction = "clear"
+
+	// ProvisioningActionCreateEK indicates that the endorsement key was created
+	// and persisted.
+	ProvisioningActionCreateEK ProvisioningAction = "create-ek"
+
+	// ProvisioningActionCreateSRK indicates that the storage root key was
+	// created and persisted.
+	ProvisioningActionCreateSRK ProvisioningAction = "create-srk"
+
+	// ProvisioningActionStoreSRKTemplate indicates that a custom template for
+	// the storage root key was persisted.
+	ProvisioningActionStoreSRKTemplate ProvisioningAction = "store-srk-template"
+
+	// ProvisioningActionRemoveSRKTemplate indicates that a previously persisted
+	// custom template for the storage root key was removed.
+	ProvisioningActionRemoveSRKTemplate ProvisioningAction = "remove-srk-template"
+
+	// ProvisioningActionStoreEKTemplate indicates that a non-default template
+	// for the endorsement key was persisted.
+	ProvisioningActionStoreEKTemplate ProvisioningAction = "store-ek-template"
+
+	// ProvisioningActionRemoveEKTemplate indicates that a previously persisted
+	// template for the endorsement key was removed.
+	ProvisioningActionRemoveEKTemplate ProvisioningAction = "remove-ek-template"
+
+	// ProvisioningActionSetDAParameters indicates that the dictionary attack
+	// parameters were configured.
+	ProvisioningActionSetDAParameters ProvisioningAction = "set-da-parameters"
+
+	// ProvisioningActionDisableOwnerClear indicates that owner clear was
+	// disabled.
+	ProvisioningActionDisableOwnerClear ProvisioningAction = "disable-owner-clear"
+
+	// ProvisioningActionSetLockoutAuth indicates that the authorization value
+	// for the lockout hierarchy was changed.
+	ProvisioningActionSetLockoutAuth ProvisioningAction = "set-lockout-auth"
+
+	// ProvisioningActionSetOwnerAuth indicates that the authorization value
+	// for the owner hierarchy was changed.
+	ProvisioningActionSetOwnerAuth ProvisioningAction = "set-owner-auth"
+
+	// ProvisioningActionSetEndorsementAuth indicates that the authorization
+	// value for the endorsement hierarchy was changed.
+	ProvisioningActionSetEndorsementAuth ProvisioningAction = "set-endorsement-auth"
+)
+
+// ErrProvisioningAuditAnchorBehind is returned from
+// Connection.VerifyProvisioningAuditAnchor if the last anchored entry in a
+// log has not been extended to the anchor, but the anchor is otherwise
+// consistent with the log.
+var ErrProvisioningAuditAnchorBehind = errors.New("the last entry in the log has not been extended to the anchor")
+
+// provisioningAuditDigestAlg is the algorithm used to chain entries in a
+// provisioning audit log.
+const provisioningAuditDigestAlg = crypto.SHA256
+
+// ProvisioningAuditEntry is a single entry in a ProvisioningAuditLog.
+type ProvisioningAuditEntry struct {
+	Time    time.Time          `json:"time"`
+	Action  ProvisioningAction `json:"action"`
+	Details string             `json:"details,omitempty"`
+
+	// Anchor is the handle of the NV index that the digest of this entry
+	// was extended to, or zero if the entry was not anchored in the TPM.
+	Anchor tpm2.Handle `json:"anchor,omitempty"`
+
+	// Prev is the digest of the previous entry in the log, or empty for
+	// the first entry.
+	Prev tpm2.Digest `json:"prev,omitempty"`
+
+	// Digest is the digest of this entry, which is computed from all of the
+	// above fields.
+	Digest tpm2.Digest `json:"digest"`
+}
+
+func (e *ProvisioningAuditEntry) computeDigest() (tpm2.Digest, error) {
+	data, err := json.Marshal(struct {
+		Time    time.Time          `json:"time"`
+		Action  ProvisioningAction `json:"action"`
+		Details string             `json:"details,omitempty"`
+		Anchor  tpm2.Handle        `json:"anchor,omitempty"`
+	}{
+		Time:    e.Time,
+		Action:  e.Action,
+		Details: e.Details,
+		Anchor:  e.Anchor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h := provisioningAuditDigestAlg.New()
+	h.Write(e.Prev)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// ProvisioningAuditLog records the provisioning actions performed on a TPM
+// as a tamper-evident log. Each entry is written as a single line of JSON,
+// and contains the digest of the previous entry so that the removal or
+// modification of an entry can be detected by VerifyProvisioningAuditLog.
+//
+// The log can optionally be anchored in the TPM by calling SetAnchor with an
+// NV index created by Connection.CreateProvisioningAuditAnchor, in which case
+// the digest of each entry is also extended to that index. This makes it
+// possible to detect the removal of entries from the end of the log or
+// the replacement of the whole log, using
+// Connection.VerifyProvisioningAuditAnchor.
+//
+// A log is associated with a connection using
+// Connection.SetProvisioningAuditLog.
+type ProvisioningAuditLog struct {
+	w      io.Writer
+	last   tpm2.Digest
+	anchor tpm2.ResourceContext
+}
+
+// NewProvisioningAuditLog creates a new ProvisioningAuditLog that writes
+// entries to w. When appending to an existing log, last should be set to
+// the digest of the last entry in it, as returned from
+// VerifyProvisioningAuditLog. It should be empty for a new log.
+func NewProvisioningAuditLog(w io.Writer, last tpm2.Digest) *ProvisioningAuditLog {
+	return &ProvisioningAuditLog{w: w, last: last}
+}
+
+// SetAnchor sets the NV index to which the digest of each subsequent entry
+// is extended. The index must have been created with
+// Connection.CreateProvisioningAuditAnchor. Passing nil disables anchoring.
+//
+// Clearing the TPM removes the anchor index, so entries recorded after the
+// TPM has been cleared aren't anchored until this is called again with a
+// new index.
+func (l *ProvisioningAuditLog) SetAnchor(index tpm2.ResourceContext) {
+	l.anchor = index
+}
+
+func (l *ProvisioningAuditLog) record(tpm *tpm2.TPMContext, session tpm2.SessionContext, action ProvisioningAction, details string) error {
+	if action == ProvisioningActionClear {
+		// The anchor index no longer exists.
+		l.anchor = nil
+	}
+
+	entry := &ProvisioningAuditEntry{
+		Time:    timeNow().UTC(),
+		Action:  action,
+		Details: details,
+		Prev:    l.last,
+	}
+	if l.anchor != nil {
+		entry.Anchor = l.anchor.Handle()
+	}
+
+	digest, err := entry.computeDigest()
+	if err != nil {
+		return xerrors.Errorf("cannot compute entry digest: %w", err)
+	}
+	entry.Digest = digest
+
+	// Write the entry before extending it to the anchor. If we are
+	// interrupted between the two, the log has one more anchored entry
+	// than the anchor, which VerifyProvisioningAuditAnchor can identify.
+	// Doing it the other way around would leave the anchor with a digest
+	// that can't be accounted for by any entry in the log.
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return xerrors.Errorf("cannot serialize entry: %w", err)
+	}
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		return xerrors.Errorf("cannot write entry: %w", err)
+	}
+	l.last = digest
+
+	if l.anchor != nil {
+		if err := runWithParamEncryption(session, tpm2.AttrCommandEncrypt, func(session tpm2.SessionContext) error {
+			return tpm.NVExtend(tpm.OwnerHandleContext(), l.anchor, tpm2.MaxNVBuffer(digest), session)
+		}); err != nil {
+			return xerrors.Errorf("cannot extend entry to anchor: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyProvisioningAuditLog reads a log written by a ProvisioningAuditLog
+// from r and verifies that the entries are correctly chained together. On
+// success, the entries are returned.
+func VerifyProvisioningAuditLog(r io.Reader) ([]*ProvisioningAuditEntry, error) {
+	var entries []*ProvisioningAuditEntry
+	var prev tpm2.Digest
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry *ProvisioningAuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, xerrors.Errorf("cannot decode entry %d: %w", len(entries), err)
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("entry %d is empty", len(entries))
+		}
+		if !bytes.Equal(entry.Prev, prev) {
+			return nil, fmt.Errorf("entry %d is not chained to the previous entry", len(entries))
+		}
+		digest, err := entry.computeDigest()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute digest for entry %d: %w", len(entries), err)
+		}
+		if !bytes.Equal(entry.Digest, digest) {
+			return nil, fmt.Errorf("entry %d has an invalid digest", len(entries))
+		}
+
+		entries = append(entries, entry)
+		prev = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("cannot read log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// CreateProvisioningAuditAnchor creates a NV extend index at the specified
+// handle for anchoring a ProvisioningAuditLog in the TPM (see
+// ProvisioningAuditLog.SetAnchor). The handle should be in the range
+// reserved for owner indices. Extending and reading the index requires
+// knowledge of the authorization value for the storage hierarchy, which
+// must be provided by calling Connection.OwnerHandleContext().SetAuthValue()
+// prior to calling this function.
+func (t *Connection) CreateProvisioningAuditAnchor(handle tpm2.Handle) (tpm2.ResourceContext, error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid handle type")
+	}
+
+	nvPub := tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeExtend.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
+		Size:    uint16(tpm2.HashAlgorithmSHA256.Size())}
+	index, err := t.NVDefineSpace(t.OwnerHandleContext(), nil, &nvPub, t.HmacSession())
+	if err != nil {
+		if isAuthFailError(err, tpm2.CommandNVDefineSpace, 1) {
+			return nil, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+
+	return index, nil
+}
+
+// VerifyProvisioningAuditAnchor verifies that the supplied entries, which
+// should be obtained from VerifyProvisioningAuditLog, are consistent with the
+// value of the supplied anchor index. Only entries recorded after the most
+// recent clear and which are anchored to the supplied index are considered.
+// This requires knowledge of the authorization value for the storage
+// hierarchy.
+//
+// If the anchor is consistent with all but the last anchored entry,
+// ErrProvisioningAuditAnchorBehind is returned. This happens if the
+// process recording the log was interrupted after writing the last entry
+// but before extending it to the anchor.
+func (t *Connection) VerifyProvisioningAuditAnchor(entries []*ProvisioningAuditEntry, index tpm2.ResourceContext) error {
+	pub, _, err := t.NVReadPublic(index)
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of anchor: %w", err)
+	}
+	if pub.Attrs.Type() != tpm2.NVTypeExtend {
+		return errors.New("anchor has the wrong type")
+	}
+	if !pub.NameAlg.Available() {
+		return errors.New("anchor has an unsupported name algorithm")
+	}
+
+	expected := make(tpm2.Digest, pub.NameAlg.Size())
+	var prevExpected tpm2.Digest
+	var anchored int
+	for _, entry := range entries {
+		switch {
+		case entry.Action == ProvisioningActionClear:
+			expected = make(tpm2.Digest, pub.NameAlg.Size())
+			anchored = 0
+		case entry.Anchor == index.Handle():
+			prevExpected = expected
+			h := pub.NameAlg.NewHash()
+			h.Write(expected)
+			h.Write(entry.Digest)
+			expected = h.Sum(nil)
+			anchored += 1
+		}
+	}
+	if anchored == 0 {
+		return errors.New("no entries are anchored to the supplied index")
+	}
+
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		if anchored == 1 {
+			return ErrProvisioningAuditAnchorBehind
+		}
+		return errors.New("anchor has not been written")
+	}
+	var value []byte
+	if err := runWithParamEncryption(t.HmacSession(), t.nvReadEncryptAttrs(), func(session tpm2.SessionContext) (err error) {
+		value, err = t.NVRead(t.OwnerHandleContext(), index, pub.Size, 0, session)
+		return err
+	}); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVRead, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot read anchor: %w", err)
+	}
+	switch {
+	case bytes.Equal(value, expected):
+		// ok
+	case bytes.Equal(value, prevExpected):
+		return ErrProvisioningAuditAnchorBehind
+	default:
+		return errors.New("log is inconsistent with the anchor")
+	}
+
+	return nil
+}
+
+// SetProvisioningAuditLog sets the log to which actions performed by
+// EnsureProvisioned and EnsureProvisionedWithCustomSRK are recorded. Passing
+// nil disables recording, which is the default. If an action cannot be
+// recorded, provisioning fails with an error.
+func (t *Connection) SetProvisioningAuditLog(log *ProvisioningAuditLog) {
+	t.auditLog = log
+}
+
+func (t *Connection) recordProvisioningAction(action ProvisioningAction, details string) error {
+	if t.auditLog == nil {
+		return nil
+	}
+	if err := t.auditLog.record(t.TPMContext, t.HmacSession(), action, details); err != nil {
+		return xerrors.Errorf("cannot record %s action in provisioning audit log: %w", action, err)
+	}
+	return nil
+}
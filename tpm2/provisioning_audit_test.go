@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type provisioningAuditSuiteNoTPM struct{}
+
+type provisioningAuditSimulatorSuite struct {
+	tpm2test.TPMSimulatorTest
+}
+
+var _ = Suite(&provisioningAuditSuiteNoTPM{})
+var _ = Suite(&provisioningAuditSimulatorSuite{})
+
+func (s *provisioningAuditSuiteNoTPM) writeLog(c *C) *bytes.Buffer {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	restore := MockTimeNow(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	})
+	defer restore()
+
+	buf := new(bytes.Buffer)
+	log := NewProvisioningAuditLog(buf, nil)
+	c.Check(log.Record(ProvisioningActionClear, ""), IsNil)
+	c.Check(log.Record(ProvisioningActionCreateEK, "handle=0x81010001"), IsNil)
+	c.Check(log.Record(ProvisioningActionCreateSRK, "handle=0x81000001"), IsNil)
+	return buf
+}
+
+func (s *provisioningAuditSuiteNoTPM) TestVerify(c *C) {
+	buf := s.writeLog(c)
+
+	entries, err := VerifyProvisioningAuditLog(buf)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Check(entries[0].Action, Equals, ProvisioningActionClear)
+	c.Check(entries[0].Prev, HasLen, 0)
+	c.Check(entries[0].Time.Equal(time.Date(2024, 5, 1, 10, 0, 1, 0, time.UTC)), Equals, true)
+	c.Check(entries[1].Action, Equals, ProvisioningActionCreateEK)
+	c.Check(entries[1].Details, Equals, "handle=0x81010001")
+	c.Check(entries[1].Prev, DeepEquals, entries[0].Digest)
+	c.Check(entries[2].Action, Equals, ProvisioningActionCreateSRK)
+	c.Check(entries[2].Prev, DeepEquals, entries[1].Digest)
+	for _, e := range entries {
+		c.Check(e.Anchor, Equals, tpm2.Handle(0))
+		c.Check(e.Digest, HasLen, 32)
+	}
+}
+
+func (s *provisioningAuditSuiteNoTPM) TestAppend(c *C) {
+	buf := s.writeLog(c)
+	entries, err := VerifyProvisioningAuditLog(bytes.NewReader(buf.Bytes()))
+	c.Assert(err, IsNil)
+
+	log := NewProvisioningAuditLog(buf, entries[len(entries)-1].Digest)
+	c.Check(log.Record(ProvisioningActionSetLockoutAuth, ""), IsNil)
+
+	entries, err = VerifyProvisioningAuditLog(buf)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 4)
+	c.Check(entries[3].Action, Equals, ProvisioningActionSetLockoutAuth)
+}
+
+func (s *provisioningAuditSuiteNoTPM) TestVerifyModifiedEntry(c *C) {
+	buf := s.writeLog(c)
+	data := bytes.Replace(buf.Bytes(), []byte("0x81010001"), []byte("0x81010002"), 1)
+
+	_, err := VerifyProvisioningAuditLog(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `entry 1 has an invalid digest`)
+}
+
+func (s *provisioningAuditSuiteNoTPM) TestVerifyRemovedEntry(c *C) {
+	buf := s.writeLog(c)
+	lines := bytes.SplitAfter(buf.Bytes(), []byte("\n"))
+	data := append(append([]byte(nil), lines[0]...), lines[2]...)
+
+	_, err := VerifyProvisioningAuditLog(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `entry 1 is not chained to the previous entry`)
+}
+
+func (s *provisioningAuditSuiteNoTPM) TestVerifyInvalidJSON(c *C) {
+	_, err := VerifyProvisioningAuditLog(bytes.NewReader([]byte("foo\n")))
+	c.Check(err, ErrorMatches, `cannot decode entry 0: .*`)
+}
+
+func (s *provisioningAuditSimulatorSuite) TestProvisionWithAnchoredLog(c *C) {
+	anchor, err := s.TPM().CreateProvisioningAuditAnchor(0x0181ff10)
+	c.Assert(err, IsNil)
+
+	buf := new(bytes.Buffer)
+	log := NewProvisioningAuditLog(buf, nil)
+	log.SetAnchor(anchor)
+	s.TPM().SetProvisioningAuditLog(log)
+
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	entries, err := VerifyProvisioningAuditLog(buf)
+	c.Assert(err, IsNil)
+	var actions []ProvisioningAction
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		c.Check(e.Anchor, Equals, tpm2.Handle(0x0181ff10))
+	}
+	c.Check(actions, DeepEquals, []ProvisioningAction{
+		ProvisioningActionCreateEK,
+		ProvisioningActionCreateSRK,
+		ProvisioningActionSetDAParameters,
+		ProvisioningActionDisableOwnerClear,
+		ProvisioningActionSetLockoutAuth,
+	})
+
+	c.Check(s.TPM().VerifyProvisioningAuditAnchor(entries, anchor), IsNil)
+	c.Check(s.TPM().VerifyProvisioningAuditAnchor(entries[:len(entries)-1], anchor), ErrorMatches, `log is inconsistent with the anchor`)
+}
+
+func (s *provisioningAuditSimulatorSuite) TestAnchorBehindLog(c *C) {
+	anchor, err := s.TPM().CreateProvisioningAuditAnchor(0x0181ff10)
+	c.Assert(err, IsNil)
+
+	buf := new(bytes.Buffer)
+	log := NewProvisioningAuditLog(buf, nil)
+	log.SetAnchor(anchor)
+	s.TPM().SetProvisioningAuditLog(log)
+
+	c.Check(s.TPM().RecordProvisioningAction(ProvisioningActionCreateEK, ""), IsNil)
+
+	// Make extending the anchor fail after the entry has been written.
+	s.TPM().OwnerHandleContext().SetAuthValue([]byte("foo"))
+	c.Check(s.TPM().RecordProvisioningAction(ProvisioningActionCreateSRK, ""), ErrorMatches,
+		`cannot record create-srk action in provisioning audit log: cannot extend entry to anchor: .*`)
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	entries, err := VerifyProvisioningAuditLog(bytes.NewReader(buf.Bytes()))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Check(s.TPM().VerifyProvisioningAuditAnchor(entries, anchor), Equals, ErrProvisioningAuditAnchorBehind)
+	c.Check(s.TPM().VerifyProvisioningAuditAnchor(entries[:1], anchor), IsNil)
+
+	// Subsequent entries are chained to the unanchored one.
+	c.Check(s.TPM().RecordProvisioningAction(ProvisioningActionSetLockoutAuth, ""), IsNil)
+	entries, err = VerifyProvisioningAuditLog(buf)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 3)
+}
@@ -0,0 +1,192 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// ProvisionStatusAttributes correspond to the state of the TPM with regards to provisioning for full disk encryption.
+type ProvisionStatusAttributes int
+
+const (
+	// AttrValidSRK indicates that the TPM contains a valid storage root key at the expected persistent handle,
+	// created with the template that Connection.EnsureProvisioned would use.
+	AttrValidSRK ProvisionStatusAttributes = 1 << iota
+
+	// AttrValidEK indicates that the TPM contains a valid endorsement key at the expected persistent handle,
+	// created with the template that Connection.EnsureProvisioned would use.
+	AttrValidEK
+
+	// AttrDAParamsOK indicates that the dictionary attack lockout parameters are configured correctly.
+	AttrDAParamsOK
+
+	// AttrOwnerClearDisabled indicates that the ability to clear the TPM with the lockout hierarchy authorization
+	// has been disabled.
+	AttrOwnerClearDisabled
+
+	// AttrLockoutAuthSet indicates that the lockout hierarchy has an authorization value.
+	AttrLockoutAuthSet
+
+	// AttrCustomSRKTemplate indicates that the TPM has a custom template for the storage root key, stored in the
+	// NV index reserved for it.
+	AttrCustomSRKTemplate
+)
+
+// RequiresLockout indicates whether Connection.EnsureProvisioned requires the use of the lockout hierarchy in
+// order to complete provisioning, in which case it would return ErrTPMProvisioningRequiresLockout if called
+// with ProvisionModeWithoutLockout. If this returns true, the caller will need to obtain the authorization value
+// for the lockout hierarchy and use ProvisionModeFull, or use ProvisionModeClear.
+func (a ProvisionStatusAttributes) RequiresLockout() bool {
+	const required = AttrDAParamsOK | AttrOwnerClearDisabled | AttrLockoutAuthSet
+	return a&required != required
+}
+
+// isObjectPrimaryKeyWithTemplate checks whether the supplied object is a primary key in the
+// specified hierarchy with the specified template.
+func isObjectPrimaryKeyWithTemplate(tpm *tpm2.TPMContext, hierarchy, object tpm2.ResourceContext, template *tpm2.Public) (bool, error) {
+	pub, _, qualifiedName, err := tpm.ReadPublic(object)
+	if err != nil {
+		return false, xerrors.Errorf("cannot read public area of object: %w", err)
+	}
+
+	// The unique field is computed by the TPM when the key is created, so
+	// exclude it from the comparison.
+	pubCopy := *pub
+	pubCopy.Unique = template.Unique
+
+	pubBytes, err := mu.MarshalToBytes(&pubCopy)
+	if err != nil {
+		return false, xerrors.Errorf("cannot marshal public area of object: %w", err)
+	}
+	templateBytes, err := mu.MarshalToBytes(template)
+	if err != nil {
+		return false, xerrors.Errorf("cannot marshal template: %w", err)
+	}
+	if !bytes.Equal(pubBytes, templateBytes) {
+		return false, nil
+	}
+
+	// The qualified name of a primary key is computed from the name of its
+	// hierarchy and its own name.
+	if !pub.NameAlg.Available() {
+		return false, nil
+	}
+	h := pub.NameAlg.NewHash()
+	h.Write(hierarchy.Name())
+	h.Write(object.Name())
+	expectedQualifiedName, err := mu.MarshalToBytes(pub.NameAlg, mu.RawBytes(h.Sum(nil)))
+	if err != nil {
+		return false, xerrors.Errorf("cannot marshal expected qualified name: %w", err)
+	}
+
+	return bytes.Equal(qualifiedName, expectedQualifiedName), nil
+}
+
+// isPersistentPrimaryKeyWithTemplate checks whether the persistent handle is occupied by a primary key in the
+// specified hierarchy with the specified template.
+func isPersistentPrimaryKeyWithTemplate(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, handle tpm2.Handle, template *tpm2.Public) (bool, error) {
+	object, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return false, nil
+	case err != nil:
+		return false, xerrors.Errorf("cannot create context for object: %w", err)
+	}
+
+	return isObjectPrimaryKeyWithTemplate(tpm, hierarchy, object, template)
+}
+
+// ProvisionStatus returns the provisioning status of the TPM, indicating which of the steps performed by
+// Connection.EnsureProvisioned have been completed. This does not modify the TPM. Callers can use this to
+// determine whether the lockout hierarchy authorization value is required to complete provisioning before
+// prompting the user for it, with ProvisionStatusAttributes.RequiresLockout.
+//
+// The status of the storage root key is determined using the custom template for it if one has been stored
+// and it can be read, which requires knowledge of the authorization value for the storage hierarchy. This can
+// be provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If it
+// cannot be read, the storage root key is checked against the default template.
+func (t *Connection) ProvisionStatus() (status ProvisionStatusAttributes, err error) {
+	r := beginOperation(OperationProvisionStatus, t.Transport())
+	defer func() {
+		r.end(err)
+	}()
+
+	var out ProvisionStatusAttributes
+
+	session := t.HmacSession()
+
+	ekTemplate := selectEkTemplate(t.TPMContext, session, t.nvReadEncryptAttrs())
+	ok, err := isPersistentPrimaryKeyWithTemplate(t.TPMContext, t.EndorsementHandleContext(), tcg.EKHandle, ekTemplate)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot determine if object at %v is a valid endorsement key: %w", tcg.EKHandle, err)
+	}
+	if ok {
+		out |= AttrValidEK
+	}
+
+	srkTemplate := selectSrkTemplate(t.TPMContext, session, t.nvReadEncryptAttrs())
+	if srkTemplate != tcg.SRKTemplate {
+		out |= AttrCustomSRKTemplate
+	}
+	ok, err = isPersistentPrimaryKeyWithTemplate(t.TPMContext, t.OwnerHandleContext(), tcg.SRKHandle, srkTemplate)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot determine if object at %v is a valid storage root key: %w", tcg.SRKHandle, err)
+	}
+	if ok {
+		out |= AttrValidSRK
+	}
+
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot fetch DA parameters: %w", err)
+	}
+	if len(props) < 3 || props[0].Property != tpm2.PropertyMaxAuthFail || props[1].Property != tpm2.PropertyLockoutInterval || props[2].Property != tpm2.PropertyLockoutRecovery {
+		return 0, errors.New("TPM returned values for the wrong properties")
+	}
+	if props[0].Value <= maxTries && props[1].Value >= recoveryTime && props[2].Value >= lockoutRecovery {
+		out |= AttrDAParamsOK
+	}
+
+	props, err = t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyPermanent {
+		return 0, errors.New("TPM returned value for the wrong property")
+	}
+	permanent := tpm2.PermanentAttributes(props[0].Value)
+	if permanent&tpm2.AttrLockoutAuthSet > 0 {
+		out |= AttrLockoutAuthSet
+	}
+	if permanent&tpm2.AttrDisableClear > 0 {
+		out |= AttrOwnerClearDisabled
+	}
+
+	return out, nil
+}
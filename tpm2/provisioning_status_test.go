@@ -0,0 +1,112 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type provisionStatusSuiteNoTPM struct{}
+
+type provisionStatusSuite struct {
+	tpm2test.TPMSimulatorTest
+}
+
+var _ = Suite(&provisionStatusSuiteNoTPM{})
+var _ = Suite(&provisionStatusSuite{})
+
+func (s *provisionStatusSuiteNoTPM) TestRequiresLockout(c *C) {
+	for _, data := range []struct {
+		attrs    ProvisionStatusAttributes
+		expected bool
+	}{
+		{attrs: 0, expected: true},
+		{attrs: AttrValidSRK | AttrValidEK, expected: true},
+		{attrs: AttrValidSRK | AttrValidEK | AttrDAParamsOK | AttrOwnerClearDisabled, expected: true},
+		{attrs: AttrValidSRK | AttrValidEK | AttrDAParamsOK | AttrLockoutAuthSet, expected: true},
+		{attrs: AttrValidSRK | AttrValidEK | AttrOwnerClearDisabled | AttrLockoutAuthSet, expected: true},
+		{attrs: AttrDAParamsOK | AttrOwnerClearDisabled | AttrLockoutAuthSet, expected: false},
+		{attrs: AttrValidSRK | AttrValidEK | AttrDAParamsOK | AttrOwnerClearDisabled | AttrLockoutAuthSet | AttrCustomSRKTemplate, expected: false},
+	} {
+		c.Check(data.attrs.RequiresLockout(), Equals, data.expected, Commentf("attrs: %v", data.attrs))
+	}
+}
+
+func (s *provisionStatusSuite) TestNewTPM(c *C) {
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&(AttrValidSRK|AttrValidEK|AttrOwnerClearDisabled|AttrLockoutAuthSet|AttrCustomSRKTemplate), Equals, ProvisionStatusAttributes(0))
+	c.Check(status.RequiresLockout(), Equals, true)
+}
+
+func (s *provisionStatusSuite) TestFullyProvisioned(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		s.TPM().LockoutHandleContext().SetAuthValue([]byte("1234"))
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status, Equals, AttrValidSRK|AttrValidEK|AttrDAParamsOK|AttrOwnerClearDisabled|AttrLockoutAuthSet)
+	c.Check(status.RequiresLockout(), Equals, false)
+}
+
+func (s *provisionStatusSuite) TestProvisionedWithoutLockout(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&(AttrValidSRK|AttrValidEK|AttrOwnerClearDisabled|AttrLockoutAuthSet), Equals, AttrValidSRK|AttrValidEK)
+	c.Check(status.RequiresLockout(), Equals, true)
+}
+
+func (s *provisionStatusSuite) TestInvalidSRK(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	// Replace the SRK with a key created with a different template.
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+
+	template := *tcg.SRKTemplate
+	template.Attrs &^= tpm2.AttrNoDA
+	key := s.CreatePrimary(c, tpm2.HandleOwner, &template)
+	s.EvictControl(c, tpm2.HandleOwner, key, tcg.SRKHandle)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&(AttrValidSRK|AttrValidEK), Equals, AttrValidEK)
+}
+
+func (s *provisionStatusSuite) TestCustomSRKTemplate(c *C) {
+	template := tcg.MakeECCSRKTemplate(tpm2.ECCCurveNIST_P256)
+	c.Check(s.TPM().EnsureProvisionedWithCustomSRK(ProvisionModeWithoutLockout, nil, template), Equals, ErrTPMProvisioningRequiresLockout)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&(AttrValidSRK|AttrValidEK|AttrCustomSRKTemplate), Equals, AttrValidSRK|AttrValidEK|AttrCustomSRKTemplate)
+}
@@ -391,6 +391,18 @@ func (s *provisioningSuite) testProvisionWithCustomSRKTemplate(c *C, mode Provis
 				Exponent: 0}}}
 	c.Check(s.TPM().EnsureProvisionedWithCustomSRK(mode, nil, &template), IsNil)
 
+	// The template should have been written with command parameter encryption.
+	var nvWrites int
+	for _, cmd := range s.CommandLog() {
+		if cmd.CmdCode != tpm2.CommandNVWrite {
+			continue
+		}
+		nvWrites += 1
+		c.Assert(cmd.CmdAuthArea, HasLen, 1)
+		c.Check(cmd.CmdAuthArea[0].SessionAttributes&tpm2.AttrCommandEncrypt, Equals, tpm2.AttrCommandEncrypt)
+	}
+	c.Check(nvWrites, Equals, 1)
+
 	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleOwner, tcg.SRKHandle, &template)
 
 	nv, err := s.TPM().CreateResourceContextFromTPM(0x01810001)
@@ -543,3 +555,238 @@ func (s *provisioningSuite) TestProvisionWithCustomSRKTemplateOverwritesExisting
 	c.Check(err, IsNil)
 	c.Check(tmplBytes, DeepEquals, mu.MustMarshalToBytes(&template2))
 }
+
+func (s *provisioningSuite) testProvisionWithParamsPreferECC(c *C, mode ProvisionMode, curve tpm2.ECCCurve, expectedCurve tpm2.ECCCurve) {
+	c.Check(s.TPM().EnsureProvisionedWithParams(mode, nil, &ProvisionParams{PreferECC: true, ECCCurve: curve}), IsNil)
+
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleEndorsement, tcg.EKHandle, tcg.ECCEKTemplate)
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleOwner, tcg.SRKHandle, tcg.MakeECCSRKTemplate(expectedCurve))
+
+	for _, data := range []struct {
+		handle   tpm2.Handle
+		template *tpm2.Public
+	}{
+		{handle: 0x01810001, template: tcg.MakeECCSRKTemplate(expectedCurve)},
+		{handle: 0x01810002, template: tcg.ECCEKTemplate},
+	} {
+		nv, err := s.TPM().CreateResourceContextFromTPM(data.handle)
+		c.Assert(err, IsNil)
+
+		nvPub, _, err := s.TPM().NVReadPublic(nv)
+		c.Assert(err, IsNil)
+		c.Check(nvPub.Attrs, Equals, tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite|tpm2.AttrNVWriteDefine|tpm2.AttrNVOwnerRead|tpm2.AttrNVNoDA|tpm2.AttrNVWriteLocked|tpm2.AttrNVWritten))
+
+		tmplBytes, err := s.TPM().NVRead(s.TPM().OwnerHandleContext(), nv, nvPub.Size, 0, nil)
+		c.Check(err, IsNil)
+		c.Check(tmplBytes, DeepEquals, mu.MustMarshalToBytes(data.template))
+	}
+
+	// The connection should be using a session salted with the new EK.
+	c.Check(s.TPM().HmacSession(), NotNil)
+	c.Check(s.TPM().HmacSession().Params().Symmetric.Algorithm, Equals, tpm2.SymAlgorithmAES)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsPreferECCClear(c *C) {
+	s.testProvisionWithParamsPreferECC(c, ProvisionModeClear, 0, tpm2.ECCCurveNIST_P256)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsPreferECCFull(c *C) {
+	s.testProvisionWithParamsPreferECC(c, ProvisionModeFull, 0, tpm2.ECCCurveNIST_P256)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsPreferECCP384(c *C) {
+	if !s.TPM().IsECCCurveSupported(tpm2.ECCCurveNIST_P384) {
+		c.Skip("NIST P-384 is not supported by the TPM")
+	}
+	s.testProvisionWithParamsPreferECC(c, ProvisionModeFull, tpm2.ECCCurveNIST_P384, tpm2.ECCCurveNIST_P384)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsPreferECCUnsupportedCurve(c *C) {
+	err := s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, nil, &ProvisionParams{PreferECC: true, ECCCurve: tpm2.ECCCurveBN_P256})
+	c.Check(err, ErrorMatches, `unsupported ECC curve .*`)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsPreferECCCustomSRK(c *C) {
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+			tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 256},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:  2048,
+				Exponent: 0}}}
+	c.Check(s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, nil, &ProvisionParams{SRKTemplate: &template, PreferECC: true}), IsNil)
+
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleEndorsement, tcg.EKHandle, tcg.ECCEKTemplate)
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleOwner, tcg.SRKHandle, &template)
+}
+
+func (s *provisioningSuite) testProvisionDefaultPreservesECCTemplates(c *C, mode ProvisionMode) {
+	lockoutAuth := []byte("1234")
+	c.Check(s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, lockoutAuth, &ProvisionParams{PreferECC: true}), IsNil)
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// EnsureProvisioned uses command parameter encryption. We have to do
+		// this manually else the test fixture fails the test.
+		s.HierarchyChangeAuth(c, tpm2.HandleLockout, nil)
+	})
+
+	for _, handle := range []tpm2.Handle{tcg.EKHandle, tcg.SRKHandle} {
+		key, err := s.TPM().CreateResourceContextFromTPM(handle)
+		c.Assert(err, IsNil)
+		s.EvictControl(c, tpm2.HandleOwner, key, key.Handle())
+	}
+
+	c.Check(s.TPM().EnsureProvisioned(mode, lockoutAuth), IsNil)
+
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleEndorsement, tcg.EKHandle, tcg.ECCEKTemplate)
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleOwner, tcg.SRKHandle, tcg.MakeECCSRKTemplate(tpm2.ECCCurveNIST_P256))
+}
+
+func (s *provisioningSuite) TestProvisionDefaultPreservesECCTemplatesFull(c *C) {
+	s.testProvisionDefaultPreservesECCTemplates(c, ProvisionModeFull)
+}
+
+func (s *provisioningSuite) TestProvisionDefaultPreservesECCTemplatesWithoutLockout(c *C) {
+	s.testProvisionDefaultPreservesECCTemplates(c, ProvisionModeWithoutLockout)
+}
+
+func (s *provisioningSuite) TestProvisionDefaultClearRemovesECCTemplates(c *C) {
+	c.Check(s.TPM().EnsureProvisionedWithParams(ProvisionModeWithoutLockout, nil, &ProvisionParams{PreferECC: true}),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleEndorsement, tcg.EKHandle, tcg.ECCEKTemplate)
+
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeClear, nil), IsNil)
+	s.validateEK(c)
+	s.validateSRK(c)
+
+	_, err := s.TPM().CreateResourceContextFromTPM(0x01810002)
+	c.Check(tpm2.IsResourceUnavailableError(err, 0x01810002), testutil.IsTrue)
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsWithoutECCRemovesECCTemplates(c *C) {
+	c.Check(s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, nil, &ProvisionParams{PreferECC: true}), IsNil)
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleEndorsement, tcg.EKHandle, tcg.ECCEKTemplate)
+
+	c.Check(s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, nil, &ProvisionParams{}), IsNil)
+	s.validateEK(c)
+	s.validateSRK(c)
+
+	for _, handle := range []tpm2.Handle{0x01810001, 0x01810002} {
+		_, err := s.TPM().CreateResourceContextFromTPM(handle)
+		c.Check(tpm2.IsResourceUnavailableError(err, handle), testutil.IsTrue)
+	}
+}
+
+func (s *provisioningSuite) TestProvisionWithParamsInvalidCustomSRKTemplate(c *C) {
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrSign,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+				Scheme:    tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:   2048,
+				Exponent:  0}}}
+	err := s.TPM().EnsureProvisionedWithParams(ProvisionModeFull, nil, &ProvisionParams{SRKTemplate: &template})
+	c.Check(err, ErrorMatches, "supplied SRK template is not valid for a parent key")
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithFallbackFull(c *C) {
+	lockoutAuth := []byte("1234")
+
+	result, err := s.TPM().EnsureProvisionedWithFallback(lockoutAuth, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// EnsureProvisioned uses command parameter encryption. We have to do
+		// this manually else the test fixture fails the test.
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	c.Check(result.Mode, Equals, ProvisionModeFull)
+	c.Check(result.Downgraded(), testutil.IsFalse)
+	c.Check(result.DowngradeReason, IsNil)
+	c.Check(result.Status.RequiresLockout(), testutil.IsFalse)
+
+	s.validateEK(c)
+	s.validateSRK(c)
+}
+
+func (s *provisioningSuite) testProvisionWithFallbackDowngraded(c *C) *ProvisionResult {
+	defer func() {
+		// These tests trip the lockout for the lockout auth, which
+		// can't be undone by the test fixture. Clear the TPM else the
+		// test fixture fails the test.
+		s.ClearTPMUsingPlatformHierarchy(c)
+	}()
+
+	result, err := s.TPM().EnsureProvisionedWithFallback(nil, nil)
+	c.Assert(err, IsNil)
+
+	c.Check(result.Mode, Equals, ProvisionModeWithoutLockout)
+	c.Check(result.Downgraded(), testutil.IsTrue)
+	c.Check(result.Status.RequiresLockout(), testutil.IsTrue)
+	c.Check(result.Status&(AttrValidSRK|AttrValidEK), Equals, AttrValidSRK|AttrValidEK)
+
+	s.validateEK(c)
+	s.validateSRK(c)
+
+	return result
+}
+
+func (s *provisioningSuite) TestProvisionWithFallbackLockoutAuthFail(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("1234"))
+	s.TPM().LockoutHandleContext().SetAuthValue(nil)
+
+	result := s.testProvisionWithFallbackDowngraded(c)
+	c.Assert(result.DowngradeReason, testutil.ConvertibleTo, AuthFailError{})
+	c.Check(result.DowngradeReason.(AuthFailError).Handle, Equals, tpm2.HandleLockout)
+}
+
+func (s *provisioningSuite) TestProvisionWithFallbackInLockout(c *C) {
+	authValue := []byte("1234")
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, authValue)
+
+	// Trip the DA lockout
+	s.TPM().LockoutHandleContext().SetAuthValue(nil)
+	c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), testutil.ErrorIs,
+		&tpm2.TPMSessionError{TPMError: &tpm2.TPMError{Command: tpm2.CommandHierarchyChangeAuth, Code: tpm2.ErrorAuthFail}, Index: 1})
+	s.TPM().LockoutHandleContext().SetAuthValue(authValue)
+
+	result := s.testProvisionWithFallbackDowngraded(c)
+	c.Check(result.DowngradeReason, Equals, ErrTPMLockout)
+}
+
+func (s *provisioningSuite) TestProvisionWithFallbackOwnerAuthFail(c *C) {
+	// Test that errors unrelated to the lockout hierarchy are not
+	// treated as a downgrade.
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	_, err := s.TPM().EnsureProvisionedWithFallback(nil, nil)
+	c.Assert(err, testutil.ConvertibleTo, AuthFailError{})
+	c.Check(err.(AuthFailError).Handle, Equals, tpm2.HandleOwner)
+}
+
+func (s *provisioningSuite) TestProvisionWithFallbackInvalidCustomSRKTemplate(c *C) {
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrSign,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+				Scheme:    tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:   2048,
+				Exponent:  0}}}
+	_, err := s.TPM().EnsureProvisionedWithFallback(nil, &ProvisionParams{SRKTemplate: &template})
+	c.Check(err, ErrorMatches, "supplied SRK template is not valid for a parent key")
+}
@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// ExportedPublicKey contains the public area of a TPM key in forms that can be
+// consumed by other systems without a TPM2 library.
+type ExportedPublicKey struct {
+	Handle tpm2.Handle // The persistent handle of the key
+	Name   tpm2.Name   // The name of the key
+
+	// TPM2B is the public area of the key marshalled as a TPM2B_PUBLIC
+	// structure, as defined in the TPM2 specification.
+	TPM2B []byte
+
+	// PKIX is the public key encoded in the DER form of a PKIX
+	// SubjectPublicKeyInfo structure.
+	PKIX []byte
+}
+
+// PEM returns the public key encoded as a PEM "PUBLIC KEY" block.
+func (k *ExportedPublicKey) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: k.PKIX})
+}
+
+// PublicKeys contains the public areas of the keys used by secboot.
+type PublicKeys struct {
+	EK  *ExportedPublicKey // The endorsement key
+	SRK *ExportedPublicKey // The storage root key
+}
+
+func newExportedPublicKey(handle tpm2.Handle, pub *tpm2.Public) (*ExportedPublicKey, error) {
+	name, err := pub.ComputeName()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name: %w", err)
+	}
+	tpm2b, err := mu.MarshalToBytes(mu.Sized(pub))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal public area: %w", err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(pub.Public())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode public key: %w", err)
+	}
+
+	return &ExportedPublicKey{
+		Handle: handle,
+		Name:   name,
+		TPM2B:  tpm2b,
+		PKIX:   pkix}, nil
+}
+
+func (t *Connection) exportPublicKey(handle tpm2.Handle) (*ExportedPublicKey, error) {
+	rc, err := t.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context: %w", err)
+	}
+
+	pub, _, _, err := t.ReadPublic(rc)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area: %w", err)
+	}
+	if !pub.IsAsymmetric() {
+		return nil, ErrTPMProvisioning
+	}
+
+	return newExportedPublicKey(handle, pub)
+}
+
+// ExportPublicKeys returns the public areas of the endorsement key and storage
+// root key, which are read from the standard persistent handles. These can be
+// supplied to attestation servers and escrow systems. Each key is provided in
+// both its TPM2B_PUBLIC form and PKIX form.
+//
+// If either key is not present, or is not an asymmetric key, a
+// ErrTPMProvisioning error will be returned.
+func (t *Connection) ExportPublicKeys() (*PublicKeys, error) {
+	ek, err := t.exportPublicKey(tcg.EKHandle)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot export EK: %w", err)
+	}
+	srk, err := t.exportPublicKey(tcg.SRKHandle)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot export SRK: %w", err)
+	}
+
+	return &PublicKeys{EK: ek, SRK: srk}, nil
+}
@@ -0,0 +1,128 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/objectutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type pubKeysSuiteNoTPM struct{}
+
+type pubKeysSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *pubKeysSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&pubKeysSuiteNoTPM{})
+var _ = Suite(&pubKeysSuite{})
+
+func (s *pubKeysSuiteNoTPM) TestNewExportedPublicKey(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	pub, err := objectutil.NewECCPublicKey(&key.PublicKey)
+	c.Assert(err, IsNil)
+
+	exported, err := NewExportedPublicKey(0x81000001, pub)
+	c.Assert(err, IsNil)
+	c.Check(exported.Handle, Equals, tpm2.Handle(0x81000001))
+
+	expectedName, err := pub.ComputeName()
+	c.Check(err, IsNil)
+	c.Check(exported.Name, DeepEquals, expectedName)
+
+	var pub2 *tpm2.Public
+	_, err = mu.UnmarshalFromBytes(exported.TPM2B, mu.Sized(&pub2))
+	c.Check(err, IsNil)
+	name2, err := pub2.ComputeName()
+	c.Check(err, IsNil)
+	c.Check(name2, DeepEquals, expectedName)
+
+	pkixKey, err := x509.ParsePKIXPublicKey(exported.PKIX)
+	c.Check(err, IsNil)
+	c.Check(key.PublicKey.Equal(pkixKey), testutil.IsTrue)
+
+	block, rest := pem.Decode(exported.PEM())
+	c.Assert(block, NotNil)
+	c.Check(rest, HasLen, 0)
+	c.Check(block.Type, Equals, "PUBLIC KEY")
+	c.Check(block.Bytes, DeepEquals, exported.PKIX)
+}
+
+func (s *pubKeysSuite) checkExportedPublicKey(c *C, exported *ExportedPublicKey, handle tpm2.Handle) {
+	rc, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	pub, name, _, err := s.TPM().ReadPublic(rc)
+	c.Assert(err, IsNil)
+
+	c.Check(exported.Handle, Equals, handle)
+	c.Check(exported.Name, DeepEquals, name)
+
+	expectedTPM2B, err := mu.MarshalToBytes(mu.Sized(pub))
+	c.Check(err, IsNil)
+	c.Check(exported.TPM2B, DeepEquals, expectedTPM2B)
+
+	expectedPKIX, err := x509.MarshalPKIXPublicKey(pub.Public())
+	c.Check(err, IsNil)
+	c.Check(exported.PKIX, DeepEquals, expectedPKIX)
+}
+
+func (s *pubKeysSuite) TestExportPublicKeys(c *C) {
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+
+	keys, err := s.TPM().ExportPublicKeys()
+	c.Assert(err, IsNil)
+	s.checkExportedPublicKey(c, keys.EK, tcg.EKHandle)
+	s.checkExportedPublicKey(c, keys.SRK, tcg.SRKHandle)
+}
+
+func (s *pubKeysSuite) TestExportPublicKeysNoSRK(c *C) {
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+
+	_, err = s.TPM().ExportPublicKeys()
+	c.Check(err, ErrorMatches, `cannot export SRK: the TPM is not correctly provisioned`)
+	c.Check(err, testutil.ErrorIs, ErrTPMProvisioning)
+}
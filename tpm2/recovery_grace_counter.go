@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// recoveryKeyGraceCounterHandle is the handle stored in the LUKS2 header for a
+// recovery key grace counter. The name binds it to the NV index that was
+// created by CreateRecoveryKeyGraceCounter.
+type recoveryKeyGraceCounterHandle struct {
+	Handle tpm2.Handle
+	Name   tpm2.Name
+}
+
+func newRecoveryKeyGraceCounterPublic(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeBits.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+}
+
+// CreateRecoveryKeyGraceCounter creates a NV index at the specified handle for
+// recording the number of times that a recovery keyslot with a grace limit has
+// been used, and returns a reference to it that can be supplied to
+// secboot.SetLUKS2ContainerRecoveryKeyGrace. The handle should be in the range
+// reserved for owner indices.
+//
+// Each use sets another bit in the index. As bits can only be cleared by
+// undefining the index, which requires the authorization value for the storage
+// hierarchy, the use count can't be rolled back by modifying or restoring the
+// LUKS2 header. An index supports at most 64 uses, after which recording a use
+// fails and the recovery keyslot can no longer be used.
+//
+// The authorization value for the storage hierarchy must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function.
+// If there is already a NV index at the specified handle, a TPMResourceExistsError
+// error is returned.
+func (t *Connection) CreateRecoveryKeyGraceCounter(handle tpm2.Handle) (counter *secboot.RecoveryKeyGraceCounter, err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid handle type")
+	}
+
+	index, err := t.NVDefineSpace(t.OwnerHandleContext(), nil, newRecoveryKeyGraceCounterPublic(handle), t.HmacSession())
+	if err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, TPMResourceExistsError{handle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		t.NVUndefineSpace(t.OwnerHandleContext(), index, t.HmacSession())
+	}()
+
+	// Initialize the index so that it can be read.
+	if err := t.NVSetBits(index, index, 0, nil); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	data, err := mu.MarshalToBytes(&recoveryKeyGraceCounterHandle{Handle: handle, Name: index.Name()})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode handle: %w", err)
+	}
+
+	return &secboot.RecoveryKeyGraceCounter{
+		PlatformName: platformName,
+		Handle:       data}, nil
+}
+
+type recoveryKeyGraceCounterHandler struct{}
+
+func (*recoveryKeyGraceCounterHandler) withIndex(data []byte, fn func(tpm *Connection, index tpm2.ResourceContext) error) error {
+	var handle recoveryKeyGraceCounterHandle
+	if _, err := mu.UnmarshalFromBytes(data, &handle); err != nil {
+		return xerrors.Errorf("cannot decode handle: %w", err)
+	}
+
+	tpm, err := ConnectToTPM()
+	if err != nil {
+		return xerrors.Errorf("cannot connect to TPM: %w", err)
+	}
+	defer tpm.Close()
+
+	index, err := tpm.CreateResourceContextFromTPM(handle.Handle)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+	if !bytes.Equal(index.Name(), handle.Name) {
+		return errors.New("NV index has the wrong name")
+	}
+	return fn(tpm, index)
+}
+
+func (h *recoveryKeyGraceCounterHandler) Uses(data []byte) (uses int, err error) {
+	err = h.withIndex(data, func(tpm *Connection, index tpm2.ResourceContext) error {
+		value, err := tpm.NVReadBits(index, index, nil)
+		if err != nil {
+			return xerrors.Errorf("cannot read NV index: %w", err)
+		}
+		uses = bits.OnesCount64(value)
+		return nil
+	})
+	return uses, err
+}
+
+func (h *recoveryKeyGraceCounterHandler) Increment(data []byte) error {
+	return h.withIndex(data, func(tpm *Connection, index tpm2.ResourceContext) error {
+		value, err := tpm.NVReadBits(index, index, nil)
+		if err != nil {
+			return xerrors.Errorf("cannot read NV index: %w", err)
+		}
+		if value == ^uint64(0) {
+			return errors.New("no uses remaining in NV index")
+		}
+		// Set the lowest clear bit.
+		if err := tpm.NVSetBits(index, index, ^value&(value+1), nil); err != nil {
+			return xerrors.Errorf("cannot update NV index: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type recoveryGraceCounterSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *recoveryGraceCounterSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&recoveryGraceCounterSuite{})
+
+func (s *recoveryGraceCounterSuite) TestCreateAndIncrement(c *C) {
+	counter, err := s.TPM().CreateRecoveryKeyGraceCounter(0x01810100)
+	c.Assert(err, IsNil)
+	c.Check(counter.PlatformName, Equals, "tpm2")
+
+	handler := NewRecoveryKeyGraceCounterHandler()
+
+	uses, err := handler.Uses(counter.Handle)
+	c.Check(err, IsNil)
+	c.Check(uses, Equals, 0)
+
+	c.Check(handler.Increment(counter.Handle), IsNil)
+	c.Check(handler.Increment(counter.Handle), IsNil)
+
+	uses, err = handler.Uses(counter.Handle)
+	c.Check(err, IsNil)
+	c.Check(uses, Equals, 2)
+}
+
+func (s *recoveryGraceCounterSuite) TestCreateExists(c *C) {
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   0x01810100,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+
+	_, err := s.TPM().CreateRecoveryKeyGraceCounter(0x01810100)
+	c.Check(err, ErrorMatches, `a resource already exists on the TPM at handle 0x01810100`)
+	c.Check(err, FitsTypeOf, TPMResourceExistsError{})
+}
+
+func (s *recoveryGraceCounterSuite) TestUsesWrongIndex(c *C) {
+	counter, err := s.TPM().CreateRecoveryKeyGraceCounter(0x01810100)
+	c.Assert(err, IsNil)
+
+	// Replace the index with one that has different attributes.
+	index, err := s.TPM().CreateResourceContextFromTPM(0x01810100)
+	c.Assert(err, IsNil)
+	c.Assert(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   0x01810100,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeBits.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+
+	_, err = NewRecoveryKeyGraceCounterHandler().Uses(counter.Handle)
+	c.Check(err, ErrorMatches, `NV index has the wrong name`)
+}
+
+func (s *recoveryGraceCounterSuite) TestCreateInvalidHandle(c *C) {
+	_, err := s.TPM().CreateRecoveryKeyGraceCounter(0x81000001)
+	c.Check(err, ErrorMatches, `invalid handle type`)
+}
@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// PCRProfileGenerator is used by RefreshSealedKeys to generate a new PCR
+// protection profile for keys with the specified role. It is called once
+// for each distinct role.
+type PCRProfileGenerator func(role string) (*PCRProtectionProfile, error)
+
+// RefreshSealedKeysOptions provides options to RefreshSealedKeys.
+type RefreshSealedKeysOptions struct {
+	// RevokeOldPolicies indicates that the PCR policies that the keys
+	// had before they were refreshed should be revoked by incrementing
+	// their PCR policy counters. This should be requested once the
+	// previous PCR policies are no longer required, eg, when the
+	// refreshed boot components have been confirmed to work. Counters
+	// are not incremented unless this is set.
+	RevokeOldPolicies bool
+}
+
+// RefreshSealedKeys updates the PCR protection policy of the TPM protected keys in
+// the key data files at the specified paths, after a boot component has been
+// updated. This packages the steps that are otherwise required to do this, which
+// are:
+//   - Read each key data file.
+//   - Generate a new PCR protection profile for each distinct role using the
+//     supplied generator.
+//   - Update the PCR policy of each key to its new profile.
+//   - Write each key data file atomically.
+//   - If requested via options, revoke the previous PCR policies.
+//
+// The supplied primary key is used to authorize the new PCR policies, and all of the
+// keys must have been created with it. Key data files created with the legacy APIs
+// (see SealedKeyObject) are not supported.
+//
+// The key data files are only written once all of the PCR policies have been
+// updated, and old PCR policies are only revoked once all of the key data files have
+// been written, so that no key is left with a revoked PCR policy if this fails.
+//
+// If validation of any key fails, an InvalidKeyDataError error will be returned.
+func RefreshSealedKeys(tpm *Connection, authKey secboot.PrimaryKey, generator PCRProfileGenerator, options *RefreshSealedKeysOptions, paths ...string) error {
+	if len(paths) == 0 {
+		return errors.New("no key data files supplied")
+	}
+	if options == nil {
+		options = new(RefreshSealedKeysOptions)
+	}
+
+	versionOption := NoNewPCRPolicyVersion
+	if options.RevokeOldPolicies {
+		versionOption = NewPCRPolicyVersion
+	}
+
+	keys := make([]*secboot.KeyData, 0, len(paths))
+	skds := make([]*SealedKeyData, 0, len(paths))
+	for _, path := range paths {
+		r, err := secboot.NewFileKeyDataReader(path)
+		if err != nil {
+			return xerrors.Errorf("cannot open key data file %s: %w", path, err)
+		}
+		k, err := secboot.ReadKeyData(r)
+		if err != nil {
+			return xerrors.Errorf("cannot read key data from %s: %w", path, err)
+		}
+		skd, err := NewSealedKeyData(k)
+		if err != nil {
+			return xerrors.Errorf("cannot obtain SealedKeyData for %s: %w", path, err)
+		}
+		keys = append(keys, k)
+		skds = append(skds, skd)
+	}
+
+	profiles := make(map[string]*PCRProtectionProfile)
+	for i, skd := range skds {
+		role := keys[i].Role()
+		profile, exists := profiles[role]
+		if !exists {
+			var err error
+			profile, err = generator(role)
+			if err != nil {
+				return xerrors.Errorf("cannot generate PCR profile for role %q: %w", role, err)
+			}
+			profiles[role] = profile
+		}
+
+		if err := skd.UpdatePCRProtectionPolicy(tpm, authKey, profile, versionOption); err != nil {
+			return xerrors.Errorf("cannot update key data from %s: %w", paths[i], err)
+		}
+	}
+
+	for i, k := range keys {
+		if err := k.WriteAtomic(secboot.NewFileKeyDataWriter(paths[i])); err != nil {
+			return xerrors.Errorf("cannot write key data to %s: %w", paths[i], err)
+		}
+	}
+
+	if !options.RevokeOldPolicies {
+		return nil
+	}
+
+	for i, skd := range skds {
+		// Related keys share a PCR policy counter, in which case this only
+		// increments it for the first one.
+		if err := skd.RevokeOldPCRProtectionPolicies(tpm, authKey); err != nil {
+			return xerrors.Errorf("cannot revoke old PCR policies for key data from %s: %w", paths[i], err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/rsa"
+	"errors"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func writeKeyDataFile(c *C, k *secboot.KeyData, path string) {
+	c.Assert(k.WriteAtomic(secboot.NewFileKeyDataWriter(path)), IsNil)
+}
+
+func readKeyDataFile(c *C, path string) *secboot.KeyData {
+	r, err := secboot.NewFileKeyDataReader(path)
+	c.Assert(err, IsNil)
+	k, err := secboot.ReadKeyData(r)
+	c.Assert(err, IsNil)
+	return k
+}
+
+type refreshSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *refreshSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *refreshSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&refreshSuite{})
+
+func (s *refreshSuite) newKeyDataFiles(c *C, roles ...string) (secboot.PrimaryKey, []string) {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	dir := c.MkDir()
+	var paths []string
+	for i, role := range roles {
+		// Protect the keys with an initial PCR policy that can't be satisfied
+		k, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+			PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")),
+			PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+			PrimaryKey:             primaryKey,
+			Role:                   role})
+		c.Assert(err, IsNil)
+
+		path := filepath.Join(dir, string(rune('a'+i)))
+		writeKeyDataFile(c, k, path)
+		paths = append(paths, path)
+	}
+	return primaryKey, paths
+}
+
+func (s *refreshSuite) TestRefreshSealedKeys(c *C) {
+	primaryKey, paths := s.newKeyDataFiles(c, "run", "recover", "run")
+
+	var roles []string
+	generator := func(role string) (*PCRProtectionProfile, error) {
+		roles = append(roles, role)
+		return tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), nil
+	}
+
+	c.Check(RefreshSealedKeys(s.TPM(), primaryKey, generator, nil, paths...), IsNil)
+	c.Check(roles, DeepEquals, []string{"run", "recover"})
+
+	for _, path := range paths {
+		_, _, err := readKeyDataFile(c, path).RecoverKeys()
+		c.Check(err, IsNil)
+	}
+}
+
+func (s *refreshSuite) TestRefreshSealedKeysRevokeOldPolicies(c *C) {
+	primaryKey, paths := s.newKeyDataFiles(c, "run")
+
+	// Keep a copy of the initial key data, with a PCR policy that
+	// can be satisfied.
+	old := readKeyDataFile(c, paths[0])
+	skd, err := NewSealedKeyData(old)
+	c.Assert(err, IsNil)
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), primaryKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), NoNewPCRPolicyVersion), IsNil)
+	_, _, err = old.RecoverKeys()
+	c.Check(err, IsNil)
+
+	generator := func(role string) (*PCRProtectionProfile, error) {
+		return tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), nil
+	}
+	c.Check(RefreshSealedKeys(s.TPM(), primaryKey, generator, &RefreshSealedKeysOptions{RevokeOldPolicies: true}, paths...), IsNil)
+
+	_, _, err = readKeyDataFile(c, paths[0]).RecoverKeys()
+	c.Check(err, IsNil)
+	_, _, err = old.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy has been revoked")
+}
+
+func (s *refreshSuite) TestRefreshSealedKeysWrongPrimaryKey(c *C) {
+	_, paths := s.newKeyDataFiles(c, "run")
+
+	generator := func(role string) (*PCRProtectionProfile, error) {
+		return tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}), nil
+	}
+	err := RefreshSealedKeys(s.TPM(), make(secboot.PrimaryKey, 32), generator, nil, paths...)
+	c.Check(err, ErrorMatches, `cannot update key data from .*: cannot update PCR protection policy: invalid key data: .*`)
+
+	var e InvalidKeyDataError
+	c.Check(errors.As(err, &e), testutil.IsTrue)
+}
+
+type refreshSuiteNoTPM struct{}
+
+var _ = Suite(&refreshSuiteNoTPM{})
+
+func (s *refreshSuiteNoTPM) TestRefreshSealedKeysNoPaths(c *C) {
+	c.Check(RefreshSealedKeys(nil, nil, nil, nil), ErrorMatches, `no key data files supplied`)
+}
+
+func (s *refreshSuiteNoTPM) TestRefreshSealedKeysMissingFile(c *C) {
+	path := filepath.Join(c.MkDir(), "foo")
+	c.Check(RefreshSealedKeys(nil, nil, nil, nil, path), ErrorMatches, `cannot open key data file .*/foo: cannot open file: open .*/foo: no such file or directory`)
+}
+
+func (s *refreshSuiteNoTPM) TestRefreshSealedKeysGeneratorError(c *C) {
+	srk, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(tpm2_testutil.NewExternalRSAStoragePublicKey(&srk.PublicKey), &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		Role:                   "foo"})
+	c.Assert(err, IsNil)
+
+	path := filepath.Join(c.MkDir(), "key")
+	writeKeyDataFile(c, k, path)
+
+	generator := func(role string) (*PCRProtectionProfile, error) {
+		c.Check(role, Equals, "foo")
+		return nil, errors.New("some error")
+	}
+	c.Check(RefreshSealedKeys(nil, primaryKey, generator, nil, path), ErrorMatches, `cannot generate PCR profile for role "foo": some error`)
+}
@@ -0,0 +1,61 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"golang.org/x/xerrors"
+)
+
+// resetCountOffset is the offset of the resetCount field in the TPMS_TIME_INFO
+// structure, which is used as the offset for TPM2_PolicyCounterTimer.
+const resetCountOffset = 16
+
+// resetCountCheck corresponds to a PolicyCounterTimer assertion in a PCR policy
+// that the TPM's reset count is not higher than the specified maximum. The reset
+// count is incremented by the TPM on every TPM reset (ie, every boot), so this
+// limits the number of boots for which a PCR policy can be used.
+type resetCountCheck struct {
+	Maximum uint32
+}
+
+func (d *pcrPolicyData_v0) addResetCountCheck(trial *util.TrialAuthPolicy, check *resetCountCheck) {
+	operandB := make([]byte, 4)
+	binary.BigEndian.PutUint32(operandB, check.Maximum)
+	trial.PolicyCounterTimer(operandB, resetCountOffset, tpm2.OpUnsignedLE)
+	d.ResetCount = check
+}
+
+func (d *pcrPolicyData_v0) executeResetCountCheck(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
+	operandB := make([]byte, 4)
+	binary.BigEndian.PutUint32(operandB, d.ResetCount.Maximum)
+	if err := tpm.PolicyCounterTimer(policySession, operandB, resetCountOffset, tpm2.OpUnsignedLE); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyCounterTimer) {
+			// The TPM has been reset too many times.
+			return policyDataError{fmt.Errorf("the TPM reset count is higher than the permitted maximum of %d", d.ResetCount.Maximum)}
+		}
+		return xerrors.Errorf("cannot complete reset count check: %w", err)
+	}
+	return nil
+}
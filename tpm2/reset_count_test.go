@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type resetCountSuiteNoTPM struct{}
+
+type resetCountSuite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+}
+
+func (s *resetCountSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&resetCountSuiteNoTPM{})
+var _ = Suite(&resetCountSuite{})
+
+func (s *resetCountSuiteNoTPM) TestRequireMaximumResetCount(c *C) {
+	maximum, ok := NewPCRProtectionProfile().RequireMaximumResetCount(5).MaximumResetCount()
+	c.Check(ok, testutil.IsTrue)
+	c.Check(maximum, Equals, uint32(5))
+
+	_, ok = NewPCRProtectionProfile().MaximumResetCount()
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resetCountSuiteNoTPM) TestAddProfileORMergesResetCount(c *C) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().RequireMaximumResetCount(7),
+		NewPCRProtectionProfile(),
+		NewPCRProtectionProfile().RequireMaximumResetCount(4))
+	maximum, ok := profile.MaximumResetCount()
+	c.Check(ok, testutil.IsTrue)
+	c.Check(maximum, Equals, uint32(4))
+}
+
+func (s *resetCountSuiteNoTPM) newKeyData(c *C) KeyData {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	authKey, err := NewPolicyAuthPublicKey(tpm2.HashAlgorithmSHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	policy, policyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKey, "", nil, false, false, nil)
+	c.Assert(err, IsNil)
+
+	params := NewPcrPolicyParams(primaryKey,
+		tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		tpm2.DigestList{make(tpm2.Digest, 32)}, nil, 0).WithResetCount(5)
+	c.Assert(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	pub := &tpm2.Public{
+		Type:       tpm2.ObjectTypeKeyedHash,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		AuthPolicy: policyDigest,
+		Params:     &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	data, err := NewKeyData(tpm2.Private{1, 2, 3, 4}, pub, nil, policy)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *resetCountSuiteNoTPM) TestKeyDataWithResetCountIsV4(c *C) {
+	data := s.newKeyData(c)
+	c.Check(data.Version(), Equals, uint32(4))
+
+	buf := new(bytes.Buffer)
+	c.Check(data.Write(buf), IsNil)
+
+	expected := buf.Bytes()
+
+	read, err := ReadKeyDataV4(bytes.NewReader(expected))
+	c.Assert(err, IsNil)
+	c.Check(read.Version(), Equals, uint32(4))
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.ResetCount, DeepEquals, &ResetCountCheck{Maximum: 5})
+	c.Check(read.Policy().(*KeyDataPolicy_v3).PCRData.NVGeneration, IsNil)
+
+	buf = new(bytes.Buffer)
+	c.Check(read.Write(buf), IsNil)
+	c.Check(buf.Bytes(), DeepEquals, expected)
+}
+
+func (s *resetCountSuiteNoTPM) TestPolicyDescription(c *C) {
+	desc, err := NewPolicyDescription(s.newKeyData(c))
+	c.Assert(err, IsNil)
+
+	c.Assert(desc.Policy, HasLen, 1)
+	pcrPolicy := desc.Policy[0].AuthorizedPolicy
+	c.Assert(pcrPolicy, NotNil)
+	c.Assert(pcrPolicy.Policy, HasLen, 3)
+	c.Check(pcrPolicy.Policy[2], DeepEquals, PolicyElementDescription{
+		Type:        "POLICYCOUNTERTIMER",
+		Description: "the TPM reset count must not be higher than the maximum",
+		OperandB:    "00000005",
+		Offset:      16,
+		Operation:   "UNSIGNED_LE"})
+}
+
+func (s *resetCountSuite) testExecutePCRPolicy(c *C, maximum uint32) error {
+	primaryKey := make(secboot.PrimaryKey, 32)
+	rand.Read(primaryKey)
+
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, primaryKey)
+
+	policyData, expectedDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, authKeyPublic, "", nil, false, false, nil)
+	c.Assert(err, IsNil)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}}
+	_, values, err := s.TPM().PCRRead(pcrs)
+	c.Assert(err, IsNil)
+	digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+	c.Assert(err, IsNil)
+
+	params := NewPcrPolicyParams(primaryKey, pcrs, tpm2.DigestList{digest}, nil, 0).WithResetCount(maximum)
+	c.Assert(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err := policyData.ExecutePCRPolicy(s.TPM().TPMContext, session, s.TPM().HmacSession()); err != nil {
+		return err
+	}
+
+	digest, err = s.TPM().PolicyGetDigest(session)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expectedDigest)
+	return nil
+}
+
+func (s *resetCountSuite) TestExecutePCRPolicyWithResetCount(c *C) {
+	info, err := s.TPM().ReadClock()
+	c.Assert(err, IsNil)
+
+	c.Check(s.testExecutePCRPolicy(c, info.ClockInfo.ResetCount), IsNil)
+	c.Check(s.testExecutePCRPolicy(c, info.ClockInfo.ResetCount+1), IsNil)
+}
@@ -23,15 +23,21 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"errors"
+	"fmt"
+	"io"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/templates"
+	"github.com/canonical/go-tpm2/util"
 
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/testhooks"
 )
 
 var (
@@ -58,7 +64,144 @@ type ProtectKeyParams struct {
 	// owner objects (0x01800000 - 0x01bfffff).
 	PCRPolicyCounterHandle tpm2.Handle
 
+	// PCRPolicyNVIndexHandle is the handle at which to create a pair of NV
+	// indices for authorizing PCR policies with a TPM2_PolicyAuthorizeNV
+	// assertion, rather than with a signature stored in the key data. The
+	// first index contains the digest of the current PCR policy, and the
+	// second index, at the following handle, contains the metadata required
+	// to execute it. Updating the PCR policy only writes to these indices,
+	// so the key data doesn't need to be rewritten, which is useful where it
+	// is stored in a read-only location. Writing a new PCR policy also
+	// revokes the previous one, so PCRPolicyCounterHandle must be
+	// tpm2.HandleNull when this is used. PCR profiles with a NV generation
+	// requirement are not supported in this mode.
+	//
+	// The handle must either be zero or tpm2.HandleNull (in which case, no
+	// NV indices are created), or it must be a valid NV index handle, and the
+	// same recommendations apply as for PCRPolicyCounterHandle.
+	//
+	// Keys created with this option use version 4 of the key data format,
+	// which is not supported by older versions of this package.
+	PCRPolicyNVIndexHandle tpm2.Handle
+
 	PrimaryKey secboot.PrimaryKey
+
+	// RequireEndorsementAuth binds the sealed key to the TPM's endorsement
+	// hierarchy in addition to the PCR policy, by requiring knowledge of the
+	// endorsement hierarchy's authorization value in order to unseal it. The
+	// key can then not be unsealed if the endorsement hierarchy is disabled
+	// or its authorization value is changed, which provides some additional
+	// protection for deployments that use a relaxed PCR policy. If the
+	// endorsement hierarchy has an authorization value, it must be provided
+	// by calling SetAuthValue on the ResourceContext returned from
+	// Connection.EndorsementHandleContext before unsealing.
+	//
+	// Keys created with this option use version 4 of the key data format,
+	// which is not supported by older versions of this package.
+	RequireEndorsementAuth bool
+
+	// ExternalAuthName is the name of a NV index or object that must
+	// authorize unsealing of the key, in addition to the PCR policy, by
+	// way of a TPM2_PolicySecret assertion. This permits an external
+	// authenticator, such as a fingerprint match engine running in a TEE,
+	// to gate unsealing by authorizing the use of the NV index or object
+	// once the user has been authenticated, as an alternative second
+	// factor to a passphrase. The NV index or object is obtained during
+	// unsealing from the ExternalAuthorizer registered with
+	// SetExternalAuthorizer.
+	//
+	// Keys created with this option use version 4 of the key data format,
+	// which is not supported by older versions of this package.
+	ExternalAuthName tpm2.Name
+
+	// PaddingBucketSize can be set to pad the serialized sealed key data with
+	// zeros so that its size is a multiple of this value. The size of the
+	// unpadded sealed key data reveals information about the complexity of
+	// its PCR profile. The padding is preserved when the key is updated. Zero
+	// means no padding.
+	//
+	// Note that this only pads the platform specific data. It doesn't hide
+	// the auth mode of the key, which is still visible from the passphrase
+	// parameters in the surrounding secboot.KeyData.
+	PaddingBucketSize uint32
+
+	// NullHierarchyDevMode seals the key to an ephemeral primary key in the
+	// TPM's null hierarchy rather than to the storage primary key. This is
+	// only intended for development and CI environments, such as when testing
+	// with a TPM simulator, as it permits the full code path to be exercised
+	// without requiring the authorization value for or making any changes to
+	// the storage hierarchy. The null hierarchy's seed changes on every TPM
+	// reset, so the key cannot be unsealed after the next reboot. This cannot
+	// be used with a PCR policy counter, so PCRPolicyCounterHandle must be
+	// tpm2.HandleNull.
+	NullHierarchyDevMode bool
+
+	// DisableDictionaryAttackProtection creates the sealed key object with
+	// the noDA attribute set, so that failed authorization attempts for it
+	// aren't counted by the TPM's dictionary attack protection logic. This
+	// only affects keys that require an authorization value, such as keys
+	// protected with a passphrase.
+	//
+	// By default, each incorrect passphrase increments the TPM's failure
+	// counter, and the TPM enters lockout mode once this reaches its limit.
+	// Lockout mode blocks all authorizations that are subject to dictionary
+	// attack protection, not just those for this key, until the failure
+	// counter is decremented by the recovery interval or reset with the
+	// lockout hierarchy's authorization value. Setting this prevents a
+	// faulty or unattended input device from locking out the TPM, at the
+	// cost of permitting unlimited passphrase guesses at the speed of the
+	// TPM, so it should only be used with high entropy passphrases and
+	// where a TPM lockout is a greater risk than a brute force attack.
+	//
+	// This can only be changed by creating a new key.
+	DisableDictionaryAttackProtection bool
+
+	// NameAlg is the name algorithm for the sealed object, the PCR policy
+	// counter and the key used for authorizing PCR policy updates. This also
+	// determines the digest algorithm of their authorization policies and the
+	// KDF algorithm for the unlock key. It must be tpm2.HashAlgorithmSHA256 or
+	// tpm2.HashAlgorithmSHA384, and the default is tpm2.HashAlgorithmSHA256 if
+	// it is not set. When creating a key with a TPM connection, the algorithm
+	// must be supported by the TPM.
+	//
+	// This can only be changed by creating a new key.
+	NameAlg tpm2.HashAlgorithmId
+
+	// PCRPolicyAuthPublicKey is the public part of a NIST P-256 key that is
+	// used to authorize PCR policies for the new key, instead of the key
+	// that is derived from the primary key. This permits a central service
+	// that holds the private part to sign PCR policies for a fleet of
+	// devices, without having to export a key from each device. The initial
+	// PCR policy is computed from PCRProfile but is not authorized, so the
+	// new key can't be unsealed until a PCR policy that is signed by the
+	// central service has been applied with
+	// SealedKeyData.UpdatePCRProtectionPolicyWithSignature (see
+	// SealedKeyData.NewUnsignedPCRPolicy). SealedKeyData.UpdatePCRProtectionPolicy
+	// and SealedKeyData.PCRPolicyAuthKey can't be used with these keys.
+	//
+	// Increments of the PCR policy counter and writes to the PCR policy
+	// NV index require a signature from the same key, so
+	// PCRPolicyCounterHandle and PCRPolicyNVIndexHandle must both be
+	// tpm2.HandleNull when this is used.
+	//
+	// This can only be changed by creating a new key.
+	PCRPolicyAuthPublicKey *ecdsa.PublicKey
+
+	// AlternatePCRBanks computes PCR policies for the new key so that they
+	// can be satisfied by each of the PCR banks that the PCR profile contains
+	// values for on its own, as well as by all of them together. This permits
+	// the key to be unsealed after the platform firmware changes the active
+	// PCR bank, eg, from SHA-256 to SHA-384, which happens after some firmware
+	// updates. The PCR profile must contain values for more than one PCR bank,
+	// and these banks must be implemented by the TPM but don't need to be
+	// active. This is recorded in the key data, and applies to the initial
+	// PCR policy and every subsequent PCR policy update.
+	//
+	// Keys created with this option use version 4 of the key data format,
+	// which is not supported by older versions of this package.
+	//
+	// This can only be changed by creating a new key.
+	AlternatePCRBanks bool
 }
 
 type PassphraseProtectKeyParams struct {
@@ -67,6 +210,36 @@ type PassphraseProtectKeyParams struct {
 	KDFOptions secboot.KDFOptions
 }
 
+// validateRoles checks that the supplied roles are valid, so that invalid roles
+// are rejected before any resources are created on the TPM. An empty role is
+// permitted.
+func validateRoles(roles ...string) error {
+	for _, role := range roles {
+		if role == "" {
+			continue
+		}
+		if err := secboot.ValidateRoleName(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newKeySealer returns the keySealer implementation to use for creating a key
+// with the supplied parameters.
+func newKeySealer(tpm *Connection, params *ProtectKeyParams) (keySealer, error) {
+	if !params.NullHierarchyDevMode {
+		return &sealedObjectKeySealer{tpm: tpm, noDA: params.DisableDictionaryAttackProtection}, nil
+	}
+	if params.PCRPolicyCounterHandle != tpm2.HandleNull {
+		return nil, errors.New("cannot use a PCR policy counter with a key sealed to the null hierarchy")
+	}
+	if params.PCRPolicyNVIndexHandle.Type() == tpm2.HandleTypeNVIndex {
+		return nil, errors.New("cannot use a PCR policy NV index with a key sealed to the null hierarchy")
+	}
+	return &nullHierarchyKeySealer{tpm: tpm, noDA: params.DisableDictionaryAttackProtection}, nil
+}
+
 type keyDataConstructor func(skd *SealedKeyData, role string, encryptedPayload []byte, kdfAlg crypto.Hash) (*secboot.KeyData, error)
 
 func makeKeyDataNoAuth(skd *SealedKeyData, role string, encryptedPayload []byte, kdfAlg crypto.Hash) (*secboot.KeyData, error) {
@@ -99,8 +272,35 @@ type makeSealedKeyDataParams struct {
 	PcrProfile             *PCRProtectionProfile
 	Role                   string
 	PcrPolicyCounterHandle tpm2.Handle
+	PcrPolicyNVIndexHandle tpm2.Handle
 	PrimaryKey             secboot.PrimaryKey
 	AuthMode               secboot.AuthMode
+	RequireEndorsementAuth bool
+	ExternalAuthName       tpm2.Name
+	PaddingBucketSize      uint32
+	NameAlg                tpm2.HashAlgorithmId
+	NullHierarchyDevMode   bool
+	PCRPolicyAuthPublicKey *ecdsa.PublicKey
+	AlternatePCRBanks      bool
+}
+
+// selectSealedKeyNameAlg returns the name algorithm to use for a new sealed
+// key, given the one requested by the caller. If a TPM connection is supplied,
+// the algorithm is checked against the algorithms supported by the TPM.
+func selectSealedKeyNameAlg(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.HashAlgorithmId, error) {
+	switch alg {
+	case tpm2.HashAlgorithmId(0):
+		alg = tpm2.HashAlgorithmSHA256
+	case tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384:
+	default:
+		return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported name algorithm %v", alg)
+	}
+
+	if tpm != nil && !tpm.IsAlgorithmSupported(tpm2.AlgorithmId(alg)) {
+		return tpm2.HashAlgorithmNull, fmt.Errorf("name algorithm %v is not supported by the TPM", alg)
+	}
+
+	return alg, nil
 }
 
 // makeSealedKeyData makes a sealed key data using the supplied parameters, keySealer implementation,
@@ -110,19 +310,84 @@ type makeSealedKeyDataParams struct {
 // used for authenticating the storage hierarchy in order to avoid trasmitting the cleartext authorization
 // value.
 func makeSealedKeyData(tpm *tpm2.TPMContext, params *makeSealedKeyDataParams, sealer keySealer, constructor keyDataConstructor, session tpm2.SessionContext) (*secboot.KeyData, secboot.PrimaryKey, secboot.DiskUnlockKey, error) {
+	kds, primaryKey, unlockKeys, err := makeSealedKeysData(tpm, params, []string{params.Role}, sealer, constructor, session)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return kds[0], primaryKey, unlockKeys[0], nil
+}
+
+// makeSealedKeysData makes a related sealed key data object for each of the supplied roles
+// using the supplied parameters, keySealer implementation, and keyDataConstructor
+// implementation. The Role field of params is ignored. The keys share the same primary key,
+// PCR policy counter and authorization policy, and the initial PCR policy is only computed
+// once for each distinct role and shared between the keys with that role. Each key has its
+// own sealed object and unlock key.
+//
+// If supplied, the session must be a HMAC session with the AttrContinueSession attribute set and is
+// used for authenticating the storage hierarchy in order to avoid trasmitting the cleartext authorization
+// value.
+func makeSealedKeysData(tpm *tpm2.TPMContext, params *makeSealedKeyDataParams, roles []string, sealer keySealer, constructor keyDataConstructor, session tpm2.SessionContext) ([]*secboot.KeyData, secboot.PrimaryKey, []secboot.DiskUnlockKey, error) {
+	if len(roles) == 0 {
+		return nil, nil, nil, errors.New("no keys requested")
+	}
+
 	// Create a primary key, if required.
 	primaryKey := params.PrimaryKey
 	if primaryKey == nil {
 		primaryKey = make(secboot.PrimaryKey, 32)
-		if _, err := rand.Read(primaryKey); err != nil {
+		if _, err := io.ReadFull(testhooks.RandReader, primaryKey); err != nil {
 			return nil, nil, nil, xerrors.Errorf("cannot create primary key: %w", err)
 		}
 	}
 
+	nameAlg := params.NameAlg
+	if nameAlg == tpm2.HashAlgorithmId(0) {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+
+	if len(params.ExternalAuthName) > 0 && (params.ExternalAuthName.Type() != tpm2.NameTypeDigest || !params.ExternalAuthName.Algorithm().IsValid()) {
+		return nil, nil, nil, errors.New("invalid external authorization name")
+	}
+
+	usePcrPolicyIndex := false
+	switch handle := params.PcrPolicyNVIndexHandle; {
+	case handle == tpm2.Handle(0) || handle == tpm2.HandleNull:
+		// not requested
+	case handle.Type() != tpm2.HandleTypeNVIndex || pcrPolicyNVDataHandle(handle).Type() != tpm2.HandleTypeNVIndex:
+		return nil, nil, nil, errors.New("invalid PCR policy NV index handle")
+	case params.PcrPolicyCounterHandle != tpm2.HandleNull:
+		return nil, nil, nil, errors.New("cannot use a PCR policy counter with a PCR policy NV index")
+	case tpm == nil:
+		return nil, nil, nil, errors.New("cannot create a PCR policy NV index without a TPM connection")
+	default:
+		// The PCR policy NV indices are bound to a single role.
+		for _, role := range roles[1:] {
+			if role != roles[0] {
+				return nil, nil, nil, errors.New("cannot use a PCR policy NV index with keys that have different roles")
+			}
+		}
+		usePcrPolicyIndex = true
+	}
+
 	// Create the key for authorizing PCR policy updates.
-	authPublicKey, err := newPolicyAuthPublicKey(primaryKey)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot derive public area of key for signing dynamic authorization policies: %w", err)
+	var authPublicKey *tpm2.Public
+	var err error
+	if params.PCRPolicyAuthPublicKey != nil {
+		switch {
+		case params.PCRPolicyAuthPublicKey.Curve != elliptic.P256():
+			return nil, nil, nil, errors.New("PCR policy authorization public key must be a NIST P-256 key")
+		case params.PcrPolicyCounterHandle != tpm2.HandleNull:
+			return nil, nil, nil, errors.New("cannot use a PCR policy counter with a PCR policy authorization public key")
+		case usePcrPolicyIndex:
+			return nil, nil, nil, errors.New("cannot use a PCR policy NV index with a PCR policy authorization public key")
+		}
+		authPublicKey = util.NewExternalECCPublicKey(nameAlg, templates.KeyUsageSign, nil, params.PCRPolicyAuthPublicKey)
+	} else {
+		authPublicKey, err = newPolicyAuthPublicKey(nameAlg, primaryKey)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot derive public area of key for signing dynamic authorization policies: %w", err)
+		}
 	}
 
 	// Create PCR policy counter, if requested and if one doesn't already exist.
@@ -144,78 +409,137 @@ func makeSealedKeyData(tpm *tpm2.TPMContext, params *makeSealedKeyDataParams, se
 		}
 	}
 
-	// Create the initial policy data.
-	nameAlg := tpm2.HashAlgorithmSHA256
-	requireAuthValue := params.AuthMode != secboot.AuthModeNone
+	// Create the PCR policy NV indices, if requested.
+	var pcrPolicyIndexPub *tpm2.NVPublic
+	if usePcrPolicyIndex {
+		handle := params.PcrPolicyNVIndexHandle
+		policyRef := computeV3PcrPolicyRef(nameAlg, secboot.RoleDerivationLabel(roles[0]), nil)
 
-	policyData, authPolicyDigest, err := newKeyDataPolicy(nameAlg, authPublicKey, params.Role, pcrPolicyCounterPub, requireAuthValue)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create initial policy data: %w", err)
-	}
-
-	// Create a 32 byte symmetric key and 12 byte nonce.
-	var symKey [32 + 12]byte
-	if _, err := rand.Read(symKey[:]); err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create symmetric key: %w", err)
-	}
-
-	// Seal the symmetric key and nonce.
-	priv, pub, importSymSeed, err := sealer.CreateSealedObject(symKey[:], nameAlg, authPolicyDigest)
-	if err != nil {
-		return nil, nil, nil, err
+		var err error
+		pcrPolicyIndexPub, err = createPcrPolicyNVIndices(tpm, handle, authPublicKey, policyRef, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, nil, nil, TPMResourceExistsError{handle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, nil, nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, nil, nil, xerrors.Errorf("cannot create new PCR policy NV indices: %w", err)
+		}
 	}
 
-	// Create a new SealedKeyData.
-	data, err := newKeyData(priv, pub, importSymSeed, policyData)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create key data: %w", err)
-	}
-	skd := &SealedKeyData{sealedKeyDataBase: sealedKeyDataBase{data: data}}
+	requireAuthValue := params.AuthMode != secboot.AuthModeNone
 
-	// Set the initial PCR policy.
 	pcrProfile := params.PcrProfile
 	if pcrProfile == nil {
 		pcrProfile = NewPCRProtectionProfile()
 	}
-	if err := skdbUpdatePCRProtectionPolicyNoValidate(&skd.sealedKeyDataBase, tpm, primaryKey, pcrPolicyCounterPub, pcrProfile, resetPcrPolicyVersion); err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot set initial PCR policy: %w", err)
-	}
 
-	// Create the GCM encrypted payload. Use the name algorithm as the KDF algorithm here.
-	kdfAlg := crypto.SHA256
-	unlockKey, payload, err := secboot.MakeDiskUnlockKey(rand.Reader, kdfAlg, primaryKey)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create new unlock key: %w", err)
-	}
+	var kds []*secboot.KeyData
+	var unlockKeys []secboot.DiskUnlockKey
+	first := make(map[string]*SealedKeyData)
+
+	for _, role := range roles {
+		// Create the initial policy data. This is computed for each key so that
+		// each one has its own copy, although they are all identical.
+		var policyData keyDataPolicy
+		var authPolicyDigest tpm2.Digest
+		if pcrPolicyIndexPub != nil {
+			policyData, authPolicyDigest, err = newKeyDataPolicyWithPCRPolicyNVIndex(nameAlg, authPublicKey, role, pcrPolicyIndexPub, requireAuthValue, params.RequireEndorsementAuth, params.ExternalAuthName)
+		} else {
+			policyData, authPolicyDigest, err = newKeyDataPolicy(nameAlg, authPublicKey, role, pcrPolicyCounterPub, requireAuthValue, params.RequireEndorsementAuth, params.ExternalAuthName)
+		}
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create initial policy data: %w", err)
+		}
+		if params.NullHierarchyDevMode {
+			// Record that the sealed object is parented to the null hierarchy
+			// so that unsealing doesn't have to guess.
+			policyData.(*keyDataPolicy_v3).StaticData.NullHierarchyDevMode = true
+		}
+		if params.AlternatePCRBanks {
+			// Record this so that it applies to every PCR policy update.
+			policyData.(*keyDataPolicy_v3).StaticData.AlternatePCRBanks = true
+		}
 
-	// Serialize the AAD. Note that we don't protect the role parameter directly because it's
-	// already bound to the sealed object via its authorization policy.
-	aad, err := mu.MarshalToBytes(&additionalData_v3{
-		Generation: uint32(secboot.KeyDataGeneration),
-		KDFAlg:     tpm2.HashAlgorithmSHA256,
-		AuthMode:   params.AuthMode,
-	})
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create AAD: %w", err)
-	}
+		// Create a 32 byte symmetric key and 12 byte nonce.
+		var symKey [32 + 12]byte
+		if _, err := io.ReadFull(testhooks.RandReader, symKey[:]); err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create symmetric key: %w", err)
+		}
 
-	b, err := aes.NewCipher(symKey[:32])
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create new cipher: %w", err)
-	}
-	aead, err := cipher.NewGCM(b)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create AEAD cipher: %w", err)
-	}
-	ciphertext := aead.Seal(nil, symKey[32:], payload, aad)
+		// Seal the symmetric key and nonce.
+		priv, pub, importSymSeed, err := sealer.CreateSealedObject(symKey[:], nameAlg, authPolicyDigest)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-	// Construct the secboot.KeyData object
-	kd, err := constructor(skd, params.Role, ciphertext, kdfAlg)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot create key data object: %w", err)
+		// Create a new SealedKeyData.
+		data, err := newKeyData(priv, pub, importSymSeed, policyData)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create key data: %w", err)
+		}
+		skd := &SealedKeyData{
+			sealedKeyDataBase: sealedKeyDataBase{data: data},
+			paddingBucketSize: params.PaddingBucketSize}
+
+		// Set the initial PCR policy. This is only computed for the first key with
+		// each role - the other keys with the same role share the same authorization
+		// policy and so can share the same PCR policy. If PCR policies are authorized
+		// by an external key, the initial policy can't be authorized here.
+		switch src, ok := first[role]; {
+		case ok:
+			skd.data.Policy().SetPCRPolicyFrom(src.data.Policy())
+		case params.PCRPolicyAuthPublicKey != nil:
+			if err := skd.setUnauthorizedPCRPolicy(tpm, pcrProfile); err != nil {
+				return nil, nil, nil, xerrors.Errorf("cannot set initial PCR policy: %w", err)
+			}
+			first[role] = skd
+		default:
+			if err := skdbUpdatePCRProtectionPolicyNoValidate(&skd.sealedKeyDataBase, tpm, primaryKey, pcrPolicyCounterPub, pcrProfile, resetPcrPolicyVersion); err != nil {
+				return nil, nil, nil, xerrors.Errorf("cannot set initial PCR policy: %w", err)
+			}
+			first[role] = skd
+		}
+
+		// Create the GCM encrypted payload. Use the name algorithm as the KDF algorithm here.
+		kdfAlg := nameAlg.GetHash()
+		unlockKey, payload, err := secboot.MakeDiskUnlockKey(testhooks.RandReader, kdfAlg, primaryKey)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create new unlock key: %w", err)
+		}
+
+		// Serialize the AAD. Note that we don't protect the role parameter directly because it's
+		// already bound to the sealed object via its authorization policy.
+		aad, err := mu.MarshalToBytes(&additionalData_v3{
+			Generation: uint32(secboot.KeyDataGeneration),
+			KDFAlg:     nameAlg,
+			AuthMode:   params.AuthMode,
+		})
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create AAD: %w", err)
+		}
+
+		b, err := aes.NewCipher(symKey[:32])
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create new cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(b)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create AEAD cipher: %w", err)
+		}
+		ciphertext := aead.Seal(nil, symKey[32:], payload, aad)
+
+		// Construct the secboot.KeyData object
+		kd, err := constructor(skd, role, ciphertext, kdfAlg)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create key data object: %w", err)
+		}
+
+		kds = append(kds, kd)
+		unlockKeys = append(unlockKeys, unlockKey)
 	}
 
-	return kd, primaryKey, unlockKey, nil
+	return kds, primaryKey, unlockKeys, nil
 }
 
 // NewExternalTPMProtectedKey seals the supplied primary key to the TPM storage
@@ -226,8 +550,14 @@ func makeSealedKeyData(tpm *tpm2.TPMContext, params *makeSealedKeyDataParams, se
 // The tpmKey argument must correspond to the storage primary key on the target TPM,
 // persisted at the standard handle (0x81000001).
 //
-// This function cannot create a sealed key that uses a PCR policy counter. The
-// PCRPolicyCounterHandle field of the params argument must be tpm2.HandleNull.
+// This makes it possible to pre-provision keys for a device without access to its TPM,
+// eg, in a factory. The returned key can be unsealed without any further action, but it
+// is imported in to the target TPM's storage hierarchy each time. ImportSealedKey can be
+// used to complete the import once on the target device, eg, on first boot.
+//
+// This function cannot create a sealed key that uses a PCR policy counter or a PCR
+// policy NV index. The PCRPolicyCounterHandle field of the params argument must be
+// tpm2.HandleNull, and the PCRPolicyNVIndexHandle field must not be set.
 //
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile
 // supplied via the PCRProfile field of the params argument. The PCR policy can be updated
@@ -241,14 +571,33 @@ func NewExternalTPMProtectedKey(tpmKey *tpm2.Public, params *ProtectKeyParams) (
 		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
 	}
 
-	sealer := &importableObjectKeySealer{tpmKey: tpmKey}
+	if params.NullHierarchyDevMode {
+		return nil, nil, nil, errors.New("cannot create an importable key in the null hierarchy")
+	}
+	if err := validateRoles(params.Role); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameAlg, err := selectSealedKeyNameAlg(nil, params.NameAlg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sealer := &importableObjectKeySealer{tpmKey: tpmKey, noDA: params.DisableDictionaryAttackProtection}
 
 	return makeSealedKeyData(nil, &makeSealedKeyDataParams{
 		PrimaryKey:             params.PrimaryKey,
 		PcrPolicyCounterHandle: params.PCRPolicyCounterHandle,
+		PcrPolicyNVIndexHandle: params.PCRPolicyNVIndexHandle,
 		AuthMode:               secboot.AuthModeNone,
 		Role:                   params.Role,
 		PcrProfile:             params.PCRProfile,
+		RequireEndorsementAuth: params.RequireEndorsementAuth,
+		ExternalAuthName:       params.ExternalAuthName,
+		PaddingBucketSize:      params.PaddingBucketSize,
+		NameAlg:                nameAlg,
+		PCRPolicyAuthPublicKey: params.PCRPolicyAuthPublicKey,
+		AlternatePCRBanks:      params.AlternatePCRBanks,
 	}, sealer, makeKeyDataNoAuth, nil)
 }
 
@@ -278,31 +627,182 @@ func NewTPMProtectedKey(tpm *Connection, params *ProtectKeyParams) (protectedKey
 	if params == nil {
 		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
 	}
+	if err := validateRoles(params.Role); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameAlg, err := selectSealedKeyNameAlg(tpm.TPMContext, params.NameAlg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	sealer := &sealedObjectKeySealer{tpm}
+	sealer, err := newKeySealer(tpm, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	return makeSealedKeyData(tpm.TPMContext, &makeSealedKeyDataParams{
 		PcrProfile:             params.PCRProfile,
 		Role:                   params.Role,
 		PcrPolicyCounterHandle: params.PCRPolicyCounterHandle,
+		PcrPolicyNVIndexHandle: params.PCRPolicyNVIndexHandle,
 		PrimaryKey:             params.PrimaryKey,
 		AuthMode:               secboot.AuthModeNone,
+		RequireEndorsementAuth: params.RequireEndorsementAuth,
+		ExternalAuthName:       params.ExternalAuthName,
+		PaddingBucketSize:      params.PaddingBucketSize,
+		NameAlg:                nameAlg,
+		PCRPolicyAuthPublicKey: params.PCRPolicyAuthPublicKey,
+		AlternatePCRBanks:      params.AlternatePCRBanks,
+		NullHierarchyDevMode:   params.NullHierarchyDevMode,
 	}, sealer, makeKeyDataNoAuth, tpm.HmacSession())
 }
 
+// SealKeysToTPM seals a related key for each of the supplied roles to the storage
+// hierarchy of the TPM, for example, a key with the "run+recover" role for the data
+// partition and a key with the "recover" role for the save partition. This behaves like
+// NewTPMProtectedKey, but the keys share the same primary key, PCR policy counter and
+// authorization policy. The PCR policy is only computed once for each distinct role and
+// is shared between the keys with that role, and the storage primary key is only
+// provisioned once, which is significantly faster than calling NewTPMProtectedKey for
+// each key on slow TPMs. Each key has its own sealed object and unlock key.
+//
+// The Role field of the params argument must be empty. If the PCRPolicyNVIndexHandle
+// field is set, all of the supplied roles must be the same.
+//
+// As the keys are related, their PCR policies can be updated together with
+// UpdateKeyDataPCRProtectionPolicy.
+//
+// On success, this function returns the sealed key objects, the primary key shared by all
+// of them and the unique key used for disk unlocking for each of them, in the same order
+// as the supplied roles.
+func SealKeysToTPM(tpm *Connection, params *ProtectKeyParams, roles []string) (protectedKeys []*secboot.KeyData, primaryKey secboot.PrimaryKey, unlockKeys []secboot.DiskUnlockKey, err error) {
+	// params is mandatory.
+	if params == nil {
+		return nil, nil, nil, errors.New("no ProtectKeyParams provided")
+	}
+	if params.Role != "" {
+		return nil, nil, nil, errors.New("the role must be supplied for each key")
+	}
+	if len(roles) == 0 {
+		return nil, nil, nil, errors.New("no keys requested")
+	}
+	if err := validateRoles(roles...); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameAlg, err := selectSealedKeyNameAlg(tpm.TPMContext, params.NameAlg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sealer, err := newKeySealer(tpm, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return makeSealedKeysData(tpm.TPMContext, &makeSealedKeyDataParams{
+		PcrProfile:             params.PCRProfile,
+		PcrPolicyCounterHandle: params.PCRPolicyCounterHandle,
+		PcrPolicyNVIndexHandle: params.PCRPolicyNVIndexHandle,
+		PrimaryKey:             params.PrimaryKey,
+		AuthMode:               secboot.AuthModeNone,
+		RequireEndorsementAuth: params.RequireEndorsementAuth,
+		ExternalAuthName:       params.ExternalAuthName,
+		PaddingBucketSize:      params.PaddingBucketSize,
+		NameAlg:                nameAlg,
+		PCRPolicyAuthPublicKey: params.PCRPolicyAuthPublicKey,
+		AlternatePCRBanks:      params.AlternatePCRBanks,
+		NullHierarchyDevMode:   params.NullHierarchyDevMode,
+	}, roles, sealer, makeKeyDataNoAuth, tpm.HmacSession())
+}
+
+// SealKeysToTPMWithPassphrase behaves like SealKeysToTPM, but each of the keys is
+// additionally protected by the supplied passphrase, as they would be when created
+// with NewTPMPassphraseProtectedKey.
+func SealKeysToTPMWithPassphrase(tpm *Connection, params *PassphraseProtectKeyParams, roles []string, passphrase string) (protectedKeys []*secboot.KeyData, primaryKey secboot.PrimaryKey, unlockKeys []secboot.DiskUnlockKey, err error) {
+	// params is mandatory.
+	if params == nil {
+		return nil, nil, nil, errors.New("no PassphraseProtectKeyParams provided")
+	}
+	if params.Role != "" {
+		return nil, nil, nil, errors.New("the role must be supplied for each key")
+	}
+	if len(roles) == 0 {
+		return nil, nil, nil, errors.New("no keys requested")
+	}
+	if err := validateRoles(roles...); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Check the passphrase before doing anything with the TPM.
+	if err := secboot.CheckPassphrase(passphrase); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameAlg, err := selectSealedKeyNameAlg(tpm.TPMContext, params.NameAlg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sealer, err := newKeySealer(tpm, &params.ProtectKeyParams)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return makeSealedKeysData(tpm.TPMContext, &makeSealedKeyDataParams{
+		PcrProfile:             params.PCRProfile,
+		PcrPolicyCounterHandle: params.PCRPolicyCounterHandle,
+		PcrPolicyNVIndexHandle: params.PCRPolicyNVIndexHandle,
+		PrimaryKey:             params.PrimaryKey,
+		AuthMode:               secboot.AuthModePassphrase,
+		RequireEndorsementAuth: params.RequireEndorsementAuth,
+		ExternalAuthName:       params.ExternalAuthName,
+		PaddingBucketSize:      params.PaddingBucketSize,
+		NameAlg:                nameAlg,
+		PCRPolicyAuthPublicKey: params.PCRPolicyAuthPublicKey,
+		AlternatePCRBanks:      params.AlternatePCRBanks,
+		NullHierarchyDevMode:   params.NullHierarchyDevMode,
+	}, roles, sealer, makeKeyDataWithPassphraseConstructor(params.KDFOptions, passphrase), tpm.HmacSession())
+}
+
 func NewTPMPassphraseProtectedKey(tpm *Connection, params *PassphraseProtectKeyParams, passphrase string) (protectedKey *secboot.KeyData, primaryKey secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
 	// params is mandatory.
 	if params == nil {
 		return nil, nil, nil, errors.New("no PassphraseProtectKeyParams provided")
 	}
+	if err := validateRoles(params.Role); err != nil {
+		return nil, nil, nil, err
+	}
 
-	sealer := &sealedObjectKeySealer{tpm}
+	// Check the passphrase before doing anything with the TPM.
+	if err := secboot.CheckPassphrase(passphrase); err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameAlg, err := selectSealedKeyNameAlg(tpm.TPMContext, params.NameAlg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sealer, err := newKeySealer(tpm, &params.ProtectKeyParams)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	return makeSealedKeyData(tpm.TPMContext, &makeSealedKeyDataParams{
 		PrimaryKey:             params.PrimaryKey,
 		PcrPolicyCounterHandle: params.PCRPolicyCounterHandle,
+		PcrPolicyNVIndexHandle: params.PCRPolicyNVIndexHandle,
 		AuthMode:               secboot.AuthModePassphrase,
 		Role:                   params.Role,
 		PcrProfile:             params.PCRProfile,
+		RequireEndorsementAuth: params.RequireEndorsementAuth,
+		ExternalAuthName:       params.ExternalAuthName,
+		PaddingBucketSize:      params.PaddingBucketSize,
+		NameAlg:                nameAlg,
+		PCRPolicyAuthPublicKey: params.PCRPolicyAuthPublicKey,
+		AlternatePCRBanks:      params.AlternatePCRBanks,
+		NullHierarchyDevMode:   params.NullHierarchyDevMode,
 	}, sealer, makeKeyDataWithPassphraseConstructor(params.KDFOptions, passphrase), tpm.HmacSession())
 }
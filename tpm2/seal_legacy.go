@@ -22,7 +22,6 @@ package tpm2
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +34,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/testhooks"
 )
 
 func makeSealedKeyTemplate() *tpm2.Public {
@@ -121,7 +121,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnlockK
 	if params.AuthKey != nil {
 		goAuthKey = params.AuthKey
 	} else {
-		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), testhooks.RandReader)
 		if err != nil {
 			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
 		}
@@ -153,7 +153,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnlockK
 		Type:      pub.Type,
 		SeedValue: make(tpm2.Digest, pub.NameAlg.Size()),
 		Sensitive: &tpm2.SensitiveCompositeU{Bits: sealedData}}
-	if _, err := io.ReadFull(rand.Reader, sensitive.SeedValue); err != nil {
+	if _, err := io.ReadFull(testhooks.RandReader, sensitive.SeedValue); err != nil {
 		return nil, xerrors.Errorf("cannot create seed value: %w", err)
 	}
 
@@ -243,6 +243,36 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 		return nil, errors.New("no keys provided")
 	}
 
+	var unlockKeys []secboot.DiskUnlockKey
+	for _, key := range keys {
+		unlockKeys = append(unlockKeys, key.Key)
+	}
+
+	return sealKeyObjectsToTPM(tpm, unlockKeys, params, func(skos []*SealedKeyObject) (err error) {
+		// Clean up files on failure.
+		defer func() {
+			if err == nil {
+				return
+			}
+			for _, key := range keys {
+				os.Remove(key.Path)
+			}
+		}()
+
+		for i, sko := range skos {
+			if err := sko.WriteAtomic(NewFileSealedKeyObjectWriter(keys[i].Path)); err != nil {
+				return xerrors.Errorf("cannot write key data file: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// sealKeyObjectsToTPM seals the supplied disk encryption keys to the storage hierarchy of the TPM
+// and passes the resulting sealed key objects to the supplied commit callback. The PCR policy
+// counter requested by params is undefined again if any part of this fails, including the commit
+// callback.
+func sealKeyObjectsToTPM(tpm *Connection, keys []secboot.DiskUnlockKey, params *KeyCreationParams, commit func([]*SealedKeyObject) error) (authKey secboot.PrimaryKey, err error) {
 	// Perform some sanity checks on params.
 	if params.AuthKey != nil && params.AuthKey.Curve != elliptic.P256() {
 		return nil, errors.New("provided AuthKey must be from elliptic.P256, no other curve is supported")
@@ -257,7 +287,7 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	srk := tpm.provisionedSrk
 	if srk == nil {
 		var err error
-		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, session)
+		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, session, tpm.nvReadEncryptAttrs())
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return nil, AuthFailError{tpm2.HandleOwner}
@@ -278,7 +308,7 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	if params.AuthKey != nil {
 		goAuthKey = params.AuthKey
 	} else {
-		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), testhooks.RandReader)
 		if err != nil {
 			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
 		}
@@ -322,22 +352,17 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	// Define the template for the sealed key object, using the computed policy digest
 	template.AuthPolicy = authPolicy
 
-	// Clean up files on failure.
-	defer func() {
-		if succeeded {
-			return
-		}
-		for _, key := range keys {
-			os.Remove(key.Path)
-		}
-	}()
-
 	// Begin session for parameter encryption, salted with the SRK.
 	symmetric := &tpm2.SymDef{
 		Algorithm: tpm2.SymAlgorithmAES,
 		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
 		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB},
 	}
+	releaseSession, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create session: %w", err)
+	}
+	defer releaseSession()
 	session, err = tpm.StartAuthSession(srk, nil, tpm2.SessionTypeHMAC, symmetric, defaultSessionHashAlgorithm, nil)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot create session: %w", err)
@@ -347,9 +372,10 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	session = session.WithAttrs(tpm2.AttrContinueSession)
 
 	// Seal each key.
+	var skos []*SealedKeyObject
 	for i, key := range keys {
 		// Create the sensitive data
-		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.Key, AuthPrivateKey: authKey})
+		sealedData, err := mu.MarshalToBytes(sealedData{Key: key, AuthPrivateKey: authKey})
 		if err != nil {
 			panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
 		}
@@ -363,14 +389,11 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
 		}
 
-		w := NewFileSealedKeyObjectWriter(key.Path)
-
 		data, err := newKeyData(priv, pub, nil, policyData)
 		if err != nil {
 			return nil, xerrors.Errorf("cannot create key data: %w", err)
 		}
 
-		// Marshal the entire object (sealed key object and auxiliary data) to disk
 		sko := newSealedKeyObject(data)
 
 		// Create a PCR authorization policy, only for the first key though. Subsequent keys
@@ -385,9 +408,11 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			}
 		}
 
-		if err := sko.WriteAtomic(w); err != nil {
-			return nil, xerrors.Errorf("cannot write key data file: %w", err)
-		}
+		skos = append(skos, sko)
+	}
+
+	if err := commit(skos); err != nil {
+		return nil, err
 	}
 
 	succeeded = true
@@ -20,9 +20,10 @@
 package tpm2_test
 
 import (
-	"crypto"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rsa"
 	_ "crypto/sha256"
 	"errors"
 	"math/rand"
@@ -31,6 +32,7 @@ import (
 	"github.com/canonical/go-tpm2/mu"
 	"github.com/canonical/go-tpm2/templates"
 	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
 	"golang.org/x/crypto/cryptobyte"
 	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
 
@@ -93,14 +95,20 @@ func (s *sealSuite) testProtectKeyWithTPM(c *C, params *ProtectKeyParams) {
 	k, primaryKey, unlockKey, err := NewTPMProtectedKey(s.TPM(), params)
 	c.Assert(err, IsNil)
 
+	nameAlg := params.NameAlg
+	if nameAlg == tpm2.HashAlgorithmId(0) {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+
 	skd, err := NewSealedKeyData(k)
 	c.Assert(err, IsNil)
 	c.Check(skd.Validate(s.TPM().TPMContext, primaryKey), IsNil)
 
 	c.Check(skd.Version(), Equals, uint32(3))
 	c.Check(skd.PCRPolicyCounterHandle(), Equals, params.PCRPolicyCounterHandle)
+	c.Check(skd.DictionaryAttackProtected(), Equals, !params.DisableDictionaryAttackProtection)
 
-	policyAuthPublicKey, err := NewPolicyAuthPublicKey(primaryKey)
+	policyAuthPublicKey, err := NewPolicyAuthPublicKey(nameAlg, primaryKey)
 	c.Assert(err, IsNil)
 
 	var pcrPolicyCounterPub *tpm2.NVPublic
@@ -110,13 +118,14 @@ func (s *sealSuite) testProtectKeyWithTPM(c *C, params *ProtectKeyParams) {
 
 		pcrPolicyCounterPub, _, err = s.TPM().NVReadPublic(index)
 		c.Check(err, IsNil)
+		c.Check(pcrPolicyCounterPub.NameAlg, Equals, nameAlg)
 
 	}
 
-	expectedPolicyData, expectedPolicyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, policyAuthPublicKey, "", pcrPolicyCounterPub, false)
+	expectedPolicyData, expectedPolicyDigest, err := NewKeyDataPolicy(nameAlg, policyAuthPublicKey, "", pcrPolicyCounterPub, false, false, nil)
 	c.Assert(err, IsNil)
 
-	c.Check(skd.Data().Public().NameAlg, Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(skd.Data().Public().NameAlg, Equals, nameAlg)
 	c.Check(skd.Data().Public().AuthPolicy, DeepEquals, expectedPolicyDigest)
 	c.Check(skd.Data().Policy().(*KeyDataPolicy_v3).StaticData, tpm2_testutil.TPMValueDeepEquals, expectedPolicyData.(*KeyDataPolicy_v3).StaticData)
 
@@ -158,6 +167,22 @@ func (s *sealSuite) TestProtectKeyWithTPMDifferentPCRPolicyCounterHandle(c *C) {
 	})
 }
 
+func (s *sealSuite) TestProtectKeyWithTPMDisableDictionaryAttackProtection(c *C) {
+	s.testProtectKeyWithTPM(c, &ProtectKeyParams{
+		PCRProfile:                        tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle:            s.NextAvailableHandle(c, 0x01810000),
+		DisableDictionaryAttackProtection: true,
+	})
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMNameAlgSHA384(c *C) {
+	s.testProtectKeyWithTPM(c, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NameAlg:                tpm2.HashAlgorithmSHA384,
+	})
+}
+
 func (s *sealSuite) TestProtectKeyWithTPMWithNewConnection(c *C) {
 	// ProtectKeyWithTPM behaves slightly different if called immediately after
 	// EnsureProvisioned with the same Connection
@@ -294,6 +319,110 @@ func (s *sealSuite) TestProtectKeyWithTPMWithProvidedPrimaryKey(c *C) {
 		PrimaryKey:             primaryKey})
 }
 
+func (s *sealSuite) TestProtectKeyWithTPMNullHierarchyDevMode(c *C) {
+	s.testProtectKeyWithTPM(c, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NullHierarchyDevMode:   true})
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMNullHierarchyDevModeNoOwnerAuth(c *C) {
+	// Sealing to the null hierarchy doesn't require the authorization value
+	// for the storage hierarchy.
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	s.ReinitTPMConnectionFromExisting(c)
+
+	k, _, unlockKey, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NullHierarchyDevMode:   true})
+	c.Assert(err, IsNil)
+
+	unlockKeyUnsealed, _, err := k.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(unlockKeyUnsealed, DeepEquals, unlockKey)
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMNullHierarchyDevModeIsRecorded(c *C) {
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NullHierarchyDevMode:   true})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.Version(), Equals, uint32(4))
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMNullHierarchyDevModeSealedObjectParent(c *C) {
+	// Ensure that a key sealed in dev mode can't be loaded with the SRK.
+	k, _, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NullHierarchyDevMode:   true})
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	_, err = s.TPM().Load(srk, skd.Data().Private(), skd.Data().Public(), nil)
+	c.Check(err, NotNil)
+}
+
+func (s *sealSuite) TestSealKeysToTPM(c *C) {
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	roles := []string{"run+recover", "recover"}
+
+	keys, primaryKey, unlockKeys, err := SealKeysToTPM(s.TPM(), params, roles)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	c.Assert(unlockKeys, HasLen, 2)
+	c.Check(unlockKeys[0], Not(DeepEquals), unlockKeys[1])
+
+	for i, k := range keys {
+		c.Check(k.Role(), Equals, roles[i])
+
+		skd, err := NewSealedKeyData(k)
+		c.Assert(err, IsNil)
+		c.Check(skd.Validate(s.TPM().TPMContext, primaryKey), IsNil)
+		c.Check(skd.PCRPolicyCounterHandle(), Equals, params.PCRPolicyCounterHandle)
+
+		unlockKeyUnsealed, primaryKeyUnsealed, err := k.RecoverKeys()
+		c.Check(err, IsNil)
+		c.Check(unlockKeyUnsealed, DeepEquals, unlockKeys[i])
+		c.Check(primaryKeyUnsealed, DeepEquals, primaryKey)
+	}
+
+	// The keys are related, so they can be updated together.
+	c.Check(UpdateKeyDataPCRProtectionPolicy(s.TPM(), primaryKey, params.PCRProfile, NewPCRPolicyVersion, keys...), IsNil)
+	for _, k := range keys {
+		_, _, err := k.RecoverKeys()
+		c.Check(err, IsNil)
+	}
+}
+
+func (s *sealSuite) TestSealKeysToTPMErrorHandlingNilParams(c *C) {
+	_, _, _, err := SealKeysToTPM(s.TPM(), nil, []string{"foo", "bar"})
+	c.Check(err, ErrorMatches, "no ProtectKeyParams provided")
+}
+
+func (s *sealSuite) TestSealKeysToTPMErrorHandlingNoKeys(c *C) {
+	_, _, _, err := SealKeysToTPM(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: tpm2.HandleNull}, nil)
+	c.Check(err, ErrorMatches, "no keys requested")
+}
+
+func (s *sealSuite) TestSealKeysToTPMErrorHandlingRoleInParams(c *C) {
+	_, _, _, err := SealKeysToTPM(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: tpm2.HandleNull, Role: "foo"}, []string{"foo"})
+	c.Check(err, ErrorMatches, "the role must be supplied for each key")
+}
+
 func (s *sealSuite) testProtectKeyWithTPMErrorHandling(c *C, params *ProtectKeyParams) error {
 	var origCounter tpm2.ResourceContext
 	if params != nil && params.PCRPolicyCounterHandle != tpm2.HandleNull {
@@ -367,6 +496,25 @@ func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingInvalidPCRProfileSelection
 	c.Check(err, ErrorMatches, "cannot set initial PCR policy: PCR protection profile contains digests for unsupported PCRs")
 }
 
+func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingTPMSessionBudget(c *C) {
+	// The connection's HMAC session already uses the whole budget.
+	secboot.SetResourceBudget(secboot.ResourceBudget{MaxTPMSessions: 1})
+	defer secboot.SetResourceBudget(secboot.ResourceBudget{})
+
+	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, ErrorMatches, "cannot create session: tpm-sessions budget exceeded: 1 requested with 1 of 1 in use")
+
+	c.Check(errors.As(err, new(*secboot.ResourceBudgetExceededError)), testutil.IsTrue)
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingNullHierarchyDevModeWithPCRPolicyCounter(c *C) {
+	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NullHierarchyDevMode:   true})
+	c.Check(err, ErrorMatches, "cannot use a PCR policy counter with a key sealed to the null hierarchy")
+}
+
 func (s *sealSuite) testProtectKeyWithExternalStorageKey(c *C, params *ProtectKeyParams) {
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
@@ -380,6 +528,11 @@ func (s *sealSuite) testProtectKeyWithExternalStorageKey(c *C, params *ProtectKe
 	k, primaryKey, unlockKey, err := NewExternalTPMProtectedKey(srkPub, params)
 	c.Assert(err, IsNil)
 
+	nameAlg := params.NameAlg
+	if nameAlg == tpm2.HashAlgorithmId(0) {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+
 	skd, err := NewSealedKeyData(k)
 	c.Assert(err, IsNil)
 	c.Check(skd.Validate(s.TPM().TPMContext, primaryKey), IsNil)
@@ -387,13 +540,13 @@ func (s *sealSuite) testProtectKeyWithExternalStorageKey(c *C, params *ProtectKe
 	c.Check(skd.Version(), Equals, uint32(3))
 	c.Check(skd.PCRPolicyCounterHandle(), Equals, tpm2.HandleNull)
 
-	policyAuthPublicKey, err := NewPolicyAuthPublicKey(primaryKey)
+	policyAuthPublicKey, err := NewPolicyAuthPublicKey(nameAlg, primaryKey)
 	c.Assert(err, IsNil)
 
-	expectedPolicyData, expectedPolicyDigest, err := NewKeyDataPolicy(tpm2.HashAlgorithmSHA256, policyAuthPublicKey, "", nil, false)
+	expectedPolicyData, expectedPolicyDigest, err := NewKeyDataPolicy(nameAlg, policyAuthPublicKey, "", nil, false, false, nil)
 	c.Assert(err, IsNil)
 
-	c.Check(skd.Data().Public().NameAlg, Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(skd.Data().Public().NameAlg, Equals, nameAlg)
 	c.Check(skd.Data().Public().AuthPolicy, DeepEquals, expectedPolicyDigest)
 	c.Check(skd.Data().Policy().(*KeyDataPolicy_v3).StaticData, tpm2_testutil.TPMValueDeepEquals, expectedPolicyData.(*KeyDataPolicy_v3).StaticData)
 
@@ -439,6 +592,13 @@ func (s *sealSuite) TestProtectKeyWithExternalStorageKeyWithProvidedPrimaryKey(c
 		PrimaryKey:             primaryKey})
 }
 
+func (s *sealSuite) TestProtectKeyWithExternalStorageKeyNameAlgSHA384(c *C) {
+	s.testProtectKeyWithExternalStorageKey(c, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NameAlg:                tpm2.HashAlgorithmSHA384})
+}
+
 func (s *sealSuite) testProtectKeyWithExternalStorageKeyErrorHandling(c *C, params *ProtectKeyParams) error {
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
@@ -457,6 +617,20 @@ func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingNilParams(c
 	c.Check(s.testProtectKeyWithExternalStorageKeyErrorHandling(c, nil), ErrorMatches, "no ProtectKeyParams provided")
 }
 
+func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingNullHierarchyDevMode(c *C) {
+	err := s.testProtectKeyWithExternalStorageKeyErrorHandling(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NullHierarchyDevMode:   true})
+	c.Check(err, ErrorMatches, "cannot create an importable key in the null hierarchy")
+}
+
+func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingUnsupportedNameAlg(c *C) {
+	err := s.testProtectKeyWithExternalStorageKeyErrorHandling(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NameAlg:                tpm2.HashAlgorithmSHA1})
+	c.Check(err, ErrorMatches, "unsupported name algorithm TPM_ALG_SHA1")
+}
+
 func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingInvalidPCRProfile(c *C) {
 	err := s.testProtectKeyWithExternalStorageKeyErrorHandling(c, &ProtectKeyParams{
 		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
@@ -511,10 +685,10 @@ func (s *sealSuiteNoTPM) SetUpTest(c *C) {
 
 	s.lastAuthKey = nil
 	s.lastAuthKeyPublic = nil
-	s.AddCleanup(MockNewPolicyAuthPublicKey(func(primaryKey secboot.PrimaryKey) (*tpm2.Public, error) {
+	s.AddCleanup(MockNewPolicyAuthPublicKey(func(nameAlg tpm2.HashAlgorithmId, primaryKey secboot.PrimaryKey) (*tpm2.Public, error) {
 		s.lastAuthKey = primaryKey
 
-		pub, err := NewPolicyAuthPublicKey(primaryKey)
+		pub, err := NewPolicyAuthPublicKey(nameAlg, primaryKey)
 		s.lastAuthKeyPublic = pub
 		return pub, err
 	}))
@@ -528,9 +702,15 @@ type testMakeSealedKeyDataData struct {
 	Role                   string
 	PCRPolicyCounterHandle tpm2.Handle
 	PrimaryKey             secboot.PrimaryKey
+	NameAlg                tpm2.HashAlgorithmId
 }
 
 func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyDataData) {
+	nameAlg := data.NameAlg
+	if nameAlg == tpm2.HashAlgorithmId(0) {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+
 	var mockTpm *tpm2.TPMContext
 	var mockSession tpm2.SessionContext
 	if data.PCRPolicyCounterHandle != tpm2.HandleNull {
@@ -546,6 +726,7 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 		c.Check(handle, Equals, data.PCRPolicyCounterHandle)
 		c.Check(pub, Equals, s.lastAuthKeyPublic)
 		c.Check(session, Equals, mockSession)
+		c.Check(pub.NameAlg, Equals, nameAlg)
 
 		mockPcrPolicyCounterPub = &tpm2.NVPublic{
 			Index:      handle,
@@ -560,11 +741,13 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 
 	var mockPolicyData *KeyDataPolicy_v3
 	var mockPolicyDigest tpm2.Digest
-	restore = MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue bool) (KeyDataPolicy, tpm2.Digest, error) {
-		c.Check(alg, Equals, tpm2.HashAlgorithmSHA256)
+	restore = MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
+		c.Check(alg, Equals, nameAlg)
 		c.Check(key, Equals, s.lastAuthKeyPublic)
 		c.Check(pcrPolicyCounterPub, Equals, mockPcrPolicyCounterPub)
 		c.Check(requireAuthValue, Equals, false)
+		c.Check(requireEndorsementAuth, Equals, false)
+		c.Check(externalAuthName, IsNil)
 
 		index := tpm2.HandleNull
 		if pcrPolicyCounterPub != nil {
@@ -610,6 +793,7 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 		Role:                   data.Role,
 		PcrPolicyCounterHandle: data.PCRPolicyCounterHandle,
 		PrimaryKey:             primaryKey,
+		NameAlg:                data.NameAlg,
 	}
 
 	constructor := MakeKeyDataNoAuth
@@ -624,7 +808,7 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 	c.Assert(s.lastKeyParams, NotNil)
 	c.Check(s.lastKeyParams.PlatformName, Equals, "tpm2")
 	c.Check(s.lastKeyParams.Role, Equals, data.Role)
-	c.Check(s.lastKeyParams.KDFAlg, Equals, crypto.SHA256)
+	c.Check(s.lastKeyParams.KDFAlg, Equals, nameAlg.GetHash())
 
 	c.Check(pk, DeepEquals, primaryKey)
 	c.Check(kd.Role(), DeepEquals, data.Role)
@@ -633,7 +817,7 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 	c.Check(kd.UnmarshalPlatformHandle(&skd), IsNil)
 
 	c.Check(skd.Data().Policy(), tpm2_testutil.TPMValueDeepEquals, mockPolicyData)
-	c.Check(skd.Data().Public().NameAlg, Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(skd.Data().Public().NameAlg, Equals, nameAlg)
 	c.Check(skd.Data().Public().AuthPolicy, DeepEquals, mockPolicyDigest)
 
 	payload := make([]byte, len(s.lastKeyParams.EncryptedPayload))
@@ -644,7 +828,7 @@ func (s *sealSuiteNoTPM) testMakeSealedKeyData(c *C, data *testMakeSealedKeyData
 
 	aad, err := mu.MarshalToBytes(&AdditionalData_v3{
 		Generation: uint32(kd.Generation()),
-		KDFAlg:     tpm2.HashAlgorithmSHA256,
+		KDFAlg:     nameAlg,
 		AuthMode:   kd.AuthMode(),
 	})
 
@@ -677,3 +861,396 @@ func (s *sealSuiteNoTPM) TestMakeSealedKeyData2(c *C) {
 		Role:                   "test",
 	})
 }
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeyDataNameAlgSHA384(c *C) {
+	s.testMakeSealedKeyData(c, &testMakeSealedKeyDataData{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: 0x01800000,
+		NameAlg:                tpm2.HashAlgorithmSHA384,
+	})
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyUnsupportedNameAlg(c *C) {
+	_, _, _, err := NewExternalTPMProtectedKey(nil, &ProtectKeyParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NameAlg:                tpm2.HashAlgorithmSHA512})
+	c.Check(err, ErrorMatches, "unsupported name algorithm TPM_ALG_SHA512")
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyInvalidExternalAuthName(c *C) {
+	_, _, _, err := NewExternalTPMProtectedKey(nil, &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		ExternalAuthName:       tpm2.MakeHandleName(tpm2.HandleOwner)})
+	c.Check(err, ErrorMatches, "invalid external authorization name")
+}
+
+func (s *sealSuiteNoTPM) newExternalTPMProtectedKey(c *C, params *ProtectKeyParams) (*SealedKeyData, secboot.PrimaryKey, error) {
+	srkKey, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&srkKey.PublicKey)
+
+	k, primaryKey, _, err := NewExternalTPMProtectedKey(srk, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	return skd, primaryKey, nil
+}
+
+func (s *sealSuiteNoTPM) checkAlternatePCRBanksPolicy(c *C, skd *SealedKeyData, values tpm2.PCRValues) {
+	// The policy should permit the combined banks or each bank on its own.
+	var expected tpm2.DigestList
+	for _, pcrs := range []tpm2.PCRSelectionList{
+		{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7}}, {Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+		{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7}}},
+		{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}},
+	} {
+		digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+		c.Assert(err, IsNil)
+		trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+		trial.PolicyPCR(digest, pcrs)
+		expected = append(expected, trial.GetDigest())
+	}
+
+	pcrData := skd.Data().Policy().(*KeyDataPolicy_v3).PCRData
+	c.Check(pcrData.Selection, tpm2_testutil.TPMValueDeepEquals, tpm2.PCRSelectionList{
+		{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7}},
+		{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	c.Assert(pcrData.OrData, HasLen, 1)
+	c.Check(pcrData.OrData[0].Digests, tpm2_testutil.TPMValueDeepEquals, expected)
+}
+
+func (s *sealSuiteNoTPM) newAlternatePCRBanksProfile(event string) (*PCRProtectionProfile, tpm2.PCRValues) {
+	values := tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA1:   {7: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, event)},
+		tpm2.HashAlgorithmSHA256: {7: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, event)}}
+
+	profile := NewPCRProtectionProfile()
+	profile.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 7, values[tpm2.HashAlgorithmSHA1][7]).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7])
+	return profile, values
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyAlternatePCRBanks(c *C) {
+	profile, values := s.newAlternatePCRBanksProfile("foo")
+
+	skd, _, err := s.newExternalTPMProtectedKey(c, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		AlternatePCRBanks:      true})
+	c.Assert(err, IsNil)
+
+	c.Check(skd.Version(), Equals, uint32(4))
+	c.Check(skd.Data().Policy().(*KeyDataPolicy_v3).StaticData.AlternatePCRBanks, testutil.IsTrue)
+	s.checkAlternatePCRBanksPolicy(c, skd, values)
+}
+
+func (s *sealSuiteNoTPM) TestAlternatePCRBanksAppliesToUpdates(c *C) {
+	profile, _ := s.newAlternatePCRBanksProfile("foo")
+
+	skd, primaryKey, err := s.newExternalTPMProtectedKey(c, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		AlternatePCRBanks:      true})
+	c.Assert(err, IsNil)
+
+	// Persist and reload the key data to make sure that the choice is
+	// recorded in it.
+	w := new(bytes.Buffer)
+	c.Assert(skd.Data().Write(w), IsNil)
+	data, err := ReadKeyDataV4(w)
+	c.Assert(err, IsNil)
+	skd = NewSealedKeyDataWithPadding(data, 0)
+
+	profile, values := s.newAlternatePCRBanksProfile("bar")
+	c.Check(skd.UpdatePCRProtectionPolicyNoValidate(nil, primaryKey, nil, profile, ResetPcrPolicyVersion), IsNil)
+	s.checkAlternatePCRBanksPolicy(c, skd, values)
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyAlternatePCRBanksOneBank(c *C) {
+	_, _, err := s.newExternalTPMProtectedKey(c, &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		AlternatePCRBanks:      true})
+	c.Check(err, ErrorMatches, `cannot set initial PCR policy: PCR protection profile must contain digests for more than one PCR bank`)
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyAlternatePCRBanksUnsupportedBank(c *C) {
+	profile := NewPCRProtectionProfile()
+	profile.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		AddPCRValue(tpm2.HashAlgorithmSHA384, 7, make(tpm2.Digest, 48))
+
+	_, _, err := s.newExternalTPMProtectedKey(c, &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		AlternatePCRBanks:      true})
+	c.Check(err, ErrorMatches, `cannot set initial PCR policy: PCR protection profile contains digests for unsupported PCR bank TPM_ALG_SHA384`)
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysData(c *C) {
+	// Verify that the PCR policy counter and the initial PCR policy are only
+	// created once and are shared between all of the keys.
+	mockTpm := new(tpm2.TPMContext)
+	mockSession := new(mockSessionContext)
+
+	counterCalls := 0
+	var mockPcrPolicyCounterPub *tpm2.NVPublic
+	restore := MockEnsurePcrPolicyCounter(func(tpm *tpm2.TPMContext, handle tpm2.Handle, pub *tpm2.Public, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+		counterCalls += 1
+		mockPcrPolicyCounterPub = &tpm2.NVPublic{
+			Index:      handle,
+			NameAlg:    tpm2.HashAlgorithmSHA256,
+			Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+			AuthPolicy: make([]byte, 32),
+			Size:       8}
+		return mockPcrPolicyCounterPub, nil
+	})
+	defer restore()
+
+	var policies []*KeyDataPolicy_v3
+	restore = MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
+		c.Check(key, Equals, s.lastAuthKeyPublic)
+		c.Check(role, Equals, "foo")
+		c.Check(pcrPolicyCounterPub, Equals, mockPcrPolicyCounterPub)
+
+		policy := &KeyDataPolicy_v3{
+			StaticData: &StaticPolicyData_v3{
+				AuthPublicKey:          key,
+				PCRPolicyCounterHandle: pcrPolicyCounterPub.Index},
+			PCRData: &PcrPolicyData_v3{
+				AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}}
+		policies = append(policies, policy)
+		return policy, make(tpm2.Digest, 32), nil
+	})
+	defer restore()
+
+	pcrPolicyCalls := 0
+	var pcrData *PcrPolicyData_v3
+	restore = MockSkdbUpdatePCRProtectionPolicyNoValidate(func(skdb *SealedKeyDataBase, tpm *tpm2.TPMContext, primaryKey secboot.PrimaryKey, counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption PcrPolicyVersionOption) error {
+		pcrPolicyCalls += 1
+		pcrData = &PcrPolicyData_v3{
+			PolicySequence:            1,
+			AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}
+		skdb.Data().Policy().(*KeyDataPolicy_v3).PCRData = pcrData
+		return nil
+	})
+	defer restore()
+
+	var sealer mockKeySealer
+
+	params := &SealedKeyDataParams{
+		PcrProfile:             NewPCRProtectionProfile(),
+		Role:                   "foo",
+		PcrPolicyCounterHandle: 0x01800000,
+	}
+
+	kds, pk, unlockKeys, err := MakeSealedKeysData(mockTpm, params, []string{"foo", "foo", "foo"}, &sealer, MakeKeyDataNoAuth, mockSession)
+	c.Assert(err, IsNil)
+	c.Check(kds, HasLen, 3)
+	c.Check(unlockKeys, HasLen, 3)
+	c.Check(pk, DeepEquals, s.lastAuthKey)
+
+	c.Check(counterCalls, Equals, 1)
+	c.Check(pcrPolicyCalls, Equals, 1)
+	c.Assert(policies, HasLen, 3)
+
+	for i, kd := range kds {
+		c.Check(kd.Role(), Equals, "foo")
+
+		var skd *SealedKeyData
+		c.Check(kd.UnmarshalPlatformHandle(&skd), IsNil)
+		c.Check(skd.Data().Policy(), tpm2_testutil.TPMValueDeepEquals, policies[i])
+		c.Check(skd.Data().Policy().(*KeyDataPolicy_v3).PCRData, tpm2_testutil.TPMValueDeepEquals, pcrData)
+
+		// Each key has its own policy structure.
+		for j := 0; j < i; j++ {
+			c.Check(policies[i], Not(Equals), policies[j])
+			c.Check(unlockKeys[i], Not(DeepEquals), unlockKeys[j])
+		}
+	}
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataDifferentRoles(c *C) {
+	// Verify that the initial PCR policy is computed once for each role and
+	// is shared between the keys with the same role.
+	mockTpm := new(tpm2.TPMContext)
+
+	restore := MockEnsurePcrPolicyCounter(func(tpm *tpm2.TPMContext, handle tpm2.Handle, pub *tpm2.Public, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+		return &tpm2.NVPublic{
+			Index:      handle,
+			NameAlg:    tpm2.HashAlgorithmSHA256,
+			Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+			AuthPolicy: make([]byte, 32),
+			Size:       8}, nil
+	})
+	defer restore()
+
+	var policyRoles []string
+	restore = MockNewKeyDataPolicy(func(alg tpm2.HashAlgorithmId, key *tpm2.Public, role string, pcrPolicyCounterPub *tpm2.NVPublic, requireAuthValue, requireEndorsementAuth bool, externalAuthName tpm2.Name) (KeyDataPolicy, tpm2.Digest, error) {
+		policyRoles = append(policyRoles, role)
+		return &KeyDataPolicy_v3{
+			StaticData: &StaticPolicyData_v3{
+				AuthPublicKey:          key,
+				PCRPolicyCounterHandle: pcrPolicyCounterPub.Index},
+			PCRData: &PcrPolicyData_v3{
+				AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}}, make(tpm2.Digest, 32), nil
+	})
+	defer restore()
+
+	var pcrData []*PcrPolicyData_v3
+	restore = MockSkdbUpdatePCRProtectionPolicyNoValidate(func(skdb *SealedKeyDataBase, tpm *tpm2.TPMContext, primaryKey secboot.PrimaryKey, counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption PcrPolicyVersionOption) error {
+		data := &PcrPolicyData_v3{
+			PolicySequence:            uint64(len(pcrData)),
+			AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}
+		pcrData = append(pcrData, data)
+		skdb.Data().Policy().(*KeyDataPolicy_v3).PCRData = data
+		return nil
+	})
+	defer restore()
+
+	var sealer mockKeySealer
+
+	params := &SealedKeyDataParams{
+		PcrProfile:             NewPCRProtectionProfile(),
+		PcrPolicyCounterHandle: 0x01800000,
+	}
+
+	roles := []string{"run+recover", "recover", "run+recover"}
+	kds, _, _, err := MakeSealedKeysData(mockTpm, params, roles, &sealer, MakeKeyDataNoAuth, nil)
+	c.Assert(err, IsNil)
+	c.Assert(kds, HasLen, 3)
+	c.Check(policyRoles, DeepEquals, roles)
+	c.Assert(pcrData, HasLen, 2)
+
+	for i, kd := range kds {
+		c.Check(kd.Role(), Equals, roles[i])
+	}
+
+	expectedPcrData := []*PcrPolicyData_v3{pcrData[0], pcrData[1], pcrData[0]}
+	for i, kd := range kds {
+		var skd *SealedKeyData
+		c.Assert(kd.UnmarshalPlatformHandle(&skd), IsNil)
+		c.Check(skd.Data().Policy().(*KeyDataPolicy_v3).PCRData, tpm2_testutil.TPMValueDeepEquals, expectedPcrData[i])
+	}
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataPCRPolicyNVIndex(c *C) {
+	// Verify that the PCR policy NV indices are only created once and are
+	// shared between all of the keys, and that no PCR policy counter is created.
+	mockTpm := new(tpm2.TPMContext)
+	mockSession := new(mockSessionContext)
+
+	restore := MockEnsurePcrPolicyCounter(func(tpm *tpm2.TPMContext, handle tpm2.Handle, pub *tpm2.Public, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+		c.Error("unexpected PCR policy counter creation")
+		return nil, errors.New("unexpected")
+	})
+	defer restore()
+
+	indexCalls := 0
+	var mockPcrPolicyIndexPub *tpm2.NVPublic
+	restore = MockCreatePcrPolicyNVIndices(func(tpm *tpm2.TPMContext, handle tpm2.Handle, pub *tpm2.Public, policyRef tpm2.Nonce, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+		indexCalls += 1
+		c.Check(tpm, Equals, mockTpm)
+		c.Check(handle, Equals, tpm2.Handle(0x01800000))
+		c.Check(pub, Equals, s.lastAuthKeyPublic)
+		c.Check(policyRef, DeepEquals, ComputeV3PcrPolicyRef(tpm2.HashAlgorithmSHA256, secboot.RoleDerivationLabel("foo"), nil))
+		c.Check(session, Equals, mockSession)
+
+		mockPcrPolicyIndexPub = &tpm2.NVPublic{
+			Index:      handle,
+			NameAlg:    tpm2.HashAlgorithmSHA256,
+			Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+			AuthPolicy: ComputePcrPolicyNVIndexAuthPolicy(tpm2.HashAlgorithmSHA256, pub.Name(), policyRef),
+			Size:       34}
+		return mockPcrPolicyIndexPub, nil
+	})
+	defer restore()
+
+	pcrPolicyCalls := 0
+	restore = MockSkdbUpdatePCRProtectionPolicyNoValidate(func(skdb *SealedKeyDataBase, tpm *tpm2.TPMContext, primaryKey secboot.PrimaryKey, counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption PcrPolicyVersionOption) error {
+		pcrPolicyCalls += 1
+		c.Check(counterPub, IsNil)
+		return nil
+	})
+	defer restore()
+
+	var sealer mockKeySealer
+
+	params := &SealedKeyDataParams{
+		PcrProfile:             NewPCRProtectionProfile(),
+		Role:                   "foo",
+		PcrPolicyCounterHandle: tpm2.HandleNull,
+		PcrPolicyNVIndexHandle: 0x01800000,
+	}
+
+	kds, _, _, err := MakeSealedKeysData(mockTpm, params, []string{"foo", "foo"}, &sealer, MakeKeyDataNoAuth, mockSession)
+	c.Assert(err, IsNil)
+	c.Check(kds, HasLen, 2)
+
+	c.Check(indexCalls, Equals, 1)
+	c.Check(pcrPolicyCalls, Equals, 1)
+
+	expectedDigest := ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, mockPcrPolicyIndexPub.Name())
+
+	for _, kd := range kds {
+		var skd *SealedKeyData
+		c.Assert(kd.UnmarshalPlatformHandle(&skd), IsNil)
+		c.Check(skd.Data().Version(), Equals, uint32(4))
+		c.Check(skd.Data().Public().AuthPolicy, DeepEquals, expectedDigest)
+
+		policy := skd.Data().Policy().(*KeyDataPolicy_v3)
+		c.Check(policy.StaticData.PCRPolicyNVIndexHandle, Equals, tpm2.Handle(0x01800000))
+		c.Check(policy.StaticData.PCRPolicyCounterHandle, Equals, tpm2.HandleNull)
+	}
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataPCRPolicyNVIndexWithCounter(c *C) {
+	var sealer mockKeySealer
+	_, _, _, err := MakeSealedKeysData(new(tpm2.TPMContext), &SealedKeyDataParams{
+		PcrPolicyCounterHandle: 0x01800000,
+		PcrPolicyNVIndexHandle: 0x01800010}, []string{""}, &sealer, MakeKeyDataNoAuth, nil)
+	c.Check(err, ErrorMatches, "cannot use a PCR policy counter with a PCR policy NV index")
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataPCRPolicyNVIndexDifferentRoles(c *C) {
+	var sealer mockKeySealer
+	_, _, _, err := MakeSealedKeysData(new(tpm2.TPMContext), &SealedKeyDataParams{
+		PcrPolicyCounterHandle: tpm2.HandleNull,
+		PcrPolicyNVIndexHandle: 0x01800000}, []string{"foo", "bar"}, &sealer, MakeKeyDataNoAuth, nil)
+	c.Check(err, ErrorMatches, "cannot use a PCR policy NV index with keys that have different roles")
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataInvalidPCRPolicyNVIndexHandle(c *C) {
+	var sealer mockKeySealer
+	_, _, _, err := MakeSealedKeysData(new(tpm2.TPMContext), &SealedKeyDataParams{
+		PcrPolicyCounterHandle: tpm2.HandleNull,
+		PcrPolicyNVIndexHandle: 0x81000001}, []string{""}, &sealer, MakeKeyDataNoAuth, nil)
+	c.Check(err, ErrorMatches, "invalid PCR policy NV index handle")
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyPCRPolicyNVIndex(c *C) {
+	_, _, _, err := NewExternalTPMProtectedKey(nil, &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyNVIndexHandle: 0x01800000})
+	c.Check(err, ErrorMatches, "cannot create a PCR policy NV index without a TPM connection")
+}
+
+func (s *sealSuiteNoTPM) TestNewExternalTPMProtectedKeyInvalidRole(c *C) {
+	_, _, _, err := NewExternalTPMProtectedKey(nil, &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		Role:                   "run recover",
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, ErrorMatches, `invalid role "run recover": .*`)
+}
+
+func (s *sealSuiteNoTPM) TestMakeSealedKeysDataNoKeys(c *C) {
+	var sealer mockKeySealer
+	_, _, _, err := MakeSealedKeysData(nil, &SealedKeyDataParams{PcrPolicyCounterHandle: tpm2.HandleNull}, nil, &sealer, MakeKeyDataNoAuth, nil)
+	c.Check(err, ErrorMatches, "no keys requested")
+}
@@ -0,0 +1,167 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// packetHeaderSize is the size of the header of command and response
+	// packets.
+	packetHeaderSize = 10
+)
+
+// handleTracker tracks the transient objects and sessions that have been
+// created by the commands submitted on a connection and which haven't been
+// flushed, by inspecting the command and response packets. Resources that the
+// TPM flushes implicitly, such as sessions used without the continue session
+// attribute, remain tracked, which errs on the side of not flushing them.
+type handleTracker struct {
+	owned map[tpm2.Handle]struct{}
+
+	command     tpm2.CommandCode // the command awaiting a response, or zero
+	flushHandle tpm2.Handle      // the handle flushed by the command awaiting a response
+	rsp         []byte           // the part of the response read so far
+}
+
+func (t *handleTracker) commandSubmitted(data []byte) {
+	t.command = 0
+	t.rsp = nil
+	if len(data) < packetHeaderSize {
+		return
+	}
+
+	t.command = tpm2.CommandCode(binary.BigEndian.Uint32(data[6:]))
+	if t.command == tpm2.CommandFlushContext {
+		// TPM2_FlushContext has no handle area, and the handle to
+		// flush is the first parameter.
+		if len(data) < packetHeaderSize+4 {
+			t.command = 0
+			return
+		}
+		t.flushHandle = tpm2.Handle(binary.BigEndian.Uint32(data[packetHeaderSize:]))
+	}
+}
+
+func (t *handleTracker) responseRead(data []byte) {
+	if t.command == 0 {
+		return
+	}
+
+	t.rsp = append(t.rsp, data...)
+	if len(t.rsp) < packetHeaderSize {
+		return
+	}
+	if binary.BigEndian.Uint32(t.rsp[6:]) != uint32(tpm2.ResponseSuccess) {
+		t.command = 0
+		t.rsp = nil
+		return
+	}
+
+	switch t.command {
+	case tpm2.CommandFlushContext:
+		delete(t.owned, t.flushHandle)
+	case tpm2.CommandCreatePrimary, tpm2.CommandLoad, tpm2.CommandLoadExternal,
+		tpm2.CommandCreateLoaded, tpm2.CommandStartAuthSession, tpm2.CommandContextLoad,
+		tpm2.CommandHashSequenceStart, tpm2.CommandHMACStart:
+		// These commands return the handle of the new resource
+		// in the response handle area.
+		if len(t.rsp) < packetHeaderSize+4 {
+			return
+		}
+		if t.owned == nil {
+			t.owned = make(map[tpm2.Handle]struct{})
+		}
+		t.owned[tpm2.Handle(binary.BigEndian.Uint32(t.rsp[packetHeaderSize:]))] = struct{}{}
+	}
+
+	t.command = 0
+	t.rsp = nil
+}
+
+func (t *handleTracker) isOwned(handle tpm2.Handle) bool {
+	_, owned := t.owned[handle]
+	return owned
+}
+
+// isHandleInRange indicates whether the supplied handle is in the range
+// that starts with first. Loaded sessions are returned from TPM2_GetCapability
+// with the handle type of the session, which may be a policy session.
+func isHandleInRange(handle, first tpm2.Handle) bool {
+	if first.Type() == tpm2.HandleTypeLoadedSession {
+		return handle.Type() == tpm2.HandleTypeHMACSession || handle.Type() == tpm2.HandleTypePolicySession
+	}
+	return handle.Type() == first.Type()
+}
+
+// CleanupStaleResources flushes transient objects and loaded sessions that
+// have been left on the TPM, such as by a previous process that crashed
+// before it could flush them. If enough of these accumulate, the TPM will
+// run out of object or session slots and subsequent operations will fail.
+// This can be called early during boot (eg, at the start of the initrd) in
+// order to recover from this.
+//
+// The transient objects and sessions that were created with this connection
+// and that haven't been flushed, including its HMAC session, are not flushed.
+// Any other transient objects or sessions that are visible to this connection
+// are considered to be stale, so this must not be called whilst other
+// operations are in progress on the TPM from another process. Note that when
+// the connection uses the kernel's resource manager, only resources created
+// with the same file descriptor are visible, and the resource manager already
+// flushes these when the file descriptor is closed.
+//
+// This can't be used with a connection created with
+// NewConnectionWithExternalHmacSession, as the resources created with the
+// caller's TPM context aren't tracked.
+//
+// On success, this returns the handles that were flushed.
+func (t *Connection) CleanupStaleResources() (flushed tpm2.HandleList, err error) {
+	if t.transport == nil {
+		return nil, errors.New("cannot determine which resources are owned by this connection")
+	}
+
+	for _, first := range []tpm2.Handle{tpm2.HandleTypeTransient.BaseHandle(), tpm2.HandleTypeLoadedSession.BaseHandle()} {
+		handles, err := t.GetCapabilityHandles(first, tpm2.CapabilityMaxProperties)
+		if err != nil {
+			return flushed, xerrors.Errorf("cannot obtain handles for type %v: %w", first.Type(), err)
+		}
+
+		for _, handle := range handles {
+			if !isHandleInRange(handle, first) {
+				break
+			}
+			if t.transport.handles.isOwned(handle) {
+				continue
+			}
+			if err := t.FlushContext(tpm2.NewHandleContext(handle)); err != nil {
+				return flushed, xerrors.Errorf("cannot flush %v: %w", handle, err)
+			}
+			flushed = append(flushed, handle)
+		}
+	}
+
+	return flushed, nil
+}
@@ -0,0 +1,75 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type handleTrackerSuite struct{}
+
+var _ = Suite(&handleTrackerSuite{})
+
+func (s *handleTrackerSuite) TestTrackCreatedHandle(c *C) {
+	var tracker HandleTracker
+
+	// TPM2_StartAuthSession
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80010000002b00000176"))
+	// The response can be read in more than one part.
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80010000002000000000"))
+	c.Check(tracker.IsOwned(0x02000000), testutil.IsFalse)
+	tracker.ResponseRead(testutil.DecodeHexString(c, "02000000"))
+	c.Check(tracker.IsOwned(0x02000000), testutil.IsTrue)
+
+	// TPM2_FlushContext
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80010000000e0000016502000000"))
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80010000000a00000000"))
+	c.Check(tracker.IsOwned(0x02000000), testutil.IsFalse)
+}
+
+func (s *handleTrackerSuite) TestTrackFailedCommand(c *C) {
+	var tracker HandleTracker
+
+	// TPM2_LoadExternal, failing with TPM_RC_BINDING.
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80010000002000000167"))
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80010000000a000000a5"))
+
+	// A subsequent unrelated command doesn't change anything.
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80010000000c0000017b0010"))
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80010000001c00000000800000ff"))
+	c.Check(tracker.IsOwned(0x800000ff), testutil.IsFalse)
+}
+
+func (s *handleTrackerSuite) TestFlushFailed(c *C) {
+	var tracker HandleTracker
+
+	// TPM2_CreatePrimary
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80020000004300000131"))
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80020000010000000000800000ff"))
+	c.Check(tracker.IsOwned(0x800000ff), testutil.IsTrue)
+
+	// TPM2_FlushContext, failing with TPM_RC_HANDLE.
+	tracker.CommandSubmitted(testutil.DecodeHexString(c, "80010000000e00000165800000ff"))
+	tracker.ResponseRead(testutil.DecodeHexString(c, "80010000000a0000018b"))
+	c.Check(tracker.IsOwned(0x800000ff), testutil.IsTrue)
+}
@@ -0,0 +1,335 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	internal_efi "github.com/snapcore/secboot/internal/efi"
+)
+
+// TPMSupportBundleProperty is a single TPM property recorded in a
+// TPMSupportBundle.
+type TPMSupportBundleProperty struct {
+	Property tpm2.Property `json:"property"`
+	Value    uint32        `json:"value"`
+}
+
+// TPMSupportBundleObject describes a persistent object recorded in a
+// TPMSupportBundle.
+type TPMSupportBundleObject struct {
+	Handle tpm2.Handle `json:"handle"`
+	Name   tpm2.Name   `json:"name"`
+}
+
+// TPMSupportBundleNVIndex describes the metadata of a NV index recorded in a
+// TPMSupportBundle. The contents of the index are not recorded.
+type TPMSupportBundleNVIndex struct {
+	Handle  tpm2.Handle          `json:"handle"`
+	Name    tpm2.Name            `json:"name"`
+	NameAlg tpm2.HashAlgorithmId `json:"name-alg"`
+	Attrs   tpm2.NVAttributes    `json:"attrs"`
+	Size    uint16               `json:"size"`
+}
+
+// TPMSupportBundleLogSummary is a summary of the digests in a TCG event log,
+// recorded in a TPMSupportBundle.
+type TPMSupportBundleLogSummary struct {
+	// Algorithms are the digest algorithms that appear in the log.
+	Algorithms []tpm2.HashAlgorithmId `json:"algorithms"`
+
+	// EventCounts is the number of events measured to each PCR.
+	EventCounts map[int]int `json:"event-counts"`
+
+	// PCRValues are the PCR values obtained by replaying the digests in the
+	// log, for each of the PCR banks that are also allocated on the TPM.
+	PCRValues tpm2.PCRValues `json:"pcr-values"`
+
+	// Mismatches are the PCRs for which the values obtained by replaying the
+	// log are not consistent with the values read from the TPM.
+	Mismatches tpm2.PCRSelectionList `json:"mismatches"`
+
+	// ReplayError describes why the log could not be replayed, in which
+	// case there are no event counts or PCR values.
+	ReplayError string `json:"replay-error,omitempty"`
+}
+
+// TPMSupportBundle is a snapshot of the state of a TPM that is relevant to
+// diagnosing failures to unseal keys, and is suitable for attaching to bug
+// reports. It doesn't contain any secrets - objects and NV indices are only
+// recorded by their names, and the contents of NV indices are not recorded.
+type TPMSupportBundle struct {
+	FixedProperties    []TPMSupportBundleProperty `json:"fixed-properties"`
+	VariableProperties []TPMSupportBundleProperty `json:"variable-properties"`
+	Algorithms         []tpm2.AlgorithmId         `json:"algorithms"`
+	Clock              *tpm2.ClockInfo            `json:"clock"`
+
+	// PCRBanks are the currently allocated PCR banks.
+	PCRBanks tpm2.PCRSelectionList `json:"pcr-banks"`
+
+	// PCRUpdateCounter and PCRValues are the values of all allocated PCRs.
+	PCRUpdateCounter uint32         `json:"pcr-update-counter"`
+	PCRValues        tpm2.PCRValues `json:"pcr-values"`
+
+	PersistentObjects []TPMSupportBundleObject  `json:"persistent-objects"`
+	NVIndices         []TPMSupportBundleNVIndex `json:"nv-indices"`
+
+	// EventLog is a summary of the TCG event log, if one was supplied to
+	// CollectTPMSupportBundle.
+	EventLog *TPMSupportBundleLogSummary `json:"event-log,omitempty"`
+}
+
+func (t *Connection) getSupportBundleProperties(first tpm2.Property) (out []TPMSupportBundleProperty, err error) {
+	props, err := t.GetCapabilityTPMProperties(first, tpm2.CapabilityMaxProperties)
+	if err != nil {
+		return nil, err
+	}
+	for _, prop := range props {
+		if prop.Property&0xffffff00 != first {
+			// Only record properties from the requested group.
+			break
+		}
+		out = append(out, TPMSupportBundleProperty{Property: prop.Property, Value: prop.Value})
+	}
+	return out, nil
+}
+
+func (t *Connection) getSupportBundleHandles(first tpm2.Handle) (tpm2.HandleList, error) {
+	handles, err := t.GetCapabilityHandles(first, tpm2.CapabilityMaxProperties)
+	if err != nil {
+		return nil, err
+	}
+	var out tpm2.HandleList
+	for _, handle := range handles {
+		if handle.Type() != first.Type() {
+			break
+		}
+		out = append(out, handle)
+	}
+	return out, nil
+}
+
+// summarizeEventLog replays the digests in the supplied event log for the
+// specified PCR banks. If the log cannot be replayed, the error is recorded in
+// the summary rather than being returned, because the log is still useful for
+// diagnosing the failure.
+func summarizeEventLog(log *tcglog.Log, banks tpm2.PCRSelectionList) *TPMSupportBundleLogSummary {
+	summary := &TPMSupportBundleLogSummary{
+		EventCounts: make(map[int]int),
+		PCRValues:   make(tpm2.PCRValues),
+	}
+
+	summary.Algorithms = append(summary.Algorithms, log.Algorithms...)
+
+	replay, err := internal_efi.ReplayEventLog(log)
+	if err != nil {
+		summary.ReplayError = err.Error()
+		return summary
+	}
+
+	for _, pcr := range replay.PCRs() {
+		if n := len(replay.Events(pcr)); n > 0 {
+			summary.EventCounts[int(pcr)] = n
+		}
+	}
+
+	for _, bank := range banks {
+		if !bank.Hash.Available() || !log.Algorithms.Contains(bank.Hash) {
+			continue
+		}
+		summary.PCRValues[bank.Hash] = make(map[int]tpm2.Digest)
+		for _, pcr := range replay.PCRs() {
+			summary.PCRValues[bank.Hash][int(pcr)] = replay.PCRValue(bank.Hash, pcr)
+		}
+	}
+
+	return summary
+}
+
+// findEventLogMismatches returns the PCRs for which the values in the supplied
+// summary are inconsistent with the supplied PCR values read from the TPM. A
+// PCR without any events in the log is only inconsistent if the TPM value isn't
+// the reset value.
+func findEventLogMismatches(summary *TPMSupportBundleLogSummary, values tpm2.PCRValues) tpm2.PCRSelectionList {
+	var algs []tpm2.HashAlgorithmId
+	for alg := range summary.PCRValues {
+		algs = append(algs, alg)
+	}
+	sort.Slice(algs, func(i, j int) bool { return algs[i] < algs[j] })
+
+	var out tpm2.PCRSelectionList
+	for _, alg := range algs {
+		pcrs := summary.PCRValues[alg]
+		sel := tpm2.PCRSelection{Hash: alg}
+		for pcr, tpmValue := range values[alg] {
+			expected, exists := pcrs[pcr]
+			if !exists {
+				if _, measured := summary.EventCounts[pcr]; !measured {
+					// Nothing in the log for this PCR.
+					continue
+				}
+				expected = make(tpm2.Digest, alg.Size())
+			}
+			if !bytes.Equal(expected, tpmValue) {
+				sel.Select = append(sel.Select, pcr)
+			}
+		}
+		if len(sel.Select) > 0 {
+			sort.Ints(sel.Select)
+			out = append(out, sel)
+		}
+	}
+	return out
+}
+
+// CollectTPMSupportBundle collects a snapshot of the state of the TPM that is
+// relevant to diagnosing failures to unseal keys. This consists of the fixed
+// and variable TPM properties, the supported algorithms, the clock information,
+// the allocated PCR banks and the values of all allocated PCRs, and the names
+// of all persistent objects and the metadata of all NV indices.
+//
+// If a TCG event log is supplied, a summary of its digests is also recorded,
+// including the PCRs for which replaying the log produces values that are
+// inconsistent with the values read from the TPM. The log can be nil.
+//
+// The returned bundle doesn't contain any secrets, and can be serialized with
+// TPMSupportBundle.Write in order to attach it to a bug report.
+func (t *Connection) CollectTPMSupportBundle(log *tcglog.Log) (*TPMSupportBundle, error) {
+	bundle := new(TPMSupportBundle)
+
+	var err error
+	bundle.FixedProperties, err = t.getSupportBundleProperties(tpm2.PropertyFixed)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain fixed properties: %w", err)
+	}
+	bundle.VariableProperties, err = t.getSupportBundleProperties(tpm2.PropertyVar)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain variable properties: %w", err)
+	}
+
+	algs, err := t.GetCapabilityAlgs(tpm2.AlgorithmFirst, tpm2.CapabilityMaxProperties)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain supported algorithms: %w", err)
+	}
+	for _, alg := range algs {
+		bundle.Algorithms = append(bundle.Algorithms, alg.Alg)
+	}
+
+	timeInfo, err := t.ReadClock()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read clock: %w", err)
+	}
+	bundle.Clock = &timeInfo.ClockInfo
+
+	bundle.PCRBanks, err = t.GetCapabilityPCRs()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain PCR banks: %w", err)
+	}
+
+	var pcrs tpm2.PCRSelectionList
+	for _, bank := range bundle.PCRBanks {
+		if len(bank.Select) == 0 {
+			continue
+		}
+		pcrs = append(pcrs, bank)
+	}
+	bundle.PCRUpdateCounter, bundle.PCRValues, err = t.PCRRead(pcrs)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+	}
+
+	persistent, err := t.getSupportBundleHandles(tpm2.HandleTypePersistent.BaseHandle())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain persistent handles: %w", err)
+	}
+	for _, handle := range persistent {
+		rc, err := t.NewResourceContext(handle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			// The object was evicted since obtaining the handles.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for persistent object %v: %w", handle, err)
+		}
+		bundle.PersistentObjects = append(bundle.PersistentObjects, TPMSupportBundleObject{
+			Handle: handle,
+			Name:   rc.Name()})
+	}
+
+	nvIndices, err := t.getSupportBundleHandles(tpm2.HandleTypeNVIndex.BaseHandle())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+	for _, handle := range nvIndices {
+		pub, name, err := t.NVReadPublic(tpm2.NewLimitedHandleContext(handle))
+		switch {
+		case tpm2.IsTPMHandleError(err, tpm2.ErrorHandle, tpm2.AnyCommandCode, tpm2.AnyHandleIndex):
+			// The index was undefined since obtaining the handles.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read public area of NV index %v: %w", handle, err)
+		}
+		bundle.NVIndices = append(bundle.NVIndices, TPMSupportBundleNVIndex{
+			Handle:  handle,
+			Name:    name,
+			NameAlg: pub.NameAlg,
+			Attrs:   pub.Attrs,
+			Size:    pub.Size})
+	}
+
+	if log != nil {
+		bundle.EventLog = summarizeEventLog(log, bundle.PCRBanks)
+		bundle.EventLog.Mismatches = findEventLogMismatches(bundle.EventLog, bundle.PCRValues)
+	}
+
+	return bundle, nil
+}
+
+// Write serializes this bundle to the supplied writer.
+func (b *TPMSupportBundle) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return xerrors.Errorf("cannot encode TPM support bundle: %w", err)
+	}
+	return nil
+}
+
+// ReadTPMSupportBundle reads a bundle previously serialized with
+// TPMSupportBundle.Write from the supplied reader.
+func ReadTPMSupportBundle(r io.Reader) (*TPMSupportBundle, error) {
+	var b *TPMSupportBundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, xerrors.Errorf("cannot decode TPM support bundle: %w", err)
+	}
+	if b == nil {
+		return nil, errors.New("no TPM support bundle")
+	}
+	return b, nil
+}
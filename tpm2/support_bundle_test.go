@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/efitest"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type supportBundleSuiteNoTPM struct{}
+
+type supportBundleSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *supportBundleSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&supportBundleSuiteNoTPM{})
+var _ = Suite(&supportBundleSuite{})
+
+var allPCRs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}
+
+func (s *supportBundleSuiteNoTPM) TestSummarizeEventLog(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	summary := SummarizeEventLog(log, tpm2.PCRSelectionList{
+		{Hash: tpm2.HashAlgorithmSHA1, Select: allPCRs},
+		{Hash: tpm2.HashAlgorithmSHA256, Select: allPCRs}})
+	c.Check(summary.Algorithms, DeepEquals, []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256})
+
+	// The SHA1 bank isn't in the log.
+	c.Check(summary.PCRValues, HasLen, 1)
+	c.Assert(summary.PCRValues, testutil.HasKey, tpm2.HashAlgorithmSHA256)
+
+	for _, pcr := range []int{0, 1, 2, 3, 4, 5, 6, 7} {
+		c.Check(summary.EventCounts[pcr] > 0, testutil.IsTrue)
+		c.Check(summary.PCRValues[tpm2.HashAlgorithmSHA256], testutil.HasKey, pcr)
+	}
+	c.Check(summary.Mismatches, HasLen, 0)
+}
+
+func (s *supportBundleSuiteNoTPM) TestSummarizeEventLogStartupLocality(c *C) {
+	banks := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: allPCRs}}
+
+	summary0 := SummarizeEventLog(efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}}), banks)
+	summary3 := SummarizeEventLog(efitest.NewLog(c, &efitest.LogOptions{
+		Algorithms:      []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256},
+		StartupLocality: 3}), banks)
+
+	// The startup locality affects PCR0 only, and isn't counted as a measurement.
+	c.Check(summary3.PCRValues[tpm2.HashAlgorithmSHA256][0], Not(DeepEquals), summary0.PCRValues[tpm2.HashAlgorithmSHA256][0])
+	c.Check(summary3.PCRValues[tpm2.HashAlgorithmSHA256][7], DeepEquals, summary0.PCRValues[tpm2.HashAlgorithmSHA256][7])
+	c.Check(summary3.EventCounts, DeepEquals, summary0.EventCounts)
+}
+
+func (s *supportBundleSuiteNoTPM) TestFindEventLogMismatchesNone(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	summary := SummarizeEventLog(log, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: allPCRs}})
+
+	values := make(tpm2.PCRValues)
+	for _, pcr := range allPCRs {
+		value, exists := summary.PCRValues[tpm2.HashAlgorithmSHA256][pcr]
+		if !exists {
+			value = make(tpm2.Digest, 32)
+		}
+		c.Check(values.SetValue(tpm2.HashAlgorithmSHA256, pcr, value), IsNil)
+	}
+	// PCR 23 has no events in the log and isn't checked.
+	c.Check(values.SetValue(tpm2.HashAlgorithmSHA256, 23, testutil.DecodeHexString(c, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")), IsNil)
+
+	c.Check(FindEventLogMismatches(summary, values), HasLen, 0)
+}
+
+func (s *supportBundleSuiteNoTPM) TestFindEventLogMismatches(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	summary := SummarizeEventLog(log, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: allPCRs}})
+
+	values := make(tpm2.PCRValues)
+	for pcr, value := range summary.PCRValues[tpm2.HashAlgorithmSHA256] {
+		c.Check(values.SetValue(tpm2.HashAlgorithmSHA256, pcr, value), IsNil)
+	}
+	c.Check(values.SetValue(tpm2.HashAlgorithmSHA256, 4, make(tpm2.Digest, 32)), IsNil)
+	c.Check(values.SetValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")), IsNil)
+
+	c.Check(FindEventLogMismatches(summary, values), DeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}})
+}
+
+func (s *supportBundleSuiteNoTPM) TestReadTPMSupportBundleEmpty(c *C) {
+	_, err := ReadTPMSupportBundle(bytes.NewReader([]byte("null")))
+	c.Check(err, ErrorMatches, `no TPM support bundle`)
+}
+
+func (s *supportBundleSuite) TestCollectTPMSupportBundle(c *C) {
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+
+	srk, err := s.TPM().NewResourceContext(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+
+	bundle, err := s.TPM().CollectTPMSupportBundle(nil)
+	c.Assert(err, IsNil)
+
+	c.Check(bundle.FixedProperties, Not(HasLen), 0)
+	for _, prop := range bundle.FixedProperties {
+		c.Check(prop.Property&0xffffff00, Equals, tpm2.PropertyFixed)
+	}
+	c.Check(bundle.VariableProperties, Not(HasLen), 0)
+	for _, prop := range bundle.VariableProperties {
+		c.Check(prop.Property&0xffffff00, Equals, tpm2.PropertyVar)
+	}
+	c.Check(tpm2.AlgorithmSHA256, testutil.InSlice(Equals), bundle.Algorithms)
+	c.Check(bundle.Clock, NotNil)
+
+	banks, err := s.TPM().GetCapabilityPCRs()
+	c.Assert(err, IsNil)
+	c.Check(bundle.PCRBanks, DeepEquals, banks)
+	c.Check(bundle.PCRValues[tpm2.HashAlgorithmSHA256], HasLen, 24)
+
+	c.Check(TPMSupportBundleObject{Handle: tcg.SRKHandle, Name: srk.Name()}, testutil.InSlice(DeepEquals), bundle.PersistentObjects)
+	c.Check(bundle.EventLog, IsNil)
+
+	// No secrets are recorded, and the bundle survives a round trip.
+	w := new(bytes.Buffer)
+	c.Check(bundle.Write(w), IsNil)
+	recovered, err := ReadTPMSupportBundle(w)
+	c.Check(err, IsNil)
+	c.Check(recovered, DeepEquals, bundle)
+}
+
+func (s *supportBundleSuite) TestCollectTPMSupportBundleNVIndex(c *C) {
+	index := s.NVDefineSpace(c, tpm2.HandleOwner, nil, &tpm2.NVPublic{
+		Index:   0x01800000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+
+	bundle, err := s.TPM().CollectTPMSupportBundle(nil)
+	c.Assert(err, IsNil)
+	c.Check(TPMSupportBundleNVIndex{
+		Handle:  index.Handle(),
+		Name:    index.Name(),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}, testutil.InSlice(DeepEquals), bundle.NVIndices)
+}
+
+func (s *supportBundleSuite) TestCollectTPMSupportBundleWithEventLog(c *C) {
+	log := efitest.NewLog(c, &efitest.LogOptions{Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+
+	bundle, err := s.TPM().CollectTPMSupportBundle(log)
+	c.Assert(err, IsNil)
+	c.Assert(bundle.EventLog, NotNil)
+	c.Check(bundle.EventLog.Algorithms, DeepEquals, []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256})
+
+	// The log doesn't correspond to the measurements made to the TPM.
+	c.Check(bundle.EventLog.Mismatches, Not(HasLen), 0)
+}
@@ -20,12 +20,15 @@
 package tpm2
 
 import (
+	"context"
 	_ "crypto/sha256"
+	"errors"
 
 	"github.com/canonical/go-tpm2"
 
 	"golang.org/x/xerrors"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
 	"github.com/snapcore/secboot/internal/tcti"
 )
@@ -35,6 +38,20 @@ type Connection struct {
 	*tpm2.TPMContext
 	provisionedSrk tpm2.ResourceContext
 	hmacSession    tpm2.SessionContext
+	externalHmac   bool         // TPMContext and hmacSession are owned by the caller
+	ekPublic       *tpm2.Public // the public area of the key used to salt hmacSession
+	transport      *contextTransport
+	auditLog       *ProvisioningAuditLog
+
+	// releaseHmacSession releases the reservation for hmacSession
+	// from the resource budget.
+	releaseHmacSession func()
+
+	// releaseDevice releases the reservation for the file descriptor
+	// of the TPM device from the resource budget.
+	releaseDevice func()
+
+	nvParamEncryption NVParameterEncryption
 }
 
 // IsEnabled indicates whether the TPM is enabled or whether it has been disabled by the platform firmware. A TPM device can be
@@ -69,6 +86,9 @@ func (t *Connection) LockoutAuthSet() bool {
 // package due to limitations in the way that TPM2_Unseal works, and the fact that the
 // platform firmware doesn't integrity protect commands that are critical to measured
 // boot such as PCR extends.
+//
+// If the connection was created with NewConnectionWithExternalHmacSession, this
+// returns the session supplied by the caller.
 func (t *Connection) HmacSession() tpm2.SessionContext {
 	if t.hmacSession == nil {
 		return nil
@@ -76,19 +96,46 @@ func (t *Connection) HmacSession() tpm2.SessionContext {
 	return t.hmacSession.WithAttrs(tpm2.AttrContinueSession)
 }
 
+// Close closes the connection to the TPM. If the connection was created with
+// NewConnectionWithExternalHmacSession, the TPM context and session are owned by
+// the caller and are left open.
 func (t *Connection) Close() error {
+	if t.externalHmac {
+		return nil
+	}
 	t.FlushContext(t.hmacSession)
-	return t.TPMContext.Close()
+	if t.releaseHmacSession != nil {
+		t.releaseHmacSession()
+	}
+	err := t.TPMContext.Close()
+	if t.releaseDevice != nil {
+		t.releaseDevice()
+	}
+	return err
 }
 
 func (t *Connection) init() (err error) {
+	if t.externalHmac {
+		// The session is owned by the caller, who is responsible for
+		// verifying it, so keep using it.
+		t.provisionedSrk = nil
+		t.ekPublic = nil
+		return nil
+	}
+
 	// Allow init to be called more than once by flushing the previous session
 	if t.hmacSession != nil && t.hmacSession.Handle() != tpm2.HandleUnassigned {
 		t.FlushContext(t.hmacSession)
 		t.hmacSession = nil
 	}
+	if t.releaseHmacSession != nil {
+		t.releaseHmacSession()
+		t.releaseHmacSession = nil
+	}
 	t.provisionedSrk = nil
+	t.ekPublic = nil
 
+	var ekPublic *tpm2.Public
 	ek, err := t.CreateResourceContextFromTPM(tcg.EKHandle)
 	switch {
 	case tpm2.IsResourceUnavailableError(err, tcg.EKHandle):
@@ -106,6 +153,8 @@ func (t *Connection) init() (err error) {
 
 		if !pub.IsAsymmetric() || !pub.IsStorageParent() || pub.Attrs&(tpm2.AttrFixedParent|tpm2.AttrFixedTPM) != tpm2.AttrFixedParent|tpm2.AttrFixedTPM {
 			ek = nil
+		} else {
+			ekPublic = pub
 		}
 	}
 
@@ -121,32 +170,46 @@ func (t *Connection) init() (err error) {
 		}
 	}
 
+	release, err := secboot.ReserveTPMSessions(1)
+	if err != nil {
+		return xerrors.Errorf("cannot create HMAC session: %w", err)
+	}
 	session, err := t.StartAuthSession(ek, nil, tpm2.SessionTypeHMAC, symmetric, defaultSessionHashAlgorithm, nil)
 	if err != nil {
+		release()
 		return xerrors.Errorf("cannot create HMAC session: %w", err)
 	}
 
 	t.hmacSession = session
+	t.releaseHmacSession = release
+	t.ekPublic = ekPublic
 	return nil
 }
 
-// connectToDefaultTPM opens a connection to the default TPM device.
-func connectToDefaultTPM() (*tpm2.TPMContext, error) {
+// connectToDefaultTPM opens a connection to the default TPM device, using the
+// supplied context for the initial commands.
+func connectToDefaultTPM(ctx context.Context) (*tpm2.TPMContext, *contextTransport, error) {
 	tcti, err := tcti.OpenDefault()
 	if err != nil {
 		if isPathError(err) {
-			return nil, ErrNoTPM2Device
+			return nil, nil, ErrNoTPM2Device
 		}
-		return nil, xerrors.Errorf("cannot open TPM device: %w", err)
+		return nil, nil, xerrors.Errorf("cannot open TPM device: %w", err)
 	}
 
-	tpm := tpm2.NewTPMContext(tcti)
+	transport := newContextTransport(tcti)
+	defer transport.setContext(ctx)()
+
+	tpm := tpm2.NewTPMContext(transport)
 	if !tpm.IsTPM2() {
 		tpm.Close()
-		return nil, ErrNoTPM2Device
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrNoTPM2Device
 	}
 
-	return tpm, nil
+	return tpm, transport, nil
 }
 
 // ConnectToDefaultTPM will attempt to connect to the default TPM. It makes no attempt to verify the authenticity of the TPM. This
@@ -156,12 +219,32 @@ func connectToDefaultTPM() (*tpm2.TPMContext, error) {
 //
 // If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
 func ConnectToDefaultTPM() (*Connection, error) {
-	tpm, err := connectToDefaultTPM()
+	return ConnectToDefaultTPMContext(context.Background())
+}
+
+// ConnectToDefaultTPMContext is a variant of ConnectToDefaultTPM that accepts a
+// context, which is used for the commands required to initialize the connection.
+// See Connection.RunWithContext for details of how to use a context with the
+// returned connection.
+func ConnectToDefaultTPMContext(ctx context.Context) (conn *Connection, err error) {
+	r := beginOperation(OperationConnect, nil)
+	defer func() {
+		r.end(err)
+	}()
+
+	releaseDevice, err := secboot.ReserveFileDescriptors(1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open TPM device: %w", err)
+	}
+
+	tpm, transport, err := connectToDefaultTPM(ctx)
 	if err != nil {
+		releaseDevice()
 		return nil, err
 	}
+	r.setNewTransport(transport)
 
-	t := &Connection{TPMContext: tpm}
+	t := &Connection{TPMContext: tpm, transport: transport, releaseDevice: releaseDevice}
 
 	succeeded := false
 	defer func() {
@@ -171,7 +254,7 @@ func ConnectToDefaultTPM() (*Connection, error) {
 		t.Close()
 	}()
 
-	if err := t.init(); err != nil {
+	if err := t.RunWithContext(ctx, t.init); err != nil {
 		return nil, xerrors.Errorf("cannot initialize TPM connection: %w", err)
 	}
 
@@ -179,9 +262,49 @@ func ConnectToDefaultTPM() (*Connection, error) {
 	return t, nil
 }
 
+// NewConnectionWithExternalHmacSession returns a Connection for the supplied TPM
+// context that uses the supplied HMAC session for all operations instead of
+// creating its own. This is useful for callers that already maintain a session
+// that is salted with a verified endorsement key, such as a long-running agent,
+// as it avoids verifying the endorsement key again and consuming an additional
+// session slot on the TPM.
+//
+// The session must be a HMAC session that was started with the supplied TPM
+// context. It should be salted and have a symmetric algorithm for parameter
+// encryption, else the APIs that require parameter encryption will fail. The
+// caller retains ownership of both the TPM context and the session, and neither
+// is closed or flushed by Close or when the connection is reinitialized during
+// provisioning.
+//
+// The returned connection can be passed to the seal and provisioning APIs, and
+// the session is used for parameter encryption when sealing instead of starting
+// a new one. To use it for unsealing and the other operations performed by the
+// platform handler, override ConnectToTPM and ConnectToTPMContext to return it.
+func NewConnectionWithExternalHmacSession(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*Connection, error) {
+	if tpm == nil {
+		return nil, errors.New("no TPM context")
+	}
+	if session == nil || session.Handle().Type() != tpm2.HandleTypeHMACSession {
+		return nil, errors.New("invalid HMAC session")
+	}
+
+	return &Connection{
+		TPMContext:   tpm,
+		hmacSession:  session,
+		externalHmac: true}, nil
+}
+
 // ConnectToTPM will attempt to connect to a TPM using the currently
 // defined connection function. This is used internally by the tpm2
 // package when a connection is required, and defaults to
 // ConnectToDefaultTPM. This can be overridden with a custom connection
 // function.
 var ConnectToTPM func() (*Connection, error) = ConnectToDefaultTPM
+
+// ConnectToTPMContext is a variant of ConnectToTPM that accepts a context. This
+// is used internally by the tpm2 package when a connection is required for an
+// operation that can be cancelled or time out, such as recovering keys for the
+// platform handler, and defaults to ConnectToDefaultTPMContext. If ConnectToTPM
+// is overridden with a custom connection function, this should be overridden
+// as well.
+var ConnectToTPMContext func(ctx context.Context) (*Connection, error) = ConnectToDefaultTPMContext
@@ -33,6 +33,7 @@ import (
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
 	"github.com/snapcore/secboot/internal/testutil"
 	"github.com/snapcore/secboot/internal/tpm2test"
@@ -208,3 +209,123 @@ func (s *tpmSuiteNoTPM) TestConnectToDefaultTPM12(c *C) {
 	c.Check(err, Equals, ErrNoTPM2Device)
 	c.Check(tpm, IsNil)
 }
+
+func (s *tpmSuiteNoTPM) TestConnectToDefaultTPMFileDescriptorBudget(c *C) {
+	restore := tpm2test.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		return &mockTPM12Transport{}, nil
+	})
+	s.AddCleanup(restore)
+
+	secboot.SetResourceBudget(secboot.ResourceBudget{MaxFileDescriptors: 1})
+	defer secboot.SetResourceBudget(secboot.ResourceBudget{})
+
+	release, err := secboot.ReserveFileDescriptors(1)
+	c.Assert(err, IsNil)
+
+	_, err = ConnectToDefaultTPM()
+	c.Check(err, ErrorMatches, `cannot open TPM device: file-descriptors budget exceeded: 1 requested with 1 of 1 in use`)
+	release()
+
+	// The reservation should be released if the connection fails.
+	_, err = ConnectToDefaultTPM()
+	c.Check(err, Equals, ErrNoTPM2Device)
+	release, err = secboot.ReserveFileDescriptors(1)
+	c.Check(err, IsNil)
+	release()
+}
+
+func (s *tpmSuite) TestNewConnectionWithExternalHmacSession(c *C) {
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
+
+	tpm, err := NewConnectionWithExternalHmacSession(s.TPM().TPMContext, session)
+	c.Assert(err, IsNil)
+	c.Check(tpm.HmacSession().Handle(), Equals, session.Handle())
+	c.Check(tpm.HmacSession().Attrs()&tpm2.AttrContinueSession, Equals, tpm2.AttrContinueSession)
+
+	// Use the session to authorize a command.
+	pub := tpm2.NVPublic{
+		Index:   0x0181ff00,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &pub, tpm.HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession()), IsNil)
+
+	// Closing the connection shouldn't close the caller's TPM context
+	// or flush the session.
+	c.Check(tpm.Close(), IsNil)
+
+	// The session should still be loaded.
+	handles, err := s.TPM().GetCapabilityHandles(tpm2.HandleTypeHMACSession.BaseHandle(), tpm2.CapabilityMaxProperties)
+	c.Check(err, IsNil)
+	var found bool
+	for _, h := range handles {
+		if h == session.Handle() {
+			found = true
+		}
+	}
+	c.Check(found, testutil.IsTrue)
+}
+
+func (s *tpmSuiteNoTPM) TestNewConnectionWithExternalHmacSessionNoSession(c *C) {
+	_, err := NewConnectionWithExternalHmacSession(new(tpm2.TPMContext), nil)
+	c.Check(err, ErrorMatches, `invalid HMAC session`)
+}
+
+func (s *tpmSuiteNoTPM) TestNewConnectionWithExternalHmacSessionNoTPM(c *C) {
+	_, err := NewConnectionWithExternalHmacSession(nil, nil)
+	c.Check(err, ErrorMatches, `no TPM context`)
+}
+
+func (s *tpmSuite) TestCleanupStaleResources(c *C) {
+	// Leave some resources loaded using another context that shares the
+	// same transport, as if they had been leaked by a process that crashed.
+	other := tpm2.NewTPMContext(s.TCTI())
+	policySession, err := other.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	hmacSession, err := other.StartAuthSession(nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+
+	pub := &tpm2.Public{
+		Type:    tpm2.ObjectTypeKeyedHash,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrUserWithAuth,
+		Params:  &tpm2.PublicParamsU{KeyedHashDetail: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+	object, err := other.LoadExternal(nil, pub, tpm2.HandleNull)
+	c.Assert(err, IsNil)
+
+	// Load an object with the connection, which it owns.
+	owned, err := s.TPM().LoadExternal(nil, pub, tpm2.HandleNull)
+	c.Assert(err, IsNil)
+
+	flushed, err := s.TPM().CleanupStaleResources()
+	c.Check(err, IsNil)
+	c.Check(flushed, DeepEquals, tpm2.HandleList{object.Handle(), policySession.Handle(), hmacSession.Handle()})
+
+	// Only the resources owned by the connection should remain.
+	handles, err := s.TPM().GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	c.Check(err, IsNil)
+	c.Check(handles, DeepEquals, tpm2.HandleList{owned.Handle()})
+
+	handles, err = s.TPM().GetCapabilityHandles(tpm2.HandleTypeLoadedSession.BaseHandle(), tpm2.CapabilityMaxProperties)
+	c.Check(err, IsNil)
+	c.Check(handles, DeepEquals, tpm2.HandleList{s.TPM().HmacSession().Handle()})
+}
+
+func (s *tpmSuite) TestCleanupStaleResourcesExternalHmacSession(c *C) {
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
+
+	tpm, err := NewConnectionWithExternalHmacSession(s.TPM().TPMContext, session)
+	c.Assert(err, IsNil)
+
+	_, err = tpm.CleanupStaleResources()
+	c.Check(err, ErrorMatches, `cannot determine which resources are owned by this connection`)
+}
+
+func (s *tpmSuite) TestCleanupStaleResourcesNone(c *C) {
+	flushed, err := s.TPM().CleanupStaleResources()
+	c.Check(err, IsNil)
+	c.Check(flushed, HasLen, 0)
+	c.Check(s.TPM().HmacSession().Handle().Type(), Equals, tpm2.HandleTypeHMACSession)
+}
@@ -26,13 +26,14 @@ import (
 
 	"golang.org/x/xerrors"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
 )
 
 const (
 	tryPersistentSRK = iota
 	tryTransientSRK
-	tryMax
+	tryNullHierarchyPrimary
 )
 
 // loadForUnseal loads the sealed key object into the TPM and returns a context
@@ -42,21 +43,35 @@ const (
 // function will try to create a transient SRK and then retry loading of the sealed
 // key object by specifying the newly created transient object as the parent.
 //
-// If both attempts to load the sealed key object fail, or if the first attempt fails
-// and a transient SRK cannot be created, an error will be returned.
+// If the sealed key object was created with ProtectKeyParams.NullHierarchyDevMode,
+// this function only tries to load it by specifying an ephemeral primary key in the
+// null hierarchy as the parent.
 //
-// If a transient SRK is created, it is flushed from the TPM before this function
-// returns.
+// If all attempts to load the sealed key object fail, an error will be returned.
+//
+// If a transient SRK or null hierarchy primary key is created, it is flushed from the
+// TPM before this function returns.
+//
+// If startPolicySession is true, a policy session for unsealing the sealed key object
+// is also started and returned. Otherwise, the returned policy session is nil.
 //
 // If session is supplied, it must be a HMAC session with the AttrContinueSession attribute
 // set, used for authenticating the use of the storage hirearchy if a transient strorage
 // primary key needs to be created, in order to avoid transmitting the cleartext authorzation
-// value.
-func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.SessionContext) (keyObject tpm2.ResourceContext, policySession tpm2.SessionContext, err error) {
-	for try := tryPersistentSRK; try <= tryMax; try++ {
+// value. The srkTemplateReadAttrs argument is passed to selectSrkTemplate when creating a
+// transient SRK, and should match the attributes used when the key was sealed so that the
+// same template is selected.
+func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.SessionContext, srkTemplateReadAttrs tpm2.SessionAttributes, startPolicySession bool) (keyObject tpm2.ResourceContext, policySession tpm2.SessionContext, err error) {
+	first, last := tryPersistentSRK, tryTransientSRK
+	if k.nullHierarchyDevMode() {
+		first, last = tryNullHierarchyPrimary, tryNullHierarchyPrimary
+	}
+
+	for try := first; try <= last; try++ {
 		var srk tpm2.ResourceContext
 		var thisErr error
-		if try == tryPersistentSRK {
+		switch try {
+		case tryPersistentSRK:
 			srk, thisErr = tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
 			if tpm2.IsResourceUnavailableError(thisErr, tcg.SRKHandle) {
 				// No SRK - save the error and try creating a transient
@@ -66,8 +81,8 @@ func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.Ses
 				// This is an unexpected error
 				return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", thisErr)
 			}
-		} else {
-			srk, _, _, _, _, thisErr = tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, selectSrkTemplate(tpm, session), nil, nil, session)
+		case tryTransientSRK:
+			srk, _, _, _, _, thisErr = tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, selectSrkTemplate(tpm, session, srkTemplateReadAttrs), nil, nil, session)
 			if isAuthFailError(thisErr, tpm2.CommandCreatePrimary, 1) {
 				// We don't know the authorization value for the storage hierarchy - ignore
 				// this so we end up returning the last error.
@@ -77,23 +92,38 @@ func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.Ses
 				return nil, nil, xerrors.Errorf("cannot create transient SRK: %w", err)
 			}
 			defer tpm.FlushContext(srk)
+		case tryNullHierarchyPrimary:
+			srk, _, _, _, _, thisErr = tpm.CreatePrimary(tpm.NullHandleContext(), nil, nullHierarchyPrimaryTemplate(), nil, nil, nil)
+			if thisErr != nil {
+				// This is an unexpected error
+				return nil, nil, xerrors.Errorf("cannot create null hierarchy primary key: %w", thisErr)
+			}
+			defer tpm.FlushContext(srk)
 		}
 
 		// Load the key data
 		keyObject, err = k.load(tpm, srk)
-		if isLoadInvalidParamError(err) || isImportInvalidParamError(err) {
+		switch {
+		case (isLoadInvalidParamError(err) || isImportInvalidParamError(err)) && try == tryNullHierarchyPrimary:
+			// The supplied key data is invalid or the null hierarchy seed has
+			// changed since it was created.
+			err = InvalidKeyDataError{
+				fmt.Sprintf("cannot load sealed key object into TPM: %v. Either the sealed key object is bad or the TPM has been reset since it was created", err)}
+			continue
+		case isLoadInvalidParamError(err) || isImportInvalidParamError(err):
 			// The supplied key data is invalid or is not protected by the supplied SRK.
 			err = InvalidKeyDataError{
 				fmt.Sprintf("cannot load sealed key object into TPM: %v. Either the sealed key object is bad or the TPM owner has changed", err)}
 			continue
-		} else if isLoadInvalidParentError(err) || isImportInvalidParentError(err) {
+		case isLoadInvalidParentError(err) || isImportInvalidParentError(err):
 			// The supplied SRK is not a valid storage parent.
 			err = ErrTPMProvisioning
 			continue
-		} else if err != nil {
+		case err != nil:
 			// This is an unexpected error
 			return nil, nil, xerrors.Errorf("cannot load sealed key object into TPM: %w", err)
 		}
+		err = nil
 
 		defer func() {
 			if err == nil {
@@ -102,6 +132,10 @@ func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.Ses
 			tpm.FlushContext(keyObject)
 		}()
 
+		if !startPolicySession {
+			return keyObject, nil, nil
+		}
+
 		// Begin policy session with parameter encryption support and salted with the SRK.
 		// Note that this only provides protection against passive interposers, as active
 		// interposers can modify session attributes supplied in the TPM2_Unseal command and
@@ -151,8 +185,23 @@ func (k *sealedKeyDataBase) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.Ses
 // If a session is supplied, it should be a HMAC session with the AttrContinueSession
 // attribute set, used for authenticating use of the storage hierarchy if a transient
 // storage primary key needs to be created, in order to avoid transmitting the cleartext
-// authorization value.
-func (k *sealedKeyDataBase) unsealDataFromTPM(tpm *tpm2.TPMContext, authValue []byte, hmacSession tpm2.SessionContext) (data []byte, err error) {
+// authorization value. The srkTemplateReadAttrs argument is used in the same way as for
+// loadForUnseal.
+func (k *sealedKeyDataBase) unsealDataFromTPM(tpm *tpm2.TPMContext, authValue []byte, hmacSession tpm2.SessionContext, srkTemplateReadAttrs tpm2.SessionAttributes) (data []byte, err error) {
+	return k.unsealDataFromTPMWithSession(tpm, authValue, nil, hmacSession, srkTemplateReadAttrs)
+}
+
+// unsealDataFromTPMWithSession unseals the data from this sealed object. If
+// policySession is nil, a policy session is started and the PCR policy is
+// executed in the same way as unsealDataFromTPM. If policySession is supplied,
+// it is used as is for unsealing, and it is the responsibility of the caller
+// to ensure that it satisfies the authorization policy of the sealed object.
+func (k *sealedKeyDataBase) unsealDataFromTPMWithSession(tpm *tpm2.TPMContext, authValue []byte, policySession, hmacSession tpm2.SessionContext, srkTemplateReadAttrs tpm2.SessionAttributes) (data []byte, err error) {
+	r := beginOperation(OperationUnseal, tpm.Transport())
+	defer func() {
+		r.end(err)
+	}()
+
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -163,32 +212,45 @@ func (k *sealedKeyDataBase) unsealDataFromTPM(tpm *tpm2.TPMContext, authValue []
 		return nil, ErrTPMLockout
 	}
 
-	keyObject, policySession, err := k.loadForUnseal(tpm, hmacSession)
+	callerSession := policySession != nil
+	if !callerSession {
+		releaseSession, err := secboot.ReserveTPMSessions(1)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseSession()
+	}
+
+	keyObject, ourSession, err := k.loadForUnseal(tpm, hmacSession, srkTemplateReadAttrs, !callerSession)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		tpm.FlushContext(keyObject)
-		tpm.FlushContext(policySession)
-	}()
+	defer tpm.FlushContext(keyObject)
 
 	keyObject.SetAuthValue(authValue)
 
-	// Execute policy session
-	if err := k.data.Policy().ExecutePCRPolicy(tpm, policySession, hmacSession); err != nil {
-		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
-		switch {
-		case isPolicyDataError(err):
-			return nil, InvalidKeyDataError{err.Error()}
-		case tpm2.IsResourceUnavailableError(err, lockNVHandle):
-			return nil, InvalidKeyDataError{"required legacy lock NV index is not present"}
+	if !callerSession {
+		policySession = ourSession
+		defer tpm.FlushContext(policySession)
+
+		// Execute policy session
+		if err := k.data.Policy().ExecutePCRPolicy(tpm, policySession, hmacSession); err != nil {
+			err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
+			switch {
+			case isPolicyDataError(err):
+				return nil, InvalidKeyDataError{err.Error()}
+			case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+				return nil, InvalidKeyDataError{"required legacy lock NV index is not present"}
+			}
+			return nil, err
 		}
-		return nil, err
 	}
 
 	// Unseal
 	data, err = tpm.Unseal(keyObject, policySession)
 	switch {
+	case callerSession && tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
+		return nil, ErrPolicySessionNotSatisfied
 	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
 		return nil, InvalidKeyDataError{"the authorization policy check failed during unsealing"}
 	case err != nil:
@@ -0,0 +1,227 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// UnsealFailureReason describes the reason that a sealed key object could not
+// be unsealed.
+type UnsealFailureReason int
+
+const (
+	// UnsealFailureUnknown indicates that the reason for the failure could not
+	// be determined. This is generally the result of an unexpected TPM or
+	// communication error.
+	UnsealFailureUnknown UnsealFailureReason = iota
+
+	// UnsealFailureLockout indicates that the TPM is in dictionary attack
+	// lockout mode. The key will need to be recovered via a mechanism that
+	// is independent of the TPM until the TPM exits lockout mode.
+	UnsealFailureLockout
+
+	// UnsealFailureProvisioning indicates that the TPM is not correctly
+	// provisioned. Calling Connection.EnsureProvisioned may rectify this.
+	UnsealFailureProvisioning
+
+	// UnsealFailurePCRMismatch indicates that the current PCR values aren't
+	// consistent with the PCR policy of the sealed key object. This is
+	// generally the result of an unexpected change to the boot chain.
+	UnsealFailurePCRMismatch
+
+	// UnsealFailurePolicyRevoked indicates that the PCR policy of the sealed
+	// key object has been revoked, eg, by a call to
+	// SealedKeyObject.RevokeOldPCRProtectionPolicies with another copy of the
+	// key.
+	UnsealFailurePolicyRevoked
+
+	// UnsealFailureInvalidKeyData indicates that the sealed key object is
+	// invalid for some other reason, or is associated with another TPM owner.
+	UnsealFailureInvalidKeyData
+)
+
+func (r UnsealFailureReason) String() string {
+	switch r {
+	case UnsealFailureUnknown:
+		return "unknown"
+	case UnsealFailureLockout:
+		return "lockout"
+	case UnsealFailureProvisioning:
+		return "provisioning"
+	case UnsealFailurePCRMismatch:
+		return "pcr-mismatch"
+	case UnsealFailurePolicyRevoked:
+		return "policy-revoked"
+	case UnsealFailureInvalidKeyData:
+		return "invalid-key-data"
+	default:
+		return fmt.Sprintf("UnsealFailureReason(%d)", int(r))
+	}
+}
+
+// UnsealError is returned from DiagnoseUnsealFailure and describes why a sealed key
+// object could not be unsealed in a way that can be used to present appropriate
+// recovery guidance. It wraps the error returned from the unseal operation, so
+// that errors such as ErrTPMLockout and InvalidKeyDataError can still be tested
+// for with errors.Is and errors.As.
+type UnsealError struct {
+	// Reason is the reason that unsealing failed.
+	Reason UnsealFailureReason
+
+	// FailedPCRs contains the PCRs that don't have the values expected by the
+	// PCR policy. This is only populated if Reason is UnsealFailurePCRMismatch
+	// and the profile that the PCR policy was created from is supplied to
+	// DiagnoseUnsealFailure.
+	FailedPCRs []PCRMismatch
+
+	// LockoutCounter is the current value of the TPM's dictionary attack
+	// lockout counter. It is populated regardless of Reason if it can be
+	// read.
+	LockoutCounter uint32
+
+	// PolicyVersionMismatch indicates that the sequence number of the PCR
+	// policy of the sealed key object is older than the current value of its
+	// PCR policy counter.
+	PolicyVersionMismatch bool
+
+	err error
+}
+
+func (e *UnsealError) Error() string {
+	return fmt.Sprintf("cannot unseal key (%v): %v", e.Reason, e.err)
+}
+
+func (e *UnsealError) Unwrap() error {
+	return e.err
+}
+
+// isPCRPolicyRevoked determines whether the PCR policy of this sealed key object
+// has been revoked, by comparing its sequence number with the current value of
+// its PCR policy counter.
+func (k *sealedKeyDataBase) isPCRPolicyRevoked(tpm *tpm2.TPMContext, role string) (bool, error) {
+	counterPub, err := k.validateData(tpm, role)
+	if err != nil {
+		return false, err
+	}
+	if counterPub == nil {
+		// There is no PCR policy counter.
+		return false, nil
+	}
+
+	counter, err := k.data.Policy().PCRPolicyCounterContext(tpm, counterPub)
+	if err != nil {
+		return false, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+	}
+	current, err := counter.Get()
+	if err != nil {
+		return false, xerrors.Errorf("cannot read PCR policy counter: %w", err)
+	}
+
+	return current > k.data.Policy().PCRPolicySequence(), nil
+}
+
+func (k *sealedKeyDataBase) diagnoseUnsealFailure(tpm *tpm2.TPMContext, role string, unsealErr error, profile *PCRProtectionProfile) (*UnsealError, error) {
+	if unsealErr == nil {
+		return nil, errors.New("no unseal error supplied")
+	}
+
+	out := &UnsealError{err: unsealErr}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 1)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot fetch lockout counter: %w", err)
+	case len(props) == 0 || props[0].Property != tpm2.PropertyLockoutCounter:
+		return nil, errors.New("TPM returned value for the wrong property")
+	}
+	out.LockoutCounter = props[0].Value
+
+	switch {
+	case xerrors.Is(unsealErr, ErrTPMLockout):
+		out.Reason = UnsealFailureLockout
+		return out, nil
+	case xerrors.Is(unsealErr, ErrTPMProvisioning):
+		out.Reason = UnsealFailureProvisioning
+		return out, nil
+	case !isInvalidKeyDataError(unsealErr):
+		out.Reason = UnsealFailureUnknown
+		return out, nil
+	}
+
+	// The key data is invalid for some reason. The possible reasons are that
+	// the PCR policy has been revoked, that the current PCR values aren't
+	// consistent with the PCR policy, or that the key data is genuinely invalid.
+	out.Reason = UnsealFailureInvalidKeyData
+
+	revoked, err := k.isPCRPolicyRevoked(tpm, role)
+	switch {
+	case isKeyDataError(err):
+		return out, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot determine if PCR policy has been revoked: %w", err)
+	case revoked:
+		out.Reason = UnsealFailurePolicyRevoked
+		out.PolicyVersionMismatch = true
+		return out, nil
+	}
+
+	result, err := k.validateAgainstCurrentPCRs(tpm)
+	switch {
+	case isInvalidKeyDataError(err):
+		return out, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot validate PCR policy against current PCR values: %w", err)
+	case result.Satisfied:
+		return out, nil
+	}
+
+	out.Reason = UnsealFailurePCRMismatch
+	if profile != nil {
+		mismatches, err := result.Mismatches(profile)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine which PCRs have unexpected values: %w", err)
+		}
+		out.FailedPCRs = mismatches
+	}
+
+	return out, nil
+}
+
+// DiagnoseUnsealFailure determines why the supplied sealed key object could not be
+// unsealed, given the error returned from SealedKeyObject.UnsealFromTPM. This should
+// be called immediately after the failure, before anything else can modify the state
+// of the TPM.
+//
+// If the supplied profile is not nil, it should be the profile that the current PCR
+// policy of the sealed key object was created from. In this case, the returned
+// UnsealError will indicate which PCRs have unexpected values if the failure is
+// because the PCR policy isn't satisfied. The profile must not contain values that
+// are read from the TPM.
+//
+// An error will be returned if the state of the TPM cannot be inspected.
+func DiagnoseUnsealFailure(tpm *Connection, k *SealedKeyObject, unsealErr error, profile *PCRProtectionProfile) (*UnsealError, error) {
+	return k.diagnoseUnsealFailure(tpm.TPMContext, "", unsealErr, profile)
+}
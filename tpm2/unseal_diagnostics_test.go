@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type unsealDiagnosticsSuiteNoTPM struct{}
+
+var _ = Suite(&unsealDiagnosticsSuiteNoTPM{})
+
+func (s *unsealDiagnosticsSuiteNoTPM) TestUnsealFailureReasonString(c *C) {
+	c.Check(UnsealFailureUnknown.String(), Equals, "unknown")
+	c.Check(UnsealFailureLockout.String(), Equals, "lockout")
+	c.Check(UnsealFailureProvisioning.String(), Equals, "provisioning")
+	c.Check(UnsealFailurePCRMismatch.String(), Equals, "pcr-mismatch")
+	c.Check(UnsealFailurePolicyRevoked.String(), Equals, "policy-revoked")
+	c.Check(UnsealFailureInvalidKeyData.String(), Equals, "invalid-key-data")
+	c.Check(UnsealFailureReason(100).String(), Equals, "UnsealFailureReason(100)")
+}
+
+func (s *unsealDiagnosticsSuiteNoTPM) TestUnsealError(c *C) {
+	err := NewUnsealError(UnsealFailureLockout, ErrTPMLockout)
+	c.Check(err, ErrorMatches, `cannot unseal key \(lockout\): the TPM is in DA lockout mode`)
+	c.Check(errors.Is(err, ErrTPMLockout), testutil.IsTrue)
+}
+
+type unsealDiagnosticsSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *unsealDiagnosticsSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *unsealDiagnosticsSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&unsealDiagnosticsSuite{})
+
+func (s *unsealDiagnosticsSuite) testDiagnoseUnsealFailure(c *C, profile *PCRProtectionProfile, prepare func(string, secboot.PrimaryKey)) (*UnsealError, error) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	params := &KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)}
+
+	authKey, err := SealKeyToTPM(s.TPM(), key, path, params)
+	c.Assert(err, IsNil)
+
+	prepare(path, authKey)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, _, unsealErr := k.UnsealFromTPM(s.TPM())
+	c.Assert(unsealErr, NotNil)
+
+	diag, err := DiagnoseUnsealFailure(s.TPM(), k, unsealErr, profile)
+	if err != nil {
+		return nil, err
+	}
+	c.Check(diag, ErrorMatches, `cannot unseal key \(.*\): `+unsealErr.Error())
+	c.Check(errors.Is(diag, unsealErr), testutil.IsTrue)
+	return diag, nil
+}
+
+func (s *unsealDiagnosticsSuite) TestDiagnoseUnsealFailureLockout(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+	diag, err := s.testDiagnoseUnsealFailure(c, profile, func(_ string, _ secboot.PrimaryKey) {
+		// Put the TPM in DA lockout mode
+		c.Check(s.TPM().DictionaryAttackParameters(s.TPM().LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
+	})
+	c.Assert(err, IsNil)
+	c.Check(diag.Reason, Equals, UnsealFailureLockout)
+	c.Check(errors.Is(diag, ErrTPMLockout), testutil.IsTrue)
+	c.Check(diag.FailedPCRs, HasLen, 0)
+	c.Check(diag.PolicyVersionMismatch, testutil.IsFalse)
+}
+
+func (s *unsealDiagnosticsSuite) TestDiagnoseUnsealFailurePCRMismatch(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+
+	_, expected, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}})
+	c.Assert(err, IsNil)
+
+	diag, err := s.testDiagnoseUnsealFailure(c, profile, func(_ string, _ secboot.PrimaryKey) {
+		_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+		c.Check(err, IsNil)
+	})
+	c.Assert(err, IsNil)
+	c.Check(diag.Reason, Equals, UnsealFailurePCRMismatch)
+	c.Check(diag.LockoutCounter, Equals, uint32(0))
+	c.Check(diag.PolicyVersionMismatch, testutil.IsFalse)
+
+	_, actual, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}})
+	c.Assert(err, IsNil)
+	c.Check(diag.FailedPCRs, DeepEquals, []PCRMismatch{
+		{
+			Alg:      tpm2.HashAlgorithmSHA256,
+			PCR:      23,
+			Expected: expected[tpm2.HashAlgorithmSHA256][23],
+			Actual:   actual[tpm2.HashAlgorithmSHA256][23],
+		},
+	})
+}
+
+func (s *unsealDiagnosticsSuite) TestDiagnoseUnsealFailurePCRMismatchNoProfile(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, _, unsealErr := k.UnsealFromTPM(s.TPM())
+	c.Assert(unsealErr, NotNil)
+
+	diag, err := DiagnoseUnsealFailure(s.TPM(), k, unsealErr, nil)
+	c.Assert(err, IsNil)
+	c.Check(diag.Reason, Equals, UnsealFailurePCRMismatch)
+	c.Check(diag.FailedPCRs, HasLen, 0)
+}
+
+func (s *unsealDiagnosticsSuite) TestDiagnoseUnsealFailureRevokedPolicy(c *C) {
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+	diag, err := s.testDiagnoseUnsealFailure(c, profile, func(path string, authKey secboot.PrimaryKey) {
+		k, err := ReadSealedKeyObjectFromFile(path)
+		c.Assert(err, IsNil)
+		c.Check(k.UpdatePCRProtectionPolicy(s.TPM(), authKey, profile), IsNil)
+		c.Check(k.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+	})
+	c.Assert(err, IsNil)
+	c.Check(diag.Reason, Equals, UnsealFailurePolicyRevoked)
+	c.Check(diag.PolicyVersionMismatch, testutil.IsTrue)
+	c.Check(diag.FailedPCRs, HasLen, 0)
+}
+
+func (s *unsealDiagnosticsSuite) TestDiagnoseUnsealFailureNoError(c *C) {
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), make(secboot.DiskUnlockKey, 32), path, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, err = DiagnoseUnsealFailure(s.TPM(), k, nil, nil)
+	c.Check(err, ErrorMatches, `no unseal error supplied`)
+}
@@ -20,6 +20,9 @@
 package tpm2
 
 import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 
 	"github.com/snapcore/secboot"
@@ -69,17 +72,26 @@ import (
 // If the authorization policy check fails during unsealing, then a InvalidKeyDataError
 // error will be returned.
 //
+// DiagnoseUnsealFailure can be used to obtain more detailed information about why
+// unsealing failed.
+//
 // On success, the unsealed cleartext key is returned as the first return value, and the
 // private part of the key used for authorizing PCR policy updates with
 // SealedKeyObject.UpdatePCRProtectionPolicy is returned as the second return value.
 //
 // Deprecated: Use NewKeyData and the secboot.KeyData API for key recovery.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection) (key secboot.DiskUnlockKey, authKey secboot.PrimaryKey, err error) {
-	data, err := k.unsealDataFromTPM(tpm.TPMContext, nil, tpm.HmacSession())
+	data, err := k.unsealDataFromTPM(tpm.TPMContext, nil, tpm.HmacSession(), tpm.nvReadEncryptAttrs())
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return k.unmarshalUnsealedData(data)
+}
+
+// unmarshalUnsealedData returns the keys from the data unsealed from this
+// sealed key object.
+func (k *SealedKeyObject) unmarshalUnsealedData(data []byte) (key secboot.DiskUnlockKey, authKey secboot.PrimaryKey, err error) {
 	if k.data.Version() == 0 {
 		return secboot.DiskUnlockKey(data), nil, nil
 	}
@@ -91,3 +103,77 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection) (key secboot.DiskUnlock
 
 	return sealedData.Key, sealedData.AuthPrivateKey, nil
 }
+
+// UnsealPolicyInfo contains the metadata required to construct and satisfy a
+// policy session for unsealing a sealed key object with
+// SealedKeyObject.UnsealWithSession.
+type UnsealPolicyInfo struct {
+	// NameAlg is the name algorithm of the sealed key object, which must
+	// be used as the digest algorithm of the policy session.
+	NameAlg tpm2.HashAlgorithmId
+
+	// AuthPolicy is the authorization policy digest of the sealed key
+	// object, which the policy session digest must match.
+	AuthPolicy tpm2.Digest
+
+	// PCRPolicyCounterHandle is the handle of the NV counter used for
+	// revoking PCR policies, or tpm2.HandleNull if there isn't one.
+	PCRPolicyCounterHandle tpm2.Handle
+
+	// PCRPolicySequence is the sequence number of the current PCR policy,
+	// which is compared against the PCR policy counter.
+	PCRPolicySequence uint64
+
+	// Description describes the assertions that make up the authorization
+	// policy. It is only available for version 3 sealed key objects and
+	// later, and is nil otherwise.
+	Description *PolicyDescription
+}
+
+// UnsealPolicyInfo returns the metadata required to construct and satisfy a
+// policy session for unsealing this sealed key object with UnsealWithSession.
+func (k *SealedKeyObject) UnsealPolicyInfo() *UnsealPolicyInfo {
+	info := &UnsealPolicyInfo{
+		NameAlg:                k.data.Public().NameAlg,
+		AuthPolicy:             k.data.Public().AuthPolicy,
+		PCRPolicyCounterHandle: k.data.Policy().PCRPolicyCounterHandle(),
+		PCRPolicySequence:      k.data.Policy().PCRPolicySequence()}
+	if desc, err := newPolicyDescription(k.data); err == nil {
+		info.Description = desc
+	}
+	return info
+}
+
+// UnsealWithSession is an advanced variant of UnsealFromTPM for callers that
+// need to satisfy the authorization policy of this sealed key object in a way
+// that isn't natively supported by this package, such as with a PCR policy
+// that is authorized with TPM2_PolicyAuthorize using a signed policy that was
+// created externally (see UnsealPolicyInfo).
+//
+// The caller is responsible for starting the supplied policy session, with the
+// digest algorithm indicated by UnsealPolicyInfo.NameAlg, and for executing the
+// assertions that satisfy the authorization policy. The session is used as is
+// for unsealing. As with any TPM command, the session is flushed by the TPM on
+// completion unless it has the tpm2.AttrContinueSession attribute set, in which
+// case the caller is responsible for flushing it. The caller may wish to salt
+// the session and set the tpm2.AttrResponseEncrypt attribute in order to protect
+// the unsealed key from passive interposers.
+//
+// If the supplied session doesn't satisfy the authorization policy, a
+// ErrPolicySessionNotSatisfied error will be returned. Other errors are the same
+// as those returned from UnsealFromTPM.
+func (k *SealedKeyObject) UnsealWithSession(tpm *Connection, session tpm2.SessionContext) (key secboot.DiskUnlockKey, authKey secboot.PrimaryKey, err error) {
+	if session == nil {
+		return nil, nil, errors.New("no policy session supplied")
+	}
+	if session.Handle().Type() != tpm2.HandleTypePolicySession {
+		return nil, nil, errors.New("the supplied session is not a policy session")
+	}
+
+	data, err := k.unsealDataFromTPMWithSession(tpm.TPMContext, nil, session, tpm.HmacSession(), tpm.nvReadEncryptAttrs())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k.unmarshalUnsealedData(data)
+}
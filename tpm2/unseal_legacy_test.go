@@ -20,10 +20,12 @@
 package tpm2_test
 
 import (
+	"crypto/rsa"
 	"math/rand"
 	"path/filepath"
 
 	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
 
 	. "gopkg.in/check.v1"
 
@@ -226,3 +228,116 @@ func (s *unsealSuite) TestUnsealFromTPMErrorHandlingSealedKeyAccessLocked(c *C)
 	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
 		"cannot execute PolicyOR assertions: current session digest not found in policy data")
 }
+
+func (s *unsealSuite) testUnsealWithSession(c *C, params *KeyCreationParams) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	authKey, err := SealKeyToTPM(s.TPM(), key, path, params)
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	info := k.UnsealPolicyInfo()
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, info.NameAlg)
+	c.Check(k.Data().Policy().ExecutePCRPolicy(s.TPM().TPMContext, session, s.TPM().HmacSession()), IsNil)
+
+	digest, err := s.TPM().PolicyGetDigest(session)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, info.AuthPolicy)
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealWithSession(s.TPM(), session)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+
+	// The key object should have been flushed.
+	handles, err := s.TPM().GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	c.Check(err, IsNil)
+	c.Check(handles, HasLen, 0)
+}
+
+func (s *unsealSuite) TestUnsealWithSessionSimplePCRProfile(c *C) {
+	s.testUnsealWithSession(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)})
+}
+
+func (s *unsealSuite) TestUnsealWithSessionNoPCRPolicyCounter(c *C) {
+	s.testUnsealWithSession(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+}
+
+func (s *unsealSuite) TestUnsealWithSessionNotSatisfied(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, k.UnsealPolicyInfo().NameAlg)
+	_, _, err = k.UnsealWithSession(s.TPM(), session)
+	c.Check(err, Equals, ErrPolicySessionNotSatisfied)
+}
+
+func (s *unsealSuite) TestUnsealWithSessionNotPolicySession(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, _, err = k.UnsealWithSession(s.TPM(), s.TPM().HmacSession())
+	c.Check(err, ErrorMatches, `the supplied session is not a policy session`)
+}
+
+type unsealSuiteNoTPM struct{}
+
+var _ = Suite(&unsealSuiteNoTPM{})
+
+func (s *unsealSuiteNoTPM) TestUnsealPolicyInfo(c *C) {
+	srkKey, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	c.Assert(err, IsNil)
+	srk := tpm2_testutil.NewExternalRSAStoragePublicKey(&srkKey.PublicKey)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err = SealKeyToExternalTPMStorageKey(srk, make(secboot.DiskUnlockKey, 32), path, &KeyCreationParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	info := k.UnsealPolicyInfo()
+	c.Check(info.NameAlg, Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(info.AuthPolicy, DeepEquals, k.Data().Public().AuthPolicy)
+
+	c.Check(info.PCRPolicyCounterHandle, Equals, tpm2.HandleNull)
+	c.Check(info.PCRPolicySequence, Equals, k.Data().Policy().PCRPolicySequence())
+
+	// Policy descriptions aren't available for legacy sealed key objects.
+	c.Check(k.Version(), Equals, uint32(2))
+	c.Check(info.Description, IsNil)
+}
+
+func (s *unsealSuiteNoTPM) TestUnsealWithSessionNoSession(c *C) {
+	_, _, err := new(SealedKeyObject).UnsealWithSession(nil, nil)
+	c.Check(err, ErrorMatches, `no policy session supplied`)
+}
@@ -20,10 +20,12 @@
 package tpm2
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
 
 	"golang.org/x/xerrors"
 
@@ -60,8 +62,8 @@ const (
 	incrementPcrPolicyVersion
 )
 
-// updatePCRProtectionPolicyNoValidate is a helper to update the PCR policy using the supplied
-// profile, authorized with the supplied key.
+// newPCRPolicyParams is a helper to compute the parameters for a new PCR policy from the
+// supplied profile. The returned parameters don't contain a key for authorizing the policy.
 //
 // If tpm is not nil, this function will verify that the supplied profile produces a PCR
 // selection that is supported by the TPM. If tpm is nil, it will be assumed that the target
@@ -70,13 +72,17 @@ const (
 //
 // If k.data.policy().pcrPolicyCounterHandle() is not tpm2.HandleNull, then counterPub
 // must be supplied, and it must correspond to the public area associated with that handle.
-func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMContext, key secboot.PrimaryKey,
-	counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption pcrPolicyVersionOption) error {
+//
+// If the key was created with alternate PCR banks (see k.alternatePCRBanks), the profile
+// must contain values for more than one PCR bank, and the returned parameters permit the
+// policy to be satisfied with each of these banks on its own (see pcrBankDigests). In this
+// case, the PCR banks only need to be implemented by the TPM rather than currently allocated.
+func (k *sealedKeyDataBase) newPCRPolicyParams(tpm *tpm2.TPMContext, counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption pcrPolicyVersionOption) (*pcrPolicyParams, error) {
 	var counterName tpm2.Name
 	var policySequence uint64
 	if counterPub != nil {
 		if tpm == nil {
-			return errors.New("TPM connection required to update PCR policy with revocation")
+			return nil, errors.New("TPM connection required to update PCR policy with revocation")
 		}
 
 		// Callers obtain a valid counterPub from sealedKeyDataBase.validateData, so
@@ -87,12 +93,12 @@ func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMCon
 		case resetPcrPolicyVersion, newPcrPolicyVersion:
 			counterContext, err := k.data.Policy().PCRPolicyCounterContext(tpm, counterPub)
 			if err != nil {
-				return xerrors.Errorf("cannot obtain PCR policy counter context: %w", err)
+				return nil, xerrors.Errorf("cannot obtain PCR policy counter context: %w", err)
 			}
 
 			value, err := counterContext.Get()
 			if err != nil {
-				return xerrors.Errorf("cannot obtain PCR policy counter value: %w", err)
+				return nil, xerrors.Errorf("cannot obtain PCR policy counter value: %w", err)
 			}
 
 			policySequence = value
@@ -109,7 +115,7 @@ func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMCon
 		var err error
 		supportedPcrs, err = tpm.GetCapabilityPCRs()
 		if err != nil {
-			return xerrors.Errorf("cannot determine supported PCRs: %w", err)
+			return nil, xerrors.Errorf("cannot determine supported PCRs: %w", err)
 		}
 	} else {
 		// Defined as mandatory in the TCG PC Client Platform TPM Profile Specification for TPM 2.0
@@ -119,22 +125,23 @@ func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMCon
 	}
 
 	alg := k.data.Public().NameAlg
+	alternateBanks := k.alternatePCRBanks()
 
 	// Compute PCR digests
 	pcrs, pcrDigests, err := profile.ComputePCRDigests(tpm, alg)
 	if err != nil {
-		return xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
 	}
 
 	if len(pcrDigests) == 0 {
-		return errors.New("PCR protection profile contains no digests")
+		return nil, errors.New("PCR protection profile contains no digests")
 	}
 
 	for _, p := range pcrs {
 		for _, s := range p.Select {
 			found := false
 			for _, p2 := range supportedPcrs {
-				if p2.Hash != p.Hash {
+				if p2.Hash != p.Hash && !alternateBanks {
 					continue
 				}
 				for _, s2 := range p2.Select {
@@ -148,18 +155,149 @@ func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMCon
 				}
 			}
 			if !found {
-				return errors.New("PCR protection profile contains digests for unsupported PCRs")
+				return nil, errors.New("PCR protection profile contains digests for unsupported PCRs")
+			}
+		}
+	}
+
+	var alternatePcrBanks []*pcrBankDigests
+	if alternateBanks {
+		for _, p := range pcrs {
+			implemented := false
+			for _, p2 := range supportedPcrs {
+				if p2.Hash == p.Hash {
+					implemented = true
+					break
+				}
+			}
+			if !implemented {
+				return nil, fmt.Errorf("PCR protection profile contains digests for unsupported PCR bank %v", p.Hash)
+			}
+		}
+
+		var err error
+		alternatePcrBanks, err = computeAlternatePCRBankDigests(tpm, profile, pcrs, alg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var nvGeneration *nvGenerationCheck
+	var nvGenerationIndexName tpm2.Name
+	if req := profile.NVGenerationRequirement(); req != nil {
+		if k.data.Version() < 3 {
+			return nil, errors.New("NV generation requirements are not supported for this key data version")
+		}
+		if tpm == nil {
+			return nil, errors.New("TPM connection required to update PCR policy with NV generation requirement")
+		}
+		name, err := readNVGenerationIndexName(tpm, req)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot use NV index %v for NV generation requirement: %w", req.Handle, err)
+		}
+		nvGeneration = &nvGenerationCheck{Handle: req.Handle, Minimum: req.Minimum, Maximum: req.Maximum}
+		nvGenerationIndexName = name
+	}
+
+	var resetCount *resetCountCheck
+	if maximum, ok := profile.MaximumResetCount(); ok {
+		if k.data.Version() < 3 {
+			return nil, errors.New("reset count requirements are not supported for this key data version")
+		}
+		if tpm != nil {
+			virtual, err := isVirtualTPM(tpm)
+			if err != nil {
+				return nil, err
+			}
+			if virtual {
+				// The reset count of a virtual TPM can be rolled back by
+				// restoring the guest from a snapshot.
+				return nil, errors.New("reset count requirements are not supported on a virtual TPM")
 			}
 		}
+		resetCount = &resetCountCheck{Maximum: maximum}
 	}
 
-	params := &pcrPolicyParams{
-		key:               key,
-		pcrs:              pcrs,
-		pcrDigests:        pcrDigests,
-		policyCounterName: counterName,
-		policySequence:    policySequence}
-	return k.data.Policy().UpdatePCRPolicy(alg, params)
+	return &pcrPolicyParams{
+		pcrs:                  pcrs,
+		pcrDigests:            pcrDigests,
+		alternatePcrBanks:     alternatePcrBanks,
+		policyCounterName:     counterName,
+		policySequence:        policySequence,
+		nvGeneration:          nvGeneration,
+		nvGenerationIndexName: nvGenerationIndexName,
+		resetCount:            resetCount}, nil
+}
+
+// alternatePCRBanks indicates whether PCR policies for this key can be satisfied
+// by each of the PCR banks in the profile on its own. This is recorded in the key
+// data when the key is created, so that it applies to every PCR policy update.
+func (k *sealedKeyDataBase) alternatePCRBanks() bool {
+	policy, ok := k.data.Policy().(*keyDataPolicy_v3)
+	return ok && policy.StaticData.AlternatePCRBanks
+}
+
+// pcrBankDigests contains the approved PCR digests for a subset of the PCR banks
+// in a PCR policy. The TPM excludes PCR banks that aren't currently allocated
+// from the selection when executing TPM2_PolicyPCR, so including these in a PCR
+// policy permits it to be satisfied if the platform firmware changes the active
+// PCR banks.
+type pcrBankDigests struct {
+	pcrs    tpm2.PCRSelectionList
+	digests tpm2.DigestList
+}
+
+// computeAlternatePCRBankDigests computes the PCR digests for each individual PCR
+// bank in the supplied selection from the supplied profile.
+func computeAlternatePCRBankDigests(tpm *tpm2.TPMContext, profile *PCRProtectionProfile, pcrs tpm2.PCRSelectionList, alg tpm2.HashAlgorithmId) ([]*pcrBankDigests, error) {
+	if len(pcrs) < 2 {
+		return nil, errors.New("PCR protection profile must contain digests for more than one PCR bank")
+	}
+
+	values, err := profile.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	var out []*pcrBankDigests
+	for _, p := range pcrs {
+		bank := &pcrBankDigests{pcrs: tpm2.PCRSelectionList{p}}
+		for _, v := range values {
+			digest, err := util.ComputePCRDigest(alg, bank.pcrs, v)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot compute PCR digest for %v bank: %w", p.Hash, err)
+			}
+			found := false
+			for _, d := range bank.digests {
+				if bytes.Equal(d, digest) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				bank.digests = append(bank.digests, digest)
+			}
+		}
+		out = append(out, bank)
+	}
+
+	return out, nil
+}
+
+// updatePCRProtectionPolicyNoValidate is a helper to update the PCR policy using the supplied
+// profile, authorized with the supplied key. See newPCRPolicyParams for a description of the
+// tpm and counterPub arguments.
+func (k *sealedKeyDataBase) updatePCRProtectionPolicyNoValidate(tpm *tpm2.TPMContext, key secboot.PrimaryKey,
+	counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, policyVersionOption pcrPolicyVersionOption) error {
+	params, err := k.newPCRPolicyParams(tpm, counterPub, profile, policyVersionOption)
+	if err != nil {
+		return err
+	}
+	params.key = key
+	if policy, ok := k.data.Policy().(*keyDataPolicy_v3); ok && policy.usesPCRPolicyNVIndex() {
+		return policy.updatePCRPolicyNV(tpm, k.data.Public().NameAlg, params)
+	}
+	return k.data.Policy().UpdatePCRPolicy(k.data.Public().NameAlg, params)
 }
 
 func (k *sealedKeyDataBase) revokeOldPCRProtectionPolicies(tpm *tpm2.TPMContext, key secboot.PrimaryKey, role string) error {
@@ -269,6 +407,10 @@ func (o PCRPolicyVersionOption) internalOpt() pcrPolicyVersionOption {
 //
 // On success, this SealedKeyObject will have an updated authorization policy that includes a PCR policy computed
 // from the supplied PCRProtectionProfile. It must be persisted using SealedKeyObject.WriteAtomic.
+//
+// If the sealed key was created with a PCR policy NV index (see ProtectKeyParams.PCRPolicyNVIndexHandle), the
+// new PCR policy is written to the NV index and replaces the previous one immediately, and the key data only
+// contains a copy of it. In this case, the updated key data doesn't need to be persisted.
 func (k *SealedKeyData) UpdatePCRProtectionPolicy(tpm *Connection, authKey secboot.PrimaryKey, pcrProfile *PCRProtectionProfile, policyVersionOption PCRPolicyVersionOption) error {
 	if err := k.updatePCRProtectionPolicy(tpm.TPMContext, authKey, k.k.Role(), pcrProfile, policyVersionOption.internalOpt()); err != nil {
 		return xerrors.Errorf("cannot update PCR protection policy: %w", err)
@@ -299,7 +441,7 @@ func (k *SealedKeyData) RevokeOldPCRProtectionPolicies(tpm *Connection, authKey
 
 // UpdateKeyPCRProtectionPolicy updates the PCR protection policy for one or more TPM protected KeyData
 // objects to the profile defined by the pcrProfile argument. The keys must all be related (ie, they were
-// created using NewKeyDataMultiple). If any key in the supplied set is not related, an error will be returned.
+// created using SealKeysToTPM). If any key in the supplied set is not related, an error will be returned.
 //
 // If validation of any KeyData object fails, an InvalidKeyDataError error will be returned.
 //
@@ -311,19 +453,21 @@ func UpdateKeyDataPCRProtectionPolicy(tpm *Connection, authKey secboot.PrimaryKe
 		return errors.New("no sealed keys supplied")
 	}
 
-	role := keys[0].Role()
-	for i, key := range keys[1:] {
-		if key.Role() != role {
-			return fmt.Errorf("unexpected role for key at index %d (expected %s, got %s)", i+1, role, key.Role())
-		}
-	}
-
+	// Related keys share the same PCR policy counter, and the auth key is
+	// validated against each key when it is updated.
+	var skds []*SealedKeyData
 	for i, key := range keys {
 		skd, err := NewSealedKeyData(key)
 		if err != nil {
 			return xerrors.Errorf("cannot obtain SealedKeyData for key at index %d: %w", i, err)
 		}
+		if i > 0 && skd.data.Policy().PCRPolicyCounterHandle() != skds[0].data.Policy().PCRPolicyCounterHandle() {
+			return fmt.Errorf("unexpected PCR policy counter for key at index %d (expected %v, got %v)", i, skds[0].data.Policy().PCRPolicyCounterHandle(), skd.data.Policy().PCRPolicyCounterHandle())
+		}
+		skds = append(skds, skd)
+	}
 
+	for i, skd := range skds {
 		if err := skd.UpdatePCRProtectionPolicy(tpm, authKey, pcrProfile, policyVersionOption); err != nil {
 			return xerrors.Errorf("cannot update key at index %d: %w", i, err)
 		}
@@ -110,6 +110,44 @@ func (s *updateSuite) TestUpdatePCRProtectionPolicyWithProvidedAuthKey(c *C) {
 		primaryKey:             primaryKey})
 }
 
+func (s *updateSuite) TestUpdatePCRProtectionPolicyWithPCRPolicyNVIndex(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	c.Assert(s.NextAvailableHandle(c, handle+1), Equals, handle+1)
+
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})
+	k1, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyNVIndexHandle: handle})
+	c.Assert(err, IsNil)
+
+	w := newMockKeyDataWriter()
+	c.Check(k1.WriteAtomic(w), IsNil)
+
+	k2, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, IsNil)
+
+	// Update the PCR policy with k2 to a policy that can't be satisfied.
+	// This takes effect for k1 without it being updated.
+	skd, err := NewSealedKeyData(k2)
+	c.Assert(err, IsNil)
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), primaryKey,
+		NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, testutil.DecodeHexString(c, "0101010101010101010101010101010101010101010101010101010101010101")),
+		NoNewPCRPolicyVersion), IsNil)
+
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, ErrorMatches, `invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: cannot execute PolicyOR assertions: current session digest not found in policy data`)
+
+	// Restore the original PCR policy with k2.
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), primaryKey, profile, NoNewPCRPolicyVersion), IsNil)
+
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
 func (s *updateSuite) testRevokeOldPCRProtectionPolicies(c *C, params *ProtectKeyParams) error {
 	k1, primaryKey, _, err := NewTPMProtectedKey(s.TPM(), params)
 	c.Assert(err, IsNil)
@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// LegacyKeyFileUpgrade is the result of upgrading a legacy sealed key file with
+// UpgradeLegacyKeyFile.
+type LegacyKeyFileUpgrade struct {
+	// KeyData is the replacement key data, which must be persisted by the
+	// caller.
+	KeyData *secboot.KeyData
+
+	// PrimaryKey is the primary key associated with KeyData, which is used
+	// for authorizing PCR policy updates.
+	PrimaryKey secboot.PrimaryKey
+
+	// UnlockKey is the key protected by KeyData, which must be added to the
+	// encrypted container by the caller.
+	UnlockKey secboot.DiskUnlockKey
+
+	// LegacyUnlockKey is the key that was protected by the legacy key file.
+	// It can be removed from the encrypted container once UnlockKey has been
+	// added and KeyData has been persisted.
+	LegacyUnlockKey secboot.DiskUnlockKey
+}
+
+// UpgradeLegacyKeyFile migrates the legacy sealed key file at the specified path,
+// which was created by SealKeyToTPM or SealKeyToTPMMultiple (including the version
+// 0 and 1 formats created by early releases), to the current secboot.KeyData
+// format. This unseals the key from the legacy file, so the current PCR values
+// must satisfy its PCR policy. A new key is then sealed to the storage hierarchy
+// with the supplied parameters, in the same way as NewTPMProtectedKey.
+//
+// The new key has a different unlock key to the legacy one, because the current
+// format derives the unlock key from the primary key. The caller is responsible
+// for adding the new unlock key to the encrypted container and persisting the new
+// key data before removing the legacy unlock key and the legacy key file. The
+// legacy key file is not modified by this function. If the legacy key file uses a
+// PCR policy counter, it must not be reused for the new key unless it has been
+// undefined first.
+//
+// If the legacy key file cannot be unsealed (eg, because the PCR values have
+// changed), the legacy key file can still be used without upgrading by creating a
+// secboot.KeyData with NewKeyDataFromSealedKeyObjectFile.
+func UpgradeLegacyKeyFile(tpm *Connection, path string, params *ProtectKeyParams) (*LegacyKeyFileUpgrade, error) {
+	// params is mandatory.
+	if params == nil {
+		return nil, errors.New("no ProtectKeyParams provided")
+	}
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read legacy key file: %w", err)
+	}
+
+	legacyUnlockKey, _, err := k.UnsealFromTPM(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot unseal legacy key: %w", err)
+	}
+
+	kd, primaryKey, unlockKey, err := NewTPMProtectedKey(tpm, params)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create new key: %w", err)
+	}
+
+	return &LegacyKeyFileUpgrade{
+		KeyData:         kd,
+		PrimaryKey:      primaryKey,
+		UnlockKey:       unlockKey,
+		LegacyUnlockKey: legacyUnlockKey}, nil
+}
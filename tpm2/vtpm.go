@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	tpmManufacturerVMW  tpm2.TPMManufacturer = 0x564D5700 // VMware
+	tpmManufacturerQEMU tpm2.TPMManufacturer = 0x51454D55 // QEMU
+)
+
+var sysfsPath = "/sys"
+
+// readDMIField returns the value of the specified DMI field from sysfs, or an
+// empty string if it cannot be read.
+func readDMIField(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(sysfsPath, "class/dmi/id", name))
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(data))
+}
+
+// isHyperVGuest indicates whether the system is a Hyper-V (or Azure) guest,
+// based on the DMI system information. Physical devices from Microsoft, such as
+// Surface devices, report the same system vendor but a different product name.
+func isHyperVGuest() bool {
+	return readDMIField("sys_vendor") == "Microsoft Corporation" &&
+		readDMIField("product_name") == "Virtual Machine"
+}
+
+// isVirtualTPMManufacturer indicates whether the supplied manufacturer ID is
+// one that is reported by the virtual TPMs of common hypervisors. Microsoft's
+// manufacturer ID is also reported by physical TPMs such as Pluton, so it is
+// only considered to be a virtual TPM if the system is a Hyper-V guest.
+func isVirtualTPMManufacturer(manufacturer tpm2.TPMManufacturer) bool {
+	switch manufacturer {
+	case tpmManufacturerVMW, tpmManufacturerQEMU:
+		return true
+	case tpm2.TPMManufacturerMSFT:
+		return isHyperVGuest()
+	default:
+		return false
+	}
+}
+
+// isVirtualTPM indicates whether the supplied TPM is a virtual TPM provided by a
+// hypervisor.
+var isVirtualTPM = func(tpm *tpm2.TPMContext) (bool, error) {
+	manufacturer, err := tpm.GetManufacturer()
+	if err != nil {
+		return false, xerrors.Errorf("cannot obtain manufacturer: %w", err)
+	}
+	return isVirtualTPMManufacturer(manufacturer), nil
+}
+
+// IsVirtualTPM indicates whether the TPM is a virtual TPM provided by a
+// hypervisor, based on the manufacturer ID that it reports. This detects the
+// virtual TPMs provided by VMware and QEMU, and the virtual TPM provided by
+// Microsoft (Hyper-V and Azure) when the DMI system information indicates that
+// the system is a Hyper-V guest. Physical TPMs that report Microsoft's
+// manufacturer ID, such as Pluton, are not considered to be virtual TPMs.
+//
+// The persistent state of a virtual TPM, such as the EK, the SRK and NV indices,
+// is preserved when a guest is live migrated or restored from a snapshot, so
+// sealed keys and their PCR policies are not affected. The TPM's clock and reset
+// count are not guaranteed to be preserved though - the clock may stop whilst
+// the guest isn't running, it may be reported as unsafe by ReadSafeClock after a
+// migration, and both the clock and the reset count may repeat previously
+// reported values after the guest is restored from a snapshot. Because of this:
+//   - a ClockMapping created by NewClockMapping on a virtual TPM is only valid
+//     for the TPM reset cycle in which it was created.
+//   - PCR policies cannot be created from a PCRProtectionProfile with a maximum
+//     reset count (see PCRProtectionProfile.RequireMaximumResetCount) on a
+//     virtual TPM, because the limit can be bypassed by restoring a snapshot.
+//     This means that FreezeProtectors is not supported on a virtual TPM.
+func (t *Connection) IsVirtualTPM() (bool, error) {
+	return isVirtualTPM(t.TPMContext)
+}
@@ -0,0 +1,85 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type vtpmSuiteNoTPM struct {
+	tpm2_testutil.BaseTest
+}
+
+func (s *vtpmSuiteNoTPM) mockDMI(c *C, vendor, product string) {
+	dir := c.MkDir()
+	dmiDir := filepath.Join(dir, "class/dmi/id")
+	c.Assert(os.MkdirAll(dmiDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dmiDir, "sys_vendor"), []byte(vendor+"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dmiDir, "product_name"), []byte(product+"\n"), 0644), IsNil)
+	s.AddCleanup(MockSysfsPath(dir))
+}
+
+type vtpmSuite struct {
+	tpm2test.TPMTest
+}
+
+var _ = Suite(&vtpmSuiteNoTPM{})
+var _ = Suite(&vtpmSuite{})
+
+func (s *vtpmSuiteNoTPM) TestIsVirtualTPMManufacturer(c *C) {
+	s.mockDMI(c, "LENOVO", "21CB")
+	c.Check(IsVirtualTPMManufacturer(0x564D5700), Equals, true) // VMW
+	c.Check(IsVirtualTPMManufacturer(0x51454D55), Equals, true) // QEMU
+	c.Check(IsVirtualTPMManufacturer(tpm2.TPMManufacturerINTC), Equals, false)
+	c.Check(IsVirtualTPMManufacturer(tpm2.TPMManufacturerIFX), Equals, false)
+}
+
+func (s *vtpmSuiteNoTPM) TestIsVirtualTPMManufacturerMSFTHyperV(c *C) {
+	s.mockDMI(c, "Microsoft Corporation", "Virtual Machine")
+	c.Check(IsVirtualTPMManufacturer(tpm2.TPMManufacturerMSFT), Equals, true)
+}
+
+func (s *vtpmSuiteNoTPM) TestIsVirtualTPMManufacturerMSFTPluton(c *C) {
+	// Surface devices have a physical Pluton TPM that reports MSFT.
+	s.mockDMI(c, "Microsoft Corporation", "Surface Laptop 7")
+	c.Check(IsVirtualTPMManufacturer(tpm2.TPMManufacturerMSFT), Equals, false)
+}
+
+func (s *vtpmSuiteNoTPM) TestIsVirtualTPMManufacturerMSFTNoDMI(c *C) {
+	s.AddCleanup(MockSysfsPath(c.MkDir()))
+	c.Check(IsVirtualTPMManufacturer(tpm2.TPMManufacturerMSFT), Equals, false)
+}
+
+func (s *vtpmSuite) TestIsVirtualTPM(c *C) {
+	// The simulator reports IBM as its manufacturer.
+	virtual, err := s.TPM().IsVirtualTPM()
+	c.Check(err, IsNil)
+	c.Check(virtual, Equals, false)
+}
@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+const keyringPurposeUnlockReason = "reason"
+
+// UnlockMethod describes the mechanism that was used to unlock a volume.
+type UnlockMethod string
+
+const (
+	// UnlockMethodPlatformKey indicates that a volume was unlocked with
+	// a platform protected KeyData that doesn't require a passphrase.
+	UnlockMethodPlatformKey UnlockMethod = "platform-key"
+
+	// UnlockMethodPlatformKeyWithPassphrase indicates that a volume was
+	// unlocked with a platform protected KeyData and its passphrase.
+	UnlockMethodPlatformKeyWithPassphrase UnlockMethod = "platform-key-with-passphrase"
+
+	// UnlockMethodRecoveryKey indicates that a volume was unlocked with a
+	// recovery key.
+	UnlockMethodRecoveryKey UnlockMethod = "recovery-key"
+
+	// UnlockMethodUserPassphrase indicates that a volume was unlocked with
+	// a user passphrase (see ActivateVolumeWithUserPassphrase).
+	UnlockMethodUserPassphrase UnlockMethod = "user-passphrase"
+
+	// UnlockMethodExternalKey indicates that a volume was unlocked with an
+	// unlock key supplied by the caller via the ExternalUnlockKey field of
+	// ActivateVolumeOptions.
+	UnlockMethodExternalKey UnlockMethod = "external-key"
+)
+
+// externalUnlockKeyName is the name used to identify a key supplied via the
+// ExternalUnlockKey field of ActivateVolumeOptions in unlock reasons and
+// errors.
+const externalUnlockKeyName = "external-key"
+
+// UnlockReasonKeyError describes why a KeyData couldn't be used to unlock a
+// volume.
+type UnlockReasonKeyError struct {
+	KeyName string `json:"key-name"`
+	Error   string `json:"error"`
+}
+
+// UnlockReason records how a volume was unlocked by one of the
+// ActivateVolumeWith* functions, and is added to the kernel keyring alongside
+// the unlock key so that it can be retrieved by the booted OS with
+// GetUnlockReasonFromKernel. This makes it possible to implement conditional
+// behaviours, such as resealing keys after a recovery key has been used.
+type UnlockReason struct {
+	Method UnlockMethod `json:"method"`
+
+	// KeyName is the name of the key that unlocked the volume. For
+	// platform protected keys, this is the readable name of the KeyData.
+	// For recovery keys, this is the name of the recovery keyslot if it
+	// is known.
+	KeyName string `json:"key-name,omitempty"`
+
+	// PlatformName and Role are set for platform protected keys.
+	PlatformName string `json:"platform-name,omitempty"`
+	Role         string `json:"role,omitempty"`
+
+	// PolicyBranch describes the branch of the authorization policy of a
+	// platform protected key that was satisfied, if the platform is able
+	// to report it (see PlatformKeyDataHandlerWithPolicyBranch).
+	PolicyBranch string `json:"policy-branch,omitempty"`
+
+	// User is set for user passphrases.
+	User string `json:"user,omitempty"`
+
+	// KeyErrors describes why each of the platform protected keys that
+	// were tried before falling back to a recovery key failed.
+	KeyErrors []UnlockReasonKeyError `json:"key-errors,omitempty"`
+}
+
+// RecoveryKeyUsed indicates whether the volume was unlocked with a recovery
+// key.
+func (r *UnlockReason) RecoveryKeyUsed() bool {
+	return r.Method == UnlockMethodRecoveryKey
+}
+
+func newUnlockReasonForKeyData(k *KeyData) *UnlockReason {
+	method := UnlockMethodPlatformKey
+	if k.AuthMode() == AuthModePassphrase {
+		method = UnlockMethodPlatformKeyWithPassphrase
+	}
+	return &UnlockReason{
+		Method:       method,
+		KeyName:      k.ReadableName(),
+		PlatformName: k.PlatformName(),
+		Role:         k.Role(),
+		PolicyBranch: k.policyBranch()}
+}
+
+func newUnlockReasonForExternalKey() *UnlockReason {
+	return &UnlockReason{
+		Method:  UnlockMethodExternalKey,
+		KeyName: externalUnlockKeyName}
+}
+
+func newUnlockReasonForRecoveryKey(keyslotName string, keyErrors []*activateWithKeyDataError) *UnlockReason {
+	reason := &UnlockReason{
+		Method:  UnlockMethodRecoveryKey,
+		KeyName: keyslotName}
+	for _, e := range keyErrors {
+		reason.KeyErrors = append(reason.KeyErrors, UnlockReasonKeyError{
+			KeyName: e.name,
+			Error:   e.err.Error()})
+	}
+	return reason
+}
+
+func addUnlockReasonToKeyring(reason *UnlockReason, devicePath string, keyring *keyringConfig) {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot serialize unlock reason: %v\n", err)
+		return
+	}
+	if err := keyring.addKey(data, devicePath, keyringPurposeUnlockReason); err != nil {
+		fmt.Fprintf(osStderr, "secboot: Cannot add unlock reason to keyring: %v\n", err)
+	}
+}
+
+// GetUnlockReasonFromKernel retrieves the record of how the encrypted
+// container at the specified path was unlocked. The value of prefix must
+// match the prefix that was supplied via ActivateVolumeOptions during
+// unlocking.
+//
+// If remove is true, the record will be removed from the kernel keyring prior
+// to returning.
+//
+// If no record is found, a ErrKernelKeyNotFound error will be returned.
+func GetUnlockReasonFromKernel(prefix, devicePath string, remove bool) (*UnlockReason, error) {
+	return GetUnlockReasonFromKernelWithOptions(&KernelKeyringOptions{Prefix: prefix}, devicePath, remove)
+}
+
+// GetUnlockReasonFromKernelWithOptions is a variant of
+// GetUnlockReasonFromKernel that retrieves the record from the keyring and
+// with the instance specified by the supplied options.
+func GetUnlockReasonFromKernelWithOptions(options *KernelKeyringOptions, devicePath string, remove bool) (*UnlockReason, error) {
+	data, err := newKeyringConfig(options).getKey(devicePath, keyringPurposeUnlockReason, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	var reason *UnlockReason
+	if err := json.Unmarshal(data, &reason); err != nil {
+		return nil, xerrors.Errorf("cannot decode unlock reason: %w", err)
+	}
+	return reason, nil
+}
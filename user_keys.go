@@ -0,0 +1,284 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+const userKeyslotNamePrefix = "user-"
+
+// ErrNoUserKeys is returned from ActivateVolumeWithUserPassphrase and
+// DeleteLUKS2ContainerUserKeys if the container has no keyslots for the
+// specified user.
+var ErrNoUserKeys = errors.New("no keys for the specified user")
+
+// LUKS2UserKeyOptions provides options to AddLUKS2ContainerUserKey.
+type LUKS2UserKeyOptions struct {
+	// KeyslotName is the name of the keyslot to create. If empty, the
+	// name "user-<user>" will be used.
+	KeyslotName string
+
+	// KDFOptions specifies the KDF used to derive the keyslot key from
+	// the passphrase, and must be either *Argon2Options or *PBKDF2Options.
+	// If nil, argon2id is used with cost parameters benchmarked by
+	// cryptsetup.
+	KDFOptions KDFOptions
+
+	// Metadata is optional metadata to store with the keyslot, such
+	// as a display name.
+	Metadata map[string]string
+}
+
+// LUKS2UserKey describes a keyslot that was created with
+// AddLUKS2ContainerUserKey.
+type LUKS2UserKey struct {
+	KeyslotName string
+	User        string
+	Metadata    map[string]string
+}
+
+func keyslotKDFOptions(options KDFOptions) (*luks2.KDFOptions, error) {
+	switch o := options.(type) {
+	case nil:
+		return &luks2.KDFOptions{Type: luks2.KDFTypeArgon2id}, nil
+	case *Argon2Options:
+		out := &luks2.KDFOptions{
+			Type:            luks2.KDFTypeArgon2id,
+			TargetDuration:  o.TargetDuration,
+			MemoryKiB:       o.MemoryKiB,
+			ForceIterations: o.ForceIterations,
+			Parallel:        o.Parallel}
+		switch o.Mode {
+		case Argon2Default, Argon2id:
+			// ok
+		case Argon2i:
+			out.Type = luks2.KDFTypeArgon2i
+		default:
+			return nil, errors.New("invalid argon2 mode")
+		}
+		return out, nil
+	case *PBKDF2Options:
+		out := &luks2.KDFOptions{
+			Type:            luks2.KDFTypePBKDF2,
+			TargetDuration:  o.TargetDuration,
+			ForceIterations: o.ForceIterations}
+		switch o.HashAlg {
+		case crypto.Hash(0):
+			// use the cryptsetup default
+		case crypto.SHA1:
+			out.Hash = luks2.HashSHA1
+		case crypto.SHA224:
+			out.Hash = luks2.HashSHA224
+		case crypto.SHA256:
+			out.Hash = luks2.HashSHA256
+		case crypto.SHA384:
+			out.Hash = luks2.HashSHA384
+		case crypto.SHA512:
+			out.Hash = luks2.HashSHA512
+		default:
+			return nil, fmt.Errorf("invalid pbkdf2 digest algorithm %v", o.HashAlg)
+		}
+		return out, nil
+	default:
+		return nil, errors.New("unsupported KDF options")
+	}
+}
+
+// AddLUKS2ContainerUserKey creates a keyslot on the LUKS2 container at the
+// specified path that is protected directly by the supplied passphrase and
+// belongs to the specified user. This allows each user of a shared machine
+// to be given their own credentials for unlocking the container without
+// having to share the recovery key. A user can have more than one keyslot,
+// as long as each has a different name.
+//
+// The passphrase is checked against the policy configured with
+// SetPassphrasePolicy. The KDF used to protect the keyslot can be
+// customized with the KDFOptions field of options, and arbitrary metadata
+// can be stored alongside it with the Metadata field.
+//
+// If a keyslot with the name already exists, an error will be returned.
+//
+// In order to perform this action, an existing key must be supplied.
+func AddLUKS2ContainerUserKey(devicePath, user string, existingKey DiskUnlockKey, passphrase string, options *LUKS2UserKeyOptions) error {
+	if user == "" {
+		return errors.New("no user specified")
+	}
+	if options == nil {
+		options = new(LUKS2UserKeyOptions)
+	}
+
+	if err := CheckPassphrase(passphrase); err != nil {
+		return err
+	}
+
+	kdfOptions, err := keyslotKDFOptions(options.KDFOptions)
+	if err != nil {
+		return xerrors.Errorf("invalid KDF options: %w", err)
+	}
+
+	keyslotName := options.KeyslotName
+	if keyslotName == "" {
+		keyslotName = userKeyslotNamePrefix + user
+	}
+
+	return addLUKS2ContainerKey(devicePath, keyslotName, luks2.AnySlot, existingKey, []byte(passphrase), kdfOptions, func(base *luksview.TokenBase) luks2.Token {
+		return &luksview.UserToken{
+			TokenBase: *base,
+			User:      user,
+			Metadata:  options.Metadata}
+	}, luks2.SlotPriorityNormal)
+}
+
+func userTokens(view *luksview.View) (tokens []*luksview.UserToken) {
+	for _, name := range view.TokenNames() {
+		token, _, _ := view.TokenByName(name)
+		if t, ok := token.(*luksview.UserToken); ok {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// ListLUKS2ContainerUserKeys lists the keyslots on the specified LUKS2
+// container that were created with AddLUKS2ContainerUserKey.
+func ListLUKS2ContainerUserKeys(devicePath string) ([]*LUKS2UserKey, error) {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	var keys []*LUKS2UserKey
+	for _, t := range userTokens(view) {
+		keys = append(keys, &LUKS2UserKey{
+			KeyslotName: t.Name(),
+			User:        t.User,
+			Metadata:    t.Metadata})
+	}
+	return keys, nil
+}
+
+// DeleteLUKS2ContainerUserKeys deletes all of the keyslots that belong to
+// the specified user from the LUKS2 container at the specified path. A
+// single keyslot can be deleted with DeleteLUKS2ContainerKey. If the user
+// has no keyslots, ErrNoUserKeys will be returned.
+func DeleteLUKS2ContainerUserKeys(devicePath, user string) error {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	var names []string
+	for _, t := range userTokens(view) {
+		if t.User == user {
+			names = append(names, t.Name())
+		}
+	}
+	if len(names) == 0 {
+		return ErrNoUserKeys
+	}
+
+	for _, name := range names {
+		if err := DeleteLUKS2ContainerKey(devicePath, name); err != nil {
+			return xerrors.Errorf("cannot delete keyslot %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ActivateVolumeWithUserPassphrase attempts to activate the LUKS encrypted
+// volume at sourceDevicePath and create a mapping with the name volumeName,
+// using the supplied passphrase with the keyslots that belong to the
+// specified user. If the container has no keyslots for the user,
+// ErrNoUserKeys will be returned.
+//
+// The Deadline, DeviceTimeout, ProgressReporter and Keyring* fields of
+// options are honoured. The other fields are ignored. If options is nil,
+// default options are used.
+//
+// Unlike the other activation functions, the key used to unlock the volume is
+// not added to the kernel keyring, as it is the user's passphrase. Only the
+// unlock reason is added.
+func ActivateVolumeWithUserPassphrase(volumeName, sourceDevicePath, user, passphrase string, options *ActivateVolumeOptions) error {
+	if options == nil {
+		var defaultOptions ActivateVolumeOptions
+		options = &defaultOptions
+	}
+
+	release, err := reserveResource(ResourceParallelActivations, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	progress := newActivationProgress(volumeName, sourceDevicePath, options)
+	if err := progress.waitForDevice(options.DeviceTimeout); err != nil {
+		return err
+	}
+
+	view, err := newLUKSView(sourceDevicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	var slots []int
+	for _, t := range userTokens(view) {
+		if t.User != user || len(t.Keyslots()) == 0 {
+			continue
+		}
+		slots = append(slots, t.Keyslots()[0])
+	}
+	if len(slots) == 0 {
+		return ErrNoUserKeys
+	}
+
+	if err := progress.begin(ActivationStageActivate); err != nil {
+		return err
+	}
+
+	key := []byte(passphrase)
+	for _, slot := range slots {
+		err = activateVolume(volumeName, sourceDevicePath, key, slot)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
+	}
+
+	reason := &UnlockReason{Method: UnlockMethodUserPassphrase, User: user}
+	keyring := options.keyringConfig(view)
+	addUnlockReasonToKeyring(reason, sourceDevicePath, keyring)
+	if keyring.deviceUUID != "" {
+		addUnlockReasonToKeyring(reason, KeyringDeviceForUUID(keyring.deviceUUID), keyring)
+	}
+	appendActivationReport(options.ActivationReportLog, volumeName, sourceDevicePath, reason)
+
+	return nil
+}
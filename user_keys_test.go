@@ -0,0 +1,206 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2024 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luksview"
+)
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKey(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", nil), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypeArgon2id}, Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+
+	dev := s.luks2.devices["/dev/sda1"]
+	c.Check(dev.keyslots[1], DeepEquals, []byte("correct horse battery staple"))
+
+	token, _, exists := mockTokenByName(c, dev, "user-alice")
+	c.Assert(exists, Equals, true)
+	c.Check(token, DeepEquals, &luksview.UserToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "user-alice"},
+		User: "alice"})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKeyWithOptions(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+
+	options := &LUKS2UserKeyOptions{
+		KeyslotName: "bob-laptop",
+		KDFOptions:  &PBKDF2Options{TargetDuration: 2 * time.Second, HashAlg: crypto.SHA512},
+		Metadata:    map[string]string{"display-name": "Bob"}}
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", options), IsNil)
+	c.Check(s.luks2.operations[1], Equals, fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{
+		KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, TargetDuration: 2 * time.Second, Hash: luks2.HashSHA512},
+		Slot:       1}, ")"))
+
+	token, _, exists := mockTokenByName(c, s.luks2.devices["/dev/sda1"], "bob-laptop")
+	c.Assert(exists, Equals, true)
+	c.Check(token, DeepEquals, &luksview.UserToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "bob-laptop"},
+		User:     "bob",
+		Metadata: map[string]string{"display-name": "Bob"}})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKeyArgon2i(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+
+	options := &LUKS2UserKeyOptions{
+		KDFOptions: &Argon2Options{Mode: Argon2i, MemoryKiB: 65536, ForceIterations: 4, Parallel: 2}}
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", options), IsNil)
+	c.Check(s.luks2.operations[1], Equals, fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{
+		KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypeArgon2i, MemoryKiB: 65536, ForceIterations: 4, Parallel: 2},
+		Slot:       1}, ")"))
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKeyNoUser(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "", existingKey, "correct horse battery staple", nil), ErrorMatches, `no user specified`)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKeyPassphrasePolicy(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+
+	orig := SetPassphrasePolicy(&PassphrasePolicy{MinLength: 20})
+	defer SetPassphrasePolicy(orig)
+
+	err := AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "too short", nil)
+	c.Check(err, ErrorMatches, `passphrase does not meet the policy requirements: too short \(9 characters, at least 20 required\)`)
+	c.Check(err, FitsTypeOf, &PassphrasePolicyError{})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUserKeyNameInUse(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", nil), IsNil)
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "another passphrase", nil), ErrorMatches, `the specified name is already in use`)
+}
+
+func (s *cryptSuite) TestListAndDeleteLUKS2ContainerUserKeys(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", nil), IsNil)
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", &LUKS2UserKeyOptions{Metadata: map[string]string{"display-name": "Bob"}}), IsNil)
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "another passphrase", &LUKS2UserKeyOptions{KeyslotName: "user-alice-2"}), IsNil)
+
+	keys, err := ListLUKS2ContainerUserKeys("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*LUKS2UserKey{
+		{KeyslotName: "user-alice", User: "alice"},
+		{KeyslotName: "user-alice-2", User: "alice"},
+		{KeyslotName: "user-bob", User: "bob", Metadata: map[string]string{"display-name": "Bob"}},
+	})
+
+	// User keys aren't platform protected keys.
+	names, err := ListLUKS2ContainerUnlockKeyNames("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+
+	c.Check(DeleteLUKS2ContainerUserKeys("/dev/sda1", "alice"), IsNil)
+	keys, err = ListLUKS2ContainerUserKeys("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*LUKS2UserKey{
+		{KeyslotName: "user-bob", User: "bob", Metadata: map[string]string{"display-name": "Bob"}},
+	})
+	c.Check(s.luks2.devices["/dev/sda1"].keyslots, HasLen, 2)
+
+	c.Check(DeleteLUKS2ContainerUserKeys("/dev/sda1", "alice"), Equals, ErrNoUserKeys)
+}
+
+func (s *cryptSuite) TestRenameLUKS2ContainerUserKey(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", &LUKS2UserKeyOptions{Metadata: map[string]string{"display-name": "Bob"}}), IsNil)
+
+	c.Check(RenameLUKS2ContainerKey("/dev/sda1", "user-bob", "bob-laptop"), IsNil)
+
+	keys, err := ListLUKS2ContainerUserKeys("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*LUKS2UserKey{
+		{KeyslotName: "bob-laptop", User: "bob", Metadata: map[string]string{"display-name": "Bob"}},
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithUserPassphrase(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", nil), IsNil)
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", nil), IsNil)
+	s.luks2.operations = nil
+
+	c.Check(ActivateVolumeWithUserPassphrase("data", "/dev/sda1", "bob", "hunter2 hunter2", &ActivateVolumeOptions{}), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,2)",
+	})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithUserPassphraseNilOptions(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", nil), IsNil)
+
+	c.Check(ActivateVolumeWithUserPassphrase("data", "/dev/sda1", "bob", "hunter2 hunter2", nil), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithUserPassphraseDoesNotAddKeyToKeyring(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", nil), IsNil)
+
+	c.Check(ActivateVolumeWithUserPassphrase("data", "/dev/sda1", "bob", "hunter2 hunter2", &ActivateVolumeOptions{}), IsNil)
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	// This should be done last because it may fail in some circumstances.
+	reason := s.checkUnlockReasonInKeyring(c, "", "/dev/sda1", UnlockMethodUserPassphrase)
+	c.Check(reason.User, Equals, "bob")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithUserPassphraseWrongUser(c *C) {
+	existingKey := s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "alice", existingKey, "correct horse battery staple", nil), IsNil)
+	c.Check(AddLUKS2ContainerUserKey("/dev/sda1", "bob", existingKey, "hunter2 hunter2", nil), IsNil)
+
+	// Bob's passphrase can't be used to unlock alice's keyslot.
+	err := ActivateVolumeWithUserPassphrase("data", "/dev/sda1", "alice", "hunter2 hunter2", &ActivateVolumeOptions{})
+	c.Check(err, ErrorMatches, `cannot activate volume: systemd-cryptsetup failed with: exit status 1`)
+	c.Check(s.luks2.activated, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithUserPassphraseNoKeys(c *C) {
+	s.addMockContainerWithDefaultKey(c, "/dev/sda1")
+	c.Check(ActivateVolumeWithUserPassphrase("data", "/dev/sda1", "alice", "correct horse battery staple", &ActivateVolumeOptions{}), Equals, ErrNoUserKeys)
+}